@@ -16,16 +16,22 @@ package main
 
 import (
     "context"
+    "encoding/json"
     "fmt"
     "os"
     "os/signal"
     "runtime"
     "syscall"
+    "time"
 
     "github.com/spf13/cobra"
+    "github.com/tobogganing/clients/native/internal/auth"
     "github.com/tobogganing/clients/native/internal/client"
     "github.com/tobogganing/clients/native/internal/config"
+    "github.com/tobogganing/clients/native/internal/service"
     "github.com/tobogganing/clients/native/internal/tray"
+    "github.com/tobogganing/clients/native/internal/vpn"
+    "github.com/tobogganing/libs/version"
 )
 
 const (
@@ -34,11 +40,9 @@ const (
     osLinux   = "linux"
 )
 
-var (
-    version   = "1.1.0"
-    buildTime = "unknown"
-    gitCommit = "unknown"
-)
+// buildInfo is reported by --version; release builds set the version,
+// commit and build time in libs/version with -ldflags
+var buildInfo = client.BuildInfo("client")
 
 func main() {
     var rootCmd = &cobra.Command{
@@ -49,13 +53,14 @@ with WireGuard VPN and dual authentication (Certificate + JWT/SSO).
 
 Supports:
 - macOS Universal (Intel + Apple Silicon)
-- Windows (x64)  
+- Windows (x64, ARM64)
 - Linux (x64, ARM64)`,
-        Version: fmt.Sprintf("%s (build %s, commit %s)", version, buildTime, gitCommit),
     }
+    setVersion(rootCmd, buildInfo)
 
     // Global flags
     rootCmd.PersistentFlags().StringP("config", "c", "", "Configuration file path")
+    rootCmd.PersistentFlags().String("profile", "", "Profile of the configuration file to apply (default $SASEWADDLE_PROFILE)")
     rootCmd.PersistentFlags().StringP("manager-url", "m", "", "Manager Service URL")
     rootCmd.PersistentFlags().StringP("log-level", "l", "info", "Log level (debug, info, warn, error)")
     rootCmd.PersistentFlags().Bool("headless", false, "Run in headless mode (no GUI)")
@@ -71,6 +76,53 @@ Supports:
     connectCmd.Flags().StringP("api-key", "k", "", "Client API key for authentication")
     connectCmd.Flags().StringP("client-name", "n", "", "Client name (defaults to hostname)")
     connectCmd.Flags().Bool("auto-connect", false, "Automatically connect on startup")
+    connectCmd.Flags().String("region", "", "Preferred egress region for internet traffic (e.g. eu-west)")
+    connectCmd.Flags().String("cluster", "", "Cluster to connect to, or auto for the lowest latency")
+    connectCmd.Flags().String("bootstrap-output", "", "Emit the enrollment for provisioning tools once connected (json)")
+    connectCmd.Flags().String("bootstrap-file", "", "Write the enrollment to this file instead of stdout")
+
+    // Login command
+    var loginCmd = &cobra.Command{
+        Use:   "login",
+        Short: "Sign in with SSO using a code",
+        Long: `Sign in to a headend's identity provider without a local browser.
+A short code and URL are shown; open the URL on any device, enter the code,
+and the client picks up the session once sign-in completes.`,
+        RunE: runLogin,
+    }
+
+    loginCmd.Flags().String("headend", "", "Headend URL to sign in through (e.g. https://headend.example.com)")
+    _ = loginCmd.MarkFlagRequired("headend")
+
+    // Regions command
+    var regionsCmd = &cobra.Command{
+        Use:   "regions",
+        Short: "List egress regions",
+        Long:  "List the egress regions available from the Manager and whether policy permits them",
+        RunE:  runRegions,
+    }
+
+    // Clusters command
+    var clustersCmd = &cobra.Command{
+        Use:   "clusters",
+        Short: "List clusters",
+        Long:  "List the clusters available from the Manager with their latency, and whether policy permits them",
+        RunE:  runClusters,
+    }
+
+    // Access command
+    var accessCmd = &cobra.Command{
+        Use:   "access",
+        Short: "Show what you can access",
+        Long: `Show a summary of your effective firewall policy: the destinations you
+can reach, the ones you can't, and whether anything else is allowed.
+Uses the session saved by the login command.`,
+        RunE: runAccess,
+    }
+
+    accessCmd.Flags().String("headend", "", "Headend URL to ask (e.g. https://headend.example.com)")
+    accessCmd.Flags().Bool("json", false, "Print the summary as JSON")
+    _ = accessCmd.MarkFlagRequired("headend")
 
     // Disconnect command
     var disconnectCmd = &cobra.Command{
@@ -130,8 +182,45 @@ Supports:
     // Add service subcommands
     serviceCmd.AddCommand(installServiceCmd, uninstallServiceCmd, startServiceCmd, stopServiceCmd)
 
+    // Config command
+    var configCmd = &cobra.Command{
+        Use:   "config",
+        Short: "Configuration file commands",
+    }
+
+    var migrateConfigCmd = &cobra.Command{
+        Use:   "migrate [file]",
+        Short: "Convert a configuration file to the current format",
+        Long: `Convert a flat version 1 configuration file to the sectioned version 2
+format and print it, or replace the file with --write, keeping the original
+as <file>.v1.bak. The file defaults to --config, then the default location.`,
+        Args: cobra.MaximumNArgs(1),
+        RunE: runConfigMigrate,
+    }
+    migrateConfigCmd.Flags().Bool("write", false, "Replace the file instead of printing the result")
+
+    var encryptConfigCmd = &cobra.Command{
+        Use:   "encrypt [file]",
+        Short: "Encrypt a configuration file with a key from the OS keystore",
+        Long: `Encrypt a configuration file at rest with a key kept in the OS keystore
+(the macOS keychain, the Secret Service on Linux, DPAPI on Windows). The client
+decrypts it when loading. Set storage.encrypt_at_rest to also encrypt the
+WireGuard configuration and session files the client writes.`,
+        Args: cobra.MaximumNArgs(1),
+        RunE: runConfigEncrypt,
+    }
+
+    var decryptConfigCmd = &cobra.Command{
+        Use:   "decrypt [file]",
+        Short: "Decrypt a configuration file encrypted at rest",
+        Args:  cobra.MaximumNArgs(1),
+        RunE:  runConfigDecrypt,
+    }
+
+    configCmd.AddCommand(migrateConfigCmd, encryptConfigCmd, decryptConfigCmd)
+
     // Add all commands
-    rootCmd.AddCommand(connectCmd, disconnectCmd, statusCmd, guiCmd, serviceCmd)
+    rootCmd.AddCommand(connectCmd, disconnectCmd, statusCmd, regionsCmd, clustersCmd, accessCmd, loginCmd, guiCmd, serviceCmd, configCmd)
 
     if err := rootCmd.Execute(); err != nil {
         fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -145,6 +234,22 @@ func runConnect(cmd *cobra.Command, args []string) error {
         return fmt.Errorf("failed to load config: %w", err)
     }
 
+    if region, _ := cmd.Flags().GetString("region"); region != "" {
+        cfg.EgressRegion = region
+    }
+    if cluster, _ := cmd.Flags().GetString("cluster"); cluster != "" {
+        cfg.Cluster = cluster
+    }
+    if output, _ := cmd.Flags().GetString("bootstrap-output"); output != "" {
+        cfg.BootstrapOutput = output
+    }
+    if file, _ := cmd.Flags().GetString("bootstrap-file"); file != "" {
+        cfg.BootstrapFile = file
+    }
+    if err := cfg.Validate(); err != nil {
+        return fmt.Errorf("invalid configuration: %w", err)
+    }
+
     client, err := client.New(cfg)
     if err != nil {
         return fmt.Errorf("failed to create client: %w", err)
@@ -163,7 +268,8 @@ func runConnect(cmd *cobra.Command, args []string) error {
         cancel()
     }()
 
-    return client.Connect(ctx)
+    // Under the Windows service manager, stopping the service disconnects
+    return service.Run(ctx, client.Connect)
 }
 
 func runDisconnect(cmd *cobra.Command, args []string) error {
@@ -203,14 +309,208 @@ func runStatus(cmd *cobra.Command, args []string) error {
     fmt.Printf("Client ID: %s\n", status.ClientID)
     fmt.Printf("WireGuard IP: %s\n", status.WireGuardIP)
     fmt.Printf("Headend URL: %s\n", status.HeadendURL)
+    if status.Cluster != "" {
+        fmt.Printf("Cluster: %s\n", status.Cluster)
+    }
+    if status.EgressRegion != "" {
+        fmt.Printf("Egress Region: %s\n", status.EgressRegion)
+    }
     fmt.Printf("Connected Since: %s\n", status.ConnectedSince.Format("2006-01-02 15:04:05"))
     fmt.Printf("Bytes Sent: %d\n", status.BytesSent)
     fmt.Printf("Bytes Received: %d\n", status.BytesReceived)
     fmt.Printf("Last Handshake: %s\n", status.LastHandshake.Format("2006-01-02 15:04:05"))
+    if status.DNSLeakDetail != "" {
+        fmt.Printf("DNS Leak Protection: %s (%s)\n", status.DNSLeakStatus, status.DNSLeakDetail)
+    } else {
+        fmt.Printf("DNS Leak Protection: %s\n", status.DNSLeakStatus)
+    }
+    fmt.Printf("WebRTC Protection: %s\n", status.WebRTCProtection)
+    if status.BypassVersion != "" {
+        fmt.Printf("SaaS Bypass: %s (%d direct routes)\n", status.BypassVersion, status.BypassRoutes)
+    }
+    fmt.Printf("Power Profile: %s\n", status.PowerProfile)
+    if status.FeatureFlagsVersion != "" {
+        fmt.Printf("Feature Flags: %s %v\n", status.FeatureFlagsVersion, status.FeatureFlags)
+    }
+    if status.Auth != nil {
+        fmt.Printf("Session: %s", status.Auth.State)
+        if !status.Auth.ExpiresAt.IsZero() {
+            fmt.Printf(" (expires %s)", status.Auth.ExpiresAt.Format("2006-01-02 15:04:05"))
+        }
+        fmt.Printf("\n")
+        if status.Auth.Failures > 0 {
+            fmt.Printf("Session Refresh: %d failures, last: %s\n", status.Auth.Failures, status.Auth.LastError)
+        }
+        if status.Auth.Reregistrations > 0 {
+            fmt.Printf("Re-registrations: %d\n", status.Auth.Reregistrations)
+        }
+    }
+    if status.LastTamper != nil {
+        fmt.Printf("Route Tampering: %d repairs, last %s (%s)\n", status.RouteTampers,
+            status.LastTamper.At.Format("2006-01-02 15:04:05"), status.LastTamper.Detail)
+    }
+    if len(status.RecentDenials) > 0 {
+        fmt.Printf("\nRecent Denials\n")
+        fmt.Printf("--------------\n")
+        for i := len(status.RecentDenials) - 1; i >= 0; i-- {
+            denial := status.RecentDenials[i]
+            fmt.Printf("%s  %s (%s", denial.At.Format("2006-01-02 15:04:05"), denial.Target, denial.Reason)
+            if denial.Category != "" {
+                fmt.Printf(", %s", denial.Category)
+            }
+            if denial.PolicyID != "" {
+                fmt.Printf(", policy %s", denial.PolicyID)
+            }
+            fmt.Printf(")\n")
+            if denial.Contact != "" {
+                fmt.Printf("    Contact: %s\n", denial.Contact)
+            }
+        }
+    }
+
+    return nil
+}
+
+func runLogin(cmd *cobra.Command, args []string) error {
+    cfg, err := loadConfig(cmd)
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    headendURL, _ := cmd.Flags().GetString("headend")
+
+    authManager, err := auth.New(cfg.ManagerURL)
+    if err != nil {
+        return fmt.Errorf("failed to create auth manager: %w", err)
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    device, err := authManager.StartDeviceLogin(ctx, headendURL)
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("To sign in, open %s and enter the code: %s\n", device.VerificationURI, device.UserCode)
+    if device.VerificationURIComplete != "" {
+        fmt.Printf("Or open %s to skip entering the code.\n", device.VerificationURIComplete)
+    }
+    fmt.Println("Waiting for sign-in to complete...")
+
+    token, err := authManager.WaitForDeviceToken(ctx, headendURL, device)
+    if err != nil {
+        return err
+    }
+
+    data, err := json.MarshalIndent(token, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode token: %w", err)
+    }
+    if err := cfg.WriteFile(cfg.GetSSOTokenPath(), data); err != nil {
+        return fmt.Errorf("failed to save token: %w", err)
+    }
+
+    fmt.Printf("Signed in. Session valid until %s\n", token.ExpiresAt.Format("2006-01-02 15:04:05"))
+    return nil
+}
+
+func runRegions(cmd *cobra.Command, args []string) error {
+    cfg, err := loadConfig(cmd)
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+
+    client, err := client.New(cfg)
+    if err != nil {
+        return fmt.Errorf("failed to create client: %w", err)
+    }
+
+    regions, err := client.ListRegions()
+    if err != nil {
+        return fmt.Errorf("failed to list regions: %w", err)
+    }
+
+    fmt.Printf("%-16s %-24s %-8s %s\n", "REGION", "NAME", "COUNTRY", "ALLOWED")
+    for _, region := range regions {
+        marker := ""
+        if region.Name == cfg.EgressRegion {
+            marker = " (preferred)"
+        }
+        fmt.Printf("%-16s %-24s %-8s %v%s\n", region.Name, region.DisplayName, region.Country, region.Allowed, marker)
+    }
 
     return nil
 }
 
+func runClusters(cmd *cobra.Command, args []string) error {
+    cfg, err := loadConfig(cmd)
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+
+    c, err := client.New(cfg)
+    if err != nil {
+        return fmt.Errorf("failed to create client: %w", err)
+    }
+
+    clusters, current, err := c.ListClusters()
+    if err != nil {
+        return fmt.Errorf("failed to list clusters: %w", err)
+    }
+    client.MeasureClusters(clusters)
+
+    fmt.Printf("%-20s %-24s %-12s %-10s %s\n", "CLUSTER", "NAME", "REGION", "LATENCY", "ALLOWED")
+    for _, cluster := range clusters {
+        latency := "-"
+        if cluster.Latency > 0 {
+            latency = cluster.Latency.Round(time.Millisecond).String()
+        }
+        marker := ""
+        switch cluster.ID {
+        case cfg.Cluster:
+            marker = " (preferred)"
+        case current:
+            marker = " (assigned)"
+        }
+        fmt.Printf("%-20s %-24s %-12s %-10s %v%s\n", cluster.ID, cluster.Name, cluster.Region, latency, cluster.Allowed, marker)
+    }
+
+    return nil
+}
+
+func runAccess(cmd *cobra.Command, args []string) error {
+    cfg, err := loadConfig(cmd)
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    headendURL, _ := cmd.Flags().GetString("headend")
+    asJSON, _ := cmd.Flags().GetBool("json")
+
+    client, err := client.New(cfg)
+    if err != nil {
+        return fmt.Errorf("failed to create client: %w", err)
+    }
+    if err := client.UseSSOSession(headendURL); err != nil {
+        return err
+    }
+
+    summary, err := client.AccessSummary()
+    if err != nil {
+        return fmt.Errorf("failed to get access summary: %w", err)
+    }
+
+    if asJSON {
+        data, err := json.MarshalIndent(summary, "", "  ")
+        if err != nil {
+            return fmt.Errorf("failed to encode access summary: %w", err)
+        }
+        fmt.Println(string(data))
+        return nil
+    }
+    summary.Format(os.Stdout)
+    return nil
+}
+
 func runGUI(cmd *cobra.Command, args []string) error {
     cfg, err := loadConfig(cmd)
     if err != nil {
@@ -225,10 +525,21 @@ func runGUI(cmd *cobra.Command, args []string) error {
 func runServiceInstall(cmd *cobra.Command, args []string) error {
     // Implementation depends on platform
     switch runtime.GOOS {
-    case osWindows:
-        return installWindowsService()
-    case osDarwin:
-        return installMacOSService()
+    case osWindows, osDarwin:
+        spec, err := serviceSpec(cmd)
+        if err != nil {
+            return err
+        }
+        // Catch a missing or mismatched wintun.dll now rather than when
+        // the service fails at boot
+        if err := vpn.CheckPlatform(); err != nil {
+            return err
+        }
+        if err := service.Install(spec); err != nil {
+            return err
+        }
+        fmt.Printf("Installed service %s running %s\n", spec.DisplayName, spec.Executable)
+        return nil
     case osLinux:
         return installLinuxService()
     default:
@@ -238,10 +549,12 @@ func runServiceInstall(cmd *cobra.Command, args []string) error {
 
 func runServiceUninstall(cmd *cobra.Command, args []string) error {
     switch runtime.GOOS {
-    case osWindows:
-        return uninstallWindowsService()
-    case osDarwin:
-        return uninstallMacOSService()
+    case osWindows, osDarwin:
+        spec, err := serviceSpec(cmd)
+        if err != nil {
+            return err
+        }
+        return service.Uninstall(spec)
     case osLinux:
         return uninstallLinuxService()
     default:
@@ -251,10 +564,12 @@ func runServiceUninstall(cmd *cobra.Command, args []string) error {
 
 func runServiceStart(cmd *cobra.Command, args []string) error {
     switch runtime.GOOS {
-    case osWindows:
-        return startWindowsService()
-    case osDarwin:
-        return startMacOSService()
+    case osWindows, osDarwin:
+        spec, err := serviceSpec(cmd)
+        if err != nil {
+            return err
+        }
+        return service.Start(spec)
     case osLinux:
         return startLinuxService()
     default:
@@ -264,10 +579,12 @@ func runServiceStart(cmd *cobra.Command, args []string) error {
 
 func runServiceStop(cmd *cobra.Command, args []string) error {
     switch runtime.GOOS {
-    case osWindows:
-        return stopWindowsService()
-    case osDarwin:
-        return stopMacOSService()
+    case osWindows, osDarwin:
+        spec, err := serviceSpec(cmd)
+        if err != nil {
+            return err
+        }
+        return service.Stop(spec)
     case osLinux:
         return stopLinuxService()
     default:
@@ -275,14 +592,122 @@ func runServiceStop(cmd *cobra.Command, args []string) error {
     }
 }
 
+// configFileArg returns the configuration file a config subcommand works
+// on: its argument, --config, or the default location
+func configFileArg(cmd *cobra.Command, args []string) string {
+    if len(args) > 0 {
+        return args[0]
+    }
+    if configFile, _ := cmd.Flags().GetString("config"); configFile != "" {
+        return configFile
+    }
+    return config.GetDefaultConfigFile()
+}
+
+func runConfigMigrate(cmd *cobra.Command, args []string) error {
+    configFile := configFileArg(cmd, args)
+    write, _ := cmd.Flags().GetBool("write")
+    
+    data, dropped, err := config.Migrate(configFile)
+    if err != nil {
+        return err
+    }
+    for _, key := range dropped {
+        fmt.Fprintf(os.Stderr, "Warning: dropping unknown setting %q\n", key)
+    }
+    
+    if !write {
+        _, err := os.Stdout.Write(data)
+        return err
+    }
+    
+    original, err := os.ReadFile(configFile)
+    if err != nil {
+        return err
+    }
+    // An encrypted file stays encrypted
+    if config.IsSealed(original) {
+        if data, err = config.Seal(data); err != nil {
+            return err
+        }
+    }
+    backup := configFile + ".v1.bak"
+    if err := os.WriteFile(backup, original, 0600); err != nil {
+        return fmt.Errorf("failed to back up %s: %w", configFile, err)
+    }
+    if err := os.WriteFile(configFile, data, 0600); err != nil {
+        return fmt.Errorf("failed to write %s: %w", configFile, err)
+    }
+    
+    fmt.Printf("Migrated %s to version %d (original saved as %s)\n", configFile, config.CurrentVersion, backup)
+    return nil
+}
+
+func runConfigEncrypt(cmd *cobra.Command, args []string) error {
+    configFile := configFileArg(cmd, args)
+    data, err := os.ReadFile(configFile)
+    if err != nil {
+        return err
+    }
+    if config.IsSealed(data) {
+        return fmt.Errorf("%s is already encrypted", configFile)
+    }
+    
+    sealed, err := config.Seal(data)
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(configFile, sealed, 0600); err != nil {
+        return fmt.Errorf("failed to write %s: %w", configFile, err)
+    }
+    
+    fmt.Printf("Encrypted %s\n", configFile)
+    return nil
+}
+
+func runConfigDecrypt(cmd *cobra.Command, args []string) error {
+    configFile := configFileArg(cmd, args)
+    data, err := os.ReadFile(configFile)
+    if err != nil {
+        return err
+    }
+    if !config.IsSealed(data) {
+        return fmt.Errorf("%s is not encrypted", configFile)
+    }
+    
+    plaintext, err := config.Unseal(data)
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(configFile, plaintext, 0600); err != nil {
+        return fmt.Errorf("failed to write %s: %w", configFile, err)
+    }
+    
+    fmt.Printf("Decrypted %s\n", configFile)
+    return nil
+}
+
+// serviceSpec describes the service running this executable with the
+// configuration file given on the command line
+func serviceSpec(cmd *cobra.Command) (service.Spec, error) {
+    executable, err := os.Executable()
+    if err != nil {
+        return service.Spec{}, fmt.Errorf("failed to locate the client executable: %w", err)
+    }
+    configFile, _ := cmd.Flags().GetString("config")
+    return service.DefaultSpec(executable, configFile)
+}
+
 func loadConfig(cmd *cobra.Command) (*config.Config, error) {
     configFile, _ := cmd.Flags().GetString("config")
     managerURL, _ := cmd.Flags().GetString("manager-url")
     logLevel, _ := cmd.Flags().GetString("log-level")
+    profile, _ := cmd.Flags().GetString("profile")
     
     cfg := &config.Config{
         ManagerURL: managerURL,
         LogLevel:   logLevel,
+        Profile:    profile,
     }
     
     if configFile != "" {
@@ -294,48 +719,8 @@ func loadConfig(cmd *cobra.Command) (*config.Config, error) {
     return cfg, cfg.Validate()
 }
 
-// Platform-specific service implementations would go here
-// For brevity, these are placeholder functions
-
-func installWindowsService() error {
-    fmt.Println("Installing Windows service...")
-    return fmt.Errorf("Windows service installation not implemented yet")
-}
-
-func uninstallWindowsService() error {
-    fmt.Println("Uninstalling Windows service...")  
-    return fmt.Errorf("Windows service uninstallation not implemented yet")
-}
-
-func startWindowsService() error {
-    fmt.Println("Starting Windows service...")
-    return fmt.Errorf("Windows service control not implemented yet")
-}
-
-func stopWindowsService() error {
-    fmt.Println("Stopping Windows service...")
-    return fmt.Errorf("Windows service control not implemented yet")
-}
-
-func installMacOSService() error {
-    fmt.Println("Installing macOS service...")
-    return fmt.Errorf("macOS service installation not implemented yet")
-}
-
-func uninstallMacOSService() error {
-    fmt.Println("Uninstalling macOS service...")
-    return fmt.Errorf("macOS service uninstallation not implemented yet")
-}
-
-func startMacOSService() error {
-    fmt.Println("Starting macOS service...")
-    return fmt.Errorf("macOS service control not implemented yet")
-}
-
-func stopMacOSService() error {
-    fmt.Println("Stopping macOS service...")
-    return fmt.Errorf("macOS service control not implemented yet")
-}
+// Windows and macOS services are installed by the service package; Linux
+// installs are left to the distribution's packaging for now
 
 func installLinuxService() error {
     fmt.Println("Installing Linux systemd service...")
@@ -355,4 +740,18 @@ func startLinuxService() error {
 func stopLinuxService() error {
     fmt.Println("Stopping Linux systemd service...")
     return fmt.Errorf("Linux service control not implemented yet")
-}
\ No newline at end of file
+}
+
+// setVersion prints info on --version, as JSON with --version --json
+func setVersion(cmd *cobra.Command, info version.Info) {
+    cmd.Version = info.String()
+    cmd.Flags().Bool("json", false, "With --version, print the build metadata as JSON")
+    cobra.AddTemplateFunc("buildInfo", func(cmd *cobra.Command) string {
+        if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+            data, _ := json.MarshalIndent(info, "", "  ")
+            return string(data)
+        }
+        return cmd.Name() + " version " + cmd.Version
+    })
+    cmd.SetVersionTemplate("{{buildInfo .}}\n")
+}
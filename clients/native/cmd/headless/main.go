@@ -1,53 +1,238 @@
+// Package main implements the SASEWaddle service client.
+//
+// The service client connects workloads - containers, VMs and servers with
+// no one at the keyboard - to internal services through the headend. It has
+// no tray or GUI and never prompts: configuration comes from flags,
+// SASEWADDLE_* environment variables and files, tokens are renewed with the
+// API key, and output can be written as JSON lines for log collectors.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"net/netip"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/tobogganing/clients/native/internal/config"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tobogganing/clients/native/internal/client"
+	"github.com/tobogganing/clients/native/internal/config"
+	"github.com/tobogganing/clients/native/internal/logging"
+	"github.com/tobogganing/libs/version"
 )
 
+// buildInfo is reported by --version; release builds set the version,
+// commit and build time in libs/version with -ldflags
+var buildInfo = client.BuildInfo("client-headless")
+
 func main() {
 	var rootCmd = &cobra.Command{
-		Use:   "sasewaddle-client",
-		Short: "SASEWaddle Native Client",
-		Long:  "A native client for SASEWaddle SASE solution",
-		Run:   runClient,
+		Use:   "sasewaddle-client-headless",
+		Short: "SASEWaddle service client",
+		Long: `SASEWaddle service client connects unattended workloads to the
+SASEWaddle network. Every setting can be given as a flag, as a
+SASEWADDLE_* environment variable (e.g. SASEWADDLE_MANAGER_URL) or in a
+config file; flags take precedence over the environment, which takes
+precedence over the file.
+
+With --bootstrap-output json the client emits its enrollment - client ID,
+WireGuard public key and address, and headend endpoint - as a JSON document
+once connected, for Terraform, Ansible and other provisioning tools. Use
+--bootstrap-file to keep it apart from the log output.`,
+		RunE:          runService,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	setVersion(rootCmd, buildInfo)
+
+	flags := rootCmd.PersistentFlags()
+	flags.StringP("config", "c", "", "Configuration file path")
+	flags.String("profile", "", "Profile of the configuration file to apply (default $SASEWADDLE_PROFILE)")
+	flags.StringP("manager-url", "m", "", "Manager Service URL")
+	flags.StringP("api-key", "k", "", "Client API key (prefer --api-key-file)")
+	flags.String("api-key-file", "", "File containing the client API key, e.g. a mounted secret")
+	flags.StringP("client-name", "n", "", "Client name (defaults to hostname)")
+	flags.String("region", "", "Preferred egress region for internet traffic (e.g. eu-west)")
+	flags.String("cluster", "", "Cluster to connect to, or auto for the lowest latency")
+	flags.StringP("log-level", "l", "info", "Log level (debug, info, warn, error)")
+	flags.String("log-format", "text", "Log format (text, json)")
+	flags.Int("reconnect-interval", 30, "Seconds to wait before reconnecting after a failure")
+	flags.String("bootstrap-output", "", "Emit the enrollment for provisioning tools once connected (json)")
+	flags.String("bootstrap-file", "", "Write the enrollment to this file instead of stdout")
+
+	// Flags override environment variables and the config file
+	for key, flag := range map[string]string{
+		"manager_url":        "manager-url",
+		"api_key":            "api-key",
+		"api_key_file":       "api-key-file",
+		"client_name":        "client-name",
+		"egress_region":      "region",
+		"cluster":            "cluster",
+		"log_level":          "log-level",
+		"log_format":         "log-format",
+		"reconnect_interval": "reconnect-interval",
+		"bootstrap_output":   "bootstrap-output",
+		"bootstrap_file":     "bootstrap-file",
+	} {
+		if err := viper.BindPFlag(key, flags.Lookup(flag)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to bind flag %s: %v\n", flag, err)
+			os.Exit(1)
+		}
 	}
 
-	var configFile string
-	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file path")
+	// Attach command: join one container rather than the host
+	var attachCmd = &cobra.Command{
+		Use:   "attach <container>",
+		Short: "Join a single container to the SASEWaddle network",
+		Long: `Attach a Docker or Podman container to the SASEWaddle network. A WireGuard
+interface is moved into the container's network namespace and only the
+given routes (by default the WireGuard network) are sent through it, so the
+container reaches internal services while the host is unaffected.
+
+Run on the container host with CAP_NET_ADMIN, the host PID namespace and
+access to the container runtime, e.g. as a sidecar with --pid host,
+--network host and the Docker socket mounted. The attachment is renewed if
+the container restarts, and removed when the helper stops.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runAttach,
+	}
+	attachCmd.Flags().String("runtime", "docker", "Container runtime (docker, podman)")
+	attachCmd.Flags().Int("pid", 0, "PID of the container's init process, for runtimes other than Docker and Podman")
+	attachCmd.Flags().String("interface", "sasewaddle0", "Tunnel interface name inside the container")
+	attachCmd.Flags().StringSlice("route", nil, "CIDR to route through the tunnel (repeatable, defaults to the WireGuard network)")
+	rootCmd.AddCommand(attachCmd)
 
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 }
 
-func runClient(cmd *cobra.Command, args []string) {
+func runService(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	restore, err := logging.Redirect(cfg.LogFormat, "sasewaddle-client")
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	fmt.Printf("SASEWaddle service client %s starting (manager %s)\n", buildInfo.Version, cfg.ManagerURL)
+	return connectUntilStopped(ctx, cfg, func(ctx context.Context, c *client.Client) error {
+		return c.Connect(ctx)
+	})
+}
+
+func runAttach(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	target := client.ContainerTarget{Container: args[0]}
+	target.Runtime, _ = cmd.Flags().GetString("runtime")
+	target.PID, _ = cmd.Flags().GetInt("pid")
+	target.Interface, _ = cmd.Flags().GetString("interface")
+	routes, _ := cmd.Flags().GetStringSlice("route")
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %w", route, err)
+		}
+		target.Routes = append(target.Routes, prefix)
+	}
+
+	// Each container registers as its own client
+	if cfg.ClientName == "" {
+		cfg.ClientName = "container-" + target.Container
+	}
+
+	restore, err := logging.Redirect(cfg.LogFormat, "sasewaddle-client")
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	fmt.Printf("SASEWaddle container helper %s attaching %s (manager %s)\n", buildInfo.Version, target.Container, cfg.ManagerURL)
+	return connectUntilStopped(ctx, cfg, func(ctx context.Context, c *client.Client) error {
+		return c.AttachContainer(ctx, target)
+	})
+}
+
+// loadConfig loads and validates the configuration from flags, environment
+// and files
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
 	cfg := config.DefaultConfig()
-	
+	cfg.Profile, _ = cmd.Flags().GetString("profile")
 	configFile, _ := cmd.Flags().GetString("config")
-	if configFile != "" {
-		if err := config.LoadFromFile(cfg, configFile); err != nil {
-			log.Fatalf("Failed to load config: %v", err)
+	if err := config.Load(cfg, configFile); err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Workloads run unattended whatever the config file says
+	cfg.Headless = true
+	cfg.ServiceMode = true
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// connectUntilStopped runs connect with a fresh client until ctx is
+// cancelled, starting over after ReconnectInterval whenever it fails
+func connectUntilStopped(ctx context.Context, cfg *config.Config, connect func(context.Context, *client.Client) error) error {
+	retry := time.Duration(cfg.ReconnectInterval) * time.Second
+
+	for {
+		c, err := client.New(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create client: %w", err)
+		}
+
+		err = connect(ctx, c)
+		if ctx.Err() != nil {
+			fmt.Println("Service client stopped")
+			return nil
 		}
-	} else {
-		if err := config.LoadFromDefaults(cfg); err != nil {
-			log.Fatalf("Failed to load default config: %v", err)
+		if err == nil {
+			err = fmt.Errorf("connection closed")
 		}
-	}
+		fmt.Printf("Connection failed, reconnecting in %s: %v\n", retry, err)
 
-	fmt.Printf("SASEWaddle Client - Headless Mode\n")
-	fmt.Printf("Manager URL: %s\n", cfg.ManagerURL)
-	fmt.Printf("Client Type: %s\n", cfg.ClientType)
-	fmt.Printf("Auto Connect: %v\n", cfg.AutoConnect)
-	
-	if cfg.ManagerURL == "" {
-		fmt.Println("No manager URL configured. Please set SASEWADDLE_MANAGER_URL environment variable or config file.")
-		os.Exit(1)
+		select {
+		case <-ctx.Done():
+			fmt.Println("Service client stopped")
+			return nil
+		case <-time.After(retry):
+		}
 	}
-	
-	fmt.Println("Client would start here...")
-}
\ No newline at end of file
+}
+
+// setVersion prints info on --version, as JSON with --version --json
+func setVersion(cmd *cobra.Command, info version.Info) {
+	cmd.Version = info.String()
+	cmd.Flags().Bool("json", false, "With --version, print the build metadata as JSON")
+	cobra.AddTemplateFunc("buildInfo", func(cmd *cobra.Command) string {
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			data, _ := json.MarshalIndent(info, "", "  ")
+			return string(data)
+		}
+		return cmd.Name() + " version " + cmd.Version
+	})
+	cmd.SetVersionTemplate("{{buildInfo .}}\n")
+}
@@ -15,6 +15,7 @@ package auth
 
 import (
     "encoding/json"
+    "errors"
     "fmt"
     "net/http"
     "strings"
@@ -23,6 +24,10 @@ import (
     "github.com/golang-jwt/jwt/v5"
 )
 
+// ErrUnauthorized is returned when the Manager rejects the credentials
+// presented, as opposed to failing to answer. Retrying won't help.
+var ErrUnauthorized = errors.New("credentials rejected by manager")
+
 // Manager handles authentication operations for the native client
 type Manager struct {
     managerURL string
@@ -72,6 +77,9 @@ func (a *Manager) GetToken(nodeID, nodeType, apiKey string) (*TokenInfo, error)
         _ = resp.Body.Close()
     }()
 
+    if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+        return nil, fmt.Errorf("token request failed with status %d: %w", resp.StatusCode, ErrUnauthorized)
+    }
     if resp.StatusCode != http.StatusOK {
         return nil, fmt.Errorf("token request failed with status %d", resp.StatusCode)
     }
@@ -91,7 +99,9 @@ func (a *Manager) GetToken(nodeID, nodeType, apiKey string) (*TokenInfo, error)
     return &tokenResp, nil
 }
 
-// RefreshToken refreshes an access token using a refresh token
+// RefreshToken refreshes an access token using a refresh token. The
+// Manager rotates refresh tokens, so the one passed in is spent and the
+// caller must keep the RefreshToken returned.
 func (a *Manager) RefreshToken(refreshToken string) (*TokenInfo, error) {
     reqBody := map[string]string{
         "refresh_token": refreshToken,
@@ -114,6 +124,9 @@ func (a *Manager) RefreshToken(refreshToken string) (*TokenInfo, error) {
         _ = resp.Body.Close()
     }()
 
+    if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+        return nil, fmt.Errorf("refresh request failed with status %d: %w", resp.StatusCode, ErrUnauthorized)
+    }
     if resp.StatusCode != http.StatusOK {
         return nil, fmt.Errorf("refresh request failed with status %d", resp.StatusCode)
     }
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -319,6 +320,70 @@ func TestTokenInfo_IsExpiringSoon(t *testing.T) {
 	}
 }
 
+func TestManager_DeviceLogin(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/auth/device":
+			_, _ = w.Write([]byte(`{
+				"device_code": "dev-code",
+				"user_code": "ABCD-EFGH",
+				"verification_uri": "https://idp.example.com/device",
+				"expires_in": 60,
+				"interval": 1
+			}`))
+		case "/auth/device/token":
+			polls++
+			if polls == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": "authorization_pending"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token": "session-token", "token_type": "Bearer", "expires_in": 3600}`))
+		default:
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	
+	manager, _ := New("http://manager.invalid")
+	
+	device, err := manager.StartDeviceLogin(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("StartDeviceLogin failed: %v", err)
+	}
+	if device.UserCode != "ABCD-EFGH" || device.VerificationURI != "https://idp.example.com/device" {
+		t.Errorf("Unexpected device authorization %+v", device)
+	}
+	
+	token, err := manager.WaitForDeviceToken(context.Background(), server.URL, device)
+	if err != nil {
+		t.Fatalf("WaitForDeviceToken failed: %v", err)
+	}
+	if token.AccessToken != "session-token" || polls != 2 {
+		t.Errorf("Expected session-token after 2 polls, got %q after %d", token.AccessToken, polls)
+	}
+	if time.Until(token.ExpiresAt) < 59*time.Minute {
+		t.Errorf("Unexpected expiry %v", token.ExpiresAt)
+	}
+}
+
+func TestManager_DeviceLogin_Denied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "access_denied"}`))
+	}))
+	defer server.Close()
+	
+	manager, _ := New("http://manager.invalid")
+	
+	_, err := manager.WaitForDeviceToken(context.Background(), server.URL, &DeviceAuthorization{DeviceCode: "dev-code", Interval: 1})
+	if err != ErrDeviceAccessDenied {
+		t.Errorf("Expected ErrDeviceAccessDenied, got %v", err)
+	}
+}
+
 // Helper method for TokenInfo
 func (t *TokenInfo) IsExpired() bool {
 	return time.Now().After(t.ExpiresAt)
@@ -0,0 +1,158 @@
+package auth
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// DeviceAuthorization is a pending device sign-in started with a headend.
+// The user opens VerificationURI on any device and enters UserCode.
+type DeviceAuthorization struct {
+    DeviceCode              string `json:"device_code"`
+    UserCode                string `json:"user_code"`
+    VerificationURI         string `json:"verification_uri"`
+    VerificationURIComplete string `json:"verification_uri_complete"`
+    ExpiresIn               int    `json:"expires_in"`
+    Interval                int    `json:"interval"`
+}
+
+var (
+    // ErrDeviceCodeExpired is returned when the user didn't finish signing in in time
+    ErrDeviceCodeExpired = errors.New("device code expired before sign-in completed")
+    // ErrDeviceAccessDenied is returned when the user declined the sign-in
+    ErrDeviceAccessDenied = errors.New("sign-in was denied")
+)
+
+// StartDeviceLogin begins the OAuth 2.0 device authorization grant through
+// a headend, for headless clients that can't complete a browser redirect
+func (a *Manager) StartDeviceLogin(ctx context.Context, headendURL string) (*DeviceAuthorization, error) {
+    req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(headendURL, "/")+"/auth/device", nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create request: %w", err)
+    }
+
+    resp, err := a.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("device authorization request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("device authorization request failed with status %d", resp.StatusCode)
+    }
+
+    var device DeviceAuthorization
+    if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
+        return nil, fmt.Errorf("failed to parse device authorization response: %w", err)
+    }
+    if device.DeviceCode == "" || device.UserCode == "" || device.VerificationURI == "" {
+        return nil, fmt.Errorf("incomplete device authorization response")
+    }
+    if device.Interval <= 0 {
+        device.Interval = 5
+    }
+
+    return &device, nil
+}
+
+// WaitForDeviceToken polls the headend until the user completes the
+// sign-in started by StartDeviceLogin, the code expires, or ctx is done
+func (a *Manager) WaitForDeviceToken(ctx context.Context, headendURL string, device *DeviceAuthorization) (*TokenInfo, error) {
+    interval := time.Duration(device.Interval) * time.Second
+    if device.ExpiresIn > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, time.Duration(device.ExpiresIn)*time.Second)
+        defer cancel()
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+                return nil, ErrDeviceCodeExpired
+            }
+            return nil, ctx.Err()
+        case <-time.After(interval):
+        }
+
+        token, code, err := a.pollDeviceToken(ctx, headendURL, device.DeviceCode)
+        switch {
+        case err != nil:
+            return nil, err
+        case token != nil:
+            return token, nil
+        }
+
+        // RFC 8628 section 3.5 error codes
+        switch code {
+        case "authorization_pending":
+        case "slow_down":
+            interval += 5 * time.Second
+        case "expired_token":
+            return nil, ErrDeviceCodeExpired
+        case "access_denied":
+            return nil, ErrDeviceAccessDenied
+        default:
+            return nil, fmt.Errorf("device token request failed: %s", code)
+        }
+    }
+}
+
+// pollDeviceToken makes one token request, returning either the token or
+// the error code the headend relayed from the identity provider
+func (a *Manager) pollDeviceToken(ctx context.Context, headendURL, deviceCode string) (*TokenInfo, string, error) {
+    jsonData, _ := json.Marshal(map[string]string{"device_code": deviceCode})
+
+    req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(headendURL, "/")+"/auth/device/token", strings.NewReader(string(jsonData)))
+    if err != nil {
+        return nil, "", fmt.Errorf("failed to create request: %w", err)
+    }
+
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := a.httpClient.Do(req)
+    if err != nil {
+        return nil, "", fmt.Errorf("device token request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    var tokenResp struct {
+        AccessToken string `json:"access_token"`
+        TokenType   string `json:"token_type"`
+        ExpiresIn   int    `json:"expires_in"`
+        Error       string `json:"error"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+        return nil, "", fmt.Errorf("failed to parse device token response (status %d): %w", resp.StatusCode, err)
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        if tokenResp.Error == "" {
+            return nil, "", fmt.Errorf("device token request failed with status %d", resp.StatusCode)
+        }
+        return nil, tokenResp.Error, nil
+    }
+    if tokenResp.AccessToken == "" {
+        return nil, "", fmt.Errorf("device token response has no access token")
+    }
+
+    token := &TokenInfo{
+        AccessToken: tokenResp.AccessToken,
+        TokenType:   tokenResp.TokenType,
+    }
+    if tokenResp.ExpiresIn > 0 {
+        token.ExpiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+    } else if exp, err := a.getTokenExpiry(tokenResp.AccessToken); err == nil {
+        token.ExpiresAt = exp
+    }
+    return token, "", nil
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+// Session states, as shown by the status command and the tray
+const (
+    StateUnauthenticated = "unauthenticated"
+    StateAuthenticated   = "authenticated"
+    StateExpiring        = "expiring"
+    StateExpired         = "expired"
+)
+
+const (
+    // refreshRetryMin and refreshRetryMax bound the backoff between
+    // failed refreshes
+    refreshRetryMin = 15 * time.Second
+    refreshRetryMax = 5 * time.Minute
+
+    // refreshFallback is how often a token without a readable expiry is
+    // checked
+    refreshFallback = 5 * time.Minute
+)
+
+// SessionState describes a session without its secrets
+type SessionState struct {
+    State           string    `json:"state"`
+    ExpiresAt       time.Time `json:"expires_at,omitempty"`
+    LastRefresh     time.Time `json:"last_refresh,omitempty"`
+    Failures        int       `json:"failures,omitempty"`
+    LastError       string    `json:"last_error,omitempty"`
+    Reregistrations int       `json:"reregistrations,omitempty"`
+}
+
+// Session keeps a client's JWT fresh. Tokens are refreshed ahead of
+// expiry, keeping the rotated refresh token each time; when the Manager
+// rejects the refresh token the session logs in again from scratch.
+type Session struct {
+    manager   *Manager
+    threshold time.Duration
+    login     func() (*TokenInfo, error)
+
+    mu              sync.Mutex
+    token           TokenInfo
+    lastRefresh     time.Time
+    failures        int
+    lastErr         error
+    reregistrations int
+    now             func() time.Time
+}
+
+// NewSession creates a session that refreshes tokens once they are within
+// threshold of expiring. login obtains a new token from the client's
+// long-lived credentials.
+func NewSession(manager *Manager, threshold time.Duration, login func() (*TokenInfo, error)) *Session {
+    return &Session{
+        manager:   manager,
+        threshold: threshold,
+        login:     login,
+        now:       time.Now,
+    }
+}
+
+// Login replaces the session with a new one from the client's credentials
+func (s *Session) Login() error {
+    token, err := s.login()
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err != nil {
+        s.failed(err)
+        return err
+    }
+    s.set(token)
+    return nil
+}
+
+// Set adopts a token obtained elsewhere, such as a device sign-in
+func (s *Session) Set(token *TokenInfo) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.set(token)
+}
+
+// Reset forgets the session
+func (s *Session) Reset() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.token = TokenInfo{}
+    s.failures = 0
+    s.lastErr = nil
+}
+
+// Reregistered records that the client had to register again to get a
+// session back
+func (s *Session) Reregistered() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.reregistrations++
+}
+
+// AccessToken returns the current access token, or "" without a session
+func (s *Session) AccessToken() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.token.AccessToken
+}
+
+// State describes the session
+func (s *Session) State() SessionState {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    state := SessionState{
+        ExpiresAt:       s.token.ExpiresAt,
+        LastRefresh:     s.lastRefresh,
+        Failures:        s.failures,
+        Reregistrations: s.reregistrations,
+    }
+    if s.lastErr != nil {
+        state.LastError = s.lastErr.Error()
+    }
+
+    now := s.now()
+    switch {
+    case s.token.AccessToken == "":
+        state.State = StateUnauthenticated
+    case s.token.ExpiresAt.IsZero():
+        state.State = StateAuthenticated
+    case !now.Before(s.token.ExpiresAt):
+        state.State = StateExpired
+    case s.token.ExpiresAt.Sub(now) < s.threshold:
+        state.State = StateExpiring
+    default:
+        state.State = StateAuthenticated
+    }
+    return state
+}
+
+// NextRefresh returns how long until Ensure should next be called: a
+// little before the token comes within the threshold of expiring, so a
+// fleet started together doesn't refresh together, or after a backoff
+// while refreshes are failing.
+func (s *Session) NextRefresh() time.Duration {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.failures > 0 {
+        backoff := refreshRetryMin << (s.failures - 1)
+        if backoff > refreshRetryMax || backoff <= 0 {
+            backoff = refreshRetryMax
+        }
+        return backoff
+    }
+    if s.token.ExpiresAt.IsZero() {
+        return refreshFallback
+    }
+
+    due := s.token.ExpiresAt.Add(-s.threshold).Sub(s.now())
+    if due <= 0 {
+        return 0
+    }
+    // Up to a tenth early
+    return due - time.Duration(rand.Int63n(int64(due)/10+1))
+}
+
+// Ensure refreshes the token if it is within the threshold of expiring.
+// The refresh token is tried first; if the Manager rejects it the client
+// logs in again. An error wrapping ErrUnauthorized means the client's
+// credentials were rejected too, and it has to register again. Other
+// errors leave the session as it was, to be retried.
+func (s *Session) Ensure() error {
+    s.mu.Lock()
+    token := s.token
+    now := s.now()
+    s.mu.Unlock()
+
+    if token.AccessToken != "" && !token.ExpiresAt.IsZero() && token.ExpiresAt.Sub(now) >= s.threshold {
+        return nil
+    }
+
+    if token.RefreshToken != "" {
+        refreshed, err := s.manager.RefreshToken(token.RefreshToken)
+
+        s.mu.Lock()
+        if err == nil {
+            // Managers that don't rotate leave the old one valid
+            if refreshed.RefreshToken == "" {
+                refreshed.RefreshToken = token.RefreshToken
+            }
+            s.set(refreshed)
+            s.mu.Unlock()
+            return nil
+        }
+        if !errors.Is(err, ErrUnauthorized) {
+            s.failed(err)
+            s.mu.Unlock()
+            return fmt.Errorf("token refresh failed: %w", err)
+        }
+        // Expired, revoked or already used: no point trying it again
+        s.token.RefreshToken = ""
+        s.mu.Unlock()
+    }
+
+    if err := s.Login(); err != nil {
+        return fmt.Errorf("login failed: %w", err)
+    }
+    return nil
+}
+
+// set adopts token. The caller holds mu.
+func (s *Session) set(token *TokenInfo) {
+    s.token = *token
+    if s.token.ExpiresAt.IsZero() && s.token.AccessToken != "" {
+        if exp, err := s.manager.getTokenExpiry(s.token.AccessToken); err == nil {
+            s.token.ExpiresAt = exp
+        }
+    }
+    s.lastRefresh = s.now()
+    s.failures = 0
+    s.lastErr = nil
+}
+
+// failed records a failed refresh or login. The caller holds mu.
+func (s *Session) failed(err error) {
+    s.failures++
+    s.lastErr = err
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rotatingManager issues single-use refresh tokens like the Manager does
+type rotatingManager struct {
+	mu     sync.Mutex
+	issued int
+	valid  map[string]bool
+}
+
+func (m *rotatingManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.valid[req.RefreshToken] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	delete(m.valid, req.RefreshToken)
+
+	m.issued++
+	refreshToken := fmt.Sprintf("refresh-%d", m.issued)
+	m.valid[refreshToken] = true
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  fmt.Sprintf("access-%d", m.issued),
+		"refresh_token": refreshToken,
+		"expires_at":    time.Now().Add(time.Hour),
+	})
+}
+
+func newTestSession(t *testing.T, handler http.Handler, login func() (*TokenInfo, error)) *Session {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	manager, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSession(manager, 5*time.Minute, login)
+}
+
+func TestSession_RefreshRotates(t *testing.T) {
+	manager := &rotatingManager{valid: map[string]bool{"refresh-0": true}}
+	logins := 0
+	session := newTestSession(t, manager, func() (*TokenInfo, error) {
+		logins++
+		return nil, errors.New("unexpected login")
+	})
+
+	// Far from expiry, nothing happens
+	session.Set(&TokenInfo{AccessToken: "access-0", RefreshToken: "refresh-0", ExpiresAt: time.Now().Add(time.Hour)})
+	if err := session.Ensure(); err != nil || session.AccessToken() != "access-0" {
+		t.Fatalf("refreshed too early: %q, %v", session.AccessToken(), err)
+	}
+
+	// Within the threshold the token is refreshed, and the refresh token
+	// from each response is used for the next
+	for i := 1; i <= 2; i++ {
+		session.now = func() time.Time { return time.Now().Add(58 * time.Minute) }
+		if state := session.State(); state.State != StateExpiring {
+			t.Errorf("state before refresh %d: got %q", i, state.State)
+		}
+		if err := session.Ensure(); err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("access-%d", i); session.AccessToken() != want {
+			t.Errorf("refresh %d: got %q, want %q", i, session.AccessToken(), want)
+		}
+		session.now = time.Now
+		if state := session.State(); state.State != StateAuthenticated || state.LastRefresh.IsZero() {
+			t.Errorf("state after refresh %d: %+v", i, state)
+		}
+	}
+	if logins != 0 {
+		t.Errorf("logged in %d times", logins)
+	}
+}
+
+func TestSession_RejectedRefreshLogsIn(t *testing.T) {
+	manager := &rotatingManager{valid: map[string]bool{}}
+	var loginErr error
+	session := newTestSession(t, manager, func() (*TokenInfo, error) {
+		if loginErr != nil {
+			return nil, loginErr
+		}
+		return &TokenInfo{AccessToken: "login", RefreshToken: "refresh-0", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	})
+
+	// The refresh token was already used, so the session starts over
+	session.Set(&TokenInfo{AccessToken: "old", RefreshToken: "spent", ExpiresAt: time.Now().Add(time.Minute)})
+	if err := session.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if session.AccessToken() != "login" {
+		t.Errorf("got %q after a rejected refresh", session.AccessToken())
+	}
+
+	// With the API key rejected too, the caller is told to register again
+	loginErr = fmt.Errorf("status 401: %w", ErrUnauthorized)
+	session.Set(&TokenInfo{AccessToken: "old", RefreshToken: "spent", ExpiresAt: time.Now().Add(-time.Minute)})
+	if err := session.Ensure(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+	state := session.State()
+	if state.State != StateExpired || state.Failures != 1 || state.LastError == "" {
+		t.Errorf("state after rejected login: %+v", state)
+	}
+}
+
+func TestSession_RetriesWithBackoff(t *testing.T) {
+	session := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}), func() (*TokenInfo, error) {
+		t.Error("logged in after a transient failure")
+		return nil, errors.New("unexpected login")
+	})
+
+	expiresAt := time.Now().Add(time.Hour)
+	session.Set(&TokenInfo{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: expiresAt})
+
+	next := session.NextRefresh()
+	due := time.Until(expiresAt.Add(-5 * time.Minute))
+	if next > due || next < due*9/10-time.Second {
+		t.Errorf("next refresh in %s, want a little under %s", next, due)
+	}
+
+	session.now = func() time.Time { return time.Now().Add(58 * time.Minute) }
+	for i, want := range []time.Duration{15 * time.Second, 30 * time.Second, time.Minute} {
+		if err := session.Ensure(); err == nil || errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("attempt %d: got %v", i, err)
+		}
+		if next := session.NextRefresh(); next != want {
+			t.Errorf("attempt %d: retry in %s, want %s", i, next, want)
+		}
+	}
+	if session.AccessToken() != "access" {
+		t.Error("failed refresh dropped the token")
+	}
+}
@@ -0,0 +1,299 @@
+// Package bypass implements per-destination path selection for the SASEWaddle
+// native client.
+//
+// The bypass package provides:
+//   - Manager-defined SaaS bypass lists (domains and CIDRs for O365, Zoom, etc.)
+//   - Host routes sending bypassed destinations directly to the local gateway
+//     while everything else stays in the tunnel
+//   - Periodic re-resolution of bypassed domains and differential route updates
+//   - Fail-closed behaviour: once a list outlives its freshness window all
+//     bypass routes are removed and traffic returns to the tunnel
+//
+// Only IPv4 destinations are bypassed. IPv6 entries are ignored, which is
+// the safe default since their traffic stays in the tunnel.
+package bypass
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// App is a named group of destinations that may leave outside the tunnel
+type App struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	CIDRs   []string `json:"cidrs"`
+}
+
+// List is a bypass list as served by the Manager
+type List struct {
+	Version string `json:"version"`
+	Apps    []App  `json:"apps"`
+	// MaxAgeSeconds is how long the list may be used without a successful
+	// refresh before bypassing stops
+	MaxAgeSeconds int `json:"max_age_seconds"`
+}
+
+// Router installs and maintains bypass routes for the current list
+type Router struct {
+	list      *List
+	fetchedAt time.Time
+	gateway   string
+	device    string
+	routes    map[string]bool // installed IPv4 prefixes
+	mutex     sync.Mutex
+}
+
+// NewRouter creates a router with no bypass routes
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[string]bool),
+	}
+}
+
+// Apply installs routes for a freshly fetched list, adding and removing only
+// the prefixes that changed since the last apply
+func (r *Router) Apply(list *List) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.gateway == "" {
+		gateway, device, err := defaultGateway()
+		if err != nil {
+			return fmt.Errorf("failed to find local gateway: %w", err)
+		}
+		r.gateway, r.device = gateway, device
+	}
+
+	desired := resolve(list)
+
+	var errs []string
+	for prefix := range r.routes {
+		if desired[prefix] {
+			continue
+		}
+		if err := deleteRoute(prefix, r.gateway, r.device); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(r.routes, prefix)
+	}
+	for prefix := range desired {
+		if r.routes[prefix] {
+			continue
+		}
+		if err := addRoute(prefix, r.gateway, r.device); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		r.routes[prefix] = true
+	}
+
+	r.list = list
+	r.fetchedAt = time.Now()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to update %d bypass routes: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Stale reports whether the current list has outlived its freshness window
+func (r *Router) Stale() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.staleLocked()
+}
+
+func (r *Router) staleLocked() bool {
+	if r.list == nil {
+		return false
+	}
+	maxAge := time.Duration(r.list.MaxAgeSeconds) * time.Second
+	return maxAge > 0 && time.Since(r.fetchedAt) > maxAge
+}
+
+// FailClosedIfStale removes every bypass route when the list is stale and
+// reports whether it did so
+func (r *Router) FailClosedIfStale() bool {
+	r.mutex.Lock()
+	stale := r.staleLocked()
+	r.mutex.Unlock()
+
+	if !stale {
+		return false
+	}
+	log.Printf("SaaS bypass list expired, sending all traffic through the tunnel")
+	r.Clear()
+	return true
+}
+
+// Clear removes every installed bypass route and forgets the list
+func (r *Router) Clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for prefix := range r.routes {
+		if err := deleteRoute(prefix, r.gateway, r.device); err != nil {
+			log.Printf("Failed to remove bypass route %s: %v", prefix, err)
+		}
+		delete(r.routes, prefix)
+	}
+	r.list = nil
+}
+
+// Version returns the version of the applied list, or "" when none is active
+func (r *Router) Version() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.list == nil {
+		return ""
+	}
+	return r.list.Version
+}
+
+// RouteCount returns the number of installed bypass routes
+func (r *Router) RouteCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.routes)
+}
+
+// resolve expands a list into the set of IPv4 prefixes to bypass
+func resolve(list *List) map[string]bool {
+	prefixes := make(map[string]bool)
+	for _, app := range list.Apps {
+		for _, cidr := range app.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil || network.IP.To4() == nil {
+				continue
+			}
+			prefixes[network.String()] = true
+		}
+		for _, domain := range app.Domains {
+			// Wildcards cannot be resolved; the Manager lists CIDRs for them
+			if strings.HasPrefix(domain, "*.") {
+				continue
+			}
+			ips, err := net.LookupIP(domain)
+			if err != nil {
+				log.Printf("Failed to resolve bypass domain %s for %s: %v", domain, app.Name, err)
+				continue
+			}
+			for _, ip := range ips {
+				if ip4 := ip.To4(); ip4 != nil {
+					prefixes[ip4.String()+"/32"] = true
+				}
+			}
+		}
+	}
+	return prefixes
+}
+
+// defaultGateway returns the gateway and device of the physical default
+// route, which wg-quick leaves in place when it takes over routing
+func defaultGateway() (string, string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		output, err := exec.Command("ip", "-4", "route", "show", "table", "main", "default").Output()
+		if err != nil {
+			return "", "", err
+		}
+		fields := strings.Fields(string(output))
+		var gateway, device string
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				gateway = fields[i+1]
+			case "dev":
+				device = fields[i+1]
+			}
+		}
+		if gateway == "" {
+			return "", "", fmt.Errorf("no default route in main table")
+		}
+		return gateway, device, nil
+	case "darwin":
+		output, err := exec.Command("route", "-n", "get", "default").Output()
+		if err != nil {
+			return "", "", err
+		}
+		var gateway, device string
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			switch fields[0] {
+			case "gateway:":
+				gateway = fields[1]
+			case "interface:":
+				device = fields[1]
+			}
+		}
+		if gateway == "" {
+			return "", "", fmt.Errorf("no default gateway")
+		}
+		return gateway, device, nil
+	case "windows":
+		output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Get-NetRoute -DestinationPrefix 0.0.0.0/0 | Sort-Object RouteMetric | Select-Object -First 1 | ForEach-Object { \"$($_.NextHop) $($_.InterfaceIndex)\" }").Output()
+		if err != nil {
+			return "", "", err
+		}
+		fields := strings.Fields(string(output))
+		if len(fields) != 2 {
+			return "", "", fmt.Errorf("no default gateway")
+		}
+		return fields[0], fields[1], nil
+	default:
+		return "", "", fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+}
+
+func addRoute(prefix, gateway, device string) error {
+	switch runtime.GOOS {
+	case "linux":
+		// wg-quick's suppress_prefixlength rule lets specific main-table
+		// routes win over the tunnel's default route
+		args := []string{"route", "replace", prefix, "via", gateway}
+		if device != "" {
+			args = append(args, "dev", device)
+		}
+		return run("ip", args...)
+	case "darwin":
+		return run("route", "-n", "add", "-net", prefix, gateway)
+	case "windows":
+		return run("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("New-NetRoute -DestinationPrefix %s -InterfaceIndex %s -NextHop %s -PolicyStore ActiveStore | Out-Null", prefix, device, gateway))
+	default:
+		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+}
+
+func deleteRoute(prefix, gateway, device string) error {
+	switch runtime.GOOS {
+	case "linux":
+		return run("ip", "route", "del", prefix, "via", gateway)
+	case "darwin":
+		return run("route", "-n", "delete", "-net", prefix, gateway)
+	case "windows":
+		return run("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Remove-NetRoute -DestinationPrefix %s -InterfaceIndex %s -Confirm:$false", prefix, device))
+	default:
+		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+}
+
+func run(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, output)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/auth"
+    "github.com/tobogganing/clients/native/internal/config"
+)
+
+// AccessSummary is the headend's summary of the policy that applies to this
+// user: what they can reach, the most important things they can't, and
+// whether anything else gets through
+type AccessSummary struct {
+    PolicyVersion string `json:"policy_version"`
+    Mode          string `json:"mode"`
+    // Profile is standard, remediation or quarantine
+    Profile       string `json:"profile"`
+    ProfileReason string `json:"profile_reason,omitempty"`
+
+    Allowed           []AccessEntry `json:"allowed"`
+    AllowedTotal      int           `json:"allowed_total"`
+    AllowedCategories []string      `json:"allowed_categories"`
+    Denied            []AccessEntry `json:"denied"`
+    DeniedTotal       int           `json:"denied_total"`
+    DeniedCategories  []string      `json:"denied_categories"`
+
+    DefaultAllow bool      `json:"default_allow"`
+    GeneratedAt  time.Time `json:"generated_at"`
+}
+
+// AccessEntry is one rule of an access summary
+type AccessEntry struct {
+    Type        string `json:"type"`
+    Target      string `json:"target"`
+    Protocol    string `json:"protocol,omitempty"`
+    Ports       string `json:"ports,omitempty"`
+    Description string `json:"description,omitempty"`
+}
+
+// AccessSummary fetches the summary of our effective policy from the headend
+func (c *Client) AccessSummary() (*AccessSummary, error) {
+    token := c.session.AccessToken()
+    if token == "" || c.headendURL == "" {
+        return nil, fmt.Errorf("not connected to a headend")
+    }
+
+    req, err := http.NewRequest("GET", strings.TrimSuffix(c.headendURL, "/")+"/session/access", nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("access summary request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("headend does not publish access summaries")
+    }
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return nil, fmt.Errorf("access summary request failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var summary AccessSummary
+    if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+        return nil, fmt.Errorf("failed to parse access summary: %w", err)
+    }
+    return &summary, nil
+}
+
+// AccessReport is the access summary as text, for the tray's access page
+func (c *Client) AccessReport() (string, error) {
+    summary, err := c.AccessSummary()
+    if err != nil {
+        return "", err
+    }
+    var report strings.Builder
+    summary.Format(&report)
+    return report.String(), nil
+}
+
+// UseSSOSession talks to headendURL with the session saved by a device
+// sign-in, so commands run outside the connected client can query it
+func (c *Client) UseSSOSession(headendURL string) error {
+    data, err := config.ReadFile(c.config.GetSSOTokenPath())
+    if err != nil {
+        return fmt.Errorf("no saved sign-in, run the login command first: %w", err)
+    }
+
+    var token auth.TokenInfo
+    if err := json.Unmarshal(data, &token); err != nil {
+        return fmt.Errorf("failed to parse saved sign-in: %w", err)
+    }
+    if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+        return fmt.Errorf("saved sign-in expired at %s, run the login command again",
+            token.ExpiresAt.Format("2006-01-02 15:04:05"))
+    }
+
+    // Headends with mTLS enabled also want the certificate from registration
+    certDir := c.getCertificateDir()
+    if cert, err := os.ReadFile(certDir + "/client.crt"); err == nil {
+        if key, err := config.ReadFile(certDir + "/client.key"); err == nil {
+            if err := c.useClientCertificate(string(cert), string(key)); err != nil {
+                fmt.Printf("WARNING: saved client certificate not used: %v\n", err)
+            }
+        }
+    }
+
+    c.headendURL = headendURL
+    c.session.Set(&token)
+    return nil
+}
+
+// Format writes the summary for people to read
+func (s *AccessSummary) Format(w io.Writer) {
+    fmt.Fprintf(w, "What can I access? (policy %s, %s mode)\n", s.PolicyVersion, s.Mode)
+
+    switch s.Profile {
+    case "remediation":
+        fmt.Fprintf(w, "\nYour access is restricted until this device is fixed (%s).\n", s.ProfileReason)
+        fmt.Fprintln(w, "Only the services needed to recover are reachable.")
+    case "quarantine":
+        fmt.Fprintf(w, "\nThis device is quarantined (%s).\n", s.ProfileReason)
+        fmt.Fprintln(w, "Only the services needed to recover are reachable.")
+    }
+
+    fmt.Fprintf(w, "\nAllowed (%d):\n", s.AllowedTotal)
+    if len(s.AllowedCategories) > 0 {
+        fmt.Fprintf(w, "  Categories: %s\n", strings.Join(s.AllowedCategories, ", "))
+    }
+    formatEntries(w, s.Allowed, s.AllowedTotal)
+
+    fmt.Fprintf(w, "\nBlocked (%d):\n", s.DeniedTotal)
+    if len(s.DeniedCategories) > 0 {
+        fmt.Fprintf(w, "  Categories: %s\n", strings.Join(s.DeniedCategories, ", "))
+    }
+    formatEntries(w, s.Denied, s.DeniedTotal)
+
+    fmt.Fprintln(w)
+    if s.DefaultAllow {
+        fmt.Fprintln(w, "Anything not listed is currently allowed.")
+    } else {
+        fmt.Fprintln(w, "Anything not listed is blocked.")
+    }
+}
+
+func formatEntries(w io.Writer, entries []AccessEntry, total int) {
+    if total == 0 {
+        fmt.Fprintln(w, "  (none)")
+        return
+    }
+    for _, entry := range entries {
+        target := entry.Target
+        if entry.Protocol != "" {
+            target += " " + entry.Protocol
+        }
+        if entry.Ports != "" {
+            target += " port " + entry.Ports
+        }
+        if entry.Description != "" {
+            fmt.Fprintf(w, "  %-40s %s\n", target, entry.Description)
+        } else {
+            fmt.Fprintf(w, "  %s\n", target)
+        }
+    }
+    if more := total - len(entries); more > 0 {
+        fmt.Fprintf(w, "  ... and %d more\n", more)
+    }
+}
@@ -0,0 +1,306 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+    "github.com/tobogganing/clients/native/internal/config"
+    "github.com/tobogganing/libs/wgconfig"
+)
+
+const (
+    // backupHeadendsRefresh is how often a connected client fetches a
+    // fresh signed backup headend list
+    backupHeadendsRefresh = 6 * time.Hour
+
+    // backupHandshakeTimeout bounds the wait for a backup headend to
+    // answer before the next one is tried
+    backupHandshakeTimeout = 10 * time.Second
+)
+
+// ErrManagerUnavailable marks failures to reach the Manager, as opposed to
+// the Manager refusing a request. Only these let the client fall back to
+// its backup headend list: a client the Manager rejects stays down.
+var ErrManagerUnavailable = errors.New("manager unavailable")
+
+// managerStatusError returns err, from a request the Manager answered with
+// status, marked as the Manager being unavailable if the status says so
+func managerStatusError(status int, err error) error {
+    if status >= http.StatusInternalServerError {
+        return fmt.Errorf("%w: %w", ErrManagerUnavailable, err)
+    }
+    return err
+}
+
+// BackupHeadend is a last-known-good headend from a signed backup list
+type BackupHeadend struct {
+    ClusterID  string `json:"id"`
+    Name       string `json:"name"`
+    Region     string `json:"region"`
+    HeadendURL string `json:"headend_url"`
+    Endpoint   string `json:"endpoint"`
+    PublicKey  string `json:"public_key"`
+}
+
+// backupHeadendList is a signed list as the Manager issues it, kept with
+// the cluster the client was on when it was fetched
+type backupHeadendList struct {
+    List      string `json:"bootstrap_list"`
+    PublicKey string `json:"public_key"`
+    Cluster   string `json:"cluster,omitempty"`
+}
+
+// backupClaims are the claims of a signed backup headend list
+type backupClaims struct {
+    Type     string          `json:"type"`
+    Headends []BackupHeadend `json:"headends"`
+    jwt.RegisteredClaims
+}
+
+// issued returns when the list was issued, zero if it doesn't say
+func (b *backupClaims) issued() time.Time {
+    if b.IssuedAt == nil {
+        return time.Time{}
+    }
+    return b.IssuedAt.Time
+}
+
+// verifyBackupList checks that list is an unexpired backup headend list
+// signed with the PEM public key keyPEM and, if clientID is set, issued
+// to that client
+func verifyBackupList(list, keyPEM, clientID string) (*backupClaims, error) {
+    key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(keyPEM))
+    if err != nil {
+        return nil, fmt.Errorf("invalid Manager public key: %w", err)
+    }
+
+    claims := &backupClaims{}
+    _, err = jwt.ParseWithClaims(list, claims, func(*jwt.Token) (interface{}, error) {
+        return key, nil
+    }, jwt.WithValidMethods([]string{"RS256"}), jwt.WithExpirationRequired())
+    if err != nil {
+        return nil, fmt.Errorf("invalid backup headend list: %w", err)
+    }
+
+    switch {
+    case claims.Type != "bootstrap":
+        return nil, fmt.Errorf("invalid backup headend list: token type %q", claims.Type)
+    case clientID != "" && claims.Subject != clientID:
+        return nil, fmt.Errorf("backup headend list was issued to another client")
+    case len(claims.Headends) == 0:
+        return nil, fmt.Errorf("backup headend list is empty")
+    }
+    return claims, nil
+}
+
+// refreshBackupHeadends fetches a fresh signed backup headend list and
+// keeps it for connecting while the Manager is unreachable
+func (c *Client) refreshBackupHeadends() error {
+    req, err := http.NewRequest("GET", c.config.ManagerURL+"/api/v1/clients/bootstrap", nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("backup headend list request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("backup headend list failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var list backupHeadendList
+    if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+        return fmt.Errorf("failed to parse backup headend list: %w", err)
+    }
+
+    // A list that won't verify now won't get us connected later
+    key := c.config.ManagerPublicKey
+    if key == "" {
+        key = list.PublicKey
+    }
+    if _, err := verifyBackupList(list.List, key, c.clientID); err != nil {
+        return err
+    }
+
+    list.Cluster = c.config.ActiveCluster
+    data, err := json.Marshal(list)
+    if err != nil {
+        return err
+    }
+    if err := c.config.WriteFile(c.config.GetBackupHeadendsPath(), data); err != nil {
+        return fmt.Errorf("failed to save backup headend list: %w", err)
+    }
+    c.backupRefreshAt = time.Now().Add(backupHeadendsRefresh)
+    return nil
+}
+
+// loadBackupHeadends returns the newest valid backup headend list, from
+// the configuration or the one kept from the Manager, and the cluster the
+// client was on when it was kept
+func (c *Client) loadBackupHeadends() (*backupClaims, string, error) {
+    var cached backupHeadendList
+    data, err := config.ReadFile(c.config.GetBackupHeadendsPath())
+    switch {
+    case err == nil:
+        if err := json.Unmarshal(data, &cached); err != nil {
+            fmt.Printf("Ignoring unreadable backup headend list: %v\n", err)
+            cached = backupHeadendList{}
+        }
+    case !errors.Is(err, os.ErrNotExist):
+        fmt.Printf("Failed to read backup headend list: %v\n", err)
+    }
+
+    key := c.config.ManagerPublicKey
+    if key == "" {
+        key = cached.PublicKey
+    }
+    if key == "" {
+        return nil, "", fmt.Errorf("no Manager public key to verify a backup headend list with")
+    }
+
+    var newest *backupClaims
+    err = fmt.Errorf("no backup headend list")
+    for _, list := range []string{c.config.BackupHeadends, cached.List} {
+        if list == "" {
+            continue
+        }
+        claims, verifyErr := verifyBackupList(list, key, "")
+        if verifyErr != nil {
+            err = verifyErr
+            continue
+        }
+        if newest == nil || claims.issued().After(newest.issued()) {
+            newest = claims
+        }
+    }
+    if newest == nil {
+        return nil, "", err
+    }
+    return newest, cached.Cluster, nil
+}
+
+// connectFromBackup brings the tunnel up from the backup headend list
+// while the Manager is unreachable. The WireGuard keys and address are
+// those of the configuration cached at the last connect, which the
+// headends already know. The headends of the cluster we were on are tried
+// first, then the others fastest first, until one completes a handshake.
+func (c *Client) connectFromBackup() error {
+    list, cluster, err := c.loadBackupHeadends()
+    if err != nil {
+        return err
+    }
+    if configured := c.config.ClusterID(); configured != "" {
+        cluster = configured
+    }
+    c.config.ActiveCluster = cluster
+
+    data, err := c.readWireGuardConfig()
+    if err != nil {
+        return fmt.Errorf("no cached WireGuard configuration: %w", err)
+    }
+    cached, err := wgconfig.ParseString(string(data))
+    if err != nil {
+        return fmt.Errorf("invalid cached WireGuard configuration: %w", err)
+    }
+    if len(cached.Interface.Addresses) == 0 {
+        return fmt.Errorf("cached WireGuard configuration has no address")
+    }
+
+    c.clientID = list.Subject
+    c.wgPrivateKey = wgtypes.Key(cached.Interface.PrivateKey)
+    c.wgPublicKey = c.wgPrivateKey.PublicKey()
+    c.wgAddress = cached.Interface.Addresses[0].String()
+    c.wgAddress6 = ""
+    for _, address := range cached.Interface.Addresses[1:] {
+        if address.Addr().Is6() {
+            c.wgAddress6 = address.String()
+            break
+        }
+    }
+
+    for _, headend := range orderBackupHeadends(list.Headends, cluster) {
+        if err := c.useBackupHeadend(headend); err != nil {
+            fmt.Printf("Backup headend %s not usable: %v\n", headend.HeadendURL, err)
+            continue
+        }
+        fmt.Printf("Connected to backup headend %s while the Manager is unreachable\n", headend.HeadendURL)
+        return nil
+    }
+    return fmt.Errorf("none of the %d backup headends answered", len(list.Headends))
+}
+
+// useBackupHeadend starts the tunnel to headend and waits for its handshake
+func (c *Client) useBackupHeadend(headend BackupHeadend) error {
+    key, err := wgtypes.ParseKey(headend.PublicKey)
+    if err != nil {
+        return fmt.Errorf("invalid public key: %w", err)
+    }
+    c.headendURL = headend.HeadendURL
+    c.headendWGEndpoint = headend.Endpoint
+    c.headendPublicKey = key
+    c.clusterID = headend.ClusterID
+    c.egressRegion = headend.Region
+
+    if err := c.createWireGuardConfig(c.wgAddress, ""); err != nil {
+        return fmt.Errorf("failed to write WireGuard configuration: %w", err)
+    }
+    start := time.Now()
+    if err := c.startWireGuard(); err != nil {
+        return err
+    }
+
+    // Setting a keepalive sends one straight away, which starts the handshake
+    keepalive := c.powerMonitor.Current().Keepalive
+    if keepalive == 0 {
+        if err := c.setKeepalive(time.Second); err == nil {
+            defer func() {
+                _ = c.setKeepalive(keepalive)
+            }()
+        }
+    }
+
+    if err := c.waitForHandshake(start, backupHandshakeTimeout); err != nil {
+        if stopErr := c.stopWireGuard(); stopErr != nil {
+            fmt.Printf("Failed to stop WireGuard: %v\n", stopErr)
+        }
+        return err
+    }
+    return nil
+}
+
+// orderBackupHeadends puts the headends of cluster first, then the others
+// fastest first, unreachable ones last
+func orderBackupHeadends(headends []BackupHeadend, cluster string) []BackupHeadend {
+    var ordered []BackupHeadend
+    var others []Cluster
+    byID := make(map[string]BackupHeadend)
+    for _, headend := range headends {
+        if headend.ClusterID == cluster {
+            ordered = append(ordered, headend)
+            continue
+        }
+        byID[headend.ClusterID] = headend
+        others = append(others, Cluster{ID: headend.ClusterID, HeadendURL: headend.HeadendURL, Allowed: true})
+    }
+
+    MeasureClusters(others)
+    for _, other := range others {
+        ordered = append(ordered, byID[other.ID])
+    }
+    return ordered
+}
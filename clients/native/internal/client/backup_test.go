@@ -0,0 +1,104 @@
+package client
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "testing"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// newManagerKey returns a signing key and its PEM public key
+func newManagerKey(t *testing.T) (*rsa.PrivateKey, string) {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signBackupList signs a backup headend list as the Manager does
+func signBackupList(t *testing.T, key *rsa.PrivateKey, tokenType, clientID string, expires time.Time) string {
+    t.Helper()
+    claims := backupClaims{
+        Type: tokenType,
+        Headends: []BackupHeadend{{
+            ClusterID:  "cluster-1",
+            HeadendURL: "https://headend.example.com",
+            Endpoint:   "headend.example.com:51820",
+            PublicKey:  "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+        }},
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject:   clientID,
+            IssuedAt:  jwt.NewNumericDate(time.Now()),
+            ExpiresAt: jwt.NewNumericDate(expires),
+        },
+    }
+    list, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return list
+}
+
+func TestVerifyBackupList(t *testing.T) {
+    key, publicKey := newManagerKey(t)
+    _, otherKey := newManagerKey(t)
+    valid := signBackupList(t, key, "bootstrap", "client-1", time.Now().Add(time.Hour))
+
+    claims, err := verifyBackupList(valid, publicKey, "client-1")
+    if err != nil {
+        t.Fatalf("expected a valid list, got %v", err)
+    }
+    if claims.Subject != "client-1" || len(claims.Headends) != 1 || claims.Headends[0].Endpoint != "headend.example.com:51820" {
+        t.Errorf("unexpected claims %+v", claims)
+    }
+
+    tests := []struct {
+        name     string
+        list     string
+        key      string
+        clientID string
+    }{
+        {"other key", valid, otherKey, ""},
+        {"other client", valid, publicKey, "client-2"},
+        {"expired", signBackupList(t, key, "bootstrap", "client-1", time.Now().Add(-time.Minute)), publicKey, ""},
+        {"access token", signBackupList(t, key, "access", "client-1", time.Now().Add(time.Hour)), publicKey, ""},
+        {"tampered", valid[:len(valid)-4] + "AAAA", publicKey, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := verifyBackupList(tt.list, tt.key, tt.clientID); err == nil {
+                t.Error("expected the list to be rejected")
+            }
+        })
+    }
+}
+
+func TestOrderBackupHeadends(t *testing.T) {
+    headends := []BackupHeadend{
+        {ClusterID: "a", HeadendURL: "https://127.0.0.1:1"},
+        {ClusterID: "b", HeadendURL: "https://127.0.0.1:2"},
+        {ClusterID: "c", HeadendURL: "https://127.0.0.1:3"},
+    }
+
+    ordered := orderBackupHeadends(headends, "b")
+    if len(ordered) != 3 || ordered[0].ClusterID != "b" {
+        t.Fatalf("expected the current cluster first, got %+v", ordered)
+    }
+    seen := map[string]bool{}
+    for _, headend := range ordered {
+        seen[headend.ClusterID] = true
+    }
+    if len(seen) != 3 {
+        t.Errorf("expected every headend once, got %+v", ordered)
+    }
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime"
+    "time"
+
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// EnrollmentSchemaVersion is bumped whenever a field of Enrollment is
+// renamed or removed; new fields may be added without a bump
+const EnrollmentSchemaVersion = 1
+
+// Enrollment is the machine-readable record of a client's enrollment,
+// emitted with bootstrap_output so Terraform, Ansible and similar tools
+// can pick up the identifiers and keys of the nodes they provision. Every
+// field is always present, empty when unknown.
+type Enrollment struct {
+    SchemaVersion int                 `json:"schema_version"`
+    Kind          string              `json:"kind"` // "client" or "container"
+    ClientID      string              `json:"client_id"`
+    ClientName    string              `json:"client_name"`
+    Platform      string              `json:"platform"`
+    ManagerURL    string              `json:"manager_url"`
+    WireGuard     EnrollmentWireGuard `json:"wireguard"`
+    Headend       EnrollmentHeadend   `json:"headend"`
+    EnrolledAt    time.Time           `json:"enrolled_at"`
+}
+
+// EnrollmentWireGuard describes the client's end of the tunnel
+type EnrollmentWireGuard struct {
+    PublicKey string `json:"public_key"`
+    Address   string `json:"address"`
+    Network   string `json:"network"`
+    Address6  string `json:"address6,omitempty"`
+    Network6  string `json:"network6,omitempty"`
+    Interface string `json:"interface"`
+}
+
+// EnrollmentHeadend describes the headend the client was assigned
+type EnrollmentHeadend struct {
+    URL          string `json:"url"`
+    Endpoint     string `json:"endpoint"`
+    PublicKey    string `json:"public_key"`
+    EgressRegion string `json:"egress_region"`
+}
+
+// Enrollment returns the enrollment record of the current registration
+func (c *Client) Enrollment() Enrollment {
+    headendKey := ""
+    if c.headendPublicKey != (wgtypes.Key{}) {
+        headendKey = c.headendPublicKey.String()
+    }
+
+    return Enrollment{
+        SchemaVersion: EnrollmentSchemaVersion,
+        Kind:          "client",
+        ClientID:      c.clientID,
+        ClientName:    c.clientName(),
+        Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+        ManagerURL:    c.config.ManagerURL,
+        WireGuard: EnrollmentWireGuard{
+            PublicKey: c.wgPublicKey.String(),
+            Address:   c.wgAddress,
+            Network:   c.wgNetwork,
+            Address6:  c.wgAddress6,
+            Network6:  c.wgNetwork6,
+            Interface: c.getWireGuardInterface(),
+        },
+        Headend: EnrollmentHeadend{
+            URL:          c.headendURL,
+            Endpoint:     c.headendEndpoint(),
+            PublicKey:    headendKey,
+            EgressRegion: c.egressRegion,
+        },
+        EnrolledAt: time.Now().UTC(),
+    }
+}
+
+// writeBootstrapOutput emits the enrollment record if bootstrap_output is
+// set
+func (c *Client) writeBootstrapOutput() error {
+    return c.emitEnrollment(c.Enrollment())
+}
+
+// emitEnrollment writes enrollment as a single JSON document to
+// bootstrap_file, or as one line to stdout if no file is configured
+func (c *Client) emitEnrollment(enrollment Enrollment) error {
+    if c.config.BootstrapOutput != "json" {
+        return nil
+    }
+
+    data, err := json.Marshal(enrollment)
+    if err != nil {
+        return fmt.Errorf("failed to encode enrollment: %w", err)
+    }
+    data = append(data, '\n')
+
+    if c.config.BootstrapFile == "" {
+        _, err := os.Stdout.Write(data)
+        return err
+    }
+
+    // Replace the file atomically so readers never see a partial document
+    dir := filepath.Dir(c.config.BootstrapFile)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return fmt.Errorf("failed to create bootstrap directory: %w", err)
+    }
+    tmp, err := os.CreateTemp(dir, ".enrollment-*")
+    if err != nil {
+        return fmt.Errorf("failed to create bootstrap file: %w", err)
+    }
+    defer func() {
+        _ = os.Remove(tmp.Name())
+    }()
+
+    if _, err := tmp.Write(data); err != nil {
+        _ = tmp.Close()
+        return fmt.Errorf("failed to write bootstrap file: %w", err)
+    }
+    if err := tmp.Chmod(0644); err != nil {
+        _ = tmp.Close()
+        return fmt.Errorf("failed to write bootstrap file: %w", err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("failed to write bootstrap file: %w", err)
+    }
+    if err := os.Rename(tmp.Name(), c.config.BootstrapFile); err != nil {
+        return fmt.Errorf("failed to write bootstrap file: %w", err)
+    }
+
+    fmt.Printf("Enrollment written to %s\n", c.config.BootstrapFile)
+    return nil
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+    "sort"
+
+    "github.com/tobogganing/clients/native/internal/config"
+    "github.com/tobogganing/libs/framing"
+    "github.com/tobogganing/libs/version"
+)
+
+// BuildInfo returns the build metadata of this client, as reported by
+// --version --json. Features are the session features the build can
+// negotiate and Protocols the versions it speaks, preferred first.
+func BuildInfo(component string) version.Info {
+    info := version.Get(component)
+    info.Features = append(append(info.Features, sessionFeatures...), featureLocalPolicy)
+    sort.Strings(info.Features)
+
+    configVersions := make([]int, 0, config.CurrentVersion)
+    for v := config.CurrentVersion; v >= 1; v-- {
+        configVersions = append(configVersions, v)
+    }
+    info.Protocols = map[string][]int{
+        "session": protocolVersions,
+        "framing": {framing.Version},
+        "config":  configVersions,
+    }
+    return info
+}
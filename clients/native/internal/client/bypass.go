@@ -0,0 +1,72 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/bypass"
+)
+
+// defaultBypassRefresh is used when the Manager does not set a max age
+const defaultBypassRefresh = 5 * time.Minute
+
+// fetchBypassList retrieves the SaaS bypass list assigned to this client
+func (c *Client) fetchBypassList() (*bypass.List, error) {
+    req, err := http.NewRequest("GET", c.config.ManagerURL+"/api/v1/clients/bypass", nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("bypass list request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return nil, fmt.Errorf("bypass list failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var list bypass.List
+    if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+        return nil, fmt.Errorf("failed to parse bypass list: %w", err)
+    }
+
+    return &list, nil
+}
+
+// refreshBypass fetches and applies the bypass list when it is due. If the
+// Manager cannot be reached and the current list has expired, every bypass
+// route is removed so traffic fails closed into the tunnel.
+func (c *Client) refreshBypass() error {
+    if !c.config.SaaSBypass || time.Now().Before(c.bypassRefreshAt) {
+        return nil
+    }
+
+    list, err := c.fetchBypassList()
+    if err != nil {
+        c.bypassRefreshAt = time.Now().Add(time.Minute)
+        c.bypassRouter.FailClosedIfStale()
+        return err
+    }
+
+    refresh := time.Duration(list.MaxAgeSeconds) * time.Second / 2
+    if refresh <= 0 {
+        refresh = defaultBypassRefresh
+    }
+    c.bypassRefreshAt = time.Now().Add(refresh)
+
+    if err := c.bypassRouter.Apply(list); err != nil {
+        return err
+    }
+
+    fmt.Printf("SaaS bypass list %q applied: %d direct routes\n", list.Version, c.bypassRouter.RouteCount())
+    return nil
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+
+    "github.com/tobogganing/libs/featureflag"
+)
+
+const (
+    // protocolV1 is the original JWT:/HOST: text framing understood by every headend
+    protocolV1 = 1
+    // protocolV2 is the length-prefixed binary header from libs/framing
+    protocolV2 = 2
+)
+
+// Capabilities describes what one side of a session supports, ordered by preference
+type Capabilities struct {
+    ProtocolVersions []int    `json:"protocol_versions"`
+    Compression      []string `json:"compression"`
+    Transports       []string `json:"transports"`
+    Features         []string `json:"features"`
+}
+
+// NegotiatedCapabilities is the subset agreed with the headend for this session
+type NegotiatedCapabilities struct {
+    ProtocolVersion int      `json:"protocol_version"`
+    Compression     string   `json:"compression"`
+    Transports      []string `json:"transports"`
+    Features        []string `json:"features"`
+}
+
+// Has reports whether a feature was agreed with the headend
+func (n *NegotiatedCapabilities) Has(feature string) bool {
+    if n == nil {
+        return false
+    }
+    for _, f := range n.Features {
+        if f == feature {
+            return true
+        }
+    }
+    return false
+}
+
+// baselineCapabilities is what we assume when the headend predates negotiation
+func baselineCapabilities() *NegotiatedCapabilities {
+    return &NegotiatedCapabilities{
+        ProtocolVersion: protocolV1,
+        Compression:     "none",
+        Transports:      []string{"wireguard"},
+        Features:        []string{},
+    }
+}
+
+// protocolVersions are the session protocol versions this build speaks,
+// preferred first
+var protocolVersions = []int{protocolV2, protocolV1}
+
+// sessionFeatures are the features this build always offers the headend;
+// local policy is offered only when enabled in configuration
+var sessionFeatures = []string{featureMigration, featureQuarantine, featureDenialFrames}
+
+// localCapabilities returns what this client build supports
+func (c *Client) localCapabilities() Capabilities {
+    features := append([]string{}, sessionFeatures...)
+    if c.config.LocalPolicy {
+        features = append(features, featureLocalPolicy)
+    }
+
+    // Feature flags hold back what is still being rolled out
+    versions := protocolVersions
+    if !c.flagEnabled(featureflag.FramingV2) {
+        versions = []int{protocolV1}
+    }
+    transports := []string{"wireguard", "tcp", "udp", "https"}
+    if !c.flagEnabled(featureflag.FallbackTransport) {
+        transports = []string{"wireguard"}
+    }
+
+    return Capabilities{
+        ProtocolVersions: versions,
+        Compression:      []string{"none"},
+        Transports:       transports,
+        Features:         features,
+    }
+}
+
+// negotiateCapabilities exchanges capabilities with the headend. Older
+// headends without the endpoint answer 404, in which case the baseline is used.
+func (c *Client) negotiateCapabilities() error {
+    fmt.Println("Negotiating session capabilities with headend...")
+
+    c.capabilities = baselineCapabilities()
+
+    if c.headendURL == "" {
+        return fmt.Errorf("headend URL not known")
+    }
+
+    reqBody, _ := json.Marshal(c.localCapabilities())
+
+    negotiateURL := strings.TrimSuffix(c.headendURL, "/") + "/session/negotiate"
+    req, err := http.NewRequest("POST", negotiateURL, bytes.NewReader(reqBody))
+    if err != nil {
+        return err
+    }
+
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("capability negotiation request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode == http.StatusNotFound {
+        fmt.Println("Headend does not support capability negotiation, using baseline")
+        return nil
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("capability negotiation failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var negResp struct {
+        Negotiated NegotiatedCapabilities `json:"negotiated"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&negResp); err != nil {
+        return fmt.Errorf("failed to parse negotiation response: %w", err)
+    }
+
+    c.capabilities = &negResp.Negotiated
+    fmt.Printf("Negotiated protocol v%d with headend\n", c.capabilities.ProtocolVersion)
+    return nil
+}
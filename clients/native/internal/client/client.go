@@ -6,9 +6,20 @@
 // - Dual authentication with X.509 certificates and JWT tokens
 // - Real-time connection monitoring and health checks
 // - Automatic reconnection and failover capabilities
+// - Migration to a peer headend when the current one drains for maintenance
 // - Certificate and configuration rotation with zero downtime
 // - Cross-platform WireGuard interface management
 // - Metrics collection and reporting to Manager service
+// - DNS leak protection while the tunnel is up
+// - WebRTC/STUN leak mitigation with per-application exceptions
+// - Egress region selection for internet-bound traffic
+// - Choosing among the user's clusters by latency or configuration, with
+//   each cluster's keys and configuration kept apart
+// - Deterministic coexistence with other VPN clients on the same host
+// - Direct routing for trusted SaaS destinations, failing closed when stale
+// - Power-aware keepalive and polling intervals to save battery
+// - Restoring tunnel routes and firewall marks other software overwrites,
+//   counting each time for the Manager
 //
 // The client maintains persistent connections to headend servers and
 // automatically handles authentication renewal, configuration updates,
@@ -17,12 +28,15 @@ package client
 
 import (
     "context"
+    "crypto/tls"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "net/http"
     "os"
     "os/exec"
+    "path/filepath"
     "runtime"
     "strings"
     "time"
@@ -33,6 +47,12 @@ import (
 
     "github.com/tobogganing/clients/native/internal/config"
     "github.com/tobogganing/clients/native/internal/auth"
+    "github.com/tobogganing/clients/native/internal/bypass"
+    "github.com/tobogganing/clients/native/internal/coexist"
+    "github.com/tobogganing/clients/native/internal/dnsguard"
+    "github.com/tobogganing/clients/native/internal/power"
+    "github.com/tobogganing/clients/native/internal/stunguard"
+    "github.com/tobogganing/libs/featureflag"
 )
 
 const (
@@ -40,6 +60,9 @@ const (
     platformWindows = "windows"
     platformDarwin  = "darwin"
     platformLinux   = "linux"
+
+    // tunnelDNS is the resolver the headend serves inside the tunnel
+    tunnelDNS = "10.200.0.1"
 )
 
 // Client represents the SASEWaddle native client
@@ -51,12 +74,35 @@ type Client struct {
     
     // Current connection state
     clientID       string
-    accessToken    string
-    refreshToken   string
+    session        *auth.Session
+    savedAuthState auth.SessionState
     headendURL     string
+    clusterID      string
+    egressRegion   string
     wgPrivateKey   wgtypes.Key
     wgPublicKey    wgtypes.Key
     headendPublicKey wgtypes.Key
+    headendWGEndpoint string
+    wgAddress      string
+    wgNetwork      string
+    wgAddress6     string
+    wgNetwork6     string
+    capabilities   *NegotiatedCapabilities
+    localPolicy    *LocalPolicy
+    quarantine     *Quarantine
+    dnsGuard       *dnsguard.Guard
+    stunGuard      *stunguard.Guard
+    bypassRouter   *bypass.Router
+    bypassRefreshAt time.Time
+    featureFlags   *featureflag.Set
+    flagsRefreshAt time.Time
+    backupRefreshAt time.Time
+    powerMonitor   *power.Monitor
+    lastLeakCheck  time.Time
+    tunnel         tunnelState
+    coexistence    coexist.Policy
+    otherVPNs      []coexist.VPN
+    tamperQuietUntil time.Time
 }
 
 // ConnectionStatus represents the current connection status
@@ -65,10 +111,25 @@ type ConnectionStatus struct {
     ClientID       string    `json:"client_id"`
     WireGuardIP    string    `json:"wireguard_ip"`
     HeadendURL     string    `json:"headend_url"`
+    Cluster        string    `json:"cluster,omitempty"`
+    EgressRegion   string    `json:"egress_region,omitempty"`
     ConnectedSince time.Time `json:"connected_since"`
     BytesSent      int64     `json:"bytes_sent"`
     BytesReceived  int64     `json:"bytes_received"`
     LastHandshake  time.Time `json:"last_handshake"`
+    DNSLeakStatus  string    `json:"dns_leak_status"`
+    DNSLeakDetail  string    `json:"dns_leak_detail,omitempty"`
+    WebRTCProtection string  `json:"webrtc_protection"`
+    BypassVersion  string    `json:"bypass_version,omitempty"`
+    BypassRoutes   int       `json:"bypass_routes"`
+    PowerProfile   string    `json:"power_profile"`
+    Quarantine     *Quarantine `json:"quarantine,omitempty"`
+    RecentDenials  []Denial    `json:"recent_denials,omitempty"`
+    RouteTampers   int          `json:"route_tampers"`
+    LastTamper     *TamperEvent `json:"last_tamper,omitempty"`
+    Auth           *auth.SessionState `json:"auth,omitempty"`
+    FeatureFlagsVersion string        `json:"feature_flags_version,omitempty"`
+    FeatureFlags   map[string]bool    `json:"feature_flags"`
 }
 
 // New creates a new SASEWaddle client
@@ -92,6 +153,28 @@ func New(cfg *config.Config) (*Client, error) {
         httpClient: &http.Client{
             Timeout: 30 * time.Second,
         },
+        bypassRouter: bypass.NewRouter(),
+        featureFlags: featureflag.New(),
+    }
+    threshold := time.Duration(cfg.AuthRefreshThreshold) * time.Second
+    client.session = auth.NewSession(authManager, threshold, client.requestToken)
+    client.dnsGuard = dnsguard.New(client.getWireGuardInterface(), []string{tunnelDNS})
+
+    webrtcMode, err := stunguard.ParseMode(cfg.WebRTCProtection)
+    if err != nil {
+        return nil, err
+    }
+    client.stunGuard = stunguard.New(client.getWireGuardInterface(), webrtcMode, cfg.WebRTCExceptions)
+
+    powerProfile, err := power.ParseProfile(cfg.PowerProfile)
+    if err != nil {
+        return nil, err
+    }
+    client.powerMonitor = power.NewMonitor(powerProfile)
+
+    client.coexistence, err = coexist.ParsePolicy(cfg.VPNCoexistence)
+    if err != nil {
+        return nil, err
     }
 
     return client, nil
@@ -101,7 +184,66 @@ func New(cfg *config.Config) (*Client, error) {
 func (c *Client) Connect(ctx context.Context) error {
     fmt.Println("Connecting to SASEWaddle network...")
 
-    // Step 1: Register with Manager Service
+    // Settle how the tunnel shares the host with other VPNs first, so a
+    // refusal leaves nothing behind
+    if err := c.checkCoexistence(); err != nil {
+        return err
+    }
+
+    // Steps 1-4 need the Manager; while it is unreachable the tunnel is
+    // brought up from the signed backup headend list instead
+    if err := c.enroll(); err != nil {
+        if !errors.Is(err, ErrManagerUnavailable) {
+            return err
+        }
+        fmt.Printf("Manager unreachable, connecting from the backup headend list: %v\n", err)
+        if backupErr := c.connectFromBackup(); backupErr != nil {
+            return fmt.Errorf("%w (backup headends: %v)", err, backupErr)
+        }
+    }
+
+    // Hand the enrollment to provisioning tools now the tunnel is up
+    if err := c.writeBootstrapOutput(); err != nil {
+        fmt.Printf("WARNING: bootstrap output not written: %v\n", err)
+    }
+
+    // Step 4a: Keep DNS inside the tunnel
+    if c.config.DNSLeakProtection {
+        if err := c.dnsGuard.Enable(); err != nil {
+            fmt.Printf("DNS leak protection not enabled: %v\n", err)
+        } else {
+            fmt.Println("DNS leak protection enabled")
+        }
+    }
+
+    // Keep WebRTC from discovering addresses outside the tunnel
+    if c.stunGuard.Mode() != stunguard.ModeOff {
+        if err := c.stunGuard.Enable(); err != nil {
+            fmt.Printf("WebRTC protection not enabled: %v\n", err)
+        } else {
+            fmt.Printf("WebRTC protection enabled (%s mode)\n", c.stunGuard.Mode())
+        }
+    }
+
+    // Send trusted SaaS traffic directly, everything else stays in the tunnel
+    if err := c.refreshBypass(); err != nil {
+        fmt.Printf("SaaS bypass not applied, all traffic stays in the tunnel: %v\n", err)
+    }
+
+    // Step 4b: Enforce the obviously-denied subset of our policy locally
+    if err := c.refreshLocalPolicy(); err != nil {
+        fmt.Printf("Local policy not applied, relying on headend enforcement: %v\n", err)
+    }
+
+    // Step 5: Start monitoring and keep-alive
+    return c.runMonitoring(ctx)
+}
+
+// enroll registers with the Manager, gets a session and the WireGuard
+// configuration from it and starts the tunnel
+func (c *Client) enroll() error {
+    // Step 1: Register with Manager Service, on the cluster we pick
+    c.selectCluster()
     if err := c.register(); err != nil {
         return fmt.Errorf("registration failed: %w", err)
     }
@@ -111,18 +253,30 @@ func (c *Client) Connect(ctx context.Context) error {
         return fmt.Errorf("authentication failed: %w", err)
     }
 
+    // Step 2b: Agree on session capabilities (falls back to baseline),
+    // offering what our feature flags allow
+    if err := c.refreshFeatureFlags(); err != nil {
+        fmt.Printf("Feature flags not fetched, using defaults: %v\n", err)
+    }
+    if err := c.negotiateCapabilities(); err != nil {
+        fmt.Printf("Capability negotiation failed, using baseline: %v\n", err)
+    }
+
     // Step 3: Get WireGuard configuration
     if err := c.setupWireGuard(); err != nil {
         return fmt.Errorf("WireGuard setup failed: %w", err)
     }
 
+    // Step 3b: Keep the headends to fall back on next time the Manager is down
+    if err := c.refreshBackupHeadends(); err != nil {
+        fmt.Printf("Backup headend list not refreshed: %v\n", err)
+    }
+
     // Step 4: Start WireGuard interface
     if err := c.startWireGuard(); err != nil {
         return fmt.Errorf("WireGuard start failed: %w", err)
     }
-
-    // Step 5: Start monitoring and keep-alive
-    return c.runMonitoring(ctx)
+    return nil
 }
 
 // Disconnect safely disconnects from the SASEWaddle network
@@ -134,10 +288,34 @@ func (c *Client) Disconnect() error {
         return fmt.Errorf("WireGuard stop failed: %w", err)
     }
 
+    // Stop blocking DNS outside the tunnel
+    if err := c.dnsGuard.Disable(); err != nil {
+        fmt.Printf("Failed to remove DNS leak protection: %v\n", err)
+    }
+
+    if err := c.stunGuard.Disable(); err != nil {
+        fmt.Printf("Failed to remove WebRTC protection: %v\n", err)
+    }
+
+    // Remove direct SaaS routes
+    c.bypassRouter.Clear()
+    c.bypassRefreshAt = time.Time{}
+
+    // Remove locally enforced policy
+    if c.localPolicy != nil {
+        if err := c.clearLocalPolicy(); err != nil {
+            fmt.Printf("Failed to remove local policy: %v\n", err)
+        }
+        c.localPolicy = nil
+    }
+
     // Clean up authentication tokens
-    c.accessToken = ""
-    c.refreshToken = ""
+    c.session.Reset()
+    c.saveAuthState()
     c.clientID = ""
+    c.capabilities = nil
+    c.flagsRefreshAt = time.Time{}
+    c.backupRefreshAt = time.Time{}
 
     fmt.Println("Disconnected successfully")
     return nil
@@ -149,7 +327,20 @@ func (c *Client) Status() (*ConnectionStatus, error) {
         State:    "disconnected",
         ClientID: c.clientID,
         HeadendURL: c.headendURL,
+        Cluster: c.clusterID,
+        EgressRegion: c.egressRegion,
+        BypassVersion: c.bypassRouter.Version(),
+        BypassRoutes: c.bypassRouter.RouteCount(),
+        PowerProfile: c.powerMonitor.Describe(),
+        DNSLeakStatus: string(dnsguard.StateDisabled),
+        WebRTCProtection: string(stunguard.ModeOff),
+        Quarantine: c.quarantine,
+        RecentDenials: c.RecentDenials(),
+        FeatureFlagsVersion: c.featureFlags.Version(),
+        FeatureFlags: c.FeatureFlags(),
     }
+    status.RouteTampers, status.LastTamper = c.Tampering()
+    status.Auth = c.AuthState()
 
     // Check WireGuard interface
     interfaceName := c.getWireGuardInterface()
@@ -173,6 +364,14 @@ func (c *Client) Status() (*ConnectionStatus, error) {
         status.LastHandshake = peer.LastHandshakeTime
     }
 
+    // Run a fresh leak test; the status command is usually a separate process
+    leakStatus := c.dnsGuard.Check(context.Background())
+    status.DNSLeakStatus = string(leakStatus.State)
+    status.DNSLeakDetail = leakStatus.Detail
+    if c.stunGuard.Installed() {
+        status.WebRTCProtection = string(c.stunGuard.Mode())
+    }
+
     return status, nil
 }
 
@@ -204,15 +403,19 @@ func (c *Client) generateWireGuardKeys() error {
     return nil
 }
 
-func (c *Client) buildRegistrationRequest() map[string]interface{} {
-    clientName := c.config.ClientName
-    if clientName == "" {
-        hostname, _ := os.Hostname()
-        clientName = fmt.Sprintf("native-client-%s-%s", runtime.GOOS, hostname)
+// clientName is the name we register under, derived from the hostname
+// unless configured
+func (c *Client) clientName() string {
+    if c.config.ClientName != "" {
+        return c.config.ClientName
     }
+    hostname, _ := os.Hostname()
+    return fmt.Sprintf("native-client-%s-%s", runtime.GOOS, hostname)
+}
 
-    return map[string]interface{}{
-        "name":       clientName,
+func (c *Client) buildRegistrationRequest() map[string]interface{} {
+    regReq := map[string]interface{}{
+        "name":       c.clientName(),
         "type":       "client_native",
         "public_key": c.wgPublicKey.String(),
         "location": map[string]interface{}{
@@ -220,6 +423,18 @@ func (c *Client) buildRegistrationRequest() map[string]interface{} {
             "architecture": runtime.GOARCH,
         },
     }
+
+    // The Manager honours the cluster we picked if policy allows it
+    if c.clusterID != "" {
+        regReq["cluster_id"] = c.clusterID
+    }
+
+    // The Manager picks a headend in this region if policy allows it
+    if c.config.EgressRegion != "" {
+        regReq["egress_region"] = c.config.EgressRegion
+    }
+
+    return regReq
 }
 
 func (c *Client) sendRegistrationRequest(regReq map[string]interface{}) (*registrationResponse, error) {
@@ -236,7 +451,7 @@ func (c *Client) sendRegistrationRequest(regReq map[string]interface{}) (*regist
 
     resp, err := c.httpClient.Do(req)
     if err != nil {
-        return nil, fmt.Errorf("registration request failed: %w", err)
+        return nil, fmt.Errorf("registration request failed: %w: %w", ErrManagerUnavailable, err)
     }
     defer func() {
         _ = resp.Body.Close()
@@ -244,7 +459,7 @@ func (c *Client) sendRegistrationRequest(regReq map[string]interface{}) (*regist
 
     if resp.StatusCode != http.StatusOK {
         body, _ := io.ReadAll(resp.Body)
-        return nil, fmt.Errorf("registration failed with status %d: %s", resp.StatusCode, body)
+        return nil, managerStatusError(resp.StatusCode, fmt.Errorf("registration failed with status %d: %s", resp.StatusCode, body))
     }
 
     var regResp registrationResponse
@@ -258,15 +473,42 @@ func (c *Client) sendRegistrationRequest(regReq map[string]interface{}) (*regist
 func (c *Client) processRegistrationResponse(regResp *registrationResponse) error {
     c.clientID = regResp.ClientID
     c.headendURL = regResp.Cluster.HeadendURL
+    c.headendWGEndpoint = ""
+    c.egressRegion = regResp.Cluster.Region
     c.config.APIKey = regResp.APIKey
 
+    if requested := c.clusterID; requested != "" && regResp.Cluster.ID != "" && requested != regResp.Cluster.ID {
+        fmt.Printf("Cluster %s not available, Manager assigned %s\n", requested, regResp.Cluster.ID)
+    }
+    if regResp.Cluster.ID != "" {
+        c.clusterID = regResp.Cluster.ID
+    }
+    // Certificates and the WireGuard configuration go to this cluster's directory
+    c.config.ActiveCluster = c.clusterID
+
+    if requested := c.config.EgressRegion; requested != "" && requested != c.egressRegion {
+        fmt.Printf("Egress region %s not permitted by policy, Manager assigned %s\n", requested, c.egressRegion)
+    }
+
     // Save certificates
     err := c.saveCertificates(regResp.Certificates.Cert, regResp.Certificates.Key, regResp.Certificates.CA)
     if err != nil {
         return fmt.Errorf("failed to save certificates: %w", err)
     }
 
-    fmt.Printf("Registration successful - Client ID: %s\n", c.clientID)
+    // Headends with mTLS enabled require the certificate alongside the JWT
+    if err := c.useClientCertificate(regResp.Certificates.Cert, regResp.Certificates.Key); err != nil {
+        return fmt.Errorf("failed to load client certificate: %w", err)
+    }
+
+    switch {
+    case c.egressRegion != "":
+        fmt.Printf("Registration successful - Client ID: %s, cluster: %s, egress region: %s\n", c.clientID, c.clusterID, c.egressRegion)
+    case c.clusterID != "":
+        fmt.Printf("Registration successful - Client ID: %s, cluster: %s\n", c.clientID, c.clusterID)
+    default:
+        fmt.Printf("Registration successful - Client ID: %s\n", c.clientID)
+    }
     return nil
 }
 
@@ -275,7 +517,9 @@ type registrationResponse struct {
     ClientID     string `json:"client_id"`
     APIKey       string `json:"api_key"`
     Cluster      struct {
+        ID         string `json:"id"`
         HeadendURL string `json:"headend_url"`
+        Region     string `json:"region"`
     } `json:"cluster"`
     Certificates struct {
         Cert string `json:"cert"`
@@ -287,6 +531,18 @@ type registrationResponse struct {
 func (c *Client) authenticate() error {
     fmt.Println("Authenticating with JWT...")
 
+    err := c.session.Login()
+    c.saveAuthState()
+    if err != nil {
+        return err
+    }
+
+    fmt.Println("JWT authentication successful")
+    return nil
+}
+
+// requestToken logs in to the Manager with the client's API key
+func (c *Client) requestToken() (*auth.TokenInfo, error) {
     authReq := map[string]interface{}{
         "node_id":   c.clientID,
         "node_type": "client_native",
@@ -297,22 +553,25 @@ func (c *Client) authenticate() error {
     
     req, err := http.NewRequest("POST", c.config.ManagerURL+"/api/v1/auth/token", strings.NewReader(string(reqBody)))
     if err != nil {
-        return err
+        return nil, err
     }
 
     req.Header.Set("Content-Type", "application/json")
 
     resp, err := c.httpClient.Do(req)
     if err != nil {
-        return fmt.Errorf("authentication request failed: %w", err)
+        return nil, fmt.Errorf("authentication request failed: %w: %w", ErrManagerUnavailable, err)
     }
     defer func() {
         _ = resp.Body.Close()
     }()
 
+    if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+        return nil, fmt.Errorf("authentication failed with status %d: %w", resp.StatusCode, auth.ErrUnauthorized)
+    }
     if resp.StatusCode != http.StatusOK {
         body, _ := io.ReadAll(resp.Body)
-        return fmt.Errorf("authentication failed with status %d: %s", resp.StatusCode, body)
+        return nil, managerStatusError(resp.StatusCode, fmt.Errorf("authentication failed with status %d: %s", resp.StatusCode, body))
     }
 
     var authResp struct {
@@ -322,19 +581,32 @@ func (c *Client) authenticate() error {
     }
 
     if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
-        return fmt.Errorf("failed to parse authentication response: %w", err)
+        return nil, fmt.Errorf("failed to parse authentication response: %w", err)
     }
 
-    c.accessToken = authResp.AccessToken
-    c.refreshToken = authResp.RefreshToken
-
-    fmt.Println("JWT authentication successful")
-    return nil
+    // The session reads the expiry from the token itself
+    return &auth.TokenInfo{
+        AccessToken:  authResp.AccessToken,
+        RefreshToken: authResp.RefreshToken,
+        TokenType:    "Bearer",
+    }, nil
 }
 
 func (c *Client) setupWireGuard() error {
     fmt.Println("Setting up WireGuard configuration...")
 
+    ipAddress, networkCIDR, err := c.requestWireGuardConfig()
+    if err != nil {
+        return err
+    }
+
+    // Create WireGuard configuration file
+    return c.createWireGuardConfig(ipAddress, networkCIDR)
+}
+
+// requestWireGuardConfig asks the Manager for our tunnel address and the
+// WireGuard network it belongs to, adopting its keys if it sent any
+func (c *Client) requestWireGuardConfig() (ipAddress, networkCIDR string, err error) {
     wgReq := map[string]interface{}{
         "node_id":   c.clientID,
         "node_type": "client_native",
@@ -346,15 +618,15 @@ func (c *Client) setupWireGuard() error {
     keysURL := c.config.ManagerURL + "/api/v1/wireguard/keys"
     req, err := http.NewRequest("POST", keysURL, strings.NewReader(string(reqBody)))
     if err != nil {
-        return err
+        return "", "", err
     }
 
     req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("Authorization", "Bearer "+c.accessToken)
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
 
     resp, err := c.httpClient.Do(req)
     if err != nil {
-        return fmt.Errorf("WireGuard config request failed: %w", err)
+        return "", "", fmt.Errorf("WireGuard config request failed: %w: %w", ErrManagerUnavailable, err)
     }
     defer func() {
         _ = resp.Body.Close()
@@ -362,7 +634,7 @@ func (c *Client) setupWireGuard() error {
 
     if resp.StatusCode != http.StatusOK {
         body, _ := io.ReadAll(resp.Body)
-        return fmt.Errorf("WireGuard config failed with status %d: %s", resp.StatusCode, body)
+        return "", "", managerStatusError(resp.StatusCode, fmt.Errorf("WireGuard config failed with status %d: %s", resp.StatusCode, body))
     }
 
     var wgResp struct {
@@ -371,11 +643,14 @@ func (c *Client) setupWireGuard() error {
             PublicKey   string `json:"public_key"`
             IPAddress   string `json:"ip_address"`
             NetworkCIDR string `json:"network_cidr"`
+            // Set on dual-stack networks
+            IPAddress6   string `json:"ip_address6"`
+            NetworkCIDR6 string `json:"network_cidr6"`
         } `json:"wireguard"`
     }
 
     if err := json.NewDecoder(resp.Body).Decode(&wgResp); err != nil {
-        return fmt.Errorf("failed to parse WireGuard response: %w", err)
+        return "", "", fmt.Errorf("failed to parse WireGuard response: %w", err)
     }
 
     // Update WireGuard keys if provided by server
@@ -387,18 +662,55 @@ func (c *Client) setupWireGuard() error {
         }
     }
 
-    // Create WireGuard configuration file
-    return c.createWireGuardConfig(wgResp.WireGuard.IPAddress, wgResp.WireGuard.NetworkCIDR)
+    c.wgAddress = wgResp.WireGuard.IPAddress
+    c.wgNetwork = wgResp.WireGuard.NetworkCIDR
+    c.wgAddress6 = wgResp.WireGuard.IPAddress6
+    c.wgNetwork6 = wgResp.WireGuard.NetworkCIDR6
+    return wgResp.WireGuard.IPAddress, wgResp.WireGuard.NetworkCIDR, nil
 }
 
 func (c *Client) createWireGuardConfig(ipAddress, networkCIDR string) error {
-    configPath := c.getWireGuardConfigPath()
+    data := []byte(c.renderWireGuardConfig(ipAddress))
+    if c.config.EncryptAtRest {
+        // Only the sealed copy stays on disk; wg-quick gets a plaintext
+        // one while it runs
+        return c.config.WriteFile(c.config.GetWireGuardConfigPath(), data)
+    }
+    return os.WriteFile(c.getWireGuardConfigPath(), data, 0600)
+}
 
-    // Extract headend connection details
-    headendHost := strings.TrimPrefix(c.headendURL, "https://")
-    headendHost = strings.TrimPrefix(headendHost, "http://")
-    headendHost = strings.Split(headendHost, ":")[0]
+// readWireGuardConfig returns the tunnel configuration last written
+func (c *Client) readWireGuardConfig() ([]byte, error) {
+    if c.config.EncryptAtRest {
+        return config.ReadFile(c.config.GetWireGuardConfigPath())
+    }
+    return os.ReadFile(c.getWireGuardConfigPath())
+}
+
+// runWGQuick runs wg-quick with the tunnel configuration. With encryption
+// at rest, the plaintext configuration wg-quick needs is written for the
+// command and removed after it.
+func (c *Client) runWGQuick(name, action string) ([]byte, error) {
+    configPath := c.getWireGuardConfigPath()
+    if c.config.EncryptAtRest {
+        data, err := c.readWireGuardConfig()
+        if err != nil {
+            return nil, fmt.Errorf("failed to read WireGuard configuration: %w", err)
+        }
+        if err := os.WriteFile(configPath, data, 0600); err != nil {
+            return nil, err
+        }
+        defer os.Remove(configPath)
+    }
+    return exec.Command(name, action, configPath).CombinedOutput()
+}
 
+// renderWireGuardConfig renders our wg-quick configuration for ipAddress,
+// adding the IPv6 address on dual-stack networks
+func (c *Client) renderWireGuardConfig(ipAddress string) string {
+    if c.wgAddress6 != "" {
+        ipAddress += ", " + c.wgAddress6
+    }
     config := fmt.Sprintf(`[Interface]
 Address = %s
 PrivateKey = %s
@@ -406,56 +718,73 @@ DNS = 10.200.0.1
 
 [Peer]
 PublicKey = %s
-Endpoint = %s:51820
-AllowedIPs = 0.0.0.0/0, ::/0
-PersistentKeepalive = 25
-`, ipAddress, c.wgPrivateKey.String(), c.headendPublicKey.String(), headendHost)
+Endpoint = %s
+AllowedIPs = %s
+PersistentKeepalive = %d
+`, ipAddress, c.wgPrivateKey.String(), c.headendPublicKey.String(), c.headendEndpoint(), c.allowedIPs(),
+        int(c.powerMonitor.Current().Keepalive.Seconds()))
 
-    return os.WriteFile(configPath, []byte(config), 0600)
+    return config
+}
+
+// headendEndpoint returns the headend's WireGuard endpoint
+func (c *Client) headendEndpoint() string {
+    // Backup headend lists name it
+    if c.headendWGEndpoint != "" {
+        return c.headendWGEndpoint
+    }
+
+    // Extract headend connection details
+    headendHost := strings.TrimPrefix(c.headendURL, "https://")
+    headendHost = strings.TrimPrefix(headendHost, "http://")
+    headendHost = strings.Split(headendHost, ":")[0]
+
+    return headendHost + ":51820"
 }
 
 func (c *Client) startWireGuard() error {
     fmt.Println("Starting WireGuard interface...")
 
     interfaceName := c.getWireGuardInterface()
-    configPath := c.getWireGuardConfigPath()
 
-    var cmd *exec.Cmd
+    var output []byte
+    var err error
     switch runtime.GOOS {
     case platformDarwin, platformLinux:
-        cmd = exec.Command("wg-quick", "up", configPath)
+        output, err = c.runWGQuick("wg-quick", "up")
     case platformWindows:
         // On Windows, we'd need to use WireGuard service
         // Use WireGuard for Windows service
-        cmd = exec.Command("wg-quick.exe", "up", configPath)
+        output, err = c.runWGQuick("wg-quick.exe", "up")
     default:
         return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
     }
 
-    if output, err := cmd.CombinedOutput(); err != nil {
+    if err != nil {
         return fmt.Errorf("failed to start WireGuard: %v, output: %s", err, output)
     }
 
     fmt.Printf("WireGuard interface %s started successfully\n", interfaceName)
+    c.snapshotTunnel()
     return nil
 }
 
 func (c *Client) stopWireGuard() error {
     interfaceName := c.getWireGuardInterface()
-    configPath := c.getWireGuardConfigPath()
 
-    var cmd *exec.Cmd
+    var output []byte
+    var err error
     switch runtime.GOOS {
     case platformDarwin, platformLinux:
-        cmd = exec.Command("wg-quick", "down", configPath)
+        output, err = c.runWGQuick("wg-quick", "down")
     case platformWindows:
         // Use WireGuard for Windows service
-        cmd = exec.Command("wg-quick.exe", "up", configPath)
+        output, err = c.runWGQuick("wg-quick.exe", "up")
     default:
         return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
     }
 
-    if output, err := cmd.CombinedOutput(); err != nil {
+    if err != nil {
         return fmt.Errorf("failed to stop WireGuard: %v, output: %s", err, output)
     }
 
@@ -466,23 +795,87 @@ func (c *Client) stopWireGuard() error {
 func (c *Client) runMonitoring(ctx context.Context) error {
     fmt.Println("Starting connection monitoring...")
 
-    ticker := time.NewTicker(30 * time.Second)
-    defer ticker.Stop()
+    timer := time.NewTimer(c.powerMonitor.Current().HealthCheck)
+    defer timer.Stop()
+
+    // Tokens are refreshed ahead of expiry rather than when a health
+    // check happens to notice
+    refresh := time.NewTimer(c.session.NextRefresh())
+    defer refresh.Stop()
+
+    var sleepWatcher *power.SleepWatcher
+    if c.config.PauseOnSleep {
+        sleepWatcher = power.WatchSleep(ctx)
+    }
+
+    // Routes other software changes are checked once the burst settles
+    networkEvents := c.watchTunnel(ctx)
+    tamperCheck := time.NewTimer(tamperCheckDelay)
+    tamperCheck.Stop()
+    defer tamperCheck.Stop()
+    tamperEvent := ""
 
     for {
         select {
         case <-ctx.Done():
             fmt.Println("Monitoring stopped")
             return c.Disconnect()
-        case <-ticker.C:
+        case event := <-sleepWatcher.Events():
+            if event.Sleeping {
+                c.pauseForSleep()
+                sleepWatcher.Ready()
+                continue
+            }
+            if err := c.resumeFromSleep(event.Slept); err != nil {
+                // The cached session is no good, start over
+                if disconnectErr := c.Disconnect(); disconnectErr != nil {
+                    fmt.Printf("Disconnect after failed resume: %v\n", disconnectErr)
+                }
+                return fmt.Errorf("resume after sleep failed: %w", err)
+            }
+            // The session may have expired while we slept
+            if err := c.healthCheck(); err != nil {
+                fmt.Printf("Health check failed: %v\n", err)
+            }
+            timer.Reset(c.powerMonitor.Current().HealthCheck)
+            refresh.Reset(c.session.NextRefresh())
+        case <-refresh.C:
+            if err := c.checkAuthentication(); err != nil {
+                fmt.Printf("Session refresh failed: %v\n", err)
+            }
+            refresh.Reset(c.session.NextRefresh())
+        case <-timer.C:
             if err := c.healthCheck(); err != nil {
                 fmt.Printf("Health check failed: %v\n", err)
             }
+            c.adaptToPowerState()
+            timer.Reset(c.powerMonitor.Current().HealthCheck)
+        case event, ok := <-networkEvents:
+            if !ok {
+                networkEvents = nil
+                continue
+            }
+            if c.touchesTunnel(event) {
+                if tamperEvent == "" {
+                    tamperEvent = event.String()
+                }
+                tamperCheck.Reset(tamperCheckDelay)
+            }
+        case <-tamperCheck.C:
+            if detail := c.checkTunnel(tamperEvent); detail != "" {
+                c.repairTunnel(detail)
+            }
+            tamperEvent = ""
         }
     }
 }
 
 func (c *Client) healthCheck() error {
+    // Put back routes and marks other software changed unnoticed
+    if detail := c.checkTunnel(""); detail != "" {
+        c.repairTunnel(detail)
+    }
+
     // Check WireGuard interface
     interfaceName := c.getWireGuardInterface()
     if _, err := c.wg.Device(interfaceName); err != nil {
@@ -494,13 +887,64 @@ func (c *Client) healthCheck() error {
         return fmt.Errorf("authentication check failed: %w", err)
     }
 
+    // Make sure DNS is not escaping the tunnel
+    if c.config.DNSLeakProtection && time.Since(c.lastLeakCheck) >= c.powerMonitor.Current().ConfigCheck {
+        c.lastLeakCheck = time.Now()
+        if leakStatus := c.dnsGuard.Check(context.Background()); leakStatus.State == dnsguard.StateLeaking {
+            fmt.Printf("WARNING: DNS leak detected: %s\n", leakStatus.Detail)
+        }
+    }
+
+    // Refresh the SaaS bypass list, failing closed if it has expired
+    if err := c.refreshBypass(); err != nil {
+        fmt.Printf("SaaS bypass refresh failed: %v\n", err)
+    }
+
+    // Keep the backup headend list fresh for the next Manager outage
+    if time.Now().After(c.backupRefreshAt) {
+        if err := c.refreshBackupHeadends(); err != nil {
+            fmt.Printf("Backup headend list refresh failed: %v\n", err)
+        }
+    }
+
+    // Pick up feature flag changes for the next negotiation
+    if err := c.refreshFeatureFlags(); err != nil {
+        fmt.Printf("Feature flag refresh failed: %v\n", err)
+    }
+
+    // Follow the headend to its peer if it is going into maintenance
+    if err := c.checkMigration(); err != nil {
+        fmt.Printf("Migration check failed: %v\n", err)
+    }
+
+    // Tell the user if we've been quarantined, or released
+    if err := c.checkQuarantine(); err != nil {
+        fmt.Printf("Quarantine check failed: %v\n", err)
+    }
+
+    // Keep the local policy in step with the headend
+    if c.localPolicy.expired() {
+        if err := c.refreshLocalPolicy(); err != nil {
+            return fmt.Errorf("local policy refresh failed: %w", err)
+        }
+    }
+
     return nil
 }
 
+// checkAuthentication renews the JWT once it is within the configured
+// refresh threshold of expiring. Renewal never needs the user: the rotated
+// refresh token is tried first, then the API key, and if the Manager has
+// forgotten the client altogether it registers again, so unattended
+// clients keep their session for as long as they run.
 func (c *Client) checkAuthentication() error {
-    // Check JWT token expiry and refresh if needed
-    // For now, this is a placeholder for proper authentication checks
-    return nil
+    err := c.session.Ensure()
+    if errors.Is(err, auth.ErrUnauthorized) {
+        fmt.Printf("Manager rejected our credentials, registering again: %v\n", err)
+        err = c.reregister()
+    }
+    c.saveAuthState()
+    return err
 }
 
 func (c *Client) getWireGuardInterface() string {
@@ -574,7 +1018,8 @@ func (c *Client) saveCertificates(cert, key, ca string) error {
         return err
     }
 
-    if err := os.WriteFile(certDir+"/client.key", []byte(key), 0600); err != nil {
+    // The key is sealed like the other files when encryption at rest is on
+    if err := c.config.WriteFile(certDir+"/client.key", []byte(key)); err != nil {
         return err
     }
 
@@ -585,7 +1030,38 @@ func (c *Client) saveCertificates(cert, key, ca string) error {
     return nil
 }
 
+// useClientCertificate makes HTTPS requests present the Manager issued
+// client certificate
+func (c *Client) useClientCertificate(cert, key string) error {
+    if cert == "" || key == "" {
+        return nil
+    }
+
+    pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+    if err != nil {
+        return err
+    }
+
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = &tls.Config{
+        Certificates: []tls.Certificate{pair},
+        MinVersion:   tls.VersionTLS12,
+    }
+    c.httpClient.Transport = transport
+    return nil
+}
+
+// getCertificateDir returns where the current cluster's certificates are
+// kept, apart from those of the user's other clusters
 func (c *Client) getCertificateDir() string {
+    dir := certificateBaseDir()
+    if cluster := c.config.ClusterID(); cluster != "" {
+        return filepath.Join(dir, "clusters", cluster)
+    }
+    return dir
+}
+
+func certificateBaseDir() string {
     switch runtime.GOOS {
     case platformDarwin:
         return os.Getenv("HOME") + "/.sasewaddle/certs"
@@ -0,0 +1,164 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/config"
+)
+
+// clusterProbeTimeout bounds measuring the latency to one cluster
+const clusterProbeTimeout = 3 * time.Second
+
+// Cluster is a headend cluster the user can connect to
+type Cluster struct {
+    ID         string `json:"id"`
+    Name       string `json:"name"`
+    Region     string `json:"region"`
+    Datacenter string `json:"datacenter"`
+    HeadendURL string `json:"headend_url"`
+    Status     string `json:"status"`
+    // Allowed is false when policy does not permit this client to use the cluster
+    Allowed bool `json:"allowed"`
+    // Latency is the TCP connect time to the headend, zero if it was not
+    // measured or the headend could not be reached
+    Latency time.Duration `json:"latency,omitempty"`
+}
+
+// ListClusters returns the clusters known to the Manager, with the one
+// this client is currently assigned to
+func (c *Client) ListClusters() ([]Cluster, string, error) {
+    return listClusters(c.httpClient, c.config)
+}
+
+// FetchClusters is ListClusters for callers without a Client, such as the
+// tray's cluster switcher
+func FetchClusters(cfg *config.Config) ([]Cluster, string, error) {
+    return listClusters(&http.Client{Timeout: 30 * time.Second}, cfg)
+}
+
+func listClusters(httpClient *http.Client, cfg *config.Config) ([]Cluster, string, error) {
+    req, err := http.NewRequest("GET", cfg.ManagerURL+"/api/v1/clients/clusters", nil)
+    if err != nil {
+        return nil, "", err
+    }
+    req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return nil, "", fmt.Errorf("cluster list request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return nil, "", fmt.Errorf("cluster list failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var clustersResp struct {
+        Current  string    `json:"current"`
+        Clusters []Cluster `json:"clusters"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&clustersResp); err != nil {
+        return nil, "", fmt.Errorf("failed to parse cluster list: %w", err)
+    }
+
+    return clustersResp.Clusters, clustersResp.Current, nil
+}
+
+// MeasureClusters measures the latency to each allowed cluster's headend
+// concurrently and sorts the clusters fastest first, unreachable and
+// disallowed ones last
+func MeasureClusters(clusters []Cluster) {
+    var wg sync.WaitGroup
+    for i := range clusters {
+        if !clusters[i].Allowed {
+            continue
+        }
+        wg.Add(1)
+        go func(cluster *Cluster) {
+            defer wg.Done()
+            cluster.Latency = probeHeadend(cluster.HeadendURL)
+        }(&clusters[i])
+    }
+    wg.Wait()
+
+    rank := func(cluster Cluster) time.Duration {
+        if !cluster.Allowed || cluster.Latency == 0 {
+            return time.Duration(math.MaxInt64)
+        }
+        return cluster.Latency
+    }
+    sort.SliceStable(clusters, func(i, j int) bool {
+        return rank(clusters[i]) < rank(clusters[j])
+    })
+}
+
+// probeHeadend returns how long a TCP connection to the headend takes, or
+// zero if it cannot be reached
+func probeHeadend(headendURL string) time.Duration {
+    u, err := url.Parse(headendURL)
+    if err != nil || u.Hostname() == "" {
+        return 0
+    }
+    port := u.Port()
+    if port == "" {
+        port = "443"
+        if u.Scheme == "http" {
+            port = "80"
+        }
+    }
+
+    start := time.Now()
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), clusterProbeTimeout)
+    if err != nil {
+        return 0
+    }
+    latency := time.Since(start)
+    _ = conn.Close()
+    return latency
+}
+
+// selectCluster settles which cluster to register with: the configured
+// one, or the allowed cluster with the lowest latency. With no choice to
+// make, or a Manager that cannot list clusters, it is left to the Manager.
+func (c *Client) selectCluster() {
+    c.config.ActiveCluster = ""
+    if cluster := c.config.ClusterID(); cluster != "" {
+        c.clusterID = cluster
+        return
+    }
+    c.clusterID = ""
+
+    clusters, _, err := c.ListClusters()
+    if err != nil {
+        fmt.Printf("Cluster list not fetched, the Manager will choose: %v\n", err)
+        return
+    }
+
+    allowed := 0
+    for _, cluster := range clusters {
+        if cluster.Allowed {
+            allowed++
+        }
+    }
+    if allowed < 2 {
+        return
+    }
+
+    MeasureClusters(clusters)
+    if best := clusters[0]; best.Allowed && best.Latency > 0 {
+        fmt.Printf("Selected cluster %s (%s) with %s latency\n", best.ID, best.Name, best.Latency.Round(time.Millisecond))
+        c.clusterID = best.ID
+    }
+}
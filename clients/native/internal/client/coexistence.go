@@ -0,0 +1,61 @@
+package client
+
+import (
+    "fmt"
+    "net/netip"
+    "strings"
+
+    "github.com/tobogganing/clients/native/internal/coexist"
+)
+
+// checkCoexistence looks for other active VPN clients and applies the
+// coexistence policy: refusing to connect, or narrowing the tunnel's
+// allowed IPs when the tunnel configuration is next written
+func (c *Client) checkCoexistence() error {
+    c.otherVPNs = coexist.Detect(c.getWireGuardInterface())
+    if len(c.otherVPNs) == 0 {
+        return nil
+    }
+
+    var found []string
+    for _, vpn := range c.otherVPNs {
+        found = append(found, vpn.String())
+    }
+    others := strings.Join(found, "; ")
+
+    switch c.coexistence {
+    case coexist.PolicyRefuse:
+        return fmt.Errorf("another VPN is active (%s); disconnect it or change vpn_coexistence", others)
+    case coexist.PolicySplit:
+        fmt.Printf("Another VPN is active (%s), routing only the SASEWaddle network through the tunnel\n", others)
+    case coexist.PolicyPrecedence:
+        fmt.Printf("Another VPN is active (%s), routing the SASEWaddle network and %s through the tunnel\n",
+            others, strings.Join(c.config.VPNCoexistenceCIDRs, ", "))
+    default:
+        fmt.Printf("WARNING: another VPN is active (%s), routing may conflict; set vpn_coexistence to choose the behavior\n", others)
+    }
+    return nil
+}
+
+// allowedIPs returns the tunnel's allowed IPs under the coexistence policy
+func (c *Client) allowedIPs() string {
+    var networks []netip.Prefix
+    for _, cidr := range []string{c.wgNetwork, c.wgNetwork6} {
+        if network, err := netip.ParsePrefix(cidr); err == nil {
+            networks = append(networks, network)
+        }
+    }
+    var precedence []netip.Prefix
+    for _, cidr := range c.config.VPNCoexistenceCIDRs {
+        // Validated with the rest of the configuration
+        if prefix, err := netip.ParsePrefix(cidr); err == nil {
+            precedence = append(precedence, prefix)
+        }
+    }
+
+    var allowed []string
+    for _, prefix := range coexist.AllowedIPs(c.coexistence, c.otherVPNs, networks, precedence) {
+        allowed = append(allowed, prefix.String())
+    }
+    return strings.Join(allowed, ", ")
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+    "context"
+    "fmt"
+    "net/netip"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/netns"
+    "github.com/tobogganing/libs/wgconfig"
+)
+
+// ContainerTarget names a container to join to the SASE network
+type ContainerTarget struct {
+    Runtime   string // docker or podman
+    Container string // name or ID
+    PID       int    // container init process; skips the runtime lookup when set
+    Interface string // tunnel interface name inside the container
+    // Routes sent through the tunnel; empty routes only the WireGuard network
+    Routes []netip.Prefix
+}
+
+// AttachContainer joins a single container, rather than the host, to the
+// SASE network. The container gets its own registration and tunnel address
+// and reaches internal services through the tunnel while the rest of its
+// traffic stays on the container network. It blocks until ctx is cancelled
+// or the container stops, then detaches.
+func (c *Client) AttachContainer(ctx context.Context, target ContainerTarget) error {
+    pid, err := target.pid()
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("Attaching container %s (PID %d) to SASEWaddle network...\n", target.Container, pid)
+
+    if err := c.register(); err != nil {
+        return fmt.Errorf("registration failed: %w", err)
+    }
+    if err := c.authenticate(); err != nil {
+        return fmt.Errorf("authentication failed: %w", err)
+    }
+    if err := c.refreshFeatureFlags(); err != nil {
+        fmt.Printf("Feature flags not fetched, using defaults: %v\n", err)
+    }
+    if err := c.negotiateCapabilities(); err != nil {
+        fmt.Printf("Capability negotiation failed, using baseline: %v\n", err)
+    }
+
+    ipAddress, networkCIDR, err := c.requestWireGuardConfig()
+    if err != nil {
+        return fmt.Errorf("WireGuard setup failed: %w", err)
+    }
+    wgConfig, err := wgconfig.ParseString(c.renderWireGuardConfig(ipAddress))
+    if err != nil {
+        return fmt.Errorf("invalid WireGuard configuration: %w", err)
+    }
+
+    routes := target.Routes
+    if len(routes) == 0 {
+        network, err := netip.ParsePrefix(networkCIDR)
+        if err != nil {
+            return fmt.Errorf("invalid WireGuard network %q: %w", networkCIDR, err)
+        }
+        routes = []netip.Prefix{network}
+    }
+
+    if err := netns.Attach(pid, target.Interface, wgConfig, routes); err != nil {
+        return fmt.Errorf("failed to attach container: %w", err)
+    }
+    fmt.Printf("Container %s attached as %s on %s, routing %v\n", target.Container, ipAddress, target.Interface, routes)
+
+    enrollment := c.Enrollment()
+    enrollment.Kind = "container"
+    enrollment.WireGuard.Interface = target.Interface
+    if err := c.emitEnrollment(enrollment); err != nil {
+        fmt.Printf("WARNING: bootstrap output not written: %v\n", err)
+    }
+
+    return c.monitorContainer(ctx, target, pid)
+}
+
+// monitorContainer keeps the attached container's session alive until ctx
+// is cancelled or the container goes away
+func (c *Client) monitorContainer(ctx context.Context, target ContainerTarget, pid int) error {
+    timer := time.NewTimer(c.powerMonitor.Current().HealthCheck)
+    defer timer.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            fmt.Printf("Detaching container %s\n", target.Container)
+            if err := netns.Detach(pid, target.Interface); err != nil {
+                return fmt.Errorf("failed to detach container: %w", err)
+            }
+            return nil
+        case <-timer.C:
+            // A restarted container has a new namespace and needs attaching again
+            if current, err := target.pid(); err != nil || current != pid {
+                return fmt.Errorf("container %s stopped", target.Container)
+            }
+            if err := c.checkAuthentication(); err != nil {
+                fmt.Printf("Authentication check failed: %v\n", err)
+            }
+            timer.Reset(c.powerMonitor.Current().HealthCheck)
+        }
+    }
+}
+
+// pid finds the process whose network namespace the container uses
+func (t ContainerTarget) pid() (int, error) {
+    if t.PID == 0 {
+        return netns.ContainerPID(t.Runtime, t.Container)
+    }
+    if !netns.ProcessExists(t.PID) {
+        return 0, fmt.Errorf("process %d of container %s is gone", t.PID, t.Container)
+    }
+    return t.PID, nil
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/config"
+    "github.com/tobogganing/libs/framing"
+)
+
+const (
+    // featureDenialFrames must be negotiated before the headend explains
+    // refused connections with a denial frame
+    featureDenialFrames = "denial_frames"
+
+    // maxRecentDenials is how many denials the status output keeps
+    maxRecentDenials = 10
+)
+
+// Denial is a connection the headend refused, as shown in the status output
+type Denial struct {
+    framing.Denial
+    At time.Time `json:"at"`
+}
+
+// denialsMu serializes updates of the denials file, which the status
+// command reads from another process
+var denialsMu sync.Mutex
+
+// deniableConn is a stream through the headend that may open with a denial
+// frame instead of the target's data
+type deniableConn struct {
+    net.Conn
+    client  *Client
+    reader  *bufio.Reader
+    checked bool
+}
+
+// watchForDenial makes the first read from conn report a denial frame as a
+// *framing.Denial error, so callers learn why the headend refused it
+func (c *Client) watchForDenial(conn net.Conn) net.Conn {
+    return &deniableConn{Conn: conn, client: c, reader: bufio.NewReader(conn)}
+}
+
+func (d *deniableConn) Read(p []byte) (int, error) {
+    if !d.checked {
+        d.checked = true
+        denial, err := framing.ReadDenial(d.reader)
+        if denial != nil {
+            d.client.recordDenial(denial)
+            _ = d.Conn.Close()
+            return 0, denial
+        }
+        if err != nil {
+            return 0, err
+        }
+    }
+    return d.reader.Read(p)
+}
+
+// CloseWrite lets callers half-close the stream
+func (d *deniableConn) CloseWrite() error {
+    if cw, ok := d.Conn.(interface{ CloseWrite() error }); ok {
+        return cw.CloseWrite()
+    }
+    return nil
+}
+
+// recordDenial logs a denial and keeps it for the status output
+func (c *Client) recordDenial(denial *framing.Denial) {
+    fmt.Printf("WARNING: %v\n", denial)
+
+    denialsMu.Lock()
+    defer denialsMu.Unlock()
+
+    denials := c.loadDenials()
+    denials = append(denials, Denial{Denial: *denial, At: time.Now()})
+    if len(denials) > maxRecentDenials {
+        denials = denials[len(denials)-maxRecentDenials:]
+    }
+
+    data, err := json.MarshalIndent(denials, "", "  ")
+    if err != nil {
+        return
+    }
+    if err := c.config.WriteFile(c.config.GetDenialsPath(), data); err != nil {
+        fmt.Printf("Failed to save denial: %v\n", err)
+    }
+}
+
+// RecentDenials returns the most recent connections the headend refused,
+// oldest first
+func (c *Client) RecentDenials() []Denial {
+    denialsMu.Lock()
+    defer denialsMu.Unlock()
+    return c.loadDenials()
+}
+
+func (c *Client) loadDenials() []Denial {
+    data, err := config.ReadFile(c.config.GetDenialsPath())
+    if err != nil {
+        if !errors.Is(err, os.ErrNotExist) {
+            fmt.Printf("Failed to read recent denials: %v\n", err)
+        }
+        return nil
+    }
+    var denials []Denial
+    if err := json.Unmarshal(data, &denials); err != nil {
+        fmt.Printf("Failed to parse recent denials: %v\n", err)
+        return nil
+    }
+    return denials
+}
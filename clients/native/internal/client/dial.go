@@ -0,0 +1,54 @@
+package client
+
+import (
+    "fmt"
+    "net"
+    "net/url"
+    "time"
+
+    "github.com/tobogganing/libs/framing"
+)
+
+// headendTCPPort is the headend's authenticated TCP proxy listener
+const headendTCPPort = "8444"
+
+// DialThroughHeadend opens a TCP stream to target (host:port) through the
+// headend's TCP proxy. The connection header uses the binary framing when
+// the headend negotiated protocol v2 and the legacy text header otherwise.
+func (c *Client) DialThroughHeadend(target string) (net.Conn, error) {
+    token := c.session.AccessToken()
+    if token == "" || c.headendURL == "" {
+        return nil, fmt.Errorf("not connected to a headend")
+    }
+
+    headendURL, err := url.Parse(c.headendURL)
+    if err != nil {
+        return nil, fmt.Errorf("invalid headend URL: %w", err)
+    }
+
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(headendURL.Hostname(), headendTCPPort), 10*time.Second)
+    if err != nil {
+        return nil, fmt.Errorf("failed to reach headend proxy: %w", err)
+    }
+
+    var header []byte
+    if c.capabilities != nil && c.capabilities.ProtocolVersion >= protocolV2 {
+        header, err = framing.Encode(token, target)
+        if err != nil {
+            _ = conn.Close()
+            return nil, fmt.Errorf("failed to encode connection header: %w", err)
+        }
+    } else {
+        header = framing.EncodeLegacy(token, target)
+    }
+
+    if _, err := conn.Write(header); err != nil {
+        _ = conn.Close()
+        return nil, fmt.Errorf("failed to send connection header: %w", err)
+    }
+
+    if c.capabilities.Has(featureDenialFrames) {
+        return c.watchForDenial(conn), nil
+    }
+    return conn, nil
+}
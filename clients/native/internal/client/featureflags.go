@@ -0,0 +1,92 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/tobogganing/libs/featureflag"
+)
+
+const (
+    // featureFlagRefresh is how often the Manager's flag rules are fetched
+    featureFlagRefresh = 10 * time.Minute
+    // featureFlagRetry is how soon a failed fetch is retried
+    featureFlagRetry = time.Minute
+)
+
+// fetchFeatureFlags retrieves the feature flag rules from our configuration
+// payload. Managers that predate feature flags send none, so the defaults
+// apply.
+func (c *Client) fetchFeatureFlags() (featureflag.Payload, error) {
+    req, err := http.NewRequest("GET", c.config.ManagerURL+"/api/v1/clients/"+url.PathEscape(c.clientID)+"/config", nil)
+    if err != nil {
+        return featureflag.Payload{}, err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return featureflag.Payload{}, fmt.Errorf("client configuration request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return featureflag.Payload{}, fmt.Errorf("client configuration failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var payload struct {
+        FeatureFlags featureflag.Payload `json:"feature_flags"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+        return featureflag.Payload{}, fmt.Errorf("failed to parse client configuration: %w", err)
+    }
+    return payload.FeatureFlags, nil
+}
+
+// refreshFeatureFlags fetches and applies the flag rules when they are due.
+// If the Manager cannot be reached the rules already applied stay in force.
+// Flags that shape the session take effect at its next negotiation.
+func (c *Client) refreshFeatureFlags() error {
+    if time.Now().Before(c.flagsRefreshAt) {
+        return nil
+    }
+
+    payload, err := c.fetchFeatureFlags()
+    if err != nil {
+        c.flagsRefreshAt = time.Now().Add(featureFlagRetry)
+        return err
+    }
+    c.flagsRefreshAt = time.Now().Add(featureFlagRefresh)
+
+    previous := c.featureFlags.Version()
+    if err := c.featureFlags.Apply(payload); err != nil {
+        fmt.Printf("Ignoring invalid feature flag rules, their defaults apply: %v\n", err)
+    }
+    if payload.Version != previous {
+        fmt.Printf("Feature flags %q applied: %v\n", payload.Version, c.featureFlags.Evaluate(c.flagSubject()))
+    }
+    return nil
+}
+
+// flagSubject describes this client for flag targeting, as the Manager
+// described it in the payload
+func (c *Client) flagSubject() featureflag.Subject {
+    return c.featureFlags.Subject(c.clientID)
+}
+
+// flagEnabled reports whether a feature flag is on for this client
+func (c *Client) flagEnabled(name string) bool {
+    return c.featureFlags.Enabled(name, c.flagSubject())
+}
+
+// FeatureFlags reports every feature flag for this client
+func (c *Client) FeatureFlags() map[string]bool {
+    return c.featureFlags.Evaluate(c.flagSubject())
+}
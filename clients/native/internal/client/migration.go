@@ -0,0 +1,159 @@
+package client
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    // featureMigration must be negotiated before the headend serves migration directives
+    featureMigration = "migration"
+
+    actionMigrate = "migrate"
+)
+
+// migrationDirective is the control message a draining headend sends to
+// move us to a peer headend
+type migrationDirective struct {
+    Action string `json:"action"`
+    Peer   *struct {
+        URL       string `json:"url"`
+        Endpoint  string `json:"endpoint"`
+        PublicKey string `json:"public_key"`
+    } `json:"peer"`
+    Ticket    string    `json:"ticket"`
+    CutoverBy time.Time `json:"cutover_by"`
+}
+
+// checkMigration polls the headend's control channel and migrates to the
+// peer headend it names, if any
+func (c *Client) checkMigration() error {
+    if !c.capabilities.Has(featureMigration) {
+        return nil
+    }
+
+    req, err := http.NewRequest("GET", strings.TrimSuffix(c.headendURL, "/")+"/session/control", nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("control request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("control request failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var directive migrationDirective
+    if err := json.NewDecoder(resp.Body).Decode(&directive); err != nil {
+        return fmt.Errorf("failed to parse control response: %w", err)
+    }
+    if directive.Action != actionMigrate || directive.Peer == nil {
+        return nil
+    }
+
+    fmt.Printf("Headend is going into maintenance, migrating to %s before %s\n",
+        directive.Peer.URL, directive.CutoverBy.Format(time.RFC3339))
+    return c.migrate(&directive)
+}
+
+// migrate establishes the session with the peer headend, which restores our
+// quota state from the ticket, then switches the tunnel over in one step
+func (c *Client) migrate(directive *migrationDirective) error {
+    peerKey, err := wgtypes.ParseKey(directive.Peer.PublicKey)
+    if err != nil {
+        return fmt.Errorf("invalid peer headend public key: %w", err)
+    }
+    endpoint, err := net.ResolveUDPAddr("udp", directive.Peer.Endpoint)
+    if err != nil {
+        return fmt.Errorf("invalid peer headend endpoint %q: %w", directive.Peer.Endpoint, err)
+    }
+
+    negotiated, err := c.redeemMigrationTicket(directive.Peer.URL, directive.Ticket)
+    if err != nil {
+        return err
+    }
+
+    // Replacing the peer moves the default route to the new headend at once
+    keepalive := c.powerMonitor.Current().Keepalive
+    _, allIPv4, _ := net.ParseCIDR("0.0.0.0/0")
+    _, allIPv6, _ := net.ParseCIDR("::/0")
+    err = c.wg.ConfigureDevice(c.getWireGuardInterface(), wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{
+            {PublicKey: c.headendPublicKey, Remove: true},
+            {
+                PublicKey:                   peerKey,
+                Endpoint:                    endpoint,
+                ReplaceAllowedIPs:           true,
+                AllowedIPs:                  []net.IPNet{*allIPv4, *allIPv6},
+                PersistentKeepaliveInterval: &keepalive,
+            },
+        },
+    })
+    if err != nil {
+        return fmt.Errorf("failed to switch tunnel to peer headend: %w", err)
+    }
+
+    c.headendURL = directive.Peer.URL
+    c.headendPublicKey = peerKey
+    c.capabilities = negotiated
+    fmt.Printf("Migrated to headend %s\n", c.headendURL)
+
+    // The local policy belongs to the old session
+    if err := c.refreshLocalPolicy(); err != nil {
+        fmt.Printf("Local policy not refreshed after migration: %v\n", err)
+    }
+    return nil
+}
+
+// redeemMigrationTicket presents the ticket to the peer headend and
+// negotiates the new session
+func (c *Client) redeemMigrationTicket(peerURL, ticket string) (*NegotiatedCapabilities, error) {
+    reqBody, _ := json.Marshal(map[string]interface{}{
+        "ticket":       ticket,
+        "capabilities": c.localCapabilities(),
+    })
+
+    req, err := http.NewRequest("POST", strings.TrimSuffix(peerURL, "/")+"/session/migrate", bytes.NewReader(reqBody))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("migration request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return nil, fmt.Errorf("peer headend refused migration with status %d: %s", resp.StatusCode, body)
+    }
+
+    var migrateResp struct {
+        Negotiated NegotiatedCapabilities `json:"negotiated"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&migrateResp); err != nil {
+        return nil, fmt.Errorf("failed to parse migration response: %w", err)
+    }
+    return &migrateResp.Negotiated, nil
+}
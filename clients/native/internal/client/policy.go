@@ -0,0 +1,211 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os/exec"
+    "runtime"
+    "strings"
+    "time"
+)
+
+const (
+    // featureLocalPolicy must be negotiated before the headend serves a local policy
+    featureLocalPolicy = "local_policy"
+
+    // localPolicyRuleName names the OS firewall chain, anchor or rule we own
+    localPolicyRuleName = "SASEWADDLE-LOCAL"
+)
+
+// LocalPolicy is the compact deny subset of the user's firewall policy that
+// the client enforces locally. The headend remains authoritative: anything
+// not blocked here is still evaluated when it reaches the headend.
+type LocalPolicy struct {
+    PolicyVersion string    `json:"policy_version"`
+    DenyDomains   []string  `json:"deny_domains"`
+    DenyCIDRs     []string  `json:"deny_cidrs"`
+    GeneratedAt   time.Time `json:"generated_at"`
+
+    networks  []*net.IPNet
+    expiresAt time.Time
+}
+
+// Blocks reports whether host (a domain or IP, with or without port) is
+// denied by the local policy
+func (p *LocalPolicy) Blocks(host string) bool {
+    if p == nil {
+        return false
+    }
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+    if ip := net.ParseIP(host); ip != nil {
+        for _, network := range p.networks {
+            if network.Contains(ip) {
+                return true
+            }
+        }
+        return false
+    }
+
+    for _, pattern := range p.DenyDomains {
+        if pattern == host {
+            return true
+        }
+        if strings.HasPrefix(pattern, "*.") {
+            base := pattern[2:]
+            if host == base || strings.HasSuffix(host, "."+base) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// expired reports whether the policy should be fetched again
+func (p *LocalPolicy) expired() bool {
+    return p == nil || time.Now().After(p.expiresAt)
+}
+
+// refreshLocalPolicy fetches the local deny policy from the headend and
+// installs it in the OS firewall. It is a no-op unless the feature was
+// negotiated and enabled in configuration.
+func (c *Client) refreshLocalPolicy() error {
+    if !c.config.LocalPolicy || !c.capabilities.Has(featureLocalPolicy) {
+        return nil
+    }
+
+    req, err := http.NewRequest("GET", strings.TrimSuffix(c.headendURL, "/")+"/session/policy", nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("local policy request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("local policy request failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var policyResp struct {
+        Policy     LocalPolicy `json:"policy"`
+        TTLSeconds int         `json:"ttl_seconds"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&policyResp); err != nil {
+        return fmt.Errorf("failed to parse local policy response: %w", err)
+    }
+
+    policy := &policyResp.Policy
+    for _, cidr := range policy.DenyCIDRs {
+        if _, network, err := net.ParseCIDR(cidr); err == nil {
+            policy.networks = append(policy.networks, network)
+        }
+    }
+    ttl := time.Duration(policyResp.TTLSeconds) * time.Second
+    if ttl <= 0 {
+        ttl = 5 * time.Minute
+    }
+    policy.expiresAt = time.Now().Add(ttl)
+
+    if err := c.installLocalPolicy(policy); err != nil {
+        return fmt.Errorf("failed to install local policy: %w", err)
+    }
+
+    c.localPolicy = policy
+    fmt.Printf("Local policy %q applied: %d domains, %d networks blocked locally\n",
+        policy.PolicyVersion, len(policy.DenyDomains), len(policy.networks))
+    return nil
+}
+
+// installLocalPolicy replaces the OS firewall rules we own with the policy's
+// denied networks. Domain denies are only enforced through Blocks.
+func (c *Client) installLocalPolicy(policy *LocalPolicy) error {
+    if err := c.clearLocalPolicy(); err != nil {
+        return err
+    }
+    if len(policy.networks) == 0 {
+        return nil
+    }
+
+    switch runtime.GOOS {
+    case platformLinux:
+        for _, network := range policy.networks {
+            tool := "iptables"
+            if network.IP.To4() == nil {
+                tool = "ip6tables"
+            }
+            if err := runFirewallCommand(tool, "-A", localPolicyRuleName, "-d", network.String(), "-j", "REJECT"); err != nil {
+                return err
+            }
+        }
+        return nil
+    case platformDarwin:
+        var rules strings.Builder
+        for _, network := range policy.networks {
+            fmt.Fprintf(&rules, "block return out quick to %s\n", network.String())
+        }
+        cmd := exec.Command("pfctl", "-a", "com.sasewaddle/local", "-f", "-")
+        cmd.Stdin = strings.NewReader(rules.String())
+        if output, err := cmd.CombinedOutput(); err != nil {
+            return fmt.Errorf("pfctl failed: %v, output: %s", err, output)
+        }
+        return nil
+    case platformWindows:
+        remote := make([]string, 0, len(policy.networks))
+        for _, network := range policy.networks {
+            remote = append(remote, network.String())
+        }
+        return runFirewallCommand("netsh", "advfirewall", "firewall", "add", "rule",
+            "name="+localPolicyRuleName, "dir=out", "action=block", "remoteip="+strings.Join(remote, ","))
+    default:
+        return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+    }
+}
+
+// clearLocalPolicy removes every OS firewall rule installed for the local
+// policy, leaving an empty (linux) chain hooked into OUTPUT
+func (c *Client) clearLocalPolicy() error {
+    switch runtime.GOOS {
+    case platformLinux:
+        for _, tool := range []string{"iptables", "ip6tables"} {
+            // Create the chain on first use; it already existing is fine
+            _ = exec.Command(tool, "-N", localPolicyRuleName).Run()
+            if err := runFirewallCommand(tool, "-F", localPolicyRuleName); err != nil {
+                return err
+            }
+            if exec.Command(tool, "-C", "OUTPUT", "-j", localPolicyRuleName).Run() != nil {
+                if err := runFirewallCommand(tool, "-I", "OUTPUT", "-j", localPolicyRuleName); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    case platformDarwin:
+        return runFirewallCommand("pfctl", "-a", "com.sasewaddle/local", "-F", "rules")
+    case platformWindows:
+        // Deleting a rule that does not exist fails, which is fine here
+        _ = exec.Command("netsh", "advfirewall", "firewall", "delete", "rule", "name="+localPolicyRuleName).Run()
+        return nil
+    default:
+        return nil
+    }
+}
+
+func runFirewallCommand(name string, args ...string) error {
+    if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+        return fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, output)
+    }
+    return nil
+}
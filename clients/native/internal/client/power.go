@@ -0,0 +1,45 @@
+package client
+
+import (
+    "fmt"
+    "time"
+
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// adaptToPowerState feeds tunnel activity to the power monitor and applies
+// a new WireGuard keepalive when the power state or activity changes it
+func (c *Client) adaptToPowerState() {
+    device, err := c.wg.Device(c.getWireGuardInterface())
+    if err != nil {
+        return
+    }
+
+    var total uint64
+    for _, peer := range device.Peers {
+        total += uint64(peer.ReceiveBytes + peer.TransmitBytes)
+    }
+
+    intervals, changed := c.powerMonitor.Update(total)
+    if !changed {
+        return
+    }
+
+    fmt.Printf("Power profile %s: keepalive %s, health checks every %s\n",
+        c.powerMonitor.Describe(), intervals.Keepalive, intervals.HealthCheck)
+
+    if err := c.setKeepalive(intervals.Keepalive); err != nil {
+        fmt.Printf("Failed to update WireGuard keepalive: %v\n", err)
+    }
+}
+
+// setKeepalive changes the persistent keepalive of the headend peer in place
+func (c *Client) setKeepalive(keepalive time.Duration) error {
+    return c.wg.ConfigureDevice(c.getWireGuardInterface(), wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{
+            PublicKey:                   c.headendPublicKey,
+            UpdateOnly:                  true,
+            PersistentKeepaliveInterval: &keepalive,
+        }},
+    })
+}
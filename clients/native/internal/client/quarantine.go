@@ -0,0 +1,107 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// featureQuarantine must be negotiated before the headend serves quarantine status
+const featureQuarantine = "quarantine"
+
+// Quarantine describes why the Manager quarantined this device. While
+// quarantined, the headend only lets traffic through to remediation services.
+type Quarantine struct {
+    Reason  string `json:"reason"`
+    Source  string `json:"source"`
+    Address string `json:"address,omitempty"`
+    Message string `json:"message,omitempty"`
+    Since   string `json:"since"`
+}
+
+// checkQuarantine polls the headend for our quarantine status. Entering or
+// leaving quarantine shows a banner and moves the tunnel to the address the
+// Manager assigned for the new state.
+func (c *Client) checkQuarantine() error {
+    if !c.capabilities.Has(featureQuarantine) {
+        return nil
+    }
+
+    req, err := http.NewRequest("GET", strings.TrimSuffix(c.headendURL, "/")+"/session/quarantine", nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.session.AccessToken())
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("quarantine status request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("quarantine status request failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var status struct {
+        Quarantined bool        `json:"quarantined"`
+        Quarantine  *Quarantine `json:"quarantine"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+        return fmt.Errorf("failed to parse quarantine status: %w", err)
+    }
+    current := status.Quarantine
+    if !status.Quarantined {
+        current = nil
+    }
+
+    previous := c.quarantine
+    c.quarantine = current
+    switch {
+    case current != nil && previous == nil:
+        printQuarantineBanner(current)
+    case current == nil && previous != nil:
+        fmt.Println("Quarantine lifted, full network access restored")
+    }
+
+    var previousAddress, currentAddress string
+    if previous != nil {
+        previousAddress = previous.Address
+    }
+    if current != nil {
+        currentAddress = current.Address
+    }
+    if previousAddress == currentAddress {
+        return nil
+    }
+    return c.reprovisionTunnel()
+}
+
+// reprovisionTunnel fetches our WireGuard configuration again and restarts
+// the tunnel with it, e.g. to move into or out of the quarantine segment
+func (c *Client) reprovisionTunnel() error {
+    if err := c.setupWireGuard(); err != nil {
+        return fmt.Errorf("failed to fetch WireGuard configuration: %w", err)
+    }
+    if err := c.stopWireGuard(); err != nil {
+        return err
+    }
+    return c.startWireGuard()
+}
+
+// printQuarantineBanner tells the user why most of the network is unreachable
+func printQuarantineBanner(q *Quarantine) {
+    rule := strings.Repeat("=", 72)
+    fmt.Println(rule)
+    fmt.Println("DEVICE QUARANTINED")
+    if q.Message != "" {
+        fmt.Println(q.Message)
+    }
+    fmt.Printf("Reason: %s (%s)\n", q.Reason, q.Source)
+    fmt.Println(rule)
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+)
+
+// Region is an egress region offered by the Manager
+type Region struct {
+    Name        string `json:"name"`
+    DisplayName string `json:"display_name"`
+    Country     string `json:"country"`
+    HeadendURL  string `json:"headend_url"`
+    // Allowed is false when policy does not permit this client to use the region
+    Allowed bool `json:"allowed"`
+}
+
+// ListRegions returns the egress regions known to the Manager
+func (c *Client) ListRegions() ([]Region, error) {
+    req, err := http.NewRequest("GET", c.config.ManagerURL+"/api/v1/clients/regions", nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("region list request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return nil, fmt.Errorf("region list failed with status %d: %s", resp.StatusCode, body)
+    }
+
+    var regionsResp struct {
+        Regions []Region `json:"regions"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&regionsResp); err != nil {
+        return nil, fmt.Errorf("failed to parse region list: %w", err)
+    }
+
+    return regionsResp.Regions, nil
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/auth"
+    "github.com/tobogganing/clients/native/internal/config"
+)
+
+// reregister registers the client again after the Manager rejected both
+// its refresh token and its API key, e.g. because the client was deleted
+// or its key rotated. Registration issues new WireGuard keys, so the
+// tunnel is rebuilt with them.
+func (c *Client) reregister() error {
+    if err := c.register(); err != nil {
+        return fmt.Errorf("re-registration failed: %w", err)
+    }
+    if err := c.session.Login(); err != nil {
+        return fmt.Errorf("authentication after re-registration failed: %w", err)
+    }
+    c.session.Reregistered()
+    fmt.Println("Re-registered, rebuilding the tunnel with the new keys")
+
+    if err := c.reprovisionTunnel(); err != nil {
+        return fmt.Errorf("tunnel rebuild after re-registration failed: %w", err)
+    }
+    return nil
+}
+
+// saveAuthState records the session state for the status command and the
+// tray, which run in other processes. It is only written when it changes.
+func (c *Client) saveAuthState() {
+    state := c.session.State()
+    if state == c.savedAuthState {
+        return
+    }
+
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return
+    }
+    if err := c.config.WriteFile(c.config.GetAuthStatePath(), data); err != nil {
+        fmt.Printf("Failed to save authentication state: %v\n", err)
+        return
+    }
+    c.savedAuthState = state
+}
+
+// AuthState describes the session, read from the connected client when it
+// is another process. It returns nil if there is no session.
+func (c *Client) AuthState() *auth.SessionState {
+    if state := c.session.State(); state.State != auth.StateUnauthenticated {
+        return &state
+    }
+
+    state, err := LoadAuthState(c.config)
+    if err != nil {
+        if !errors.Is(err, os.ErrNotExist) {
+            fmt.Printf("Failed to read authentication state: %v\n", err)
+        }
+        return nil
+    }
+    if state.State == auth.StateUnauthenticated {
+        return nil
+    }
+    return state
+}
+
+// LoadAuthState reads the session state the connected client last saved
+func LoadAuthState(cfg *config.Config) (*auth.SessionState, error) {
+    data, err := config.ReadFile(cfg.GetAuthStatePath())
+    if err != nil {
+        return nil, err
+    }
+    var state auth.SessionState
+    if err := json.Unmarshal(data, &state); err != nil {
+        return nil, fmt.Errorf("failed to parse authentication state: %w", err)
+    }
+    // The client may have stopped without renewing it
+    if state.State != auth.StateUnauthenticated && !state.ExpiresAt.IsZero() && time.Now().After(state.ExpiresAt) {
+        state.State = auth.StateExpired
+    }
+    return &state, nil
+}
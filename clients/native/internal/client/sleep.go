@@ -0,0 +1,89 @@
+package client
+
+import (
+    "fmt"
+    "net"
+    "time"
+
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    // resumeTimeout bounds the wait for the first handshake after a wake,
+    // after which the client reconnects from scratch
+    resumeTimeout = 10 * time.Second
+
+    // handshakePollInterval is how often the peer is checked while resuming
+    handshakePollInterval = 50 * time.Millisecond
+)
+
+// pauseForSleep quiets the tunnel before the host sleeps, so no keepalives
+// or handshakes are attempted on a network that is about to go away
+func (c *Client) pauseForSleep() {
+    fmt.Println("System going to sleep, pausing tunnel")
+    if err := c.setKeepalive(0); err != nil {
+        fmt.Printf("Failed to pause WireGuard keepalive: %v\n", err)
+    }
+}
+
+// resumeFromSleep brings the tunnel back after a wake without registering
+// or fetching configuration again: the headend endpoint is re-resolved for
+// the network we woke up on and a single handshake is forced. It fails if
+// no handshake completes within resumeTimeout.
+func (c *Client) resumeFromSleep(slept time.Duration) error {
+    start := time.Now()
+    fmt.Printf("System woke after %s, resuming tunnel\n", slept.Round(time.Second))
+
+    endpoint, err := net.ResolveUDPAddr("udp", c.headendEndpoint())
+    if err != nil {
+        return fmt.Errorf("failed to resolve headend endpoint: %w", err)
+    }
+
+    // Setting a keepalive sends one straight away, which starts the handshake
+    keepalive := c.powerMonitor.Current().Keepalive
+    kick := keepalive
+    if kick == 0 {
+        kick = time.Second
+    }
+    err = c.wg.ConfigureDevice(c.getWireGuardInterface(), wgtypes.Config{
+        Peers: []wgtypes.PeerConfig{{
+            PublicKey:                   c.headendPublicKey,
+            UpdateOnly:                  true,
+            Endpoint:                    endpoint,
+            PersistentKeepaliveInterval: &kick,
+        }},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to reconfigure WireGuard peer: %w", err)
+    }
+
+    if err := c.waitForHandshake(start, resumeTimeout); err != nil {
+        return err
+    }
+    fmt.Printf("Tunnel resumed in %s\n", time.Since(start).Round(time.Millisecond))
+
+    if kick != keepalive {
+        if err := c.setKeepalive(keepalive); err != nil {
+            fmt.Printf("Failed to restore WireGuard keepalive: %v\n", err)
+        }
+    }
+    return nil
+}
+
+// waitForHandshake waits for a handshake with the headend newer than since
+func (c *Client) waitForHandshake(since time.Time, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+        device, err := c.wg.Device(c.getWireGuardInterface())
+        if err != nil {
+            return fmt.Errorf("WireGuard interface down: %w", err)
+        }
+        for _, peer := range device.Peers {
+            if peer.PublicKey == c.headendPublicKey && peer.LastHandshakeTime.After(since) {
+                return nil
+            }
+        }
+        time.Sleep(handshakePollInterval)
+    }
+    return fmt.Errorf("no handshake with the headend within %s", timeout)
+}
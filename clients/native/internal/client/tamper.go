@@ -0,0 +1,243 @@
+package client
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/netip"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/tobogganing/clients/native/internal/config"
+    "github.com/tobogganing/clients/native/internal/netmon"
+    "github.com/tobogganing/libs/wgconfig"
+)
+
+const (
+    // tamperCheckDelay gathers the burst of events one change causes into
+    // one check of the tunnel
+    tamperCheckDelay = 250 * time.Millisecond
+
+    // tamperQuiet is how long the events a repair itself causes are ignored
+    tamperQuiet = 2 * time.Second
+)
+
+// Default routes are probed with documentation addresses, which no bypass
+// or LAN route covers, so they follow the default route
+var (
+    defaultProbe4 = netip.MustParseAddr("192.0.2.1")
+    defaultProbe6 = netip.MustParseAddr("2001:db8::1")
+)
+
+// TamperEvent is one change other software, such as Docker or another VPN,
+// made to the tunnel's routes or firewall mark while connected
+type TamperEvent struct {
+    At     time.Time `json:"at"`
+    Detail string    `json:"detail"`
+}
+
+// tamperHistory is kept in a file for the status output, since the status
+// command runs in another process
+type tamperHistory struct {
+    Count int          `json:"count"`
+    Last  *TamperEvent `json:"last,omitempty"`
+}
+
+// tamperMu serializes updates of the tamper file
+var tamperMu sync.Mutex
+
+// tunnelState is what the tunnel looked like when it came up, to check it
+// against later
+type tunnelState struct {
+    index  int
+    routes []netip.Prefix
+    fwMark int
+}
+
+// watchTunnel reports changes to the host's interfaces and routes. The
+// channel is nil where the platform has no change notifications; the health
+// check still verifies the tunnel then.
+func (c *Client) watchTunnel(ctx context.Context) <-chan netmon.Event {
+    events, err := netmon.Watch(ctx)
+    if err != nil {
+        fmt.Printf("Route monitoring unavailable, checking the tunnel with each health check: %v\n", err)
+        return nil
+    }
+    return events
+}
+
+// snapshotTunnel records the tunnel as wg-quick set it up, and ignores the
+// events bringing it up
+func (c *Client) snapshotTunnel() {
+    c.tamperQuietUntil = time.Now().Add(tamperQuiet)
+
+    interfaceName := c.getWireGuardInterface()
+    state := tunnelState{}
+    if iface, err := net.InterfaceByName(interfaceName); err == nil {
+        state.index = iface.Index
+    }
+    if device, err := c.wg.Device(interfaceName); err == nil {
+        state.fwMark = device.FirewallMark
+    }
+    if data, err := c.readWireGuardConfig(); err == nil {
+        if cfg, err := wgconfig.ParseString(string(data)); err == nil {
+            for _, peer := range cfg.Peers {
+                state.routes = append(state.routes, peer.AllowedIPs...)
+            }
+        }
+    }
+    c.tunnel = state
+}
+
+// touchesTunnel reports whether e may have changed the tunnel, outside the
+// quiet period after a repair
+func (c *Client) touchesTunnel(e netmon.Event) bool {
+    if time.Now().Before(c.tamperQuietUntil) {
+        return false
+    }
+    return e.Affects(c.tunnel.index, c.getWireGuardInterface(), c.tunnel.routes)
+}
+
+// checkTunnel compares the tunnel with how it came up and returns what
+// changed, or "" if nothing did. A route event the platform cannot verify
+// is reported as the change itself.
+func (c *Client) checkTunnel(event string) string {
+    interfaceName := c.getWireGuardInterface()
+    if _, err := net.InterfaceByName(interfaceName); err != nil {
+        return fmt.Sprintf("interface %s removed", interfaceName)
+    }
+
+    if c.tunnel.fwMark != 0 {
+        if device, err := c.wg.Device(interfaceName); err == nil && device.FirewallMark != c.tunnel.fwMark {
+            return fmt.Sprintf("firewall mark changed from %#x to %#x", c.tunnel.fwMark, device.FirewallMark)
+        }
+    }
+
+    for _, route := range c.tunnel.routes {
+        probe := route.Masked().Addr()
+        if route.Bits() == 0 {
+            probe = defaultProbe4
+            if route.Addr().Is6() {
+                probe = defaultProbe6
+            }
+        }
+        via, err := netmon.RouteInterface(probe)
+        if errors.Is(err, netmon.ErrUnsupported) {
+            return event
+        }
+        if err != nil {
+            // No route at all leaks nothing
+            continue
+        }
+        if via != interfaceName {
+            return fmt.Sprintf("traffic for %s routed through %s", route, via)
+        }
+    }
+    return ""
+}
+
+// repairTunnel records the tampering detail describes, tells the Manager and
+// brings the tunnel up afresh, since wg-quick owns its routes and marks. The
+// restart takes a new snapshot of the tunnel.
+func (c *Client) repairTunnel(detail string) {
+    fmt.Printf("WARNING: tunnel changed by other software (%s), repairing\n", detail)
+    count := c.recordTamper(detail)
+    if err := c.reportTamper(count); err != nil {
+        fmt.Printf("Failed to report tampering to the Manager: %v\n", err)
+    }
+
+    if err := c.stopWireGuard(); err != nil {
+        fmt.Printf("Tearing down tunnel for repair: %v\n", err)
+    }
+    if err := c.startWireGuard(); err != nil {
+        fmt.Printf("Failed to repair tunnel: %v\n", err)
+    }
+}
+
+// recordTamper adds a tamper event to the history and returns how many
+// there have been
+func (c *Client) recordTamper(detail string) int {
+    tamperMu.Lock()
+    defer tamperMu.Unlock()
+
+    history := c.loadTamperHistory()
+    history.Count++
+    history.Last = &TamperEvent{At: time.Now(), Detail: detail}
+
+    data, err := json.MarshalIndent(history, "", "  ")
+    if err == nil {
+        if err := c.config.WriteFile(c.config.GetTamperPath(), data); err != nil {
+            fmt.Printf("Failed to save tamper event: %v\n", err)
+        }
+    }
+    return history.Count
+}
+
+// reportTamper sends the tamper count to the Manager with the client's
+// metrics
+func (c *Client) reportTamper(count int) error {
+    if c.clientID == "" {
+        return nil
+    }
+
+    reqBody, err := json.Marshal(map[string]interface{}{
+        "headless": c.config.Headless,
+        "metrics": map[string]interface{}{
+            "route_tamper_total": count,
+        },
+    })
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest("POST", c.config.ManagerURL+"/api/v1/clients/"+c.clientID+"/metrics", bytes.NewReader(reqBody))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("metrics request failed: %w", err)
+    }
+    defer func() {
+        _ = resp.Body.Close()
+    }()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("metrics request failed with status %d: %s", resp.StatusCode, body)
+    }
+    return nil
+}
+
+// Tampering returns how often the tunnel was changed by other software and
+// the most recent change
+func (c *Client) Tampering() (int, *TamperEvent) {
+    tamperMu.Lock()
+    defer tamperMu.Unlock()
+    history := c.loadTamperHistory()
+    return history.Count, history.Last
+}
+
+func (c *Client) loadTamperHistory() tamperHistory {
+    var history tamperHistory
+    data, err := config.ReadFile(c.config.GetTamperPath())
+    if err != nil {
+        if !errors.Is(err, os.ErrNotExist) {
+            fmt.Printf("Failed to read tamper history: %v\n", err)
+        }
+        return history
+    }
+    if err := json.Unmarshal(data, &history); err != nil {
+        fmt.Printf("Failed to parse tamper history: %v\n", err)
+    }
+    return history
+}
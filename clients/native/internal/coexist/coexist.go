@@ -0,0 +1,220 @@
+// Package coexist detects other VPN clients running alongside the
+// SASEWaddle native client and decides how the tunnel shares the host with
+// them.
+//
+// The coexist package provides:
+//   - Detection of other active VPNs from interface names and the
+//     point-to-point interfaces they create, noting which one holds the
+//     default route
+//   - The coexistence policy: warn only, refuse to connect, route only the
+//     SASEWaddle network, or take precedence for configured CIDRs
+//   - The tunnel's allowed IPs under each policy
+//
+// Two VPNs that both claim the default route leave routing to whichever
+// came up last. A policy makes the outcome deterministic instead.
+package coexist
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/tobogganing/clients/native/internal/netmon"
+)
+
+// Policy is how the tunnel behaves when another VPN is active
+type Policy string
+
+const (
+	// PolicyOff connects as usual and only warns about other VPNs
+	PolicyOff Policy = "off"
+	// PolicyRefuse does not connect while another VPN is active
+	PolicyRefuse Policy = "refuse"
+	// PolicySplit routes only the SASEWaddle network through the tunnel,
+	// leaving everything else to the other VPN
+	PolicySplit Policy = "split"
+	// PolicyPrecedence is PolicySplit plus the configured CIDRs, routed
+	// through the tunnel even where the other VPN routes them too
+	PolicyPrecedence Policy = "precedence"
+)
+
+// ParsePolicy validates a configured policy. An empty string means off.
+func ParsePolicy(value string) (Policy, error) {
+	switch Policy(strings.ToLower(strings.TrimSpace(value))) {
+	case "", PolicyOff:
+		return PolicyOff, nil
+	case PolicyRefuse:
+		return PolicyRefuse, nil
+	case PolicySplit:
+		return PolicySplit, nil
+	case PolicyPrecedence:
+		return PolicyPrecedence, nil
+	default:
+		return PolicyOff, fmt.Errorf("invalid VPN coexistence policy %q (want off, refuse, split or precedence)", value)
+	}
+}
+
+// VPN is another VPN client found active
+type VPN struct {
+	Product      string // best guess at the product, from the interface name
+	Interface    string
+	DefaultRoute bool // it currently carries internet traffic
+}
+
+func (v VPN) String() string {
+	if v.DefaultRoute {
+		return fmt.Sprintf("%s on %s, holding the default route", v.Product, v.Interface)
+	}
+	return fmt.Sprintf("%s on %s", v.Product, v.Interface)
+}
+
+// products maps interface name fragments to the VPN that creates them.
+// Windows names adapters after the product; the Unix names are prefixes.
+var products = []struct {
+	fragment string
+	prefix   bool
+	product  string
+}{
+	{"tailscale", false, "Tailscale"},
+	{"zerotier", false, "ZeroTier"},
+	{"zt", true, "ZeroTier"},
+	{"anyconnect", false, "Cisco AnyConnect"},
+	{"cscotun", true, "Cisco AnyConnect"},
+	{"globalprotect", false, "GlobalProtect"},
+	{"pangp", false, "GlobalProtect"},
+	{"gpd", true, "GlobalProtect"},
+	{"forti", false, "FortiClient"},
+	{"nordlynx", false, "NordVPN"},
+	{"proton", false, "Proton VPN"},
+	{"mullvad", false, "Mullvad"},
+	{"openvpn", false, "OpenVPN"},
+	{"wireguard", false, "WireGuard"},
+	{"wg", true, "WireGuard"},
+	{"tun", true, "OpenVPN or another tunnel"},
+	{"tap", true, "OpenVPN or another tunnel"},
+	{"utun", true, "a tunnel"},
+	{"ppp", true, "PPP or L2TP"},
+	{"ipsec", true, "IPsec"},
+	{"vpn", false, "a VPN"},
+}
+
+// defaultProbe is a documentation address, which no LAN route covers, so
+// it follows the default route
+var defaultProbe = netip.MustParseAddr("192.0.2.1")
+
+// iface is what detection needs to know about an interface
+type iface struct {
+	name         string
+	pointToPoint bool
+	addrs        []netip.Addr
+}
+
+// Detect returns the other VPNs active now, ignoring our own tunnel
+// interface
+func Detect(ours string) []VPN {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var candidates []iface
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		candidate := iface{name: i.Name, pointToPoint: i.Flags&net.FlagPointToPoint != 0}
+		addrs, _ := i.Addrs()
+		for _, addr := range addrs {
+			if prefix, err := netip.ParsePrefix(addr.String()); err == nil {
+				candidate.addrs = append(candidate.addrs, prefix.Addr())
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	defaultInterface, _ := netmon.RouteInterface(defaultProbe)
+	return detect(candidates, ours, defaultInterface)
+}
+
+// detect picks the VPNs out of interfaces. An interface counts if it has an
+// address beyond link-local, since idle tunnels (macOS keeps a few utun
+// interfaces for system services) have none, and either its name belongs to
+// a VPN or it is point-to-point.
+func detect(interfaces []iface, ours, defaultInterface string) []VPN {
+	var vpns []VPN
+	for _, i := range interfaces {
+		if i.name == ours || !routable(i.addrs) {
+			continue
+		}
+		product := productFor(i.name)
+		if product == "" {
+			if !i.pointToPoint {
+				continue
+			}
+			product = "an unknown VPN"
+		}
+		vpns = append(vpns, VPN{Product: product, Interface: i.name, DefaultRoute: i.name == defaultInterface})
+	}
+	return vpns
+}
+
+// productFor guesses the VPN that created the named interface, or ""
+func productFor(name string) string {
+	lower := strings.ToLower(name)
+	for _, p := range products {
+		if p.prefix && strings.HasPrefix(lower, p.fragment) || !p.prefix && strings.Contains(lower, p.fragment) {
+			return p.product
+		}
+	}
+	return ""
+}
+
+// routable reports whether any address is usable beyond the link
+func routable(addrs []netip.Addr) bool {
+	for _, addr := range addrs {
+		if !addr.IsLinkLocalUnicast() && !addr.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedIPs returns the prefixes the tunnel carries under policy: all
+// traffic, unless another VPN is active and the policy splits the tunnel
+// down to networks, the IPv4 and IPv6 networks of a dual-stack tunnel,
+// plus the precedence CIDRs. Each precedence CIDR is split
+// into its two halves, which are more specific than the other VPN's route
+// for the same CIDR and so win over it.
+func AllowedIPs(policy Policy, others []VPN, networks []netip.Prefix, precedence []netip.Prefix) []netip.Prefix {
+	all := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	if len(others) == 0 || (policy != PolicySplit && policy != PolicyPrecedence) {
+		return all
+	}
+
+	var allowed []netip.Prefix
+	for _, network := range networks {
+		if network.IsValid() {
+			allowed = append(allowed, network.Masked())
+		}
+	}
+	if policy == PolicyPrecedence {
+		for _, prefix := range precedence {
+			allowed = append(allowed, halves(prefix.Masked())...)
+		}
+	}
+	return allowed
+}
+
+// halves splits prefix into its two halves, or returns it whole if it is a
+// single address
+func halves(prefix netip.Prefix) []netip.Prefix {
+	bits := prefix.Bits()
+	if bits == prefix.Addr().BitLen() {
+		return []netip.Prefix{prefix}
+	}
+	lower := netip.PrefixFrom(prefix.Addr(), bits+1)
+	upper := prefix.Addr().AsSlice()
+	upper[bits/8] |= 0x80 >> (bits % 8)
+	addr, _ := netip.AddrFromSlice(upper)
+	return []netip.Prefix{lower, netip.PrefixFrom(addr, bits+1)}
+}
@@ -0,0 +1,72 @@
+package coexist
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	global := []netip.Addr{netip.MustParseAddr("100.64.0.5")}
+	linkLocal := []netip.Addr{netip.MustParseAddr("fe80::1")}
+
+	vpns := detect([]iface{
+		{name: "eth0", addrs: []netip.Addr{netip.MustParseAddr("192.168.1.10")}},
+		{name: "wg0", pointToPoint: true, addrs: global},        // ours
+		{name: "tailscale0", pointToPoint: true, addrs: global}, // named
+		{name: "utun3", pointToPoint: true, addrs: linkLocal},   // idle system tunnel
+		{name: "corp1", pointToPoint: true, addrs: global},      // unnamed tunnel
+		{name: "PANGP Virtual Ethernet Adapter", addrs: global},
+	}, "wg0", "corp1")
+
+	want := []VPN{
+		{Product: "Tailscale", Interface: "tailscale0"},
+		{Product: "an unknown VPN", Interface: "corp1", DefaultRoute: true},
+		{Product: "GlobalProtect", Interface: "PANGP Virtual Ethernet Adapter"},
+	}
+	if !reflect.DeepEqual(vpns, want) {
+		t.Errorf("got %+v, want %+v", vpns, want)
+	}
+}
+
+func TestAllowedIPs(t *testing.T) {
+	others := []VPN{{Product: "Tailscale", Interface: "tailscale0"}}
+	network := netip.MustParsePrefix("10.200.0.0/16")
+	network6 := netip.MustParsePrefix("fd00:200::/64")
+	precedence := []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("192.0.2.7/32")}
+	all := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+	for _, test := range []struct {
+		policy   Policy
+		others   []VPN
+		networks []netip.Prefix
+		want     []netip.Prefix
+	}{
+		{PolicySplit, nil, []netip.Prefix{network}, all},
+		{PolicyOff, others, []netip.Prefix{network}, all},
+		{PolicySplit, others, []netip.Prefix{network}, []netip.Prefix{network}},
+		{PolicySplit, others, []netip.Prefix{network, network6}, []netip.Prefix{network, network6}},
+		{PolicyPrecedence, others, []netip.Prefix{network}, []netip.Prefix{
+			network,
+			netip.MustParsePrefix("172.16.0.0/13"),
+			netip.MustParsePrefix("172.24.0.0/13"),
+			netip.MustParsePrefix("192.0.2.7/32"),
+		}},
+	} {
+		if got := AllowedIPs(test.policy, test.others, test.networks, precedence); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s with %d others: got %v, want %v", test.policy, len(test.others), got, test.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	if policy, err := ParsePolicy(""); err != nil || policy != PolicyOff {
+		t.Errorf("empty policy: got %q, %v", policy, err)
+	}
+	if policy, err := ParsePolicy("Split"); err != nil || policy != PolicySplit {
+		t.Errorf("Split: got %q, %v", policy, err)
+	}
+	if _, err := ParsePolicy("ignore"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
@@ -4,7 +4,8 @@
 // - Hierarchical configuration loading from multiple sources
 // - Environment variable and file-based configuration
 // - Cross-platform configuration directory management
-// - Secure storage of API keys and certificates
+// - Secure storage of API keys and certificates, optionally encrypted at
+//   rest with a key from the OS keystore
 // - Configuration validation and defaults
 // - Hot reloading of configuration changes
 //
@@ -13,14 +14,22 @@
 // 2. Environment variables
 // 3. Configuration files (.yaml, .json, .toml)
 // 4. Default values
+//
+// YAML files use the sectioned version 2 format, with environment variable
+// interpolation, includes and profiles (see v2.go); flat version 1 files
+// still load, and Migrate converts them.
 package config
 
 import (
+    "encoding/pem"
     "fmt"
+    "net/netip"
     "os"
     "path/filepath"
     "runtime"
+    "strings"
 
+    "github.com/mitchellh/mapstructure"
     "github.com/spf13/viper"
 )
 
@@ -30,6 +39,9 @@ type Config struct {
     ManagerURL string `mapstructure:"manager_url" json:"manager_url"`
     APIKey     string `mapstructure:"api_key" json:"api_key"`
     
+    // File holding the API key, e.g. a mounted secret; it overrides APIKey
+    APIKeyFile string `mapstructure:"api_key_file" json:"api_key_file,omitempty"`
+    
     // Client configuration
     ClientName string `mapstructure:"client_name" json:"client_name"`
     ClientType string `mapstructure:"client_type" json:"client_type"`
@@ -38,19 +50,90 @@ type Config struct {
     AutoConnect       bool `mapstructure:"auto_connect" json:"auto_connect"`
     ReconnectInterval int  `mapstructure:"reconnect_interval" json:"reconnect_interval"`
     
+    // Preferred egress region for internet-bound traffic (e.g. "eu-west").
+    // Empty lets the Manager choose; policy may override the preference.
+    EgressRegion string `mapstructure:"egress_region" json:"egress_region"`
+    
+    // Cluster to connect to, by ID, when the user belongs to several.
+    // Empty or "auto" picks the allowed cluster with the lowest latency.
+    Cluster string `mapstructure:"cluster" json:"cluster"`
+    
+    // Signed list of last-known-good headends, as issued by the Manager,
+    // to bring the tunnel up from while the Manager is unreachable. The
+    // client also keeps the newest list it was sent at
+    // GetBackupHeadendsPath, and uses whichever was issued last.
+    BackupHeadends string `mapstructure:"backup_headends" json:"backup_headends,omitempty"`
+    
+    // PEM public key backup headend lists must be signed with. When empty,
+    // the key the Manager sent along with the cached list is trusted.
+    ManagerPublicKey string `mapstructure:"manager_public_key" json:"manager_public_key,omitempty"`
+    
+    // Cluster the client connected to, chosen from Cluster or
+    // automatically; its keys and WireGuard configuration are kept apart
+    // from other clusters' under GetClusterDir
+    ActiveCluster string `mapstructure:"-" json:"-"`
+    
     // Logging and UI
-    LogLevel string `mapstructure:"log_level" json:"log_level"`
-    Headless bool   `mapstructure:"headless" json:"headless"`
+    LogLevel  string `mapstructure:"log_level" json:"log_level"`
+    LogFormat string `mapstructure:"log_format" json:"log_format"` // "text" or "json"
+    Headless  bool   `mapstructure:"headless" json:"headless"`
     
     // Platform-specific settings
     ServiceMode bool `mapstructure:"service_mode" json:"service_mode"`
     
+    // Enrollment artifact for provisioning tools: "" (none) or "json",
+    // written to BootstrapFile, or to stdout if it is empty
+    BootstrapOutput string `mapstructure:"bootstrap_output" json:"bootstrap_output,omitempty"`
+    BootstrapFile   string `mapstructure:"bootstrap_file" json:"bootstrap_file,omitempty"`
+    
     // Advanced settings
     WireGuardInterface string `mapstructure:"wireguard_interface" json:"wireguard_interface"`
     DNSServers         []string `mapstructure:"dns_servers" json:"dns_servers"`
     
+    // Enforce the headend's compact deny policy locally for fast failure
+    LocalPolicy bool `mapstructure:"local_policy" json:"local_policy"`
+    
+    // Route Manager-defined SaaS destinations directly instead of through the tunnel
+    SaaSBypass bool `mapstructure:"saas_bypass" json:"saas_bypass"`
+    
+    // Block DNS outside the tunnel while connected
+    DNSLeakProtection bool `mapstructure:"dns_leak_protection" json:"dns_leak_protection"`
+    
+    // WebRTC/STUN leak mitigation: "off", "block" or "tunnel", with
+    // applications (cgroup paths on Linux) exempted from it
+    WebRTCProtection string   `mapstructure:"webrtc_protection" json:"webrtc_protection"`
+    WebRTCExceptions []string `mapstructure:"webrtc_exceptions" json:"webrtc_exceptions"`
+    
+    // What to do when another VPN client is active: "off" (warn only),
+    // "refuse" to connect, "split" to route only the SASEWaddle network, or
+    // "precedence" to also route VPNCoexistenceCIDRs through the tunnel
+    // ahead of the other VPN
+    VPNCoexistence      string   `mapstructure:"vpn_coexistence" json:"vpn_coexistence"`
+    VPNCoexistenceCIDRs []string `mapstructure:"vpn_coexistence_cidrs" json:"vpn_coexistence_cidrs,omitempty"`
+    
+    // Power profile for keepalive and polling: "auto", "performance",
+    // "balanced" or "battery_saver"
+    PowerProfile string `mapstructure:"power_profile" json:"power_profile"`
+    
+    // Pause the tunnel when the system sleeps and resume it on wake with
+    // the cached configuration, instead of waiting for it to time out
+    PauseOnSleep bool `mapstructure:"pause_on_sleep" json:"pause_on_sleep"`
+    
     // Authentication settings
     AuthRefreshThreshold int `mapstructure:"auth_refresh_threshold" json:"auth_refresh_threshold"`
+    
+    // Encrypt the files the client writes - this configuration, the cached
+    // WireGuard configuration and session state - with a key kept in the OS
+    // keystore. Sealed files are decrypted at load whatever this says.
+    EncryptAtRest bool `mapstructure:"encrypt_at_rest" json:"encrypt_at_rest"`
+    
+    // Profile of a version 2 file to apply: set from the command line
+    // before loading, and to the profile applied after
+    Profile string `mapstructure:"-" json:"profile,omitempty"`
+    
+    // Where a version 2 file set each key, as file:line:column, so
+    // validation errors point at the setting
+    sources map[string]string
 }
 
 // DefaultConfig returns a configuration with default values
@@ -60,26 +143,32 @@ func DefaultConfig() *Config {
         AutoConnect:          false,
         ReconnectInterval:    30,
         LogLevel:             "info",
+        LogFormat:            "text",
         Headless:             false,
         ServiceMode:          false,
         DNSServers:           []string{"10.200.0.1", "1.1.1.1", "8.8.8.8"},
+        LocalPolicy:          true,
+        SaaSBypass:           true,
+        DNSLeakProtection:    true,
+        WebRTCProtection:     "off",
+        VPNCoexistence:       "off",
+        PowerProfile:         "auto",
+        PauseOnSleep:         true,
         AuthRefreshThreshold: 300, // 5 minutes before expiry
     }
 }
 
 // LoadFromFile loads configuration from a file
 func LoadFromFile(cfg *Config, configFile string) error {
-    viper.SetConfigFile(configFile)
-    
-    if err := viper.ReadInConfig(); err != nil {
-        return fmt.Errorf("failed to read config file: %w", err)
+    if err := readConfigFile(cfg, configFile); err != nil {
+        return err
     }
     
-    if err := viper.Unmarshal(cfg); err != nil {
-        return fmt.Errorf("failed to unmarshal config: %w", err)
+    if err := unmarshal(cfg); err != nil {
+        return err
     }
     
-    return nil
+    return cfg.loadAPIKeyFile()
 }
 
 // LoadFromDefaults loads configuration from default locations and environment variables
@@ -87,56 +176,158 @@ func LoadFromDefaults(cfg *Config) error {
     viper.SetConfigName("sasewaddle")
     viper.SetConfigType("yaml")
     
-    // Add config paths
-    viper.AddConfigPath(".")
-    viper.AddConfigPath("$HOME/.sasewaddle")
-    viper.AddConfigPath("/etc/sasewaddle")
+    setDefaults()
     
-    // Set environment variable prefix
+    // Try to read config file (it's ok if it doesn't exist)
+    if configFile := findConfigFile(); configFile != "" {
+        if err := readConfigFile(cfg, configFile); err != nil {
+            return err
+        }
+    }
+    
+    if err := unmarshal(cfg); err != nil {
+        return err
+    }
+    
+    return cfg.loadAPIKeyFile()
+}
+
+// Load loads configuration from configFile, or from the default locations
+// if it is empty. Environment variables and flags bound to viper override
+// the file, so a workload can be configured without one.
+func Load(cfg *Config, configFile string) error {
+    if configFile == "" {
+        return LoadFromDefaults(cfg)
+    }
+    
+    setDefaults()
+    
+    if err := readConfigFile(cfg, configFile); err != nil {
+        return err
+    }
+    
+    if err := unmarshal(cfg); err != nil {
+        return err
+    }
+    
+    return cfg.loadAPIKeyFile()
+}
+
+// findConfigFile returns the first sasewaddle config file in the default
+// locations, or "" if there is none
+func findConfigFile() string {
+    for _, dir := range []string{".", os.ExpandEnv("$HOME/.sasewaddle"), "/etc/sasewaddle"} {
+        for _, ext := range viper.SupportedExts {
+            path := filepath.Join(dir, "sasewaddle."+ext)
+            if info, err := os.Stat(path); err == nil && !info.IsDir() {
+                return path
+            }
+        }
+    }
+    return ""
+}
+
+// unmarshal decodes viper's settings into cfg. Lists replace the defaults
+// already in cfg rather than overwriting them element by element.
+func unmarshal(cfg *Config) error {
+    zeroFields := func(dc *mapstructure.DecoderConfig) {
+        dc.ZeroFields = true
+    }
+    if err := viper.Unmarshal(cfg, zeroFields); err != nil {
+        return fmt.Errorf("failed to unmarshal config: %w", err)
+    }
+    return nil
+}
+
+// setDefaults reads SASEWADDLE_* environment variables and sets the
+// default for every key
+func setDefaults() {
     viper.SetEnvPrefix("SASEWADDLE")
     viper.AutomaticEnv()
     
-    // Set default values
+    // Set default values. Every key needs one so Unmarshal picks up its
+    // environment variable, even when no config file sets it.
+    viper.SetDefault("manager_url", "")
+    viper.SetDefault("api_key", "")
+    viper.SetDefault("api_key_file", "")
+    viper.SetDefault("client_name", "")
+    viper.SetDefault("egress_region", "")
+    viper.SetDefault("cluster", "")
+    viper.SetDefault("backup_headends", "")
+    viper.SetDefault("manager_public_key", "")
+    viper.SetDefault("wireguard_interface", "")
     viper.SetDefault("client_type", "client_native")
     viper.SetDefault("auto_connect", false)
     viper.SetDefault("reconnect_interval", 30)
     viper.SetDefault("log_level", "info")
+    viper.SetDefault("log_format", "text")
     viper.SetDefault("headless", false)
     viper.SetDefault("service_mode", false)
+    viper.SetDefault("bootstrap_output", "")
+    viper.SetDefault("bootstrap_file", "")
     viper.SetDefault("dns_servers", []string{"10.200.0.1", "1.1.1.1", "8.8.8.8"})
+    viper.SetDefault("local_policy", true)
+    viper.SetDefault("saas_bypass", true)
+    viper.SetDefault("dns_leak_protection", true)
+    viper.SetDefault("webrtc_protection", "off")
+    viper.SetDefault("vpn_coexistence", "off")
+    viper.SetDefault("vpn_coexistence_cidrs", []string{})
+    viper.SetDefault("power_profile", "auto")
+    viper.SetDefault("pause_on_sleep", true)
     viper.SetDefault("auth_refresh_threshold", 300)
-    
-    // Try to read config file (it's ok if it doesn't exist)
-    if err := viper.ReadInConfig(); err != nil {
-        if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
-            return fmt.Errorf("failed to read config file: %w", err)
-        }
+    viper.SetDefault("encrypt_at_rest", false)
+}
+
+// loadAPIKeyFile reads the API key from APIKeyFile, if one is configured
+func (c *Config) loadAPIKeyFile() error {
+    if c.APIKeyFile == "" {
+        return nil
     }
     
-    if err := viper.Unmarshal(cfg); err != nil {
-        return fmt.Errorf("failed to unmarshal config: %w", err)
+    data, err := os.ReadFile(c.APIKeyFile)
+    if err != nil {
+        return fmt.Errorf("failed to read api_key_file: %w", err)
     }
     
+    c.APIKey = strings.TrimSpace(string(data))
     return nil
 }
 
-// Save saves the configuration to a file
+// Save saves the configuration to a file. YAML files are written in the
+// version 2 format; other formats keep the flat version 1 keys.
 func (c *Config) Save(configFile string) error {
-    viper.SetConfigFile(configFile)
-    
-    // Set values in viper
-    viper.Set("manager_url", c.ManagerURL)
-    viper.Set("api_key", c.APIKey)
-    viper.Set("client_name", c.ClientName)
-    viper.Set("client_type", c.ClientType)
-    viper.Set("auto_connect", c.AutoConnect)
-    viper.Set("reconnect_interval", c.ReconnectInterval)
-    viper.Set("log_level", c.LogLevel)
-    viper.Set("headless", c.Headless)
-    viper.Set("service_mode", c.ServiceMode)
-    viper.Set("wireguard_interface", c.WireGuardInterface)
-    viper.Set("dns_servers", c.DNSServers)
-    viper.Set("auth_refresh_threshold", c.AuthRefreshThreshold)
+    settings := map[string]interface{}{
+        "manager_url":            c.ManagerURL,
+        "api_key":                c.APIKey,
+        "api_key_file":           c.APIKeyFile,
+        "client_name":            c.ClientName,
+        "client_type":            c.ClientType,
+        "auto_connect":           c.AutoConnect,
+        "reconnect_interval":     c.ReconnectInterval,
+        "egress_region":          c.EgressRegion,
+        "cluster":                c.Cluster,
+        "backup_headends":        c.BackupHeadends,
+        "manager_public_key":     c.ManagerPublicKey,
+        "log_level":              c.LogLevel,
+        "log_format":             c.LogFormat,
+        "headless":               c.Headless,
+        "service_mode":           c.ServiceMode,
+        "bootstrap_output":       c.BootstrapOutput,
+        "bootstrap_file":         c.BootstrapFile,
+        "wireguard_interface":    c.WireGuardInterface,
+        "dns_servers":            c.DNSServers,
+        "local_policy":           c.LocalPolicy,
+        "saas_bypass":            c.SaaSBypass,
+        "dns_leak_protection":    c.DNSLeakProtection,
+        "webrtc_protection":      c.WebRTCProtection,
+        "webrtc_exceptions":      c.WebRTCExceptions,
+        "vpn_coexistence":        c.VPNCoexistence,
+        "vpn_coexistence_cidrs":  c.VPNCoexistenceCIDRs,
+        "power_profile":          c.PowerProfile,
+        "pause_on_sleep":         c.PauseOnSleep,
+        "auth_refresh_threshold": c.AuthRefreshThreshold,
+        "encrypt_at_rest":        c.EncryptAtRest,
+    }
     
     // Create directory if it doesn't exist
     configDir := filepath.Dir(configFile)
@@ -144,6 +335,22 @@ func (c *Config) Save(configFile string) error {
         return fmt.Errorf("failed to create config directory: %w", err)
     }
     
+    switch strings.ToLower(filepath.Ext(configFile)) {
+    case ".yaml", ".yml":
+        data, err := encodeV2(settings)
+        if err != nil {
+            return fmt.Errorf("failed to encode config: %w", err)
+        }
+        return c.WriteFile(configFile, data)
+    }
+    
+    if c.EncryptAtRest {
+        return fmt.Errorf("encrypt_at_rest needs a YAML config file")
+    }
+    viper.SetConfigFile(configFile)
+    for key, value := range settings {
+        viper.Set(key, value)
+    }
     if err := viper.WriteConfig(); err != nil {
         return fmt.Errorf("failed to write config file: %w", err)
     }
@@ -151,6 +358,16 @@ func (c *Config) Save(configFile string) error {
     return nil
 }
 
+// invalid returns a validation error for key, prefixed with where a
+// version 2 file set it
+func (c *Config) invalid(key string, format string, args ...interface{}) error {
+    err := fmt.Errorf(format, args...)
+    if source, ok := c.sources[key]; ok {
+        return fmt.Errorf("%s: %w", source, err)
+    }
+    return err
+}
+
 // Validate validates the configuration
 func (c *Config) Validate() error {
     if c.ManagerURL == "" {
@@ -162,7 +379,7 @@ func (c *Config) Validate() error {
     }
     
     if c.ClientType != "client_native" {
-        return fmt.Errorf("invalid client_type: %s", c.ClientType)
+        return c.invalid("client_type", "invalid client_type: %s", c.ClientType)
     }
     
     validLogLevels := map[string]bool{
@@ -173,15 +390,84 @@ func (c *Config) Validate() error {
     }
     
     if !validLogLevels[c.LogLevel] {
-        return fmt.Errorf("invalid log_level: %s", c.LogLevel)
+        return c.invalid("log_level", "invalid log_level: %s", c.LogLevel)
+    }
+    
+    validLogFormats := map[string]bool{
+        "":     true,
+        "text": true,
+        "json": true,
+    }
+    
+    if !validLogFormats[c.LogFormat] {
+        return c.invalid("log_format", "invalid log_format: %s", c.LogFormat)
+    }
+    
+    if c.BootstrapOutput != "" && c.BootstrapOutput != "json" {
+        return c.invalid("bootstrap_output", "invalid bootstrap_output: %s", c.BootstrapOutput)
+    }
+    
+    validWebRTCModes := map[string]bool{
+        "":       true,
+        "off":    true,
+        "block":  true,
+        "tunnel": true,
+    }
+    
+    if !validWebRTCModes[c.WebRTCProtection] {
+        return c.invalid("webrtc_protection", "invalid webrtc_protection: %s", c.WebRTCProtection)
+    }
+    
+    validCoexistence := map[string]bool{
+        "":           true,
+        "off":        true,
+        "refuse":     true,
+        "split":      true,
+        "precedence": true,
+    }
+    
+    if !validCoexistence[c.VPNCoexistence] {
+        return c.invalid("vpn_coexistence", "invalid vpn_coexistence: %s", c.VPNCoexistence)
+    }
+    
+    for _, cidr := range c.VPNCoexistenceCIDRs {
+        if _, err := netip.ParsePrefix(cidr); err != nil {
+            return c.invalid("vpn_coexistence_cidrs", "invalid vpn_coexistence_cidrs entry %q: %w", cidr, err)
+        }
+    }
+    
+    if c.VPNCoexistence == "precedence" && len(c.VPNCoexistenceCIDRs) == 0 {
+        return c.invalid("vpn_coexistence", "vpn_coexistence precedence needs vpn_coexistence_cidrs")
+    }
+    
+    if strings.ContainsAny(c.Cluster, `/\`) || c.Cluster == "." || c.Cluster == ".." {
+        return c.invalid("cluster", "invalid cluster: %s", c.Cluster)
+    }
+    
+    if c.ManagerPublicKey != "" {
+        if block, _ := pem.Decode([]byte(c.ManagerPublicKey)); block == nil {
+            return c.invalid("manager_public_key", "invalid manager_public_key: not a PEM public key")
+        }
+    }
+    
+    validPowerProfiles := map[string]bool{
+        "":              true,
+        "auto":          true,
+        "performance":   true,
+        "balanced":      true,
+        "battery_saver": true,
+    }
+    
+    if !validPowerProfiles[c.PowerProfile] {
+        return c.invalid("power_profile", "invalid power_profile: %s", c.PowerProfile)
     }
     
     if c.ReconnectInterval < 10 {
-        return fmt.Errorf("reconnect_interval must be at least 10 seconds")
+        return c.invalid("reconnect_interval", "reconnect_interval must be at least 10 seconds")
     }
     
     if c.AuthRefreshThreshold < 60 {
-        return fmt.Errorf("auth_refresh_threshold must be at least 60 seconds")
+        return c.invalid("auth_refresh_threshold", "auth_refresh_threshold must be at least 60 seconds")
     }
     
     return nil
@@ -210,13 +496,81 @@ func GetDefaultConfigFile() string {
     return GetConfigDir() + "/config.yaml"
 }
 
-// GetWireGuardConfigPath returns the path to the WireGuard configuration file
+// GetClusterDir returns the directory holding the keys and WireGuard
+// configuration for cluster, or the configuration directory itself if
+// cluster is empty
+func GetClusterDir(cluster string) string {
+    if cluster == "" {
+        return GetConfigDir()
+    }
+    return filepath.Join(GetConfigDir(), "clusters", cluster)
+}
+
+// ClusterID returns the cluster the client is connected to, or the one
+// configured, or "" when it is chosen automatically
+func (c *Config) ClusterID() string {
+    if c.ActiveCluster != "" {
+        return c.ActiveCluster
+    }
+    if c.Cluster == "auto" {
+        return ""
+    }
+    return c.Cluster
+}
+
+// GetWireGuardConfigPath returns the path to the WireGuard configuration
+// file of the current cluster
 func (c *Config) GetWireGuardConfigPath() string {
-    return GetConfigDir() + "/wireguard.conf"
+    return GetClusterWireGuardConfigPath(c.ClusterID())
 }
 
-// WriteFile writes data to a file with proper permissions
+// GetClusterWireGuardConfigPath returns the path to the WireGuard
+// configuration file of cluster
+func GetClusterWireGuardConfigPath(cluster string) string {
+    return filepath.Join(GetClusterDir(cluster), "wireguard.conf")
+}
+
+// GetSSOTokenPath returns the path where the SSO session token from a
+// device sign-in is stored
+func (c *Config) GetSSOTokenPath() string {
+    return GetConfigDir() + "/sso_token.json"
+}
+
+// GetDenialsPath returns the path where the connections most recently
+// refused by the headend are kept for the status output
+func (c *Config) GetDenialsPath() string {
+    return GetConfigDir() + "/denials.json"
+}
+
+// GetTamperPath returns the path where changes other software made to the
+// tunnel's routes are counted for the status output
+func (c *Config) GetTamperPath() string {
+    return GetConfigDir() + "/tamper.json"
+}
+
+// GetBackupHeadendsPath returns the path where the newest signed backup
+// headend list the Manager sent is kept
+func (c *Config) GetBackupHeadendsPath() string {
+    return GetConfigDir() + "/backup_headends.json"
+}
+
+// GetAuthStatePath returns the path where the connected client records the
+// state of its session, without the tokens, for the status output and tray
+func (c *Config) GetAuthStatePath() string {
+    return GetConfigDir() + "/auth_state.json"
+}
+
+// WriteFile writes data to a file with proper permissions, sealed with the
+// at-rest key if EncryptAtRest is set. ReadFile reads it back.
 func (c *Config) WriteFile(path string, data []byte) error {
+    if c.EncryptAtRest {
+        sealed, err := Seal(data)
+        if err != nil {
+            return fmt.Errorf("failed to encrypt %s: %w", filepath.Base(path), err)
+        }
+        data = sealed
+    }
+    
     // Create directory if it doesn't exist
     configDir := filepath.Dir(path)
     if err := os.MkdirAll(configDir, 0700); err != nil {
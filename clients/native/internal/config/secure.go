@@ -0,0 +1,129 @@
+package config
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+
+    "github.com/tobogganing/clients/native/internal/keystore"
+)
+
+// sealedHeader begins files encrypted at rest. What follows is the GCM
+// nonce and the ciphertext, which authenticates the header too.
+const sealedHeader = "SASEWADDLE-SEALED-1\n"
+
+// atRestKeyName is the OS keystore entry holding the at-rest key
+const atRestKeyName = "config-at-rest-key"
+
+var (
+    atRestMu  sync.Mutex
+    atRestKey []byte
+
+    // Where the key is kept; tests replace them
+    keystoreGet = keystore.Get
+    keystoreSet = keystore.Set
+)
+
+// loadAtRestKey returns the AES-256 key files are sealed with, creating
+// one in the OS keystore the first time a file is sealed
+func loadAtRestKey(create bool) ([]byte, error) {
+    atRestMu.Lock()
+    defer atRestMu.Unlock()
+
+    if atRestKey != nil {
+        return atRestKey, nil
+    }
+
+    key, err := keystoreGet(atRestKeyName)
+    if errors.Is(err, keystore.ErrNotFound) && create {
+        key = make([]byte, 32)
+        if _, err := rand.Read(key); err != nil {
+            return nil, fmt.Errorf("failed to generate at-rest key: %w", err)
+        }
+        if err := keystoreSet(atRestKeyName, key); err != nil {
+            return nil, fmt.Errorf("failed to store at-rest key: %w", err)
+        }
+    } else if err != nil {
+        return nil, fmt.Errorf("failed to load at-rest key: %w", err)
+    }
+    if len(key) != 32 {
+        return nil, fmt.Errorf("at-rest key in the OS keystore is %d bytes, want 32", len(key))
+    }
+
+    atRestKey = key
+    return key, nil
+}
+
+func atRestCipher(create bool) (cipher.AEAD, error) {
+    key, err := loadAtRestKey(create)
+    if err != nil {
+        return nil, err
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// IsSealed reports whether data was encrypted by Seal
+func IsSealed(data []byte) bool {
+    return bytes.HasPrefix(data, []byte(sealedHeader))
+}
+
+// Seal encrypts data with the at-rest key from the OS keystore
+func Seal(data []byte) ([]byte, error) {
+    gcm, err := atRestCipher(true)
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, err
+    }
+    sealed := append([]byte(sealedHeader), nonce...)
+    return gcm.Seal(sealed, nonce, data, []byte(sealedHeader)), nil
+}
+
+// Unseal decrypts data sealed by Seal. Data that isn't sealed is returned
+// as it is, so readers handle both.
+func Unseal(data []byte) ([]byte, error) {
+    if !IsSealed(data) {
+        return data, nil
+    }
+
+    gcm, err := atRestCipher(false)
+    if err != nil {
+        return nil, err
+    }
+    sealed := data[len(sealedHeader):]
+    if len(sealed) < gcm.NonceSize() {
+        return nil, fmt.Errorf("sealed data is truncated")
+    }
+    nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+    plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(sealedHeader))
+    if err != nil {
+        return nil, fmt.Errorf("failed to decrypt: the at-rest key does not match or the file was modified")
+    }
+    return plaintext, nil
+}
+
+// ReadFile reads a file the client wrote, decrypting it if it is sealed
+func ReadFile(path string) ([]byte, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    plaintext, err := Unseal(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return plaintext, nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/tobogganing/clients/native/internal/keystore"
+)
+
+// fakeKeystore replaces the OS keystore for a test
+func fakeKeystore(t *testing.T) map[string][]byte {
+    t.Helper()
+    secrets := make(map[string][]byte)
+    get, set := keystoreGet, keystoreSet
+    keystoreGet = func(name string) ([]byte, error) {
+        if secret, ok := secrets[name]; ok {
+            return secret, nil
+        }
+        return nil, keystore.ErrNotFound
+    }
+    keystoreSet = func(name string, secret []byte) error {
+        secrets[name] = secret
+        return nil
+    }
+    atRestKey = nil
+    t.Cleanup(func() {
+        keystoreGet, keystoreSet = get, set
+        atRestKey = nil
+    })
+    return secrets
+}
+
+func TestSealRoundTrip(t *testing.T) {
+    secrets := fakeKeystore(t)
+    plaintext := []byte("[Interface]\nPrivateKey = secret\n")
+
+    if _, err := Unseal([]byte("manager_url: https://manager.example.com")); err != nil {
+        t.Errorf("plaintext should pass through: %v", err)
+    }
+
+    sealed, err := Seal(plaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(secrets[atRestKeyName]) != 32 {
+        t.Fatalf("no key created in the keystore: %v", secrets)
+    }
+    if !IsSealed(sealed) || bytes.Contains(sealed, []byte("PrivateKey")) {
+        t.Fatalf("not sealed: %q", sealed)
+    }
+
+    got, err := Unseal(sealed)
+    if err != nil || !bytes.Equal(got, plaintext) {
+        t.Errorf("got %q, %v", got, err)
+    }
+
+    sealed[len(sealed)-1] ^= 1
+    if _, err := Unseal(sealed); err == nil {
+        t.Error("expected an error for a modified file")
+    }
+
+    // Without the key, sealed data cannot be read and no key is made up
+    delete(secrets, atRestKeyName)
+    atRestKey = nil
+    if _, err := Unseal(sealed); err == nil {
+        t.Error("expected an error without the key")
+    }
+    if _, ok := secrets[atRestKeyName]; ok {
+        t.Error("Unseal created a key")
+    }
+}
+
+func TestLoadSealedConfig(t *testing.T) {
+    fakeKeystore(t)
+    dir := t.TempDir()
+    path := filepath.Join(dir, "sasewaddle.yaml")
+
+    cfg := DefaultConfig()
+    cfg.ManagerURL = "https://manager.example.com"
+    cfg.APIKey = "key"
+    cfg.EncryptAtRest = true
+    if err := cfg.Save(path); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !IsSealed(data) {
+        t.Fatalf("config saved in the clear: %q", data)
+    }
+
+    loaded, err := load(t, path, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if loaded.APIKey != "key" || !loaded.EncryptAtRest {
+        t.Errorf("sealed config did not load: %+v", loaded)
+    }
+
+    // Flat files load sealed too
+    sealed, err := Seal([]byte("manager_url: https://manager.example.com\napi_key: flat\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(path, sealed, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if loaded, err := load(t, path, ""); err != nil || loaded.APIKey != "flat" {
+        t.Errorf("sealed version 1 config: got %+v, %v", loaded, err)
+    }
+}
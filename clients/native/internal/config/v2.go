@@ -0,0 +1,612 @@
+package config
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/spf13/viper"
+    "gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the configuration file format Save writes. Version 2
+// groups settings into sections and supports ${ENV} interpolation,
+// includes and profiles; files without a version are version 1, the flat
+// key list, and still load.
+//
+//	version: 2
+//	include: [common.yaml]         # merged first, relative to this file
+//	profile: office                # default profile
+//	manager:
+//	  url: https://manager.example.com
+//	  api_key: ${SASEWADDLE_API_KEY}
+//	connection:
+//	  reconnect_interval: ${RECONNECT:-30}
+//	profiles:
+//	  travel:                      # sections merged over the ones above
+//	    connection:
+//	      vpn_coexistence: split
+const CurrentVersion = 2
+
+// ProfileEnv selects a profile when the command line does not
+const ProfileEnv = "SASEWADDLE_PROFILE"
+
+// v2Schema maps each version 2 setting, section.key, to the version 1 key
+// it replaces, in the order Save and migrate write them
+var v2Schema = []struct {
+    path string
+    key  string
+}{
+    {"manager.url", "manager_url"},
+    {"manager.api_key", "api_key"},
+    {"manager.api_key_file", "api_key_file"},
+    {"manager.public_key", "manager_public_key"},
+    {"client.name", "client_name"},
+    {"client.type", "client_type"},
+    {"connection.auto_connect", "auto_connect"},
+    {"connection.reconnect_interval", "reconnect_interval"},
+    {"connection.egress_region", "egress_region"},
+    {"connection.cluster", "cluster"},
+    {"connection.backup_headends", "backup_headends"},
+    {"connection.wireguard_interface", "wireguard_interface"},
+    {"connection.pause_on_sleep", "pause_on_sleep"},
+    {"connection.vpn_coexistence", "vpn_coexistence"},
+    {"connection.vpn_coexistence_cidrs", "vpn_coexistence_cidrs"},
+    {"auth.refresh_threshold", "auth_refresh_threshold"},
+    {"logging.level", "log_level"},
+    {"logging.format", "log_format"},
+    {"runtime.headless", "headless"},
+    {"runtime.service_mode", "service_mode"},
+    {"bootstrap.output", "bootstrap_output"},
+    {"bootstrap.file", "bootstrap_file"},
+    {"dns.servers", "dns_servers"},
+    {"dns.leak_protection", "dns_leak_protection"},
+    {"policy.local", "local_policy"},
+    {"policy.saas_bypass", "saas_bypass"},
+    {"webrtc.protection", "webrtc_protection"},
+    {"webrtc.exceptions", "webrtc_exceptions"},
+    {"power.profile", "power_profile"},
+    {"storage.encrypt_at_rest", "encrypt_at_rest"},
+}
+
+// v2TopLevel are the keys of a version 2 file outside the sections
+var v2TopLevel = map[string]bool{"version": true, "include": true, "profile": true, "profiles": true}
+
+// document is a parsed configuration file whose nodes remember the file
+// they came from, for error positions
+type document struct {
+    root    *yaml.Node
+    origins map[*yaml.Node]string
+}
+
+// position returns where node is, as file:line:column
+func (d *document) position(node *yaml.Node) string {
+    return fmt.Sprintf("%s:%d:%d", d.origins[node], node.Line, node.Column)
+}
+
+func (d *document) errorf(node *yaml.Node, format string, args ...interface{}) error {
+    return fmt.Errorf("%s: %s", d.position(node), fmt.Sprintf(format, args...))
+}
+
+// fileVersion returns the format version of a configuration file: 1 for a
+// flat file without one, including files that are not YAML at all
+func fileVersion(path string) (int, error) {
+    data, err := ReadFile(path)
+    if err != nil {
+        return 0, err
+    }
+    var header struct {
+        Version yaml.Node `yaml:"version"`
+    }
+    if err := yaml.Unmarshal(data, &header); err != nil || header.Version.Kind == 0 {
+        return 1, nil
+    }
+    version, err := strconv.Atoi(header.Version.Value)
+    if err != nil || version < 1 || version > CurrentVersion {
+        return 0, fmt.Errorf("%s:%d:%d: unsupported config version %q, want 1 or %d",
+            path, header.Version.Line, header.Version.Column, header.Version.Value, CurrentVersion)
+    }
+    return version, nil
+}
+
+// readConfigFile loads a configuration file of either version into viper.
+// Version 2 files are flattened to the version 1 keys, so environment
+// variables and defaults apply the same way to both, and the positions of
+// their settings are recorded in cfg for validation errors.
+func readConfigFile(cfg *Config, path string) error {
+    version, err := fileVersion(path)
+    if err != nil {
+        return fmt.Errorf("failed to read config file: %w", err)
+    }
+    if version == 1 {
+        return readV1(viper.GetViper(), path)
+    }
+
+    profile := cfg.Profile
+    if profile == "" {
+        profile = os.Getenv(ProfileEnv)
+    }
+    settings, sources, profile, err := loadV2(path, profile)
+    if err != nil {
+        return err
+    }
+    if err := viper.MergeConfigMap(settings); err != nil {
+        return fmt.Errorf("failed to apply config file: %w", err)
+    }
+    cfg.Profile = profile
+    cfg.sources = sources
+    return nil
+}
+
+// readV1 reads a flat version 1 file, which may be sealed, into v
+func readV1(v *viper.Viper, path string) error {
+    data, err := ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read config file: %w", err)
+    }
+    v.SetConfigFile(path)
+    // Files found without an extension are YAML
+    if ext := strings.TrimPrefix(filepath.Ext(path), "."); ext != "" {
+        v.SetConfigType(ext)
+    } else {
+        v.SetConfigType("yaml")
+    }
+    if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+        return fmt.Errorf("failed to read config file: %w", err)
+    }
+    return nil
+}
+
+// loadV2 reads a version 2 file with its includes and the selected profile,
+// or the file's default profile if profile is empty. It returns the version
+// 1 settings, where each was set, and the profile applied.
+func loadV2(path, profile string) (map[string]interface{}, map[string]string, string, error) {
+    doc := &document{origins: make(map[*yaml.Node]string)}
+    root, err := doc.load(path, nil)
+    if err != nil {
+        return nil, nil, "", err
+    }
+    doc.root = root
+
+    var errs []error
+    if node := mappingValue(root, "profile"); node != nil && profile == "" {
+        profile = node.Value
+    }
+    if profile != "" {
+        profiles := mappingValue(root, "profiles")
+        overlay := mappingValue(profiles, profile)
+        if overlay == nil {
+            return nil, nil, "", fmt.Errorf("%s: profile %q is not defined", path, profile)
+        }
+        if overlay.Kind != yaml.MappingNode {
+            return nil, nil, "", doc.errorf(overlay, "profile %q must be a mapping of sections", profile)
+        }
+        for i := 0; i < len(overlay.Content); i += 2 {
+            if v2TopLevel[overlay.Content[i].Value] {
+                errs = append(errs, doc.errorf(overlay.Content[i], "%q cannot be set in a profile", overlay.Content[i].Value))
+            }
+        }
+        root = merge(root, overlay)
+    }
+
+    settings := make(map[string]interface{})
+    sources := make(map[string]string)
+    for i := 0; i < len(root.Content); i += 2 {
+        keyNode, section := root.Content[i], root.Content[i+1]
+        if v2TopLevel[keyNode.Value] {
+            continue
+        }
+        if !isSection(keyNode.Value) {
+            errs = append(errs, doc.errorf(keyNode, "unknown section %q%s", keyNode.Value, suggest(keyNode.Value, sectionNames())))
+            continue
+        }
+        if section.Kind != yaml.MappingNode {
+            errs = append(errs, doc.errorf(section, "section %q must be a mapping", keyNode.Value))
+            continue
+        }
+        for j := 0; j < len(section.Content); j += 2 {
+            name, value := section.Content[j], section.Content[j+1]
+            path := keyNode.Value + "." + name.Value
+            key := v1Key(path)
+            if key == "" {
+                errs = append(errs, doc.errorf(name, "unknown key %q in section %s%s", name.Value, keyNode.Value, suggest(name.Value, sectionKeys(keyNode.Value))))
+                continue
+            }
+            decoded, err := decodeSetting(key, value)
+            if err != nil {
+                errs = append(errs, doc.errorf(value, "%s: %v", path, err))
+                continue
+            }
+            settings[key] = decoded
+            sources[key] = doc.position(value)
+        }
+    }
+    if len(errs) > 0 {
+        return nil, nil, "", errors.Join(errs...)
+    }
+    return settings, sources, profile, nil
+}
+
+// load parses path and the files it includes, merged in order with path
+// last, expanding environment variables in every value. including is the
+// chain of files that led here, to catch include loops.
+func (d *document) load(path string, including []string) (*yaml.Node, error) {
+    absolute, err := filepath.Abs(path)
+    if err != nil {
+        return nil, err
+    }
+    for _, seen := range including {
+        if seen == absolute {
+            return nil, fmt.Errorf("%s: include loop through %s", including[len(including)-1], path)
+        }
+    }
+
+    data, err := ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read config file: %w", err)
+    }
+    var file yaml.Node
+    if err := yaml.Unmarshal(data, &file); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    root := &yaml.Node{Kind: yaml.MappingNode}
+    if len(file.Content) > 0 {
+        root = file.Content[0]
+    }
+    var errs []error
+    d.walk(root, path, &errs)
+    if len(errs) > 0 {
+        return nil, errors.Join(errs...)
+    }
+    if root.Kind != yaml.MappingNode {
+        return nil, d.errorf(root, "a config file must be a mapping")
+    }
+
+    merged := &yaml.Node{Kind: yaml.MappingNode}
+    if include := mappingValue(root, "include"); include != nil {
+        var files []*yaml.Node
+        switch include.Kind {
+        case yaml.ScalarNode:
+            files = []*yaml.Node{include}
+        case yaml.SequenceNode:
+            files = include.Content
+        default:
+            return nil, d.errorf(include, "include must be a file or a list of files")
+        }
+        for _, file := range files {
+            includePath := file.Value
+            if !filepath.IsAbs(includePath) {
+                includePath = filepath.Join(filepath.Dir(path), includePath)
+            }
+            included, err := d.load(includePath, append(including, absolute))
+            if err != nil {
+                return nil, err
+            }
+            merged = merge(merged, included)
+        }
+    }
+    return merge(merged, root), nil
+}
+
+// walk records the file each node came from and expands environment
+// variables in scalar values
+func (d *document) walk(node *yaml.Node, path string, errs *[]error) {
+    d.origins[node] = path
+    if node.Kind == yaml.AliasNode {
+        *errs = append(*errs, d.errorf(node, "YAML aliases are not supported"))
+        return
+    }
+    for i, child := range node.Content {
+        d.walk(child, path, errs)
+        // Keys are names, never interpolated
+        if node.Kind == yaml.MappingNode && i%2 == 0 {
+            continue
+        }
+        if child.Kind == yaml.ScalarNode && strings.Contains(child.Value, "$") {
+            expanded, err := expandEnv(child.Value)
+            if err != nil {
+                *errs = append(*errs, d.errorf(child, "%v", err))
+                continue
+            }
+            child.Value = expanded
+            // Let the expanded value resolve to a number or boolean,
+            // unless it was quoted
+            if child.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) == 0 {
+                child.Tag = ""
+            }
+        }
+    }
+}
+
+// expandEnv replaces ${NAME} with the environment variable, or with the
+// default in ${NAME:-default} when it is unset or empty. $$ is a literal $.
+func expandEnv(value string) (string, error) {
+    var out strings.Builder
+    for i := 0; i < len(value); i++ {
+        if value[i] != '$' || i+1 == len(value) {
+            out.WriteByte(value[i])
+            continue
+        }
+        switch value[i+1] {
+        case '$':
+            out.WriteByte('$')
+            i++
+        case '{':
+            end := strings.IndexByte(value[i:], '}')
+            if end < 0 {
+                return "", fmt.Errorf("unterminated ${ in %q", value)
+            }
+            expr := value[i+2 : i+end]
+            name, fallback, hasDefault := strings.Cut(expr, ":-")
+            if name == "" {
+                return "", fmt.Errorf("empty variable name in %q", value)
+            }
+            if env := os.Getenv(name); env != "" {
+                out.WriteString(env)
+            } else if hasDefault {
+                out.WriteString(fallback)
+            } else {
+                return "", fmt.Errorf("environment variable %s is not set", name)
+            }
+            i += end
+        default:
+            out.WriteByte('$')
+        }
+    }
+    return out.String(), nil
+}
+
+// merge returns base with overlay's keys laid over it: mappings merge key
+// by key, anything else replaces
+func merge(base, overlay *yaml.Node) *yaml.Node {
+    if base == nil || base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+        return overlay
+    }
+    merged := &yaml.Node{Kind: yaml.MappingNode, Tag: base.Tag, Line: base.Line, Column: base.Column}
+    merged.Content = append(merged.Content, base.Content...)
+    for i := 0; i < len(overlay.Content); i += 2 {
+        key, value := overlay.Content[i], overlay.Content[i+1]
+        replaced := false
+        for j := 0; j < len(merged.Content); j += 2 {
+            if merged.Content[j].Value == key.Value {
+                merged.Content[j+1] = merge(merged.Content[j+1], value)
+                replaced = true
+                break
+            }
+        }
+        if !replaced {
+            merged.Content = append(merged.Content, key, value)
+        }
+    }
+    return merged
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+    if node == nil || node.Kind != yaml.MappingNode {
+        return nil
+    }
+    for i := 0; i < len(node.Content); i += 2 {
+        if node.Content[i].Value == key {
+            return node.Content[i+1]
+        }
+    }
+    return nil
+}
+
+// decodeSetting decodes value as the type of the Config field for key
+func decodeSetting(key string, value *yaml.Node) (interface{}, error) {
+    switch fieldKind(key) {
+    case reflect.Bool:
+        var b bool
+        if value.Kind != yaml.ScalarNode || value.ShortTag() != "!!bool" {
+            return nil, fmt.Errorf("want true or false, got %q", value.Value)
+        }
+        err := value.Decode(&b)
+        return b, err
+    case reflect.Int:
+        if value.Kind != yaml.ScalarNode || value.ShortTag() != "!!int" {
+            return nil, fmt.Errorf("want a whole number, got %q", value.Value)
+        }
+        var n int
+        err := value.Decode(&n)
+        return n, err
+    case reflect.Slice:
+        if value.Kind != yaml.SequenceNode {
+            return nil, fmt.Errorf("want a list")
+        }
+        list := []string{}
+        for _, item := range value.Content {
+            if item.Kind != yaml.ScalarNode {
+                return nil, fmt.Errorf("want a list of strings")
+            }
+            list = append(list, item.Value)
+        }
+        return list, nil
+    default:
+        if value.Kind != yaml.ScalarNode {
+            return nil, fmt.Errorf("want a string")
+        }
+        return value.Value, nil
+    }
+}
+
+// fieldKind returns the kind of the Config field a version 1 key sets
+func fieldKind(key string) reflect.Kind {
+    t := reflect.TypeOf(Config{})
+    for i := 0; i < t.NumField(); i++ {
+        if t.Field(i).Tag.Get("mapstructure") == key {
+            return t.Field(i).Type.Kind()
+        }
+    }
+    return reflect.Invalid
+}
+
+// v1Key returns the version 1 key a version 2 path sets, or ""
+func v1Key(path string) string {
+    for _, setting := range v2Schema {
+        if setting.path == path {
+            return setting.key
+        }
+    }
+    return ""
+}
+
+// v2Path returns the version 2 path of a version 1 key, or ""
+func v2Path(key string) string {
+    for _, setting := range v2Schema {
+        if setting.key == key {
+            return setting.path
+        }
+    }
+    return ""
+}
+
+func isSection(name string) bool {
+    for _, section := range sectionNames() {
+        if section == name {
+            return true
+        }
+    }
+    return false
+}
+
+// sectionNames returns the sections in schema order
+func sectionNames() []string {
+    var names []string
+    for _, setting := range v2Schema {
+        section, _, _ := strings.Cut(setting.path, ".")
+        if len(names) == 0 || names[len(names)-1] != section {
+            names = append(names, section)
+        }
+    }
+    return names
+}
+
+// sectionKeys returns the keys of a section
+func sectionKeys(section string) []string {
+    var keys []string
+    for _, setting := range v2Schema {
+        if name, key, _ := strings.Cut(setting.path, "."); name == section {
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
+// suggest returns a "did you mean" hint for a misspelled name
+func suggest(name string, candidates []string) string {
+    best, bestDistance := "", 3
+    for _, candidate := range candidates {
+        if d := editDistance(name, candidate); d < bestDistance {
+            best, bestDistance = candidate, d
+        }
+    }
+    if best == "" {
+        return ""
+    }
+    return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+    previous := make([]int, len(b)+1)
+    for j := range previous {
+        previous[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        current := make([]int, len(b)+1)
+        current[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+        }
+        previous = current
+    }
+    return previous[len(b)]
+}
+
+// encodeV2 renders version 1 settings as a version 2 file
+func encodeV2(settings map[string]interface{}) ([]byte, error) {
+    root := &yaml.Node{Kind: yaml.MappingNode}
+    addScalar := func(node *yaml.Node, key string, value interface{}) error {
+        var valueNode yaml.Node
+        if err := valueNode.Encode(value); err != nil {
+            return err
+        }
+        node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &valueNode)
+        return nil
+    }
+    if err := addScalar(root, "version", CurrentVersion); err != nil {
+        return nil, err
+    }
+
+    sections := make(map[string]*yaml.Node)
+    for _, setting := range v2Schema {
+        value, ok := settings[setting.key]
+        if !ok {
+            continue
+        }
+        name, key, _ := strings.Cut(setting.path, ".")
+        section := sections[name]
+        if section == nil {
+            section = &yaml.Node{Kind: yaml.MappingNode}
+            sections[name] = section
+            root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, section)
+        }
+        if err := addScalar(section, key, value); err != nil {
+            return nil, err
+        }
+    }
+
+    var out bytes.Buffer
+    encoder := yaml.NewEncoder(&out)
+    encoder.SetIndent(2)
+    if err := encoder.Encode(root); err != nil {
+        return nil, err
+    }
+    if err := encoder.Close(); err != nil {
+        return nil, err
+    }
+    return out.Bytes(), nil
+}
+
+// Migrate converts a version 1 configuration file, in any format viper
+// reads, to version 2. Settings version 2 does not have are returned
+// rather than carried over, since version 2 rejects unknown keys.
+func Migrate(path string) ([]byte, []string, error) {
+    version, err := fileVersion(path)
+    if err != nil {
+        return nil, nil, err
+    }
+    if version != 1 {
+        return nil, nil, fmt.Errorf("%s is already version %d", path, version)
+    }
+
+    v := viper.New()
+    if err := readV1(v, path); err != nil {
+        return nil, nil, err
+    }
+
+    settings := make(map[string]interface{})
+    var dropped []string
+    for key, value := range v.AllSettings() {
+        if v2Path(key) == "" {
+            dropped = append(dropped, key)
+            continue
+        }
+        settings[key] = value
+    }
+    sort.Strings(dropped)
+    data, err := encodeV2(settings)
+    return data, dropped, err
+}
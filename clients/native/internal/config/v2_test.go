@@ -0,0 +1,250 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/spf13/viper"
+)
+
+// writeFiles writes name: content pairs to a temporary directory
+func writeFiles(t *testing.T, files map[string]string) string {
+    t.Helper()
+    dir := t.TempDir()
+    for name, content := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+// load loads path the way the headless client does
+func load(t *testing.T, path, profile string) (*Config, error) {
+    t.Helper()
+    viper.Reset()
+    t.Cleanup(viper.Reset)
+    cfg := DefaultConfig()
+    cfg.Profile = profile
+    if err := Load(cfg, path); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+func TestLoadV2(t *testing.T) {
+    t.Setenv("TEST_API_KEY", "secret")
+    t.Setenv("TEST_RECONNECT", "")
+    dir := writeFiles(t, map[string]string{
+        "common.yaml": `
+manager:
+  url: https://manager.example.com
+connection:
+  egress_region: us-east
+dns:
+  servers: [10.0.0.1]
+`,
+        "sasewaddle.yaml": `
+version: 2
+include: common.yaml
+profile: office
+manager:
+  api_key: ${TEST_API_KEY}
+client:
+  name: "$${literal}"
+connection:
+  reconnect_interval: ${TEST_RECONNECT:-45}
+profiles:
+  office:
+    connection:
+      egress_region: eu-west
+  travel:
+    connection:
+      vpn_coexistence: split
+`,
+    })
+    path := filepath.Join(dir, "sasewaddle.yaml")
+
+    cfg, err := load(t, path, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.ManagerURL != "https://manager.example.com" || cfg.APIKey != "secret" || cfg.ClientName != "${literal}" {
+        t.Errorf("unexpected manager settings: %q %q %q", cfg.ManagerURL, cfg.APIKey, cfg.ClientName)
+    }
+    if cfg.ReconnectInterval != 45 {
+        t.Errorf("reconnect_interval: got %d, want 45", cfg.ReconnectInterval)
+    }
+    if cfg.Profile != "office" || cfg.EgressRegion != "eu-west" {
+        t.Errorf("default profile: got %q with region %q", cfg.Profile, cfg.EgressRegion)
+    }
+    if !reflect.DeepEqual(cfg.DNSServers, []string{"10.0.0.1"}) {
+        t.Errorf("dns_servers from the include: got %v", cfg.DNSServers)
+    }
+    if cfg.PowerProfile != "auto" {
+        t.Errorf("unset keys keep their defaults: got power_profile %q", cfg.PowerProfile)
+    }
+
+    t.Setenv(ProfileEnv, "travel")
+    cfg, err = load(t, path, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Profile != "travel" || cfg.EgressRegion != "us-east" || cfg.VPNCoexistence != "split" {
+        t.Errorf("travel profile: got %q with region %q and coexistence %q", cfg.Profile, cfg.EgressRegion, cfg.VPNCoexistence)
+    }
+
+    if _, err := load(t, path, "home"); err == nil || !strings.Contains(err.Error(), `profile "home" is not defined`) {
+        t.Errorf("unknown profile: got %v", err)
+    }
+}
+
+func TestLoadV2Errors(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "bad.yaml": `version: 2
+manager:
+  ur1: https://manager.example.com
+connection:
+  auto_connect: maybe
+loging:
+  level: debug
+`,
+        "invalid.yaml": `version: 2
+manager:
+  url: https://manager.example.com
+  api_key: key
+logging:
+  level: verbose
+`,
+        "unset.yaml": "version: 2\nconnection:\n  reconnect_interval: ${TEST_UNSET_VARIABLE}\n",
+        "loop.yaml": "version: 2\ninclude: loop.yaml\n",
+        "future.yaml": "version: 3\n",
+    })
+
+    _, err := load(t, filepath.Join(dir, "bad.yaml"), "")
+    if err == nil {
+        t.Fatal("expected errors")
+    }
+    for _, want := range []string{
+        `bad.yaml:3:3: unknown key "ur1" in section manager (did you mean "url"?)`,
+        `bad.yaml:5:17: connection.auto_connect: want true or false, got "maybe"`,
+        `bad.yaml:6:1: unknown section "loging" (did you mean "logging"?)`,
+    } {
+        if !strings.Contains(err.Error(), want) {
+            t.Errorf("missing %q in:\n%v", want, err)
+        }
+    }
+
+    cfg, err := load(t, filepath.Join(dir, "invalid.yaml"), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "invalid.yaml:6:10: invalid log_level: verbose") {
+        t.Errorf("validation error without position: %v", err)
+    }
+
+    if _, err := load(t, filepath.Join(dir, "unset.yaml"), ""); err == nil || !strings.Contains(err.Error(), "unset.yaml:3:23: environment variable TEST_UNSET_VARIABLE is not set") {
+        t.Errorf("unset variable: got %v", err)
+    }
+    if _, err := load(t, filepath.Join(dir, "loop.yaml"), ""); err == nil || !strings.Contains(err.Error(), "include loop") {
+        t.Errorf("include loop: got %v", err)
+    }
+    if _, err := load(t, filepath.Join(dir, "future.yaml"), ""); err == nil || !strings.Contains(err.Error(), "unsupported config version") {
+        t.Errorf("future version: got %v", err)
+    }
+}
+
+func TestMigrate(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "v1.yaml": `manager_url: https://manager.example.com
+api_key: key
+reconnect_interval: 60
+dns_servers: [10.0.0.1, 1.1.1.1]
+dns_leak_protection: false
+legacy_option: true
+`,
+    })
+    path := filepath.Join(dir, "v1.yaml")
+
+    data, dropped, err := Migrate(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(dropped, []string{"legacy_option"}) {
+        t.Errorf("dropped: got %v", dropped)
+    }
+    want := `version: 2
+manager:
+  url: https://manager.example.com
+  api_key: key
+connection:
+  reconnect_interval: 60
+dns:
+  servers:
+    - 10.0.0.1
+    - 1.1.1.1
+  leak_protection: false
+`
+    if string(data) != want {
+        t.Errorf("got:\n%s\nwant:\n%s", data, want)
+    }
+
+    // The result loads to the same settings, and is not migrated again
+    if err := os.WriteFile(path, data, 0600); err != nil {
+        t.Fatal(err)
+    }
+    cfg, err := load(t, path, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.ReconnectInterval != 60 || cfg.DNSLeakProtection || len(cfg.DNSServers) != 2 {
+        t.Errorf("migrated settings did not load: %+v", cfg)
+    }
+    if _, _, err := Migrate(path); err == nil {
+        t.Error("expected an error migrating a version 2 file")
+    }
+}
+
+func TestClusterPaths(t *testing.T) {
+    t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+    t.Setenv("HOME", t.TempDir())
+    dir := writeFiles(t, map[string]string{
+        "sasewaddle.yaml": `
+version: 2
+manager:
+  url: https://manager.example.com
+  api_key: secret
+connection:
+  cluster: eu-west-1
+`,
+    })
+
+    cfg, err := load(t, filepath.Join(dir, "sasewaddle.yaml"), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.ClusterID() != "eu-west-1" {
+        t.Fatalf("cluster: got %q, want eu-west-1", cfg.ClusterID())
+    }
+    if want := filepath.Join(GetConfigDir(), "clusters", "eu-west-1", "wireguard.conf"); cfg.GetWireGuardConfigPath() != want {
+        t.Errorf("WireGuard configuration path: got %s, want %s", cfg.GetWireGuardConfigPath(), want)
+    }
+
+    // Automatic selection uses the shared directory until a cluster is chosen
+    cfg.Cluster = "auto"
+    if cfg.GetWireGuardConfigPath() != filepath.Join(GetConfigDir(), "wireguard.conf") {
+        t.Errorf("unexpected path before selection: %s", cfg.GetWireGuardConfigPath())
+    }
+    cfg.ActiveCluster = "us-east-1"
+    if cfg.ClusterID() != "us-east-1" {
+        t.Errorf("cluster after selection: got %q, want us-east-1", cfg.ClusterID())
+    }
+
+    cfg.Cluster = "../escape"
+    if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "invalid cluster") {
+        t.Errorf("expected a cluster with a path separator to be rejected, got %v", err)
+    }
+}
@@ -0,0 +1,236 @@
+// Package dnsguard implements DNS leak protection for the SASEWaddle native client.
+//
+// The dnsguard package provides:
+//   - Platform firewall rules that block plain DNS (53), DNS-over-TLS (853)
+//     and well-known DNS-over-HTTPS resolvers outside the tunnel interface
+//   - Periodic leak tests that detect queries escaping the tunnel
+//   - A leak status suitable for the status command and the tray
+//
+// While connected, every DNS query must resolve through the tunnel DNS
+// server. Rules are installed into a dedicated chain, anchor or rule group
+// owned by the client so they can be removed cleanly on disconnect.
+package dnsguard
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ruleName names the iptables chain, pf anchor and Windows rule group we own
+	ruleName = "SASEWADDLE-DNS"
+	pfAnchor = "com.sasewaddle/dns"
+	dnsPorts = "53,853"
+)
+
+// State is the DNS leak protection state reported to users
+type State string
+
+const (
+	StateDisabled  State = "disabled"
+	StateProtected State = "protected"
+	StateLeaking   State = "leaking"
+	StateUnknown   State = "unknown"
+)
+
+// Status is the outcome of the most recent leak check
+type Status struct {
+	State     State     `json:"state"`
+	Detail    string    `json:"detail,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// publicDoHResolvers are well-known DNS-over-HTTPS endpoints. Browsers use
+// them directly, bypassing the system resolver, so HTTPS to these addresses
+// is blocked outside the tunnel.
+var publicDoHResolvers = []string{
+	"1.1.1.1", "1.0.0.1", // Cloudflare
+	"8.8.8.8", "8.8.4.4", // Google
+	"9.9.9.9", "149.112.112.112", // Quad9
+	"208.67.222.222", "208.67.220.220", // OpenDNS
+	"2606:4700:4700::1111", "2606:4700:4700::1001",
+	"2001:4860:4860::8888", "2001:4860:4860::8844",
+	"2620:fe::fe", "2620:fe::9",
+}
+
+// Guard installs and checks DNS leak protection for one tunnel interface
+type Guard struct {
+	interfaceName   string
+	tunnelResolvers []string
+	enabled         bool
+	lastStatus      Status
+	mutex           sync.RWMutex
+}
+
+// New creates a guard for the tunnel interface. tunnelResolvers are the DNS
+// servers reachable through the tunnel.
+func New(interfaceName string, tunnelResolvers []string) *Guard {
+	return &Guard{
+		interfaceName:   interfaceName,
+		tunnelResolvers: tunnelResolvers,
+		lastStatus:      Status{State: StateDisabled},
+	}
+}
+
+// SetInterfaceName changes the tunnel interface the rules exempt, for
+// platforms that name the interface when it is created. Call it before
+// Enable.
+func (g *Guard) SetInterfaceName(interfaceName string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.interfaceName = interfaceName
+}
+
+// Enable installs the platform rules blocking DNS outside the tunnel
+func (g *Guard) Enable() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if err := g.removeRules(); err != nil {
+		return err
+	}
+
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		err = g.installLinux()
+	case "darwin":
+		err = g.installDarwin()
+	case "windows":
+		err = g.installWindows()
+	default:
+		err = fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+	if err != nil {
+		_ = g.removeRules()
+		return fmt.Errorf("failed to install DNS leak protection: %w", err)
+	}
+
+	g.enabled = true
+	g.lastStatus = Status{State: StateUnknown, CheckedAt: time.Now()}
+	return nil
+}
+
+// Disable removes the rules installed by Enable
+func (g *Guard) Disable() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.enabled = false
+	g.lastStatus = Status{State: StateDisabled, CheckedAt: time.Now()}
+	return g.removeRules()
+}
+
+// Installed reports whether protection rules are present on the system,
+// including rules installed by another client process
+func (g *Guard) Installed() bool {
+	switch runtime.GOOS {
+	case "linux":
+		return exec.Command("iptables", "-C", "OUTPUT", "-j", ruleName).Run() == nil
+	case "darwin":
+		output, err := exec.Command("pfctl", "-a", pfAnchor, "-s", "rules").Output()
+		return err == nil && len(strings.TrimSpace(string(output))) > 0
+	case "windows":
+		return exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name="+ruleName).Run() == nil
+	default:
+		return false
+	}
+}
+
+// LastStatus returns the result of the most recent leak check
+func (g *Guard) LastStatus() Status {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.lastStatus
+}
+
+func (g *Guard) installLinux() error {
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if err := run(tool, "-N", ruleName); err != nil {
+			return err
+		}
+
+		// DNS through the tunnel or to a local stub resolver is fine
+		rules := [][]string{
+			{"-A", ruleName, "-o", g.interfaceName, "-j", "RETURN"},
+			{"-A", ruleName, "-o", "lo", "-j", "RETURN"},
+			{"-A", ruleName, "-p", "udp", "-m", "multiport", "--dports", dnsPorts, "-j", "REJECT"},
+			{"-A", ruleName, "-p", "tcp", "-m", "multiport", "--dports", dnsPorts, "-j", "REJECT"},
+		}
+		for _, resolver := range publicDoHResolvers {
+			if strings.Contains(resolver, ":") != (tool == "ip6tables") {
+				continue
+			}
+			rules = append(rules, []string{"-A", ruleName, "-p", "tcp", "-d", resolver, "--dport", "443", "-j", "REJECT"})
+		}
+		rules = append(rules, []string{"-I", "OUTPUT", "-j", ruleName})
+
+		for _, rule := range rules {
+			if err := run(tool, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Guard) installDarwin() error {
+	var rules strings.Builder
+	fmt.Fprintf(&rules, "pass out quick on %s proto { udp tcp } to any port { 53 853 }\n", g.interfaceName)
+	fmt.Fprintf(&rules, "pass out quick on lo0 proto { udp tcp } to any port { 53 853 }\n")
+	fmt.Fprintf(&rules, "block return out quick proto { udp tcp } to any port { 53 853 }\n")
+	fmt.Fprintf(&rules, "pass out quick on %s proto tcp to { %s } port 443\n", g.interfaceName, strings.Join(publicDoHResolvers, " "))
+	fmt.Fprintf(&rules, "block return out quick proto tcp to { %s } port 443\n", strings.Join(publicDoHResolvers, " "))
+
+	cmd := exec.Command("pfctl", "-a", pfAnchor, "-f", "-")
+	cmd.Stdin = strings.NewReader(rules.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pfctl failed: %v, output: %s", err, output)
+	}
+	return nil
+}
+
+func (g *Guard) installWindows() error {
+	// Windows block rules override allow rules, so the block is scoped to
+	// every adapter except the tunnel instead of adding a tunnel exception
+	script := fmt.Sprintf(`$ifs = (Get-NetAdapter | Where-Object Name -ne '%[1]s').Name
+New-NetFirewallRule -DisplayName '%[2]s' -Group '%[2]s' -Direction Outbound -Action Block -Protocol UDP -RemotePort 53,853 -InterfaceAlias $ifs | Out-Null
+New-NetFirewallRule -DisplayName '%[2]s' -Group '%[2]s' -Direction Outbound -Action Block -Protocol TCP -RemotePort 53,853 -InterfaceAlias $ifs | Out-Null
+New-NetFirewallRule -DisplayName '%[2]s' -Group '%[2]s' -Direction Outbound -Action Block -Protocol TCP -RemotePort 443 -RemoteAddress %[3]s -InterfaceAlias $ifs | Out-Null`,
+		g.interfaceName, ruleName, strings.Join(publicDoHResolvers, ","))
+	return run("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+}
+
+// removeRules deletes everything we installed. Missing rules are not an error.
+func (g *Guard) removeRules() error {
+	switch runtime.GOOS {
+	case "linux":
+		for _, tool := range []string{"iptables", "ip6tables"} {
+			for exec.Command(tool, "-D", "OUTPUT", "-j", ruleName).Run() == nil {
+			}
+			_ = exec.Command(tool, "-F", ruleName).Run()
+			_ = exec.Command(tool, "-X", ruleName).Run()
+		}
+		return nil
+	case "darwin":
+		_ = exec.Command("pfctl", "-a", pfAnchor, "-F", "rules").Run()
+		return nil
+	case "windows":
+		_ = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Remove-NetFirewallRule -Group '%s' -ErrorAction SilentlyContinue", ruleName)).Run()
+		return nil
+	default:
+		return nil
+	}
+}
+
+func run(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, output)
+	}
+	return nil
+}
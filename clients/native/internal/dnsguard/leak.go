@@ -0,0 +1,191 @@
+package dnsguard
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// leakTestResolver is queried directly during leak tests. With protection in
+// place the query must either fail or leave through the tunnel.
+const leakTestResolver = "1.1.1.1:53"
+
+// Check runs a leak test and records the result. It verifies that system
+// resolvers point into the tunnel and that a direct query to a public
+// resolver cannot leave through another interface.
+func (g *Guard) Check(ctx context.Context) Status {
+	g.mutex.RLock()
+	enabled := g.enabled
+	g.mutex.RUnlock()
+
+	status := g.check(ctx, enabled || g.Installed())
+
+	g.mutex.Lock()
+	g.lastStatus = status
+	g.mutex.Unlock()
+	return status
+}
+
+func (g *Guard) check(ctx context.Context, protected bool) Status {
+	status := Status{State: StateProtected, CheckedAt: time.Now()}
+	if !protected {
+		status.State = StateDisabled
+		return status
+	}
+
+	for _, resolver := range systemResolvers() {
+		if !g.isTunnelResolver(resolver) {
+			status.State = StateLeaking
+			status.Detail = fmt.Sprintf("system resolver %s is outside the tunnel", resolver)
+			return status
+		}
+	}
+
+	leaked, via, err := g.testQuery(ctx)
+	if err != nil {
+		status.State = StateUnknown
+		status.Detail = err.Error()
+		return status
+	}
+	if leaked {
+		status.State = StateLeaking
+		status.Detail = fmt.Sprintf("test query to %s answered via %s", leakTestResolver, via)
+	}
+	return status
+}
+
+func (g *Guard) isTunnelResolver(resolver string) bool {
+	ip := net.ParseIP(resolver)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		// Local stub resolvers forward to whatever the tunnel configured
+		return true
+	}
+	for _, tunnelResolver := range g.tunnelResolvers {
+		if ip.Equal(net.ParseIP(tunnelResolver)) {
+			return true
+		}
+	}
+	return false
+}
+
+// testQuery sends a query for a random name directly to a public resolver.
+// It reports a leak if an answer arrives over a non-tunnel source address.
+func (g *Guard) testQuery(ctx context.Context) (bool, string, error) {
+	query, err := buildQuery()
+	if err != nil {
+		return false, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", leakTestResolver)
+	if err != nil {
+		// No route or blocked at connect time: nothing leaked
+		return false, "", nil
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return false, "", nil
+	}
+	reply := make([]byte, 512)
+	if _, err := conn.Read(reply); err != nil {
+		return false, "", nil
+	}
+
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	tunnelIPs, err := g.tunnelAddresses()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read tunnel addresses: %w", err)
+	}
+	for _, tunnelIP := range tunnelIPs {
+		if tunnelIP.Equal(localIP) {
+			return false, "", nil
+		}
+	}
+	return true, localIP.String(), nil
+}
+
+func (g *Guard) tunnelAddresses() ([]net.IP, error) {
+	iface, err := net.InterfaceByName(g.interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// buildQuery encodes a recursive A query for a random name under the
+// reserved .invalid TLD so resolvers answer without contacting anyone else
+func buildQuery() ([]byte, error) {
+	random := make([]byte, 10)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate query name: %w", err)
+	}
+	name := "sasewaddle-leaktest-" + hex.EncodeToString(random[2:]) + ".invalid"
+
+	query := make([]byte, 12, 64)
+	copy(query[0:2], random[0:2])                  // ID
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(query[4:6], 1)      // QDCOUNT
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 1, 0, 1) // root, QTYPE A, QCLASS IN
+	return query, nil
+}
+
+// systemResolvers returns the nameservers the OS resolver is configured to
+// use. Windows per-adapter resolvers are enforced by the firewall rules.
+func systemResolvers() []string {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var resolvers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			resolvers = append(resolvers, fields[1])
+		}
+	}
+	return resolvers
+}
@@ -0,0 +1,35 @@
+// Package keystore keeps small secrets in the operating system's credential
+// store, so they are protected by the user's login rather than by file
+// permissions alone.
+//
+// The keystore package provides:
+//   - The login keychain on macOS, through the security tool
+//   - The Secret Service (GNOME Keyring, KWallet) on Linux, through
+//     secret-tool; headless hosts without a session bus have no keystore
+//   - DPAPI on Windows, which encrypts the secret to the current user and
+//     keeps it in a file under %APPDATA%
+package keystore
+
+import "errors"
+
+// Service names the client's entries in the credential store
+const Service = "SASEWaddle"
+
+var (
+	// ErrNotFound is returned by Get when there is no secret by that name
+	ErrNotFound = errors.New("secret not found in the OS keystore")
+
+	// ErrUnsupported is returned when the platform has no keystore the
+	// package can use
+	ErrUnsupported = errors.New("no OS keystore available")
+)
+
+// Get returns the secret stored as name
+func Get(name string) ([]byte, error) {
+	return get(name)
+}
+
+// Set stores secret as name, replacing any secret already there
+func Set(name string, secret []byte) error {
+	return set(name, secret)
+}
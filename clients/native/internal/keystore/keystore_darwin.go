@@ -0,0 +1,37 @@
+//go:build darwin
+
+package keystore
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// errItemNotFound is the security tool's exit status for a missing item
+const errItemNotFound = 44
+
+func get(name string) ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", Service, "-a", name, "-w").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == errItemNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read %s from the keychain: %w", name, err)
+	}
+	// Secrets are stored base64-encoded, since -w prints binary as hex
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func set(name string, secret []byte) error {
+	// -U updates an existing item instead of failing
+	cmd := exec.Command("security", "add-generic-password", "-U", "-s", Service, "-a", name,
+		"-w", base64.StdEncoding.EncodeToString(secret))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store %s in the keychain: %v, output: %s", name, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package keystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func get(name string) ([]byte, error) {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil, fmt.Errorf("%w: secret-tool is not installed", ErrUnsupported)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "lookup", "service", Service, "account", name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// secret-tool exits 1 without output when nothing matches
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && stderr.Len() == 0 {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read %s from the Secret Service: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func set(name string, secret []byte) error {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return fmt.Errorf("%w: secret-tool is not installed", ErrUnsupported)
+	}
+	cmd := exec.Command("secret-tool", "store", "--label", Service+" "+name, "service", Service, "account", name)
+	// The secret goes on stdin, never on the command line
+	cmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(secret))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store %s in the Secret Service: %v, output: %s", name, err, output)
+	}
+	return nil
+}
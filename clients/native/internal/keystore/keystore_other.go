@@ -0,0 +1,11 @@
+//go:build !darwin && !linux && !windows
+
+package keystore
+
+func get(name string) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func set(name string, secret []byte) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,73 @@
+//go:build windows
+
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// path returns the file holding the DPAPI-protected secret name
+func path(name string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "SASEWaddle", "keys", name+".dpapi"), nil
+}
+
+func get(name string) ([]byte, error) {
+	file, err := path(name)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(blob(protected), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("failed to unprotect %s: %w", name, err)
+	}
+	return take(&out), nil
+}
+
+func set(name string, secret []byte) error {
+	file, err := path(name)
+	if err != nil {
+		return err
+	}
+
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(blob(secret), windows.StringToUTF16Ptr(Service), nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return fmt.Errorf("failed to protect %s: %w", name, err)
+	}
+	protected := take(&out)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(file, protected, 0600)
+}
+
+func blob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+// take copies a blob DPAPI allocated and frees it
+func take(b *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	return append([]byte(nil), unsafe.Slice(b.Data, b.Size)...)
+}
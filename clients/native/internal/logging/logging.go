@@ -0,0 +1,155 @@
+// Package logging formats the native client's console output for log
+// collectors.
+//
+// The client reports progress with plain lines on stdout. When it runs as a
+// workload or service client, those lines are captured and re-emitted as
+// one JSON object per line so they can be shipped without parsing.
+package logging
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // FormatText leaves output unchanged
+    FormatText = "text"
+    // FormatJSON writes one JSON object per line
+    FormatJSON = "json"
+)
+
+// entry is a single structured log line
+type entry struct {
+    Time    string `json:"time"`
+    Level   string `json:"level"`
+    Message string `json:"msg"`
+    Service string `json:"service"`
+}
+
+// JSONWriter turns the lines written to it into JSON log entries. Partial
+// lines are held until their newline arrives.
+type JSONWriter struct {
+    mu      sync.Mutex
+    out     io.Writer
+    service string
+    pending []byte
+    now     func() time.Time
+}
+
+// NewJSONWriter creates a writer emitting JSON entries for service to out
+func NewJSONWriter(out io.Writer, service string) *JSONWriter {
+    return &JSONWriter{out: out, service: service, now: time.Now}
+}
+
+// Write implements io.Writer
+func (w *JSONWriter) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    w.pending = append(w.pending, p...)
+    for {
+        i := bytes.IndexByte(w.pending, '\n')
+        if i < 0 {
+            break
+        }
+        line := string(w.pending[:i])
+        w.pending = w.pending[i+1:]
+        if err := w.emit(line); err != nil {
+            return len(p), err
+        }
+    }
+    return len(p), nil
+}
+
+// Flush emits a trailing line that never got its newline
+func (w *JSONWriter) Flush() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if len(w.pending) == 0 {
+        return nil
+    }
+    line := string(w.pending)
+    w.pending = nil
+    return w.emit(line)
+}
+
+func (w *JSONWriter) emit(line string) error {
+    line = strings.TrimRight(line, "\r")
+    if strings.TrimSpace(line) == "" {
+        return nil
+    }
+
+    level, message := classify(line)
+    data, err := json.Marshal(entry{
+        Time:    w.now().UTC().Format(time.RFC3339Nano),
+        Level:   level,
+        Message: message,
+        Service: w.service,
+    })
+    if err != nil {
+        return err
+    }
+    _, err = w.out.Write(append(data, '\n'))
+    return err
+}
+
+// classify infers a level from the client's console conventions
+func classify(line string) (level, message string) {
+    message = strings.TrimSpace(line)
+    switch {
+    case strings.HasPrefix(message, "WARNING:"):
+        return "warn", strings.TrimSpace(strings.TrimPrefix(message, "WARNING:"))
+    case strings.Contains(strings.ToLower(message), "failed"):
+        return "error", message
+    default:
+        return "info", message
+    }
+}
+
+// Redirect sends everything the process prints to stdout, and the standard
+// logger, through a JSON writer on the real stdout. The returned function
+// restores stdout and flushes buffered output. For FormatText it does nothing.
+func Redirect(format, service string) (func(), error) {
+    switch format {
+    case "", FormatText:
+        return func() {}, nil
+    case FormatJSON:
+    default:
+        return nil, fmt.Errorf("unknown log format: %s", format)
+    }
+
+    reader, writer, err := os.Pipe()
+    if err != nil {
+        return nil, fmt.Errorf("failed to capture stdout: %w", err)
+    }
+
+    stdout := os.Stdout
+    jsonWriter := NewJSONWriter(stdout, service)
+    done := make(chan struct{})
+    go func() {
+        _, _ = io.Copy(jsonWriter, reader)
+        _ = jsonWriter.Flush()
+        close(done)
+    }()
+
+    os.Stdout = writer
+    log.SetFlags(0)
+    log.SetOutput(writer)
+
+    return func() {
+        os.Stdout = stdout
+        log.SetFlags(log.LstdFlags)
+        log.SetOutput(os.Stderr)
+        _ = writer.Close()
+        <-done
+        _ = reader.Close()
+    }, nil
+}
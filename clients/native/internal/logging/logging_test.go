@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONWriter_Lines(t *testing.T) {
+	var out bytes.Buffer
+	w := NewJSONWriter(&out, "test")
+	w.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	// Lines may arrive split across writes
+	_, _ = w.Write([]byte("Connecting to "))
+	_, _ = w.Write([]byte("SASEWaddle network...\n\nWARNING: DNS leak detected: 8.8.8.8\n"))
+	_, _ = w.Write([]byte("Health check failed: timeout\npartial"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []entry{
+		{Time: "2024-01-02T03:04:05Z", Level: "info", Message: "Connecting to SASEWaddle network...", Service: "test"},
+		{Time: "2024-01-02T03:04:05Z", Level: "warn", Message: "DNS leak detected: 8.8.8.8", Service: "test"},
+		{Time: "2024-01-02T03:04:05Z", Level: "error", Message: "Health check failed: timeout", Service: "test"},
+		{Time: "2024-01-02T03:04:05Z", Level: "info", Message: "partial", Service: "test"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d: %q", len(expected), len(lines), out.String())
+	}
+	for i, line := range lines {
+		var got entry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("Line %d is not JSON: %v", i, err)
+		}
+		if got != expected[i] {
+			t.Errorf("Line %d: expected %+v, got %+v", i, expected[i], got)
+		}
+	}
+}
+
+func TestRedirect_UnknownFormat(t *testing.T) {
+	if _, err := Redirect("xml", "test"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,115 @@
+// Package netmon watches the host's interfaces, addresses and routes for
+// the SASEWaddle native client.
+//
+// The netmon package provides:
+//   - Link, address and route change events as they happen, from rtnetlink
+//     on Linux, the PF_ROUTE socket on macOS and the IP Helper change
+//     notifications on Windows
+//   - The interface index, name and address or route prefix of each change,
+//     where the platform reports them
+//   - ErrUnsupported elsewhere, so callers can fall back to polling
+//   - The interface traffic to an address currently leaves through
+//
+// Events say what changed, not whether it matters: the VPN manager decides
+// which ones touch the tunnel and repairs it.
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrUnsupported is returned by Watch on platforms without change
+// notifications
+var ErrUnsupported = errors.New("interface and route monitoring is not supported on this platform")
+
+// Kind is what an event is about
+type Kind string
+
+const (
+	KindLink    Kind = "link"
+	KindAddress Kind = "address"
+	KindRoute   Kind = "route"
+)
+
+// Event is one change to the host's networking
+type Event struct {
+	Kind    Kind
+	Removed bool         // the link, address or route went away
+	Index   int          // interface index; 0 when unknown
+	Name    string       // interface name, when reported
+	Prefix  netip.Prefix // address or route destination, when reported
+}
+
+func (e Event) String() string {
+	action := "changed"
+	if e.Removed {
+		action = "removed"
+	}
+	target := fmt.Sprintf("interface %d", e.Index)
+	if e.Name != "" {
+		target = e.Name
+	}
+	if e.Prefix.IsValid() {
+		return fmt.Sprintf("%s %s %s on %s", e.Kind, e.Prefix, action, target)
+	}
+	return fmt.Sprintf("%s %s on %s", e.Kind, action, target)
+}
+
+// Affects reports whether e changed the tunnel interface with the given
+// index or name, or a route that can take traffic away from one of the
+// tunnel's routes. Routes that only overlap a default route through the
+// tunnel are ordinary LAN routes and do not count.
+func (e Event) Affects(index int, name string, routes []netip.Prefix) bool {
+	if (e.Index != 0 && e.Index == index) || (e.Name != "" && e.Name == name) {
+		return true
+	}
+	if e.Kind != KindRoute {
+		return false
+	}
+	if !e.Prefix.IsValid() {
+		// The platform could not say which route changed
+		return true
+	}
+	for _, route := range routes {
+		if route.Bits() > 0 && route.Overlaps(e.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reports changes until ctx is done, when the channel is closed.
+// Events are dropped rather than delivered late if the receiver falls
+// behind, since a receiver checks the current state anyway.
+func Watch(ctx context.Context) (<-chan Event, error) {
+	events := make(chan Event, eventBuffer)
+	if err := watch(ctx, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// eventBuffer absorbs the burst of events bringing an interface up or down
+const eventBuffer = 64
+
+// send delivers e without blocking
+func send(events chan<- Event, e Event) {
+	select {
+	case events <- e:
+	default:
+	}
+}
+
+// prefixFrom builds a prefix from an address and prefix length, returning
+// the zero prefix if either is unusable
+func prefixFrom(addr []byte, bits int) netip.Prefix {
+	ip, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return netip.Prefix{}
+	}
+	// PrefixFrom keeps the host bits of an interface address
+	return netip.PrefixFrom(ip.Unmap(), bits)
+}
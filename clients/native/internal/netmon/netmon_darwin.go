@@ -0,0 +1,134 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+func watch(ctx context.Context, events chan<- Event) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to configure routing socket: %w", err)
+	}
+
+	// A non-blocking file goes through the runtime poller, so closing it
+	// interrupts the read
+	socket := os.NewFile(uintptr(fd), "route")
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 16<<10)
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				return
+			}
+			messages, err := route.ParseRIB(route.RIBTypeRoute, buf[:n])
+			if err != nil {
+				// Whatever changed is still worth a look
+				send(events, Event{Kind: KindRoute})
+				continue
+			}
+			for _, m := range messages {
+				if e, ok := routeEvent(m); ok {
+					send(events, e)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// routeEvent turns a routing socket message into an event
+func routeEvent(m route.Message) (Event, bool) {
+	switch m := m.(type) {
+	case *route.RouteMessage:
+		switch m.Type {
+		case syscall.RTM_ADD, syscall.RTM_DELETE, syscall.RTM_CHANGE:
+		default:
+			return Event{}, false
+		}
+		e := Event{Kind: KindRoute, Removed: m.Type == syscall.RTM_DELETE, Index: m.Index}
+		if len(m.Addrs) > syscall.RTAX_NETMASK {
+			ones := -1
+			if m.Flags&syscall.RTF_HOST != 0 {
+				ones = 128
+			} else if m.Addrs[syscall.RTAX_NETMASK] != nil {
+				ones = maskBits(m.Addrs[syscall.RTAX_NETMASK])
+			}
+			e.Prefix = addrPrefix(m.Addrs[syscall.RTAX_DST], ones)
+		}
+		return e, true
+
+	case *route.InterfaceMessage:
+		// An interface going away is reported as going down; it has no
+		// announce message of its own here
+		return Event{Kind: KindLink, Index: m.Index, Name: m.Name}, true
+
+	case *route.InterfaceAddrMessage:
+		e := Event{Kind: KindAddress, Removed: m.Type == syscall.RTM_DELADDR, Index: m.Index}
+		if len(m.Addrs) > syscall.RTAX_IFA {
+			ones := -1
+			if m.Addrs[syscall.RTAX_NETMASK] != nil {
+				ones = maskBits(m.Addrs[syscall.RTAX_NETMASK])
+			}
+			e.Prefix = addrPrefix(m.Addrs[syscall.RTAX_IFA], ones)
+		}
+		return e, true
+	}
+	return Event{}, false
+}
+
+// addrPrefix builds a prefix of ones bits from a routing socket address;
+// ones of -1 or more than the address length mean a host prefix
+func addrPrefix(addr route.Addr, ones int) netip.Prefix {
+	var ip []byte
+	switch addr := addr.(type) {
+	case *route.Inet4Addr:
+		ip = addr.IP[:]
+	case *route.Inet6Addr:
+		ip = addr.IP[:]
+	default:
+		return netip.Prefix{}
+	}
+	if ones < 0 || ones > len(ip)*8 {
+		ones = len(ip) * 8
+	}
+	return prefixFrom(ip, ones)
+}
+
+// maskBits counts the leading ones of a netmask address
+func maskBits(mask route.Addr) int {
+	var b []byte
+	switch mask := mask.(type) {
+	case *route.Inet4Addr:
+		b = mask.IP[:]
+	case *route.Inet6Addr:
+		b = mask.IP[:]
+	default:
+		return -1
+	}
+	ones := 0
+	for _, octet := range b {
+		ones += bits.LeadingZeros8(^octet)
+		if octet != 0xff {
+			break
+		}
+	}
+	return ones
+}
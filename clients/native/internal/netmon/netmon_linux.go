@@ -0,0 +1,168 @@
+package netmon
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rtnetlinkGroups are the multicast groups carrying link, address and
+// route changes
+const rtnetlinkGroups = unix.RTMGRP_LINK |
+	unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+	unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE
+
+func watch(ctx context.Context, events chan<- Event) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open rtnetlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: rtnetlinkGroups}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to join rtnetlink groups: %w", err)
+	}
+
+	// A non-blocking file goes through the runtime poller, so closing it
+	// interrupts the read
+	socket := os.NewFile(uintptr(fd), "rtnetlink")
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := socket.Read(buf)
+			if errors.Is(err, unix.ENOBUFS) {
+				// The kernel dropped events; whatever changed is still
+				// worth a look
+				send(events, Event{Kind: KindRoute})
+				continue
+			}
+			if err != nil {
+				return
+			}
+			for _, e := range parseNetlink(buf[:n]) {
+				send(events, e)
+			}
+		}
+	}()
+	return nil
+}
+
+// parseNetlink turns rtnetlink notifications into events
+func parseNetlink(b []byte) []Event {
+	messages, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil
+	}
+
+	var parsed []Event
+	for _, m := range messages {
+		switch m.Header.Type {
+		case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+			if len(m.Data) < unix.SizeofIfInfomsg {
+				continue
+			}
+			info := (*unix.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+			e := Event{Kind: KindLink, Removed: m.Header.Type == unix.RTM_DELLINK, Index: int(info.Index)}
+			for _, attr := range parseAttrs(m.Data[unix.SizeofIfInfomsg:]) {
+				if attr.typ == unix.IFLA_IFNAME {
+					e.Name = cString(attr.value)
+				}
+			}
+			parsed = append(parsed, e)
+
+		case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+			if len(m.Data) < unix.SizeofIfAddrmsg {
+				continue
+			}
+			info := (*unix.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+			e := Event{Kind: KindAddress, Removed: m.Header.Type == unix.RTM_DELADDR, Index: int(info.Index)}
+			for _, attr := range parseAttrs(m.Data[unix.SizeofIfAddrmsg:]) {
+				switch attr.typ {
+				case unix.IFA_LOCAL:
+					e.Prefix = prefixFrom(attr.value, int(info.Prefixlen))
+				case unix.IFA_ADDRESS:
+					if !e.Prefix.IsValid() {
+						e.Prefix = prefixFrom(attr.value, int(info.Prefixlen))
+					}
+				case unix.IFA_LABEL:
+					e.Name = cString(attr.value)
+				}
+			}
+			parsed = append(parsed, e)
+
+		case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+			if len(m.Data) < unix.SizeofRtMsg {
+				continue
+			}
+			info := (*unix.RtMsg)(unsafe.Pointer(&m.Data[0]))
+			// Local and broadcast routes follow address changes
+			if info.Type != unix.RTN_UNICAST {
+				continue
+			}
+			e := Event{Kind: KindRoute, Removed: m.Header.Type == unix.RTM_DELROUTE}
+			for _, attr := range parseAttrs(m.Data[unix.SizeofRtMsg:]) {
+				switch attr.typ {
+				case unix.RTA_DST:
+					e.Prefix = prefixFrom(attr.value, int(info.Dst_len))
+				case unix.RTA_OIF:
+					if len(attr.value) >= 4 {
+						e.Index = int(binary.NativeEndian.Uint32(attr.value))
+					}
+				}
+			}
+			// A default route carries no destination
+			if !e.Prefix.IsValid() && info.Dst_len == 0 {
+				switch info.Family {
+				case unix.AF_INET:
+					e.Prefix = prefixFrom(make([]byte, 4), 0)
+				case unix.AF_INET6:
+					e.Prefix = prefixFrom(make([]byte, 16), 0)
+				}
+			}
+			parsed = append(parsed, e)
+		}
+	}
+	return parsed
+}
+
+// attr is one rtnetlink attribute
+type attr struct {
+	typ   uint16
+	value []byte
+}
+
+// parseAttrs splits the attributes following a message's fixed header
+func parseAttrs(b []byte) []attr {
+	var attrs []attr
+	for len(b) >= unix.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(b))
+		if length < unix.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs = append(attrs, attr{
+			typ:   binary.NativeEndian.Uint16(b[2:]) &^ unix.NLA_F_NESTED,
+			value: b[unix.SizeofRtAttr:length],
+		})
+		b = b[min((length+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1), len(b)):]
+	}
+	return attrs
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
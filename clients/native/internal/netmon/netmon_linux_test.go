@@ -0,0 +1,69 @@
+package netmon
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// netlinkMessage frames a message of type typ with a fixed header and
+// attributes
+func netlinkMessage(typ uint16, header []byte, attrs ...attr) []byte {
+	body := append([]byte(nil), header...)
+	for _, a := range attrs {
+		length := unix.SizeofRtAttr + len(a.value)
+		b := make([]byte, (length+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1))
+		binary.NativeEndian.PutUint16(b, uint16(length))
+		binary.NativeEndian.PutUint16(b[2:], a.typ)
+		copy(b[unix.SizeofRtAttr:], a.value)
+		body = append(body, b...)
+	}
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg, uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	return append(msg, body...)
+}
+
+func structBytes[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
+
+func TestParseNetlink(t *testing.T) {
+	oif := make([]byte, 4)
+	binary.NativeEndian.PutUint32(oif, 3)
+
+	var b []byte
+	b = append(b, netlinkMessage(unix.RTM_DELLINK,
+		structBytes(&unix.IfInfomsg{Index: 7}),
+		attr{unix.IFLA_IFNAME, []byte("wg0\x00")})...)
+	b = append(b, netlinkMessage(unix.RTM_NEWADDR,
+		structBytes(&unix.IfAddrmsg{Family: unix.AF_INET, Prefixlen: 24, Index: 7}),
+		attr{unix.IFA_LOCAL, []byte{10, 200, 0, 2}})...)
+	b = append(b, netlinkMessage(unix.RTM_NEWROUTE,
+		structBytes(&unix.RtMsg{Family: unix.AF_INET, Dst_len: 16, Type: unix.RTN_UNICAST}),
+		attr{unix.RTA_DST, []byte{10, 1, 0, 0}}, attr{unix.RTA_OIF, oif})...)
+	b = append(b, netlinkMessage(unix.RTM_DELROUTE,
+		structBytes(&unix.RtMsg{Family: unix.AF_INET6, Type: unix.RTN_UNICAST}))...)
+	b = append(b, netlinkMessage(unix.RTM_NEWROUTE,
+		structBytes(&unix.RtMsg{Family: unix.AF_INET, Dst_len: 32, Type: unix.RTN_LOCAL}),
+		attr{unix.RTA_DST, []byte{10, 200, 0, 2}})...)
+
+	want := []Event{
+		{Kind: KindLink, Removed: true, Index: 7, Name: "wg0"},
+		{Kind: KindAddress, Index: 7, Prefix: netip.MustParsePrefix("10.200.0.2/24")},
+		{Kind: KindRoute, Index: 3, Prefix: netip.MustParsePrefix("10.1.0.0/16")},
+		{Kind: KindRoute, Removed: true, Prefix: netip.MustParsePrefix("::/0")},
+	}
+	got := parseNetlink(b)
+	if len(got) != len(want) {
+		t.Fatalf("got %d events %v, want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
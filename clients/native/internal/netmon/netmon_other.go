@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package netmon
+
+import "context"
+
+func watch(ctx context.Context, events chan<- Event) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,132 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	iphlpapi               = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyRouteChange2 = iphlpapi.NewProc("NotifyRouteChange2")
+
+	// Callbacks are a scarce process-wide resource, so there is one of
+	// each, dispatching to the watchers registered below
+	interfaceCallback = windows.NewCallback(onInterfaceChange)
+	addressCallback   = windows.NewCallback(onAddressChange)
+	routeCallback     = windows.NewCallback(onRouteChange)
+
+	watchersMutex sync.Mutex
+	watchers      = make(map[*chan<- Event]bool)
+)
+
+// mibIPForwardRow2 is the start of MIB_IPFORWARD_ROW2, up to the
+// destination prefix, which is all a route change needs
+type mibIPForwardRow2 struct {
+	InterfaceLuid     uint64
+	InterfaceIndex    uint32
+	DestinationPrefix windows.RawSockaddrInet6 // SOCKADDR_INET union
+	PrefixLength      uint8
+}
+
+func watch(ctx context.Context, events chan<- Event) error {
+	if err := procNotifyRouteChange2.Find(); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	watcher := &events
+	watchersMutex.Lock()
+	watchers[watcher] = true
+	watchersMutex.Unlock()
+
+	var handles []windows.Handle
+	cancel := func() {
+		for _, handle := range handles {
+			windows.CancelMibChangeNotify2(handle)
+		}
+		watchersMutex.Lock()
+		delete(watchers, watcher)
+		watchersMutex.Unlock()
+	}
+
+	var handle windows.Handle
+	if err := windows.NotifyIpInterfaceChange(windows.AF_UNSPEC, interfaceCallback, nil, false, &handle); err != nil {
+		cancel()
+		return fmt.Errorf("failed to watch interfaces: %w", err)
+	}
+	handles = append(handles, handle)
+	if err := windows.NotifyUnicastIpAddressChange(windows.AF_UNSPEC, addressCallback, nil, false, &handle); err != nil {
+		cancel()
+		return fmt.Errorf("failed to watch addresses: %w", err)
+	}
+	handles = append(handles, handle)
+	ret, _, _ := procNotifyRouteChange2.Call(windows.AF_UNSPEC, routeCallback, 0, 0, uintptr(unsafe.Pointer(&handle)))
+	if ret != 0 {
+		cancel()
+		return fmt.Errorf("failed to watch routes: %w", windows.Errno(ret))
+	}
+	handles = append(handles, handle)
+
+	go func() {
+		<-ctx.Done()
+		// CancelMibChangeNotify2 waits for running callbacks, so none
+		// sends on the channel once it is closed
+		cancel()
+		close(events)
+	}()
+	return nil
+}
+
+// dispatch sends e to every watcher
+func dispatch(e Event) {
+	watchersMutex.Lock()
+	defer watchersMutex.Unlock()
+	for watcher := range watchers {
+		send(*watcher, e)
+	}
+}
+
+func onInterfaceChange(_ uintptr, row *windows.MibIpInterfaceRow, notificationType uint32) uintptr {
+	e := Event{Kind: KindLink, Removed: notificationType == windows.MibDeleteInstance}
+	if row != nil {
+		e.Index = int(row.InterfaceIndex)
+	}
+	dispatch(e)
+	return 0
+}
+
+func onAddressChange(_ uintptr, row *windows.MibUnicastIpAddressRow, notificationType uint32) uintptr {
+	e := Event{Kind: KindAddress, Removed: notificationType == windows.MibDeleteInstance}
+	if row != nil {
+		e.Index = int(row.InterfaceIndex)
+		e.Prefix = sockaddrPrefix(&row.Address, int(row.OnLinkPrefixLength))
+	}
+	dispatch(e)
+	return 0
+}
+
+func onRouteChange(_ uintptr, row *mibIPForwardRow2, notificationType uint32) uintptr {
+	e := Event{Kind: KindRoute, Removed: notificationType == windows.MibDeleteInstance}
+	if row != nil {
+		e.Index = int(row.InterfaceIndex)
+		e.Prefix = sockaddrPrefix(&row.DestinationPrefix, int(row.PrefixLength))
+	}
+	dispatch(e)
+	return 0
+}
+
+// sockaddrPrefix reads the address out of a SOCKADDR_INET
+func sockaddrPrefix(sa *windows.RawSockaddrInet6, bits int) netip.Prefix {
+	switch sa.Family {
+	case windows.AF_INET:
+		// sockaddr_in keeps the address after the family and port
+		return prefixFrom((*[8]byte)(unsafe.Pointer(sa))[4:8], bits)
+	case windows.AF_INET6:
+		return prefixFrom(sa.Addr[:], bits)
+	}
+	return netip.Prefix{}
+}
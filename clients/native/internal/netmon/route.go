@@ -0,0 +1,52 @@
+package netmon
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// RouteInterface returns the name of the interface traffic to addr leaves
+// through, as the routing table stands now
+func RouteInterface(addr netip.Addr) (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		output, err := exec.Command("ip", "route", "get", addr.String()).Output()
+		if err != nil {
+			return "", fmt.Errorf("route lookup for %s failed: %w", addr, err)
+		}
+		return fieldAfter(string(output), "dev"), nil
+	case "darwin":
+		family := "-inet"
+		if addr.Is6() {
+			family = "-inet6"
+		}
+		output, err := exec.Command("route", "-n", "get", family, addr.String()).Output()
+		if err != nil {
+			return "", fmt.Errorf("route lookup for %s failed: %w", addr, err)
+		}
+		return fieldAfter(string(output), "interface:"), nil
+	case "windows":
+		output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Find-NetRoute -RemoteIPAddress %s | Select-Object -First 1 -ExpandProperty InterfaceAlias", addr)).Output()
+		if err != nil {
+			return "", fmt.Errorf("route lookup for %s failed: %w", addr, err)
+		}
+		return strings.TrimSpace(string(output)), nil
+	default:
+		return "", ErrUnsupported
+	}
+}
+
+// fieldAfter returns the field following key in output, or ""
+func fieldAfter(output, key string) string {
+	fields := strings.Fields(output)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == key {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+// Package netns attaches SASEWaddle tunnels to individual containers.
+//
+// The netns package provides:
+//   - Lookup of a Docker or Podman container's network namespace, or use
+//     of a given PID for other runtimes
+//   - A WireGuard interface created on the host and moved into that
+//     namespace, so only the container joins the SASE network
+//   - Split-tunnel routes inside the container, leaving its default route
+//     on the container network
+//   - Clean removal when the container is detached
+//
+// The interface is created in the host namespace and keeps its UDP socket
+// there after the move, so the tunnel reaches the headend through the host
+// while the container sees only the tunnel interface. Linux only; it needs
+// CAP_NET_ADMIN on the host and the ip, wg and nsenter tools.
+package netns
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/tobogganing/libs/wgconfig"
+)
+
+// Runtimes are the container runtimes whose containers can be attached
+var Runtimes = []string{"docker", "podman"}
+
+// ContainerPID returns the PID of a running container's init process,
+// whose network namespace the container uses
+func ContainerPID(containerRuntime, container string) (int, error) {
+	if !supportedRuntime(containerRuntime) {
+		return 0, fmt.Errorf("unsupported container runtime: %s", containerRuntime)
+	}
+
+	output, err := exec.Command(containerRuntime, "inspect", "--format", "{{.State.Pid}}", container).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect container %s: %w", container, err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected PID for container %s: %q", container, output)
+	}
+	if pid == 0 {
+		return 0, fmt.Errorf("container %s is not running", container)
+	}
+	return pid, nil
+}
+
+// ProcessExists reports whether pid is still running
+func ProcessExists(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d/ns/net", pid))
+	return err == nil
+}
+
+// Attach creates the WireGuard interface iface for cfg inside the network
+// namespace of pid and routes only routes through it
+func Attach(pid int, iface string, cfg *wgconfig.Config, routes []netip.Prefix) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("attaching containers is not supported on %s", runtime.GOOS)
+	}
+	if len(cfg.Interface.Addresses) == 0 {
+		return fmt.Errorf("WireGuard configuration has no address")
+	}
+
+	// Created under a temporary name so it can't clash with host interfaces
+	hostName := fmt.Sprintf("swc%d", pid)
+	if len(hostName) > 15 {
+		hostName = hostName[:15]
+	}
+	if err := run("ip", "link", "add", hostName, "type", "wireguard"); err != nil {
+		return err
+	}
+
+	// The device keeps its keys, peers and UDP socket across the move
+	if err := setConf(hostName, cfg); err != nil {
+		_ = run("ip", "link", "del", hostName)
+		return err
+	}
+	if err := run("ip", "link", "set", hostName, "netns", strconv.Itoa(pid)); err != nil {
+		_ = run("ip", "link", "del", hostName)
+		return err
+	}
+
+	commands := [][]string{{"ip", "link", "set", hostName, "name", iface}}
+	for _, address := range cfg.Interface.Addresses {
+		commands = append(commands, []string{"ip", "address", "add", address.String(), "dev", iface})
+	}
+	if cfg.Interface.MTU != 0 {
+		commands = append(commands, []string{"ip", "link", "set", iface, "mtu", strconv.Itoa(cfg.Interface.MTU)})
+	}
+	commands = append(commands, []string{"ip", "link", "set", iface, "up"})
+	for _, route := range routes {
+		commands = append(commands, []string{"ip", "route", "replace", route.Masked().String(), "dev", iface})
+	}
+
+	for _, command := range commands {
+		if err := runIn(pid, command...); err != nil {
+			_ = Detach(pid, iface)
+			_ = runIn(pid, "ip", "link", "del", hostName)
+			return err
+		}
+	}
+	return nil
+}
+
+// Detach removes the interface from the container, taking its routes with it
+func Detach(pid int, iface string) error {
+	return runIn(pid, "ip", "link", "del", iface)
+}
+
+// setConf applies the keys and peers of cfg. wg(8) rejects the wg-quick
+// options, which Attach applies itself.
+func setConf(iface string, cfg *wgconfig.Config) error {
+	device := *cfg
+	device.Interface = wgconfig.Interface{
+		PrivateKey: cfg.Interface.PrivateKey,
+		ListenPort: cfg.Interface.ListenPort,
+		FwMark:     cfg.Interface.FwMark,
+	}
+
+	cmd := exec.Command("wg", "setconf", iface, "/dev/stdin")
+	cmd.Stdin = strings.NewReader(device.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to configure %s: %v, output: %s", iface, err, output)
+	}
+	return nil
+}
+
+// runIn runs a command in the network namespace of pid
+func runIn(pid int, args ...string) error {
+	return run(append([]string{"nsenter", "-t", strconv.Itoa(pid), "-n", "--"}, args...)...)
+}
+
+func run(args ...string) error {
+	if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v, output: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
+
+func supportedRuntime(name string) bool {
+	for _, r := range Runtimes {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+// Package power adapts the background activity of the SASEWaddle native
+// client to the host's power state and tunnel activity.
+//
+// The power package provides:
+//   - Power profiles ("auto", "performance", "balanced", "battery_saver")
+//   - Detection of whether the host is running on battery
+//   - Idle detection from the tunnel's byte counters
+//   - The WireGuard keepalive, health check, status polling and
+//     configuration check intervals to use for the current conditions
+//   - Notification of system sleep and wake, so the tunnel can be paused
+//     and resumed rather than left to time out
+//
+// On a laptop running from battery, frequent keepalives and polling keep
+// the radio and CPU awake. Profiles trade a little reaction time for
+// battery life, and stretch intervals further while the tunnel is idle.
+package power
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile selects how aggressively background activity is reduced
+type Profile string
+
+const (
+	// ProfileAuto uses performance on AC power and battery_saver on battery
+	ProfileAuto         Profile = "auto"
+	ProfilePerformance  Profile = "performance"
+	ProfileBalanced     Profile = "balanced"
+	ProfileBatterySaver Profile = "battery_saver"
+)
+
+const (
+	// powerCheckInterval limits how often the power source is queried,
+	// which spawns a process on macOS and Windows
+	powerCheckInterval = time.Minute
+
+	// idleThreshold is the traffic below which the tunnel counts as idle
+	// between two updates; keepalives and handshakes alone stay under it
+	idleThreshold = 4096
+)
+
+// ParseProfile validates a profile name. An empty name means auto.
+func ParseProfile(name string) (Profile, error) {
+	switch Profile(name) {
+	case "", ProfileAuto:
+		return ProfileAuto, nil
+	case ProfilePerformance, ProfileBalanced, ProfileBatterySaver:
+		return Profile(name), nil
+	default:
+		return "", fmt.Errorf("unknown power profile %q", name)
+	}
+}
+
+// Intervals are the timings background activity should use
+type Intervals struct {
+	// Keepalive is the WireGuard persistent keepalive; zero disables it
+	Keepalive time.Duration
+	// HealthCheck is how often the client checks the tunnel and session
+	HealthCheck time.Duration
+	// StatusPoll is how often interface status and statistics are polled
+	StatusPoll time.Duration
+	// ConfigCheck is how often DNS and routing configuration is re-verified
+	ConfigCheck time.Duration
+}
+
+var (
+	fastIntervals = Intervals{
+		Keepalive:   25 * time.Second,
+		HealthCheck: 30 * time.Second,
+		StatusPoll:  5 * time.Second,
+		ConfigCheck: time.Minute,
+	}
+	saverIntervals = Intervals{
+		Keepalive:   60 * time.Second,
+		HealthCheck: 2 * time.Minute,
+		StatusPoll:  30 * time.Second,
+		ConfigCheck: 10 * time.Minute,
+	}
+	saverIdleIntervals = Intervals{
+		Keepalive:   0,
+		HealthCheck: 5 * time.Minute,
+		StatusPoll:  time.Minute,
+		ConfigCheck: 10 * time.Minute,
+	}
+)
+
+// Intervals returns the timings for this profile given the power source
+// and whether the tunnel has been idle
+func (p Profile) Intervals(onBattery, idle bool) Intervals {
+	switch p {
+	case ProfilePerformance:
+		return fastIntervals
+	case ProfileBatterySaver:
+		if idle {
+			return saverIdleIntervals
+		}
+		return saverIntervals
+	case ProfileBalanced:
+		switch {
+		case onBattery && idle:
+			return Intervals{
+				Keepalive:   60 * time.Second,
+				HealthCheck: 2 * time.Minute,
+				StatusPoll:  30 * time.Second,
+				ConfigCheck: 5 * time.Minute,
+			}
+		case onBattery:
+			return Intervals{
+				Keepalive:   25 * time.Second,
+				HealthCheck: time.Minute,
+				StatusPoll:  15 * time.Second,
+				ConfigCheck: 5 * time.Minute,
+			}
+		case idle:
+			return Intervals{
+				Keepalive:   25 * time.Second,
+				HealthCheck: time.Minute,
+				StatusPoll:  15 * time.Second,
+				ConfigCheck: time.Minute,
+			}
+		default:
+			return fastIntervals
+		}
+	default:
+		if onBattery {
+			return ProfileBatterySaver.Intervals(onBattery, idle)
+		}
+		return fastIntervals
+	}
+}
+
+// Monitor tracks power source and tunnel activity and picks intervals
+type Monitor struct {
+	profile        Profile
+	onBattery      bool
+	idle           bool
+	lastBytes      uint64
+	haveBytes      bool
+	lastPowerCheck time.Time
+	current        Intervals
+	mu             sync.Mutex
+}
+
+// NewMonitor creates a monitor for a profile, starting from the intervals
+// for the current power source with the tunnel assumed active
+func NewMonitor(profile Profile) *Monitor {
+	m := &Monitor{profile: profile}
+	m.refreshPowerSource()
+	m.current = profile.Intervals(m.onBattery, false)
+	return m
+}
+
+// Update records the tunnel's total byte counter and returns the intervals
+// to use from now on, and whether they differ from the previous ones
+func (m *Monitor) Update(totalBytes uint64) (Intervals, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.lastPowerCheck) >= powerCheckInterval {
+		m.refreshPowerSource()
+	}
+
+	// Counters reset when the interface is recreated; treat that as activity
+	m.idle = m.haveBytes && totalBytes >= m.lastBytes && totalBytes-m.lastBytes < idleThreshold
+	m.lastBytes = totalBytes
+	m.haveBytes = true
+
+	next := m.profile.Intervals(m.onBattery, m.idle)
+	changed := next != m.current
+	m.current = next
+	return next, changed
+}
+
+// Current returns the intervals chosen by the last update
+func (m *Monitor) Current() Intervals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// Describe summarizes the profile and conditions, e.g. "auto (battery, idle)"
+func (m *Monitor) Describe() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	source := "AC power"
+	if m.onBattery {
+		source = "battery"
+	}
+	if m.idle {
+		return fmt.Sprintf("%s (%s, idle)", m.profile, source)
+	}
+	return fmt.Sprintf("%s (%s)", m.profile, source)
+}
+
+func (m *Monitor) refreshPowerSource() {
+	m.lastPowerCheck = time.Now()
+	onBattery, err := OnBattery()
+	if err != nil {
+		// Without a reading keep the previous state; AC is assumed initially
+		return
+	}
+	m.onBattery = onBattery
+}
+
+// OnBattery reports whether the host is currently running on battery power.
+// Hosts without a battery report false.
+func OnBattery() (bool, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return onBatteryLinux()
+	case "darwin":
+		out, err := exec.Command("pmset", "-g", "batt").Output()
+		if err != nil {
+			return false, fmt.Errorf("pmset failed: %w", err)
+		}
+		return strings.Contains(string(out), "'Battery Power'"), nil
+	case "windows":
+		// BatteryStatus 1 means the battery is discharging
+		out, err := exec.Command("powershell", "-NoProfile", "-Command",
+			"(Get-CimInstance -ClassName Win32_Battery).BatteryStatus").Output()
+		if err != nil {
+			return false, fmt.Errorf("battery query failed: %w", err)
+		}
+		for _, line := range strings.Fields(string(out)) {
+			if line == "1" {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// onBatteryLinux reads /sys/class/power_supply: any online mains supply
+// means AC power, otherwise a discharging battery means battery power
+func onBatteryLinux() (bool, error) {
+	supplies, err := filepath.Glob("/sys/class/power_supply/*")
+	if err != nil {
+		return false, err
+	}
+
+	discharging := false
+	for _, supply := range supplies {
+		switch readSysfs(supply, "type") {
+		case "Mains", "USB":
+			if readSysfs(supply, "online") == "1" {
+				return false, nil
+			}
+		case "Battery":
+			if readSysfs(supply, "status") == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+	return discharging, nil
+}
+
+func readSysfs(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
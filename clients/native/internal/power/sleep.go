@@ -0,0 +1,214 @@
+package power
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// sleepCheckInterval is how often the wall clock is compared with the
+	// monotonic clock to spot a suspend the OS didn't announce
+	sleepCheckInterval = 2 * time.Second
+
+	// sleepGapThreshold is how far the wall clock must run ahead of the
+	// check interval to count as a suspend rather than a busy host
+	sleepGapThreshold = 10 * time.Second
+
+	logindService   = "org.freedesktop.login1"
+	logindPath      = "/org/freedesktop/login1"
+	logindInterface = "org.freedesktop.login1.Manager"
+)
+
+// SleepEvent reports the host going to sleep or waking up
+type SleepEvent struct {
+	Sleeping bool
+	// Slept is how long the host was suspended, on wake
+	Slept time.Duration
+}
+
+// SleepWatcher reports when the host sleeps and wakes. On Linux, systemd
+// announces sleep in advance and waits for Ready before suspending, so the
+// tunnel can be paused cleanly. Elsewhere, and when logind is unavailable,
+// only wakes are reported, detected from the jump in the wall clock.
+type SleepWatcher struct {
+	events  chan SleepEvent
+	bus     *dbus.Conn
+	lock    *os.File // logind delay lock, held while awake
+	sleptAt time.Time
+	wokeAt  time.Time
+	mu      sync.Mutex
+}
+
+// WatchSleep starts watching for sleep and wake until ctx is cancelled
+func WatchSleep(ctx context.Context) *SleepWatcher {
+	w := &SleepWatcher{events: make(chan SleepEvent, 4)}
+
+	if runtime.GOOS == "linux" {
+		if err := w.watchLogind(ctx); err != nil {
+			fmt.Printf("Sleep notifications unavailable, detecting wake from the clock: %v\n", err)
+		}
+	}
+	go w.watchClock(ctx)
+
+	return w
+}
+
+// Events delivers sleep and wake events
+func (w *SleepWatcher) Events() <-chan SleepEvent {
+	if w == nil {
+		return nil
+	}
+	return w.events
+}
+
+// Ready lets a pending sleep go ahead once the tunnel has been paused
+func (w *SleepWatcher) Ready() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.releaseLock()
+}
+
+// watchLogind subscribes to logind's PrepareForSleep signal and takes a
+// delay lock, so sleep waits (up to InhibitDelayMaxSec) for Ready
+func (w *SleepWatcher) watchLogind(ctx context.Context) error {
+	bus, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the system bus: %w", err)
+	}
+	if err := bus.AddMatchSignal(
+		dbus.WithMatchInterface(logindInterface),
+		dbus.WithMatchMember("PrepareForSleep"),
+	); err != nil {
+		_ = bus.Close()
+		return fmt.Errorf("failed to subscribe to sleep notifications: %w", err)
+	}
+	w.bus = bus
+
+	w.mu.Lock()
+	w.takeLock()
+	w.mu.Unlock()
+
+	signals := make(chan *dbus.Signal, 4)
+	bus.Signal(signals)
+
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			w.releaseLock()
+			w.mu.Unlock()
+			_ = bus.Close()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case signal, ok := <-signals:
+				if !ok {
+					return
+				}
+				if signal.Name != logindInterface+".PrepareForSleep" || len(signal.Body) == 0 {
+					continue
+				}
+				sleeping, _ := signal.Body[0].(bool)
+				w.logindSleep(ctx, sleeping)
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *SleepWatcher) logindSleep(ctx context.Context, sleeping bool) {
+	now := time.Now().Round(0)
+
+	w.mu.Lock()
+	event := SleepEvent{Sleeping: sleeping}
+	if sleeping {
+		w.sleptAt = now
+	} else {
+		if !w.sleptAt.IsZero() {
+			event.Slept = now.Sub(w.sleptAt)
+		}
+		w.wokeAt = now
+		// Hold off the next sleep too
+		w.takeLock()
+	}
+	w.mu.Unlock()
+
+	w.send(ctx, event)
+}
+
+// watchClock reports a wake whenever the wall clock jumps ahead of the
+// monotonic clock, which stops while the host is suspended
+func (w *SleepWatcher) watchClock(ctx context.Context) {
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now().Round(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().Round(0)
+		gap := now.Sub(last) - sleepCheckInterval
+		last = now
+		if gap < sleepGapThreshold {
+			continue
+		}
+
+		// logind may already have reported this wake
+		w.mu.Lock()
+		reported := now.Sub(w.wokeAt) < sleepGapThreshold
+		if !reported {
+			w.wokeAt = now
+		}
+		w.mu.Unlock()
+
+		if !reported {
+			w.send(ctx, SleepEvent{Slept: gap})
+		}
+	}
+}
+
+func (w *SleepWatcher) send(ctx context.Context, event SleepEvent) {
+	select {
+	case w.events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// takeLock acquires a logind delay lock on sleep; w.mu must be held
+func (w *SleepWatcher) takeLock() {
+	if w.bus == nil || w.lock != nil {
+		return
+	}
+	var fd dbus.UnixFD
+	err := w.bus.Object(logindService, logindPath).Call(logindInterface+".Inhibit", 0,
+		"sleep", "SASEWaddle", "Pausing the VPN tunnel", "delay").Store(&fd)
+	if err != nil {
+		fmt.Printf("Failed to take sleep delay lock: %v\n", err)
+		return
+	}
+	w.lock = os.NewFile(uintptr(fd), "logind-delay-lock")
+}
+
+// releaseLock lets logind suspend; w.mu must be held
+func (w *SleepWatcher) releaseLock() {
+	if w.lock == nil {
+		return
+	}
+	_ = w.lock.Close()
+	w.lock = nil
+}
@@ -0,0 +1,134 @@
+// Package service installs the SASEWaddle client as a system service.
+//
+// The service package provides:
+//   - launchd daemons on macOS. On Apple Silicon the kernel only runs signed
+//     code, so an unsigned or quarantined binary is caught at install time
+//     rather than left for launchd to refuse silently.
+//   - Service Control Manager services on Windows, x64 and ARM64 alike, with
+//     recovery actions that restart the client when it fails
+//   - Running under the Service Control Manager, which stops a service that
+//     doesn't report its status within 30 seconds of starting
+//
+// Linux installs are left to the distribution's packaging.
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	// Name is the Windows service name
+	Name = "SASEWaddle"
+
+	// Label is the launchd job label
+	Label = "com.sasewaddle.client"
+
+	// DisplayName is shown in the Windows services console
+	DisplayName = "SASEWaddle Client"
+
+	description = "Keeps the SASEWaddle WireGuard tunnel connected."
+
+	// darwinLogPath is where launchd sends the daemon's output
+	darwinLogPath = "/Library/Logs/SASEWaddle/client.log"
+)
+
+// ErrUnsupported is returned on platforms the package can't install on
+var ErrUnsupported = errors.New("service installation is not supported on this platform")
+
+// Spec describes the service to install
+type Spec struct {
+	Name        string
+	Label       string
+	DisplayName string
+	Description string
+	Executable  string
+	Args        []string
+	LogPath     string
+}
+
+// DefaultSpec returns the service running executable's connect command,
+// with the configuration file at configPath when one is given
+func DefaultSpec(executable, configPath string) (Spec, error) {
+	executable, err := filepath.Abs(executable)
+	if err != nil {
+		return Spec{}, fmt.Errorf("failed to resolve %s: %w", executable, err)
+	}
+
+	args := []string{"connect"}
+	if configPath != "" {
+		// Services start in another working directory
+		configPath, err = filepath.Abs(configPath)
+		if err != nil {
+			return Spec{}, fmt.Errorf("failed to resolve %s: %w", configPath, err)
+		}
+		args = append(args, "--config", configPath)
+	}
+
+	return Spec{
+		Name:        Name,
+		Label:       Label,
+		DisplayName: DisplayName,
+		Description: description,
+		Executable:  executable,
+		Args:        args,
+		LogPath:     darwinLogPath,
+	}, nil
+}
+
+// LaunchdPlist returns the launchd property list of a daemon running spec.
+// The daemon starts at boot and is restarted if it exits with an error.
+func LaunchdPlist(spec Spec) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString(`<plist version="1.0">` + "\n<dict>\n")
+
+	writeKey := func(key string) {
+		b.WriteString("\t<key>")
+		_ = xml.EscapeText(&b, []byte(key))
+		b.WriteString("</key>\n")
+	}
+	writeString := func(indent, value string) {
+		b.WriteString(indent + "<string>")
+		_ = xml.EscapeText(&b, []byte(value))
+		b.WriteString("</string>\n")
+	}
+
+	writeKey("Label")
+	writeString("\t", spec.Label)
+	writeKey("ProgramArguments")
+	b.WriteString("\t<array>\n")
+	writeString("\t\t", spec.Executable)
+	for _, arg := range spec.Args {
+		writeString("\t\t", arg)
+	}
+	b.WriteString("\t</array>\n")
+	writeKey("RunAtLoad")
+	b.WriteString("\t<true/>\n")
+	writeKey("KeepAlive")
+	b.WriteString("\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	// Keeps launchd from throttling the tunnel like a background job
+	writeKey("ProcessType")
+	writeString("\t", "Interactive")
+	if spec.LogPath != "" {
+		writeKey("StandardOutPath")
+		writeString("\t", spec.LogPath)
+		writeKey("StandardErrorPath")
+		writeString("\t", spec.LogPath)
+	}
+
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+// Run runs the client until ctx is cancelled. Under the Windows Service
+// Control Manager it also reports the service's status and stops when the
+// service is stopped; elsewhere it just calls run.
+func Run(ctx context.Context, run func(context.Context) error) error {
+	return runPlatform(ctx, run)
+}
@@ -0,0 +1,29 @@
+//go:build !darwin && !windows
+
+package service
+
+import "context"
+
+// Install is not supported on this platform
+func Install(spec Spec) error {
+	return ErrUnsupported
+}
+
+// Uninstall is not supported on this platform
+func Uninstall(spec Spec) error {
+	return ErrUnsupported
+}
+
+// Start is not supported on this platform
+func Start(spec Spec) error {
+	return ErrUnsupported
+}
+
+// Stop is not supported on this platform
+func Stop(spec Spec) error {
+	return ErrUnsupported
+}
+
+func runPlatform(ctx context.Context, run func(context.Context) error) error {
+	return run(ctx)
+}
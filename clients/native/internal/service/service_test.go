@@ -0,0 +1,63 @@
+package service
+
+import (
+	"encoding/xml"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultSpec(t *testing.T) {
+	spec, err := DefaultSpec("sasewaddle-client", "client.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(spec.Executable) {
+		t.Errorf("executable %q is not absolute", spec.Executable)
+	}
+	if len(spec.Args) != 3 || spec.Args[0] != "connect" || spec.Args[1] != "--config" || !filepath.IsAbs(spec.Args[2]) {
+		t.Errorf("unexpected arguments %q", spec.Args)
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	spec := Spec{
+		Label:      Label,
+		Executable: "/Applications/SASEWaddle.app/Contents/MacOS/sasewaddle-client",
+		Args:       []string{"connect", "--config", "/Library/Application Support/SASEWaddle/a&b.yaml"},
+		LogPath:    darwinLogPath,
+	}
+	plist := LaunchdPlist(spec)
+
+	// Well-formed, with the arguments escaped
+	decoder := xml.NewDecoder(strings.NewReader(string(plist)))
+	decoder.Strict = true
+	var strs []string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "string" {
+			var value string
+			if err := decoder.DecodeElement(&value, &start); err != nil {
+				t.Fatal(err)
+			}
+			strs = append(strs, value)
+		}
+	}
+	want := append([]string{Label, spec.Executable}, spec.Args...)
+	if len(strs) < len(want) {
+		t.Fatalf("plist strings %q, want %q first", strs, want)
+	}
+	for i := range want {
+		if strs[i] != want[i] {
+			t.Errorf("string %d = %q, want %q", i, strs[i], want[i])
+		}
+	}
+	for _, key := range []string{"<key>RunAtLoad</key>", "<key>SuccessfulExit</key>", "<key>StandardErrorPath</key>"} {
+		if !strings.Contains(string(plist), key) {
+			t.Errorf("plist lacks %s", key)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+//go:build windows
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// stopTimeout bounds how long Stop waits for the client to disconnect
+const stopTimeout = 30 * time.Second
+
+// Install registers the client with the Service Control Manager, starting
+// at boot once the network stack is up, and restarting after failures
+func Install(spec Spec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager (run as Administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(spec.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", spec.Name)
+	}
+
+	s, err := m.CreateService(spec.Name, spec.Executable, mgr.Config{
+		DisplayName:      spec.DisplayName,
+		Description:      spec.Description,
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+		// The tunnel needs the network store and TCP/IP stack, as the
+		// WireGuard tunnel service does
+		Dependencies: []string{"Nsi", "TcpIp"},
+	}, spec.Args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service %s: %w", spec.Name, err)
+	}
+	defer s.Close()
+
+	recovery := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 2 * time.Minute},
+	}
+	if err := s.SetRecoveryActions(recovery, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	// Restart on a non-zero exit too, not only on a crash
+	if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	return nil
+}
+
+// Uninstall stops the service if it is running and deletes it
+func Uninstall(spec Spec) error {
+	_ = Stop(spec)
+
+	return withService(spec, func(s *mgr.Service) error {
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to delete service %s: %w", spec.Name, err)
+		}
+		return nil
+	})
+}
+
+// Start starts the service
+func Start(spec Spec) error {
+	return withService(spec, func(s *mgr.Service) error {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start service %s: %w", spec.Name, err)
+		}
+		return nil
+	})
+}
+
+// Stop stops the service and waits for the client to disconnect
+func Stop(spec Spec) error {
+	return withService(spec, func(s *mgr.Service) error {
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return fmt.Errorf("failed to stop service %s: %w", spec.Name, err)
+		}
+		deadline := time.Now().Add(stopTimeout)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service %s did not stop within %s", spec.Name, stopTimeout)
+			}
+			time.Sleep(250 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return fmt.Errorf("failed to query service %s: %w", spec.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func withService(spec Spec, f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager (run as Administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(spec.Name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", spec.Name, err)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+func runPlatform(ctx context.Context, run func(context.Context) error) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return run(ctx)
+	}
+
+	h := &handler{ctx: ctx, run: run}
+	if err := svc.Run(Name, h); err != nil {
+		return fmt.Errorf("failed to run as service: %w", err)
+	}
+	return h.err
+}
+
+// handler runs the client under the Service Control Manager
+type handler struct {
+	ctx context.Context
+	run func(context.Context) error
+	err error
+}
+
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.run(ctx) }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			// A non-zero exit code triggers the recovery actions
+			h.err = err
+			if err != nil {
+				return false, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				h.err = <-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package stunguard implements WebRTC/STUN leak mitigation for the SASEWaddle
+// native client.
+//
+// The stunguard package provides:
+// - Blocking STUN/TURN traffic entirely while connected ("block" mode)
+// - Forcing STUN/TURN traffic through the tunnel interface ("tunnel" mode)
+// - Per-application exceptions for trusted conferencing software
+//
+// WebRTC discovers the public address of every interface via STUN, so a
+// browser can reveal the real IP address even with the tunnel up. Rules
+// are installed into a dedicated chain, anchor or rule group owned by the
+// client and removed on disconnect.
+//
+// Application exceptions are cgroup v2 paths (e.g. the systemd slice or
+// scope an application runs in) and are only supported on Linux: neither pf
+// nor Windows block rules can exempt individual programs, so exceptions are
+// logged and ignored there.
+package stunguard
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Mode selects how STUN/TURN traffic is handled while connected
+type Mode string
+
+const (
+	ModeOff    Mode = "off"
+	ModeBlock  Mode = "block"
+	ModeTunnel Mode = "tunnel"
+)
+
+const (
+	// ruleName names the iptables chain, pf anchor and Windows rule group we own
+	ruleName = "SASEWADDLE-STUN"
+	pfAnchor = "com.sasewaddle/stun"
+)
+
+// stunPorts are the standard STUN/TURN ports plus the range used by
+// Google's public STUN servers
+var stunPorts = []string{"3478", "3479", "5349", "5350", "19302:19309"}
+
+// ParseMode validates a configured mode. An empty string means off.
+func ParseMode(value string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(value))) {
+	case "", ModeOff:
+		return ModeOff, nil
+	case ModeBlock:
+		return ModeBlock, nil
+	case ModeTunnel:
+		return ModeTunnel, nil
+	default:
+		return ModeOff, fmt.Errorf("invalid WebRTC protection mode %q (want off, block or tunnel)", value)
+	}
+}
+
+// Guard installs STUN/TURN rules for one tunnel interface
+type Guard struct {
+	interfaceName string
+	mode          Mode
+	exceptions    []string
+}
+
+// New creates a guard; exceptions name applications allowed to use STUN freely
+func New(interfaceName string, mode Mode, exceptions []string) *Guard {
+	return &Guard{
+		interfaceName: interfaceName,
+		mode:          mode,
+		exceptions:    exceptions,
+	}
+}
+
+// SetInterfaceName changes the tunnel interface the rules apply to, for
+// platforms that name the interface when it is created. Call it before
+// Enable.
+func (g *Guard) SetInterfaceName(interfaceName string) {
+	g.interfaceName = interfaceName
+}
+
+// Mode returns the configured mode
+func (g *Guard) Mode() Mode {
+	return g.mode
+}
+
+// Enable installs the rules for the configured mode
+func (g *Guard) Enable() error {
+	if err := g.Disable(); err != nil {
+		return err
+	}
+	if g.mode == ModeOff {
+		return nil
+	}
+
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		err = g.installLinux()
+	case "darwin":
+		err = g.installDarwin()
+	case "windows":
+		err = g.installWindows()
+	default:
+		err = fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+	if err != nil {
+		_ = g.Disable()
+		return fmt.Errorf("failed to install WebRTC protection: %w", err)
+	}
+	return nil
+}
+
+// Disable removes every rule we installed. Missing rules are not an error.
+func (g *Guard) Disable() error {
+	switch runtime.GOOS {
+	case "linux":
+		for _, tool := range []string{"iptables", "ip6tables"} {
+			for exec.Command(tool, "-D", "OUTPUT", "-j", ruleName).Run() == nil {
+			}
+			_ = exec.Command(tool, "-F", ruleName).Run()
+			_ = exec.Command(tool, "-X", ruleName).Run()
+		}
+	case "darwin":
+		_ = exec.Command("pfctl", "-a", pfAnchor, "-F", "rules").Run()
+	case "windows":
+		_ = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Remove-NetFirewallRule -Group '%s' -ErrorAction SilentlyContinue", ruleName)).Run()
+	}
+	return nil
+}
+
+// Installed reports whether STUN rules are present on the system
+func (g *Guard) Installed() bool {
+	switch runtime.GOOS {
+	case "linux":
+		return exec.Command("iptables", "-C", "OUTPUT", "-j", ruleName).Run() == nil
+	case "darwin":
+		output, err := exec.Command("pfctl", "-a", pfAnchor, "-s", "rules").Output()
+		return err == nil && len(strings.TrimSpace(string(output))) > 0
+	case "windows":
+		return exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name="+ruleName).Run() == nil
+	default:
+		return false
+	}
+}
+
+func (g *Guard) installLinux() error {
+	ports := strings.Join(stunPorts, ",")
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if err := run(tool, "-N", ruleName); err != nil {
+			return err
+		}
+
+		var rules [][]string
+		for _, cgroup := range g.exceptions {
+			rules = append(rules, []string{"-A", ruleName, "-m", "cgroup", "--path", cgroup, "-j", "RETURN"})
+		}
+		if g.mode == ModeTunnel {
+			rules = append(rules, []string{"-A", ruleName, "-o", g.interfaceName, "-j", "RETURN"})
+		}
+		rules = append(rules,
+			[]string{"-A", ruleName, "-p", "udp", "-m", "multiport", "--dports", ports, "-j", "REJECT"},
+			[]string{"-A", ruleName, "-p", "tcp", "-m", "multiport", "--dports", ports, "-j", "REJECT"},
+			[]string{"-I", "OUTPUT", "-j", ruleName},
+		)
+
+		for _, rule := range rules {
+			if err := run(tool, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Guard) installDarwin() error {
+	if len(g.exceptions) > 0 {
+		log.Printf("WebRTC protection: per-application exceptions are not supported on macOS, ignoring %d", len(g.exceptions))
+	}
+
+	ports := strings.Join(stunPorts, " ")
+	var rules strings.Builder
+	if g.mode == ModeTunnel {
+		fmt.Fprintf(&rules, "pass out quick on %s proto { udp tcp } to any port { %s }\n", g.interfaceName, ports)
+	}
+	fmt.Fprintf(&rules, "block return out quick proto { udp tcp } to any port { %s }\n", ports)
+
+	cmd := exec.Command("pfctl", "-a", pfAnchor, "-f", "-")
+	cmd.Stdin = strings.NewReader(rules.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pfctl failed: %v, output: %s", err, output)
+	}
+	return nil
+}
+
+func (g *Guard) installWindows() error {
+	if len(g.exceptions) > 0 {
+		// Windows block rules always override allow rules, so an allow rule
+		// per excepted program would have no effect
+		log.Printf("WebRTC protection: per-application exceptions are not supported on Windows, ignoring %d", len(g.exceptions))
+	}
+
+	// In tunnel mode the block is scoped to every adapter except the tunnel
+	scope := ""
+	if g.mode == ModeTunnel {
+		scope = fmt.Sprintf(" -InterfaceAlias (Get-NetAdapter | Where-Object Name -ne '%s').Name", g.interfaceName)
+	}
+	ports := strings.ReplaceAll(strings.Join(stunPorts, ","), ":", "-")
+
+	var script strings.Builder
+	for _, proto := range []string{"UDP", "TCP"} {
+		fmt.Fprintf(&script, "New-NetFirewallRule -DisplayName '%[1]s' -Group '%[1]s' -Direction Outbound -Action Block -Protocol %[2]s -RemotePort %[3]s%[4]s | Out-Null\n",
+			ruleName, proto, ports, scope)
+	}
+	return run("powershell", "-NoProfile", "-NonInteractive", "-Command", script.String())
+}
+
+func run(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, output)
+	}
+	return nil
+}
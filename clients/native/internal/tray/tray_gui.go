@@ -6,6 +6,9 @@
 // - Monitor connection status
 // - Connect/disconnect from WireGuard tunnels
 // - View connection statistics
+// - See DNS leak protection status and the egress region in use
+// - Switch between the clusters they belong to
+// - See what their policy lets them access
 // - Access client settings
 // - Exit the application
 //
@@ -16,6 +19,7 @@ package tray
 import (
 	"context"
 	"fmt"
+	"html"
 	"log"
 	"os"
 	"path/filepath"
@@ -35,6 +39,19 @@ type VPNManager interface {
 	GetStatistics() map[string]interface{}
 }
 
+// AccessReporter is implemented by VPN managers that can describe what the
+// user's policy lets them access
+type AccessReporter interface {
+	AccessReport() (string, error)
+}
+
+// ClusterSwitcher is implemented by VPN managers that can move the tunnel
+// to another of the user's clusters
+type ClusterSwitcher interface {
+	Clusters() (ids []string, current string, err error)
+	SwitchCluster(id string) error
+}
+
 // ConfigManager interface defines methods for configuration management
 type ConfigManager interface {
 	GetServerURL() string
@@ -50,11 +67,19 @@ type TrayManager struct {
 	cancel     context.CancelFunc
 	connected  bool
 	lastUpdate time.Time
+	dnsStatus  string
+	authState  string
 
 	// Menu items
 	connectItem    *systray.MenuItem
 	disconnectItem *systray.MenuItem
 	statusItem     *systray.MenuItem
+	dnsItem        *systray.MenuItem
+	regionItem     *systray.MenuItem
+	clusterItem    *systray.MenuItem
+	clusterChoices map[string]*systray.MenuItem
+	authItem       *systray.MenuItem
+	accessItem     *systray.MenuItem
 	statsItem      *systray.MenuItem
 	updateItem     *systray.MenuItem
 	settingsItem   *systray.MenuItem
@@ -116,6 +141,19 @@ func (t *TrayManager) setupMenu() {
 	t.statusItem = systray.AddMenuItem("Status: Disconnected", "Current connection status")
 	t.statusItem.Disable()
 
+	t.dnsItem = systray.AddMenuItem("DNS Protection: disabled", "DNS leak protection status")
+	t.dnsItem.Disable()
+
+	t.regionItem = systray.AddMenuItem("Egress Region: automatic", "Region used for internet-bound traffic")
+	t.regionItem.Disable()
+
+	t.clusterItem = systray.AddMenuItem("Cluster: automatic", "Cluster the tunnel connects to")
+	t.setupClusterMenu()
+
+	t.authItem = systray.AddMenuItem("Session: unauthenticated", "Authentication with the Manager")
+	t.authItem.Disable()
+
+	t.accessItem = systray.AddMenuItem("What can I access?", "Show what your policy lets you reach")
 	t.statsItem = systray.AddMenuItem("View Statistics", "View connection statistics in browser")
 	systray.AddSeparator()
 
@@ -126,8 +164,9 @@ func (t *TrayManager) setupMenu() {
 
 	t.exitItem = systray.AddMenuItem("Exit", "Exit SASEWaddle")
 
-	// Initially disable disconnect
+	// Initially disable disconnect and the access summary
 	t.disconnectItem.Disable()
+	t.accessItem.Disable()
 
 	// Start menu handlers
 	go t.handleMenuClicks()
@@ -146,6 +185,9 @@ func (t *TrayManager) handleMenuClicks() {
 		case <-t.disconnectItem.ClickedCh:
 			t.handleDisconnect()
 
+		case <-t.accessItem.ClickedCh:
+			t.handleAccess()
+
 		case <-t.statsItem.ClickedCh:
 			t.handleViewStats()
 
@@ -199,6 +241,101 @@ func (t *TrayManager) updateStatus() {
 	// Update tooltip
 	tooltip := fmt.Sprintf("SASEWaddle - %s", status)
 	systray.SetTooltip(tooltip)
+
+	t.updateDNSStatus()
+	t.updateRegion()
+	t.updateCluster()
+	t.updateAuthState()
+}
+
+// setupClusterMenu offers the user's clusters, and automatic selection, as
+// choices under the cluster item
+func (t *TrayManager) setupClusterMenu() {
+	switcher, ok := t.vpn.(ClusterSwitcher)
+	if !ok {
+		t.clusterItem.Disable()
+		return
+	}
+
+	ids, current, err := switcher.Clusters()
+	if err != nil {
+		log.Printf("Failed to list clusters: %v", err)
+		t.clusterItem.Disable()
+		return
+	}
+
+	t.clusterChoices = make(map[string]*systray.MenuItem)
+	for _, id := range append([]string{""}, ids...) {
+		title := id
+		if id == "" {
+			title = "Automatic (lowest latency)"
+		}
+		item := t.clusterItem.AddSubMenuItemCheckbox(title, "Connect through this cluster", id == current)
+		t.clusterChoices[id] = item
+		go func(id string, item *systray.MenuItem) {
+			for {
+				select {
+				case <-t.ctx.Done():
+					return
+				case <-item.ClickedCh:
+					t.handleSwitchCluster(switcher, id)
+				}
+			}
+		}(id, item)
+	}
+}
+
+// updateCluster shows the cluster the tunnel connects to
+func (t *TrayManager) updateCluster() {
+	cluster, _ := t.vpn.GetStatistics()["cluster"].(string)
+	if cluster == "" {
+		cluster = "automatic"
+	}
+	t.clusterItem.SetTitle(fmt.Sprintf("Cluster: %s", cluster))
+}
+
+// updateAuthState shows the state of the session with the Manager and
+// warns when it has run out
+func (t *TrayManager) updateAuthState() {
+	stats := t.vpn.GetStatistics()
+	authState, _ := stats["auth_state"].(string)
+	if authState == "" {
+		authState = "unauthenticated"
+	}
+
+	title := fmt.Sprintf("Session: %s", authState)
+	if expiresAt, ok := stats["auth_expires_at"].(time.Time); ok && authState != "expired" {
+		title += fmt.Sprintf(" (until %s)", expiresAt.Local().Format("15:04"))
+	}
+	t.authItem.SetTitle(title)
+
+	if authState == "expired" && t.authState != authState && t.connected {
+		t.showNotification("Session Expired", "SASEWaddle could not renew its session with the Manager")
+	}
+	t.authState = authState
+}
+
+// updateRegion shows the egress region used for internet-bound traffic
+func (t *TrayManager) updateRegion() {
+	region, _ := t.vpn.GetStatistics()["egress_region"].(string)
+	if region == "" {
+		region = "automatic"
+	}
+	t.regionItem.SetTitle(fmt.Sprintf("Egress Region: %s", region))
+}
+
+// updateDNSStatus shows the DNS leak protection state and warns on leaks
+func (t *TrayManager) updateDNSStatus() {
+	dnsStatus, _ := t.vpn.GetStatistics()["dns_leak_status"].(string)
+	if dnsStatus == "" || dnsStatus == t.dnsStatus {
+		return
+	}
+
+	t.dnsStatus = dnsStatus
+	t.dnsItem.SetTitle(fmt.Sprintf("DNS Protection: %s", dnsStatus))
+	if dnsStatus == "leaking" {
+		t.showNotification("DNS Leak Detected", "DNS queries are leaving outside the secure tunnel")
+	}
 }
 
 // updateMenuItems enables/disables menu items based on connection state
@@ -206,9 +343,11 @@ func (t *TrayManager) updateMenuItems() {
 	if t.connected {
 		t.connectItem.Disable()
 		t.disconnectItem.Enable()
+		t.accessItem.Enable()
 	} else {
 		t.connectItem.Enable()
 		t.disconnectItem.Disable()
+		t.accessItem.Disable()
 	}
 }
 
@@ -274,6 +413,52 @@ func (t *TrayManager) handleDisconnect() {
 	}
 }
 
+// handleSwitchCluster moves the tunnel to the chosen cluster, "" for
+// automatic selection
+func (t *TrayManager) handleSwitchCluster(switcher ClusterSwitcher, id string) {
+	log.Printf("Tray: Switch to cluster %q requested", id)
+	if err := switcher.SwitchCluster(id); err != nil {
+		log.Printf("Failed to switch cluster: %v", err)
+		t.showNotification("Cluster Switch Failed", fmt.Sprintf("Failed to switch cluster: %v", err))
+		return
+	}
+	for choice, item := range t.clusterChoices {
+		if choice == id {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+	t.updateCluster()
+}
+
+// handleAccess shows the access summary as a page in the browser
+func (t *TrayManager) handleAccess() {
+	reporter, ok := t.vpn.(AccessReporter)
+	if !ok {
+		t.showNotification("Access Summary Unavailable", "This client cannot show your policy")
+		return
+	}
+
+	report, err := reporter.AccessReport()
+	if err != nil {
+		log.Printf("Failed to get access summary: %v", err)
+		t.showNotification("Access Summary Unavailable", fmt.Sprintf("Failed to get your policy: %v", err))
+		return
+	}
+
+	page := filepath.Join(os.TempDir(), "sasewaddle-access.html")
+	content := fmt.Sprintf("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>What can I access?</title></head>\n<body><pre>%s</pre></body></html>\n",
+		html.EscapeString(report))
+	if err := os.WriteFile(page, []byte(content), 0600); err != nil {
+		log.Printf("Failed to write access summary page: %v", err)
+		return
+	}
+	if err := browser.OpenFile(page); err != nil {
+		log.Printf("Failed to open access summary page: %v", err)
+	}
+}
+
 func (t *TrayManager) handleViewStats() {
 	// Open statistics page in browser
 	statsURL := fmt.Sprintf("%s/client/stats", t.config.GetServerURL())
@@ -19,6 +19,19 @@ type VPNManager interface {
 	GetStatistics() map[string]interface{}
 }
 
+// AccessReporter is implemented by VPN managers that can describe what the
+// user's policy lets them access
+type AccessReporter interface {
+	AccessReport() (string, error)
+}
+
+// ClusterSwitcher is implemented by VPN managers that can move the tunnel
+// to another of the user's clusters
+type ClusterSwitcher interface {
+	Clusters() (ids []string, current string, err error)
+	SwitchCluster(id string) error
+}
+
 // ConfigManager interface defines methods for configuration management
 type ConfigManager interface {
 	GetServerURL() string
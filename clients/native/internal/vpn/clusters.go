@@ -0,0 +1,79 @@
+package vpn
+
+import (
+	"log"
+	"os"
+
+	"github.com/tobogganing/clients/native/internal/client"
+	"github.com/tobogganing/clients/native/internal/config"
+)
+
+// Clusters lists the clusters the user may switch to, by ID, with the one
+// in use, "" while it is chosen automatically
+func (m *Manager) Clusters() ([]string, string, error) {
+	clusters, _, err := client.FetchClusters(m.config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var ids []string
+	for _, cluster := range clusters {
+		if cluster.Allowed {
+			ids = append(ids, cluster.ID)
+		}
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return ids, m.config.Cluster, nil
+}
+
+// SwitchCluster moves the tunnel to cluster, "" or "auto" to choose
+// automatically, reconnecting with that cluster's configuration if the
+// tunnel is up
+func (m *Manager) SwitchCluster(cluster string) error {
+	m.mutex.Lock()
+	m.config.Cluster = cluster
+	m.config.ActiveCluster = ""
+	m.mutex.Unlock()
+
+	if !m.IsConnected() {
+		return nil
+	}
+	if err := m.Disconnect(); err != nil {
+		return err
+	}
+	return m.Connect()
+}
+
+// resolveConfigPath points the manager at the WireGuard configuration of
+// the configured cluster or, when it is chosen automatically, of the
+// fastest allowed cluster the client has registered with. The caller holds
+// m.mutex.
+func (m *Manager) resolveConfigPath() {
+	if m.config.ClusterID() == "" {
+		m.config.ActiveCluster = m.fastestRegisteredCluster()
+	}
+	m.configPath = m.config.GetWireGuardConfigPath()
+}
+
+// fastestRegisteredCluster returns the allowed cluster with the lowest
+// latency that has a cached configuration, or "" if there is none
+func (m *Manager) fastestRegisteredCluster() string {
+	clusters, _, err := client.FetchClusters(m.config)
+	if err != nil {
+		log.Printf("Cluster list not fetched, using the default configuration: %v", err)
+		return ""
+	}
+
+	client.MeasureClusters(clusters)
+	for _, cluster := range clusters {
+		if !cluster.Allowed || cluster.Latency == 0 {
+			continue
+		}
+		if _, err := os.Stat(config.GetClusterWireGuardConfigPath(cluster.ID)); err == nil {
+			return cluster.ID
+		}
+	}
+	return ""
+}
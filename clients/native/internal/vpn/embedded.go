@@ -7,9 +7,14 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"os/exec"
+	"runtime"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/tobogganing/libs/wgconfig"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
@@ -20,7 +25,9 @@ type EmbeddedWireGuard struct {
 	device      *device.Device
 	tun         tun.Device
 	interfaceName string
+	requestedName string // the name asked for, which macOS may not honor
 	config      string
+	parsed      *wgconfig.Config
 	isRunning   bool
 	mutex       sync.RWMutex
 	ctx         context.Context
@@ -32,6 +39,7 @@ func NewEmbeddedWireGuard(interfaceName string) *EmbeddedWireGuard {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &EmbeddedWireGuard{
 		interfaceName: interfaceName,
+		requestedName: interfaceName,
 		ctx:           ctx,
 		cancel:        cancel,
 	}
@@ -46,8 +54,17 @@ func (ew *EmbeddedWireGuard) Start(config string) error {
 		return fmt.Errorf("WireGuard is already running")
 	}
 
+	cfg, err := wgconfig.ParseString(config)
+	if err != nil {
+		return fmt.Errorf("invalid WireGuard configuration: %w", err)
+	}
+
+	if err := ew.runHooks("PreUp", cfg.Interface.PreUp); err != nil {
+		return err
+	}
+
 	// Create TUN interface
-	tunDevice, err := ew.createTunInterface()
+	tunDevice, err := ew.createTunInterface(cfg.Interface.MTU)
 	if err != nil {
 		return fmt.Errorf("failed to create TUN interface: %w", err)
 	}
@@ -60,7 +77,7 @@ func (ew *EmbeddedWireGuard) Start(config string) error {
 	ew.device = wgDevice
 
 	// Configure WireGuard device
-	if err := ew.configureDevice(config); err != nil {
+	if err := ew.configureDevice(cfg); err != nil {
 		ew.cleanup()
 		return fmt.Errorf("failed to configure device: %w", err)
 	}
@@ -71,7 +88,14 @@ func (ew *EmbeddedWireGuard) Start(config string) error {
 		return fmt.Errorf("failed to bring device up: %w", err)
 	}
 
+	// wg-quick tears the interface down again when PostUp fails
+	if err := ew.runHooks("PostUp", cfg.Interface.PostUp); err != nil {
+		ew.cleanup()
+		return err
+	}
+
 	ew.config = config
+	ew.parsed = cfg
 	ew.isRunning = true
 
 	return nil
@@ -86,7 +110,13 @@ func (ew *EmbeddedWireGuard) Stop() error {
 		return nil
 	}
 
+	if err := ew.runHooks("PreDown", ew.parsed.Interface.PreDown); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 	ew.cleanup()
+	if err := ew.runHooks("PostDown", ew.parsed.Interface.PostDown); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 	ew.isRunning = false
 	ew.cancel()
 
@@ -107,93 +137,121 @@ func (ew *EmbeddedWireGuard) GetConfig() string {
 	return ew.config
 }
 
-// GetInterfaceName returns the interface name
+// SetKeepalive changes the persistent keepalive of the configured peer
+// without restarting the tunnel. A zero keepalive disables it.
+func (ew *EmbeddedWireGuard) SetKeepalive(keepalive time.Duration) error {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+
+	if !ew.isRunning || ew.device == nil {
+		return fmt.Errorf("WireGuard is not running")
+	}
+	if len(ew.parsed.Peers) == 0 {
+		return fmt.Errorf("no peers in configuration")
+	}
+
+	var ipc strings.Builder
+	for _, peer := range ew.parsed.Peers {
+		fmt.Fprintf(&ipc, "public_key=%s\nupdate_only=true\npersistent_keepalive_interval=%d\n",
+			peer.PublicKey.Hex(), int(keepalive.Seconds()))
+	}
+	return ew.device.IpcSet(ipc.String())
+}
+
+// Reapply configures the running tunnel's addresses, routes and DNS again,
+// e.g. after something outside the client removed them
+func (ew *EmbeddedWireGuard) Reapply() error {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+
+	if !ew.isRunning {
+		return fmt.Errorf("WireGuard is not running")
+	}
+	return ew.configureNetworking(ew.parsed)
+}
+
+// GetInterfaceName returns the interface name. On macOS it is the utun
+// interface the kernel assigned once the tunnel has started.
 func (ew *EmbeddedWireGuard) GetInterfaceName() string {
+	ew.mutex.RLock()
+	defer ew.mutex.RUnlock()
 	return ew.interfaceName
 }
 
 // createTunInterface creates a platform-specific TUN interface
-func (ew *EmbeddedWireGuard) createTunInterface() (tun.Device, error) {
+func (ew *EmbeddedWireGuard) createTunInterface(mtu int) (tun.Device, error) {
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+
+	if err := checkTunPrerequisites(ew.requestedName); err != nil {
+		return nil, err
+	}
+
 	// Create TUN device with the specified interface name
-	tunDevice, err := tun.CreateTUN(ew.interfaceName, device.DefaultMTU)
+	tunDevice, err := tun.CreateTUN(ew.requestedName, mtu)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create TUN device: %w", err)
 	}
 
+	// macOS picks the utun unit when asked for plain "utun"
+	if name, err := tunDevice.Name(); err == nil && name != "" {
+		ew.interfaceName = name
+	}
+
 	return tunDevice, nil
 }
 
 // configureDevice applies WireGuard configuration to the device
-func (ew *EmbeddedWireGuard) configureDevice(config string) error {
-	// Parse and apply the WireGuard configuration
-	if err := ew.device.IpcSetOperation(strings.NewReader(ew.parseConfig(config))); err != nil {
+func (ew *EmbeddedWireGuard) configureDevice(cfg *wgconfig.Config) error {
+	// The UAPI only accepts ip:port endpoints, so resolve names first
+	resolved := *cfg
+	resolved.Peers = append([]wgconfig.Peer(nil), cfg.Peers...)
+	for i, peer := range resolved.Peers {
+		if peer.Endpoint == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", peer.Endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to resolve endpoint %s: %w", peer.Endpoint, err)
+		}
+		resolved.Peers[i].Endpoint = addr.String()
+	}
+
+	if err := ew.device.IpcSetOperation(strings.NewReader(resolved.IPC())); err != nil {
 		return fmt.Errorf("failed to set device configuration: %w", err)
 	}
 
 	// Configure IP address and routes from the config
-	if err := ew.configureNetworking(config); err != nil {
+	if err := ew.configureNetworking(cfg); err != nil {
 		return fmt.Errorf("failed to configure networking: %w", err)
 	}
 
 	return nil
 }
 
-// parseConfig converts WireGuard .conf format to IPC format
-func (ew *EmbeddedWireGuard) parseConfig(config string) string {
-	// This is a simplified parser - in production, would use a proper parser
-	lines := strings.Split(config, "\n")
-	var ipcConfig strings.Builder
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		if strings.HasPrefix(line, "[") {
-			continue // Skip section headers
-		}
-
-		if strings.Contains(line, "=") {
-			parts := strings.SplitN(line, "=", 2)
-			key := strings.TrimSpace(strings.ToLower(parts[0]))
-			value := strings.TrimSpace(parts[1])
-
-			switch key {
-			case "privatekey":
-				ipcConfig.WriteString(fmt.Sprintf("private_key=%s\n", value))
-			case "publickey":
-				ipcConfig.WriteString(fmt.Sprintf("public_key=%s\n", value))
-			case "endpoint":
-				ipcConfig.WriteString(fmt.Sprintf("endpoint=%s\n", value))
-			case "allowedips":
-				ipcConfig.WriteString(fmt.Sprintf("allowed_ip=%s\n", value))
-			case "persistentkeepalive":
-				ipcConfig.WriteString(fmt.Sprintf("persistent_keepalive_interval=%s\n", value))
-			}
-		}
+// configureNetworking sets up IP addresses, routes and DNS
+func (ew *EmbeddedWireGuard) configureNetworking(cfg *wgconfig.Config) error {
+	if len(cfg.Interface.Addresses) == 0 {
+		return fmt.Errorf("no Address specified in configuration")
 	}
 
-	return ipcConfig.String()
-}
-
-// configureNetworking sets up IP addresses and routes
-func (ew *EmbeddedWireGuard) configureNetworking(config string) error {
-	// Extract Address from config
-	address := ew.extractConfigValue(config, "Address")
-	if address == "" {
-		return fmt.Errorf("no Address specified in configuration")
+	// Configure the TUN interface with each address
+	for _, address := range cfg.Interface.Addresses {
+		if err := ew.configureInterfaceIP(address); err != nil {
+			return fmt.Errorf("failed to configure interface IP: %w", err)
+		}
 	}
 
-	// Configure the TUN interface with the IP address
-	if err := ew.configureInterfaceIP(address); err != nil {
-		return fmt.Errorf("failed to configure interface IP: %w", err)
+	// Table = off leaves routing to the PostUp hooks, as in wg-quick
+	if cfg.Interface.Table != wgconfig.TableOff {
+		for _, peer := range cfg.Peers {
+			ew.configureRoutes(peer.AllowedIPs, cfg.Interface.Table)
+		}
 	}
 
-	// Extract and configure DNS if specified
-	dns := ew.extractConfigValue(config, "DNS")
-	if dns != "" {
-		if err := ew.configureDNS(dns); err != nil {
+	if len(cfg.Interface.DNS) > 0 {
+		if err := ew.configureDNS(cfg.Interface.DNS, cfg.Interface.DNSSearch); err != nil {
 			// DNS configuration is not critical, log but continue
 			fmt.Printf("Warning: failed to configure DNS: %v\n", err)
 		}
@@ -202,35 +260,33 @@ func (ew *EmbeddedWireGuard) configureNetworking(config string) error {
 	return nil
 }
 
-// extractConfigValue extracts a value from WireGuard config
-func (ew *EmbeddedWireGuard) extractConfigValue(config, key string) string {
-	lines := strings.Split(config, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(strings.ToLower(line), strings.ToLower(key)+"=") {
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				return strings.TrimSpace(parts[1])
-			}
+// runHooks runs wg-quick style hook commands through the shell, with %i
+// replaced by the interface name. The first failing command stops the rest.
+func (ew *EmbeddedWireGuard) runHooks(stage string, commands []string) error {
+	for _, command := range commands {
+		command = strings.ReplaceAll(command, "%i", ew.interfaceName)
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("sh", "-c", command)
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s hook %q failed: %w, output: %s", stage, command, err, output)
 		}
 	}
-	return ""
+	return nil
 }
 
 // configureInterfaceIP configures the IP address on the TUN interface
-func (ew *EmbeddedWireGuard) configureInterfaceIP(address string) error {
-	// Parse the CIDR address
-	ip, ipNet, err := net.ParseCIDR(address)
-	if err != nil {
-		return fmt.Errorf("invalid address format: %w", err)
-	}
-
+func (ew *EmbeddedWireGuard) configureInterfaceIP(address netip.Prefix) error {
 	// For embedded implementation, we would configure the TUN interface
 	// This is platform-specific and would require different implementations
 	// for Windows, macOS, and Linux
 	
 	fmt.Printf("Configuring interface %s with IP %s (network %s)\n", 
-		ew.interfaceName, ip.String(), ipNet.String())
+		ew.interfaceName, address.Addr(), address.Masked())
 
 	// In a full implementation, this would call platform-specific functions
 	// to configure the interface IP address and routing table
@@ -238,14 +294,22 @@ func (ew *EmbeddedWireGuard) configureInterfaceIP(address string) error {
 	return nil
 }
 
-// configureDNS configures DNS settings
-func (ew *EmbeddedWireGuard) configureDNS(dns string) error {
-	dnsServers := strings.Split(dns, ",")
-	for i, server := range dnsServers {
-		dnsServers[i] = strings.TrimSpace(server)
+// configureRoutes routes a peer's allowed IPs through the tunnel
+func (ew *EmbeddedWireGuard) configureRoutes(allowedIPs []netip.Prefix, table string) {
+	if table == "" {
+		table = wgconfig.TableAuto
+	}
+	for _, prefix := range allowedIPs {
+		fmt.Printf("Routing %s via %s (table %s)\n", prefix, ew.interfaceName, table)
 	}
 
-	fmt.Printf("Configuring DNS servers: %v\n", dnsServers)
+	// In a full implementation, this would add the routes to the platform
+	// routing table, using a separate table and rule for default routes
+}
+
+// configureDNS configures DNS settings
+func (ew *EmbeddedWireGuard) configureDNS(dnsServers []netip.Addr, searchDomains []string) error {
+	fmt.Printf("Configuring DNS servers: %v (search %v)\n", dnsServers, searchDomains)
 
 	// In a full implementation, this would configure system DNS settings
 	// This is platform-specific and requires elevated privileges
@@ -4,7 +4,13 @@
 // - Connection establishment and termination
 // - Configuration management
 // - Status monitoring and statistics
+// - Event-driven repair when the tunnel interface, its addresses or the
+//   routes through it change, counting each as tampering
 // - Automatic reconnection and failover
+// - Switching between the user's clusters, each with its own configuration
+// - DNS leak protection and periodic leak tests
+// - WebRTC/STUN leak mitigation
+// - Power-aware keepalive and status polling
 // - Integration with system networking
 package vpn
 
@@ -13,15 +19,21 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/tobogganing/clients/native/internal/client"
 	"github.com/tobogganing/clients/native/internal/config"
+	"github.com/tobogganing/clients/native/internal/dnsguard"
+	"github.com/tobogganing/clients/native/internal/power"
+	"github.com/tobogganing/clients/native/internal/stunguard"
+	"github.com/tobogganing/libs/wgconfig"
 )
 
 const (
@@ -30,6 +42,9 @@ const (
 	
 	// Status constants
 	statusUnknown = "unknown"
+	
+	// tunnelDNS is the resolver the headend serves inside the tunnel
+	tunnelDNS = "10.200.0.1"
 )
 
 // Manager handles WireGuard VPN connections and implements the tray.VPNManager interface
@@ -47,11 +62,26 @@ type Manager struct {
 	
 	// Connection monitoring
 	monitorTicker  *time.Ticker
+	netWatchCancel context.CancelFunc
+	tunnelIndex    int
+	tunnelRoutes   []netip.Prefix
+	tamperCount    int
+	lastTamper     time.Time
 	
 	// Embedded WireGuard
 	embeddedWG     *EmbeddedWireGuard
 	useEmbedded    bool
 	monitorStop    chan struct{}
+	
+	// DNS leak protection
+	dnsGuard       *dnsguard.Guard
+	lastLeakCheck  time.Time
+	
+	// WebRTC/STUN leak mitigation
+	stunGuard      *stunguard.Guard
+	
+	// Power-aware keepalive and polling
+	powerMonitor   *power.Monitor
 }
 
 // NewManager creates a new VPN manager instance
@@ -59,10 +89,7 @@ func NewManager(cfg *config.Config) *Manager {
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	// Determine interface name based on platform
-	interfaceName := "wg0"
-	if runtime.GOOS == platformWindows {
-		interfaceName = "SASEWaddle"
-	}
+	interfaceName := DefaultInterfaceName()
 	
 	manager := &Manager{
 		config:        cfg,
@@ -76,6 +103,14 @@ func NewManager(cfg *config.Config) *Manager {
 	
 	// Initialize embedded WireGuard
 	manager.embeddedWG = NewEmbeddedWireGuard(interfaceName)
+	manager.dnsGuard = dnsguard.New(interfaceName, []string{tunnelDNS})
+	
+	// Config validation rejects unknown modes, so a parse error means off
+	webrtcMode, _ := stunguard.ParseMode(cfg.WebRTCProtection)
+	manager.stunGuard = stunguard.New(interfaceName, webrtcMode, cfg.WebRTCExceptions)
+	
+	powerProfile, _ := power.ParseProfile(cfg.PowerProfile)
+	manager.powerMonitor = power.NewMonitor(powerProfile)
 	
 	return manager
 }
@@ -91,6 +126,9 @@ func (m *Manager) Connect() error {
 	
 	log.Println("Initiating VPN connection...")
 	
+	// Use the configuration of the cluster we connect to
+	m.resolveConfigPath()
+	
 	// Validate configuration
 	if err := m.validateConfig(); err != nil {
 		return fmt.Errorf("invalid configuration: %w", err)
@@ -101,6 +139,23 @@ func (m *Manager) Connect() error {
 		return fmt.Errorf("failed to establish WireGuard connection: %w", err)
 	}
 	
+	// The guards follow the interface the platform actually created
+	if m.useEmbedded {
+		m.interfaceName = m.embeddedWG.GetInterfaceName()
+		m.dnsGuard.SetInterfaceName(m.interfaceName)
+		m.stunGuard.SetInterfaceName(m.interfaceName)
+	}
+	
+	// Keep DNS inside the tunnel
+	if m.config.DNSLeakProtection {
+		if err := m.dnsGuard.Enable(); err != nil {
+			log.Printf("Warning: DNS leak protection not enabled: %v", err)
+		}
+	}
+	if err := m.stunGuard.Enable(); err != nil {
+		log.Printf("Warning: WebRTC protection not enabled: %v", err)
+	}
+	
 	// Update status
 	m.isConnected = true
 	m.currentStatus = client.ConnectionStatus{
@@ -108,6 +163,8 @@ func (m *Manager) Connect() error {
 		ClientID:       m.config.ClientName,
 		WireGuardIP:    m.getLocalIP(),
 		HeadendURL:     m.config.ManagerURL,
+		Cluster:        m.config.ClusterID(),
+		EgressRegion:   m.config.EgressRegion,
 		ConnectedSince: time.Now(),
 		BytesReceived:  0,
 		BytesSent:      0,
@@ -135,6 +192,13 @@ func (m *Manager) Disconnect() error {
 	// Stop monitoring
 	m.stopMonitoring()
 	
+	if err := m.dnsGuard.Disable(); err != nil {
+		log.Printf("Warning: failed to remove DNS leak protection: %v", err)
+	}
+	if err := m.stunGuard.Disable(); err != nil {
+		log.Printf("Warning: failed to remove WebRTC protection: %v", err)
+	}
+	
 	// Platform-specific disconnection logic
 	if err := m.disconnectWireGuard(); err != nil {
 		log.Printf("Warning: error during disconnection: %v", err)
@@ -176,6 +240,9 @@ func (m *Manager) GetStatus() client.ConnectionStatus {
 // GetStatusString returns a simple string status for tray interface
 func (m *Manager) GetStatusString() string {
 	if m.isConnected {
+		if m.dnsGuard.LastStatus().State == dnsguard.StateLeaking {
+			return "Connected (DNS leak detected)"
+		}
 		return "Connected"
 	}
 	return "Disconnected"
@@ -189,6 +256,22 @@ func (m *Manager) GetStatistics() map[string]interface{} {
 	stats := make(map[string]interface{})
 	stats["connected"] = m.isConnected
 	stats["status"] = m.GetStatusString()
+	stats["dns_leak_status"] = string(m.dnsGuard.LastStatus().State)
+	stats["webrtc_protection"] = string(m.stunGuard.Mode())
+	stats["egress_region"] = m.currentStatus.EgressRegion
+	stats["cluster"] = m.currentStatus.Cluster
+	stats["power_profile"] = m.powerMonitor.Describe()
+	stats["route_tampers"] = m.tamperCount
+	if !m.lastTamper.IsZero() {
+		stats["last_route_tamper"] = m.lastTamper
+	}
+	// The session belongs to the client service, which saves its state
+	if authState, err := client.LoadAuthState(m.config); err == nil {
+		stats["auth_state"] = authState.State
+		if !authState.ExpiresAt.IsZero() {
+			stats["auth_expires_at"] = authState.ExpiresAt
+		}
+	}
 	
 	if m.isConnected {
 		ifaceStats := m.getInterfaceStatistics()
@@ -395,14 +478,17 @@ func (m *Manager) validateConfig() error {
 	}
 	
 	// Validate config content (basic check)
-	content, err := os.ReadFile(m.configPath)
+	content, err := readWireGuardConfig(m.configPath)
 	if err != nil {
 		return fmt.Errorf("cannot read configuration file: %w", err)
 	}
 	
-	configStr := string(content)
-	if !strings.Contains(configStr, "[Interface]") || !strings.Contains(configStr, "[Peer]") {
-		return fmt.Errorf("invalid WireGuard configuration format")
+	cfg, err := wgconfig.ParseString(string(content))
+	if err != nil {
+		return fmt.Errorf("invalid WireGuard configuration: %w", err)
+	}
+	if len(cfg.Peers) == 0 {
+		return fmt.Errorf("invalid WireGuard configuration: no [Peer] section")
 	}
 	
 	return nil
@@ -422,13 +508,21 @@ func (m *Manager) getLocalIP() string {
 		return statusUnknown
 	}
 	
+	// Prefer the IPv4 address, IPv6-only tunnels report their IPv6 one
+	ipv6 := ""
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
 				return ipnet.IP.String()
 			}
+			if ipv6 == "" && !ipnet.IP.IsLinkLocalUnicast() {
+				ipv6 = ipnet.IP.String()
+			}
 		}
 	}
+	if ipv6 != "" {
+		return ipv6
+	}
 	
 	return statusUnknown
 }
@@ -529,7 +623,8 @@ func (m *Manager) parseTransferAmount(amountStr string) uint64 {
 // Connection monitoring
 
 func (m *Manager) startMonitoring() {
-	m.monitorTicker = time.NewTicker(5 * time.Second)
+	m.startNetworkWatch()
+	m.monitorTicker = time.NewTicker(m.powerMonitor.Current().StatusPoll)
 	
 	go func() {
 		for {
@@ -546,6 +641,7 @@ func (m *Manager) startMonitoring() {
 }
 
 func (m *Manager) stopMonitoring() {
+	m.stopNetworkWatch()
 	if m.monitorTicker != nil {
 		m.monitorTicker.Stop()
 	}
@@ -557,14 +653,11 @@ func (m *Manager) stopMonitoring() {
 }
 
 func (m *Manager) checkConnection() {
-	// Check if the WireGuard interface is still up
+	// Check if the WireGuard interface is still up. Where the platform
+	// reports changes, the network watch has normally repaired it already.
 	_, err := net.InterfaceByName(m.interfaceName)
 	if err != nil {
-		log.Printf("WireGuard interface %s not found, marking as disconnected", m.interfaceName)
-		m.mutex.Lock()
-		m.isConnected = false
-		m.currentStatus.State = "disconnected"
-		m.mutex.Unlock()
+		m.repair(fmt.Sprintf("interface %s not found", m.interfaceName))
 		return
 	}
 	
@@ -577,12 +670,56 @@ func (m *Manager) checkConnection() {
 	stats := m.getInterfaceStatistics()
 	m.mutex.Lock()
 	m.currentStatus.LastHandshake = stats.LastHandshake
+	intervals, changed := m.powerMonitor.Update(stats.BytesSent + stats.BytesReceived)
+	runLeakCheck := m.config.DNSLeakProtection && time.Since(m.lastLeakCheck) >= intervals.ConfigCheck
+	if runLeakCheck {
+		m.lastLeakCheck = time.Now()
+	}
 	m.mutex.Unlock()
+	
+	// Adapt polling and keepalive to the power state and tunnel activity
+	if changed {
+		log.Printf("Power profile %s: keepalive %s, status polling every %s",
+			m.powerMonitor.Describe(), intervals.Keepalive, intervals.StatusPoll)
+		m.monitorTicker.Reset(intervals.StatusPoll)
+		if err := m.setKeepalive(intervals.Keepalive); err != nil {
+			log.Printf("Warning: failed to update WireGuard keepalive: %v", err)
+		}
+	}
+	
+	if runLeakCheck {
+		if status := m.dnsGuard.Check(m.ctx); status.State == dnsguard.StateLeaking {
+			log.Printf("Warning: DNS leak detected: %s", status.Detail)
+		}
+	}
+}
+
+// setKeepalive changes the persistent keepalive of the tunnel's peers in place
+func (m *Manager) setKeepalive(keepalive time.Duration) error {
+	if m.useEmbedded && m.embeddedWG.IsRunning() {
+		return m.embeddedWG.SetKeepalive(keepalive)
+	}
+	
+	peers, err := exec.Command("wg", "show", m.interfaceName, "peers").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list WireGuard peers: %w", err)
+	}
+	
+	value := "off"
+	if keepalive > 0 {
+		value = strconv.Itoa(int(keepalive.Seconds()))
+	}
+	for _, peer := range strings.Fields(string(peers)) {
+		if output, err := exec.Command("wg", "set", m.interfaceName, "peer", peer, "persistent-keepalive", value).CombinedOutput(); err != nil {
+			return fmt.Errorf("wg set failed: %v, output: %s", err, output)
+		}
+	}
+	return nil
 }
 
 // Utility functions for VPN management
 
 
 func readWireGuardConfig(path string) ([]byte, error) {
-	return os.ReadFile(path)
+	return config.ReadFile(path)
 }
\ No newline at end of file
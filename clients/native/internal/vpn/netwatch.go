@@ -0,0 +1,179 @@
+package vpn
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/tobogganing/clients/native/internal/netmon"
+	"github.com/tobogganing/libs/wgconfig"
+)
+
+// repairDelay gathers the burst of events one change causes, e.g. an
+// interface going down with all its addresses and routes, into one repair
+const repairDelay = 250 * time.Millisecond
+
+// repairQuiet is how long the events a repair itself causes are ignored
+const repairQuiet = 2 * time.Second
+
+// startNetworkWatch repairs the tunnel as soon as its interface, addresses
+// or routes change. Where the platform has no change notifications, the
+// status polling in checkConnection notices a missing interface instead.
+// Caller must hold mutex.
+func (m *Manager) startNetworkWatch() {
+	ctx, cancel := context.WithCancel(m.ctx)
+	events, err := netmon.Watch(ctx)
+	if err != nil {
+		cancel()
+		log.Printf("Interface and route monitoring unavailable, relying on status polling: %v", err)
+		return
+	}
+	m.netWatchCancel = cancel
+	m.tunnelIndex = interfaceIndex(m.interfaceName)
+	m.tunnelRoutes = m.readTunnelRoutes()
+
+	go func() {
+		repair := time.NewTimer(repairDelay)
+		repair.Stop()
+		reason := ""
+		var quietUntil time.Time
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					repair.Stop()
+					return
+				}
+				if time.Now().Before(quietUntil) {
+					continue
+				}
+				if m.affectsTunnel(e) {
+					if reason == "" {
+						reason = e.String()
+					}
+					repair.Reset(repairDelay)
+				}
+			case <-repair.C:
+				m.repair(reason)
+				reason = ""
+				quietUntil = time.Now().Add(repairQuiet)
+			}
+		}
+	}()
+}
+
+// stopNetworkWatch stops the watch started by startNetworkWatch. Caller
+// must hold mutex.
+func (m *Manager) stopNetworkWatch() {
+	if m.netWatchCancel != nil {
+		m.netWatchCancel()
+		m.netWatchCancel = nil
+	}
+}
+
+// affectsTunnel reports whether e changed the tunnel interface, or a route
+// that can take traffic away from it
+func (m *Manager) affectsTunnel(e netmon.Event) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.isConnected && e.Affects(m.tunnelIndex, m.interfaceName, m.tunnelRoutes)
+}
+
+// repair puts the tunnel back after reason changed it: a missing interface
+// is recreated with a reconnect, otherwise its addresses and routes are
+// applied again. Each repair counts as tampering, since the client never
+// changes a connected tunnel itself.
+func (m *Manager) repair(reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.isConnected {
+		return
+	}
+	m.tamperCount++
+	m.lastTamper = time.Now()
+	log.Printf("Warning: tunnel changed by other software (%s), repairing", reason)
+
+	if _, err := net.InterfaceByName(m.interfaceName); err != nil {
+		if err := m.reconnectLocked(); err != nil {
+			log.Printf("Failed to recreate WireGuard interface %s, marking as disconnected: %v", m.interfaceName, err)
+			m.isConnected = false
+			m.currentStatus.State = "disconnected"
+			return
+		}
+		log.Printf("Recreated WireGuard interface %s", m.interfaceName)
+		return
+	}
+
+	if m.useEmbedded {
+		if err := m.embeddedWG.Reapply(); err != nil {
+			log.Printf("Warning: failed to repair tunnel networking: %v", err)
+		}
+		return
+	}
+	// wg-quick owns the addresses and routes, so bring it up afresh
+	if err := m.reconnectLocked(); err != nil {
+		log.Printf("Warning: failed to repair tunnel: %v", err)
+	}
+}
+
+// reconnectLocked tears the tunnel down and brings it up again, moving the
+// leak guards to the new interface. Caller must hold mutex.
+func (m *Manager) reconnectLocked() error {
+	if err := m.disconnectWireGuard(); err != nil {
+		log.Printf("Warning: error tearing down tunnel for repair: %v", err)
+	}
+	if err := m.connectWireGuard(); err != nil {
+		return err
+	}
+
+	if m.useEmbedded {
+		if name := m.embeddedWG.GetInterfaceName(); name != m.interfaceName {
+			_ = m.dnsGuard.Disable()
+			_ = m.stunGuard.Disable()
+			m.interfaceName = name
+			m.dnsGuard.SetInterfaceName(name)
+			m.stunGuard.SetInterfaceName(name)
+			if m.config.DNSLeakProtection {
+				if err := m.dnsGuard.Enable(); err != nil {
+					log.Printf("Warning: DNS leak protection not enabled: %v", err)
+				}
+			}
+			if err := m.stunGuard.Enable(); err != nil {
+				log.Printf("Warning: WebRTC protection not enabled: %v", err)
+			}
+		}
+	}
+	m.tunnelIndex = interfaceIndex(m.interfaceName)
+	return nil
+}
+
+// readTunnelRoutes returns the allowed IPs of every peer, which the tunnel
+// routes
+func (m *Manager) readTunnelRoutes() []netip.Prefix {
+	data, err := readWireGuardConfig(m.configPath)
+	if err != nil {
+		return nil
+	}
+	cfg, err := wgconfig.ParseString(string(data))
+	if err != nil {
+		return nil
+	}
+	var routes []netip.Prefix
+	for _, peer := range cfg.Peers {
+		routes = append(routes, peer.AllowedIPs...)
+	}
+	return routes
+}
+
+// interfaceIndex returns the index of the named interface, or 0
+func interfaceIndex(name string) int {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0
+	}
+	return iface.Index
+}
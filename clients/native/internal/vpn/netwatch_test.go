@@ -0,0 +1,45 @@
+package vpn
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/tobogganing/clients/native/internal/netmon"
+)
+
+func TestAffectsTunnel(t *testing.T) {
+	m := &Manager{
+		isConnected:   true,
+		interfaceName: "wg0",
+		tunnelIndex:   7,
+		tunnelRoutes: []netip.Prefix{
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("10.0.0.0/8"),
+		},
+	}
+
+	for _, test := range []struct {
+		event netmon.Event
+		want  bool
+	}{
+		{netmon.Event{Kind: netmon.KindLink, Removed: true, Index: 7}, true},
+		{netmon.Event{Kind: netmon.KindLink, Name: "wg0"}, true},
+		{netmon.Event{Kind: netmon.KindLink, Index: 2, Name: "eth0"}, false},
+		{netmon.Event{Kind: netmon.KindAddress, Index: 2, Prefix: netip.MustParsePrefix("192.168.1.5/24")}, false},
+		{netmon.Event{Kind: netmon.KindRoute, Removed: true, Index: 7, Prefix: netip.MustParsePrefix("10.0.0.0/8")}, true},
+		// A more specific route elsewhere takes tunnel traffic
+		{netmon.Event{Kind: netmon.KindRoute, Index: 2, Prefix: netip.MustParsePrefix("10.1.0.0/16")}, true},
+		// Overlapping only the default route through the tunnel
+		{netmon.Event{Kind: netmon.KindRoute, Index: 2, Prefix: netip.MustParsePrefix("192.168.1.0/24")}, false},
+		{netmon.Event{Kind: netmon.KindRoute}, true},
+	} {
+		if got := m.affectsTunnel(test.event); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.event, got, test.want)
+		}
+	}
+
+	m.isConnected = false
+	if m.affectsTunnel(netmon.Event{Kind: netmon.KindLink, Index: 7}) {
+		t.Error("event affects a disconnected tunnel")
+	}
+}
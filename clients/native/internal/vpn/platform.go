@@ -0,0 +1,134 @@
+package vpn
+
+// Platform quirks of the embedded WireGuard tunnel.
+//
+// macOS, on Intel and Apple Silicon alike, only creates utun interfaces and
+// numbers them itself, so the tunnel asks for "utun" and adopts the name
+// the kernel hands out; the DNS and WebRTC guards follow it. Creating one
+// requires root.
+//
+// Windows, on x64 and ARM64 alike, creates the adapter through the Wintun
+// driver. wintun.dll must sit beside the executable, or in System32, and be
+// built for the same architecture: an ARM64 client can't load the amd64
+// DLL, and Windows only reports that as a module that couldn't be found.
+// The adapter is created with a fixed GUID, see platform_windows.go.
+
+import (
+	"debug/pe"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const platformDarwin = "darwin"
+
+// wintunDLL is the Wintun driver library the embedded tunnel loads on Windows
+const wintunDLL = "wintun.dll"
+
+// peMachines maps the machine type of a PE image to its GOARCH
+var peMachines = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+	pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+	pe.IMAGE_FILE_MACHINE_I386:  "386",
+	pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+}
+
+// DefaultInterfaceName returns the tunnel interface name to ask for on this
+// platform
+func DefaultInterfaceName() string {
+	switch runtime.GOOS {
+	case platformDarwin:
+		return "utun"
+	case platformWindows:
+		return "SASEWaddle"
+	default:
+		return "wg0"
+	}
+}
+
+// CheckPlatform reports what would keep the embedded tunnel from starting
+// on this machine, such as missing privileges or a missing or mismatched
+// wintun.dll. Installers and platform tests call it before going further.
+func CheckPlatform() error {
+	return checkTunPrerequisites(DefaultInterfaceName())
+}
+
+// checkTunPrerequisites checks what creating the interface name needs,
+// turning failures the platform reports obscurely into actionable errors
+func checkTunPrerequisites(name string) error {
+	switch runtime.GOOS {
+	case platformDarwin:
+		if !validUtunName(name) {
+			return fmt.Errorf("interface name %q is not valid on macOS: use utun, or utunN for a fixed unit", name)
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("creating a utun interface requires root: run the client as a launchd daemon or with sudo")
+		}
+	case platformWindows:
+		return checkWintun(wintunSearchDirs(), runtime.GOARCH)
+	}
+	return nil
+}
+
+// validUtunName reports whether macOS accepts name for a utun interface
+func validUtunName(name string) bool {
+	if name == "utun" {
+		return true
+	}
+	unit, ok := strings.CutPrefix(name, "utun")
+	if !ok || unit == "" {
+		return false
+	}
+	n, err := strconv.Atoi(unit)
+	return err == nil && n >= 0 && strconv.Itoa(n) == unit
+}
+
+// wintunSearchDirs returns the directories Windows loads wintun.dll from,
+// in order
+func wintunSearchDirs() []string {
+	var dirs []string
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	if root := os.Getenv("SystemRoot"); root != "" {
+		dirs = append(dirs, filepath.Join(root, "System32"))
+	}
+	return dirs
+}
+
+// checkWintun finds wintun.dll in the first of dirs that has it and checks
+// it was built for goarch
+func checkWintun(dirs []string, goarch string) error {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, wintunDLL)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		arch, err := dllArch(path)
+		if err != nil {
+			return err
+		}
+		if arch != goarch {
+			return fmt.Errorf("%s is built for %s but this client is %s: install the %s wintun.dll from https://www.wintun.net", path, arch, goarch, goarch)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s not found in %s: install the %s build from https://www.wintun.net beside the client", wintunDLL, strings.Join(dirs, ", "), goarch)
+}
+
+// dllArch returns the GOARCH a PE image was built for
+func dllArch(path string) (string, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if arch, ok := peMachines[f.Machine]; ok {
+		return arch, nil
+	}
+	return "", fmt.Errorf("%s has unknown machine type %#x", path, f.Machine)
+}
@@ -0,0 +1,94 @@
+package vpn
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// platformTestsEnv opts in to tests that create a real tunnel interface.
+// They need root or Administrator, and on Windows wintun.dll, which CI
+// runners lack, so they skip unless it is set.
+const platformTestsEnv = "SASEWADDLE_PLATFORM_TESTS"
+
+func requirePlatformTests(t *testing.T) {
+	t.Helper()
+	if os.Getenv(platformTestsEnv) == "" {
+		t.Skipf("set %s=1 to create a real tunnel interface", platformTestsEnv)
+	}
+	if err := CheckPlatform(); err != nil {
+		t.Skipf("platform not ready: %v", err)
+	}
+}
+
+// writePE writes the headers of a PE image built for machine
+func writePE(t *testing.T, path string, machine uint16) {
+	t.Helper()
+	image := make([]byte, 512)
+	copy(image, "MZ")
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x40)
+	copy(image[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(image[0x44:], machine)
+	if err := os.WriteFile(path, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidUtunName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"utun": true, "utun0": true, "utun12": true,
+		"wg0": false, "utun-1": false, "utun01": false, "utunx": false, "SASEWaddle": false,
+	} {
+		if got := validUtunName(name); got != want {
+			t.Errorf("validUtunName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCheckWintun(t *testing.T) {
+	appDir, systemDir := t.TempDir(), t.TempDir()
+	dirs := []string{appDir, systemDir}
+
+	if err := checkWintun(dirs, "arm64"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a missing DLL to be reported, got %v", err)
+	}
+
+	// The DLL beside the executable wins over System32
+	writePE(t, filepath.Join(systemDir, wintunDLL), pe.IMAGE_FILE_MACHINE_ARM64)
+	writePE(t, filepath.Join(appDir, wintunDLL), pe.IMAGE_FILE_MACHINE_AMD64)
+	if err := checkWintun(dirs, "arm64"); err == nil || !strings.Contains(err.Error(), "built for amd64") {
+		t.Errorf("expected the amd64 DLL to be rejected for arm64, got %v", err)
+	}
+	if err := checkWintun(dirs, "amd64"); err != nil {
+		t.Errorf("expected the amd64 DLL to suit amd64, got %v", err)
+	}
+}
+
+// TestPlatformTunnel creates a real interface with the platform's default
+// name, checking the name the platform hands back
+func TestPlatformTunnel(t *testing.T) {
+	requirePlatformTests(t)
+
+	ew := NewEmbeddedWireGuard(DefaultInterfaceName())
+	tunDevice, err := ew.createTunInterface(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunDevice.Close()
+
+	name := ew.GetInterfaceName()
+	switch runtime.GOOS {
+	case platformDarwin:
+		if name == "utun" || !validUtunName(name) {
+			t.Errorf("expected a numbered utun interface, got %q", name)
+		}
+	default:
+		if name != DefaultInterfaceName() {
+			t.Errorf("interface name = %q, want %q", name, DefaultInterfaceName())
+		}
+	}
+}
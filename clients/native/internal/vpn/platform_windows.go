@@ -0,0 +1,23 @@
+//go:build windows
+
+package vpn
+
+import (
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Windows files the network profile of an adapter under its GUID. Without
+// a fixed one each connect creates a new adapter GUID, and with it a new
+// "Network N" profile that defaults to the Public firewall profile.
+var wintunAdapterGUID = windows.GUID{
+	Data1: 0x5a5e3add,
+	Data2: 0x1e0d,
+	Data3: 0x4c3b,
+	Data4: [8]byte{0x9a, 0x41, 0x53, 0x41, 0x53, 0x45, 0x57, 0x44},
+}
+
+func init() {
+	tun.WintunTunnelType = "SASEWaddle"
+	tun.WintunStaticRequestedGUID = &wintunAdapterGUID
+}
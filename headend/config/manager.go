@@ -22,6 +22,7 @@ import (
     "time"
     
     log "github.com/sirupsen/logrus"
+    "github.com/tobogganing/libs/featureflag"
 )
 
 // Manager handles configuration retrieval from SASEWaddle Manager Service
@@ -54,6 +55,9 @@ type HeadendConfig struct {
     
     // Proxy configuration
     Proxy        ProxyConfig       `json:"proxy"`
+    
+    // Feature flag rules for gradual rollouts
+    FeatureFlags featureflag.Payload `json:"feature_flags"`
 }
 
 // AuthConfig contains authentication provider settings
@@ -105,11 +109,11 @@ type WireGuardPeer struct {
 // MirrorConfig contains traffic mirroring settings
 type MirrorConfig struct {
     Enabled      bool              `json:"enabled"`
-    Destinations []string          `json:"destinations"`
+    Destinations []string          `json:"destinations"`     // host:port collectors, file:///dir or s3://bucket/prefix for pcapng captures, kafka://brokers/topic for metadata
     Protocol     string            `json:"protocol"`
     BufferSize   int               `json:"buffer_size"`
-    SampleRate   int               `json:"sample_rate"`
-    Filter       string            `json:"filter,omitempty"`
+    SampleRate   int               `json:"sample_rate"`      // mirror one in N sessions; 0 or 1 mirrors all
+    Filter       string            `json:"filter,omitempty"` // see mirror.Filter for the syntax
 }
 
 // ProxyConfig contains proxy behavior settings
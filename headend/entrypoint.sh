@@ -111,7 +111,9 @@ wg show wg0
 
 # Setup intelligent routing for WireGuard traffic
 echo "Setting up WireGuard traffic routing..."
-export WG_IP_ADDRESS
+export WG_IP_ADDRESS WG_LISTEN_PORT
+WG_HANDSHAKE_RATE="${WG_HANDSHAKE_RATE:-$(echo "$CONFIG_RESPONSE" | jq -r '.wireguard.handshake_rate_limit // empty')}"
+export WG_HANDSHAKE_RATE
 /app/wireguard/scripts/setup-routing.sh
 
 # Setup traffic mirroring iptables rules if enabled
@@ -136,6 +138,13 @@ if [ ! -f "$CERT_FILE" ] || [ ! -f "$KEY_FILE" ]; then
     chmod 644 "$CERT_FILE"
 fi
 
+# Install the Manager CA used to verify client certificates when mTLS is enabled
+CA_CERT=$(echo "$CONFIG_RESPONSE" | jq -r '.certificates.ca_certificate // empty')
+if [ -n "$CA_CERT" ]; then
+    echo "$CA_CERT" > /certs/manager-ca.pem
+    chmod 644 /certs/manager-ca.pem
+fi
+
 # Export configuration for the Go application
 export HEADEND_CONFIG_FILE="/tmp/headend-config.json"
 
@@ -156,4 +165,4 @@ echo "Starting SASEWaddle Headend Proxy Server..."
 trap 'echo "Shutting down..."; wg-quick down wg0; exit 0' SIGTERM SIGINT
 
 # Start the application
-exec /app/headend-proxy
\ No newline at end of file
+exec /app/headend-proxy "$@"
\ No newline at end of file
@@ -0,0 +1,329 @@
+// Package accesslog writes the headend's access log to a local file, for
+// deployments without a syslog collector or as a second copy alongside one.
+//
+// The accesslog package provides:
+//   - One JSON object per line, the same entries the syslog logger sends
+//   - Rotation when the file reaches a size, after an interval, or both
+//   - gzip compression of rotated files, in the background so writes do
+//     not wait for it
+//   - Pruning of rotated files beyond a configured count
+//
+// Rotated files are named after the active file with the rotation time
+// added, e.g. access-20240301T123000.log.gz next to access.log.
+package accesslog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/syslog"
+)
+
+const (
+	DefaultMaxSize        = 100 << 20 // 100 MiB
+	DefaultRotateInterval = 24 * time.Hour
+	DefaultMaxBackups     = 7
+
+	// rotatedTime is the timestamp in rotated file names; it sorts in
+	// time order
+	rotatedTime = "20060102T150405"
+)
+
+// Config configures a Logger
+type Config struct {
+	Path string
+	// MaxSize rotates the file before it grows past this many bytes; zero
+	// disables size-based rotation
+	MaxSize int64
+	// RotateInterval rotates the file this long after it was opened; zero
+	// disables time-based rotation
+	RotateInterval time.Duration
+	// MaxBackups is how many rotated files to keep; zero keeps them all
+	MaxBackups int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// Logger appends access log entries to a file. It is safe for concurrent
+// use.
+type Logger struct {
+	config   Config
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	mu       sync.Mutex
+	// compressing tracks background compression, so Close can wait for
+	// it; housekeepingMu runs one compression and pruning pass at a time
+	compressing    sync.WaitGroup
+	housekeepingMu sync.Mutex
+	now            func() time.Time
+}
+
+// New opens the access log at config.Path for appending, creating it and
+// its directory if needed
+func New(config Config) (*Logger, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("access log path is required")
+	}
+	if config.MaxSize < 0 || config.RotateInterval < 0 || config.MaxBackups < 0 {
+		return nil, fmt.Errorf("access log limits cannot be negative")
+	}
+
+	l := &Logger{config: config, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log appends an entry, rotating the file first if it is due
+func (l *Logger) Log(entry syslog.AccessLog) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal access log: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("access log is closed")
+	}
+	if l.rotationDue(int64(len(line))) {
+		if err := l.rotate(); err != nil {
+			writeErrors.Inc()
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		writeErrors.Inc()
+		return fmt.Errorf("failed to write access log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file and waits for rotated files to be compressed
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	var err error
+	if l.file != nil {
+		err = l.file.Close()
+		l.file = nil
+	}
+	l.mu.Unlock()
+
+	l.compressing.Wait()
+	return err
+}
+
+// Path returns the file entries are written to
+func (l *Logger) Path() string {
+	return l.config.Path
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	l.openedAt = l.now()
+	return nil
+}
+
+// rotationDue reports whether the file must be rotated before writing n
+// more bytes. An entry larger than MaxSize is still written, to an empty
+// file.
+func (l *Logger) rotationDue(n int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.config.MaxSize > 0 && l.size+n > l.config.MaxSize {
+		return true
+	}
+	return l.config.RotateInterval > 0 && l.now().Sub(l.openedAt) >= l.config.RotateInterval
+}
+
+// rotate renames the active file aside and opens a new one
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		log.Warnf("Failed to close access log before rotating: %v", err)
+	}
+	l.file = nil
+
+	rotated := l.rotatedName(l.now())
+	if err := os.Rename(l.config.Path, rotated); err != nil {
+		// Keep logging to the file we have rather than losing entries
+		if reopenErr := l.open(); reopenErr != nil {
+			return fmt.Errorf("failed to rotate access log: %v; failed to reopen: %w", err, reopenErr)
+		}
+		return fmt.Errorf("failed to rotate access log: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	rotations.Inc()
+
+	l.compressing.Add(1)
+	go func() {
+		defer l.compressing.Done()
+		l.housekeeping()
+	}()
+	return nil
+}
+
+// rotatedName returns a name for the file rotated at t that is not taken
+func (l *Logger) rotatedName(t time.Time) string {
+	ext := filepath.Ext(l.config.Path)
+	base := strings.TrimSuffix(l.config.Path, ext) + "-" + t.UTC().Format(rotatedTime)
+	name := base + ext
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return name
+}
+
+// backups returns the rotated files, oldest first
+func (l *Logger) backups() ([]string, error) {
+	ext := filepath.Ext(l.config.Path)
+	prefix := filepath.Base(strings.TrimSuffix(l.config.Path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(l.config.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	type backup struct {
+		name string
+		at   time.Time
+		seq  int
+	}
+	var found []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		stem := strings.TrimSuffix(name, ".gz")
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(stem, ext) {
+			continue
+		}
+		// The rotation time, and a sequence number for rotations within
+		// the same second
+		stamp, seq, _ := strings.Cut(strings.TrimSuffix(stem, ext)[len(prefix):], ".")
+		at, err := time.Parse(rotatedTime, stamp)
+		if err != nil {
+			continue
+		}
+		b := backup{name: name, at: at}
+		if seq != "" {
+			if b.seq, err = strconv.Atoi(seq); err != nil {
+				continue
+			}
+		}
+		found = append(found, b)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].at.Equal(found[j].at) {
+			return found[i].at.Before(found[j].at)
+		}
+		return found[i].seq < found[j].seq
+	})
+
+	paths := make([]string, len(found))
+	for i, b := range found {
+		paths[i] = filepath.Join(filepath.Dir(l.config.Path), b.name)
+	}
+	return paths, nil
+}
+
+// housekeeping compresses rotated files not yet compressed and removes the
+// oldest beyond MaxBackups. Passes can start in any order after quick
+// rotations, so each one covers every rotated file.
+func (l *Logger) housekeeping() {
+	l.housekeepingMu.Lock()
+	defer l.housekeepingMu.Unlock()
+
+	backups, err := l.backups()
+	if err != nil {
+		log.Warnf("Failed to list rotated access logs: %v", err)
+		return
+	}
+
+	if l.config.MaxBackups > 0 {
+		for len(backups) > l.config.MaxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				log.Warnf("Failed to remove rotated access log %s: %v", backups[0], err)
+			}
+			backups = backups[1:]
+		}
+	}
+
+	if !l.config.Compress {
+		return
+	}
+	for _, backup := range backups {
+		if strings.HasSuffix(backup, ".gz") {
+			continue
+		}
+		if err := compress(backup); err != nil {
+			log.Warnf("Failed to compress rotated access log %s: %v", backup, err)
+		}
+	}
+}
+
+// compress gzips path to path.gz and removes path
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
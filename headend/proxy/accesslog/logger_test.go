@@ -0,0 +1,135 @@
+package accesslog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/syslog"
+)
+
+// readEntries returns the user IDs in a log file, gzipped or not
+func readEntries(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var scanner *bufio.Scanner
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner = bufio.NewScanner(zr)
+	} else {
+		scanner = bufio.NewScanner(file)
+	}
+
+	var users []string
+	for scanner.Scan() {
+		var entry syslog.AccessLog
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		users = append(users, entry.UserID)
+	}
+	return users
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	entry, err := json.Marshal(syslog.AccessLog{UserID: "a", Action: "allow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two entries fit in a file
+	l, err := New(Config{Path: path, MaxSize: 2 * int64(len(entry)+1), MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 8; i++ {
+		if err := l.Log(syslog.AccessLog{UserID: string(rune('a' + i)), Action: "allow"}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got backups %v, want the newest 2", backups)
+	}
+	var rotated []string
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".log.gz") {
+			t.Errorf("%s was not compressed", backup)
+		}
+		rotated = append(rotated, readEntries(t, backup)...)
+	}
+	if got := strings.Join(rotated, ""); got != "cdef" {
+		t.Errorf("rotated entries: got %q, want cdef", got)
+	}
+	if got := strings.Join(readEntries(t, path), ""); got != "gh" {
+		t.Errorf("active entries: got %q, want gh", got)
+	}
+}
+
+func TestRotateByInterval(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	l, err := New(Config{Path: path, RotateInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	l.openedAt = now
+
+	for _, user := range []string{"a", "b"} {
+		if err := l.Log(syslog.AccessLog{UserID: user}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(30 * time.Minute)
+	}
+	if err := l.Log(syslog.AccessLog{UserID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := filepath.Join(dir, "access-20240301T130000.log")
+	if got := strings.Join(readEntries(t, rotated), ""); got != "ab" {
+		t.Errorf("rotated entries: got %q, want ab", got)
+	}
+	if got := strings.Join(readEntries(t, path), ""); got != "c" {
+		t.Errorf("active entries: got %q, want c", got)
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	for _, config := range []Config{
+		{},
+		{Path: filepath.Join(t.TempDir(), "access.log"), MaxSize: -1},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package accesslog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	writeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_access_log_write_errors_total",
+		Help: "Total number of access log entries that could not be written to the access log file.",
+	})
+
+	rotations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_access_log_rotations_total",
+		Help: "Total number of times the access log file was rotated.",
+	})
+)
@@ -0,0 +1,530 @@
+// Package acme obtains and renews the headend's public TLS certificate from
+// an ACME certificate authority such as Let's Encrypt.
+//
+// The acme package provides:
+//   - Registration of an ACME account, whose key is kept with the
+//     certificate so restarts reuse it
+//   - HTTP-01 challenges, answered by a handler for
+//     /.well-known/acme-challenge/ that the headend serves on port 80
+//   - DNS-01 challenges, published by a hook command since every DNS
+//     provider has its own API; wildcard names need DNS-01
+//   - Renewal in the background once the certificate is within its renewal
+//     window, or no longer covers the configured domains
+//
+// The certificate and key are written to the storage directory as
+// cert.pem and key.pem, which the headend serves through certreload, so a
+// renewal takes effect on the next handshake.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+// Challenge types
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+// Defaults for the fields of Config left empty
+const (
+	DefaultStorageDir    = "/etc/headend/acme"
+	DefaultRenewBefore   = 30 * 24 * time.Hour
+	DefaultCheckInterval = 12 * time.Hour
+	DefaultDNSWait       = 30 * time.Second
+	DefaultTimeout       = 5 * time.Minute
+)
+
+// File names within the storage directory
+const (
+	AccountKeyFile  = "account.key"
+	CertificateFile = "cert.pem"
+	KeyFile         = "key.pem"
+)
+
+// Config describes the certificate to obtain and how
+type Config struct {
+	Domains []string
+	Email   string
+	// DirectoryURL defaults to Let's Encrypt production
+	DirectoryURL string
+	Challenge    string
+	StorageDir   string
+	// RenewBefore is how long before expiry to renew
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+	// DNSHook publishes and removes DNS-01 records; it runs with
+	// ACME_ACTION (present or cleanup), ACME_DOMAIN, ACME_RECORD and
+	// ACME_VALUE in its environment
+	DNSHook string
+	// DNSWait gives DNS-01 records time to propagate before validation
+	DNSWait time.Duration
+	// Timeout bounds one attempt to obtain a certificate
+	Timeout time.Duration
+	// OnRenew runs after a new certificate has been written
+	OnRenew func()
+}
+
+// Status reports the managed certificate and the last renewal attempt
+type Status struct {
+	Domains     []string  `json:"domains"`
+	Challenge   string    `json:"challenge"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	LastRenewal time.Time `json:"last_renewal,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Manager keeps the certificate in the storage directory valid
+type Manager struct {
+	cfg Config
+
+	// tokens maps HTTP-01 challenge paths to their responses
+	tokens   map[string]string
+	tokensMu sync.RWMutex
+
+	mu          sync.Mutex
+	notAfter    time.Time
+	lastRenewal time.Time
+	lastErr     error
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// New validates cfg and creates a manager; nothing is requested until
+// EnsureCertificate or Start
+func New(cfg Config) (*Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, fmt.Errorf("ACME requires at least one domain")
+	}
+	switch cfg.Challenge {
+	case "":
+		cfg.Challenge = ChallengeHTTP01
+	case ChallengeHTTP01, ChallengeDNS01:
+	default:
+		return nil, fmt.Errorf("unknown ACME challenge %q, expected %s or %s", cfg.Challenge, ChallengeHTTP01, ChallengeDNS01)
+	}
+	if cfg.Challenge == ChallengeDNS01 && cfg.DNSHook == "" {
+		return nil, fmt.Errorf("the %s challenge requires a DNS hook", ChallengeDNS01)
+	}
+	for _, domain := range cfg.Domains {
+		if strings.HasPrefix(domain, "*.") && cfg.Challenge != ChallengeDNS01 {
+			return nil, fmt.Errorf("wildcard domain %s requires the %s challenge", domain, ChallengeDNS01)
+		}
+	}
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = acme.LetsEncryptURL
+	}
+	if cfg.StorageDir == "" {
+		cfg.StorageDir = DefaultStorageDir
+	}
+	if cfg.RenewBefore <= 0 {
+		cfg.RenewBefore = DefaultRenewBefore
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultCheckInterval
+	}
+	if cfg.DNSWait < 0 {
+		cfg.DNSWait = 0
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	return &Manager{
+		cfg:      cfg,
+		tokens:   make(map[string]string),
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// CertFile returns the path the certificate chain is written to
+func (m *Manager) CertFile() string {
+	return filepath.Join(m.cfg.StorageDir, CertificateFile)
+}
+
+// KeyFile returns the path the certificate's private key is written to
+func (m *Manager) KeyFile() string {
+	return filepath.Join(m.cfg.StorageDir, KeyFile)
+}
+
+// HTTPHandler answers HTTP-01 challenges and hands every other request to
+// fallback, or responds 404 if fallback is nil
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			m.tokensMu.RLock()
+			response, ok := m.tokens[r.URL.Path]
+			m.tokensMu.RUnlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(response))
+			return
+		}
+		if fallback == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// EnsureCertificate obtains a certificate unless the stored one is valid,
+// covers every domain and isn't due for renewal
+func (m *Manager) EnsureCertificate(ctx context.Context) error {
+	leaf, err := loadLeaf(m.CertFile(), m.KeyFile())
+	if err == nil {
+		m.setNotAfter(leaf.NotAfter)
+		reason := m.renewalReason(leaf, time.Now())
+		if reason == "" {
+			return nil
+		}
+		log.Infof("Renewing ACME certificate for %s: %s", strings.Join(m.cfg.Domains, ", "), reason)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("Replacing unusable ACME certificate: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+	err = m.obtain(ctx)
+
+	m.mu.Lock()
+	m.lastRenewal = time.Now().UTC()
+	m.lastErr = err
+	m.mu.Unlock()
+	if err != nil {
+		renewals.WithLabelValues("failure").Inc()
+		return err
+	}
+	renewals.WithLabelValues("success").Inc()
+	if m.cfg.OnRenew != nil {
+		m.cfg.OnRenew()
+	}
+	return nil
+}
+
+// renewalReason returns why leaf needs replacing, or "" if it doesn't
+func (m *Manager) renewalReason(leaf *x509.Certificate, now time.Time) string {
+	for _, domain := range m.cfg.Domains {
+		if err := leaf.VerifyHostname(strings.Replace(domain, "*.", "acme-check.", 1)); err != nil {
+			return fmt.Sprintf("%s is not covered", domain)
+		}
+	}
+	if remaining := leaf.NotAfter.Sub(now); remaining < m.cfg.RenewBefore {
+		return fmt.Sprintf("expires in %s", remaining.Round(time.Hour))
+	}
+	return ""
+}
+
+// Start checks the certificate every CheckInterval and renews it when due
+func (m *Manager) Start() {
+	go func() {
+		ticker := time.NewTicker(m.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.EnsureCertificate(context.Background()); err != nil {
+					log.Errorf("ACME certificate renewal failed, retrying in %s: %v", m.cfg.CheckInterval, err)
+				}
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops renewals. It is safe to call on a nil Manager.
+func (m *Manager) Stop() {
+	if m == nil {
+		return
+	}
+	m.stopOnce.Do(func() { close(m.stopChan) })
+}
+
+// Status reports the managed certificate, or nil if ACME is disabled
+func (m *Manager) Status() *Status {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := &Status{
+		Domains:     m.cfg.Domains,
+		Challenge:   m.cfg.Challenge,
+		NotAfter:    m.notAfter,
+		LastRenewal: m.lastRenewal,
+	}
+	if m.lastErr != nil {
+		status.LastError = m.lastErr.Error()
+	}
+	return status
+}
+
+func (m *Manager) setNotAfter(notAfter time.Time) {
+	m.mu.Lock()
+	m.notAfter = notAfter
+	m.mu.Unlock()
+}
+
+// obtain runs an ACME order for the configured domains and writes the
+// resulting certificate and key
+func (m *Manager) obtain(ctx context.Context) error {
+	if err := os.MkdirAll(m.cfg.StorageDir, 0700); err != nil {
+		return fmt.Errorf("failed to create ACME storage directory: %w", err)
+	}
+	accountKey, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: m.cfg.DirectoryURL,
+		UserAgent:    "tobogganing-headend",
+	}
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.cfg.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create ACME order: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, url); err != nil {
+			return err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("ACME order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Domains[0]},
+		DNSNames: m.cfg.Domains,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize ACME order: %w", err)
+	}
+
+	leaf, err := m.store(chain, key)
+	if err != nil {
+		return err
+	}
+	m.setNotAfter(leaf.NotAfter)
+	log.Infof("Obtained ACME certificate for %s, valid until %s", strings.Join(m.cfg.Domains, ", "), leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// authorize completes one authorization with the configured challenge
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch ACME authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.cfg.Challenge {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("ACME server offered no %s challenge for %s", m.cfg.Challenge, domain)
+	}
+
+	switch m.cfg.Challenge {
+	case ChallengeHTTP01:
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		path := client.HTTP01ChallengePath(challenge.Token)
+		m.tokensMu.Lock()
+		m.tokens[path] = response
+		m.tokensMu.Unlock()
+		defer func() {
+			m.tokensMu.Lock()
+			delete(m.tokens, path)
+			m.tokensMu.Unlock()
+		}()
+	case ChallengeDNS01:
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		record := "_acme-challenge." + domain + "."
+		if err := m.runDNSHook(ctx, "present", domain, record, value); err != nil {
+			return err
+		}
+		defer func() {
+			if err := m.runDNSHook(context.Background(), "cleanup", domain, record, value); err != nil {
+				log.Warnf("Failed to remove %s: %v", record, err)
+			}
+		}()
+		select {
+		case <-time.After(m.cfg.DNSWait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept %s challenge for %s: %w", m.cfg.Challenge, domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s challenge for %s failed: %w", m.cfg.Challenge, domain, err)
+	}
+	return nil
+}
+
+// runDNSHook runs the DNS hook to publish or remove a DNS-01 record
+func (m *Manager) runDNSHook(ctx context.Context, action, domain, record, value string) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", m.cfg.DNSHook)
+	cmd.Env = append(os.Environ(),
+		"ACME_ACTION="+action,
+		"ACME_DOMAIN="+domain,
+		"ACME_RECORD="+record,
+		"ACME_VALUE="+value,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ACME DNS %s hook failed: %v, output: %s", action, err, output)
+	}
+	return nil
+}
+
+// accountKey loads the account key, creating it on first use
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.cfg.StorageDir, AccountKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %s", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ACME account key: %w", err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read ACME account key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// store writes the certificate chain and its key, key first so a watcher
+// never pairs a new certificate with the old key for long
+func (m *Manager) store(chain [][]byte, key *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("ACME server returned an empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issued certificate: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var certPEM []byte
+	for _, cert := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	if err := writeFile(m.KeyFile(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to write certificate key: %w", err)
+	}
+	if err := writeFile(m.CertFile(), certPEM); err != nil {
+		return nil, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return leaf, nil
+}
+
+// loadLeaf loads a certificate and key pair and returns its leaf
+func loadLeaf(certFile, keyFile string) (*x509.Certificate, error) {
+	if _, err := os.Stat(certFile); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// writeFile replaces path atomically, readable only by the headend
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,202 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewValidatesConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{"no domains", Config{}, "at least one domain"},
+		{"unknown challenge", Config{Domains: []string{"vpn.example.com"}, Challenge: "tls-alpn-01"}, "unknown ACME challenge"},
+		{"dns without hook", Config{Domains: []string{"vpn.example.com"}, Challenge: ChallengeDNS01}, "requires a DNS hook"},
+		{"wildcard over http", Config{Domains: []string{"*.example.com"}}, "requires the dns-01 challenge"},
+	}
+	for _, tc := range cases {
+		if _, err := New(tc.cfg); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	m, err := New(Config{Domains: []string{"vpn.example.com"}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if m.cfg.Challenge != ChallengeHTTP01 || m.CertFile() != filepath.Join(DefaultStorageDir, CertificateFile) {
+		t.Errorf("expected HTTP-01 and the default storage directory, got %+v", m.cfg)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	m, err := New(Config{Domains: []string{"vpn.example.com"}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	m.tokens["/.well-known/acme-challenge/token"] = "token.thumbprint"
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	server := httptest.NewServer(m.HTTPHandler(fallback))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("/.well-known/acme-challenge/token"); status != http.StatusOK || body != "token.thumbprint" {
+		t.Errorf("expected the challenge response, got %d %q", status, body)
+	}
+	if status, _ := get("/.well-known/acme-challenge/other"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown token, got %d", status)
+	}
+	if status, _ := get("/"); status != http.StatusTeapot {
+		t.Errorf("expected other requests to reach the fallback, got %d", status)
+	}
+}
+
+func TestEnsureCertificateKeepsValidCertificate(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(Config{Domains: []string{"vpn.example.com", "*.vpn.example.com"}, Challenge: ChallengeDNS01, DNSHook: "true", StorageDir: dir})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	notAfter := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	writeCertificate(t, m, []string{"vpn.example.com", "*.vpn.example.com"}, notAfter)
+
+	// A valid certificate is kept without contacting the ACME server
+	m.cfg.DirectoryURL = "http://127.0.0.1:1/directory"
+	if err := m.EnsureCertificate(context.Background()); err != nil {
+		t.Fatalf("EnsureCertificate failed: %v", err)
+	}
+	if status := m.Status(); !status.NotAfter.Equal(notAfter) || status.LastError != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestRenewalReason(t *testing.T) {
+	m, err := New(Config{Domains: []string{"vpn.example.com", "*.vpn.example.com"}, Challenge: ChallengeDNS01, DNSHook: "true", StorageDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	now := time.Now()
+
+	leaf := writeCertificate(t, m, []string{"vpn.example.com", "*.vpn.example.com"}, now.Add(60*24*time.Hour))
+	if reason := m.renewalReason(leaf, now); reason != "" {
+		t.Errorf("expected no renewal, got %q", reason)
+	}
+	if reason := m.renewalReason(leaf, now.Add(45*24*time.Hour)); !strings.Contains(reason, "expires in") {
+		t.Errorf("expected renewal within RenewBefore, got %q", reason)
+	}
+
+	leaf = writeCertificate(t, m, []string{"vpn.example.com"}, now.Add(60*24*time.Hour))
+	if reason := m.renewalReason(leaf, now); reason != "*.vpn.example.com is not covered" {
+		t.Errorf("expected renewal for a missing domain, got %q", reason)
+	}
+}
+
+func TestDNSHookEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	m, err := New(Config{
+		Domains:   []string{"vpn.example.com"},
+		Challenge: ChallengeDNS01,
+		DNSHook:   `echo "$ACME_ACTION $ACME_DOMAIN $ACME_RECORD $ACME_VALUE" >> ` + out,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := m.runDNSHook(context.Background(), "present", "vpn.example.com", "_acme-challenge.vpn.example.com.", "digest"); err != nil {
+		t.Fatalf("hook failed: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook wrote nothing: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "present vpn.example.com _acme-challenge.vpn.example.com. digest" {
+		t.Errorf("unexpected hook environment %q", got)
+	}
+
+	m.cfg.DNSHook = "echo denied; exit 1"
+	if err := m.runDNSHook(context.Background(), "present", "vpn.example.com", "_acme-challenge.vpn.example.com.", "digest"); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("expected the hook's output in the error, got %v", err)
+	}
+}
+
+func TestAccountKeyPersists(t *testing.T) {
+	m, err := New(Config{Domains: []string{"vpn.example.com"}, StorageDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	first, err := m.accountKey()
+	if err != nil {
+		t.Fatalf("accountKey failed: %v", err)
+	}
+	second, err := m.accountKey()
+	if err != nil {
+		t.Fatalf("accountKey failed: %v", err)
+	}
+	if !first.(*ecdsa.PrivateKey).Equal(second) {
+		t.Error("expected the stored account key to be reused")
+	}
+	info, err := os.Stat(filepath.Join(m.cfg.StorageDir, AccountKeyFile))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the account key with mode 0600, got %v %v", info, err)
+	}
+}
+
+func TestNilManager(t *testing.T) {
+	var m *Manager
+	if m.Status() != nil {
+		t.Error("expected no status for a nil manager")
+	}
+	m.Stop()
+}
+
+// writeCertificate stores a self-signed certificate for domains as if it
+// had been issued, and returns its leaf
+func writeCertificate(t *testing.T, m *Manager, domains []string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := m.store([][]byte{der}, key)
+	if err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	return leaf
+}
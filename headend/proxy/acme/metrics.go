@@ -0,0 +1,12 @@
+package acme
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The certificate's expiry is exported by certreload once it's served
+var renewals = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "headend_acme_renewals_total",
+	Help: "Total attempts to obtain a certificate from the ACME server, by result.",
+}, []string{"result"})
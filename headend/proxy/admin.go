@@ -0,0 +1,304 @@
+// Admin API for operators of the headend.
+//
+// The /admin group exposes runtime state that the health check only
+// summarizes: active sessions, dynamic port listeners, firewall policy
+// versions, mirror counters, WireGuard peers and the sessions between them. It also offers the actions
+// operators otherwise need a shell or a signal for: closing sessions,
+// forcing a firewall refresh, lifting temporary blocks and draining. It is off by default and, when
+// enabled, requires admin.auth_token as a bearer token.
+//
+// Flow traces debug a single flow: an operator flags a user, optionally
+// with a destination, and the next matching flow records each stage of the
+// pipeline, retrieved from /admin/traces once it finishes.
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/tobogganing/headend/proxy/flowtrace"
+)
+
+// adminAuthRequired admits only requests carrying the admin token
+func (s *ProxyServer) adminAuthRequired(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	expected := viper.GetString("admin.auth_token")
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+// adminSessionsHandler lists active TCP, dynamic port and UDP sessions,
+// optionally only those of the user in the user query parameter
+func (s *ProxyServer) adminSessionsHandler(c *gin.Context) {
+	sessions := s.activeSessions.List(c.Query("user"))
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+		"total":    len(sessions),
+	})
+}
+
+// adminKillSessionHandler closes one session
+func (s *ProxyServer) adminKillSessionHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !s.activeSessions.Kill(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	log.Infof("Admin API closed session %s", id)
+	c.JSON(http.StatusOK, gin.H{"killed": 1})
+}
+
+// adminKillUserSessionsHandler closes every session of the user in the user
+// query parameter
+func (s *ProxyServer) adminKillUserSessionsHandler(c *gin.Context) {
+	userID := c.Query("user")
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user is required"})
+		return
+	}
+	killed := s.activeSessions.KillUser(userID)
+	log.Infof("Admin API closed %d sessions of user %s", killed, userID)
+	c.JSON(http.StatusOK, gin.H{"killed": killed})
+}
+
+// adminPortsHandler lists the dynamic port listeners and the outcome of the
+// last bind attempt of each configured port
+func (s *ProxyServer) adminPortsHandler(c *gin.Context) {
+	type listener struct {
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+		Active   bool   `json:"active"`
+	}
+
+	listeners := []listener{}
+	if s.portManager != nil {
+		for _, l := range s.portManager.GetActiveListeners() {
+			listeners = append(listeners, listener{Port: l.Port, Protocol: l.Protocol, Active: l.Active})
+		}
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		if listeners[i].Port != listeners[j].Port {
+			return listeners[i].Port < listeners[j].Port
+		}
+		return listeners[i].Protocol < listeners[j].Protocol
+	})
+
+	response := gin.H{
+		"enabled":   s.portManager != nil,
+		"listeners": listeners,
+	}
+	if s.portManager != nil {
+		response["status"] = s.portManager.Status()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// adminFirewallHandler reports the policy versions being served
+func (s *ProxyServer) adminFirewallHandler(c *gin.Context) {
+	if s.firewallManager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firewall is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, s.firewallStatus())
+}
+
+// adminFirewallRefreshHandler fetches rules from the Manager now. With
+// full=true the whole rule set is fetched instead of a delta.
+func (s *ProxyServer) adminFirewallRefreshHandler(c *gin.Context) {
+	if s.firewallManager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firewall is not enabled"})
+		return
+	}
+
+	full := c.Query("full") == "true"
+	if err := s.firewallManager.Refresh(full); err != nil {
+		log.Errorf("Admin API firewall refresh failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("Admin API refreshed firewall rules (full: %v), now at version %s",
+		full, s.firewallManager.GetPolicyVersion())
+	c.JSON(http.StatusOK, s.firewallStatus())
+}
+
+// adminFirewallBlocksHandler lists the temporary blocks in force, such as
+// those inserted for Suricata alerts
+func (s *ProxyServer) adminFirewallBlocksHandler(c *gin.Context) {
+	if s.firewallManager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firewall is not enabled"})
+		return
+	}
+	blocks := s.firewallManager.Blocks()
+	c.JSON(http.StatusOK, gin.H{
+		"blocks": blocks,
+		"total":  len(blocks),
+	})
+}
+
+// adminFirewallUnblockHandler lifts the temporary blocks of the user in the
+// user query parameter, only the one on target when that is given
+func (s *ProxyServer) adminFirewallUnblockHandler(c *gin.Context) {
+	if s.firewallManager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firewall is not enabled"})
+		return
+	}
+	userID := c.Query("user")
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user is required"})
+		return
+	}
+	lifted := s.firewallManager.Unblock(userID, c.Query("target"))
+	log.Infof("Admin API lifted %d temporary blocks of user %s", lifted, userID)
+	c.JSON(http.StatusOK, gin.H{"lifted": lifted})
+}
+
+func (s *ProxyServer) firewallStatus() gin.H {
+	return gin.H{
+		"policy_version": s.firewallManager.GetPolicyVersion(),
+		"policy_mode":    s.firewallManager.PolicyMode(),
+		"user_rules":     s.firewallManager.GetRulesCount(),
+		"rollouts":       s.firewallManager.GetRollouts(),
+		"last_update":    s.firewallManager.GetLastUpdateTime(),
+	}
+}
+
+// adminMirrorHandler reports the mirror's destinations and counters
+func (s *ProxyServer) adminMirrorHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": s.mirrorManager != nil,
+		"mirror":  s.mirrorManager.Status(),
+	})
+}
+
+// adminWireGuardHandler lists the WireGuard peers
+func (s *ProxyServer) adminWireGuardHandler(c *gin.Context) {
+	if s.wgMonitor == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+
+	response := gin.H{
+		"enabled": true,
+		"status":  s.wgMonitor.Status(),
+	}
+	if peers, err := s.wgMonitor.Peers(); err != nil {
+		response["peers_error"] = err.Error()
+	} else {
+		response["peers"] = peers
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// adminPeerSessionsHandler lists the client-to-client sessions routed
+// between WireGuard peers, with their original and source-translated
+// tuples, optionally only those of the user in the user query parameter
+func (s *ProxyServer) adminPeerSessionsHandler(c *gin.Context) {
+	if s.wgRouter == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":  true,
+		"open":     s.wgRouter.peerSessions.Len(),
+		"sessions": s.wgRouter.peerSessions.List(c.Query("user")),
+	})
+}
+
+// adminDrainHandler starts a drain, as SIGUSR1 does
+func (s *ProxyServer) adminDrainHandler(c *gin.Context) {
+	if !s.beginDrain() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Already draining", "drain": s.sessions.Status()})
+		return
+	}
+	log.Info("Admin API started a drain")
+	go s.waitForDrain()
+	c.JSON(http.StatusAccepted, gin.H{"drain": s.sessions.Status()})
+}
+
+// adminTelemetryHandler shows the telemetry report the current window would
+// produce, exactly as it would be sent
+func (s *ProxyServer) adminTelemetryHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": s.telemetry != nil,
+		"report":  s.telemetry.Preview(),
+	})
+}
+
+// adminArmTraceHandler flags the next flow of a user, to a destination if
+// one is given, for tracing. The body is {"user", "destination", "ttl"},
+// ttl being how long to wait for the flow, e.g. "10m".
+func (s *ProxyServer) adminArmTraceHandler(c *gin.Context) {
+	var body struct {
+		User        string `json:"user"`
+		Destination string `json:"destination"`
+		TTL         string `json:"ttl"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration"})
+			return
+		}
+	}
+
+	trace, err := s.flowTraces.Arm(body.User, body.Destination, ttl)
+	switch {
+	case errors.Is(err, flowtrace.ErrNoUser):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user is required"})
+		return
+	case errors.Is(err, flowtrace.ErrTooMany):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("Admin API armed flow trace %s for user %s to %q", trace.ID, trace.UserID, trace.Destination)
+	c.JSON(http.StatusCreated, trace)
+}
+
+// adminTracesHandler lists the armed, recording and finished flow traces
+func (s *ProxyServer) adminTracesHandler(c *gin.Context) {
+	traces := s.flowTraces.List()
+	c.JSON(http.StatusOK, gin.H{
+		"traces": traces,
+		"total":  len(traces),
+	})
+}
+
+// adminTraceHandler returns one flow trace
+func (s *ProxyServer) adminTraceHandler(c *gin.Context) {
+	trace, ok := s.flowTraces.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trace not found"})
+		return
+	}
+	c.JSON(http.StatusOK, trace)
+}
+
+// adminDeleteTraceHandler disarms a flow trace, or discards a recorded one
+func (s *ProxyServer) adminDeleteTraceHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !s.flowTraces.Delete(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trace not found"})
+		return
+	}
+	log.Infof("Admin API deleted flow trace %s", id)
+	c.JSON(http.StatusOK, gin.H{"deleted": 1})
+}
@@ -0,0 +1,153 @@
+// Client certificate identity binding for SASEWaddle dual authentication.
+//
+// Clients receive X.509 certificates from the Manager CA alongside their
+// JWTs. When the headend runs an mTLS listener, the TLS layer verifies the
+// certificate chain and this file checks that the certificate belongs to
+// the same identity as the token, so a stolen token can't be used from a
+// device holding someone else's certificate.
+package auth
+
+import (
+    "crypto/x509"
+    "fmt"
+    "os"
+    "time"
+)
+
+// LoadClientCAPool reads the PEM encoded CA certificates that client
+// certificates must chain to
+func LoadClientCAPool(caFile string) (*x509.CertPool, error) {
+    pemData, err := os.ReadFile(caFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read client CA file: %w", err)
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pemData) {
+        return nil, fmt.Errorf("no certificates found in client CA file %s", caFile)
+    }
+
+    return pool, nil
+}
+
+// CertificateIdentities returns every identity a certificate asserts: its
+// common name and its DNS, URI and email subject alternative names
+func CertificateIdentities(cert *x509.Certificate) []string {
+    identities := []string{}
+    if cert.Subject.CommonName != "" {
+        identities = append(identities, cert.Subject.CommonName)
+    }
+    identities = append(identities, cert.DNSNames...)
+    for _, uri := range cert.URIs {
+        identities = append(identities, uri.String())
+    }
+    identities = append(identities, cert.EmailAddresses...)
+    return identities
+}
+
+// BindCertificate checks that a verified client certificate names the same
+// identity as the authenticated user. Manager issued certificates carry
+// "<node_type>-<node_id>" as their common name, which matches the user name
+// derived from the JWT; the bare ID and email are accepted too.
+func BindCertificate(cert *x509.Certificate, user *User) error {
+    if cert == nil {
+        return fmt.Errorf("no client certificate presented")
+    }
+
+    for _, identity := range CertificateIdentities(cert) {
+        if identity == "" {
+            continue
+        }
+        if identity == user.ID || identity == user.Name || identity == user.Email {
+            return nil
+        }
+    }
+
+    return fmt.Errorf("client certificate %q does not belong to user %s", cert.Subject.CommonName, user.ID)
+}
+
+// CertVerifier verifies client certificates against the Manager CA like the
+// TLS layer does, except that a certificate which expired less than the
+// grace period ago is still accepted. Such clients are then restricted to
+// the remediation profile so they can reach the Manager and renew.
+type CertVerifier struct {
+    roots *x509.CertPool
+    grace time.Duration
+    now   func() time.Time
+}
+
+// NewCertVerifier creates a verifier accepting certificates up to grace
+// past their expiry
+func NewCertVerifier(roots *x509.CertPool, grace time.Duration) *CertVerifier {
+    return &CertVerifier{roots: roots, grace: grace, now: time.Now}
+}
+
+// Verify checks a presented chain, leaf first. It reports whether the leaf
+// is expired but within the grace period.
+func (v *CertVerifier) Verify(certs []*x509.Certificate) (expired bool, err error) {
+    if len(certs) == 0 {
+        return false, fmt.Errorf("no client certificate presented")
+    }
+
+    opts := x509.VerifyOptions{
+        Roots:         v.roots,
+        Intermediates: x509.NewCertPool(),
+        KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }
+    for _, cert := range certs[1:] {
+        opts.Intermediates.AddCert(cert)
+    }
+
+    leaf := certs[0]
+    now := v.now()
+    if _, err := leaf.Verify(opts); err == nil {
+        return false, nil
+    } else if !now.After(leaf.NotAfter) {
+        return false, err
+    }
+
+    if now.Sub(leaf.NotAfter) > v.grace {
+        return false, fmt.Errorf("client certificate %q expired at %s, past the %s grace period",
+            leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339), v.grace)
+    }
+
+    // Verify the chain as of the moment before expiry, so nothing but the
+    // expiry itself is forgiven
+    opts.CurrentTime = leaf.NotAfter
+    if _, err := leaf.Verify(opts); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// Expired reports whether a certificate that passed Verify has since
+// expired, and whether it is still within the grace period. Long-lived
+// connections are checked on every request with this.
+func (v *CertVerifier) Expired(cert *x509.Certificate) (expired, withinGrace bool) {
+    now := v.now()
+    if !now.After(cert.NotAfter) {
+        return false, true
+    }
+    return true, now.Sub(cert.NotAfter) <= v.grace
+}
+
+// VerifyPeerCertificate is the tls.Config hook for listeners that request
+// client certificates but leave their verification to the verifier
+func (v *CertVerifier) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+    if len(rawCerts) == 0 {
+        // Certificates are only required on authenticated routes
+        return nil
+    }
+
+    certs := make([]*x509.Certificate, 0, len(rawCerts))
+    for _, raw := range rawCerts {
+        cert, err := x509.ParseCertificate(raw)
+        if err != nil {
+            return fmt.Errorf("failed to parse client certificate: %w", err)
+        }
+        certs = append(certs, cert)
+    }
+
+    _, err := v.Verify(certs)
+    return err
+}
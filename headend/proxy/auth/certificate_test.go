@@ -0,0 +1,79 @@
+package auth
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "testing"
+    "time"
+)
+
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("failed to generate key: %v", err)
+    }
+    if parent == nil {
+        parent, parentKey = template, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+    if err != nil {
+        t.Fatalf("failed to create certificate: %v", err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatalf("failed to parse certificate: %v", err)
+    }
+    return cert, key
+}
+
+func TestCertVerifierGracePeriod(t *testing.T) {
+    now := time.Now()
+    ca, caKey := newTestCertificate(t, &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "Manager CA"},
+        NotBefore:             now.Add(-365 * 24 * time.Hour),
+        NotAfter:              now.Add(365 * 24 * time.Hour),
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageCertSign,
+    }, nil, nil)
+    leaf, _ := newTestCertificate(t, &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject:      pkix.Name{CommonName: "alice"},
+        NotBefore:    now.Add(-30 * 24 * time.Hour),
+        NotAfter:     now.Add(-time.Hour),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }, ca, caKey)
+
+    roots := x509.NewCertPool()
+    roots.AddCert(ca)
+
+    verifier := NewCertVerifier(roots, 24*time.Hour)
+    expired, err := verifier.Verify([]*x509.Certificate{leaf})
+    if err != nil || !expired {
+        t.Fatalf("expected an expired certificate within grace, got expired=%v err=%v", expired, err)
+    }
+    if expired, withinGrace := verifier.Expired(leaf); !expired || !withinGrace {
+        t.Errorf("expected expired within grace, got %v, %v", expired, withinGrace)
+    }
+
+    // Once the grace period has passed, the certificate is rejected
+    verifier.now = func() time.Time { return now.Add(48 * time.Hour) }
+    if _, err := verifier.Verify([]*x509.Certificate{leaf}); err == nil {
+        t.Error("expected an error past the grace period")
+    }
+    if _, withinGrace := verifier.Expired(leaf); withinGrace {
+        t.Error("expected the certificate to be past the grace period")
+    }
+
+    // Expiry is the only thing forgiven: an untrusted chain still fails
+    verifier = NewCertVerifier(x509.NewCertPool(), 24*time.Hour)
+    if _, err := verifier.Verify([]*x509.Certificate{leaf}); err == nil {
+        t.Error("expected an error for a certificate from an unknown CA")
+    }
+}
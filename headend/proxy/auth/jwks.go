@@ -0,0 +1,200 @@
+// JWKS key set handling for SASEWaddle headend JWT validation.
+//
+// The Manager publishes its signing keys as a JSON Web Key Set. Keys are
+// selected by the token's kid header; when the Manager rotates, the new
+// key is picked up on the next refresh and the old one keeps validating
+// for a grace period so tokens issued before the rotation stay usable
+// until they expire.
+package auth
+
+import (
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math/big"
+    "sort"
+    "sync"
+    "time"
+)
+
+// jwk is the subset of RFC 7517 fields used for RSA signing keys
+type jwk struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    Alg string `json:"alg"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+}
+
+// parseJWKS returns the RSA signing keys in a JWKS document by kid, in the
+// order they were published. Keys without a kid are named by their RFC
+// 7638 thumbprint; non-RSA and encryption keys are skipped.
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, []string, error) {
+    var set struct {
+        Keys []jwk `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &set); err != nil {
+        return nil, nil, fmt.Errorf("failed to parse JWKS: %w", err)
+    }
+
+    keys := make(map[string]*rsa.PublicKey)
+    order := []string{}
+    for _, k := range set.Keys {
+        if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+            continue
+        }
+        key, err := k.rsaPublicKey()
+        if err != nil {
+            return nil, nil, fmt.Errorf("invalid key %q: %w", k.Kid, err)
+        }
+        kid := k.Kid
+        if kid == "" {
+            kid = keyThumbprint(key)
+        }
+        if _, dup := keys[kid]; !dup {
+            order = append(order, kid)
+        }
+        keys[kid] = key
+    }
+
+    if len(keys) == 0 {
+        return nil, nil, fmt.Errorf("JWKS contains no RSA signing keys")
+    }
+    return keys, order, nil
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+    n, err := base64.RawURLEncoding.DecodeString(k.N)
+    if err != nil || len(n) == 0 {
+        return nil, fmt.Errorf("invalid modulus")
+    }
+    e, err := base64.RawURLEncoding.DecodeString(k.E)
+    if err != nil || len(e) == 0 || len(e) > 4 {
+        return nil, fmt.Errorf("invalid exponent")
+    }
+
+    exponent := int(new(big.Int).SetBytes(e).Int64())
+    if exponent < 3 {
+        return nil, fmt.Errorf("invalid exponent")
+    }
+    return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+}
+
+// keyThumbprint returns the RFC 7638 thumbprint of an RSA key, which the
+// Manager uses as its kid
+func keyThumbprint(key *rsa.PublicKey) string {
+    e := big.NewInt(int64(key.E)).Bytes()
+    canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+        base64.RawURLEncoding.EncodeToString(e),
+        base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+    sum := sha256.Sum256([]byte(canonical))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// keyEntry is a verification key. retireAt is zero while the Manager still
+// publishes the key and set to the end of its grace period once it stops.
+type keyEntry struct {
+    key      *rsa.PublicKey
+    added    time.Time
+    retireAt time.Time
+}
+
+func (e *keyEntry) valid(now time.Time) bool {
+    return e.retireAt.IsZero() || now.Before(e.retireAt)
+}
+
+// keySet holds the keys tokens may be signed with
+type keySet struct {
+    keys    map[string]*keyEntry
+    current string
+    mu      sync.RWMutex
+}
+
+func newKeySet() *keySet {
+    return &keySet{keys: make(map[string]*keyEntry)}
+}
+
+// update replaces the published keys. Keys that are no longer published
+// stay valid for grace, then are dropped; a retired key that reappears is
+// reinstated. It returns how many keys were added and retired.
+func (ks *keySet) update(keys map[string]*rsa.PublicKey, order []string, grace time.Duration, now time.Time) (added, retired int) {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+
+    for kid, key := range keys {
+        entry, ok := ks.keys[kid]
+        if !ok {
+            ks.keys[kid] = &keyEntry{key: key, added: now}
+            added++
+            continue
+        }
+        entry.key = key
+        entry.retireAt = time.Time{}
+    }
+
+    for kid, entry := range ks.keys {
+        if _, published := keys[kid]; published {
+            continue
+        }
+        if entry.retireAt.IsZero() {
+            entry.retireAt = now.Add(grace)
+            retired++
+        }
+        if !entry.valid(now) {
+            delete(ks.keys, kid)
+        }
+    }
+
+    if len(order) > 0 {
+        ks.current = order[0]
+    }
+    return added, retired
+}
+
+// lookup returns the key for kid if it is still valid
+func (ks *keySet) lookup(kid string, now time.Time) (*rsa.PublicKey, bool) {
+    ks.mu.RLock()
+    defer ks.mu.RUnlock()
+
+    entry, ok := ks.keys[kid]
+    if !ok || !entry.valid(now) {
+        return nil, false
+    }
+    return entry.key, true
+}
+
+// candidates returns every valid key, current key first and then newest to
+// oldest, for tokens that carry no kid
+func (ks *keySet) candidates(now time.Time) []*rsa.PublicKey {
+    ks.mu.RLock()
+    defer ks.mu.RUnlock()
+
+    kids := make([]string, 0, len(ks.keys))
+    for kid, entry := range ks.keys {
+        if entry.valid(now) {
+            kids = append(kids, kid)
+        }
+    }
+    sort.Slice(kids, func(i, j int) bool {
+        if kids[i] == ks.current || kids[j] == ks.current {
+            return kids[i] == ks.current
+        }
+        return ks.keys[kids[i]].added.After(ks.keys[kids[j]].added)
+    })
+
+    keys := make([]*rsa.PublicKey, 0, len(kids))
+    for _, kid := range kids {
+        keys = append(keys, ks.keys[kid].key)
+    }
+    return keys
+}
+
+// size returns the number of keys held, including those in their grace period
+func (ks *keySet) size() int {
+    ks.mu.RLock()
+    defer ks.mu.RUnlock()
+    return len(ks.keys)
+}
@@ -3,6 +3,7 @@
 // This file implements JWT (JSON Web Token) based authentication using RSA
 // public key cryptography for secure token validation. Features include:
 // - RSA public key validation with automatic key rotation
+// - JWKS key sets with kid-based key selection and a rotation grace period
 // - Manager service integration for public key retrieval
 // - Token expiration and signature validation
 // - User claim extraction and role assignment
@@ -20,6 +21,7 @@ import (
     "io"
     "net/http"
     "strings"
+    "sync"
     "time"
 
     "github.com/gin-gonic/gin"
@@ -27,39 +29,169 @@ import (
     log "github.com/sirupsen/logrus"
 )
 
+// Default JWKS timings. The grace period matches the Manager's access token
+// lifetime so every token signed before a rotation can still be used.
+const (
+    DefaultJWKSRefreshInterval = 15 * time.Minute
+    DefaultJWKSGracePeriod     = 24 * time.Hour
+
+    // unknownKidRefreshInterval limits how often a token with an unknown
+    // kid can force a key refresh, so forged kids can't hammer the Manager
+    unknownKidRefreshInterval = 30 * time.Second
+)
+
+// JWTConfig configures the JWT provider
+type JWTConfig struct {
+    ManagerURL    string
+    PublicKeyPath string
+    // JWKSURL is where signing keys are published. Defaults to the
+    // Manager's /.well-known/jwks.json; the legacy single public key
+    // endpoint is used if the Manager doesn't serve a key set.
+    JWKSURL         string
+    RefreshInterval time.Duration
+    GracePeriod     time.Duration
+}
+
 // JWTProvider implements JWT-based authentication for the headend proxy
 type JWTProvider struct {
-    managerURL    string
-    publicKey     *rsa.PublicKey
-    publicKeyPEM  []byte
-    client        *http.Client
-    lastKeyFetch  time.Time
+    managerURL      string
+    jwksURL         string
+    keys            *keySet
+    client          *http.Client
+    refreshInterval time.Duration
+    gracePeriod     time.Duration
+    lastKeyFetch    time.Time
+    fetchMu         sync.Mutex
+    static          bool
 }
 
 // NewJWTProvider creates a new JWT authentication provider
 func NewJWTProvider(managerURL, publicKeyPath string) (Provider, error) {
+    return NewJWTProviderWithConfig(JWTConfig{
+        ManagerURL:    managerURL,
+        PublicKeyPath: publicKeyPath,
+    })
+}
+
+// NewJWTProviderWithConfig creates a JWT provider that keeps its signing
+// keys in sync with the Manager's key set
+func NewJWTProviderWithConfig(cfg JWTConfig) (Provider, error) {
+    if cfg.JWKSURL == "" {
+        cfg.JWKSURL = strings.TrimRight(cfg.ManagerURL, "/") + "/.well-known/jwks.json"
+    }
+    if cfg.RefreshInterval <= 0 {
+        cfg.RefreshInterval = DefaultJWKSRefreshInterval
+    }
+    if cfg.GracePeriod <= 0 {
+        cfg.GracePeriod = DefaultJWKSGracePeriod
+    }
+
     provider := &JWTProvider{
-        managerURL: managerURL,
+        managerURL:      cfg.ManagerURL,
+        jwksURL:         cfg.JWKSURL,
+        keys:            newKeySet(),
+        refreshInterval: cfg.RefreshInterval,
+        gracePeriod:     cfg.GracePeriod,
         client: &http.Client{
             Timeout: 30 * time.Second,
         },
     }
     
-    // Fetch public key from manager
-    if err := provider.fetchPublicKey(); err != nil {
+    // Fetch signing keys from manager
+    if err := provider.refreshKeys(); err != nil {
         return nil, fmt.Errorf("failed to fetch public key: %w", err)
     }
     
+    go provider.refreshLoop()
+    
     log.Info("JWT provider initialized successfully")
     return provider, nil
 }
 
-func (j *JWTProvider) fetchPublicKey() error {
+// NewJWTProviderWithKey creates a JWT provider that validates tokens against
+// a fixed public key rather than one fetched from the Manager
+func NewJWTProviderWithKey(publicKey *rsa.PublicKey) Provider {
+    provider := &JWTProvider{
+        keys:   newKeySet(),
+        static: true,
+        client: &http.Client{
+            Timeout: 30 * time.Second,
+        },
+    }
+    kid := keyThumbprint(publicKey)
+    provider.keys.update(map[string]*rsa.PublicKey{kid: publicKey}, []string{kid}, 0, time.Now())
+    return provider
+}
+
+// refreshLoop keeps the key set current so rotations are picked up
+// without waiting for a token signed with the new key
+func (j *JWTProvider) refreshLoop() {
+    ticker := time.NewTicker(j.refreshInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        if err := j.refreshKeys(); err != nil {
+            log.Warnf("Failed to refresh JWT signing keys: %v", err)
+        }
+    }
+}
+
+// refreshKeys fetches the Manager's key set, falling back to the legacy
+// single public key endpoint for Managers that don't publish one
+func (j *JWTProvider) refreshKeys() error {
+    j.fetchMu.Lock()
+    defer j.fetchMu.Unlock()
+    return j.refreshKeysLocked()
+}
+
+func (j *JWTProvider) refreshKeysLocked() error {
+    keys, order, err := j.fetchJWKS()
+    if err != nil {
+        log.Debugf("JWKS unavailable, using public key endpoint: %v", err)
+        publicKey, legacyErr := j.fetchPublicKey()
+        if legacyErr != nil {
+            return fmt.Errorf("%v; %w", err, legacyErr)
+        }
+        kid := keyThumbprint(publicKey)
+        keys, order = map[string]*rsa.PublicKey{kid: publicKey}, []string{kid}
+    }
+
+    j.lastKeyFetch = time.Now()
+    added, retired := j.keys.update(keys, order, j.gracePeriod, j.lastKeyFetch)
+    if added > 0 || retired > 0 {
+        log.Infof("JWT signing keys updated: %d added, %d retired, %d held", added, retired, j.keys.size())
+    }
+    return nil
+}
+
+func (j *JWTProvider) fetchJWKS() (map[string]*rsa.PublicKey, []string, error) {
+    resp, err := j.client.Get(j.jwksURL)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+    }
+    defer func() {
+        if err := resp.Body.Close(); err != nil {
+            log.Warnf("Failed to close response body: %v", err)
+        }
+    }()
+    
+    if resp.StatusCode != http.StatusOK {
+        return nil, nil, fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+    }
+    
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to read JWKS: %w", err)
+    }
+    return parseJWKS(body)
+}
+
+func (j *JWTProvider) fetchPublicKey() (*rsa.PublicKey, error) {
     url := j.managerURL + "/api/v1/auth/public-key"
     
     resp, err := j.client.Get(url)
     if err != nil {
-        return fmt.Errorf("failed to fetch public key: %w", err)
+        return nil, fmt.Errorf("failed to fetch public key: %w", err)
     }
     defer func() {
         if err := resp.Body.Close(); err != nil {
@@ -68,12 +200,12 @@ func (j *JWTProvider) fetchPublicKey() error {
     }()
     
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("manager returned status %d", resp.StatusCode)
+        return nil, fmt.Errorf("manager returned status %d", resp.StatusCode)
     }
     
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        return fmt.Errorf("failed to read response: %w", err)
+        return nil, fmt.Errorf("failed to read response: %w", err)
     }
     
     var keyResponse struct {
@@ -82,38 +214,64 @@ func (j *JWTProvider) fetchPublicKey() error {
     }
     
     if err := json.Unmarshal(body, &keyResponse); err != nil {
-        return fmt.Errorf("failed to parse response: %w", err)
+        return nil, fmt.Errorf("failed to parse response: %w", err)
     }
     
     // Parse the RSA public key
     publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(keyResponse.PublicKey))
     if err != nil {
-        return fmt.Errorf("failed to parse RSA public key: %w", err)
+        return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
     }
     
-    j.publicKey = publicKey
-    j.publicKeyPEM = []byte(keyResponse.PublicKey)
-    j.lastKeyFetch = time.Now()
-    
-    log.Info("Successfully fetched public key from manager")
-    return nil
+    return publicKey, nil
 }
 
-func (j *JWTProvider) ValidateToken(tokenString string) (*User, error) {
-    // Refresh public key periodically
-    if time.Since(j.lastKeyFetch) > 1*time.Hour {
-        if err := j.fetchPublicKey(); err != nil {
-            log.Warnf("Failed to refresh public key: %v", err)
+// verificationKey picks the key for a token. A kid the headend hasn't seen
+// usually means the Manager just rotated, so it triggers an early refresh;
+// tokens without a kid are tried against every valid key.
+func (j *JWTProvider) verificationKey(kid string) (interface{}, error) {
+    now := time.Now()
+    if kid == "" {
+        keys := j.keys.candidates(now)
+        if len(keys) == 0 {
+            return nil, fmt.Errorf("no valid signing keys")
+        }
+        set := jwt.VerificationKeySet{}
+        for _, key := range keys {
+            set.Keys = append(set.Keys, key)
         }
+        return set, nil
     }
-    
+
+    if key, ok := j.keys.lookup(kid, now); ok {
+        return key, nil
+    }
+
+    if !j.static {
+        j.fetchMu.Lock()
+        if time.Since(j.lastKeyFetch) >= unknownKidRefreshInterval {
+            if err := j.refreshKeysLocked(); err != nil {
+                log.Warnf("Failed to refresh JWT signing keys for kid %q: %v", kid, err)
+            }
+        }
+        j.fetchMu.Unlock()
+
+        if key, ok := j.keys.lookup(kid, time.Now()); ok {
+            return key, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (j *JWTProvider) ValidateToken(tokenString string) (*User, error) {
     // Parse and validate the token
     token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
         // Validate signing method
         if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
             return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
         }
-        return j.publicKey, nil
+        kid, _ := token.Header["kid"].(string)
+        return j.verificationKey(kid)
     })
     
     if err != nil {
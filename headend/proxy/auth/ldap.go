@@ -0,0 +1,423 @@
+//go:build !minimal
+
+// LDAP/Active Directory authentication for SASEWaddle headend proxy.
+//
+// This file implements bind authentication against an LDAP directory for
+// enterprises without an identity provider. Features include:
+// - User lookup with a service account (or anonymous) search
+// - Password verification by binding as the user's DN
+// - Group extraction from memberOf or a separate group search
+// - LDAPS and StartTLS transport security
+// - Headend-signed session tokens so proxied requests don't rebind
+//
+// Clients POST their username and password to /auth/login and receive a
+// bearer token that the proxy validates locally until it expires.
+package auth
+
+import (
+    "crypto/tls"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/go-ldap/ldap/v3"
+    "github.com/golang-jwt/jwt/v5"
+    log "github.com/sirupsen/logrus"
+)
+
+func init() {
+    Register("ldap", func(s Settings) (Provider, error) {
+        return NewLDAPProvider(LDAPConfig{
+            URL:                s.GetString("ldap.url"),
+            StartTLS:           s.GetBool("ldap.start_tls"),
+            InsecureSkipVerify: s.GetBool("ldap.insecure_skip_verify"),
+            BindDN:             s.GetString("ldap.bind_dn"),
+            BindPassword:       s.GetString("ldap.bind_password"),
+            BaseDN:             s.GetString("ldap.base_dn"),
+            UserFilter:         s.GetString("ldap.user_filter"),
+            IDAttribute:        s.GetString("ldap.id_attribute"),
+            NameAttribute:      s.GetString("ldap.name_attribute"),
+            EmailAttribute:     s.GetString("ldap.email_attribute"),
+            GroupAttribute:     s.GetString("ldap.group_attribute"),
+            GroupBaseDN:        s.GetString("ldap.group_base_dn"),
+            GroupFilter:        s.GetString("ldap.group_filter"),
+            SessionSecret:      s.GetString("ldap.session_secret"),
+            SessionTTL:         s.GetDuration("ldap.session_ttl"),
+            Timeout:            s.GetDuration("ldap.timeout"),
+        })
+    })
+}
+
+// ldapSessionIssuer marks session tokens issued by the LDAP provider
+const ldapSessionIssuer = "sasewaddle-headend-ldap"
+
+// LDAPConfig configures the LDAP provider. UserFilter and GroupFilter
+// contain a single %s, replaced by the escaped username and user DN.
+type LDAPConfig struct {
+    URL                string
+    StartTLS           bool
+    InsecureSkipVerify bool
+    BindDN             string
+    BindPassword       string
+    BaseDN             string
+    UserFilter         string
+    IDAttribute        string
+    NameAttribute      string
+    EmailAttribute     string
+    GroupAttribute     string
+    GroupBaseDN        string
+    GroupFilter        string
+    SessionSecret      string
+    SessionTTL         time.Duration
+    Timeout            time.Duration
+}
+
+// LDAPProvider implements bind authentication against an LDAP directory
+type LDAPProvider struct {
+    config LDAPConfig
+    secret []byte
+}
+
+// NewLDAPProvider creates an LDAP provider and checks the directory is
+// reachable with the configured service account
+func NewLDAPProvider(cfg LDAPConfig) (Provider, error) {
+    if cfg.URL == "" || cfg.BaseDN == "" {
+        return nil, fmt.Errorf("ldap url and base_dn are required")
+    }
+    if len(cfg.SessionSecret) < 32 {
+        return nil, fmt.Errorf("ldap session_secret must be at least 32 characters")
+    }
+    if cfg.UserFilter == "" {
+        cfg.UserFilter = "(uid=%s)"
+    }
+    if cfg.IDAttribute == "" {
+        cfg.IDAttribute = "uid"
+    }
+    if cfg.NameAttribute == "" {
+        cfg.NameAttribute = "cn"
+    }
+    if cfg.EmailAttribute == "" {
+        cfg.EmailAttribute = "mail"
+    }
+    if cfg.GroupAttribute == "" {
+        cfg.GroupAttribute = "memberOf"
+    }
+    if cfg.GroupBaseDN == "" {
+        cfg.GroupBaseDN = cfg.BaseDN
+    }
+    if cfg.SessionTTL <= 0 {
+        cfg.SessionTTL = 8 * time.Hour
+    }
+    if cfg.Timeout <= 0 {
+        cfg.Timeout = 10 * time.Second
+    }
+
+    provider := &LDAPProvider{
+        config: cfg,
+        secret: []byte(cfg.SessionSecret),
+    }
+
+    conn, err := provider.connect()
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+    }
+    defer conn.Close()
+
+    if err := provider.serviceBind(conn); err != nil {
+        return nil, err
+    }
+
+    log.Infof("LDAP provider initialized for %s", cfg.URL)
+    return provider, nil
+}
+
+// connect dials the directory, upgrading to TLS with StartTLS if configured
+func (p *LDAPProvider) connect() (*ldap.Conn, error) {
+    tlsConfig := &tls.Config{
+        InsecureSkipVerify: p.config.InsecureSkipVerify, // #nosec G402 -- opt-in for lab directories
+        MinVersion:         tls.VersionTLS12,
+    }
+
+    conn, err := ldap.DialURL(p.config.URL,
+        ldap.DialWithDialer(&net.Dialer{Timeout: p.config.Timeout}),
+        ldap.DialWithTLSConfig(tlsConfig),
+    )
+    if err != nil {
+        return nil, err
+    }
+    conn.SetTimeout(p.config.Timeout)
+
+    if p.config.StartTLS {
+        if err := conn.StartTLS(tlsConfig); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("StartTLS failed: %w", err)
+        }
+    }
+
+    return conn, nil
+}
+
+// serviceBind binds as the service account, or stays anonymous without one
+func (p *LDAPProvider) serviceBind(conn *ldap.Conn) error {
+    if p.config.BindDN == "" {
+        return nil
+    }
+    if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+        return fmt.Errorf("LDAP service bind failed: %w", err)
+    }
+    return nil
+}
+
+// Authenticate verifies a username and password by binding as the user
+// and returns the user with their groups
+func (p *LDAPProvider) Authenticate(username, password string) (*User, error) {
+    // An empty password would be an unauthenticated bind, which many
+    // directories accept for any DN
+    if username == "" || password == "" {
+        return nil, fmt.Errorf("username and password required")
+    }
+
+    conn, err := p.connect()
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+    }
+    defer conn.Close()
+
+    if err := p.serviceBind(conn); err != nil {
+        return nil, err
+    }
+
+    result, err := conn.Search(ldap.NewSearchRequest(
+        p.config.BaseDN,
+        ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.config.Timeout.Seconds()), false,
+        fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(username)),
+        []string{p.config.IDAttribute, p.config.NameAttribute, p.config.EmailAttribute, p.config.GroupAttribute},
+        nil,
+    ))
+    if err != nil {
+        return nil, fmt.Errorf("LDAP user search failed: %w", err)
+    }
+    if len(result.Entries) != 1 {
+        return nil, fmt.Errorf("invalid credentials")
+    }
+    entry := result.Entries[0]
+
+    if err := conn.Bind(entry.DN, password); err != nil {
+        return nil, fmt.Errorf("invalid credentials")
+    }
+
+    groups := []string{}
+    for _, groupDN := range entry.GetAttributeValues(p.config.GroupAttribute) {
+        groups = append(groups, groupName(groupDN))
+    }
+
+    if p.config.GroupFilter != "" {
+        // Group membership may not be readable as the user
+        if err := p.serviceBind(conn); err != nil {
+            return nil, err
+        }
+        searched, err := p.searchGroups(conn, entry.DN)
+        if err != nil {
+            return nil, err
+        }
+        groups = appendUnique(groups, searched...)
+    }
+
+    id := entry.GetAttributeValue(p.config.IDAttribute)
+    if id == "" {
+        id = username
+    }
+
+    return &User{
+        ID:     id,
+        Name:   entry.GetAttributeValue(p.config.NameAttribute),
+        Email:  entry.GetAttributeValue(p.config.EmailAttribute),
+        Groups: groups,
+        Metadata: map[string]interface{}{
+            "provider": "ldap",
+            "dn":       entry.DN,
+        },
+    }, nil
+}
+
+// searchGroups finds groups listing the user as a member, for directories
+// without memberOf
+func (p *LDAPProvider) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+    result, err := conn.Search(ldap.NewSearchRequest(
+        p.config.GroupBaseDN,
+        ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(p.config.Timeout.Seconds()), false,
+        fmt.Sprintf(p.config.GroupFilter, ldap.EscapeFilter(userDN)),
+        []string{"cn"},
+        nil,
+    ))
+    if err != nil {
+        return nil, fmt.Errorf("LDAP group search failed: %w", err)
+    }
+
+    groups := []string{}
+    for _, entry := range result.Entries {
+        name := entry.GetAttributeValue("cn")
+        if name == "" {
+            name = groupName(entry.DN)
+        }
+        groups = append(groups, name)
+    }
+    return groups, nil
+}
+
+// groupName returns the common name of a group DN, or the DN itself if it
+// has no CN
+func groupName(dn string) string {
+    parsed, err := ldap.ParseDN(dn)
+    if err != nil || len(parsed.RDNs) == 0 {
+        return dn
+    }
+    for _, attr := range parsed.RDNs[0].Attributes {
+        if strings.EqualFold(attr.Type, "cn") {
+            return attr.Value
+        }
+    }
+    return dn
+}
+
+func appendUnique(list []string, values ...string) []string {
+    for _, v := range values {
+        found := false
+        for _, existing := range list {
+            if existing == v {
+                found = true
+                break
+            }
+        }
+        if !found {
+            list = append(list, v)
+        }
+    }
+    return list
+}
+
+// issueSession signs a session token for an authenticated user
+func (p *LDAPProvider) issueSession(user *User) (string, error) {
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+        "iss":    ldapSessionIssuer,
+        "sub":    user.ID,
+        "name":   user.Name,
+        "email":  user.Email,
+        "groups": user.Groups,
+        "dn":     user.Metadata["dn"],
+        "iat":    time.Now().Unix(),
+        "exp":    time.Now().Add(p.config.SessionTTL).Unix(),
+    })
+    return token.SignedString(p.secret)
+}
+
+func (p *LDAPProvider) LoginHandler() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var creds struct {
+            Username string `json:"username" form:"username"`
+            Password string `json:"password" form:"password"`
+        }
+        if err := c.ShouldBind(&creds); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "username and password required"})
+            return
+        }
+
+        user, err := p.Authenticate(creds.Username, creds.Password)
+        if err != nil {
+            log.Warnf("LDAP login failed for %s from %s: %v", creds.Username, c.ClientIP(), err)
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication failed"})
+            return
+        }
+
+        tokenString, err := p.issueSession(user)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+            return
+        }
+
+        log.Infof("LDAP login succeeded for %s", user.ID)
+        maxAge := int(p.config.SessionTTL.Seconds())
+        c.SetCookie("session_token", tokenString, maxAge, "/", "", true, true)
+        c.JSON(http.StatusOK, gin.H{
+            "access_token": tokenString,
+            "token_type":   "Bearer",
+            "expires_in":   maxAge,
+        })
+    }
+}
+
+func (p *LDAPProvider) CallbackHandler() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        // LDAP logins complete in LoginHandler; there is no redirect flow
+        c.JSON(http.StatusOK, gin.H{"message": "LDAP callback not required"})
+    }
+}
+
+func (p *LDAPProvider) LogoutHandler() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.SetCookie("session_token", "", -1, "/", "", true, true)
+        c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+    }
+}
+
+func (p *LDAPProvider) ValidateToken(tokenString string) (*User, error) {
+    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        }
+        return p.secret, nil
+    }, jwt.WithIssuer(ldapSessionIssuer), jwt.WithExpirationRequired())
+
+    if err != nil {
+        return nil, fmt.Errorf("token validation failed: %w", err)
+    }
+
+    claims, ok := token.Claims.(jwt.MapClaims)
+    if !ok || !token.Valid {
+        return nil, fmt.Errorf("invalid token")
+    }
+
+    groups := []string{}
+    if g, ok := claims["groups"].([]interface{}); ok {
+        for _, group := range g {
+            if s, ok := group.(string); ok {
+                groups = append(groups, s)
+            }
+        }
+    }
+
+    id, _ := claims["sub"].(string)
+    name, _ := claims["name"].(string)
+    email, _ := claims["email"].(string)
+    dn, _ := claims["dn"].(string)
+    if id == "" {
+        return nil, fmt.Errorf("token has no subject")
+    }
+
+    return &User{
+        ID:     id,
+        Name:   name,
+        Email:  email,
+        Groups: groups,
+        Metadata: map[string]interface{}{
+            "provider": "ldap",
+            "dn":       dn,
+        },
+    }, nil
+}
+
+func (p *LDAPProvider) GetUser(c *gin.Context) (*User, error) {
+    authHeader := c.GetHeader("Authorization")
+    if strings.HasPrefix(authHeader, "Bearer ") {
+        return p.ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+    }
+
+    cookie, err := c.Cookie("session_token")
+    if err != nil {
+        return nil, fmt.Errorf("no authentication found")
+    }
+    return p.ValidateToken(cookie)
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var authValidationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+    Name:    "headend_auth_validation_seconds",
+    Help:    "Time taken to validate a token, by provider and result (ok, invalid).",
+    Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"provider", "result"})
+
+// instrumentedProvider times token validation for the provider registered
+// under name
+type instrumentedProvider struct {
+    Provider
+    name string
+}
+
+// instrumentedDeviceProvider keeps the device authorization grant of the
+// providers that support it
+type instrumentedDeviceProvider struct {
+    *instrumentedProvider
+    DeviceAuthorizer
+}
+
+// instrument wraps provider so its token validations are timed
+func instrument(name string, provider Provider) Provider {
+    wrapped := &instrumentedProvider{Provider: provider, name: name}
+    if device, ok := provider.(DeviceAuthorizer); ok {
+        return &instrumentedDeviceProvider{instrumentedProvider: wrapped, DeviceAuthorizer: device}
+    }
+    return wrapped
+}
+
+// ValidateToken implements Provider
+func (p *instrumentedProvider) ValidateToken(token string) (*User, error) {
+    start := time.Now()
+    user, err := p.Provider.ValidateToken(token)
+
+    result := "ok"
+    if err != nil {
+        result = "invalid"
+    }
+    authValidationDuration.WithLabelValues(p.name, result).Observe(time.Since(start).Seconds())
+    return user, err
+}
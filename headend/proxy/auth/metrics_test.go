@@ -0,0 +1,47 @@
+package auth
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+type stubProvider struct{}
+
+func (stubProvider) LoginHandler() gin.HandlerFunc    { return nil }
+func (stubProvider) CallbackHandler() gin.HandlerFunc { return nil }
+func (stubProvider) LogoutHandler() gin.HandlerFunc   { return nil }
+func (stubProvider) GetUser(*gin.Context) (*User, error) {
+    return nil, errors.New("not implemented")
+}
+
+func (stubProvider) ValidateToken(token string) (*User, error) {
+    if token != "good" {
+        return nil, errors.New("invalid token")
+    }
+    return &User{ID: "alice"}, nil
+}
+
+type stubDeviceProvider struct{ stubProvider }
+
+func (stubDeviceProvider) DeviceAuthHandler() gin.HandlerFunc  { return nil }
+func (stubDeviceProvider) DeviceTokenHandler() gin.HandlerFunc { return nil }
+
+func TestInstrumentKeepsProviderBehaviour(t *testing.T) {
+    provider := instrument("stub", stubProvider{})
+    if user, err := provider.ValidateToken("good"); err != nil || user.ID != "alice" {
+        t.Errorf("ValidateToken(good) = %+v, %v", user, err)
+    }
+    if _, err := provider.ValidateToken("bad"); err == nil {
+        t.Error("expected an invalid token to be rejected")
+    }
+    if _, ok := provider.(DeviceAuthorizer); ok {
+        t.Error("provider without the device grant gained it")
+    }
+
+    // The device authorization grant must survive instrumentation
+    if _, ok := instrument("stub", stubDeviceProvider{}).(DeviceAuthorizer); !ok {
+        t.Error("instrumented provider lost the device authorization grant")
+    }
+}
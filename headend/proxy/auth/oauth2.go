@@ -1,9 +1,15 @@
+//go:build !minimal
+
 package auth
 
 import (
     "context"
+    "encoding/json"
+    "errors"
     "fmt"
+    "io"
     "net/http"
+    "net/url"
     "strings"
     "time"
 
@@ -13,10 +19,31 @@ import (
     "golang.org/x/oauth2"
 )
 
+func init() {
+    Register("oauth2", func(s Settings) (Provider, error) {
+        provider, err := NewOAuth2Provider(
+            s.GetString("oauth2.issuer"),
+            s.GetString("oauth2.client_id"),
+            s.GetString("oauth2.client_secret"),
+        )
+        if err != nil {
+            return nil, err
+        }
+        return provider, nil
+    })
+}
+
+// deviceCodeGrantType is the RFC 8628 grant used to poll for device tokens
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// sessionTTL is the lifetime of the session tokens issued after sign-in
+const sessionTTL = 24 * time.Hour
+
 type OAuth2Provider struct {
     config       *oauth2.Config
     oidcProvider *oidc.Provider
     verifier     *oidc.IDTokenVerifier
+    client       *http.Client
     issuer       string
     clientID     string
 }
@@ -45,6 +72,7 @@ func NewOAuth2Provider(issuer, clientID, clientSecret string) (*OAuth2Provider,
         config:       config,
         oidcProvider: provider,
         verifier:     verifier,
+        client:       &http.Client{Timeout: 15 * time.Second},
         issuer:       issuer,
         clientID:     clientID,
     }, nil
@@ -92,42 +120,163 @@ func (p *OAuth2Provider) CallbackHandler() gin.HandlerFunc {
             return
         }
         
-        idToken, err := p.verifier.Verify(ctx, rawIDToken)
+        tokenString, err := p.sessionFromIDToken(ctx, rawIDToken)
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify id_token"})
+            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
             return
         }
         
-        var claims struct {
-            Email    string   `json:"email"`
-            Name     string   `json:"name"`
-            Subject  string   `json:"sub"`
-            Groups   []string `json:"groups"`
-            Verified bool     `json:"email_verified"`
+        c.SetCookie("session_token", tokenString, 86400, "/", "", true, true)
+        c.Redirect(http.StatusTemporaryRedirect, "/")
+    }
+}
+
+// sessionFromIDToken verifies an ID token from the identity provider and
+// issues the headend session token for the user it names
+func (p *OAuth2Provider) sessionFromIDToken(ctx context.Context, rawIDToken string) (string, error) {
+    idToken, err := p.verifier.Verify(ctx, rawIDToken)
+    if err != nil {
+        return "", errors.New("failed to verify id_token")
+    }
+    
+    var claims struct {
+        Email    string   `json:"email"`
+        Name     string   `json:"name"`
+        Subject  string   `json:"sub"`
+        Groups   []string `json:"groups"`
+        Verified bool     `json:"email_verified"`
+    }
+    
+    if err := idToken.Claims(&claims); err != nil {
+        return "", errors.New("failed to parse claims")
+    }
+    
+    // Create session token
+    sessionToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+        "sub":    claims.Subject,
+        "email":  claims.Email,
+        "name":   claims.Name,
+        "groups": claims.Groups,
+        "exp":    time.Now().Add(sessionTTL).Unix(),
+    })
+    
+    tokenString, err := sessionToken.SignedString([]byte(p.clientID))
+    if err != nil {
+        return "", errors.New("failed to create session")
+    }
+    return tokenString, nil
+}
+
+// DeviceAuthHandler starts an RFC 8628 device authorization with the
+// identity provider for clients that can't open a browser. The client shows
+// the user code and verification URL, then polls DeviceTokenHandler.
+func (p *OAuth2Provider) DeviceAuthHandler() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if p.config.Endpoint.DeviceAuthURL == "" {
+            c.JSON(http.StatusNotImplemented, gin.H{"error": "identity provider does not support device authorization"})
+            return
         }
         
-        if err := idToken.Claims(&claims); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to parse claims"})
+        var opts []oauth2.AuthCodeOption
+        if p.config.ClientSecret != "" {
+            opts = append(opts, oauth2.SetAuthURLParam("client_secret", p.config.ClientSecret))
+        }
+        
+        ctx := context.WithValue(c.Request.Context(), oauth2.HTTPClient, p.client)
+        resp, err := p.config.DeviceAuth(ctx, opts...)
+        if err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "device authorization failed"})
             return
         }
         
-        // Create session token
-        sessionToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-            "sub":    claims.Subject,
-            "email":  claims.Email,
-            "name":   claims.Name,
-            "groups": claims.Groups,
-            "exp":    time.Now().Add(24 * time.Hour).Unix(),
+        // RFC 8628 defaults to a 5 second polling interval
+        interval := resp.Interval
+        if interval == 0 {
+            interval = 5
+        }
+        expiresIn := 0
+        if !resp.Expiry.IsZero() {
+            expiresIn = int(time.Until(resp.Expiry).Seconds())
+        }
+        c.JSON(http.StatusOK, gin.H{
+            "device_code":               resp.DeviceCode,
+            "user_code":                 resp.UserCode,
+            "verification_uri":          resp.VerificationURI,
+            "verification_uri_complete": resp.VerificationURIComplete,
+            "expires_in":                expiresIn,
+            "interval":                  interval,
         })
+    }
+}
+
+// DeviceTokenHandler makes one token request for a pending device
+// authorization. While the user hasn't finished signing in it relays the
+// identity provider's RFC 8628 error (authorization_pending, slow_down,
+// expired_token or access_denied) so the client knows how to keep polling.
+func (p *OAuth2Provider) DeviceTokenHandler() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req struct {
+            DeviceCode string `json:"device_code" form:"device_code"`
+        }
+        if err := c.ShouldBind(&req); err != nil || req.DeviceCode == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "device_code is required"})
+            return
+        }
+        
+        form := url.Values{
+            "grant_type":  {deviceCodeGrantType},
+            "device_code": {req.DeviceCode},
+            "client_id":   {p.config.ClientID},
+        }
+        if p.config.ClientSecret != "" {
+            form.Set("client_secret", p.config.ClientSecret)
+        }
         
-        tokenString, err := sessionToken.SignedString([]byte(p.clientID))
+        tokenReq, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, p.config.Endpoint.TokenURL, strings.NewReader(form.Encode()))
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
             return
         }
+        tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        tokenReq.Header.Set("Accept", "application/json")
         
-        c.SetCookie("session_token", tokenString, 86400, "/", "", true, true)
-        c.Redirect(http.StatusTemporaryRedirect, "/")
+        resp, err := p.client.Do(tokenReq)
+        if err != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "server_error", "error_description": "identity provider unreachable"})
+            return
+        }
+        defer func() { _ = resp.Body.Close() }()
+        
+        var tokenResp struct {
+            IDToken          string `json:"id_token"`
+            Error            string `json:"error"`
+            ErrorDescription string `json:"error_description"`
+        }
+        body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+        if err != nil || json.Unmarshal(body, &tokenResp) != nil {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "server_error", "error_description": "invalid identity provider response"})
+            return
+        }
+        if tokenResp.Error != "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": tokenResp.Error, "error_description": tokenResp.ErrorDescription})
+            return
+        }
+        if tokenResp.IDToken == "" {
+            c.JSON(http.StatusBadGateway, gin.H{"error": "server_error", "error_description": "no id_token"})
+            return
+        }
+        
+        tokenString, err := p.sessionFromIDToken(c.Request.Context(), tokenResp.IDToken)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+            return
+        }
+        
+        c.JSON(http.StatusOK, gin.H{
+            "access_token": tokenString,
+            "token_type":   "Bearer",
+            "expires_in":   int(sessionTTL.Seconds()),
+        })
     }
 }
 
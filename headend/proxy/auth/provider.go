@@ -4,6 +4,7 @@
 // - JWT token-based authentication for API access
 // - SAML2 integration with enterprise identity providers
 // - OAuth2 support for cloud-based authentication
+// - LDAP/Active Directory bind authentication for enterprises without an IdP
 // - Local user management with secure password hashing
 //
 // The Provider interface abstracts different authentication mechanisms,
@@ -29,4 +30,11 @@ type Provider interface {
     LogoutHandler() gin.HandlerFunc
     ValidateToken(token string) (*User, error)
     GetUser(ctx *gin.Context) (*User, error)
+}
+
+// DeviceAuthorizer is implemented by providers that support the OAuth 2.0
+// device authorization grant for clients without a local browser
+type DeviceAuthorizer interface {
+    DeviceAuthHandler() gin.HandlerFunc
+    DeviceTokenHandler() gin.HandlerFunc
 }
\ No newline at end of file
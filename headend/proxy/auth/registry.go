@@ -0,0 +1,86 @@
+// Provider registry for SASEWaddle headend authentication.
+//
+// Providers register a factory under the name used for auth.type, so new
+// authentication methods can be added without touching the proxy's
+// startup code. The built-in jwt provider is always registered; the
+// oauth2, saml2 and ldap providers register themselves from their own
+// files, which the minimal build leaves out.
+package auth
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Settings gives a provider factory access to its configuration. Keys are
+// relative to the auth section, e.g. "manager_url" or "ldap.url".
+type Settings interface {
+    GetString(key string) string
+    GetStringSlice(key string) []string
+    GetBool(key string) bool
+    GetDuration(key string) time.Duration
+}
+
+// Factory builds a provider from its settings
+type Factory func(settings Settings) (Provider, error)
+
+var (
+    registry   = make(map[string]Factory)
+    registryMu sync.RWMutex
+)
+
+// Register makes a provider available under name. Registering the same
+// name twice panics, as that is always a programming error.
+func Register(name string, factory Factory) {
+    registryMu.Lock()
+    defer registryMu.Unlock()
+
+    if _, exists := registry[name]; exists {
+        panic(fmt.Sprintf("auth provider %q registered twice", name))
+    }
+    registry[name] = factory
+}
+
+// New builds the provider registered under name. Its token validations are
+// timed in headend_auth_validation_seconds.
+func New(name string, settings Settings) (Provider, error) {
+    registryMu.RLock()
+    factory, ok := registry[name]
+    registryMu.RUnlock()
+
+    if !ok {
+        return nil, fmt.Errorf("unsupported auth type: %s (available: %v)", name, Registered())
+    }
+    provider, err := factory(settings)
+    if err != nil {
+        return nil, err
+    }
+    return instrument(name, provider), nil
+}
+
+// Registered returns the names of all registered providers, sorted
+func Registered() []string {
+    registryMu.RLock()
+    defer registryMu.RUnlock()
+
+    names := make([]string, 0, len(registry))
+    for name := range registry {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func init() {
+    Register("jwt", func(s Settings) (Provider, error) {
+        return NewJWTProviderWithConfig(JWTConfig{
+            ManagerURL:      s.GetString("manager_url"),
+            PublicKeyPath:   s.GetString("jwt_public_key_path"),
+            JWKSURL:         s.GetString("jwks_url"),
+            RefreshInterval: s.GetDuration("jwks_refresh_interval"),
+            GracePeriod:     s.GetDuration("jwks_grace_period"),
+        })
+    })
+}
@@ -1,10 +1,14 @@
+//go:build !minimal
+
 package auth
 
 import (
     "encoding/base64"
     "encoding/xml"
+    "errors"
     "fmt"
     "net/http"
+    "strings"
     "time"
 
     "github.com/gin-gonic/gin"
@@ -12,6 +16,19 @@ import (
     log "github.com/sirupsen/logrus"
 )
 
+func init() {
+    Register("saml2", func(s Settings) (Provider, error) {
+        provider, err := NewSAML2Provider(
+            s.GetString("saml2.idp_metadata_url"),
+            s.GetString("saml2.sp_entity_id"),
+        )
+        if err != nil {
+            return nil, err
+        }
+        return provider, nil
+    })
+}
+
 type SAML2Provider struct {
     idpMetadataURL string
     spEntityID     string
@@ -102,42 +119,12 @@ func (p *SAML2Provider) CallbackHandler() gin.HandlerFunc {
             return
         }
         
-        decoded, err := base64.StdEncoding.DecodeString(samlResponse)
+        user, err := parseSAMLResponse(samlResponse)
         if err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid SAML response"})
-            return
-        }
-        
-        var response SAMLResponse
-        if err := xml.Unmarshal(decoded, &response); err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "failed to parse SAML response"})
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
             return
         }
         
-        // TODO: Validate SAML response signature
-        
-        // Extract user information
-        user := &User{
-            ID:    response.Assertion.Subject.NameID.Value,
-            Email: response.Assertion.Subject.NameID.Value,
-        }
-        
-        // Extract attributes
-        for _, attr := range response.Assertion.AttributeStatement.Attributes {
-            switch attr.Name {
-            case "email", "mail":
-                if len(attr.Values) > 0 {
-                    user.Email = attr.Values[0]
-                }
-            case "name", "displayName":
-                if len(attr.Values) > 0 {
-                    user.Name = attr.Values[0]
-                }
-            case "groups", "memberOf":
-                user.Groups = attr.Values
-            }
-        }
-        
         // Create session token
         sessionToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
             "sub":    user.ID,
@@ -158,6 +145,52 @@ func (p *SAML2Provider) CallbackHandler() gin.HandlerFunc {
     }
 }
 
+// parseSAMLResponse decodes a base64 SAMLResponse form value and extracts
+// the user it asserts. The value comes straight from the browser, so it
+// must be treated as attacker-controlled.
+func parseSAMLResponse(encoded string) (*User, error) {
+    decoded, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, errors.New("invalid SAML response")
+    }
+    
+    var response SAMLResponse
+    if err := xml.Unmarshal(decoded, &response); err != nil {
+        return nil, errors.New("failed to parse SAML response")
+    }
+    
+    // TODO: Validate SAML response signature
+    
+    nameID := strings.TrimSpace(response.Assertion.Subject.NameID.Value)
+    if nameID == "" {
+        return nil, errors.New("SAML response has no NameID")
+    }
+    
+    // Extract user information
+    user := &User{
+        ID:    nameID,
+        Email: nameID,
+    }
+    
+    // Extract attributes
+    for _, attr := range response.Assertion.AttributeStatement.Attributes {
+        switch attr.Name {
+        case "email", "mail":
+            if len(attr.Values) > 0 {
+                user.Email = attr.Values[0]
+            }
+        case "name", "displayName":
+            if len(attr.Values) > 0 {
+                user.Name = attr.Values[0]
+            }
+        case "groups", "memberOf":
+            user.Groups = attr.Values
+        }
+    }
+    
+    return user, nil
+}
+
 func (p *SAML2Provider) LogoutHandler() gin.HandlerFunc {
     return func(c *gin.Context) {
         c.SetCookie("session_token", "", -1, "/", "", true, true)
@@ -0,0 +1,38 @@
+//go:build !minimal
+
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+const samlSeed = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_1" InResponseTo="_0">
+  <saml:Assertion>
+    <saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">alice@example.com</saml:NameID></saml:Subject>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="displayName"><saml:AttributeValue>Alice</saml:AttributeValue></saml:Attribute>
+      <saml:Attribute Name="groups"><saml:AttributeValue>admins</saml:AttributeValue><saml:AttributeValue>users</saml:AttributeValue></saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+// The SAMLResponse form value is posted by the browser, so anything can
+// arrive here. The fuzzer works on the raw XML and encodes it the way the
+// IdP would, which keeps mutations inside the XML parser.
+func FuzzParseSAMLResponse(f *testing.F) {
+	f.Add(samlSeed)
+	f.Add(`<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol"><Assertion><Subject><NameID></NameID></Subject></Assertion></Response>`)
+	f.Add(`<!DOCTYPE r [<!ENTITY a "aaaa">]><Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol">&a;</Response>`)
+	f.Add(`<Response>`)
+
+	f.Fuzz(func(t *testing.T, xmlDoc string) {
+		user, err := parseSAMLResponse(base64.StdEncoding.EncodeToString([]byte(xmlDoc)))
+		if err != nil {
+			return
+		}
+		if user.ID == "" {
+			t.Fatalf("accepted SAML response without a NameID: %q", xmlDoc)
+		}
+	})
+}
@@ -0,0 +1,226 @@
+// Package blockpage tells users of the SASEWaddle headend proxy why the
+// firewall denied their HTTP request.
+//
+// The blockpage package provides:
+//   - A branded HTML block page for browsers, from a built-in template or
+//     one supplied by the operator, showing the reason, the matched rule,
+//     a support contact and the request ID to quote to them
+//   - The same details as JSON for everything else, keeping the error field
+//     existing clients read
+//   - The X-Policy-Denial header on every denial, a structured field
+//     dictionary (RFC 8941) that automation can parse whatever the body
+//
+// Browsers get the page when they ask for text/html ahead of JSON; clients
+// sending no Accept header or */*, such as curl and SDKs, get JSON.
+package blockpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is the machine-readable denial header
+const Header = "X-Policy-Denial"
+
+// ErrorMessage is the error field of JSON denials
+const ErrorMessage = "Access denied by firewall policy"
+
+// Denial describes a denied request
+type Denial struct {
+	// Reason is the firewall's reason code, such as rule_deny, default_deny
+	// or quarantined
+	Reason        string
+	Rule          string
+	Category      string
+	PolicyVersion string
+	Target        string
+	RequestID     string
+}
+
+// Message explains the denial's reason to the user
+func (d Denial) Message() string {
+	switch {
+	case strings.HasPrefix(d.Reason, "blocked_by_"):
+		return "This destination is blocked by your organization's threat protection."
+	case strings.HasPrefix(d.Reason, "remediation_"):
+		return "Your device needs attention before it can reach this destination."
+	case d.Reason == "quarantined":
+		return "Your device is quarantined and can only reach remediation services."
+	case d.Reason == "rule_deny":
+		return "A firewall rule denies access to this destination."
+	default:
+		return "This destination is not allowed by your organization's access policy."
+	}
+}
+
+// Config brands the block page
+type Config struct {
+	// TemplateFile is an html/template replacing the built-in page; it is
+	// executed with a Data
+	TemplateFile string
+	Organization string
+	LogoURL      string
+	// Contact tells users who can help, e.g. a helpdesk address
+	Contact string
+}
+
+// Data is what the page template is executed with
+type Data struct {
+	Denial
+	Message      string
+	Organization string
+	LogoURL      string
+	Contact      string
+	Time         time.Time
+}
+
+// Page writes denials. A nil Page writes JSON only.
+type Page struct {
+	cfg      Config
+	template *template.Template
+	now      func() time.Time
+}
+
+// New parses the page's template
+func New(cfg Config) (*Page, error) {
+	source := defaultTemplate
+	if cfg.TemplateFile != "" {
+		content, err := os.ReadFile(cfg.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block page template: %w", err)
+		}
+		source = string(content)
+	}
+	tmpl, err := template.New("blockpage").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse block page template: %w", err)
+	}
+	return &Page{cfg: cfg, template: tmpl, now: time.Now}, nil
+}
+
+// Write answers the request r with a 403 explaining d
+func (p *Page) Write(w http.ResponseWriter, r *http.Request, d Denial) {
+	var cfg Config
+	if p != nil {
+		cfg = p.cfg
+	}
+	header := w.Header()
+	header.Set(Header, HeaderValue(d))
+	header.Set("Cache-Control", "no-store")
+	if d.RequestID != "" {
+		header.Set("X-Request-ID", d.RequestID)
+	}
+
+	if p != nil && wantsHTML(r.Header.Get("Accept")) {
+		var body bytes.Buffer
+		err := p.template.Execute(&body, Data{
+			Denial:       d,
+			Message:      d.Message(),
+			Organization: cfg.Organization,
+			LogoURL:      cfg.LogoURL,
+			Contact:      cfg.Contact,
+			Time:         p.now().UTC(),
+		})
+		// A broken operator template falls back to JSON
+		if err == nil {
+			header.Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write(body.Bytes())
+			return
+		}
+	}
+
+	body, _ := json.Marshal(struct {
+		Error         string `json:"error"`
+		Reason        string `json:"reason"`
+		Message       string `json:"message"`
+		Rule          string `json:"rule,omitempty"`
+		Category      string `json:"category,omitempty"`
+		PolicyVersion string `json:"policy_version,omitempty"`
+		Target        string `json:"target,omitempty"`
+		RequestID     string `json:"request_id,omitempty"`
+		Contact       string `json:"contact,omitempty"`
+	}{
+		Error:         ErrorMessage,
+		Reason:        d.Reason,
+		Message:       d.Message(),
+		Rule:          d.Rule,
+		Category:      d.Category,
+		PolicyVersion: d.PolicyVersion,
+		Target:        d.Target,
+		RequestID:     d.RequestID,
+		Contact:       cfg.Contact,
+	})
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write(body)
+}
+
+// HeaderValue encodes d as the X-Policy-Denial dictionary, e.g.
+// reason="rule_deny", rule="*.example.com", policy="v42", request-id="..."
+func HeaderValue(d Denial) string {
+	members := []string{"reason=" + sfString(d.Reason)}
+	for _, member := range []struct{ key, value string }{
+		{"rule", d.Rule},
+		{"policy", d.PolicyVersion},
+		{"request-id", d.RequestID},
+	} {
+		if member.value != "" {
+			members = append(members, member.key+"="+sfString(member.value))
+		}
+	}
+	return strings.Join(members, ", ")
+}
+
+// sfString encodes s as a structured field string, which holds printable
+// ASCII only; anything else is replaced by '?'
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// wantsHTML reports whether accept prefers text/html to JSON. Wildcards
+// don't count towards HTML, so clients that accept anything get JSON.
+func wantsHTML(accept string) bool {
+	var html, json float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			html = max(html, q)
+		case "application/json":
+			json = max(json, q)
+		}
+	}
+	return html > 0 && html >= json
+}
@@ -0,0 +1,125 @@
+package blockpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var denial = Denial{
+	Reason:        "rule_deny",
+	Rule:          "*.example.com",
+	Category:      "Social media",
+	PolicyVersion: "v42",
+	Target:        "www.example.com",
+	RequestID:     "req-1",
+}
+
+func write(t *testing.T, page *Page, accept string, d Denial) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	page.Write(w, r, d)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	return w
+}
+
+func TestBrowsersGetThePage(t *testing.T) {
+	page, err := New(Config{Organization: "Example Corp", Contact: "helpdesk@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := denial
+	d.Category = "<script>alert(1)</script>"
+	w := write(t, page, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", d)
+
+	body := w.Body.String()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected HTML, got %s", w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{"Example Corp", "helpdesk@example.com", "req-1", "*.example.com", d.Message()} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page lacks %q", want)
+		}
+	}
+	if strings.Contains(body, "<script>") {
+		t.Error("expected the category escaped")
+	}
+	if got := w.Header().Get(Header); got != `reason="rule_deny", rule="*.example.com", policy="v42", request-id="req-1"` {
+		t.Errorf("unexpected %s: %s", Header, got)
+	}
+}
+
+func TestAutomationGetsJSON(t *testing.T) {
+	page, _ := New(Config{Contact: "helpdesk@example.com"})
+	for _, accept := range []string{"", "*/*", "application/json", "text/html;q=0.5, application/json"} {
+		w := write(t, page, accept, denial)
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Accept %q: expected JSON: %v", accept, err)
+		}
+		if body["error"] != ErrorMessage || body["reason"] != "rule_deny" || body["request_id"] != "req-1" ||
+			body["contact"] != "helpdesk@example.com" {
+			t.Errorf("Accept %q: unexpected body %v", accept, body)
+		}
+		if w.Header().Get(Header) == "" || w.Header().Get("X-Request-ID") != "req-1" {
+			t.Errorf("Accept %q: expected the denial headers", accept)
+		}
+	}
+
+	// Without a page every client gets JSON
+	var none *Page
+	w := write(t, none, "text/html", denial)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected JSON without a page, got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestTemplateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.html")
+	if err := os.WriteFile(path, []byte(`<p>{{.Organization}}: {{.Reason}} {{.Missing}}</p>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	page, err := New(Config{TemplateFile: path, Organization: "Example Corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The template refers to a field Data lacks, so it falls back to JSON
+	if w := write(t, page, "text/html", denial); !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected a failing template to fall back to JSON, got %s", w.Body.String())
+	}
+
+	if err := os.WriteFile(path, []byte(`<p>{{.Organization}}: {{.Reason}}</p>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	page, _ = New(Config{TemplateFile: path, Organization: "Example Corp"})
+	if w := write(t, page, "text/html", denial); w.Body.String() != "<p>Example Corp: rule_deny</p>" {
+		t.Errorf("unexpected page %q", w.Body.String())
+	}
+
+	if _, err := New(Config{TemplateFile: filepath.Join(t.TempDir(), "missing.html")}); err == nil {
+		t.Error("expected a missing template rejected")
+	}
+	if err := os.WriteFile(path, []byte(`{{.Reason`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{TemplateFile: path}); err == nil {
+		t.Error("expected an invalid template rejected")
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	got := HeaderValue(Denial{Reason: "blocked_by_threat_feed", Rule: `a"b\c` + "\n"})
+	if want := `reason="blocked_by_threat_feed", rule="a\"b\\c?"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+package blockpage
+
+// defaultTemplate is the block page used without a TemplateFile
+const defaultTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Access denied{{with .Organization}} - {{.}}{{end}}</title>
+<style>
+body { margin: 0; font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; background: #f4f5f7; color: #1f2933; }
+main { max-width: 36rem; margin: 10vh auto; padding: 2rem; background: #fff; border-radius: 8px; box-shadow: 0 1px 4px rgba(0, 0, 0, .12); }
+img { max-height: 3rem; margin-bottom: 1rem; }
+h1 { font-size: 1.5rem; margin: 0 0 1rem; color: #b42318; }
+dl { display: grid; grid-template-columns: max-content 1fr; gap: .4rem 1rem; margin: 1.5rem 0; font-size: .9rem; }
+dt { color: #616e7c; }
+dd { margin: 0; word-break: break-all; }
+code { font-family: ui-monospace, Menlo, Consolas, monospace; }
+footer { font-size: .85rem; color: #616e7c; }
+</style>
+</head>
+<body>
+<main>
+{{with .LogoURL}}<img src="{{.}}" alt="">{{end}}
+<h1>Access denied</h1>
+<p>{{.Message}}</p>
+<dl>
+{{with .Target}}<dt>Destination</dt><dd><code>{{.}}</code></dd>{{end}}
+<dt>Reason</dt><dd><code>{{.Reason}}</code></dd>
+{{with .Rule}}<dt>Rule</dt><dd><code>{{.}}</code></dd>{{end}}
+{{with .Category}}<dt>Category</dt><dd>{{.}}</dd>{{end}}
+{{with .PolicyVersion}}<dt>Policy</dt><dd><code>{{.}}</code></dd>{{end}}
+{{with .RequestID}}<dt>Request ID</dt><dd><code>{{.}}</code></dd>{{end}}
+<dt>Time</dt><dd>{{.Time.Format "2006-01-02 15:04:05 UTC"}}</dd>
+</dl>
+<footer>
+{{if .Contact}}If you need access, contact {{.Contact}} and quote the request ID.{{else}}If you need access, contact your administrator and quote the request ID.{{end}}
+{{with .Organization}}<br>{{.}}{{end}}
+</footer>
+</main>
+</body>
+</html>
+`
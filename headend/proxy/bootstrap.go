@@ -0,0 +1,195 @@
+// Machine-readable enrollment output for automated provisioning.
+//
+// With `--bootstrap-output json` (or bootstrap.output) the headend emits a
+// JSON document describing itself once it has initialized: its identifiers,
+// WireGuard public key and the endpoints clients and operators reach it on.
+// Terraform, Ansible and similar tools read it to register the headend and
+// wire up the rest of the fleet without scraping logs. The schema is
+// versioned; every field is always present, empty when unknown.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// enrollmentSchemaVersion is bumped whenever a field of headendEnrollment is
+// renamed or removed; new fields may be added without a bump
+const enrollmentSchemaVersion = 1
+
+type headendEnrollment struct {
+	SchemaVersion int                        `json:"schema_version"`
+	Kind          string                     `json:"kind"`
+	HeadendID     string                     `json:"headend_id"`
+	ClusterID     string                     `json:"cluster_id"`
+	Hostname      string                     `json:"hostname"`
+	ManagerURL    string                     `json:"manager_url"`
+	WireGuard     headendEnrollmentWireGuard `json:"wireguard"`
+	Endpoints     headendEnrollmentEndpoints `json:"endpoints"`
+	GeneratedAt   time.Time                  `json:"generated_at"`
+}
+
+type headendEnrollmentWireGuard struct {
+	Interface  string `json:"interface"`
+	PublicKey  string `json:"public_key"`
+	ListenPort int    `json:"listen_port"`
+	Endpoint   string `json:"endpoint"`
+	Address    string `json:"address"`
+	Network    string `json:"network"`
+	// Set on dual-stack headends
+	Address6 string `json:"address6,omitempty"`
+	Network6 string `json:"network6,omitempty"`
+}
+
+// headendEnrollmentEndpoints are host:port pairs; disabled listeners are
+// empty
+type headendEnrollmentEndpoints struct {
+	ProxyURL string `json:"proxy_url"`
+	TCP      string `json:"tcp"`
+	UDP      string `json:"udp"`
+	SOCKS    string `json:"socks"`
+	QUIC     string `json:"quic"`
+	Metrics  string `json:"metrics"`
+}
+
+// headendID identifies this headend to the Manager, falling back to the
+// hostname when none is configured
+func headendID() string {
+	if id := viper.GetString("ports.headend_id"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// buildEnrollment describes this headend from its configuration and the
+// live WireGuard interface
+func buildEnrollment() headendEnrollment {
+	hostname, _ := os.Hostname()
+	publicHost := viper.GetString("bootstrap.public_host")
+	if publicHost == "" {
+		publicHost = hostname
+	}
+	endpoint := func(port string) string {
+		return net.JoinHostPort(publicHost, port)
+	}
+
+	enrollment := headendEnrollment{
+		SchemaVersion: enrollmentSchemaVersion,
+		Kind:          "headend",
+		HeadendID:     headendID(),
+		ClusterID:     viper.GetString("ports.cluster_id"),
+		Hostname:      hostname,
+		ManagerURL:    viper.GetString("auth.manager_url"),
+		WireGuard: headendEnrollmentWireGuard{
+			Interface: viper.GetString("wireguard.interface"),
+			Network:   viper.GetString("wireguard.network"),
+			Network6:  viper.GetString("wireguard.network6"),
+		},
+		Endpoints: headendEnrollmentEndpoints{
+			TCP:     endpoint(viper.GetString("server.tcp_port")),
+			UDP:     endpoint(viper.GetString("server.udp_port")),
+			Metrics: endpoint(viper.GetString("server.metrics_port")),
+		},
+		GeneratedAt: time.Now().UTC(),
+	}
+
+	scheme := "http"
+	if viper.GetString("server.cert_file") != "" && viper.GetString("server.key_file") != "" {
+		scheme = "https"
+	}
+	enrollment.Endpoints.ProxyURL = scheme + "://" + endpoint(viper.GetString("server.http_port"))
+	if viper.GetBool("server.socks_enabled") {
+		enrollment.Endpoints.SOCKS = endpoint(viper.GetString("server.socks_port"))
+	}
+	if viper.GetBool("server.quic.enabled") {
+		port := viper.GetString("server.quic.port")
+		if port == "" {
+			port = viper.GetString("server.http_port")
+		}
+		enrollment.Endpoints.QUIC = endpoint(port)
+	}
+
+	// The interface is set up by the entrypoint before the proxy starts
+	wg := &enrollment.WireGuard
+	client, err := wgctrl.New()
+	if err != nil {
+		log.Warnf("Enrollment has no WireGuard key: %v", err)
+	} else {
+		defer func() {
+			_ = client.Close()
+		}()
+		device, err := client.Device(wg.Interface)
+		if err != nil {
+			log.Warnf("Enrollment has no WireGuard key: %v", err)
+		} else {
+			wg.PublicKey = device.PublicKey.String()
+			wg.ListenPort = device.ListenPort
+			wg.Endpoint = endpoint(strconv.Itoa(device.ListenPort))
+		}
+	}
+
+	if iface, err := net.InterfaceByName(wg.Interface); err == nil {
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				ipNet, ok := addr.(*net.IPNet)
+				switch {
+				case !ok:
+				case ipNet.IP.To4() != nil && wg.Address == "":
+					wg.Address = addr.String()
+				case ipNet.IP.To4() == nil && !ipNet.IP.IsLinkLocalUnicast() && wg.Address6 == "":
+					wg.Address6 = addr.String()
+				}
+			}
+		}
+	}
+
+	return enrollment
+}
+
+// writeBootstrapOutput emits the enrollment in the format bootstrap.output
+// names, to bootstrap.file or to stdout, which carries no log output
+func writeBootstrapOutput() error {
+	format := viper.GetString("bootstrap.output")
+	switch format {
+	case "":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("unsupported bootstrap output format: %s", format)
+	}
+
+	data, err := json.Marshal(buildEnrollment())
+	if err != nil {
+		return fmt.Errorf("failed to encode enrollment: %w", err)
+	}
+	data = append(data, '\n')
+
+	file := viper.GetString("bootstrap.file")
+	if file == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	// Replace the file atomically so readers never see a partial document
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write bootstrap file: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write bootstrap file: %w", err)
+	}
+
+	log.Infof("Enrollment written to %s", file)
+	return nil
+}
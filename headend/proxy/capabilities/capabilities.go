@@ -0,0 +1,197 @@
+// Package capabilities implements client-headend capability negotiation for
+// the SASEWaddle headend proxy.
+//
+// The capabilities package provides:
+// - A description of what each side supports (protocol versions, compression,
+//   fallback transports and control channel features)
+// - Deterministic negotiation of the common subset
+// - A baseline set assumed for clients that predate negotiation
+// - A per-client registry so proxies can consult negotiated features
+//
+// Negotiation lets old clients and new headends interoperate: anything not
+// agreed during session establishment is simply not used, so new features
+// can roll out incrementally on either side.
+package capabilities
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// ProtocolV1 is the original JWT:/HOST: text framing
+	ProtocolV1 = 1
+	// ProtocolV2 is the length-prefixed binary header from libs/framing
+	ProtocolV2 = 2
+
+	CompressionNone = "none"
+
+	TransportWireGuard = "wireguard"
+	TransportTCP       = "tcp"
+	TransportUDP       = "udp"
+	TransportHTTPS     = "https"
+
+	// FeatureDynamicPorts means the headend accepts flows on Manager-assigned ports
+	FeatureDynamicPorts = "dynamic_ports"
+	// FeatureLocalPolicy means the client may fetch a local deny subset of its policy
+	FeatureLocalPolicy = "local_policy"
+	// FeatureMigration means the client polls for migration directives and
+	// can move its session to a peer headend
+	FeatureMigration = "migration"
+	// FeatureQuarantine means the client polls its quarantine status to show
+	// a banner and move to its quarantine address
+	FeatureQuarantine = "quarantine"
+	// FeatureDenialFrames means the client reads a denial frame, explaining
+	// why policy refused a flow, in place of the stream or first response
+	FeatureDenialFrames = "denial_frames"
+	// FeatureDNSProxy means the headend answers DNS queries at its tunnel
+	// address, filtered by the user's policy
+	FeatureDNSProxy = "dns_proxy"
+)
+
+// Set describes the capabilities one side of a session supports. Slices are
+// ordered by preference, most preferred first.
+type Set struct {
+	ProtocolVersions []int    `json:"protocol_versions"`
+	Compression      []string `json:"compression"`
+	Transports       []string `json:"transports"`
+	Features         []string `json:"features"`
+}
+
+// Negotiated is the agreed subset used for the lifetime of a session
+type Negotiated struct {
+	ProtocolVersion int       `json:"protocol_version"`
+	Compression     string    `json:"compression"`
+	Transports      []string  `json:"transports"`
+	Features        []string  `json:"features"`
+	NegotiatedAt    time.Time `json:"negotiated_at"`
+}
+
+// Baseline returns the capabilities assumed for clients that never negotiate
+func Baseline() Set {
+	return Set{
+		ProtocolVersions: []int{ProtocolV1},
+		Compression:      []string{CompressionNone},
+		Transports:       []string{TransportWireGuard},
+	}
+}
+
+// Negotiate computes the common capabilities of the headend (local) and a
+// client (remote). The client's preference order wins for compression and
+// transports; the highest shared protocol version is chosen.
+func Negotiate(local, remote Set) (*Negotiated, error) {
+	version := 0
+	for _, lv := range local.ProtocolVersions {
+		for _, rv := range remote.ProtocolVersions {
+			if lv == rv && lv > version {
+				version = lv
+			}
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("no common protocol version (headend %v, client %v)",
+			local.ProtocolVersions, remote.ProtocolVersions)
+	}
+
+	compression := CompressionNone
+	for _, c := range remote.Compression {
+		if contains(local.Compression, c) {
+			compression = c
+			break
+		}
+	}
+
+	transports := intersect(remote.Transports, local.Transports)
+	if len(transports) == 0 {
+		transports = []string{TransportWireGuard}
+	}
+
+	return &Negotiated{
+		ProtocolVersion: version,
+		Compression:     compression,
+		Transports:      transports,
+		Features:        intersect(remote.Features, local.Features),
+		NegotiatedAt:    time.Now().UTC(),
+	}, nil
+}
+
+// Has reports whether a feature was agreed for the session
+func (n *Negotiated) Has(feature string) bool {
+	return n != nil && contains(n.Features, feature)
+}
+
+// Registry remembers the negotiated capabilities of each client
+type Registry struct {
+	sessions map[string]*Negotiated
+	mu       sync.RWMutex
+}
+
+// NewRegistry creates an empty capability registry
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*Negotiated),
+	}
+}
+
+// Set stores the negotiated capabilities for a client
+func (r *Registry) Set(clientID string, negotiated *Negotiated) {
+	r.mu.Lock()
+	r.sessions[clientID] = negotiated
+	r.mu.Unlock()
+}
+
+// Get returns the negotiated capabilities for a client, or nil if the
+// client has not negotiated and should be treated as Baseline
+func (r *Registry) Get(clientID string) *Negotiated {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sessions[clientID]
+}
+
+// Remove forgets a client's negotiated capabilities
+func (r *Registry) Remove(clientID string) {
+	r.mu.Lock()
+	delete(r.sessions, clientID)
+	r.mu.Unlock()
+}
+
+// All returns a copy of every client's negotiated capabilities
+func (r *Registry) All() map[string]*Negotiated {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make(map[string]*Negotiated, len(r.sessions))
+	for clientID, negotiated := range r.sessions {
+		all[clientID] = negotiated
+	}
+	return all
+}
+
+// Count returns the number of clients with negotiated capabilities
+func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the values of preferred that also appear in supported,
+// keeping the order of preferred
+func intersect(preferred, supported []string) []string {
+	result := []string{}
+	for _, v := range preferred {
+		if contains(supported, v) && !contains(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
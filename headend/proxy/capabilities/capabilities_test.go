@@ -0,0 +1,125 @@
+package capabilities
+
+import (
+	"reflect"
+	"testing"
+)
+
+// headend is what the headend advertises
+var headend = Set{
+	ProtocolVersions: []int{ProtocolV1, ProtocolV2},
+	Compression:      []string{CompressionNone, "zstd"},
+	Transports:       []string{TransportWireGuard, TransportTCP, TransportHTTPS},
+	Features:         []string{FeatureDynamicPorts, FeatureDenialFrames, FeatureMigration},
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		client Set
+		want   Negotiated
+	}{
+		{
+			name:   "baseline client",
+			client: Baseline(),
+			want: Negotiated{
+				ProtocolVersion: ProtocolV1,
+				Compression:     CompressionNone,
+				Transports:      []string{TransportWireGuard},
+				Features:        []string{},
+			},
+		},
+		{
+			name: "client preference wins",
+			client: Set{
+				ProtocolVersions: []int{ProtocolV1, ProtocolV2},
+				Compression:      []string{"zstd", CompressionNone},
+				Transports:       []string{TransportHTTPS, TransportUDP, TransportWireGuard, TransportHTTPS},
+				Features:         []string{FeatureDenialFrames, FeatureQuarantine, FeatureDynamicPorts},
+			},
+			want: Negotiated{
+				ProtocolVersion: ProtocolV2,
+				Compression:     "zstd",
+				Transports:      []string{TransportHTTPS, TransportWireGuard},
+				Features:        []string{FeatureDenialFrames, FeatureDynamicPorts},
+			},
+		},
+		{
+			name: "nothing else in common",
+			client: Set{
+				ProtocolVersions: []int{ProtocolV1, 7},
+				Compression:      []string{"brotli"},
+				Transports:       []string{TransportUDP},
+				Features:         []string{"teleport"},
+			},
+			want: Negotiated{
+				ProtocolVersion: ProtocolV1,
+				Compression:     CompressionNone,
+				Transports:      []string{TransportWireGuard},
+				Features:        []string{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Negotiate(headend, tt.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.NegotiatedAt.IsZero() {
+				t.Error("negotiation time not set")
+			}
+			got.NegotiatedAt = tt.want.NegotiatedAt
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Negotiate(headend, Set{ProtocolVersions: []int{3}}); err == nil {
+		t.Error("negotiated without a common protocol version")
+	}
+}
+
+func TestRegistryHas(t *testing.T) {
+	r := NewRegistry()
+	negotiated, _ := Negotiate(headend, Set{
+		ProtocolVersions: []int{ProtocolV2},
+		Features:         []string{FeatureDenialFrames},
+	})
+	r.Set("alice", negotiated)
+	r.Set("bob", nil)
+
+	tests := []struct {
+		user    string
+		feature string
+		want    bool
+	}{
+		{"alice", FeatureDenialFrames, true},
+		{"alice", FeatureMigration, false},
+		{"alice", "unknown_feature", false},
+		{"bob", FeatureDenialFrames, false},
+		{"carol", FeatureDenialFrames, false},
+		{"", FeatureDenialFrames, false},
+	}
+	for _, tt := range tests {
+		if got := r.Get(tt.user).Has(tt.feature); got != tt.want {
+			t.Errorf("%q has %s: %v, want %v", tt.user, tt.feature, got, tt.want)
+		}
+	}
+
+	if r.Count() != 2 || len(r.All()) != 2 {
+		t.Errorf("%d clients registered, want 2", r.Count())
+	}
+	r.Remove("alice")
+	if r.Get("alice") != nil || r.Get("alice").Has(FeatureDenialFrames) || r.Count() != 1 {
+		t.Error("capabilities kept after Remove")
+	}
+
+	// All is a copy the caller may change
+	all := r.All()
+	delete(all, "bob")
+	if r.Count() != 1 {
+		t.Error("All exposed the registry's map")
+	}
+}
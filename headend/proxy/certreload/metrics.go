@@ -0,0 +1,18 @@
+package certreload
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_tls_certificate_reloads_total",
+		Help: "Total reloads of the headend TLS certificate, by result (ok, error).",
+	}, []string{"result"})
+
+	certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_tls_certificate_expiry_timestamp_seconds",
+		Help: "Expiry of the TLS certificate in service, as a Unix timestamp.",
+	})
+)
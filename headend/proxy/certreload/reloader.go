@@ -0,0 +1,226 @@
+// Package certreload serves the headend's TLS certificate and reloads it
+// from disk when it changes.
+//
+// The certreload package provides:
+//   - A GetCertificate callback for tls.Config, so listeners pick up a new
+//     certificate on the next handshake without restarting or dropping
+//     established connections
+//   - A watcher on the certificate and key directories, so renewals by
+//     certbot, cert-manager or a mounted Kubernetes secret are noticed
+//   - Manual reloads, for the headend's SIGHUP handler
+//
+// A certificate that fails to load, or whose key doesn't match, is logged
+// and counted; the previous certificate stays in service.
+package certreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDebounce is how long the watcher waits for writes to settle. Tools
+// replace the certificate and key one after the other, and a reload between
+// the two would see a mismatched pair.
+const DefaultDebounce = 2 * time.Second
+
+// Status describes the certificate in service
+type Status struct {
+	CertFile  string    `json:"cert_file"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotAfter  time.Time `json:"not_after"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	Reloads   int64     `json:"reloads"`
+	LastError string    `json:"last_error,omitempty"`
+	Watching  bool      `json:"watching"`
+}
+
+// loaded is a certificate with its parsed leaf
+type loaded struct {
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	loadedAt time.Time
+}
+
+// Reloader holds the current certificate of a cert and key file pair
+type Reloader struct {
+	certFile string
+	keyFile  string
+	debounce time.Duration
+
+	current atomic.Pointer[loaded]
+	reloads atomic.Int64
+
+	mu        sync.Mutex
+	lastError string
+	watcher   *fsnotify.Watcher
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// New loads the certificate and key. The headend can't serve TLS without
+// them, so failing to load is an error here, unlike on reload.
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, debounce: DefaultDebounce}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current.Load().cert, nil
+}
+
+// Reload reads the certificate and key again. On failure the previous
+// certificate stays in service.
+func (r *Reloader) Reload() error {
+	err := r.load()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		reloads.WithLabelValues("error").Inc()
+		r.lastError = err.Error()
+		log.Errorf("Failed to reload TLS certificate, keeping the current one: %v", err)
+		return err
+	}
+	r.reloads.Add(1)
+	reloads.WithLabelValues("ok").Inc()
+	r.lastError = ""
+
+	leaf := r.current.Load().leaf
+	log.Infof("Reloaded TLS certificate for %s, valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (r *Reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	r.current.Store(&loaded{cert: &cert, leaf: leaf, loadedAt: time.Now()})
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	return nil
+}
+
+// Watch reloads the certificate whenever the files change. The directories
+// are watched rather than the files, as renewals usually replace the files
+// (or, for Kubernetes secrets, swap a symlink) instead of writing to them.
+func (r *Reloader) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create certificate watcher: %w", err)
+	}
+	dirs := map[string]bool{filepath.Dir(r.certFile): true, filepath.Dir(r.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.watcher = watcher
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	r.mu.Unlock()
+
+	go r.watch(watcher, r.stop, r.done)
+	log.Infof("Watching %s and %s for certificate renewals", r.certFile, r.keyFile)
+	return nil
+}
+
+func (r *Reloader) watch(watcher *fsnotify.Watcher, stop, done chan struct{}) {
+	defer close(done)
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if r.relevant(event) {
+				pending = time.After(r.debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("Certificate watcher error: %v", err)
+		case <-pending:
+			pending = nil
+			_ = r.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// relevant reports whether event may have changed the certificate or key
+func (r *Reloader) relevant(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	if name == filepath.Clean(r.certFile) || name == filepath.Clean(r.keyFile) {
+		return true
+	}
+	// Kubernetes secret volumes swap the ..data symlink to publish updates
+	return filepath.Base(name) == "..data"
+}
+
+// Stop stops watching. It is nil-safe and safe to call more than once.
+func (r *Reloader) Stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	watcher, stop, done := r.watcher, r.stop, r.done
+	r.watcher = nil
+	r.mu.Unlock()
+
+	if watcher == nil {
+		return
+	}
+	close(stop)
+	<-done
+	_ = watcher.Close()
+}
+
+// Status describes the certificate in service, or returns nil if r is nil
+func (r *Reloader) Status() *Status {
+	if r == nil {
+		return nil
+	}
+	current := r.current.Load()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Status{
+		CertFile:  r.certFile,
+		Subject:   current.leaf.Subject.CommonName,
+		DNSNames:  current.leaf.DNSNames,
+		NotAfter:  current.leaf.NotAfter,
+		LoadedAt:  current.loadedAt,
+		Reloads:   r.reloads.Load(),
+		LastError: r.lastError,
+		Watching:  r.watcher != nil,
+	}
+}
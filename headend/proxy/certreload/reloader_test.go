@@ -0,0 +1,138 @@
+package certreload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for commonName and its key
+func writePair(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// writeFile replaces path the way renewal tools do, with a rename
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("failed to rename %s: %v", tmp, err)
+	}
+}
+
+func servedName(t *testing.T, r *Reloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writePair(t, certFile, keyFile, "old.example.com")
+
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if got := servedName(t, r); got != "old.example.com" {
+		t.Fatalf("serving %q, want old.example.com", got)
+	}
+
+	writePair(t, certFile, keyFile, "new.example.com")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if got := servedName(t, r); got != "new.example.com" {
+		t.Errorf("serving %q after reload, want new.example.com", got)
+	}
+
+	// A key that doesn't match the certificate leaves the last good pair
+	other := filepath.Join(dir, "other")
+	writePair(t, other+".crt", other+".key", "other.example.com")
+	data, err := os.ReadFile(other + ".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, keyFile, data)
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected a mismatched key to fail the reload")
+	}
+	if got := servedName(t, r); got != "new.example.com" {
+		t.Errorf("serving %q after a failed reload, want new.example.com", got)
+	}
+	if status := r.Status(); status.Reloads != 1 || status.LastError == "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestNewRequiresCertificate(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("expected New to fail without a certificate")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writePair(t, certFile, keyFile, "old.example.com")
+
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	r.debounce = 10 * time.Millisecond
+	if err := r.Watch(); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer r.Stop()
+
+	writePair(t, certFile, keyFile, "renewed.example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, r) != "renewed.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping twice is safe
+	r.Stop()
+}
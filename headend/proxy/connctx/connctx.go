@@ -0,0 +1,245 @@
+// Package connctx carries per-connection metadata through the SASEWaddle
+// headend proxy.
+//
+// The connctx package provides:
+//   - A context value holding the authenticated user, a request ID and the
+//     protocol, source and target of a proxied connection or request
+//   - Request ID generation for connections that don't bring their own
+//   - A logger tagged with the connection's metadata
+//   - Upstream dialing bound to the connection's context, through
+//     pre-resolved addresses when an address cache is installed
+//
+// Handlers build the context once the user is authenticated and pass it to
+// firewall checks, dials, mirroring and logging, so per-user dial policies,
+// cancellation and tracing share one carrier instead of positional
+// parameters. Cancelling the context aborts a dial still in progress.
+// Log entries carry the trace ID when the connection's trace is recorded.
+// Flows an operator flagged for tracing carry a flowtrace.Trace, started
+// here and fed the auth result and upstream dial timing. An identity
+// observer learns which user each source address belongs to.
+// Dials and refused connections are counted by the client's protocol.
+package connctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/flowtrace"
+	"github.com/tobogganing/headend/proxy/tracing"
+)
+
+// DialTimeout bounds upstream dials when the context has no earlier deadline
+const DialTimeout = 10 * time.Second
+
+// CachedDialTimeout bounds a dial to a cached address, so a stale one falls
+// back to resolving the host quickly
+const CachedDialTimeout = 3 * time.Second
+
+// AddressCache holds pre-resolved addresses of frequently dialed upstreams
+type AddressCache interface {
+	// Lookup returns cached IPs of host, or nil to resolve it normally.
+	// Every dial by name looks its host up, so the cache can learn which
+	// upstreams are popular.
+	Lookup(host string) []string
+}
+
+type cacheHolder struct{ cache AddressCache }
+
+var addressCache atomic.Pointer[cacheHolder]
+
+// SetAddressCache installs the cache upstream dials consult; nil removes it
+func SetAddressCache(cache AddressCache) {
+	if cache == nil {
+		addressCache.Store(nil)
+		return
+	}
+	addressCache.Store(&cacheHolder{cache: cache})
+}
+
+var flowRecorder atomic.Pointer[flowtrace.Recorder]
+
+// IdentityObserver learns which user is behind a source address from the
+// user's authenticated flows, for traffic that carries no credentials
+type IdentityObserver interface {
+	Observe(source string, user *auth.User)
+}
+
+type observerHolder struct{ observer IdentityObserver }
+
+var identityObserver atomic.Pointer[observerHolder]
+
+// SetIdentityObserver installs the observer told about every flow with a
+// user; nil removes it
+func SetIdentityObserver(observer IdentityObserver) {
+	if observer == nil {
+		identityObserver.Store(nil)
+		return
+	}
+	identityObserver.Store(&observerHolder{observer: observer})
+}
+
+// SetFlowRecorder installs the recorder of flows flagged for tracing; nil
+// removes it
+func SetFlowRecorder(recorder *flowtrace.Recorder) {
+	flowRecorder.Store(recorder)
+}
+
+// Meta describes a proxied connection or HTTP request
+type Meta struct {
+	User       *auth.User
+	RequestID  string
+	Protocol   string
+	SourceIP   string
+	TargetHost string
+}
+
+// UserID returns the ID of the connection's user, or "" if there is none
+func (m *Meta) UserID() string {
+	if m == nil || m.User == nil {
+		return ""
+	}
+	return m.User.ID
+}
+
+type metaKey struct{}
+
+// WithMeta returns a copy of parent carrying meta. A request ID is
+// generated if meta doesn't have one. The flow's trace starts here if it
+// was flagged for one.
+func WithMeta(parent context.Context, meta Meta) context.Context {
+	if meta.RequestID == "" {
+		meta.RequestID = NewRequestID()
+	}
+	ctx := context.WithValue(parent, metaKey{}, &meta)
+
+	if holder := identityObserver.Load(); holder != nil && meta.User != nil && meta.SourceIP != "" {
+		holder.observer.Observe(meta.SourceIP, meta.User)
+	}
+
+	trace := flowRecorder.Load().Begin(flowtrace.Flow{
+		UserID:    meta.UserID(),
+		Protocol:  meta.Protocol,
+		SourceIP:  meta.SourceIP,
+		Target:    meta.TargetHost,
+		RequestID: meta.RequestID,
+	})
+	if trace != nil {
+		trace.Record("auth", map[string]any{
+			"result":  "authenticated",
+			"user_id": meta.User.ID,
+			"email":   meta.User.Email,
+			"groups":  meta.User.Groups,
+		})
+		ctx = flowtrace.WithTrace(ctx, trace)
+	}
+	return ctx
+}
+
+// FromContext returns the metadata carried by ctx, or nil if there is none
+func FromContext(ctx context.Context) *Meta {
+	meta, _ := ctx.Value(metaKey{}).(*Meta)
+	return meta
+}
+
+// NewRequestID returns a random 128-bit request ID in hex
+func NewRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Logger returns a log entry tagged with the connection's metadata
+func Logger(ctx context.Context) *log.Entry {
+	meta := FromContext(ctx)
+	if meta == nil {
+		return log.NewEntry(log.StandardLogger())
+	}
+
+	fields := log.Fields{"request_id": meta.RequestID}
+	if meta.User != nil {
+		fields["user_id"] = meta.User.ID
+	}
+	if meta.Protocol != "" {
+		fields["protocol"] = meta.Protocol
+	}
+	if meta.SourceIP != "" {
+		fields["source_ip"] = meta.SourceIP
+	}
+	if meta.TargetHost != "" {
+		fields["target"] = meta.TargetHost
+	}
+	if traceID := tracing.TraceIDFromContext(ctx); traceID != "" {
+		fields["trace_id"] = traceID
+	}
+	return log.WithFields(fields)
+}
+
+// Dial connects to address on behalf of the connection in ctx. The dial is
+// abandoned when ctx is cancelled or DialTimeout passes, traced as a child
+// of the connection's span and timed in headend_upstream_dial_seconds.
+func Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, span := tracing.Start(ctx, "upstream.dial", trace.SpanKindClient,
+		attribute.String("network.transport", network),
+		attribute.String("server.address", address),
+	)
+	defer span.End()
+
+	start := time.Now()
+	conn, err := DialContext(ctx, network, address)
+	tracing.RecordError(span, err)
+
+	if trace := flowtrace.FromContext(ctx); trace != nil {
+		detail := map[string]any{"network": network, "address": address}
+		if err != nil {
+			detail["error"] = err.Error()
+		} else {
+			detail["remote_address"] = conn.RemoteAddr().String()
+		}
+		trace.Timed("upstream.dial", start, detail)
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	var protocol string
+	if meta := FromContext(ctx); meta != nil {
+		protocol = meta.Protocol
+	}
+	upstreamDialDuration.WithLabelValues(protocolLabel(protocol), result).Observe(time.Since(start).Seconds())
+	return conn, err
+}
+
+// DialContext connects to address, trying the first cached IP of its host
+// before resolving the name. It's the untraced dial of Dial, and the dialer
+// of upstream HTTP transports. Its sockets are marked for policy routing, see
+// newDialer.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := newDialer(ctx, DialTimeout)
+	holder := addressCache.Load()
+	host, port, err := net.SplitHostPort(address)
+	if holder == nil || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	if ips := holder.cache.Lookup(host); len(ips) > 0 {
+		cached := newDialer(ctx, CachedDialTimeout)
+		conn, err := cached.DialContext(ctx, network, net.JoinHostPort(ips[0], port))
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		Logger(ctx).Debugf("Cached address %s of %s failed, resolving it: %v", ips[0], host, err)
+	}
+	return dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,135 @@
+package connctx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/flowtrace"
+)
+
+func TestWithMeta(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Fatal("expected no metadata on a bare context")
+	}
+
+	ctx := WithMeta(context.Background(), Meta{
+		User:       &auth.User{ID: "alice"},
+		Protocol:   "TCP",
+		TargetHost: "example.com:443",
+	})
+	meta := FromContext(ctx)
+	if meta == nil || meta.UserID() != "alice" || meta.TargetHost != "example.com:443" {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	if len(meta.RequestID) != 32 {
+		t.Errorf("generated request ID %q, want 32 hex characters", meta.RequestID)
+	}
+
+	fields := Logger(ctx).Data
+	if fields["user_id"] != "alice" || fields["request_id"] != meta.RequestID || fields["target"] != "example.com:443" {
+		t.Errorf("unexpected log fields %v", fields)
+	}
+
+	// A request ID from the client is kept
+	ctx = WithMeta(context.Background(), Meta{RequestID: "req-1"})
+	if got := FromContext(ctx).RequestID; got != "req-1" {
+		t.Errorf("RequestID = %q, want req-1", got)
+	}
+	if got := FromContext(ctx).UserID(); got != "" {
+		t.Errorf("UserID = %q for a connection without a user", got)
+	}
+}
+
+func TestDialCancelled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(WithMeta(context.Background(), Meta{}))
+	conn, err := Dial(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+
+	cancel()
+	if _, err := Dial(ctx, "tcp", ln.Addr().String()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Dial after cancel = %v, want context.Canceled", err)
+	}
+}
+
+type staticCache map[string][]string
+
+func (c staticCache) Lookup(host string) []string {
+	return c[host]
+}
+
+func TestDialAddressCache(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	SetAddressCache(staticCache{
+		"app.internal.invalid": {"127.0.0.1"},
+		"localhost":            {"127.0.0.2"}, // stale; nothing listens there
+	})
+	defer SetAddressCache(nil)
+
+	ctx := WithMeta(context.Background(), Meta{})
+	conn, err := Dial(ctx, "tcp", net.JoinHostPort("app.internal.invalid", port))
+	if err != nil {
+		t.Fatalf("Dial through the cache: %v", err)
+	}
+	conn.Close()
+
+	// A stale cached address falls back to resolving the name
+	conn, err = Dial(ctx, "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("Dial with a stale cached address: %v", err)
+	}
+	conn.Close()
+}
+
+func TestFlaggedFlowIsTraced(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	recorder := flowtrace.NewRecorder(10)
+	SetFlowRecorder(recorder)
+	defer SetFlowRecorder(nil)
+	armed, _ := recorder.Arm("alice", "127.0.0.1", 0)
+
+	untraced := WithMeta(context.Background(), Meta{User: &auth.User{ID: "bob"}, TargetHost: listener.Addr().String()})
+	if flowtrace.FromContext(untraced) != nil {
+		t.Error("expected bob's flow untraced")
+	}
+
+	ctx := WithMeta(context.Background(), Meta{User: &auth.User{ID: "alice"}, TargetHost: listener.Addr().String()})
+	if flowtrace.FromContext(ctx) == nil {
+		t.Fatal("expected alice's flow traced")
+	}
+	conn, err := Dial(ctx, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	trace, _ := recorder.Get(armed.ID)
+	if len(trace.Stages) != 2 || trace.Stages[0].Name != "auth" || trace.Stages[1].Name != "upstream.dial" {
+		t.Fatalf("expected the auth and dial stages, got %+v", trace.Stages)
+	}
+	if trace.Stages[1].Detail["remote_address"] != listener.Addr().String() {
+		t.Errorf("unexpected dial detail %v", trace.Stages[1].Detail)
+	}
+}
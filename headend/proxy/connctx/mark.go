@@ -0,0 +1,90 @@
+package connctx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// AuthenticatedMark is the firewall mark of upstream traffic of
+// authenticated connections that setup-routing.sh's rules accept
+const AuthenticatedMark = 100
+
+var errMarkUnsupported = errors.New("socket marks are not supported on this platform")
+
+// MarkSelector returns the mark of upstream sockets to address, or zero
+// for the default mark
+type MarkSelector func(address netip.Addr) uint32
+
+var (
+	// socketMark is set on the sockets of upstream connections, none if zero
+	socketMark atomic.Uint32
+	// markSelector overrides socketMark by destination, if set
+	markSelector atomic.Pointer[MarkSelector]
+)
+
+type socketMarkKey struct{}
+
+// SetSocketMark sets mark (SO_MARK) on the sockets of upstream connections
+// dialed from now on, so iptables and policy routing can tell them apart;
+// zero stops marking. It fails, leaving marking off, when the headend may
+// not mark sockets, which needs CAP_NET_ADMIN on Linux.
+func SetSocketMark(mark uint32) error {
+	if mark != 0 {
+		if err := probeMark(int(mark)); err != nil {
+			socketMark.Store(0)
+			return err
+		}
+	}
+	socketMark.Store(mark)
+	return nil
+}
+
+// SetMarkSelector has selector choose the mark of upstream sockets by
+// destination, e.g. to route some networks out another interface; nil
+// removes it. Sockets it returns zero for carry the SetSocketMark mark.
+func SetMarkSelector(selector MarkSelector) {
+	if selector == nil {
+		markSelector.Store(nil)
+		return
+	}
+	markSelector.Store(&selector)
+}
+
+// WithSocketMark returns a copy of parent whose upstream dials mark their
+// sockets with mark, whatever their destination
+func WithSocketMark(parent context.Context, mark uint32) context.Context {
+	return context.WithValue(parent, socketMarkKey{}, mark)
+}
+
+// newDialer returns a dialer marking its sockets with the mark of ctx, of
+// their destination or the socket mark, in that order
+func newDialer(ctx context.Context, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	mark, _ := ctx.Value(socketMarkKey{}).(uint32)
+	selector := markSelector.Load()
+	if mark == 0 && selector == nil && socketMark.Load() == 0 {
+		return dialer
+	}
+
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		mark := mark
+		if mark == 0 && selector != nil {
+			if addrPort, err := netip.ParseAddrPort(address); err == nil {
+				mark = (*selector)(addrPort.Addr().Unmap())
+			}
+		}
+		if mark == 0 {
+			mark = socketMark.Load()
+		}
+		if mark == 0 {
+			return nil
+		}
+		return setMark(c, int(mark))
+	}
+	return dialer
+}
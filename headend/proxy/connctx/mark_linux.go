@@ -0,0 +1,39 @@
+package connctx
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setMark sets SO_MARK on the socket of c
+func setMark(c syscall.RawConn, mark int) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+	}); controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set socket mark %d: %w", mark, err)
+	}
+	return nil
+}
+
+// probeMark checks that sockets may be marked, on a socket of its own
+func probeMark(mark int) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		// IPv6-only hosts
+		fd, err = unix.Socket(unix.AF_INET6, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open socket: %w", err)
+		}
+	}
+	defer unix.Close(fd)
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, mark); err != nil {
+		return fmt.Errorf("failed to set socket mark %d: %w", mark, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package connctx
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// dialedMark dials address and returns the mark of the socket
+func dialedMark(t *testing.T, ctx context.Context, address string) int {
+	t.Helper()
+	conn, err := Dial(ctx, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var markErr error
+	if err := raw.Control(func(fd uintptr) {
+		mark, markErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}); err != nil || markErr != nil {
+		t.Fatalf("failed to read the mark: %v %v", err, markErr)
+	}
+	return mark
+}
+
+func TestDialMarksSockets(t *testing.T) {
+	if err := SetSocketMark(AuthenticatedMark); err != nil {
+		t.Skipf("sockets can't be marked here: %v", err)
+	}
+	defer SetSocketMark(0)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	address := listener.Addr().String()
+
+	if mark := dialedMark(t, context.Background(), address); mark != AuthenticatedMark {
+		t.Errorf("expected mark %d, got %d", AuthenticatedMark, mark)
+	}
+
+	// Destinations can be marked for another route, and connections
+	// whatever their destination
+	SetMarkSelector(func(address netip.Addr) uint32 {
+		if address == netip.MustParseAddr("127.0.0.1") {
+			return 200
+		}
+		return 0
+	})
+	defer SetMarkSelector(nil)
+	if mark := dialedMark(t, context.Background(), address); mark != 200 {
+		t.Errorf("expected the destination's mark 200, got %d", mark)
+	}
+	if mark := dialedMark(t, WithSocketMark(context.Background(), 300), address); mark != 300 {
+		t.Errorf("expected the connection's mark 300, got %d", mark)
+	}
+
+	// Marking can be turned off
+	SetMarkSelector(nil)
+	if err := SetSocketMark(0); err != nil {
+		t.Fatal(err)
+	}
+	if newDialer(context.Background(), DialTimeout).Control != nil {
+		t.Error("expected unmarked dials")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package connctx
+
+import "syscall"
+
+func setMark(c syscall.RawConn, mark int) error {
+	return errMarkUnsupported
+}
+
+func probeMark(mark int) error {
+	return errMarkUnsupported
+}
@@ -0,0 +1,42 @@
+package connctx
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "headend_upstream_dial_seconds",
+		Help:    "Time taken to connect to upstream targets, by client protocol and result (ok, error).",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"protocol", "result"})
+
+	deniedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_denied_requests_total",
+		Help: "Total connections and requests refused, by client protocol and reason.",
+	}, []string{"protocol", "reason"})
+)
+
+// Reasons for refusing a connection before the firewall is consulted; the
+// firewall's come from firewall.Decision.DenialLabel
+const (
+	DenyAuth        = "auth"
+	DenyCertificate = "certificate"
+)
+
+// RecordDenial counts a connection or request of protocol refused for
+// reason. Reasons must come from a fixed set, never from user input.
+func RecordDenial(protocol, reason string) {
+	deniedRequests.WithLabelValues(protocolLabel(protocol), reason).Inc()
+}
+
+// protocolLabel is protocol as used in metric labels
+func protocolLabel(protocol string) string {
+	if protocol == "" {
+		return "unknown"
+	}
+	return strings.ToLower(protocol)
+}
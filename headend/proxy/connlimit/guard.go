@@ -0,0 +1,204 @@
+// Package connlimit bounds proxied TCP sessions in the SASEWaddle headend
+// proxy.
+//
+// The connlimit package provides:
+//   - An idle timeout that closes sessions with no traffic in either
+//     direction, so a peer that goes silent does not hold a session forever
+//   - A maximum session lifetime, after which a session is closed even if
+//     it is still busy
+//   - A per-user cap on concurrent sessions
+//   - Metrics for every session closed or refused by a limit
+//
+// A forced close closes the client connection and cancels the session's
+// context; proxies close the target connection when that context ends.
+package connlimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/connctx"
+)
+
+const (
+	ReasonIdle        = "idle"
+	ReasonMaxLifetime = "max_lifetime"
+)
+
+// Limits configures a Guard. Zero disables a limit.
+type Limits struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	MaxPerUser  int
+}
+
+// Guard enforces Limits on TCP sessions. A nil Guard enforces nothing.
+type Guard struct {
+	limits  Limits
+	perUser map[string]int
+	mu      sync.Mutex
+}
+
+// Status reports the configured limits for health checks
+type Status struct {
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	MaxLifetime string `json:"max_lifetime,omitempty"`
+	MaxPerUser  int    `json:"max_per_user,omitempty"`
+	Users       int    `json:"users"`
+}
+
+// NewGuard creates a Guard, or returns nil when every limit is disabled
+func NewGuard(limits Limits) *Guard {
+	if limits.IdleTimeout <= 0 && limits.MaxLifetime <= 0 && limits.MaxPerUser <= 0 {
+		return nil
+	}
+	return &Guard{limits: limits, perUser: make(map[string]int)}
+}
+
+// Admit counts a new session of kind against the user's concurrent session
+// cap. It returns false if the user is at the cap; otherwise release must
+// be called when the session ends.
+func (g *Guard) Admit(kind, userID string) (release func(), ok bool) {
+	if g == nil || g.limits.MaxPerUser <= 0 {
+		return func() {}, true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.perUser[userID] >= g.limits.MaxPerUser {
+		rejectedSessions.WithLabelValues(kind).Inc()
+		return nil, false
+	}
+	g.perUser[userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.perUser[userID]--; g.perUser[userID] <= 0 {
+				delete(g.perUser, userID)
+			}
+		})
+	}, true
+}
+
+// Watch enforces the idle timeout and maximum lifetime on a session until
+// ctx is done. Traffic is tracked through the returned connection, which
+// must be used in place of conn. When a limit is hit conn is closed and
+// cancel is called.
+func (g *Guard) Watch(ctx context.Context, kind string, conn net.Conn, cancel context.CancelFunc) net.Conn {
+	if g == nil || (g.limits.IdleTimeout <= 0 && g.limits.MaxLifetime <= 0) {
+		return conn
+	}
+
+	watched := &watchedConn{Conn: conn}
+	watched.touch()
+	go g.watch(ctx, kind, watched, cancel)
+	return watched
+}
+
+func (g *Guard) watch(ctx context.Context, kind string, conn *watchedConn, cancel context.CancelFunc) {
+	var lifetime <-chan time.Time
+	if g.limits.MaxLifetime > 0 {
+		timer := time.NewTimer(g.limits.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var idle <-chan time.Time
+	if g.limits.IdleTimeout > 0 {
+		ticker := time.NewTicker(idleCheckInterval(g.limits.IdleTimeout))
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	reason := ""
+	for reason == "" {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lifetime:
+			reason = ReasonMaxLifetime
+		case <-idle:
+			if conn.idleFor() >= g.limits.IdleTimeout {
+				reason = ReasonIdle
+			}
+		}
+	}
+
+	forcedCloses.WithLabelValues(kind, reason).Inc()
+	connctx.Logger(ctx).Infof("Closing %s session: %s limit reached", kind, reason)
+	cancel()
+	_ = conn.Close()
+}
+
+// Status returns the configured limits and the number of users with
+// sessions counted against the per-user cap
+func (g *Guard) Status() Status {
+	if g == nil {
+		return Status{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	status := Status{MaxPerUser: g.limits.MaxPerUser, Users: len(g.perUser)}
+	if g.limits.IdleTimeout > 0 {
+		status.IdleTimeout = g.limits.IdleTimeout.String()
+	}
+	if g.limits.MaxLifetime > 0 {
+		status.MaxLifetime = g.limits.MaxLifetime.String()
+	}
+	return status
+}
+
+// idleCheckInterval checks often enough to close an idle session within a
+// quarter of the timeout of it going idle
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// watchedConn records when traffic last crossed the client connection
+type watchedConn struct {
+	net.Conn
+	lastActive atomic.Int64
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// CloseWrite lets proxies half-close watched TCP connections
+func (c *watchedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *watchedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *watchedConn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
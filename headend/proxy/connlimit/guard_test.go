@@ -0,0 +1,112 @@
+package connlimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNilGuardEnforcesNothing(t *testing.T) {
+	guard := NewGuard(Limits{})
+	if guard != nil {
+		t.Fatal("expected no guard without limits")
+	}
+
+	release, ok := guard.Admit("tcp", "alice")
+	if !ok {
+		t.Fatal("nil guard refused a session")
+	}
+	release()
+
+	client, _ := net.Pipe()
+	defer client.Close()
+	if conn := guard.Watch(context.Background(), "tcp", client, func() {}); conn != client {
+		t.Error("nil guard wrapped the connection")
+	}
+}
+
+func TestAdmitCapsSessionsPerUser(t *testing.T) {
+	guard := NewGuard(Limits{MaxPerUser: 2})
+
+	first, ok := guard.Admit("tcp", "alice")
+	if !ok {
+		t.Fatal("first session refused")
+	}
+	if _, ok := guard.Admit("dynamic", "alice"); !ok {
+		t.Fatal("second session refused")
+	}
+	if _, ok := guard.Admit("tcp", "alice"); ok {
+		t.Fatal("third session admitted over the cap")
+	}
+	if _, ok := guard.Admit("tcp", "bob"); !ok {
+		t.Fatal("another user's session refused")
+	}
+
+	// Releasing twice must only free one slot
+	first()
+	first()
+	if _, ok := guard.Admit("tcp", "alice"); !ok {
+		t.Fatal("session refused after one was released")
+	}
+	if _, ok := guard.Admit("tcp", "alice"); ok {
+		t.Fatal("double release freed a second slot")
+	}
+}
+
+func TestWatchClosesIdleSession(t *testing.T) {
+	guard := NewGuard(Limits{IdleTimeout: 100 * time.Millisecond})
+
+	client, peer := net.Pipe()
+	defer peer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := guard.Watch(ctx, "tcp", client, cancel)
+
+	// Traffic keeps the session open past the timeout
+	go func() {
+		buffer := make([]byte, 16)
+		for {
+			if _, err := peer.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 6; i++ {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("active session closed: %v", err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	if _, err := conn.Write([]byte("late")); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+}
+
+func TestWatchClosesSessionAtMaxLifetime(t *testing.T) {
+	guard := NewGuard(Limits{MaxLifetime: 100 * time.Millisecond})
+
+	client, peer := net.Pipe()
+	defer peer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	conn := guard.Watch(ctx, "tcp", client, cancel)
+
+	buffer := make([]byte, 16)
+	if _, err := conn.Read(buffer); err == nil {
+		t.Fatal("expected the read to fail once the session was closed")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("session closed after %s, before its lifetime", elapsed)
+	}
+	if ctx.Err() == nil {
+		t.Error("expected the session context to be cancelled")
+	}
+}
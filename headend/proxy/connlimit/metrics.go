@@ -0,0 +1,18 @@
+package connlimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	forcedCloses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_tcp_sessions_forced_closed_total",
+		Help: "Total TCP sessions closed by a session limit, by kind (tcp, dynamic) and reason (idle, max_lifetime).",
+	}, []string{"kind", "reason"})
+
+	rejectedSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_tcp_sessions_rejected_total",
+		Help: "Total TCP sessions refused because the user was at the concurrent session limit, by kind.",
+	}, []string{"kind"})
+)
@@ -0,0 +1,220 @@
+// Package conntrack tracks the client-to-client sessions the SASEWaddle
+// headend forwards between WireGuard peers.
+//
+// The conntrack package provides:
+//   - A session table in the manner of the kernel's connection tracking:
+//     each session has its original tuple, as the client sent it, and its
+//     translated tuple, as the headend forwards it from its own address
+//   - Session states from new through established to closed, with the
+//     bytes carried each way once a session closes
+//   - A bound on the number of sessions; closed sessions linger briefly for
+//     inspection and are the first to go when the table is full
+//
+// Sessions are opened before the peer is dialed, so a full table refuses
+// them up front, and closed when the relay ends.
+package conntrack
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session states
+const (
+	StateNew         = "new"
+	StateEstablished = "established"
+	StateClosed      = "closed"
+)
+
+const (
+	// DefaultMaxSessions bounds the table, as nf_conntrack_max does
+	DefaultMaxSessions = 65536
+	// DefaultLinger keeps closed sessions listed for this long
+	DefaultLinger = 2 * time.Minute
+)
+
+// ErrTableFull refuses a session when every tracked session is still open
+var ErrTableFull = errors.New("peer session table is full")
+
+// Tuple identifies one direction of a flow
+type Tuple struct {
+	Protocol    string         `json:"protocol"`
+	Source      netip.AddrPort `json:"source"`
+	Destination netip.AddrPort `json:"destination"`
+}
+
+// Session is a tracked client-to-client session
+type Session struct {
+	ID     uint64 `json:"id"`
+	UserID string `json:"user_id"`
+	// Original is the flow as the client sent it
+	Original Tuple `json:"original"`
+	// Translated is the flow as forwarded to the peer, from the headend's
+	// address; it is set once the session is established
+	Translated *Tuple `json:"translated,omitempty"`
+	State      string `json:"state"`
+	// Rule is the firewall rule that allowed the session
+	Rule string `json:"rule,omitempty"`
+	// BytesOriginal were sent by the client and BytesReply by the peer,
+	// counted when the session closes
+	BytesOriginal int64      `json:"bytes_original"`
+	BytesReply    int64      `json:"bytes_reply"`
+	StartedAt     time.Time  `json:"started_at"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+}
+
+// Table is the session table. A nil Table tracks nothing.
+type Table struct {
+	max      int
+	linger   time.Duration
+	sessions map[uint64]*Session
+	nextID   uint64
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+// New creates a table of at most max sessions, listing closed ones for
+// linger. Zero values take the defaults.
+func New(max int, linger time.Duration) *Table {
+	if max <= 0 {
+		max = DefaultMaxSessions
+	}
+	if linger <= 0 {
+		linger = DefaultLinger
+	}
+	return &Table{max: max, linger: linger, sessions: make(map[uint64]*Session), now: time.Now}
+}
+
+// Entry is a session's handle in the table. A nil Entry ignores updates.
+type Entry struct {
+	table *Table
+	id    uint64
+}
+
+// Open tracks a new session of userID allowed by rule
+func (t *Table) Open(userID string, original Tuple, rule string) (*Entry, error) {
+	if t == nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.sessions) >= t.max {
+		t.expireLocked(now, true)
+		if len(t.sessions) >= t.max {
+			sessionsRejected.Inc()
+			return nil, ErrTableFull
+		}
+	}
+
+	t.nextID++
+	t.sessions[t.nextID] = &Session{
+		ID:        t.nextID,
+		UserID:    userID,
+		Original:  original,
+		State:     StateNew,
+		Rule:      rule,
+		StartedAt: now.UTC(),
+	}
+	t.updateGauges()
+	return &Entry{table: t, id: t.nextID}, nil
+}
+
+// Established records that the peer was reached with the translated tuple
+func (e *Entry) Established(translated Tuple) {
+	if e == nil {
+		return
+	}
+	e.table.mu.Lock()
+	defer e.table.mu.Unlock()
+	if session, ok := e.table.sessions[e.id]; ok && session.State == StateNew {
+		session.Translated = &translated
+		session.State = StateEstablished
+		e.table.updateGauges()
+	}
+}
+
+// Close records the end of the session and the bytes it carried
+func (e *Entry) Close(bytesOriginal, bytesReply int64) {
+	if e == nil {
+		return
+	}
+	e.table.mu.Lock()
+	defer e.table.mu.Unlock()
+	session, ok := e.table.sessions[e.id]
+	if !ok || session.State == StateClosed {
+		return
+	}
+	closedAt := e.table.now().UTC()
+	session.State = StateClosed
+	session.ClosedAt = &closedAt
+	session.BytesOriginal = bytesOriginal
+	session.BytesReply = bytesReply
+	e.table.updateGauges()
+}
+
+// List returns the tracked sessions, oldest first. A non-empty userID
+// selects the sessions of that user.
+func (t *Table) List(userID string) []Session {
+	sessions := []Session{}
+	if t == nil {
+		return sessions
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expireLocked(t.now(), false)
+	for _, session := range t.sessions {
+		if userID == "" || session.UserID == userID {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Len returns the number of open sessions. It is nil-safe.
+func (t *Table) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	open := 0
+	for _, session := range t.sessions {
+		if session.State != StateClosed {
+			open++
+		}
+	}
+	return open
+}
+
+// expireLocked forgets closed sessions that lingered long enough, or every
+// closed session if all is set; t.mu must be held
+func (t *Table) expireLocked(now time.Time, all bool) {
+	expired := false
+	for id, session := range t.sessions {
+		if session.State == StateClosed && (all || now.Sub(*session.ClosedAt) >= t.linger) {
+			delete(t.sessions, id)
+			expired = true
+		}
+	}
+	if expired {
+		t.updateGauges()
+	}
+}
+
+// updateGauges sets the per-state session gauges; t.mu must be held
+func (t *Table) updateGauges() {
+	counts := map[string]int{StateNew: 0, StateEstablished: 0, StateClosed: 0}
+	for _, session := range t.sessions {
+		counts[session.State]++
+	}
+	for state, count := range counts {
+		trackedSessions.WithLabelValues(state).Set(float64(count))
+	}
+}
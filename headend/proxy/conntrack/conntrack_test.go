@@ -0,0 +1,91 @@
+package conntrack
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func tuple(source, destination string) Tuple {
+	return Tuple{
+		Protocol:    "tcp",
+		Source:      netip.MustParseAddrPort(source),
+		Destination: netip.MustParseAddrPort(destination),
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	table := New(0, 0)
+	now := time.Unix(1700000000, 0)
+	table.now = func() time.Time { return now }
+
+	entry, err := table.Open("alice", tuple("10.200.0.2:51000", "10.200.0.3:22"), "ssh-peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions := table.List(""); len(sessions) != 1 || sessions[0].State != StateNew || sessions[0].Translated != nil {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	entry.Established(tuple("10.200.0.1:40000", "10.200.0.3:22"))
+	if table.Len() != 1 {
+		t.Errorf("expected one open session, got %d", table.Len())
+	}
+
+	entry.Close(1200, 3400)
+	sessions := table.List("alice")
+	if len(sessions) != 1 {
+		t.Fatalf("expected the closed session listed, got %+v", sessions)
+	}
+	session := sessions[0]
+	if session.State != StateClosed || session.BytesOriginal != 1200 || session.BytesReply != 3400 || session.ClosedAt == nil {
+		t.Errorf("unexpected closed session %+v", session)
+	}
+	if session.Translated == nil || session.Translated.Source.Port() != 40000 || session.Original.Destination.Port() != 22 {
+		t.Errorf("unexpected tuples %+v", session)
+	}
+	if table.Len() != 0 || len(table.List("bob")) != 0 {
+		t.Error("expected no open sessions and none for another user")
+	}
+
+	// Closed sessions are forgotten once they have lingered
+	now = now.Add(DefaultLinger)
+	if sessions := table.List(""); len(sessions) != 0 {
+		t.Errorf("expected the session expired, got %+v", sessions)
+	}
+}
+
+func TestTableFull(t *testing.T) {
+	table := New(2, time.Hour)
+
+	first, _ := table.Open("alice", tuple("10.200.0.2:51000", "10.200.0.3:22"), "")
+	if _, err := table.Open("alice", tuple("10.200.0.2:51001", "10.200.0.3:22"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Open("alice", tuple("10.200.0.2:51002", "10.200.0.3:22"), ""); !errors.Is(err, ErrTableFull) {
+		t.Fatalf("expected ErrTableFull, got %v", err)
+	}
+
+	// A closed session makes room even before it has lingered
+	first.Close(0, 0)
+	if _, err := table.Open("alice", tuple("10.200.0.2:51002", "10.200.0.3:22"), ""); err != nil {
+		t.Fatalf("expected the closed session evicted, got %v", err)
+	}
+	if sessions := table.List(""); len(sessions) != 2 || sessions[0].ID != 2 || sessions[1].ID != 3 {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+}
+
+func TestNilTable(t *testing.T) {
+	var table *Table
+	entry, err := table.Open("alice", tuple("10.200.0.2:51000", "10.200.0.3:22"), "")
+	if err != nil || entry != nil {
+		t.Fatalf("expected a nil table to track nothing, got %v %v", entry, err)
+	}
+	entry.Established(Tuple{})
+	entry.Close(0, 0)
+	if table.Len() != 0 || len(table.List("")) != 0 {
+		t.Error("expected a nil table to be empty")
+	}
+}
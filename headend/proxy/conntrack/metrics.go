@@ -0,0 +1,18 @@
+package conntrack
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	trackedSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_peer_sessions",
+		Help: "Client-to-client sessions in the session table, by state.",
+	}, []string{"state"})
+
+	sessionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_peer_sessions_rejected_total",
+		Help: "Total client-to-client sessions refused because the session table was full.",
+	})
+)
@@ -0,0 +1,182 @@
+// DNS server for tunnel clients.
+//
+// Clients are configured with the headend's tunnel address as their DNS
+// server. With dns.enabled, the headend answers there, forwarding to
+// dns.upstreams or its own resolvers, and checks each query against the
+// user's firewall rules first. Queries are attributed to users by tunnel
+// address, learned from the users' authenticated flows; dns.unknown_clients
+// decides what happens to queries from addresses no flow came from yet.
+// The dns_proxy feature flag rolls the service out per user.
+//
+// Upstreams may be DNS over HTTPS or TLS resolvers, so queries can't be
+// observed or altered between the headend and the resolver. The
+// dns.encryption settings require that for everyone, or for some users
+// and groups: their queries then only go to encrypted upstreams.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/connctx"
+	"github.com/tobogganing/headend/proxy/dnsproxy"
+	"github.com/tobogganing/libs/featureflag"
+	"github.com/tobogganing/libs/wgconfig"
+)
+
+// What the DNS server does with queries from unattributed addresses, set
+// with dns.unknown_clients
+const (
+	dnsUnknownAllow  = "allow"
+	dnsUnknownRefuse = "refuse"
+)
+
+// initializeDNSProxy starts the DNS server from dns.*
+func (s *ProxyServer) initializeDNSProxy() error {
+	unknown := strings.ToLower(viper.GetString("dns.unknown_clients"))
+	if unknown != dnsUnknownAllow && unknown != dnsUnknownRefuse {
+		return fmt.Errorf("invalid dns.unknown_clients %q: expected %s or %s", unknown, dnsUnknownAllow, dnsUnknownRefuse)
+	}
+
+	var networks []netip.Prefix
+	var listen []string
+	for _, network := range wireguardNetworks() {
+		headend, err := wgconfig.HeadendAddress(network)
+		if err != nil {
+			return fmt.Errorf("invalid WireGuard network %q: %w", network, err)
+		}
+		networks = append(networks, headend.Masked())
+		listen = append(listen, net.JoinHostPort(headend.Addr().String(), strconv.Itoa(dnsproxy.Port)))
+	}
+	if configured := viper.GetStringSlice("dns.listen"); len(configured) > 0 {
+		listen = configured
+	}
+
+	var tlsConfig *tls.Config
+	if caFile := viper.GetString("dns.tls_ca_file"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read dns.tls_ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in dns.tls_ca_file %s", caFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+
+	var upstreams []dnsproxy.Upstream
+	encrypted := false
+	for _, spec := range viper.GetStringSlice("dns.upstreams") {
+		upstream, err := dnsproxy.ParseUpstream(spec, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("invalid dns.upstreams entry: %w", err)
+		}
+		upstreams = append(upstreams, upstream)
+		encrypted = encrypted || upstream.Encrypted()
+	}
+	if !encrypted && (viper.GetBool("dns.encryption.required") ||
+		len(viper.GetStringSlice("dns.encryption.required_users")) > 0 ||
+		len(viper.GetStringSlice("dns.encryption.required_groups")) > 0) {
+		return fmt.Errorf("dns.encryption requires an https:// or tls:// resolver in dns.upstreams")
+	}
+	if len(upstreams) == 0 {
+		var err error
+		if upstreams, err = dnsproxy.SystemUpstreams(dnsproxy.ResolvConf); err != nil {
+			return fmt.Errorf("no dns.upstreams and no system resolvers: %w", err)
+		}
+	}
+
+	s.dnsIdentities = dnsproxy.NewIdentities(networks, viper.GetDuration("dns.identity_ttl"))
+	connctx.SetIdentityObserver(s.dnsIdentities)
+
+	server, err := dnsproxy.New(dnsproxy.Config{
+		Listen:    listen,
+		Upstreams: upstreams,
+		Timeout:   viper.GetDuration("dns.timeout"),
+		Cache: dnsproxy.NewCache(viper.GetInt("dns.cache_size"),
+			viper.GetDuration("dns.cache_max_ttl"), viper.GetDuration("dns.negative_ttl")),
+		Identities: s.dnsIdentities,
+		Policy:     s.dnsPolicy,
+		Events:     s.eventBus,
+	})
+	if err != nil {
+		return err
+	}
+	if err := server.Start(); err != nil {
+		return err
+	}
+	s.dnsProxy = server
+	return nil
+}
+
+// dnsPolicy decides a client's DNS query. Users outside the dns_proxy
+// rollout are refused. A name is denied when a rule denies it or a
+// temporary block covers it; names no rule matches still resolve, since
+// their addresses may be allowed by IP rules, and the proxies enforce the
+// rest when the client connects.
+func (s *ProxyServer) dnsPolicy(query dnsproxy.Query) dnsproxy.Verdict {
+	if query.User == nil {
+		if strings.ToLower(viper.GetString("dns.unknown_clients")) == dnsUnknownRefuse {
+			return dnsproxy.Verdict{Refused: true, Reason: "unknown_client"}
+		}
+		if !s.featureFlags.Enabled(featureflag.DNSProxy, s.featureFlags.Subject(headendID())) {
+			return dnsproxy.Verdict{Refused: true, Reason: "dns_proxy_disabled"}
+		}
+		return dnsproxy.Verdict{Allowed: true, RequireEncryption: dnsEncryptionRequired(nil)}
+	}
+
+	if !s.featureFlags.Enabled(featureflag.DNSProxy, userSubject(query.User)) {
+		return dnsproxy.Verdict{Refused: true, Reason: "dns_proxy_disabled"}
+	}
+	if s.firewallManager == nil {
+		return dnsproxy.Verdict{Allowed: true, RequireEncryption: dnsEncryptionRequired(query.User)}
+	}
+
+	decision := s.firewallManager.DecideWithGroups(query.User.ID, query.User.Groups, query.Name)
+	verdict := dnsproxy.Verdict{
+		Allowed:       decision.Allowed,
+		Reason:        decision.Reason,
+		Rule:          decision.RuleLabel(),
+		PolicyVersion: decision.PolicyVersion,
+		// Checked on every query so changes apply without a restart
+		RequireEncryption: dnsEncryptionRequired(query.User),
+	}
+	if !decision.Allowed && decision.MatchedRule == nil && !strings.HasPrefix(decision.Reason, "blocked_by_") {
+		verdict.Allowed = true
+	}
+	if !verdict.Allowed {
+		log.Debugf("DNS query of user %s for %s denied: %s", query.User.ID, query.Name, decision.Reason)
+	}
+	return verdict
+}
+
+// dnsEncryptionRequired reports whether the queries of user, nil for an
+// unattributed client, may only go to encrypted upstreams
+func dnsEncryptionRequired(user *auth.User) bool {
+	if viper.GetBool("dns.encryption.required") {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	if slices.Contains(viper.GetStringSlice("dns.encryption.required_users"), user.ID) {
+		return true
+	}
+	for _, group := range viper.GetStringSlice("dns.encryption.required_groups") {
+		if slices.Contains(user.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
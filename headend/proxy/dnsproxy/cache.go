@@ -0,0 +1,189 @@
+package dnsproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Cache defaults
+const (
+	DefaultCacheSize   = 10000
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 30 * time.Second
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	message dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+	// encrypted is set for responses that came over an encrypted upstream
+	encrypted bool
+}
+
+// Cache keeps upstream responses for as long as their records live, at
+// most maxTTL. Negative answers live for the SOA minimum of their zone, or
+// negativeTTL without one. A nil Cache keeps nothing.
+type Cache struct {
+	size        int
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+// NewCache creates a cache of up to size responses, or returns nil when
+// size is 0 or less
+func NewCache(size int, maxTTL, negativeTTL time.Duration) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	if maxTTL <= 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = DefaultNegativeTTL
+	}
+	return &Cache{
+		size:        size,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     make(map[cacheKey]*cacheEntry),
+	}
+}
+
+func keyOf(q dnsmessage.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+// Get returns the cached response to q with its TTLs counted down. With
+// encryptedOnly, responses that came over a plain upstream don't count.
+func (c *Cache) Get(q dnsmessage.Question, encryptedOnly bool) (dnsmessage.Message, bool) {
+	if c == nil {
+		return dnsmessage.Message{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := keyOf(q)
+	entry, ok := c.entries[key]
+	now := c.now()
+	if !ok || !now.Before(entry.expires) {
+		if ok {
+			delete(c.entries, key)
+		}
+		cacheLookups.WithLabelValues("miss").Inc()
+		return dnsmessage.Message{}, false
+	}
+	if encryptedOnly && !entry.encrypted {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return dnsmessage.Message{}, false
+	}
+	cacheLookups.WithLabelValues("hit").Inc()
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	message := entry.message
+	message.Answers = agedResources(entry.message.Answers, elapsed)
+	message.Authorities = agedResources(entry.message.Authorities, elapsed)
+	message.Additionals = agedResources(entry.message.Additionals, elapsed)
+	return message, true
+}
+
+// Put caches response to q, unless it is a failure or truncated. encrypted
+// tells whether it came over an encrypted upstream.
+func (c *Cache) Put(q dnsmessage.Question, response dnsmessage.Message, encrypted bool) {
+	if c == nil || response.Truncated {
+		return
+	}
+	ttl, ok := c.ttl(response)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= c.size {
+		c.evictLocked(now)
+	}
+	c.entries[keyOf(q)] = &cacheEntry{message: response, stored: now, expires: now.Add(ttl), encrypted: encrypted}
+	cacheEntries.Set(float64(len(c.entries)))
+}
+
+// ttl returns how long response may be cached
+func (c *Cache) ttl(response dnsmessage.Message) (time.Duration, bool) {
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	if response.RCode == dnsmessage.RCodeNameError || len(response.Answers) == 0 {
+		ttl := c.negativeTTL
+		for _, authority := range response.Authorities {
+			if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+				ttl = time.Duration(min(soa.MinTTL, authority.Header.TTL)) * time.Second
+			}
+		}
+		return min(ttl, c.maxTTL), true
+	}
+
+	ttl := c.maxTTL
+	for _, resources := range [][]dnsmessage.Resource{response.Answers, response.Authorities, response.Additionals} {
+		for _, resource := range resources {
+			if resource.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			ttl = min(ttl, time.Duration(resource.Header.TTL)*time.Second)
+		}
+	}
+	return ttl, true
+}
+
+// evictLocked makes room for an entry: expired ones go first, then any.
+// The caller holds c.mu.
+func (c *Cache) evictLocked(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// agedResources copies resources with elapsed seconds taken off their TTLs
+func agedResources(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(resources) == 0 {
+		return nil
+	}
+	aged := make([]dnsmessage.Resource, len(resources))
+	copy(aged, resources)
+	for i := range aged {
+		// The TTL field of an OPT record carries flags
+		if aged[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if aged[i].Header.TTL > elapsed {
+			aged[i].Header.TTL -= elapsed
+		} else {
+			aged[i].Header.TTL = 0
+		}
+	}
+	return aged
+}
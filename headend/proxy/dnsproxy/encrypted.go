@@ -0,0 +1,230 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// TLSPort is the DNS-over-TLS port
+	TLSPort = 853
+
+	// dnsMessageType is the media type of DNS-over-HTTPS bodies
+	dnsMessageType = "application/dns-message"
+
+	// maxIdleTLSConns is how many DNS-over-TLS connections are kept open
+	// per resolver between queries
+	maxIdleTLSConns = 4
+	// tlsIdleTimeout drops kept connections resolvers have likely closed
+	tlsIdleTimeout = 10 * time.Second
+)
+
+// errNoEncryptedUpstream fails queries that must be encrypted when only
+// plain resolvers are configured
+var errNoEncryptedUpstream = errors.New("no encrypted upstream resolver")
+
+// parseEncryptedUpstream parses the resolvers spoken to over TLS:
+// https://host/path for DNS over HTTPS, and tls://host[:port] for DNS over
+// TLS, where ?server_name= sets the name to verify when host is an IP
+// without one in its certificate
+func parseEncryptedUpstream(u *url.URL, config *tls.Config) (Upstream, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("resolver %q has no host", u.String())
+	}
+	switch u.Scheme {
+	case "https":
+		return newHTTPSUpstream(u.String(), config), nil
+
+	case "tls":
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), fmt.Sprint(TLSPort))
+		}
+		serverName := u.Query().Get("server_name")
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		return newTLSUpstream(address, serverName, config), nil
+	}
+	return nil, fmt.Errorf("unsupported resolver %q", u.String())
+}
+
+// httpsUpstream is a DNS-over-HTTPS resolver (RFC 8484)
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSUpstream(endpoint string, config *tls.Config) *httpsUpstream {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config != nil {
+		tlsConfig = config.Clone()
+	}
+	return &httpsUpstream{
+		url: endpoint,
+		client: &http.Client{Transport: &http.Transport{
+			// Queries never go through an HTTP proxy, which would see them
+			Proxy:               nil,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: maxIdleTLSConns,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+	}
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) Encrypted() bool { return true }
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query too short")
+	}
+	// The ID is sent as 0 so identical queries are cacheable by HTTP, and
+	// restored in the response
+	id := binary.BigEndian.Uint16(query)
+	body := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(body, 0)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != dnsMessageType {
+		return nil, fmt.Errorf("unexpected content type %q", contentType)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 || len(response) > maxMessageSize {
+		return nil, fmt.Errorf("invalid response of %d bytes", len(response))
+	}
+	binary.BigEndian.PutUint16(response, id)
+	return response, nil
+}
+
+type idleTLSConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// tlsUpstream is a DNS-over-TLS resolver (RFC 7858). Connections are kept
+// open between queries to spare a handshake per query.
+type tlsUpstream struct {
+	address string
+	dialer  tls.Dialer
+
+	mu   sync.Mutex
+	idle []idleTLSConn
+}
+
+func newTLSUpstream(address, serverName string, config *tls.Config) *tlsUpstream {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config != nil {
+		tlsConfig = config.Clone()
+	}
+	tlsConfig.ServerName = serverName
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(maxIdleTLSConns)
+	}
+	return &tlsUpstream{
+		address: address,
+		dialer:  tls.Dialer{NetDialer: &net.Dialer{}, Config: tlsConfig},
+	}
+}
+
+func (u *tlsUpstream) String() string { return "tls://" + u.address }
+
+func (u *tlsUpstream) Encrypted() bool { return true }
+
+func (u *tlsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	for {
+		conn, reused, err := u.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err := u.exchange(ctx, conn, query)
+		if err == nil {
+			u.release(conn)
+			return response, nil
+		}
+		_ = conn.Close()
+		// The resolver may have closed a kept connection; retry those on
+		// a new one
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *tlsUpstream) exchange(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	setDeadline(ctx, conn)
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	for {
+		response, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		// A late answer to a query that timed out on this connection
+		if len(response) < 12 || binary.BigEndian.Uint16(response) != binary.BigEndian.Uint16(query) {
+			continue
+		}
+		return response, nil
+	}
+}
+
+// conn returns a kept connection, or dials a new one
+func (u *tlsUpstream) conn(ctx context.Context) (net.Conn, bool, error) {
+	u.mu.Lock()
+	for len(u.idle) > 0 {
+		last := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(last.since) < tlsIdleTimeout {
+			u.mu.Unlock()
+			return last.conn, true, nil
+		}
+		_ = last.conn.Close()
+	}
+	u.mu.Unlock()
+
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.address)
+	return conn, false, err
+}
+
+// release keeps conn for the next query
+func (u *tlsUpstream) release(conn net.Conn) {
+	_ = conn.SetDeadline(time.Time{})
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= maxIdleTLSConns {
+		_ = conn.Close()
+		return
+	}
+	u.idle = append(u.idle, idleTLSConn{conn: conn, since: time.Now()})
+}
@@ -0,0 +1,176 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// trusting returns a TLS configuration trusting the test server's
+// certificate, which is valid for example.com and 127.0.0.1
+func trusting(server *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	resolver := &fakeUpstream{ttl: 60}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != "POST" || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dnsMessageType ||
+			len(query) < 12 || binary.BigEndian.Uint16(query) != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response, _ := resolver.Exchange(r.Context(), query)
+		w.Header().Set("Content-Type", dnsMessageType)
+		_, _ = w.Write(response)
+	}))
+	defer server.Close()
+
+	upstream, err := ParseUpstream(server.URL+"/dns-query", trusting(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := upstream.Exchange(context.Background(), newQuery(t, 0x1234, "example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := unpack(t, answer); response.ID != 0x1234 || len(response.Answers) != 1 {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	// Resolvers with untrusted certificates aren't used
+	untrusted, _ := ParseUpstream(server.URL+"/dns-query", nil)
+	if _, err := untrusted.Exchange(context.Background(), newQuery(t, 1, "example.com.")); err == nil {
+		t.Error("expected an untrusted certificate rejected")
+	}
+}
+
+func TestTLSUpstreamKeepsConnections(t *testing.T) {
+	certificates := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certificates.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certificates.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The resolver answers up to two queries per connection
+	resolver := &fakeUpstream{ttl: 60}
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for i := 0; i < 2; i++ {
+					query, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					response, _ := resolver.Exchange(context.Background(), query)
+					_ = writeTCPMessage(conn, response)
+				}
+			}()
+		}
+	}()
+
+	upstream, err := ParseUpstream("tls://"+listener.Addr().String()+"?server_name=example.com", trusting(certificates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint16(1); id <= 3; id++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		answer, err := upstream.Exchange(ctx, newQuery(t, id, "example.com."))
+		cancel()
+		if err != nil {
+			t.Fatalf("query %d failed: %v", id, err)
+		}
+		if response := unpack(t, answer); response.ID != id || len(response.Answers) != 1 {
+			t.Errorf("unexpected response %+v", response)
+		}
+	}
+	// The third query found the kept connection closed and dialed again
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("expected 2 connections for 3 queries, got %d", n)
+	}
+}
+
+func TestParseEncryptedUpstreams(t *testing.T) {
+	for spec, want := range map[string]string{
+		"tls://1.1.1.1":                     "tls://1.1.1.1:853",
+		"tls://[2606:4700::1111]:8853":      "tls://[2606:4700::1111]:8853",
+		"https://dns.example.com/dns-query": "https://dns.example.com/dns-query",
+	} {
+		upstream, err := ParseUpstream(spec, nil)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if upstream.String() != want || !upstream.Encrypted() {
+			t.Errorf("%s: got %s", spec, upstream)
+		}
+	}
+
+	upstream, _ := ParseUpstream("tls://1.1.1.1?server_name=one.one.one.one", nil)
+	if name := upstream.(*tlsUpstream).dialer.Config.ServerName; name != "one.one.one.one" {
+		t.Errorf("expected the configured server name, got %q", name)
+	}
+	if _, err := ParseUpstream("tls://", nil); err == nil {
+		t.Error("expected a resolver without a host rejected")
+	}
+	if upstream, _ := ParseUpstream("10.0.0.53", nil); upstream.Encrypted() {
+		t.Error("expected a plain resolver")
+	}
+}
+
+func TestResolveRequiresEncryption(t *testing.T) {
+	plain := &fakeUpstream{ttl: 300}
+	encrypted := &fakeUpstream{ttl: 300, encrypted: true}
+	require := false
+	server, err := New(Config{
+		Listen:    []string{"127.0.0.1:0"},
+		Upstreams: []Upstream{plain, encrypted},
+		Cache:     NewCache(100, time.Hour, time.Minute),
+		Policy: func(Query) Verdict {
+			return Verdict{Allowed: true, RequireEncryption: require}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Resolve(context.Background(), newQuery(t, 1, "example.com."), client, minUDPSize)
+	if plain.queries != 1 || encrypted.queries != 0 {
+		t.Fatalf("expected the first upstream used, got %d plain and %d encrypted", plain.queries, encrypted.queries)
+	}
+
+	// The answer cached from the plain upstream isn't trusted either
+	require = true
+	response := unpack(t, server.Resolve(context.Background(), newQuery(t, 2, "example.com."), client, minUDPSize))
+	if response.RCode != dnsmessage.RCodeSuccess || plain.queries != 1 || encrypted.queries != 1 {
+		t.Errorf("expected the encrypted upstream used, got %d plain and %d encrypted", plain.queries, encrypted.queries)
+	}
+
+	server.cfg.Upstreams = []Upstream{plain}
+	response = unpack(t, server.Resolve(context.Background(), newQuery(t, 3, "other.example.com."), netip.MustParseAddr("10.200.1.3"), minUDPSize))
+	if response.RCode != dnsmessage.RCodeServerFailure || plain.queries != 1 {
+		t.Errorf("expected SERVFAIL without an encrypted upstream, got %v", response.RCode)
+	}
+}
@@ -0,0 +1,120 @@
+package dnsproxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/auth"
+)
+
+// DefaultIdentityTTL is how long a tunnel address stays attributed to a
+// user after its last authenticated flow
+const DefaultIdentityTTL = 24 * time.Hour
+
+// observeInterval is how often a repeated flow refreshes its identity
+const observeInterval = time.Minute
+
+type identity struct {
+	user auth.User
+	seen time.Time
+}
+
+// Identities maps tunnel addresses to the users behind them. DNS queries
+// carry no credentials, so they are attributed to the user whose
+// authenticated flows came from the same address.
+type Identities struct {
+	networks []netip.Prefix
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.RWMutex
+	users map[netip.Addr]identity
+}
+
+// NewIdentities creates a table of the addresses in networks, the
+// WireGuard networks clients are addressed from
+func NewIdentities(networks []netip.Prefix, ttl time.Duration) *Identities {
+	if ttl <= 0 {
+		ttl = DefaultIdentityTTL
+	}
+	return &Identities{
+		networks: networks,
+		ttl:      ttl,
+		now:      time.Now,
+		users:    make(map[netip.Addr]identity),
+	}
+}
+
+// Observe records that user sent a flow from source, an address with or
+// without a port. Addresses outside the tunnel networks are ignored.
+func (i *Identities) Observe(source string, user *auth.User) {
+	if i == nil || user == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return
+	}
+	addr = addr.Unmap()
+	if !i.inNetworks(addr) {
+		return
+	}
+
+	now := i.now()
+	i.mu.RLock()
+	known, ok := i.users[addr]
+	i.mu.RUnlock()
+	if ok && known.user.ID == user.ID && now.Sub(known.seen) < observeInterval {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.users[addr] = identity{user: *user, seen: now}
+}
+
+// Lookup returns the user last seen at addr, or nil
+func (i *Identities) Lookup(addr netip.Addr) *auth.User {
+	if i == nil {
+		return nil
+	}
+	i.mu.RLock()
+	known, ok := i.users[addr.Unmap()]
+	i.mu.RUnlock()
+	if !ok || i.now().Sub(known.seen) >= i.ttl {
+		return nil
+	}
+	user := known.user
+	return &user
+}
+
+// Prune forgets addresses not seen for the TTL
+func (i *Identities) Prune() {
+	if i == nil {
+		return
+	}
+	now := i.now()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for addr, known := range i.users {
+		if now.Sub(known.seen) >= i.ttl {
+			delete(i.users, addr)
+		}
+	}
+	identitiesKnown.Set(float64(len(i.users)))
+}
+
+func (i *Identities) inNetworks(addr netip.Addr) bool {
+	for _, network := range i.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
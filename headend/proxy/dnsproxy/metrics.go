@@ -0,0 +1,34 @@
+package dnsproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_dns_queries_total",
+		Help: "Total DNS queries from tunnel clients, by result: forwarded, cached, blocked, refused, failed, malformed or not_implemented.",
+	}, []string{"result"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "headend_dns_upstream_duration_seconds",
+		Help:    "Time taken by upstream resolvers to answer forwarded queries, by upstream and result.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"upstream", "result"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_dns_cache_lookups_total",
+		Help: "Total DNS cache lookups, by result: hit or miss.",
+	}, []string{"result"})
+
+	cacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_dns_cache_entries",
+		Help: "Responses in the DNS cache.",
+	})
+
+	identitiesKnown = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_dns_identities",
+		Help: "Tunnel addresses the DNS server attributes to users.",
+	})
+)
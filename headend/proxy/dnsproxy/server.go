@@ -0,0 +1,468 @@
+// Package dnsproxy answers the DNS queries of tunnel clients on the
+// SASEWaddle headend.
+//
+// The dnsproxy package provides:
+//   - A DNS server over UDP and TCP at the address clients are configured
+//     to use, the headend's address in each WireGuard network
+//   - Forwarding to configured resolvers, or to the headend's own from
+//     /etc/resolv.conf, in the clear or over DNS over HTTPS or TLS
+//   - Per-user policy at resolution time, with clients identified by their
+//     tunnel address as learned from their authenticated flows
+//   - A response cache honouring record TTLs
+//   - A verdict event per query, which reaches syslog like proxied flows
+//
+// The policy is supplied by the headend; the server only asks it about
+// each query and answers NXDOMAIN, or REFUSED, when it says no. The policy
+// can also require a query to be encrypted, in which case only encrypted
+// resolvers, and cached answers that came from one, are used.
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/events"
+)
+
+// DefaultTimeout bounds forwarding a query to the upstreams
+const DefaultTimeout = 5 * time.Second
+
+// Port is the DNS port
+const Port = 53
+
+const (
+	// minUDPSize is the UDP response size every client accepts
+	minUDPSize = 512
+	// tcpIdleTimeout closes TCP connections without a query for this long
+	tcpIdleTimeout = 10 * time.Second
+	// pruneInterval is how often stale identities are forgotten
+	pruneInterval = 10 * time.Minute
+)
+
+// Query is a DNS question from a tunnel client
+type Query struct {
+	// Name is the queried name in lower case, without the trailing dot
+	Name string
+	// Type is the record type, such as A or AAAA
+	Type   string
+	Source netip.Addr
+	// User is nil when no authenticated flow came from Source
+	User *auth.User
+}
+
+// Verdict is the policy's answer to a query
+type Verdict struct {
+	Allowed bool
+	// Refused answers REFUSED rather than NXDOMAIN, for clients that are
+	// not served at all rather than denied the name
+	Refused       bool
+	Reason        string
+	Rule          string
+	PolicyVersion string
+	// RequireEncryption forwards the query only to encrypted resolvers
+	RequireEncryption bool
+}
+
+// Policy decides whether a query is answered
+type Policy func(query Query) Verdict
+
+// Config configures a Server
+type Config struct {
+	// Listen are the host:port addresses served over UDP and TCP
+	Listen    []string
+	Upstreams []Upstream
+	// Timeout bounds forwarding a query, DefaultTimeout if zero
+	Timeout    time.Duration
+	Cache      *Cache
+	Identities *Identities
+	// Policy decides each query; nil answers every one
+	Policy Policy
+	// Events receives a verdict event per query; nil publishes none
+	Events *events.Bus
+}
+
+// Server is the headend's DNS server
+type Server struct {
+	cfg Config
+
+	mu        sync.Mutex
+	packets   []net.PacketConn
+	listeners []net.Listener
+	wg        sync.WaitGroup
+	// ctx is cancelled by Stop
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+}
+
+// New creates a server for cfg
+func New(cfg Config) (*Server, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, errors.New("no upstream resolvers")
+	}
+	if len(cfg.Listen) == 0 {
+		return nil, errors.New("no listen addresses")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{cfg: cfg, ctx: ctx, cancel: cancel}, nil
+}
+
+// Start opens the listeners. Addresses that can't be bound are skipped
+// with a warning; it fails only if none could be.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, address := range s.cfg.Listen {
+		packet, err := net.ListenPacket("udp", address)
+		if err != nil {
+			log.Warnf("DNS server not listening on %s/udp: %v", address, err)
+		} else {
+			s.packets = append(s.packets, packet)
+			s.wg.Add(1)
+			go s.serveUDP(packet)
+		}
+
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Warnf("DNS server not listening on %s/tcp: %v", address, err)
+		} else {
+			s.listeners = append(s.listeners, listener)
+			s.wg.Add(1)
+			go s.serveTCP(listener)
+		}
+	}
+	if len(s.packets) == 0 && len(s.listeners) == 0 {
+		return fmt.Errorf("could not listen on any of %s", strings.Join(s.cfg.Listen, ", "))
+	}
+
+	s.wg.Add(1)
+	go s.pruneLoop()
+	log.Infof("DNS server listening on %s, forwarding to %s", strings.Join(s.cfg.Listen, ", "), s.upstreamNames())
+	return nil
+}
+
+// Stop closes the listeners and waits for queries in flight
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		s.cancel()
+		s.mu.Lock()
+		for _, packet := range s.packets {
+			_ = packet.Close()
+		}
+		for _, listener := range s.listeners {
+			_ = listener.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	})
+}
+
+// Addrs returns the addresses the server answers UDP queries on
+func (s *Server) Addrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, 0, len(s.packets))
+	for _, packet := range s.packets {
+		addrs = append(addrs, packet.LocalAddr().String())
+	}
+	return addrs
+}
+
+func (s *Server) upstreamNames() string {
+	names := make([]string, 0, len(s.cfg.Upstreams))
+	for _, upstream := range s.cfg.Upstreams {
+		names = append(names, upstream.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func (s *Server) pruneLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.cfg.Identities.Prune()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) {
+	defer s.wg.Done()
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Debugf("DNS read error: %v", err)
+			continue
+		}
+		query := append([]byte(nil), buffer[:n]...)
+		source := addrOf(from)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if response := s.Resolve(s.ctx, query, source, udpSize(query)); response != nil {
+				_, _ = conn.WriteTo(response, from)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Debugf("DNS accept error: %v", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP answers the queries of one TCP connection until it goes idle
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	source := addrOf(conn.RemoteAddr())
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		response := s.Resolve(s.ctx, query, source, maxMessageSize)
+		if response == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// Resolve answers a packed query from source with a response of at most
+// maxSize bytes, or returns nil when it can't be answered at all
+func (s *Server) Resolve(ctx context.Context, query []byte, source netip.Addr, maxSize int) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		queriesTotal.WithLabelValues("malformed").Inc()
+		return nil
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil || header.Response || len(questions) != 1 {
+		queriesTotal.WithLabelValues("malformed").Inc()
+		return reply(header, questions, dnsmessage.RCodeFormatError)
+	}
+	if header.OpCode != 0 {
+		queriesTotal.WithLabelValues("not_implemented").Inc()
+		return reply(header, questions, dnsmessage.RCodeNotImplemented)
+	}
+
+	question := questions[0]
+	q := Query{
+		Name:   strings.ToLower(strings.TrimSuffix(question.Name.String(), ".")),
+		Type:   strings.TrimPrefix(question.Type.String(), "Type"),
+		Source: source,
+		User:   s.cfg.Identities.Lookup(source),
+	}
+	verdict := Verdict{Allowed: true}
+	if s.cfg.Policy != nil {
+		verdict = s.cfg.Policy(q)
+	}
+	s.publish(q, verdict)
+	if !verdict.Allowed {
+		if verdict.Refused {
+			queriesTotal.WithLabelValues("refused").Inc()
+			return reply(header, questions, dnsmessage.RCodeRefused)
+		}
+		queriesTotal.WithLabelValues("blocked").Inc()
+		return reply(header, questions, dnsmessage.RCodeNameError)
+	}
+
+	if cached, ok := s.cfg.Cache.Get(question, verdict.RequireEncryption); ok {
+		cached.ID = header.ID
+		cached.RecursionDesired = header.RecursionDesired
+		if response, err := cached.Pack(); err == nil {
+			queriesTotal.WithLabelValues("cached").Inc()
+			return fit(response, maxSize)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	response, encrypted, err := s.forward(ctx, query, verdict.RequireEncryption)
+	if err != nil {
+		log.Debugf("DNS query for %s %s failed: %v", q.Type, q.Name, err)
+		queriesTotal.WithLabelValues("failed").Inc()
+		return reply(header, questions, dnsmessage.RCodeServerFailure)
+	}
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err == nil {
+		s.cfg.Cache.Put(question, message, encrypted)
+	}
+	queriesTotal.WithLabelValues("forwarded").Inc()
+	return fit(response, maxSize)
+}
+
+// forward asks the upstreams in turn until one answers, only the encrypted
+// ones if encryptedOnly is set. It reports whether the answer came over an
+// encrypted upstream.
+func (s *Server) forward(ctx context.Context, query []byte, encryptedOnly bool) ([]byte, bool, error) {
+	lastErr := errNoEncryptedUpstream
+	for _, upstream := range s.cfg.Upstreams {
+		if encryptedOnly && !upstream.Encrypted() {
+			continue
+		}
+		start := time.Now()
+		response, err := upstream.Exchange(ctx, query)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		upstreamDuration.WithLabelValues(upstream.String(), result).Observe(time.Since(start).Seconds())
+		if err == nil {
+			return response, upstream.Encrypted(), nil
+		}
+		lastErr = fmt.Errorf("%s: %w", upstream, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, false, lastErr
+}
+
+// publish reports the verdict on q, for syslog and the access log
+func (s *Server) publish(q Query, verdict Verdict) {
+	if s.cfg.Events == nil {
+		return
+	}
+	event := events.Event{
+		Type:          events.TypeVerdict,
+		SourceIP:      q.Source.String(),
+		TargetHost:    q.Name,
+		Protocol:      "DNS",
+		Port:          Port,
+		Method:        q.Type,
+		Allowed:       verdict.Allowed,
+		Rule:          verdict.Rule,
+		PolicyVersion: verdict.PolicyVersion,
+	}
+	if q.User != nil {
+		event.UserID = q.User.ID
+		event.Username = q.User.Name
+	}
+	if !verdict.Allowed {
+		event.Reason = verdict.Reason
+	}
+	s.cfg.Events.Publish(event)
+}
+
+// reply builds an answerless response with rcode
+func reply(header dnsmessage.Header, questions []dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: questions,
+	}
+	response, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// fit truncates response to its question when it's larger than maxSize,
+// setting TC so the client retries over TCP
+func fit(response []byte, maxSize int) []byte {
+	if len(response) <= maxSize {
+		return response
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil
+	}
+	questions, _ := parser.AllQuestions()
+	header.Truncated = true
+	message := dnsmessage.Message{Header: header, Questions: questions}
+	truncated, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return truncated
+}
+
+// udpSize returns the largest UDP response the client of query accepts:
+// the size its EDNS record advertises, or 512 bytes
+func udpSize(query []byte) int {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return minUDPSize
+	}
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return minUDPSize
+	}
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if header.Type == dnsmessage.TypeOPT {
+			// The class of an OPT record is the UDP payload size
+			return max(minUDPSize, int(header.Class))
+		}
+		if parser.SkipAdditional() != nil {
+			return minUDPSize
+		}
+	}
+}
+
+// addrOf returns the IP address of addr
+func addrOf(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
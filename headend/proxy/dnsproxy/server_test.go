@@ -0,0 +1,294 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/tobogganing/headend/proxy/auth"
+)
+
+// fakeUpstream answers A queries with addresses from 192.0.2.0/24 and
+// counts the queries it gets
+type fakeUpstream struct {
+	queries   int
+	ttl       uint32
+	answers   int
+	err       error
+	encrypted bool
+}
+
+func (f *fakeUpstream) String() string { return "fake" }
+
+func (f *fakeUpstream) Encrypted() bool { return f.encrypted }
+
+func (f *fakeUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	f.queries++
+	if f.err != nil {
+		return nil, f.err
+	}
+	var message dnsmessage.Message
+	if err := message.Unpack(query); err != nil {
+		return nil, err
+	}
+	message.Response = true
+	message.RecursionAvailable = true
+	question := message.Questions[0]
+	for i := 0; i < max(f.answers, 1); i++ {
+		message.Answers = append(message.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: f.ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}},
+		})
+	}
+	return message.Pack()
+}
+
+func newQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func unpack(t *testing.T, response []byte) dnsmessage.Message {
+	t.Helper()
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return message
+}
+
+var client = netip.MustParseAddr("10.200.1.2")
+
+func newServer(t *testing.T, upstream Upstream, policy Policy) *Server {
+	t.Helper()
+	server, err := New(Config{
+		Listen:     []string{"127.0.0.1:0"},
+		Upstreams:  []Upstream{upstream},
+		Cache:      NewCache(100, time.Hour, time.Minute),
+		Identities: NewIdentities([]netip.Prefix{netip.MustParsePrefix("10.200.0.0/16")}, time.Hour),
+		Policy:     policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestResolveForwardsAndCaches(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	server := newServer(t, upstream, nil)
+
+	response := unpack(t, server.Resolve(context.Background(), newQuery(t, 1, "example.com."), client, minUDPSize))
+	if response.ID != 1 || response.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 1 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	now := time.Now()
+	server.cfg.Cache.now = func() time.Time { return now.Add(100 * time.Second) }
+	response = unpack(t, server.Resolve(context.Background(), newQuery(t, 2, "EXAMPLE.com."), client, minUDPSize))
+	if upstream.queries != 1 {
+		t.Errorf("expected the second query answered from the cache, upstream got %d", upstream.queries)
+	}
+	if response.ID != 2 || len(response.Answers) != 1 {
+		t.Fatalf("unexpected cached response %+v", response)
+	}
+	if ttl := response.Answers[0].Header.TTL; ttl > 200 || ttl < 199 {
+		t.Errorf("expected the cached TTL counted down to 200, got %d", ttl)
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	var seen Query
+	server := newServer(t, upstream, func(q Query) Verdict {
+		seen = q
+		switch q.Name {
+		case "blocked.example.com":
+			return Verdict{Reason: "rule_deny"}
+		case "refused.example.com":
+			return Verdict{Refused: true}
+		}
+		return Verdict{Allowed: true}
+	})
+	server.cfg.Identities.Observe("10.200.1.2:40000", &auth.User{ID: "alice", Groups: []string{"eng"}})
+
+	response := unpack(t, server.Resolve(context.Background(), newQuery(t, 1, "Blocked.Example.com."), client, minUDPSize))
+	if response.RCode != dnsmessage.RCodeNameError || len(response.Questions) != 1 {
+		t.Errorf("expected NXDOMAIN for a denied name, got %+v", response.Header)
+	}
+	if seen.Name != "blocked.example.com" || seen.Type != "A" || seen.User == nil || seen.User.ID != "alice" {
+		t.Errorf("unexpected query given to the policy %+v", seen)
+	}
+
+	response = unpack(t, server.Resolve(context.Background(), newQuery(t, 2, "refused.example.com."), client, minUDPSize))
+	if response.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("expected REFUSED, got %v", response.RCode)
+	}
+	if upstream.queries != 0 {
+		t.Errorf("expected no forwarded query, got %d", upstream.queries)
+	}
+
+	// Addresses no flow came from have no user
+	server.Resolve(context.Background(), newQuery(t, 3, "example.com."), netip.MustParseAddr("10.200.9.9"), minUDPSize)
+	if seen.User != nil {
+		t.Errorf("expected no user for an unknown address, got %+v", seen.User)
+	}
+}
+
+func TestResolveFailures(t *testing.T) {
+	server := newServer(t, &fakeUpstream{err: errors.New("unreachable")}, nil)
+
+	response := unpack(t, server.Resolve(context.Background(), newQuery(t, 7, "example.com."), client, minUDPSize))
+	if response.ID != 7 || response.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %+v", response.Header)
+	}
+	if server.Resolve(context.Background(), []byte{1, 2, 3}, client, minUDPSize) != nil {
+		t.Error("expected no answer to a malformed query")
+	}
+}
+
+func TestResolveTruncatesLargeUDPResponses(t *testing.T) {
+	server := newServer(t, &fakeUpstream{ttl: 300, answers: 40}, nil)
+
+	response := unpack(t, server.Resolve(context.Background(), newQuery(t, 1, "big.example.com."), client, minUDPSize))
+	if !response.Truncated || len(response.Answers) != 0 || len(response.Questions) != 1 {
+		t.Errorf("expected a truncated response, got %+v", response.Header)
+	}
+	response = unpack(t, server.Resolve(context.Background(), newQuery(t, 2, "big.example.com."), client, maxMessageSize))
+	if response.Truncated || len(response.Answers) != 40 {
+		t.Errorf("expected the full response over TCP, got %d answers", len(response.Answers))
+	}
+}
+
+func TestServerOverUDPAndTCP(t *testing.T) {
+	server := newServer(t, &fakeUpstream{ttl: 60}, nil)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	udpAddr := server.Addrs()[0]
+	tcpAddr := server.listeners[0].Addr().String()
+
+	answer, err := (&plainUpstream{address: udpAddr}).Exchange(context.Background(), newQuery(t, 9, "example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := unpack(t, answer); response.ID != 9 || len(response.Answers) != 1 {
+		t.Errorf("unexpected UDP response %+v", response)
+	}
+
+	answer, err = (&plainUpstream{address: tcpAddr}).exchangeTCP(context.Background(), newQuery(t, 10, "example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := unpack(t, answer); response.ID != 10 || len(response.Answers) != 1 {
+		t.Errorf("unexpected TCP response %+v", response)
+	}
+}
+
+func TestNegativeAnswersUseSOAMinimum(t *testing.T) {
+	cache := NewCache(10, time.Hour, time.Minute)
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("missing.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: []dnsmessage.Question{question},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("admin.example.com."), MinTTL: 5},
+		}},
+	}
+	if ttl, ok := cache.ttl(response); !ok || ttl != 5*time.Second {
+		t.Errorf("expected the SOA minimum, got %v %v", ttl, ok)
+	}
+
+	response.RCode = dnsmessage.RCodeServerFailure
+	cache.Put(question, response, true)
+	if _, ok := cache.Get(question, false); ok {
+		t.Error("expected failures not cached")
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	identities := NewIdentities([]netip.Prefix{netip.MustParsePrefix("10.200.0.0/16"), netip.MustParsePrefix("fd00:200::/64")}, time.Hour)
+	now := time.Now()
+	identities.now = func() time.Time { return now }
+
+	identities.Observe("10.200.1.2:5000", &auth.User{ID: "alice"})
+	identities.Observe("[fd00:200::102]:5000", &auth.User{ID: "alice"})
+	identities.Observe("203.0.113.7:5000", &auth.User{ID: "mallory"})
+
+	if user := identities.Lookup(netip.MustParseAddr("10.200.1.2")); user == nil || user.ID != "alice" {
+		t.Errorf("expected alice at her IPv4 address, got %+v", user)
+	}
+	if user := identities.Lookup(netip.MustParseAddr("fd00:200::102")); user == nil || user.ID != "alice" {
+		t.Errorf("expected alice at her IPv6 address, got %+v", user)
+	}
+	if identities.Lookup(netip.MustParseAddr("203.0.113.7")) != nil {
+		t.Error("expected addresses outside the tunnel ignored")
+	}
+
+	// A new user of the address takes it over at once
+	identities.Observe("10.200.1.2:5001", &auth.User{ID: "bob"})
+	if user := identities.Lookup(netip.MustParseAddr("10.200.1.2")); user == nil || user.ID != "bob" {
+		t.Errorf("expected bob, got %+v", user)
+	}
+
+	now = now.Add(time.Hour)
+	if identities.Lookup(netip.MustParseAddr("10.200.1.2")) != nil {
+		t.Error("expected the identity to expire")
+	}
+	identities.Prune()
+	if len(identities.users) != 0 {
+		t.Errorf("expected stale identities pruned, %d left", len(identities.users))
+	}
+}
+
+func TestSystemUpstreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "# generated\nsearch example.com\nnameserver 10.0.0.53\nnameserver fe80::1%eth0\nnameserver [2001:db8::53]:5353\n"
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upstreams, err := SystemUpstreams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, upstream := range upstreams {
+		got = append(got, upstream.String())
+	}
+	want := []string{"10.0.0.53:53", "[fe80::1]:53", "[2001:db8::53]:5353"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	if _, err := ParseUpstream("quic://1.1.1.1", nil); err == nil {
+		t.Error("expected an unsupported scheme rejected")
+	}
+	if _, err := SystemUpstreams(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected a missing resolv.conf to fail")
+	}
+}
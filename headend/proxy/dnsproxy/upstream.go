@@ -0,0 +1,181 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ResolvConf is where the headend's own resolvers are read from when no
+// upstreams are configured
+const ResolvConf = "/etc/resolv.conf"
+
+// maxMessageSize is the largest DNS message, the limit of TCP framing
+const maxMessageSize = 65535
+
+// Upstream is a resolver queries are forwarded to
+type Upstream interface {
+	// Exchange sends a packed query and returns the packed response
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	// Encrypted reports whether queries are protected on the way to the
+	// resolver
+	Encrypted() bool
+	String() string
+}
+
+// ParseUpstream parses a resolver address: an IP, optionally with a port,
+// or udp://host:port for a plain resolver, https://host/path for DNS over
+// HTTPS and tls://host[:port] for DNS over TLS. config, if not nil, is the
+// TLS configuration of encrypted resolvers, such as the CAs to trust.
+func ParseUpstream(spec string, config *tls.Config) (Upstream, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "https://") || strings.HasPrefix(spec, "tls://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver %q: %w", spec, err)
+		}
+		return parseEncryptedUpstream(u, config)
+	}
+
+	address := strings.TrimPrefix(spec, "udp://")
+	if address == "" {
+		return nil, errors.New("empty resolver address")
+	}
+	if strings.Contains(address, "://") {
+		return nil, fmt.Errorf("unsupported resolver %q", spec)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "53")
+	}
+	return &plainUpstream{address: address}, nil
+}
+
+// SystemUpstreams returns the nameservers of the resolv.conf at path
+func SystemUpstreams(path string) ([]Upstream, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var upstreams []Upstream
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// Drop the zone of a link-local address
+		upstream, err := ParseUpstream(strings.SplitN(fields[1], "%", 2)[0], nil)
+		if err != nil {
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no nameserver in %s", path)
+	}
+	return upstreams, nil
+}
+
+// plainUpstream is a resolver spoken to in the clear: over UDP, retrying
+// over TCP when the answer is truncated
+type plainUpstream struct {
+	address string
+}
+
+func (u *plainUpstream) String() string {
+	return u.address
+}
+
+func (u *plainUpstream) Encrypted() bool { return false }
+
+func (u *plainUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// Answers to other queries, or forged ones, are ignored
+		if n < 12 || binary.BigEndian.Uint16(buffer) != binary.BigEndian.Uint16(query) {
+			continue
+		}
+		if buffer[2]&0x02 != 0 {
+			return u.exchangeTCP(ctx, query)
+		}
+		return append([]byte(nil), buffer[:n]...), nil
+	}
+}
+
+func (u *plainUpstream) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+// setDeadline bounds the I/O on conn by the deadline of ctx
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	}
+}
+
+// readTCPMessage reads one length-prefixed message
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeTCPMessage writes message with its length prefix
+func writeTCPMessage(w io.Writer, message []byte) error {
+	if len(message) > maxMessageSize {
+		return errors.New("message too large")
+	}
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+	_, err := w.Write(framed)
+	return err
+}
@@ -0,0 +1,23 @@
+package drain
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	activeSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_active_sessions",
+		Help: "Number of active proxied sessions, by kind (tcp, dynamic, socks, connect).",
+	}, []string{"kind"})
+
+	refusedSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_drain_refused_sessions_total",
+		Help: "Total sessions refused because the headend was draining, by kind.",
+	}, []string{"kind"})
+
+	drainingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_draining",
+		Help: "Whether the headend is draining (1) or accepting new sessions (0).",
+	})
+)
@@ -0,0 +1,180 @@
+// Package drain implements connection draining for the SASEWaddle headend
+// proxy.
+//
+// The drain package provides:
+//   - Tracking of active sessions by kind (TCP proxy, dynamic port, SOCKS5,
+//     HTTP CONNECT)
+//   - A drain mode in which new sessions are refused while active ones run
+//     to completion
+//   - A drain deadline after which the headend may shut down regardless
+//   - Drain progress for health checks and metrics
+//
+// Draining lets a headend leave a load balancer pool without cutting off
+// in-flight sessions: health checks fail as soon as the drain begins, so
+// no new clients arrive, and shutdown waits until the existing ones are
+// done or the deadline passes.
+package drain
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	KindTCP       = "tcp"
+	KindDynamic   = "dynamic"
+	KindSOCKS     = "socks"
+	KindConnect   = "connect"
+	KindWebSocket = "websocket"
+)
+
+// Status is a snapshot of drain progress
+type Status struct {
+	Draining         bool           `json:"draining"`
+	StartedAt        time.Time      `json:"started_at,omitempty"`
+	Deadline         time.Time      `json:"deadline,omitempty"`
+	RemainingSeconds float64        `json:"remaining_seconds"`
+	ActiveSessions   map[string]int `json:"active_sessions"`
+	TotalActive      int            `json:"total_active"`
+}
+
+// Tracker counts active sessions and coordinates draining
+type Tracker struct {
+	active    map[string]int
+	total     int
+	draining  bool
+	startedAt time.Time
+	deadline  time.Time
+	drained   chan struct{}
+	mu        sync.Mutex
+}
+
+// NewTracker creates a tracker that is accepting sessions
+func NewTracker() *Tracker {
+	return &Tracker{
+		active:  make(map[string]int),
+		drained: make(chan struct{}),
+	}
+}
+
+// Begin registers a new session of the given kind. It returns false while
+// draining, in which case the caller should refuse the session. Otherwise
+// the returned function must be called when the session ends.
+func (t *Tracker) Begin(kind string) (func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		refusedSessions.WithLabelValues(kind).Inc()
+		return nil, false
+	}
+
+	t.active[kind]++
+	t.total++
+	activeSessions.WithLabelValues(kind).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.end(kind) })
+	}, true
+}
+
+func (t *Tracker) end(kind string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active[kind]--
+	t.total--
+	activeSessions.WithLabelValues(kind).Dec()
+	t.checkDrained()
+}
+
+// checkDrained closes the drained channel once draining with no sessions
+// left. Callers must hold t.mu.
+func (t *Tracker) checkDrained() {
+	if !t.draining || t.total > 0 {
+		return
+	}
+	select {
+	case <-t.drained:
+	default:
+		close(t.drained)
+	}
+}
+
+// Drain switches the tracker into drain mode with the given deadline. It
+// returns false if a drain is already underway.
+func (t *Tracker) Drain(timeout time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
+	}
+
+	t.draining = true
+	t.startedAt = time.Now().UTC()
+	t.deadline = t.startedAt.Add(timeout)
+	drainingGauge.Set(1)
+	t.checkDrained()
+	return true
+}
+
+// Wait blocks until every session has ended after a drain began, or until
+// the drain deadline or ctx expires. It returns nil only if fully drained.
+func (t *Tracker) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	deadline := t.deadline
+	t.mu.Unlock()
+
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	select {
+	case <-t.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Draining reports whether a drain has begun
+func (t *Tracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Total returns the number of active sessions
+func (t *Tracker) Total() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// Status returns a snapshot of active sessions and drain progress
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := Status{
+		Draining:       t.draining,
+		StartedAt:      t.startedAt,
+		Deadline:       t.deadline,
+		ActiveSessions: make(map[string]int, len(t.active)),
+		TotalActive:    t.total,
+	}
+	for kind, n := range t.active {
+		status.ActiveSessions[kind] = n
+	}
+	if t.draining {
+		if remaining := time.Until(t.deadline); remaining > 0 {
+			status.RemainingSeconds = remaining.Seconds()
+		}
+	}
+	return status
+}
@@ -0,0 +1,141 @@
+package drain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBeginCountsSessions(t *testing.T) {
+	tr := NewTracker()
+	active := testutil.ToFloat64(activeSessions.WithLabelValues(KindTCP))
+
+	doneTCP, ok := tr.Begin(KindTCP)
+	if !ok {
+		t.Fatal("session refused before draining")
+	}
+	doneOther, _ := tr.Begin(KindTCP)
+	doneSOCKS, _ := tr.Begin(KindSOCKS)
+
+	status := tr.Status()
+	if status.TotalActive != 3 || status.ActiveSessions[KindTCP] != 2 || status.ActiveSessions[KindSOCKS] != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if got := testutil.ToFloat64(activeSessions.WithLabelValues(KindTCP)) - active; got != 2 {
+		t.Errorf("active tcp gauge moved by %v, want 2", got)
+	}
+
+	// Calling done more than once ends the session once
+	doneTCP()
+	doneTCP()
+	if tr.Total() != 2 || tr.Status().ActiveSessions[KindTCP] != 1 {
+		t.Errorf("%d sessions after ending one twice, want 2", tr.Total())
+	}
+	doneOther()
+	doneSOCKS()
+	if tr.Total() != 0 || testutil.ToFloat64(activeSessions.WithLabelValues(KindTCP)) != active {
+		t.Errorf("%d sessions left after ending them all", tr.Total())
+	}
+	if status := tr.Status(); status.Draining || status.RemainingSeconds != 0 {
+		t.Errorf("draining without a drain: %+v", status)
+	}
+}
+
+func TestBeginRefusedWhileDraining(t *testing.T) {
+	tr := NewTracker()
+	refused := testutil.ToFloat64(refusedSessions.WithLabelValues(KindDynamic))
+	done, _ := tr.Begin(KindDynamic)
+
+	if tr.Draining() {
+		t.Fatal("draining before Drain")
+	}
+	if !tr.Drain(time.Minute) {
+		t.Fatal("Drain refused")
+	}
+	if tr.Drain(time.Hour) {
+		t.Error("a second Drain started")
+	}
+	if !tr.Draining() {
+		t.Error("not draining after Drain")
+	}
+
+	if done, ok := tr.Begin(KindDynamic); ok || done != nil {
+		t.Error("session accepted while draining")
+	}
+	if got := testutil.ToFloat64(refusedSessions.WithLabelValues(KindDynamic)) - refused; got != 1 {
+		t.Errorf("counted %v refused sessions, want 1", got)
+	}
+
+	// Sessions from before the drain still end normally
+	status := tr.Status()
+	if status.TotalActive != 1 || status.RemainingSeconds <= 0 || status.RemainingSeconds > 60 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if !status.Deadline.Equal(status.StartedAt.Add(time.Minute)) {
+		t.Errorf("deadline %v, want a minute after %v", status.Deadline, status.StartedAt)
+	}
+	done()
+	if tr.Total() != 0 {
+		t.Errorf("%d sessions left", tr.Total())
+	}
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions int
+		timeout  time.Duration
+		cancel   bool
+		end      bool
+		want     error
+	}{
+		{name: "no sessions", timeout: time.Minute},
+		{name: "sessions end", sessions: 2, timeout: time.Minute, end: true},
+		{name: "deadline passes", sessions: 1, timeout: 20 * time.Millisecond, want: context.DeadlineExceeded},
+		{name: "context canceled", sessions: 1, timeout: time.Minute, cancel: true, want: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			var ends []func()
+			for i := 0; i < tt.sessions; i++ {
+				done, _ := tr.Begin(KindConnect)
+				ends = append(ends, done)
+			}
+			tr.Drain(tt.timeout)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := make(chan error, 1)
+			go func() { result <- tr.Wait(ctx) }()
+
+			if tt.sessions > 0 {
+				select {
+				case err := <-result:
+					t.Fatalf("Wait returned %v with sessions active", err)
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			if tt.end {
+				for _, done := range ends {
+					done()
+				}
+			}
+			if tt.cancel {
+				cancel()
+			}
+
+			select {
+			case err := <-result:
+				if !errors.Is(err, tt.want) {
+					t.Errorf("Wait returned %v, want %v", err, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Wait did not return")
+			}
+		})
+	}
+}
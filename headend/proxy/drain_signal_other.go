@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// drainSignals start a drain without exiting. There is no SIGUSR1 here;
+// drains are started through the admin API instead.
+var drainSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals start a drain without exiting
+var drainSignals = []os.Signal{syscall.SIGUSR1}
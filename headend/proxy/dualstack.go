@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// IP families the proxy listeners accept, set with server.ip_family
+const (
+	ipFamilyDual = "dual"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+// checkIPFamily rejects an unknown server.ip_family before any listener opens
+func checkIPFamily() error {
+	switch family := strings.ToLower(viper.GetString("server.ip_family")); family {
+	case ipFamilyDual, ipFamilyIPv4, ipFamilyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("invalid server.ip_family %q: expected %s, %s or %s", family, ipFamilyDual, ipFamilyIPv4, ipFamilyIPv6)
+	}
+}
+
+// listenNetwork returns the network the proxy listeners open for proto,
+// "tcp" or "udp": one socket taking both IPv4 and IPv6 by default, or only
+// the configured family
+func listenNetwork(proto string) string {
+	switch strings.ToLower(viper.GetString("server.ip_family")) {
+	case ipFamilyIPv4:
+		return proto + "4"
+	case ipFamilyIPv6:
+		return proto + "6"
+	default:
+		return proto
+	}
+}
+
+// wireguardNetworks returns the WireGuard networks clients are addressed
+// from: wireguard.network, plus wireguard.network6 on dual-stack headends
+func wireguardNetworks() []string {
+	networks := []string{viper.GetString("wireguard.network")}
+	if network6 := viper.GetString("wireguard.network6"); network6 != "" {
+		networks = append(networks, network6)
+	}
+	return networks
+}
@@ -0,0 +1,173 @@
+// Package events implements the internal event bus for the SASEWaddle headend proxy.
+//
+// The event bus provides:
+// - Typed events for connection lifecycle, access verdicts, authentication and IDS alerts
+// - Fan-out to any number of subscribed sinks (syslog, metrics, webhooks, admin stream)
+// - Per-sink bounded queues so a slow sink never blocks the data path
+// - Type filtering so sinks only receive the events they care about
+// - Drop accounting per sink when a queue is saturated
+//
+// Proxy handlers publish what happened; sinks decide what to do with it.
+// This keeps handleConnection/proxyHandler free of hand-wired calls to
+// every logging and reporting subsystem.
+package events
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type identifies the kind of event published on the bus
+type Type string
+
+const (
+	TypeConnectionOpened Type = "connection_opened"
+	TypeConnectionClosed Type = "connection_closed"
+	TypeVerdict          Type = "verdict"
+	TypeAuth             Type = "auth"
+	TypeIDSAlert         Type = "ids_alert"
+)
+
+// Event is a single occurrence published by a proxy subsystem. Fields that
+// do not apply to an event type are left at their zero value.
+type Event struct {
+	Type          Type          `json:"type"`
+	Timestamp     time.Time     `json:"timestamp"`
+	UserID        string        `json:"user_id,omitempty"`
+	Username      string        `json:"username,omitempty"`
+	PseudonymKey  string        `json:"pseudonym_key,omitempty"` // key the user ID and name were pseudonymized with
+	SourceIP      string        `json:"source_ip,omitempty"`
+	TargetHost    string        `json:"target_host,omitempty"`
+	Protocol      string        `json:"protocol,omitempty"` // HTTP, TCP, UDP
+	Port          int           `json:"port,omitempty"`
+	Allowed       bool          `json:"allowed"`
+	Reason        string        `json:"reason,omitempty"`
+	PolicyVersion string        `json:"policy_version,omitempty"`
+	Rule          string        `json:"rule,omitempty"`          // pattern of the rule that decided a verdict, or gid:sid:rev of an IDS alert
+	ShadowAction  string        `json:"shadow_action,omitempty"` // would-be verdict of a monitor rule
+	WouldDeny     bool          `json:"would_deny,omitempty"`    // denied by the rules, allowed by permissive mode
+	Method        string        `json:"method,omitempty"`
+	Path          string        `json:"path,omitempty"`
+	UserAgent     string        `json:"user_agent,omitempty"`
+	RequestID     string        `json:"request_id,omitempty"`
+	StatusCode    int           `json:"status_code,omitempty"`
+	BytesSent     int64         `json:"bytes_sent,omitempty"`
+	BytesReceived int64         `json:"bytes_received,omitempty"`
+	Duration      time.Duration `json:"duration,omitempty"`
+	HTTPVersion   string        `json:"http_version,omitempty"` // e.g. HTTP/2.0
+	GRPCStatus    string        `json:"grpc_status,omitempty"`  // status code of a gRPC call
+}
+
+// Sink consumes events from the bus. Handle is called from a dedicated
+// goroutine per sink, so it may block without affecting publishers.
+type Sink interface {
+	Name() string
+	Handle(event Event)
+}
+
+type subscription struct {
+	sink  Sink
+	types map[Type]bool
+	queue chan Event
+	done  chan struct{}
+}
+
+// Bus fans published events out to subscribed sinks
+type Bus struct {
+	bufferSize    int
+	subscriptions []*subscription
+	mu            sync.RWMutex
+	stopped       bool
+}
+
+// NewBus creates an event bus where each sink gets a queue of bufferSize events
+func NewBus(bufferSize int) *Bus {
+	if bufferSize <= 0 {
+		bufferSize = 1000
+	}
+	return &Bus{
+		bufferSize: bufferSize,
+	}
+}
+
+// Subscribe registers a sink for the given event types. With no types the
+// sink receives every event.
+func (b *Bus) Subscribe(sink Sink, types ...Type) {
+	sub := &subscription{
+		sink:  sink,
+		queue: make(chan Event, b.bufferSize),
+		done:  make(chan struct{}),
+	}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subscriptions = append(b.subscriptions, sub)
+	b.mu.Unlock()
+
+	go sub.run()
+	log.Debugf("Event sink %s subscribed", sink.Name())
+}
+
+// Publish delivers an event to every interested sink without blocking.
+// When a sink's queue is full the event is dropped for that sink only and
+// counted in headend_events_dropped_total.
+func (b *Bus) Publish(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.stopped {
+		return
+	}
+
+	for _, sub := range b.subscriptions {
+		if sub.types != nil && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+		default:
+			eventsDropped.WithLabelValues(sub.sink.Name()).Inc()
+		}
+	}
+}
+
+// Stop closes all sink queues and waits for sinks to drain them. Sinks that
+// buffer internally are stopped once their queue is drained.
+func (b *Bus) Stop() {
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return
+	}
+	b.stopped = true
+	subs := b.subscriptions
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		close(sub.queue)
+	}
+	for _, sub := range subs {
+		<-sub.done
+	}
+}
+
+func (s *subscription) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		s.sink.Handle(event)
+	}
+	if stopper, ok := s.sink.(interface{ Stop() }); ok {
+		stopper.Stop()
+	}
+}
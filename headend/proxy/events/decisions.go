@@ -0,0 +1,204 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DecisionCount is the number of verdicts for one (rule, user, verdict)
+// series within a reporting window
+type DecisionCount struct {
+	Rule          string `json:"rule"`
+	UserID        string `json:"user_id"`
+	Verdict       string `json:"verdict"`
+	PolicyVersion string `json:"policy_version,omitempty"`
+	Count         uint64 `json:"count"`
+}
+
+// DecisionBatch is the payload posted to the Manager for each window
+type DecisionBatch struct {
+	HeadendID   string          `json:"headend_id"`
+	WindowStart time.Time       `json:"window_start"`
+	WindowEnd   time.Time       `json:"window_end"`
+	Decisions   []DecisionCount `json:"decisions"`
+	// Overflow counts verdicts that were not attributed to a series because
+	// the window already held the maximum number of series
+	Overflow uint64 `json:"overflow,omitempty"`
+}
+
+type decisionKey struct {
+	rule          string
+	userID        string
+	verdict       string
+	policyVersion string
+}
+
+// DecisionSink aggregates firewall verdicts into per-series counts and posts
+// them to the Manager once per flush interval. Memory is bounded by
+// maxSeries; a failed post drops the window rather than retrying it.
+type DecisionSink struct {
+	url         string
+	authToken   string
+	headendID   string
+	maxSeries   int
+	httpClient  *http.Client
+	counts      map[decisionKey]uint64
+	overflow    uint64
+	windowStart time.Time
+	mu          sync.Mutex
+	stopChan    chan struct{}
+}
+
+// NewDecisionSink creates a sink posting decision batches to the Manager
+func NewDecisionSink(managerURL, authToken, headendID string, maxSeries int, flushInterval time.Duration) *DecisionSink {
+	if maxSeries <= 0 {
+		maxSeries = 10000
+	}
+	if flushInterval <= 0 {
+		flushInterval = 60 * time.Second
+	}
+
+	d := &DecisionSink{
+		url:       fmt.Sprintf("%s/api/v1/headend/%s/policy-decisions", managerURL, headendID),
+		authToken: authToken,
+		headendID: headendID,
+		maxSeries: maxSeries,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		counts:      make(map[decisionKey]uint64),
+		windowStart: time.Now().UTC(),
+		stopChan:    make(chan struct{}),
+	}
+	go d.flushLoop(flushInterval)
+	return d
+}
+
+// Name returns the sink name used in metrics
+func (d *DecisionSink) Name() string {
+	return "decisions"
+}
+
+// Handle counts a verdict event in the current window
+func (d *DecisionSink) Handle(event Event) {
+	if event.Type != TypeVerdict {
+		return
+	}
+
+	rule := event.Rule
+	if rule == "" {
+		rule = "none"
+	}
+	key := decisionKey{
+		rule:          rule,
+		userID:        event.UserID,
+		verdict:       actionLabel(event),
+		policyVersion: event.PolicyVersion,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.counts[key]; !exists && len(d.counts) >= d.maxSeries {
+		d.overflow++
+		decisionSeriesOverflow.Inc()
+		return
+	}
+	d.counts[key]++
+}
+
+// Stop posts the final window and stops the flush loop
+func (d *DecisionSink) Stop() {
+	close(d.stopChan)
+	d.flush()
+}
+
+func (d *DecisionSink) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.flush()
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+func (d *DecisionSink) flush() {
+	now := time.Now().UTC()
+
+	d.mu.Lock()
+	counts := d.counts
+	overflow := d.overflow
+	batch := DecisionBatch{
+		HeadendID:   d.headendID,
+		WindowStart: d.windowStart,
+		WindowEnd:   now,
+	}
+	d.counts = make(map[decisionKey]uint64)
+	d.overflow = 0
+	d.windowStart = now
+	d.mu.Unlock()
+
+	if len(counts) == 0 && overflow == 0 {
+		return
+	}
+
+	batch.Overflow = overflow
+	batch.Decisions = make([]DecisionCount, 0, len(counts))
+	for key, count := range counts {
+		batch.Decisions = append(batch.Decisions, DecisionCount{
+			Rule:          key.rule,
+			UserID:        key.userID,
+			Verdict:       key.verdict,
+			PolicyVersion: key.policyVersion,
+			Count:         count,
+		})
+	}
+
+	if err := d.post(batch); err != nil {
+		log.Warnf("Failed to post %d decision series to Manager: %v", len(batch.Decisions), err)
+		decisionBatchesFailed.Inc()
+		return
+	}
+	log.Debugf("Posted %d decision series to Manager", len(batch.Decisions))
+}
+
+func (d *DecisionSink) post(batch DecisionBatch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal decisions: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+	req.Header.Set("Authorization", "Bearer "+d.authToken)
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post decisions: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("Error closing response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("manager returned status %d", resp.StatusCode)
+	}
+	return nil
+}
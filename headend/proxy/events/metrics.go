@@ -0,0 +1,33 @@
+package events
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_events_dropped_total",
+		Help: "Total number of events dropped because a sink queue was full.",
+	}, []string{"sink"})
+
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_events_total",
+		Help: "Total number of events published, by type, protocol and action.",
+	}, []string{"type", "protocol", "action"})
+
+	proxiedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_proxied_bytes_total",
+		Help: "Total bytes proxied for allowed requests, by protocol, method and direction (sent to or received from the client).",
+	}, []string{"protocol", "method", "direction"})
+
+	decisionSeriesOverflow = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_decision_series_overflow_total",
+		Help: "Total number of verdicts not attributed to a decision series because the series limit was reached.",
+	})
+
+	decisionBatchesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_decision_batches_failed_total",
+		Help: "Total number of decision batches that could not be posted to the Manager.",
+	})
+)
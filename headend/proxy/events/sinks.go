@@ -0,0 +1,363 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/accesslog"
+	"github.com/tobogganing/headend/proxy/pseudonym"
+	"github.com/tobogganing/headend/proxy/syslog"
+)
+
+// SyslogSink writes verdict events to the syslog access log
+type SyslogSink struct {
+	logger *syslog.SyslogLogger
+}
+
+// NewSyslogSink creates a sink that forwards verdicts to the syslog logger
+func NewSyslogSink(logger *syslog.SyslogLogger) *SyslogSink {
+	return &SyslogSink{logger: logger}
+}
+
+// Name returns the sink name used in metrics
+func (s *SyslogSink) Name() string {
+	return "syslog"
+}
+
+// Handle converts a verdict event into an access log entry
+func (s *SyslogSink) Handle(event Event) {
+	if event.Type != TypeVerdict {
+		return
+	}
+
+	s.logger.LogAccess(accessLogEntry(event))
+}
+
+// AccessLogSink writes verdict events to the local access log file
+type AccessLogSink struct {
+	logger *accesslog.Logger
+	// failing is set while writes fail, so each outage is logged once
+	failing bool
+}
+
+// NewAccessLogSink creates a sink that appends verdicts to the access log
+// file
+func NewAccessLogSink(logger *accesslog.Logger) *AccessLogSink {
+	return &AccessLogSink{logger: logger}
+}
+
+// Name returns the sink name used in metrics
+func (s *AccessLogSink) Name() string {
+	return "access_log"
+}
+
+// Handle appends a verdict event to the access log
+func (s *AccessLogSink) Handle(event Event) {
+	if event.Type != TypeVerdict {
+		return
+	}
+
+	err := s.logger.Log(accessLogEntry(event))
+	if err != nil && !s.failing {
+		log.Warnf("Failed to write access log %s: %v", s.logger.Path(), err)
+	} else if err == nil && s.failing {
+		log.Infof("Writing access log %s again", s.logger.Path())
+	}
+	s.failing = err != nil
+}
+
+// accessLogEntry converts a verdict event into an access log entry
+func accessLogEntry(event Event) syslog.AccessLog {
+	return syslog.AccessLog{
+		Timestamp:     event.Timestamp,
+		UserID:        event.UserID,
+		Username:      event.Username,
+		PseudonymKey:  event.PseudonymKey,
+		SourceIP:      event.SourceIP,
+		TargetHost:    event.TargetHost,
+		Protocol:      event.Protocol,
+		Action:        actionLabel(event),
+		Method:        event.Method,
+		Path:          event.Path,
+		StatusCode:    event.StatusCode,
+		BytesSent:     event.BytesSent,
+		BytesReceived: event.BytesReceived,
+		UserAgent:     event.UserAgent,
+		RequestID:     event.RequestID,
+		PolicyVersion: event.PolicyVersion,
+		ShadowAction:  event.ShadowAction,
+		HTTPVersion:   event.HTTPVersion,
+		GRPCStatus:    event.GRPCStatus,
+	}
+}
+
+// PseudonymizingSink passes events on to another sink with the user's ID
+// and name replaced by pseudonyms, for sinks that export them
+type PseudonymizingSink struct {
+	sink Sink
+	keys *pseudonym.Keys
+}
+
+// NewPseudonymizingSink wraps sink so it only sees pseudonyms. A nil keys
+// leaves sink as it is.
+func NewPseudonymizingSink(sink Sink, keys *pseudonym.Keys) Sink {
+	if keys == nil {
+		return sink
+	}
+	return &PseudonymizingSink{sink: sink, keys: keys}
+}
+
+// Name returns the wrapped sink's name, used in metrics
+func (p *PseudonymizingSink) Name() string {
+	return p.sink.Name()
+}
+
+// Handle pseudonymizes the event's user and hands it on
+func (p *PseudonymizingSink) Handle(event Event) {
+	if event.UserID != "" || event.Username != "" {
+		event.PseudonymKey = p.keys.Replace(&event.UserID, &event.Username)
+	}
+	p.sink.Handle(event)
+}
+
+// Stop stops the wrapped sink, if it buffers, once the bus has drained
+func (p *PseudonymizingSink) Stop() {
+	if stopper, ok := p.sink.(interface{ Stop() }); ok {
+		stopper.Stop()
+	}
+}
+
+// MetricsSink counts events in Prometheus
+type MetricsSink struct{}
+
+// NewMetricsSink creates a sink that exports event counts
+func NewMetricsSink() *MetricsSink {
+	return &MetricsSink{}
+}
+
+// Name returns the sink name used in metrics
+func (m *MetricsSink) Name() string {
+	return "metrics"
+}
+
+// Handle increments the event counter for the event and counts the bytes
+// a verdict reports as transferred
+func (m *MetricsSink) Handle(event Event) {
+	eventsTotal.WithLabelValues(string(event.Type), event.Protocol, actionLabel(event)).Inc()
+
+	if event.Type == TypeVerdict {
+		if event.BytesSent > 0 {
+			proxiedBytes.WithLabelValues(event.Protocol, event.Method, "sent").Add(float64(event.BytesSent))
+		}
+		if event.BytesReceived > 0 {
+			proxiedBytes.WithLabelValues(event.Protocol, event.Method, "received").Add(float64(event.BytesReceived))
+		}
+	}
+}
+
+// WebhookSink batches events and POSTs them as JSON to an external URL
+type WebhookSink struct {
+	url        string
+	authToken  string
+	batchSize  int
+	httpClient *http.Client
+	batch      []Event
+	mu         sync.Mutex
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewWebhookSink creates a webhook sink that flushes every batchSize events
+// or every flushInterval, whichever comes first
+func NewWebhookSink(url, authToken string, batchSize int, flushInterval time.Duration) *WebhookSink {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if flushInterval <= 0 {
+		flushInterval = 10 * time.Second
+	}
+
+	w := &WebhookSink{
+		url:       url,
+		authToken: authToken,
+		batchSize: batchSize,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		stopChan: make(chan struct{}),
+	}
+	go w.flushLoop(flushInterval)
+	return w
+}
+
+// Name returns the sink name used in metrics
+func (w *WebhookSink) Name() string {
+	return "webhook"
+}
+
+// Handle adds the event to the current batch
+func (w *WebhookSink) Handle(event Event) {
+	w.mu.Lock()
+	w.batch = append(w.batch, event)
+	full := len(w.batch) >= w.batchSize
+	w.mu.Unlock()
+
+	if full {
+		w.flush()
+	}
+}
+
+// Stop flushes any pending events and stops the flush loop. It may be
+// called more than once; events handled after the first call are not sent.
+func (w *WebhookSink) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopChan)
+		w.flush()
+	})
+}
+
+func (w *WebhookSink) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+func (w *WebhookSink) flush() {
+	w.mu.Lock()
+	if len(w.batch) == 0 {
+		w.mu.Unlock()
+		return
+	}
+	batch := w.batch
+	w.batch = nil
+	w.mu.Unlock()
+
+	if err := w.post(batch); err != nil {
+		log.Warnf("Failed to deliver %d events to webhook: %v", len(batch), err)
+		eventsDropped.WithLabelValues(w.Name()).Add(float64(len(batch)))
+	}
+}
+
+func (w *WebhookSink) post(batch []Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"events": batch,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal events: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+	if w.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.authToken)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post events: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("Error closing response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Stream fans events out to live watchers such as an admin event stream.
+// Watchers that fall behind miss events rather than slowing the bus.
+type Stream struct {
+	watchers map[chan Event]struct{}
+	mu       sync.RWMutex
+}
+
+// NewStream creates an empty stream sink
+func NewStream() *Stream {
+	return &Stream{
+		watchers: make(map[chan Event]struct{}),
+	}
+}
+
+// Name returns the sink name used in metrics
+func (s *Stream) Name() string {
+	return "stream"
+}
+
+// Handle forwards the event to every watcher that has room for it
+func (s *Stream) Handle(event Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for ch := range s.watchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Watch registers a new watcher. The returned function must be called to
+// unregister it once the watcher is done.
+func (s *Stream) Watch(bufferSize int) (<-chan Event, func()) {
+	ch := make(chan Event, bufferSize)
+
+	s.mu.Lock()
+	s.watchers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		if _, ok := s.watchers[ch]; ok {
+			delete(s.watchers, ch)
+			close(ch)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func actionLabel(event Event) string {
+	switch event.Type {
+	case TypeVerdict:
+		if event.WouldDeny {
+			return "would_deny"
+		}
+		if event.Allowed {
+			return "allow"
+		}
+		return "deny"
+	case TypeAuth:
+		if event.Allowed {
+			return "success"
+		}
+		return "failure"
+	case TypeIDSAlert:
+		if event.Allowed {
+			return "alert"
+		}
+		return "block"
+	default:
+		return ""
+	}
+}
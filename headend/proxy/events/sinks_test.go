@@ -0,0 +1,48 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/pseudonym"
+)
+
+func TestWebhookSinkStopFlushes(t *testing.T) {
+	batches := make(chan []Event, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Events []Event `json:"events"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		batches <- body.Events
+	}))
+	defer webhook.Close()
+
+	sink := NewWebhookSink(webhook.URL, "", 100, time.Hour)
+	bus := NewBus(10)
+	// Without a key yet the identifiers are withheld, never sent as is
+	bus.Subscribe(NewPseudonymizingSink(sink, pseudonym.NewKeys("", "", 0)))
+	bus.Publish(Event{Type: TypeVerdict, UserID: "alice", TargetHost: "a.example.com"})
+	bus.Publish(Event{Type: TypeVerdict, UserID: "bob", TargetHost: "b.example.com"})
+
+	// The bus drains into the sink, through the wrapper, then stops it,
+	// sending the partial batch
+	bus.Stop()
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 || batch[0].TargetHost != "a.example.com" || batch[0].UserID != "" {
+			t.Errorf("unexpected batch %+v", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending events were not delivered on stop")
+	}
+
+	// Stopping again is harmless
+	sink.Stop()
+	if len(batches) != 0 {
+		t.Error("expected no further deliveries")
+	}
+}
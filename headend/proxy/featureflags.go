@@ -0,0 +1,142 @@
+// Feature flags for the headend.
+//
+// The Manager delivers flag rules in the headend configuration payload. The
+// headend refreshes them periodically and evaluates them per user when it
+// negotiates session capabilities, so framing v2 and the fallback
+// transports can be rolled out to a share of users, to tenants or to
+// groups. Until a payload arrives, and for any flag it leaves out or gets
+// wrong, the defaults in libs/featureflag apply.
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tobogganing/headend/config"
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/capabilities"
+	"github.com/tobogganing/headend/proxy/startup"
+	"github.com/tobogganing/libs/featureflag"
+)
+
+// initializeFeatureFlags applies local overrides and starts refreshing the
+// Manager's rules, fetching the first ones as part of group. Failing to
+// reach the Manager is not fatal.
+func (s *ProxyServer) initializeFeatureFlags(group *startup.Group) error {
+	s.featureFlags = featureflag.New()
+
+	overrides := make(map[string]bool)
+	for name := range viper.GetStringMap("feature_flags.overrides") {
+		overrides[name] = viper.GetBool("feature_flags.overrides." + name)
+	}
+	if err := s.featureFlags.SetOverrides(overrides); err != nil {
+		return err
+	}
+	if len(overrides) > 0 {
+		log.Infof("Feature flag overrides: %v", overrides)
+	}
+
+	if !viper.GetBool("feature_flags.enabled") {
+		return nil
+	}
+	if os.Getenv("CLUSTER_ID") == "" {
+		log.Warn("Feature flags enabled without CLUSTER_ID, using the defaults")
+		return nil
+	}
+
+	s.flagSource = config.NewManager(viper.GetString("feature_flags.manager_url"), os.Getenv("CLUSTER_API_KEY"))
+	group.Go(startup.Task{
+		Name:    "feature_flags",
+		Timeout: startupTimeout("feature_flags"),
+		Run: func(context.Context) error {
+			// The defaults apply until the next refresh
+			return s.refreshFeatureFlags()
+		},
+	})
+
+	s.flagsStop = make(chan struct{})
+	go s.featureFlagLoop(viper.GetDuration("feature_flags.refresh_interval"))
+	return nil
+}
+
+func (s *ProxyServer) featureFlagLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Keep the rules we have if the Manager can't be reached
+			if err := s.refreshFeatureFlags(); err != nil {
+				log.Errorf("Failed to refresh feature flags: %v", err)
+			}
+		case <-s.flagsStop:
+			return
+		}
+	}
+}
+
+// refreshFeatureFlags fetches the headend configuration and applies its
+// feature flag rules
+func (s *ProxyServer) refreshFeatureFlags() error {
+	cfg, err := s.flagSource.FetchConfig()
+	if err != nil {
+		return err
+	}
+
+	previous := s.featureFlags.Version()
+	if err := s.featureFlags.Apply(cfg.FeatureFlags); err != nil {
+		log.Warnf("Ignoring invalid feature flag rules, their defaults apply: %v", err)
+	}
+	if cfg.FeatureFlags.Version != previous {
+		log.Infof("Applied feature flags version %q: %v",
+			cfg.FeatureFlags.Version, s.featureFlags.Evaluate(s.featureFlags.Subject(headendID())))
+	}
+	return nil
+}
+
+// userSubject describes a user for flag targeting. Its groups are its
+// cohorts; its tenant is set by the identity provider or, for Manager JWTs,
+// in the token's metadata claim.
+func userSubject(user *auth.User) featureflag.Subject {
+	subject := featureflag.Subject{ID: user.ID, Cohorts: user.Groups}
+	if tenant, ok := user.Metadata["tenant"].(string); ok {
+		subject.Tenant = tenant
+	} else if extra, ok := user.Metadata["extra"].(map[string]interface{}); ok {
+		subject.Tenant, _ = extra["tenant"].(string)
+	}
+	return subject
+}
+
+// capabilitiesFor returns the capabilities offered to user: the local set
+// minus whatever its feature flags hold back
+func (s *ProxyServer) capabilitiesFor(user *auth.User) capabilities.Set {
+	local := s.localCaps
+	subject := userSubject(user)
+
+	if !s.featureFlags.Enabled(featureflag.FramingV2, subject) {
+		versions := make([]int, 0, len(local.ProtocolVersions))
+		for _, v := range local.ProtocolVersions {
+			if v != capabilities.ProtocolV2 {
+				versions = append(versions, v)
+			}
+		}
+		local.ProtocolVersions = versions
+	}
+	if !s.featureFlags.Enabled(featureflag.FallbackTransport, subject) {
+		local.Transports = []string{capabilities.TransportWireGuard}
+	}
+	if !s.featureFlags.Enabled(featureflag.DNSProxy, subject) {
+		features := make([]string, 0, len(local.Features))
+		for _, feature := range local.Features {
+			if feature != capabilities.FeatureDNSProxy {
+				features = append(features, feature)
+			}
+		}
+		local.Features = features
+	}
+	return local
+}
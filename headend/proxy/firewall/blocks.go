@@ -0,0 +1,158 @@
+package firewall
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockVersion is the policy version reported for decisions made by a
+// temporary block
+const BlockVersion = "temporary_block"
+
+// TemporaryBlock denies a user a target, or every target, until it expires.
+// Blocks are inserted by the headend itself, e.g. in response to IDS
+// alerts, and are never synced from the Manager.
+type TemporaryBlock struct {
+	UserID  string    `json:"user_id"`
+	Target  string    `json:"target,omitempty"` // host name or IP; empty blocks every target
+	Reason  string    `json:"reason"`
+	Source  string    `json:"source"` // e.g. suricata or admin
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Block denies userID access to target for ttl. target is a host name or
+// IP, optionally with a port, which is ignored; an empty target blocks
+// every target. Blocking the same user and target again extends the
+// block. Like a restriction, a block applies whatever the policy mode.
+func (m *Manager) Block(userID, target, reason, source string, ttl time.Duration) {
+	now := time.Now()
+	block := TemporaryBlock{
+		UserID:  userID,
+		Reason:  reason,
+		Source:  source,
+		Created: now.UTC(),
+		Expires: now.Add(ttl).UTC(),
+	}
+	if target != "" {
+		block.Target = blockKey(target)
+	}
+
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.pruneBlocks(now)
+	if m.blocks[userID] == nil {
+		m.blocks[userID] = make(map[string]TemporaryBlock)
+	}
+	if existing, ok := m.blocks[userID][block.Target]; ok {
+		block.Created = existing.Created
+	} else {
+		log.Warnf("User %s blocked from %s for %s by %s (%s)", userID, describeBlockTarget(block.Target), ttl, source, reason)
+	}
+	m.blocks[userID][block.Target] = block
+	firewallTemporaryBlocks.Set(float64(m.countBlocks()))
+}
+
+// Unblock lifts the block of userID on target, or every block of the user
+// when target is empty. It reports how many blocks were lifted.
+func (m *Manager) Unblock(userID, target string) int {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+
+	lifted := 0
+	if target == "" {
+		lifted = len(m.blocks[userID])
+		delete(m.blocks, userID)
+	} else if _, ok := m.blocks[userID][blockKey(target)]; ok {
+		delete(m.blocks[userID], blockKey(target))
+		if len(m.blocks[userID]) == 0 {
+			delete(m.blocks, userID)
+		}
+		lifted = 1
+	}
+	if lifted > 0 {
+		log.Infof("Lifted %d temporary blocks of user %s", lifted, userID)
+	}
+	firewallTemporaryBlocks.Set(float64(m.countBlocks()))
+	return lifted
+}
+
+// Blocks returns the blocks in force, soonest to expire first
+func (m *Manager) Blocks() []TemporaryBlock {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.pruneBlocks(time.Now())
+
+	blocks := []TemporaryBlock{}
+	for _, userBlocks := range m.blocks {
+		for _, block := range userBlocks {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Expires.Before(blocks[j].Expires) })
+	return blocks
+}
+
+// blocked returns the block denying userID target, if any. Caller must
+// hold updateMutex.
+func (m *Manager) blocked(userID, target string, now time.Time) (TemporaryBlock, bool) {
+	userBlocks := m.blocks[userID]
+	if len(userBlocks) == 0 {
+		return TemporaryBlock{}, false
+	}
+
+	candidates := []string{"", blockKey(target)}
+	candidates = append(candidates, m.pinnedNames(target)...)
+	for _, candidate := range candidates {
+		if block, ok := userBlocks[blockKey(candidate)]; ok && now.Before(block.Expires) {
+			return block, true
+		}
+	}
+	return TemporaryBlock{}, false
+}
+
+// pruneBlocks drops expired blocks. Caller must hold updateMutex for
+// writing.
+func (m *Manager) pruneBlocks(now time.Time) {
+	for userID, userBlocks := range m.blocks {
+		for target, block := range userBlocks {
+			if !now.Before(block.Expires) {
+				delete(userBlocks, target)
+				log.Infof("Temporary block of user %s on %s expired", userID, describeBlockTarget(target))
+			}
+		}
+		if len(userBlocks) == 0 {
+			delete(m.blocks, userID)
+		}
+	}
+	firewallTemporaryBlocks.Set(float64(m.countBlocks()))
+}
+
+func (m *Manager) countBlocks() int {
+	count := 0
+	for _, userBlocks := range m.blocks {
+		count += len(userBlocks)
+	}
+	return count
+}
+
+// blockKey normalizes target to the host name or address a block is kept
+// under
+func blockKey(target string) string {
+	host := strings.ToLower(targetHostname(target))
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+func describeBlockTarget(target string) string {
+	if target == "" {
+		return "all targets"
+	}
+	return target
+}
@@ -0,0 +1,69 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTemporaryBlocks(t *testing.T) {
+	alice := domainRules("alice", "*.example.com", AccessTypeAllow)
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+
+	if d := m.Decide("alice", "app.example.com"); !d.Allowed {
+		t.Fatalf("expected alice's rules to apply before the block, got %+v", d)
+	}
+
+	m.Block("alice", "APP.example.com", "ET MALWARE beacon", "suricata", time.Hour)
+	if d := m.Decide("alice", "app.example.com"); d.Allowed || d.PolicyVersion != BlockVersion || d.Reason != "blocked_by_suricata" {
+		t.Errorf("expected the cached allow to be replaced by a block, got %+v", d)
+	}
+	if d := m.Decide("alice", "api.example.com"); !d.Allowed {
+		t.Errorf("expected other targets to stay reachable, got %+v", d)
+	}
+
+	// No policy mode relaxes a block
+	m.SetPolicyMode(PolicyModeDisabled)
+	if d := m.Decide("alice", "app.example.com"); d.Allowed {
+		t.Errorf("expected the block to hold with the policy disabled, got %+v", d)
+	}
+	m.SetPolicyMode(PolicyModeEnforce)
+
+	// Addresses are normalized
+	m.Block("alice", "[2001:DB8::1]:443", "scan", "admin", time.Hour)
+	if d := m.Decide("alice", "2001:db8::1"); d.Allowed {
+		t.Errorf("expected the address to be blocked, got %+v", d)
+	}
+
+	if blocks := m.Blocks(); len(blocks) != 2 || blocks[0].Target != "app.example.com" {
+		t.Errorf("unexpected blocks %+v", blocks)
+	}
+	if n := m.Unblock("alice", "app.example.com"); n != 1 {
+		t.Errorf("lifted %d blocks, want 1", n)
+	}
+	if d := m.Decide("alice", "app.example.com"); !d.Allowed {
+		t.Errorf("expected alice's rules to apply again, got %+v", d)
+	}
+}
+
+func TestTemporaryBlockOfAllTargetsExpires(t *testing.T) {
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": domainRules("alice", "*.example.org", AccessTypeAllow)})
+
+	m.Block("alice", "", "ET POLICY exfiltration", "suricata", 50*time.Millisecond)
+	if d := m.Decide("alice", "anything.example.org"); d.Allowed {
+		t.Errorf("expected every target to be blocked, got %+v", d)
+	}
+	if d := m.Decide("bob", "anything.example.org"); d.PolicyVersion == BlockVersion {
+		t.Errorf("expected other users to be unaffected, got %+v", d)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if d := m.Decide("alice", "anything.example.org"); !d.Allowed {
+		t.Errorf("expected the block to expire, got %+v", d)
+	}
+	if blocks := m.Blocks(); len(blocks) != 0 {
+		t.Errorf("expired blocks still listed: %+v", blocks)
+	}
+}
@@ -0,0 +1,118 @@
+package firewall
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDecisionCacheSize is the number of (user, target) decisions kept
+	DefaultDecisionCacheSize = 10000
+
+	// DefaultDecisionCacheTTL bounds how long a cached decision is reused.
+	// Rule refreshes clear the cache, so this only limits staleness from
+	// inputs outside the rule set, such as rollout cohort changes.
+	DefaultDecisionCacheTTL = 30 * time.Second
+)
+
+type decisionKey struct {
+	userID string
+	groups string
+	target string
+}
+
+type decisionEntry struct {
+	key       decisionKey
+	decision  Decision
+	expiresAt time.Time
+}
+
+// decisionCache is an LRU cache of firewall decisions with a TTL
+type decisionCache struct {
+	size    int
+	ttl     time.Duration
+	entries map[decisionKey]*list.Element
+	order   *list.List // front is most recently used
+	mu      sync.Mutex
+}
+
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[decisionKey]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached decision for key if it hasn't expired
+func (c *decisionCache) get(key decisionKey, now time.Time) (Decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return Decision{}, false
+	}
+	entry := elem.Value.(*decisionEntry)
+	if !now.Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return Decision{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.decision, true
+}
+
+// put caches decision for key, evicting the least recently used entry when
+// the cache is full
+func (c *decisionCache) put(key decisionKey, decision Decision, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*decisionEntry)
+		entry.decision = decision
+		entry.expiresAt = now.Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decisionEntry).key)
+		firewallCacheEvictions.Inc()
+	}
+	c.entries[key] = c.order.PushFront(&decisionEntry{key: key, decision: decision, expiresAt: now.Add(c.ttl)})
+}
+
+// clear drops every cached decision
+func (c *decisionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[decisionKey]*list.Element, c.size)
+	c.order.Init()
+}
+
+// clearUsers drops the cached decisions of the given users
+func (c *decisionCache) clearUsers(users map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if users[key.userID] {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// len returns the number of cached decisions
+func (c *decisionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,99 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecisionCacheLRU(t *testing.T) {
+	cache := newDecisionCache(2, time.Minute)
+	now := time.Now()
+	a := decisionKey{userID: "alice", target: "a.example.com"}
+	b := decisionKey{userID: "alice", target: "b.example.com"}
+	c := decisionKey{userID: "bob", target: "a.example.com"}
+
+	cache.put(a, Decision{Allowed: true}, now)
+	cache.put(b, Decision{Allowed: false}, now)
+
+	// Using a makes b the least recently used entry
+	if d, ok := cache.get(a, now); !ok || !d.Allowed {
+		t.Fatalf("get(a) = %+v, %v", d, ok)
+	}
+	cache.put(c, Decision{Allowed: true}, now)
+
+	if _, ok := cache.get(b, now); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, ok := cache.get(a, now); !ok {
+		t.Error("a should still be cached")
+	}
+	if _, ok := cache.get(c, now); !ok {
+		t.Error("c should be cached")
+	}
+}
+
+func TestDecisionCacheTTL(t *testing.T) {
+	cache := newDecisionCache(10, time.Minute)
+	now := time.Now()
+	key := decisionKey{userID: "alice", target: "example.com"}
+
+	cache.put(key, Decision{Allowed: true}, now)
+	if _, ok := cache.get(key, now.Add(59*time.Second)); !ok {
+		t.Fatal("entry expired early")
+	}
+	if _, ok := cache.get(key, now.Add(time.Minute)); ok {
+		t.Fatal("expired entry was returned")
+	}
+	if cache.len() != 0 {
+		t.Errorf("expired entry was not removed, len %d", cache.len())
+	}
+}
+
+func TestDecideInvalidatedOnRefresh(t *testing.T) {
+	m := NewManager("", "")
+
+	rules := UserRules{UserID: "alice"}
+	rules.Rules.AllowDomains = []FirewallRule{{Pattern: "*.example.com", Priority: 10}}
+	m.userRules = copyUserRules(map[string]UserRules{"alice": rules})
+
+	if d := m.Decide("alice", "www.example.com"); !d.Allowed {
+		t.Fatalf("expected allow, got %+v", d)
+	}
+	if m.cache.len() != 1 {
+		t.Fatalf("decision was not cached")
+	}
+
+	// A higher-priority deny arriving with the next refresh must win at once
+	rules.Rules.DenyDomains = []FirewallRule{{Pattern: "www.example.com", Priority: 1}}
+	m.updateMutex.Lock()
+	m.userRules = copyUserRules(map[string]UserRules{"alice": rules})
+	m.cache.clear()
+	m.updateMutex.Unlock()
+
+	if d := m.Decide("alice", "www.example.com"); d.Allowed || d.Reason != "rule_deny" {
+		t.Fatalf("expected deny after refresh, got %+v", d)
+	}
+}
+
+func TestCompiledRuleOrder(t *testing.T) {
+	rules := UserRules{}
+	rules.Rules.AllowDomains = []FirewallRule{{Pattern: "allow-5", Priority: 5}, {Pattern: "allow-1", Priority: 1}}
+	rules.Rules.DenyIPs = []FirewallRule{{Pattern: "deny-5", Priority: 5}}
+	rules.Rules.AllowURLPatterns = []FirewallRule{{Pattern: "(", Priority: 3}}
+	rules.compile()
+
+	want := []string{"allow-1", "(", "deny-5", "allow-5"}
+	if len(rules.compiled) != len(want) {
+		t.Fatalf("compiled %d rules, want %d", len(rules.compiled), len(want))
+	}
+	for i, cr := range rules.compiled {
+		if cr.rule.Pattern != want[i] {
+			t.Errorf("rule %d = %q, want %q", i, cr.rule.Pattern, want[i])
+		}
+	}
+
+	// An invalid URL pattern is kept in order but never matches
+	if rules.compiled[1].regex != nil {
+		t.Error("invalid pattern should not compile")
+	}
+}
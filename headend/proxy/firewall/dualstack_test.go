@@ -0,0 +1,91 @@
+package firewall
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIPv6Targets(t *testing.T) {
+	alice := UserRules{UserID: "alice"}
+	alice.Rules.DenyIPs = []FirewallRule{{Pattern: "2001:db8::1", Priority: 1}}
+	alice.Rules.DenyIPRanges = []FirewallRule{{Pattern: "2001:db8:bad::/48", Priority: 2}}
+	alice.Rules.AllowIPRanges = []FirewallRule{
+		{Pattern: "2001:db8::/32", Priority: 10},
+		{Pattern: "10.0.0.0/8", Priority: 10},
+	}
+
+	m := NewManager("", "")
+	m.SetDecisionCache(0, 0)
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"[2001:db8::1]:443", false},
+		{"[2001:db8::1]", false},
+		{"2001:db8::1", false},
+		{"https://[2001:DB8::1]/path", false},
+		{"[2001:db8:bad::7]:80", false},
+		{"[2001:db8::2]:443", true},
+		{"[2001:db9::2]:443", false},
+		// IPv4-mapped addresses match IPv4 rules
+		{"[::ffff:10.1.2.3]:443", true},
+	}
+	for _, tt := range tests {
+		if d := m.Decide("alice", tt.target); d.Allowed != tt.allowed {
+			t.Errorf("Decide(%q) = %+v, want allowed %v", tt.target, d, tt.allowed)
+		}
+	}
+}
+
+func TestParseIPv6ConnectionTarget(t *testing.T) {
+	m := NewManager("", "")
+
+	got := m.parseConnectionTarget("tcp:[fd00:200::1:2]:5000->[2001:db8::1]:443:inbound")
+	want := map[string]string{
+		"protocol":  "tcp",
+		"src_ip":    "fd00:200::1:2",
+		"src_port":  "5000",
+		"dst_ip":    "2001:db8::1",
+		"dst_port":  "443",
+		"direction": "inbound",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// IPv4 targets parse as before
+	got = m.parseConnectionTarget("udp:10.200.1.2:5000->8.8.8.8:53")
+	if got["src_ip"] != "10.200.1.2" || got["dst_ip"] != "8.8.8.8" || got["dst_port"] != "53" || got["direction"] != "outbound" {
+		t.Errorf("unexpected IPv4 parse %v", got)
+	}
+
+	rule := FirewallRule{Protocol: "tcp", DstIP: "2001:db8::/32", DstPort: "443"}
+	if !m.matchProtocolRule(rule, "tcp:[fd00:200::1:2]:5000->[2001:db8::1]:443") {
+		t.Error("expected the IPv6 protocol rule to match")
+	}
+}
+
+func TestPinnedAAAARecords(t *testing.T) {
+	alice := UserRules{UserID: "alice"}
+	alice.Rules.DenyDomains = []FirewallRule{{Pattern: "blocked.example.com", Priority: 1}}
+	alice.Rules.AllowIPRanges = []FirewallRule{{Pattern: "::/0", Priority: 10}}
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+	m.SetFQDNPinning(time.Minute)
+	m.pinner.lookup = fakeLookup(map[string]string{"blocked.example.com": "2001:db8::10"})
+	m.updatePins()
+
+	// Any spelling of the address hits the pin
+	for _, target := range []string{"[2001:db8::10]:443", "[2001:0db8:0:0::10]:443"} {
+		if d := m.Decide("alice", target); d.Allowed {
+			t.Errorf("expected %s denied through the AAAA pin, got %+v", target, d)
+		}
+	}
+	if d := m.Decide("alice", "[2001:db8::11]:443"); !d.Allowed {
+		t.Errorf("unpinned address should still be allowed, got %+v", d)
+	}
+}
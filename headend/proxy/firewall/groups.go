@@ -0,0 +1,126 @@
+package firewall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GroupPrecedence controls how a user's own rules are merged with the rule
+// sets of the groups they belong to
+type GroupPrecedence string
+
+const (
+	// GroupPrecedencePriority merges user and group rules by priority, the
+	// same way a single rule set is ordered; user rules win ties
+	GroupPrecedencePriority GroupPrecedence = "priority"
+	// GroupPrecedenceUser evaluates every user rule before any group rule,
+	// so individual exceptions override team policy
+	GroupPrecedenceUser GroupPrecedence = "user"
+	// GroupPrecedenceGroup evaluates every group rule before any user rule,
+	// so team policy can't be overridden per user
+	GroupPrecedenceGroup GroupPrecedence = "group"
+)
+
+// ParseGroupPrecedence validates a precedence name from configuration
+func ParseGroupPrecedence(name string) (GroupPrecedence, error) {
+	switch p := GroupPrecedence(strings.ToLower(name)); p {
+	case GroupPrecedencePriority, GroupPrecedenceUser, GroupPrecedenceGroup:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown group precedence %q", name)
+	}
+}
+
+// SetGroupPrecedence sets how group rule sets merge with user rules. Call
+// before Start.
+func (m *Manager) SetGroupPrecedence(precedence GroupPrecedence) {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.groupPrecedence = precedence
+}
+
+// effectiveRules returns the rules serving a user who belongs to groups:
+// the user's rule-set version merged with the rule sets of their groups.
+// Group rule sets are only served from the stable version. Caller must
+// hold updateMutex.
+func (m *Manager) effectiveRules(userID string, groups []string) (*UserRules, string) {
+	rules, version := m.rulesForUser(userID)
+
+	var groupSets []*UserRules
+	for _, group := range sortedGroups(groups) {
+		if groupRules, ok := m.groupRules[group]; ok {
+			groupSets = append(groupSets, groupRules)
+		}
+	}
+	if len(groupSets) == 0 {
+		return rules, version
+	}
+	return mergeRules(userID, rules, groupSets, m.groupPrecedence), version
+}
+
+// mergeRules combines a user's rules, which may be nil, with group rule
+// sets into one compiled rule set
+func mergeRules(userID string, user *UserRules, groupSets []*UserRules, precedence GroupPrecedence) *UserRules {
+	merged := &UserRules{UserID: userID}
+	var userCompiled, groupCompiled []compiledRule
+	if user != nil {
+		merged.Timestamp = user.Timestamp
+		merged.Rules = user.Rules
+		userCompiled = user.compiled
+	}
+
+	for _, group := range groupSets {
+		merged.appendRules(group)
+		groupCompiled = append(groupCompiled, group.compiled...)
+	}
+	// Rules of several groups are ordered among themselves by priority
+	sortCompiled(groupCompiled)
+
+	compiled := make([]compiledRule, 0, len(userCompiled)+len(groupCompiled))
+	switch precedence {
+	case GroupPrecedenceGroup:
+		compiled = append(append(compiled, groupCompiled...), userCompiled...)
+	case GroupPrecedenceUser:
+		compiled = append(append(compiled, userCompiled...), groupCompiled...)
+	default:
+		compiled = append(append(compiled, userCompiled...), groupCompiled...)
+		sortCompiled(compiled)
+	}
+	merged.compiled = compiled
+	return merged
+}
+
+// appendRules adds other's rule lists to r's without modifying the slices
+// r may share with another rule set
+func (r *UserRules) appendRules(other *UserRules) {
+	cat := func(a, b []FirewallRule) []FirewallRule {
+		return append(a[:len(a):len(a)], b...)
+	}
+	r.Rules.AllowDomains = cat(r.Rules.AllowDomains, other.Rules.AllowDomains)
+	r.Rules.DenyDomains = cat(r.Rules.DenyDomains, other.Rules.DenyDomains)
+	r.Rules.AllowIPs = cat(r.Rules.AllowIPs, other.Rules.AllowIPs)
+	r.Rules.DenyIPs = cat(r.Rules.DenyIPs, other.Rules.DenyIPs)
+	r.Rules.AllowIPRanges = cat(r.Rules.AllowIPRanges, other.Rules.AllowIPRanges)
+	r.Rules.DenyIPRanges = cat(r.Rules.DenyIPRanges, other.Rules.DenyIPRanges)
+	r.Rules.AllowURLPatterns = cat(r.Rules.AllowURLPatterns, other.Rules.AllowURLPatterns)
+	r.Rules.DenyURLPatterns = cat(r.Rules.DenyURLPatterns, other.Rules.DenyURLPatterns)
+	r.Rules.AllowProtocolRules = cat(r.Rules.AllowProtocolRules, other.Rules.AllowProtocolRules)
+	r.Rules.DenyProtocolRules = cat(r.Rules.DenyProtocolRules, other.Rules.DenyProtocolRules)
+}
+
+// sortedGroups returns a sorted copy of groups so that the same membership
+// always merges, and caches, the same way
+func sortedGroups(groups []string) []string {
+	if len(groups) < 2 {
+		return groups
+	}
+	sorted := append([]string(nil), groups...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// groupsKey identifies a group membership in the decision cache
+func groupsKey(groups []string) string {
+	return strings.Join(sortedGroups(groups), "\x00")
+}
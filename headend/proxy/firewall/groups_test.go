@@ -0,0 +1,128 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGroupPrecedence(t *testing.T) {
+	// alice has a personal exception allowing a domain her team denies,
+	// with a lower priority than the team rule
+	alice := UserRules{UserID: "alice"}
+	alice.Rules.AllowDomains = []FirewallRule{{Pattern: "social.example.com", Priority: 50}}
+	team := UserRules{}
+	team.Rules.DenyDomains = []FirewallRule{{Pattern: "social.example.com", Priority: 10}}
+	team.Rules.AllowDomains = []FirewallRule{{Pattern: "*.corp.example.com", Priority: 100}}
+
+	tests := []struct {
+		precedence GroupPrecedence
+		allowed    bool
+	}{
+		{GroupPrecedencePriority, false},
+		{GroupPrecedenceUser, true},
+		{GroupPrecedenceGroup, false},
+	}
+	for _, tt := range tests {
+		m := NewManager("", "")
+		m.SetGroupPrecedence(tt.precedence)
+		m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+		m.groupRules = copyUserRules(map[string]UserRules{"engineering": team})
+
+		if d := m.DecideWithGroups("alice", []string{"engineering"}, "social.example.com"); d.Allowed != tt.allowed {
+			t.Errorf("%s precedence: expected allowed=%v, got %+v", tt.precedence, tt.allowed, d)
+		}
+		if d := m.DecideWithGroups("alice", []string{"engineering"}, "git.corp.example.com"); !d.Allowed {
+			t.Errorf("%s precedence: group allow rule not applied: %+v", tt.precedence, d)
+		}
+		// Without the membership only alice's own rules apply
+		if d := m.DecideWithGroups("alice", nil, "social.example.com"); !d.Allowed {
+			t.Errorf("%s precedence: decision cached across memberships: %+v", tt.precedence, d)
+		}
+	}
+}
+
+func TestGroupRulesWithoutUserRules(t *testing.T) {
+	team := domainRules("", "intranet.example.com", AccessTypeAllow)
+
+	m := NewManager("", "")
+	m.groupRules = copyUserRules(map[string]UserRules{"staff": team})
+
+	if d := m.DecideWithGroups("bob", []string{"staff"}, "intranet.example.com"); !d.Allowed {
+		t.Errorf("expected the group rule set to serve a user with no rules, got %+v", d)
+	}
+	if d := m.Decide("bob", "intranet.example.com"); d.Allowed || d.Reason != "no_rules" {
+		t.Errorf("expected no_rules without the membership, got %+v", d)
+	}
+
+	policy := m.GetLocalPolicy("bob", []string{"staff"})
+	if len(policy.DenyDomains) != 0 {
+		t.Errorf("unexpected local deny rules: %+v", policy)
+	}
+}
+
+func TestLocalPolicyRespectsUserPrecedence(t *testing.T) {
+	alice := domainRules("alice", "social.example.com", AccessTypeAllow)
+	alice.Rules.AllowDomains[0].Priority = 50
+	team := UserRules{}
+	team.Rules.DenyDomains = []FirewallRule{
+		{Pattern: "social.example.com", Priority: 10},
+		{Pattern: "malware.example.com", Priority: 10},
+	}
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+	m.groupRules = copyUserRules(map[string]UserRules{"engineering": team})
+
+	if policy := m.GetLocalPolicy("alice", []string{"engineering"}); len(policy.DenyDomains) != 2 {
+		t.Errorf("priority precedence: expected both team denies, got %+v", policy.DenyDomains)
+	}
+
+	// alice's allow is evaluated first, so no team deny is safe locally
+	m.SetGroupPrecedence(GroupPrecedenceUser)
+	if policy := m.GetLocalPolicy("alice", []string{"engineering"}); len(policy.DenyDomains) != 0 {
+		t.Errorf("user precedence: expected no local denies, got %+v", policy.DenyDomains)
+	}
+}
+
+func TestFetchRulesGroupDelta(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{
+			Cursor:     "10",
+			UserRules:  map[string]UserRules{"alice": domainRules("alice", "example.com", AccessTypeAllow)},
+			GroupRules: map[string]UserRules{"contractors": domainRules("", "example.com", AccessTypeDeny)},
+		}),
+		respond(AllRulesResponse{
+			Cursor:        "11",
+			Delta:         true,
+			RemovedGroups: []string{"contractors"},
+		}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	m := NewManager(server.URL, "token")
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("full fetch: %v", err)
+	}
+	// Equal priority: the group deny wins over the user allow
+	if d := m.DecideWithGroups("alice", []string{"contractors"}, "example.com"); d.Allowed {
+		t.Fatalf("expected the contractors deny to apply, got %+v", d)
+	}
+
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("delta fetch: %v", err)
+	}
+	if d := m.DecideWithGroups("alice", []string{"contractors"}, "example.com"); !d.Allowed {
+		t.Errorf("removed group still applied: %+v", d)
+	}
+}
+
+func TestParseGroupPrecedence(t *testing.T) {
+	if p, err := ParseGroupPrecedence("User"); err != nil || p != GroupPrecedenceUser {
+		t.Errorf("got %q, %v", p, err)
+	}
+	if _, err := ParseGroupPrecedence("random"); err == nil {
+		t.Error("expected an error for an unknown precedence")
+	}
+}
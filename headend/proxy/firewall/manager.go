@@ -7,8 +7,30 @@
 // - Source and destination port range filtering
 // - Directional traffic control (inbound, outbound, bidirectional)
 // - Priority-based rule processing and conflict resolution
-// - Real-time rule updates from the Manager service
-// - Redis caching with randomized refresh intervals to prevent thundering herd
+// - Real-time rule updates from the Manager service, transferring only the
+//   users whose rules changed, with periodic full resyncs
+// - Group rule sets merged with each user's own rules, with configurable
+//   precedence, so policy can be managed per team
+// - Canary and percentage-based rollout of new rule-set versions
+// - A policy mode, configured or sent by the Manager, that can relax
+//   enforcement to logging would-be denials or disable the firewall
+// - A remediation profile that confines individual users, such as clients
+//   with recently expired certificates, to a few renewal targets
+// - A Manager-defined quarantine profile for users failing posture checks
+//   or flagged by anomaly detection
+// - Logical upstream targets defined in the Manager, handed on to the
+//   proxy's load balancer
+// - Shadow-mode ("monitor") rules that are evaluated and logged but not enforced
+// - Compact local deny policies for client-side fast failure
+// - A summary of each user's effective policy, so users can see what they
+//   can access
+// - Rule sets compiled and sorted at fetch time, with an LRU decision cache
+//   that is cleared whenever rules are refreshed
+// - FQDN pinning, which resolves the domains of domain rules so connections
+//   made by IP address can't bypass them
+// - Randomized refresh intervals to prevent thundering herd, and an optional
+//   Redis cache of the Manager's rule responses shared by a fleet of
+//   headends, invalidated by the Manager when rules change
 //
 // The firewall integrates with the proxy's request processing pipeline to
 // enforce access controls before traffic is forwarded to destinations.
@@ -17,12 +39,14 @@ package firewall
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,6 +72,16 @@ const (
 	AccessTypeDeny  AccessType = "deny"
 )
 
+// RuleMode controls whether a matching rule decides the verdict
+type RuleMode string
+
+const (
+	RuleModeEnforce RuleMode = "enforce"
+	// RuleModeMonitor rules are evaluated and their would-be verdict is
+	// logged and metered, but they never affect the enforced verdict
+	RuleModeMonitor RuleMode = "monitor"
+)
+
 type FirewallRule struct {
 	Pattern     string                 `json:"pattern"`
 	Priority    int                    `json:"priority"`
@@ -58,6 +92,10 @@ type FirewallRule struct {
 	SrcPort     string                 `json:"src_port,omitempty"`
 	DstPort     string                 `json:"dst_port,omitempty"`
 	Direction   string                 `json:"direction,omitempty"`
+	Mode        RuleMode               `json:"mode,omitempty"` // empty means enforce
+	// Tags label the rule for features acting on the traffic it allows,
+	// such as egress routes
+	Tags []string `json:"tags,omitempty"`
 }
 
 type UserRules struct {
@@ -75,31 +113,257 @@ type UserRules struct {
 		AllowProtocolRules []FirewallRule `json:"allow_protocol_rules"`
 		DenyProtocolRules  []FirewallRule `json:"deny_protocol_rules"`
 	} `json:"rules"`
+
+	// compiled is every rule in evaluation order, built when the rules are
+	// fetched so decisions don't rebuild and sort the list each time
+	compiled []compiledRule
+}
+
+// compiledRule is a rule ready for matching. URL patterns are compiled
+// once; an invalid pattern has a nil regex and never matches.
+type compiledRule struct {
+	rule       FirewallRule
+	ruleType   RuleType
+	accessType AccessType
+	regex      *regexp.Regexp
+}
+
+// compile builds the priority-ordered rule list. Lower priority numbers are
+// evaluated first; on equal priority deny rules precede allow rules, and
+// rules otherwise keep the order the Manager sent them in.
+func (r *UserRules) compile() {
+	lists := []struct {
+		rules      []FirewallRule
+		ruleType   RuleType
+		accessType AccessType
+	}{
+		{r.Rules.DenyDomains, RuleTypeDomain, AccessTypeDeny},
+		{r.Rules.DenyIPs, RuleTypeIP, AccessTypeDeny},
+		{r.Rules.DenyIPRanges, RuleTypeIPRange, AccessTypeDeny},
+		{r.Rules.DenyURLPatterns, RuleTypeURLPattern, AccessTypeDeny},
+		{r.Rules.DenyProtocolRules, RuleTypeProtocolRule, AccessTypeDeny},
+		{r.Rules.AllowDomains, RuleTypeDomain, AccessTypeAllow},
+		{r.Rules.AllowIPs, RuleTypeIP, AccessTypeAllow},
+		{r.Rules.AllowIPRanges, RuleTypeIPRange, AccessTypeAllow},
+		{r.Rules.AllowURLPatterns, RuleTypeURLPattern, AccessTypeAllow},
+		{r.Rules.AllowProtocolRules, RuleTypeProtocolRule, AccessTypeAllow},
+	}
+
+	compiled := []compiledRule{}
+	for _, list := range lists {
+		for _, rule := range list.rules {
+			cr := compiledRule{rule: rule, ruleType: list.ruleType, accessType: list.accessType}
+			if list.ruleType == RuleTypeURLPattern {
+				regex, err := regexp.Compile("(?i)" + rule.Pattern)
+				if err != nil {
+					log.Errorf("Invalid regex pattern for user %s: %s, error: %v", r.UserID, rule.Pattern, err)
+				}
+				cr.regex = regex
+			}
+			compiled = append(compiled, cr)
+		}
+	}
+
+	sortCompiled(compiled)
+	r.compiled = compiled
+}
+
+// sortCompiled orders rules by priority, deny before allow on equal
+// priority, keeping the order of rules that are otherwise equal
+func sortCompiled(compiled []compiledRule) {
+	sort.SliceStable(compiled, func(i, j int) bool {
+		if compiled[i].rule.Priority != compiled[j].rule.Priority {
+			return compiled[i].rule.Priority < compiled[j].rule.Priority
+		}
+		return compiled[i].accessType == AccessTypeDeny && compiled[j].accessType == AccessTypeAllow
+	})
 }
 
+// AllRulesResponse is the Manager's rule set. Cursor identifies the point in
+// the Manager's change history it reflects. When Delta is set, UserRules
+// and GroupRules only hold users and groups whose rules changed since the
+// requested cursor, and RemovedUsers and RemovedGroups those who no longer
+// have any. Group rule sets have the same shape as user rule sets and are
+// keyed by group name.
 type AllRulesResponse struct {
-	Timestamp  string               `json:"timestamp"`
-	RulesCount int                  `json:"rules_count"`
-	UserRules  map[string]UserRules `json:"user_rules"`
+	Timestamp       string               `json:"timestamp"`
+	Version         string               `json:"version,omitempty"`
+	RulesCount      int                  `json:"rules_count"`
+	UserRules       map[string]UserRules `json:"user_rules"`
+	GroupRules      map[string]UserRules `json:"group_rules,omitempty"`
+	RolloutVersions []RolloutVersion     `json:"rollout_versions,omitempty"`
+	Cursor          string               `json:"cursor,omitempty"`
+	Delta           bool                 `json:"delta,omitempty"`
+	RemovedUsers    []string             `json:"removed_users,omitempty"`
+	RemovedGroups   []string             `json:"removed_groups,omitempty"`
+	PolicyMode      string               `json:"policy_mode,omitempty"` // overrides the configured mode
+	Quarantine      *QuarantinePolicy    `json:"quarantine,omitempty"`  // sent whole, also with deltas
+	Upstreams       map[string][]string  `json:"upstreams,omitempty"`   // logical target -> backends, sent whole
+}
+
+// RolloutVersion is a candidate rule-set version served to a subset of users
+// before it replaces the stable version. Users are assigned to the cohort by
+// a stable hash of their ID, so raising Percent only ever adds users.
+type RolloutVersion struct {
+	Version   string               `json:"version"`
+	Percent   int                  `json:"percent"`
+	Labels    []string             `json:"labels,omitempty"`
+	Users     []string             `json:"users,omitempty"` // always in the cohort
+	UserRules map[string]UserRules `json:"user_rules"`
+}
+
+// Decision is the outcome of evaluating a target against a user's rules.
+// ShadowRule is the highest-priority monitor rule that matched ahead of the
+// enforced verdict; ShadowAllowed is what the verdict would be if it were
+// enforced. WouldDeny marks a denial that permissive mode let through;
+// Reason and MatchedRule still describe the denial.
+type Decision struct {
+	Allowed       bool
+	PolicyVersion string
+	MatchedRule   *FirewallRule
+	Reason        string
+	ShadowRule    *FirewallRule
+	ShadowAllowed bool
+	WouldDeny     bool
+}
+
+// RuleLabel identifies what decided the verdict: the matched rule pattern,
+// or the reason when no enforcing rule matched
+func (d Decision) RuleLabel() string {
+	if d.MatchedRule != nil {
+		return d.MatchedRule.Pattern
+	}
+	return d.Reason
+}
+
+// ShadowAction returns the would-be verdict of the matched monitor rule, or
+// an empty string when no monitor rule matched
+func (d Decision) ShadowAction() string {
+	if d.ShadowRule == nil {
+		return ""
+	}
+	return verdictLabel(d.ShadowAllowed)
+}
+
+// DenialLabel classifies why the decision denied access, for metrics:
+// blocked, quarantined, remediation, firewall_rule or firewall_default. It
+// is empty when access was allowed. Unlike Reason it never carries the
+// block source or remediation cause, so it keeps the series count fixed.
+func (d Decision) DenialLabel() string {
+	switch {
+	case d.Allowed:
+		return ""
+	case strings.HasPrefix(d.Reason, "blocked_by_"):
+		return "blocked"
+	case strings.HasPrefix(d.Reason, "remediation_"):
+		return "remediation"
+	case d.Reason == "quarantined":
+		return "quarantined"
+	case d.Reason == "rule_"+string(AccessTypeDeny):
+		return "firewall_rule"
+	default:
+		return "firewall_default"
+	}
+}
+
+type rollout struct {
+	version   string
+	percent   int
+	labels    []string
+	users     map[string]bool
+	userRules map[string]*UserRules
 }
 
 type Manager struct {
 	managerURL    string
 	authToken     string
 	userRules     map[string]*UserRules
+	groupRules    map[string]*UserRules
+	version       string
+	rollouts      []*rollout
 	lastUpdate    time.Time
 	updateMutex   sync.RWMutex
 	refreshTicker *time.Ticker
 	stopChan      chan bool
+	cache         *decisionCache
+	
+	groupPrecedence GroupPrecedence
+	configMode      PolicyMode
+	managerMode     PolicyMode
+	
+	// Users confined to the remediation profile, by reason
+	remediation *UserRules
+	restricted  map[string]string
+	
+	// Users held to the Manager's quarantine profile
+	quarantineRules *UserRules
+	quarantined     map[string]Quarantine
+	
+	// Temporary blocks by user and target, see blocks.go
+	blocks map[string]map[string]TemporaryBlock
+	
+	// Receives the logical upstream targets, see upstreams.go
+	upstreamsHandler func(map[string][]string)
+	
+	// FQDN pinning: resolved address -> domains, see pinning.go
+	pinner *fqdnPinner
+	pins   map[string][]string
+	
+	// Rule responses shared with the rest of the fleet, see shared.go
+	shared    SharedCache
+	sharedTTL time.Duration
+	
+	// Delta sync state; fetchMutex keeps forced refreshes from racing the
+	// scheduled ones
+	fetchMutex         sync.Mutex
+	cursor             string
+	lastFullSync       time.Time
+	fullResyncInterval time.Duration
 }
 
+// DefaultFullResyncInterval is how often the full rule set is fetched even
+// when deltas are available, bounding drift from changes a delta can't
+// express, such as users being deactivated
+const DefaultFullResyncInterval = 15 * time.Minute
+
 func NewManager(managerURL, authToken string) *Manager {
 	return &Manager{
 		managerURL:  managerURL,
 		authToken:   authToken,
 		userRules:   make(map[string]*UserRules),
+		groupRules:  make(map[string]*UserRules),
+		restricted:  make(map[string]string),
+		quarantined: make(map[string]Quarantine),
+		blocks:      make(map[string]map[string]TemporaryBlock),
 		stopChan:    make(chan bool),
+		cache:       newDecisionCache(DefaultDecisionCacheSize, DefaultDecisionCacheTTL),
+		
+		groupPrecedence:    GroupPrecedencePriority,
+		configMode:         PolicyModeEnforce,
+		fullResyncInterval: DefaultFullResyncInterval,
+	}
+}
+
+// SetFullResyncInterval sets how often the full rule set is fetched instead
+// of a delta. Zero or less fetches the full set on every refresh. Call
+// before Start.
+func (m *Manager) SetFullResyncInterval(interval time.Duration) {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.fullResyncInterval = interval
+}
+
+// SetDecisionCache resizes the decision cache, dropping its contents. A
+// size or TTL of zero disables caching. Call before Start.
+func (m *Manager) SetDecisionCache(size int, ttl time.Duration) {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	
+	if size <= 0 || ttl <= 0 {
+		m.cache = nil
+		return
 	}
+	m.cache = newDecisionCache(size, ttl)
 }
 
 func (m *Manager) Start() error {
@@ -119,6 +383,13 @@ func (m *Manager) Start() error {
 	m.refreshTicker = time.NewTicker(refreshInterval)
 	go m.refreshLoop()
 	
+	if m.pinner != nil {
+		go m.pinLoop()
+	}
+	if m.shared != nil {
+		go m.watchShared()
+	}
+	
 	log.Info("Firewall manager started successfully")
 	return nil
 }
@@ -133,6 +404,23 @@ func (m *Manager) Stop() {
 	close(m.stopChan)
 }
 
+// Refresh fetches rules from the Manager now rather than at the next
+// scheduled refresh. full discards the delta cursor so the whole rule set
+// is fetched.
+func (m *Manager) Refresh(full bool) error {
+	if full {
+		m.updateMutex.Lock()
+		m.lastFullSync = time.Time{}
+		m.updateMutex.Unlock()
+	}
+	
+	if err := m.fetchRules(); err != nil {
+		return err
+	}
+	m.pinner.refresh()
+	return nil
+}
+
 func (m *Manager) refreshLoop() {
 	for {
 		select {
@@ -140,6 +428,8 @@ func (m *Manager) refreshLoop() {
 			if err := m.fetchRules(); err != nil {
 				log.Errorf("Failed to refresh rules: %v", err)
 			} else {
+				m.pinner.refresh()
+				
 				// Randomize next refresh interval to prevent synchronization
 				nextInterval := time.Duration(30+rand.Intn(61)) * time.Second
 				m.refreshTicker.Reset(nextInterval)
@@ -151,14 +441,103 @@ func (m *Manager) refreshLoop() {
 	}
 }
 
+// fetchRules pulls rules from the Manager. Once a full rule set has been
+// loaded, only users whose rules changed since the returned cursor are
+// requested; a full set is fetched again every fullResyncInterval, and the
+// Manager answers with a full set whenever it can't serve a delta.
 func (m *Manager) fetchRules() error {
+	m.fetchMutex.Lock()
+	defer m.fetchMutex.Unlock()
+	
+	m.updateMutex.RLock()
+	cursor := m.cursor
+	if time.Since(m.lastFullSync) >= m.fullResyncInterval {
+		cursor = ""
+	}
+	m.updateMutex.RUnlock()
+	
+	sharedKey := m.sharedKey(cursor)
+	body, notModified, shared, err := m.readRules(sharedKey, cursor)
+	if err != nil {
+		return err
+	}
+	
+	if notModified {
+		if !shared {
+			m.storeShared(sharedKey, nil)
+		}
+		m.updateMutex.Lock()
+		m.lastUpdate = time.Now()
+		m.updateMutex.Unlock()
+		firewallSyncs.WithLabelValues("not_modified").Inc()
+		log.Debugf("Firewall rules unchanged since cursor %q", cursor)
+		return nil
+	}
+	
+	var rulesResponse AllRulesResponse
+	if err := json.Unmarshal(body, &rulesResponse); err != nil {
+		return fmt.Errorf("failed to decode rules response: %w", err)
+	}
+	
+	// A delta is only meaningful against the rules it was requested for
+	if rulesResponse.Delta && cursor == "" {
+		return fmt.Errorf("manager sent a delta for a full rules request")
+	}
+	if !shared {
+		m.storeShared(sharedKey, body)
+	}
+	
+	rollouts := buildRollouts(rulesResponse.RolloutVersions)
+	userRules := copyUserRules(rulesResponse.UserRules)
+	groupRules := copyUserRules(rulesResponse.GroupRules)
+	
+	if rulesResponse.Delta {
+		m.applyDelta(&rulesResponse, userRules, groupRules, rollouts)
+		if rulesResponse.Upstreams != nil {
+			m.applyUpstreams(rulesResponse.Upstreams)
+		}
+		return nil
+	}
+	
+	m.updateMutex.Lock()
+	m.userRules = userRules
+	m.groupRules = groupRules
+	m.version = rulesResponse.Version
+	m.rollouts = rollouts
+	m.setManagerMode(rulesResponse.PolicyMode)
+	m.applyQuarantine(rulesResponse.Quarantine)
+	m.cursor = rulesResponse.Cursor
+	m.lastUpdate = time.Now()
+	m.lastFullSync = m.lastUpdate
+	// Decisions made under the old rules must not outlive them
+	if m.cache != nil {
+		m.cache.clear()
+	}
+	m.updateMutex.Unlock()
+	m.applyUpstreams(rulesResponse.Upstreams)
+	
+	firewallSyncs.WithLabelValues("full").Inc()
+	log.Infof("Updated firewall rules for %d users and %d groups (version %q, %d rollout versions)",
+		len(rulesResponse.UserRules), len(rulesResponse.GroupRules), rulesResponse.Version, len(rollouts))
+	return nil
+}
+
+// requestRules asks the Manager for the rules changed since cursor, or the
+// full rule set when cursor is empty. notModified reports a 304 for a
+// cursor, in which case body is nil.
+func (m *Manager) requestRules(cursor string) (body []byte, notModified bool, err error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 	
-	req, err := http.NewRequest("GET", m.managerURL+"/api/v1/firewall/rules", nil)
+	rulesURL := m.managerURL + "/api/v1/firewall/rules"
+	if cursor != "" {
+		rulesURL += "?cursor=" + url.QueryEscape(cursor)
+	}
+	
+	req, err := http.NewRequest("GET", rulesURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
 	}
 	
 	req.Header.Set("Authorization", "Bearer "+m.authToken)
@@ -166,7 +545,7 @@ func (m *Manager) fetchRules() error {
 	
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to fetch rules: %w", err)
+		return nil, false, fmt.Errorf("failed to fetch rules: %w", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -174,102 +553,306 @@ func (m *Manager) fetchRules() error {
 		}
 	}()
 	
+	if resp.StatusCode == http.StatusNotModified && cursor != "" {
+		return nil, true, nil
+	}
+	
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to fetch rules: status %d, body: %s", resp.StatusCode, string(body))
+		return nil, false, fmt.Errorf("failed to fetch rules: status %d, body: %s", resp.StatusCode, string(body))
 	}
 	
-	var rulesResponse AllRulesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&rulesResponse); err != nil {
-		return fmt.Errorf("failed to decode rules response: %w", err)
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read rules response: %w", err)
 	}
-	
-	// Update local cache
+	return body, false, nil
+}
+
+// applyDelta merges the user and group rule sets that changed since the
+// last cursor. Version and rollouts are replaced only when the delta
+// carries them.
+func (m *Manager) applyDelta(delta *AllRulesResponse, changed, changedGroups map[string]*UserRules, rollouts []*rollout) {
 	m.updateMutex.Lock()
-	m.userRules = make(map[string]*UserRules)
-	for userID, rules := range rulesResponse.UserRules {
-		userRulesCopy := rules
-		m.userRules[userID] = &userRulesCopy
+	defer m.updateMutex.Unlock()
+	
+	affected := make(map[string]bool, len(changed)+len(delta.RemovedUsers))
+	for userID, rules := range changed {
+		m.userRules[userID] = rules
+		affected[userID] = true
 	}
+	for _, userID := range delta.RemovedUsers {
+		delete(m.userRules, userID)
+		affected[userID] = true
+	}
+	
+	// Group members aren't known until they connect, so any group change
+	// invalidates every cached decision
+	policyChanged := len(changedGroups) > 0 || len(delta.RemovedGroups) > 0
+	for group, rules := range changedGroups {
+		m.groupRules[group] = rules
+	}
+	for _, group := range delta.RemovedGroups {
+		delete(m.groupRules, group)
+	}
+	
+	if delta.Version != "" && delta.Version != m.version {
+		m.version = delta.Version
+		policyChanged = true
+	}
+	if delta.RolloutVersions != nil {
+		m.rollouts = rollouts
+		policyChanged = true
+	}
+	
+	if delta.PolicyMode != "" {
+		m.setManagerMode(delta.PolicyMode)
+	}
+	if delta.Quarantine != nil {
+		for userID := range m.applyQuarantine(delta.Quarantine) {
+			affected[userID] = true
+		}
+	}
+	m.cursor = delta.Cursor
 	m.lastUpdate = time.Now()
-	m.updateMutex.Unlock()
 	
-	log.Infof("Updated firewall rules for %d users", len(rulesResponse.UserRules))
-	return nil
+	if m.cache != nil {
+		if policyChanged {
+			m.cache.clear()
+		} else if len(affected) > 0 {
+			m.cache.clearUsers(affected)
+		}
+	}
+	
+	firewallSyncs.WithLabelValues("delta").Inc()
+	if len(affected) > 0 || policyChanged {
+		log.Infof("Applied firewall rule delta: %d users updated, %d removed, %d groups updated, %d removed (version %q, cursor %q)",
+			len(changed), len(delta.RemovedUsers), len(changedGroups), len(delta.RemovedGroups), m.version, m.cursor)
+	}
 }
 
+// buildRollouts validates rollout versions from the Manager
+func buildRollouts(versions []RolloutVersion) []*rollout {
+	rollouts := make([]*rollout, 0, len(versions))
+	for _, rv := range versions {
+		if rv.Version == "" || rv.Percent < 0 || rv.Percent > 100 {
+			log.Warnf("Ignoring invalid rollout version %q (percent %d)", rv.Version, rv.Percent)
+			continue
+		}
+		r := &rollout{
+			version:   rv.Version,
+			percent:   rv.Percent,
+			labels:    rv.Labels,
+			users:     make(map[string]bool, len(rv.Users)),
+			userRules: copyUserRules(rv.UserRules),
+		}
+		for _, userID := range rv.Users {
+			r.users[userID] = true
+		}
+		rollouts = append(rollouts, r)
+	}
+	return rollouts
+}
+
+func copyUserRules(src map[string]UserRules) map[string]*UserRules {
+	dst := make(map[string]*UserRules, len(src))
+	for userID, rules := range src {
+		userRulesCopy := rules
+		userRulesCopy.compile()
+		dst[userID] = &userRulesCopy
+	}
+	return dst
+}
+
+// cohortBucket maps a user to a stable bucket in [0, 100)
+func cohortBucket(userID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return int(h.Sum32() % 100)
+}
+
+// rulesForUser selects the rule-set version that serves a user: the first
+// rollout version whose cohort contains the user and which has rules for
+// them, otherwise the stable version. Caller must hold updateMutex.
+func (m *Manager) rulesForUser(userID string) (*UserRules, string) {
+	for _, r := range m.rollouts {
+		if !r.users[userID] && cohortBucket(userID) >= r.percent {
+			continue
+		}
+		if rules, ok := r.userRules[userID]; ok {
+			return rules, r.version
+		}
+	}
+	return m.userRules[userID], m.version
+}
+
+// CheckAccess reports whether userID may reach target
 func (m *Manager) CheckAccess(userID, target string) bool {
+	return m.Decide(userID, target).Allowed
+}
+
+// Decide evaluates target against the rules serving userID and reports the
+// verdict together with the rule-set version that produced it. Decisions
+// are cached per user and target until the rules are next refreshed.
+func (m *Manager) Decide(userID, target string) Decision {
+	return m.DecideWithGroups(userID, nil, target)
+}
+
+// DecideWithGroups is Decide for a user who belongs to groups, merging the
+// groups' rule sets with the user's own
+func (m *Manager) DecideWithGroups(userID string, groups []string, target string) Decision {
+	start := time.Now()
+	source := "evaluated"
+	defer func() {
+		firewallEvaluationDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+	}()
+	
 	m.updateMutex.RLock()
 	defer m.updateMutex.RUnlock()
 	
-	rules, exists := m.userRules[userID]
-	if !exists {
-		log.Warnf("No firewall rules found for user %s, denying access", userID)
-		return false
-	}
-	
-	// Collect all rules with priorities
-	type priorityRule struct {
-		rule       FirewallRule
-		ruleType   RuleType
-		accessType AccessType
+	// Temporary blocks expire on their own, so they are checked ahead of
+	// the cache, and no policy mode relaxes them
+	if block, ok := m.blocked(userID, target, time.Now()); ok {
+		source = "blocked"
+		firewallDecisions.WithLabelValues(BlockVersion, verdictLabel(false)).Inc()
+		return Decision{Allowed: false, PolicyVersion: BlockVersion, Reason: "blocked_by_" + block.Source}
 	}
 	
-	var allRules []priorityRule
-	
-	// Add all rule types to a single list for priority-based processing
-	for _, rule := range rules.Rules.DenyDomains {
-		allRules = append(allRules, priorityRule{rule, RuleTypeDomain, AccessTypeDeny})
-	}
-	for _, rule := range rules.Rules.AllowDomains {
-		allRules = append(allRules, priorityRule{rule, RuleTypeDomain, AccessTypeAllow})
+	// The policy mode never relaxes a restriction or quarantine
+	mode := m.policyMode()
+	if m.confined(userID) {
+		mode = PolicyModeEnforce
 	}
-	for _, rule := range rules.Rules.DenyIPs {
-		allRules = append(allRules, priorityRule{rule, RuleTypeIP, AccessTypeDeny})
+	if mode == PolicyModeDisabled {
+		source = "disabled"
+		firewallDecisions.WithLabelValues(m.version, verdictLabel(true)).Inc()
+		return Decision{Allowed: true, PolicyVersion: m.version, Reason: "policy_disabled"}
 	}
-	for _, rule := range rules.Rules.AllowIPs {
-		allRules = append(allRules, priorityRule{rule, RuleTypeIP, AccessTypeAllow})
+	
+	// The cache is only filled and cleared under updateMutex, so a decision
+	// evaluated against old rules can't be stored after a refresh. Cached
+	// decisions are the rules' verdict; the policy mode applies on top.
+	var decision Decision
+	key := decisionKey{userID: userID, groups: groupsKey(groups), target: target}
+	if cached, ok := m.cachedDecision(key); ok {
+		source = "cache"
+		decision = cached
+	} else {
+		decision = m.evaluate(userID, groups, target)
+		if m.cache != nil {
+			m.cache.put(key, decision, time.Now())
+		}
 	}
-	for _, rule := range rules.Rules.DenyIPRanges {
-		allRules = append(allRules, priorityRule{rule, RuleTypeIPRange, AccessTypeDeny})
+	decision = applyPolicyMode(mode, userID, target, decision)
+	
+	// Names under wildcard rules are pinned as clients use them
+	if host := targetHostname(target); m.pinner != nil && net.ParseIP(host) == nil {
+		m.pinner.observe(host)
 	}
-	for _, rule := range rules.Rules.AllowIPRanges {
-		allRules = append(allRules, priorityRule{rule, RuleTypeIPRange, AccessTypeAllow})
+	
+	firewallDecisions.WithLabelValues(decision.PolicyVersion, verdictLabel(decision.Allowed)).Inc()
+	if decision.ShadowRule != nil {
+		diverges := decision.ShadowAllowed != decision.Allowed
+		firewallShadowDecisions.WithLabelValues(verdictLabel(decision.ShadowAllowed), strconv.FormatBool(diverges)).Inc()
+		if diverges {
+			log.Infof("Monitor rule %q would %s user %s access to %s (enforced: %s)",
+				decision.ShadowRule.Pattern, verdictLabel(decision.ShadowAllowed), userID, target, verdictLabel(decision.Allowed))
+		}
 	}
-	for _, rule := range rules.Rules.DenyURLPatterns {
-		allRules = append(allRules, priorityRule{rule, RuleTypeURLPattern, AccessTypeDeny})
+	return decision
+}
+
+// cachedDecision looks key up in the decision cache, counting the hit or miss
+func (m *Manager) cachedDecision(key decisionKey) (Decision, bool) {
+	if m.cache == nil {
+		return Decision{}, false
 	}
-	for _, rule := range rules.Rules.AllowURLPatterns {
-		allRules = append(allRules, priorityRule{rule, RuleTypeURLPattern, AccessTypeAllow})
+	decision, ok := m.cache.get(key, time.Now())
+	if ok {
+		firewallCacheHits.Inc()
+	} else {
+		firewallCacheMisses.Inc()
 	}
-	for _, rule := range rules.Rules.DenyProtocolRules {
-		allRules = append(allRules, priorityRule{rule, RuleTypeProtocolRule, AccessTypeDeny})
+	return decision, ok
+}
+
+// evaluate runs priority-ordered rule matching. Caller must hold updateMutex.
+func (m *Manager) evaluate(userID string, groups []string, target string) Decision {
+	if reason, restricted := m.restricted[userID]; restricted {
+		return m.evaluateRemediation(userID, target, reason)
 	}
-	for _, rule := range rules.Rules.AllowProtocolRules {
-		allRules = append(allRules, priorityRule{rule, RuleTypeProtocolRule, AccessTypeAllow})
+	if _, quarantined := m.quarantined[userID]; quarantined {
+		return m.evaluateQuarantine(userID, target)
 	}
 	
-	// Sort by priority (lower number = higher priority)
-	for i := 0; i < len(allRules)-1; i++ {
-		for j := i + 1; j < len(allRules); j++ {
-			if allRules[i].rule.Priority > allRules[j].rule.Priority {
-				allRules[i], allRules[j] = allRules[j], allRules[i]
-			}
-		}
+	rules, version := m.effectiveRules(userID, groups)
+	if rules == nil {
+		log.Warnf("No firewall rules found for user %s, denying access", userID)
+		return Decision{Allowed: false, PolicyVersion: version, Reason: "no_rules"}
 	}
 	
-	// Process rules in priority order
-	for _, priorityRule := range allRules {
-		if m.matchesRule(priorityRule.rule, priorityRule.ruleType, target) {
-			allowed := priorityRule.accessType == AccessTypeAllow
-			log.Debugf("User %s access to %s: %v (matched rule: %s, priority: %d)", 
-				userID, target, allowed, priorityRule.rule.Pattern, priorityRule.rule.Priority)
-			return allowed
+	// An IP target also matches the domain rules of the names it was
+	// resolved from
+	pinned := m.pinnedNames(target)
+	
+	// Process rules in priority order. Monitor rules only record the first
+	// would-be verdict; evaluation continues to the first enforcing match.
+	decision := Decision{PolicyVersion: version}
+	for _, priorityRule := range rules.compiled {
+		if !m.matchesCompiled(priorityRule, target) && !m.matchesPinned(priorityRule, pinned) {
+			continue
 		}
+		allowed := priorityRule.accessType == AccessTypeAllow
+		matched := priorityRule.rule
+		
+		if priorityRule.rule.Mode == RuleModeMonitor {
+			if decision.ShadowRule == nil {
+				decision.ShadowRule = &matched
+				decision.ShadowAllowed = allowed
+			}
+			continue
+		}
+		
+		log.Debugf("User %s access to %s: %v (matched rule: %s, priority: %d, version: %q)", 
+			userID, target, allowed, priorityRule.rule.Pattern, priorityRule.rule.Priority, version)
+		decision.Allowed = allowed
+		decision.MatchedRule = &matched
+		decision.Reason = "rule_" + string(priorityRule.accessType)
+		return decision
 	}
 	
 	// No matching rule found - default deny
 	log.Debugf("User %s access to %s: denied (no matching rules)", userID, target)
+	decision.Reason = "default_deny"
+	return decision
+}
+
+func verdictLabel(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
+
+// matchesCompiled is matchesRule using the rule's precompiled URL pattern
+func (m *Manager) matchesCompiled(cr compiledRule, target string) bool {
+	if cr.ruleType == RuleTypeURLPattern {
+		return cr.regex != nil && cr.regex.MatchString(target)
+	}
+	return m.matchesRule(cr.rule, cr.ruleType, target)
+}
+
+// matchesPinned reports whether a domain rule matches any of the names an
+// IP target was resolved from
+func (m *Manager) matchesPinned(cr compiledRule, names []string) bool {
+	if cr.ruleType != RuleTypeDomain {
+		return false
+	}
+	for _, name := range names {
+		if m.matchDomain(cr.rule.Pattern, name) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -320,20 +903,7 @@ func (m *Manager) matchDomain(pattern, target string) bool {
 }
 
 func (m *Manager) matchIP(pattern, target string) bool {
-	// Extract IP from URL if target is a URL
-	targetIP := target
-	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
-		if u, err := url.Parse(target); err == nil {
-			targetIP = u.Hostname()
-		}
-	}
-	
-	// Remove port if present
-	if host, _, err := net.SplitHostPort(targetIP); err == nil {
-		targetIP = host
-	}
-	
-	targetAddr := net.ParseIP(targetIP)
+	targetAddr := targetAddress(target)
 	patternAddr := net.ParseIP(pattern)
 	
 	if targetAddr == nil || patternAddr == nil {
@@ -344,20 +914,7 @@ func (m *Manager) matchIP(pattern, target string) bool {
 }
 
 func (m *Manager) matchIPRange(pattern, target string) bool {
-	// Extract IP from URL if target is a URL
-	targetIP := target
-	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
-		if u, err := url.Parse(target); err == nil {
-			targetIP = u.Hostname()
-		}
-	}
-	
-	// Remove port if present
-	if host, _, err := net.SplitHostPort(targetIP); err == nil {
-		targetIP = host
-	}
-	
-	targetAddr := net.ParseIP(targetIP)
+	targetAddr := targetAddress(target)
 	if targetAddr == nil {
 		return false
 	}
@@ -422,6 +979,8 @@ func (m *Manager) matchProtocolRule(rule FirewallRule, target string) bool {
 	return true
 }
 
+// parseConnectionTarget parses a protocol rule target. IPv6 addresses in it
+// are bracketed, e.g. tcp:[fd00:200::1:2]:5000->[2001:db8::1]:443.
 func (m *Manager) parseConnectionTarget(target string) map[string]string {
 	if !strings.Contains(target, "->") {
 		return nil
@@ -436,7 +995,7 @@ func (m *Manager) parseConnectionTarget(target string) map[string]string {
 	dstPart := parts[1]
 	
 	// Parse source
-	srcComponents := strings.Split(srcPart, ":")
+	srcComponents := splitConnectionPart(srcPart)
 	if len(srcComponents) < 1 {
 		return nil
 	}
@@ -453,7 +1012,7 @@ func (m *Manager) parseConnectionTarget(target string) map[string]string {
 	}
 	
 	// Parse destination
-	dstComponents := strings.Split(dstPart, ":")
+	dstComponents := splitConnectionPart(dstPart)
 	dstIP := "*"
 	dstPort := "*"
 	direction := "outbound"
@@ -478,6 +1037,32 @@ func (m *Manager) parseConnectionTarget(target string) map[string]string {
 	}
 }
 
+// splitConnectionPart splits one side of a connection target at its colons
+// like strings.Split, keeping bracketed IPv6 addresses whole and removing
+// their brackets
+func splitConnectionPart(part string) []string {
+	var components []string
+	for {
+		if strings.HasPrefix(part, "[") {
+			if end := strings.Index(part, "]"); end > 0 {
+				components = append(components, part[1:end])
+				rest := part[end+1:]
+				if !strings.HasPrefix(rest, ":") {
+					return components
+				}
+				part = rest[1:]
+				continue
+			}
+		}
+		component, rest, found := strings.Cut(part, ":")
+		components = append(components, component)
+		if !found {
+			return components
+		}
+		part = rest
+	}
+}
+
 func (m *Manager) matchIPOrRange(ruleIP, targetIP string) bool {
 	if ruleIP == "*" || targetIP == "*" {
 		return true
@@ -571,6 +1156,121 @@ func (m *Manager) GetLastUpdateTime() time.Time {
 	return m.lastUpdate
 }
 
+// GetPolicyVersion returns the stable rule-set version
+func (m *Manager) GetPolicyVersion() string {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	return m.version
+}
+
+// LocalPolicy is the subset of a user's rules a client can enforce locally.
+// It only contains deny rules that outrank every allow rule, so a local
+// block never contradicts the headend, which remains authoritative.
+type LocalPolicy struct {
+	PolicyVersion string    `json:"policy_version"`
+	DenyDomains   []string  `json:"deny_domains"`
+	DenyCIDRs     []string  `json:"deny_cidrs"`
+	GeneratedAt   time.Time `json:"generated_at"`
+}
+
+// GetLocalPolicy builds the local deny policy for a user who belongs to
+// groups. Rules qualified by protocol, port or source are left to the
+// headend.
+func (m *Manager) GetLocalPolicy(userID string, groups []string) *LocalPolicy {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	
+	rules, version := m.effectiveRules(userID, groups)
+	policy := &LocalPolicy{
+		PolicyVersion: version,
+		DenyDomains:   []string{},
+		DenyCIDRs:     []string{},
+		GeneratedAt:   time.Now().UTC(),
+	}
+	// Clients must not block what the headend would let through, and
+	// confined users are held to a profile enforced here instead
+	if rules == nil || m.policyMode() != PolicyModeEnforce || m.confined(userID) {
+		return policy
+	}
+	
+	// A deny rule is only safe to enforce locally if no allow rule can win
+	// over it, i.e. it has a strictly higher priority than every allow rule
+	minAllow := int(^uint(0) >> 1)
+	for _, list := range [][]FirewallRule{
+		rules.Rules.AllowDomains, rules.Rules.AllowIPs, rules.Rules.AllowIPRanges,
+		rules.Rules.AllowURLPatterns, rules.Rules.AllowProtocolRules,
+	} {
+		for _, rule := range list {
+			if rule.Mode != RuleModeMonitor && rule.Priority < minAllow {
+				minAllow = rule.Priority
+			}
+		}
+	}
+	
+	localCandidate := func(rule FirewallRule) bool {
+		return rule.Mode != RuleModeMonitor && rule.Priority < minAllow &&
+			rule.Protocol == "" && rule.SrcIP == "" && rule.SrcPort == "" && rule.DstPort == ""
+	}
+	
+	// With user or group precedence, evaluation order isn't priority order,
+	// so nothing after the first enforcing allow rule is safe either
+	for _, cr := range rules.compiled {
+		if cr.accessType == AccessTypeAllow {
+			if cr.rule.Mode != RuleModeMonitor {
+				break
+			}
+			continue
+		}
+		if !localCandidate(cr.rule) {
+			continue
+		}
+		
+		switch cr.ruleType {
+		case RuleTypeDomain:
+			policy.DenyDomains = append(policy.DenyDomains, strings.ToLower(cr.rule.Pattern))
+		case RuleTypeIP:
+			if ip := net.ParseIP(cr.rule.Pattern); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					bits = 32
+				}
+				policy.DenyCIDRs = append(policy.DenyCIDRs, fmt.Sprintf("%s/%d", ip.String(), bits))
+			}
+		case RuleTypeIPRange:
+			if _, network, err := net.ParseCIDR(cr.rule.Pattern); err == nil {
+				policy.DenyCIDRs = append(policy.DenyCIDRs, network.String())
+			}
+		}
+	}
+	
+	return policy
+}
+
+// RolloutStatus describes an active rollout for health and admin reporting
+type RolloutStatus struct {
+	Version string   `json:"version"`
+	Percent int      `json:"percent"`
+	Labels  []string `json:"labels,omitempty"`
+	Users   int      `json:"users"`
+}
+
+// GetRollouts returns the rollout versions currently being served
+func (m *Manager) GetRollouts() []RolloutStatus {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	
+	status := make([]RolloutStatus, 0, len(m.rollouts))
+	for _, r := range m.rollouts {
+		status = append(status, RolloutStatus{
+			Version: r.version,
+			Percent: r.percent,
+			Labels:  r.labels,
+			Users:   len(r.userRules),
+		})
+	}
+	return status
+}
+
 func (m *Manager) GetRulesCount() int {
 	m.updateMutex.RLock()
 	defer m.updateMutex.RUnlock()
@@ -0,0 +1,84 @@
+package firewall
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	firewallDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_firewall_decisions_total",
+		Help: "Total number of firewall decisions, by serving policy version and verdict.",
+	}, []string{"policy_version", "verdict"})
+
+	firewallEvaluationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "headend_firewall_evaluation_seconds",
+		Help:    "Time taken to decide access to a target, by how the decision was reached (evaluated, cache, blocked, disabled).",
+		Buckets: []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05},
+	}, []string{"source"})
+
+	firewallShadowDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_firewall_shadow_decisions_total",
+		Help: "Total number of monitor-mode rule matches, by would-be verdict and whether it differs from the enforced verdict.",
+	}, []string{"verdict", "diverges"})
+
+	firewallPermissiveDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_firewall_permissive_denials_total",
+		Help: "Total number of denials let through because the policy mode is permissive, by deny reason.",
+	}, []string{"reason"})
+
+	firewallQuarantinedUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_firewall_quarantined_users",
+		Help: "Number of users held to the quarantine profile.",
+	})
+
+	firewallRestrictedUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_firewall_restricted_users",
+		Help: "Number of users confined to the remediation profile.",
+	})
+
+	firewallTemporaryBlocks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_firewall_temporary_blocks",
+		Help: "Number of temporary blocks in force, such as those inserted for IDS alerts.",
+	})
+
+	firewallSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_firewall_rule_syncs_total",
+		Help: "Total number of successful rule syncs with the Manager, by mode (full, delta, not_modified).",
+	}, []string{"mode"})
+
+	firewallCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_firewall_decision_cache_hits_total",
+		Help: "Total number of firewall decisions served from the decision cache.",
+	})
+
+	firewallCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_firewall_decision_cache_misses_total",
+		Help: "Total number of firewall decisions evaluated because the decision cache had no valid entry.",
+	})
+
+	firewallCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_firewall_decision_cache_evictions_total",
+		Help: "Total number of decisions evicted from the full decision cache.",
+	})
+
+	firewallPinLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_firewall_pin_lookups_total",
+		Help: "Total number of DNS lookups made to pin domain rules to addresses, by result.",
+	}, []string{"result"})
+
+	firewallPinnedAddresses = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_firewall_pinned_addresses",
+		Help: "Number of addresses currently pinned to the domains of domain rules.",
+	})
+
+	firewallSharedLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_firewall_shared_cache_lookups_total",
+		Help: "Total number of rule responses looked up in the shared cache, by result (hit, miss, error).",
+	}, []string{"result"})
+
+	firewallSharedInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_firewall_shared_cache_invalidations_total",
+		Help: "Total number of rule change announcements received from the Manager, including resubscribes.",
+	})
+)
@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PolicyMode controls whether firewall verdicts are enforced
+type PolicyMode string
+
+const (
+	// PolicyModeEnforce blocks whatever the rules deny
+	PolicyModeEnforce PolicyMode = "enforce"
+	// PolicyModePermissive evaluates the rules and reports would-be denials,
+	// but lets all traffic through. Useful while rolling rules out.
+	PolicyModePermissive PolicyMode = "permissive"
+	// PolicyModeDisabled skips rule evaluation and allows all traffic
+	PolicyModeDisabled PolicyMode = "disabled"
+)
+
+// ParsePolicyMode validates a policy mode name from configuration or the
+// Manager. "log-only" is accepted as an alias for permissive.
+func ParsePolicyMode(name string) (PolicyMode, error) {
+	switch mode := PolicyMode(strings.ToLower(name)); mode {
+	case PolicyModeEnforce, PolicyModePermissive, PolicyModeDisabled:
+		return mode, nil
+	case "log-only":
+		return PolicyModePermissive, nil
+	default:
+		return "", fmt.Errorf("unknown firewall policy mode %q", name)
+	}
+}
+
+// SetPolicyMode sets the configured policy mode. A mode sent by the Manager
+// with the rule set takes precedence over it. Call before Start.
+func (m *Manager) SetPolicyMode(mode PolicyMode) {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.configMode = mode
+}
+
+// PolicyMode returns the policy mode in effect
+func (m *Manager) PolicyMode() PolicyMode {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	return m.policyMode()
+}
+
+// policyMode returns the Manager's mode if it sent one, otherwise the
+// configured mode. Caller must hold updateMutex.
+func (m *Manager) policyMode() PolicyMode {
+	if m.managerMode != "" {
+		return m.managerMode
+	}
+	return m.configMode
+}
+
+// setManagerMode adopts the policy mode sent with a rule set, ignoring
+// modes this headend doesn't know. Caller must hold updateMutex.
+func (m *Manager) setManagerMode(name string) {
+	if name == "" {
+		m.managerMode = ""
+		return
+	}
+	mode, err := ParsePolicyMode(name)
+	if err != nil {
+		log.Warnf("Ignoring policy mode from the Manager: %v", err)
+		return
+	}
+	if mode != m.managerMode {
+		log.Infof("Firewall policy mode set to %s by the Manager", mode)
+	}
+	m.managerMode = mode
+}
+
+// applyPolicyMode turns a denial into a logged would-be denial in
+// permissive mode
+func applyPolicyMode(mode PolicyMode, userID, target string, decision Decision) Decision {
+	if mode != PolicyModePermissive || decision.Allowed {
+		return decision
+	}
+
+	log.Infof("Permissive mode: user %s access to %s would be denied (%s)", userID, target, decision.RuleLabel())
+	firewallPermissiveDenials.WithLabelValues(decision.Reason).Inc()
+	decision.Allowed = true
+	decision.WouldDeny = true
+	return decision
+}
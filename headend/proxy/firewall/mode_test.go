@@ -0,0 +1,119 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyModes(t *testing.T) {
+	alice := domainRules("alice", "blocked.example.com", AccessTypeDeny)
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+
+	if d := m.Decide("alice", "blocked.example.com"); d.Allowed || d.WouldDeny {
+		t.Fatalf("enforce: expected deny, got %+v", d)
+	}
+
+	m.SetPolicyMode(PolicyModePermissive)
+	d := m.Decide("alice", "blocked.example.com")
+	if !d.Allowed || !d.WouldDeny || d.Reason != "rule_deny" || d.MatchedRule == nil {
+		t.Errorf("permissive: expected an allowed would-be denial, got %+v", d)
+	}
+	// Users without rules are let through too, which is what makes
+	// permissive mode useful for initial rollout
+	if d := m.Decide("bob", "example.com"); !d.Allowed || !d.WouldDeny || d.Reason != "no_rules" {
+		t.Errorf("permissive: expected no_rules let through, got %+v", d)
+	}
+	if policy := m.GetLocalPolicy("alice", nil); len(policy.DenyDomains) != 0 {
+		t.Errorf("permissive: clients must not block locally, got %+v", policy)
+	}
+
+	m.SetPolicyMode(PolicyModeDisabled)
+	if d := m.Decide("alice", "blocked.example.com"); !d.Allowed || d.WouldDeny || d.Reason != "policy_disabled" {
+		t.Errorf("disabled: expected allow without evaluation, got %+v", d)
+	}
+
+	// The cached verdict is still the rules' verdict once enforcement returns
+	m.SetPolicyMode(PolicyModeEnforce)
+	if d := m.Decide("alice", "blocked.example.com"); d.Allowed {
+		t.Errorf("enforce: expected deny after switching back, got %+v", d)
+	}
+}
+
+func TestManagerPolicyModeOverridesConfig(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{Cursor: "1", PolicyMode: "log-only"}),
+		respond(AllRulesResponse{Cursor: "2", Delta: true}),
+		respond(AllRulesResponse{Cursor: "3"}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	m := NewManager(server.URL, "token")
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("full fetch: %v", err)
+	}
+	if mode := m.PolicyMode(); mode != PolicyModePermissive {
+		t.Errorf("expected the Manager's permissive mode, got %s", mode)
+	}
+
+	// A delta without a mode leaves it unchanged
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("delta fetch: %v", err)
+	}
+	if mode := m.PolicyMode(); mode != PolicyModePermissive {
+		t.Errorf("expected permissive after a delta, got %s", mode)
+	}
+
+	// A full set without a mode falls back to the configured one
+	m.lastFullSync = time.Now().Add(-2 * DefaultFullResyncInterval)
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("resync fetch: %v", err)
+	}
+	if mode := m.PolicyMode(); mode != PolicyModeEnforce {
+		t.Errorf("expected the configured enforce mode, got %s", mode)
+	}
+}
+
+func TestParsePolicyMode(t *testing.T) {
+	if mode, err := ParsePolicyMode("Permissive"); err != nil || mode != PolicyModePermissive {
+		t.Errorf("got %q, %v", mode, err)
+	}
+	if _, err := ParsePolicyMode("audit"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestDecisionDenialLabel(t *testing.T) {
+	alice := domainRules("alice", "blocked.example.com", AccessTypeDeny)
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+	m.Block("carol", "example.com", "ET MALWARE beacon", "suricata", time.Hour)
+	m.Restrict("dave", "posture_failed")
+
+	tests := []struct {
+		user, target string
+		want         string
+	}{
+		{"alice", "blocked.example.com", "firewall_rule"},
+		{"alice", "example.com", "firewall_default"},
+		{"bob", "example.com", "firewall_default"},
+		{"carol", "example.com", "blocked"},
+		{"dave", "example.com", "remediation"},
+	}
+	for _, tt := range tests {
+		if got := m.Decide(tt.user, tt.target).DenialLabel(); got != tt.want {
+			t.Errorf("DenialLabel for %s to %s = %q, want %q", tt.user, tt.target, got, tt.want)
+		}
+	}
+
+	// Denials let through in permissive mode aren't counted as denials
+	m.SetPolicyMode(PolicyModePermissive)
+	if got := m.Decide("alice", "blocked.example.com").DenialLabel(); got != "" {
+		t.Errorf("DenialLabel of a permissive would-be denial = %q, want empty", got)
+	}
+}
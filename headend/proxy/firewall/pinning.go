@@ -0,0 +1,249 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPinTTL is how long resolved addresses of a domain are trusted
+	// before the domain is resolved again
+	DefaultPinTTL = time.Minute
+
+	// observedNameTTL is how long a hostname seen in traffic stays pinned
+	// after it was last used
+	observedNameTTL = 30 * time.Minute
+
+	// maxObservedNames bounds the hostnames pinned for wildcard rules
+	maxObservedNames = 10000
+)
+
+// fqdnPinner resolves the domains named by domain rules so that targets
+// given as an IP address are still matched against them. Exact domains come
+// from the rules; names under wildcard rules can't be enumerated, so they
+// are pinned as clients connect to them by name.
+type fqdnPinner struct {
+	ttl      time.Duration
+	lookup   func(ctx context.Context, host string) ([]net.IP, error)
+	observed chan string
+	kick     chan struct{}
+
+	// names is only used by the pinning loop
+	names map[string]time.Time
+}
+
+func newFQDNPinner(ttl time.Duration) *fqdnPinner {
+	return &fqdnPinner{
+		ttl: ttl,
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		observed: make(chan string, 256),
+		kick:     make(chan struct{}, 1),
+		names:    make(map[string]time.Time),
+	}
+}
+
+// observe queues a hostname seen in traffic without blocking
+func (p *fqdnPinner) observe(host string) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.observed <- host:
+	default:
+	}
+}
+
+// refresh asks the pinning loop to re-resolve everything, e.g. after the
+// rules changed
+func (p *fqdnPinner) refresh() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+// SetFQDNPinning enables matching IP targets against domain rules through
+// the domains' resolved addresses, re-resolving them every ttl. A ttl of
+// zero or less disables pinning. Call before Start.
+func (m *Manager) SetFQDNPinning(ttl time.Duration) {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+
+	m.pins = nil
+	if ttl <= 0 {
+		m.pinner = nil
+		return
+	}
+	m.pinner = newFQDNPinner(ttl)
+}
+
+// pinLoop keeps the pinned addresses current until the manager stops
+func (m *Manager) pinLoop() {
+	p := m.pinner
+	m.updatePins()
+
+	ticker := time.NewTicker(p.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case host := <-p.observed:
+			if _, known := p.names[host]; known {
+				p.names[host] = time.Now()
+				continue
+			}
+			if len(p.names) >= maxObservedNames || !m.matchesWildcardRule(host) {
+				continue
+			}
+			p.names[host] = time.Now()
+			m.updatePins()
+		case <-p.kick:
+			m.updatePins()
+		case <-ticker.C:
+			m.updatePins()
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// updatePins resolves every pinned name and swaps in the new address map,
+// clearing cached decisions if it changed
+func (m *Manager) updatePins() {
+	p := m.pinner
+	now := time.Now()
+	for host, lastSeen := range p.names {
+		if now.Sub(lastSeen) > observedNameTTL {
+			delete(p.names, host)
+		}
+	}
+
+	names := m.exactDomains()
+	for host := range p.names {
+		names[host] = true
+	}
+
+	pins := make(map[string][]string)
+	for host := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ips, err := p.lookup(ctx, host)
+		cancel()
+		if err != nil {
+			log.Debugf("Failed to resolve %s for FQDN pinning: %v", host, err)
+			firewallPinLookups.WithLabelValues("error").Inc()
+			continue
+		}
+		firewallPinLookups.WithLabelValues("ok").Inc()
+		for _, ip := range ips {
+			key := ip.String()
+			pins[key] = append(pins[key], host)
+		}
+	}
+
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	if reflect.DeepEqual(pins, m.pins) {
+		return
+	}
+	m.pins = pins
+	if m.cache != nil {
+		m.cache.clear()
+	}
+	firewallPinnedAddresses.Set(float64(len(pins)))
+}
+
+// exactDomains returns the non-wildcard patterns of every domain rule
+func (m *Manager) exactDomains() map[string]bool {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+
+	domains := make(map[string]bool)
+	m.eachDomainRule(func(pattern string) {
+		if !strings.HasPrefix(pattern, "*.") && net.ParseIP(pattern) == nil {
+			domains[pattern] = true
+		}
+	})
+	return domains
+}
+
+// matchesWildcardRule reports whether host falls under any wildcard domain rule
+func (m *Manager) matchesWildcardRule(host string) bool {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+
+	matched := false
+	m.eachDomainRule(func(pattern string) {
+		if !matched && strings.HasPrefix(pattern, "*.") && m.matchDomain(pattern, host) {
+			matched = true
+		}
+	})
+	return matched
+}
+
+// eachDomainRule calls fn with the lowercased pattern of every domain rule
+// in the stable, group and rollout rule sets. Caller must hold updateMutex.
+func (m *Manager) eachDomainRule(fn func(pattern string)) {
+	visit := func(rules *UserRules) {
+		for _, cr := range rules.compiled {
+			if cr.ruleType == RuleTypeDomain {
+				fn(strings.ToLower(cr.rule.Pattern))
+			}
+		}
+	}
+	for _, rules := range m.userRules {
+		visit(rules)
+	}
+	for _, rules := range m.groupRules {
+		visit(rules)
+	}
+	for _, r := range m.rollouts {
+		for _, rules := range r.userRules {
+			visit(rules)
+		}
+	}
+}
+
+// pinnedNames returns the domains target's address was resolved from, or
+// nil if target isn't an IP. Caller must hold updateMutex.
+func (m *Manager) pinnedNames(target string) []string {
+	if m.pins == nil {
+		return nil
+	}
+	ip := targetAddress(target)
+	if ip == nil {
+		return nil
+	}
+	return m.pins[ip.String()]
+}
+
+// targetHostname extracts the host from a target given as a URL, host:port
+// or bare host. IPv6 addresses lose their brackets.
+func targetHostname(target string) string {
+	host := target
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		if u, err := url.Parse(target); err == nil {
+			host = u.Hostname()
+		}
+	} else if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// targetAddress returns the IP address a target names, IPv4 or IPv6, or nil
+// if it names a host
+func targetAddress(target string) net.IP {
+	return net.ParseIP(targetHostname(target))
+}
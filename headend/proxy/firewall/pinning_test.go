@@ -0,0 +1,82 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func fakeLookup(addrs map[string]string) func(ctx context.Context, host string) ([]net.IP, error) {
+	return func(_ context.Context, host string) ([]net.IP, error) {
+		if addr, ok := addrs[host]; ok {
+			return []net.IP{net.ParseIP(addr)}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+}
+
+func TestPinnedDenyClosesIPBypass(t *testing.T) {
+	alice := UserRules{UserID: "alice"}
+	alice.Rules.DenyDomains = []FirewallRule{{Pattern: "blocked.example.com", Priority: 1}}
+	alice.Rules.AllowIPRanges = []FirewallRule{{Pattern: "0.0.0.0/0", Priority: 10}}
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+
+	if d := m.Decide("alice", "192.0.2.10:443"); !d.Allowed {
+		t.Fatalf("expected allow before pinning, got %+v", d)
+	}
+
+	m.SetFQDNPinning(time.Minute)
+	m.pinner.lookup = fakeLookup(map[string]string{"blocked.example.com": "192.0.2.10"})
+	m.updatePins()
+
+	// The cached allow must not survive the new pin
+	d := m.Decide("alice", "192.0.2.10:443")
+	if d.Allowed || d.MatchedRule == nil || d.MatchedRule.Pattern != "blocked.example.com" {
+		t.Fatalf("expected deny by the pinned domain rule, got %+v", d)
+	}
+	if d := m.Decide("alice", "192.0.2.11:443"); !d.Allowed {
+		t.Errorf("unpinned address should still be allowed, got %+v", d)
+	}
+}
+
+func TestPinObservedWildcardNames(t *testing.T) {
+	bob := UserRules{UserID: "bob"}
+	bob.Rules.AllowDomains = []FirewallRule{{Pattern: "*.corp.example.com", Priority: 5}}
+
+	m := NewManager("", "")
+	m.SetDecisionCache(0, 0)
+	m.userRules = copyUserRules(map[string]UserRules{"bob": bob})
+	m.SetFQDNPinning(time.Hour)
+	m.pinner.lookup = fakeLookup(map[string]string{
+		"app.corp.example.com": "198.51.100.7",
+		"other.example.net":    "198.51.100.8",
+	})
+
+	go m.pinLoop()
+	defer close(m.stopChan)
+
+	if d := m.Decide("bob", "198.51.100.7"); d.Allowed {
+		t.Fatalf("expected default deny before the name is seen, got %+v", d)
+	}
+
+	// Connecting by name pins the name's address in the background
+	m.Decide("bob", "app.corp.example.com:443")
+	m.Decide("bob", "other.example.net:443")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !m.Decide("bob", "198.51.100.7").Allowed {
+		if time.Now().After(deadline) {
+			t.Fatal("observed name was never pinned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Names outside every wildcard rule are not pinned
+	if d := m.Decide("bob", "198.51.100.8"); d.Allowed {
+		t.Errorf("address of an unrelated name was allowed: %+v", d)
+	}
+}
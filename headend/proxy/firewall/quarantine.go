@@ -0,0 +1,112 @@
+package firewall
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuarantineVersion is the policy version reported for decisions made by
+// the quarantine profile
+const QuarantineVersion = "quarantine"
+
+// QuarantinePolicy is the Manager's quarantine profile: the restricted rule
+// set quarantined users are held to, and who they are
+type QuarantinePolicy struct {
+	Rules UserRules             `json:"rules"`
+	Users map[string]Quarantine `json:"users"`
+}
+
+// Quarantine describes why a user was quarantined
+type Quarantine struct {
+	Reason  string `json:"reason"`
+	Source  string `json:"source"`            // posture, anomaly or admin
+	Address string `json:"address,omitempty"` // tunnel address in the quarantine segment
+	Message string `json:"message,omitempty"` // banner text for the client
+	Since   string `json:"since"`
+}
+
+// Quarantine returns the quarantine of a user, if it is quarantined
+func (m *Manager) Quarantine(userID string) (Quarantine, bool) {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	q, ok := m.quarantined[userID]
+	return q, ok
+}
+
+// QuarantinedUsers returns the number of quarantined users
+func (m *Manager) QuarantinedUsers() int {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	return len(m.quarantined)
+}
+
+// applyQuarantine replaces the quarantine profile and returns the users
+// whose cached decisions it invalidates. Caller must hold updateMutex.
+func (m *Manager) applyQuarantine(policy *QuarantinePolicy) map[string]bool {
+	var rules *UserRules
+	users := map[string]Quarantine{}
+	if policy != nil {
+		rules = &UserRules{UserID: QuarantineVersion, Timestamp: policy.Rules.Timestamp, Rules: policy.Rules.Rules}
+		rules.compile()
+		if policy.Users != nil {
+			users = policy.Users
+		}
+	}
+
+	affected := make(map[string]bool)
+	for userID, q := range users {
+		if old, ok := m.quarantined[userID]; !ok || old != q {
+			affected[userID] = true
+			if !ok {
+				log.Warnf("User %s quarantined (%s: %s)", userID, q.Source, q.Reason)
+			}
+		}
+	}
+	for userID := range m.quarantined {
+		if _, ok := users[userID]; !ok {
+			affected[userID] = true
+			log.Infof("User %s released from quarantine", userID)
+		}
+	}
+
+	// A new rule set changes the decisions of everyone held to it
+	if (m.quarantineRules == nil) != (rules == nil) ||
+		(rules != nil && !reflect.DeepEqual(m.quarantineRules.Rules, rules.Rules)) {
+		for userID := range users {
+			affected[userID] = true
+		}
+	}
+
+	m.quarantineRules = rules
+	m.quarantined = users
+	firewallQuarantinedUsers.Set(float64(len(users)))
+	return affected
+}
+
+// evaluateQuarantine matches target against the quarantine rule set, then
+// the remediation targets, which quarantined users can always reach so
+// they can recover. Anything else is denied. Caller must hold updateMutex.
+func (m *Manager) evaluateQuarantine(userID, target string) Decision {
+	decision := Decision{PolicyVersion: QuarantineVersion}
+	if m.quarantineRules != nil {
+		for _, cr := range m.quarantineRules.compiled {
+			if cr.rule.Mode == RuleModeMonitor || !m.matchesCompiled(cr, target) {
+				continue
+			}
+			matched := cr.rule
+			decision.Allowed = cr.accessType == AccessTypeAllow
+			decision.MatchedRule = &matched
+			decision.Reason = "rule_" + string(cr.accessType)
+			return decision
+		}
+	}
+
+	if remediation, ok := m.remediationAllows(target); ok {
+		return remediation
+	}
+
+	log.Debugf("User %s access to %s: denied by the quarantine profile", userID, target)
+	decision.Reason = "quarantined"
+	return decision
+}
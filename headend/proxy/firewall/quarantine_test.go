@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQuarantineProfile(t *testing.T) {
+	profile := UserRules{}
+	profile.Rules.AllowDomains = []FirewallRule{{Pattern: "updates.example.com", Priority: 10}}
+	quarantine := &QuarantinePolicy{
+		Rules: profile,
+		Users: map[string]Quarantine{"alice": {Reason: "posture check failed", Source: "posture", Address: "10.200.255.1"}},
+	}
+
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{
+			Cursor:     "1",
+			UserRules:  map[string]UserRules{"alice": domainRules("alice", "*.example.com", AccessTypeAllow)},
+			Quarantine: quarantine,
+		}),
+		respond(AllRulesResponse{Cursor: "2", Delta: true}),
+		respond(AllRulesResponse{Cursor: "3", Delta: true, Quarantine: &QuarantinePolicy{Rules: profile}}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	m := NewManager(server.URL, "token")
+	m.SetRemediationProfile([]string{"manager.example.com"})
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("full fetch: %v", err)
+	}
+
+	if q, ok := m.Quarantine("alice"); !ok || q.Address != "10.200.255.1" {
+		t.Fatalf("expected alice to be quarantined, got %+v, %v", q, ok)
+	}
+	if d := m.Decide("alice", "app.example.com"); d.Allowed || d.Reason != "quarantined" {
+		t.Errorf("expected the quarantine profile to deny, got %+v", d)
+	}
+	if d := m.Decide("alice", "updates.example.com"); !d.Allowed || d.PolicyVersion != QuarantineVersion {
+		t.Errorf("expected the quarantine rule set to allow, got %+v", d)
+	}
+	if d := m.Decide("alice", "manager.example.com"); !d.Allowed {
+		t.Errorf("expected remediation targets to stay reachable, got %+v", d)
+	}
+
+	// A delta without a quarantine profile leaves it unchanged
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("delta fetch: %v", err)
+	}
+	if _, ok := m.Quarantine("alice"); !ok {
+		t.Fatal("quarantine lost by a delta without one")
+	}
+
+	// Releasing alice drops her cached quarantine decisions
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("release fetch: %v", err)
+	}
+	if d := m.Decide("alice", "app.example.com"); !d.Allowed {
+		t.Errorf("expected alice's own rules after release, got %+v", d)
+	}
+	if n := m.QuarantinedUsers(); n != 0 {
+		t.Errorf("expected no quarantined users, got %d", n)
+	}
+}
@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RemediationVersion is the policy version reported for decisions made by
+// the remediation profile
+const RemediationVersion = "remediation"
+
+// SetRemediationProfile sets the targets restricted users may still reach,
+// typically the Manager's renewal endpoints. Targets are domains (wildcards
+// allowed), IP addresses or CIDR ranges; everything else is denied.
+func (m *Manager) SetRemediationProfile(targets []string) {
+	profile := UserRules{UserID: RemediationVersion}
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		rule := FirewallRule{Pattern: target, Priority: 1, Description: "remediation"}
+		if _, _, err := net.ParseCIDR(target); err == nil {
+			profile.Rules.AllowIPRanges = append(profile.Rules.AllowIPRanges, rule)
+		} else if net.ParseIP(target) != nil {
+			profile.Rules.AllowIPs = append(profile.Rules.AllowIPs, rule)
+		} else {
+			profile.Rules.AllowDomains = append(profile.Rules.AllowDomains, rule)
+		}
+	}
+	profile.compile()
+
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.remediation = &profile
+}
+
+// Restrict confines userID to the remediation profile for the given
+// reason until Unrestrict is called. The profile applies to every flow of
+// the user regardless of the policy mode, since it guards against a failed
+// security check.
+func (m *Manager) Restrict(userID, reason string) {
+	m.updateMutex.RLock()
+	current, ok := m.restricted[userID]
+	m.updateMutex.RUnlock()
+	if ok && current == reason {
+		return
+	}
+
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.restricted[userID] = reason
+	if m.cache != nil {
+		m.cache.clearUsers(map[string]bool{userID: true})
+	}
+	firewallRestrictedUsers.Set(float64(len(m.restricted)))
+	log.Warnf("User %s restricted to the remediation profile (%s)", userID, reason)
+}
+
+// Unrestrict lifts a user's restriction, e.g. once they present a renewed
+// certificate
+func (m *Manager) Unrestrict(userID string) {
+	m.updateMutex.RLock()
+	_, ok := m.restricted[userID]
+	m.updateMutex.RUnlock()
+	if !ok {
+		return
+	}
+
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	delete(m.restricted, userID)
+	if m.cache != nil {
+		m.cache.clearUsers(map[string]bool{userID: true})
+	}
+	firewallRestrictedUsers.Set(float64(len(m.restricted)))
+	log.Infof("User %s released from the remediation profile", userID)
+}
+
+// RestrictedUsers returns the number of users confined to the remediation
+// profile
+func (m *Manager) RestrictedUsers() int {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+	return len(m.restricted)
+}
+
+// confined reports whether a user is held to the remediation or quarantine
+// profile. Caller must hold updateMutex.
+func (m *Manager) confined(userID string) bool {
+	_, restricted := m.restricted[userID]
+	_, quarantined := m.quarantined[userID]
+	return restricted || quarantined
+}
+
+// evaluateRemediation matches target against the remediation profile.
+// Caller must hold updateMutex.
+func (m *Manager) evaluateRemediation(userID, target, reason string) Decision {
+	if decision, ok := m.remediationAllows(target); ok {
+		return decision
+	}
+
+	log.Debugf("User %s access to %s: denied by the remediation profile (%s)", userID, target, reason)
+	return Decision{PolicyVersion: RemediationVersion, Reason: "remediation_" + reason}
+}
+
+// remediationAllows returns the allow decision of the remediation target
+// matching target, if any. Caller must hold updateMutex.
+func (m *Manager) remediationAllows(target string) (Decision, bool) {
+	if m.remediation == nil {
+		return Decision{}, false
+	}
+	for _, cr := range m.remediation.compiled {
+		if m.matchesCompiled(cr, target) {
+			matched := cr.rule
+			return Decision{
+				Allowed:       true,
+				PolicyVersion: RemediationVersion,
+				MatchedRule:   &matched,
+				Reason:        "rule_allow",
+			}, true
+		}
+	}
+	return Decision{}, false
+}
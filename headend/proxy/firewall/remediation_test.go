@@ -0,0 +1,41 @@
+package firewall
+
+import "testing"
+
+func TestRemediationProfile(t *testing.T) {
+	alice := domainRules("alice", "*.example.com", AccessTypeAllow)
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": alice})
+	m.SetRemediationProfile([]string{"manager.example.com", "10.0.0.0/24"})
+
+	if d := m.Decide("alice", "app.example.com"); !d.Allowed {
+		t.Fatalf("expected alice's rules to apply before restriction, got %+v", d)
+	}
+
+	m.Restrict("alice", "expired_certificate")
+	if d := m.Decide("alice", "app.example.com"); d.Allowed || d.Reason != "remediation_expired_certificate" {
+		t.Errorf("expected the cached allow to be replaced by a remediation deny, got %+v", d)
+	}
+	if d := m.Decide("alice", "manager.example.com"); !d.Allowed || d.PolicyVersion != RemediationVersion {
+		t.Errorf("expected the renewal endpoint to stay reachable, got %+v", d)
+	}
+	if d := m.Decide("alice", "10.0.0.5"); !d.Allowed {
+		t.Errorf("expected the remediation range to stay reachable, got %+v", d)
+	}
+
+	// Permissive mode doesn't relax a restriction
+	m.SetPolicyMode(PolicyModePermissive)
+	if d := m.Decide("alice", "app.example.com"); d.Allowed {
+		t.Errorf("expected the restriction to hold in permissive mode, got %+v", d)
+	}
+	m.SetPolicyMode(PolicyModeEnforce)
+
+	if n := m.RestrictedUsers(); n != 1 {
+		t.Errorf("expected 1 restricted user, got %d", n)
+	}
+	m.Unrestrict("alice")
+	if d := m.Decide("alice", "app.example.com"); !d.Allowed {
+		t.Errorf("expected alice's rules to apply again, got %+v", d)
+	}
+}
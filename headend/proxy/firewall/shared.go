@@ -0,0 +1,142 @@
+package firewall
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SharedCache stores the Manager's rule responses for every headend in a
+// fleet, so one headend's fetch serves the rest. It is implemented by the
+// redis package's Client.
+type SharedCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Subscribe(ctx context.Context, channel string, handler func(message []byte))
+}
+
+// Keys and channel shared with the Manager. The Manager increments the
+// generation and publishes it on the channel whenever rules change, so
+// responses cached before the change are never read again, even if a
+// headend that fetched just before the change stores them late.
+const (
+	SharedGenerationKey       = "headend:firewall:generation"
+	SharedRulesKeyPrefix      = "headend:firewall:rules:"
+	SharedInvalidationChannel = "headend:firewall:invalidate"
+)
+
+// DefaultSharedCacheTTL bounds how long a cached response is served when an
+// invalidation is missed
+const DefaultSharedCacheTTL = 2 * time.Minute
+
+const (
+	sharedCacheTimeout = 2 * time.Second
+
+	// Headends refetch at random within this window after an invalidation,
+	// so the first to refetch fills the cache for the others
+	sharedRefreshJitter = 3 * time.Second
+)
+
+// SetSharedCache reads rule responses from cache before asking the Manager,
+// and stores the Manager's responses there for ttl. A nil cache disables
+// sharing. Call before Start.
+func (m *Manager) SetSharedCache(cache SharedCache, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultSharedCacheTTL
+	}
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.shared = cache
+	m.sharedTTL = ttl
+}
+
+// sharedKey names the cached response for cursor under the current
+// generation. It is empty when sharing is disabled or the cache can't be
+// reached, in which case the Manager is asked directly.
+func (m *Manager) sharedKey(cursor string) string {
+	if m.shared == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedCacheTimeout)
+	defer cancel()
+
+	generation, ok, err := m.shared.Get(ctx, SharedGenerationKey)
+	if err != nil {
+		firewallSharedLookups.WithLabelValues("error").Inc()
+		log.Warnf("Shared firewall cache unavailable, fetching rules from the Manager: %v", err)
+		return ""
+	}
+	if !ok {
+		generation = []byte("0")
+	}
+	if cursor == "" {
+		return SharedRulesKeyPrefix + string(generation) + ":full"
+	}
+	return SharedRulesKeyPrefix + string(generation) + ":cursor:" + cursor
+}
+
+// readRules returns the response for cursor from the shared cache when
+// another headend has already fetched it, and from the Manager otherwise.
+// An empty cached response records that nothing changed since cursor.
+func (m *Manager) readRules(key, cursor string) (body []byte, notModified, shared bool, err error) {
+	if key != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), sharedCacheTimeout)
+		cached, ok, err := m.shared.Get(ctx, key)
+		cancel()
+		switch {
+		case err != nil:
+			firewallSharedLookups.WithLabelValues("error").Inc()
+			log.Warnf("Shared firewall cache lookup failed, fetching rules from the Manager: %v", err)
+		case ok && (len(cached) > 0 || cursor != ""):
+			firewallSharedLookups.WithLabelValues("hit").Inc()
+			log.Debugf("Firewall rules for cursor %q served from the shared cache", cursor)
+			return cached, len(cached) == 0, true, nil
+		default:
+			firewallSharedLookups.WithLabelValues("miss").Inc()
+		}
+	}
+
+	body, notModified, err = m.requestRules(cursor)
+	return body, notModified, false, err
+}
+
+// storeShared caches a response from the Manager for the rest of the fleet
+func (m *Manager) storeShared(key string, body []byte) {
+	if key == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedCacheTimeout)
+	defer cancel()
+
+	if body == nil {
+		body = []byte{}
+	}
+	if err := m.shared.Set(ctx, key, body, m.sharedTTL); err != nil {
+		log.Warnf("Failed to store firewall rules in the shared cache: %v", err)
+	}
+}
+
+// watchShared refreshes rules whenever the Manager announces a change, and
+// after resubscribing, since announcements made meanwhile are lost
+func (m *Manager) watchShared() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-m.stopChan
+		cancel()
+	}()
+
+	m.shared.Subscribe(ctx, SharedInvalidationChannel, func(generation []byte) {
+		firewallSharedInvalidations.Inc()
+		delay := time.Duration(rand.Int63n(int64(sharedRefreshJitter)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if err := m.Refresh(false); err != nil {
+			log.Errorf("Failed to refresh rules after invalidation (generation %q): %v", generation, err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCache is a SharedCache in memory
+type memoryCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	err  error
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, false, c.err
+	}
+	value, ok := c.data[key]
+	return value, ok, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, value []byte, _ time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.data[key] = value
+	return nil
+}
+
+func (c *memoryCache) Subscribe(ctx context.Context, _ string, _ func([]byte)) {
+	<-ctx.Done()
+}
+
+func TestSharedCacheServesFleet(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{
+			Cursor:    "10",
+			UserRules: map[string]UserRules{"alice": domainRules("alice", "example.com", AccessTypeAllow)},
+		}),
+		func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotModified) },
+		respond(AllRulesResponse{
+			Cursor:    "11",
+			Delta:     true,
+			UserRules: map[string]UserRules{"alice": domainRules("alice", "example.com", AccessTypeDeny)},
+		}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cache := &memoryCache{data: make(map[string][]byte)}
+	first := NewManager(server.URL, "token")
+	first.SetSharedCache(cache, time.Minute)
+	second := NewManager(server.URL, "token")
+	second.SetSharedCache(cache, time.Minute)
+
+	// The second headend's full fetch and unchanged poll come from the cache
+	for _, m := range []*Manager{first, second} {
+		if err := m.fetchRules(); err != nil {
+			t.Fatalf("full fetch: %v", err)
+		}
+		if !m.Decide("alice", "example.com").Allowed {
+			t.Fatal("expected alice allowed after full sync")
+		}
+	}
+	for _, m := range []*Manager{first, second} {
+		if err := m.fetchRules(); err != nil {
+			t.Fatalf("not modified fetch: %v", err)
+		}
+	}
+	if len(fake.cursors) != 2 {
+		t.Fatalf("expected the Manager asked twice, got cursors %q", fake.cursors)
+	}
+	if value, ok := cache.data[SharedRulesKeyPrefix+"0:cursor:10"]; !ok || len(value) != 0 {
+		t.Errorf("expected not modified cached as empty, got %q", value)
+	}
+
+	// After the Manager bumps the generation, cached responses are ignored
+	cache.data[SharedGenerationKey] = []byte("1")
+	if err := second.fetchRules(); err != nil {
+		t.Fatalf("delta fetch: %v", err)
+	}
+	if d := second.Decide("alice", "example.com"); d.Allowed {
+		t.Errorf("expected the delta applied, got %+v", d)
+	}
+	if len(fake.cursors) != 3 || fake.cursors[2] != "10" {
+		t.Errorf("expected the Manager asked for the delta, got cursors %q", fake.cursors)
+	}
+	if _, ok := cache.data[SharedRulesKeyPrefix+"1:cursor:10"]; !ok {
+		t.Error("expected the delta cached under the new generation")
+	}
+}
+
+func TestSharedCacheUnavailable(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{Cursor: "10"}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	m := NewManager(server.URL, "token")
+	m.SetSharedCache(&memoryCache{err: errors.New("connection refused")}, 0)
+	if m.sharedTTL != DefaultSharedCacheTTL {
+		t.Errorf("expected the default TTL, got %v", m.sharedTTL)
+	}
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("expected the Manager asked directly, got %v", err)
+	}
+	if m.cursor != "10" {
+		t.Errorf("expected cursor 10, got %q", m.cursor)
+	}
+}
@@ -0,0 +1,149 @@
+package firewall
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// ProfileStandard is the profile of users held to their own rules
+	ProfileStandard = "standard"
+
+	// maxSummaryEntries bounds each list of a policy summary; the totals
+	// still count every rule
+	maxSummaryEntries = 100
+)
+
+// PolicySummary is the user-facing view of the policy serving a user: what
+// they can reach, the most important things they can't, and whether
+// anything else gets through. It answers "what can I access?" and is not
+// meant for enforcement.
+type PolicySummary struct {
+	PolicyVersion string     `json:"policy_version"`
+	Mode          PolicyMode `json:"mode"`
+	// Profile is standard, remediation or quarantine
+	Profile       string `json:"profile"`
+	ProfileReason string `json:"profile_reason,omitempty"`
+
+	Allowed           []PolicyEntry `json:"allowed"`
+	AllowedTotal      int           `json:"allowed_total"`
+	AllowedCategories []string      `json:"allowed_categories"`
+	Denied            []PolicyEntry `json:"denied"`
+	DeniedTotal       int           `json:"denied_total"`
+	DeniedCategories  []string      `json:"denied_categories"`
+
+	// DefaultAllow reports whether destinations no rule covers are
+	// reachable, as they are when the policy isn't enforced
+	DefaultAllow bool      `json:"default_allow"`
+	GeneratedAt  time.Time `json:"generated_at"`
+}
+
+// PolicyEntry is one rule of a policy summary
+type PolicyEntry struct {
+	Type        RuleType `json:"type"`
+	Target      string   `json:"target"`
+	Protocol    string   `json:"protocol,omitempty"`
+	Ports       string   `json:"ports,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// Summary describes the policy serving a user who belongs to groups, in
+// evaluation order. Monitor rules are left out since they never affect
+// what the user can reach.
+func (m *Manager) Summary(userID string, groups []string) *PolicySummary {
+	m.updateMutex.RLock()
+	defer m.updateMutex.RUnlock()
+
+	summary := &PolicySummary{
+		Mode:              m.policyMode(),
+		Profile:           ProfileStandard,
+		Allowed:           []PolicyEntry{},
+		AllowedCategories: []string{},
+		Denied:            []PolicyEntry{},
+		DeniedCategories:  []string{},
+		GeneratedAt:       time.Now().UTC(),
+	}
+
+	// Confined users are held to their profile whatever the policy mode
+	var ruleSets []*UserRules
+	if reason, restricted := m.restricted[userID]; restricted {
+		summary.Profile = RemediationVersion
+		summary.ProfileReason = reason
+		summary.PolicyVersion = RemediationVersion
+		summary.Mode = PolicyModeEnforce
+		ruleSets = []*UserRules{m.remediation}
+	} else if quarantine, quarantined := m.quarantined[userID]; quarantined {
+		summary.Profile = QuarantineVersion
+		summary.ProfileReason = quarantine.Reason
+		summary.PolicyVersion = QuarantineVersion
+		summary.Mode = PolicyModeEnforce
+		ruleSets = []*UserRules{m.quarantineRules, m.remediation}
+	} else {
+		rules, version := m.effectiveRules(userID, groups)
+		summary.PolicyVersion = version
+		summary.DefaultAllow = summary.Mode != PolicyModeEnforce
+		ruleSets = []*UserRules{rules}
+	}
+
+	allowedCategories := make(map[string]bool)
+	deniedCategories := make(map[string]bool)
+	for _, rules := range ruleSets {
+		if rules == nil {
+			continue
+		}
+		for _, cr := range rules.compiled {
+			if cr.rule.Mode == RuleModeMonitor {
+				continue
+			}
+			entry := summaryEntry(cr)
+			if cr.accessType == AccessTypeAllow {
+				summary.AllowedTotal++
+				if len(summary.Allowed) < maxSummaryEntries {
+					summary.Allowed = append(summary.Allowed, entry)
+				}
+				if entry.Description != "" {
+					allowedCategories[entry.Description] = true
+				}
+			} else {
+				summary.DeniedTotal++
+				if len(summary.Denied) < maxSummaryEntries {
+					summary.Denied = append(summary.Denied, entry)
+				}
+				if entry.Description != "" {
+					deniedCategories[entry.Description] = true
+				}
+			}
+		}
+	}
+	summary.AllowedCategories = sortedKeys(allowedCategories)
+	summary.DeniedCategories = sortedKeys(deniedCategories)
+
+	return summary
+}
+
+// summaryEntry describes a compiled rule the way a user would look for it
+func summaryEntry(cr compiledRule) PolicyEntry {
+	entry := PolicyEntry{
+		Type:        cr.ruleType,
+		Target:      cr.rule.Pattern,
+		Protocol:    cr.rule.Protocol,
+		Ports:       cr.rule.DstPort,
+		Description: cr.rule.Description,
+	}
+	if entry.Target == "" {
+		entry.Target = cr.rule.DstIP
+	}
+	if entry.Target == "" {
+		entry.Target = "*"
+	}
+	return entry
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,84 @@
+package firewall
+
+import "testing"
+
+func TestSummaryListsRulesInEvaluationOrder(t *testing.T) {
+	rules := UserRules{UserID: "alice"}
+	rules.Rules.AllowDomains = []FirewallRule{
+		{Pattern: "*.example.com", Priority: 20, Description: "Intranet"},
+	}
+	rules.Rules.DenyDomains = []FirewallRule{
+		{Pattern: "social.example.com", Priority: 10, Description: "Social media"},
+		{Pattern: "trial.example.com", Priority: 5, Mode: RuleModeMonitor},
+	}
+	rules.Rules.AllowProtocolRules = []FirewallRule{
+		{DstIP: "10.0.0.5", Protocol: "tcp", DstPort: "22", Priority: 30},
+	}
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": rules})
+
+	summary := m.Summary("alice", nil)
+	if summary.Profile != ProfileStandard || summary.Mode != PolicyModeEnforce || summary.DefaultAllow {
+		t.Fatalf("unexpected profile %s, mode %s, default allow %v", summary.Profile, summary.Mode, summary.DefaultAllow)
+	}
+	if summary.AllowedTotal != 2 || len(summary.Allowed) != 2 {
+		t.Fatalf("expected 2 allowed entries, got %+v", summary.Allowed)
+	}
+	if summary.Allowed[0].Target != "*.example.com" || summary.Allowed[1].Target != "10.0.0.5" || summary.Allowed[1].Ports != "22" {
+		t.Errorf("unexpected allowed entries %+v", summary.Allowed)
+	}
+	// The monitor rule doesn't affect access, so it is left out
+	if summary.DeniedTotal != 1 || summary.Denied[0].Target != "social.example.com" {
+		t.Errorf("unexpected denied entries %+v", summary.Denied)
+	}
+	if len(summary.AllowedCategories) != 1 || summary.AllowedCategories[0] != "Intranet" {
+		t.Errorf("unexpected allowed categories %v", summary.AllowedCategories)
+	}
+	if len(summary.DeniedCategories) != 1 || summary.DeniedCategories[0] != "Social media" {
+		t.Errorf("unexpected denied categories %v", summary.DeniedCategories)
+	}
+
+	m.SetPolicyMode(PolicyModePermissive)
+	if summary := m.Summary("alice", nil); !summary.DefaultAllow {
+		t.Error("expected everything to be reachable in permissive mode")
+	}
+}
+
+func TestSummaryOfRestrictedUser(t *testing.T) {
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{
+		"alice": domainRules("alice", "*.example.com", AccessTypeAllow),
+	})
+	m.SetRemediationProfile([]string{"manager.example.com"})
+	m.SetPolicyMode(PolicyModePermissive)
+	m.Restrict("alice", "expired_certificate")
+
+	summary := m.Summary("alice", nil)
+	if summary.Profile != RemediationVersion || summary.ProfileReason != "expired_certificate" {
+		t.Fatalf("expected the remediation profile, got %s (%s)", summary.Profile, summary.ProfileReason)
+	}
+	// Permissive mode doesn't relax a restriction
+	if summary.Mode != PolicyModeEnforce || summary.DefaultAllow {
+		t.Errorf("expected the restriction to be enforced, got mode %s, default allow %v", summary.Mode, summary.DefaultAllow)
+	}
+	if len(summary.Allowed) != 1 || summary.Allowed[0].Target != "manager.example.com" {
+		t.Errorf("expected only the renewal endpoint, got %+v", summary.Allowed)
+	}
+}
+
+func TestSummaryCapsEntries(t *testing.T) {
+	rules := UserRules{UserID: "alice"}
+	for i := 0; i < maxSummaryEntries+10; i++ {
+		rules.Rules.DenyIPs = append(rules.Rules.DenyIPs, FirewallRule{Pattern: "192.0.2.1", Priority: i})
+	}
+
+	m := NewManager("", "")
+	m.userRules = copyUserRules(map[string]UserRules{"alice": rules})
+
+	summary := m.Summary("alice", nil)
+	if len(summary.Denied) != maxSummaryEntries || summary.DeniedTotal != maxSummaryEntries+10 {
+		t.Errorf("expected %d of %d denied entries, got %d of %d",
+			maxSummaryEntries, maxSummaryEntries+10, len(summary.Denied), summary.DeniedTotal)
+	}
+}
@@ -0,0 +1,176 @@
+package firewall
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func domainRules(userID, pattern string, access AccessType) UserRules {
+	rules := UserRules{UserID: userID}
+	rule := FirewallRule{Pattern: pattern, Priority: 10}
+	if access == AccessTypeAllow {
+		rules.Rules.AllowDomains = []FirewallRule{rule}
+	} else {
+		rules.Rules.DenyDomains = []FirewallRule{rule}
+	}
+	return rules
+}
+
+// fakeManager serves a queue of responses and records the cursors requested
+type fakeManager struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter)
+	cursors   []string
+}
+
+func (f *fakeManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cursors = append(f.cursors, r.URL.Query().Get("cursor"))
+	next := f.responses[0]
+	f.responses = f.responses[1:]
+	next(w)
+}
+
+func respond(resp AllRulesResponse) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func TestFetchRulesDelta(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{
+			Cursor: "10",
+			UserRules: map[string]UserRules{
+				"alice": domainRules("alice", "example.com", AccessTypeAllow),
+				"bob":   domainRules("bob", "example.com", AccessTypeAllow),
+			},
+		}),
+		respond(AllRulesResponse{
+			Cursor:       "12",
+			Delta:        true,
+			UserRules:    map[string]UserRules{"alice": domainRules("alice", "example.com", AccessTypeDeny)},
+			RemovedUsers: []string{"bob"},
+		}),
+		func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotModified) },
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	m := NewManager(server.URL, "token")
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("full fetch: %v", err)
+	}
+	if !m.Decide("alice", "example.com").Allowed || !m.Decide("bob", "example.com").Allowed {
+		t.Fatal("expected both users allowed after full sync")
+	}
+
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("delta fetch: %v", err)
+	}
+	if d := m.Decide("alice", "example.com"); d.Allowed {
+		t.Errorf("alice still allowed from a stale cached decision: %+v", d)
+	}
+	if d := m.Decide("bob", "example.com"); d.Allowed || d.Reason != "no_rules" {
+		t.Errorf("removed user bob: %+v", d)
+	}
+
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("not modified fetch: %v", err)
+	}
+	if m.cursor != "12" || m.GetRulesCount() != 1 {
+		t.Errorf("cursor %q with %d users after not modified", m.cursor, m.GetRulesCount())
+	}
+
+	want := []string{"", "10", "12"}
+	for i, cursor := range fake.cursors {
+		if cursor != want[i] {
+			t.Errorf("request %d used cursor %q, want %q", i, cursor, want[i])
+		}
+	}
+}
+
+func TestFetchRulesFullResync(t *testing.T) {
+	full := respond(AllRulesResponse{
+		Cursor:    "10",
+		UserRules: map[string]UserRules{"alice": domainRules("alice", "example.com", AccessTypeAllow)},
+	})
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){full, full, full}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	m := NewManager(server.URL, "token")
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	// The Manager falls back to a full set when it can't serve the delta
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("fallback fetch: %v", err)
+	}
+
+	// Past the resync interval no cursor is sent
+	m.lastFullSync = time.Now().Add(-2 * DefaultFullResyncInterval)
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("resync fetch: %v", err)
+	}
+
+	want := []string{"", "10", ""}
+	for i, cursor := range fake.cursors {
+		if cursor != want[i] {
+			t.Errorf("request %d used cursor %q, want %q", i, cursor, want[i])
+		}
+	}
+}
+
+func TestFetchRulesRejectsUnrequestedDelta(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{Cursor: "10", Delta: true}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if err := NewManager(server.URL, "token").fetchRules(); err == nil {
+		t.Fatal("expected an error for a delta answering a full request")
+	}
+}
+
+func TestFetchRulesUpstreams(t *testing.T) {
+	fake := &fakeManager{responses: []func(w http.ResponseWriter){
+		respond(AllRulesResponse{Cursor: "10", Upstreams: map[string][]string{"app": {"10.0.0.1:443", "10.0.0.2:443"}}}),
+		respond(AllRulesResponse{Cursor: "11", Delta: true}),
+		respond(AllRulesResponse{Cursor: "12", Delta: true, Upstreams: map[string][]string{"app": {"10.0.0.3:443"}}}),
+		respond(AllRulesResponse{Cursor: "13"}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	var received []map[string][]string
+	m := NewManager(server.URL, "token")
+	m.SetUpstreamsHandler(func(upstreams map[string][]string) {
+		received = append(received, upstreams)
+	})
+	for i := 0; i < 3; i++ {
+		if err := m.fetchRules(); err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+	}
+	// A full sync without upstreams removes them
+	m.lastFullSync = time.Now().Add(-2 * DefaultFullResyncInterval)
+	if err := m.fetchRules(); err != nil {
+		t.Fatalf("resync fetch: %v", err)
+	}
+
+	if len(received) != 3 {
+		t.Fatalf("expected upstreams from the full syncs and the delta carrying them, got %v", received)
+	}
+	if len(received[0]["app"]) != 2 || received[1]["app"][0] != "10.0.0.3:443" || len(received[2]) != 0 {
+		t.Errorf("unexpected upstreams %v", received)
+	}
+}
@@ -0,0 +1,22 @@
+package firewall
+
+// SetUpstreamsHandler sets the function given the logical upstream targets
+// - name to backend addresses - each time the Manager sends them, so the
+// proxy can balance sessions to a name over its backends. Full syncs
+// always carry them; deltas only when they changed. Call before Start.
+func (m *Manager) SetUpstreamsHandler(handler func(map[string][]string)) {
+	m.updateMutex.Lock()
+	defer m.updateMutex.Unlock()
+	m.upstreamsHandler = handler
+}
+
+// applyUpstreams hands upstreams to the upstreams handler, if there is one
+func (m *Manager) applyUpstreams(upstreams map[string][]string) {
+	m.updateMutex.RLock()
+	handler := m.upstreamsHandler
+	m.updateMutex.RUnlock()
+
+	if handler != nil {
+		handler(upstreams)
+	}
+}
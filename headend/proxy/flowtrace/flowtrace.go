@@ -0,0 +1,451 @@
+// Package flowtrace records the pipeline of single live flows an operator
+// flagged through the admin API of the SASEWaddle headend proxy.
+//
+// The flowtrace package provides:
+//   - Arming a trace for a user and, optionally, a destination; the next
+//     matching flow is recorded, later ones are not
+//   - A structured record of every stage the flow went through: the
+//     authenticated user, the firewall decision and matched rule, the
+//     routing decision, upstream dials with their timing, and the final
+//     verdict with the bytes transferred
+//   - Retention of the last finished traces for retrieval
+//
+// Proxy code records stages on the trace carried by the flow's context.
+// Flows that aren't traced carry none, and recording on a nil trace does
+// nothing, so the data path pays a context lookup and nothing more.
+package flowtrace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/events"
+)
+
+// DefaultTTL is how long an armed trace waits for its flow
+const DefaultTTL = 10 * time.Minute
+
+// MaxTTL bounds how long a trace can stay armed
+const MaxTTL = 24 * time.Hour
+
+// maxArmed bounds the traces waiting for a flow at once
+const maxArmed = 100
+
+// Status is the state of a trace
+type Status string
+
+const (
+	StatusArmed     Status = "armed"
+	StatusRecording Status = "recording"
+	StatusComplete  Status = "complete"
+	StatusExpired   Status = "expired"
+)
+
+// Errors returned by Arm
+var (
+	ErrNoUser   = errors.New("a user is required")
+	ErrTooMany  = errors.New("too many armed traces")
+	ErrDisabled = errors.New("flow tracing is not enabled")
+)
+
+// Stage is one step of a traced flow
+type Stage struct {
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+	// Offset is the time since the flow started
+	Offset time.Duration `json:"offset"`
+	// Duration is how long a timed stage, such as a dial, took
+	Duration time.Duration  `json:"duration,omitempty"`
+	Detail   map[string]any `json:"detail,omitempty"`
+}
+
+// Trace is the record of one flagged flow
+type Trace struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	Destination string     `json:"destination,omitempty"`
+	Status      Status     `json:"status"`
+	ArmedAt     time.Time  `json:"armed_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+
+	// The flow that was recorded
+	Protocol  string `json:"protocol,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+	Target    string `json:"target,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	Stages        []Stage       `json:"stages"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+	Duration      time.Duration `json:"duration,omitempty"`
+
+	recorder *Recorder
+}
+
+// Flow describes a flow starting on the headend
+type Flow struct {
+	UserID    string
+	Protocol  string
+	SourceIP  string
+	Target    string
+	RequestID string
+}
+
+// Recorder holds the armed, recording and finished traces. A nil Recorder
+// traces nothing.
+type Recorder struct {
+	maxKept int
+	now     func() time.Time
+
+	// armedCount lets flows skip the lock while nothing is armed
+	armedCount atomic.Int32
+
+	mu        sync.Mutex
+	armed     []*Trace
+	recording map[string]*Trace // by request ID
+	finished  []*Trace          // oldest first
+}
+
+// NewRecorder creates a recorder keeping the last maxKept finished traces
+func NewRecorder(maxKept int) *Recorder {
+	if maxKept <= 0 {
+		maxKept = 50
+	}
+	return &Recorder{
+		maxKept:   maxKept,
+		now:       time.Now,
+		recording: make(map[string]*Trace),
+	}
+}
+
+// Arm flags the next flow of userID to destination for tracing. An empty
+// destination matches any; otherwise it is a host, matching every port,
+// or host:port. ttl <= 0 uses DefaultTTL.
+func (r *Recorder) Arm(userID, destination string, ttl time.Duration) (Trace, error) {
+	if r == nil {
+		return Trace{}, ErrDisabled
+	}
+	if userID == "" {
+		return Trace{}, ErrNoUser
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	if len(r.armed) >= maxArmed {
+		return Trace{}, ErrTooMany
+	}
+
+	now := r.now().UTC()
+	trace := &Trace{
+		ID:          newID(),
+		UserID:      userID,
+		Destination: strings.ToLower(strings.TrimSpace(destination)),
+		Status:      StatusArmed,
+		ArmedAt:     now,
+		ExpiresAt:   now.Add(ttl),
+		Stages:      []Stage{},
+		recorder:    r,
+	}
+	r.armed = append(r.armed, trace)
+	r.armedCount.Store(int32(len(r.armed)))
+	tracesArmed.Inc()
+	return trace.snapshot(), nil
+}
+
+// Begin starts recording flow if an armed trace matches it, consuming the
+// trace, and returns nil otherwise
+func (r *Recorder) Begin(flow Flow) *Trace {
+	if r == nil || r.armedCount.Load() == 0 || flow.UserID == "" {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	for i, trace := range r.armed {
+		if trace.UserID != flow.UserID || !matchDestination(trace.Destination, flow.Target) {
+			continue
+		}
+		r.armed = append(r.armed[:i], r.armed[i+1:]...)
+		r.armedCount.Store(int32(len(r.armed)))
+
+		started := r.now().UTC()
+		trace.Status = StatusRecording
+		trace.StartedAt = &started
+		trace.Protocol = flow.Protocol
+		trace.SourceIP = flow.SourceIP
+		trace.Target = flow.Target
+		trace.RequestID = flow.RequestID
+		r.recording[flow.RequestID] = trace
+		return trace
+	}
+	return nil
+}
+
+// Record appends a stage to the trace; a nil trace records nothing
+func (t *Trace) Record(name string, detail map[string]any) {
+	t.record(name, 0, detail)
+}
+
+// Timed appends a stage that began at start and ends now
+func (t *Trace) Timed(name string, start time.Time, detail map[string]any) {
+	if t == nil {
+		return
+	}
+	t.record(name, t.recorder.now().Sub(start), detail)
+}
+
+func (t *Trace) record(name string, duration time.Duration, detail map[string]any) {
+	if t == nil {
+		return
+	}
+	r := t.recorder
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.Status != StatusRecording {
+		return
+	}
+	now := r.now().UTC()
+	t.Stages = append(t.Stages, Stage{
+		Name:     name,
+		At:       now,
+		Offset:   now.Sub(*t.StartedAt),
+		Duration: duration,
+		Detail:   detail,
+	})
+}
+
+// Name identifies the recorder as an event bus sink
+func (r *Recorder) Name() string {
+	return "flowtrace"
+}
+
+// Handle finishes the trace of a flow when its verdict is published, which
+// carries the flow's outcome and the bytes it transferred
+func (r *Recorder) Handle(event events.Event) {
+	if event.Type != events.TypeVerdict || event.RequestID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	trace, ok := r.recording[event.RequestID]
+	if !ok {
+		return
+	}
+	delete(r.recording, event.RequestID)
+
+	detail := map[string]any{"allowed": event.Allowed}
+	if event.Reason != "" {
+		detail["reason"] = event.Reason
+	}
+	if event.Rule != "" {
+		detail["rule"] = event.Rule
+	}
+	if event.StatusCode != 0 {
+		detail["status_code"] = event.StatusCode
+	}
+	finished := r.now().UTC()
+	trace.Stages = append(trace.Stages, Stage{
+		Name:     "verdict",
+		At:       finished,
+		Offset:   finished.Sub(*trace.StartedAt),
+		Duration: event.Duration,
+		Detail:   detail,
+	})
+	trace.Status = StatusComplete
+	trace.FinishedAt = &finished
+	trace.BytesSent = event.BytesSent
+	trace.BytesReceived = event.BytesReceived
+	trace.Duration = finished.Sub(*trace.StartedAt)
+	r.finishLocked(trace)
+	tracesFinished.WithLabelValues(string(StatusComplete)).Inc()
+}
+
+// List returns every trace: armed, recording and finished, newest first
+func (r *Recorder) List() []Trace {
+	traces := []Trace{}
+	if r == nil {
+		return traces
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	for i := len(r.armed) - 1; i >= 0; i-- {
+		traces = append(traces, r.armed[i].snapshot())
+	}
+	for _, trace := range r.recording {
+		traces = append(traces, trace.snapshot())
+	}
+	for i := len(r.finished) - 1; i >= 0; i-- {
+		traces = append(traces, r.finished[i].snapshot())
+	}
+	return traces
+}
+
+// Get returns the trace with id
+func (r *Recorder) Get(id string) (Trace, bool) {
+	if r == nil {
+		return Trace{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	if trace := r.findLocked(id); trace != nil {
+		return trace.snapshot(), true
+	}
+	return Trace{}, false
+}
+
+// Delete disarms or discards the trace with id
+func (r *Recorder) Delete(id string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	trace := r.findLocked(id)
+	if trace == nil {
+		return false
+	}
+
+	switch trace.Status {
+	case StatusArmed:
+		for i, armed := range r.armed {
+			if armed == trace {
+				r.armed = append(r.armed[:i], r.armed[i+1:]...)
+				break
+			}
+		}
+		r.armedCount.Store(int32(len(r.armed)))
+	case StatusRecording:
+		// The flow goes on untraced
+		delete(r.recording, trace.RequestID)
+		trace.Status = StatusComplete
+	default:
+		for i, finished := range r.finished {
+			if finished == trace {
+				r.finished = append(r.finished[:i], r.finished[i+1:]...)
+				break
+			}
+		}
+	}
+	return true
+}
+
+// findLocked returns the trace with id, or nil. The caller holds r.mu.
+func (r *Recorder) findLocked(id string) *Trace {
+	for _, trace := range r.armed {
+		if trace.ID == id {
+			return trace
+		}
+	}
+	for _, trace := range r.recording {
+		if trace.ID == id {
+			return trace
+		}
+	}
+	for _, trace := range r.finished {
+		if trace.ID == id {
+			return trace
+		}
+	}
+	return nil
+}
+
+// expireLocked retires armed traces whose flow never came. The caller
+// holds r.mu.
+func (r *Recorder) expireLocked() {
+	now := r.now()
+	kept := r.armed[:0]
+	for _, trace := range r.armed {
+		if now.Before(trace.ExpiresAt) {
+			kept = append(kept, trace)
+			continue
+		}
+		trace.Status = StatusExpired
+		r.finishLocked(trace)
+		tracesFinished.WithLabelValues(string(StatusExpired)).Inc()
+	}
+	for i := len(kept); i < len(r.armed); i++ {
+		r.armed[i] = nil
+	}
+	r.armed = kept
+	r.armedCount.Store(int32(len(r.armed)))
+}
+
+// finishLocked keeps trace among the finished ones, dropping the oldest
+// beyond maxKept. The caller holds r.mu.
+func (r *Recorder) finishLocked(trace *Trace) {
+	r.finished = append(r.finished, trace)
+	if excess := len(r.finished) - r.maxKept; excess > 0 {
+		r.finished = append([]*Trace(nil), r.finished[excess:]...)
+	}
+}
+
+// snapshot copies the trace for callers outside the recorder. The caller
+// holds the recorder's lock.
+func (t *Trace) snapshot() Trace {
+	copied := *t
+	copied.Stages = append([]Stage{}, t.Stages...)
+	copied.recorder = nil
+	return copied
+}
+
+// matchDestination reports whether target, host or host:port, is the
+// armed destination
+func matchDestination(destination, target string) bool {
+	if destination == "" {
+		return true
+	}
+	target = strings.ToLower(target)
+	if destination == target {
+		return true
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = strings.Trim(target, "[]")
+	}
+	return strings.Trim(destination, "[]") == host
+}
+
+func newID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+type traceKey struct{}
+
+// WithTrace returns a copy of parent carrying trace
+func WithTrace(parent context.Context, trace *Trace) context.Context {
+	if trace == nil {
+		return parent
+	}
+	return context.WithValue(parent, traceKey{}, trace)
+}
+
+// FromContext returns the trace of the flow in ctx, or nil if it isn't traced
+func FromContext(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
@@ -0,0 +1,141 @@
+package flowtrace
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/events"
+)
+
+func TestTraceNextMatchingFlow(t *testing.T) {
+	r := NewRecorder(10)
+	armed, err := r.Arm("alice", "Example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if armed.Status != StatusArmed || armed.Destination != "example.com" {
+		t.Fatalf("unexpected armed trace %+v", armed)
+	}
+
+	// Other users and destinations don't consume the trace
+	if r.Begin(Flow{UserID: "bob", Target: "example.com:443", RequestID: "r0"}) != nil {
+		t.Error("expected bob's flow untraced")
+	}
+	if r.Begin(Flow{UserID: "alice", Target: "other.com:443", RequestID: "r1"}) != nil {
+		t.Error("expected a flow to another destination untraced")
+	}
+
+	trace := r.Begin(Flow{UserID: "alice", Protocol: "TCP", Target: "example.com:443", RequestID: "r2"})
+	if trace == nil {
+		t.Fatal("expected the matching flow traced")
+	}
+	if r.Begin(Flow{UserID: "alice", Target: "example.com:443", RequestID: "r3"}) != nil {
+		t.Error("expected only the next flow traced")
+	}
+
+	ctx := WithTrace(context.Background(), trace)
+	FromContext(ctx).Record("policy", map[string]any{"allowed": true})
+	FromContext(ctx).Timed("upstream.dial", time.Now().Add(-time.Millisecond), nil)
+	FromContext(context.Background()).Record("ignored", nil)
+
+	if got, ok := r.Get(armed.ID); !ok || got.Status != StatusRecording || len(got.Stages) != 2 {
+		t.Fatalf("expected the recording trace with 2 stages, got %+v", got)
+	}
+
+	r.Handle(events.Event{Type: events.TypeConnectionOpened, RequestID: "r2"})
+	r.Handle(events.Event{Type: events.TypeVerdict, RequestID: "r2", Allowed: true, BytesSent: 10, BytesReceived: 20})
+
+	got, _ := r.Get(armed.ID)
+	if got.Status != StatusComplete || got.FinishedAt == nil || got.BytesSent != 10 || got.BytesReceived != 20 {
+		t.Fatalf("expected the trace complete with bytes, got %+v", got)
+	}
+	names := []string{}
+	for _, stage := range got.Stages {
+		names = append(names, stage.Name)
+	}
+	if len(names) != 3 || names[0] != "policy" || names[1] != "upstream.dial" || names[2] != "verdict" {
+		t.Errorf("unexpected stages %v", names)
+	}
+	if got.Stages[1].Duration < time.Millisecond {
+		t.Errorf("expected the dial timed, got %v", got.Stages[1].Duration)
+	}
+
+	// Finished traces take no more stages
+	trace.Record("late", nil)
+	if got, _ := r.Get(armed.ID); len(got.Stages) != 3 {
+		t.Errorf("expected no stage after the verdict, got %d", len(got.Stages))
+	}
+}
+
+func TestMatchDestination(t *testing.T) {
+	tests := []struct {
+		destination, target string
+		match               bool
+	}{
+		{"", "anything:1", true},
+		{"example.com", "example.com:443", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"example.com:443", "example.com:443", true},
+		{"example.com:443", "example.com:80", false},
+		{"2001:db8::1", "[2001:db8::1]:443", true},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443", true},
+		{"example.com", "www.example.com:443", false},
+	}
+	for _, tt := range tests {
+		if got := matchDestination(tt.destination, tt.target); got != tt.match {
+			t.Errorf("matchDestination(%q, %q) = %v, want %v", tt.destination, tt.target, got, tt.match)
+		}
+	}
+}
+
+func TestArmedTraceExpires(t *testing.T) {
+	r := NewRecorder(10)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	armed, _ := r.Arm("alice", "", time.Minute)
+	now = now.Add(time.Minute)
+	if r.Begin(Flow{UserID: "alice", RequestID: "r1"}) != nil {
+		t.Error("expected an expired trace not to record")
+	}
+	if got, ok := r.Get(armed.ID); !ok || got.Status != StatusExpired {
+		t.Errorf("expected the trace expired, got %+v", got)
+	}
+}
+
+func TestRetentionAndDelete(t *testing.T) {
+	r := NewRecorder(2)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		armed, _ := r.Arm("alice", "", 0)
+		ids = append(ids, armed.ID)
+		r.Begin(Flow{UserID: "alice", RequestID: armed.ID})
+		r.Handle(events.Event{Type: events.TypeVerdict, RequestID: armed.ID})
+	}
+	if _, ok := r.Get(ids[0]); ok {
+		t.Error("expected the oldest finished trace dropped")
+	}
+	if traces := r.List(); len(traces) != 2 || traces[0].ID != ids[2] {
+		t.Errorf("expected the 2 newest traces newest first, got %+v", traces)
+	}
+
+	pending, _ := r.Arm("bob", "", 0)
+	if !r.Delete(pending.ID) || !r.Delete(ids[2]) {
+		t.Fatal("expected the traces deleted")
+	}
+	if r.Begin(Flow{UserID: "bob", RequestID: "r"}) != nil {
+		t.Error("expected a disarmed trace not to record")
+	}
+	if r.Delete("missing") {
+		t.Error("expected an unknown trace not deleted")
+	}
+
+	var disabled *Recorder
+	if _, err := disabled.Arm("alice", "", 0); err != ErrDisabled {
+		t.Errorf("expected ErrDisabled, got %v", err)
+	}
+	if _, err := r.Arm("", "", 0); err != ErrNoUser {
+		t.Errorf("expected ErrNoUser, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package flowtrace
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tracesArmed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_flow_traces_armed_total",
+		Help: "Total flow traces armed through the admin API.",
+	})
+
+	tracesFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_flow_traces_finished_total",
+		Help: "Total flow traces finished, by status: complete when the flow was recorded, expired when none came.",
+	}, []string{"status"})
+)
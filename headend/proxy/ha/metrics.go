@@ -0,0 +1,28 @@
+package ha
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	haState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_ha_state",
+		Help: "1 for the current VRRP state of this headend, 0 for the others.",
+	}, []string{"state"})
+
+	haTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_ha_transitions_total",
+		Help: "Total VRRP state transitions reported by keepalived, by new state.",
+	}, []string{"state"})
+
+	haSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_ha_syncs_total",
+		Help: "Total snapshot pulls from the master while standby, by result.",
+	}, []string{"result"})
+
+	haSyncedPeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_ha_synced_peers",
+		Help: "Number of WireGuard peers last replicated from the master.",
+	})
+)
@@ -0,0 +1,396 @@
+// Package ha implements warm standby pairs for the SASEWaddle headend proxy.
+//
+// The ha package provides:
+//   - Tracking of the VRRP role of this headend, driven by keepalived
+//     notify hooks
+//   - Replication of WireGuard peers and negotiated session metadata from
+//     the master to the standby, so the standby can take over established
+//     tunnels
+//   - Hook commands run on each transition, e.g. to re-announce routes when
+//     becoming master
+//
+// Both headends of a pair share the virtual IP and the WireGuard private
+// key. The standby continuously pulls a snapshot from the master; when
+// keepalived promotes it, it already has every peer configured, so clients
+// only see their next handshake go to the other machine.
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/tobogganing/headend/proxy/capabilities"
+)
+
+// VRRP states as reported by keepalived
+const (
+	StateMaster = "MASTER"
+	StateBackup = "BACKUP"
+	StateFault  = "FAULT"
+	StateStop   = "STOP"
+)
+
+// DefaultSyncInterval is how often the standby pulls the master's snapshot
+const DefaultSyncInterval = 2 * time.Second
+
+// Device is the part of the WireGuard control client the pair needs
+type Device interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// Config configures one headend of a pair
+type Config struct {
+	Interface    string
+	PeerURL      string // the other headend of the pair
+	Token        string // shared secret for the /ha endpoints
+	SyncInterval time.Duration
+	OnMaster     string // shell command run after becoming master
+	OnBackup     string // shell command run after becoming backup
+	// OnPeersApplied is called after the master's peers were configured on
+	// the local interface, if set
+	OnPeersApplied func()
+}
+
+// Peer is a replicated WireGuard peer
+type Peer struct {
+	PublicKey  string   `json:"public_key"`
+	AllowedIPs []string `json:"allowed_ips"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	// KeepaliveSeconds is the persistent keepalive interval, zero if unset
+	KeepaliveSeconds int `json:"keepalive_seconds,omitempty"`
+}
+
+// Snapshot is the state the master replicates to the standby
+type Snapshot struct {
+	Peers    []Peer                              `json:"peers"`
+	Sessions map[string]*capabilities.Negotiated `json:"sessions"`
+	TakenAt  time.Time                           `json:"taken_at"`
+}
+
+// Status reports the pair's role and replication progress
+type Status struct {
+	State        string    `json:"state"`
+	Peer         string    `json:"peer"`
+	LastSync     time.Time `json:"last_sync,omitempty"`
+	LastSyncErr  string    `json:"last_sync_error,omitempty"`
+	SyncedPeers  int       `json:"synced_peers"`
+	TransitionAt time.Time `json:"transition_at,omitempty"`
+}
+
+// Pair is this headend's side of a warm standby pair
+type Pair struct {
+	cfg      Config
+	device   Device
+	sessions *capabilities.Registry
+	client   *http.Client
+
+	state        string
+	transitionAt time.Time
+	lastSync     time.Time
+	lastSyncErr  error
+	appliedPeers []Peer
+	mu           sync.Mutex
+	stopChan     chan bool
+}
+
+// NewPair creates a pair member in the BACKUP state; keepalived reports the
+// real state once VRRP has converged
+func NewPair(cfg Config, device Device, sessions *capabilities.Registry) (*Pair, error) {
+	if cfg.PeerURL == "" {
+		return nil, fmt.Errorf("HA peer URL is required")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("HA token is required")
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
+
+	haState.WithLabelValues(StateBackup).Set(1)
+	return &Pair{
+		cfg:      cfg,
+		device:   device,
+		sessions: sessions,
+		client:   &http.Client{Timeout: cfg.SyncInterval},
+		state:    StateBackup,
+		stopChan: make(chan bool),
+	}, nil
+}
+
+// Start begins pulling snapshots from the master while this side is standby
+func (p *Pair) Start() {
+	go func() {
+		ticker := time.NewTicker(p.cfg.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if p.State() == StateBackup {
+					p.recordSync(p.sync(context.Background()))
+				}
+			case <-p.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops replication
+func (p *Pair) Stop() {
+	close(p.stopChan)
+}
+
+// Authorized reports whether token is the pair's shared secret
+func (p *Pair) Authorized(token string) bool {
+	return p != nil && token == p.cfg.Token
+}
+
+// State returns the current VRRP state
+func (p *Pair) State() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// Transition records a state change reported by keepalived. Becoming
+// master first applies one last snapshot if the old master still answers,
+// then runs the OnMaster hook.
+func (p *Pair) Transition(state string) error {
+	state = strings.ToUpper(state)
+	switch state {
+	case StateMaster, StateBackup, StateFault, StateStop:
+	default:
+		return fmt.Errorf("unknown HA state %q", state)
+	}
+
+	p.mu.Lock()
+	previous := p.state
+	p.state = state
+	p.transitionAt = time.Now().UTC()
+	p.mu.Unlock()
+
+	if previous == state {
+		return nil
+	}
+	log.Infof("HA state changed from %s to %s", previous, state)
+	haState.WithLabelValues(previous).Set(0)
+	haState.WithLabelValues(state).Set(1)
+	haTransitions.WithLabelValues(state).Inc()
+
+	switch state {
+	case StateMaster:
+		// The old master is usually gone, so don't wait long for it
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := p.sync(ctx); err != nil {
+			log.Debugf("No final snapshot from the old master: %v", err)
+		}
+		cancel()
+		return p.runHook(p.cfg.OnMaster, state)
+	case StateBackup:
+		return p.runHook(p.cfg.OnBackup, state)
+	}
+	return nil
+}
+
+// Snapshot captures the state to replicate to the standby
+func (p *Pair) Snapshot() (*Snapshot, error) {
+	device, err := p.device.Device(p.cfg.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard device %s: %w", p.cfg.Interface, err)
+	}
+
+	snapshot := &Snapshot{
+		Peers:    peersFromDevice(device.Peers),
+		Sessions: p.sessions.All(),
+		TakenAt:  time.Now().UTC(),
+	}
+	return snapshot, nil
+}
+
+// Status returns the pair's role and replication progress
+func (p *Pair) Status() *Status {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := &Status{
+		State:        p.state,
+		Peer:         p.cfg.PeerURL,
+		LastSync:     p.lastSync,
+		SyncedPeers:  len(p.appliedPeers),
+		TransitionAt: p.transitionAt,
+	}
+	if p.lastSyncErr != nil {
+		status.LastSyncErr = p.lastSyncErr.Error()
+	}
+	return status
+}
+
+// sync pulls the master's snapshot and applies it
+func (p *Pair) sync(ctx context.Context) error {
+	snapshot, err := p.fetchSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	return p.apply(snapshot)
+}
+
+func (p *Pair) recordSync(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastSyncErr = err
+	if err != nil {
+		log.Debugf("HA sync from %s failed: %v", p.cfg.PeerURL, err)
+		haSyncs.WithLabelValues("error").Inc()
+		return
+	}
+	p.lastSync = time.Now().UTC()
+	haSyncs.WithLabelValues("ok").Inc()
+}
+
+func (p *Pair) fetchSnapshot(ctx context.Context) (*Snapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.cfg.PeerURL, "/")+"/ha/snapshot", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.Token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch HA snapshot: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to fetch HA snapshot: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode HA snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// apply configures the snapshot's peers on the local interface, replacing
+// any others, and adopts its session metadata
+func (p *Pair) apply(snapshot *Snapshot) error {
+	for clientID, negotiated := range snapshot.Sessions {
+		p.sessions.Set(clientID, negotiated)
+	}
+
+	p.mu.Lock()
+	unchanged := reflect.DeepEqual(p.appliedPeers, snapshot.Peers)
+	p.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	peers, err := peerConfigs(snapshot.Peers)
+	if err != nil {
+		return err
+	}
+	if err := p.device.ConfigureDevice(p.cfg.Interface, wgtypes.Config{ReplacePeers: true, Peers: peers}); err != nil {
+		return fmt.Errorf("failed to configure WireGuard peers: %w", err)
+	}
+
+	p.mu.Lock()
+	p.appliedPeers = snapshot.Peers
+	p.mu.Unlock()
+	haSyncedPeers.Set(float64(len(snapshot.Peers)))
+	if p.cfg.OnPeersApplied != nil {
+		p.cfg.OnPeersApplied()
+	}
+	return nil
+}
+
+// runHook runs a transition hook with the new state in HA_STATE
+func (p *Pair) runHook(command, state string) error {
+	if command == "" {
+		return nil
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "HA_STATE="+state)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("HA %s hook failed: %v, output: %s", state, err, output)
+	}
+	return nil
+}
+
+// peersFromDevice converts the device's peers, sorted by key so snapshots
+// of an unchanged device compare equal
+func peersFromDevice(devicePeers []wgtypes.Peer) []Peer {
+	peers := make([]Peer, 0, len(devicePeers))
+	for _, dp := range devicePeers {
+		peer := Peer{
+			PublicKey:        dp.PublicKey.String(),
+			AllowedIPs:       make([]string, 0, len(dp.AllowedIPs)),
+			KeepaliveSeconds: int(dp.PersistentKeepaliveInterval.Seconds()),
+		}
+		for _, ipNet := range dp.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, ipNet.String())
+		}
+		if dp.Endpoint != nil {
+			peer.Endpoint = dp.Endpoint.String()
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+	return peers
+}
+
+// peerConfigs converts replicated peers back into WireGuard configuration
+func peerConfigs(peers []Peer) ([]wgtypes.PeerConfig, error) {
+	configs := make([]wgtypes.PeerConfig, 0, len(peers))
+	for _, peer := range peers {
+		key, err := wgtypes.ParseKey(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer public key %q: %w", peer.PublicKey, err)
+		}
+
+		config := wgtypes.PeerConfig{PublicKey: key, ReplaceAllowedIPs: true}
+		for _, cidr := range peer.AllowedIPs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed IP %q for peer %s: %w", cidr, peer.PublicKey, err)
+			}
+			config.AllowedIPs = append(config.AllowedIPs, *ipNet)
+		}
+		if peer.Endpoint != "" {
+			if endpoint, err := net.ResolveUDPAddr("udp", peer.Endpoint); err == nil {
+				config.Endpoint = endpoint
+			}
+		}
+		if peer.KeepaliveSeconds > 0 {
+			keepalive := time.Duration(peer.KeepaliveSeconds) * time.Second
+			config.PersistentKeepaliveInterval = &keepalive
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
@@ -0,0 +1,188 @@
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/tobogganing/headend/proxy/capabilities"
+)
+
+type fakeDevice struct {
+	mu         sync.Mutex
+	peers      []wgtypes.Peer
+	configures int
+}
+
+func (d *fakeDevice) Device(name string) (*wgtypes.Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &wgtypes.Device{Name: name, Peers: append([]wgtypes.Peer(nil), d.peers...)}, nil
+}
+
+func (d *fakeDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.configures++
+	if cfg.ReplacePeers {
+		d.peers = nil
+	}
+	for _, pc := range cfg.Peers {
+		peer := wgtypes.Peer{PublicKey: pc.PublicKey, Endpoint: pc.Endpoint, AllowedIPs: pc.AllowedIPs}
+		if pc.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		d.peers = append(d.peers, peer)
+	}
+	return nil
+}
+
+func testPeer(t *testing.T, cidr string) wgtypes.Peer {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ipNet, _ := net.ParseCIDR(cidr)
+	return wgtypes.Peer{
+		PublicKey:                   key.PublicKey(),
+		Endpoint:                    &net.UDPAddr{IP: net.ParseIP("198.51.100.4"), Port: 51820},
+		AllowedIPs:                  []net.IPNet{*ipNet},
+		PersistentKeepaliveInterval: 25 * time.Second,
+	}
+}
+
+// masterServer serves master's snapshot the way the proxy's /ha/snapshot does
+func masterServer(t *testing.T, master *Pair) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !master.Authorized(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		snapshot, err := master.Snapshot()
+		if err != nil {
+			t.Errorf("snapshot failed: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(snapshot)
+	}))
+}
+
+func TestStandbyReplicatesPeersAndSessions(t *testing.T) {
+	masterDevice := &fakeDevice{peers: []wgtypes.Peer{testPeer(t, "10.200.0.2/32"), testPeer(t, "10.200.0.3/32")}}
+	masterSessions := capabilities.NewRegistry()
+	masterSessions.Set("client-1", &capabilities.Negotiated{ProtocolVersion: capabilities.ProtocolV1, Features: []string{capabilities.FeatureMigration}})
+
+	master, err := NewPair(Config{Interface: "wg0", PeerURL: "http://standby", Token: "secret"}, masterDevice, masterSessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := masterServer(t, master)
+	defer server.Close()
+
+	standbyDevice := &fakeDevice{peers: []wgtypes.Peer{testPeer(t, "10.200.0.9/32")}}
+	standbySessions := capabilities.NewRegistry()
+	applied := 0
+	standby, err := NewPair(Config{
+		Interface:      "wg0",
+		PeerURL:        server.URL,
+		Token:          "secret",
+		OnPeersApplied: func() { applied++ },
+	}, standbyDevice, standbySessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	standby.recordSync(standby.sync(context.Background()))
+	if status := standby.Status(); status.LastSyncErr != "" || status.SyncedPeers != 2 {
+		t.Fatalf("unexpected status after sync: %+v", status)
+	}
+
+	got := peersFromDevice(standbyDevice.peers)
+	want := peersFromDevice(masterDevice.peers)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d peers, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].PublicKey != want[i].PublicKey || got[i].Endpoint != want[i].Endpoint ||
+			got[i].KeepaliveSeconds != 25 || got[i].AllowedIPs[0] != want[i].AllowedIPs[0] {
+			t.Errorf("peer %d not replicated: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if !standbySessions.Get("client-1").Has(capabilities.FeatureMigration) {
+		t.Error("session metadata was not replicated")
+	}
+
+	// Unchanged peers aren't reconfigured on every pull
+	standby.recordSync(standby.sync(context.Background()))
+	if standbyDevice.configures != 1 || applied != 1 {
+		t.Errorf("expected 1 device configuration, got %d and %d notifications", standbyDevice.configures, applied)
+	}
+}
+
+func TestSyncRejectsWrongToken(t *testing.T) {
+	master, err := NewPair(Config{Interface: "wg0", PeerURL: "http://standby", Token: "secret"}, &fakeDevice{}, capabilities.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := masterServer(t, master)
+	defer server.Close()
+
+	standby, err := NewPair(Config{Interface: "wg0", PeerURL: server.URL, Token: "wrong"}, &fakeDevice{}, capabilities.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	standby.recordSync(standby.sync(context.Background()))
+	if status := standby.Status(); !strings.Contains(status.LastSyncErr, "status 401") {
+		t.Errorf("expected an authorization failure, got %+v", status)
+	}
+}
+
+func TestTransitionRunsHooks(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "announced")
+	pair, err := NewPair(Config{
+		Interface: "wg0",
+		PeerURL:   "http://127.0.0.1:1", // the old master is gone
+		Token:     "secret",
+		OnMaster:  "echo $HA_STATE > " + marker,
+	}, &fakeDevice{}, capabilities.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pair.Transition("bogus"); err == nil {
+		t.Error("expected an unknown state to be rejected")
+	}
+	if err := pair.Transition("master"); err != nil {
+		t.Fatalf("transition failed: %v", err)
+	}
+	if pair.State() != StateMaster {
+		t.Errorf("expected MASTER, got %s", pair.State())
+	}
+
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("OnMaster hook did not run: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != StateMaster {
+		t.Errorf("hook saw HA_STATE %q", data)
+	}
+}
+
+func TestNilPairStatus(t *testing.T) {
+	var pair *Pair
+	if pair.Status() != nil || pair.Authorized("anything") {
+		t.Error("nil pair should report no status and authorize nothing")
+	}
+}
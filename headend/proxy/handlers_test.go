@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/capabilities"
+	"github.com/tobogganing/headend/proxy/connctx"
+	"github.com/tobogganing/headend/proxy/drain"
+	"github.com/tobogganing/headend/proxy/events"
+	"github.com/tobogganing/headend/proxy/firewall"
+	"github.com/tobogganing/headend/proxy/middleware"
+	"github.com/tobogganing/libs/framing"
+)
+
+// staticProvider accepts a single token for a fixed user
+type staticProvider struct {
+	token string
+	user  auth.User
+}
+
+func (p *staticProvider) LoginHandler() gin.HandlerFunc    { return nil }
+func (p *staticProvider) CallbackHandler() gin.HandlerFunc { return nil }
+func (p *staticProvider) LogoutHandler() gin.HandlerFunc   { return nil }
+
+func (p *staticProvider) ValidateToken(token string) (*auth.User, error) {
+	if token != p.token {
+		return nil, errors.New("invalid token")
+	}
+	user := p.user
+	return &user, nil
+}
+
+func (p *staticProvider) GetUser(c *gin.Context) (*auth.User, error) {
+	return nil, errors.New("not supported")
+}
+
+// verdictSink records the verdicts published on the bus
+type verdictSink chan events.Event
+
+func (s verdictSink) Name() string              { return "test" }
+func (s verdictSink) Handle(event events.Event) { s <- event }
+
+// newTestServer returns a server routing /auth/userinfo, /proxy and CONNECT
+// through the auth middleware, as setupRoutes does without mTLS
+func newTestServer(t *testing.T) (*ProxyServer, verdictSink) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	verdicts := make(verdictSink, 8)
+	bus := events.NewBus(8)
+	bus.Subscribe(verdicts, events.TypeVerdict)
+	t.Cleanup(bus.Stop)
+
+	s := &ProxyServer{
+		authProvider: &staticProvider{
+			token: "alice-token",
+			user:  auth.User{ID: "alice", Name: "Alice"},
+		},
+		eventBus: bus,
+		proxies:  make(map[string]*httputil.ReverseProxy),
+		sessions: drain.NewTracker(),
+	}
+
+	requireAuth := middleware.AuthRequired(s.authProvider)
+	s.router = gin.New()
+	s.router.GET("/auth/userinfo", requireAuth, s.userInfoHandler)
+	s.router.Group("/proxy").Use(requireAuth).Any("/*path", s.proxyHandler)
+	s.router.Handle(http.MethodConnect, connectRoutePath, requireAuth, s.connectHandler)
+	return s, verdicts
+}
+
+// get requests path from the server's router with the bearer token and headers
+func get(t *testing.T, s *ProxyServer, path, token string, header map[string]string) (int, string) {
+	t.Helper()
+	// The reverse proxy needs a real connection, not a ResponseRecorder
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// connect opens a CONNECT tunnel to target through the server, returning the
+// connection and the proxy's response
+func connect(t *testing.T, s *ProxyServer, target, token string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(s.routeRequest))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if token != "" {
+		request += "Proxy-Authorization: Bearer " + token + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("CONNECT %s: %v", target, err)
+	}
+	return conn, reader, resp
+}
+
+func nextVerdict(t *testing.T, verdicts verdictSink) events.Event {
+	t.Helper()
+	select {
+	case event := <-verdicts:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no verdict published")
+		return events.Event{}
+	}
+}
+
+func TestUserInfoHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	if code, _ := get(t, s, "/auth/userinfo", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated request got %d, want 401", code)
+	}
+
+	code, body := get(t, s, "/auth/userinfo", "alice-token", nil)
+	if code != http.StatusOK {
+		t.Fatalf("got %d, want 200: %s", code, body)
+	}
+	var user auth.User
+	if err := json.Unmarshal([]byte(body), &user); err != nil || user.ID != "alice" {
+		t.Errorf("unexpected user %s (%v)", body, err)
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	s, verdicts := newTestServer(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	s.proxies["app.example.com"] = httputil.NewSingleHostReverseProxy(upstreamURL)
+
+	target := map[string]string{"X-Target-Host": "app.example.com"}
+	if code, body := get(t, s, "/proxy/index.html", "alice-token", target); code != http.StatusOK || body != "hello" {
+		t.Fatalf("got %d %q, want the upstream's response", code, body)
+	}
+	if v := nextVerdict(t, verdicts); !v.Allowed || v.UserID != "alice" || v.TargetHost != "app.example.com" {
+		t.Errorf("unexpected verdict %+v", v)
+	}
+
+	// Denied targets get the block page, attributed to the user
+	s.firewallManager = firewall.NewManager("", "")
+	s.firewallManager.Block("alice", "app.example.com", "test", "admin", time.Hour)
+
+	if code, _ := get(t, s, "/proxy/index.html", "alice-token", target); code != http.StatusForbidden {
+		t.Fatalf("got %d, want 403", code)
+	}
+	if v := nextVerdict(t, verdicts); v.Allowed || v.UserID != "alice" || v.Reason != "blocked_by_admin" {
+		t.Errorf("unexpected verdict %+v", v)
+	}
+}
+
+func TestConnectHandler(t *testing.T) {
+	s, verdicts := newTestServer(t)
+
+	// The target echoes what it reads back, prefixed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte("echo " + line))
+			}()
+		}
+	}()
+	target := listener.Addr().String()
+
+	if _, _, resp := connect(t, s, target, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated CONNECT got %d, want 401", resp.StatusCode)
+	}
+	if _, _, resp := connect(t, s, "no-port.example.com", "alice-token"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("CONNECT without a port got %d, want 400", resp.StatusCode)
+	}
+
+	conn, reader, resp := connect(t, s, target, "alice-token")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "echo hello\n" {
+		t.Fatalf("read %q (%v) through the tunnel, want the echo", line, err)
+	}
+	conn.Close()
+
+	// The verdict is published with the byte counts once the tunnel closes
+	v := nextVerdict(t, verdicts)
+	if !v.Allowed || v.UserID != "alice" || v.Method != http.MethodConnect || v.StatusCode != http.StatusOK {
+		t.Errorf("unexpected verdict %+v", v)
+	}
+	// Counted from the headend's side: received from the client, sent to it
+	if v.BytesReceived != int64(len("hello\n")) || v.BytesSent != int64(len("echo hello\n")) {
+		t.Errorf("counted %d bytes sent and %d received", v.BytesSent, v.BytesReceived)
+	}
+
+	// Denied targets get the block page before anything is dialed
+	s.firewallManager = firewall.NewManager("", "")
+	s.firewallManager.Block("alice", target, "test", "admin", time.Hour)
+
+	if _, _, resp := connect(t, s, target, "alice-token"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %d, want 403", resp.StatusCode)
+	}
+	if v := nextVerdict(t, verdicts); v.Allowed || v.Method != http.MethodConnect || v.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected verdict %+v", v)
+	}
+}
+
+func TestDenialFrame(t *testing.T) {
+	caps := capabilities.NewRegistry()
+	caps.Set("alice", &capabilities.Negotiated{Features: []string{capabilities.FeatureDenialFrames}})
+	caps.Set("bob", &capabilities.Negotiated{Features: []string{capabilities.FeatureMigration}})
+
+	decision := firewall.Decision{
+		PolicyVersion: "v7",
+		Reason:        "blocked_by_rule",
+		MatchedRule:   &firewall.FirewallRule{Pattern: "*.casino.example", Description: "gambling"},
+	}
+	frameFor := func(userID string) []byte {
+		ctx := connctx.WithMeta(context.Background(), connctx.Meta{
+			User:       &auth.User{ID: userID},
+			TargetHost: "play.casino.example:443",
+		})
+		return denialFrame(ctx, caps, decision)
+	}
+
+	// Only clients that negotiated denial frames get one
+	for _, user := range []string{"bob", "carol"} {
+		if frame := frameFor(user); frame != nil {
+			t.Errorf("%s got a denial frame without negotiating it", user)
+		}
+	}
+
+	denial, err := framing.DecodeDenial(frameFor("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denial.Reason != "blocked_by_rule" || denial.PolicyID != "v7" || denial.Rule != "*.casino.example" ||
+		denial.Category != "gambling" || denial.Target != "play.casino.example:443" {
+		t.Errorf("unexpected denial %+v", denial)
+	}
+}
@@ -0,0 +1,87 @@
+// Registration with the Manager.
+//
+// With registration.enabled the headend registers with the Manager once it
+// has initialized and then sends a heartbeat every registration.interval.
+// Each carries the headend's advertisement: the enrollment (identifiers,
+// WireGuard key and endpoints) plus what only the running server knows,
+// i.e. its build, enabled features, capabilities, DNS listeners, dynamic
+// ports and whether it is draining.
+package main
+
+import (
+	"sort"
+
+	"github.com/spf13/viper"
+	"github.com/tobogganing/headend/proxy/registration"
+)
+
+// initializeRegistration starts registering with the Manager
+func (s *ProxyServer) initializeRegistration() error {
+	client, err := registration.New(registration.Config{
+		ManagerURL: viper.GetString("registration.manager_url"),
+		AuthToken:  viper.GetString("registration.auth_token"),
+		Interval:   viper.GetDuration("registration.interval"),
+		Describe:   s.advertisement,
+	})
+	if err != nil {
+		return err
+	}
+	s.registration = client
+	client.Start()
+	return nil
+}
+
+// advertisement describes this headend to the Manager
+func (s *ProxyServer) advertisement() registration.Advertisement {
+	enrollment := buildEnrollment()
+	wg := enrollment.WireGuard
+	info := s.buildInfo()
+
+	advertisement := registration.Advertisement{
+		HeadendID:    enrollment.HeadendID,
+		ClusterID:    enrollment.ClusterID,
+		Hostname:     enrollment.Hostname,
+		Version:      info,
+		Features:     info.Features,
+		Capabilities: s.localCaps,
+		WireGuard: registration.WireGuard{
+			Interface:  wg.Interface,
+			PublicKey:  wg.PublicKey,
+			ListenPort: wg.ListenPort,
+			Endpoint:   wg.Endpoint,
+			Address:    wg.Address,
+			Network:    wg.Network,
+			Address6:   wg.Address6,
+			Network6:   wg.Network6,
+		},
+		Draining:       s.sessions.Draining(),
+		ActiveSessions: s.activeSessions.Len(),
+	}
+
+	endpoints := enrollment.Endpoints
+	for _, listener := range []registration.Listener{
+		{Name: "proxy", Protocol: "http", Address: endpoints.ProxyURL},
+		{Name: "tcp", Protocol: "tcp", Address: endpoints.TCP},
+		{Name: "udp", Protocol: "udp", Address: endpoints.UDP},
+		{Name: "socks", Protocol: "tcp", Address: endpoints.SOCKS},
+		{Name: "quic", Protocol: "udp", Address: endpoints.QUIC},
+		{Name: "metrics", Protocol: "http", Address: endpoints.Metrics},
+		{Name: "wireguard", Protocol: "udp", Address: wg.Endpoint},
+	} {
+		if listener.Address != "" {
+			advertisement.Listeners = append(advertisement.Listeners, listener)
+		}
+	}
+	if s.dnsProxy != nil {
+		addrs := s.dnsProxy.Addrs()
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			advertisement.Listeners = append(advertisement.Listeners,
+				registration.Listener{Name: "dns", Protocol: "udp", Address: addr})
+		}
+	}
+	if s.portManager != nil {
+		advertisement.DynamicPorts = s.portManager.GetListenerCount()
+	}
+	return advertisement
+}
@@ -0,0 +1,66 @@
+// HTTP/2 support for the headend listener.
+//
+// gRPC runs over HTTP/2 only, streams for as long as the call lasts and
+// carries its status in trailers. The listener therefore accepts HTTP/2
+// over TLS and, for clients on the WireGuard network that skip TLS, over
+// cleartext (h2c); the upstream side is handled by the transport package.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 enables HTTP/2 on the server according to server.http2.*,
+// over TLS when the listener terminates it and as h2c otherwise. It must run
+// after the server's TLS config is set and before it starts listening.
+func configureHTTP2(server *http.Server, useTLS bool) error {
+	if !viper.GetBool("server.http2.enabled") {
+		// A non-nil, empty map keeps net/http from negotiating h2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		log.Info("HTTP/2 disabled on the headend listener")
+		return nil
+	}
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams: uint32(viper.GetInt("server.http2.max_concurrent_streams")),
+		IdleTimeout:          server.IdleTimeout,
+	}
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return fmt.Errorf("failed to configure HTTP/2: %w", err)
+	}
+
+	if !useTLS && viper.GetBool("server.http2.h2c") {
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+		log.Info("HTTP/2 cleartext (h2c) enabled on the headend listener")
+	}
+	return nil
+}
+
+// grpcStatusOf returns the grpc-status a completed response carried, either
+// as a trailer or, for trailers-only error responses, as a header
+func grpcStatusOf(header http.Header) string {
+	if status := header.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return header.Get(http.TrailerPrefix + "Grpc-Status")
+}
+
+// clearStreamDeadlines lifts the server's read and write timeouts from a
+// request, so long-lived gRPC streams aren't cut off mid-call
+func clearStreamDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		log.Debugf("Error clearing stream read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Debugf("Error clearing stream write deadline: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package ids
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/mirror"
+)
+
+const (
+	// DefaultMaxFlows bounds the flows kept for correlation
+	DefaultMaxFlows = 65536
+
+	// DefaultFlowTTL is how long a flow is kept after its last mirrored
+	// packet. Suricata raises most alerts within seconds, but may hold a
+	// stream back until it is reassembled.
+	DefaultFlowTTL = 10 * time.Minute
+)
+
+// Flow is a mirrored flow and the session that produced it
+type Flow struct {
+	ID        int64
+	Src       string // endpoints of the first packet mirrored
+	Dst       string
+	Client    string // address of the headend's client, when known
+	UserID    string
+	RequestID string
+	LastSeen  time.Time
+}
+
+// Peer returns the endpoint of the flow that isn't the client, falling back
+// to the destination of the first packet when the client is unknown
+func (f Flow) Peer() string {
+	if f.Client != "" {
+		client := hostOf(f.Client)
+		for _, endpoint := range []string{f.Dst, f.Src} {
+			if hostOf(endpoint) != client {
+				return endpoint
+			}
+		}
+	}
+	return f.Dst
+}
+
+// Correlator remembers the flows the mirror sends to Suricata, so alerts
+// can be traced back to a user and session. It implements
+// mirror.FlowObserver and is safe for concurrent use.
+type Correlator struct {
+	maxFlows  int
+	ttl       time.Duration
+	mu        sync.Mutex
+	flows     map[int64]*Flow
+	lastSweep time.Time
+}
+
+// NewCorrelator creates a correlator that keeps up to maxFlows flows for
+// ttl after their last packet. Zero values select the defaults.
+func NewCorrelator(maxFlows int, ttl time.Duration) *Correlator {
+	if maxFlows <= 0 {
+		maxFlows = DefaultMaxFlows
+	}
+	if ttl <= 0 {
+		ttl = DefaultFlowTTL
+	}
+	return &Correlator{
+		maxFlows:  maxFlows,
+		ttl:       ttl,
+		flows:     make(map[int64]*Flow),
+		lastSweep: time.Now(),
+	}
+}
+
+// ObserveFlow records a packet of the flow between src and dst. It is
+// called by the mirror workers for every packet mirrored.
+func (c *Correlator) ObserveFlow(flowID int64, src, dst, client, userID, requestID string) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if flow, ok := c.flows[flowID]; ok {
+		flow.LastSeen = now
+		if flow.UserID == "" {
+			flow.UserID, flow.RequestID = userID, requestID
+		}
+		if flow.Client == "" {
+			flow.Client = client
+		}
+		return
+	}
+
+	if now.Sub(c.lastSweep) >= c.ttl/4 {
+		c.sweep(now)
+	}
+	if len(c.flows) >= c.maxFlows {
+		// Evict an arbitrary flow rather than sweeping on every packet
+		for id := range c.flows {
+			delete(c.flows, id)
+			break
+		}
+	}
+	c.flows[flowID] = &Flow{
+		ID:        flowID,
+		Src:       src,
+		Dst:       dst,
+		Client:    client,
+		UserID:    userID,
+		RequestID: requestID,
+		LastSeen:  now,
+	}
+	trackedFlows.Set(float64(len(c.flows)))
+}
+
+// Lookup finds the flow an alert is about, first by the alert's flow ID,
+// then by its endpoints in either direction. Suricata assigns flow IDs of
+// its own, so the endpoints are what usually match.
+func (c *Correlator) Lookup(flowID int64, src, dst string) (Flow, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range []int64{flowID, mirror.FlowID(src, dst)} {
+		if flow, ok := c.flows[id]; ok && now.Sub(flow.LastSeen) < c.ttl {
+			return *flow, true
+		}
+	}
+	return Flow{}, false
+}
+
+// Len returns the number of flows kept
+func (c *Correlator) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.flows)
+}
+
+// sweep drops flows idle for longer than the TTL. Caller must hold mu.
+func (c *Correlator) sweep(now time.Time) {
+	for id, flow := range c.flows {
+		if now.Sub(flow.LastSeen) >= c.ttl {
+			delete(c.flows, id)
+		}
+	}
+	c.lastSweep = now
+	trackedFlows.Set(float64(len(c.flows)))
+}
+
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
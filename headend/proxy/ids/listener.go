@@ -0,0 +1,341 @@
+// Package ids ingests Suricata alerts for the SASEWaddle headend proxy.
+//
+// The ids package provides:
+//   - A listener for Suricata's EVE JSON output on a unix stream or
+//     datagram socket, or over TCP
+//   - Correlation of alerts with the user and session whose mirrored
+//     traffic raised them, by flow ID or by the flow's endpoints
+//   - Optional temporary firewall blocks of the offending user and
+//     destination, and optionally closing the offending session
+//
+// Suricata is fed by the traffic mirror, and its eve-log output, with
+// filetype unix_stream or unix_dgram, points at the listener. TCP suits a
+// log shipper forwarding EVE lines from a remote sensor. Events other than
+// alerts are ignored.
+package ids
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/events"
+	"github.com/tobogganing/headend/proxy/firewall"
+	"github.com/tobogganing/headend/proxy/registry"
+)
+
+const (
+	// DefaultBlockTTL is how long an alert blocks the offending destination
+	DefaultBlockTTL = time.Hour
+
+	// maxEventSize bounds one EVE line; alerts with payloads and
+	// metadata run to a few kilobytes
+	maxEventSize = 1 << 20
+)
+
+// Config configures the alert listener
+type Config struct {
+	// Listen is unix:///path, unixgram:///path or tcp://host:port
+	Listen string
+
+	// BlockEnabled inserts a temporary deny rule for the offending user
+	// and destination when an alert is at least as severe as BlockSeverity.
+	// Suricata severities run from 1, the most severe, to 4.
+	BlockEnabled  bool
+	BlockSeverity int
+	BlockTTL      time.Duration
+
+	// KillSessions closes the offending session when it is blocked
+	KillSessions bool
+}
+
+// eveEvent is the part of a Suricata EVE record the listener uses
+type eveEvent struct {
+	EventType string    `json:"event_type"`
+	FlowID    int64     `json:"flow_id"`
+	SrcIP     string    `json:"src_ip"`
+	SrcPort   int       `json:"src_port"`
+	DestIP    string    `json:"dest_ip"`
+	DestPort  int       `json:"dest_port"`
+	Proto     string    `json:"proto"`
+	Alert     *eveAlert `json:"alert"`
+}
+
+type eveAlert struct {
+	Action      string `json:"action"`
+	GID         int    `json:"gid"`
+	SignatureID int    `json:"signature_id"`
+	Rev         int    `json:"rev"`
+	Signature   string `json:"signature"`
+	Category    string `json:"category"`
+	Severity    int    `json:"severity"`
+}
+
+// Listener receives Suricata alerts and acts on them. The firewall,
+// registry and bus may each be nil.
+type Listener struct {
+	config     Config
+	correlator *Correlator
+	firewall   *firewall.Manager
+	sessions   *registry.Registry
+	bus        *events.Bus
+
+	listener   net.Listener
+	packetConn net.PacketConn
+	socketPath string
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// NewListener creates a listener that correlates alerts through correlator
+func NewListener(config Config, correlator *Correlator, fw *firewall.Manager, sessions *registry.Registry, bus *events.Bus) *Listener {
+	if config.BlockSeverity <= 0 {
+		config.BlockSeverity = 1
+	}
+	if config.BlockTTL <= 0 {
+		config.BlockTTL = DefaultBlockTTL
+	}
+	return &Listener{
+		config:     config,
+		correlator: correlator,
+		firewall:   fw,
+		sessions:   sessions,
+		bus:        bus,
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// Start opens the listening socket. A stale unix socket left by an earlier
+// run is replaced.
+func (l *Listener) Start() error {
+	scheme, address, ok := strings.Cut(l.config.Listen, "://")
+	if !ok || address == "" {
+		return fmt.Errorf("invalid suricata alert listener %q: expected unix:///path, unixgram:///path or tcp://host:port", l.config.Listen)
+	}
+
+	switch scheme {
+	case "unix", "unixgram":
+		l.socketPath = address
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket %s: %w", address, err)
+		}
+	case "tcp":
+	default:
+		return fmt.Errorf("unsupported suricata alert listener scheme %q", scheme)
+	}
+
+	if scheme == "unixgram" {
+		conn, err := net.ListenPacket(scheme, address)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", l.config.Listen, err)
+		}
+		l.packetConn = conn
+		l.wg.Add(1)
+		go l.readDatagrams()
+	} else {
+		listener, err := net.Listen(scheme, address)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", l.config.Listen, err)
+		}
+		l.listener = listener
+		l.wg.Add(1)
+		go l.accept()
+	}
+
+	log.Infof("Suricata alert listener on %s (blocking %v)", l.config.Listen, l.config.BlockEnabled)
+	return nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	if l.packetConn != nil {
+		return l.packetConn.LocalAddr()
+	}
+	if l.listener != nil {
+		return l.listener.Addr()
+	}
+	return nil
+}
+
+// Stop closes the socket and every connection from Suricata
+func (l *Listener) Stop() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.stopped = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	if l.packetConn != nil {
+		l.packetConn.Close()
+	}
+	l.wg.Wait()
+	if l.socketPath != "" {
+		os.Remove(l.socketPath)
+	}
+}
+
+func (l *Listener) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		l.mu.Lock()
+		if l.stopped {
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+
+		go l.readStream(conn)
+	}
+}
+
+// readStream handles newline-delimited EVE records from one connection
+func (l *Listener) readStream(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		l.HandleEvent(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil && !l.isStopped() {
+		log.Warnf("Suricata alert stream from %s ended: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// readDatagrams handles EVE records sent one per datagram
+func (l *Listener) readDatagrams() {
+	defer l.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := l.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		l.HandleEvent(buf[:n])
+	}
+}
+
+func (l *Listener) isStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// HandleEvent processes one EVE record, ignoring everything but alerts
+func (l *Listener) HandleEvent(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	var event eveEvent
+	if err := json.Unmarshal(line, &event); err != nil {
+		invalidEvents.Inc()
+		log.Debugf("Ignoring invalid EVE record: %v", err)
+		return
+	}
+	if event.EventType != "alert" || event.Alert == nil {
+		return
+	}
+	l.handleAlert(event)
+}
+
+func (l *Listener) handleAlert(event eveEvent) {
+	alert := event.Alert
+	src := net.JoinHostPort(event.SrcIP, strconv.Itoa(event.SrcPort))
+	dst := net.JoinHostPort(event.DestIP, strconv.Itoa(event.DestPort))
+	rule := fmt.Sprintf("%d:%d:%d", alert.GID, alert.SignatureID, alert.Rev)
+
+	flow, correlated := l.correlator.Lookup(event.FlowID, src, dst)
+	alertsTotal.WithLabelValues(strconv.Itoa(alert.Severity), strconv.FormatBool(correlated)).Inc()
+	if !correlated || flow.UserID == "" {
+		log.Infof("Suricata alert [%s] %q on %s -> %s matches no mirrored session", rule, alert.Signature, src, dst)
+		l.publish(event, rule, Flow{}, "", false)
+		return
+	}
+
+	target := hostOf(flow.Peer())
+	var session registry.Session
+	var haveSession bool
+	if l.sessions != nil {
+		session, haveSession = l.sessions.ByRequest(flow.RequestID)
+		if haveSession && session.Target != "" {
+			target = session.Target
+		}
+	}
+	log.Warnf("Suricata alert [%s] %q (severity %d) for user %s, request %s, target %s",
+		rule, alert.Signature, alert.Severity, flow.UserID, flow.RequestID, target)
+
+	blocked := false
+	if l.config.BlockEnabled && l.firewall != nil && alert.Severity > 0 && alert.Severity <= l.config.BlockSeverity {
+		reason := fmt.Sprintf("suricata [%s] %s", rule, alert.Signature)
+		l.firewall.Block(flow.UserID, target, reason, "suricata", l.config.BlockTTL)
+		blocksTotal.Inc()
+		blocked = true
+
+		if l.config.KillSessions && haveSession {
+			l.sessions.Kill(session.ID)
+		}
+	}
+	l.publish(event, rule, flow, target, blocked)
+}
+
+// publish reports the alert on the event bus. Allowed is false when the
+// alert blocked the user.
+func (l *Listener) publish(event eveEvent, rule string, flow Flow, target string, blocked bool) {
+	if l.bus == nil {
+		return
+	}
+	if target == "" {
+		target = event.DestIP
+	}
+	sourceIP := hostOf(flow.Client)
+	if sourceIP == "" {
+		sourceIP = event.SrcIP
+	}
+	l.bus.Publish(events.Event{
+		Type:       events.TypeIDSAlert,
+		UserID:     flow.UserID,
+		SourceIP:   sourceIP,
+		TargetHost: target,
+		Protocol:   strings.ToUpper(event.Proto),
+		Allowed:    !blocked,
+		Reason:     event.Alert.Signature,
+		Rule:       rule,
+		RequestID:  flow.RequestID,
+	})
+}
@@ -0,0 +1,145 @@
+package ids
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/events"
+	"github.com/tobogganing/headend/proxy/firewall"
+	"github.com/tobogganing/headend/proxy/mirror"
+	"github.com/tobogganing/headend/proxy/registry"
+)
+
+func alertLine(flowID int64, src, dst string, severity int) string {
+	srcHost, srcPort, _ := net.SplitHostPort(src)
+	dstHost, dstPort, _ := net.SplitHostPort(dst)
+	return fmt.Sprintf(`{"timestamp":"2026-10-16T12:00:00.000000+0000","flow_id":%d,"event_type":"alert",`+
+		`"src_ip":"%s","src_port":%s,"dest_ip":"%s","dest_port":%s,"proto":"TCP",`+
+		`"alert":{"action":"allowed","gid":1,"signature_id":2024897,"rev":3,"signature":"ET MALWARE beacon","category":"A Network Trojan was detected","severity":%d}}`+"\n",
+		flowID, srcHost, srcPort, dstHost, dstPort, severity)
+}
+
+func TestCorrelatorLookup(t *testing.T) {
+	c := NewCorrelator(2, time.Minute)
+	client, target := "192.0.2.10:51000", "203.0.113.5:443"
+	c.ObserveFlow(mirror.FlowID(client, target), client, target, client, "alice", "r1")
+
+	// Suricata's own flow ID won't match; the endpoints do, either way round
+	flow, ok := c.Lookup(12345, target, client)
+	if !ok || flow.UserID != "alice" || flow.RequestID != "r1" {
+		t.Fatalf("expected alice's flow, got %+v, %v", flow, ok)
+	}
+	if flow.Peer() != target {
+		t.Errorf("peer = %s, want %s", flow.Peer(), target)
+	}
+	if _, ok := c.Lookup(mirror.FlowID(client, target), "", ""); !ok {
+		t.Error("expected a lookup by the mirror's flow ID to match")
+	}
+	if _, ok := c.Lookup(0, client, "203.0.113.6:443"); ok {
+		t.Error("expected other endpoints not to match")
+	}
+
+	c.ObserveFlow(1, "a:1", "b:2", "", "bob", "r2")
+	c.ObserveFlow(2, "c:1", "d:2", "", "carol", "r3")
+	if n := c.Len(); n != 2 {
+		t.Errorf("kept %d flows, want at most 2", n)
+	}
+}
+
+func TestListenerBlocksCorrelatedAlert(t *testing.T) {
+	client, target := "192.0.2.10:51000", "203.0.113.5:443"
+	correlator := NewCorrelator(0, 0)
+	correlator.ObserveFlow(mirror.FlowID(client, target), client, target, client, "alice", "r1")
+
+	fw := firewall.NewManager("", "")
+	sessions := registry.New()
+	var killed atomic.Int32
+	sessions.Add(registry.Session{Kind: "tcp", UserID: "alice", Target: "evil.example.com:443", RequestID: "r1"},
+		func() { killed.Add(1) })
+
+	l := NewListener(Config{
+		Listen:        "tcp://127.0.0.1:0",
+		BlockEnabled:  true,
+		BlockSeverity: 2,
+		KillSessions:  true,
+	}, correlator, fw, sessions, nil)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An informational alert and non-alert events change nothing
+	fmt.Fprint(conn, `{"event_type":"flow","flow_id":1}`+"\n")
+	fmt.Fprint(conn, alertLine(99, target, client, 3))
+	fmt.Fprint(conn, alertLine(99, target, client, 1))
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fw.Blocks()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	blocks := fw.Blocks()
+	if len(blocks) != 1 || blocks[0].UserID != "alice" || blocks[0].Target != "evil.example.com" || blocks[0].Source != "suricata" {
+		t.Fatalf("expected alice to be blocked from the session's target, got %+v", blocks)
+	}
+	if remaining := time.Until(blocks[0].Expires); remaining < 59*time.Minute {
+		t.Errorf("block expires in %s, want the default hour", remaining)
+	}
+	if d := fw.Decide("alice", "evil.example.com"); d.Allowed || d.PolicyVersion != firewall.BlockVersion {
+		t.Errorf("expected the block to deny, got %+v", d)
+	}
+	if killed.Load() != 1 {
+		t.Errorf("session killed %d times, want once", killed.Load())
+	}
+}
+
+func TestListenerPublishesAlertsOverUnixgram(t *testing.T) {
+	client, target := "192.0.2.10:51000", "203.0.113.5:443"
+	correlator := NewCorrelator(0, 0)
+	correlator.ObserveFlow(mirror.FlowID(client, target), client, target, client, "alice", "r1")
+
+	bus := events.NewBus(10)
+	sink := &recordingSink{events: make(chan events.Event, 10)}
+	bus.Subscribe(sink, events.TypeIDSAlert)
+	defer bus.Stop()
+
+	path := filepath.Join(t.TempDir(), "eve.sock")
+	l := NewListener(Config{Listen: "unixgram://" + path}, correlator, firewall.NewManager("", ""), nil, bus)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, alertLine(0, client, target, 1))
+
+	select {
+	case event := <-sink.events:
+		if event.UserID != "alice" || event.RequestID != "r1" || event.TargetHost != "203.0.113.5" ||
+			!event.Allowed || event.Rule != "1:2024897:3" || event.SourceIP != "192.0.2.10" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert event published")
+	}
+}
+
+type recordingSink struct {
+	events chan events.Event
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Handle(event events.Event) { s.events <- event }
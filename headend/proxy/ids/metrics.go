@@ -0,0 +1,28 @@
+package ids
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	alertsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_ids_alerts_total",
+		Help: "Total Suricata alerts received, by severity and whether they were correlated with a mirrored flow.",
+	}, []string{"severity", "correlated"})
+
+	blocksTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_ids_blocks_total",
+		Help: "Total temporary firewall blocks inserted in response to Suricata alerts.",
+	})
+
+	invalidEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_ids_invalid_events_total",
+		Help: "Total EVE lines that could not be parsed.",
+	})
+
+	trackedFlows = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_ids_tracked_flows",
+		Help: "Number of mirrored flows kept for alert correlation.",
+	})
+)
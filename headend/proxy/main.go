@@ -15,6 +15,9 @@ package main
 import (
     "context"
     "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "flag"
     "fmt"
     "net"
     "net/http"
@@ -22,6 +25,7 @@ import (
     "net/url"
     "os"
     "os/signal"
+    "strconv"
     "strings"
     "sync"
     "syscall"
@@ -31,26 +35,110 @@ import (
     "github.com/prometheus/client_golang/prometheus/promhttp"
     log "github.com/sirupsen/logrus"
     "github.com/spf13/viper"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+    "golang.zx2c4.com/wireguard/wgctrl"
 
+    "github.com/tobogganing/headend/config"
+    "github.com/tobogganing/headend/proxy/accesslog"
+    "github.com/tobogganing/headend/proxy/acme"
     "github.com/tobogganing/headend/proxy/auth"
+    "github.com/tobogganing/headend/proxy/blockpage"
+    "github.com/tobogganing/headend/proxy/capabilities"
+    "github.com/tobogganing/headend/proxy/certreload"
+    "github.com/tobogganing/headend/proxy/connctx"
+    "github.com/tobogganing/headend/proxy/conntrack"
+    "github.com/tobogganing/headend/proxy/connlimit"
+    "github.com/tobogganing/headend/proxy/dnsproxy"
+    "github.com/tobogganing/headend/proxy/drain"
+    "github.com/tobogganing/headend/proxy/events"
     "github.com/tobogganing/headend/proxy/firewall"
+    "github.com/tobogganing/headend/proxy/flowtrace"
+    "github.com/tobogganing/headend/proxy/ha"
+    "github.com/tobogganing/headend/proxy/mesh"
+    "github.com/tobogganing/headend/proxy/ids"
     "github.com/tobogganing/headend/proxy/mirror"
     "github.com/tobogganing/headend/proxy/middleware"
+    "github.com/tobogganing/headend/proxy/migration"
     "github.com/tobogganing/headend/proxy/ports"
+    "github.com/tobogganing/headend/proxy/prewarm"
+    "github.com/tobogganing/headend/proxy/upstream"
+    "github.com/tobogganing/headend/proxy/probe"
+    "github.com/tobogganing/headend/proxy/pseudonym"
+    "github.com/tobogganing/headend/proxy/protocol"
+    "github.com/tobogganing/headend/proxy/proxyproto"
+    "github.com/tobogganing/headend/proxy/ratelimit"
+    "github.com/tobogganing/headend/proxy/registration"
+    "github.com/tobogganing/headend/proxy/registry"
+    "github.com/tobogganing/headend/proxy/routing"
+    "github.com/tobogganing/headend/proxy/socks"
+    "github.com/tobogganing/headend/proxy/startup"
     "github.com/tobogganing/headend/proxy/syslog"
+    "github.com/tobogganing/headend/proxy/telemetry"
+    "github.com/tobogganing/headend/proxy/tracing"
+    "github.com/tobogganing/headend/proxy/transport"
+    "github.com/tobogganing/headend/proxy/udpflow"
+    "github.com/tobogganing/libs/featureflag"
+    "github.com/tobogganing/libs/framing"
+    "github.com/tobogganing/libs/version"
+    "github.com/tobogganing/headend/wireguard"
 )
 
 type ProxyServer struct {
     router          *gin.Engine
     httpServer      *http.Server
+    quicServer      *http3Server
     tcpProxy        *TCPProxy
     udpProxy        *UDPProxy
+    dynamicUDP      *UDPProxy // flows of the dynamic UDP ports
+    socksProxy      *SOCKSProxy
     portManager     *ports.PortManager
+    proxyProtocol   *proxyproto.Config // PROXY protocol on the TCP listeners, nil when disabled
     authProvider    auth.Provider
     mirrorManager   *mirror.Manager
+    mirrorSource    *config.Manager
+    mirrorStop      chan struct{}
+    mirrorSelection string          // sample rate and filter last applied
     firewallManager *firewall.Manager
+    blockPage       *blockpage.Page
+    flowCorrelator  *ids.Correlator
+    alertListener   *ids.Listener
     syslogLogger    *syslog.SyslogLogger
+    accessLog       *accesslog.Logger
+    logPseudonyms   *pseudonym.Keys
+    tracer          *tracing.Tracer
+    eventBus        *events.Bus
+    telemetry       *telemetry.Reporter
     wgRouter        *WireGuardRouter
+    wgMonitor       *wireguard.Monitor
+    egressRoutes    *routing.Table
+    rateLimiter     *ratelimit.Limiter
+    egress          *ratelimit.Egress
+    connLimits      *connlimit.Guard
+    transports      *transport.Pool
+    prewarmer       *prewarm.Warmer
+    upstreamPool    *upstream.Pool
+    balancer        *upstream.Balancer
+    certificates    *certreload.Reloader
+    acmeManager     *acme.Manager
+    acmeServer      *http.Server
+    readiness       *startup.Readiness
+    prober          *probe.Prober
+    sessions        *drain.Tracker
+    activeSessions  *registry.Registry
+    flowTraces      *flowtrace.Recorder
+    dnsProxy        *dnsproxy.Server
+    dnsIdentities   *dnsproxy.Identities
+    migration       *migration.Coordinator
+    haPair          *ha.Pair
+    mesh            *mesh.Mesh
+    registration    *registration.Client
+    certVerifier    *auth.CertVerifier
+    localCaps       capabilities.Set
+    featureFlags    *featureflag.Set
+    flagSource      *config.Manager
+    flagsStop       chan struct{}
+    sessionCaps     *capabilities.Registry
     proxies         map[string]*httputil.ReverseProxy
     mu              sync.RWMutex
 }
@@ -61,8 +149,17 @@ type TCPProxy struct {
     authProvider    auth.Provider
     mirrorManager   *mirror.Manager
     firewallManager *firewall.Manager
-    syslogLogger    *syslog.SyslogLogger
+    eventBus        *events.Bus
     wgRouter        *WireGuardRouter
+    upstreamPool    *upstream.Pool
+    balancer        *upstream.Balancer
+    mesh            *mesh.Mesh
+    rateLimiter     *ratelimit.Limiter
+    egress          *ratelimit.Egress
+    connLimits      *connlimit.Guard
+    sessions        *drain.Tracker
+    activeSessions  *registry.Registry
+    sessionCaps     *capabilities.Registry
 }
 
 // UDPProxy handles raw UDP traffic with JWT authentication  
@@ -71,13 +168,43 @@ type UDPProxy struct {
     authProvider    auth.Provider
     mirrorManager   *mirror.Manager
     firewallManager *firewall.Manager
-    syslogLogger    *syslog.SyslogLogger
+    eventBus        *events.Bus
+    wgRouter        *WireGuardRouter
+    rateLimiter     *ratelimit.Limiter
+    egress          *ratelimit.Egress
+    sessionCaps     *capabilities.Registry
+    activeSessions  *registry.Registry
+    flows           *udpflow.Table
+}
+
+// SOCKSProxy handles SOCKS5 CONNECT requests, authenticating with the JWT
+// supplied as the username/password password
+type SOCKSProxy struct {
+    listener        net.Listener
+    authProvider    auth.Provider
+    mirrorManager   *mirror.Manager
+    firewallManager *firewall.Manager
+    eventBus        *events.Bus
     wgRouter        *WireGuardRouter
+    rateLimiter     *ratelimit.Limiter
+    egress          *ratelimit.Egress
+    sessions        *drain.Tracker
 }
 
 func main() {
     initConfig()
     initLogging()
+    log.Infof("SASEWaddle headend %s", version.Get(versionComponent))
+
+    if len(os.Args) > 1 && os.Args[1] == "selftest" {
+        os.Exit(runSelfTest(os.Args[2:]))
+    }
+
+    bootstrapOutput := flag.String("bootstrap-output", "", "emit the enrollment for provisioning tools once initialized (json)")
+    flag.Parse()
+    if *bootstrapOutput != "" {
+        viper.Set("bootstrap.output", *bootstrapOutput)
+    }
 
     server := &ProxyServer{
         proxies: make(map[string]*httputil.ReverseProxy),
@@ -87,6 +214,10 @@ func main() {
         log.Fatalf("Failed to initialize server: %v", err)
     }
 
+    if err := writeBootstrapOutput(); err != nil {
+        log.Fatalf("Failed to write bootstrap output: %v", err)
+    }
+
     if err := server.Run(); err != nil {
         log.Fatalf("Server failed: %v", err)
     }
@@ -105,35 +236,286 @@ func initConfig() {
     viper.SetDefault("server.http_port", "8443")
     viper.SetDefault("server.tcp_port", "8444") 
     viper.SetDefault("server.udp_port", "8445")
+    viper.SetDefault("server.ip_family", ipFamilyDual) // dual, ipv4 or ipv6; every proxy listener takes it
     viper.SetDefault("server.metrics_port", "9090")
+    viper.SetDefault("server.socks_enabled", false)
+    viper.SetDefault("server.socks_port", "1080")
+    viper.SetDefault("server.drain_timeout", "60s")
+    viper.SetDefault("server.udp.idle_timeout", udpflow.DefaultIdleTimeout)
+    viper.SetDefault("server.udp.max_flows", udpflow.DefaultMaxFlows)
+    viper.SetDefault("server.tcp.idle_timeout", "1h") // 0 keeps silent sessions open
+    viper.SetDefault("server.tcp.max_lifetime", "0s") // 0 disables the lifetime limit
+    viper.SetDefault("server.tcp.max_connections_per_user", 0) // 0 disables the per-user cap
+    viper.SetDefault("server.proxy_protocol.enabled", false) // read PROXY headers on the TCP proxy and dynamic TCP ports
+    viper.SetDefault("server.proxy_protocol.trusted", []string{}) // load balancers that must send one; empty trusts every source
+    viper.SetDefault("server.proxy_protocol.header_timeout", proxyproto.DefaultHeaderTimeout)
+    viper.SetDefault("server.proxy_protocol.upstream", "") // v1 or v2 to send one toward upstreams
+    viper.SetDefault("server.http2.enabled", true)
+    viper.SetDefault("server.http2.h2c", true) // cleartext listener only
+    viper.SetDefault("server.http2.max_concurrent_streams", 250)
+    viper.SetDefault("server.quic.enabled", false)
+    viper.SetDefault("server.quic.port", "") // UDP; empty uses server.http_port
+    viper.SetDefault("server.quic.idle_timeout", "30s")
+    viper.SetDefault("bootstrap.output", "")      // "json" emits the enrollment at startup
+    viper.SetDefault("bootstrap.file", "")        // empty writes it to stdout
+    viper.SetDefault("bootstrap.public_host", "") // advertised host; empty uses the hostname
+    viper.SetDefault("migration.enabled", false)
+    viper.SetDefault("migration.manager_url", "http://manager:8000")
+    viper.SetDefault("migration.auth_token", "headend-server-token")
+    viper.SetDefault("migration.ticket_ttl", migration.DefaultTicketTTL)
+    viper.SetDefault("migration.peer.url", "") // peer that clients move to when this headend drains
+    viper.SetDefault("migration.peer.endpoint", "")
+    viper.SetDefault("migration.peer.public_key", "")
+    viper.SetDefault("ha.enabled", false)
+    viper.SetDefault("ha.peer_url", "") // the other headend of the pair
+    viper.SetDefault("ha.token", "")
+    viper.SetDefault("ha.sync_interval", ha.DefaultSyncInterval)
+    viper.SetDefault("ha.on_master", "/app/scripts/ha-announce-routes.sh")
+    viper.SetDefault("ha.on_backup", "")
+    viper.SetDefault("dns.enabled", false)
+    viper.SetDefault("dns.listen", []string{}) // empty serves the headend's address in each WireGuard network
+    viper.SetDefault("dns.upstreams", []string{}) // empty forwards to the resolvers of /etc/resolv.conf
+    viper.SetDefault("dns.timeout", dnsproxy.DefaultTimeout.String())
+    viper.SetDefault("dns.cache_size", dnsproxy.DefaultCacheSize) // responses; 0 disables the cache
+    viper.SetDefault("dns.cache_max_ttl", dnsproxy.DefaultMaxTTL.String())
+    viper.SetDefault("dns.negative_ttl", dnsproxy.DefaultNegativeTTL.String()) // NXDOMAIN without an SOA minimum
+    viper.SetDefault("dns.unknown_clients", dnsUnknownAllow) // or refuse: queries from addresses no authenticated flow came from
+    viper.SetDefault("dns.identity_ttl", dnsproxy.DefaultIdentityTTL.String())
+    viper.SetDefault("dns.tls_ca_file", "") // CAs of https:// and tls:// upstreams; empty trusts the system roots
+    viper.SetDefault("dns.encryption.required", false) // every query goes to encrypted upstreams only
+    viper.SetDefault("dns.encryption.required_users", []string{})
+    viper.SetDefault("dns.encryption.required_groups", []string{})
+    viper.SetDefault("registration.enabled", true) // register with the Manager and send heartbeats advertising this headend
+    viper.SetDefault("registration.manager_url", "http://manager:8000")
+    viper.SetDefault("registration.auth_token", "headend-server-token")
+    viper.SetDefault("registration.interval", registration.DefaultInterval.String())
+    viper.SetDefault("mesh.enabled", false)
+    viper.SetDefault("mesh.token", "") // shared by every headend of the mesh; required
+    viper.SetDefault("mesh.manager_url", "http://manager:8000") // lists the other clusters' headends
+    viper.SetDefault("mesh.auth_token", "headend-server-token")
+    viper.SetDefault("mesh.advertise_url", "") // where peers reach this headend; empty relies on peers listing it
+    viper.SetDefault("mesh.region", "")
+    viper.SetDefault("mesh.heartbeat_interval", mesh.DefaultHeartbeatInterval.String())
+    viper.SetDefault("mesh.peer_list_interval", mesh.DefaultPeerListInterval.String())
+    viper.SetDefault("mesh.max_local_failures", mesh.DefaultMaxLocalFailures) // upstream dials failing in a row before sessions go to peers first
+    viper.SetDefault("mesh.retry_local", mesh.DefaultRetryLocal.String())
+    viper.SetDefault("mesh.peers", []map[string]string{}) // static peers: id, url and region
+    viper.SetDefault("admin.enabled", false)
+    viper.SetDefault("admin.auth_token", "") // required; the admin API isn't served without it
+    viper.SetDefault("admin.trace_retention", 50) // finished flow traces kept for the admin API
+    viper.SetDefault("startup.timeout", "30s") // per subsystem; override with startup.timeouts.<auth|firewall|ratelimit|ports|feature_flags>
+    viper.SetDefault("server.cert_watch", true) // reload server.cert_file and server.key_file when they change; SIGHUP always reloads
+    viper.SetDefault("acme.enabled", false) // replaces server.cert_file and server.key_file
+    viper.SetDefault("acme.domains", []string{})
+    viper.SetDefault("acme.email", "")
+    viper.SetDefault("acme.directory_url", "") // empty uses Let's Encrypt production
+    viper.SetDefault("acme.challenge", acme.ChallengeHTTP01) // or dns-01, needed for wildcards
+    viper.SetDefault("acme.storage_dir", acme.DefaultStorageDir)
+    viper.SetDefault("acme.renew_before", acme.DefaultRenewBefore)
+    viper.SetDefault("acme.check_interval", acme.DefaultCheckInterval)
+    viper.SetDefault("acme.http_address", ":80") // HTTP-01 challenges only
+    viper.SetDefault("acme.dns_hook", "") // dns-01: run with ACME_ACTION, ACME_DOMAIN, ACME_RECORD and ACME_VALUE
+    viper.SetDefault("acme.dns_wait", acme.DefaultDNSWait)
+    viper.SetDefault("server.mtls.enabled", false)
+    viper.SetDefault("server.mtls.client_ca_file", "/certs/manager-ca.pem")
+    viper.SetDefault("server.mtls.expired_grace_period", 0) // 0 rejects expired certificates outright
     viper.SetDefault("auth.type", "jwt")
     viper.SetDefault("auth.manager_url", "http://manager:8000")
+    viper.SetDefault("auth.jwks_refresh_interval", "15m")
+    viper.SetDefault("auth.jwks_grace_period", "24h")
+    viper.SetDefault("auth.ldap.user_filter", "(uid=%s)")
+    viper.SetDefault("auth.ldap.id_attribute", "uid")
+    viper.SetDefault("auth.ldap.name_attribute", "cn")
+    viper.SetDefault("auth.ldap.email_attribute", "mail")
+    viper.SetDefault("auth.ldap.group_attribute", "memberOf")
+    viper.SetDefault("auth.ldap.start_tls", false)
+    viper.SetDefault("auth.ldap.session_ttl", "8h")
+    viper.SetDefault("auth.ldap.timeout", "10s")
     viper.SetDefault("mirror.enabled", false)
     viper.SetDefault("mirror.buffer_size", 1000)
+    viper.SetDefault("mirror.manager_url", "http://manager:8000") // sample rate and filter come with the headend configuration, needs CLUSTER_ID
+    viper.SetDefault("mirror.refresh_interval", "5m")
+    // mirror.sample_rate (one in N sessions) and mirror.filter (e.g. "user alice or
+    // (tcp and dst net 10.0.0.0/8 and not port 22)") override the Manager's when set
+    viper.SetDefault("mirror.pcapng.max_file_size", 100<<20)
+    viper.SetDefault("mirror.pcapng.rotate_interval", "1h")
+    viper.SetDefault("mirror.pcapng.spool_dir", "/var/spool/headend/captures") // staging for s3:// destinations
+    viper.SetDefault("mirror.pcapng.s3.endpoint", "")                        // empty means AWS
+    viper.SetDefault("mirror.pcapng.s3.region", "us-east-1")
+    viper.SetDefault("mirror.pcapng.s3.access_key", "")
+    viper.SetDefault("mirror.pcapng.s3.secret_key", "")
+    viper.SetDefault("mirror.kafka.client_id", "headend-mirror")
+    viper.SetDefault("mirror.kafka.acks", 1) // 0, 1 or -1 for all in-sync replicas
+    viper.SetDefault("mirror.kafka.batch_size", 500)
+    viper.SetDefault("mirror.kafka.flush_interval", "1s")
+    viper.SetDefault("mirror.kafka.max_pending", 10000)
+    viper.SetDefault("mirror.kafka.timeout", "10s")
+    viper.SetDefault("mirror.kafka.tls", false)
+    viper.SetDefault("mirror.kafka.username", "") // SASL/PLAIN when set
+    viper.SetDefault("mirror.kafka.password", "")
+    viper.SetDefault("mirror.workers", 0) // 0 sizes the pool to GOMAXPROCS
+    viper.SetDefault("mirror.gre.key", 0)            // RFC 2890 key; 0 sends none
+    viper.SetDefault("mirror.gre.sequence", false)   // RFC 2890 sequence numbers
+    viper.SetDefault("mirror.erspan.version", 2)     // 2 (Type II) or 3 (Type III)
+    viper.SetDefault("mirror.erspan.session_id", 1)  // 0-1023, matched by the collector
+    viper.SetDefault("mirror.erspan.hardware_id", 0) // 0-63, Type III only
+    viper.SetDefault("mirror.backpressure.policy", "drop-newest") // drop-newest, drop-oldest or block
+    viper.SetDefault("mirror.backpressure.block_timeout", "10ms")  // longest the block policy holds up a request
+    viper.SetDefault("mirror.spill.enabled", false)               // overflow a full queue to disk
+    viper.SetDefault("mirror.spill.path", "/var/spool/headend/mirror/spill.ring")
+    viper.SetDefault("mirror.spill.max_size", 256<<20)
+    viper.SetDefault("mirror.suricata_json", true)
     viper.SetDefault("mirror.suricata_enabled", false)
     viper.SetDefault("mirror.suricata_host", "")
     viper.SetDefault("mirror.suricata_port", "9999")
+    viper.SetDefault("suricata.alerts.enabled", false) // needs mirror.enabled to correlate alerts with sessions
+    viper.SetDefault("suricata.alerts.listen", "unix:///run/headend/suricata-eve.sock") // unix://, unixgram:// or tcp://host:port
+    viper.SetDefault("suricata.alerts.max_flows", ids.DefaultMaxFlows)
+    viper.SetDefault("suricata.alerts.flow_ttl", ids.DefaultFlowTTL)
+    viper.SetDefault("suricata.alerts.block_enabled", false)
+    viper.SetDefault("suricata.alerts.block_severity", 1) // block on alerts of this severity or more severe (1 is highest)
+    viper.SetDefault("suricata.alerts.block_ttl", ids.DefaultBlockTTL)
+    viper.SetDefault("suricata.alerts.kill_sessions", false)
+    viper.SetDefault("proxy.transport.max_idle_conns", 100)
+    viper.SetDefault("proxy.transport.max_idle_conns_per_host", 10)
+    viper.SetDefault("proxy.transport.idle_conn_timeout", "90s")
+    viper.SetDefault("proxy.transport.force_attempt_http2", false)
+    viper.SetDefault("proxy.transport.tls_session_cache_size", 0)
+    viper.SetDefault("proxy.transport.h2c", false)
+    viper.SetDefault("proxy.prewarm.enabled", false)
+    viper.SetDefault("proxy.prewarm.targets", prewarm.DefaultTargets) // most accessed hosts kept warm
+    viper.SetDefault("proxy.prewarm.interval", prewarm.DefaultInterval)
+    viper.SetDefault("proxy.prewarm.half_life", prewarm.DefaultHalfLife) // how fast past accesses stop counting
+    viper.SetDefault("proxy.prewarm.min_hits", prewarm.DefaultMinHits)
+    viper.SetDefault("proxy.prewarm.address_ttl", prewarm.DefaultAddressTTL)
+    viper.SetDefault("proxy.upstream_pool.enabled", false) // pre-dialed connections for TCP proxy targets
+    viper.SetDefault("proxy.upstream_pool.max_idle", upstream.DefaultMaxIdle) // per target
+    viper.SetDefault("proxy.upstream_pool.max_lifetime", upstream.DefaultMaxLifetime)
+    viper.SetDefault("proxy.upstream_pool.health_interval", upstream.DefaultHealthInterval)
+    viper.SetDefault("proxy.upstream_pool.min_dials", upstream.DefaultMinDials) // dials within demand_window that pool a target
+    viper.SetDefault("proxy.upstream_pool.demand_window", upstream.DefaultDemandWindow)
+    viper.SetDefault("proxy.upstream_pool.max_targets", upstream.DefaultMaxTargets)
+    viper.SetDefault("proxy.upstream_pool.targets", []string{}) // host:port pooled regardless of demand
+    viper.SetDefault("proxy.upstreams.groups", map[string][]string{}) // logical target host -> backend addresses
+    viper.SetDefault("proxy.upstreams.max_failures", upstream.DefaultMaxFailures) // failures in a row that eject a backend
+    viper.SetDefault("proxy.upstreams.eject_duration", upstream.DefaultEjectDuration)
     viper.SetDefault("log.level", "info")
+    viper.SetDefault("performance.profile", "default") // default or edge, see tuning.go
+    viper.SetDefault("performance.gomaxprocs", 0)      // 0 leaves the Go runtime's choice
+    viper.SetDefault("performance.relay_buffer_size", protocol.DefaultRelayBufferSize)
     viper.SetDefault("wireguard.interface", "wg0")
     viper.SetDefault("wireguard.network", "10.200.0.0/16")
+    viper.SetDefault("wireguard.network6", "") // e.g. fd00:200::/64 to address clients dual-stack
+    viper.SetDefault("wireguard.monitor_enabled", true)
+    viper.SetDefault("wireguard.monitor_interval", wireguard.DefaultMonitorInterval)
+    viper.SetDefault("wireguard.peer_refresh_interval", wireguard.DefaultPeerRefreshInterval)
+    viper.SetDefault("wireguard.peer_sessions_max", conntrack.DefaultMaxSessions)
+    viper.SetDefault("wireguard.peer_sessions_linger", conntrack.DefaultLinger) // closed client-to-client sessions stay listed this long
+    viper.SetDefault("wireguard.authenticated_mark", connctx.AuthenticatedMark) // SO_MARK of upstream sockets, 0 disables
+    viper.SetDefault("routing.egress", []map[string]any{}) // egress routes: name, destinations, tags, interface, gateway, table and mark
     viper.SetDefault("firewall.enabled", true)
     viper.SetDefault("firewall.manager_url", "http://manager:8000")
     viper.SetDefault("firewall.auth_token", "headend-server-token")
+    viper.SetDefault("firewall.local_policy_ttl", "5m")
+    viper.SetDefault("firewall.decision_cache_size", firewall.DefaultDecisionCacheSize)
+    viper.SetDefault("firewall.decision_cache_ttl", firewall.DefaultDecisionCacheTTL)
+    viper.SetDefault("firewall.full_resync_interval", firewall.DefaultFullResyncInterval)
+    viper.SetDefault("firewall.fqdn_pin_ttl", firewall.DefaultPinTTL) // 0 disables FQDN pinning
+    viper.SetDefault("firewall.shared_cache.redis_url", "") // redis:// or rediss:// URL of a cache shared by the fleet; empty disables sharing
+    viper.SetDefault("firewall.shared_cache.ttl", firewall.DefaultSharedCacheTTL)
+    viper.SetDefault("firewall.policy_mode", string(firewall.PolicyModeEnforce)) // enforce, permissive or disabled; the Manager may override
+    viper.SetDefault("firewall.group_precedence", string(firewall.GroupPrecedencePriority)) // priority, user or group
+    viper.SetDefault("firewall.remediation_targets", []string{}) // reachable by restricted and quarantined users; defaults to the Manager's host
+    viper.SetDefault("firewall.denial_contact", "") // who users should contact about a denial, sent in denial frames and block pages
+    viper.SetDefault("firewall.block_page.template_file", "") // html/template replacing the built-in block page
+    viper.SetDefault("firewall.block_page.organization", "")
+    viper.SetDefault("firewall.block_page.logo_url", "")
+    viper.SetDefault("ratelimit.enabled", false)
+    viper.SetDefault("ratelimit.manager_url", "http://manager:8000")
+    viper.SetDefault("ratelimit.auth_token", "headend-server-token")
+    viper.SetDefault("feature_flags.enabled", true) // rules come with the headend configuration, needs CLUSTER_ID
+    viper.SetDefault("feature_flags.manager_url", "http://manager:8000")
+    viper.SetDefault("feature_flags.refresh_interval", "5m")
+    viper.SetDefault("feature_flags.overrides", map[string]bool{}) // flag name to forced value, wins over the Manager
+    viper.SetDefault("egress.bytes_per_second", 0) // 0 disables the headend-wide cap
+    viper.SetDefault("egress.burst_bytes", 0)
+    viper.SetDefault("egress.shares", map[string]float64{})
+    viper.SetDefault("probes.enabled", false)
+    viper.SetDefault("probes.headend_checks", true)
     viper.SetDefault("syslog.enabled", false)
     viper.SetDefault("syslog.host", "")
     viper.SetDefault("syslog.port", "514")
     viper.SetDefault("syslog.facility", "local0")
     viper.SetDefault("syslog.tag", "sasewaddle-headend")
+    viper.SetDefault("syslog.workers", 0) // 0 sizes the pool to GOMAXPROCS
+    viper.SetDefault("syslog.queue_size", 1000)
+    viper.SetDefault("syslog.protocol", syslog.ProtocolUDP) // udp, tcp or tls (RFC 5425, usually port 6514)
+    viper.SetDefault("syslog.format", syslog.FormatRFC3164) // rfc3164 or rfc5424
+    viper.SetDefault("syslog.enterprise_id", syslog.DefaultEnterpriseID) // names the rfc5424 structured data
+    viper.SetDefault("syslog.tls.ca_file", "") // empty trusts the system roots
+    viper.SetDefault("syslog.tls.cert_file", "") // client certificate, for servers that require one
+    viper.SetDefault("syslog.tls.key_file", "")
+    viper.SetDefault("syslog.tls.server_name", "") // empty verifies syslog.host
+    viper.SetDefault("syslog.reconnect.min_backoff", "1s")
+    viper.SetDefault("syslog.reconnect.max_backoff", "1m")
+    viper.SetDefault("access_log.enabled", false) // instead of or alongside syslog
+    viper.SetDefault("access_log.path", "/var/log/sasewaddle/access.log")
+    viper.SetDefault("access_log.max_size_mb", accesslog.DefaultMaxSize>>20) // 0 disables size-based rotation
+    viper.SetDefault("access_log.rotate_interval", accesslog.DefaultRotateInterval.String()) // 0 disables time-based rotation
+    viper.SetDefault("access_log.max_backups", accesslog.DefaultMaxBackups) // 0 keeps every rotated file
+    viper.SetDefault("access_log.compress", true) // gzip rotated files
+    viper.SetDefault("log_pseudonym.enabled", false) // hash user identifiers in syslog, the access log file and the event webhook
+    viper.SetDefault("log_pseudonym.manager_url", "http://manager:8000")
+    viper.SetDefault("log_pseudonym.auth_token", "headend-server-token")
+    viper.SetDefault("log_pseudonym.refresh_interval", pseudonym.DefaultRefreshInterval.String()) // bounds how long a rotated key stays in use
+    viper.SetDefault("tracing.enabled", false)
+    viper.SetDefault("tracing.endpoint", "") // OTLP/HTTP collector, e.g. http://otel-collector:4318; empty uses OTEL_EXPORTER_OTLP_ENDPOINT
+    viper.SetDefault("tracing.headers", map[string]string{}) // sent with every export, e.g. collector credentials
+    viper.SetDefault("tracing.service_name", tracing.DefaultServiceName)
+    viper.SetDefault("tracing.sample_ratio", 0.1) // share of new traces recorded; traces from clients follow their traceparent
+    viper.SetDefault("tracing.batch_size", tracing.DefaultBatchSize)
+    viper.SetDefault("tracing.queue_size", tracing.DefaultQueueSize) // spans beyond it are dropped
+    viper.SetDefault("tracing.flush_interval", tracing.DefaultFlushInterval.String())
+    viper.SetDefault("events.buffer_size", 1000)
+    viper.SetDefault("events.webhook_url", "")
+    viper.SetDefault("events.webhook_batch_size", 100)
+    viper.SetDefault("events.webhook_flush_interval", "10s")
+    viper.SetDefault("decisions.enabled", false)
+    viper.SetDefault("decisions.flush_interval", "60s")
+    viper.SetDefault("decisions.max_series", 10000)
+    viper.SetDefault("telemetry.enabled", false) // opt-in anonymous usage reports
+    viper.SetDefault("telemetry.endpoint", "")
+    viper.SetDefault("telemetry.interval", telemetry.DefaultInterval)
+    viper.SetDefault("telemetry.min_count", telemetry.DefaultMinCount) // k: counters below it are only reported as "<k"
+    viper.SetDefault("telemetry.id_rotation", telemetry.DefaultIDRotation)
+    viper.SetDefault("capabilities.disabled_features", []string{})
     viper.SetDefault("ports.dynamic_enabled", true)
     viper.SetDefault("ports.headend_id", "")
     viper.SetDefault("ports.cluster_id", "default")
     viper.SetDefault("ports.refresh_interval", "60s")
 
+    // Subsystems this build leaves out are off unless configured otherwise;
+    // settings such as URLs already default to empty
+    for _, key := range excludedFeatures {
+        if _, flag := viper.Get(key).(bool); flag {
+            viper.SetDefault(key, false)
+        }
+    }
+
     if err := viper.ReadInConfig(); err != nil {
         log.Warnf("No config file found, using environment variables: %v", err)
     }
+    applyTuningProfile()
 }
 
+// authSettings exposes the auth section of the config to provider factories
+type authSettings struct{}
+
+func (authSettings) GetString(key string) string { return viper.GetString("auth." + key) }
+func (authSettings) GetStringSlice(key string) []string { return viper.GetStringSlice("auth." + key) }
+func (authSettings) GetBool(key string) bool { return viper.GetBool("auth." + key) }
+func (authSettings) GetDuration(key string) time.Duration { return viper.GetDuration("auth." + key) }
+
 func initLogging() {
     logLevel := viper.GetString("log.level")
     level, err := log.ParseLevel(logLevel)
@@ -147,44 +529,126 @@ func initLogging() {
 func (s *ProxyServer) Initialize() error {
     var err error
 
+    if err := checkBuildProfile(); err != nil {
+        return err
+    }
+    if err := checkIPFamily(); err != nil {
+        return err
+    }
+    if err := applyRuntimeTuning(); err != nil {
+        return err
+    }
+
+    s.sessions = drain.NewTracker()
+    s.activeSessions = registry.New()
+    s.sessionCaps = capabilities.NewRegistry()
+
+    // Subsystems that fetch their initial state from the Manager start
+    // concurrently, each within its own timeout, and are waited for before
+    // the listeners that depend on them
+    s.readiness = startup.NewReadiness()
+    group := startup.NewGroup(s.readiness)
+
     // Initialize WireGuard router for peer-to-peer and internet routing
     wgInterface := viper.GetString("wireguard.interface")
-    wgNetwork := viper.GetString("wireguard.network")
-    headendIP := "10.200.0.1" // Headend's IP in WireGuard network
-    
-    s.wgRouter, err = NewWireGuardRouter(wgInterface, wgNetwork, headendIP)
+    s.wgRouter, err = NewWireGuardRouter(wgInterface, wireguardNetworks())
     if err != nil {
         log.Warnf("Failed to initialize WireGuard router: %v (continuing without WG routing)", err)
         s.wgRouter = nil
     } else {
         log.Info("WireGuard-aware routing enabled")
+        s.wgRouter.peerSessions = conntrack.New(viper.GetInt("wireguard.peer_sessions_max"), viper.GetDuration("wireguard.peer_sessions_linger"))
+
+        // Peers are looked up in a table kept from the WireGuard control
+        // interface rather than read for every connection
+        if client, err := wgctrl.New(); err != nil {
+            log.Warnf("WireGuard peers cannot be read, routing to peers disabled: %v", err)
+        } else {
+            s.wgRouter.peers = wireguard.NewPeerTable(wgInterface, viper.GetDuration("wireguard.peer_refresh_interval"), client)
+            s.wgRouter.peers.Start()
+        }
     }
 
-    // Initialize auth provider - supports JWT, OAuth2, or SAML2
-    authType := viper.GetString("auth.type")
-    switch authType {
-    case "jwt":
-        s.authProvider, err = auth.NewJWTProvider(
-            viper.GetString("auth.manager_url"),
-            viper.GetString("auth.jwt_public_key_path"),
-        )
-    case "oauth2":
-        s.authProvider, err = auth.NewOAuth2Provider(
-            viper.GetString("auth.oauth2.issuer"),
-            viper.GetString("auth.oauth2.client_id"),
-            viper.GetString("auth.oauth2.client_secret"),
-        )
-    case "saml2":
-        s.authProvider, err = auth.NewSAML2Provider(
-            viper.GetString("auth.saml2.idp_metadata_url"),
-            viper.GetString("auth.saml2.sp_entity_id"),
-        )
-    default:
-        return fmt.Errorf("unsupported auth type: %s", authType)
+    // Upstream sockets carry the mark the WireGuard forwarding rules accept
+    if err := connctx.SetSocketMark(uint32(viper.GetInt("wireguard.authenticated_mark"))); err != nil {
+        log.Warnf("Upstream connections will not be marked: %v", err)
+    }
+    if removed, err := removeLegacyMarkRules(); err != nil {
+        log.Warnf("Failed to remove legacy traffic marking rules: %v", err)
+    } else if removed > 0 {
+        log.Infof("Removed %d legacy traffic marking rules", removed)
+    }
+
+    if err := s.initializeEgressRoutes(); err != nil {
+        return err
+    }
+
+    // Track the WireGuard listen port separately from the proxy data ports
+    if viper.GetBool("wireguard.monitor_enabled") {
+        s.wgMonitor = wireguard.NewMonitor(wgInterface, viper.GetDuration("wireguard.monitor_interval"))
+        s.wgMonitor.Start()
+    }
+
+    // Initialize auth provider from the registry - JWT, OAuth2, SAML2, LDAP
+    // or any other registered provider. The JWT provider fetches the
+    // Manager's signing keys.
+    group.Go(startup.Task{
+        Name:     "auth",
+        Required: true,
+        Timeout:  startupTimeout("auth"),
+        Run: func(context.Context) error {
+            provider, err := auth.New(viper.GetString("auth.type"), authSettings{})
+            if err != nil {
+                return fmt.Errorf("failed to initialize auth provider: %w", err)
+            }
+            s.authProvider = provider
+            return nil
+        },
+    })
+
+    // Pre-resolved addresses serve reverse-proxied requests too
+    var upstreamDial func(ctx context.Context, network, address string) (net.Conn, error)
+    if viper.GetBool("proxy.prewarm.enabled") {
+        upstreamDial = connctx.DialContext
     }
 
+    // Logical targets are balanced over their backends by every proxy
+    s.initializeBalancer()
+    upstreamDial = s.balancer.DialContext(upstreamDial)
+
+    // Fail sessions over to a peer headend when upstream connectivity fails
+    if viper.GetBool("mesh.enabled") {
+        if err := s.initializeMesh(); err != nil {
+            return fmt.Errorf("failed to initialize headend mesh: %w", err)
+        }
+        upstreamDial = s.mesh.DialContext(upstreamDial)
+    }
+
+    // Initialize upstream transports, tuned per target class
+    var transportClasses []transport.Class
+    if err := viper.UnmarshalKey("proxy.transport.classes", &transportClasses); err != nil {
+        return fmt.Errorf("failed to parse transport classes: %w", err)
+    }
+    s.transports, err = transport.NewPool(transport.Settings{
+        MaxIdleConns:        viper.GetInt("proxy.transport.max_idle_conns"),
+        MaxIdleConnsPerHost: viper.GetInt("proxy.transport.max_idle_conns_per_host"),
+        IdleConnTimeout:     viper.GetDuration("proxy.transport.idle_conn_timeout"),
+        ForceAttemptHTTP2:   viper.GetBool("proxy.transport.force_attempt_http2"),
+        TLSSessionCacheSize: viper.GetInt("proxy.transport.tls_session_cache_size"),
+        SkipTLSVerify:       viper.GetBool("proxy.skip_tls_verify"),
+        H2C:                 viper.GetBool("proxy.transport.h2c"),
+        DialContext:         upstreamDial,
+    }, transportClasses)
     if err != nil {
-        return fmt.Errorf("failed to initialize auth provider: %w", err)
+        return fmt.Errorf("failed to initialize upstream transports: %w", err)
+    }
+
+    if viper.GetBool("proxy.prewarm.enabled") {
+        s.initializePrewarm()
+    }
+
+    if viper.GetBool("proxy.upstream_pool.enabled") {
+        s.initializeUpstreamPool()
     }
 
     // Initialize traffic mirroring if enabled
@@ -211,6 +675,63 @@ func (s *ProxyServer) Initialize() error {
             log.Info("Traffic mirroring enabled")
         }
         
+        if err := s.initializeMirrorSelection(); err != nil {
+            return err
+        }
+        s.mirrorManager.SetWorkers(viper.GetInt("mirror.workers"))
+        s.mirrorManager.SetKafkaConfig(mirror.KafkaConfig{
+            ClientID:      viper.GetString("mirror.kafka.client_id"),
+            Acks:          viper.GetInt("mirror.kafka.acks"),
+            BatchSize:     viper.GetInt("mirror.kafka.batch_size"),
+            FlushInterval: viper.GetDuration("mirror.kafka.flush_interval"),
+            MaxPending:    viper.GetInt("mirror.kafka.max_pending"),
+            Timeout:       viper.GetDuration("mirror.kafka.timeout"),
+            TLS:           viper.GetBool("mirror.kafka.tls"),
+            Username:      viper.GetString("mirror.kafka.username"),
+            Password:      viper.GetString("mirror.kafka.password"),
+        })
+        s.mirrorManager.SetSuricataJSON(viper.GetBool("mirror.suricata_json"))
+        backpressure := mirror.BackpressureConfig{
+            Policy:       viper.GetString("mirror.backpressure.policy"),
+            BlockTimeout: viper.GetDuration("mirror.backpressure.block_timeout"),
+        }
+        if viper.GetBool("mirror.spill.enabled") {
+            backpressure.SpillPath = viper.GetString("mirror.spill.path")
+            backpressure.SpillMaxBytes = viper.GetInt64("mirror.spill.max_size")
+        }
+        if err := s.mirrorManager.SetBackpressure(backpressure); err != nil {
+            return err
+        }
+        if err := s.mirrorManager.SetEncapConfig(mirror.EncapConfig{
+            GREKey:           viper.GetUint32("mirror.gre.key"),
+            GRESequence:      viper.GetBool("mirror.gre.sequence"),
+            ERSPANVersion:    viper.GetInt("mirror.erspan.version"),
+            ERSPANSessionID:  viper.GetInt("mirror.erspan.session_id"),
+            ERSPANHardwareID: viper.GetInt("mirror.erspan.hardware_id"),
+        }); err != nil {
+            return err
+        }
+        s.mirrorManager.SetCaptureConfig(mirror.CaptureConfig{
+            MaxFileSize:    viper.GetInt64("mirror.pcapng.max_file_size"),
+            RotateInterval: viper.GetDuration("mirror.pcapng.rotate_interval"),
+            SpoolDir:       viper.GetString("mirror.pcapng.spool_dir"),
+            S3: mirror.S3Config{
+                Endpoint:  viper.GetString("mirror.pcapng.s3.endpoint"),
+                Region:    viper.GetString("mirror.pcapng.s3.region"),
+                AccessKey: viper.GetString("mirror.pcapng.s3.access_key"),
+                SecretKey: viper.GetString("mirror.pcapng.s3.secret_key"),
+            },
+        })
+        // Suricata alerts are traced back to sessions through the flows
+        // the mirror sends out
+        if viper.GetBool("suricata.alerts.enabled") {
+            s.flowCorrelator = ids.NewCorrelator(
+                viper.GetInt("suricata.alerts.max_flows"),
+                viper.GetDuration("suricata.alerts.flow_ttl"),
+            )
+            s.mirrorManager.SetFlowObserver(s.flowCorrelator)
+        }
+        
         if err := s.mirrorManager.Start(); err != nil {
             return fmt.Errorf("failed to start mirror manager: %w", err)
         }
@@ -222,14 +743,99 @@ func (s *ProxyServer) Initialize() error {
         authToken := viper.GetString("firewall.auth_token")
         
         s.firewallManager = firewall.NewManager(managerURL, authToken)
-        if err := s.firewallManager.Start(); err != nil {
-            return fmt.Errorf("failed to start firewall manager: %w", err)
+        s.firewallManager.SetDecisionCache(
+            viper.GetInt("firewall.decision_cache_size"),
+            viper.GetDuration("firewall.decision_cache_ttl"),
+        )
+        s.firewallManager.SetFullResyncInterval(viper.GetDuration("firewall.full_resync_interval"))
+        s.firewallManager.SetFQDNPinning(viper.GetDuration("firewall.fqdn_pin_ttl"))
+        if redisURL := viper.GetString("firewall.shared_cache.redis_url"); redisURL != "" {
+            sharedCache, addr, err := newSharedCache(redisURL)
+            if err != nil {
+                return fmt.Errorf("invalid firewall configuration: %w", err)
+            }
+            s.firewallManager.SetSharedCache(sharedCache, viper.GetDuration("firewall.shared_cache.ttl"))
+            log.Infof("Sharing firewall rules through Redis at %s", addr)
+        }
+        precedence, err := firewall.ParseGroupPrecedence(viper.GetString("firewall.group_precedence"))
+        if err != nil {
+            return fmt.Errorf("invalid firewall configuration: %w", err)
+        }
+        s.firewallManager.SetGroupPrecedence(precedence)
+        policyMode, err := firewall.ParsePolicyMode(viper.GetString("firewall.policy_mode"))
+        if err != nil {
+            return fmt.Errorf("invalid firewall configuration: %w", err)
         }
-        log.Info("Firewall manager enabled and started")
+        s.firewallManager.SetPolicyMode(policyMode)
+        targets, err := remediationTargets()
+        if err != nil {
+            return fmt.Errorf("invalid firewall configuration: %w", err)
+        }
+        s.firewallManager.SetRemediationProfile(targets)
+        s.firewallManager.SetUpstreamsHandler(s.balancer.SetManagedGroups)
+        s.blockPage, err = blockpage.New(blockpage.Config{
+            TemplateFile: viper.GetString("firewall.block_page.template_file"),
+            Organization: viper.GetString("firewall.block_page.organization"),
+            LogoURL:      viper.GetString("firewall.block_page.logo_url"),
+            Contact:      viper.GetString("firewall.denial_contact"),
+        })
+        if err != nil {
+            return fmt.Errorf("invalid firewall configuration: %w", err)
+        }
+        group.Go(startup.Task{
+            Name:     "firewall",
+            Required: true,
+            Timeout:  startupTimeout("firewall"),
+            Run: func(context.Context) error {
+                return s.firewallManager.Start()
+            },
+        })
+        if s.wgRouter != nil {
+            s.wgRouter.firewall = s.firewallManager
+        }
+        log.Info("Firewall manager enabled")
     } else {
         log.Info("Firewall manager disabled")
     }
 
+    // Initialize per-user bandwidth limits if enabled
+    if viper.GetBool("ratelimit.enabled") {
+        s.rateLimiter = ratelimit.NewLimiter(
+            viper.GetString("ratelimit.manager_url"),
+            viper.GetString("ratelimit.auth_token"),
+        )
+        group.Go(startup.Task{
+            Name:     "ratelimit",
+            Required: true,
+            Timeout:  startupTimeout("ratelimit"),
+            Run: func(context.Context) error {
+                return s.rateLimiter.Start()
+            },
+        })
+        log.Info("Per-user rate limiting enabled")
+    }
+
+    // Initialize the headend-wide egress cap if configured
+    var egressShares map[string]float64
+    if err := viper.UnmarshalKey("egress.shares", &egressShares); err != nil {
+        return fmt.Errorf("failed to parse egress shares: %w", err)
+    }
+    s.egress = ratelimit.NewEgress(ratelimit.EgressConfig{
+        BytesPerSecond: viper.GetInt64("egress.bytes_per_second"),
+        BurstBytes:     viper.GetInt64("egress.burst_bytes"),
+        Shares:         egressShares,
+    })
+    if s.egress != nil {
+        log.Infof("Egress capped at %d bytes/s", viper.GetInt64("egress.bytes_per_second"))
+    }
+
+    // Initialize TCP session limits
+    s.connLimits = connlimit.NewGuard(connlimit.Limits{
+        IdleTimeout: viper.GetDuration("server.tcp.idle_timeout"),
+        MaxLifetime: viper.GetDuration("server.tcp.max_lifetime"),
+        MaxPerUser:  viper.GetInt("server.tcp.max_connections_per_user"),
+    })
+
     // Initialize syslog logger if enabled
     if viper.GetBool("syslog.enabled") {
         syslogHost := viper.GetString("syslog.host")
@@ -237,10 +843,25 @@ func (s *ProxyServer) Initialize() error {
         
         if syslogHost != "" {
             s.syslogLogger = syslog.NewSyslogLogger(syslogHost, syslogPort)
+            s.syslogLogger.SetWorkers(viper.GetInt("syslog.workers"))
+            s.syslogLogger.SetQueueSize(viper.GetInt("syslog.queue_size"))
+            if err := s.syslogLogger.SetTransport(syslog.TransportConfig{
+                Protocol:     viper.GetString("syslog.protocol"),
+                Format:       viper.GetString("syslog.format"),
+                EnterpriseID: viper.GetInt("syslog.enterprise_id"),
+                CAFile:       viper.GetString("syslog.tls.ca_file"),
+                CertFile:     viper.GetString("syslog.tls.cert_file"),
+                KeyFile:      viper.GetString("syslog.tls.key_file"),
+                ServerName:   viper.GetString("syslog.tls.server_name"),
+                MinBackoff:   viper.GetDuration("syslog.reconnect.min_backoff"),
+                MaxBackoff:   viper.GetDuration("syslog.reconnect.max_backoff"),
+            }); err != nil {
+                return fmt.Errorf("invalid syslog transport: %w", err)
+            }
             if err := s.syslogLogger.Start(); err != nil {
                 return fmt.Errorf("failed to start syslog logger: %w", err)
             }
-            log.Infof("Syslog logging enabled - sending to %s:%s", syslogHost, syslogPort)
+            log.Infof("Syslog logging enabled - sending to %s:%s over %s", syslogHost, syslogPort, viper.GetString("syslog.protocol"))
         } else {
             log.Warn("Syslog enabled but no host configured")
         }
@@ -248,7 +869,91 @@ func (s *ProxyServer) Initialize() error {
         log.Info("Syslog logging disabled")
     }
 
-    // Initialize dynamic port manager if enabled
+    // Initialize the access log file if enabled
+    if viper.GetBool("access_log.enabled") {
+        accessLog, err := accesslog.New(accesslog.Config{
+            Path:           viper.GetString("access_log.path"),
+            MaxSize:        viper.GetInt64("access_log.max_size_mb") << 20,
+            RotateInterval: viper.GetDuration("access_log.rotate_interval"),
+            MaxBackups:     viper.GetInt("access_log.max_backups"),
+            Compress:       viper.GetBool("access_log.compress"),
+        })
+        if err != nil {
+            return fmt.Errorf("failed to start access log: %w", err)
+        }
+        s.accessLog = accessLog
+        log.Infof("Access logging enabled - writing to %s", accessLog.Path())
+    }
+
+    // Pseudonymize user identifiers in exported logs if enabled. Until the
+    // first key arrives identifiers are withheld rather than logged.
+    if viper.GetBool("log_pseudonym.enabled") {
+        s.logPseudonyms = pseudonym.NewKeys(
+            viper.GetString("log_pseudonym.manager_url"),
+            viper.GetString("log_pseudonym.auth_token"),
+            viper.GetDuration("log_pseudonym.refresh_interval"),
+        )
+        group.Go(startup.Task{
+            Name:    "log_pseudonym",
+            Timeout: startupTimeout("log_pseudonym"),
+            Run: func(context.Context) error {
+                return s.logPseudonyms.Start()
+            },
+        })
+        log.Info("Log pseudonymization enabled")
+    }
+
+    // Initialize OpenTelemetry tracing if enabled
+    if viper.GetBool("tracing.enabled") {
+        endpoint := viper.GetString("tracing.endpoint")
+        if endpoint == "" {
+            endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+        }
+        tracer, err := tracing.New(tracing.Config{
+            Endpoint:      endpoint,
+            Headers:       viper.GetStringMapString("tracing.headers"),
+            ServiceName:   viper.GetString("tracing.service_name"),
+            SampleRatio:   viper.GetFloat64("tracing.sample_ratio"),
+            BatchSize:     viper.GetInt("tracing.batch_size"),
+            QueueSize:     viper.GetInt("tracing.queue_size"),
+            FlushInterval: viper.GetDuration("tracing.flush_interval"),
+        })
+        if err != nil {
+            return fmt.Errorf("failed to start tracing: %w", err)
+        }
+        s.tracer = tracer
+        tracing.SetDefault(tracer)
+        log.Infof("Tracing enabled - exporting to %s", tracer.Endpoint())
+    }
+
+    // Initialize the event bus - handlers publish, sinks subscribe
+    s.initEventBus()
+
+    // Initialize Suricata alert ingestion if enabled
+    if viper.GetBool("suricata.alerts.enabled") {
+        if s.flowCorrelator == nil {
+            return fmt.Errorf("suricata.alerts.enabled requires mirror.enabled to correlate alerts with sessions")
+        }
+        blockEnabled := viper.GetBool("suricata.alerts.block_enabled")
+        if blockEnabled && s.firewallManager == nil {
+            log.Warn("Suricata alert blocking needs the firewall manager, alerts will only be logged")
+        }
+        s.alertListener = ids.NewListener(ids.Config{
+            Listen:        viper.GetString("suricata.alerts.listen"),
+            BlockEnabled:  blockEnabled,
+            BlockSeverity: viper.GetInt("suricata.alerts.block_severity"),
+            BlockTTL:      viper.GetDuration("suricata.alerts.block_ttl"),
+            KillSessions:  viper.GetBool("suricata.alerts.kill_sessions"),
+        }, s.flowCorrelator, s.firewallManager, s.activeSessions, s.eventBus)
+        if err := s.alertListener.Start(); err != nil {
+            return fmt.Errorf("failed to start suricata alert listener: %w", err)
+        }
+    }
+
+    // Initialize dynamic port manager if enabled. Its configuration is
+    // fetched alongside the other subsystems and applied once they are up.
+    var portClient *ports.ConfigClient
+    portConfigs := make(chan *ports.PortConfig, 1)
     if viper.GetBool("ports.dynamic_enabled") {
         headendID := viper.GetString("ports.headend_id")
         clusterID := viper.GetString("ports.cluster_id")
@@ -264,39 +969,40 @@ func (s *ProxyServer) Initialize() error {
             }
         }
         
-        s.portManager = ports.NewPortManager()
-        
-        // Set up connection handlers
-        s.portManager.SetConnectionHandlers(
-            s.handleDynamicTCPConnection,
-            s.handleDynamicUDPPacket,
-        )
-        
-        // Fetch initial configuration
-        configClient := ports.NewConfigClient(managerURL, authToken, headendID, clusterID)
-        config, err := configClient.FetchConfig()
-        if err != nil {
-            log.Errorf("Failed to fetch initial port config: %v", err)
-            log.Info("Continuing with static port configuration")
-        } else {
-            // Parse and apply the configuration
-            if err := s.portManager.ParsePortRanges(config.TCPRanges, config.UDPRanges); err != nil {
-                log.Errorf("Failed to parse port ranges: %v", err)
-            } else {
-                if err := s.portManager.StartListening(); err != nil {
-                    log.Errorf("Failed to start dynamic port listeners: %v", err)
-                } else {
-                    log.Infof("Dynamic port manager started with %d listeners", s.portManager.GetListenerCount())
-                    
-                    // Start periodic config refresh
-                    go s.refreshPortConfig(configClient)
+        portClient = ports.NewConfigClient(managerURL, authToken, headendID, clusterID)
+        group.Go(startup.Task{
+            Name:    "ports",
+            Timeout: startupTimeout("ports"),
+            Run: func(context.Context) error {
+                config, err := portClient.FetchConfig()
+                if err != nil {
+                    return err
                 }
-            }
-        }
+                portConfigs <- config
+                return nil
+            },
+        })
     } else {
         log.Info("Dynamic port management disabled")
     }
 
+    // Feature flags narrow the capabilities offered to each user
+    if err := s.initializeFeatureFlags(group); err != nil {
+        return fmt.Errorf("invalid feature flag overrides: %w", err)
+    }
+
+    if err := group.Wait(); err != nil {
+        return fmt.Errorf("failed to start: %w", err)
+    }
+
+    if err := s.initializeProxyProtocol(); err != nil {
+        return fmt.Errorf("invalid PROXY protocol configuration: %w", err)
+    }
+
+    if portClient != nil {
+        s.startDynamicPorts(portClient, portConfigs)
+    }
+
     // Initialize TCP and UDP proxies
     if err := s.initializeTCPProxy(); err != nil {
         return fmt.Errorf("failed to initialize TCP proxy: %w", err)
@@ -305,13 +1011,425 @@ func (s *ProxyServer) Initialize() error {
     if err := s.initializeUDPProxy(); err != nil {
         return fmt.Errorf("failed to initialize UDP proxy: %w", err)  
     }
+    
+    if viper.GetBool("server.socks_enabled") {
+        if err := s.initializeSOCKSProxy(); err != nil {
+            return fmt.Errorf("failed to initialize SOCKS5 proxy: %w", err)
+        }
+    }
+
+    // Answer the DNS queries of tunnel clients
+    if viper.GetBool("dns.enabled") {
+        if err := s.initializeDNSProxy(); err != nil {
+            return fmt.Errorf("failed to initialize DNS server: %w", err)
+        }
+    }
+
+    // Initialize synthetic probes once the listeners they check exist
+    if viper.GetBool("probes.enabled") {
+        if err := s.initializeProber(); err != nil {
+            return fmt.Errorf("failed to initialize synthetic probes: %w", err)
+        }
+    }
+
+    // Hand clients over to a peer headend during planned maintenance
+    if viper.GetBool("migration.enabled") {
+        store := migration.NewManagerStore(
+            viper.GetString("migration.manager_url"),
+            viper.GetString("migration.auth_token"),
+        )
+        s.migration = migration.NewCoordinator(store, s.rateLimiter, viper.GetDuration("migration.ticket_ttl"))
+        log.Info("Session migration enabled")
+    }
+
+    // Advertise capabilities only after every subsystem is initialized
+    s.localCaps = s.buildLocalCapabilities()
+
+    // Replicate peers and sessions to a warm standby sharing our virtual IP
+    if viper.GetBool("ha.enabled") {
+        if err := s.initializeHA(); err != nil {
+            return fmt.Errorf("failed to initialize HA pair: %w", err)
+        }
+    }
+
+    // Let clients with recently expired certificates reach the Manager to
+    // renew, and nothing else
+    if viper.GetBool("server.mtls.enabled") && viper.GetDuration("server.mtls.expired_grace_period") > 0 {
+        if err := s.initializeCertGrace(); err != nil {
+            return fmt.Errorf("failed to initialize certificate grace period: %w", err)
+        }
+    }
 
     // Setup HTTP routes
     s.setupRoutes()
 
+    // Announce the headend once everything it advertises exists
+    if viper.GetBool("registration.enabled") {
+        if err := s.initializeRegistration(); err != nil {
+            return fmt.Errorf("failed to initialize registration: %w", err)
+        }
+    }
+
+    return nil
+}
+
+// initializeCertGrace sets up verification of client certificates with an
+// expiry grace period. Clients in it are confined to the remediation targets.
+func (s *ProxyServer) initializeCertGrace() error {
+    if s.firewallManager == nil {
+        return fmt.Errorf("the expired certificate grace period requires the firewall to be enabled")
+    }
+
+    clientCAs, err := auth.LoadClientCAPool(viper.GetString("server.mtls.client_ca_file"))
+    if err != nil {
+        return fmt.Errorf("failed to load mTLS client CA: %w", err)
+    }
+
+    grace := viper.GetDuration("server.mtls.expired_grace_period")
+    s.certVerifier = auth.NewCertVerifier(clientCAs, grace)
+    log.Infof("Expired client certificates accepted for %s with access limited to remediation targets", grace)
+    return nil
+}
+
+// remediationTargets returns the targets users confined by the firewall
+// can still reach, by default the Manager so they can renew and recover
+func remediationTargets() ([]string, error) {
+    targets := viper.GetStringSlice("firewall.remediation_targets")
+    if len(targets) > 0 {
+        return targets, nil
+    }
+    managerURL, err := url.Parse(viper.GetString("auth.manager_url"))
+    if err != nil || managerURL.Hostname() == "" {
+        return nil, fmt.Errorf("failed to derive remediation targets from auth.manager_url")
+    }
+    return []string{managerURL.Hostname()}, nil
+}
+
+// restrictExpiredCertificate confines users presenting an expired client
+// certificate to the remediation profile, and releases them once they
+// present a renewed one
+func (s *ProxyServer) restrictExpiredCertificate(user *auth.User, cert *x509.Certificate, expired bool) {
+    if !expired {
+        s.firewallManager.Unrestrict(user.ID)
+        return
+    }
+    s.firewallManager.Restrict(user.ID, "expired_certificate")
+}
+
+// initializeHA joins this headend to a warm standby pair. Keepalived owns
+// the virtual IP and reports its VRRP state through /ha/transition.
+func (s *ProxyServer) initializeHA() error {
+    client, err := wgctrl.New()
+    if err != nil {
+        return fmt.Errorf("failed to open WireGuard control client: %w", err)
+    }
+
+    s.haPair, err = ha.NewPair(ha.Config{
+        Interface:    viper.GetString("wireguard.interface"),
+        PeerURL:      viper.GetString("ha.peer_url"),
+        Token:        viper.GetString("ha.token"),
+        SyncInterval: viper.GetDuration("ha.sync_interval"),
+        OnMaster:     viper.GetString("ha.on_master"),
+        OnBackup:     viper.GetString("ha.on_backup"),
+        OnPeersApplied: s.invalidatePeers,
+    }, client, s.sessionCaps)
+    if err != nil {
+        _ = client.Close()
+        return err
+    }
+
+    s.haPair.Start()
+    log.Infof("HA pair enabled with peer %s", viper.GetString("ha.peer_url"))
+    return nil
+}
+
+// initializeEgressRoutes installs the routing tables of the egress routes
+// and has upstream sockets marked for them
+func (s *ProxyServer) initializeEgressRoutes() error {
+    var routes []routing.Route
+    if err := viper.UnmarshalKey("routing.egress", &routes); err != nil {
+        return fmt.Errorf("failed to parse egress routes: %w", err)
+    }
+    if len(routes) == 0 {
+        return nil
+    }
+
+    table, err := routing.New(routes)
+    if err != nil {
+        return fmt.Errorf("invalid routing configuration: %w", err)
+    }
+    // Routes whose interface isn't up yet are reported in the health output
+    if err := table.Install(); err != nil {
+        log.Warnf("Failed to install egress routes: %v", err)
+    }
+    s.egressRoutes = table
+    connctx.SetMarkSelector(table.MarkFor)
+    if s.wgRouter != nil {
+        s.wgRouter.egressRoutes = table
+    }
+    log.Infof("Policy-based routing enabled with %d egress routes", table.Len())
+    return nil
+}
+
+// invalidatePeers makes the WireGuard router reread the peers after they
+// were replaced
+func (s *ProxyServer) invalidatePeers() {
+    if s.wgRouter != nil {
+        s.wgRouter.peers.Invalidate()
+    }
+}
+
+// initializeMesh joins this headend to the mesh of headends that sessions
+// fail over to when its own upstream connectivity fails
+func (s *ProxyServer) initializeMesh() error {
+    var peers []mesh.Peer
+    if err := viper.UnmarshalKey("mesh.peers", &peers); err != nil {
+        return fmt.Errorf("failed to parse mesh peers: %w", err)
+    }
+
+    var err error
+    s.mesh, err = mesh.New(mesh.Config{
+        ID:                headendID(),
+        URL:               viper.GetString("mesh.advertise_url"),
+        Region:            viper.GetString("mesh.region"),
+        Token:             viper.GetString("mesh.token"),
+        ManagerURL:        viper.GetString("mesh.manager_url"),
+        AuthToken:         viper.GetString("mesh.auth_token"),
+        ClusterID:         viper.GetString("ports.cluster_id"),
+        Peers:             peers,
+        HeartbeatInterval: viper.GetDuration("mesh.heartbeat_interval"),
+        PeerListInterval:  viper.GetDuration("mesh.peer_list_interval"),
+        MaxLocalFailures:  viper.GetInt("mesh.max_local_failures"),
+        RetryLocal:        viper.GetDuration("mesh.retry_local"),
+        // Upstream probes, once enabled, tell us before sessions fail
+        LocalHealth: func() (bool, bool) {
+            return s.prober.Healthy(probe.ScopeUpstream), s.sessions.Draining()
+        },
+    })
+    if err != nil {
+        return err
+    }
+    if s.wgRouter != nil {
+        s.wgRouter.mesh = s.mesh
+    }
+
+    s.mesh.Start()
+    log.Infof("Headend mesh enabled as %s", headendID())
+    return nil
+}
+
+// initializePrewarm keeps the most accessed upstream hosts resolved, and TLS
+// sessions with the reverse-proxied ones cached, so the first request after
+// a quiet period doesn't pay for DNS and a full handshake
+func (s *ProxyServer) initializePrewarm() {
+    s.prewarmer = prewarm.New(prewarm.Config{
+        Targets:    viper.GetInt("proxy.prewarm.targets"),
+        Interval:   viper.GetDuration("proxy.prewarm.interval"),
+        HalfLife:   viper.GetDuration("proxy.prewarm.half_life"),
+        MinHits:    viper.GetFloat64("proxy.prewarm.min_hits"),
+        AddressTTL: viper.GetDuration("proxy.prewarm.address_ttl"),
+    }, s.transports)
+    connctx.SetAddressCache(s.prewarmer)
+    s.prewarmer.Start()
+
+    if viper.GetInt("proxy.transport.tls_session_cache_size") <= 0 {
+        log.Warn("Upstream TLS sessions aren't pre-warmed without proxy.transport.tls_session_cache_size")
+    }
+    log.Infof("Pre-warming the %d most accessed upstream hosts every %s", viper.GetInt("proxy.prewarm.targets"), viper.GetDuration("proxy.prewarm.interval"))
+}
+
+// initializeBalancer spreads sessions to logical targets, configured here
+// or sent by the Manager with the firewall rules, over their backends by
+// least connections, ejecting backends that keep failing
+func (s *ProxyServer) initializeBalancer() {
+    s.balancer = upstream.NewBalancer(upstream.BalancerConfig{
+        MaxFailures:   viper.GetInt("proxy.upstreams.max_failures"),
+        EjectDuration: viper.GetDuration("proxy.upstreams.eject_duration"),
+        Groups:        viper.GetStringMapStringSlice("proxy.upstreams.groups"),
+    })
+    if s.wgRouter != nil {
+        s.wgRouter.balancer = s.balancer
+    }
+    if groups := s.balancer.Status(); len(groups) > 0 {
+        log.Infof("Balancing %d logical upstream targets by least connections", len(groups))
+    }
+}
+
+// initializeUpstreamPool keeps connections to busy TCP proxy targets
+// dialed ahead of use, for the TCP proxy and the WireGuard router
+func (s *ProxyServer) initializeUpstreamPool() {
+    s.upstreamPool = upstream.New(upstream.Config{
+        MaxIdle:        viper.GetInt("proxy.upstream_pool.max_idle"),
+        MaxLifetime:    viper.GetDuration("proxy.upstream_pool.max_lifetime"),
+        HealthInterval: viper.GetDuration("proxy.upstream_pool.health_interval"),
+        MinDials:       viper.GetInt("proxy.upstream_pool.min_dials"),
+        DemandWindow:   viper.GetDuration("proxy.upstream_pool.demand_window"),
+        MaxTargets:     viper.GetInt("proxy.upstream_pool.max_targets"),
+        Targets:        viper.GetStringSlice("proxy.upstream_pool.targets"),
+    })
+    s.upstreamPool.Start()
+    if s.wgRouter != nil {
+        s.wgRouter.upstreamPool = s.upstreamPool
+    }
+    log.Infof("Pooling connections to TCP proxy targets dialed %d times within %s", viper.GetInt("proxy.upstream_pool.min_dials"), viper.GetDuration("proxy.upstream_pool.demand_window"))
+}
+
+// initializeACME obtains the server certificate from the ACME server, or
+// reuses the stored one, and keeps it renewed. HTTP-01 challenges are
+// answered on acme.http_address, which must be reachable on port 80 at
+// every domain.
+func (s *ProxyServer) initializeACME() error {
+    var err error
+    s.acmeManager, err = acme.New(acme.Config{
+        Domains:       viper.GetStringSlice("acme.domains"),
+        Email:         viper.GetString("acme.email"),
+        DirectoryURL:  viper.GetString("acme.directory_url"),
+        Challenge:     viper.GetString("acme.challenge"),
+        StorageDir:    viper.GetString("acme.storage_dir"),
+        RenewBefore:   viper.GetDuration("acme.renew_before"),
+        CheckInterval: viper.GetDuration("acme.check_interval"),
+        DNSHook:       viper.GetString("acme.dns_hook"),
+        DNSWait:       viper.GetDuration("acme.dns_wait"),
+        // The watcher would notice too, but not if cert_watch is off
+        OnRenew: func() {
+            if s.certificates != nil {
+                _ = s.certificates.Reload()
+            }
+        },
+    })
+    if err != nil {
+        return err
+    }
+
+    if viper.GetString("acme.challenge") != acme.ChallengeDNS01 {
+        s.acmeServer = &http.Server{
+            Addr:              viper.GetString("acme.http_address"),
+            Handler:           s.acmeManager.HTTPHandler(nil),
+            ReadHeaderTimeout: 10 * time.Second,
+        }
+        go func() {
+            if err := s.acmeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Errorf("ACME challenge server error: %v", err)
+            }
+        }()
+    }
+
+    // A stored certificate that failed to renew is still served until it
+    // expires; without one the headend has nothing to serve
+    if err := s.acmeManager.EnsureCertificate(context.Background()); err != nil {
+        if _, statErr := os.Stat(s.acmeManager.CertFile()); statErr != nil {
+            return fmt.Errorf("failed to obtain ACME certificate: %w", err)
+        }
+        log.Errorf("ACME certificate renewal failed, serving the stored certificate: %v", err)
+    }
+    s.acmeManager.Start()
+    log.Infof("ACME certificate management enabled for %s", strings.Join(viper.GetStringSlice("acme.domains"), ", "))
+    return nil
+}
+
+// initializeProber starts synthetic checks of the configured upstream
+// targets, plus checks of the headend's own listeners so dashboards can
+// tell a broken headend from a broken upstream
+func (s *ProxyServer) initializeProber() error {
+    var checks []probe.Check
+    if err := viper.UnmarshalKey("probes.checks", &checks); err != nil {
+        return fmt.Errorf("failed to parse probe checks: %w", err)
+    }
+
+    prober, err := probe.NewProber(checks, s.transports.ForTarget)
+    if err != nil {
+        return err
+    }
+
+    if viper.GetBool("probes.headend_checks") {
+        listeners := map[string]string{
+            "headend-http": viper.GetString("server.http_port"),
+            "headend-tcp":  viper.GetString("server.tcp_port"),
+        }
+        if s.socksProxy != nil {
+            listeners["headend-socks"] = viper.GetString("server.socks_port")
+        }
+        for name, port := range listeners {
+            if err := prober.AddHeadendCheck(name, probe.TypeTCP, net.JoinHostPort("127.0.0.1", port)); err != nil {
+                return err
+            }
+        }
+    }
+
+    s.prober = prober
+    s.prober.Start()
     return nil
 }
 
+// initEventBus creates the event bus and subscribes the configured sinks
+func (s *ProxyServer) initEventBus() {
+    s.eventBus = events.NewBus(viper.GetInt("events.buffer_size"))
+    s.eventBus.Subscribe(events.NewMetricsSink())
+    
+    if s.syslogLogger != nil {
+        s.eventBus.Subscribe(events.NewPseudonymizingSink(events.NewSyslogSink(s.syslogLogger), s.logPseudonyms), events.TypeVerdict)
+    }
+    
+    if s.accessLog != nil {
+        s.eventBus.Subscribe(events.NewPseudonymizingSink(events.NewAccessLogSink(s.accessLog), s.logPseudonyms), events.TypeVerdict)
+    }
+    
+    if webhookURL := viper.GetString("events.webhook_url"); webhookURL != "" {
+        flushInterval, err := time.ParseDuration(viper.GetString("events.webhook_flush_interval"))
+        if err != nil {
+            flushInterval = 10 * time.Second
+        }
+        webhookSink := events.NewWebhookSink(
+            webhookURL,
+            viper.GetString("events.webhook_token"),
+            viper.GetInt("events.webhook_batch_size"),
+            flushInterval,
+        )
+        s.eventBus.Subscribe(events.NewPseudonymizingSink(webhookSink, s.logPseudonyms))
+        log.Infof("Event webhook enabled - posting to %s", webhookURL)
+    }
+    
+    if viper.GetBool("decisions.enabled") {
+        flushInterval, err := time.ParseDuration(viper.GetString("decisions.flush_interval"))
+        if err != nil {
+            flushInterval = 60 * time.Second
+        }
+        s.eventBus.Subscribe(events.NewDecisionSink(
+            viper.GetString("firewall.manager_url"),
+            viper.GetString("firewall.auth_token"),
+            headendID(),
+            viper.GetInt("decisions.max_series"),
+            flushInterval,
+        ), events.TypeVerdict)
+        log.Infof("Policy decision reporting enabled - flushing every %s", flushInterval)
+    }
+    
+    // Flows flagged through the admin API finish with their verdict
+    if viper.GetBool("admin.enabled") && viper.GetString("admin.auth_token") != "" {
+        s.flowTraces = flowtrace.NewRecorder(viper.GetInt("admin.trace_retention"))
+        connctx.SetFlowRecorder(s.flowTraces)
+        s.eventBus.Subscribe(s.flowTraces, events.TypeVerdict)
+    }
+    
+    if viper.GetBool("telemetry.enabled") {
+        endpoint := viper.GetString("telemetry.endpoint")
+        if endpoint == "" {
+            log.Warn("Telemetry enabled without telemetry.endpoint, not reporting")
+            return
+        }
+        s.telemetry = telemetry.New(telemetry.Config{
+            Endpoint:   endpoint,
+            Interval:   viper.GetDuration("telemetry.interval"),
+            MinCount:   viper.GetInt("telemetry.min_count"),
+            IDRotation: viper.GetDuration("telemetry.id_rotation"),
+            Features:   s.enabledFeatures,
+            Scale:      s.telemetryScale,
+        })
+        s.eventBus.Subscribe(s.telemetry, events.TypeVerdict)
+        log.Infof("Anonymous telemetry enabled - reporting to %s", endpoint)
+    }
+}
+
 func (s *ProxyServer) setupRoutes() {
     gin.SetMode(gin.ReleaseMode)
     s.router = gin.New()
@@ -324,6 +1442,17 @@ func (s *ProxyServer) setupRoutes() {
     // Health check endpoints
     s.router.GET("/health", s.healthHandler)
     s.router.GET("/healthz", s.healthzHandler)
+    s.router.GET("/readyz", s.readyzHandler)
+    s.router.GET("/version", s.versionHandler)
+
+    // With mTLS, authenticated routes also require a client certificate
+    // bound to the same identity as the token
+    requireAuth := middleware.AuthRequired(s.authProvider)
+    if s.certVerifier != nil {
+        requireAuth = middleware.DualAuthWithGrace(s.authProvider, s.certVerifier, s.restrictExpiredCertificate)
+    } else if viper.GetBool("server.mtls.enabled") {
+        requireAuth = middleware.DualAuthRequired(s.authProvider)
+    }
 
     // Auth endpoints
     authGroup := s.router.Group("/auth")
@@ -331,24 +1460,93 @@ func (s *ProxyServer) setupRoutes() {
         authGroup.POST("/login", s.authProvider.LoginHandler())
         authGroup.GET("/callback", s.authProvider.CallbackHandler())
         authGroup.POST("/logout", s.authProvider.LogoutHandler())
-        authGroup.GET("/userinfo", middleware.AuthRequired(s.authProvider), s.userInfoHandler)
+        authGroup.GET("/userinfo", requireAuth, s.userInfoHandler)
+        if device, ok := s.authProvider.(auth.DeviceAuthorizer); ok {
+            authGroup.POST("/device", device.DeviceAuthHandler())
+            authGroup.POST("/device/token", device.DeviceTokenHandler())
+        }
+    }
+
+    // Session establishment endpoints
+    sessionGroup := s.router.Group("/session")
+    sessionGroup.Use(requireAuth)
+    {
+        sessionGroup.POST("/negotiate", s.negotiateHandler)
+        sessionGroup.GET("/policy", s.localPolicyHandler)
+        sessionGroup.GET("/access", s.accessSummaryHandler)
+        sessionGroup.GET("/control", s.controlHandler)
+        sessionGroup.GET("/quarantine", s.quarantineHandler)
+        sessionGroup.POST("/migrate", s.migrateHandler)
     }
 
     // Proxy endpoints (require authentication)
     proxyGroup := s.router.Group("/proxy")
-    proxyGroup.Use(middleware.AuthRequired(s.authProvider))
+    proxyGroup.Use(requireAuth)
     {
         proxyGroup.Any("/*path", s.proxyHandler)
     }
 
-    // Metrics endpoint with authentication
-    go func() {
-        metricsPort := viper.GetString("server.metrics_port")
-        metricsRouter := gin.New()
-        metricsRouter.Use(gin.Recovery())
-        
-        // Authenticated metrics endpoint
-        metricsRouter.GET("/metrics", s.metricsHandler)
+    // HA pair endpoints, authenticated with the pair's shared token
+    if s.haPair != nil {
+        haGroup := s.router.Group("/ha")
+        haGroup.Use(s.haAuthRequired)
+        {
+            haGroup.POST("/transition", s.haTransitionHandler)
+            haGroup.GET("/snapshot", s.haSnapshotHandler)
+        }
+    }
+
+    // Mesh endpoints, authenticated with the mesh's shared token
+    if s.mesh != nil {
+        meshGroup := s.router.Group("/mesh/v1")
+        meshGroup.Use(s.meshAuthRequired)
+        {
+            meshGroup.POST("/health", s.meshHealthHandler)
+            meshGroup.GET("/relay", s.meshRelayHandler)
+        }
+    }
+
+    // Admin API, authenticated with the admin token
+    if viper.GetBool("admin.enabled") {
+        if viper.GetString("admin.auth_token") == "" {
+            log.Warn("Admin API enabled without admin.auth_token, not serving it")
+        } else {
+            adminGroup := s.router.Group("/admin")
+            adminGroup.Use(s.adminAuthRequired)
+            {
+                adminGroup.GET("/sessions", s.adminSessionsHandler)
+                adminGroup.DELETE("/sessions", s.adminKillUserSessionsHandler)
+                adminGroup.DELETE("/sessions/:id", s.adminKillSessionHandler)
+                adminGroup.GET("/ports", s.adminPortsHandler)
+                adminGroup.GET("/firewall", s.adminFirewallHandler)
+                adminGroup.POST("/firewall/refresh", s.adminFirewallRefreshHandler)
+                adminGroup.GET("/firewall/blocks", s.adminFirewallBlocksHandler)
+                adminGroup.DELETE("/firewall/blocks", s.adminFirewallUnblockHandler)
+                adminGroup.GET("/mirror", s.adminMirrorHandler)
+                adminGroup.GET("/wireguard", s.adminWireGuardHandler)
+                adminGroup.GET("/wireguard/sessions", s.adminPeerSessionsHandler)
+                adminGroup.POST("/drain", s.adminDrainHandler)
+                adminGroup.GET("/telemetry", s.adminTelemetryHandler)
+                adminGroup.POST("/traces", s.adminArmTraceHandler)
+                adminGroup.GET("/traces", s.adminTracesHandler)
+                adminGroup.GET("/traces/:id", s.adminTraceHandler)
+                adminGroup.DELETE("/traces/:id", s.adminDeleteTraceHandler)
+            }
+            log.Info("Admin API enabled at /admin")
+        }
+    }
+
+    // CONNECT tunnels, dispatched here by routeRequest
+    s.router.Handle(http.MethodConnect, connectRoutePath, requireAuth, s.connectHandler)
+
+    // Metrics endpoint with authentication
+    go func() {
+        metricsPort := viper.GetString("server.metrics_port")
+        metricsRouter := gin.New()
+        metricsRouter.Use(gin.Recovery())
+        
+        // Authenticated metrics endpoint
+        metricsRouter.GET("/metrics", s.metricsHandler)
         
         log.Infof("Metrics server listening on :%s", metricsPort)
         if err := http.ListenAndServe(":"+metricsPort, metricsRouter); err != nil {
@@ -368,18 +1566,84 @@ func (s *ProxyServer) healthHandler(c *gin.Context) {
         portListenerCount = s.portManager.GetListenerCount()
     }
     
+    udpFlows := 0
+    if s.udpProxy != nil {
+        udpFlows += s.udpProxy.flows.Len()
+    }
+    if s.dynamicUDP != nil {
+        udpFlows += s.dynamicUDP.flows.Len()
+    }
+    
+    mirrorQueueDepth := 0
+    if s.mirrorManager != nil {
+        mirrorQueueDepth = s.mirrorManager.QueueDepth()
+    }
+    
+    policyVersion := ""
+    var policyMode firewall.PolicyMode
+    var policyRollouts []firewall.RolloutStatus
+    restrictedUsers := 0
+    quarantinedUsers := 0
+    if s.firewallManager != nil {
+        policyVersion = s.firewallManager.GetPolicyVersion()
+        policyMode = s.firewallManager.PolicyMode()
+        policyRollouts = s.firewallManager.GetRollouts()
+        restrictedUsers = s.firewallManager.RestrictedUsers()
+        quarantinedUsers = s.firewallManager.QuarantinedUsers()
+    }
+    
     c.JSON(http.StatusOK, gin.H{
         "status": "healthy",
         "service": "headend-proxy",
+        "build_profile": buildProfile,
         "mirror_enabled": s.mirrorManager != nil,
+        "mirror_queue_depth": mirrorQueueDepth,
         "firewall_enabled": s.firewallManager != nil,
+        "suricata_alerts_enabled": s.alertListener != nil,
+        "policy_version": policyVersion,
+        "policy_mode": policyMode,
+        "policy_rollouts": policyRollouts,
         "syslog_enabled": s.syslogLogger != nil && s.syslogLogger.IsEnabled(),
         "syslog_queue_depth": syslogQueueDepth,
+        "access_log_enabled": s.accessLog != nil,
+        "tracing_enabled": s.tracer != nil,
         "dynamic_ports_enabled": s.portManager != nil,
         "port_listeners_count": portListenerCount,
+        "negotiated_sessions": s.sessionCaps.Count(),
+        "feature_flags_version": s.featureFlags.Version(),
+        "feature_flags": s.featureFlags.Evaluate(s.featureFlags.Subject(headendID())),
         "auth_provider": s.authProvider != nil,
         "tcp_proxy": s.tcpProxy != nil,
         "udp_proxy": s.udpProxy != nil,
+        "udp_flows": udpFlows,
+        "socks_proxy": s.socksProxy != nil,
+        "mtls_enabled": viper.GetBool("server.mtls.enabled"),
+        "tls_certificate": s.certificates.Status(),
+        "acme": s.acmeManager.Status(),
+        "quic_enabled": s.quicServer != nil,
+        "restricted_users": restrictedUsers,
+        "quarantined_users": quarantinedUsers,
+        "transport_classes": s.transports.Classes(),
+        "prewarm": s.prewarmer.Status(),
+        "upstream_pool": s.upstreamPool.Status(),
+        "upstream_balancer": s.balancer.Status(),
+        "log_pseudonym": s.logPseudonyms.Status(),
+        "ratelimit_enabled": s.rateLimiter != nil,
+        "ratelimit_version": s.rateLimiter.Version(),
+        "egress_enabled": s.egress != nil,
+        "egress": s.egress.Status(),
+        "tcp_session_limits": s.connLimits.Status(),
+        "probes_enabled": s.prober != nil,
+        "probes_headend_healthy": s.prober.Healthy(probe.ScopeHeadend),
+        "probes_upstream_healthy": s.prober.Healthy(probe.ScopeUpstream),
+        "probes": s.prober.Results(),
+        "wireguard": s.wgMonitor.Status(),
+        "egress_routes": s.egressRoutes.Status(),
+        "drain": s.sessions.Status(),
+        "migration": s.migration.Status(),
+        "ha": s.haPair.Status(),
+        "mesh": s.mesh.Status(),
+        "registration": s.registration.Status(),
     })
 }
 
@@ -392,6 +1656,13 @@ func (s *ProxyServer) healthzHandler(c *gin.Context) {
         healthy = false
     }
     
+    // A draining headend fails its health check so load balancers stop
+    // sending it new clients, and reports how far the drain has got
+    if s.sessions.Draining() {
+        c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining", "drain": s.sessions.Status()})
+        return
+    }
+    
     if healthy {
         c.JSON(http.StatusOK, gin.H{"status": "ok"})
     } else {
@@ -399,6 +1670,34 @@ func (s *ProxyServer) healthzHandler(c *gin.Context) {
     }
 }
 
+// readyzHandler reports whether the headend is ready for clients, with the
+// startup state of each subsystem. Optional subsystems that failed to start
+// are listed but don't make the headend unready.
+func (s *ProxyServer) readyzHandler(c *gin.Context) {
+    status := "ready"
+    if !s.readiness.Ready() {
+        status = "not_ready"
+    }
+    if s.sessions.Draining() {
+        status = "draining"
+    }
+    
+    code := http.StatusOK
+    if status != "ready" {
+        code = http.StatusServiceUnavailable
+    }
+    c.JSON(code, gin.H{"status": status, "components": s.readiness.Components()})
+}
+
+// startupTimeout is how long the named subsystem may take to start, from
+// startup.timeouts.<name> or else startup.timeout
+func startupTimeout(name string) time.Duration {
+    if key := "startup.timeouts." + name; viper.IsSet(key) {
+        return viper.GetDuration(key)
+    }
+    return viper.GetDuration("startup.timeout")
+}
+
 func (s *ProxyServer) metricsHandler(c *gin.Context) {
     // Check authentication for metrics endpoint
     authHeader := c.GetHeader("Authorization")
@@ -439,8 +1738,292 @@ func (s *ProxyServer) metricsHandler(c *gin.Context) {
     c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication"})
 }
 
+// buildLocalCapabilities describes what this headend supports, minus any
+// features disabled in configuration for staged rollouts
+func (s *ProxyServer) buildLocalCapabilities() capabilities.Set {
+    local := capabilities.Set{
+        ProtocolVersions: []int{capabilities.ProtocolV2, capabilities.ProtocolV1},
+        Compression:      []string{capabilities.CompressionNone},
+        Transports: []string{
+            capabilities.TransportWireGuard,
+            capabilities.TransportTCP,
+            capabilities.TransportUDP,
+            capabilities.TransportHTTPS,
+        },
+        Features: []string{},
+    }
+    
+    if s.portManager != nil {
+        local.Features = append(local.Features, capabilities.FeatureDynamicPorts)
+    }
+    
+    if s.firewallManager != nil {
+        local.Features = append(local.Features, capabilities.FeatureLocalPolicy, capabilities.FeatureQuarantine,
+            capabilities.FeatureDenialFrames)
+    }
+    
+    if s.migration != nil {
+        local.Features = append(local.Features, capabilities.FeatureMigration)
+    }
+    
+    if s.dnsProxy != nil {
+        local.Features = append(local.Features, capabilities.FeatureDNSProxy)
+    }
+    
+    disabled := viper.GetStringSlice("capabilities.disabled_features")
+    enabled := local.Features[:0]
+    for _, feature := range local.Features {
+        keep := true
+        for _, d := range disabled {
+            if d == feature {
+                keep = false
+                break
+            }
+        }
+        if keep {
+            enabled = append(enabled, feature)
+        }
+    }
+    local.Features = enabled
+    
+    return local
+}
+
+// negotiateHandler agrees on session capabilities with a client. Clients
+// that never call it are treated as capabilities.Baseline().
+func (s *ProxyServer) negotiateHandler(c *gin.Context) {
+    user := c.MustGet("user").(*auth.User)
+    
+    var remote capabilities.Set
+    if err := c.ShouldBindJSON(&remote); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid capability set"})
+        return
+    }
+    
+    local := s.capabilitiesFor(user)
+    negotiated, err := capabilities.Negotiate(local, remote)
+    if err != nil {
+        log.Warnf("Capability negotiation failed for user %s: %v", user.ID, err)
+        c.JSON(http.StatusConflict, gin.H{
+            "error":        err.Error(),
+            "capabilities": local,
+        })
+        return
+    }
+    
+    s.sessionCaps.Set(user.ID, negotiated)
+    log.Infof("Negotiated protocol v%d with features %v for user %s",
+        negotiated.ProtocolVersion, negotiated.Features, user.ID)
+    
+    c.JSON(http.StatusOK, gin.H{
+        "negotiated":   negotiated,
+        "capabilities": local,
+    })
+}
+
+// localPolicyHandler returns the deny rules a client may enforce locally to
+// fail fast. The headend still evaluates every flow it receives.
+func (s *ProxyServer) localPolicyHandler(c *gin.Context) {
+    user := c.MustGet("user").(*auth.User)
+    
+    if s.firewallManager == nil || !s.sessionCaps.Get(user.ID).Has(capabilities.FeatureLocalPolicy) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Local policy not available for this session"})
+        return
+    }
+    
+    c.JSON(http.StatusOK, gin.H{
+        "policy":      s.firewallManager.GetLocalPolicy(user.ID, user.Groups),
+        "ttl_seconds": int(viper.GetDuration("firewall.local_policy_ttl").Seconds()),
+    })
+}
+
+// accessSummaryHandler shows users what their effective policy lets them
+// reach, so clients can answer "what can I access?" without a support call
+func (s *ProxyServer) accessSummaryHandler(c *gin.Context) {
+    user := c.MustGet("user").(*auth.User)
+    
+    if s.firewallManager == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Firewall policy not enabled on this headend"})
+        return
+    }
+    
+    c.JSON(http.StatusOK, s.firewallManager.Summary(user.ID, user.Groups))
+}
+
+// quarantineHandler tells clients whether they are quarantined, so they can
+// show the user why most of the network is unreachable and move to their
+// quarantine address
+func (s *ProxyServer) quarantineHandler(c *gin.Context) {
+    user := c.MustGet("user").(*auth.User)
+    
+    if s.firewallManager == nil || !s.sessionCaps.Get(user.ID).Has(capabilities.FeatureQuarantine) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Quarantine status not available for this session"})
+        return
+    }
+    
+    quarantine, quarantined := s.firewallManager.Quarantine(user.ID)
+    if !quarantined {
+        c.JSON(http.StatusOK, gin.H{"quarantined": false})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "quarantined": true,
+        "quarantine":  quarantine,
+    })
+}
+
+// controlHandler is the control channel clients that negotiated migration
+// poll. It tells them when to move to a peer headend.
+func (s *ProxyServer) controlHandler(c *gin.Context) {
+    user := c.MustGet("user").(*auth.User)
+    
+    if !s.sessionCaps.Get(user.ID).Has(capabilities.FeatureMigration) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Control channel not available for this session"})
+        return
+    }
+    
+    directive, err := s.migration.Directive(c.Request.Context(), user.ID)
+    if err != nil {
+        log.Errorf("Failed to issue migration directive for user %s: %v", user.ID, err)
+        c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Migration unavailable"})
+        return
+    }
+    if directive.Action == migration.ActionMigrate {
+        log.Infof("Directing user %s to peer headend %s", user.ID, directive.Peer.URL)
+    }
+    
+    c.JSON(http.StatusOK, directive)
+}
+
+// migrateHandler accepts a client moving here from a draining headend. It
+// restores the state carried by the client's ticket and negotiates the
+// session in one step so the client can cut over immediately.
+func (s *ProxyServer) migrateHandler(c *gin.Context) {
+    user := c.MustGet("user").(*auth.User)
+    
+    var req struct {
+        Ticket       string           `json:"ticket"`
+        Capabilities capabilities.Set `json:"capabilities"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil || req.Ticket == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid migration request"})
+        return
+    }
+    
+    if s.migration == nil || s.sessions.Draining() {
+        c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Headend is not accepting migrations"})
+        return
+    }
+    
+    if _, err := s.migration.Redeem(c.Request.Context(), user.ID, req.Ticket); err != nil {
+        log.Warnf("Migration ticket rejected for user %s: %v", user.ID, err)
+        status := http.StatusForbidden
+        if errors.Is(err, migration.ErrTicketNotFound) {
+            status = http.StatusNotFound
+        }
+        c.JSON(status, gin.H{"error": err.Error()})
+        return
+    }
+    
+    local := s.capabilitiesFor(user)
+    negotiated, err := capabilities.Negotiate(local, req.Capabilities)
+    if err != nil {
+        c.JSON(http.StatusConflict, gin.H{
+            "error":        err.Error(),
+            "capabilities": local,
+        })
+        return
+    }
+    s.sessionCaps.Set(user.ID, negotiated)
+    log.Infof("User %s migrated from a peer headend", user.ID)
+    
+    c.JSON(http.StatusOK, gin.H{
+        "negotiated":   negotiated,
+        "capabilities": local,
+    })
+}
+
+// haAuthRequired admits only the other headend of the pair and the local
+// keepalived notify hook
+func (s *ProxyServer) haAuthRequired(c *gin.Context) {
+    token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+    if !s.haPair.Authorized(token) {
+        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid HA token"})
+        return
+    }
+    c.Next()
+}
+
+// meshAuthRequired admits only headends of the mesh
+func (s *ProxyServer) meshAuthRequired(c *gin.Context) {
+    token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+    if !s.mesh.Authorized(token) {
+        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid mesh token"})
+        return
+    }
+    c.Next()
+}
+
+// meshHealthHandler exchanges health with a peer headend
+func (s *ProxyServer) meshHealthHandler(c *gin.Context) {
+    var health mesh.Health
+    if err := c.ShouldBindJSON(&health); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid health report"})
+        return
+    }
+
+    local, err := s.mesh.Exchange(health)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusOK, local)
+}
+
+// meshRelayHandler tunnels a peer's session to its target. Relayed
+// sessions were already authorized by the peer's firewall, and are dialed
+// only locally so they never bounce on to another peer.
+func (s *ProxyServer) meshRelayHandler(c *gin.Context) {
+    s.mesh.ServeRelay(c.Writer, c.Request, func(ctx context.Context, address string) (net.Conn, error) {
+        return s.balancer.Dial(ctx, address, func(ctx context.Context, address string) (net.Conn, error) {
+            return connctx.Dial(ctx, "tcp", address)
+        })
+    })
+}
+
+// haTransitionHandler receives VRRP state changes from keepalived
+func (s *ProxyServer) haTransitionHandler(c *gin.Context) {
+    var req struct {
+        State string `json:"state" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transition request"})
+        return
+    }
+
+    if err := s.haPair.Transition(req.State); err != nil {
+        log.Errorf("HA transition to %s failed: %v", req.State, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, s.haPair.Status())
+}
+
+// haSnapshotHandler serves the state the standby replicates
+func (s *ProxyServer) haSnapshotHandler(c *gin.Context) {
+    snapshot, err := s.haPair.Snapshot()
+    if err != nil {
+        log.Errorf("Failed to take HA snapshot: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to take snapshot"})
+        return
+    }
+
+    c.JSON(http.StatusOK, snapshot)
+}
+
 func (s *ProxyServer) userInfoHandler(c *gin.Context) {
-    user := c.MustGet("user").(auth.User)
+    user := c.MustGet("user").(*auth.User)
     c.JSON(http.StatusOK, user)
 }
 
@@ -451,51 +2034,105 @@ func (s *ProxyServer) proxyHandler(c *gin.Context) {
         return
     }
 
-    user := c.MustGet("user").(auth.User)
+    user := c.MustGet("user").(*auth.User)
     sourceIP := c.ClientIP()
     method := c.Request.Method
     path := c.Request.URL.Path
     userAgent := c.GetHeader("User-Agent")
-    requestID := c.GetHeader("X-Request-ID")
+
+    // Continue the client's trace if it sent a traceparent
+    ctx, span := traceConnection(tracing.Extract(c.Request.Context(), c.Request.Header), "HTTP", sourceIP, 0)
+    span.SetAttributes(
+        attribute.String("enduser.id", user.ID),
+        attribute.String("http.request.method", method),
+        attribute.String("server.address", targetHost),
+    )
+    defer span.End()
+
+    ctx = connctx.WithMeta(ctx, connctx.Meta{
+        User:       user, 
+        RequestID:  c.GetHeader("X-Request-ID"),
+        Protocol:   "HTTP",
+        SourceIP:   sourceIP,
+        TargetHost: targetHost,
+    })
+    c.Request = c.Request.WithContext(ctx)
+    requestID := connctx.FromContext(ctx).RequestID
+    logger := connctx.Logger(ctx)
     
     // Check firewall rules if firewall manager is enabled
-    var allowed bool
-    if s.firewallManager != nil {
-        allowed = s.firewallManager.CheckAccess(user.ID, targetHost)
-    } else {
-        allowed = true
-    }
+    decision := decideAccess(ctx, s.firewallManager)
         
-    if !allowed {
-            log.Warnf("Firewall blocked access for user %s to %s", user.ID, targetHost)
+    if !decision.Allowed {
+            logger.Warnf("Firewall blocked access for user %s to %s", user.ID, targetHost)
             
-            // Log denied access to syslog
-            if s.syslogLogger != nil {
-                s.syslogLogger.LogHTTPAccess(user.ID, user.Name, sourceIP, targetHost, method, path, userAgent, requestID, 403, 0, false)
-            }
+            s.eventBus.Publish(events.Event{
+                Type:          events.TypeVerdict,
+                UserID:        user.ID,
+                Username:      user.Name,
+                SourceIP:      sourceIP,
+                TargetHost:    targetHost,
+                Protocol:      "HTTP",
+                Allowed:       false,
+                Reason:        decision.Reason,
+                PolicyVersion: decision.PolicyVersion,
+                Rule:          decision.RuleLabel(),
+                ShadowAction:  decision.ShadowAction(),
+                Method:     method,
+                Path:       path,
+                UserAgent:  userAgent,
+                RequestID:  requestID,
+                StatusCode: http.StatusForbidden,
+            })
             
-            c.JSON(http.StatusForbidden, gin.H{"error": "Access denied by firewall policy"})
+            span.SetAttributes(attribute.Int("http.response.status_code", http.StatusForbidden))
+            s.blockPage.Write(c.Writer, c.Request, blockDenial(ctx, decision))
             return
     }
         
-    log.Debugf("Firewall allowed access for user %s to %s", user.ID, targetHost)
+    logger.Debugf("Firewall allowed access for user %s to %s", user.ID, targetHost)
+
+    // WebSockets are relayed directly; the reverse proxy can't account for them
+    if isWebSocketUpgrade(c.Request) {
+        s.proxyWebSocket(c, decision)
+        return
+    }
+
+    // gRPC streams last as long as the call, not the server's timeouts
+    grpc := transport.IsGRPC(c.Request)
+    if grpc {
+        clearStreamDeadlines(c.Writer)
+    }
+
+    // Uploads count against the user's bandwidth limit
+    c.Request.Body = s.rateLimiter.Reader(ctx, user.ID, c.Request.Body)
+    c.Request.Body = s.egress.Reader(ctx, "http", c.Request.Body)
 
     // Get or create proxy for target
     proxy := s.getOrCreateProxy(targetHost)
+    s.prewarmer.RecordTLS(targetHost)
 
     // Create response writer wrapper for monitoring
     wrapper := &responseWriterWrapper{
         ResponseWriter: c.Writer,
         mirrorManager:  s.mirrorManager,
-        syslogLogger:   s.syslogLogger,
+        eventBus:       s.eventBus,
+        rateLimiter:    s.rateLimiter,
+        egress:         s.egress,
         request:        c.Request,
-        user:           user,
+        user:           *user,
         targetHost:     targetHost,
         sourceIP:       sourceIP,
         method:         method,
         path:           path,
         userAgent:      userAgent,
         requestID:      requestID,
+        policyVersion:  decision.PolicyVersion,
+        shadowAction:   decision.ShadowAction(),
+        rule:           decision.RuleLabel(),
+        wouldDeny:      decision.WouldDeny,
+        grpc:           grpc,
+        start:          time.Now(),
     }
     c.Writer = wrapper
 
@@ -503,9 +2140,118 @@ func (s *ProxyServer) proxyHandler(c *gin.Context) {
     proxy.ServeHTTP(c.Writer, c.Request)
     
     // Ensure logging and mirroring happens
-    if wrapper, ok := c.Writer.(*responseWriterWrapper); ok {
-        wrapper.Flush()
+    wrapper.complete()
+    if wrapper.statusCode != 0 {
+        span.SetAttributes(attribute.Int("http.response.status_code", wrapper.statusCode))
+    }
+}
+
+// connectHandler tunnels a CONNECT request to its target, so TLS traffic
+// can pass through without the X-Target-Host header. The target is subject
+// to the same firewall checks; the verdict is published when the tunnel
+// closes so the access log carries the bytes transferred.
+func (s *ProxyServer) connectHandler(c *gin.Context) {
+    targetHost := c.Request.Host
+    _, portStr, err := net.SplitHostPort(targetHost)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "CONNECT target must be host:port"})
+        return
+    }
+    port, _ := strconv.Atoi(portStr)
+
+    done, ok := s.sessions.Begin(drain.KindConnect)
+    if !ok {
+        c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Headend is draining"})
+        return
+    }
+    defer done()
+
+    user := c.MustGet("user").(*auth.User)
+    ctx, span := traceConnection(tracing.Extract(c.Request.Context(), c.Request.Header), "CONNECT", c.ClientIP(), 0)
+    span.SetAttributes(attribute.String("enduser.id", user.ID), attribute.String("server.address", targetHost))
+    defer span.End()
+
+    ctx = connctx.WithMeta(ctx, connctx.Meta{
+        User:       user,
+        RequestID:  c.GetHeader("X-Request-ID"),
+        Protocol:   "HTTP",
+        SourceIP:   c.ClientIP(),
+        TargetHost: targetHost,
+    })
+    logger := connctx.Logger(ctx)
+
+    decision := decideAccess(ctx, s.firewallManager)
+    event := verdictEvent(ctx, port, decision)
+    event.Method = http.MethodConnect
+    event.UserAgent = c.GetHeader("User-Agent")
+
+    if !decision.Allowed {
+        logger.Warnf("Firewall blocked CONNECT for user %s to %s", user.ID, targetHost)
+        event.StatusCode = http.StatusForbidden
+        s.eventBus.Publish(event)
+        s.blockPage.Write(c.Writer, c.Request, blockDenial(ctx, decision))
+        return
+    }
+
+    targetConn, err := s.mesh.Dial(ctx, targetHost, func(ctx context.Context, address string) (net.Conn, error) {
+        return connctx.Dial(ctx, "tcp", address)
+    })
+    if err != nil {
+        logger.Errorf("Failed to connect to CONNECT target %s: %v", targetHost, err)
+        event.StatusCode = http.StatusBadGateway
+        s.eventBus.Publish(event)
+        c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to connect to target"})
+        return
     }
+    defer func() {
+        if err := targetConn.Close(); err != nil {
+            log.Debugf("Error closing target connection: %v", err)
+        }
+    }()
+
+    clientConn, buffered, err := c.Writer.Hijack()
+    if err != nil {
+        log.Errorf("Failed to hijack CONNECT connection: %v", err)
+        event.StatusCode = http.StatusInternalServerError
+        s.eventBus.Publish(event)
+        return
+    }
+    defer func() {
+        _ = clientConn.Close()
+    }()
+
+    // The server's read and write timeouts must not cut long-lived tunnels
+    if err := clientConn.SetDeadline(time.Time{}); err != nil {
+        log.Debugf("Error clearing CONNECT deadlines: %v", err)
+    }
+
+    if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+        log.Errorf("Failed to write CONNECT response: %v", err)
+        return
+    }
+
+    logger.Debugf("CONNECT tunnel open for user %s to %s", user.ID, targetHost)
+    event.StatusCode = http.StatusOK
+    defer publishConnectionLifecycle(ctx, s.eventBus, port)()
+
+    // The tunnel counts against the user's bandwidth limit in both directions
+    clientConn = s.rateLimiter.Conn(user.ID, clientConn)
+    clientConn = s.egress.Conn("http", clientConn)
+
+    // Anything the client sent right after the request is already buffered
+    initial, _ := buffered.Reader.Peek(buffered.Reader.Buffered())
+
+    start := time.Now()
+    received, sent, err := protocol.Relay(clientConn, targetConn, initial, nil)
+    if err != nil {
+        logger.Errorf("Failed to write to CONNECT target %s: %v", targetHost, err)
+    }
+    _ = clientConn.Close()
+
+    event.BytesSent = sent
+    event.BytesReceived = received
+    event.Duration = time.Since(start)
+    s.eventBus.Publish(event)
 }
 
 func (s *ProxyServer) getOrCreateProxy(targetHost string) *httputil.ReverseProxy {
@@ -529,15 +2275,14 @@ func (s *ProxyServer) getOrCreateProxy(targetHost string) *httputil.ReverseProxy
     targetURL, _ := url.Parse(fmt.Sprintf("https://%s", targetHost))
     proxy = httputil.NewSingleHostReverseProxy(targetURL)
 
-    // Configure proxy
-    proxy.Transport = &http.Transport{
-        TLSClientConfig: &tls.Config{
-            InsecureSkipVerify: viper.GetBool("proxy.skip_tls_verify"),
-        },
-        MaxIdleConns:        100,
-        MaxIdleConnsPerHost: 10,
-        IdleConnTimeout:     90 * time.Second,
-    }
+    // Targets in the same class share a transport and its connection pool.
+    // Upstream requests are traced and carry our traceparent.
+    proxy.Transport = tracing.Transport(s.transports.ForTarget(targetHost))
+
+    // Logical targets are dialed on their least loaded backend; gateway
+    // errors count against the backend that answered. The Manager may make
+    // a host logical after its proxy is created.
+    proxy.Transport = s.balancer.Transport(proxy.Transport)
 
     proxy.ModifyResponse = func(resp *http.Response) error {
         // Add security headers
@@ -551,21 +2296,72 @@ func (s *ProxyServer) getOrCreateProxy(targetHost string) *httputil.ReverseProxy
     return proxy
 }
 
+// initializeProxyProtocol reads the PROXY protocol settings: the header
+// load balancers put in front of connections to the TCP listeners, and the
+// one sent toward upstreams
+func (s *ProxyServer) initializeProxyProtocol() error {
+    version, err := proxyproto.ParseVersion(viper.GetString("server.proxy_protocol.upstream"))
+    if err != nil {
+        return err
+    }
+    proxyproto.SetUpstreamVersion(version)
+    if version > 0 {
+        log.Infof("Sending PROXY protocol v%d headers to upstreams", version)
+    }
+
+    if !viper.GetBool("server.proxy_protocol.enabled") {
+        return nil
+    }
+    trusted, err := proxyproto.ParseTrusted(viper.GetStringSlice("server.proxy_protocol.trusted"))
+    if err != nil {
+        return err
+    }
+    s.proxyProtocol = &proxyproto.Config{
+        Trusted: trusted,
+        Timeout: viper.GetDuration("server.proxy_protocol.header_timeout"),
+    }
+    if len(trusted) == 0 {
+        log.Warn("Every TCP proxy connection must open with a PROXY protocol header, as no trusted sources are configured")
+    } else {
+        log.Infof("Reading PROXY protocol headers from %d trusted sources", len(trusted))
+    }
+    return nil
+}
+
+// acceptProxyProtocol makes listener read the PROXY header of connections
+// from trusted load balancers, if enabled
+func (s *ProxyServer) acceptProxyProtocol(listener net.Listener) net.Listener {
+    if s.proxyProtocol == nil {
+        return listener
+    }
+    return proxyproto.NewListener(listener, *s.proxyProtocol)
+}
+
 func (s *ProxyServer) initializeTCPProxy() error {
     tcpPort := viper.GetString("server.tcp_port")
     
-    listener, err := net.Listen("tcp", ":"+tcpPort)
+    listener, err := net.Listen(listenNetwork("tcp"), ":"+tcpPort)
     if err != nil {
         return fmt.Errorf("failed to create TCP listener: %w", err)
     }
+    listener = s.acceptProxyProtocol(listener)
     
     s.tcpProxy = &TCPProxy{
         listener:        listener,
         authProvider:    s.authProvider,
         mirrorManager:   s.mirrorManager,
         firewallManager: s.firewallManager,
-        syslogLogger:    s.syslogLogger,
+        eventBus:        s.eventBus,
         wgRouter:        s.wgRouter,
+        upstreamPool:    s.upstreamPool,
+        balancer:        s.balancer,
+        mesh:            s.mesh,
+        rateLimiter:     s.rateLimiter,
+        egress:          s.egress,
+        connLimits:      s.connLimits,
+        sessions:        s.sessions,
+        activeSessions:  s.activeSessions,
+        sessionCaps:     s.sessionCaps,
     }
     
     // Start TCP proxy in goroutine
@@ -578,32 +2374,64 @@ func (s *ProxyServer) initializeTCPProxy() error {
 func (s *ProxyServer) initializeUDPProxy() error {
     udpPort := viper.GetString("server.udp_port")
     
-    addr, err := net.ResolveUDPAddr("udp", ":"+udpPort)
+    addr, err := net.ResolveUDPAddr(listenNetwork("udp"), ":"+udpPort)
     if err != nil {
         return fmt.Errorf("failed to resolve UDP address: %w", err)
     }
     
-    conn, err := net.ListenUDP("udp", addr)
+    conn, err := net.ListenUDP(listenNetwork("udp"), addr)
     if err != nil {
         return fmt.Errorf("failed to create UDP listener: %w", err)
     }
     
-    s.udpProxy = &UDPProxy{
-        conn:            conn,
+    s.udpProxy = s.newUDPProxy(conn, "static")
+    
+    // Start UDP proxy in goroutine
+    go s.udpProxy.Start()
+    
+    log.Infof("UDP proxy listening on port %s", udpPort)
+    return nil
+}
+
+func (s *ProxyServer) initializeSOCKSProxy() error {
+    socksPort := viper.GetString("server.socks_port")
+    
+    listener, err := net.Listen(listenNetwork("tcp"), ":"+socksPort)
+    if err != nil {
+        return fmt.Errorf("failed to create SOCKS5 listener: %w", err)
+    }
+    
+    s.socksProxy = &SOCKSProxy{
+        listener:        listener,
         authProvider:    s.authProvider,
         mirrorManager:   s.mirrorManager,
         firewallManager: s.firewallManager,
-        syslogLogger:    s.syslogLogger,
+        eventBus:        s.eventBus,
         wgRouter:        s.wgRouter,
+        rateLimiter:     s.rateLimiter,
+        egress:          s.egress,
+        sessions:        s.sessions,
     }
     
-    // Start UDP proxy in goroutine
-    go s.udpProxy.Start()
+    go s.socksProxy.Start()
     
-    log.Infof("UDP proxy listening on port %s", udpPort)
+    log.Infof("SOCKS5 proxy listening on port %s", socksPort)
     return nil
 }
 
+// connectRoutePath is the internal route CONNECT requests are dispatched to,
+// since their request target is an authority ("host:port") rather than a path
+const connectRoutePath = "/connect"
+
+// routeRequest hands every request to the gin router, pointing CONNECT
+// requests at the CONNECT handler
+func (s *ProxyServer) routeRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodConnect {
+        r.URL.Path = connectRoutePath
+    }
+    s.router.ServeHTTP(w, r)
+}
+
 func (s *ProxyServer) Run() error {
     httpPort := viper.GetString("server.http_port")
     certFile := viper.GetString("server.cert_file")
@@ -611,23 +2439,155 @@ func (s *ProxyServer) Run() error {
 
     s.httpServer = &http.Server{
         Addr:         ":" + httpPort,
-        Handler:      s.router,
+        Handler:      http.HandlerFunc(s.routeRequest),
         ReadTimeout:  30 * time.Second,
         WriteTimeout: 30 * time.Second,
         IdleTimeout:  120 * time.Second,
     }
 
-    // Graceful shutdown
-    go func() {
-        sigChan := make(chan os.Signal, 1)
-        signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    // ACME provisions the certificate instead of it being distributed
+    if viper.GetBool("acme.enabled") {
+        if err := s.initializeACME(); err != nil {
+            return err
+        }
+        certFile, keyFile = s.acmeManager.CertFile(), s.acmeManager.KeyFile()
+    }
+
+    // The certificate is served through GetCertificate so renewals take
+    // effect on the next handshake, without a restart
+    if certFile != "" && keyFile != "" {
+        certificates, err := certreload.New(certFile, keyFile)
+        if err != nil {
+            return err
+        }
+        s.certificates = certificates
+        if viper.GetBool("server.cert_watch") {
+            if err := certificates.Watch(); err != nil {
+                log.Warnf("Certificate renewals will need a SIGHUP to take effect: %v", err)
+            }
+        }
+    }
+
+    if viper.GetBool("server.mtls.enabled") {
+        if certFile == "" || keyFile == "" {
+            return fmt.Errorf("mTLS requires server.cert_file and server.key_file")
+        }
+        clientCAs, err := auth.LoadClientCAPool(viper.GetString("server.mtls.client_ca_file"))
+        if err != nil {
+            return fmt.Errorf("failed to load mTLS client CA: %w", err)
+        }
+        // Certificates are verified whenever presented, but only required on
+        // authenticated routes so health checks work without one
+        s.httpServer.TLSConfig = &tls.Config{
+            ClientCAs:  clientCAs,
+            ClientAuth: tls.VerifyClientCertIfGiven,
+            MinVersion: tls.VersionTLS12,
+        }
+        if s.certVerifier != nil {
+            // Expired certificates fail the TLS layer's verification, so
+            // leave it to the verifier which knows the grace period
+            s.httpServer.TLSConfig.ClientAuth = tls.RequestClientCert
+            s.httpServer.TLSConfig.VerifyPeerCertificate = s.certVerifier.VerifyPeerCertificate
+        }
+        log.Info("mTLS enabled: client certificates must be signed by the Manager CA")
+    }
+    if s.certificates != nil {
+        if s.httpServer.TLSConfig == nil {
+            s.httpServer.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+        }
+        s.httpServer.TLSConfig.GetCertificate = s.certificates.GetCertificate
+    }
+
+    if viper.GetBool("server.quic.enabled") {
+        if err := s.initializeQUIC(); err != nil {
+            return err
+        }
+    }
+
+    if err := configureHTTP2(s.httpServer, s.certificates != nil); err != nil {
+        return err
+    }
+
+    // Reload the certificate on SIGHUP, e.g. from a certbot deploy hook
+    if s.certificates != nil {
+        go func() {
+            reloadChan := make(chan os.Signal, 1)
+            signal.Notify(reloadChan, syscall.SIGHUP)
+            for range reloadChan {
+                log.Info("Reloading TLS certificate on SIGHUP")
+                _ = s.certificates.Reload()
+            }
+        }()
+    }
+
+    // Drain on SIGUSR1 without exiting; the orchestrator follows up with
+    // SIGTERM once /healthz shows the drain has finished
+    if len(drainSignals) > 0 {
+        go func() {
+            drainChan := make(chan os.Signal, 1)
+            signal.Notify(drainChan, drainSignals...)
+            for range drainChan {
+                if s.beginDrain() {
+                    go s.waitForDrain()
+                }
+            }
+        }()
+    }
+
+    // Graceful shutdown; Run returns once it has finished
+    shutdownDone := make(chan struct{})
+    sigChan := make(chan os.Signal, 1)
+    notifyShutdown(sigChan)
+    go func() {
+        defer close(shutdownDone)
         <-sigChan
 
         log.Info("Shutting down server...")
         
+        // Let in-flight sessions finish before tearing anything down
+        s.beginDrain()
+        s.waitForDrain()
+        
         ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
         defer cancel()
 
+        if s.prober != nil {
+            s.prober.Stop()
+        }
+        
+        if s.dnsProxy != nil {
+            s.dnsProxy.Stop()
+        }
+
+        if s.wgMonitor != nil {
+            s.wgMonitor.Stop()
+        }
+        if s.wgRouter != nil {
+            s.wgRouter.peers.Stop()
+        }
+        s.egressRoutes.Remove()
+        
+        s.acmeManager.Stop()
+        s.prewarmer.Stop()
+        s.upstreamPool.Stop()
+        if s.acmeServer != nil {
+            if err := s.acmeServer.Shutdown(ctx); err != nil {
+                log.Errorf("ACME challenge server shutdown error: %v", err)
+            }
+        }
+        s.certificates.Stop()
+
+        if s.haPair != nil {
+            s.haPair.Stop()
+        }
+        s.mesh.Stop()
+        s.registration.Stop()
+        
+        s.alertListener.Stop()
+        
+        if s.mirrorStop != nil {
+            close(s.mirrorStop)
+        }
         if s.mirrorManager != nil {
             s.mirrorManager.Stop()
         }
@@ -636,44 +2596,156 @@ func (s *ProxyServer) Run() error {
             s.firewallManager.Stop()
         }
         
-        if s.syslogLogger != nil {
-            s.syslogLogger.Stop()
+        if s.rateLimiter != nil {
+            s.rateLimiter.Stop()
+        }
+        
+        if s.flagsStop != nil {
+            close(s.flagsStop)
+        }
+        
+        // Drain the event bus, which stops the sinks that buffer
+        if s.eventBus != nil {
+            s.eventBus.Stop()
         }
+        s.telemetry.Stop()
+        s.logPseudonyms.Stop()
         
-        if s.portManager != nil {
-            s.portManager.Stop()
+        if s.syslogLogger != nil {
+            s.syslogLogger.Stop()
         }
         
-        // Close TCP and UDP proxies
-        if s.tcpProxy != nil && s.tcpProxy.listener != nil {
-            if err := s.tcpProxy.listener.Close(); err != nil {
-                log.Errorf("Failed to close TCP listener: %v", err)
+        if s.accessLog != nil {
+            if err := s.accessLog.Close(); err != nil {
+                log.Errorf("Failed to close access log: %v", err)
             }
         }
+        
+        // TCP listeners were closed when the drain began
         if s.udpProxy != nil && s.udpProxy.conn != nil {
             if err := s.udpProxy.conn.Close(); err != nil {
                 log.Errorf("Failed to close UDP connection: %v", err)
             }
+            s.udpProxy.flows.Close()
+        }
+        if s.dynamicUDP != nil {
+            s.dynamicUDP.flows.Close()
+        }
+
+        if s.quicServer != nil {
+            if err := s.quicServer.Shutdown(ctx); err != nil {
+                log.Errorf("HTTP/3 shutdown error: %v", err)
+            }
         }
 
         if err := s.httpServer.Shutdown(ctx); err != nil {
             log.Errorf("Server shutdown error: %v", err)
         }
+
+        // Export the spans of the requests and flows that just ended
+        if s.tracer != nil {
+            tracing.SetDefault(nil)
+            if err := s.tracer.Shutdown(ctx); err != nil {
+                log.Errorf("Failed to export remaining spans: %v", err)
+            }
+        }
+
+        if s.transports != nil {
+            s.transports.CloseIdleConnections()
+        }
     }()
 
     log.Infof("Starting headend HTTP proxy on port %s", httpPort)
+
+    if s.quicServer != nil {
+        go s.serveQUIC()
+    }
     
-    if certFile != "" && keyFile != "" {
-        return s.httpServer.ListenAndServeTLS(certFile, keyFile)
+    listener, err := net.Listen(listenNetwork("tcp"), s.httpServer.Addr)
+    if err != nil {
+        return fmt.Errorf("failed to create HTTP listener: %w", err)
+    }
+
+    if s.certificates != nil {
+        // The certificate comes from TLSConfig.GetCertificate
+        err = s.httpServer.ServeTLS(listener, "", "")
+    } else {
+        err = s.httpServer.Serve(listener)
+    }
+    if !errors.Is(err, http.ErrServerClosed) {
+        return err
     }
     
-    return s.httpServer.ListenAndServe()
+    // Serve returns as soon as Shutdown begins; wait for in-flight requests
+    // and the last spans before letting the process exit
+    <-shutdownDone
+    return nil
+}
+
+// notifyShutdown relays the signals that stop the headend to c. Tests
+// replace it to stop Run without signalling the process.
+var notifyShutdown = func(c chan<- os.Signal) {
+    signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// beginDrain stops accepting new TCP, SOCKS5, CONNECT and dynamic-port
+// sessions. It returns false if a drain is already underway.
+func (s *ProxyServer) beginDrain() bool {
+    timeout := viper.GetDuration("server.drain_timeout")
+    if !s.sessions.Drain(timeout) {
+        return false
+    }
+    
+    log.Infof("Draining: refusing new connections, waiting up to %s for %d active sessions",
+        timeout, s.sessions.Total())
+    
+    s.httpServer.SetKeepAlivesEnabled(false)
+    
+    if s.tcpProxy != nil && s.tcpProxy.listener != nil {
+        if err := s.tcpProxy.listener.Close(); err != nil {
+            log.Errorf("Failed to close TCP listener: %v", err)
+        }
+    }
+    if s.socksProxy != nil && s.socksProxy.listener != nil {
+        if err := s.socksProxy.listener.Close(); err != nil {
+            log.Errorf("Failed to close SOCKS5 listener: %v", err)
+        }
+    }
+    if s.portManager != nil {
+        s.portManager.Stop()
+    }
+    
+    // Clients that negotiated migration move to the peer instead of waiting
+    // for their sessions to be cut off at the deadline
+    if peerURL := viper.GetString("migration.peer.url"); peerURL != "" {
+        peer := migration.Peer{
+            URL:       peerURL,
+            Endpoint:  viper.GetString("migration.peer.endpoint"),
+            PublicKey: viper.GetString("migration.peer.public_key"),
+        }
+        if s.migration.Begin(peer, s.sessions.Status().Deadline) {
+            log.Infof("Migrating clients to peer headend %s", peerURL)
+        }
+    }
+    
+    return true
+}
+
+// waitForDrain blocks until active sessions finish or the drain deadline passes
+func (s *ProxyServer) waitForDrain() {
+    if err := s.sessions.Wait(context.Background()); err != nil {
+        log.Warnf("Drain deadline reached with %d sessions still active", s.sessions.Total())
+        return
+    }
+    log.Info("Drain complete, no active sessions")
 }
 
 type responseWriterWrapper struct {
     gin.ResponseWriter
     mirrorManager *mirror.Manager
-    syslogLogger  *syslog.SyslogLogger
+    eventBus      *events.Bus
+    rateLimiter   *ratelimit.Limiter
+    egress        *ratelimit.Egress
     request       *http.Request
     user          auth.User
     targetHost    string
@@ -682,6 +2754,12 @@ type responseWriterWrapper struct {
     path          string
     userAgent     string
     requestID     string
+    policyVersion string
+    shadowAction  string
+    rule          string
+    wouldDeny     bool
+    grpc          bool
+    start         time.Time
     statusCode    int
     bytesWritten  int64
     written       []byte
@@ -699,40 +2777,66 @@ func (w *responseWriterWrapper) Write(data []byte) (int, error) {
     }
     w.bytesWritten += int64(len(data))
     
+    // Downloads count against the user's bandwidth limit
+    if err := w.rateLimiter.Wait(w.request.Context(), w.user.ID, len(data)); err != nil {
+        return 0, err
+    }
+    if err := w.egress.Wait(w.request.Context(), "http", len(data)); err != nil {
+        return 0, err
+    }
+    
     // Mirror and log are handled by worker queues for performance
     // Just track the data here, actual work is deferred
     
     return w.ResponseWriter.Write(data)
 }
 
-// Flush handles final logging and mirroring when the response is complete
+// Flush sends buffered response data to the client. The reverse proxy
+// flushes after every write of a streaming response.
 func (w *responseWriterWrapper) Flush() {
-    // Send to mirror asynchronously if enabled
+    w.ResponseWriter.Flush()
+}
+
+// complete handles final logging and mirroring once the response is done.
+// For gRPC this is once per stream, with the call's status from the trailers.
+func (w *responseWriterWrapper) complete() {
+    // Queue for mirroring if enabled - MirrorHTTP never blocks, it drops
+    // the packet when the mirror queue is saturated
     if w.mirrorManager != nil && len(w.written) > 0 {
-        go w.mirrorManager.MirrorHTTP(w.request, w.statusCode, w.written)
-    }
-    
-    // Log to syslog - uses internal worker queue for performance
-    if w.syslogLogger != nil {
-        w.syslogLogger.LogHTTPAccess(
-            w.user.ID,
-            w.user.Name,
-            w.sourceIP,
-            w.targetHost,
-            w.method,
-            w.path,
-            w.userAgent,
-            w.requestID,
-            w.statusCode,
-            w.bytesWritten,
-            true, // allowed (we wouldn't get here if not allowed)
-        )
+        w.mirrorManager.MirrorHTTP(w.request, w.statusCode, w.written)
     }
     
-    // Call the underlying Flush if available
-    if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
-        flusher.Flush()
+    var grpcStatus string
+    if w.grpc {
+        grpcStatus = grpcStatusOf(w.Header())
     }
+    
+    // HTTP verdicts are published once the response completes so the
+    // access log carries the status code and response size
+    w.eventBus.Publish(events.Event{
+        Type:       events.TypeVerdict,
+        UserID:     w.user.ID,
+        Username:   w.user.Name,
+        SourceIP:   w.sourceIP,
+        TargetHost: w.targetHost,
+        Protocol:   "HTTP",
+        Allowed:    true, // we wouldn't get here if not allowed
+        PolicyVersion: w.policyVersion,
+        ShadowAction:  w.shadowAction,
+        Rule:          w.rule,
+        WouldDeny:     w.wouldDeny,
+        Method:     w.method,
+        Path:       w.path,
+        UserAgent:  w.userAgent,
+        RequestID:  w.requestID,
+        StatusCode: w.statusCode,
+        BytesSent:  w.bytesWritten,
+        Duration:   time.Since(w.start),
+        HTTPVersion: w.request.Proto,
+        GRPCStatus:  grpcStatus,
+    })
+    
+    w.ResponseWriter.Flush()
 }
 
 // TCP Proxy Implementation
@@ -742,6 +2846,9 @@ func (t *TCPProxy) Start() {
     for {
         conn, err := t.listener.Accept()
         if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
             log.Errorf("TCP accept error: %v", err)
             continue
         }
@@ -758,218 +2865,97 @@ func (t *TCPProxy) handleConnection(clientConn net.Conn) {
         }
     }()
     
-    // Read first packet to extract JWT token from headers
-    buffer := make([]byte, 4096)
-    n, err := clientConn.Read(buffer)
+    done, ok := t.sessions.Begin(drain.KindTCP)
+    if !ok {
+        return
+    }
+    defer done()
+    
+    // Read the connection header carrying the JWT token and target host
+    header, initial, err := protocol.ReadHeader(clientConn)
     if err != nil {
-        log.Errorf("TCP read error: %v", err)
+        log.Errorf("Invalid TCP connection header from %s: %v", clientConn.RemoteAddr(), err)
         return
     }
+    log.Debugf("TCP connection from %s uses %s framing", clientConn.RemoteAddr(), header.Format)
     
-    // Parse JWT token from connection metadata
-    // This would typically be in a custom protocol header
-    token := t.extractJWTFromTCPPacket(buffer[:n])
+    ctx, span := traceConnection(context.Background(), "TCP", clientConn.RemoteAddr().String(), 0)
+    defer span.End()
     
     // Authenticate using JWT
-    user, err := t.authProvider.ValidateToken(token)
+    user, err := t.authProvider.ValidateToken(header.Token)
     if err != nil {
         log.Errorf("TCP authentication failed: %v", err)
+        tracing.RecordError(span, err)
+        t.eventBus.Publish(authEvent(nil, "TCP", clientConn.RemoteAddr().String(), err))
+        connctx.RecordDenial("TCP", connctx.DenyAuth)
         return
     }
+    t.eventBus.Publish(authEvent(user, "TCP", clientConn.RemoteAddr().String(), nil))
     
-    log.Infof("TCP connection authenticated for user: %s", user.ID)
+    targetHost := header.Target
+    span.SetAttributes(attribute.String("enduser.id", user.ID), attribute.String("server.address", targetHost))
+    ctx, cancel := context.WithCancel(connctx.WithMeta(ctx, connctx.Meta{
+        User:       user,
+        Protocol:   "TCP",
+        SourceIP:   clientConn.RemoteAddr().String(),
+        TargetHost: targetHost,
+    }))
+    defer cancel()
+    logger := connctx.Logger(ctx)
     
-    // Extract target host from the packet
-    targetHost := t.extractTargetFromTCPPacket(buffer[:n])
-    if targetHost == "" {
-        log.Error("No target host found in TCP packet")
-        return
-    }
+    logger.Infof("TCP connection authenticated for user: %s", user.ID)
     
     // Check firewall rules if firewall manager is enabled
-    var allowed bool
-    if t.firewallManager != nil {
-        allowed = t.firewallManager.CheckAccess(user.ID, targetHost)
-    } else {
-        allowed = true
-    }
+    decision := decideAccess(ctx, t.firewallManager)
         
-    if !allowed {
-            log.Warnf("Firewall blocked TCP connection for user %s to %s", user.ID, targetHost)
+    if !decision.Allowed {
+            logger.Warnf("Firewall blocked TCP connection for user %s to %s (%s)", user.ID, targetHost, decision.Reason)
             
-            // Log denied access to syslog
-            if t.syslogLogger != nil {
-                t.syslogLogger.LogTCPAccess(user.ID, user.Name, clientConn.RemoteAddr().String(), targetHost, false)
-            }
+            t.eventBus.Publish(verdictEvent(ctx, 0, decision))
+            sendDenial(ctx, clientConn, t.sessionCaps, decision)
             
             return
     }
         
-    log.Debugf("Firewall allowed TCP connection for user %s to %s", user.ID, targetHost)
-    
-    // Log allowed access to syslog
-    if t.syslogLogger != nil {
-        t.syslogLogger.LogTCPAccess(user.ID, user.Name, clientConn.RemoteAddr().String(), targetHost, true)
-    }
+    logger.Debugf("Firewall allowed TCP connection for user %s to %s", user.ID, targetHost)
     
-    // Use WireGuard router if available for intelligent routing
-    if t.wgRouter != nil {
-        log.Infof("Using WireGuard router for TCP traffic to %s", targetHost)
-        if err := t.wgRouter.RouteTraffic(targetHost, clientConn); err != nil {
-            log.Errorf("WireGuard routing failed for %s: %v", targetHost, err)
-        }
-        return
-    }
-    
-    // Fallback to direct connection
-    targetConn, err := net.Dial("tcp", targetHost)
-    if err != nil {
-        log.Errorf("Failed to connect to target %s: %v", targetHost, err)
-        return
-    }
-    defer func() {
-        if err := targetConn.Close(); err != nil {
-            log.Debugf("Error closing target connection: %v", err)
-        }
-    }()
+    t.eventBus.Publish(verdictEvent(ctx, 0, decision))
     
-    // Send original packet to target
-    if _, err := targetConn.Write(buffer[:n]); err != nil {
-        log.Errorf("Failed to write to target: %v", err)
+    release, ok := t.connLimits.Admit(drain.KindTCP, user.ID)
+    if !ok {
+        logger.Warnf("User %s is at the concurrent TCP session limit", user.ID)
         return
     }
+    defer release()
+    defer publishConnectionLifecycle(ctx, t.eventBus, 0)()
     
-    // Mirror traffic if enabled
-    if t.mirrorManager != nil {
-        go t.mirrorManager.MirrorTCP(clientConn.RemoteAddr().String(), targetHost, buffer[:n])
-    }
+    // From here on the connection counts against the user's bandwidth limit
+    clientConn = t.rateLimiter.Conn(user.ID, clientConn)
+    clientConn = t.egress.Conn("tcp", clientConn)
+    clientConn = t.connLimits.Watch(ctx, drain.KindTCP, clientConn, cancel)
+    defer t.activeSessions.Add(activeSession(ctx, drain.KindTCP, 0), func() {
+        cancel()
+        _ = clientConn.Close()
+    })()
     
-    // Bidirectional proxy
-    go t.proxyData(clientConn, targetConn, "client->target")
-    t.proxyData(targetConn, clientConn, "target->client")
-}
-
-func (t *TCPProxy) proxyData(src, dst net.Conn, direction string) {
-    buffer := make([]byte, 32768)
-    
-    for {
-        n, err := src.Read(buffer)
-        if err != nil {
-            break
-        }
-        
-        if _, err := dst.Write(buffer[:n]); err != nil {
-            break
-        }
-        
-        // Mirror additional data if enabled
-        if t.mirrorManager != nil {
-            go t.mirrorManager.MirrorTCP(src.RemoteAddr().String(), dst.RemoteAddr().String(), buffer[:n])
-        }
-    }
-}
-
-func (t *TCPProxy) extractJWTFromTCPPacket(data []byte) string {
-    // Simple implementation - look for JWT token in first 512 bytes
-    // In practice, this would be part of a custom protocol
-    dataStr := string(data)
-    if idx := strings.Index(dataStr, "JWT:"); idx != -1 {
-        end := strings.Index(dataStr[idx+4:], "\n")
-        if end == -1 {
-            end = len(dataStr) - idx - 4
-        }
-        return strings.TrimSpace(dataStr[idx+4 : idx+4+end])
-    }
-    return ""
-}
-
-func (t *TCPProxy) extractTargetFromTCPPacket(data []byte) string {
-    // Simple implementation - look for target host in packet
-    dataStr := string(data)
-    if idx := strings.Index(dataStr, "HOST:"); idx != -1 {
-        end := strings.Index(dataStr[idx+5:], "\n")
-        if end == -1 {
-            end = len(dataStr) - idx - 5
-        }
-        return strings.TrimSpace(dataStr[idx+5 : idx+5+end])
-    }
-    return ""
-}
-
-// UDP Proxy Implementation  
-func (u *UDPProxy) Start() {
-    log.Info("Starting UDP proxy server")
-    
-    buffer := make([]byte, 65536)
-    
-    for {
-        n, clientAddr, err := u.conn.ReadFromUDP(buffer)
-        if err != nil {
-            log.Errorf("UDP read error: %v", err)
-            continue
+    // Use WireGuard router if available for intelligent routing
+    if t.wgRouter != nil {
+        logger.Infof("Using WireGuard router for TCP traffic to %s", targetHost)
+        if err := t.wgRouter.RouteTraffic(ctx, targetHost, decision, clientConn); err != nil {
+            logger.Errorf("WireGuard routing failed for %s: %v", targetHost, err)
         }
-        
-        // Handle packet in goroutine with authentication
-        go u.handlePacket(buffer[:n], clientAddr)
-    }
-}
-
-func (u *UDPProxy) handlePacket(data []byte, clientAddr *net.UDPAddr) {
-    // Parse JWT token from UDP packet
-    token := u.extractJWTFromUDPPacket(data)
-    
-    // Authenticate using JWT
-    user, err := u.authProvider.ValidateToken(token)
-    if err != nil {
-        log.Errorf("UDP authentication failed: %v", err)
-        return
-    }
-    
-    log.Infof("UDP packet authenticated for user: %s", user.ID)
-    
-    // Extract target from packet
-    targetHost := u.extractTargetFromUDPPacket(data)
-    if targetHost == "" {
-        log.Error("No target host found in UDP packet")
         return
     }
     
-    // Check firewall rules if firewall manager is enabled
-    var allowed bool
-    if u.firewallManager != nil {
-        allowed = u.firewallManager.CheckAccess(user.ID, targetHost)
-    } else {
-        allowed = true
-    }
-        
-    if !allowed {
-            log.Warnf("Firewall blocked UDP packet for user %s to %s", user.ID, targetHost)
-            
-            // Log denied access to syslog
-            if u.syslogLogger != nil {
-                u.syslogLogger.LogUDPAccess(user.ID, user.Name, clientAddr.String(), targetHost, false)
-            }
-            
-            return
-    }
-        
-    log.Debugf("Firewall allowed UDP packet for user %s to %s", user.ID, targetHost)
-    
-    // Log allowed access to syslog
-    if u.syslogLogger != nil {
-        u.syslogLogger.LogUDPAccess(user.ID, user.Name, clientAddr.String(), targetHost, true)
-    }
-    
-    // Connect to target
-    targetAddr, err := net.ResolveUDPAddr("udp", targetHost)
-    if err != nil {
-        log.Errorf("Failed to resolve target %s: %v", targetHost, err)
-        return
-    }
-    
-    targetConn, err := net.DialUDP("udp", nil, targetAddr)
+    // Fallback to direct connection, pre-dialed if the target is busy, to
+    // the least loaded backend of a logical target, through a peer headend
+    // if upstream connectivity fails here
+    targetConn, err := t.mesh.Dial(ctx, targetHost, func(ctx context.Context, address string) (net.Conn, error) {
+        return t.balancer.Dial(ctx, address, t.upstreamPool.Dial)
+    })
     if err != nil {
-        log.Errorf("Failed to connect to target %s: %v", targetHost, err)
+        logger.Errorf("Failed to connect to target %s: %v", targetHost, err)
         return
     }
     defer func() {
@@ -977,68 +2963,23 @@ func (u *UDPProxy) handlePacket(data []byte, clientAddr *net.UDPAddr) {
             log.Debugf("Error closing target connection: %v", err)
         }
     }()
+    // A session closed by its limits must not wait on a silent target
+    stop := context.AfterFunc(ctx, func() { _ = targetConn.Close() })
+    defer stop()
     
-    // Forward packet to target
-    if _, err := targetConn.Write(data); err != nil {
-        log.Errorf("Failed to write to target: %v", err)
+    if err := proxyproto.WriteUpstream(targetConn, clientConn.RemoteAddr()); err != nil {
+        logger.Errorf("Failed to write to target: %v", err)
         return
     }
     
-    // Mirror traffic if enabled
-    if u.mirrorManager != nil {
-        go u.mirrorManager.MirrorUDP(clientAddr.String(), targetHost, data)
-    }
-    
-    // Read response and send back
-    response := make([]byte, 65536)
-    if err := targetConn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
-        log.Errorf("Failed to set read deadline: %v", err)
-        return
-    }
-    n, err := targetConn.Read(response)
-    if err != nil {
-        log.Errorf("Failed to read response from target: %v", err)
-        return
-    }
-    
-    // Send response back to client
-    if _, err := u.conn.WriteToUDP(response[:n], clientAddr); err != nil {
-        log.Errorf("Failed to write response to client: %v", err)
-        return
-    }
-    
-    // Mirror response if enabled
-    if u.mirrorManager != nil {
-        go u.mirrorManager.MirrorUDP(targetHost, clientAddr.String(), response[:n])
+    // Whatever arrived with the header goes to the target first
+    _ = t.rateLimiter.Wait(ctx, user.ID, len(initial))
+    _ = t.egress.Wait(ctx, "tcp", len(initial))
+    if _, _, err := protocol.Relay(clientConn, targetConn, initial, mirrorTap(ctx, t.mirrorManager)); err != nil {
+        logger.Errorf("Failed to write to target: %v", err)
     }
 }
 
-func (u *UDPProxy) extractJWTFromUDPPacket(data []byte) string {
-    // Similar to TCP implementation
-    dataStr := string(data)
-    if idx := strings.Index(dataStr, "JWT:"); idx != -1 {
-        end := strings.Index(dataStr[idx+4:], "\n")
-        if end == -1 {
-            end = len(dataStr) - idx - 4
-        }
-        return strings.TrimSpace(dataStr[idx+4 : idx+4+end])
-    }
-    return ""
-}
-
-func (u *UDPProxy) extractTargetFromUDPPacket(data []byte) string {
-    // Similar to TCP implementation
-    dataStr := string(data)
-    if idx := strings.Index(dataStr, "HOST:"); idx != -1 {
-        end := strings.Index(dataStr[idx+5:], "\n")
-        if end == -1 {
-            end = len(dataStr) - idx - 5
-        }
-        return strings.TrimSpace(dataStr[idx+5 : idx+5+end])
-    }
-    return ""
-}
-
 // refreshPortConfig periodically fetches updated port configuration from the Manager
 func (s *ProxyServer) refreshPortConfig(configClient *ports.ConfigClient) {
 	refreshInterval, err := time.ParseDuration(viper.GetString("ports.refresh_interval"))
@@ -1050,6 +2991,11 @@ func (s *ProxyServer) refreshPortConfig(configClient *ports.ConfigClient) {
 	defer ticker.Stop()
 	
 	for range ticker.C {
+		// Don't reopen listeners that a drain has closed
+		if s.sessions.Draining() {
+			return
+		}
+
 		config, err := configClient.FetchConfig()
 		if err != nil {
 			log.Errorf("Failed to refresh port config: %v", err)
@@ -1068,101 +3014,160 @@ func (s *ProxyServer) refreshPortConfig(configClient *ports.ConfigClient) {
 		} else {
 			log.Infof("Updated port configuration: TCP=%s, UDP=%s", config.TCPRanges, config.UDPRanges)
 		}
+		s.reportPortStatus(configClient)
 	}
 }
 
-// updatePortConfiguration applies new port configuration to the port manager
-func (s *ProxyServer) updatePortConfiguration(config *ports.PortConfig) error {
-	// Stop current listeners
-	s.portManager.Stop()
-	
-	// Create new port manager with updated config
+// reportPortStatus tells the Manager which of the requested ports are
+// bound, and why the others aren't
+func (s *ProxyServer) reportPortStatus(configClient *ports.ConfigClient) {
+	statuses := s.portManager.Status()
+	for _, status := range statuses {
+		if status.State != ports.ListenerListening {
+			log.Warnf("Dynamic %s port %d is not listening (%s): %s", strings.ToUpper(status.Protocol), status.Port, status.State, status.Error)
+		}
+	}
+	if err := configClient.ReportStatus(statuses); err != nil {
+		log.Warnf("Failed to report dynamic port status to the Manager: %v", err)
+	}
+}
+
+// startDynamicPorts opens the dynamic port listeners with the configuration
+// fetched at startup, if it arrived in time, and keeps them up to date. A
+// configuration that didn't arrive is picked up by the next refresh.
+func (s *ProxyServer) startDynamicPorts(configClient *ports.ConfigClient, fetched <-chan *ports.PortConfig) {
+	s.dynamicUDP = s.newUDPProxy(nil, "dynamic")
 	s.portManager = ports.NewPortManager()
+	s.portManager.SetListenNetworks(listenNetwork("tcp"), listenNetwork("udp"))
+	s.portManager.SetListenerWrapper(s.acceptProxyProtocol)
 	s.portManager.SetConnectionHandlers(
 		s.handleDynamicTCPConnection,
 		s.handleDynamicUDPPacket,
 	)
-	
-	// Parse and apply new configuration
-	if err := s.portManager.ParsePortRanges(config.TCPRanges, config.UDPRanges); err != nil {
-		return fmt.Errorf("failed to parse port ranges: %w", err)
+
+	select {
+	case config := <-fetched:
+		if err := s.portManager.ParsePortRanges(config.TCPRanges, config.UDPRanges); err != nil {
+			log.Errorf("Failed to parse port ranges: %v", err)
+		} else if err := s.portManager.StartListening(); err != nil {
+			log.Errorf("Failed to start dynamic port listeners: %v", err)
+		} else {
+			log.Infof("Dynamic port manager started with %d listeners", s.portManager.GetListenerCount())
+		}
+		go s.reportPortStatus(configClient)
+	default:
+		log.Info("Continuing with static port configuration until the next refresh")
 	}
-	
-	if err := s.portManager.StartListening(); err != nil {
-		return fmt.Errorf("failed to start listeners: %w", err)
+
+	go s.refreshPortConfig(configClient)
+}
+
+// updatePortConfiguration applies new port configuration to the port
+// manager, opening and closing only the listeners of ports that changed so
+// sessions on the others carry on
+func (s *ProxyServer) updatePortConfiguration(config *ports.PortConfig) error {
+	opened, closed, err := s.portManager.Update(config.TCPRanges, config.UDPRanges)
+	if err != nil {
+		return err
+	}
+	if opened > 0 || closed > 0 {
+		log.Infof("Dynamic port listeners changed: %d opened, %d closed", opened, closed)
 	}
-	
 	return nil
 }
 
 // handleDynamicTCPConnection handles new TCP connections on dynamically configured ports
-func (s *ProxyServer) handleDynamicTCPConnection(conn net.Conn, port int, protocol string) {
+func (s *ProxyServer) handleDynamicTCPConnection(conn net.Conn, port int, proto string) {
 	defer func() {
 		if err := conn.Close(); err != nil {
 			log.Debugf("Error closing connection: %v", err)
 		}
 	}()
+
+	done, ok := s.sessions.Begin(drain.KindDynamic)
+	if !ok {
+		return
+	}
+	defer done()
 	
 	log.Debugf("New TCP connection on dynamic port %d from %s", port, conn.RemoteAddr())
 	
-	// Read first packet to extract authentication and target information
-	buffer := make([]byte, 4096)
-	n, err := conn.Read(buffer)
+	// Read the connection header carrying authentication and target information
+	header, initial, err := protocol.ReadHeader(conn)
 	if err != nil {
-		log.Errorf("Failed to read from TCP connection on port %d: %v", port, err)
+		log.Errorf("Invalid TCP connection header on port %d: %v", port, err)
 		return
 	}
+	targetHost := header.Target
 	
-	// Extract JWT token and target from the packet
-	token := s.extractJWTFromTCPPacket(buffer[:n])
-	targetHost := s.extractTargetFromTCPPacket(buffer[:n])
-	
-	if token == "" || targetHost == "" {
-		log.Errorf("Missing authentication or target in TCP packet on port %d", port)
-		return
-	}
+	ctx, span := traceConnection(context.Background(), "TCP", conn.RemoteAddr().String(), port)
+	defer span.End()
 	
 	// Authenticate using JWT
-	user, err := s.authProvider.ValidateToken(token)
+	user, err := s.authProvider.ValidateToken(header.Token)
 	if err != nil {
 		log.Errorf("Authentication failed for TCP connection on port %d: %v", port, err)
+		tracing.RecordError(span, err)
+		s.eventBus.Publish(authEvent(nil, "TCP", conn.RemoteAddr().String(), err))
+		connctx.RecordDenial("TCP", connctx.DenyAuth)
 		return
 	}
+	s.eventBus.Publish(authEvent(user, "TCP", conn.RemoteAddr().String(), nil))
+	span.SetAttributes(attribute.String("enduser.id", user.ID), attribute.String("server.address", targetHost))
+	
+	ctx, cancel := context.WithCancel(connctx.WithMeta(ctx, connctx.Meta{
+		User:       user,
+		Protocol:   "TCP",
+		SourceIP:   conn.RemoteAddr().String(),
+		TargetHost: targetHost,
+	}))
+	defer cancel()
+	logger := connctx.Logger(ctx)
 	
-	log.Infof("Authenticated TCP connection on port %d for user: %s to %s", port, user.ID, targetHost)
+	logger.Infof("Authenticated TCP connection on port %d for user: %s to %s", port, user.ID, targetHost)
 	
 	// Check firewall rules
-	if s.firewallManager != nil {
-		allowed := s.firewallManager.CheckAccess(user.ID, targetHost)
-		if !allowed {
-			log.Warnf("Firewall blocked TCP connection on port %d for user %s to %s", port, user.ID, targetHost)
-			
-			// Log denied access to syslog
-			if s.syslogLogger != nil {
-				s.syslogLogger.LogTCPAccess(user.ID, user.Name, conn.RemoteAddr().String(), targetHost, false)
-			}
-			return
-		}
+	decision := decideAccess(ctx, s.firewallManager)
+	if !decision.Allowed {
+		logger.Warnf("Firewall blocked TCP connection on port %d for user %s to %s (%s)", port, user.ID, targetHost, decision.Reason)
+		
+		s.eventBus.Publish(verdictEvent(ctx, port, decision))
+		sendDenial(ctx, conn, s.sessionCaps, decision)
+		return
 	}
 	
-	// Log allowed access to syslog
-	if s.syslogLogger != nil {
-		s.syslogLogger.LogTCPAccess(user.ID, user.Name, conn.RemoteAddr().String(), targetHost, true)
+	s.eventBus.Publish(verdictEvent(ctx, port, decision))
+
+	release, ok := s.connLimits.Admit(drain.KindDynamic, user.ID)
+	if !ok {
+		logger.Warnf("User %s is at the concurrent TCP session limit, refusing connection on port %d", user.ID, port)
+		return
 	}
+	defer release()
+	defer publishConnectionLifecycle(ctx, s.eventBus, port)()
+	
+	// From here on the connection counts against the user's bandwidth limit
+	conn = s.rateLimiter.Conn(user.ID, conn)
+	conn = s.egress.Conn("tcp", conn)
+	conn = s.connLimits.Watch(ctx, drain.KindDynamic, conn, cancel)
+	defer s.activeSessions.Add(activeSession(ctx, drain.KindDynamic, port), func() {
+		cancel()
+		_ = conn.Close()
+	})()
 	
 	// Use WireGuard router if available for intelligent routing
 	if s.wgRouter != nil {
-		log.Infof("Using WireGuard router for dynamic TCP traffic to %s on port %d", targetHost, port)
-		if err := s.wgRouter.RouteTraffic(targetHost, conn); err != nil {
-			log.Errorf("WireGuard routing failed for %s on port %d: %v", targetHost, port, err)
+		logger.Infof("Using WireGuard router for dynamic TCP traffic to %s on port %d", targetHost, port)
+		if err := s.wgRouter.RouteTraffic(ctx, targetHost, decision, conn); err != nil {
+			logger.Errorf("WireGuard routing failed for %s on port %d: %v", targetHost, port, err)
 		}
 		return
 	}
 	
 	// Fallback to direct connection
-	targetConn, err := net.Dial("tcp", targetHost)
+	targetConn, err := connctx.Dial(ctx, "tcp", targetHost)
 	if err != nil {
-		log.Errorf("Failed to connect to target %s from port %d: %v", targetHost, port, err)
+		logger.Errorf("Failed to connect to target %s from port %d: %v", targetHost, port, err)
 		return
 	}
 	defer func() {
@@ -1170,74 +3175,140 @@ func (s *ProxyServer) handleDynamicTCPConnection(conn net.Conn, port int, protoc
 			log.Debugf("Error closing target connection: %v", err)
 		}
 	}()
+	// A session closed by its limits must not wait on a silent target
+	stop := context.AfterFunc(ctx, func() { _ = targetConn.Close() })
+	defer stop()
 	
-	// Send original packet to target
-	if _, err := targetConn.Write(buffer[:n]); err != nil {
-		log.Errorf("Failed to write to target: %v", err)
+	if err := proxyproto.WriteUpstream(targetConn, conn.RemoteAddr()); err != nil {
+		logger.Errorf("Failed to write to target from port %d: %v", port, err)
 		return
 	}
 	
-	// Mirror traffic if enabled
-	if s.mirrorManager != nil {
-		go s.mirrorManager.MirrorTCP(conn.RemoteAddr().String(), targetHost, buffer[:n])
+	// Whatever arrived with the header goes to the target first
+	_ = s.rateLimiter.Wait(ctx, user.ID, len(initial))
+	_ = s.egress.Wait(ctx, "tcp", len(initial))
+	if _, _, err := protocol.Relay(conn, targetConn, initial, mirrorTap(ctx, s.mirrorManager)); err != nil {
+		logger.Errorf("Failed to write to target from port %d: %v", port, err)
 	}
-	
-	// Bidirectional proxy
-	go s.proxyTCPData(conn, targetConn, fmt.Sprintf("client->target (port %d)", port))
-	s.proxyTCPData(targetConn, conn, fmt.Sprintf("target->client (port %d)", port))
 }
 
-// handleDynamicUDPPacket handles new UDP packets on dynamically configured ports
-func (s *ProxyServer) handleDynamicUDPPacket(data []byte, addr *net.UDPAddr, port int) {
-	log.Debugf("New UDP packet on dynamic port %d from %s", port, addr)
-	
-	// Extract JWT token and target from the packet
-	token := s.extractJWTFromUDPPacket(data)
-	targetHost := s.extractTargetFromUDPPacket(data)
-	
-	if token == "" || targetHost == "" {
-		log.Errorf("Missing authentication or target in UDP packet on port %d", port)
+// Start accepts SOCKS5 connections until the listener is closed
+func (p *SOCKSProxy) Start() {
+	log.Info("Starting SOCKS5 proxy server")
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("SOCKS5 accept error: %v", err)
+			continue
+		}
+
+		go p.handleConnection(conn)
+	}
+}
+
+func (p *SOCKSProxy) handleConnection(clientConn net.Conn) {
+	defer func() {
+		if err := clientConn.Close(); err != nil {
+			log.Debugf("Error closing SOCKS5 client connection: %v", err)
+		}
+	}()
+
+	done, ok := p.sessions.Begin(drain.KindSOCKS)
+	if !ok {
 		return
 	}
-	
-	// Authenticate using JWT
-	user, err := s.authProvider.ValidateToken(token)
+	defer done()
+
+	sourceIP := clientConn.RemoteAddr().String()
+
+	// Bound the handshake so idle clients cannot hold connections open
+	if err := clientConn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		log.Debugf("Failed to set SOCKS5 handshake deadline: %v", err)
+	}
+
+	// The password carries the JWT; the username is informational only
+	var user *auth.User
+	request, err := socks.ServerHandshake(clientConn, func(username, password string) error {
+		validated, err := p.authProvider.ValidateToken(password)
+		if err != nil {
+			return err
+		}
+		user = validated
+		return nil
+	})
 	if err != nil {
-		log.Errorf("Authentication failed for UDP packet on port %d: %v", port, err)
+		if errors.Is(err, socks.ErrAuthFailed) {
+			log.Errorf("SOCKS5 authentication failed from %s: %v", sourceIP, err)
+			p.eventBus.Publish(authEvent(nil, "SOCKS5", sourceIP, err))
+			connctx.RecordDenial("SOCKS5", connctx.DenyAuth)
+		} else {
+			log.Debugf("SOCKS5 handshake failed from %s: %v", sourceIP, err)
+		}
 		return
 	}
-	
-	log.Infof("Authenticated UDP packet on port %d for user: %s to %s", port, user.ID, targetHost)
-	
-	// Check firewall rules
-	if s.firewallManager != nil {
-		allowed := s.firewallManager.CheckAccess(user.ID, targetHost)
-		if !allowed {
-			log.Warnf("Firewall blocked UDP packet on port %d for user %s to %s", port, user.ID, targetHost)
-			
-			// Log denied access to syslog
-			if s.syslogLogger != nil {
-				s.syslogLogger.LogUDPAccess(user.ID, user.Name, addr.String(), targetHost, false)
-			}
-			return
-		}
+	p.eventBus.Publish(authEvent(user, "SOCKS5", sourceIP, nil))
+
+	if request.Command != socks.CommandConnect {
+		log.Warnf("Unsupported SOCKS5 command %d from user %s", request.Command, user.ID)
+		_ = socks.WriteReply(clientConn, socks.ReplyCommandNotSupported, nil)
+		return
 	}
-	
-	// Log allowed access to syslog
-	if s.syslogLogger != nil {
-		s.syslogLogger.LogUDPAccess(user.ID, user.Name, addr.String(), targetHost, true)
+
+	targetHost := request.Target
+	ctx, span := traceConnection(context.Background(), "SOCKS5", sourceIP, 0)
+	span.SetAttributes(attribute.String("enduser.id", user.ID), attribute.String("server.address", targetHost))
+	defer span.End()
+
+	ctx, cancel := context.WithCancel(connctx.WithMeta(ctx, connctx.Meta{
+		User:       user,
+		Protocol:   "SOCKS5",
+		SourceIP:   sourceIP,
+		TargetHost: targetHost,
+	}))
+	defer cancel()
+	logger := connctx.Logger(ctx)
+
+	decision := decideAccess(ctx, p.firewallManager)
+	p.eventBus.Publish(verdictEvent(ctx, 0, decision))
+	if !decision.Allowed {
+		logger.Warnf("Firewall blocked SOCKS5 connection for user %s to %s", user.ID, targetHost)
+		_ = socks.WriteReply(clientConn, socks.ReplyNotAllowed, nil)
+		return
 	}
-	
-	// Connect to target
-	targetAddr, err := net.ResolveUDPAddr("udp", targetHost)
-	if err != nil {
-		log.Errorf("Failed to resolve target %s from port %d: %v", targetHost, port, err)
+
+	logger.Debugf("Firewall allowed SOCKS5 connection for user %s to %s", user.ID, targetHost)
+
+	// Relaying is not subject to the handshake deadline
+	if err := clientConn.SetDeadline(time.Time{}); err != nil {
+		logger.Debugf("Failed to clear SOCKS5 deadline: %v", err)
+	}
+
+	defer publishConnectionLifecycle(ctx, p.eventBus, 0)()
+
+	// From here on the connection counts against the user's bandwidth limit
+	clientConn = p.rateLimiter.Conn(user.ID, clientConn)
+	clientConn = p.egress.Conn("socks5", clientConn)
+
+	// Use WireGuard router if available for intelligent routing. It dials
+	// the target itself, so success is reported before routing starts.
+	if p.wgRouter != nil {
+		if err := socks.WriteReply(clientConn, socks.ReplySucceeded, nil); err != nil {
+			return
+		}
+		if err := p.wgRouter.RouteTraffic(ctx, targetHost, decision, clientConn); err != nil {
+			logger.Errorf("WireGuard routing failed for %s: %v", targetHost, err)
+		}
 		return
 	}
-	
-	targetConn, err := net.DialUDP("udp", nil, targetAddr)
+
+	targetConn, err := connctx.Dial(ctx, "tcp", targetHost)
 	if err != nil {
-		log.Errorf("Failed to connect to target %s from port %d: %v", targetHost, port, err)
+		logger.Errorf("Failed to connect to SOCKS5 target %s: %v", targetHost, err)
+		_ = socks.WriteReply(clientConn, socks.ReplyCodeForError(err), nil)
 		return
 	}
 	defer func() {
@@ -1245,83 +3316,237 @@ func (s *ProxyServer) handleDynamicUDPPacket(data []byte, addr *net.UDPAddr, por
 			log.Debugf("Error closing target connection: %v", err)
 		}
 	}()
-	
-	// Forward packet to target
-	if _, err := targetConn.Write(data); err != nil {
-		log.Errorf("Failed to write to target: %v", err)
+
+	if err := socks.WriteReply(clientConn, socks.ReplySucceeded, targetConn.LocalAddr()); err != nil {
 		return
 	}
-	
-	// Mirror traffic if enabled
-	if s.mirrorManager != nil {
-		go s.mirrorManager.MirrorUDP(addr.String(), targetHost, data)
-	}
-	
-	// Read response and send back (UDP response handling would need port manager support)
-	response := make([]byte, 65536)
-	if err := targetConn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		log.Errorf("Failed to set read deadline: %v", err)
+	if err := proxyproto.WriteUpstream(targetConn, clientConn.RemoteAddr()); err != nil {
+		logger.Errorf("Failed to write to SOCKS5 target %s: %v", targetHost, err)
 		return
 	}
-	n, err := targetConn.Read(response)
-	if err != nil {
-		log.Debugf("No response from target %s (normal for UDP)", targetHost)
-		return
+
+	_, _, _ = protocol.Relay(clientConn, targetConn, nil, mirrorTap(ctx, p.mirrorManager))
+}
+
+// mirrorTap returns a relay tap feeding the mirror manager with packets
+// tagged by the connection in ctx, or nil when mirroring is disabled
+func mirrorTap(ctx context.Context, m *mirror.Manager) protocol.Tap {
+	if m == nil {
+		return nil
+	}
+	return func(src, dst string, data []byte) {
+		m.MirrorTCPContext(ctx, src, dst, data)
 	}
-	
-	log.Debugf("Received %d bytes response from target %s", n, targetHost)
 }
 
-// proxyTCPData proxies data between two TCP connections
-func (s *ProxyServer) proxyTCPData(src, dst net.Conn, direction string) {
-	buffer := make([]byte, 32768)
-	
-	for {
-		n, err := src.Read(buffer)
-		if err != nil {
-			break
-		}
-		
-		if _, err := dst.Write(buffer[:n]); err != nil {
-			break
+// traceConnection starts the server span of a connection or request from
+// source. port is the dynamic port it arrived on, or 0.
+func traceConnection(ctx context.Context, protocol, source string, port int) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("network.protocol.name", strings.ToLower(protocol)),
+		attribute.String("client.address", source),
+	}
+	if port != 0 {
+		attrs = append(attrs, attribute.Int("server.port", port))
+	}
+	return tracing.Start(ctx, "proxy."+strings.ToLower(protocol), trace.SpanKindServer, attrs...)
+}
+
+// decideAccess evaluates the firewall for the user and target of the
+// connection in ctx, traced as a child of its span, and counts denials.
+// Traffic is allowed when no firewall manager is configured.
+func decideAccess(ctx context.Context, fm *firewall.Manager) (decision firewall.Decision) {
+	meta := connctx.FromContext(ctx)
+	_, span := tracing.Start(ctx, "firewall.decide", trace.SpanKindInternal)
+	start := time.Now()
+	defer func() {
+		span.SetAttributes(
+			attribute.Bool("firewall.allowed", decision.Allowed),
+			attribute.String("firewall.reason", decision.Reason),
+			attribute.String("firewall.rule", decision.RuleLabel()),
+		)
+		span.End()
+		if !decision.Allowed && meta != nil {
+			connctx.RecordDenial(meta.Protocol, decision.DenialLabel())
 		}
-		
-		// Mirror additional data if enabled
-		if s.mirrorManager != nil {
-			go s.mirrorManager.MirrorTCP(src.RemoteAddr().String(), dst.RemoteAddr().String(), buffer[:n])
+		if trace := flowtrace.FromContext(ctx); trace != nil {
+			trace.Timed("policy", start, policyTraceDetail(fm, decision))
 		}
+	}()
+
+	if fm == nil {
+		return firewall.Decision{Allowed: true}
+	}
+	if meta == nil || meta.User == nil {
+		return fm.Decide(meta.UserID(), meta.TargetHost)
 	}
+	return fm.DecideWithGroups(meta.User.ID, meta.User.Groups, meta.TargetHost)
 }
 
-// Helper methods for extracting data from packets (reuse existing implementations)
-func (s *ProxyServer) extractJWTFromTCPPacket(data []byte) string {
-	dataStr := string(data)
-	if idx := strings.Index(dataStr, "JWT:"); idx != -1 {
-		end := strings.Index(dataStr[idx+4:], "\n")
-		if end == -1 {
-			end = len(dataStr) - idx - 4
-		}
-		return strings.TrimSpace(dataStr[idx+4 : idx+4+end])
+// policyTraceDetail describes decision for a flow trace
+func policyTraceDetail(fm *firewall.Manager, decision firewall.Decision) map[string]any {
+	detail := map[string]any{
+		"firewall": fm != nil,
+		"allowed":  decision.Allowed,
+	}
+	if decision.Reason != "" {
+		detail["reason"] = decision.Reason
 	}
-	return ""
+	if decision.PolicyVersion != "" {
+		detail["policy_version"] = decision.PolicyVersion
+	}
+	if decision.MatchedRule != nil {
+		detail["matched_rule"] = *decision.MatchedRule
+	}
+	if decision.ShadowRule != nil {
+		detail["shadow_rule"] = *decision.ShadowRule
+		detail["shadow_action"] = decision.ShadowAction()
+	}
+	if decision.WouldDeny {
+		detail["would_deny"] = true
+	}
+	return detail
 }
 
-func (s *ProxyServer) extractTargetFromTCPPacket(data []byte) string {
-	dataStr := string(data)
-	if idx := strings.Index(dataStr, "HOST:"); idx != -1 {
-		end := strings.Index(dataStr[idx+5:], "\n")
-		if end == -1 {
-			end = len(dataStr) - idx - 5
-		}
-		return strings.TrimSpace(dataStr[idx+5 : idx+5+end])
+// verdictEvent builds a firewall verdict event for the flow in ctx
+func verdictEvent(ctx context.Context, port int, decision firewall.Decision) events.Event {
+	meta := connctx.FromContext(ctx)
+	event := events.Event{
+		Type:          events.TypeVerdict,
+		UserID:        meta.User.ID,
+		Username:      meta.User.Name,
+		SourceIP:      meta.SourceIP,
+		TargetHost:    meta.TargetHost,
+		Protocol:      meta.Protocol,
+		Port:          port,
+		RequestID:     meta.RequestID,
+		Allowed:       decision.Allowed,
+		PolicyVersion: decision.PolicyVersion,
+		Rule:          decision.RuleLabel(),
+		ShadowAction:  decision.ShadowAction(),
+		WouldDeny:     decision.WouldDeny,
+	}
+	if !decision.Allowed || decision.WouldDeny {
+		event.Reason = decision.Reason
+	}
+	return event
+}
+
+// denialWriteTimeout bounds sending a denial to a client that isn't reading
+const denialWriteTimeout = 5 * time.Second
+
+// denialFrame builds the frame telling the client in ctx why decision
+// refused its flow, or returns nil if it didn't negotiate denial frames
+func denialFrame(ctx context.Context, caps *capabilities.Registry, decision firewall.Decision) []byte {
+	meta := connctx.FromContext(ctx)
+	if !caps.Get(meta.User.ID).Has(capabilities.FeatureDenialFrames) {
+		return nil
+	}
+
+	denial := framing.Denial{
+		Reason:   decision.Reason,
+		PolicyID: decision.PolicyVersion,
+		Target:   meta.TargetHost,
+		Contact:  viper.GetString("firewall.denial_contact"),
+	}
+	if decision.MatchedRule != nil {
+		denial.Rule = decision.MatchedRule.Pattern
+		denial.Category = decision.MatchedRule.Description
+	}
+	frame, err := framing.EncodeDenial(denial)
+	if err != nil {
+		connctx.Logger(ctx).Debugf("Failed to encode denial: %v", err)
+		return nil
+	}
+	return frame
+}
+
+// blockDenial describes decision's denial of the HTTP request in ctx for
+// the block page
+func blockDenial(ctx context.Context, decision firewall.Decision) blockpage.Denial {
+	meta := connctx.FromContext(ctx)
+	denial := blockpage.Denial{
+		Reason:        decision.Reason,
+		PolicyVersion: decision.PolicyVersion,
+		Target:        meta.TargetHost,
+		RequestID:     meta.RequestID,
+	}
+	if decision.MatchedRule != nil {
+		denial.Rule = decision.MatchedRule.Pattern
+		denial.Category = decision.MatchedRule.Description
+	}
+	return denial
+}
+
+// sendDenial tells the client why its stream was refused before it is closed
+func sendDenial(ctx context.Context, conn net.Conn, caps *capabilities.Registry, decision firewall.Decision) {
+	frame := denialFrame(ctx, caps, decision)
+	if frame == nil {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(denialWriteTimeout))
+	if _, err := conn.Write(frame); err != nil {
+		connctx.Logger(ctx).Debugf("Failed to send denial: %v", err)
 	}
-	return ""
 }
 
-func (s *ProxyServer) extractJWTFromUDPPacket(data []byte) string {
-	return s.extractJWTFromTCPPacket(data) // Same implementation
+// authEvent builds an authentication event; user is nil when authentication failed
+func authEvent(user *auth.User, protocol, sourceIP string, authErr error) events.Event {
+	event := events.Event{
+		Type:     events.TypeAuth,
+		SourceIP: sourceIP,
+		Protocol: protocol,
+		Allowed:  authErr == nil,
+	}
+	if user != nil {
+		event.UserID = user.ID
+		event.Username = user.Name
+	}
+	if authErr != nil {
+		event.Reason = authErr.Error()
+	}
+	return event
 }
 
-func (s *ProxyServer) extractTargetFromUDPPacket(data []byte) string {
-	return s.extractTargetFromTCPPacket(data) // Same implementation
-}
\ No newline at end of file
+// activeSession describes the connection in ctx for the admin API's
+// session listing
+func activeSession(ctx context.Context, kind string, port int) registry.Session {
+	meta := connctx.FromContext(ctx)
+	return registry.Session{
+		Kind:      kind,
+		UserID:    meta.User.ID,
+		SourceIP:  meta.SourceIP,
+		Target:    meta.TargetHost,
+		Protocol:  meta.Protocol,
+		Port:      port,
+		RequestID: meta.RequestID,
+	}
+}
+
+// publishConnectionLifecycle publishes a connection opened event for the
+// connection in ctx and returns a function that publishes the matching
+// closed event with the duration
+func publishConnectionLifecycle(ctx context.Context, bus *events.Bus, port int) func() {
+	meta := connctx.FromContext(ctx)
+	start := time.Now()
+	opened := events.Event{
+		Type:       events.TypeConnectionOpened,
+		UserID:     meta.User.ID,
+		Username:   meta.User.Name,
+		SourceIP:   meta.SourceIP,
+		TargetHost: meta.TargetHost,
+		Protocol:   meta.Protocol,
+		Port:       port,
+		RequestID:  meta.RequestID,
+		Allowed:    true,
+	}
+	bus.Publish(opened)
+
+	return func() {
+		closed := opened
+		closed.Type = events.TypeConnectionClosed
+		closed.Timestamp = time.Time{}
+		closed.Duration = time.Since(start)
+		bus.Publish(closed)
+	}
+}
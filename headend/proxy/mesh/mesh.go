@@ -0,0 +1,672 @@
+// Package mesh implements headend-to-headend failover for the SASEWaddle
+// headend proxy.
+//
+// The mesh package provides:
+//   - A peer list from the Manager (the other clusters' headends) and from
+//     configuration, refreshed in the background
+//   - Health exchange: each headend posts its health to every peer and gets
+//     the peer's back, which also registers it with peers that don't list it
+//   - Failover of upstream dials: when upstream connectivity fails here, new
+//     sessions are tunneled through a healthy peer's relay instead
+//   - Per-peer health, latency and relay metrics
+//
+// A headend considers its upstream connectivity failed when its upstream
+// probes fail, or when MaxLocalFailures dials in a row fail; it then sends
+// sessions through peers first, trying locally again every RetryLocal. A
+// relay only ever dials locally, so sessions never bounce between peers.
+// Peers are authenticated with a token shared by the mesh.
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/flowtrace"
+)
+
+// Defaults for the fields of Config left zero
+const (
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultPeerListInterval  = time.Minute
+	DefaultMaxLocalFailures  = 3
+	DefaultRetryLocal        = 10 * time.Second
+
+	// staleHeartbeats is how many heartbeat intervals a peer may stay
+	// silent before it no longer counts as healthy
+	staleHeartbeats = 3
+
+	// maxRelayAttempts bounds how many peers one session is tried on
+	maxRelayAttempts = 2
+)
+
+// Peer is another headend of the mesh
+type Peer struct {
+	ID     string `json:"id" mapstructure:"id"`
+	URL    string `json:"url" mapstructure:"url"`
+	Region string `json:"region,omitempty" mapstructure:"region"`
+}
+
+// Health is what headends tell each other about themselves
+type Health struct {
+	ID     string `json:"id"`
+	URL    string `json:"url,omitempty"`
+	Region string `json:"region,omitempty"`
+	// Healthy means upstream connectivity works, so the headend can relay
+	Healthy   bool      `json:"healthy"`
+	Draining  bool      `json:"draining,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Config configures a Mesh
+type Config struct {
+	// ID identifies this headend to its peers
+	ID string
+	// URL is where peers reach this headend; without it peers only reach
+	// it if they list it themselves
+	URL    string
+	Region string
+	// Token authenticates peers to each other
+	Token string
+	// ManagerURL and AuthToken fetch the peer list; without a Manager URL
+	// only the configured Peers are used
+	ManagerURL string
+	AuthToken  string
+	ClusterID  string
+	Peers      []Peer
+
+	HeartbeatInterval time.Duration
+	PeerListInterval  time.Duration
+	MaxLocalFailures  int
+	RetryLocal        time.Duration
+
+	// LocalHealth reports whether upstream connectivity works and whether
+	// this headend is draining; nil counts as healthy
+	LocalHealth func() (healthy, draining bool)
+}
+
+// PeerStatus describes a peer, as reported by Mesh.Status
+type PeerStatus struct {
+	Peer
+	Healthy   bool       `json:"healthy"`
+	Draining  bool       `json:"draining,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	LatencyMs float64    `json:"latency_ms,omitempty"`
+	Listed    bool       `json:"listed"`
+	Relayed   uint64     `json:"relayed"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// Status reports the mesh for health checks
+type Status struct {
+	ID            string       `json:"id"`
+	Healthy       bool         `json:"healthy"`
+	LocalFailing  bool         `json:"local_failing"`
+	HealthyPeers  int          `json:"healthy_peers"`
+	Peers         []PeerStatus `json:"peers"`
+	LastPeerList  *time.Time   `json:"last_peer_list,omitempty"`
+	PeerListError string       `json:"peer_list_error,omitempty"`
+}
+
+type peerState struct {
+	Peer
+	listed   bool
+	health   Health
+	lastSeen time.Time
+	latency  time.Duration
+	relayed  uint64
+	lastErr  error
+}
+
+// Mesh is this headend's membership in the failover mesh
+type Mesh struct {
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+
+	mu            sync.Mutex
+	peers         map[string]*peerState
+	localFailures int
+	retryLocalAt  time.Time
+	lastPeerList  time.Time
+	peerListErr   error
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a mesh member
+func New(cfg Config) (*Mesh, error) {
+	if cfg.ID == "" {
+		return nil, fmt.Errorf("mesh ID is required")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("mesh token is required")
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.PeerListInterval <= 0 {
+		cfg.PeerListInterval = DefaultPeerListInterval
+	}
+	if cfg.MaxLocalFailures <= 0 {
+		cfg.MaxLocalFailures = DefaultMaxLocalFailures
+	}
+	if cfg.RetryLocal <= 0 {
+		cfg.RetryLocal = DefaultRetryLocal
+	}
+
+	m := &Mesh{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.HeartbeatInterval},
+		now:      time.Now,
+		peers:    make(map[string]*peerState),
+		stopChan: make(chan struct{}),
+	}
+	m.setListed(nil)
+	return m, nil
+}
+
+// Start fetches the peer list and begins exchanging health with peers
+func (m *Mesh) Start() {
+	go m.run()
+}
+
+// Stop stops the heartbeats
+func (m *Mesh) Stop() {
+	if m == nil {
+		return
+	}
+	m.stopOnce.Do(func() { close(m.stopChan) })
+}
+
+func (m *Mesh) run() {
+	m.refreshPeers()
+	m.heartbeat()
+
+	heartbeats := time.NewTicker(m.cfg.HeartbeatInterval)
+	defer heartbeats.Stop()
+	nextList := time.After(m.cfg.PeerListInterval)
+	for {
+		select {
+		case <-heartbeats.C:
+			m.heartbeat()
+		case <-nextList:
+			m.refreshPeers()
+			// Randomized like the firewall refresh to avoid a thundering herd
+			nextList = time.After(m.cfg.PeerListInterval/2 + time.Duration(rand.Int63n(int64(m.cfg.PeerListInterval))))
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// Authorized reports whether token is the mesh's shared secret
+func (m *Mesh) Authorized(token string) bool {
+	return m != nil && token == m.cfg.Token
+}
+
+// Local returns this headend's health as told to peers
+func (m *Mesh) Local() Health {
+	healthy, draining := true, false
+	if m.cfg.LocalHealth != nil {
+		healthy, draining = m.cfg.LocalHealth()
+	}
+	return Health{
+		ID:        m.cfg.ID,
+		URL:       m.cfg.URL,
+		Region:    m.cfg.Region,
+		Healthy:   healthy && !m.localFailing(),
+		Draining:  draining,
+		Timestamp: m.now().UTC(),
+	}
+}
+
+// Exchange records the health a peer posted, registering it if it wasn't
+// known, and returns ours
+func (m *Mesh) Exchange(health Health) (Health, error) {
+	if health.ID == "" {
+		return Health{}, fmt.Errorf("peer ID is required")
+	}
+	if health.ID != m.cfg.ID {
+		m.record(Peer{ID: health.ID, URL: health.URL, Region: health.Region}, health, 0, nil)
+	}
+	return m.Local(), nil
+}
+
+// setListed replaces the peers from the Manager and configuration. Peers
+// that dropped off the list are kept while they keep registering.
+func (m *Mesh) setListed(peers []Peer) {
+	listed := make(map[string]Peer)
+	for _, peer := range append(append([]Peer(nil), m.cfg.Peers...), peers...) {
+		if peer.ID == "" || peer.URL == "" || peer.ID == m.cfg.ID {
+			continue
+		}
+		listed[peer.ID] = peer
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, state := range m.peers {
+		if _, ok := listed[id]; !ok {
+			state.listed = false
+			if !m.fresh(state) {
+				delete(m.peers, id)
+				peerHealth.DeleteLabelValues(id)
+			}
+		}
+	}
+	for id, peer := range listed {
+		state := m.peers[id]
+		if state == nil {
+			state = &peerState{}
+			m.peers[id] = state
+		}
+		state.Peer = peer
+		state.listed = true
+	}
+}
+
+// record updates a peer after a heartbeat either way. The caller must not
+// hold m.mu.
+func (m *Mesh) record(peer Peer, health Health, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.peers[peer.ID]
+	if state == nil {
+		state = &peerState{Peer: peer}
+		m.peers[peer.ID] = state
+		log.Infof("Mesh peer %s registered from %s", peer.ID, peer.URL)
+	}
+	if peer.URL != "" && !state.listed {
+		state.URL = peer.URL
+		state.Region = peer.Region
+	}
+	state.lastErr = err
+	if err != nil {
+		return
+	}
+	state.health = health
+	state.lastSeen = m.now()
+	if latency > 0 {
+		state.latency = latency
+	}
+	peerHealth.WithLabelValues(peer.ID).Set(boolGauge(m.usable(state)))
+}
+
+// fresh reports whether the peer was heard from recently; m.mu must be held
+func (m *Mesh) fresh(state *peerState) bool {
+	return !state.lastSeen.IsZero() && m.now().Sub(state.lastSeen) < staleHeartbeats*m.cfg.HeartbeatInterval
+}
+
+// usable reports whether sessions can be relayed through the peer; m.mu
+// must be held
+func (m *Mesh) usable(state *peerState) bool {
+	return state.URL != "" && m.fresh(state) && state.health.Healthy && !state.health.Draining
+}
+
+// refreshPeers fetches the peer list from the Manager
+func (m *Mesh) refreshPeers() {
+	if m.cfg.ManagerURL == "" {
+		return
+	}
+	peers, err := m.fetchPeers()
+
+	m.mu.Lock()
+	m.peerListErr = err
+	if err == nil {
+		m.lastPeerList = m.now()
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		// Keep the peers we have if the Manager can't be reached
+		log.Errorf("Failed to refresh mesh peers: %v", err)
+		return
+	}
+	m.setListed(peers)
+}
+
+func (m *Mesh) fetchPeers() ([]Peer, error) {
+	query := url.Values{"cluster_id": {m.cfg.ClusterID}, "headend_id": {m.cfg.ID}}
+	req, err := http.NewRequest("GET", m.cfg.ManagerURL+"/api/v1/headend/mesh/peers?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+m.cfg.AuthToken)
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var list struct {
+		Peers []Peer `json:"peers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode mesh peers: %w", err)
+	}
+	return list.Peers, nil
+}
+
+// heartbeat exchanges health with every peer that has a URL
+func (m *Mesh) heartbeat() {
+	m.mu.Lock()
+	peers := make([]Peer, 0, len(m.peers))
+	for _, state := range m.peers {
+		if state.URL != "" {
+			peers = append(peers, state.Peer)
+		}
+	}
+	m.mu.Unlock()
+
+	local := m.Local()
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			start := m.now()
+			health, err := m.postHealth(peer, local)
+			if err != nil {
+				log.Debugf("Mesh heartbeat to %s failed: %v", peer.ID, err)
+				heartbeats.WithLabelValues("error").Inc()
+			} else {
+				heartbeats.WithLabelValues("ok").Inc()
+			}
+			m.record(peer, health, m.now().Sub(start), err)
+		}(peer)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	healthy := 0
+	for _, state := range m.peers {
+		if m.usable(state) {
+			healthy++
+		}
+		peerHealth.WithLabelValues(state.ID).Set(boolGauge(m.usable(state)))
+	}
+	m.mu.Unlock()
+	healthyPeers.Set(float64(healthy))
+}
+
+func (m *Mesh) postHealth(peer Peer, local Health) (Health, error) {
+	body, err := json.Marshal(local)
+	if err != nil {
+		return Health{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(peer.URL, "/")+"/mesh/v1/health", bytes.NewReader(body))
+	if err != nil {
+		return Health{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+m.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return Health{}, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Health{}, fmt.Errorf("status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return Health{}, fmt.Errorf("failed to decode peer health: %w", err)
+	}
+	if health.ID != peer.ID && peer.ID != "" {
+		// A cluster URL answers with one of its headends
+		health.ID = peer.ID
+	}
+	return health, nil
+}
+
+// candidates returns the peers sessions can be relayed through, fastest
+// first
+func (m *Mesh) candidates() []*peerState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var usable []*peerState
+	for _, state := range m.peers {
+		if m.usable(state) {
+			usable = append(usable, state)
+		}
+	}
+	sort.Slice(usable, func(i, j int) bool {
+		if usable[i].latency != usable[j].latency {
+			return usable[i].latency < usable[j].latency
+		}
+		return usable[i].ID < usable[j].ID
+	})
+	return usable
+}
+
+// localFailing reports whether recent local dials failed, so sessions go
+// to peers first
+func (m *Mesh) localFailing() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.localFailures >= m.cfg.MaxLocalFailures
+}
+
+// preferPeers reports whether a session should try peers before dialing
+// locally
+func (m *Mesh) preferPeers() bool {
+	if m.cfg.LocalHealth != nil {
+		if healthy, _ := m.cfg.LocalHealth(); !healthy {
+			return true
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.localFailures < m.cfg.MaxLocalFailures {
+		return false
+	}
+	if now := m.now(); !now.Before(m.retryLocalAt) {
+		// Let this session find out whether local dials work again
+		m.retryLocalAt = now.Add(m.cfg.RetryLocal)
+		return false
+	}
+	return true
+}
+
+func (m *Mesh) localResult(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		if m.localFailures >= m.cfg.MaxLocalFailures {
+			log.Info("Upstream dials succeed again, ending mesh failover")
+		}
+		m.localFailures = 0
+		return
+	}
+	m.localFailures++
+	if m.localFailures == m.cfg.MaxLocalFailures {
+		m.retryLocalAt = m.now().Add(m.cfg.RetryLocal)
+		log.Warnf("Upstream dials failed %d times in a row, failing sessions over to mesh peers: %v", m.localFailures, err)
+	}
+}
+
+// Dial connects to target with dial, failing over to a healthy peer's
+// relay when the local dial fails, or first when upstream connectivity is
+// known to have failed. A nil mesh just dials target.
+func (m *Mesh) Dial(ctx context.Context, target string, dial func(ctx context.Context, address string) (net.Conn, error)) (net.Conn, error) {
+	if m == nil {
+		return dial(ctx, target)
+	}
+
+	if m.preferPeers() {
+		if conn, err := m.relay(ctx, target); err == nil {
+			return conn, nil
+		} else if ctx.Err() != nil {
+			return nil, err
+		}
+		// No peer could help; the local dial is all that's left
+		conn, err := dial(ctx, target)
+		if ctx.Err() == nil {
+			m.localResult(err)
+		}
+		return conn, err
+	}
+
+	conn, err := dial(ctx, target)
+	if err == nil || ctx.Err() != nil {
+		if err == nil {
+			m.localResult(nil)
+		}
+		return conn, err
+	}
+	m.localResult(err)
+
+	relayed, relayErr := m.relay(ctx, target)
+	if relayErr != nil {
+		if !errors.Is(relayErr, errNoPeers) {
+			log.Debugf("Mesh failover for %s failed: %v", target, relayErr)
+		}
+		return nil, err
+	}
+	return relayed, nil
+}
+
+// DialContext wraps next, the dialer of an HTTP transport, so its dials
+// fail over to peers too; nil next uses a plain dialer
+func (m *Mesh) DialContext(next func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if next == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		next = dialer.DialContext
+	}
+	if m == nil {
+		return next
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return m.Dial(ctx, address, func(ctx context.Context, address string) (net.Conn, error) {
+			return next(ctx, network, address)
+		})
+	}
+}
+
+// errNoPeers means no peer was healthy enough to relay through
+var errNoPeers = errors.New("no healthy mesh peer")
+
+// relay connects to target through the first peer that accepts it
+func (m *Mesh) relay(ctx context.Context, target string) (net.Conn, error) {
+	candidates := m.candidates()
+	if len(candidates) == 0 {
+		relays.WithLabelValues("", "no_peer").Inc()
+		return nil, errNoPeers
+	}
+
+	var lastErr error
+	for i, state := range candidates {
+		if i == maxRelayAttempts {
+			break
+		}
+		conn, err := dialRelay(ctx, state.URL, m.cfg.Token, m.cfg.ID, target)
+		if err == nil {
+			m.mu.Lock()
+			state.relayed++
+			m.mu.Unlock()
+			relays.WithLabelValues(state.ID, "ok").Inc()
+			if trace := flowtrace.FromContext(ctx); trace != nil {
+				trace.Record("mesh.relay", map[string]any{"peer": state.ID, "attempts": i + 1})
+			}
+			return conn, nil
+		}
+		relays.WithLabelValues(state.ID, "error").Inc()
+		lastErr = fmt.Errorf("relay through %s: %w", state.ID, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// Status reports this headend's mesh membership, or nil for a nil mesh
+func (m *Mesh) Status() *Status {
+	if m == nil {
+		return nil
+	}
+	local := m.Local()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := &Status{
+		ID:           m.cfg.ID,
+		Healthy:      local.Healthy,
+		LocalFailing: m.localFailures >= m.cfg.MaxLocalFailures,
+		Peers:        make([]PeerStatus, 0, len(m.peers)),
+	}
+	if !m.lastPeerList.IsZero() {
+		at := m.lastPeerList
+		status.LastPeerList = &at
+	}
+	if m.peerListErr != nil {
+		status.PeerListError = m.peerListErr.Error()
+	}
+	for _, state := range m.peers {
+		ps := PeerStatus{
+			Peer:      state.Peer,
+			Healthy:   m.usable(state),
+			Draining:  state.health.Draining,
+			LatencyMs: float64(state.latency.Microseconds()) / 1000,
+			Listed:    state.listed,
+			Relayed:   state.relayed,
+		}
+		if !state.lastSeen.IsZero() {
+			seen := state.lastSeen
+			ps.LastSeen = &seen
+		}
+		if state.lastErr != nil {
+			ps.LastError = state.lastErr.Error()
+		}
+		if ps.Healthy {
+			status.HealthyPeers++
+		}
+		status.Peers = append(status.Peers, ps)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].ID < status.Peers[j].ID })
+	return status
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,228 @@
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer accepts connections and echoes what it reads
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// peerServer runs a mesh member behind the routes the headend serves
+func peerServer(t *testing.T, peer *Mesh) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !peer.Authorized(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/mesh/v1/health":
+			var health Health
+			_ = json.NewDecoder(r.Body).Decode(&health)
+			local, err := peer.Exchange(health)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(local)
+		case "/mesh/v1/relay":
+			peer.ServeRelay(w, r, func(ctx context.Context, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "tcp", address)
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newMesh(t *testing.T, cfg Config) *Mesh {
+	t.Helper()
+	if cfg.Token == "" {
+		cfg.Token = "secret"
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func failingDial(ctx context.Context, address string) (net.Conn, error) {
+	return nil, errors.New("upstream unreachable")
+}
+
+func TestDialFailsOverToPeer(t *testing.T) {
+	target := echoServer(t)
+	peer := newMesh(t, Config{ID: "dc2"})
+	server := peerServer(t, peer)
+
+	local := newMesh(t, Config{ID: "dc1", URL: "http://dc1.example", Peers: []Peer{{ID: "dc2", URL: server.URL}}})
+	local.heartbeat()
+
+	if status := local.Status(); status.HealthyPeers != 1 {
+		t.Fatalf("expected the peer to be healthy, got %+v", status.Peers)
+	}
+	// The heartbeat registered us with the peer
+	if status := peer.Status(); len(status.Peers) != 1 || status.Peers[0].URL != "http://dc1.example" {
+		t.Errorf("expected the peer to know us, got %+v", status.Peers)
+	}
+
+	conn, err := local.Dial(context.Background(), target, failingDial)
+	if err != nil {
+		t.Fatalf("expected the dial to fail over, got %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the echo through the peer, got %q %v", buf, err)
+	}
+}
+
+func TestDialWithoutPeersReturnsLocalError(t *testing.T) {
+	local := newMesh(t, Config{ID: "dc1"})
+	if _, err := local.Dial(context.Background(), "127.0.0.1:1", failingDial); err == nil || err.Error() != "upstream unreachable" {
+		t.Errorf("expected the local error, got %v", err)
+	}
+
+	var nilMesh *Mesh
+	if _, err := nilMesh.Dial(context.Background(), "127.0.0.1:1", failingDial); err == nil {
+		t.Error("expected a nil mesh to just dial")
+	}
+}
+
+func TestLocalFailuresPreferPeers(t *testing.T) {
+	local := newMesh(t, Config{ID: "dc1", MaxLocalFailures: 2, RetryLocal: time.Minute})
+	now := time.Now()
+	local.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, _ = local.Dial(context.Background(), "127.0.0.1:1", failingDial)
+	}
+	if local.Local().Healthy {
+		t.Error("expected failing local dials to be advertised")
+	}
+	if !local.preferPeers() {
+		t.Error("expected sessions to go to peers first")
+	}
+
+	// After RetryLocal one session tries locally again
+	now = now.Add(time.Minute)
+	if local.preferPeers() {
+		t.Error("expected a local retry")
+	}
+	local.localResult(nil)
+	if !local.Local().Healthy || local.preferPeers() {
+		t.Error("expected a successful local dial to end the failover")
+	}
+}
+
+func TestUnhealthyPeerRefusesRelay(t *testing.T) {
+	target := echoServer(t)
+	healthy := true
+	peer := newMesh(t, Config{ID: "dc2", LocalHealth: func() (bool, bool) { return healthy, false }})
+	server := peerServer(t, peer)
+
+	local := newMesh(t, Config{ID: "dc1", Peers: []Peer{{ID: "dc2", URL: server.URL}}})
+	local.heartbeat()
+
+	healthy = false
+	if _, err := dialRelay(context.Background(), server.URL, "secret", "dc1", target); err == nil {
+		t.Error("expected an unhealthy peer to refuse relays")
+	}
+
+	// Its next heartbeat takes it out of the candidates
+	local.heartbeat()
+	if len(local.candidates()) != 0 {
+		t.Error("expected no candidates after the peer reported unhealthy")
+	}
+	if _, err := dialRelay(context.Background(), server.URL, "wrong", "dc1", target); err == nil {
+		t.Error("expected a wrong token to be rejected")
+	}
+}
+
+func TestStalePeerIsNotUsed(t *testing.T) {
+	local := newMesh(t, Config{ID: "dc1", HeartbeatInterval: time.Second})
+	now := time.Now()
+	local.now = func() time.Time { return now }
+
+	if _, err := local.Exchange(Health{ID: "dc2", URL: "http://dc2.example", Healthy: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(local.candidates()) != 1 {
+		t.Fatal("expected the registered peer to be a candidate")
+	}
+	now = now.Add(staleHeartbeats * time.Second)
+	if len(local.candidates()) != 0 {
+		t.Error("expected a silent peer to go stale")
+	}
+	if _, err := local.Exchange(Health{}); err == nil {
+		t.Error("expected a health without ID to be rejected")
+	}
+}
+
+func TestRefreshPeers(t *testing.T) {
+	manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/headend/mesh/peers" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("cluster_id") != "c1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"peers": [{"id": "c2", "url": "https://c2.example", "region": "eu"}, {"id": "dc1", "url": "https://self.example"}]}`))
+	}))
+	defer manager.Close()
+
+	local := newMesh(t, Config{ID: "dc1", ClusterID: "c1", ManagerURL: manager.URL, AuthToken: "token"})
+	local.refreshPeers()
+
+	status := local.Status()
+	if status.PeerListError != "" || len(status.Peers) != 1 || status.Peers[0].ID != "c2" || !status.Peers[0].Listed {
+		t.Fatalf("unexpected peers %+v (error %q)", status.Peers, status.PeerListError)
+	}
+
+	// A failed fetch keeps the peers we have
+	local.cfg.AuthToken = "wrong"
+	local.refreshPeers()
+	if status := local.Status(); status.PeerListError == "" || len(status.Peers) != 1 {
+		t.Errorf("expected the peers kept with the error reported, got %+v", status)
+	}
+}
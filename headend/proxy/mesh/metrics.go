@@ -0,0 +1,33 @@
+package mesh
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	healthyPeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_mesh_peers_healthy",
+		Help: "Number of mesh peers sessions can currently fail over to.",
+	})
+
+	peerHealth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_mesh_peer_healthy",
+		Help: "Whether each mesh peer can currently relay sessions (1) or not (0).",
+	}, []string{"peer"})
+
+	heartbeats = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_mesh_heartbeats_total",
+		Help: "Total number of health exchanges with mesh peers by result.",
+	}, []string{"result"})
+
+	relays = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_mesh_relays_total",
+		Help: "Total number of sessions failed over to mesh peers by peer and result.",
+	}, []string{"peer", "result"})
+
+	relaysServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_mesh_relays_served_total",
+		Help: "Total number of relay requests from mesh peers by result.",
+	}, []string{"result"})
+)
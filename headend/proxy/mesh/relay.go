@@ -0,0 +1,163 @@
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/protocol"
+)
+
+// relayProtocol is the Upgrade token of relayed sessions
+const relayProtocol = "sasewaddle-mesh"
+
+// relayDialTimeout bounds connecting to a peer and its answer
+const relayDialTimeout = 10 * time.Second
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialRelay asks the peer at peerURL to connect to target and returns the
+// tunnel once the peer has
+func dialRelay(ctx context.Context, peerURL, token, origin, target string) (net.Conn, error) {
+	u, err := url.Parse(peerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer URL: %w", err)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, relayDialTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	if u.Scheme == "https" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The answer must arrive in time too; the tunnel itself has no deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	path := strings.TrimSuffix(u.Path, "/") + "/mesh/v1/relay?" + url.Values{"target": {target}}.Encode()
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + relayProtocol + "\r\n" +
+		"Authorization: Bearer " + token + "\r\n" +
+		"X-Mesh-Origin: " + origin + "\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read relay response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = resp.Body.Close()
+		_ = conn.Close()
+		return nil, fmt.Errorf("peer answered with status %d", resp.StatusCode)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, r: reader}, nil
+}
+
+// ServeRelay serves a peer's relay request: it connects to the requested
+// target with dial and tunnels the hijacked connection to it. The caller
+// authenticates the peer. Relays are refused while this headend's own
+// upstream connectivity has failed, and dial must only dial locally, so a
+// session is never relayed twice.
+func (m *Mesh) ServeRelay(w http.ResponseWriter, r *http.Request, dial func(ctx context.Context, address string) (net.Conn, error)) {
+	origin := r.Header.Get("X-Mesh-Origin")
+	target := r.URL.Query().Get("target")
+	if target == "" || !strings.EqualFold(r.Header.Get("Upgrade"), relayProtocol) {
+		relaysServed.WithLabelValues("invalid").Inc()
+		http.Error(w, "Invalid relay request", http.StatusBadRequest)
+		return
+	}
+	if local := m.Local(); !local.Healthy || local.Draining {
+		relaysServed.WithLabelValues("unavailable").Inc()
+		http.Error(w, "Upstream connectivity unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	targetConn, err := dial(r.Context(), target)
+	if err != nil {
+		log.Warnf("Mesh relay from %s to %s failed: %v", origin, target, err)
+		relaysServed.WithLabelValues("dial_error").Inc()
+		http.Error(w, "Failed to connect to target", http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		_ = targetConn.Close()
+	}()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		relaysServed.WithLabelValues("error").Inc()
+		http.Error(w, "Relay not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Failed to hijack mesh relay connection: %v", err)
+		relaysServed.WithLabelValues("error").Inc()
+		return
+	}
+	defer func() {
+		_ = clientConn.Close()
+	}()
+
+	// The server's read and write timeouts must not cut long-lived tunnels
+	if err := clientConn.SetDeadline(time.Time{}); err != nil {
+		log.Debugf("Error clearing mesh relay deadlines: %v", err)
+	}
+	if _, err := clientConn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + relayProtocol + "\r\n\r\n")); err != nil {
+		relaysServed.WithLabelValues("error").Inc()
+		return
+	}
+	relaysServed.WithLabelValues("ok").Inc()
+	log.Debugf("Relaying session from mesh peer %s to %s", origin, target)
+
+	initial, _ := buffered.Reader.Peek(buffered.Reader.Buffered())
+	if _, _, err := protocol.Relay(clientConn, targetConn, initial, nil); err != nil {
+		log.Debugf("Mesh relay from %s to %s ended: %v", origin, target, err)
+	}
+}
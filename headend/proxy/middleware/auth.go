@@ -7,10 +7,12 @@
 //
 // The middleware integrates with various authentication providers (JWT, SAML2, OAuth2)
 // and enforces access controls before requests are proxied to backend services.
-// All authentication events are logged for security auditing.
+// All authentication events are logged for security auditing, and failures
+// are counted in headend_denied_requests_total.
 package middleware
 
 import (
+    "crypto/x509"
     "net/http"
     "strings"
 
@@ -18,6 +20,7 @@ import (
     log "github.com/sirupsen/logrus"
 
     "github.com/tobogganing/headend/proxy/auth"
+    "github.com/tobogganing/headend/proxy/connctx"
 )
 
 // AuthRequired middleware validates both certificate and JWT/SSO authentication
@@ -29,57 +32,159 @@ func AuthRequired(authProvider auth.Provider) gin.HandlerFunc {
         // Step 1: Verify client certificate (already handled by TLS)
         // The certificate validation happens at the TLS layer
         
-        // Step 2: Verify JWT or SSO authentication  
-        authHeader := c.GetHeader("Authorization")
-        if authHeader == "" {
-            log.Warn("Missing Authorization header")
+        // Step 2: Verify JWT or SSO authentication
+        if _, ok := authenticate(c, authProvider); !ok {
+            return
+        }
+        c.Next()
+    }
+}
+
+// DualAuthRequired is AuthRequired for mTLS listeners. The request must
+// carry a client certificate verified against the Manager CA, and the
+// certificate must name the same identity as the JWT/SSO token.
+func DualAuthRequired(authProvider auth.Provider) gin.HandlerFunc {
+    return DualAuthWithGrace(authProvider, nil, nil)
+}
+
+// CertificateHook is told, after dual authentication succeeds, whether the
+// user's client certificate is expired but within the grace period
+type CertificateHook func(user *auth.User, cert *x509.Certificate, expired bool)
+
+// DualAuthWithGrace is DualAuthRequired for mTLS listeners that accept
+// client certificates within an expiry grace period. The TLS layer leaves
+// verification to verifier, which is consulted again on every request as
+// connections outlive certificates. A nil verifier requires certificates
+// verified by the TLS layer, as DualAuthRequired does.
+func DualAuthWithGrace(authProvider auth.Provider, verifier *auth.CertVerifier, hook CertificateHook) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        // Step 1: Require a client certificate that passed TLS verification
+        var cert *x509.Certificate
+        if c.Request.TLS != nil {
+            if verifier == nil && len(c.Request.TLS.VerifiedChains) > 0 {
+                cert = c.Request.TLS.VerifiedChains[0][0]
+            } else if verifier != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+                cert = c.Request.TLS.PeerCertificates[0]
+            }
+        }
+        if cert == nil {
+            log.Warn("Missing client certificate")
+            connctx.RecordDenial("HTTP", connctx.DenyCertificate)
             c.JSON(http.StatusUnauthorized, gin.H{
-                "error": "Authorization required",
+                "error": "Client certificate required",
                 "message": "Both client certificate and JWT/SSO authentication required",
             })
             c.Abort()
             return
         }
         
-        var token string
-        if strings.HasPrefix(authHeader, "Bearer ") {
-            token = authHeader[7:] // Remove 'Bearer ' prefix
-        } else {
-            log.Warn("Invalid Authorization header format")
-            c.JSON(http.StatusUnauthorized, gin.H{
-                "error": "Invalid authorization format", 
-                "message": "Expected 'Bearer <token>'",
-            })
-            c.Abort()
+        expired := false
+        if verifier != nil {
+            var withinGrace bool
+            expired, withinGrace = verifier.Expired(cert)
+            if !withinGrace {
+                log.Warnf("Client certificate %q expired past the grace period", cert.Subject.CommonName)
+                connctx.RecordDenial("HTTP", connctx.DenyCertificate)
+                c.JSON(http.StatusUnauthorized, gin.H{
+                    "error": "Client certificate expired",
+                    "message": "Client certificate expired beyond the renewal grace period",
+                })
+                c.Abort()
+                return
+            }
+        }
+        
+        // Step 2: Verify JWT or SSO authentication
+        user, ok := authenticate(c, authProvider)
+        if !ok {
             return
         }
         
-        // Validate the token using the configured auth provider (JWT/SSO)
-        user, err := authProvider.ValidateToken(token)
-        if err != nil {
-            log.Errorf("Authentication failed: %v", err)
-            c.JSON(http.StatusUnauthorized, gin.H{
-                "error": "Authentication failed",
-                "message": err.Error(),
+        // Step 3: Bind the certificate identity to the token identity
+        if err := auth.BindCertificate(cert, user); err != nil {
+            log.Warnf("Dual authentication failed: %v", err)
+            connctx.RecordDenial("HTTP", connctx.DenyCertificate)
+            c.JSON(http.StatusForbidden, gin.H{
+                "error": "Certificate identity mismatch",
+                "message": "Client certificate does not match the authenticated user",
             })
             c.Abort()
             return
         }
         
-        // Store user information in context
-        c.Set("user", user)
-        c.Set("user_id", user.ID)
-        
-        // Extract permissions from metadata
-        if permissions, ok := user.Metadata["permissions"]; ok {
-            c.Set("permissions", permissions)
+        if hook != nil {
+            hook(user, cert, expired)
+        }
+        if expired {
+            // Tell the client why it only reaches the renewal endpoints
+            c.Header("X-Certificate-Status", "expired")
         }
         
-        log.Infof("User authenticated: %s (name: %s)", user.ID, user.Name)
+        c.Set("client_certificate", cert.Subject.CommonName)
+        c.Set("client_cert_expired", expired)
         c.Next()
     }
 }
 
+// authenticate validates the request's bearer token and stores the user in
+// the context. On failure it writes the error response, aborts and returns false.
+func authenticate(c *gin.Context, authProvider auth.Provider) (*auth.User, bool) {
+    authHeader := c.GetHeader("Authorization")
+    if authHeader == "" && c.Request.Method == http.MethodConnect {
+        // Proxy clients send CONNECT credentials in Proxy-Authorization
+        authHeader = c.GetHeader("Proxy-Authorization")
+    }
+    if authHeader == "" {
+        log.Warn("Missing Authorization header")
+        connctx.RecordDenial("HTTP", connctx.DenyAuth)
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "error": "Authorization required",
+            "message": "Both client certificate and JWT/SSO authentication required",
+        })
+        c.Abort()
+        return nil, false
+    }
+    
+    var token string
+    if strings.HasPrefix(authHeader, "Bearer ") {
+        token = authHeader[7:] // Remove 'Bearer ' prefix
+    } else {
+        log.Warn("Invalid Authorization header format")
+        connctx.RecordDenial("HTTP", connctx.DenyAuth)
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "error": "Invalid authorization format", 
+            "message": "Expected 'Bearer <token>'",
+        })
+        c.Abort()
+        return nil, false
+    }
+    
+    // Validate the token using the configured auth provider (JWT/SSO)
+    user, err := authProvider.ValidateToken(token)
+    if err != nil {
+        log.Errorf("Authentication failed: %v", err)
+        connctx.RecordDenial("HTTP", connctx.DenyAuth)
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "error": "Authentication failed",
+            "message": err.Error(),
+        })
+        c.Abort()
+        return nil, false
+    }
+    
+    // Store user information in context
+    c.Set("user", user)
+    c.Set("user_id", user.ID)
+    
+    // Extract permissions from metadata
+    if permissions, ok := user.Metadata["permissions"]; ok {
+        c.Set("permissions", permissions)
+    }
+    
+    log.Infof("User authenticated: %s (name: %s)", user.ID, user.Name)
+    return user, true
+}
+
 // PermissionRequired middleware checks if user has required permissions
 func PermissionRequired(requiredPermissions ...string) gin.HandlerFunc {
     return func(c *gin.Context) {
@@ -21,13 +21,19 @@ var (
     }, []string{"path", "method", "status"})
 )
 
+// Metrics records the duration and count of HTTP requests. Requests are
+// labeled by route template rather than raw path, so proxied URLs and
+// scanners probing random paths don't create a series each.
 func Metrics() gin.HandlerFunc {
     return func(c *gin.Context) {
-        path := c.Request.URL.Path
         start := time.Now()
         
         c.Next()
         
+        path := c.FullPath()
+        if path == "" {
+            path = "unmatched"
+        }
         status := strconv.Itoa(c.Writer.Status())
         elapsed := time.Since(start).Seconds()
         
@@ -0,0 +1,23 @@
+package migration
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	migratingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_migration_active",
+		Help: "1 while this headend is migrating its clients to a peer, 0 otherwise.",
+	})
+
+	ticketsIssued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_migration_tickets_issued_total",
+		Help: "Total migration tickets issued to clients of this headend.",
+	})
+
+	ticketsRedeemed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_migration_tickets_redeemed_total",
+		Help: "Total migration tickets presented to this headend, by result.",
+	}, []string{"result"})
+)
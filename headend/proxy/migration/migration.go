@@ -0,0 +1,219 @@
+// Package migration implements session migration between headends for the
+// SASEWaddle headend proxy.
+//
+// The migration package provides:
+//   - Migration directives that tell connected clients, over the session
+//     control endpoint, which peer headend to move to and by when
+//   - One-time tickets that carry a user's quota state from the draining
+//     headend to the peer through a shared store
+//   - Redemption of tickets on the peer, restoring that state before the
+//     client cuts its tunnel over
+//
+// Migration complements draining: instead of waiting for sessions to end,
+// the draining headend hands its clients to a designated peer, so users see
+// a brief reconnect rather than a dropped tunnel, and can't reset their
+// rate limit by being moved.
+package migration
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/ratelimit"
+)
+
+const (
+	ActionNone    = "none"
+	ActionMigrate = "migrate"
+
+	// DefaultTicketTTL bounds how long a ticket waits in the store for the
+	// client to redeem it
+	DefaultTicketTTL = 5 * time.Minute
+)
+
+// ErrTicketNotFound means a ticket was never issued, already redeemed or
+// expired
+var ErrTicketNotFound = errors.New("migration ticket not found")
+
+// Peer describes the headend clients migrate to
+type Peer struct {
+	URL string `json:"url"`
+	// Endpoint is the peer's WireGuard endpoint (host:port)
+	Endpoint  string `json:"endpoint"`
+	PublicKey string `json:"public_key"`
+}
+
+// Directive is the control message a client polls for
+type Directive struct {
+	Action    string    `json:"action"`
+	Peer      *Peer     `json:"peer,omitempty"`
+	Ticket    string    `json:"ticket,omitempty"`
+	CutoverBy time.Time `json:"cutover_by,omitempty"`
+}
+
+// UserState is the per-user state carried by a ticket
+type UserState struct {
+	UserID string `json:"user_id"`
+	// RateLimitTokens is the user's bucket level, absent for unlimited users
+	RateLimitTokens *float64  `json:"rate_limit_tokens,omitempty"`
+	IssuedAt        time.Time `json:"issued_at"`
+}
+
+// Store holds tickets where both headends can reach them
+type Store interface {
+	Put(ctx context.Context, ticket string, state *UserState, ttl time.Duration) error
+	// Take returns and removes a ticket, or ErrTicketNotFound
+	Take(ctx context.Context, ticket string) (*UserState, error)
+}
+
+// Status reports migration progress for health checks
+type Status struct {
+	Migrating       bool      `json:"migrating"`
+	Peer            string    `json:"peer,omitempty"`
+	CutoverBy       time.Time `json:"cutover_by,omitempty"`
+	TicketsIssued   int       `json:"tickets_issued"`
+	TicketsRedeemed int       `json:"tickets_redeemed"`
+}
+
+// Coordinator issues tickets while this headend migrates its clients away
+// and redeems tickets from other headends
+type Coordinator struct {
+	store     Store
+	limiter   *ratelimit.Limiter
+	ticketTTL time.Duration
+	peer      *Peer
+	cutoverBy time.Time
+	issued    int
+	redeemed  int
+	mu        sync.Mutex
+}
+
+// NewCoordinator creates a coordinator that keeps tickets in store and
+// transfers the usage tracked by limiter, which may be nil
+func NewCoordinator(store Store, limiter *ratelimit.Limiter, ticketTTL time.Duration) *Coordinator {
+	if ticketTTL <= 0 {
+		ticketTTL = DefaultTicketTTL
+	}
+	return &Coordinator{
+		store:     store,
+		limiter:   limiter,
+		ticketTTL: ticketTTL,
+	}
+}
+
+// Begin starts directing clients to peer, asking them to cut over before
+// cutoverBy. It returns false if a migration is already underway.
+func (c *Coordinator) Begin(peer Peer, cutoverBy time.Time) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.peer != nil {
+		return false
+	}
+	c.peer = &peer
+	c.cutoverBy = cutoverBy
+	migratingGauge.Set(1)
+	return true
+}
+
+// Directive returns the control message for userID. While migrating it
+// snapshots the user's state into a fresh ticket.
+func (c *Coordinator) Directive(ctx context.Context, userID string) (*Directive, error) {
+	if c == nil {
+		return &Directive{Action: ActionNone}, nil
+	}
+
+	c.mu.Lock()
+	peer, cutoverBy := c.peer, c.cutoverBy
+	c.mu.Unlock()
+
+	if peer == nil {
+		return &Directive{Action: ActionNone}, nil
+	}
+
+	ticket, err := newTicket()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &UserState{UserID: userID, IssuedAt: time.Now().UTC()}
+	if tokens, ok := c.limiter.Tokens(userID); ok {
+		state.RateLimitTokens = &tokens
+	}
+	if err := c.store.Put(ctx, ticket, state, c.ticketTTL); err != nil {
+		return nil, fmt.Errorf("failed to store migration ticket: %w", err)
+	}
+
+	c.mu.Lock()
+	c.issued++
+	c.mu.Unlock()
+	ticketsIssued.Inc()
+
+	return &Directive{Action: ActionMigrate, Peer: peer, Ticket: ticket, CutoverBy: cutoverBy}, nil
+}
+
+// Redeem takes a ticket issued by another headend and restores its state
+// for userID. A ticket issued to a different user is rejected and consumed.
+func (c *Coordinator) Redeem(ctx context.Context, userID, ticket string) (*UserState, error) {
+	if c == nil {
+		return nil, ErrTicketNotFound
+	}
+
+	state, err := c.store.Take(ctx, ticket)
+	if err != nil {
+		ticketsRedeemed.WithLabelValues("not_found").Inc()
+		return nil, err
+	}
+	if state.UserID != userID {
+		ticketsRedeemed.WithLabelValues("wrong_user").Inc()
+		return nil, fmt.Errorf("migration ticket was issued to another user")
+	}
+
+	if state.RateLimitTokens != nil {
+		c.limiter.SetTokens(userID, *state.RateLimitTokens)
+	}
+
+	c.mu.Lock()
+	c.redeemed++
+	c.mu.Unlock()
+	ticketsRedeemed.WithLabelValues("ok").Inc()
+	return state, nil
+}
+
+// Status returns a snapshot of migration progress
+func (c *Coordinator) Status() *Status {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := &Status{
+		Migrating:       c.peer != nil,
+		CutoverBy:       c.cutoverBy,
+		TicketsIssued:   c.issued,
+		TicketsRedeemed: c.redeemed,
+	}
+	if c.peer != nil {
+		status.Peer = c.peer.URL
+	}
+	return status
+}
+
+func newTicket() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate migration ticket: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,135 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/ratelimit"
+)
+
+// memoryStore stands in for the Manager in tests
+type memoryStore struct {
+	tickets map[string]*UserState
+	mu      sync.Mutex
+}
+
+func (s *memoryStore) Put(_ context.Context, ticket string, state *UserState, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickets[ticket] = state
+	return nil
+}
+
+func (s *memoryStore) Take(_ context.Context, ticket string) (*UserState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.tickets[ticket]
+	if !ok {
+		return nil, ErrTicketNotFound
+	}
+	delete(s.tickets, ticket)
+	return state, nil
+}
+
+func newLimiter() *ratelimit.Limiter {
+	l := ratelimit.NewLimiter("", "")
+	l.Apply(ratelimit.LimitsResponse{Default: ratelimit.Limit{BytesPerSecond: 1000}})
+	return l
+}
+
+func TestMigrationCarriesUsage(t *testing.T) {
+	store := &memoryStore{tickets: make(map[string]*UserState)}
+	ctx := context.Background()
+
+	draining := NewCoordinator(store, newLimiter(), 0)
+	if d, err := draining.Directive(ctx, "alice"); err != nil || d.Action != ActionNone {
+		t.Fatalf("directive before migration = %+v, %v", d, err)
+	}
+
+	// alice has used her whole burst on the draining headend
+	drainingLimiter := draining.limiter
+	if !drainingLimiter.Allow("alice", 1000) {
+		t.Fatal("burst was not available")
+	}
+
+	peer := Peer{URL: "https://peer.example.com", Endpoint: "peer.example.com:51820", PublicKey: "key"}
+	if !draining.Begin(peer, time.Now().Add(time.Minute)) || draining.Begin(peer, time.Now()) {
+		t.Fatal("Begin should only succeed once")
+	}
+
+	d, err := draining.Directive(ctx, "alice")
+	if err != nil || d.Action != ActionMigrate || d.Peer.URL != peer.URL || d.Ticket == "" {
+		t.Fatalf("directive while migrating = %+v, %v", d, err)
+	}
+
+	target := NewCoordinator(store, newLimiter(), 0)
+	if _, err := target.Redeem(ctx, "bob", d.Ticket); err == nil {
+		t.Fatal("expected another user's ticket to be rejected")
+	}
+
+	d, _ = draining.Directive(ctx, "alice")
+	state, err := target.Redeem(ctx, "alice", d.Ticket)
+	if err != nil || state.RateLimitTokens == nil {
+		t.Fatalf("Redeem = %+v, %v", state, err)
+	}
+	if target.limiter.Allow("alice", 500) {
+		t.Error("alice's exhausted bucket was reset by migrating")
+	}
+
+	if _, err := target.Redeem(ctx, "alice", d.Ticket); !errors.Is(err, ErrTicketNotFound) {
+		t.Errorf("second redemption = %v, want ErrTicketNotFound", err)
+	}
+
+	if status := draining.Status(); !status.Migrating || status.TicketsIssued != 2 {
+		t.Errorf("unexpected draining status %+v", status)
+	}
+}
+
+func TestManagerStore(t *testing.T) {
+	var stored []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v1/headend/migrations/t1":
+			var body struct {
+				State      json.RawMessage `json:"state"`
+				TTLSeconds int             `json:"ttl_seconds"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body.TTLSeconds != 60 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			stored = body.State
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/t1/redeem") && stored != nil:
+			_, _ = w.Write([]byte(`{"state":` + string(stored) + `}`))
+			stored = nil
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	store := NewManagerStore(server.URL, "token")
+	ctx := context.Background()
+	if err := store.Put(ctx, "t1", &UserState{UserID: "alice"}, time.Minute); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	state, err := store.Take(ctx, "t1")
+	if err != nil || state.UserID != "alice" {
+		t.Fatalf("Take = %+v, %v", state, err)
+	}
+	if _, err := store.Take(ctx, "t1"); !errors.Is(err, ErrTicketNotFound) {
+		t.Fatalf("second Take = %v, want ErrTicketNotFound", err)
+	}
+}
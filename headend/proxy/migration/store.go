@@ -0,0 +1,106 @@
+package migration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ManagerStore keeps tickets in the Manager, which every headend of a
+// cluster can reach
+type ManagerStore struct {
+	managerURL string
+	authToken  string
+	client     *http.Client
+}
+
+// NewManagerStore creates a store backed by the Manager's migration API
+func NewManagerStore(managerURL, authToken string) *ManagerStore {
+	return &ManagerStore{
+		managerURL: managerURL,
+		authToken:  authToken,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Put stores a ticket for ttl
+func (s *ManagerStore) Put(ctx context.Context, ticket string, state *UserState, ttl time.Duration) error {
+	body, err := json.Marshal(struct {
+		State      *UserState `json:"state"`
+		TTLSeconds int        `json:"ttl_seconds"`
+	}{state, int(ttl.Seconds())})
+	if err != nil {
+		return fmt.Errorf("failed to encode migration ticket: %w", err)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.ticketURL(ticket), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer s.close(resp)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to store migration ticket: status %d, body: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Take redeems a ticket; the Manager deletes it as it is returned
+func (s *ManagerStore) Take(ctx context.Context, ticket string) (*UserState, error) {
+	resp, err := s.do(ctx, http.MethodPost, s.ticketURL(ticket)+"/redeem", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrTicketNotFound
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to redeem migration ticket: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var redeemed struct {
+		State UserState `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&redeemed); err != nil {
+		return nil, fmt.Errorf("failed to decode migration ticket: %w", err)
+	}
+	return &redeemed.State, nil
+}
+
+func (s *ManagerStore) ticketURL(ticket string) string {
+	return s.managerURL + "/api/v1/headend/migrations/" + url.PathEscape(ticket)
+}
+
+func (s *ManagerStore) do(ctx context.Context, method, target string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.authToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("migration store request failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (s *ManagerStore) close(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %v", err)
+	}
+}
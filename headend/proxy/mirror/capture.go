@@ -0,0 +1,257 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    captureSuffix = ".pcapng"
+    // partialSuffix marks the file being written, so readers of the
+    // directory only pick up finished captures
+    partialSuffix = ".part"
+
+    defaultCaptureFileSize = 100 << 20
+    defaultCaptureInterval = time.Hour
+
+    // captureTick is how often open captures are flushed to disk and
+    // checked for rotation
+    captureTick = 5 * time.Second
+
+    // uploadRetry is how long a failed upload waits before the next attempt
+    uploadRetry = time.Minute
+)
+
+// isCaptureDestination reports whether dest is written as pcapng files
+// rather than sent to a collector
+func isCaptureDestination(dest string) bool {
+    return strings.HasPrefix(dest, "file://") || strings.HasPrefix(dest, "s3://")
+}
+
+// capture writes mirrored packets to rotating pcapng files in a directory
+// and, for s3:// destinations, uploads each file once it is rotated out
+type capture struct {
+    dest     string
+    dir      string
+    config   CaptureConfig
+    uploader *s3Uploader
+
+    mu         sync.Mutex
+    file       *os.File
+    buffer     *bufio.Writer
+    writer     *pcapngWriter
+    opened     time.Time
+    sequence   int
+    pending    []string // finished files awaiting upload
+    nextUpload time.Time
+}
+
+func newCapture(dest string, config CaptureConfig) (*capture, error) {
+    u, err := url.Parse(dest)
+    if err != nil {
+        return nil, fmt.Errorf("invalid capture destination %q: %w", dest, err)
+    }
+
+    if config.MaxFileSize <= 0 {
+        config.MaxFileSize = defaultCaptureFileSize
+    }
+    if config.RotateInterval <= 0 {
+        config.RotateInterval = defaultCaptureInterval
+    }
+    if config.SpoolDir == "" {
+        config.SpoolDir = filepath.Join(os.TempDir(), "headend-captures")
+    }
+
+    c := &capture{dest: dest, config: config}
+    switch u.Scheme {
+    case "file":
+        c.dir = u.Path
+    case "s3":
+        if u.Host == "" {
+            return nil, fmt.Errorf("invalid capture destination %q: missing bucket", dest)
+        }
+        c.dir = filepath.Join(config.SpoolDir, u.Host)
+        c.uploader = newS3Uploader(config.S3, u.Host, u.Path)
+    }
+    if c.dir == "" {
+        return nil, fmt.Errorf("invalid capture destination %q: missing directory", dest)
+    }
+    if err := os.MkdirAll(c.dir, 0o750); err != nil {
+        return nil, fmt.Errorf("failed to create capture directory: %w", err)
+    }
+
+    // Finish the files a previous run left behind, so they are kept and,
+    // for s3:// destinations, uploaded
+    partials, _ := filepath.Glob(filepath.Join(c.dir, "*"+captureSuffix+partialSuffix))
+    for _, partial := range partials {
+        if err := os.Rename(partial, strings.TrimSuffix(partial, partialSuffix)); err != nil {
+            log.Warnf("Failed to finish capture %s: %v", partial, err)
+        }
+    }
+    if c.uploader != nil {
+        c.pending, _ = filepath.Glob(filepath.Join(c.dir, "*"+captureSuffix))
+    }
+    return c, nil
+}
+
+// write appends packet to the current file, opening one if needed, and
+// returns the number of bytes written
+func (c *capture) write(packet *MirrorPacket) (int64, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.writer == nil {
+        if err := c.open(); err != nil {
+            return 0, err
+        }
+    }
+
+    before := c.writer.written
+    err := c.writer.writePacket(packet)
+    written := c.writer.written - before
+    if err == nil && c.writer.written >= c.config.MaxFileSize {
+        err = c.rotate()
+    }
+    return written, err
+}
+
+func (c *capture) open() error {
+    c.opened = time.Now()
+
+    var file *os.File
+    for {
+        // The sequence keeps names unique within a second; files left by
+        // a previous run are skipped
+        c.sequence++
+        name := fmt.Sprintf("headend-%s-%d%s%s", c.opened.UTC().Format("20060102T150405Z"), c.sequence, captureSuffix, partialSuffix)
+        var err error
+        file, err = os.OpenFile(filepath.Join(c.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+        if err == nil {
+            break
+        }
+        if !os.IsExist(err) {
+            return fmt.Errorf("failed to create capture file: %w", err)
+        }
+    }
+    buffer := bufio.NewWriterSize(file, 64<<10)
+    writer, err := newPcapngWriter(buffer)
+    if err != nil {
+        file.Close()
+        os.Remove(file.Name())
+        return err
+    }
+
+    c.file, c.buffer, c.writer = file, buffer, writer
+    return nil
+}
+
+// rotate finishes the current file. The caller holds c.mu.
+func (c *capture) rotate() error {
+    file := c.file
+    err := c.buffer.Flush()
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    c.file, c.buffer, c.writer = nil, nil, nil
+    if err != nil {
+        captureFiles.WithLabelValues("failed").Inc()
+        return fmt.Errorf("failed to finish capture file: %w", err)
+    }
+
+    finished := strings.TrimSuffix(file.Name(), partialSuffix)
+    if err := os.Rename(file.Name(), finished); err != nil {
+        captureFiles.WithLabelValues("failed").Inc()
+        return fmt.Errorf("failed to finish capture file: %w", err)
+    }
+    captureFiles.WithLabelValues("written").Inc()
+    log.Debugf("Finished capture %s", finished)
+
+    if c.uploader != nil {
+        c.pending = append(c.pending, finished)
+    }
+    return nil
+}
+
+// tick flushes the current file, rotates it once it is old enough and
+// uploads the finished files
+func (c *capture) tick(now time.Time) {
+    c.mu.Lock()
+    if c.writer != nil {
+        var err error
+        if now.Sub(c.opened) >= c.config.RotateInterval {
+            err = c.rotate()
+        } else {
+            err = c.buffer.Flush()
+        }
+        if err != nil {
+            log.Errorf("Capture %s: %v", c.dest, err)
+        }
+    }
+    c.mu.Unlock()
+
+    c.upload(now, false)
+}
+
+// upload puts the pending files into the bucket in order, deleting each
+// local copy once it is stored. After a failure the rest wait for
+// uploadRetry unless force is set.
+func (c *capture) upload(now time.Time, force bool) {
+    if c.uploader == nil {
+        return
+    }
+
+    c.mu.Lock()
+    if !force && now.Before(c.nextUpload) {
+        c.mu.Unlock()
+        return
+    }
+    pending := append([]string(nil), c.pending...)
+    c.mu.Unlock()
+
+    uploaded := 0
+    for _, path := range pending {
+        if err := c.uploader.upload(context.Background(), path); err != nil {
+            captureFiles.WithLabelValues("upload_failed").Inc()
+            log.Errorf("Failed to upload capture %s to %s: %v", filepath.Base(path), c.dest, err)
+            break
+        }
+        captureFiles.WithLabelValues("uploaded").Inc()
+        if err := os.Remove(path); err != nil {
+            log.Warnf("Failed to remove uploaded capture %s: %v", path, err)
+        }
+        uploaded++
+    }
+
+    c.mu.Lock()
+    // Files rotated out during the upload were appended behind these
+    c.pending = c.pending[uploaded:]
+    if uploaded < len(pending) {
+        c.nextUpload = now.Add(uploadRetry)
+    }
+    c.mu.Unlock()
+}
+
+// close finishes the current file and makes a last attempt to upload the
+// pending ones. Files that still fail are uploaded by the next run.
+func (c *capture) close() {
+    c.mu.Lock()
+    if c.writer != nil {
+        if err := c.rotate(); err != nil {
+            log.Errorf("Capture %s: %v", c.dest, err)
+        }
+    }
+    c.mu.Unlock()
+
+    c.upload(time.Now(), true)
+}
@@ -0,0 +1,68 @@
+package mirror
+
+import "time"
+
+// CaptureConfig configures the pcapng capture destinations. A destination
+// of file:///dir writes captures into dir; s3://bucket/prefix writes them
+// into SpoolDir and uploads each file once it is rotated out.
+type CaptureConfig struct {
+    MaxFileSize    int64         // rotate once a file reaches this many bytes
+    RotateInterval time.Duration // rotate files older than this
+    SpoolDir       string        // local staging for s3:// destinations
+    S3             S3Config
+}
+
+// S3Config locates and authenticates against an S3-compatible bucket.
+// Requests are path-style, which every S3-compatible store accepts.
+type S3Config struct {
+    Endpoint  string // e.g. https://minio.internal:9000; empty means AWS
+    Region    string
+    AccessKey string
+    SecretKey string
+}
+
+// KafkaConfig configures the kafka:// destinations, which publish each
+// mirrored packet's metadata, never its payload, as a JSON record. A
+// destination of kafka://broker1:9092,broker2:9092/topic bootstraps from
+// the listed brokers.
+type KafkaConfig struct {
+    ClientID      string
+    Acks          int           // 0, 1 or -1 (all in-sync replicas)
+    BatchSize     int           // records per produce request
+    FlushInterval time.Duration // longest a record waits for a full batch
+    MaxPending    int           // records buffered before new ones are dropped
+    Timeout       time.Duration // per batch, retries included
+    TLS           bool
+    Username      string // SASL/PLAIN, when set
+    Password      string
+}
+
+// Backpressure policies, applied when a packet finds the mirror queue, and
+// the spill file if there is one, full
+const (
+    DropNewest = "drop-newest" // drop the packet being submitted
+    DropOldest = "drop-oldest" // drop the oldest buffered packet to make room
+    Block      = "block"       // wait up to BlockTimeout for room, then drop
+)
+
+// BackpressureConfig configures what the mirror does when its destinations
+// fall behind. With a SpillPath, packets that do not fit in the queue are
+// appended to a ring file of up to SpillMaxBytes and fed back to the queue
+// as it drains, so a short IDS outage loses nothing. The file outlives
+// restarts, so packets spilled before a restart are mirrored after it.
+type BackpressureConfig struct {
+    Policy        string        // DropNewest, DropOldest or Block; empty means DropNewest
+    BlockTimeout  time.Duration // longest Block makes a submitter wait
+    SpillPath     string        // ring file; empty disables spilling
+    SpillMaxBytes int64         // size of the ring file, header included
+}
+
+// EncapConfig configures the GRE and ERSPAN encapsulation. Both run over
+// IP protocol 47, so the headend needs CAP_NET_RAW to send them.
+type EncapConfig struct {
+    GREKey           uint32 // RFC 2890 key sent with GRE; 0 sends none
+    GRESequence      bool   // RFC 2890 sequence numbers on GRE
+    ERSPANVersion    int    // 2 for Type II, 3 for Type III; 0 means 2
+    ERSPANSessionID  int    // 0-1023, matched by the collector
+    ERSPANHardwareID int    // 0-63, identifies the headend; Type III only
+}
@@ -0,0 +1,68 @@
+//go:build minimal
+
+package mirror
+
+import (
+    "context"
+    "errors"
+    "net/http"
+)
+
+// errNotBuilt is returned by a headend built with the minimal profile,
+// which leaves traffic mirroring out
+var errNotBuilt = errors.New("traffic mirroring is not included in the minimal build")
+
+// Manager stands in for the mirror manager in the minimal build. It never
+// mirrors anything.
+type Manager struct{}
+
+// Status is a snapshot of the mirror for the admin API
+type Status struct{}
+
+func NewManager(destinations []string, protocol string, bufferSize int) *Manager {
+    return &Manager{}
+}
+
+func NewManagerWithSuricata(destinations []string, protocol string, bufferSize int, suricataHost, suricataPort string) *Manager {
+    return &Manager{}
+}
+
+func (m *Manager) SetSelection(sampleRate int, filter *Filter) {}
+
+func (m *Manager) SetWorkers(workers int) {}
+
+func (m *Manager) SetSuricataJSON(enabled bool) {}
+
+func (m *Manager) SetCaptureConfig(config CaptureConfig) {}
+
+func (m *Manager) SetKafkaConfig(config KafkaConfig) {}
+
+func (m *Manager) SetFlowObserver(observer FlowObserver) {}
+
+func (m *Manager) SetBackpressure(config BackpressureConfig) error {
+    return nil
+}
+
+func (m *Manager) SetEncapConfig(config EncapConfig) error {
+    return nil
+}
+
+func (m *Manager) Start() error {
+    return errNotBuilt
+}
+
+func (m *Manager) Stop() {}
+
+func (m *Manager) MirrorHTTP(req *http.Request, statusCode int, body []byte) {}
+
+func (m *Manager) MirrorTCPContext(ctx context.Context, src, dst string, data []byte) {}
+
+func (m *Manager) MirrorUDPContext(ctx context.Context, src, dst string, data []byte) {}
+
+func (m *Manager) QueueDepth() int {
+    return 0
+}
+
+func (m *Manager) Status() *Status {
+    return nil
+}
@@ -0,0 +1,166 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "encoding/binary"
+    "fmt"
+    "sync"
+)
+
+// GRE flags (RFC 2784, RFC 2890) and the protocol types carried
+const (
+    greFlagKey      = 0x2000
+    greFlagSequence = 0x1000
+
+    etherTypeIPv4      = 0x0800
+    etherTypeIPv6      = 0x86DD
+    etherTypeERSPANII  = 0x88BE
+    etherTypeERSPANIII = 0x22EB
+
+    erspanVersionII  = 1 // the Ver field of Type II
+    erspanVersionIII = 2 // the Ver field of Type III
+
+    // maxEncapPayload keeps each encapsulated packet, ERSPAN Type III over
+    // IPv4 being the largest, within a 1500-byte MTU
+    maxEncapPayload = 1400
+)
+
+// The synthesized Ethernet frames ERSPAN carries run between two locally
+// administered addresses, from the client side to the server side
+var (
+    clientMAC = [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+    serverMAC = [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// encapsulator builds GRE and ERSPAN packets. The proxy mirrors payloads,
+// so each is wrapped in synthesized IP and TCP or UDP headers first, like
+// the pcapng captures. GRE carries the IP packet; ERSPAN carries it in an
+// Ethernet frame, as a switch port mirror would.
+type encapsulator struct {
+    config EncapConfig
+
+    mu      sync.Mutex
+    streams *tcpStreams
+    // seq is the GRE sequence number of the next packet
+    seq uint32
+}
+
+func newEncapsulator(config EncapConfig) *encapsulator {
+    return &encapsulator{config: config, streams: newTCPStreams()}
+}
+
+// validate checks config's fields fit their headers
+func (config EncapConfig) validate() error {
+    switch config.ERSPANVersion {
+    case 0, 2, 3:
+    default:
+        return fmt.Errorf("unsupported ERSPAN version %d, want 2 or 3", config.ERSPANVersion)
+    }
+    if config.ERSPANSessionID < 0 || config.ERSPANSessionID > 0x3FF {
+        return fmt.Errorf("ERSPAN session ID %d does not fit in 10 bits", config.ERSPANSessionID)
+    }
+    if config.ERSPANHardwareID < 0 || config.ERSPANHardwareID > 0x3F {
+        return fmt.Errorf("ERSPAN hardware ID %d does not fit in 6 bits", config.ERSPANHardwareID)
+    }
+    return nil
+}
+
+// gre encapsulates packet in GRE, with the key and sequence number if
+// configured
+func (e *encapsulator) gre(packet *MirrorPacket) [][]byte {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    var packets [][]byte
+    for _, ip := range e.streams.ipPackets(packet, maxEncapPayload) {
+        protocol := uint16(etherTypeIPv4)
+        if ip[0]>>4 == 6 {
+            protocol = etherTypeIPv6
+        }
+        var flags uint16
+        if e.config.GREKey != 0 {
+            flags |= greFlagKey
+        }
+        if e.config.GRESequence {
+            flags |= greFlagSequence
+        }
+        packets = append(packets, append(e.greHeader(flags, protocol), ip...))
+    }
+    return packets
+}
+
+// erspan encapsulates packet in ERSPAN Type II or III over GRE, which
+// always carries a sequence number and never a key
+func (e *encapsulator) erspan(packet *MirrorPacket) [][]byte {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    var packets [][]byte
+    for _, ip := range e.streams.ipPackets(packet, maxEncapPayload) {
+        frame := ethernetFrame(ip)
+        var header []byte
+        if e.config.ERSPANVersion == 3 {
+            header = append(e.greHeader(greFlagSequence, etherTypeERSPANIII), e.erspanIIIHeader(packet)...)
+        } else {
+            header = append(e.greHeader(greFlagSequence, etherTypeERSPANII), e.erspanIIHeader()...)
+        }
+        packets = append(packets, append(header, frame...))
+    }
+    return packets
+}
+
+// greHeader builds a GRE header with flags, advancing the sequence number
+// when it is sent. Caller must hold mu.
+func (e *encapsulator) greHeader(flags, protocol uint16) []byte {
+    header := make([]byte, 4, 12)
+    binary.BigEndian.PutUint16(header[0:], flags) // version 0
+    binary.BigEndian.PutUint16(header[2:], protocol)
+    if flags&greFlagKey != 0 {
+        header = binary.BigEndian.AppendUint32(header, e.config.GREKey)
+    }
+    if flags&greFlagSequence != 0 {
+        header = binary.BigEndian.AppendUint32(header, e.seq)
+        e.seq++
+    }
+    return header
+}
+
+// erspanIIHeader builds the 8-byte Type II header: version, VLAN 0, class
+// of service 0, encapsulation type 0 (untagged), not truncated, the
+// session ID and port index 0
+func (e *encapsulator) erspanIIHeader() []byte {
+    header := make([]byte, 8)
+    binary.BigEndian.PutUint16(header[0:], erspanVersionII<<12)
+    binary.BigEndian.PutUint16(header[2:], uint16(e.config.ERSPANSessionID))
+    binary.BigEndian.PutUint32(header[4:], 0) // reserved, port index
+    return header
+}
+
+// erspanIIIHeader builds the 12-byte Type III header without the optional
+// platform subheader: version, VLAN 0, class of service 0, BSO 0, not
+// truncated, the session ID, a timestamp in 100 microsecond units, SGT 0,
+// an Ethernet frame (P set, FT 0), the hardware ID, ingress and 100
+// microsecond granularity.
+func (e *encapsulator) erspanIIIHeader(packet *MirrorPacket) []byte {
+    header := make([]byte, 12)
+    binary.BigEndian.PutUint16(header[0:], erspanVersionIII<<12)
+    binary.BigEndian.PutUint16(header[2:], uint16(e.config.ERSPANSessionID))
+    binary.BigEndian.PutUint32(header[4:], uint32(packet.Timestamp.UnixMicro()/100))
+    binary.BigEndian.PutUint16(header[8:], 0) // security group tag
+    binary.BigEndian.PutUint16(header[10:], 1<<15|uint16(e.config.ERSPANHardwareID)<<4)
+    return header
+}
+
+// ethernetFrame wraps an IP packet in an untagged Ethernet II frame
+func ethernetFrame(ip []byte) []byte {
+    etherType := uint16(etherTypeIPv4)
+    if ip[0]>>4 == 6 {
+        etherType = etherTypeIPv6
+    }
+    frame := make([]byte, 14, 14+len(ip))
+    copy(frame[0:], serverMAC[:])
+    copy(frame[6:], clientMAC[:])
+    binary.BigEndian.PutUint16(frame[12:], etherType)
+    return append(frame, ip...)
+}
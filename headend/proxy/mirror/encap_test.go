@@ -0,0 +1,120 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// readGolden decodes a packet fixture: hex bytes, in any grouping, with
+// # comments naming each header
+func readGolden(t *testing.T, name string) []byte {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join("testdata", name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var digits strings.Builder
+    for _, line := range strings.Split(string(data), "\n") {
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        digits.WriteString(strings.Join(strings.Fields(line), ""))
+    }
+    golden, err := hex.DecodeString(digits.String())
+    if err != nil {
+        t.Fatalf("%s: %v", name, err)
+    }
+    return golden
+}
+
+func TestEncapsulationGolden(t *testing.T) {
+    at := time.Unix(1700000000, 123456000)
+    tcp := &MirrorPacket{
+        Timestamp: at,
+        Protocol:  "TCP",
+        Data:      []byte("hello"),
+        Metadata:  map[string]interface{}{"src": "10.0.0.1:40000", "dst": "10.0.0.2:443"},
+    }
+    udp6 := &MirrorPacket{
+        Timestamp: at,
+        Protocol:  "UDP",
+        Data:      []byte("hi"),
+        Metadata:  map[string]interface{}{"src": "[2001:db8::1]:5353", "dst": "[2001:db8::2]:53"},
+    }
+
+    for _, test := range []struct {
+        golden string
+        config EncapConfig
+        erspan bool
+        packet *MirrorPacket
+    }{
+        {"gre_key_seq.hex", EncapConfig{GREKey: 42, GRESequence: true}, false, tcp},
+        {"gre_ipv6.hex", EncapConfig{}, false, udp6},
+        {"erspan_ii.hex", EncapConfig{ERSPANSessionID: 100}, true, tcp},
+        {"erspan_iii.hex", EncapConfig{ERSPANVersion: 3, ERSPANSessionID: 100, ERSPANHardwareID: 5}, true, tcp},
+    } {
+        t.Run(test.golden, func(t *testing.T) {
+            if err := test.config.validate(); err != nil {
+                t.Fatal(err)
+            }
+            e := newEncapsulator(test.config)
+            var packets [][]byte
+            if test.erspan {
+                packets = e.erspan(test.packet)
+            } else {
+                packets = e.gre(test.packet)
+            }
+            if len(packets) != 1 {
+                t.Fatalf("got %d packets, want 1", len(packets))
+            }
+            if want := readGolden(t, test.golden); !bytes.Equal(packets[0], want) {
+                t.Errorf("got\n%s\nwant\n%s", hex.Dump(packets[0]), hex.Dump(want))
+            }
+        })
+    }
+}
+
+func TestEncapsulationSequenceAndSegments(t *testing.T) {
+    e := newEncapsulator(EncapConfig{GRESequence: true})
+    packet := &MirrorPacket{
+        Timestamp: time.Now(),
+        Protocol:  "TCP",
+        Data:      make([]byte, 2*maxEncapPayload+1),
+        Metadata:  map[string]interface{}{"src": "10.0.0.1:40000", "dst": "10.0.0.2:443"},
+    }
+
+    packets := append(e.gre(packet), e.gre(packet)...)
+    if len(packets) != 6 {
+        t.Fatalf("got %d packets, want 3 per mirrored packet", len(packets))
+    }
+    for i, p := range packets {
+        if seq := binary.BigEndian.Uint32(p[4:]); seq != uint32(i) {
+            t.Errorf("packet %d has sequence number %d", i, seq)
+        }
+        // GRE, IPv4 and TCP headers around at most maxEncapPayload bytes
+        if len(p) > 8+20+20+maxEncapPayload {
+            t.Errorf("packet %d is %d bytes", i, len(p))
+        }
+    }
+}
+
+func TestEncapConfigValidate(t *testing.T) {
+    for _, config := range []EncapConfig{
+        {ERSPANVersion: 1},
+        {ERSPANSessionID: 1024},
+        {ERSPANHardwareID: 64},
+        {ERSPANSessionID: -1},
+    } {
+        if err := config.validate(); err == nil {
+            t.Errorf("%+v: expected an error", config)
+        }
+    }
+}
@@ -0,0 +1,291 @@
+package mirror
+
+import (
+    "fmt"
+    "hash/fnv"
+    "net"
+    "net/netip"
+    "strconv"
+    "strings"
+)
+
+// Filter selects the traffic to mirror. Expressions borrow tcpdump's syntax
+// for the primitives that make sense at the proxy:
+//
+//    user <id>
+//    proto <tcp|udp|http>      also the bare words tcp, udp and http
+//    [src|dst] host <ip>
+//    [src|dst] net <cidr>
+//    [src|dst] port <port>[-<port>]
+//
+// Primitives combine with and (&&), or (||), not (!) and parentheses; and
+// binds tighter than or. Like BPF, src and dst refer to each mirrored
+// packet, so "dst port 443" only selects the client's half of a session
+// while "port 443" selects both. A nil Filter selects everything.
+type Filter struct {
+    expr  string
+    match matcher
+}
+
+// flowInfo is what a filter sees of a mirrored packet
+type flowInfo struct {
+    userID   string
+    protocol string
+    src      endpoint
+    dst      endpoint
+}
+
+// endpoint is one end of a packet. addr is invalid when the end is known
+// only by name, as the target of an HTTP request is.
+type endpoint struct {
+    addr netip.Addr
+    port int
+}
+
+type matcher func(*flowInfo) bool
+
+// ParseFilter compiles a filter expression. An empty expression returns a
+// nil Filter, which selects everything.
+func ParseFilter(expr string) (*Filter, error) {
+    tokens := tokenize(expr)
+    if len(tokens) == 0 {
+        return nil, nil
+    }
+
+    p := &filterParser{tokens: tokens}
+    match, err := p.parseOr()
+    if err != nil {
+        return nil, fmt.Errorf("invalid mirror filter %q: %w", expr, err)
+    }
+    if p.pos < len(p.tokens) {
+        return nil, fmt.Errorf("invalid mirror filter %q: unexpected %q", expr, p.tokens[p.pos])
+    }
+    return &Filter{expr: expr, match: match}, nil
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+    if f == nil {
+        return ""
+    }
+    return f.expr
+}
+
+func (f *Filter) matches(info *flowInfo) bool {
+    return f == nil || f.match(info)
+}
+
+func tokenize(expr string) []string {
+    for _, op := range []string{"(", ")", "&&", "||", "!"} {
+        expr = strings.ReplaceAll(expr, op, " "+op+" ")
+    }
+    return strings.Fields(expr)
+}
+
+type filterParser struct {
+    tokens []string
+    pos    int
+}
+
+func (p *filterParser) peek() string {
+    if p.pos < len(p.tokens) {
+        return p.tokens[p.pos]
+    }
+    return ""
+}
+
+func (p *filterParser) next() (string, error) {
+    if p.pos >= len(p.tokens) {
+        return "", fmt.Errorf("unexpected end of expression")
+    }
+    token := p.tokens[p.pos]
+    p.pos++
+    return token, nil
+}
+
+func (p *filterParser) parseOr() (matcher, error) {
+    left, err := p.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek() == "or" || p.peek() == "||" {
+        p.pos++
+        right, err := p.parseAnd()
+        if err != nil {
+            return nil, err
+        }
+        l := left
+        left = func(info *flowInfo) bool { return l(info) || right(info) }
+    }
+    return left, nil
+}
+
+func (p *filterParser) parseAnd() (matcher, error) {
+    left, err := p.parseNot()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek() == "and" || p.peek() == "&&" {
+        p.pos++
+        right, err := p.parseNot()
+        if err != nil {
+            return nil, err
+        }
+        l := left
+        left = func(info *flowInfo) bool { return l(info) && right(info) }
+    }
+    return left, nil
+}
+
+func (p *filterParser) parseNot() (matcher, error) {
+    if p.peek() == "not" || p.peek() == "!" {
+        p.pos++
+        inner, err := p.parseNot()
+        if err != nil {
+            return nil, err
+        }
+        return func(info *flowInfo) bool { return !inner(info) }, nil
+    }
+    return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (matcher, error) {
+    token, err := p.next()
+    if err != nil {
+        return nil, err
+    }
+
+    switch token {
+    case "(":
+        inner, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        if closing, err := p.next(); err != nil || closing != ")" {
+            return nil, fmt.Errorf("missing )")
+        }
+        return inner, nil
+    case "user":
+        userID, err := p.next()
+        if err != nil {
+            return nil, err
+        }
+        return func(info *flowInfo) bool { return info.userID == userID }, nil
+    case "proto":
+        proto, err := p.next()
+        if err != nil {
+            return nil, err
+        }
+        return protoMatcher(proto)
+    case "tcp", "udp", "http":
+        return protoMatcher(token)
+    case "src", "dst":
+        qualifier, err := p.next()
+        if err != nil {
+            return nil, err
+        }
+        return p.parseEndpoint(qualifier, token)
+    case "host", "net", "port":
+        return p.parseEndpoint(token, "")
+    }
+    return nil, fmt.Errorf("unknown primitive %q", token)
+}
+
+func protoMatcher(proto string) (matcher, error) {
+    proto = strings.ToLower(proto)
+    switch proto {
+    case "tcp", "udp", "http":
+        return func(info *flowInfo) bool { return info.protocol == proto }, nil
+    }
+    return nil, fmt.Errorf("unknown protocol %q", proto)
+}
+
+// parseEndpoint parses the argument of a host, net or port primitive. dir
+// is src, dst or empty for either end.
+func (p *filterParser) parseEndpoint(qualifier, dir string) (matcher, error) {
+    arg, err := p.next()
+    if err != nil {
+        return nil, err
+    }
+
+    var test func(endpoint) bool
+    switch qualifier {
+    case "host":
+        addr, err := netip.ParseAddr(arg)
+        if err != nil {
+            return nil, fmt.Errorf("invalid host %q", arg)
+        }
+        addr = addr.Unmap()
+        test = func(e endpoint) bool { return e.addr == addr }
+    case "net":
+        prefix, err := netip.ParsePrefix(arg)
+        if err != nil {
+            return nil, fmt.Errorf("invalid net %q", arg)
+        }
+        prefix = prefix.Masked()
+        test = func(e endpoint) bool { return e.addr.IsValid() && prefix.Contains(e.addr) }
+    case "port":
+        low, high, err := parsePortRange(arg)
+        if err != nil {
+            return nil, err
+        }
+        test = func(e endpoint) bool { return e.port >= low && e.port <= high }
+    default:
+        return nil, fmt.Errorf("expected host, net or port after %s, got %q", dir, qualifier)
+    }
+
+    switch dir {
+    case "src":
+        return func(info *flowInfo) bool { return test(info.src) }, nil
+    case "dst":
+        return func(info *flowInfo) bool { return test(info.dst) }, nil
+    }
+    return func(info *flowInfo) bool { return test(info.src) || test(info.dst) }, nil
+}
+
+func parsePortRange(arg string) (int, int, error) {
+    lowArg, highArg, isRange := strings.Cut(arg, "-")
+    low, err := strconv.Atoi(lowArg)
+    if err != nil || low < 0 || low > 65535 {
+        return 0, 0, fmt.Errorf("invalid port %q", arg)
+    }
+    high := low
+    if isRange {
+        high, err = strconv.Atoi(highArg)
+        if err != nil || high < low || high > 65535 {
+            return 0, 0, fmt.Errorf("invalid port range %q", arg)
+        }
+    }
+    return low, high, nil
+}
+
+// splitEndpoint splits a host:port address as the proxy reports it
+func splitEndpoint(address string) endpoint {
+    host, portArg, err := net.SplitHostPort(address)
+    if err != nil {
+        host = address
+    }
+    var e endpoint
+    if addr, err := netip.ParseAddr(host); err == nil {
+        e.addr = addr.Unmap()
+    }
+    e.port, _ = strconv.Atoi(portArg)
+    return e
+}
+
+// sampled reports whether the session between src and dst falls in the
+// sample. Both directions hash alike, so a sampled session is mirrored
+// whole rather than as scattered packets.
+func sampled(rate int, src, dst string) bool {
+    if rate <= 1 {
+        return true
+    }
+    if src > dst {
+        src, dst = dst, src
+    }
+    h := fnv.New32a()
+    _, _ = h.Write([]byte(src))
+    _, _ = h.Write([]byte{0})
+    _, _ = h.Write([]byte(dst))
+    return h.Sum32()%uint32(rate) == 0
+}
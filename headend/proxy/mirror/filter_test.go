@@ -0,0 +1,63 @@
+package mirror
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestFilterMatches(t *testing.T) {
+    web := &flowInfo{userID: "alice", protocol: "tcp", src: splitEndpoint("198.51.100.7:51000"), dst: splitEndpoint("10.1.2.3:443")}
+    dns := &flowInfo{userID: "bob", protocol: "udp", src: splitEndpoint("198.51.100.8:53000"), dst: splitEndpoint("[2001:db8::53]:53")}
+    site := &flowInfo{userID: "bob", protocol: "http", src: splitEndpoint("198.51.100.8:52000"), dst: splitEndpoint("intranet.example.com:80")}
+
+    cases := []struct {
+        expr string
+        want [3]bool
+    }{
+        {"user alice", [3]bool{true, false, false}},
+        {"tcp and dst net 10.0.0.0/8", [3]bool{true, false, false}},
+        {"port 443 or proto udp", [3]bool{true, true, false}},
+        {"dst port 50000-60000", [3]bool{false, false, false}},
+        {"src port 50000-60000", [3]bool{true, true, true}},
+        {"not net 10.0.0.0/8 && !udp", [3]bool{false, false, true}},
+        {"user bob and (host 2001:db8::53 or http)", [3]bool{false, true, true}},
+    }
+    for _, c := range cases {
+        filter, err := ParseFilter(c.expr)
+        if err != nil {
+            t.Fatalf("ParseFilter(%q): %v", c.expr, err)
+        }
+        got := [3]bool{filter.matches(web), filter.matches(dns), filter.matches(site)}
+        if got != c.want {
+            t.Errorf("%q matched %v, want %v", c.expr, got, c.want)
+        }
+    }
+}
+
+func TestParseFilterErrors(t *testing.T) {
+    if filter, err := ParseFilter("  "); filter != nil || err != nil {
+        t.Errorf("expected an empty filter to select everything, got %v, %v", filter, err)
+    }
+    for _, expr := range []string{"user", "port 70000", "net 10.0.0.0", "(tcp", "tcp udp", "src user alice", "proto icmp"} {
+        if _, err := ParseFilter(expr); err == nil {
+            t.Errorf("expected %q to be rejected", expr)
+        }
+    }
+}
+
+func TestSamplingKeepsSessionsWhole(t *testing.T) {
+    selected := 0
+    for i := 0; i < 1000; i++ {
+        client := fmt.Sprintf("198.51.100.7:%d", 40000+i)
+        forward := sampled(10, client, "10.1.2.3:443")
+        if forward != sampled(10, "10.1.2.3:443", client) {
+            t.Fatalf("session %s sampled in one direction only", client)
+        }
+        if forward {
+            selected++
+        }
+    }
+    if selected < 50 || selected > 150 {
+        t.Errorf("expected about 1 in 10 sessions, got %d of 1000", selected)
+    }
+}
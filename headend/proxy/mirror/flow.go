@@ -0,0 +1,48 @@
+package mirror
+
+import (
+    "hash/fnv"
+    "net"
+    "net/netip"
+    "strconv"
+)
+
+// FlowID identifies the flow between two endpoints, in either direction.
+// The Suricata envelope carries it as flow_id, and an alert about the same
+// endpoints yields the same ID, so alerts can be traced back to the user
+// and session that produced the traffic.
+func FlowID(a, b string) int64 {
+    a, b = normalizeEndpoint(a), normalizeEndpoint(b)
+    if a > b {
+        a, b = b, a
+    }
+    h := fnv.New64a()
+    _, _ = h.Write([]byte(a))
+    _, _ = h.Write([]byte{0})
+    _, _ = h.Write([]byte(b))
+    // Suricata flow IDs are non-negative JSON integers
+    return int64(h.Sum64() >> 1)
+}
+
+// normalizeEndpoint writes host:port addresses the same way whichever form
+// they arrived in, e.g. IPv4-mapped IPv6 or with a zero-padded port
+func normalizeEndpoint(address string) string {
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return address
+    }
+    if addr, err := netip.ParseAddr(host); err == nil {
+        host = addr.Unmap().String()
+    }
+    if n, err := strconv.Atoi(port); err == nil {
+        port = strconv.Itoa(n)
+    }
+    return net.JoinHostPort(host, port)
+}
+
+// FlowObserver learns of every flow the mirror sends out, so alerts raised
+// by the tools it feeds can be traced back to a user and session. client
+// is the address of the headend's client, when known.
+type FlowObserver interface {
+    ObserveFlow(flowID int64, src, dst, client, userID, requestID string)
+}
@@ -0,0 +1,284 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+    "github.com/twmb/franz-go/pkg/kgo"
+    "github.com/twmb/franz-go/pkg/sasl/plain"
+)
+
+const (
+    defaultKafkaBatchSize     = 500
+    defaultKafkaFlushInterval = time.Second
+    defaultKafkaMaxPending    = 10000
+    defaultKafkaTimeout       = 10 * time.Second
+
+    // kafkaErrorLogInterval rate-limits the log while brokers are down
+    kafkaErrorLogInterval = 30 * time.Second
+)
+
+// isKafkaDestination reports whether dest publishes packet metadata to
+// Kafka rather than mirroring packets
+func isKafkaDestination(dest string) bool {
+    return strings.HasPrefix(dest, "kafka://")
+}
+
+// kafkaEnvelope is the metadata published for each mirrored packet. The
+// payload itself is never published.
+type kafkaEnvelope struct {
+    Timestamp time.Time `json:"timestamp"`
+    User      string    `json:"user,omitempty"`
+    RequestID string    `json:"request_id,omitempty"`
+    Src       string    `json:"src,omitempty"`
+    Dst       string    `json:"dst,omitempty"`
+    Proto     string    `json:"proto"`
+    Bytes     int       `json:"bytes"`
+}
+
+// kafkaRecord is one record to publish
+type kafkaRecord struct {
+    key       []byte
+    value     []byte
+    timestamp time.Time
+}
+
+// kafkaSink batches packet metadata and publishes it to a topic from its
+// own goroutine, so a slow or unreachable cluster never holds up the
+// mirror workers. Records that cannot be published stay queued, up to
+// MaxPending, and are retried with the next batch.
+type kafkaSink struct {
+    dest   string
+    config KafkaConfig
+    client *kgo.Client
+
+    mu      sync.Mutex
+    pending []kafkaRecord
+
+    flushCh chan struct{}
+    stopCh  chan struct{}
+    done    chan struct{}
+
+    lastErrorLog time.Time
+}
+
+func newKafkaSink(dest string, config KafkaConfig) (*kafkaSink, error) {
+    brokerList, topic, _ := strings.Cut(strings.TrimPrefix(dest, "kafka://"), "/")
+    topic = strings.Trim(topic, "/")
+    if brokerList == "" || topic == "" {
+        return nil, fmt.Errorf("invalid kafka destination %q: expected kafka://broker[,broker...]/topic", dest)
+    }
+
+    if config.ClientID == "" {
+        config.ClientID = "headend-mirror"
+    }
+    if config.BatchSize <= 0 {
+        config.BatchSize = defaultKafkaBatchSize
+    }
+    if config.FlushInterval <= 0 {
+        config.FlushInterval = defaultKafkaFlushInterval
+    }
+    if config.MaxPending <= 0 {
+        config.MaxPending = defaultKafkaMaxPending
+    }
+    if config.Timeout <= 0 {
+        config.Timeout = defaultKafkaTimeout
+    }
+
+    opts := []kgo.Opt{
+        kgo.SeedBrokers(strings.Split(brokerList, ",")...),
+        kgo.DefaultProduceTopic(topic),
+        kgo.ClientID(config.ClientID),
+        kgo.DialTimeout(config.Timeout),
+        kgo.ProduceRequestTimeout(config.Timeout),
+    }
+    switch config.Acks {
+    case -1:
+        opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+    case 0:
+        opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+    case 1:
+        opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+    default:
+        return nil, fmt.Errorf("invalid kafka acks %d: expected 0, 1 or -1", config.Acks)
+    }
+    if config.TLS {
+        // franz-go sets the server name of each broker it dials
+        opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+    }
+    if config.Username != "" {
+        opts = append(opts, kgo.SASL(plain.Auth{User: config.Username, Pass: config.Password}.AsMechanism()))
+    }
+    client, err := kgo.NewClient(opts...)
+    if err != nil {
+        return nil, fmt.Errorf("invalid kafka destination %q: %w", dest, err)
+    }
+
+    s := &kafkaSink{
+        dest:    dest,
+        config:  config,
+        client:  client,
+        flushCh: make(chan struct{}, 1),
+        stopCh:  make(chan struct{}),
+        done:    make(chan struct{}),
+    }
+    go s.run()
+    return s, nil
+}
+
+// add queues the metadata of packet. It returns false when the queue is
+// full and the record was dropped.
+func (s *kafkaSink) add(packet *MirrorPacket) bool {
+    envelope := kafkaEnvelope{
+        Timestamp: packet.Timestamp,
+        Proto:     strings.ToLower(packet.Protocol),
+        Bytes:     len(packet.Data),
+    }
+    envelope.User, _ = packet.Metadata["user_id"].(string)
+    envelope.RequestID, _ = packet.Metadata["request_id"].(string)
+    envelope.Src, _ = packet.Metadata["src"].(string)
+    envelope.Dst, _ = packet.Metadata["dst"].(string)
+
+    value, err := json.Marshal(envelope)
+    if err != nil {
+        kafkaRecords.WithLabelValues("dropped").Inc()
+        return false
+    }
+    record := kafkaRecord{value: value, timestamp: packet.Timestamp}
+    if envelope.User != "" {
+        record.key = []byte(envelope.User)
+    }
+
+    s.mu.Lock()
+    if len(s.pending) >= s.config.MaxPending {
+        s.mu.Unlock()
+        kafkaRecords.WithLabelValues("dropped").Inc()
+        return false
+    }
+    s.pending = append(s.pending, record)
+    full := len(s.pending) >= s.config.BatchSize
+    s.mu.Unlock()
+
+    if full {
+        select {
+        case s.flushCh <- struct{}{}:
+        default:
+        }
+    }
+    return true
+}
+
+func (s *kafkaSink) run() {
+    defer close(s.done)
+
+    ticker := time.NewTicker(s.config.FlushInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            s.flush()
+        case <-s.flushCh:
+            s.flush()
+        case <-s.stopCh:
+            s.flush()
+            return
+        }
+    }
+}
+
+// flush publishes the queued records batch by batch, stopping at the first
+// batch that fails
+func (s *kafkaSink) flush() {
+    for {
+        s.mu.Lock()
+        n := min(len(s.pending), s.config.BatchSize)
+        batch := s.pending[:n:n]
+        s.pending = s.pending[n:]
+        s.mu.Unlock()
+        if n == 0 {
+            return
+        }
+
+        failed, err := s.produce(batch)
+        kafkaRecords.WithLabelValues("sent").Add(float64(n - len(failed)))
+        if len(failed) == 0 {
+            continue
+        }
+
+        s.logError(err)
+        s.requeue(failed)
+        return
+    }
+}
+
+// produce publishes batch, returning the records that were not published
+// and the first error. franz-go retries until the timeout, finding moved
+// partition leaders again, and the records left are requeued rather than
+// holding up the next flush. Records with the same key, the
+// user, land in the same partition so consumers see each user's traffic in
+// order.
+func (s *kafkaSink) produce(batch []kafkaRecord) ([]kafkaRecord, error) {
+    records := make([]*kgo.Record, len(batch))
+    index := make(map[*kgo.Record]int, len(batch))
+    for i, record := range batch {
+        records[i] = &kgo.Record{Key: record.key, Value: record.value, Timestamp: record.timestamp}
+        index[records[i]] = i
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+    defer cancel()
+
+    // Results arrive in completion order; failures are requeued in order
+    errs := make([]error, len(batch))
+    var firstErr error
+    for _, result := range s.client.ProduceSync(ctx, records...) {
+        errs[index[result.Record]] = result.Err
+        if firstErr == nil {
+            firstErr = result.Err
+        }
+    }
+    var failed []kafkaRecord
+    for i, err := range errs {
+        if err != nil {
+            failed = append(failed, batch[i])
+        }
+    }
+    return failed, firstErr
+}
+
+// requeue puts records that failed back at the front of the queue, keeping
+// their order, and drops what no longer fits
+func (s *kafkaSink) requeue(records []kafkaRecord) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    room := max(s.config.MaxPending-len(s.pending), 0)
+    if len(records) > room {
+        kafkaRecords.WithLabelValues("dropped").Add(float64(len(records) - room))
+        records = records[len(records)-room:]
+    }
+    s.pending = append(records, s.pending...)
+}
+
+func (s *kafkaSink) logError(err error) {
+    if time.Since(s.lastErrorLog) >= kafkaErrorLogInterval {
+        s.lastErrorLog = time.Now()
+        log.Errorf("Failed to publish mirror metadata to %s: %v", s.dest, err)
+    }
+}
+
+// close publishes what is queued and closes the broker connections
+func (s *kafkaSink) close() {
+    close(s.stopCh)
+    <-s.done
+    s.client.Close()
+}
@@ -0,0 +1,194 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/twmb/franz-go/pkg/kfake"
+    "github.com/twmb/franz-go/pkg/kgo"
+    "github.com/twmb/franz-go/pkg/kmsg"
+    "github.com/twmb/franz-go/pkg/sasl/plain"
+)
+
+// newTestCluster starts an in-process Kafka cluster with a mirror topic
+// of several partitions, requiring SASL/PLAIN
+func newTestCluster(t *testing.T) *kfake.Cluster {
+    t.Helper()
+    cluster, err := kfake.NewCluster(
+        kfake.NumBrokers(3),
+        kfake.SeedTopics(6, "mirror"),
+        kfake.EnableSASL(),
+        kfake.Superuser("PLAIN", "headend", "secret"),
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(cluster.Close)
+    return cluster
+}
+
+// consume reads n records from the mirror topic
+func consume(t *testing.T, cluster *kfake.Cluster, n int) []*kgo.Record {
+    t.Helper()
+    consumer, err := kgo.NewClient(
+        kgo.SeedBrokers(cluster.ListenAddrs()...),
+        kgo.SASL(plain.Auth{User: "headend", Pass: "secret"}.AsMechanism()),
+        kgo.ConsumeTopics("mirror"),
+        kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer consumer.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    var records []*kgo.Record
+    for len(records) < n {
+        fetches := consumer.PollFetches(ctx)
+        if ctx.Err() != nil {
+            t.Fatalf("read %d records, want %d", len(records), n)
+        }
+        records = append(records, fetches.Records()...)
+    }
+    return records
+}
+
+func TestKafkaSinkPublishesMetadata(t *testing.T) {
+    cluster := newTestCluster(t)
+
+    // The first produce request loses its connection; the sink's client
+    // retries it
+    var refused atomic.Int32
+    cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+        refused.Add(1)
+        return nil, errors.New("connection dropped"), true
+    })
+
+    sink, err := newKafkaSink("kafka://"+strings.Join(cluster.ListenAddrs(), ",")+"/mirror", KafkaConfig{
+        Acks:          -1,
+        FlushInterval: time.Hour,
+        Timeout:       5 * time.Second,
+        Username:      "headend",
+        Password:      "secret",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    at := time.Unix(1700000000, 0).UTC()
+    for i, user := range []string{"alice", "bob", "alice"} {
+        packet := &MirrorPacket{
+            Timestamp: at.Add(time.Duration(i) * time.Millisecond),
+            Protocol:  "TCP",
+            Data:      []byte("secret payload"),
+            Metadata:  map[string]interface{}{"src": "10.0.0.1:40000", "dst": "10.0.0.2:443", "user_id": user},
+        }
+        if !sink.add(packet) {
+            t.Fatal("record dropped")
+        }
+    }
+    sink.close()
+
+    sink.mu.Lock()
+    pending := len(sink.pending)
+    sink.mu.Unlock()
+    if pending != 0 || refused.Load() != 1 {
+        t.Errorf("%d records pending after %d refused produces, want none after one", pending, refused.Load())
+    }
+
+    users := make(map[string]int32)
+    for _, record := range consume(t, cluster, 3) {
+        var envelope kafkaEnvelope
+        if err := json.Unmarshal(record.Value, &envelope); err != nil {
+            t.Fatalf("record %q: %v", record.Value, err)
+        }
+        if envelope.Proto != "tcp" || envelope.Bytes != len("secret payload") || envelope.Dst != "10.0.0.2:443" {
+            t.Errorf("unexpected envelope %+v", envelope)
+        }
+        if string(record.Key) != envelope.User || !record.Timestamp.Equal(envelope.Timestamp) {
+            t.Errorf("record key %q and timestamp %v do not match %+v", record.Key, record.Timestamp, envelope)
+        }
+        if previous, ok := users[envelope.User]; ok && previous != record.Partition {
+            t.Errorf("records of %s in partitions %d and %d", envelope.User, previous, record.Partition)
+        }
+        users[envelope.User] = record.Partition
+    }
+}
+
+func TestKafkaSinkRejectsWrongCredentials(t *testing.T) {
+    cluster := newTestCluster(t)
+
+    sink, err := newKafkaSink("kafka://"+cluster.ListenAddrs()[0]+"/mirror", KafkaConfig{
+        FlushInterval: time.Hour,
+        Timeout:       time.Second,
+        Username:      "headend",
+        Password:      "wrong",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sink.close()
+
+    sink.add(&MirrorPacket{Timestamp: time.Now(), Protocol: "UDP", Metadata: map[string]interface{}{}})
+    sink.flush()
+    sink.mu.Lock()
+    pending := len(sink.pending)
+    sink.mu.Unlock()
+    if pending != 1 {
+        t.Errorf("%d records pending after authentication failed, want 1", pending)
+    }
+}
+
+func TestKafkaSinkRequeuesWhenUnreachable(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := listener.Addr().String()
+    listener.Close()
+
+    sink, err := newKafkaSink("kafka://"+addr+"/mirror", KafkaConfig{
+        FlushInterval: time.Hour,
+        MaxPending:    2,
+        Timeout:       time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    packet := &MirrorPacket{Timestamp: time.Now(), Protocol: "UDP", Metadata: map[string]interface{}{}}
+    if !sink.add(packet) || !sink.add(packet) {
+        t.Fatal("record dropped below MaxPending")
+    }
+    if sink.add(packet) {
+        t.Error("record accepted beyond MaxPending")
+    }
+
+    sink.flush()
+    sink.mu.Lock()
+    pending := len(sink.pending)
+    sink.mu.Unlock()
+    if pending != 2 {
+        t.Errorf("%d records pending after a failed flush, want 2", pending)
+    }
+    sink.close()
+}
+
+func TestNewKafkaSinkRejectsBadDestinations(t *testing.T) {
+    for _, dest := range []string{"kafka://", "kafka://broker:9092", "kafka:///topic"} {
+        if _, err := newKafkaSink(dest, KafkaConfig{Acks: 1}); err == nil {
+            t.Errorf("%s: expected an error", dest)
+        }
+    }
+    if _, err := newKafkaSink("kafka://broker:9092/mirror", KafkaConfig{Acks: 2}); err == nil {
+        t.Error("expected invalid acks to be rejected")
+    }
+}
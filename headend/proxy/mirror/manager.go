@@ -1,12 +1,21 @@
+//go:build !minimal
+
 // Package mirror implements traffic mirroring capabilities for the SASEWaddle headend proxy.
 //
 // The mirror manager provides:
 // - Real-time packet duplication to external security tools
 // - Support for multiple mirror destinations
-// - Protocol support: VXLAN, GRE, ERSPAN
+// - Rotating pcapng capture files on local disk or in an S3-compatible bucket
+// - Per-packet metadata published to Kafka for SIEM pipelines
+// - Protocol support: VXLAN, GRE (RFC 2784/2890 keys and sequence numbers),
+//   ERSPAN Type II and III
 // - Integration with IDS/IPS systems (Suricata, Snort, etc.)
 // - High-performance zero-copy mirroring
 // - Buffered queue with configurable size for performance
+// - Backpressure policies (drop-newest, drop-oldest, block with a deadline)
+//   and an on-disk spill ring that rides out short IDS outages
+// - Bounded worker pool, sized to GOMAXPROCS by default, with non-blocking
+//   and context-aware submission
 // - Connection pooling and automatic reconnection
 // - Traffic statistics and monitoring
 //
@@ -16,17 +25,33 @@ package mirror
 
 import (
     "bytes"
+    "context"
     "encoding/binary"
     "encoding/json"
+    "errors"
     "fmt"
     "net"
     "net/http"
+    "runtime"
+    "sort"
     "sync"
+    "sync/atomic"
     "time"
 
     log "github.com/sirupsen/logrus"
+
+    "github.com/tobogganing/headend/proxy/connctx"
 )
 
+// ErrQueueFull is returned when a packet is rejected because the mirror queue,
+// and the spill file if there is one, is saturated. Dropped packets are
+// counted in the stats and, by reason, in the headend_mirror_dropped_total
+// metric, never retried.
+var ErrQueueFull = errors.New("mirror queue full")
+
+// ErrStopped is returned when a packet is submitted after Stop was called.
+var ErrStopped = errors.New("mirror manager stopped")
+
 type Manager struct {
     destinations    []string
     protocol        string
@@ -41,8 +66,42 @@ type Manager struct {
     suricataHost    string
     suricataPort    string
     suricataConn    net.Conn
+    lastDropLog     atomic.Int64
+    
+    // Selection, applied before packets are queued. The Manager may
+    // replace it while packets are being mirrored.
+    selection atomic.Pointer[selection]
+    
+    // workers is the size of the worker pool; 0 sizes it to GOMAXPROCS
+    workers int
+    // suricataJSON wraps each packet sent to Suricata in an EVE JSON
+    // envelope; without it the payload is sent as is
+    suricataJSON bool
+    
+    // pcapng capture destinations, fixed once started
+    captureConfig CaptureConfig
+    captures      []*capture
+    
+    // flowObserver correlates IDS alerts with sessions
+    flowObserver FlowObserver
+    
+    // Kafka metadata destinations, fixed once started
+    kafkaConfig KafkaConfig
+    kafkaSinks  []*kafkaSink
+    
+    // What to do when the queue is full, and the spill file the queue
+    // overflows into
+    backpressure BackpressureConfig
+    spill        *spill
+    
+    // GRE and ERSPAN headers
+    encap *encapsulator
 }
 
+// maxWorkers bounds the default worker pool. Sending is mostly syscalls, so
+// more workers than this only add contention on the destinations.
+const maxWorkers = 4
+
 type MirrorPacket struct {
     Timestamp   time.Time
     Source      net.IP
@@ -73,6 +132,8 @@ func NewManager(destinations []string, protocol string, bufferSize int) *Manager
         stopCh:       make(chan struct{}),
         connections:  make(map[string]net.Conn),
         stats:        &Stats{},
+        backpressure: BackpressureConfig{Policy: DropNewest},
+        encap:        newEncapsulator(EncapConfig{}),
     }
 }
 
@@ -89,17 +150,115 @@ func NewManagerWithSuricata(destinations []string, protocol string, bufferSize i
         stopCh:          make(chan struct{}),
         connections:     make(map[string]net.Conn),
         stats:           &Stats{},
+        backpressure:    BackpressureConfig{Policy: DropNewest},
+        encap:           newEncapsulator(EncapConfig{}),
         suricataEnabled: suricataHost != "" && suricataPort != "",
+        suricataJSON:    true,
         suricataHost:    suricataHost,
         suricataPort:    suricataPort,
     }
 }
 
+// selection is the traffic chosen for mirroring
+type selection struct {
+    sampleRate int
+    filter     *Filter
+}
+
+// SetSelection mirrors one in sampleRate sessions of the traffic filter
+// selects. A sampleRate of 0 or 1 mirrors every session and a nil filter
+// selects all traffic. It may be called at any time.
+func (m *Manager) SetSelection(sampleRate int, filter *Filter) {
+    m.selection.Store(&selection{sampleRate: sampleRate, filter: filter})
+}
+
+// SetWorkers sets the number of workers sending mirrored packets; 0 uses
+// one per GOMAXPROCS, up to maxWorkers. It must be called before Start.
+func (m *Manager) SetWorkers(workers int) {
+    m.workers = workers
+}
+
+// SetSuricataJSON turns the per-packet EVE JSON envelope for Suricata on or
+// off. Marshaling every packet is the mirror's largest CPU cost on small
+// ARM gateways. It must be called before Start.
+func (m *Manager) SetSuricataJSON(enabled bool) {
+    m.suricataJSON = enabled
+}
+
+// SetCaptureConfig configures the file:// and s3:// capture destinations.
+// It must be called before Start.
+func (m *Manager) SetCaptureConfig(config CaptureConfig) {
+    m.captureConfig = config
+}
+
+// SetFlowObserver registers observer to learn of every mirrored flow. It
+// must be called before Start.
+func (m *Manager) SetFlowObserver(observer FlowObserver) {
+    m.flowObserver = observer
+}
+
+// SetKafkaConfig configures the kafka:// destinations. It must be called
+// before Start.
+func (m *Manager) SetKafkaConfig(config KafkaConfig) {
+    m.kafkaConfig = config
+}
+
+// SetBackpressure configures what happens to packets that find the queue
+// full. It must be called before Start.
+func (m *Manager) SetBackpressure(config BackpressureConfig) error {
+    switch config.Policy {
+    case "":
+        config.Policy = DropNewest
+    case DropNewest, DropOldest, Block:
+    default:
+        return fmt.Errorf("unknown mirror backpressure policy %q", config.Policy)
+    }
+    m.backpressure = config
+    return nil
+}
+
+// SetEncapConfig configures the GRE and ERSPAN headers. It must be called
+// before Start.
+func (m *Manager) SetEncapConfig(config EncapConfig) error {
+    if err := config.validate(); err != nil {
+        return err
+    }
+    m.encap = newEncapsulator(config)
+    return nil
+}
+
 func (m *Manager) Start() error {
     log.Infof("Starting mirror manager with protocol %s to %v", m.protocol, m.destinations)
     
+    if m.backpressure.SpillPath != "" {
+        spill, err := openSpill(m.backpressure.SpillPath, m.backpressure.SpillMaxBytes)
+        if err != nil {
+            return err
+        }
+        m.spill = spill
+    }
+    
     // Establish connections to mirror destinations
     for _, dest := range m.destinations {
+        if isCaptureDestination(dest) {
+            c, err := newCapture(dest, m.captureConfig)
+            if err != nil {
+                log.Errorf("Failed to open mirror capture %s: %v", dest, err)
+                continue
+            }
+            m.captures = append(m.captures, c)
+            continue
+        }
+        if isKafkaDestination(dest) {
+            sink, err := newKafkaSink(dest, m.kafkaConfig)
+            if err != nil {
+                log.Errorf("Failed to configure mirror destination %s: %v", dest, err)
+                continue
+            }
+            m.kafkaSinks = append(m.kafkaSinks, sink)
+            continue
+        }
+        
         conn, err := m.createConnection(dest)
         if err != nil {
             log.Errorf("Failed to connect to mirror destination %s: %v", dest, err)
@@ -110,7 +269,7 @@ func (m *Manager) Start() error {
     
     // Initialize Suricata connection if enabled
     if m.suricataEnabled {
-        suricataAddr := fmt.Sprintf("%s:%s", m.suricataHost, m.suricataPort)
+        suricataAddr := net.JoinHostPort(m.suricataHost, m.suricataPort)
         conn, err := net.Dial("tcp", suricataAddr)
         if err != nil {
             log.Errorf("Failed to connect to Suricata at %s: %v", suricataAddr, err)
@@ -120,20 +279,38 @@ func (m *Manager) Start() error {
         }
     }
     
-    if len(m.connections) == 0 && !m.suricataEnabled {
+    if len(m.connections) == 0 && len(m.captures) == 0 && len(m.kafkaSinks) == 0 && !m.suricataEnabled {
+        if m.spill != nil {
+            m.spill.close()
+        }
         return fmt.Errorf("no mirror destinations available")
     }
     
+    queueCapacity.Set(float64(cap(m.queue)))
+    
     // Start worker goroutines
-    workerCount := 4
+    workerCount := m.workers
+    if workerCount <= 0 {
+        workerCount = min(runtime.GOMAXPROCS(0), maxWorkers)
+    }
     for i := 0; i < workerCount; i++ {
         m.wg.Add(1)
         go m.worker()
     }
     
+    if m.spill != nil {
+        m.wg.Add(1)
+        go m.drainSpill()
+    }
+    
     // Start stats reporter
     go m.reportStats()
     
+    if len(m.captures) > 0 {
+        m.wg.Add(1)
+        go m.rotateCaptures()
+    }
+    
     return nil
 }
 
@@ -144,6 +321,19 @@ func (m *Manager) Stop() {
     // Wait for workers to finish
     m.wg.Wait()
     
+    // Keep what is still spilled for the next start
+    if m.spill != nil {
+        m.spill.close()
+    }
+    
+    // Finish capture files, uploading what is pending
+    for _, c := range m.captures {
+        c.close()
+    }
+    for _, sink := range m.kafkaSinks {
+        sink.close()
+    }
+    
     // Close connections
     m.mu.Lock()
     for dest, conn := range m.connections {
@@ -166,81 +356,163 @@ func (m *Manager) Stop() {
 
 func (m *Manager) createConnection(dest string) (net.Conn, error) {
     switch m.protocol {
-    case "VXLAN":
-        return net.Dial("udp", dest)
-    case "GRE":
-        return net.Dial("ip4:47", dest)
-    case "ERSPAN":
-        return net.Dial("udp", dest)
+    case "GRE", "ERSPAN":
+        // GRE is its own IP protocol, so a port means nothing to it
+        host := dest
+        if h, _, err := net.SplitHostPort(dest); err == nil {
+            host = h
+        }
+        addr, err := net.ResolveIPAddr("ip", host)
+        if err != nil {
+            return nil, err
+        }
+        network := "ip4:gre"
+        if addr.IP.To4() == nil {
+            network = "ip6:gre"
+        }
+        return net.DialIP(network, nil, addr)
     default:
         return net.Dial("udp", dest)
     }
 }
 
+// MirrorHTTP encodes the request and response body and queues them without
+// blocking. It is safe to call directly from the request path.
 func (m *Manager) MirrorHTTP(req *http.Request, statusCode int, body []byte) {
+    dst := req.Host
+    if _, _, err := net.SplitHostPort(dst); err != nil {
+        if req.TLS != nil {
+            dst = net.JoinHostPort(dst, "443")
+        } else {
+            dst = net.JoinHostPort(dst, "80")
+        }
+    }
+    if !m.selects(req.Context(), "http", req.RemoteAddr, dst) {
+        return
+    }
+    
     packet := &MirrorPacket{
         Timestamp: time.Now(),
         Protocol:  "HTTP",
         Data:      m.encodeHTTP(req, statusCode, body),
         Metadata: map[string]interface{}{
+            "src":         req.RemoteAddr,
+            "dst":         dst,
             "method":      req.Method,
             "url":         req.URL.String(),
             "status_code": statusCode,
             "user_agent":  req.UserAgent(),
         },
     }
+    tagPacket(req.Context(), packet)
     
-    select {
-    case m.queue <- packet:
-        // Packet queued successfully
-    default:
-        // Queue full, drop packet
-        m.stats.incrementDropped()
-        log.Warn("Mirror queue full, dropping packet")
+    if err := m.TrySubmit(packet); err != nil {
+        log.Debugf("Dropping HTTP mirror packet: %v", err)
     }
 }
 
+// MirrorTCP queues a copy of data for mirroring. The caller may reuse data
+// once MirrorTCP returns.
 func (m *Manager) MirrorTCP(src, dst string, data []byte) {
+    m.MirrorTCPContext(context.Background(), src, dst, data)
+}
+
+// MirrorTCPContext is MirrorTCP for a connection whose metadata is carried
+// by ctx, tagging the mirrored packet with its user and request ID
+func (m *Manager) MirrorTCPContext(ctx context.Context, src, dst string, data []byte) {
+    if !m.selects(ctx, "tcp", src, dst) {
+        return
+    }
+    
     packet := &MirrorPacket{
         Timestamp: time.Now(),
         Protocol:  "TCP",
-        Data:      data,
+        Data:      append([]byte(nil), data...),
         Metadata: map[string]interface{}{
             "src": src,
             "dst": dst,
             "protocol": "tcp",
         },
     }
+    tagPacket(ctx, packet)
     
-    select {
-    case m.queue <- packet:
-        // Packet queued successfully
-    default:
-        // Queue full, drop packet
-        m.stats.incrementDropped()
-        log.Warn("Mirror queue full, dropping TCP packet")
+    if err := m.TrySubmit(packet); err != nil {
+        log.Debugf("Dropping TCP mirror packet: %v", err)
     }
 }
 
+// MirrorUDP queues a copy of data for mirroring. The caller may reuse data
+// once MirrorUDP returns.
 func (m *Manager) MirrorUDP(src, dst string, data []byte) {
+    m.MirrorUDPContext(context.Background(), src, dst, data)
+}
+
+// MirrorUDPContext is MirrorUDP for a datagram whose metadata is carried by
+// ctx, tagging the mirrored packet with its user and request ID
+func (m *Manager) MirrorUDPContext(ctx context.Context, src, dst string, data []byte) {
+    if !m.selects(ctx, "udp", src, dst) {
+        return
+    }
+    
     packet := &MirrorPacket{
         Timestamp: time.Now(),
-        Protocol:  "UDP", 
-        Data:      data,
+        Protocol:  "UDP",
+        Data:      append([]byte(nil), data...),
         Metadata: map[string]interface{}{
             "src": src,
             "dst": dst,
             "protocol": "udp",
         },
     }
+    tagPacket(ctx, packet)
     
-    select {
-    case m.queue <- packet:
-        // Packet queued successfully
-    default:
-        // Queue full, drop packet
-        m.stats.incrementDropped()
-        log.Warn("Mirror queue full, dropping UDP packet")
+    if err := m.TrySubmit(packet); err != nil {
+        log.Debugf("Dropping UDP mirror packet: %v", err)
+    }
+}
+
+// selects applies the sample rate and filter to a packet about to be
+// mirrored, so unselected traffic is never copied or queued
+func (m *Manager) selects(ctx context.Context, protocol, src, dst string) bool {
+    sel := m.selection.Load()
+    if sel == nil || sel.sampleRate <= 1 && sel.filter == nil {
+        return true
+    }
+    
+    if !sampled(sel.sampleRate, src, dst) {
+        skippedPackets.WithLabelValues("sample").Inc()
+        return false
+    }
+    if sel.filter != nil {
+        info := &flowInfo{
+            protocol: protocol,
+            src:      splitEndpoint(src),
+            dst:      splitEndpoint(dst),
+        }
+        if meta := connctx.FromContext(ctx); meta != nil {
+            info.userID = meta.UserID()
+        }
+        if !sel.filter.matches(info) {
+            skippedPackets.WithLabelValues("filter").Inc()
+            return false
+        }
+    }
+    return true
+}
+
+// tagPacket adds the user and request ID of the connection in ctx to a
+// mirrored packet's metadata
+func tagPacket(ctx context.Context, packet *MirrorPacket) {
+    meta := connctx.FromContext(ctx)
+    if meta == nil {
+        return
+    }
+    packet.Metadata["request_id"] = meta.RequestID
+    if meta.SourceIP != "" {
+        packet.Metadata["client"] = meta.SourceIP
+    }
+    if userID := meta.UserID(); userID != "" {
+        packet.Metadata["user_id"] = userID
     }
 }
 
@@ -252,13 +524,241 @@ func (m *Manager) MirrorRaw(data []byte, metadata map[string]interface{}) {
         Metadata:  metadata,
     }
     
+    _ = m.TrySubmit(packet)
+}
+
+// TrySubmit queues a packet. When the queue is saturated the packet goes to
+// the spill file, if there is one, and otherwise the backpressure policy
+// decides: only the block policy makes the caller wait, and no longer than
+// its timeout, so callers on the data path never wait on mirror destinations
+// for long. ErrQueueFull is returned when the packet is dropped.
+func (m *Manager) TrySubmit(packet *MirrorPacket) error {
+    select {
+    case <-m.stopCh:
+        return ErrStopped
+    default:
+    }
+    
+    // Packets queue behind spilled ones, so they are mirrored in order
+    if !m.spilling() {
+        select {
+        case m.queue <- packet:
+            queueDepth.Set(float64(len(m.queue)))
+            return nil
+        default:
+        }
+    }
+    return m.overflow(packet)
+}
+
+// spilling reports whether packets are waiting in the spill file
+func (m *Manager) spilling() bool {
+    if m.spill == nil {
+        return false
+    }
+    count, _ := m.spill.size()
+    return count > 0
+}
+
+// overflow handles a packet that found the queue full
+func (m *Manager) overflow(packet *MirrorPacket) error {
+    if m.spill != nil {
+        evicted, err := m.spill.push(packet, m.backpressure.Policy == DropOldest)
+        for i := 0; i < evicted; i++ {
+            m.recordDrop("evicted")
+        }
+        if err == nil {
+            spilledPackets.Inc()
+            return nil
+        }
+        if !errors.Is(err, errSpillFull) {
+            log.Errorf("Failed to spill mirrored packet: %v", err)
+            m.recordDrop("spill_error")
+            return fmt.Errorf("%w: %v", ErrQueueFull, err)
+        }
+    }
+    
+    switch m.backpressure.Policy {
+    case DropOldest:
+        select {
+        case <-m.queue:
+            m.recordDrop("evicted")
+        default:
+        }
+        select {
+        case m.queue <- packet:
+            queueDepth.Set(float64(len(m.queue)))
+            return nil
+        default:
+            m.recordDrop("queue_full")
+            return ErrQueueFull
+        }
+    case Block:
+        timer := time.NewTimer(m.backpressure.BlockTimeout)
+        defer timer.Stop()
+        select {
+        case m.queue <- packet:
+            queueDepth.Set(float64(len(m.queue)))
+            return nil
+        case <-m.stopCh:
+            return ErrStopped
+        case <-timer.C:
+            m.recordDrop("timeout")
+            return ErrQueueFull
+        }
+    default:
+        m.recordDrop("queue_full")
+        return ErrQueueFull
+    }
+}
+
+// drainSpill feeds spilled packets back into the queue as it drains. A
+// packet leaves the spill file only once it is queued, so none are lost to
+// a restart.
+func (m *Manager) drainSpill() {
+    defer m.wg.Done()
+    
+    for {
+        packet, seq, err := m.spill.peek()
+        if err != nil {
+            log.Errorf("Failed to read mirror spill file: %v", err)
+        }
+        if packet == nil {
+            select {
+            case <-m.spill.ready:
+                continue
+            case <-m.stopCh:
+                return
+            }
+        }
+        
+        select {
+        case m.queue <- packet:
+            queueDepth.Set(float64(len(m.queue)))
+            if err := m.spill.discard(seq); err != nil {
+                log.Errorf("Failed to update mirror spill file: %v", err)
+            }
+        case <-m.stopCh:
+            return
+        }
+    }
+}
+
+// Submit queues a packet, waiting for queue space until ctx is done. It is
+// intended for callers that can tolerate backpressure (e.g. replay tooling);
+// on timeout or cancellation the packet is dropped and counted like TrySubmit.
+func (m *Manager) Submit(ctx context.Context, packet *MirrorPacket) error {
+    select {
+    case <-m.stopCh:
+        return ErrStopped
+    default:
+    }
+    
     select {
     case m.queue <- packet:
-        // Packet queued successfully
+        queueDepth.Set(float64(len(m.queue)))
+        return nil
     default:
-        // Queue full, drop packet
-        m.stats.incrementDropped()
     }
+    
+    select {
+    case m.queue <- packet:
+        queueDepth.Set(float64(len(m.queue)))
+        return nil
+    case <-m.stopCh:
+        return ErrStopped
+    case <-ctx.Done():
+        m.recordDrop("timeout")
+        return fmt.Errorf("%w: %v", ErrQueueFull, ctx.Err())
+    }
+}
+
+// recordDrop counts a packet dropped for reason and rate-limits the warning
+// log so a saturated queue does not flood the proxy logs.
+func (m *Manager) recordDrop(reason string) {
+    m.stats.incrementDropped()
+    droppedPackets.WithLabelValues(reason).Inc()
+    
+    now := time.Now().Unix()
+    last := m.lastDropLog.Load()
+    if now-last >= 10 && m.lastDropLog.CompareAndSwap(last, now) {
+        log.Warnf("Mirror queue saturated (%d/%d), dropping packets", len(m.queue), cap(m.queue))
+    }
+}
+
+// QueueDepth returns the number of packets waiting to be mirrored
+func (m *Manager) QueueDepth() int {
+    return len(m.queue)
+}
+
+// QueueCapacity returns the maximum number of packets the queue can hold
+func (m *Manager) QueueCapacity() int {
+    return cap(m.queue)
+}
+
+// Status is a snapshot of the mirror for the admin API
+type Status struct {
+    Destinations      []string `json:"destinations"`
+    Connected         []string `json:"connected"`
+    Protocol          string   `json:"protocol"`
+    SuricataConnected bool     `json:"suricata_connected"`
+    PacketsSent       uint64   `json:"packets_sent"`
+    PacketsDropped    uint64   `json:"packets_dropped"`
+    BytesSent         uint64   `json:"bytes_sent"`
+    Errors            uint64   `json:"errors"`
+    QueueDepth        int      `json:"queue_depth"`
+    QueueCapacity     int      `json:"queue_capacity"`
+    Backpressure      string   `json:"backpressure"`
+    SpillPackets      int      `json:"spill_packets"`
+    SpillBytes        int64    `json:"spill_bytes"`
+    SampleRate        int      `json:"sample_rate"`
+    Filter            string   `json:"filter,omitempty"`
+}
+
+// Status returns the mirror's destinations and counters. It is nil-safe.
+func (m *Manager) Status() *Status {
+    if m == nil {
+        return nil
+    }
+
+    status := &Status{
+        Destinations:  m.destinations,
+        Connected:     []string{},
+        Protocol:      m.protocol,
+        QueueDepth:    m.QueueDepth(),
+        QueueCapacity: m.QueueCapacity(),
+        Backpressure:  m.backpressure.Policy,
+    }
+    if sel := m.selection.Load(); sel != nil {
+        status.SampleRate = sel.sampleRate
+        status.Filter = sel.filter.String()
+    }
+    if m.spill != nil {
+        status.SpillPackets, status.SpillBytes = m.spill.size()
+    }
+
+    m.mu.RLock()
+    for dest := range m.connections {
+        status.Connected = append(status.Connected, dest)
+    }
+    for _, c := range m.captures {
+        status.Connected = append(status.Connected, c.dest)
+    }
+    for _, sink := range m.kafkaSinks {
+        status.Connected = append(status.Connected, sink.dest)
+    }
+    status.SuricataConnected = m.suricataConn != nil
+    m.mu.RUnlock()
+    sort.Strings(status.Connected)
+
+    m.stats.mu.RLock()
+    status.PacketsSent = m.stats.PacketsSent
+    status.PacketsDropped = m.stats.PacketsDropped
+    status.BytesSent = m.stats.BytesSent
+    status.Errors = m.stats.Errors
+    m.stats.mu.RUnlock()
+
+    return status
 }
 
 func (m *Manager) worker() {
@@ -267,6 +767,7 @@ func (m *Manager) worker() {
     for {
         select {
         case packet := <-m.queue:
+            queueDepth.Set(float64(len(m.queue)))
             m.sendPacket(packet)
         case <-m.stopCh:
             // Drain remaining packets
@@ -284,45 +785,79 @@ func (m *Manager) worker() {
 }
 
 func (m *Manager) sendPacket(packet *MirrorPacket) {
-    var encapsulated []byte
-    var err error
+    if m.flowObserver != nil {
+        src, _ := packet.Metadata["src"].(string)
+        dst, _ := packet.Metadata["dst"].(string)
+        if src != "" && dst != "" {
+            client, _ := packet.Metadata["client"].(string)
+            userID, _ := packet.Metadata["user_id"].(string)
+            requestID, _ := packet.Metadata["request_id"].(string)
+            m.flowObserver.ObserveFlow(FlowID(src, dst), src, dst, client, userID, requestID)
+        }
+    }
     
-    switch m.protocol {
-    case "VXLAN":
-        encapsulated, err = m.encapsulateVXLAN(packet)
-    case "GRE":
-        encapsulated, err = m.encapsulateGRE(packet)
-    case "ERSPAN":
-        encapsulated, err = m.encapsulateERSPAN(packet)
-    default:
-        encapsulated = packet.Data
+    // Capture files take the packet as mirrored, not encapsulated
+    for _, c := range m.captures {
+        written, err := c.write(packet)
+        if err != nil {
+            log.Errorf("Failed to write mirror capture %s: %v", c.dest, err)
+            m.stats.incrementErrors()
+        } else {
+            m.stats.incrementSent(uint64(written))
+        }
     }
     
-    if err != nil {
-        log.Errorf("Failed to encapsulate packet: %v", err)
-        m.stats.incrementErrors()
-        return
+    // Kafka gets only the metadata, batched by each sink
+    for _, sink := range m.kafkaSinks {
+        if !sink.add(packet) {
+            m.stats.incrementErrors()
+        }
     }
     
     m.mu.RLock()
     defer m.mu.RUnlock()
     
     // Send to regular mirror destinations
-    for dest, conn := range m.connections {
-        if _, err := conn.Write(encapsulated); err != nil {
-            log.Errorf("Failed to send to mirror destination %s: %v", dest, err)
-            m.stats.incrementErrors()
-            
-            // Try to reconnect
-            go m.reconnect(dest)
-        } else {
-            m.stats.incrementSent(uint64(len(encapsulated)))
+    if len(m.connections) > 0 {
+        var encapsulated [][]byte
+        switch m.protocol {
+        case "VXLAN":
+            vxlan, err := m.encapsulateVXLAN(packet)
+            if err != nil {
+                log.Errorf("Failed to encapsulate packet: %v", err)
+                m.stats.incrementErrors()
+                return
+            }
+            encapsulated = [][]byte{vxlan}
+        case "GRE":
+            encapsulated = m.encap.gre(packet)
+        case "ERSPAN":
+            encapsulated = m.encap.erspan(packet)
+        default:
+            encapsulated = [][]byte{packet.Data}
+        }
+        
+        for dest, conn := range m.connections {
+            for _, b := range encapsulated {
+                if _, err := conn.Write(b); err != nil {
+                    log.Errorf("Failed to send to mirror destination %s: %v", dest, err)
+                    m.stats.incrementErrors()
+                    
+                    // Try to reconnect
+                    go m.reconnect(dest)
+                    break
+                }
+                m.stats.incrementSent(uint64(len(b)))
+            }
         }
     }
     
     // Send to Suricata if enabled
     if m.suricataEnabled && m.suricataConn != nil {
-        suricataData := m.prepareSuricataData(packet)
+        suricataData := packet.Data
+        if m.suricataJSON {
+            suricataData = m.prepareSuricataData(packet)
+        }
         if _, err := m.suricataConn.Write(suricataData); err != nil {
             log.Errorf("Failed to send to Suricata: %v", err)
             m.stats.incrementErrors()
@@ -347,30 +882,6 @@ func (m *Manager) encapsulateVXLAN(packet *MirrorPacket) ([]byte, error) {
     return append(vxlanHeader, packet.Data...), nil
 }
 
-func (m *Manager) encapsulateGRE(packet *MirrorPacket) ([]byte, error) {
-    // Simplified GRE encapsulation
-    greHeader := make([]byte, 4)
-    binary.BigEndian.PutUint16(greHeader[2:], 0x0800) // Protocol type: IPv4
-    
-    return append(greHeader, packet.Data...), nil
-}
-
-func (m *Manager) encapsulateERSPAN(packet *MirrorPacket) ([]byte, error) {
-    // ERSPAN Type II header
-    erspanHeader := make([]byte, 8)
-    
-    // Version (4 bits) | VLAN (12 bits)
-    binary.BigEndian.PutUint16(erspanHeader[0:], 0x1000) // Version 1, VLAN 0
-    
-    // COS (3 bits) | EN (2 bits) | T (1 bit) | Session ID (10 bits)
-    binary.BigEndian.PutUint16(erspanHeader[2:], 0x0001) // Session ID 1
-    
-    // Reserved (12 bits) | Index (20 bits)
-    binary.BigEndian.PutUint32(erspanHeader[4:], uint32(time.Now().Unix()&0xFFFFF))
-    
-    return append(erspanHeader, packet.Data...), nil
-}
-
 func (m *Manager) encodeHTTP(req *http.Request, statusCode int, body []byte) []byte {
     var buf bytes.Buffer
     
@@ -419,6 +930,25 @@ func (m *Manager) reconnect(dest string) {
     log.Infof("Reconnected to mirror destination %s", dest)
 }
 
+// rotateCaptures periodically flushes, rotates and uploads the capture files
+func (m *Manager) rotateCaptures() {
+    defer m.wg.Done()
+    
+    ticker := time.NewTicker(captureTick)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case now := <-ticker.C:
+            for _, c := range m.captures {
+                c.tick(now)
+            }
+        case <-m.stopCh:
+            return
+        }
+    }
+}
+
 func (m *Manager) reportStats() {
     ticker := time.NewTicker(60 * time.Second)
     defer ticker.Stop()
@@ -480,7 +1010,7 @@ func (m *Manager) prepareSuricataData(packet *MirrorPacket) []byte {
     // Create Suricata EVE JSON format
     eveLog := map[string]interface{}{
         "timestamp":    packet.Timestamp.Format(time.RFC3339Nano),
-        "flow_id":      fmt.Sprintf("%x", packet.Timestamp.UnixNano()),
+        "flow_id":      suricataFlowID(packet),
         "event_type":   "mirror",
         "mirror":       envelope,
         "sasewaddle": map[string]interface{}{
@@ -499,6 +1029,18 @@ func (m *Manager) prepareSuricataData(packet *MirrorPacket) []byte {
     return append(jsonData, '\n')
 }
 
+// suricataFlowID is the flow ID of packet's endpoints, so Suricata's alerts
+// on a flow can be correlated with the session. Packets without endpoints
+// fall back to an ID of their own.
+func suricataFlowID(packet *MirrorPacket) int64 {
+    src, _ := packet.Metadata["src"].(string)
+    dst, _ := packet.Metadata["dst"].(string)
+    if src == "" || dst == "" {
+        return packet.Timestamp.UnixNano()
+    }
+    return FlowID(src, dst)
+}
+
 // reconnectSuricata attempts to reconnect to Suricata
 func (m *Manager) reconnectSuricata() {
     m.mu.Lock()
@@ -511,7 +1053,7 @@ func (m *Manager) reconnectSuricata() {
         m.suricataConn = nil
     }
     
-    suricataAddr := fmt.Sprintf("%s:%s", m.suricataHost, m.suricataPort)
+    suricataAddr := net.JoinHostPort(m.suricataHost, m.suricataPort)
     conn, err := net.Dial("tcp", suricataAddr)
     if err != nil {
         log.Errorf("Failed to reconnect to Suricata at %s: %v", suricataAddr, err)
@@ -0,0 +1,121 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// discardConn stands in for a Suricata connection
+type discardConn struct {
+    net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) {
+    return len(p), nil
+}
+
+// BenchmarkSendPacketSuricata compares sending a mirrored packet to
+// Suricata with and without the per-packet EVE JSON envelope, which the
+// edge tuning profile turns off
+func BenchmarkSendPacketSuricata(b *testing.B) {
+    packet := &MirrorPacket{
+        Timestamp: time.Now(),
+        Protocol:  "TCP",
+        Data:      make([]byte, 1400),
+        Metadata: map[string]interface{}{
+            "src":        "10.0.0.1:40000",
+            "dst":        "10.0.0.2:443",
+            "protocol":   "tcp",
+            "request_id": "0123456789abcdef",
+            "user_id":    "alice",
+        },
+    }
+
+    for _, bench := range []struct {
+        name string
+        json bool
+    }{
+        {"json", true},
+        {"raw", false},
+    } {
+        b.Run(bench.name, func(b *testing.B) {
+            m := NewManagerWithSuricata(nil, "VXLAN", 1, "suricata", "9999")
+            m.SetSuricataJSON(bench.json)
+            m.suricataConn = discardConn{}
+
+            b.SetBytes(int64(len(packet.Data)))
+            b.ReportAllocs()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                m.sendPacket(packet)
+            }
+        })
+    }
+}
+
+func TestSetSelectionReplacesSelection(t *testing.T) {
+    m := NewManager(nil, "", 10)
+    ctx := context.Background()
+    if !m.selects(ctx, "udp", "198.51.100.8:53000", "10.1.2.3:53") {
+        t.Fatal("expected everything to be mirrored before a selection is set")
+    }
+
+    filter, _ := ParseFilter("tcp")
+    m.SetSelection(0, filter)
+    if m.selects(ctx, "udp", "198.51.100.8:53000", "10.1.2.3:53") || !m.selects(ctx, "tcp", "198.51.100.7:51000", "10.1.2.3:443") {
+        t.Error("expected only TCP to be mirrored")
+    }
+    if status := m.Status(); status.Filter != "tcp" || status.SampleRate != 0 {
+        t.Errorf("unexpected status %+v", status)
+    }
+
+    m.SetSelection(0, nil)
+    if !m.selects(ctx, "udp", "198.51.100.8:53000", "10.1.2.3:53") {
+        t.Error("expected clearing the filter to mirror everything again")
+    }
+}
+
+func TestSubmitWaitsThenDrops(t *testing.T) {
+    m := NewManager(nil, "VXLAN", 1)
+    if err := m.Submit(context.Background(), spillPacket(0)); err != nil {
+        t.Fatal(err)
+    }
+
+    // A saturated queue makes Submit wait for space
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        <-m.queue
+    }()
+    if err := m.Submit(context.Background(), spillPacket(1)); err != nil {
+        t.Fatalf("submit after space freed: %v", err)
+    }
+
+    // ...until its context ends, when the packet is dropped and counted
+    timeouts := testutil.ToFloat64(droppedPackets.WithLabelValues("timeout"))
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if err := m.Submit(ctx, spillPacket(2)); !errors.Is(err, ErrQueueFull) {
+        t.Fatalf("got %v after the deadline, want ErrQueueFull", err)
+    }
+    if got := testutil.ToFloat64(droppedPackets.WithLabelValues("timeout")) - timeouts; got != 1 {
+        t.Errorf("counted %v timeout drops, want 1", got)
+    }
+    m.stats.mu.Lock()
+    dropped := m.stats.PacketsDropped
+    m.stats.mu.Unlock()
+    if dropped != 1 || m.QueueDepth() != 1 || requestID(<-m.queue) != "req-1" {
+        t.Error("the dropped packet displaced the queued one")
+    }
+
+    m.Stop()
+    if err := m.Submit(context.Background(), spillPacket(3)); !errors.Is(err, ErrStopped) {
+        t.Errorf("got %v after Stop, want ErrStopped", err)
+    }
+}
@@ -0,0 +1,55 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_mirror_queue_depth",
+        Help: "Number of packets waiting in the mirror queue.",
+    })
+    
+    queueCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_mirror_queue_capacity",
+        Help: "Maximum number of packets the mirror queue can hold.",
+    })
+    
+    droppedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "headend_mirror_dropped_total",
+        Help: "Total number of mirror packets dropped because the queue was saturated, by reason (queue_full, evicted, timeout, spill_error).",
+    }, []string{"reason"})
+    
+    spilledPackets = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "headend_mirror_spilled_total",
+        Help: "Total number of mirror packets written to the spill file because the queue was full.",
+    })
+    
+    spillPackets = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_mirror_spill_packets",
+        Help: "Number of packets waiting in the mirror spill file.",
+    })
+    
+    spillBytes = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_mirror_spill_bytes",
+        Help: "Bytes of the mirror spill file in use.",
+    })
+    
+    skippedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "headend_mirror_skipped_total",
+        Help: "Total number of packets not mirrored because of the sample rate or filter, by reason (sample, filter).",
+    }, []string{"reason"})
+    
+    captureFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "headend_mirror_capture_files_total",
+        Help: "Total number of pcapng capture files by result (written, failed, uploaded, upload_failed).",
+    }, []string{"result"})
+    
+    kafkaRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "headend_mirror_kafka_records_total",
+        Help: "Total number of packet metadata records for Kafka by result (sent, dropped).",
+    }, []string{"result"})
+)
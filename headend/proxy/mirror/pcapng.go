@@ -0,0 +1,304 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net/netip"
+    "strings"
+)
+
+// pcapng block types and the link type of the captured packets
+const (
+    blockSectionHeader        = 0x0A0D0D0A
+    blockInterfaceDescription = 0x00000001
+    blockEnhancedPacket       = 0x00000006
+
+    byteOrderMagic = 0x1A2B3C4D
+
+    // linkTypeRaw packets start with their IPv4 or IPv6 header
+    linkTypeRaw = 101
+
+    optionEnd     = 0
+    optionComment = 1
+    optionUserApp = 4 // shb_userappl
+
+    // maxSegment bounds the payload of one synthesized packet so the IP
+    // length fields never overflow
+    maxSegment = 65000
+
+    // maxTrackedStreams bounds the TCP sequence state of a capture file
+    maxTrackedStreams = 65536
+)
+
+// pcapngWriter writes mirrored packets as a pcapng capture that Wireshark
+// can open. The proxy mirrors payloads, not frames, so each payload is
+// wrapped in synthesized IP and TCP or UDP headers built from the packet's
+// addresses. TCP sequence numbers run on per direction, so Wireshark can
+// reassemble streams.
+type pcapngWriter struct {
+    w       io.Writer
+    written int64
+    streams *tcpStreams
+}
+
+// tcpStreams numbers the synthesized TCP segments of each direction. It is
+// not safe for concurrent use.
+type tcpStreams struct {
+    // next sequence number per direction, keyed "src dst"
+    seq map[string]uint32
+}
+
+func newTCPStreams() *tcpStreams {
+    return &tcpStreams{seq: make(map[string]uint32)}
+}
+
+// newPcapngWriter writes the section header and the interface description
+// that every packet refers to
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+    p := &pcapngWriter{w: w, streams: newTCPStreams()}
+
+    // Section header: byte order magic, version 1.0, unknown section length
+    shb := make([]byte, 16)
+    binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+    binary.LittleEndian.PutUint16(shb[4:], 1)
+    binary.LittleEndian.PutUint16(shb[6:], 0)
+    binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+    shb = appendOption(shb, optionUserApp, []byte("tobogganing headend mirror"))
+    shb = appendOption(shb, optionEnd, nil)
+    if err := p.writeBlock(blockSectionHeader, shb); err != nil {
+        return nil, err
+    }
+
+    // Interface description: raw IP, no snap length, microsecond timestamps
+    idb := make([]byte, 8)
+    binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+    if err := p.writeBlock(blockInterfaceDescription, idb); err != nil {
+        return nil, err
+    }
+    return p, nil
+}
+
+// writePacket writes packet as one or more enhanced packet blocks
+func (p *pcapngWriter) writePacket(packet *MirrorPacket) error {
+    var comment []string
+    if userID, ok := packet.Metadata["user_id"].(string); ok && userID != "" {
+        comment = append(comment, "user="+userID)
+    }
+    if requestID, ok := packet.Metadata["request_id"].(string); ok && requestID != "" {
+        comment = append(comment, "request_id="+requestID)
+    }
+
+    for _, frame := range p.streams.ipPackets(packet, maxSegment) {
+        micros := uint64(packet.Timestamp.UnixMicro())
+        epb := make([]byte, 20, 20+len(frame)+64)
+        binary.LittleEndian.PutUint32(epb[0:], 0) // interface ID
+        binary.LittleEndian.PutUint32(epb[4:], uint32(micros>>32))
+        binary.LittleEndian.PutUint32(epb[8:], uint32(micros))
+        binary.LittleEndian.PutUint32(epb[12:], uint32(len(frame)))
+        binary.LittleEndian.PutUint32(epb[16:], uint32(len(frame)))
+        epb = append(epb, frame...)
+        epb = pad32(epb)
+        if len(comment) > 0 {
+            epb = appendOption(epb, optionComment, []byte(strings.Join(comment, " ")))
+            epb = appendOption(epb, optionEnd, nil)
+        }
+        if err := p.writeBlock(blockEnhancedPacket, epb); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// writeBlock frames body, which must be 32-bit aligned, as a pcapng block
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+    length := uint32(12 + len(body))
+    block := make([]byte, 0, length)
+    block = binary.LittleEndian.AppendUint32(block, blockType)
+    block = binary.LittleEndian.AppendUint32(block, length)
+    block = append(block, body...)
+    block = binary.LittleEndian.AppendUint32(block, length)
+
+    n, err := p.w.Write(block)
+    p.written += int64(n)
+    if err != nil {
+        return fmt.Errorf("failed to write pcapng block: %w", err)
+    }
+    return nil
+}
+
+// ipPackets wraps packet's payload in synthesized IP and TCP or UDP
+// headers built from its addresses, splitting it into segments of at most
+// maxPayload bytes. An empty payload still makes one packet.
+func (s *tcpStreams) ipPackets(packet *MirrorPacket, maxPayload int) [][]byte {
+    src := metadataEndpoint(packet.Metadata, "src")
+    dst := metadataEndpoint(packet.Metadata, "dst")
+    udp := strings.EqualFold(packet.Protocol, "UDP") || strings.EqualFold(packet.Protocol, "RAW")
+
+    var packets [][]byte
+    data := packet.Data
+    for first := true; first || len(data) > 0; first = false {
+        segment := data
+        if len(segment) > maxPayload {
+            segment = segment[:maxPayload]
+        }
+        data = data[len(segment):]
+
+        if udp {
+            packets = append(packets, ipPacket(src, dst, 17, udpSegment(src, dst, segment)))
+        } else {
+            packets = append(packets, ipPacket(src, dst, 6, s.tcpSegment(src, dst, segment)))
+        }
+    }
+    return packets
+}
+
+// tcpSegment builds a PSH/ACK segment carrying payload, advancing the
+// direction's sequence number and acknowledging the reverse direction
+func (s *tcpStreams) tcpSegment(src, dst endpoint, payload []byte) []byte {
+    forward := fmt.Sprintf("%v:%d %v:%d", src.addr, src.port, dst.addr, dst.port)
+    reverse := fmt.Sprintf("%v:%d %v:%d", dst.addr, dst.port, src.addr, src.port)
+    if len(s.seq) >= maxTrackedStreams {
+        s.seq = make(map[string]uint32)
+    }
+    seq, ok := s.seq[forward]
+    if !ok {
+        seq = 1
+    }
+    ack, ok := s.seq[reverse]
+    if !ok {
+        ack = 1
+    }
+    s.seq[forward] = seq + uint32(len(payload))
+
+    segment := make([]byte, 20, 20+len(payload))
+    binary.BigEndian.PutUint16(segment[0:], uint16(src.port))
+    binary.BigEndian.PutUint16(segment[2:], uint16(dst.port))
+    binary.BigEndian.PutUint32(segment[4:], seq)
+    binary.BigEndian.PutUint32(segment[8:], ack)
+    segment[12] = 5 << 4 // data offset: 5 words
+    segment[13] = 0x18   // PSH, ACK
+    binary.BigEndian.PutUint16(segment[14:], 65535)
+    segment = append(segment, payload...)
+    binary.BigEndian.PutUint16(segment[16:], transportChecksum(src, dst, 6, segment))
+    return segment
+}
+
+func udpSegment(src, dst endpoint, payload []byte) []byte {
+    segment := make([]byte, 8, 8+len(payload))
+    binary.BigEndian.PutUint16(segment[0:], uint16(src.port))
+    binary.BigEndian.PutUint16(segment[2:], uint16(dst.port))
+    binary.BigEndian.PutUint16(segment[4:], uint16(8+len(payload)))
+    segment = append(segment, payload...)
+    checksum := transportChecksum(src, dst, 17, segment)
+    if checksum == 0 {
+        checksum = 0xFFFF // zero means no checksum in UDP
+    }
+    binary.BigEndian.PutUint16(segment[6:], checksum)
+    return segment
+}
+
+// ipPacket wraps a transport segment in an IPv4 header, or IPv6 when
+// either end is an IPv6 address
+func ipPacket(src, dst endpoint, proto byte, segment []byte) []byte {
+    if isIPv6(src, dst) {
+        packet := make([]byte, 40, 40+len(segment))
+        packet[0] = 0x60
+        binary.BigEndian.PutUint16(packet[4:], uint16(len(segment)))
+        packet[6] = proto
+        packet[7] = 64 // hop limit
+        srcAddr, dstAddr := ip16(src.addr), ip16(dst.addr)
+        copy(packet[8:], srcAddr[:])
+        copy(packet[24:], dstAddr[:])
+        return append(packet, segment...)
+    }
+
+    packet := make([]byte, 20, 20+len(segment))
+    packet[0] = 0x45
+    binary.BigEndian.PutUint16(packet[2:], uint16(20+len(segment)))
+    binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+    packet[8] = 64                                  // TTL
+    packet[9] = proto
+    srcAddr, dstAddr := ip4(src.addr), ip4(dst.addr)
+    copy(packet[12:], srcAddr[:])
+    copy(packet[16:], dstAddr[:])
+    binary.BigEndian.PutUint16(packet[10:], ^checksumSum(0, packet))
+    return append(packet, segment...)
+}
+
+// transportChecksum is the TCP or UDP checksum of segment, including the
+// pseudo-header of the IP version ipPacket will use
+func transportChecksum(src, dst endpoint, proto byte, segment []byte) uint16 {
+    var pseudo []byte
+    if isIPv6(src, dst) {
+        srcAddr, dstAddr := ip16(src.addr), ip16(dst.addr)
+        pseudo = append(pseudo, srcAddr[:]...)
+        pseudo = append(pseudo, dstAddr[:]...)
+        pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+        pseudo = append(pseudo, 0, 0, 0, proto)
+    } else {
+        srcAddr, dstAddr := ip4(src.addr), ip4(dst.addr)
+        pseudo = append(pseudo, srcAddr[:]...)
+        pseudo = append(pseudo, dstAddr[:]...)
+        pseudo = append(pseudo, 0, proto)
+        pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+    }
+    return ^checksumSum(checksumSum(0, pseudo), segment)
+}
+
+// checksumSum adds data to an Internet checksum's one's complement sum
+func checksumSum(sum uint16, data []byte) uint16 {
+    total := uint32(sum)
+    for i := 0; i+1 < len(data); i += 2 {
+        total += uint32(binary.BigEndian.Uint16(data[i:]))
+    }
+    if len(data)%2 == 1 {
+        total += uint32(data[len(data)-1]) << 8
+    }
+    for total > 0xFFFF {
+        total = total>>16 + total&0xFFFF
+    }
+    return uint16(total)
+}
+
+// metadataEndpoint reads the src or dst address of a mirrored packet. Ends
+// known only by name are written as the unspecified address.
+func metadataEndpoint(metadata map[string]interface{}, key string) endpoint {
+    address, _ := metadata[key].(string)
+    return splitEndpoint(address)
+}
+
+func isIPv6(src, dst endpoint) bool {
+    return src.addr.Is6() || dst.addr.Is6()
+}
+
+func ip4(addr netip.Addr) [4]byte {
+    if addr.Is4() {
+        return addr.As4()
+    }
+    return [4]byte{}
+}
+
+func ip16(addr netip.Addr) [16]byte {
+    if addr.IsValid() {
+        return addr.As16()
+    }
+    return [16]byte{}
+}
+
+// appendOption appends a pcapng option, padded to 32 bits
+func appendOption(b []byte, code uint16, value []byte) []byte {
+    b = binary.LittleEndian.AppendUint16(b, code)
+    b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+    b = append(b, value...)
+    return pad32(b)
+}
+
+func pad32(b []byte) []byte {
+    for len(b)%4 != 0 {
+        b = append(b, 0)
+    }
+    return b
+}
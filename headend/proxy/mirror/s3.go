@@ -0,0 +1,157 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// s3Uploader puts finished capture files into an S3-compatible bucket,
+// signing requests with AWS Signature Version 4
+type s3Uploader struct {
+    config S3Config
+    bucket string
+    prefix string
+    client *http.Client
+}
+
+func newS3Uploader(config S3Config, bucket, prefix string) *s3Uploader {
+    if config.Region == "" {
+        config.Region = "us-east-1"
+    }
+    if config.Endpoint == "" {
+        config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+    }
+    config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+
+    return &s3Uploader{
+        config: config,
+        bucket: bucket,
+        prefix: strings.Trim(prefix, "/"),
+        client: &http.Client{Timeout: 10 * time.Minute},
+    }
+}
+
+// upload puts the file at path into the bucket under the prefix
+func (u *s3Uploader) upload(ctx context.Context, path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open capture: %w", err)
+    }
+    defer file.Close()
+
+    hash := sha256.New()
+    size, err := io.Copy(hash, file)
+    if err != nil {
+        return fmt.Errorf("failed to hash capture: %w", err)
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return fmt.Errorf("failed to rewind capture: %w", err)
+    }
+
+    key := filepath.Base(path)
+    if u.prefix != "" {
+        key = u.prefix + "/" + key
+    }
+    target := u.config.Endpoint + "/" + uriEncode(u.bucket) + "/" + uriEncode(key)
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, file)
+    if err != nil {
+        return fmt.Errorf("failed to create upload request: %w", err)
+    }
+    req.ContentLength = size
+    req.Header.Set("Content-Type", "application/vnd.tcpdump.pcap")
+    u.sign(req, hex.EncodeToString(hash.Sum(nil)), time.Now())
+
+    resp, err := u.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to upload capture: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("failed to upload capture: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    return nil
+}
+
+// sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers.
+// Every header already set on req is signed along with the host.
+func (u *s3Uploader) sign(req *http.Request, payloadHash string, now time.Time) {
+    now = now.UTC()
+    amzDate := now.Format("20060102T150405Z")
+    date := now.Format("20060102")
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    headers := map[string]string{"host": req.URL.Host}
+    for name, values := range req.Header {
+        headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+    }
+    names := make([]string, 0, len(headers))
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.Query().Encode(),
+        canonicalHeaders.String(),
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+
+    scope := date + "/" + u.config.Region + "/s3/aws4_request"
+    requestHash := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+    key := hmacSHA256([]byte("AWS4"+u.config.SecretKey), date)
+    key = hmacSHA256(key, u.config.Region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        u.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// uriEncode escapes everything but unreserved characters and slashes, the
+// encoding SigV4 expects of object keys
+func uriEncode(path string) string {
+    var b strings.Builder
+    for i := 0; i < len(path); i++ {
+        c := path[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+            c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
@@ -0,0 +1,321 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    spillMagic   = "HMSQ"
+    spillVersion = 1
+
+    // spillHeaderSize covers the magic, version, capacity, head offset,
+    // bytes used and record count
+    spillHeaderSize = 40
+    // spillRecordHeader is the length prefix of each record
+    spillRecordHeader = 4
+
+    defaultSpillMaxBytes = 256 << 20
+    minSpillMaxBytes     = 64 << 10
+)
+
+// errSpillFull is returned when a packet does not fit in the spill file
+// and eviction was not asked for
+var errSpillFull = errors.New("mirror spill file full")
+
+// spill is a bounded FIFO of packets in a ring file. The header at the
+// start of the file records where the oldest record is and how much of the
+// ring is in use, so the records survive a restart. Records are a 4-byte
+// big-endian length followed by the packet as JSON, and wrap around the
+// end of the ring.
+type spill struct {
+    path     string
+    file     *os.File
+    capacity uint64 // bytes of ring after the header
+
+    mu    sync.Mutex
+    head  uint64 // offset into the ring of the oldest record
+    used  uint64
+    count uint64
+    // seq numbers the oldest record, so a peeked record that was evicted
+    // meanwhile is not discarded twice
+    seq uint64
+    // ready is signaled when a record is pushed
+    ready chan struct{}
+}
+
+// openSpill opens the ring file at path, creating it with room for maxBytes
+// in total. Records left by a previous run are kept unless the file was
+// sized differently, in which case it is started afresh.
+func openSpill(path string, maxBytes int64) (*spill, error) {
+    if maxBytes <= 0 {
+        maxBytes = defaultSpillMaxBytes
+    }
+    if maxBytes < minSpillMaxBytes {
+        return nil, fmt.Errorf("mirror spill size %d is below the minimum of %d bytes", maxBytes, minSpillMaxBytes)
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+        return nil, fmt.Errorf("failed to create mirror spill directory: %w", err)
+    }
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open mirror spill file: %w", err)
+    }
+
+    s := &spill{
+        path:     path,
+        file:     file,
+        capacity: uint64(maxBytes) - spillHeaderSize,
+        ready:    make(chan struct{}, 1),
+    }
+    if info, err := file.Stat(); err == nil && info.Size() == 0 {
+        err = s.reset()
+        if err != nil {
+            file.Close()
+            return nil, err
+        }
+    } else if err := s.load(); err != nil {
+        log.Warnf("Starting mirror spill file %s afresh: %v", path, err)
+        if err := s.reset(); err != nil {
+            file.Close()
+            return nil, err
+        }
+    }
+    if err := file.Truncate(maxBytes); err != nil {
+        file.Close()
+        return nil, fmt.Errorf("failed to size mirror spill file: %w", err)
+    }
+    if s.count > 0 {
+        log.Infof("Mirror spill file %s holds %d packets from a previous run", path, s.count)
+        s.signal()
+    }
+    s.updateMetrics()
+    return s, nil
+}
+
+// load reads the header left by a previous run
+func (s *spill) load() error {
+    var header [spillHeaderSize]byte
+    if _, err := s.file.ReadAt(header[:], 0); err != nil {
+        return fmt.Errorf("no header: %w", err)
+    }
+    if string(header[:4]) != spillMagic || binary.BigEndian.Uint32(header[4:]) != spillVersion {
+        return errors.New("not a spill file")
+    }
+    if capacity := binary.BigEndian.Uint64(header[8:]); capacity != s.capacity {
+        return fmt.Errorf("sized for %d bytes, not %d", capacity+spillHeaderSize, s.capacity+spillHeaderSize)
+    }
+    head, used := binary.BigEndian.Uint64(header[16:]), binary.BigEndian.Uint64(header[24:])
+    if head >= s.capacity || used > s.capacity {
+        return errors.New("corrupt header")
+    }
+    s.head, s.used, s.count = head, used, binary.BigEndian.Uint64(header[32:])
+    return nil
+}
+
+// reset empties the ring. Caller must hold mu, or own s exclusively.
+func (s *spill) reset() error {
+    s.head, s.used, s.count = 0, 0, 0
+    s.seq++
+    return s.writeHeader()
+}
+
+func (s *spill) writeHeader() error {
+    var header [spillHeaderSize]byte
+    copy(header[:], spillMagic)
+    binary.BigEndian.PutUint32(header[4:], spillVersion)
+    binary.BigEndian.PutUint64(header[8:], s.capacity)
+    binary.BigEndian.PutUint64(header[16:], s.head)
+    binary.BigEndian.PutUint64(header[24:], s.used)
+    binary.BigEndian.PutUint64(header[32:], s.count)
+    if _, err := s.file.WriteAt(header[:], 0); err != nil {
+        return fmt.Errorf("failed to write mirror spill header: %w", err)
+    }
+    return nil
+}
+
+// push appends packet. When it does not fit, the oldest records are
+// evicted to make room if evict is set, and errSpillFull is returned
+// otherwise. It returns the number of records evicted.
+func (s *spill) push(packet *MirrorPacket, evict bool) (int, error) {
+    payload, err := json.Marshal(packet)
+    if err != nil {
+        return 0, fmt.Errorf("failed to encode spilled packet: %w", err)
+    }
+    size := uint64(spillRecordHeader + len(payload))
+    if size > s.capacity {
+        return 0, errSpillFull
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    evicted := 0
+    for s.capacity-s.used < size {
+        if !evict {
+            return evicted, errSpillFull
+        }
+        if err := s.discardLocked(); err != nil {
+            return evicted, err
+        }
+        evicted++
+    }
+
+    record := make([]byte, size)
+    binary.BigEndian.PutUint32(record, uint32(len(payload)))
+    copy(record[spillRecordHeader:], payload)
+    if err := s.writeRing((s.head+s.used)%s.capacity, record); err != nil {
+        return evicted, err
+    }
+    s.used += size
+    s.count++
+    if err := s.writeHeader(); err != nil {
+        return evicted, err
+    }
+    s.updateMetrics()
+    s.signal()
+    return evicted, nil
+}
+
+// peek returns the oldest packet and its sequence number for discard, or
+// nil when the spill is empty. A record that cannot be decoded empties the
+// ring, since nothing after it can be trusted.
+func (s *spill) peek() (*MirrorPacket, uint64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.count == 0 {
+        return nil, 0, nil
+    }
+    length, err := s.recordLength()
+    if err != nil {
+        return nil, 0, err
+    }
+    payload := make([]byte, length)
+    if err := s.readRing((s.head+spillRecordHeader)%s.capacity, payload); err != nil {
+        return nil, 0, err
+    }
+    packet := &MirrorPacket{}
+    if err := json.Unmarshal(payload, packet); err != nil {
+        log.Errorf("Discarding %d packets from corrupt mirror spill file %s: %v", s.count, s.path, err)
+        return nil, 0, s.reset()
+    }
+    return packet, s.seq, nil
+}
+
+// discard drops the oldest record if it is still the one peek returned
+// with seq
+func (s *spill) discard(seq uint64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.count == 0 || seq != s.seq {
+        return nil
+    }
+    return s.discardLocked()
+}
+
+// discardLocked drops the oldest record. Caller must hold mu.
+func (s *spill) discardLocked() error {
+    length, err := s.recordLength()
+    if err != nil {
+        return err
+    }
+    size := uint64(spillRecordHeader + length)
+    s.head = (s.head + size) % s.capacity
+    s.used -= size
+    s.count--
+    s.seq++
+    if s.count == 0 {
+        s.head, s.used = 0, 0
+    }
+    s.updateMetrics()
+    return s.writeHeader()
+}
+
+// recordLength reads the length of the oldest record. A length that runs
+// past the data in use empties the ring. Caller must hold mu.
+func (s *spill) recordLength() (uint32, error) {
+    var prefix [spillRecordHeader]byte
+    if err := s.readRing(s.head, prefix[:]); err != nil {
+        return 0, err
+    }
+    length := binary.BigEndian.Uint32(prefix[:])
+    if uint64(spillRecordHeader)+uint64(length) > s.used {
+        count := s.count
+        if err := s.reset(); err != nil {
+            return 0, err
+        }
+        return 0, fmt.Errorf("corrupt record in mirror spill file %s, discarded %d packets", s.path, count)
+    }
+    return length, nil
+}
+
+// writeRing writes p at offset into the ring, wrapping at its end
+func (s *spill) writeRing(offset uint64, p []byte) error {
+    first := min(uint64(len(p)), s.capacity-offset)
+    if _, err := s.file.WriteAt(p[:first], int64(spillHeaderSize+offset)); err != nil {
+        return fmt.Errorf("failed to write mirror spill file: %w", err)
+    }
+    if first < uint64(len(p)) {
+        if _, err := s.file.WriteAt(p[first:], spillHeaderSize); err != nil {
+            return fmt.Errorf("failed to write mirror spill file: %w", err)
+        }
+    }
+    return nil
+}
+
+// readRing fills p from offset into the ring, wrapping at its end
+func (s *spill) readRing(offset uint64, p []byte) error {
+    first := min(uint64(len(p)), s.capacity-offset)
+    if _, err := s.file.ReadAt(p[:first], int64(spillHeaderSize+offset)); err != nil {
+        return fmt.Errorf("failed to read mirror spill file: %w", err)
+    }
+    if first < uint64(len(p)) {
+        if _, err := s.file.ReadAt(p[first:], spillHeaderSize); err != nil {
+            return fmt.Errorf("failed to read mirror spill file: %w", err)
+        }
+    }
+    return nil
+}
+
+// signal wakes the drainer without blocking
+func (s *spill) signal() {
+    select {
+    case s.ready <- struct{}{}:
+    default:
+    }
+}
+
+// size returns the number of spilled packets and the bytes they take
+func (s *spill) size() (int, int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return int(s.count), int64(s.used)
+}
+
+func (s *spill) updateMetrics() {
+    spillPackets.Set(float64(s.count))
+    spillBytes.Set(float64(s.used))
+}
+
+// close syncs the ring file so its records are there after a restart
+func (s *spill) close() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.file.Sync(); err != nil {
+        log.Errorf("Failed to sync mirror spill file %s: %v", s.path, err)
+    }
+    if err := s.file.Close(); err != nil {
+        log.Debugf("Error closing mirror spill file: %v", err)
+    }
+}
@@ -0,0 +1,209 @@
+//go:build !minimal
+
+package mirror
+
+import (
+    "errors"
+    "fmt"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func spillPacket(i int) *MirrorPacket {
+    return &MirrorPacket{
+        Timestamp: time.Unix(1700000000, 0).UTC(),
+        Protocol:  "TCP",
+        Data:      make([]byte, 1000),
+        Metadata:  map[string]interface{}{"request_id": fmt.Sprintf("req-%d", i)},
+    }
+}
+
+func requestID(packet *MirrorPacket) string {
+    id, _ := packet.Metadata["request_id"].(string)
+    return id
+}
+
+func TestSpillWrapsAndSurvivesReopen(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "spill.ring")
+    s, err := openSpill(path, minSpillMaxBytes)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Push and pop enough to wrap the ring a few times
+    next := 0
+    for i := 0; i < 200; i++ {
+        if _, err := s.push(spillPacket(i), false); err != nil {
+            t.Fatalf("push %d: %v", i, err)
+        }
+        if i%6 == 5 {
+            continue
+        }
+        packet, seq, err := s.peek()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got, want := requestID(packet), fmt.Sprintf("req-%d", next); got != want {
+            t.Fatalf("peeked %s, want %s", got, want)
+        }
+        if err := s.discard(seq); err != nil {
+            t.Fatal(err)
+        }
+        next++
+    }
+    count, _ := s.size()
+    s.close()
+
+    s, err = openSpill(path, minSpillMaxBytes)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+    if reopened, _ := s.size(); reopened != count {
+        t.Fatalf("%d packets after reopening, want %d", reopened, count)
+    }
+    for ; count > 0; count-- {
+        packet, seq, err := s.peek()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got, want := requestID(packet), fmt.Sprintf("req-%d", next); got != want {
+            t.Fatalf("peeked %s after reopening, want %s", got, want)
+        }
+        s.discard(seq)
+        next++
+    }
+    if packet, _, _ := s.peek(); packet != nil {
+        t.Error("spill not empty after popping every packet")
+    }
+}
+
+func TestSpillFullAndEviction(t *testing.T) {
+    s, err := openSpill(filepath.Join(t.TempDir(), "spill.ring"), minSpillMaxBytes)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+
+    i := 0
+    for ; ; i++ {
+        if _, err := s.push(spillPacket(i), false); errors.Is(err, errSpillFull) {
+            break
+        } else if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    evicted, err := s.push(spillPacket(i), true)
+    if err != nil || evicted == 0 {
+        t.Fatalf("evicting push: %d evicted, %v", evicted, err)
+    }
+    packet, _, _ := s.peek()
+    if got, want := requestID(packet), fmt.Sprintf("req-%d", evicted); got != want {
+        t.Errorf("oldest packet %s after eviction, want %s", got, want)
+    }
+}
+
+func TestSpillDiscardsAfterEviction(t *testing.T) {
+    s, err := openSpill(filepath.Join(t.TempDir(), "spill.ring"), minSpillMaxBytes)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.close()
+
+    s.push(spillPacket(0), false)
+    s.push(spillPacket(1), false)
+    _, seq, _ := s.peek()
+    s.discardLocked() // evicted while the drainer held it
+    s.discard(seq)
+    if count, _ := s.size(); count != 1 {
+        t.Errorf("%d packets left, want 1", count)
+    }
+}
+
+func TestOverflowPolicies(t *testing.T) {
+    t.Run("drop-newest", func(t *testing.T) {
+        m := NewManager(nil, "VXLAN", 1)
+        m.TrySubmit(spillPacket(0))
+        if err := m.TrySubmit(spillPacket(1)); !errors.Is(err, ErrQueueFull) {
+            t.Fatalf("got %v, want ErrQueueFull", err)
+        }
+        if got := requestID(<-m.queue); got != "req-0" {
+            t.Errorf("queued %s, want req-0", got)
+        }
+    })
+
+    t.Run("drop-oldest", func(t *testing.T) {
+        m := NewManager(nil, "VXLAN", 1)
+        if err := m.SetBackpressure(BackpressureConfig{Policy: DropOldest}); err != nil {
+            t.Fatal(err)
+        }
+        m.TrySubmit(spillPacket(0))
+        if err := m.TrySubmit(spillPacket(1)); err != nil {
+            t.Fatal(err)
+        }
+        if got := requestID(<-m.queue); got != "req-1" {
+            t.Errorf("queued %s, want req-1", got)
+        }
+    })
+
+    t.Run("block", func(t *testing.T) {
+        m := NewManager(nil, "VXLAN", 1)
+        m.SetBackpressure(BackpressureConfig{Policy: Block, BlockTimeout: time.Second})
+        m.TrySubmit(spillPacket(0))
+        go func() {
+            time.Sleep(10 * time.Millisecond)
+            <-m.queue
+        }()
+        if err := m.TrySubmit(spillPacket(1)); err != nil {
+            t.Fatalf("blocked submit: %v", err)
+        }
+
+        m.SetBackpressure(BackpressureConfig{Policy: Block, BlockTimeout: time.Millisecond})
+        if err := m.TrySubmit(spillPacket(2)); !errors.Is(err, ErrQueueFull) {
+            t.Fatalf("got %v after the timeout, want ErrQueueFull", err)
+        }
+    })
+
+    t.Run("unknown", func(t *testing.T) {
+        if err := NewManager(nil, "VXLAN", 1).SetBackpressure(BackpressureConfig{Policy: "drop-all"}); err == nil {
+            t.Error("expected an error")
+        }
+    })
+}
+
+func TestOverflowSpillsAndDrainsInOrder(t *testing.T) {
+    m := NewManager(nil, "VXLAN", 2)
+    m.SetBackpressure(BackpressureConfig{SpillPath: filepath.Join(t.TempDir(), "spill.ring"), SpillMaxBytes: minSpillMaxBytes})
+    spill, err := openSpill(m.backpressure.SpillPath, m.backpressure.SpillMaxBytes)
+    if err != nil {
+        t.Fatal(err)
+    }
+    m.spill = spill
+    defer spill.close()
+
+    for i := 0; i < 10; i++ {
+        if err := m.TrySubmit(spillPacket(i)); err != nil {
+            t.Fatalf("submit %d: %v", i, err)
+        }
+    }
+    if count, _ := spill.size(); count != 8 {
+        t.Fatalf("%d packets spilled, want 8", count)
+    }
+
+    m.wg.Add(1)
+    go m.drainSpill()
+    for i := 0; i < 10; i++ {
+        select {
+        case packet := <-m.queue:
+            if got, want := requestID(packet), fmt.Sprintf("req-%d", i); got != want {
+                t.Fatalf("dequeued %s, want %s", got, want)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("packet %d never drained from the spill file", i)
+        }
+    }
+    close(m.stopCh)
+    m.wg.Wait()
+}
@@ -0,0 +1,105 @@
+// Traffic mirror selection from the Manager.
+//
+// The Manager delivers the mirror's sample rate and filter in the headend
+// configuration payload as MirrorConfig. The headend fetches it when the
+// mirror starts and again every mirror.refresh_interval, so operators can
+// narrow or widen what reaches the IDS without restarting headends.
+// mirror.sample_rate and mirror.filter, when set locally, win over the
+// Manager's values.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tobogganing/headend/config"
+	"github.com/tobogganing/headend/proxy/mirror"
+)
+
+// initializeMirrorSelection applies the mirror's sample rate and filter and
+// starts refreshing them from the Manager. Failing to reach the Manager is
+// not fatal; the local settings, or else all traffic, are mirrored until it
+// answers.
+func (s *ProxyServer) initializeMirrorSelection() error {
+	// A bad local filter is a configuration error, not something to wait out
+	if err := s.applyMirrorSelection(config.MirrorConfig{}); err != nil {
+		return err
+	}
+	if os.Getenv("CLUSTER_ID") == "" {
+		log.Warn("Traffic mirroring without CLUSTER_ID, using the local sample rate and filter")
+		return nil
+	}
+
+	s.mirrorSource = config.NewManager(viper.GetString("mirror.manager_url"), os.Getenv("CLUSTER_API_KEY"))
+	if err := s.refreshMirrorSelection(); err != nil {
+		log.Errorf("Failed to fetch the mirror configuration: %v", err)
+	}
+
+	s.mirrorStop = make(chan struct{})
+	go s.mirrorSelectionLoop(viper.GetDuration("mirror.refresh_interval"))
+	return nil
+}
+
+func (s *ProxyServer) mirrorSelectionLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Keep the selection we have if the Manager can't be reached
+			if err := s.refreshMirrorSelection(); err != nil {
+				log.Errorf("Failed to refresh the mirror configuration: %v", err)
+			}
+		case <-s.mirrorStop:
+			return
+		}
+	}
+}
+
+// refreshMirrorSelection fetches the headend configuration and applies its
+// mirror settings
+func (s *ProxyServer) refreshMirrorSelection() error {
+	cfg, err := s.mirrorSource.FetchConfig()
+	if err != nil {
+		return err
+	}
+	if err := s.applyMirrorSelection(cfg.Mirror); err != nil {
+		// Keep mirroring what we did rather than everything
+		log.Warnf("Ignoring the Manager's mirror configuration: %v", err)
+	}
+	return nil
+}
+
+// applyMirrorSelection sets the mirror's sample rate and filter from cfg,
+// unless they are set locally
+func (s *ProxyServer) applyMirrorSelection(cfg config.MirrorConfig) error {
+	sampleRate, expr := cfg.SampleRate, cfg.Filter
+	if viper.IsSet("mirror.sample_rate") {
+		sampleRate = viper.GetInt("mirror.sample_rate")
+	}
+	if viper.IsSet("mirror.filter") {
+		expr = viper.GetString("mirror.filter")
+	}
+
+	filter, err := mirror.ParseFilter(expr)
+	if err != nil {
+		return fmt.Errorf("failed to parse mirror filter: %w", err)
+	}
+	selection := fmt.Sprintf("%d %s", sampleRate, filter.String())
+	if selection == s.mirrorSelection {
+		return nil
+	}
+	s.mirrorSelection = selection
+
+	s.mirrorManager.SetSelection(sampleRate, filter)
+	if filter != nil || sampleRate > 1 {
+		log.Infof("Mirroring one in %d sessions matching %q", max(sampleRate, 1), filter.String())
+	} else {
+		log.Info("Mirroring all sessions")
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package ports
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -33,6 +34,30 @@ type PortRange struct {
 	UpdatedAt   string `json:"updated_at"`
 }
 
+// Listener states reported to the Manager
+const (
+	ListenerListening = "listening"
+	ListenerConflict  = "conflict" // the port is held by another process
+	ListenerFailed    = "failed"
+)
+
+// ListenerStatus is the outcome of the last attempt to bind a configured port
+type ListenerStatus struct {
+	Port        int       `json:"port"`
+	Protocol    string    `json:"protocol"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+// StatusReport tells the Manager which of the requested ports are bound
+type StatusReport struct {
+	HeadendID  string           `json:"headend_id"`
+	ClusterID  string           `json:"cluster_id"`
+	ReportedAt time.Time        `json:"reported_at"`
+	Listeners  []ListenerStatus `json:"listeners"`
+}
+
 // ConfigClient fetches port configuration from the Manager service
 type ConfigClient struct {
 	managerURL  string
@@ -103,4 +128,46 @@ func (c *ConfigClient) ValidateConfig(config *PortConfig) error {
 	}
 	
 	return nil
-}
\ No newline at end of file
+}
+
+// ReportStatus sends the state of the headend's listeners to the Manager
+func (c *ConfigClient) ReportStatus(listeners []ListenerStatus) error {
+	if listeners == nil {
+		listeners = []ListenerStatus{}
+	}
+	body, err := json.Marshal(StatusReport{
+		HeadendID:  c.headendID,
+		ClusterID:  c.clusterID,
+		ReportedAt: time.Now().UTC(),
+		Listeners:  listeners,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode status report: %w", err)
+	}
+	
+	url := fmt.Sprintf("%s/api/v1/headend/%s/ports/status", c.managerURL, c.headendID)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	
+	req.Header.Set("Authorization", "Bearer "+c.authToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+	
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to report status: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("Error closing response body: %v", err)
+		}
+	}()
+	
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to report status: status %d, body: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
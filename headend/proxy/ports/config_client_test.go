@@ -0,0 +1,47 @@
+package ports
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReportStatus(t *testing.T) {
+	var report StatusReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/headend/headend-1/ports/status" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewConfigClient(server.URL, "token", "headend-1", "cluster-1")
+	listeners := []ListenerStatus{
+		{Port: 8000, Protocol: "tcp", State: ListenerListening, LastAttempt: time.Now().UTC()},
+		{Port: 8001, Protocol: "tcp", State: ListenerConflict, Error: "address already in use", LastAttempt: time.Now().UTC()},
+	}
+	if err := client.ReportStatus(listeners); err != nil {
+		t.Fatal(err)
+	}
+	if report.HeadendID != "headend-1" || report.ClusterID != "cluster-1" || len(report.Listeners) != 2 ||
+		report.Listeners[1].State != ListenerConflict || report.ReportedAt.IsZero() {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer failing.Close()
+	if err := NewConfigClient(failing.URL, "token", "headend-1", "cluster-1").ReportStatus(nil); err == nil {
+		t.Error("expected a rejected report to fail")
+	}
+}
@@ -0,0 +1,64 @@
+//go:build minimal
+
+package ports
+
+import (
+	"errors"
+	"net"
+)
+
+// errNotBuilt is returned by a headend built with the minimal profile,
+// which leaves dynamic ports out
+var errNotBuilt = errors.New("dynamic ports are not included in the minimal build")
+
+// PortListener represents an active listener on a specific port
+type PortListener struct {
+	Port     int
+	Protocol string
+	Listener interface{}
+	Active   bool
+}
+
+// PortManager stands in for the port manager in the minimal build. It
+// never listens.
+type PortManager struct{}
+
+func NewPortManager() *PortManager {
+	return &PortManager{}
+}
+
+func (pm *PortManager) SetListenNetworks(tcpNetwork, udpNetwork string) {}
+
+func (pm *PortManager) SetListenerWrapper(wrap func(net.Listener) net.Listener) {}
+
+func (pm *PortManager) SetConnectionHandlers(
+	onNewConn func(conn net.Conn, port int, protocol string),
+	onNewPacket func(conn *net.UDPConn, data []byte, addr *net.UDPAddr, port int),
+) {
+}
+
+func (pm *PortManager) ParsePortRanges(tcpRanges, udpRanges string) error {
+	return errNotBuilt
+}
+
+func (pm *PortManager) StartListening() error {
+	return errNotBuilt
+}
+
+func (pm *PortManager) Update(tcpRanges, udpRanges string) (opened, closed int, err error) {
+	return 0, 0, errNotBuilt
+}
+
+func (pm *PortManager) GetActiveListeners() map[string]*PortListener {
+	return map[string]*PortListener{}
+}
+
+func (pm *PortManager) Status() []ListenerStatus {
+	return nil
+}
+
+func (pm *PortManager) GetListenerCount() int {
+	return 0
+}
+
+func (pm *PortManager) Stop() {}
@@ -1,13 +1,17 @@
+//go:build !minimal
+
 // Package ports implements dynamic port management for the SASEWaddle headend proxy.
 //
 // The port manager provides:
 // - Dynamic TCP and UDP port listening based on Manager configuration
 // - Support for port ranges (e.g., "8000-8100,9000,9500-9600")
-// - Hot reconfiguration without service interruption
+// - Hot reconfiguration without service interruption: a refresh only
+//   closes the listeners of removed ports and opens those of added ones
 // - Automatic listener lifecycle management
 // - Integration with firewall and authentication systems
 // - Connection pooling and load balancing across ports
-// - Real-time port status monitoring and health checks
+// - Real-time port status monitoring and health checks, with the outcome
+//   of each port's last bind attempt reported back to the Manager
 //
 // Configuration is fetched from the Manager service and can be updated
 // in real-time, allowing administrators to control which ports the
@@ -15,11 +19,15 @@
 package ports
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -36,27 +44,50 @@ type PortListener struct {
 
 // PortManager manages dynamic port listening for the proxy
 type PortManager struct {
-	tcpRanges   []PortRange
-	udpRanges   []PortRange
-	listeners   map[string]*PortListener // key: "protocol:port"
-	mu          sync.RWMutex
-	stopChan    chan bool
-	onNewConn   func(conn net.Conn, port int, protocol string)
-	onNewPacket func(data []byte, addr *net.UDPAddr, port int)
+	tcpRanges    []PortRange
+	udpRanges    []PortRange
+	listeners    map[string]*PortListener // key: "protocol:port"
+	status       map[string]*ListenerStatus // last bind attempt of each configured port, same keys
+	mu           sync.RWMutex
+	stopChan     chan bool
+	stopOnce     sync.Once
+	onNewConn    func(conn net.Conn, port int, protocol string)
+	onNewPacket  func(conn *net.UDPConn, data []byte, addr *net.UDPAddr, port int)
+	tcpNetwork   string
+	udpNetwork   string
+	wrapListener func(net.Listener) net.Listener
 }
 
-// NewPortManager creates a new port manager
+// NewPortManager creates a new port manager listening on IPv4 and IPv6
 func NewPortManager() *PortManager {
 	return &PortManager{
-		listeners: make(map[string]*PortListener),
-		stopChan:  make(chan bool),
+		listeners:  make(map[string]*PortListener),
+		status:     make(map[string]*ListenerStatus),
+		stopChan:   make(chan bool),
+		tcpNetwork: "tcp",
+		udpNetwork: "udp",
 	}
 }
 
-// SetConnectionHandlers sets the callback functions for new connections/packets
+// SetListenNetworks restricts the listeners to one IP family, e.g. "tcp4"
+// and "udp4". Call before StartListening.
+func (pm *PortManager) SetListenNetworks(tcpNetwork, udpNetwork string) {
+	pm.tcpNetwork = tcpNetwork
+	pm.udpNetwork = udpNetwork
+}
+
+// SetListenerWrapper sets a function wrapping each TCP listener, such as
+// one reading PROXY protocol headers. Call before StartListening.
+func (pm *PortManager) SetListenerWrapper(wrap func(net.Listener) net.Listener) {
+	pm.wrapListener = wrap
+}
+
+// SetConnectionHandlers sets the callback functions for new connections/packets.
+// onNewPacket is called in the receive loop, in arrival order, and must not
+// block; replies to the packet are sent on conn.
 func (pm *PortManager) SetConnectionHandlers(
 	onNewConn func(conn net.Conn, port int, protocol string),
-	onNewPacket func(data []byte, addr *net.UDPAddr, port int),
+	onNewPacket func(conn *net.UDPConn, data []byte, addr *net.UDPAddr, port int),
 ) {
 	pm.onNewConn = onNewConn
 	pm.onNewPacket = onNewPacket
@@ -177,12 +208,91 @@ func (pm *PortManager) StartListening() error {
 	return nil
 }
 
+// Update applies new port ranges differentially: listeners on ports that
+// stay configured, and the sessions accepted from them, are left alone;
+// only the listeners of removed ports are closed and those of added ports
+// opened. Ports that failed to open before are retried. It returns how
+// many listeners were opened and closed.
+func (pm *PortManager) Update(tcpRanges, udpRanges string) (opened, closed int, err error) {
+	tcpParsed, err := pm.parseRangeString(tcpRanges, "tcp")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse TCP ranges: %w", err)
+	}
+	udpParsed, err := pm.parseRangeString(udpRanges, "udp")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse UDP ranges: %w", err)
+	}
+	
+	select {
+	case <-pm.stopChan:
+		return 0, 0, errors.New("port manager is stopped")
+	default:
+	}
+	
+	wanted := make(map[string]bool)
+	for _, ranges := range [][]PortRange{tcpParsed, udpParsed} {
+		for _, portRange := range ranges {
+			for port := portRange.StartPort; port <= portRange.EndPort; port++ {
+				wanted[fmt.Sprintf("%s:%d", portRange.Protocol, port)] = true
+			}
+		}
+	}
+	
+	// Close the listeners of removed ports
+	pm.mu.Lock()
+	pm.tcpRanges = tcpParsed
+	pm.udpRanges = udpParsed
+	for key, portListener := range pm.listeners {
+		if wanted[key] {
+			continue
+		}
+		pm.closeListener(key, portListener)
+		delete(pm.listeners, key)
+		closed++
+	}
+	for key := range pm.status {
+		if !wanted[key] {
+			delete(pm.status, key)
+		}
+	}
+	pm.mu.Unlock()
+	
+	// Open the listeners of added ports
+	for key := range wanted {
+		pm.mu.RLock()
+		_, listening := pm.listeners[key]
+		pm.mu.RUnlock()
+		if listening {
+			continue
+		}
+		protocol, portStr, _ := strings.Cut(key, ":")
+		port, _ := strconv.Atoi(portStr)
+		if protocol == "tcp" {
+			err = pm.startTCPListener(port)
+		} else {
+			err = pm.startUDPListener(port)
+		}
+		if err != nil {
+			log.Errorf("Failed to start %s listener on port %d: %v", strings.ToUpper(protocol), port, err)
+			continue
+		}
+		opened++
+	}
+	
+	log.Debugf("Port manager updated: %d listeners opened, %d closed, %d active", opened, closed, pm.GetListenerCount())
+	return opened, closed, nil
+}
+
 // startTCPListener creates a TCP listener on the specified port
 func (pm *PortManager) startTCPListener(port int) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	listener, err := net.Listen(pm.tcpNetwork, fmt.Sprintf(":%d", port))
+	pm.recordAttempt("tcp", port, err)
 	if err != nil {
 		return fmt.Errorf("failed to listen on TCP port %d: %w", port, err)
 	}
+	if pm.wrapListener != nil {
+		listener = pm.wrapListener(listener)
+	}
 	
 	portListener := &PortListener{
 		Port:     port,
@@ -194,6 +304,7 @@ func (pm *PortManager) startTCPListener(port int) error {
 	pm.mu.Lock()
 	pm.listeners[fmt.Sprintf("tcp:%d", port)] = portListener
 	pm.mu.Unlock()
+	dynamicListeners.WithLabelValues("tcp").Inc()
 	
 	// Start accepting connections in a goroutine
 	go pm.acceptTCPConnections(listener, port)
@@ -204,12 +315,14 @@ func (pm *PortManager) startTCPListener(port int) error {
 
 // startUDPListener creates a UDP listener on the specified port
 func (pm *PortManager) startUDPListener(port int) error {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	addr, err := net.ResolveUDPAddr(pm.udpNetwork, fmt.Sprintf(":%d", port))
 	if err != nil {
+		pm.recordAttempt("udp", port, err)
 		return fmt.Errorf("failed to resolve UDP address for port %d: %w", port, err)
 	}
 	
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP(pm.udpNetwork, addr)
+	pm.recordAttempt("udp", port, err)
 	if err != nil {
 		return fmt.Errorf("failed to listen on UDP port %d: %w", port, err)
 	}
@@ -224,6 +337,7 @@ func (pm *PortManager) startUDPListener(port int) error {
 	pm.mu.Lock()
 	pm.listeners[fmt.Sprintf("udp:%d", port)] = portListener
 	pm.mu.Unlock()
+	dynamicListeners.WithLabelValues("udp").Inc()
 	
 	// Start receiving packets in a goroutine
 	go pm.receiveUDPPackets(conn, port)
@@ -232,12 +346,38 @@ func (pm *PortManager) startUDPListener(port int) error {
 	return nil
 }
 
+// recordAttempt records the outcome of binding a port. A port another
+// process holds is a conflict, any other error a failure.
+func (pm *PortManager) recordAttempt(protocol string, port int, err error) {
+	status := &ListenerStatus{
+		Port:        port,
+		Protocol:    protocol,
+		State:       ListenerListening,
+		LastAttempt: time.Now().UTC(),
+	}
+	if err != nil {
+		status.State = ListenerFailed
+		if errors.Is(err, syscall.EADDRINUSE) {
+			status.State = ListenerConflict
+		}
+		status.Error = err.Error()
+	}
+	
+	pm.mu.Lock()
+	pm.status[fmt.Sprintf("%s:%d", protocol, port)] = status
+	pm.mu.Unlock()
+	listenerBindAttempts.WithLabelValues(protocol, status.State).Inc()
+}
+
 // acceptTCPConnections handles incoming TCP connections
 func (pm *PortManager) acceptTCPConnections(listener net.Listener, port int) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			// Check if we're shutting down
+			// The listener is closed when its port is removed or on shutdown
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			select {
 			case <-pm.stopChan:
 				return
@@ -265,7 +405,10 @@ func (pm *PortManager) receiveUDPPackets(conn *net.UDPConn, port int) {
 	for {
 		n, addr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
-			// Check if we're shutting down
+			// The socket is closed when its port is removed or on shutdown
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			select {
 			case <-pm.stopChan:
 				return
@@ -275,9 +418,12 @@ func (pm *PortManager) receiveUDPPackets(conn *net.UDPConn, port int) {
 			}
 		}
 		
-		// Handle the packet with the registered handler
+		// Handle the packet with the registered handler, on a copy as the
+		// buffer is reused for the next read
 		if pm.onNewPacket != nil {
-			go pm.onNewPacket(buffer[:n], addr, port)
+			packet := make([]byte, n)
+			copy(packet, buffer[:n])
+			pm.onNewPacket(conn, packet, addr, port)
 		}
 	}
 }
@@ -295,6 +441,25 @@ func (pm *PortManager) GetActiveListeners() map[string]*PortListener {
 	return result
 }
 
+// Status returns the state of every configured port, as of its last bind
+// attempt, ordered by port and protocol
+func (pm *PortManager) Status() []ListenerStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	
+	statuses := make([]ListenerStatus, 0, len(pm.status))
+	for _, status := range pm.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Port != statuses[j].Port {
+			return statuses[i].Port < statuses[j].Port
+		}
+		return statuses[i].Protocol < statuses[j].Protocol
+	})
+	return statuses
+}
+
 // GetListenerCount returns the number of active listeners
 func (pm *PortManager) GetListenerCount() int {
 	pm.mu.RLock()
@@ -302,8 +467,12 @@ func (pm *PortManager) GetListenerCount() int {
 	return len(pm.listeners)
 }
 
-// Stop gracefully shuts down all listeners
+// Stop gracefully shuts down all listeners. Calling it more than once is safe.
 func (pm *PortManager) Stop() {
+	pm.stopOnce.Do(pm.stop)
+}
+
+func (pm *PortManager) stop() {
 	log.Info("Stopping port manager")
 	
 	// Signal all goroutines to stop
@@ -314,26 +483,34 @@ func (pm *PortManager) Stop() {
 	
 	// Close all listeners
 	for key, portListener := range pm.listeners {
-		if portListener.Active {
-			switch listener := portListener.Listener.(type) {
-			case net.Listener:
-				// TCP listener
-				if err := listener.Close(); err != nil {
-					log.Errorf("Error closing TCP listener %s: %v", key, err)
-				}
-			case *net.UDPConn:
-				// UDP connection
-				if err := listener.Close(); err != nil {
-					log.Errorf("Error closing UDP listener %s: %v", key, err)
-				}
-			}
-			portListener.Active = false
-		}
+		pm.closeListener(key, portListener)
 	}
 	
 	log.Infof("Stopped %d port listeners", len(pm.listeners))
 }
 
+// closeListener closes an active listener. Connections accepted from a TCP
+// listener stay open. pm.mu must be held.
+func (pm *PortManager) closeListener(key string, portListener *PortListener) {
+	if !portListener.Active {
+		return
+	}
+	switch listener := portListener.Listener.(type) {
+	case net.Listener:
+		// TCP listener
+		if err := listener.Close(); err != nil {
+			log.Errorf("Error closing TCP listener %s: %v", key, err)
+		}
+	case *net.UDPConn:
+		// UDP connection
+		if err := listener.Close(); err != nil {
+			log.Errorf("Error closing UDP listener %s: %v", key, err)
+		}
+	}
+	portListener.Active = false
+	dynamicListeners.WithLabelValues(portListener.Protocol).Dec()
+}
+
 // ValidatePortRanges checks if the specified port ranges are valid and available
 func (pm *PortManager) ValidatePortRanges(tcpRanges, udpRanges string) error {
 	// Parse ranges first
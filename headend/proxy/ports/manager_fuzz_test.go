@@ -0,0 +1,35 @@
+//go:build !minimal
+
+package ports
+
+import (
+	"testing"
+)
+
+// Port ranges arrive from the Manager and from operator config; a bad
+// range must be rejected rather than open a listener outside 1-65535.
+func FuzzParseRangeString(f *testing.F) {
+	for _, seed := range []string{
+		"8000-8100", "9000", "8000-8100,9000-9100, 443", "", " , ,",
+		"0-10", "65535", "65536", "100-1", "1-2-3", "-5", "5-", "+1-+2",
+		"99999999999999999999", "080-0x90",
+	} {
+		f.Add(seed)
+	}
+
+	pm := &PortManager{}
+	f.Fuzz(func(t *testing.T, rangeStr string) {
+		ranges, err := pm.parseRangeString(rangeStr, "tcp")
+		if err != nil {
+			return
+		}
+		for _, r := range ranges {
+			if r.StartPort < 1 || r.EndPort > 65535 || r.StartPort > r.EndPort {
+				t.Fatalf("%q parsed to invalid range %d-%d", rangeStr, r.StartPort, r.EndPort)
+			}
+			if r.Protocol != "tcp" {
+				t.Fatalf("%q parsed with protocol %q", rangeStr, r.Protocol)
+			}
+		}
+	})
+}
@@ -0,0 +1,135 @@
+//go:build !minimal
+
+package ports
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePorts returns n TCP ports that were free a moment ago
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	var ports []int
+	for len(ports) < n {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+		defer listener.Close()
+	}
+	return ports
+}
+
+func dial(port int) (net.Conn, error) {
+	return net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+}
+
+func TestUpdateKeepsUnchangedListeners(t *testing.T) {
+	ports := freePorts(t, 2)
+	kept, added := ports[0], ports[1]
+
+	pm := NewPortManager()
+	pm.SetListenNetworks("tcp4", "udp4")
+	defer pm.Stop()
+	accepted := make(chan net.Conn, 1)
+	pm.SetConnectionHandlers(func(conn net.Conn, port int, protocol string) {
+		accepted <- conn
+	}, nil)
+
+	if opened, closed, err := pm.Update(strconv.Itoa(kept), ""); err != nil || opened != 1 || closed != 0 {
+		t.Fatalf("Update = %d, %d, %v; want 1 opened", opened, closed, err)
+	}
+	listener := pm.GetActiveListeners()[fmt.Sprintf("tcp:%d", kept)]
+
+	client, err := dial(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	// Adding a port leaves the existing listener in place
+	if opened, closed, err := pm.Update(fmt.Sprintf("%d,%d", kept, added), ""); err != nil || opened != 1 || closed != 0 {
+		t.Fatalf("Update = %d, %d, %v; want 1 opened", opened, closed, err)
+	}
+	if pm.GetActiveListeners()[fmt.Sprintf("tcp:%d", kept)] != listener {
+		t.Error("expected the unchanged port's listener kept")
+	}
+	if opened, closed, err := pm.Update(fmt.Sprintf("%d,%d", kept, added), ""); err != nil || opened != 0 || closed != 0 {
+		t.Errorf("Update of the same ranges = %d, %d, %v; want no changes", opened, closed, err)
+	}
+
+	// Removing the port closes its listener but not the session on it
+	if opened, closed, err := pm.Update(strconv.Itoa(added), ""); err != nil || opened != 0 || closed != 1 {
+		t.Fatalf("Update = %d, %d, %v; want 1 closed", opened, closed, err)
+	}
+	if conn, err := dial(kept); err == nil {
+		conn.Close()
+		t.Error("expected the removed port closed")
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 4)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server, buffer); err != nil || string(buffer) != "ping" {
+		t.Errorf("expected the session to carry on, got %q, %v", buffer, err)
+	}
+	if pm.GetListenerCount() != 1 {
+		t.Errorf("expected one listener, got %d", pm.GetListenerCount())
+	}
+
+	pm.Stop()
+	if _, _, err := pm.Update(strconv.Itoa(kept), ""); err == nil {
+		t.Error("expected a stopped port manager not to reopen listeners")
+	}
+}
+
+func TestStatusReportsConflicts(t *testing.T) {
+	ports := freePorts(t, 2)
+	free, taken := ports[0], ports[1]
+	holder, err := net.Listen("tcp4", fmt.Sprintf(":%d", taken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+
+	pm := NewPortManager()
+	pm.SetListenNetworks("tcp4", "udp4")
+	defer pm.Stop()
+
+	if _, _, err := pm.Update(fmt.Sprintf("%d,%d", free, taken), ""); err != nil {
+		t.Fatal(err)
+	}
+	statuses := pm.Status()
+	if len(statuses) != 2 {
+		t.Fatalf("expected two ports reported, got %+v", statuses)
+	}
+	byPort := map[int]ListenerStatus{}
+	for _, status := range statuses {
+		byPort[status.Port] = status
+	}
+	if status := byPort[free]; status.State != ListenerListening || status.Error != "" || status.LastAttempt.IsZero() {
+		t.Errorf("unexpected status of the free port %+v", status)
+	}
+	if status := byPort[taken]; status.State != ListenerConflict || status.Error == "" {
+		t.Errorf("unexpected status of the taken port %+v", status)
+	}
+
+	// The conflicting port is retried once it is released, and removed
+	// ports are no longer reported
+	holder.Close()
+	if opened, _, err := pm.Update(strconv.Itoa(taken), ""); err != nil || opened != 1 {
+		t.Fatalf("Update = %d, %v; want the released port opened", opened, err)
+	}
+	if statuses := pm.Status(); len(statuses) != 1 || statuses[0].Port != taken || statuses[0].State != ListenerListening {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+}
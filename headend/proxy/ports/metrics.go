@@ -0,0 +1,20 @@
+//go:build !minimal
+
+package ports
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dynamicListeners = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_dynamic_listeners",
+		Help: "Number of open dynamic port listeners, by protocol (tcp, udp).",
+	}, []string{"protocol"})
+
+	listenerBindAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_dynamic_listener_bind_attempts_total",
+		Help: "Total attempts to bind dynamic ports, by protocol and resulting state (listening, conflict, failed).",
+	}, []string{"protocol", "state"})
+)
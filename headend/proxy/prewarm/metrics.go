@@ -0,0 +1,23 @@
+package prewarm
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	warmTargets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_prewarm_targets",
+		Help: "Upstream targets warmed by the last pre-warming run, by kind (dns, tls).",
+	}, []string{"kind"})
+
+	warmOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_prewarm_operations_total",
+		Help: "Total pre-warming resolutions and TLS handshakes, by kind (dns, tls) and result.",
+	}, []string{"kind", "result"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_prewarm_address_lookups_total",
+		Help: "Total upstream dials that looked up pre-resolved addresses, by result (hit, miss).",
+	}, []string{"result"})
+)
@@ -0,0 +1,401 @@
+// Package prewarm keeps the headend's most popular upstream targets warm,
+// so the first request after a quiet period doesn't pay for name
+// resolution and a full TLS handshake on top of the tunnel.
+//
+// The prewarm package provides:
+//   - Access statistics per upstream host, learned from the names dials
+//     look up and from reverse-proxied HTTPS targets, decaying over a
+//     half-life so yesterday's busy targets are still warm the next morning
+//   - An address cache for connctx, re-resolving the top hosts in the
+//     background so dials skip DNS
+//   - TLS session warming of the top HTTPS targets, through the transport
+//     pool's session caches, so the first request resumes a session
+//
+// Statistics are kept in memory, so a restarted headend learns its targets
+// again.
+package prewarm
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults for the fields of Config left zero
+const (
+	DefaultTargets    = 20
+	DefaultInterval   = 5 * time.Minute
+	DefaultHalfLife   = 24 * time.Hour
+	DefaultMinHits    = 5
+	DefaultAddressTTL = 10 * time.Minute
+	DefaultMaxTracked = 4096
+	DefaultTimeout    = 5 * time.Second
+)
+
+// maxTLSTargets bounds the HTTPS ports warmed per host
+const maxTLSTargets = 4
+
+// pruneBelow drops hosts whose decayed hit count has fallen this low
+const pruneBelow = 0.5
+
+// TLSWarmer completes TLS handshakes ahead of use; transport.Pool is one
+type TLSWarmer interface {
+	WarmTLS(ctx context.Context, target string) (bool, error)
+}
+
+// Config tunes which targets are kept warm and how often
+type Config struct {
+	// Targets is how many of the most accessed hosts are kept warm
+	Targets  int
+	Interval time.Duration
+	// HalfLife is how long it takes a host's hit count to halve
+	HalfLife time.Duration
+	// MinHits is the decayed hit count a host needs to be kept warm
+	MinHits float64
+	// AddressTTL is how long resolved addresses are served; the top hosts
+	// are re-resolved every Interval
+	AddressTTL time.Duration
+	MaxTracked int
+	// Timeout bounds resolving or handshaking with one target
+	Timeout time.Duration
+}
+
+// Target is a host kept warm, as reported by Status
+type Target struct {
+	Host       string    `json:"host"`
+	Hits       float64   `json:"hits"`
+	Addresses  []string  `json:"addresses,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at,omitempty"`
+	TLS        []string  `json:"tls,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// Status reports what the warmer tracks and keeps warm
+type Status struct {
+	Tracked int       `json:"tracked"`
+	LastRun time.Time `json:"last_run,omitempty"`
+	Targets []Target  `json:"targets"`
+}
+
+type entry struct {
+	hits       float64
+	tlsTargets map[string]struct{}
+	addrs      []string
+	resolvedAt time.Time
+	lastErr    error
+}
+
+// Warmer learns the popular upstream hosts and keeps them warm
+type Warmer struct {
+	cfg        Config
+	tls        TLSWarmer
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu        sync.Mutex
+	hosts     map[string]*entry
+	lastDecay time.Time
+	lastRun   time.Time
+	warm      []string
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a warmer; tls may be nil to only pre-resolve
+func New(cfg Config, tls TLSWarmer) *Warmer {
+	if cfg.Targets <= 0 {
+		cfg.Targets = DefaultTargets
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.HalfLife <= 0 {
+		cfg.HalfLife = DefaultHalfLife
+	}
+	if cfg.MinHits <= 0 {
+		cfg.MinHits = DefaultMinHits
+	}
+	if cfg.AddressTTL <= 0 {
+		cfg.AddressTTL = DefaultAddressTTL
+	}
+	if cfg.MaxTracked <= 0 {
+		cfg.MaxTracked = DefaultMaxTracked
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return &Warmer{
+		cfg:        cfg,
+		tls:        tls,
+		lookupHost: net.DefaultResolver.LookupHost,
+		hosts:      make(map[string]*entry),
+		lastDecay:  time.Now(),
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Lookup counts an access to host and returns its pre-resolved addresses,
+// if they're fresh. It implements connctx.AddressCache.
+func (w *Warmer) Lookup(host string) []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e := w.track(strings.ToLower(host))
+	if e == nil {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	e.hits++
+	if len(e.addrs) == 0 || time.Since(e.resolvedAt) > w.cfg.AddressTTL {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	cacheLookups.WithLabelValues("hit").Inc()
+	return e.addrs
+}
+
+// RecordTLS counts a reverse-proxied request to target (host or
+// host:port, 443 by default), making it a candidate for TLS warming
+func (w *Warmer) RecordTLS(target string) {
+	if w == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, "443"
+	}
+	host = strings.ToLower(host)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e := w.track(host)
+	if e == nil {
+		return
+	}
+	e.hits++
+	if e.tlsTargets == nil {
+		e.tlsTargets = make(map[string]struct{})
+	}
+	if len(e.tlsTargets) < maxTLSTargets {
+		e.tlsTargets[net.JoinHostPort(host, port)] = struct{}{}
+	}
+}
+
+// track returns the entry of host, creating it unless MaxTracked hosts are
+// already tracked. The caller holds w.mu.
+func (w *Warmer) track(host string) *entry {
+	if e, ok := w.hosts[host]; ok {
+		return e
+	}
+	if len(w.hosts) >= w.cfg.MaxTracked {
+		return nil
+	}
+	e := &entry{}
+	w.hosts[host] = e
+	return e
+}
+
+// Start keeps the top hosts warm every Interval
+func (w *Warmer) Start() {
+	go func() {
+		ticker := time.NewTicker(w.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Warm(context.Background())
+			case <-w.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops warming. It is safe to call on a nil Warmer.
+func (w *Warmer) Stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() { close(w.stopChan) })
+}
+
+// candidate is a host to warm, copied out of the lock
+type candidate struct {
+	host       string
+	tlsTargets []string
+}
+
+// Warm decays the statistics, then resolves the top hosts and warms TLS
+// sessions with their HTTPS targets
+func (w *Warmer) Warm(ctx context.Context) {
+	w.mu.Lock()
+	now := time.Now()
+	w.decay(now.Sub(w.lastDecay))
+	w.lastDecay = now
+	candidates := w.top()
+	w.lastRun = now.UTC()
+	w.warm = w.warm[:0]
+	for _, c := range candidates {
+		w.warm = append(w.warm, c.host)
+	}
+	w.mu.Unlock()
+
+	var resolved, warmedTLS int
+	var countMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range candidates {
+		wg.Add(1)
+		go func(c candidate) {
+			defer wg.Done()
+			dns, tls := w.warmHost(ctx, c)
+			countMu.Lock()
+			resolved += dns
+			warmedTLS += tls
+			countMu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	warmTargets.WithLabelValues("dns").Set(float64(resolved))
+	warmTargets.WithLabelValues("tls").Set(float64(warmedTLS))
+	if len(candidates) > 0 {
+		log.Debugf("Pre-warmed %d upstream hosts: %d resolved, %d TLS sessions", len(candidates), resolved, warmedTLS)
+	}
+}
+
+// warmHost resolves one host and warms its TLS targets, returning how many
+// of each succeeded
+func (w *Warmer) warmHost(ctx context.Context, c candidate) (resolved, warmedTLS int) {
+	var lastErr error
+
+	if net.ParseIP(c.host) == nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+		addrs, err := w.lookupHost(lookupCtx, c.host)
+		cancel()
+		if err == nil && len(addrs) > 0 {
+			resolved = 1
+			warmOperations.WithLabelValues("dns", "ok").Inc()
+			w.mu.Lock()
+			if e, ok := w.hosts[c.host]; ok {
+				e.addrs = addrs
+				e.resolvedAt = time.Now()
+			}
+			w.mu.Unlock()
+		} else {
+			lastErr = err
+			warmOperations.WithLabelValues("dns", "error").Inc()
+		}
+	}
+
+	if w.tls != nil {
+		for _, target := range c.tlsTargets {
+			tlsCtx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+			warmed, err := w.tls.WarmTLS(tlsCtx, target)
+			cancel()
+			switch {
+			case err != nil:
+				lastErr = err
+				warmOperations.WithLabelValues("tls", "error").Inc()
+			case warmed:
+				warmedTLS++
+				warmOperations.WithLabelValues("tls", "ok").Inc()
+			}
+		}
+	}
+
+	w.mu.Lock()
+	if e, ok := w.hosts[c.host]; ok {
+		e.lastErr = lastErr
+	}
+	w.mu.Unlock()
+	if lastErr != nil {
+		log.Debugf("Failed to pre-warm %s: %v", c.host, lastErr)
+	}
+	return resolved, warmedTLS
+}
+
+// decay ages every hit count by elapsed and forgets hosts that have gone
+// quiet. The caller holds w.mu.
+func (w *Warmer) decay(elapsed time.Duration) {
+	factor := math.Pow(0.5, elapsed.Seconds()/w.cfg.HalfLife.Seconds())
+	for host, e := range w.hosts {
+		e.hits *= factor
+		if e.hits < pruneBelow {
+			delete(w.hosts, host)
+		}
+	}
+}
+
+// top returns the most accessed hosts with at least MinHits. The caller
+// holds w.mu.
+func (w *Warmer) top() []candidate {
+	hosts := make([]string, 0, len(w.hosts))
+	for host, e := range w.hosts {
+		if e.hits >= w.cfg.MinHits {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		a, b := w.hosts[hosts[i]], w.hosts[hosts[j]]
+		if a.hits != b.hits {
+			return a.hits > b.hits
+		}
+		return hosts[i] < hosts[j]
+	})
+	if len(hosts) > w.cfg.Targets {
+		hosts = hosts[:w.cfg.Targets]
+	}
+
+	candidates := make([]candidate, 0, len(hosts))
+	for _, host := range hosts {
+		c := candidate{host: host}
+		for target := range w.hosts[host].tlsTargets {
+			c.tlsTargets = append(c.tlsTargets, target)
+		}
+		sort.Strings(c.tlsTargets)
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// Status reports the hosts kept warm by the last run, or nil if warming is
+// disabled
+func (w *Warmer) Status() *Status {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := &Status{Tracked: len(w.hosts), LastRun: w.lastRun, Targets: []Target{}}
+	for _, host := range w.warm {
+		e, ok := w.hosts[host]
+		if !ok {
+			continue
+		}
+		target := Target{
+			Host:       host,
+			Hits:       math.Round(e.hits*10) / 10,
+			Addresses:  e.addrs,
+			ResolvedAt: e.resolvedAt,
+		}
+		for t := range e.tlsTargets {
+			target.TLS = append(target.TLS, t)
+		}
+		sort.Strings(target.TLS)
+		if e.lastErr != nil {
+			target.LastError = e.lastErr.Error()
+		}
+		status.Targets = append(status.Targets, target)
+	}
+	return status
+}
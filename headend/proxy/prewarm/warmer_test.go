@@ -0,0 +1,132 @@
+package prewarm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTLS struct {
+	mu     sync.Mutex
+	warmed []string
+}
+
+func (f *fakeTLS) WarmTLS(_ context.Context, target string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.warmed = append(f.warmed, target)
+	return true, nil
+}
+
+func newTestWarmer(cfg Config, tls TLSWarmer) *Warmer {
+	w := New(cfg, tls)
+	w.lookupHost = func(_ context.Context, host string) ([]string, error) {
+		if host == "broken.internal" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"10.0.0.1"}, nil
+	}
+	return w
+}
+
+func TestWarmTopTargets(t *testing.T) {
+	tls := &fakeTLS{}
+	w := newTestWarmer(Config{Targets: 2, MinHits: 3}, tls)
+
+	for i := 0; i < 10; i++ {
+		w.Lookup("git.internal")
+	}
+	for i := 0; i < 5; i++ {
+		w.RecordTLS("wiki.internal")
+		w.RecordTLS("wiki.internal:8443")
+	}
+	for i := 0; i < 4; i++ {
+		w.Lookup("chat.internal") // popular enough, but not in the top 2
+	}
+	w.Lookup("rare.internal")
+
+	if addrs := w.Lookup("git.internal"); addrs != nil {
+		t.Fatalf("expected no addresses before warming, got %v", addrs)
+	}
+	w.Warm(context.Background())
+
+	if addrs := w.Lookup("git.internal"); len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Errorf("expected pre-resolved addresses, got %v", addrs)
+	}
+	if addrs := w.Lookup("chat.internal"); addrs != nil {
+		t.Errorf("expected hosts outside the top to stay unresolved, got %v", addrs)
+	}
+	if len(tls.warmed) != 2 || tls.warmed[0] != "wiki.internal:443" || tls.warmed[1] != "wiki.internal:8443" {
+		t.Errorf("expected wiki's HTTPS targets to be warmed, got %v", tls.warmed)
+	}
+
+	status := w.Status()
+	if status.Tracked != 4 || len(status.Targets) != 2 || status.Targets[0].Host != "git.internal" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestStaleAddressesAreNotServed(t *testing.T) {
+	w := newTestWarmer(Config{MinHits: 1, AddressTTL: time.Minute}, nil)
+	w.Lookup("git.internal")
+	w.Lookup("git.internal")
+	w.Warm(context.Background())
+	if w.Lookup("git.internal") == nil {
+		t.Fatal("expected fresh addresses")
+	}
+
+	w.hosts["git.internal"].resolvedAt = time.Now().Add(-2 * time.Minute)
+	if addrs := w.Lookup("git.internal"); addrs != nil {
+		t.Errorf("expected stale addresses to be dropped, got %v", addrs)
+	}
+}
+
+func TestResolutionFailure(t *testing.T) {
+	w := newTestWarmer(Config{MinHits: 1}, nil)
+	w.Lookup("broken.internal")
+	w.Lookup("broken.internal")
+	w.Warm(context.Background())
+
+	if addrs := w.Lookup("broken.internal"); addrs != nil {
+		t.Errorf("expected no addresses, got %v", addrs)
+	}
+	if status := w.Status(); len(status.Targets) != 1 || status.Targets[0].LastError == "" {
+		t.Errorf("expected the failure in the status, got %+v", status)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	w := newTestWarmer(Config{HalfLife: time.Hour}, nil)
+	for i := 0; i < 8; i++ {
+		w.Lookup("git.internal")
+	}
+	w.Lookup("rare.internal")
+
+	w.decay(2 * time.Hour)
+	if hits := w.hosts["git.internal"].hits; hits != 2 {
+		t.Errorf("expected 8 hits to decay to 2 over two half-lives, got %v", hits)
+	}
+	if _, ok := w.hosts["rare.internal"]; ok {
+		t.Error("expected a host decayed below the prune threshold to be forgotten")
+	}
+}
+
+func TestMaxTracked(t *testing.T) {
+	w := newTestWarmer(Config{MaxTracked: 1}, nil)
+	w.Lookup("git.internal")
+	w.Lookup("wiki.internal")
+	if len(w.hosts) != 1 {
+		t.Errorf("expected at most 1 tracked host, got %d", len(w.hosts))
+	}
+}
+
+func TestNilWarmer(t *testing.T) {
+	var w *Warmer
+	if w.Lookup("git.internal") != nil || w.Status() != nil {
+		t.Error("expected a nil warmer to cache nothing")
+	}
+	w.RecordTLS("git.internal")
+	w.Stop()
+}
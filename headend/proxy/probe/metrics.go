@@ -0,0 +1,29 @@
+package probe
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	probeRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_probe_runs_total",
+		Help: "Total synthetic probe runs, by check, type, scope (headend or upstream) and outcome.",
+	}, []string{"probe", "type", "scope", "outcome"})
+
+	probeUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_probe_up",
+		Help: "Whether the latest run of a synthetic probe succeeded (1) or failed (0).",
+	}, []string{"probe", "type", "scope"})
+
+	probeLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "headend_probe_latency_seconds",
+		Help:    "Synthetic probe latency in seconds, including failed runs.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"probe", "type", "scope"})
+
+	probeLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_probe_last_success_timestamp_seconds",
+		Help: "Unix time of the latest successful run of a synthetic probe.",
+	}, []string{"probe", "type", "scope"})
+)
@@ -0,0 +1,302 @@
+// Package probe implements synthetic monitoring for the SASEWaddle headend
+// proxy.
+//
+// The probe package provides:
+//   - Periodic HTTP and TCP checks against configured representative targets
+//   - HTTP checks sent through the reverse proxy's own upstream transports,
+//     so probes share pooling, TLS and class settings with user traffic
+//   - Built-in checks of the headend's own listeners
+//   - Success, latency and last-success metrics labelled by scope
+//
+// Every check has a scope: "headend" for the built-in listener checks and
+// "upstream" for configured targets. When headend checks fail the headend
+// itself is broken; when only upstream checks fail the problem lies beyond
+// it. Dashboards can split on the scope label to tell the two apart.
+package probe
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TypeHTTP = "http"
+	TypeTCP  = "tcp"
+
+	ScopeHeadend  = "headend"
+	ScopeUpstream = "upstream"
+
+	defaultInterval = 60 * time.Second
+	defaultTimeout  = 10 * time.Second
+
+	// startupDelay gives the headend's listeners time to come up before
+	// the first round of checks
+	startupDelay = 5 * time.Second
+)
+
+// Check is one synthetic probe. Target is a URL for HTTP checks and a
+// host:port for TCP checks.
+type Check struct {
+	Name     string        `mapstructure:"name"`
+	Type     string        `mapstructure:"type"`
+	Target   string        `mapstructure:"target"`
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	// ExpectStatus is the HTTP status that counts as success; zero accepts
+	// any status below 500
+	ExpectStatus int `mapstructure:"expect_status"`
+
+	scope string
+}
+
+// Result is the outcome of the most recent run of a check
+type Result struct {
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Scope     string        `json:"scope"`
+	Target    string        `json:"target"`
+	Success   bool          `json:"success"`
+	Latency   time.Duration `json:"latency"`
+	Error     string        `json:"error,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// TransportFunc returns the upstream transport used for a target host
+type TransportFunc func(target string) http.RoundTripper
+
+// Prober runs checks on their own schedules and keeps their latest results
+type Prober struct {
+	checks     []Check
+	transports TransportFunc
+	dialer     net.Dialer
+	results    map[string]Result
+	mu         sync.RWMutex
+	stopChan   chan bool
+	wg         sync.WaitGroup
+}
+
+// NewProber validates the upstream checks and creates a prober. Built-in
+// headend checks are added with AddHeadendCheck.
+func NewProber(checks []Check, transports TransportFunc) (*Prober, error) {
+	p := &Prober{
+		transports: transports,
+		results:    make(map[string]Result),
+		stopChan:   make(chan bool),
+	}
+
+	for _, check := range checks {
+		check.scope = ScopeUpstream
+		if err := p.add(check); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// AddHeadendCheck adds a check of one of the headend's own listeners
+func (p *Prober) AddHeadendCheck(name, checkType, target string) error {
+	return p.add(Check{
+		Name:   name,
+		Type:   checkType,
+		Target: target,
+		scope:  ScopeHeadend,
+	})
+}
+
+func (p *Prober) add(check Check) error {
+	if check.Name == "" {
+		return fmt.Errorf("probe check for %q has no name", check.Target)
+	}
+	for _, existing := range p.checks {
+		if existing.Name == check.Name {
+			return fmt.Errorf("duplicate probe check name %q", check.Name)
+		}
+	}
+
+	switch check.Type {
+	case TypeHTTP:
+		u, err := url.Parse(check.Target)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("probe check %q: invalid URL %q", check.Name, check.Target)
+		}
+	case TypeTCP:
+		if _, _, err := net.SplitHostPort(check.Target); err != nil {
+			return fmt.Errorf("probe check %q: invalid address %q: %w", check.Name, check.Target, err)
+		}
+	default:
+		return fmt.Errorf("probe check %q: unknown type %q", check.Name, check.Type)
+	}
+
+	if check.Interval <= 0 {
+		check.Interval = defaultInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = defaultTimeout
+	}
+
+	p.checks = append(p.checks, check)
+	return nil
+}
+
+// Start runs every check shortly after startup and then on its interval
+func (p *Prober) Start() {
+	log.Infof("Starting synthetic prober with %d checks", len(p.checks))
+
+	for _, check := range p.checks {
+		p.wg.Add(1)
+		go p.run(check)
+	}
+}
+
+// Stop halts all checks
+func (p *Prober) Stop() {
+	close(p.stopChan)
+	p.wg.Wait()
+}
+
+func (p *Prober) run(check Check) {
+	defer p.wg.Done()
+
+	// Spread the first round so checks don't all fire together
+	jitter := time.Duration(rand.Int63n(int64(check.Interval)/10 + 1))
+	timer := time.NewTimer(startupDelay + jitter)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			p.record(check, p.probe(check))
+			timer.Reset(check.Interval)
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+func (p *Prober) probe(check Check) Result {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	switch check.Type {
+	case TypeHTTP:
+		err = p.probeHTTP(ctx, check)
+	case TypeTCP:
+		err = p.probeTCP(ctx, check)
+	}
+
+	result := Result{
+		Name:      check.Name,
+		Type:      check.Type,
+		Scope:     check.scope,
+		Target:    check.Target,
+		Success:   err == nil,
+		Latency:   time.Since(start),
+		CheckedAt: time.Now().UTC(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (p *Prober) probeHTTP(ctx context.Context, check Check) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.Target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "SASEWaddle-Headend-Probe/1.0")
+
+	// Headend checks talk to local listeners, not through the upstream pool
+	var rt http.RoundTripper = http.DefaultTransport
+	if check.scope == ScopeUpstream && p.transports != nil {
+		rt = p.transports(req.URL.Host)
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if check.ExpectStatus != 0 {
+		if resp.StatusCode != check.ExpectStatus {
+			return fmt.Errorf("unexpected status %d, want %d", resp.StatusCode, check.ExpectStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("server error status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Prober) probeTCP(ctx context.Context, check Check) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", check.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *Prober) record(check Check, result Result) {
+	p.mu.Lock()
+	p.results[check.Name] = result
+	p.mu.Unlock()
+
+	probeRuns.WithLabelValues(check.Name, check.Type, check.scope, outcome(result.Success)).Inc()
+	probeLatency.WithLabelValues(check.Name, check.Type, check.scope).Observe(result.Latency.Seconds())
+	if result.Success {
+		probeUp.WithLabelValues(check.Name, check.Type, check.scope).Set(1)
+		probeLastSuccess.WithLabelValues(check.Name, check.Type, check.scope).Set(float64(result.CheckedAt.Unix()))
+	} else {
+		probeUp.WithLabelValues(check.Name, check.Type, check.scope).Set(0)
+		log.Warnf("Probe %s (%s) to %s failed: %s", check.Name, check.scope, check.Target, result.Error)
+	}
+}
+
+// Results returns the latest result of every check that has run, sorted by name
+func (p *Prober) Results() []Result {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	results := make([]Result, 0, len(p.results))
+	for _, r := range p.results {
+		results = append(results, r)
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// Healthy reports whether every check of the given scope passed on its
+// latest run. Checks that have not run yet are not counted.
+func (p *Prober) Healthy(scope string) bool {
+	for _, r := range p.Results() {
+		if r.Scope == scope && !r.Success {
+			return false
+		}
+	}
+	return true
+}
+
+func outcome(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
@@ -0,0 +1,176 @@
+package probe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// statusServer answers every request with a status that can be changed
+func statusServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &status
+}
+
+// runOnce runs every check once, as a round of the schedule would
+func runOnce(p *Prober) {
+	for _, check := range p.checks {
+		p.record(check, p.probe(check))
+	}
+}
+
+func TestNewProberRejectsBadChecks(t *testing.T) {
+	tests := []struct {
+		name  string
+		check Check
+	}{
+		{"no name", Check{Type: TypeTCP, Target: "db:5432"}},
+		{"unknown type", Check{Name: "db", Type: "icmp", Target: "db"}},
+		{"relative URL", Check{Name: "app", Type: TypeHTTP, Target: "/healthz"}},
+		{"other scheme", Check{Name: "app", Type: TypeHTTP, Target: "ftp://app/"}},
+		{"no port", Check{Name: "db", Type: TypeTCP, Target: "db"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewProber([]Check{tt.check}, nil); err == nil {
+				t.Errorf("accepted %+v", tt.check)
+			}
+		})
+	}
+
+	p, err := NewProber([]Check{{Name: "db", Type: TypeTCP, Target: "db:5432"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddHeadendCheck("db", TypeTCP, "127.0.0.1:8080"); err == nil {
+		t.Error("accepted a duplicate name")
+	}
+	if check := p.checks[0]; check.Interval != defaultInterval || check.Timeout != defaultTimeout || check.scope != ScopeUpstream {
+		t.Errorf("defaults not applied: %+v", check)
+	}
+}
+
+func TestProbeTransitions(t *testing.T) {
+	headend, headendStatus := statusServer(t)
+	upstream, upstreamStatus := statusServer(t)
+
+	var viaPool atomic.Int32
+	p, err := NewProber([]Check{
+		{Name: "app", Type: TypeHTTP, Target: upstream.URL + "/health"},
+	}, func(target string) http.RoundTripper {
+		viaPool.Add(1)
+		return http.DefaultTransport
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddHeadendCheck("http", TypeHTTP, headend.URL+"/healthz"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has run yet, so nothing counts against health
+	if !p.Healthy(ScopeHeadend) || !p.Healthy(ScopeUpstream) || len(p.Results()) != 0 {
+		t.Fatal("unhealthy before any check ran")
+	}
+
+	steps := []struct {
+		name         string
+		headend      int
+		upstream     int
+		wantHeadend  bool
+		wantUpstream bool
+	}{
+		{"all up", http.StatusOK, http.StatusOK, true, true},
+		{"upstream server error", http.StatusOK, http.StatusServiceUnavailable, true, false},
+		{"upstream recovers", http.StatusOK, http.StatusNotFound, true, true},
+		{"headend down", http.StatusBadGateway, http.StatusOK, false, true},
+		{"both down", http.StatusInternalServerError, http.StatusInternalServerError, false, false},
+		{"both recover", http.StatusOK, http.StatusOK, true, true},
+	}
+	for _, step := range steps {
+		headendStatus.Store(int32(step.headend))
+		upstreamStatus.Store(int32(step.upstream))
+		runOnce(p)
+
+		if got := p.Healthy(ScopeHeadend); got != step.wantHeadend {
+			t.Errorf("%s: headend healthy %v, want %v", step.name, got, step.wantHeadend)
+		}
+		if got := p.Healthy(ScopeUpstream); got != step.wantUpstream {
+			t.Errorf("%s: upstream healthy %v, want %v", step.name, got, step.wantUpstream)
+		}
+		up := testutil.ToFloat64(probeUp.WithLabelValues("app", TypeHTTP, ScopeUpstream))
+		if (up == 1) != step.wantUpstream {
+			t.Errorf("%s: upstream probe_up %v", step.name, up)
+		}
+
+		results := p.Results()
+		if len(results) != 2 || results[0].Name != "app" || results[1].Name != "http" {
+			t.Fatalf("%s: unexpected results %+v", step.name, results)
+		}
+		if results[0].Success == (results[0].Error != "") || results[0].Scope != ScopeUpstream {
+			t.Errorf("%s: inconsistent result %+v", step.name, results[0])
+		}
+	}
+
+	// Only upstream checks go through the upstream transports
+	if got := viaPool.Load(); got != int32(len(steps)) {
+		t.Errorf("%d upstream probes through the pool, want %d", got, len(steps))
+	}
+}
+
+func TestProbeExpectStatus(t *testing.T) {
+	srv, status := statusServer(t)
+	p, err := NewProber([]Check{
+		{Name: "app", Type: TypeHTTP, Target: srv.URL, ExpectStatus: http.StatusNoContent},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runOnce(p)
+	if p.Healthy(ScopeUpstream) {
+		t.Error("healthy on 200 when 204 is expected")
+	}
+	status.Store(http.StatusNoContent)
+	runOnce(p)
+	if !p.Healthy(ScopeUpstream) {
+		t.Errorf("unhealthy on the expected status: %+v", p.Results())
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	srv, _ := statusServer(t)
+	p, err := NewProber(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddHeadendCheck("tcp", TypeTCP, srv.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	runOnce(p)
+	if !p.Healthy(ScopeHeadend) {
+		t.Errorf("unhealthy with the listener up: %+v", p.Results())
+	}
+	srv.Close()
+	runOnce(p)
+	if p.Healthy(ScopeHeadend) {
+		t.Error("healthy with the listener closed")
+	}
+}
+
+func TestNilProberIsHealthy(t *testing.T) {
+	var p *Prober
+	if !p.Healthy(ScopeUpstream) || p.Results() != nil {
+		t.Error("a disabled prober should report healthy with no results")
+	}
+}
@@ -0,0 +1,43 @@
+// Build profiles for the headend.
+//
+// The default build includes every subsystem. Building with the minimal
+// tag produces a slimmer binary for edge deployments that only proxy
+// HTTP and TCP with JWT authentication: traffic mirroring and the Suricata
+// alert ingestion that relies on it, syslog, dynamic ports, OpenTelemetry
+// trace export, HTTP/3, the Redis shared firewall cache and the oauth2,
+// saml2 and ldap auth providers are left out, along with their
+// dependencies.
+//
+//	go build -tags minimal -o headend-proxy ./proxy
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// checkBuildProfile refuses configuration that enables a subsystem this
+// build leaves out, rather than starting without it
+func checkBuildProfile() error {
+	for _, key := range excludedFeatures {
+		if featureEnabled(key) {
+			return fmt.Errorf("%s is set but this headend was built with the %s profile, which leaves it out", key, buildProfile)
+		}
+	}
+	return nil
+}
+
+// featureEnabled reports whether key turns its subsystem on: a flag that is
+// true, or a setting such as a URL that is not empty
+func featureEnabled(key string) bool {
+	value, ok := viper.Get(key).(string)
+	if !ok {
+		return viper.GetBool(key)
+	}
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		return enabled
+	}
+	return value != ""
+}
@@ -0,0 +1,10 @@
+//go:build !minimal
+
+package main
+
+// buildProfile names the set of subsystems compiled in
+const buildProfile = "full"
+
+// excludedFeatures are the config keys of subsystems this build leaves out:
+// flags that enable them, or settings such as URLs that do when not empty
+var excludedFeatures []string
@@ -0,0 +1,18 @@
+//go:build minimal
+
+package main
+
+// buildProfile names the set of subsystems compiled in
+const buildProfile = "minimal"
+
+// excludedFeatures are the config keys of subsystems this build leaves out:
+// flags that enable them, or settings such as URLs that do when not empty
+var excludedFeatures = []string{
+	"mirror.enabled",
+	"suricata.alerts.enabled",
+	"syslog.enabled",
+	"ports.dynamic_enabled",
+	"tracing.enabled",
+	"server.quic.enabled",
+	"firewall.shared_cache.redis_url",
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestFeatureEnabled(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	tests := []struct {
+		value interface{}
+		want  bool
+	}{
+		{nil, false},
+		{false, false},
+		{true, true},
+		{"", false},
+		{"false", false},
+		{"true", true},
+		{"1", true},
+		{"redis://cache:6379/0", true},
+	}
+	for _, tt := range tests {
+		viper.Set("feature", tt.value)
+		if got := featureEnabled("feature"); got != tt.want {
+			t.Errorf("%#v: enabled %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package protocol implements the stream handling shared by the SASEWaddle
+// headend proxy listeners.
+//
+// The protocol package provides:
+//   - Reading the framing header that opens a client stream, keeping any
+//     payload bytes that arrived with it
+//   - Relaying a stream between client and target in both directions, with
+//     half-close and an optional tap for traffic mirroring
+//   - Relay buffers of a configurable size drawn from a shared pool, and
+//     zero-copy splice(2) between plain TCP connections on Linux when
+//     nothing taps the stream
+//
+// The static TCP listener, dynamically configured TCP ports, the SOCKS5
+// listener and HTTP CONNECT tunnels all relay through this package, so the
+// framing can evolve in one place.
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tobogganing/libs/framing"
+)
+
+const (
+	// headerBufferSize bounds how much is read ahead while looking for the
+	// end of the header
+	headerBufferSize = 4096
+
+	// DefaultRelayBufferSize is the chunk size for each relay direction
+	DefaultRelayBufferSize = 32 * 1024
+
+	// minRelayBufferSize keeps small buffers from turning every relayed
+	// chunk into a syscall storm
+	minRelayBufferSize = 2 * 1024
+)
+
+// relayBufferSize is the chunk size for each relay direction
+var relayBufferSize = DefaultRelayBufferSize
+
+// SetRelayBufferSize sets the chunk size for each relay direction. Smaller
+// buffers trade throughput for memory on small edge gateways, where every
+// relayed stream holds two of them. It must be called before the first
+// relay; zero keeps the default.
+func SetRelayBufferSize(size int) {
+	if size == 0 {
+		return
+	}
+	relayBufferSize = max(size, minRelayBufferSize)
+}
+
+// relayBuffers recycles relay buffers between connections, so a busy
+// headend doesn't allocate 64KB for every stream it relays
+var relayBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, relayBufferSize)
+		return &buffer
+	},
+}
+
+// Tap receives a copy of every chunk relayed, with the remote addresses of
+// the connections it was read from and written to. data is only valid
+// until the tap returns.
+type Tap func(src, dst string, data []byte)
+
+// ReadHeader reads the framing header from the start of a client stream.
+// It also returns the payload bytes that were read along with the header,
+// which must be delivered to the target before the rest of the stream.
+func ReadHeader(conn net.Conn) (*framing.Header, []byte, error) {
+	reader := bufio.NewReaderSize(conn, headerBufferSize)
+	header, err := framing.ReadHeader(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var initial []byte
+	if n := reader.Buffered(); n > 0 {
+		initial = make([]byte, n)
+		_, _ = reader.Read(initial)
+	}
+	return header, initial, nil
+}
+
+// Relay writes initial to target, then copies client to target and target
+// to client until both directions finish. When the client stops sending the
+// target's write side is closed; when the target stops sending the client
+// side is done too, so a client holding its connection open can't keep the
+// relay alive. It returns the bytes delivered in each direction, including
+// initial. The error is only set when initial could not be written.
+func Relay(client, target net.Conn, initial []byte, tap Tap) (toTarget, toClient int64, err error) {
+	if len(initial) > 0 {
+		if _, err := target.Write(initial); err != nil {
+			return 0, 0, err
+		}
+		if tap != nil {
+			tap(client.RemoteAddr().String(), target.RemoteAddr().String(), initial)
+		}
+		toTarget = int64(len(initial))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		toTarget += copyStream(target, client, tap)
+		closeWrite(target)
+	}()
+
+	toClient = copyStream(client, target, tap)
+	closeWrite(client)
+
+	// Unblock the client read if the client hasn't finished on its own
+	_ = client.SetReadDeadline(time.Now())
+	wg.Wait()
+
+	return toTarget, toClient, nil
+}
+
+// copyStream copies src to dst until either side fails, passing each chunk
+// to tap after it is written. Without a tap the copy is left to io.Copy,
+// which splices TCP to TCP in the kernel on Linux.
+func copyStream(dst, src net.Conn, tap Tap) int64 {
+	buffer := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(buffer)
+	if len(*buffer) != relayBufferSize {
+		// Pooled before SetRelayBufferSize changed the size
+		*buffer = make([]byte, relayBufferSize)
+	}
+
+	if tap == nil {
+		total, _ := io.CopyBuffer(dst, src, *buffer)
+		return total
+	}
+
+	srcAddr, dstAddr := src.RemoteAddr().String(), dst.RemoteAddr().String()
+	var total int64
+	for {
+		n, err := src.Read(*buffer)
+		if n > 0 {
+			chunk := (*buffer)[:n]
+			if _, werr := dst.Write(chunk); werr != nil {
+				return total
+			}
+			total += int64(n)
+			tap(srcAddr, dstAddr, chunk)
+		}
+		if err != nil {
+			return total
+		}
+	}
+}
+
+// closeWrite half-closes conn when it supports it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
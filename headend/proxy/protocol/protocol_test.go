@@ -0,0 +1,342 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/libs/framing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	remote, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		remote.Close()
+	})
+	return dialed, remote
+}
+
+func TestReadHeader(t *testing.T) {
+	binary, err := framing.Encode("token", "example.com:443")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header []byte
+		format framing.Format
+		// legacy clients expect their header forwarded with the payload
+		forwarded bool
+	}{
+		{"binary", binary, framing.FormatBinary, false},
+		{"legacy", framing.EncodeLegacy("token", "example.com:443"), framing.FormatLegacy, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			payload := []byte("GET / HTTP/1.1\r\n\r\n")
+			if _, err := client.Write(append(tt.header, payload...)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			header, initial, err := ReadHeader(server)
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			if header.Token != "token" || header.Target != "example.com:443" || header.Format != tt.format {
+				t.Errorf("unexpected header %+v", header)
+			}
+
+			want := payload
+			if tt.forwarded {
+				want = append(tt.header, payload...)
+			}
+
+			// Whatever wasn't buffered with the header is still on the connection
+			rest := make([]byte, len(want)-len(initial))
+			if _, err := io.ReadFull(server, rest); err != nil {
+				t.Fatalf("read rest: %v", err)
+			}
+			if got := append(initial, rest...); !bytes.Equal(got, want) {
+				t.Errorf("payload = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	client, server := tcpPair(t)
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	client.Close()
+
+	if _, _, err := ReadHeader(server); err == nil {
+		t.Fatal("expected error for stream without a header")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+
+	var mu sync.Mutex
+	var tapped int
+	tap := func(src, dst string, data []byte) {
+		mu.Lock()
+		tapped += len(data)
+		mu.Unlock()
+	}
+
+	type result struct{ toTarget, toClient int64 }
+	done := make(chan result, 1)
+	go func() {
+		toTarget, toClient, err := Relay(clientSide, targetSide, []byte("hello "), tap)
+		if err != nil {
+			t.Errorf("Relay: %v", err)
+		}
+		done <- result{toTarget, toClient}
+	}()
+
+	// The target echoes the request in upper case once the client half-closes
+	go func() {
+		request, _ := io.ReadAll(target)
+		_, _ = target.Write(bytes.ToUpper(request))
+		target.Close()
+	}()
+
+	if _, err := client.Write([]byte("world")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(response) != "HELLO WORLD" {
+		t.Errorf("response = %q, want %q", response, "HELLO WORLD")
+	}
+
+	select {
+	case r := <-done:
+		if r.toTarget != 11 || r.toClient != 11 {
+			t.Errorf("Relay counted %d to target and %d to client, want 11 each", r.toTarget, r.toClient)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not return")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tapped != 22 {
+		t.Errorf("tap saw %d bytes, want 22", tapped)
+	}
+}
+
+func TestRelayTargetCloses(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		_, _, _ = Relay(clientSide, targetSide, nil, nil)
+		close(done)
+	}()
+
+	// The client never half-closes, so only the target ending the stream
+	// can finish the relay
+	if _, err := target.Write([]byte("bye")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	target.Close()
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "bye" {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not return after the target closed")
+	}
+}
+
+func TestSetRelayBufferSize(t *testing.T) {
+	defer SetRelayBufferSize(DefaultRelayBufferSize)
+
+	SetRelayBufferSize(8 * 1024)
+	if relayBufferSize != 8*1024 {
+		t.Errorf("relayBufferSize = %d, want 8192", relayBufferSize)
+	}
+	SetRelayBufferSize(0)
+	if relayBufferSize != 8*1024 {
+		t.Errorf("size 0 changed relayBufferSize to %d", relayBufferSize)
+	}
+	SetRelayBufferSize(100)
+	if relayBufferSize != minRelayBufferSize {
+		t.Errorf("relayBufferSize = %d, want the minimum %d", relayBufferSize, minRelayBufferSize)
+	}
+}
+
+// relayChunk is the size of each write in the relay benchmarks
+const relayChunk = 64 * 1024
+
+// copyStreamUnpooled is the relay loop before buffer pooling and splice:
+// a fresh buffer per direction and every byte copied through user space
+func copyStreamUnpooled(dst, src net.Conn) {
+	buffer := make([]byte, relayBufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, werr := dst.Write(buffer[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// benchmarkRelay measures client to target throughput through relay
+func benchmarkRelay(b *testing.B, relay func(client, target net.Conn)) {
+	client, clientSide := tcpPair(b)
+	targetSide, target := tcpPair(b)
+
+	go func() {
+		relay(clientSide, targetSide)
+		closeWrite(targetSide)
+	}()
+
+	chunk := make([]byte, relayChunk)
+	b.SetBytes(relayChunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+		closeWrite(client)
+	}()
+
+	if _, err := io.Copy(io.Discard, target); err != nil {
+		b.Fatalf("read: %v", err)
+	}
+}
+
+func BenchmarkRelayUnpooled(b *testing.B) {
+	benchmarkRelay(b, func(client, target net.Conn) {
+		copyStreamUnpooled(target, client)
+	})
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarkRelay(b, func(client, target net.Conn) {
+		copyStream(target, client, nil)
+	})
+}
+
+func BenchmarkRelayTapped(b *testing.B) {
+	benchmarkRelay(b, func(client, target net.Conn) {
+		copyStream(target, client, func(src, dst string, data []byte) {})
+	})
+}
+
+// BenchmarkRelayBufferSize compares the relay buffer sizes of the tuning
+// profiles. The relay is tapped, as it is with mirroring on, so every chunk
+// passes through the buffer rather than being spliced in the kernel.
+func BenchmarkRelayBufferSize(b *testing.B) {
+	defer SetRelayBufferSize(DefaultRelayBufferSize)
+	for _, profile := range []struct {
+		name string
+		size int
+	}{
+		{"default", DefaultRelayBufferSize},
+		{"edge", 8 * 1024},
+	} {
+		b.Run(profile.name, func(b *testing.B) {
+			SetRelayBufferSize(profile.size)
+			benchmarkRelay(b, func(client, target net.Conn) {
+				copyStream(target, client, func(src, dst string, data []byte) {})
+			})
+		})
+	}
+}
+
+// BenchmarkRelayConnections measures the per-connection cost of relaying
+// many short streams, where the buffer allocations dominate
+func BenchmarkRelayConnections(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		copy func(dst, src net.Conn)
+	}{
+		{"unpooled", copyStreamUnpooled},
+		{"pooled", func(dst, src net.Conn) { copyStream(dst, src, func(string, string, []byte) {}) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client, clientSide := tcpPair(b)
+			targetSide, target := tcpPair(b)
+			message := []byte("ping")
+			reply := make([]byte, len(message))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				done := make(chan struct{})
+				go func() {
+					bench.copy(targetSide, clientSide)
+					close(done)
+				}()
+				if _, err := client.Write(message); err != nil {
+					b.Fatalf("write: %v", err)
+				}
+				if _, err := io.ReadFull(target, reply); err != nil {
+					b.Fatalf("read: %v", err)
+				}
+				// End this copy without closing the connections
+				_ = clientSide.SetReadDeadline(time.Now())
+				<-done
+				_ = clientSide.SetReadDeadline(time.Time{})
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package proxyproto
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	headersReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_proxy_protocol_headers_received_total",
+		Help: "Total PROXY protocol headers read from trusted sources, by version and result (proxied, local, invalid).",
+	}, []string{"version", "result"})
+
+	headersSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_proxy_protocol_headers_sent_total",
+		Help: "Total PROXY protocol headers written toward upstreams, by version.",
+	}, []string{"version"})
+)
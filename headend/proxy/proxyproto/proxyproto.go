@@ -0,0 +1,447 @@
+// Package proxyproto implements the PROXY protocol, versions 1 and 2, for
+// the SASEWaddle headend's TCP listeners and upstream connections.
+//
+// The proxyproto package provides:
+//   - Parsing the PROXY header an L4 load balancer puts in front of a
+//     stream, so the headend sees the real client address
+//   - A listener that requires the header from trusted sources, the load
+//     balancers, and passes connections from anyone else through untouched
+//   - Writing a header toward upstreams, so the services behind the headend
+//     can log the true source of the traffic it relays
+//
+// Parsed connections keep splice(2) relaying: once the header has been
+// consumed, copies from them go straight to the underlying TCP connection.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHeaderTimeout bounds the wait for the header of a trusted source
+	DefaultHeaderTimeout = 5 * time.Second
+
+	// v1MaxLength is the longest version 1 header, CRLF included
+	v1MaxLength = 107
+
+	// v2MaxLength bounds the address and TLV block of a version 2 header
+	v2MaxLength = 4096
+)
+
+// v2Signature opens every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// ErrNoHeader is returned when a stream doesn't start with a PROXY header
+	ErrNoHeader = errors.New("no PROXY protocol header")
+	// ErrInvalidHeader is returned for a malformed PROXY header
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+// Header is a parsed PROXY protocol header. Source and Destination are
+// invalid for a LOCAL (version 2) or UNKNOWN (version 1) header, which a
+// load balancer sends for its own connections, such as health checks; the
+// connection's own addresses apply then.
+type Header struct {
+	Version     int
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// Parse reads a version 1 or 2 header from the start of r
+func Parse(r *bufio.Reader) (*Header, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY" {
+		return parseV1(r)
+	}
+	if start[0] == v2Signature[0] {
+		signature, err := r.Peek(len(v2Signature))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(signature, v2Signature) {
+			return parseV2(r)
+		}
+	}
+	return nil, ErrNoHeader
+}
+
+// parseV1 parses a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func parseV1(r *bufio.Reader) (*Header, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	if err != nil || len(line) > v1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: version 1 line too long or not CRLF terminated", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	source, err := v1AddrPort(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, err
+	}
+	destination, err := v1AddrPort(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: source, Destination: destination}, nil
+}
+
+// v1AddrPort parses an address and port of a version 1 header
+func v1AddrPort(address, port string, ipv6 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil || addr.Is6() != ipv6 || addr.Zone() != "" {
+		return netip.AddrPort{}, fmt.Errorf("%w: address %q", ErrInvalidHeader, address)
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("%w: port %q", ErrInvalidHeader, port)
+	}
+	return netip.AddrPortFrom(addr, uint16(number)), nil
+}
+
+// parseV2 parses a binary version 2 header. TLVs are skipped.
+func parseV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, versionCommand>>4)
+	}
+	if length > v2MaxLength {
+		return nil, fmt.Errorf("%w: %d bytes of addresses", ErrInvalidHeader, length)
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: 2}
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL
+		return header, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, versionCommand&0x0f)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidHeader)
+		}
+		header.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(block[0:4])), binary.BigEndian.Uint16(block[8:10]))
+		header.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(block[4:8])), binary.BigEndian.Uint16(block[10:12]))
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidHeader)
+		}
+		header.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(block[0:16])), binary.BigEndian.Uint16(block[32:34]))
+		header.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(block[16:32])), binary.BigEndian.Uint16(block[34:36]))
+	default:
+		// AF_UNSPEC and AF_UNIX carry no address the headend can use
+	}
+	return header, nil
+}
+
+// Bytes encodes the header in version 1 or 2. A header without addresses
+// encodes as UNKNOWN or LOCAL. Mixed address families are sent as IPv6,
+// the IPv4 address mapped.
+func (h *Header) Bytes(version int) []byte {
+	source, destination := h.Source, h.Destination
+	proxied := source.IsValid() && destination.IsValid()
+	if proxied && source.Addr().Is4() != destination.Addr().Is4() {
+		source = netip.AddrPortFrom(netip.AddrFrom16(source.Addr().As16()), source.Port())
+		destination = netip.AddrPortFrom(netip.AddrFrom16(destination.Addr().As16()), destination.Port())
+	}
+	ipv4 := proxied && source.Addr().Is4()
+
+	if version == 1 {
+		if !proxied {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family,
+			source.Addr().WithZone(""), destination.Addr().WithZone(""), source.Port(), destination.Port())
+	}
+
+	header := append([]byte{}, v2Signature...)
+	if !proxied {
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	var block []byte
+	family := byte(0x21) // AF_INET6, STREAM
+	if ipv4 {
+		family = 0x11 // AF_INET, STREAM
+		sourceAddr, destinationAddr := source.Addr().As4(), destination.Addr().As4()
+		block = append(append(block, sourceAddr[:]...), destinationAddr[:]...)
+	} else {
+		sourceAddr, destinationAddr := source.Addr().As16(), destination.Addr().As16()
+		block = append(append(block, sourceAddr[:]...), destinationAddr[:]...)
+	}
+	block = binary.BigEndian.AppendUint16(block, source.Port())
+	block = binary.BigEndian.AppendUint16(block, destination.Port())
+
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(block)))
+	return append(header, block...)
+}
+
+// Config configures a Listener
+type Config struct {
+	// Trusted are the sources that must open their connections with a
+	// header, the load balancers; every source when empty
+	Trusted []netip.Prefix
+	// Timeout bounds the wait for the header, DefaultHeaderTimeout if zero
+	Timeout time.Duration
+}
+
+// ParseTrusted parses the trusted sources of a Config, networks or single
+// addresses
+func ParseTrusted(sources []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, source := range sources {
+		if strings.Contains(source, "/") {
+			prefix, err := netip.ParsePrefix(source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted PROXY protocol source %q: %w", source, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted PROXY protocol source %q: %w", source, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Listener reads the PROXY header of connections from trusted sources
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix
+	timeout time.Duration
+}
+
+// NewListener wraps inner so connections from trusted sources report the
+// addresses of their PROXY header
+func NewListener(inner net.Listener, cfg Config) *Listener {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHeaderTimeout
+	}
+	return &Listener{Listener: inner, trusted: cfg.Trusted, timeout: cfg.Timeout}
+}
+
+// Accept returns the next connection. The header is read on the
+// connection's first Read, RemoteAddr or LocalAddr, so a slow source
+// doesn't hold up the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// isTrusted reports whether addr must send a header
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	source, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, prefix := range l.trusted {
+		if prefix.Contains(source.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection opened with a PROXY header
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	header  *Header
+	err     error
+}
+
+// readHeader consumes the header, once
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = Parse(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			headersReceived.WithLabelValues("none", "invalid").Inc()
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+			return
+		}
+		result := "proxied"
+		if !c.header.Source.IsValid() {
+			result = "local"
+		}
+		headersReceived.WithLabelValues(strconv.Itoa(c.header.Version), result).Inc()
+	})
+}
+
+// Header returns the connection's PROXY header, reading it if need be
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+// Read reads the stream after the header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// WriteTo copies the stream after the header to w, straight from the
+// underlying connection once what was read ahead is delivered, so a TCP w
+// can splice it
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	var total int64
+	if buffered := c.reader.Buffered(); buffered > 0 {
+		data, _ := c.reader.Peek(buffered)
+		n, err := w.Write(data)
+		_, _ = c.reader.Discard(n)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := io.Copy(w, c.Conn)
+	return total + n, err
+}
+
+// RemoteAddr returns the client address of the header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header == nil || !c.header.Source.IsValid() {
+		return c.Conn.RemoteAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.header.Source)
+}
+
+// LocalAddr returns the address the client connected to according to the
+// header
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header == nil || !c.header.Destination.IsValid() {
+		return c.Conn.LocalAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.header.Destination)
+}
+
+// CloseWrite half-closes the underlying connection
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// upstreamVersion is the version of the header written toward upstreams,
+// 0 when none is
+var upstreamVersion atomic.Int32
+
+// ParseVersion parses a configured header version: "v1", "v2", or "" for
+// none
+func ParseVersion(version string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(version)) {
+	case "", "off", "none":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("unknown PROXY protocol version %q, expected v1 or v2", version)
+	}
+}
+
+// SetUpstreamVersion makes WriteUpstream send version 1 or 2 headers, or
+// none for 0
+func SetUpstreamVersion(version int) {
+	upstreamVersion.Store(int32(version))
+}
+
+// WriteUpstream opens an upstream stream with a header carrying the address
+// of the client it relays, if headers are sent upstream
+func WriteUpstream(upstream net.Conn, client net.Addr) error {
+	version := int(upstreamVersion.Load())
+	if version == 0 {
+		return nil
+	}
+	header := &Header{Version: version}
+	source, sourceErr := addrPort(client)
+	destination, destinationErr := addrPort(upstream.RemoteAddr())
+	if sourceErr == nil && destinationErr == nil {
+		header.Source, header.Destination = source, destination
+	}
+	if _, err := upstream.Write(header.Bytes(version)); err != nil {
+		return fmt.Errorf("failed to send PROXY protocol header: %w", err)
+	}
+	headersSent.WithLabelValues(strconv.Itoa(version)).Inc()
+	return nil
+}
+
+// addrPort returns the IP address and port of addr, IPv4 unmapped
+func addrPort(addr net.Addr) (netip.AddrPort, error) {
+	if addr == nil {
+		return netip.AddrPort{}, errors.New("no address")
+	}
+	addressPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addressPort.Addr().Unmap(), addressPort.Port()), nil
+}
@@ -0,0 +1,209 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseV1(t *testing.T) {
+	for line, want := range map[string]Header{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n": {
+			Version:     1,
+			Source:      netip.MustParseAddrPort("192.0.2.1:56324"),
+			Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+		},
+		"PROXY TCP6 2001:db8::1 2001:db8::2 4000 8444\r\n": {
+			Version:     1,
+			Source:      netip.MustParseAddrPort("[2001:db8::1]:4000"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:8444"),
+		},
+		"PROXY UNKNOWN\r\n": {Version: 1},
+		"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n": {Version: 1},
+	} {
+		reader := bufio.NewReader(strings.NewReader(line + "payload"))
+		header, err := Parse(reader)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if *header != want {
+			t.Errorf("%q parsed to %+v, want %+v", line, header, want)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "payload" {
+			t.Errorf("%q: expected the payload left, got %q", line, rest)
+		}
+	}
+
+	for _, line := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 0443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 70000\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+	} {
+		if _, err := Parse(bufio.NewReader(strings.NewReader(line))); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%q: expected ErrInvalidHeader, got %v", line, err)
+		}
+	}
+
+	if _, err := Parse(bufio.NewReader(strings.NewReader("SASE1 token target\n"))); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("expected ErrNoHeader, got %v", err)
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	for _, header := range []Header{
+		{Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:56324"), Destination: netip.MustParseAddrPort("198.51.100.1:443")},
+		{Version: 2, Source: netip.MustParseAddrPort("[2001:db8::1]:4000"), Destination: netip.MustParseAddrPort("[2001:db8::2]:8444")},
+		{Version: 2},
+	} {
+		encoded := header.Bytes(2)
+		parsed, err := Parse(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("%+v: %v", header, err)
+		}
+		if *parsed != header {
+			t.Errorf("%+v round-tripped to %+v", header, parsed)
+		}
+	}
+
+	// TLVs after the addresses are skipped
+	header := Header{Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:1"), Destination: netip.MustParseAddrPort("192.0.2.2:2")}
+	encoded := header.Bytes(2)
+	encoded[15] += 4
+	encoded = append(encoded, 0x04, 0x00, 0x01, 0xff, 'x')
+	reader := bufio.NewReader(bytes.NewReader(encoded))
+	if parsed, err := Parse(reader); err != nil || *parsed != header {
+		t.Errorf("expected the TLV skipped, got %+v, %v", parsed, err)
+	}
+	if rest, _ := io.ReadAll(reader); string(rest) != "x" {
+		t.Errorf("expected the payload left, got %q", rest)
+	}
+
+	// Mixed families are sent as IPv6
+	mixed := Header{Source: netip.MustParseAddrPort("192.0.2.1:1"), Destination: netip.MustParseAddrPort("[2001:db8::2]:2")}
+	if line := string(mixed.Bytes(1)); line != "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1 2\r\n" {
+		t.Errorf("unexpected version 1 header %q", line)
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	listener := NewListener(inner, Config{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, Timeout: time.Second})
+
+	header := Header{Source: netip.MustParseAddrPort("203.0.113.7:40000"), Destination: netip.MustParseAddrPort("198.51.100.1:8444")}
+	go func() {
+		client, err := net.Dial("tcp4", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		_, _ = client.Write(append(header.Bytes(2), "hello"...))
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:40000" {
+		t.Errorf("expected the header's source, got %s", got)
+	}
+	if got := conn.LocalAddr().String(); got != "198.51.100.1:8444" {
+		t.Errorf("expected the header's destination, got %s", got)
+	}
+	var received bytes.Buffer
+	if _, err := io.Copy(&received, conn); err != nil || received.String() != "hello" {
+		t.Errorf("expected the payload, got %q, %v", received.String(), err)
+	}
+
+	// A trusted source without a header is refused
+	go func() {
+		client, err := net.Dial("tcp4", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		_, _ = client.Write([]byte("SASE1 token target\n"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+	conn, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("expected ErrNoHeader, got %v", err)
+	}
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("expected the connection's own address, got %s", got)
+	}
+}
+
+func TestUntrustedSource(t *testing.T) {
+	listener := NewListener(nil, Config{Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	if listener.isTrusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}) {
+		t.Error("expected a source outside the trusted networks untrusted")
+	}
+	if !listener.isTrusted(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1}) {
+		t.Error("expected a mapped trusted source trusted")
+	}
+	if !NewListener(nil, Config{}).isTrusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}) {
+		t.Error("expected every source trusted without a trusted list")
+	}
+
+	prefixes, err := ParseTrusted([]string{"10.0.0.1/8", "192.0.2.10", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefixes[0].String() != "10.0.0.0/8" || prefixes[1].String() != "192.0.2.10/32" || len(prefixes) != 3 {
+		t.Errorf("unexpected prefixes %v", prefixes)
+	}
+	if _, err := ParseTrusted([]string{"load-balancer"}); err == nil {
+		t.Error("expected an invalid source rejected")
+	}
+}
+
+func TestWriteUpstream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Pipes have no IP addresses, so the header carries none
+	SetUpstreamVersion(1)
+	defer SetUpstreamVersion(0)
+	go func() {
+		_ = WriteUpstream(client, &net.TCPAddr{IP: net.ParseIP("10.200.0.2"), Port: 5000})
+	}()
+	header, err := Parse(bufio.NewReader(server))
+	if err != nil || header.Version != 1 || header.Source.IsValid() {
+		t.Errorf("expected an UNKNOWN header, got %+v, %v", header, err)
+	}
+
+	SetUpstreamVersion(0)
+	if err := WriteUpstream(client, nil); err != nil {
+		t.Errorf("expected nothing written, got %v", err)
+	}
+
+	for input, want := range map[string]int{"": 0, "v1": 1, "2": 2, "V2": 2} {
+		if got, err := ParseVersion(input); err != nil || got != want {
+			t.Errorf("ParseVersion(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+	if _, err := ParseVersion("v3"); err == nil {
+		t.Error("expected v3 rejected")
+	}
+}
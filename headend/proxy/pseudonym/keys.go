@@ -0,0 +1,206 @@
+// Package pseudonym replaces user identifiers in the logs the headend
+// exports with pseudonyms, so bulk analytics of access logs never see who
+// did what.
+//
+// The pseudonym package provides:
+//   - A keyed hash (HMAC-SHA256, truncated to 128 bits) of each identifier
+//   - Keys issued and rotated by the Manager, refreshed in the background;
+//     each entry names the key that hashed it, never the key itself
+//   - Identifiers withheld entirely until a first key arrives
+//
+// The Manager keeps past keys for a retention period, so an admin can
+// unmask the pseudonyms in an entry during an incident by hashing known
+// identifiers with the key it names.
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRefreshInterval is how often the current key is fetched; it
+	// bounds how long a rotated key stays in use
+	DefaultRefreshInterval = 5 * time.Minute
+
+	// pseudonymBytes is how much of the HMAC a pseudonym keeps
+	pseudonymBytes = 16
+)
+
+// Key is a pseudonymization key as the Manager issues it
+type Key struct {
+	ID     string `json:"key_id"`
+	Secret []byte `json:"key"`
+}
+
+// Pseudonymize returns the pseudonym of identifier under k; an empty
+// identifier stays empty
+func (k *Key) Pseudonymize(identifier string) string {
+	if identifier == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(identifier))
+	return hex.EncodeToString(mac.Sum(nil)[:pseudonymBytes])
+}
+
+// Keys holds the current pseudonymization key, refreshed from the Manager
+type Keys struct {
+	managerURL string
+	authToken  string
+	interval   time.Duration
+	httpClient *http.Client
+
+	mu       sync.RWMutex
+	current  *Key
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// NewKeys creates a key source that fetches keys from the Manager every
+// interval, DefaultRefreshInterval if zero
+func NewKeys(managerURL, authToken string, interval time.Duration) *Keys {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	return &Keys{
+		managerURL: managerURL,
+		authToken:  authToken,
+		interval:   interval,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Start fetches the current key and keeps it refreshed. The refresh loop
+// runs even if the first fetch fails; identifiers are withheld until a key
+// arrives.
+func (k *Keys) Start() error {
+	go k.refreshLoop()
+	if err := k.refresh(); err != nil {
+		return fmt.Errorf("failed to fetch the log pseudonymization key: %w", err)
+	}
+	return nil
+}
+
+// Stop stops refreshing the key
+func (k *Keys) Stop() {
+	if k == nil {
+		return
+	}
+	k.stopOnce.Do(func() { close(k.stopChan) })
+}
+
+func (k *Keys) refreshLoop() {
+	for {
+		// Randomized like the firewall refresh to avoid a thundering herd
+		jitter := time.Duration(rand.Int63n(int64(k.interval) / 5))
+		select {
+		case <-time.After(k.interval - k.interval/10 + jitter):
+			// Keep hashing with the key we have if the Manager can't be reached
+			if err := k.refresh(); err != nil {
+				log.Errorf("Failed to refresh the log pseudonymization key: %v", err)
+			}
+		case <-k.stopChan:
+			return
+		}
+	}
+}
+
+func (k *Keys) refresh() error {
+	req, err := http.NewRequest("GET", k.managerURL+"/api/v1/headend/log-pseudonym-key", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+k.authToken)
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var key Key
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return fmt.Errorf("failed to decode key: %w", err)
+	}
+	if key.ID == "" || len(key.Secret) == 0 {
+		return fmt.Errorf("the Manager sent an empty key")
+	}
+	k.Set(&key)
+	return nil
+}
+
+// Set makes key the current key
+func (k *Keys) Set(key *Key) {
+	k.mu.Lock()
+	previous := k.current
+	k.current = key
+	k.mu.Unlock()
+
+	if previous == nil || previous.ID != key.ID {
+		keyRotations.Inc()
+		log.Infof("Pseudonymizing exported logs with key %s", key.ID)
+	}
+}
+
+// Current returns the key to hash with, or nil before the first one
+// arrives
+func (k *Keys) Current() *Key {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Replace replaces each identifier with its pseudonym under the current
+// key and returns the key's ID. Before the first key arrives the
+// identifiers are cleared instead and the ID is empty.
+func (k *Keys) Replace(identifiers ...*string) string {
+	key := k.Current()
+	if key == nil {
+		withheld.Inc()
+		for _, identifier := range identifiers {
+			*identifier = ""
+		}
+		return ""
+	}
+	for _, identifier := range identifiers {
+		*identifier = key.Pseudonymize(*identifier)
+	}
+	return key.ID
+}
+
+// Status reports the key in use, or nil if pseudonymization is off
+func (k *Keys) Status() map[string]interface{} {
+	if k == nil {
+		return nil
+	}
+	key := k.Current()
+	if key == nil {
+		return map[string]interface{}{"key_id": nil}
+	}
+	return map[string]interface{}{"key_id": key.ID}
+}
@@ -0,0 +1,63 @@
+package pseudonym
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPseudonymize(t *testing.T) {
+	key := &Key{ID: "k1", Secret: []byte("key")}
+
+	// The Manager computes the same value to unmask it
+	if got := key.Pseudonymize("alice"); got != "76fb55e929c06b97b01c35950ee5f72f" {
+		t.Errorf("unexpected pseudonym %s", got)
+	}
+	if got := key.Pseudonymize(""); got != "" {
+		t.Errorf("expected an empty identifier to stay empty, got %s", got)
+	}
+	other := &Key{ID: "k2", Secret: []byte("other")}
+	if key.Pseudonymize("alice") == other.Pseudonymize("alice") {
+		t.Error("expected pseudonyms to change with the key")
+	}
+}
+
+func TestReplaceWithholdsWithoutKey(t *testing.T) {
+	keys := NewKeys("http://127.0.0.1:1", "token", 0)
+
+	userID, username := "u-1", "alice"
+	if id := keys.Replace(&userID, &username); id != "" || userID != "" || username != "" {
+		t.Fatalf("expected identifiers withheld without a key, got %q %q with key %q", userID, username, id)
+	}
+
+	keys.Set(&Key{ID: "k1", Secret: []byte("key")})
+	userID, username = "u-1", "alice"
+	if id := keys.Replace(&userID, &username); id != "k1" || username != "76fb55e929c06b97b01c35950ee5f72f" || userID == "u-1" {
+		t.Errorf("expected pseudonyms under k1, got %q %q with key %q", userID, username, id)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/headend/log-pseudonym-key" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The Manager sends the secret base64 encoded
+		_, _ = w.Write([]byte(`{"key_id": "k1", "key": "a2V5", "expires_at": "2024-03-02T12:00:00"}`))
+	}))
+	defer server.Close()
+
+	keys := NewKeys(server.URL, "token", 0)
+	if err := keys.refresh(); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	if key := keys.Current(); key == nil || key.ID != "k1" || string(key.Secret) != "key" {
+		t.Errorf("unexpected key %+v", key)
+	}
+
+	keys = NewKeys(server.URL, "wrong", 0)
+	if err := keys.refresh(); err == nil || keys.Current() != nil {
+		t.Error("expected a rejected fetch to leave no key")
+	}
+}
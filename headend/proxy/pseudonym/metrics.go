@@ -0,0 +1,18 @@
+package pseudonym
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	keyRotations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_log_pseudonym_key_rotations_total",
+		Help: "Total number of times a new log pseudonymization key was taken into use.",
+	})
+
+	withheld = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_log_pseudonym_withheld_total",
+		Help: "Total number of exported log entries whose user identifiers were withheld for lack of a pseudonymization key.",
+	})
+)
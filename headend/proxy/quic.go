@@ -0,0 +1,83 @@
+//go:build !minimal
+
+// HTTP/3 listener for the headend.
+//
+// Clients on lossy mobile networks suffer from TCP head-of-line blocking
+// and reconnect on every network change. QUIC avoids both. The HTTP/3
+// listener serves the same router as the TCP listener, so requests go
+// through the same auth middleware and firewall enforcement, and TCP
+// responses advertise it with Alt-Svc so capable clients switch over.
+//
+// CONNECT tunnels and WebSocket upgrades need a hijacked TCP connection
+// and stay on the TCP listener.
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// http3Server is the HTTP/3 listener, which the minimal build leaves out
+type http3Server = http3.Server
+
+// initializeQUIC prepares the HTTP/3 listener from server.quic.*. It reuses
+// the TCP listener's TLS settings, including mTLS client verification, and
+// must run after they are set. The certificate is shared with the TCP
+// listener, so it is reloaded for both.
+func (s *ProxyServer) initializeQUIC() error {
+	if s.certificates == nil {
+		return fmt.Errorf("QUIC requires server.cert_file and server.key_file")
+	}
+
+	tlsConfig := s.httpServer.TLSConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13 // QUIC requires TLS 1.3
+
+	port := viper.GetString("server.quic.port")
+	if port == "" {
+		port = viper.GetString("server.http_port")
+	}
+
+	s.quicServer = &http3.Server{
+		Addr:        ":" + port,
+		Handler:     http.HandlerFunc(s.routeRequest),
+		TLSConfig:   tlsConfig,
+		IdleTimeout: viper.GetDuration("server.quic.idle_timeout"),
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout: viper.GetDuration("server.quic.idle_timeout"),
+			// 0-RTT requests can be replayed, which a proxy can't make safe
+			Allow0RTT: false,
+		},
+	}
+
+	// Advertise HTTP/3 on every TCP response
+	tcpHandler := s.httpServer.Handler
+	s.httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = s.quicServer.SetQUICHeaders(w.Header())
+		tcpHandler.ServeHTTP(w, r)
+	})
+
+	return nil
+}
+
+// serveQUIC runs the HTTP/3 listener until it is shut down
+func (s *ProxyServer) serveQUIC() {
+	log.Infof("Starting headend HTTP/3 (QUIC) listener on UDP %s", s.quicServer.Addr)
+	conn, err := net.ListenPacket(listenNetwork("udp"), s.quicServer.Addr)
+	if err != nil {
+		log.Errorf("HTTP/3 listener failed: %v", err)
+		return
+	}
+	err = s.quicServer.Serve(conn)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) &&
+		!errors.Is(err, net.ErrClosed) {
+		log.Errorf("HTTP/3 listener failed: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build minimal
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// http3Server stands in for the HTTP/3 listener, which the minimal build
+// leaves out along with quic-go
+type http3Server struct{}
+
+func (s *http3Server) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (s *ProxyServer) initializeQUIC() error {
+	return errors.New("HTTP/3 is not included in the minimal build")
+}
+
+func (s *ProxyServer) serveQUIC() {}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket measured in bytes. Wait-style reservations may
+// drive it negative; the debt is repaid before later callers proceed, so a
+// large write is delayed rather than split.
+type bucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+	mu       sync.Mutex
+}
+
+func newBucket(limit Limit) *bucket {
+	b := &bucket{last: time.Now(), lastUsed: time.Now()}
+	b.setLimit(limit)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *bucket) setLimit(limit Limit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.rate = float64(limit.BytesPerSecond)
+	b.burst = float64(limit.BurstBytes)
+	if b.burst <= 0 {
+		b.burst = b.rate
+	}
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// refill adds tokens for the time elapsed since the last update; b.mu must be held
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long the caller must wait for
+// the bucket to be out of debt
+func (b *bucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.refill(now)
+	b.lastUsed = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes n tokens only if they are available now
+func (b *bucket) allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.refill(now)
+	b.lastUsed = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refund returns n tokens taken by allow when the caller couldn't use them
+func (b *bucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+n)
+}
+
+// level returns the tokens available now
+func (b *bucket) level() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens
+}
+
+// setLevel replaces the bucket's tokens, capped at the burst
+func (b *bucket) setLevel(tokens float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens = math.Min(b.burst, tokens)
+}
+
+func (b *bucket) idleFor() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Since(b.lastUsed)
+}
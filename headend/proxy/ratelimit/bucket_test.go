@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	b := newBucket(Limit{BytesPerSecond: 1000, BurstBytes: 500})
+	if b.tokens != 500 {
+		t.Fatalf("new bucket has %.0f tokens, want the burst", b.tokens)
+	}
+
+	if !b.allow(500) || b.allow(1) {
+		t.Fatal("expected the burst, and no more, to be allowed")
+	}
+
+	// A quarter second refills 250 bytes
+	b.last = b.last.Add(-250 * time.Millisecond)
+	if tokens := b.level(); tokens < 249 || tokens > 260 {
+		t.Errorf("refilled to %.0f tokens, want about 250", tokens)
+	}
+
+	// Refills never exceed the burst
+	b.last = b.last.Add(-time.Hour)
+	if tokens := b.level(); tokens != 500 {
+		t.Errorf("refilled to %.0f tokens, want the burst of 500", tokens)
+	}
+}
+
+func TestBucketDebt(t *testing.T) {
+	b := newBucket(Limit{BytesPerSecond: 1000})
+	if b.burst != 1000 {
+		t.Fatalf("burst %.0f, want one second of traffic", b.burst)
+	}
+
+	// A reservation larger than the bucket goes into debt
+	if delay := b.reserve(1500); delay < 450*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("reserving past the bucket waits %v, want about 500ms", delay)
+	}
+	if tokens := b.level(); tokens >= 0 {
+		t.Fatalf("bucket has %.0f tokens, want debt", tokens)
+	}
+
+	// Later callers wait for the debt to be repaid first
+	if delay := b.reserve(100); delay < 550*time.Millisecond {
+		t.Errorf("reserving in debt waits %v, want about 600ms", delay)
+	}
+	if b.allow(1) {
+		t.Error("expected nothing to be allowed in debt")
+	}
+}
+
+func TestBucketSetLimit(t *testing.T) {
+	b := newBucket(Limit{BytesPerSecond: 1000})
+	b.setLimit(Limit{BytesPerSecond: 100, BurstBytes: 200})
+	if b.rate != 100 || b.burst != 200 || b.tokens > 200 {
+		t.Errorf("unexpected bucket after lowering the limit: rate %.0f burst %.0f tokens %.0f", b.rate, b.burst, b.tokens)
+	}
+}
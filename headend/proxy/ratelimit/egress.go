@@ -0,0 +1,287 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EgressConfig is a headend-wide bandwidth cap. Shares cap individual
+// protocols (http, tcp, udp, socks5) at a fraction of the total, so one
+// protocol can't starve the others; protocols without a share may use the
+// whole cap.
+type EgressConfig struct {
+	BytesPerSecond int64
+	// BurstBytes is the bucket size; zero allows one second of traffic
+	BurstBytes int64
+	Shares     map[string]float64
+}
+
+// Egress throttles all traffic the headend relays against a single cap, so
+// a headend on a constrained uplink slows every session down instead of
+// saturating the site link. A nil Egress passes traffic through untouched.
+type Egress struct {
+	limit  Limit
+	global *bucket
+	shares map[string]*egressShare
+	meter  *egressMeter
+}
+
+type egressShare struct {
+	fraction float64
+	bucket   *bucket
+}
+
+// EgressStatus reports the cap and recent utilization for health checks
+type EgressStatus struct {
+	BytesPerSecond int64                        `json:"bytes_per_second"`
+	Utilization    float64                      `json:"utilization"`
+	Shares         map[string]EgressShareStatus `json:"shares,omitempty"`
+}
+
+// EgressShareStatus reports a protocol's share of the cap
+type EgressShareStatus struct {
+	Fraction       float64 `json:"fraction"`
+	BytesPerSecond int64   `json:"bytes_per_second"`
+	Utilization    float64 `json:"utilization"`
+}
+
+// NewEgress creates a headend-wide cap, or returns nil when cfg has no rate.
+// Shares outside (0, 1] are ignored.
+func NewEgress(cfg EgressConfig) *Egress {
+	if cfg.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	limit := Limit{BytesPerSecond: cfg.BytesPerSecond, BurstBytes: cfg.BurstBytes}
+	e := &Egress{
+		limit:  limit,
+		global: newBucket(limit),
+		shares: make(map[string]*egressShare, len(cfg.Shares)),
+		meter:  newEgressMeter(float64(cfg.BytesPerSecond)),
+	}
+	egressLimitBytesPerSecond.Set(float64(cfg.BytesPerSecond))
+
+	for protocol, fraction := range cfg.Shares {
+		if fraction <= 0 || fraction > 1 {
+			continue
+		}
+		shareLimit := Limit{
+			BytesPerSecond: int64(float64(cfg.BytesPerSecond) * fraction),
+			BurstBytes:     int64(float64(limit.BurstBytes) * fraction),
+		}
+		if shareLimit.BytesPerSecond <= 0 {
+			continue
+		}
+		e.shares[strings.ToLower(protocol)] = &egressShare{fraction: fraction, bucket: newBucket(shareLimit)}
+	}
+	return e
+}
+
+// Wait charges n bytes of protocol traffic and blocks until both the
+// headend cap and the protocol's share allow them, or ctx is done
+func (e *Egress) Wait(ctx context.Context, protocol string, n int) error {
+	if e == nil || n <= 0 {
+		return nil
+	}
+
+	protocol = strings.ToLower(protocol)
+	delay := e.global.reserve(float64(n))
+	if share, ok := e.shares[protocol]; ok {
+		if shareDelay := share.bucket.reserve(float64(n)); shareDelay > delay {
+			delay = shareDelay
+		}
+	}
+	e.meter.add(protocol, n)
+	egressBytes.WithLabelValues(protocol).Add(float64(n))
+	if delay <= 0 {
+		return nil
+	}
+
+	egressThrottled.WithLabelValues(protocol).Add(delay.Seconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Allow charges n bytes of protocol traffic only if the cap and the
+// protocol's share have room for them now. It is used for UDP.
+func (e *Egress) Allow(protocol string, n int) bool {
+	if e == nil {
+		return true
+	}
+
+	protocol = strings.ToLower(protocol)
+	share, hasShare := e.shares[protocol]
+	if hasShare && !share.bucket.allow(float64(n)) {
+		egressDropped.WithLabelValues(protocol).Inc()
+		return false
+	}
+	if !e.global.allow(float64(n)) {
+		if hasShare {
+			share.bucket.refund(float64(n))
+		}
+		egressDropped.WithLabelValues(protocol).Inc()
+		return false
+	}
+	e.meter.add(protocol, n)
+	egressBytes.WithLabelValues(protocol).Add(float64(n))
+	return true
+}
+
+// Conn throttles a client connection against the cap. Both directions are
+// charged, so every byte relayed for the client counts once.
+func (e *Egress) Conn(protocol string, conn net.Conn) net.Conn {
+	if e == nil {
+		return conn
+	}
+	return &egressConn{Conn: conn, egress: e, protocol: protocol}
+}
+
+// Reader throttles reads from r against the cap
+func (e *Egress) Reader(ctx context.Context, protocol string, r io.ReadCloser) io.ReadCloser {
+	if e == nil || r == nil {
+		return r
+	}
+	return &egressReader{ReadCloser: r, ctx: ctx, egress: e, protocol: protocol}
+}
+
+// Status returns the cap and utilization over the last full second
+func (e *Egress) Status() *EgressStatus {
+	if e == nil {
+		return nil
+	}
+
+	total, byProtocol := e.meter.lastSecond()
+	status := &EgressStatus{
+		BytesPerSecond: e.limit.BytesPerSecond,
+		Utilization:    float64(total) / float64(e.limit.BytesPerSecond),
+	}
+	if len(e.shares) > 0 {
+		status.Shares = make(map[string]EgressShareStatus, len(e.shares))
+		for protocol, share := range e.shares {
+			rate := int64(share.bucket.rate)
+			status.Shares[protocol] = EgressShareStatus{
+				Fraction:       share.fraction,
+				BytesPerSecond: rate,
+				Utilization:    float64(byProtocol[protocol]) / float64(rate),
+			}
+		}
+	}
+	return status
+}
+
+type egressConn struct {
+	net.Conn
+	egress   *Egress
+	protocol string
+}
+
+func (c *egressConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		_ = c.egress.Wait(context.Background(), c.protocol, n)
+	}
+	return n, err
+}
+
+func (c *egressConn) Write(p []byte) (int, error) {
+	_ = c.egress.Wait(context.Background(), c.protocol, len(p))
+	return c.Conn.Write(p)
+}
+
+// CloseWrite lets proxies half-close throttled TCP connections
+func (c *egressConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+type egressReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	egress   *Egress
+	protocol string
+}
+
+func (r *egressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.egress.Wait(r.ctx, r.protocol, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// egressMeter counts bytes per one-second window. The last complete window
+// gives the current utilization.
+type egressMeter struct {
+	rate     float64
+	window   int64
+	current  map[string]int64
+	previous map[string]int64
+	mu       sync.Mutex
+}
+
+func newEgressMeter(rate float64) *egressMeter {
+	return &egressMeter{
+		rate:    rate,
+		window:  time.Now().Unix(),
+		current: make(map[string]int64),
+	}
+}
+
+func (m *egressMeter) add(protocol string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(time.Now().Unix())
+	m.current[protocol] += int64(n)
+}
+
+// roll starts a new window if the current one has ended; m.mu must be held
+func (m *egressMeter) roll(now int64) {
+	if now == m.window {
+		return
+	}
+	if now == m.window+1 {
+		m.previous = m.current
+	} else {
+		// A second or more passed without traffic
+		m.previous = nil
+	}
+	m.window = now
+	m.current = make(map[string]int64, len(m.previous))
+
+	var total int64
+	for _, n := range m.previous {
+		total += n
+	}
+	egressUtilization.Set(float64(total) / m.rate)
+}
+
+// lastSecond returns the bytes charged in the last complete second, in
+// total and by protocol
+func (m *egressMeter) lastSecond() (int64, map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(time.Now().Unix())
+	byProtocol := make(map[string]int64, len(m.previous))
+	var total int64
+	for protocol, n := range m.previous {
+		byProtocol[protocol] = n
+		total += n
+	}
+	return total, byProtocol
+}
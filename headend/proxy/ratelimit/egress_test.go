@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewEgressDisabled(t *testing.T) {
+	e := NewEgress(EgressConfig{})
+	if e != nil {
+		t.Fatal("expected nil egress without a rate")
+	}
+	if !e.Allow("udp", 1<<20) || e.Wait(context.Background(), "tcp", 1<<20) != nil || e.Status() != nil {
+		t.Fatal("nil egress should pass traffic through")
+	}
+}
+
+func TestEgressShares(t *testing.T) {
+	e := NewEgress(EgressConfig{
+		BytesPerSecond: 1000,
+		Shares:         map[string]float64{"UDP": 0.25, "tcp": 2},
+	})
+
+	// UDP may only use a quarter of the burst
+	if !e.Allow("udp", 250) {
+		t.Fatal("udp within its share was dropped")
+	}
+	if e.Allow("udp", 10) {
+		t.Fatal("udp over its share was allowed")
+	}
+
+	// tcp's invalid share is ignored, so it may use the rest of the cap
+	if !e.Allow("tcp", 750) {
+		t.Fatal("tcp within the cap was dropped")
+	}
+	if e.Allow("http", 10) {
+		t.Fatal("traffic over the cap was allowed")
+	}
+
+	status := e.Status()
+	if status.BytesPerSecond != 1000 || len(status.Shares) != 1 || status.Shares["udp"].BytesPerSecond != 250 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestEgressRefundsShare(t *testing.T) {
+	e := NewEgress(EgressConfig{
+		BytesPerSecond: 1000,
+		Shares:         map[string]float64{"udp": 0.5},
+	})
+
+	// With the global bucket empty, a refused datagram must not use up
+	// udp's share as well
+	if !e.Allow("tcp", 1000) {
+		t.Fatal("tcp within the cap was dropped")
+	}
+	if e.Allow("udp", 100) {
+		t.Fatal("udp allowed with the cap exhausted")
+	}
+	if tokens := e.shares["udp"].bucket.tokens; tokens < 500 {
+		t.Fatalf("udp share has %.0f tokens after a refused datagram, want 500", tokens)
+	}
+}
+
+func TestEgressWaitThrottles(t *testing.T) {
+	e := NewEgress(EgressConfig{BytesPerSecond: 10000})
+
+	ctx := context.Background()
+	if err := e.Wait(ctx, "tcp", 10000); err != nil {
+		t.Fatalf("burst: %v", err)
+	}
+
+	start := time.Now()
+	if err := e.Wait(ctx, "tcp", 1000); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("waited %v past the cap, want about 100ms", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := e.Wait(cancelled, "tcp", 10000); err == nil {
+		t.Error("expected an error waiting on a cancelled context")
+	}
+}
@@ -0,0 +1,463 @@
+// Package ratelimit implements per-user bandwidth limiting for the SASEWaddle
+// headend proxy.
+//
+// The ratelimit package provides:
+//   - A token bucket per user ID, sized from limits set in the Manager
+//   - Hot reloading of limits with randomized refresh intervals, like the
+//     firewall rules; existing buckets adopt new limits in place
+//   - Throttled net.Conn, io.Reader and io.Writer wrappers for the HTTP,
+//     CONNECT, SOCKS5 and TCP data paths
+//   - Policing (drop when over limit) for UDP datagrams
+//   - Per-user usage, throttling and limit metrics
+//
+// Users without a limit, and a nil Limiter, pass traffic through untouched.
+// Both directions of a user's traffic draw from the same bucket.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// idleBucketTTL is how long an unused bucket is kept before it is dropped
+const idleBucketTTL = 10 * time.Minute
+
+// Limit is a bandwidth limit. A zero rate means unlimited.
+type Limit struct {
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	// BurstBytes is the bucket size; zero allows one second of traffic
+	BurstBytes int64 `json:"burst_bytes"`
+}
+
+// LimitsResponse is the rate limit configuration served by the Manager
+type LimitsResponse struct {
+	Version string           `json:"version"`
+	Default Limit            `json:"default"`
+	Users   map[string]Limit `json:"users"`
+}
+
+// Limiter holds a token bucket per user
+type Limiter struct {
+	managerURL    string
+	authToken     string
+	defaultLimit  Limit
+	users         map[string]Limit
+	version       string
+	buckets       map[string]*bucket
+	mu            sync.Mutex
+	refreshTicker *time.Ticker
+	stopChan      chan bool
+}
+
+// NewLimiter creates a limiter that fetches limits from the Manager
+func NewLimiter(managerURL, authToken string) *Limiter {
+	return &Limiter{
+		managerURL: managerURL,
+		authToken:  authToken,
+		users:      make(map[string]Limit),
+		buckets:    make(map[string]*bucket),
+		stopChan:   make(chan bool),
+	}
+}
+
+// Start fetches the initial limits and keeps them refreshed
+func (l *Limiter) Start() error {
+	log.Info("Starting rate limiter")
+
+	if err := l.fetchLimits(); err != nil {
+		return fmt.Errorf("failed to fetch initial rate limits: %w", err)
+	}
+
+	// Randomized like the firewall refresh to avoid a thundering herd
+	l.refreshTicker = time.NewTicker(time.Duration(30+rand.Intn(61)) * time.Second)
+	go l.refreshLoop()
+	return nil
+}
+
+// Stop stops refreshing limits
+func (l *Limiter) Stop() {
+	if l.refreshTicker != nil {
+		l.refreshTicker.Stop()
+	}
+	close(l.stopChan)
+}
+
+func (l *Limiter) refreshLoop() {
+	for {
+		select {
+		case <-l.refreshTicker.C:
+			if err := l.fetchLimits(); err != nil {
+				log.Errorf("Failed to refresh rate limits: %v", err)
+			} else {
+				l.refreshTicker.Reset(time.Duration(30+rand.Intn(61)) * time.Second)
+			}
+			l.expireIdleBuckets()
+		case <-l.stopChan:
+			return
+		}
+	}
+}
+
+func (l *Limiter) fetchLimits() error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequest("GET", l.managerURL+"/api/v1/headend/rate-limits", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+l.authToken)
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch rate limits: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to fetch rate limits: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var limits LimitsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&limits); err != nil {
+		return fmt.Errorf("failed to decode rate limits: %w", err)
+	}
+
+	l.Apply(limits)
+	return nil
+}
+
+// Apply replaces the configured limits. Existing buckets adopt their new
+// limit immediately; buckets for users that became unlimited are dropped.
+func (l *Limiter) Apply(limits LimitsResponse) {
+	users := make(map[string]Limit, len(limits.Users))
+	for userID, limit := range limits.Users {
+		users[userID] = limit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.defaultLimit = limits.Default
+	l.users = users
+	l.version = limits.Version
+
+	for userID, b := range l.buckets {
+		limit := l.limitFor(userID)
+		if limit.BytesPerSecond <= 0 {
+			delete(l.buckets, userID)
+			deleteUserMetrics(userID)
+			continue
+		}
+		b.setLimit(limit)
+		rateLimitBytesPerSecond.WithLabelValues(userID).Set(float64(limit.BytesPerSecond))
+	}
+
+	log.Infof("Updated rate limits for %d users (version %q)", len(users), limits.Version)
+}
+
+// Version returns the version of the limits in use
+func (l *Limiter) Version() string {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version
+}
+
+// limitFor returns a user's limit; l.mu must be held
+func (l *Limiter) limitFor(userID string) Limit {
+	if limit, ok := l.users[userID]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// bucketFor returns the user's bucket, or nil if the user is unlimited
+func (l *Limiter) bucketFor(userID string) *bucket {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[userID]; ok {
+		return b
+	}
+
+	limit := l.limitFor(userID)
+	if limit.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	b := newBucket(limit)
+	l.buckets[userID] = b
+	rateLimitBytesPerSecond.WithLabelValues(userID).Set(float64(limit.BytesPerSecond))
+	return b
+}
+
+func (l *Limiter) expireIdleBuckets() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for userID, b := range l.buckets {
+		if b.idleFor() > idleBucketTTL {
+			delete(l.buckets, userID)
+			deleteUserMetrics(userID)
+		}
+	}
+}
+
+// Wait charges n bytes to the user and blocks until the bucket allows them
+// or ctx is done
+func (l *Limiter) Wait(ctx context.Context, userID string, n int) error {
+	b := l.bucketFor(userID)
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	delay := l.reserve(b, userID, n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve charges n bytes to the user's bucket b and returns how long the
+// caller must wait for them
+func (l *Limiter) reserve(b *bucket, userID string, n int) time.Duration {
+	rateLimitBytes.WithLabelValues(userID).Add(float64(n))
+	delay := b.reserve(float64(n))
+	if delay > 0 {
+		rateLimitThrottled.WithLabelValues(userID).Add(delay.Seconds())
+	}
+	return delay
+}
+
+// Allow charges n bytes to the user only if the bucket has room for them
+// now. It is used for UDP, where delaying datagrams is worse than dropping.
+func (l *Limiter) Allow(userID string, n int) bool {
+	b := l.bucketFor(userID)
+	if b == nil {
+		return true
+	}
+	if !b.allow(float64(n)) {
+		rateLimitDropped.WithLabelValues(userID).Inc()
+		return false
+	}
+	rateLimitBytes.WithLabelValues(userID).Add(float64(n))
+	return true
+}
+
+// Tokens returns the user's current bucket level, which is negative while
+// the user is in debt. ok is false if the user is unlimited.
+func (l *Limiter) Tokens(userID string) (tokens float64, ok bool) {
+	b := l.bucketFor(userID)
+	if b == nil {
+		return 0, false
+	}
+	return b.level(), true
+}
+
+// SetTokens sets the user's bucket level, e.g. to carry a user's usage
+// over from another headend. It is capped at the user's burst.
+func (l *Limiter) SetTokens(userID string, tokens float64) {
+	if b := l.bucketFor(userID); b != nil {
+		b.setLevel(tokens)
+	}
+}
+
+// Conn throttles both directions of a connection against the user's bucket.
+// A read or write held back by the limit returns early when the connection
+// is closed or its deadline passes.
+func (l *Limiter) Conn(userID string, conn net.Conn) net.Conn {
+	if l.bucketFor(userID) == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, limiter: l, userID: userID, closed: make(chan struct{})}
+}
+
+// Reader throttles reads from r against the user's bucket
+func (l *Limiter) Reader(ctx context.Context, userID string, r io.ReadCloser) io.ReadCloser {
+	if r == nil || l.bucketFor(userID) == nil {
+		return r
+	}
+	return &limitedReader{ReadCloser: r, ctx: ctx, limiter: l, userID: userID}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter   *Limiter
+	userID    string
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if waitErr := c.wait(&c.readDeadline, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if err := c.wait(&c.writeDeadline, len(p)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// wait charges n bytes and blocks until the bucket allows them, the
+// connection is closed or d passes, failing like the connection would
+func (c *limitedConn) wait(d *deadline, n int) error {
+	b := c.limiter.bucketFor(c.userID)
+	if b == nil {
+		return nil
+	}
+	delay := c.limiter.reserve(b, c.userID, n)
+	if delay <= 0 {
+		return nil
+	}
+
+	allowed := time.NewTimer(delay)
+	defer allowed.Stop()
+	for {
+		until, changed := d.get()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !until.IsZero() {
+			remaining := time.Until(until)
+			if remaining <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(remaining)
+			expired = timer.C
+		}
+
+		var err error
+		done := true
+		select {
+		case <-allowed.C:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			// Wait again against the new deadline
+			done = false
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return err
+		}
+	}
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitedConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// deadline is one direction's deadline, which throttled reads and writes
+// watch for changes while they wait
+type deadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+// get returns the deadline and a channel closed when it next changes
+func (d *deadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+// CloseWrite lets proxies half-close throttled TCP connections
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *Limiter
+	userID  string
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.Wait(r.ctx, r.userID, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNilLimiterPassesTraffic(t *testing.T) {
+	var l *Limiter
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	if !l.Allow("alice", 1<<20) || l.Wait(context.Background(), "alice", 1<<20) != nil || l.Conn("alice", conn) != conn {
+		t.Fatal("nil limiter should pass traffic through")
+	}
+}
+
+func TestApplyReloadsBuckets(t *testing.T) {
+	l := NewLimiter("", "")
+	l.Apply(LimitsResponse{
+		Version: "1",
+		Default: Limit{BytesPerSecond: 1000},
+		Users:   map[string]Limit{"bob": {}},
+	})
+
+	alice := l.bucketFor("alice")
+	if alice == nil || alice.rate != 1000 {
+		t.Fatalf("expected alice to get the default limit, got %+v", alice)
+	}
+	if l.bucketFor("bob") != nil {
+		t.Fatal("expected bob to be unlimited")
+	}
+
+	l.Apply(LimitsResponse{
+		Version: "2",
+		Default: Limit{BytesPerSecond: 1000},
+		Users:   map[string]Limit{"alice": {BytesPerSecond: 100, BurstBytes: 50}},
+	})
+	if l.Version() != "2" {
+		t.Errorf("version %q, want 2", l.Version())
+	}
+	if b := l.bucketFor("alice"); b != alice || b.rate != 100 || b.burst != 50 {
+		t.Errorf("expected alice's bucket to adopt her new limit in place")
+	}
+	if tokens, _ := l.Tokens("alice"); tokens > 50 {
+		t.Errorf("alice has %.0f tokens past her new burst", tokens)
+	}
+
+	// Users that become unlimited lose their bucket
+	l.Apply(LimitsResponse{Version: "3"})
+	if _, ok := l.Tokens("alice"); ok {
+		t.Error("expected alice to be unlimited")
+	}
+}
+
+func TestAllowDropsUDP(t *testing.T) {
+	l := NewLimiter("", "")
+	l.Apply(LimitsResponse{Default: Limit{BytesPerSecond: 1000}})
+
+	if !l.Allow("alice", 600) {
+		t.Fatal("datagram within the burst was dropped")
+	}
+	if l.Allow("alice", 600) {
+		t.Fatal("datagram over the limit was allowed")
+	}
+	if tokens, _ := l.Tokens("alice"); tokens < 0 {
+		t.Errorf("a dropped datagram left alice %.0f tokens in debt", tokens)
+	}
+	if !l.Allow("alice", 300) {
+		t.Error("datagram within the remaining tokens was dropped")
+	}
+}
+
+func TestExpireIdleBuckets(t *testing.T) {
+	l := NewLimiter("", "")
+	l.Apply(LimitsResponse{Default: Limit{BytesPerSecond: 1000}})
+
+	idle := l.bucketFor("alice")
+	l.bucketFor("bob")
+	idle.lastUsed = time.Now().Add(-idleBucketTTL - time.Minute)
+
+	l.expireIdleBuckets()
+	if _, ok := l.buckets["alice"]; ok {
+		t.Error("expected alice's idle bucket to be dropped")
+	}
+	if _, ok := l.buckets["bob"]; !ok {
+		t.Error("expected bob's bucket to be kept")
+	}
+
+	// An expired user gets a full bucket on their next use
+	if tokens, ok := l.Tokens("alice"); !ok || tokens != 1000 {
+		t.Errorf("alice has %.0f tokens after expiry, want a full bucket", tokens)
+	}
+}
+
+func TestStartFetchesLimits(t *testing.T) {
+	manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/headend/rate-limits" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(LimitsResponse{
+			Version: "abc",
+			Users:   map[string]Limit{"alice": {BytesPerSecond: 1000}},
+		})
+	}))
+	defer manager.Close()
+
+	l := NewLimiter(manager.URL, "token")
+	if err := l.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer l.Stop()
+
+	if l.Version() != "abc" {
+		t.Errorf("version %q, want abc", l.Version())
+	}
+	if _, ok := l.Tokens("alice"); !ok {
+		t.Error("expected alice to be limited")
+	}
+}
+
+func TestLimitedConnWaitEndsWithConn(t *testing.T) {
+	l := NewLimiter("", "")
+	l.Apply(LimitsResponse{Default: Limit{BytesPerSecond: 100}})
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn := l.Conn("alice", client)
+
+	// The first write uses the burst; the next would wait ten seconds
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("write within the burst: %v", err)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 1000)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("throttled write past its deadline returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("throttled write ignored its deadline for %v", elapsed)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 1000))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("throttled write on a closed connection returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("throttled write kept waiting after close")
+	}
+}
+
+func TestLimitedConnDeadlineChangeWakesWait(t *testing.T) {
+	l := NewLimiter("", "")
+	l.Apply(LimitsResponse{Default: Limit{BytesPerSecond: 100}})
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := l.Conn("alice", client)
+	defer conn.Close()
+
+	l.SetTokens("alice", 0)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 1000))
+		errs <- err
+	}()
+
+	// Proxies interrupt a blocked write by moving its deadline
+	time.Sleep(20 * time.Millisecond)
+	conn.SetWriteDeadline(time.Now())
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("interrupted write returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("throttled write ignored the new deadline")
+	}
+}
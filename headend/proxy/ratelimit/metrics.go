@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rateLimitBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_ratelimit_bytes_total",
+		Help: "Total bytes charged to rate-limited users; rate() gives current usage.",
+	}, []string{"user_id"})
+
+	rateLimitBytesPerSecond = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_ratelimit_limit_bytes_per_second",
+		Help: "Configured bandwidth limit of each rate-limited user with recent traffic.",
+	}, []string{"user_id"})
+
+	rateLimitThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_ratelimit_throttled_seconds_total",
+		Help: "Total time traffic was delayed by rate limiting, by user.",
+	}, []string{"user_id"})
+
+	rateLimitDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_ratelimit_dropped_packets_total",
+		Help: "Total UDP datagrams dropped because the user was over their limit.",
+	}, []string{"user_id"})
+
+	egressBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_egress_bytes_total",
+		Help: "Total bytes charged to the headend-wide egress cap, by protocol.",
+	}, []string{"protocol"})
+
+	egressLimitBytesPerSecond = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_egress_limit_bytes_per_second",
+		Help: "Configured headend-wide egress cap.",
+	})
+
+	egressUtilization = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_egress_utilization_ratio",
+		Help: "Fraction of the egress cap used in the last complete second.",
+	})
+
+	egressThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_egress_throttled_seconds_total",
+		Help: "Total time traffic was delayed by the egress cap, by protocol.",
+	}, []string{"protocol"})
+
+	egressDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_egress_dropped_packets_total",
+		Help: "Total UDP datagrams dropped because the egress cap was reached.",
+	}, []string{"protocol"})
+)
+
+// deleteUserMetrics removes the series of a user whose bucket was dropped
+func deleteUserMetrics(userID string) {
+	rateLimitBytes.DeleteLabelValues(userID)
+	rateLimitBytesPerSecond.DeleteLabelValues(userID)
+	rateLimitThrottled.DeleteLabelValues(userID)
+	rateLimitDropped.DeleteLabelValues(userID)
+}
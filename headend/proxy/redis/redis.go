@@ -0,0 +1,140 @@
+// Package redis wraps go-redis with the commands the headend uses to share
+// state with the rest of its fleet.
+//
+// The redis package provides:
+//   - redis:// and rediss:// URLs with a password and database number
+//   - GET, SET with an expiry and DEL over go-redis's connection pool
+//   - SUBSCRIBE that survives dropped connections, telling the caller when
+//     it resubscribed so it can catch up on messages it missed
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout bounds dialing and each command when the context has no
+// earlier deadline
+const DefaultTimeout = 3 * time.Second
+
+// Subscriptions back off between reconnects up to this long
+const maxResubscribeDelay = 30 * time.Second
+
+// Client talks to a single Redis server. It is safe for concurrent use.
+type Client struct {
+	client *goredis.Client
+}
+
+// New parses a redis:// or rediss:// URL, such as
+// redis://:password@cache:6379/2. Nothing is dialed until the first command.
+func New(rawURL string) (*Client, error) {
+	opts, err := goredis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	// go-redis falls back to localhost, which is never what a headend wants
+	if u, _ := url.Parse(rawURL); u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid redis URL: missing host")
+	}
+	if opts.DB < 0 {
+		return nil, fmt.Errorf("invalid redis URL: database %d", opts.DB)
+	}
+
+	opts.DialTimeout = DefaultTimeout
+	opts.ReadTimeout = DefaultTimeout
+	opts.WriteTimeout = DefaultTimeout
+	opts.ContextTimeoutEnabled = true
+	return &Client{client: goredis.NewClient(opts)}, nil
+}
+
+// Addr returns the server's host:port
+func (c *Client) Addr() string {
+	return c.client.Options().Addr
+}
+
+// Get returns the value of key, and false if it doesn't exist
+func (c *Client) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set stores value under key, expiring after ttl unless ttl is zero
+func (c *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+// Del removes keys, returning how many existed
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return c.client.Del(ctx, keys...).Result()
+}
+
+// Ping checks the server is reachable
+func (c *Client) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// Close drops the client's connections; later commands fail
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// Subscribe calls handler with each message published on channel until ctx
+// is done. go-redis reconnects and resubscribes after errors; messages
+// published while disconnected are lost, so handler is also called with nil
+// after each resubscribe for the caller to catch up.
+func (c *Client) Subscribe(ctx context.Context, channel string, handler func(message []byte)) {
+	pubsub := c.client.Subscribe(ctx, channel)
+	defer pubsub.Close()
+	// Receive blocks until a message arrives; closing ends it on cancel
+	stop := context.AfterFunc(ctx, func() { _ = pubsub.Close() })
+	defer stop()
+
+	subscribed := false
+	delay := time.Second
+	for {
+		reply, err := pubsub.Receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("Redis subscription to %s on %s lost, retrying in %s: %v", channel, c.Addr(), delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxResubscribeDelay {
+				delay = maxResubscribeDelay
+			}
+			continue
+		}
+
+		switch reply := reply.(type) {
+		case *goredis.Subscription:
+			if reply.Kind != "subscribe" || reply.Channel != channel {
+				continue
+			}
+			if subscribed {
+				handler(nil)
+			}
+			subscribed = true
+			delay = time.Second
+		case *goredis.Message:
+			if reply.Channel == channel {
+				handler([]byte(reply.Payload))
+			}
+		}
+	}
+}
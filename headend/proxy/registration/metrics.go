@@ -0,0 +1,23 @@
+package registration
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	registrations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_manager_registrations_total",
+		Help: "Total registration attempts with the Manager, by result.",
+	}, []string{"result"})
+
+	heartbeats = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_manager_heartbeats_total",
+		Help: "Total heartbeats sent to the Manager, by result (ok, error or unregistered).",
+	}, []string{"result"})
+
+	managerRegistered = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_manager_registered",
+		Help: "Whether the headend is registered with the Manager (1) or not (0).",
+	})
+)
@@ -0,0 +1,289 @@
+// Package registration announces the SASEWaddle headend to the Manager.
+//
+// The registration package provides:
+//   - Registration at startup, retried until the Manager accepts it
+//   - Periodic heartbeats carrying the headend's current advertisement:
+//     version, enabled features, negotiable capabilities, listeners and
+//     WireGuard public key
+//   - Registering again whenever the Manager answers a heartbeat with 404,
+//     e.g. after its database was reset
+//
+// The advertisement is rebuilt for every heartbeat, so the Manager learns
+// of configuration changes, a drain or a new WireGuard key within one
+// interval instead of assuming what each headend runs.
+package registration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/capabilities"
+	"github.com/tobogganing/libs/version"
+)
+
+// DefaultInterval is how often heartbeats are sent
+const DefaultInterval = 30 * time.Second
+
+// errNotRegistered is returned for heartbeats the Manager doesn't know
+var errNotRegistered = errors.New("headend not registered with the Manager")
+
+// Listener is an address the headend serves on
+type Listener struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+}
+
+// WireGuard describes the headend's WireGuard interface
+type WireGuard struct {
+	Interface  string `json:"interface"`
+	PublicKey  string `json:"public_key"`
+	ListenPort int    `json:"listen_port"`
+	Endpoint   string `json:"endpoint"`
+	Address    string `json:"address"`
+	Network    string `json:"network"`
+	Address6   string `json:"address6,omitempty"`
+	Network6   string `json:"network6,omitempty"`
+}
+
+// Advertisement is what the headend tells the Manager about itself
+type Advertisement struct {
+	HeadendID    string           `json:"headend_id"`
+	ClusterID    string           `json:"cluster_id"`
+	Hostname     string           `json:"hostname"`
+	Version      version.Info     `json:"version"`
+	Features     []string         `json:"features"`
+	Capabilities capabilities.Set `json:"capabilities"`
+	Listeners    []Listener       `json:"listeners"`
+	// DynamicPorts counts the Manager-assigned ports being listened on
+	DynamicPorts   int       `json:"dynamic_ports"`
+	WireGuard      WireGuard `json:"wireguard"`
+	Draining       bool      `json:"draining"`
+	ActiveSessions int       `json:"active_sessions"`
+	// HeartbeatIntervalSeconds tells the Manager when to consider the
+	// headend stale
+	HeartbeatIntervalSeconds int       `json:"heartbeat_interval_seconds"`
+	Timestamp                time.Time `json:"timestamp"`
+}
+
+// Config configures a Client
+type Config struct {
+	ManagerURL string
+	AuthToken  string
+	// Interval between heartbeats, DefaultInterval if zero
+	Interval time.Duration
+	// Describe builds the current advertisement
+	Describe func() Advertisement
+}
+
+// Status reports the registration for health checks
+type Status struct {
+	Registered    bool       `json:"registered"`
+	RegisteredAt  *time.Time `json:"registered_at,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Client registers the headend with the Manager and keeps sending
+// heartbeats. A nil Client does nothing.
+type Client struct {
+	cfg        Config
+	httpClient *http.Client
+
+	mu            sync.Mutex
+	registered    bool
+	registeredAt  time.Time
+	lastHeartbeat time.Time
+	lastErr       error
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a client; Start begins registering
+func New(cfg Config) (*Client, error) {
+	if cfg.ManagerURL == "" {
+		return nil, fmt.Errorf("registration requires a Manager URL")
+	}
+	if cfg.Describe == nil {
+		return nil, fmt.Errorf("registration requires an advertisement")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	return &Client{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		stopChan:   make(chan struct{}),
+	}, nil
+}
+
+// Start registers and sends heartbeats in the background. Failures are
+// retried every interval without holding up startup.
+func (c *Client) Start() {
+	go c.loop()
+}
+
+// Stop stops sending heartbeats
+func (c *Client) Stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() { close(c.stopChan) })
+}
+
+// Status reports whether the headend is registered and when it last got a
+// heartbeat through
+func (c *Client) Status() *Status {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := &Status{Registered: c.registered}
+	if !c.registeredAt.IsZero() {
+		registeredAt := c.registeredAt
+		status.RegisteredAt = &registeredAt
+	}
+	if !c.lastHeartbeat.IsZero() {
+		lastHeartbeat := c.lastHeartbeat
+		status.LastHeartbeat = &lastHeartbeat
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	return status
+}
+
+func (c *Client) loop() {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.beat()
+		select {
+		case <-ticker.C:
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// beat registers if needed, or sends a heartbeat
+func (c *Client) beat() {
+	c.mu.Lock()
+	registered := c.registered
+	c.mu.Unlock()
+
+	if !registered {
+		err := c.register()
+		c.record(err, func(now time.Time) {
+			c.registered = true
+			c.registeredAt = now
+			c.lastHeartbeat = now
+		})
+		if err != nil {
+			registrations.WithLabelValues("error").Inc()
+			return
+		}
+		registrations.WithLabelValues("ok").Inc()
+		log.Infof("Registered with the Manager at %s", c.cfg.ManagerURL)
+		return
+	}
+
+	err := c.heartbeat()
+	c.record(err, func(now time.Time) {
+		c.lastHeartbeat = now
+	})
+	switch {
+	case errors.Is(err, errNotRegistered):
+		heartbeats.WithLabelValues("unregistered").Inc()
+		log.Warn("The Manager doesn't know this headend, registering again")
+		c.mu.Lock()
+		c.registered = false
+		c.mu.Unlock()
+		managerRegistered.Set(0)
+		c.beat()
+	case err != nil:
+		heartbeats.WithLabelValues("error").Inc()
+	default:
+		heartbeats.WithLabelValues("ok").Inc()
+	}
+}
+
+// record updates the status after an attempt, logging the first of a run
+// of failures and the recovery from it
+func (c *Client) record(err error, succeeded func(now time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.lastErr
+	c.lastErr = err
+	if err != nil {
+		if previous == nil && !errors.Is(err, errNotRegistered) {
+			log.Warnf("Failed to reach the Manager for registration: %v", err)
+		}
+		return
+	}
+	if previous != nil && !errors.Is(previous, errNotRegistered) {
+		log.Info("Reaching the Manager for registration again")
+	}
+	succeeded(time.Now())
+	managerRegistered.Set(1)
+}
+
+func (c *Client) register() error {
+	return c.send(func(Advertisement) string { return "/api/v1/headend/register" })
+}
+
+func (c *Client) heartbeat() error {
+	return c.send(func(advertisement Advertisement) string {
+		return "/api/v1/headend/" + url.PathEscape(advertisement.HeadendID) + "/heartbeat"
+	})
+}
+
+// send posts the current advertisement to the path pathOf gives for it
+func (c *Client) send(pathOf func(Advertisement) string) error {
+	advertisement := c.cfg.Describe()
+	advertisement.HeartbeatIntervalSeconds = int(c.cfg.Interval / time.Second)
+	advertisement.Timestamp = time.Now().UTC()
+	body, err := json.Marshal(advertisement)
+	if err != nil {
+		return fmt.Errorf("failed to encode advertisement: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.cfg.ManagerURL+pathOf(advertisement), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.cfg.AuthToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SASEWaddle-Headend/1.0")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %v", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNotRegistered
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d, body: %s", resp.StatusCode, string(body))
+	}
+}
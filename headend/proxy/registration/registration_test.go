@@ -0,0 +1,132 @@
+package registration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeManager records the requests it gets and forgets registrations on
+// demand
+type fakeManager struct {
+	mu       sync.Mutex
+	paths    []string
+	known    map[string]bool
+	received []Advertisement
+}
+
+func (m *fakeManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var advertisement Advertisement
+	if err := json.NewDecoder(r.Body).Decode(&advertisement); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths = append(m.paths, r.URL.Path)
+	m.received = append(m.received, advertisement)
+	switch r.URL.Path {
+	case "/api/v1/headend/register":
+		m.known[advertisement.HeadendID] = true
+	case "/api/v1/headend/" + advertisement.HeadendID + "/heartbeat":
+		if !m.known[advertisement.HeadendID] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+func newClient(t *testing.T, url, token string) *Client {
+	t.Helper()
+	client, err := New(Config{
+		ManagerURL: url,
+		AuthToken:  token,
+		Interval:   time.Minute,
+		Describe: func() Advertisement {
+			return Advertisement{
+				HeadendID: "headend-1",
+				ClusterID: "cluster-a",
+				Features:  []string{"firewall"},
+				Listeners: []Listener{{Name: "tcp", Protocol: "tcp", Address: "vpn.example.com:8443"}},
+				WireGuard: WireGuard{PublicKey: "key-1"},
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRegistersThenSendsHeartbeats(t *testing.T) {
+	manager := &fakeManager{known: map[string]bool{}}
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	client := newClient(t, server.URL, "token")
+	client.beat()
+	client.beat()
+
+	want := []string{"/api/v1/headend/register", "/api/v1/headend/headend-1/heartbeat"}
+	if len(manager.paths) != len(want) || manager.paths[0] != want[0] || manager.paths[1] != want[1] {
+		t.Fatalf("got requests %v, want %v", manager.paths, want)
+	}
+	advertisement := manager.received[1]
+	if advertisement.WireGuard.PublicKey != "key-1" || len(advertisement.Listeners) != 1 ||
+		advertisement.HeartbeatIntervalSeconds != 60 || advertisement.Timestamp.IsZero() {
+		t.Errorf("unexpected advertisement %+v", advertisement)
+	}
+	if status := client.Status(); !status.Registered || status.LastHeartbeat == nil || status.LastError != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// A Manager that lost the registration gets it again
+	manager.mu.Lock()
+	manager.known = map[string]bool{}
+	manager.paths = nil
+	manager.mu.Unlock()
+	client.beat()
+	want = []string{"/api/v1/headend/headend-1/heartbeat", "/api/v1/headend/register"}
+	if len(manager.paths) != len(want) || manager.paths[0] != want[0] || manager.paths[1] != want[1] {
+		t.Errorf("got requests %v, want %v", manager.paths, want)
+	}
+	if !client.Status().Registered {
+		t.Error("expected the headend registered again")
+	}
+}
+
+func TestRegistrationFailures(t *testing.T) {
+	server := httptest.NewServer(&fakeManager{known: map[string]bool{}})
+	defer server.Close()
+
+	client := newClient(t, server.URL, "wrong")
+	client.beat()
+	if status := client.Status(); status.Registered || status.LastError == "" {
+		t.Errorf("expected a rejected registration, got %+v", status)
+	}
+
+	if _, err := New(Config{Describe: func() Advertisement { return Advertisement{} }}); err == nil {
+		t.Error("expected a Manager URL required")
+	}
+	if _, err := New(Config{ManagerURL: server.URL}); err == nil {
+		t.Error("expected an advertisement required")
+	}
+
+	var nilClient *Client
+	nilClient.Stop()
+	if nilClient.Status() != nil {
+		t.Error("expected no status from a nil client")
+	}
+}
@@ -0,0 +1,11 @@
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var killedSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "headend_admin_sessions_killed_total",
+	Help: "Total sessions closed through the admin API, by kind.",
+}, []string{"kind"})
@@ -0,0 +1,167 @@
+// Package registry keeps the active sessions of the SASEWaddle headend
+// proxy for the admin API.
+//
+// The registry package provides:
+//   - A listing of active TCP, dynamic port and UDP sessions with their user,
+//     source and target
+//   - Closing a single session, or every session of a user, on demand
+//
+// Sessions register themselves once they are authorized and remove
+// themselves when they end; the registry never closes connections itself
+// except through the kill function a session registers with.
+package registry
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session describes an active proxied session
+type Session struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	UserID    string    `json:"user_id"`
+	SourceIP  string    `json:"source_ip"`
+	Target    string    `json:"target"`
+	Protocol  string    `json:"protocol"`
+	Port      int       `json:"port,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type entry struct {
+	seq     uint64
+	session Session
+	kill    func()
+}
+
+// Registry is the set of active sessions. A nil Registry tracks nothing.
+type Registry struct {
+	sessions map[string]*entry
+	nextID   uint64
+	mu       sync.Mutex
+}
+
+// New creates an empty registry
+func New() *Registry {
+	return &Registry{sessions: make(map[string]*entry)}
+}
+
+// Add registers session, which kill closes, and returns a function that
+// removes it again once it ends. The session's ID and start time are
+// assigned here.
+func (r *Registry) Add(session Session, kill func()) (remove func()) {
+	if r == nil {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	r.nextID++
+	session.ID = strconv.FormatUint(r.nextID, 10)
+	session.StartedAt = time.Now().UTC()
+	r.sessions[session.ID] = &entry{seq: r.nextID, session: session, kill: kill}
+	r.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.sessions, session.ID)
+			r.mu.Unlock()
+		})
+	}
+}
+
+// List returns the active sessions, oldest first. A non-empty userID
+// selects the sessions of that user.
+func (r *Registry) List(userID string) []Session {
+	sessions := []Session{}
+	if r == nil {
+		return sessions
+	}
+
+	r.mu.Lock()
+	entries := make([]*entry, 0, len(r.sessions))
+	for _, e := range r.sessions {
+		if userID == "" || e.session.UserID == userID {
+			entries = append(entries, e)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	for _, e := range entries {
+		sessions = append(sessions, e.session)
+	}
+	return sessions
+}
+
+// ByRequest returns the active session with requestID, the ID its
+// connection was logged and mirrored under
+func (r *Registry) ByRequest(requestID string) (Session, bool) {
+	if r == nil || requestID == "" {
+		return Session{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.sessions {
+		if e.session.RequestID == requestID {
+			return e.session, true
+		}
+	}
+	return Session{}, false
+}
+
+// Len returns the number of active sessions
+func (r *Registry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Kill closes the session with id. It returns false if there is no such
+// session. The session stays listed until it has wound down.
+func (r *Registry) Kill(id string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	e, ok := r.sessions[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	killedSessions.WithLabelValues(e.session.Kind).Inc()
+	e.kill()
+	return true
+}
+
+// KillUser closes every session of userID and returns how many it closed
+func (r *Registry) KillUser(userID string) int {
+	if r == nil {
+		return 0
+	}
+
+	var victims []*entry
+	r.mu.Lock()
+	for _, e := range r.sessions {
+		if e.session.UserID == userID {
+			victims = append(victims, e)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, e := range victims {
+		killedSessions.WithLabelValues(e.session.Kind).Inc()
+		e.kill()
+	}
+	return len(victims)
+}
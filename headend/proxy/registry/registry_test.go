@@ -0,0 +1,63 @@
+package registry
+
+import "testing"
+
+func TestAddListRemove(t *testing.T) {
+	r := New()
+	removeA := r.Add(Session{Kind: "tcp", UserID: "alice", Target: "a.example.com:443", RequestID: "r1"}, func() {})
+	r.Add(Session{Kind: "udp", UserID: "bob", Target: "b.example.com:53"}, func() {})
+
+	sessions := r.List("")
+	if len(sessions) != 2 || sessions[0].Target != "a.example.com:443" {
+		t.Fatalf("expected both sessions oldest first, got %+v", sessions)
+	}
+	if sessions[0].ID == "" || sessions[0].ID == sessions[1].ID {
+		t.Errorf("expected distinct session IDs, got %q and %q", sessions[0].ID, sessions[1].ID)
+	}
+	if bob := r.List("bob"); len(bob) != 1 || bob[0].Kind != "udp" {
+		t.Errorf("expected bob's UDP session, got %+v", bob)
+	}
+
+	if session, ok := r.ByRequest("r1"); !ok || session.UserID != "alice" {
+		t.Errorf("expected alice's session for request r1, got %+v", session)
+	}
+
+	removeA()
+	removeA()
+	if _, ok := r.ByRequest("r1"); ok {
+		t.Error("expected no session for request r1 after removal")
+	}
+	if r.Len() != 1 {
+		t.Errorf("expected 1 session after removal, got %d", r.Len())
+	}
+}
+
+func TestKill(t *testing.T) {
+	r := New()
+	killed := map[string]int{}
+	kill := func(name string) func() { return func() { killed[name]++ } }
+
+	r.Add(Session{Kind: "tcp", UserID: "alice"}, kill("a1"))
+	r.Add(Session{Kind: "dynamic", UserID: "alice"}, kill("a2"))
+	r.Add(Session{Kind: "tcp", UserID: "bob"}, kill("b1"))
+
+	bob := r.List("bob")[0]
+	if !r.Kill(bob.ID) || killed["b1"] != 1 {
+		t.Errorf("expected bob's session to be killed, got %v", killed)
+	}
+	if r.Kill("missing") {
+		t.Error("expected killing an unknown session to fail")
+	}
+
+	if n := r.KillUser("alice"); n != 2 || killed["a1"] != 1 || killed["a2"] != 1 {
+		t.Errorf("expected both of alice's sessions killed, got %d: %v", n, killed)
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	r.Add(Session{UserID: "alice"}, func() {})()
+	if len(r.List("")) != 0 || r.Len() != 0 || r.Kill("1") || r.KillUser("alice") != 0 {
+		t.Error("expected a nil registry to track nothing")
+	}
+}
@@ -0,0 +1,18 @@
+package routing
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	routedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_egress_route_connections_total",
+		Help: "Total upstream connections sent out an egress route, by route and what selected it (destination or tag).",
+	}, []string{"route", "match"})
+
+	routesInstalled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_egress_route_installed",
+		Help: "Whether the routing table and ip rule of an egress route are installed.",
+	}, []string{"route"})
+)
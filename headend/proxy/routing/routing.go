@@ -0,0 +1,294 @@
+// Package routing sends upstream connections of the SASEWaddle headend out
+// egress interfaces other than the default route.
+//
+// The routing package provides:
+//   - Egress routes selecting connections by destination network or by the
+//     tags of the firewall rule that allowed them
+//   - A firewall mark (fwmark) per route, set on the upstream socket, and a
+//     Linux routing table per route holding a default route out its
+//     interface, e.g. a secondary WireGuard tunnel to a partner network
+//   - Installing and removing the ip rules and routes of those tables
+//
+// Destination routes apply to every upstream connection, including pooled
+// and HTTP ones, since the mark is chosen when the socket connects to the
+// resolved address. Tag routes apply to the connections the WireGuard
+// router proxies once the firewall has matched a tagged rule.
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RulePriority is the priority of the ip rules looking up route tables,
+// ahead of the main table's 32766
+const RulePriority = 1000
+
+// Route sends matching upstream connections out Interface
+type Route struct {
+	Name string `mapstructure:"name" json:"name"`
+	// Destinations are the networks routed, e.g. 10.50.0.0/16
+	Destinations []string `mapstructure:"destinations" json:"destinations,omitempty"`
+	// Tags route connections allowed by a firewall rule with one of them
+	Tags      []string `mapstructure:"tags" json:"tags,omitempty"`
+	Interface string   `mapstructure:"interface" json:"interface"`
+	// Gateway is the next hop, none for point-to-point interfaces such as
+	// WireGuard tunnels
+	Gateway string `mapstructure:"gateway" json:"gateway,omitempty"`
+	// Table is the Linux routing table of the route, 1-252
+	Table int    `mapstructure:"table" json:"table"`
+	Mark  uint32 `mapstructure:"mark" json:"mark"`
+}
+
+// RouteStatus reports whether a route's table is installed
+type RouteStatus struct {
+	Route
+	Installed bool   `json:"installed"`
+	Error     string `json:"error,omitempty"`
+}
+
+type route struct {
+	Route
+	prefixes []netip.Prefix
+	gateway  netip.Addr
+	// families are the IP families ("-4", "-6") the route's table serves
+	families  []string
+	installed bool
+	err       error
+}
+
+// Table selects the egress route of upstream connections
+type Table struct {
+	routes []*route
+	// run runs an ip command; replaced in tests
+	run func(args ...string) error
+	mu  sync.Mutex
+}
+
+// New validates routes, which are tried in order
+func New(routes []Route) (*Table, error) {
+	t := &Table{run: runIP}
+	names := make(map[string]bool)
+	marks := make(map[uint32]bool)
+	tables := make(map[int]bool)
+	for _, cfg := range routes {
+		r, err := compile(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if names[cfg.Name] || marks[cfg.Mark] || tables[cfg.Table] {
+			return nil, fmt.Errorf("egress route %s: name, mark and table must be unique", cfg.Name)
+		}
+		names[cfg.Name], marks[cfg.Mark], tables[cfg.Table] = true, true, true
+		t.routes = append(t.routes, r)
+	}
+	return t, nil
+}
+
+func compile(cfg Route) (*route, error) {
+	switch {
+	case cfg.Name == "":
+		return nil, errors.New("egress route without a name")
+	case cfg.Interface == "":
+		return nil, fmt.Errorf("egress route %s: no interface", cfg.Name)
+	case cfg.Mark == 0:
+		return nil, fmt.Errorf("egress route %s: no mark", cfg.Name)
+	case cfg.Table < 1 || cfg.Table > 252:
+		return nil, fmt.Errorf("egress route %s: table must be between 1 and 252", cfg.Name)
+	case len(cfg.Destinations) == 0 && len(cfg.Tags) == 0:
+		return nil, fmt.Errorf("egress route %s: no destinations or tags", cfg.Name)
+	}
+
+	r := &route{Route: cfg}
+	for _, destination := range cfg.Destinations {
+		prefix, err := netip.ParsePrefix(destination)
+		if err != nil {
+			return nil, fmt.Errorf("egress route %s: %w", cfg.Name, err)
+		}
+		r.prefixes = append(r.prefixes, prefix.Masked())
+	}
+	if cfg.Gateway != "" {
+		gateway, err := netip.ParseAddr(cfg.Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("egress route %s: invalid gateway: %w", cfg.Name, err)
+		}
+		r.gateway = gateway
+	}
+
+	// A gateway reaches one family; an interface route serves the families
+	// of the destinations, or both for tag routes
+	switch {
+	case r.gateway.IsValid() && r.gateway.Is4():
+		r.families = []string{"-4"}
+	case r.gateway.IsValid():
+		r.families = []string{"-6"}
+	case len(r.prefixes) > 0 && len(cfg.Tags) == 0:
+		for _, prefix := range r.prefixes {
+			family := "-6"
+			if prefix.Addr().Is4() {
+				family = "-4"
+			}
+			if !slices.Contains(r.families, family) {
+				r.families = append(r.families, family)
+			}
+		}
+	default:
+		r.families = []string{"-4", "-6"}
+	}
+	for _, prefix := range r.prefixes {
+		if r.gateway.IsValid() && prefix.Addr().Is4() != r.gateway.Is4() {
+			return nil, fmt.Errorf("egress route %s: %s is not in the gateway's family", cfg.Name, prefix)
+		}
+	}
+	return r, nil
+}
+
+// Len returns the number of routes. It is nil-safe.
+func (t *Table) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.routes)
+}
+
+// Install adds each route's table and the ip rule looking it up for its
+// mark. Routes that fail, e.g. because their interface is down, are
+// reported and skipped.
+func (t *Table) Install() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var errs []error
+	for _, r := range t.routes {
+		r.err = t.install(r)
+		r.installed = r.err == nil
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("egress route %s: %w", r.Name, r.err))
+			routesInstalled.WithLabelValues(r.Name).Set(0)
+			continue
+		}
+		routesInstalled.WithLabelValues(r.Name).Set(1)
+		log.Infof("Egress route %s: mark %d looks up table %d out %s", r.Name, r.Mark, r.Table, r.Interface)
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Table) install(r *route) error {
+	mark, table := strconv.FormatUint(uint64(r.Mark), 10), strconv.Itoa(r.Table)
+	for _, family := range r.families {
+		// Replacing the rule keeps restarts from stacking duplicates
+		_ = t.run(family, "rule", "del", "fwmark", mark, "lookup", table)
+		if err := t.run(family, "rule", "add", "fwmark", mark, "lookup", table, "priority", strconv.Itoa(RulePriority)); err != nil {
+			return err
+		}
+
+		args := []string{family, "route", "replace", "default", "dev", r.Interface}
+		if r.gateway.IsValid() {
+			args = append(args, "via", r.gateway.String())
+		}
+		if err := t.run(append(args, "table", table)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the installed rules and tables. It is nil-safe.
+func (t *Table) Remove() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range t.routes {
+		if !r.installed {
+			continue
+		}
+		mark, table := strconv.FormatUint(uint64(r.Mark), 10), strconv.Itoa(r.Table)
+		for _, family := range r.families {
+			if err := t.run(family, "rule", "del", "fwmark", mark, "lookup", table); err != nil {
+				log.Debugf("Failed to remove the rule of egress route %s: %v", r.Name, err)
+			}
+			if err := t.run(family, "route", "flush", "table", table); err != nil {
+				log.Debugf("Failed to flush the table of egress route %s: %v", r.Name, err)
+			}
+		}
+		r.installed = false
+		routesInstalled.WithLabelValues(r.Name).Set(0)
+	}
+}
+
+// MarkFor returns the mark of the most specific destination route holding
+// address, or zero. It is nil-safe and a connctx.MarkSelector.
+func (t *Table) MarkFor(address netip.Addr) uint32 {
+	if t == nil {
+		return 0
+	}
+	var best *route
+	bits := -1
+	for _, r := range t.routes {
+		for _, prefix := range r.prefixes {
+			if prefix.Bits() > bits && prefix.Contains(address) {
+				best, bits = r, prefix.Bits()
+			}
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	routedConnections.WithLabelValues(best.Name, "destination").Inc()
+	return best.Mark
+}
+
+// ForTags returns the first route with one of tags, or nil. It is
+// nil-safe.
+func (t *Table) ForTags(tags []string) *Route {
+	if t == nil || len(tags) == 0 {
+		return nil
+	}
+	for _, r := range t.routes {
+		for _, tag := range r.Tags {
+			if slices.Contains(tags, tag) {
+				routedConnections.WithLabelValues(r.Name, "tag").Inc()
+				return &r.Route
+			}
+		}
+	}
+	return nil
+}
+
+// Status reports each route. It is nil-safe.
+func (t *Table) Status() []RouteStatus {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]RouteStatus, 0, len(t.routes))
+	for _, r := range t.routes {
+		status := RouteStatus{Route: r.Route, Installed: r.installed}
+		if r.err != nil {
+			status.Error = r.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// runIP runs the ip command with args
+func runIP(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %v: %v, output: %s", args, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package routing
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var partner = Route{
+	Name:         "partner",
+	Destinations: []string{"10.50.0.0/16", "10.50.7.0/24"},
+	Tags:         []string{"partner"},
+	Interface:    "wg-partner",
+	Table:        200,
+	Mark:         200,
+}
+
+var backup = Route{
+	Name:         "backup",
+	Destinations: []string{"10.50.7.0/25", "203.0.113.0/24"},
+	Interface:    "eth1",
+	Gateway:      "192.0.2.1",
+	Table:        201,
+	Mark:         201,
+}
+
+func TestSelection(t *testing.T) {
+	table, err := New([]Route{partner, backup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, want := range map[string]uint32{
+		"10.50.1.1":    200,
+		"10.50.7.200":  200,
+		"10.50.7.5":    201, // the most specific network wins
+		"203.0.113.9":  201,
+		"198.51.100.1": 0,
+	} {
+		if got := table.MarkFor(netip.MustParseAddr(address)); got != want {
+			t.Errorf("MarkFor(%s) = %d, want %d", address, got, want)
+		}
+	}
+
+	if route := table.ForTags([]string{"finance", "partner"}); route == nil || route.Name != "partner" {
+		t.Errorf("expected the partner route, got %+v", route)
+	}
+	if route := table.ForTags([]string{"finance"}); route != nil {
+		t.Errorf("expected no route, got %+v", route)
+	}
+
+	var none *Table
+	if none.MarkFor(netip.MustParseAddr("10.50.1.1")) != 0 || none.ForTags([]string{"partner"}) != nil || none.Len() != 0 {
+		t.Error("expected a nil table to route nothing")
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	for name, route := range map[string]Route{
+		"no name":      {Interface: "eth1", Table: 10, Mark: 10, Tags: []string{"a"}},
+		"no interface": {Name: "a", Table: 10, Mark: 10, Tags: []string{"a"}},
+		"no mark":      {Name: "a", Interface: "eth1", Table: 10, Tags: []string{"a"}},
+		"main table":   {Name: "a", Interface: "eth1", Table: 254, Mark: 10, Tags: []string{"a"}},
+		"no selector":  {Name: "a", Interface: "eth1", Table: 10, Mark: 10},
+		"bad network":  {Name: "a", Interface: "eth1", Table: 10, Mark: 10, Destinations: []string{"10.0.0.1"}},
+		"bad family":   {Name: "a", Interface: "eth1", Table: 10, Mark: 10, Gateway: "192.0.2.1", Destinations: []string{"2001:db8::/32"}},
+	} {
+		if _, err := New([]Route{route}); err == nil {
+			t.Errorf("%s: expected the route rejected", name)
+		}
+	}
+
+	duplicate := backup
+	duplicate.Name = "other"
+	if _, err := New([]Route{backup, duplicate}); err == nil {
+		t.Error("expected routes sharing a table rejected")
+	}
+}
+
+func TestInstall(t *testing.T) {
+	table, err := New([]Route{partner, backup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	table.run = func(args ...string) error {
+		command := strings.Join(args, " ")
+		commands = append(commands, command)
+		if strings.Contains(command, "dev eth1") {
+			return errors.New("Cannot find device \"eth1\"")
+		}
+		return nil
+	}
+
+	if err := table.Install(); err == nil || !strings.Contains(err.Error(), "backup") {
+		t.Fatalf("expected the backup route to fail, got %v", err)
+	}
+	want := []string{
+		"-4 rule del fwmark 200 lookup 200",
+		"-4 rule add fwmark 200 lookup 200 priority 1000",
+		"-4 route replace default dev wg-partner table 200",
+		"-6 rule del fwmark 200 lookup 200",
+		"-6 rule add fwmark 200 lookup 200 priority 1000",
+		"-6 route replace default dev wg-partner table 200",
+		"-4 rule del fwmark 201 lookup 201",
+		"-4 rule add fwmark 201 lookup 201 priority 1000",
+		"-4 route replace default dev eth1 via 192.0.2.1 table 201",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("got commands\n%s\nwant\n%s", strings.Join(commands, "\n"), strings.Join(want, "\n"))
+	}
+
+	status := table.Status()
+	if !status[0].Installed || status[1].Installed || status[1].Error == "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Only the installed route is removed
+	commands = nil
+	table.Remove()
+	want = []string{
+		"-4 rule del fwmark 200 lookup 200",
+		"-4 route flush table 200",
+		"-6 rule del fwmark 200 lookup 200",
+		"-6 route flush table 200",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("got commands\n%s\nwant\n%s", strings.Join(commands, "\n"), strings.Join(want, "\n"))
+	}
+}
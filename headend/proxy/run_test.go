@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+func TestRunReturnsAfterShutdown(t *testing.T) {
+	s, _ := newTestServer(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	s.router.GET("/slow", func(c *gin.Context) {
+		close(entered)
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	viper.Set("server.http_port", port)
+	viper.Set("server.drain_timeout", time.Second)
+	t.Cleanup(viper.Reset)
+
+	signals := make(chan chan<- os.Signal, 1)
+	notify := notifyShutdown
+	notifyShutdown = func(c chan<- os.Signal) { signals <- c }
+	t.Cleanup(func() { notifyShutdown = notify })
+
+	result := make(chan error, 1)
+	go func() { result <- s.Run() }()
+	shutdown := <-signals
+
+	// Wait for the server to listen, then hold a request open across the
+	// shutdown
+	responses := make(chan *http.Response, 1)
+	go func() {
+		for {
+			resp, err := http.Get("http://127.0.0.1:" + port + "/slow")
+			if err == nil {
+				responses <- resp
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never answered")
+	}
+
+	shutdown <- syscall.SIGTERM
+	select {
+	case err := <-result:
+		t.Fatalf("Run returned %v with a request in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	resp := <-responses
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "done" {
+		t.Errorf("in-flight request got %d %q, want it finished", resp.StatusCode, body)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Run returned %v after shutdown, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+	if !s.sessions.Draining() {
+		t.Error("shutdown did not drain the sessions first")
+	}
+}
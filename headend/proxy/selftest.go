@@ -0,0 +1,286 @@
+// Self-test for headend startup verification.
+//
+// `headend-proxy selftest` checks an image and its configuration without
+// starting the proxy: it validates the config, checks the Manager is
+// reachable, binds each listener type on an ephemeral port and pushes a
+// request through the TCP proxy pipeline to a loopback echo target using a
+// token signed by a throwaway key. Each subsystem is reported as PASS, FAIL
+// or SKIP and the exit status is non-zero if anything failed, so CI/CD can
+// gate images and configs on it.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+	"github.com/tobogganing/headend/proxy/auth"
+	"github.com/tobogganing/headend/proxy/drain"
+	"github.com/tobogganing/headend/proxy/events"
+	"github.com/tobogganing/headend/proxy/probe"
+	"github.com/tobogganing/headend/proxy/transport"
+	"github.com/tobogganing/libs/framing"
+)
+
+// selfTestTimeout bounds each network step of the self-test
+const selfTestTimeout = 10 * time.Second
+
+// errSkipped marks a check that was deliberately not run
+var errSkipped = fmt.Errorf("skipped")
+
+type selfTestCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// runSelfTest runs every check, prints one line per subsystem and returns
+// the process exit code
+func runSelfTest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	offline := flags.Bool("offline", false, "skip checks that need the Manager")
+	_ = flags.Parse(args)
+
+	checks := []selfTestCheck{
+		{"config", selfTestConfig},
+		{"manager", func() (string, error) {
+			if *offline {
+				return "", errSkipped
+			}
+			return selfTestManager()
+		}},
+		{"listeners", selfTestListeners},
+		{"proxy", selfTestLoopbackProxy},
+	}
+
+	failed := 0
+	for _, check := range checks {
+		detail, err := check.run()
+		switch {
+		case err == errSkipped:
+			fmt.Printf("SKIP  %-10s\n", check.name)
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL  %-10s %v\n", check.name, err)
+		default:
+			fmt.Printf("PASS  %-10s %s\n", check.name, detail)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("Self-test failed: %d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Println("Self-test passed")
+	return 0
+}
+
+// selfTestConfig validates the settings Initialize would otherwise only
+// trip over at startup
+func selfTestConfig() (string, error) {
+	authType := viper.GetString("auth.type")
+	registered := false
+	for _, name := range auth.Registered() {
+		registered = registered || name == authType
+	}
+	if !registered {
+		return "", fmt.Errorf("unsupported auth type: %s (available: %v)", authType, auth.Registered())
+	}
+
+	portKeys := []string{"server.http_port", "server.tcp_port", "server.udp_port", "server.metrics_port"}
+	if viper.GetBool("server.socks_enabled") {
+		portKeys = append(portKeys, "server.socks_port")
+	}
+	for _, key := range portKeys {
+		port, err := strconv.Atoi(viper.GetString(key))
+		if err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("%s is not a valid port: %q", key, viper.GetString(key))
+		}
+	}
+
+	durationKeys := []string{
+		"server.drain_timeout",
+		"server.tcp.idle_timeout",
+		"server.tcp.max_lifetime",
+		"proxy.transport.idle_conn_timeout",
+		"firewall.local_policy_ttl",
+		"events.webhook_flush_interval",
+		"decisions.flush_interval",
+		"ports.refresh_interval",
+	}
+	for _, key := range durationKeys {
+		if _, err := time.ParseDuration(viper.GetString(key)); err != nil {
+			return "", fmt.Errorf("%s is not a valid duration: %w", key, err)
+		}
+	}
+
+	var transportClasses []transport.Class
+	if err := viper.UnmarshalKey("proxy.transport.classes", &transportClasses); err != nil {
+		return "", fmt.Errorf("failed to parse transport classes: %w", err)
+	}
+	if _, err := transport.NewPool(transport.Settings{}, transportClasses); err != nil {
+		return "", fmt.Errorf("invalid transport classes: %w", err)
+	}
+
+	if viper.GetBool("probes.enabled") {
+		var checks []probe.Check
+		if err := viper.UnmarshalKey("probes.checks", &checks); err != nil {
+			return "", fmt.Errorf("failed to parse probe checks: %w", err)
+		}
+		if _, err := probe.NewProber(checks, nil); err != nil {
+			return "", err
+		}
+	}
+
+	certFile := viper.GetString("server.cert_file")
+	keyFile := viper.GetString("server.key_file")
+	if certFile != "" && keyFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return "", fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	}
+
+	if viper.GetBool("server.mtls.enabled") {
+		if certFile == "" || keyFile == "" {
+			return "", fmt.Errorf("mTLS requires server.cert_file and server.key_file")
+		}
+		if _, err := auth.LoadClientCAPool(viper.GetString("server.mtls.client_ca_file")); err != nil {
+			return "", err
+		}
+	}
+
+	source := "environment and defaults"
+	if viper.ConfigFileUsed() != "" {
+		source = viper.ConfigFileUsed()
+	}
+	return "loaded from " + source, nil
+}
+
+// selfTestManager checks the Manager answers its health endpoint and, for
+// JWT auth, serves a usable public key
+func selfTestManager() (string, error) {
+	managerURL := strings.TrimSuffix(viper.GetString("auth.manager_url"), "/")
+	client := &http.Client{Timeout: selfTestTimeout}
+
+	resp, err := client.Get(managerURL + "/health")
+	if err != nil {
+		return "", fmt.Errorf("manager unreachable: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("manager health returned status %d", resp.StatusCode)
+	}
+
+	if viper.GetString("auth.type") == "jwt" {
+		if _, err := auth.New("jwt", authSettings{}); err != nil {
+			return "", err
+		}
+		return managerURL + " healthy, signing keys valid", nil
+	}
+	return managerURL + " healthy", nil
+}
+
+// selfTestListeners binds every listener type the headend uses
+func selfTestListeners() (string, error) {
+	bound := []string{}
+
+	for _, name := range []string{"http", "tcp", "socks"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", fmt.Errorf("failed to bind %s listener: %w", name, err)
+		}
+		bound = append(bound, name+"="+listener.Addr().String())
+		_ = listener.Close()
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return "", fmt.Errorf("failed to bind udp listener: %w", err)
+	}
+	bound = append(bound, "udp="+conn.LocalAddr().String())
+	_ = conn.Close()
+
+	return strings.Join(bound, " "), nil
+}
+
+// selfTestLoopbackProxy sends a framed, authenticated connection through a
+// TCPProxy on an ephemeral port to a loopback echo target and checks the
+// payload comes back unchanged
+func selfTestLoopbackProxy() (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate test key: %w", err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":       "selftest",
+		"type":      "access",
+		"node_type": "selftest",
+		"exp":       time.Now().Add(time.Minute).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign test token: %w", err)
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to bind echo target: %w", err)
+	}
+	defer func() { _ = echo.Close() }()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to bind TCP proxy: %w", err)
+	}
+	tcpProxy := &TCPProxy{
+		listener:     listener,
+		authProvider: auth.NewJWTProviderWithKey(&key.PublicKey),
+		eventBus:     events.NewBus(0),
+		sessions:     drain.NewTracker(),
+	}
+	go tcpProxy.Start()
+	defer func() { _ = listener.Close() }()
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), selfTestTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to TCP proxy: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	payload := []byte("sasewaddle-headend-selftest")
+	if err := framing.WriteHeader(conn, token, echo.Addr().String()); err != nil {
+		return "", fmt.Errorf("failed to send connection header: %w", err)
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return "", fmt.Errorf("failed to send payload: %w", err)
+	}
+
+	reply := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", fmt.Errorf("no reply through proxy: %w", err)
+	}
+	if !bytes.Equal(reply, payload) {
+		return "", fmt.Errorf("proxied payload corrupted: got %q", reply)
+	}
+
+	return fmt.Sprintf("loopback round trip in %s", time.Since(start).Round(time.Millisecond)), nil
+}
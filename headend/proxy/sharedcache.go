@@ -0,0 +1,18 @@
+//go:build !minimal
+
+package main
+
+import (
+	"github.com/tobogganing/headend/proxy/firewall"
+	"github.com/tobogganing/headend/proxy/redis"
+)
+
+// newSharedCache connects to the Redis server at rawURL for the firewall's
+// fleet-wide rule cache, returning it and the server's address
+func newSharedCache(rawURL string) (firewall.SharedCache, string, error) {
+	cache, err := redis.New(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return cache, cache.Addr(), nil
+}
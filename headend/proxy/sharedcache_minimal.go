@@ -0,0 +1,15 @@
+//go:build minimal
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tobogganing/headend/proxy/firewall"
+)
+
+// newSharedCache fails in the minimal build, which leaves the Redis client
+// out
+func newSharedCache(rawURL string) (firewall.SharedCache, string, error) {
+	return nil, "", errors.New("the Redis shared cache is not included in the minimal build")
+}
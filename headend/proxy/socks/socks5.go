@@ -0,0 +1,263 @@
+// Package socks implements the SOCKS5 wire protocol (RFC 1928) for the
+// SASEWaddle headend proxy.
+//
+// The socks package provides:
+// - Server-side method negotiation and request parsing
+// - Username/password authentication (RFC 1929) delegated to a callback
+// - Reply encoding for IPv4, IPv6 and domain name addresses
+//
+// The package only speaks the protocol. Authentication, firewall checks and
+// relaying are performed by the proxy, so standard tooling (curl, browsers,
+// ssh -D) can use the headend without the custom JWT:/HOST: framing.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Commands a client may request
+const (
+	CommandConnect      = 0x01
+	CommandBind         = 0x02
+	CommandUDPAssociate = 0x03
+)
+
+// Reply codes sent in response to a request
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddressNotSupported = 0x08
+)
+
+var (
+	// ErrNoAcceptableMethod is returned when the client does not offer
+	// username/password authentication
+	ErrNoAcceptableMethod = errors.New("socks: client offered no acceptable authentication method")
+	// ErrAuthFailed is returned when the Authenticator rejects the credentials
+	ErrAuthFailed = errors.New("socks: authentication failed")
+	// ErrAddressNotSupported is returned when a request's address type is
+	// unknown or its domain is not a hostname
+	ErrAddressNotSupported = errors.New("socks: address type not supported")
+)
+
+// Authenticator validates the username/password sub-negotiation
+type Authenticator func(username, password string) error
+
+// Request is a parsed SOCKS5 request
+type Request struct {
+	Command byte
+	// Target is the requested destination as host:port
+	Target string
+}
+
+// ServerHandshake performs method negotiation, username/password
+// authentication and reads the client's request. Username/password is the
+// only method offered. On authentication failure the client is told so
+// before ErrAuthFailed is returned, and likewise for ErrAddressNotSupported.
+func ServerHandshake(rw io.ReadWriter, authenticate Authenticator) (*Request, error) {
+	if err := negotiateMethod(rw); err != nil {
+		return nil, err
+	}
+	if err := authenticateUserPass(rw, authenticate); err != nil {
+		return nil, err
+	}
+	request, err := readRequest(rw)
+	if errors.Is(err, ErrAddressNotSupported) {
+		_ = WriteReply(rw, ReplyAddressNotSupported, nil)
+	}
+	return request, err
+}
+
+func negotiateMethod(rw io.ReadWriter) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return fmt.Errorf("socks: failed to read greeting: %w", err)
+	}
+	if header[0] != version5 {
+		return fmt.Errorf("socks: unsupported version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return fmt.Errorf("socks: failed to read methods: %w", err)
+	}
+
+	for _, method := range methods {
+		if method == methodUserPass {
+			_, err := rw.Write([]byte{version5, methodUserPass})
+			return err
+		}
+	}
+
+	_, _ = rw.Write([]byte{version5, methodNoAcceptable})
+	return ErrNoAcceptableMethod
+}
+
+func authenticateUserPass(rw io.ReadWriter, authenticate Authenticator) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return fmt.Errorf("socks: failed to read credentials: %w", err)
+	}
+	if header[0] != userPassVersion {
+		return fmt.Errorf("socks: unsupported auth version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, username); err != nil {
+		return fmt.Errorf("socks: failed to read username: %w", err)
+	}
+
+	passwordLen := make([]byte, 1)
+	if _, err := io.ReadFull(rw, passwordLen); err != nil {
+		return fmt.Errorf("socks: failed to read password: %w", err)
+	}
+	password := make([]byte, passwordLen[0])
+	if _, err := io.ReadFull(rw, password); err != nil {
+		return fmt.Errorf("socks: failed to read password: %w", err)
+	}
+
+	if err := authenticate(string(username), string(password)); err != nil {
+		_, _ = rw.Write([]byte{userPassVersion, userPassFailure})
+		return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+
+	_, err := rw.Write([]byte{userPassVersion, userPassSuccess})
+	return err
+}
+
+func readRequest(r io.Reader) (*Request, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("socks: failed to read request: %w", err)
+	}
+	if header[0] != version5 {
+		return nil, fmt.Errorf("socks: unsupported version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if header[3] == atypIPv6 {
+			size = net.IPv6len
+		}
+		addr := make([]byte, size)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, fmt.Errorf("socks: failed to read address: %w", err)
+		}
+		host = net.IP(addr).String()
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, fmt.Errorf("socks: failed to read domain: %w", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, fmt.Errorf("socks: failed to read domain: %w", err)
+		}
+		if !isHostname(domain) {
+			return nil, fmt.Errorf("%w: invalid domain %q", ErrAddressNotSupported, domain)
+		}
+		host = string(domain)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrAddressNotSupported, header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, fmt.Errorf("socks: failed to read port: %w", err)
+	}
+
+	return &Request{
+		Command: header[1],
+		Target:  net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))),
+	}, nil
+}
+
+// isHostname reports whether domain is a non-empty hostname. Anything else,
+// such as a colon or bracket, would make the target ambiguous to the
+// firewall and the dialer.
+func isHostname(domain []byte) bool {
+	if len(domain) == 0 {
+		return false
+	}
+	for _, c := range domain {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WriteReply sends a reply with the given code. bind is the address the
+// proxy used to reach the target and may be nil for failures.
+func WriteReply(w io.Writer, code byte, bind net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcpAddr, ok := bind.(*net.TCPAddr); ok && tcpAddr != nil {
+		ip = tcpAddr.IP
+		port = tcpAddr.Port
+	}
+
+	reply := []byte{version5, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, atypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, atypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+
+	_, err := w.Write(reply)
+	return err
+}
+
+// ReplyCodeForError maps a dial error to the closest SOCKS5 reply code
+func ReplyCodeForError(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return ReplyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReplyTTLExpired
+	default:
+		return ReplyGeneralFailure
+	}
+}
@@ -0,0 +1,255 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// conn replays a client's bytes and records what the server writes
+type conn struct {
+	io.Reader
+	written bytes.Buffer
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func newConn(input ...[]byte) *conn {
+	return &conn{Reader: bytes.NewReader(bytes.Join(input, nil))}
+}
+
+// checkCredentials accepts alice with the password secret
+func checkCredentials(username, password string) error {
+	if username != "alice" || password != "secret" {
+		return errors.New("bad credentials")
+	}
+	return nil
+}
+
+// credentials encodes an RFC 1929 username/password request
+func credentials(username, password string) []byte {
+	b := []byte{userPassVersion, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func TestNegotiateMethod(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		reply   []byte
+		wantErr error
+	}{
+		{"user/pass offered", []byte{5, 2, methodNoAuth, methodUserPass}, []byte{5, methodUserPass}, nil},
+		{"only no-auth offered", []byte{5, 1, methodNoAuth}, []byte{5, methodNoAcceptable}, ErrNoAcceptableMethod},
+		{"no methods", []byte{5, 0}, []byte{5, methodNoAcceptable}, ErrNoAcceptableMethod},
+		{"SOCKS4", []byte{4, 1, methodUserPass}, nil, nil},
+		{"empty", nil, nil, io.EOF},
+		{"truncated header", []byte{5}, nil, io.ErrUnexpectedEOF},
+		{"fewer methods than announced", []byte{5, 3, methodUserPass}, nil, io.ErrUnexpectedEOF},
+		{"255 methods announced, none sent", []byte{5, 255}, nil, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn(tt.input)
+			err := negotiateMethod(c)
+			if tt.wantErr == nil && tt.reply != nil && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if tt.reply == nil && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !bytes.Equal(c.written.Bytes(), tt.reply) {
+				t.Errorf("replied % x, want % x", c.written.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUserPass(t *testing.T) {
+	long := strings.Repeat("a", 255)
+	tests := []struct {
+		name    string
+		input   []byte
+		reply   []byte
+		wantErr error
+	}{
+		{"accepted", credentials("alice", "secret"), []byte{userPassVersion, userPassSuccess}, nil},
+		{"rejected", credentials("alice", "wrong"), []byte{userPassVersion, userPassFailure}, ErrAuthFailed},
+		{"longest fields", credentials(long, long), []byte{userPassVersion, userPassFailure}, ErrAuthFailed},
+		{"empty fields", credentials("", ""), []byte{userPassVersion, userPassFailure}, ErrAuthFailed},
+		{"wrong version", append([]byte{5}, credentials("alice", "secret")[1:]...), nil, nil},
+		{"empty", nil, nil, io.EOF},
+		{"truncated username", []byte{userPassVersion, 5, 'a', 'l'}, nil, io.ErrUnexpectedEOF},
+		{"missing password length", []byte{userPassVersion, 5, 'a', 'l', 'i', 'c', 'e'}, nil, io.EOF},
+		{"password longer than sent", []byte{userPassVersion, 1, 'a', 200, 's'}, nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn(tt.input)
+			err := authenticateUserPass(c, checkCredentials)
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			case tt.wantErr == nil && tt.reply != nil && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case tt.reply == nil && err == nil:
+				t.Fatal("expected an error")
+			}
+			if !bytes.Equal(c.written.Bytes(), tt.reply) {
+				t.Errorf("replied % x, want % x", c.written.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    Request
+		wantErr error
+	}{
+		{"IPv4 connect", []byte{5, CommandConnect, 0, atypIPv4, 192, 0, 2, 1, 0x01, 0xBB}, Request{CommandConnect, "192.0.2.1:443"}, nil},
+		{"IPv6 connect", append(append([]byte{5, CommandConnect, 0, atypIPv6}, net.ParseIP("2001:db8::1")...), 0, 80), Request{CommandConnect, "[2001:db8::1]:80"}, nil},
+		{"domain connect", append([]byte{5, CommandConnect, 0, atypDomain, 11}, "example.com\x00\x16"...), Request{CommandConnect, "example.com:22"}, nil},
+		{"longest domain", append(append([]byte{5, CommandConnect, 0, atypDomain, 255}, strings.Repeat("a", 255)...), 0, 1), Request{CommandConnect, strings.Repeat("a", 255) + ":1"}, nil},
+		// The caller refuses commands other than CONNECT
+		{"bind is passed on", []byte{5, CommandBind, 0, atypIPv4, 192, 0, 2, 1, 0, 80}, Request{CommandBind, "192.0.2.1:80"}, nil},
+		{"unknown command is passed on", []byte{5, 0x7F, 0, atypIPv4, 192, 0, 2, 1, 0, 80}, Request{0x7F, "192.0.2.1:80"}, nil},
+		{"unknown address type", []byte{5, CommandConnect, 0, 0x05, 192, 0, 2, 1, 0, 80}, Request{}, ErrAddressNotSupported},
+		{"empty domain", []byte{5, CommandConnect, 0, atypDomain, 0, 0, 80}, Request{}, ErrAddressNotSupported},
+		{"domain with a port", append([]byte{5, CommandConnect, 0, atypDomain, 14}, "example.com:25\x00\x50"...), Request{}, ErrAddressNotSupported},
+		{"domain with a bracket", append([]byte{5, CommandConnect, 0, atypDomain, 5}, "a]b:c\x00\x50"...), Request{}, ErrAddressNotSupported},
+		{"wrong version", []byte{4, CommandConnect, 0, atypIPv4, 192, 0, 2, 1, 0, 80}, Request{}, nil},
+		{"empty", nil, Request{}, io.EOF},
+		{"truncated header", []byte{5, CommandConnect}, Request{}, io.ErrUnexpectedEOF},
+		{"truncated IPv4", []byte{5, CommandConnect, 0, atypIPv4, 192, 0}, Request{}, io.ErrUnexpectedEOF},
+		{"truncated IPv6", []byte{5, CommandConnect, 0, atypIPv6, 0x20, 0x01}, Request{}, io.ErrUnexpectedEOF},
+		{"missing domain length", []byte{5, CommandConnect, 0, atypDomain}, Request{}, io.EOF},
+		{"domain longer than sent", []byte{5, CommandConnect, 0, atypDomain, 200, 'a', 'b'}, Request{}, io.ErrUnexpectedEOF},
+		{"missing port", []byte{5, CommandConnect, 0, atypIPv4, 192, 0, 2, 1}, Request{}, io.EOF},
+		{"truncated port", []byte{5, CommandConnect, 0, atypIPv4, 192, 0, 2, 1, 0}, Request{}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := readRequest(bytes.NewReader(tt.input))
+			if tt.want.Target == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", request)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if *request != tt.want {
+				t.Errorf("parsed %+v, want %+v", *request, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	c := newConn(
+		[]byte{5, 1, methodUserPass},
+		credentials("alice", "secret"),
+		[]byte{5, CommandConnect, 0, atypIPv4, 192, 0, 2, 1, 0x01, 0xBB},
+	)
+	request, err := ServerHandshake(c, checkCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Command != CommandConnect || request.Target != "192.0.2.1:443" {
+		t.Errorf("unexpected request %+v", request)
+	}
+	if want := []byte{5, methodUserPass, userPassVersion, userPassSuccess}; !bytes.Equal(c.written.Bytes(), want) {
+		t.Errorf("replied % x, want % x", c.written.Bytes(), want)
+	}
+
+	// Requests for unknown address types are answered before failing
+	c = newConn(
+		[]byte{5, 1, methodUserPass},
+		credentials("alice", "secret"),
+		[]byte{5, CommandConnect, 0, 0x09},
+	)
+	if _, err := ServerHandshake(c, checkCredentials); !errors.Is(err, ErrAddressNotSupported) {
+		t.Fatalf("error %v, want ErrAddressNotSupported", err)
+	}
+	reply := c.written.Bytes()[4:]
+	if len(reply) < 2 || reply[1] != ReplyAddressNotSupported {
+		t.Errorf("replied % x, want address type not supported", reply)
+	}
+
+	// Rejected credentials never reach the request
+	c = newConn(
+		[]byte{5, 1, methodUserPass},
+		credentials("alice", "wrong"),
+		[]byte{5, CommandConnect, 0, atypIPv4, 192, 0, 2, 1, 0x01, 0xBB},
+	)
+	if request, err := ServerHandshake(c, checkCredentials); !errors.Is(err, ErrAuthFailed) || request != nil {
+		t.Errorf("got %+v, %v, want ErrAuthFailed", request, err)
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteReply(&b, ReplySucceeded, &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1080}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{5, ReplySucceeded, 0, atypIPv4, 192, 0, 2, 7, 0x04, 0x38}; !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("wrote % x, want % x", b.Bytes(), want)
+	}
+
+	b.Reset()
+	if err := WriteReply(&b, ReplyNotAllowed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{5, ReplyNotAllowed, 0, atypIPv4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("wrote % x, want % x", b.Bytes(), want)
+	}
+}
+
+// FuzzServerHandshake feeds arbitrary client bytes to the handshake. It
+// must never panic, and a request it accepts must name a usable target.
+func FuzzServerHandshake(f *testing.F) {
+	greeting := []byte{5, 1, methodUserPass}
+	login := credentials("alice", "secret")
+	f.Add(bytes.Join([][]byte{greeting, login, {5, CommandConnect, 0, atypIPv4, 192, 0, 2, 1, 0x01, 0xBB}}, nil))
+	f.Add(bytes.Join([][]byte{greeting, login, append([]byte{5, CommandConnect, 0, atypDomain, 11}, "example.com\x00\x50"...)}, nil))
+	f.Add(bytes.Join([][]byte{greeting, login, append(append([]byte{5, CommandConnect, 0, atypIPv6}, net.ParseIP("2001:db8::1")...), 0, 80)}, nil))
+	f.Add(bytes.Join([][]byte{greeting, login, {5, CommandBind, 0, 0x05}}, nil))
+	f.Add(bytes.Join([][]byte{greeting, credentials("alice", "wrong")}, nil))
+	f.Add([]byte{5, 255})
+	f.Add([]byte{5, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		request, err := ServerHandshake(newConn(data), checkCredentials)
+		if err != nil {
+			if request != nil {
+				t.Fatalf("returned %+v with error %v", request, err)
+			}
+			return
+		}
+		host, port, err := net.SplitHostPort(request.Target)
+		if err != nil || host == "" {
+			t.Fatalf("accepted unusable target %q", request.Target)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			t.Fatalf("accepted target %q with port %q", request.Target, port)
+		}
+	})
+}
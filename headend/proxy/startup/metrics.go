@@ -0,0 +1,18 @@
+package startup
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	componentReady = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_component_ready",
+		Help: "Whether a subsystem started at boot is ready (1) or not (0), by component.",
+	}, []string{"component"})
+
+	componentStartup = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_component_startup_seconds",
+		Help: "Time a subsystem took to become ready at boot, by component.",
+	}, []string{"component"})
+)
@@ -0,0 +1,202 @@
+// Package startup starts independent headend subsystems concurrently and
+// tracks whether each one is ready.
+//
+// The startup package provides:
+//   - A Group that runs the network-bound parts of startup (fetching signing
+//     keys, firewall rules, rate limits, port configuration and feature
+//     flags) side by side, each within its own timeout
+//   - Required tasks, whose failure stops the headend from starting, and
+//     optional ones, which leave it running degraded
+//   - A Readiness record of every task's state, served at /readyz
+//
+// Subsystem Start methods don't take a context, so a timeout can't abort
+// them. A task that outlives its timeout is reported as failed and keeps
+// running; if it later succeeds, its component becomes ready.
+package startup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// State is the startup state of a component
+type State string
+
+const (
+	StatePending State = "pending"
+	StateReady   State = "ready"
+	StateFailed  State = "failed"
+)
+
+// Task is one subsystem to start
+type Task struct {
+	Name string
+	// Required tasks must succeed for the headend to start
+	Required bool
+	// Timeout bounds the task; zero means no limit
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Component is the startup state of a task, as reported by /readyz
+type Component struct {
+	Name       string `json:"name"`
+	State      State  `json:"state"`
+	Required   bool   `json:"required"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Readiness records the state of every component started by a Group
+type Readiness struct {
+	mu         sync.RWMutex
+	components map[string]*Component
+}
+
+// NewReadiness creates an empty readiness record
+func NewReadiness() *Readiness {
+	return &Readiness{components: make(map[string]*Component)}
+}
+
+func (r *Readiness) register(name string, required bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components[name] = &Component{Name: name, State: StatePending, Required: required}
+	componentReady.WithLabelValues(name).Set(0)
+}
+
+func (r *Readiness) set(name string, err error, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	component, ok := r.components[name]
+	if !ok {
+		return
+	}
+	component.DurationMS = elapsed.Milliseconds()
+	if err != nil {
+		component.State = StateFailed
+		component.Error = err.Error()
+		componentReady.WithLabelValues(name).Set(0)
+		return
+	}
+	component.State = StateReady
+	component.Error = ""
+	componentReady.WithLabelValues(name).Set(1)
+	componentStartup.WithLabelValues(name).Set(elapsed.Seconds())
+}
+
+// Ready reports whether every required component is ready. Optional
+// components that failed don't count against it. A nil Readiness is ready.
+func (r *Readiness) Ready() bool {
+	if r == nil {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, component := range r.components {
+		if component.Required && component.State != StateReady {
+			return false
+		}
+	}
+	return true
+}
+
+// Components returns the state of every component, sorted by name
+func (r *Readiness) Components() []Component {
+	if r == nil {
+		return []Component{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	components := make([]Component, 0, len(r.components))
+	for _, component := range r.components {
+		components = append(components, *component)
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+	return components
+}
+
+// Group runs tasks concurrently, recording their outcome in a Readiness
+type Group struct {
+	readiness *Readiness
+	wg        sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// NewGroup creates a group that records its tasks in readiness
+func NewGroup(readiness *Readiness) *Group {
+	return &Group{readiness: readiness}
+}
+
+// Go starts task in the background
+func (g *Group) Go(task Task) {
+	g.readiness.register(task.Name, task.Required)
+	g.wg.Add(1)
+	go g.run(task)
+}
+
+func (g *Group) run(task Task) {
+	defer g.wg.Done()
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if task.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, task.Timeout)
+	}
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- task.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		g.finish(task, err, time.Since(start))
+	case <-ctx.Done():
+		g.finish(task, fmt.Errorf("timed out after %s", task.Timeout), time.Since(start))
+		go g.late(task, done, start)
+	}
+}
+
+// finish records the outcome of task within its timeout
+func (g *Group) finish(task Task, err error, elapsed time.Duration) {
+	g.readiness.set(task.Name, err, elapsed)
+	switch {
+	case err == nil:
+		log.Infof("Started %s in %s", task.Name, elapsed.Round(time.Millisecond))
+	case task.Required:
+		g.mu.Lock()
+		g.errs = append(g.errs, fmt.Errorf("%s: %w", task.Name, err))
+		g.mu.Unlock()
+	default:
+		log.Warnf("Failed to start %s, continuing without it: %v", task.Name, err)
+	}
+}
+
+// late records the outcome of a task that outlived its timeout
+func (g *Group) late(task Task, done <-chan error, start time.Time) {
+	err := <-done
+	if err != nil {
+		return
+	}
+	g.readiness.set(task.Name, nil, time.Since(start))
+	log.Infof("Started %s after its timeout, in %s", task.Name, time.Since(start).Round(time.Millisecond))
+}
+
+// Wait waits for every task to finish or time out, and returns the errors
+// of the required tasks that didn't succeed
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return errors.Join(g.errs...)
+}
@@ -0,0 +1,127 @@
+package startup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupRunsTasksConcurrently(t *testing.T) {
+	readiness := NewReadiness()
+	group := NewGroup(readiness)
+
+	// Each task only finishes once the other has started
+	a, b := make(chan struct{}), make(chan struct{})
+	group.Go(Task{Name: "a", Required: true, Timeout: time.Second, Run: func(context.Context) error {
+		close(a)
+		<-b
+		return nil
+	}})
+	group.Go(Task{Name: "b", Required: true, Timeout: time.Second, Run: func(context.Context) error {
+		close(b)
+		<-a
+		return nil
+	}})
+
+	if err := group.Wait(); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if !readiness.Ready() {
+		t.Errorf("expected ready, got %+v", readiness.Components())
+	}
+}
+
+func TestGroupFailures(t *testing.T) {
+	readiness := NewReadiness()
+	group := NewGroup(readiness)
+
+	group.Go(Task{Name: "rules", Required: true, Run: func(context.Context) error {
+		return errors.New("manager unreachable")
+	}})
+	group.Go(Task{Name: "flags", Run: func(context.Context) error {
+		return errors.New("manager unreachable")
+	}})
+	group.Go(Task{Name: "keys", Required: true, Run: func(context.Context) error {
+		return nil
+	}})
+
+	err := group.Wait()
+	if err == nil || !strings.Contains(err.Error(), "rules: manager unreachable") {
+		t.Fatalf("expected the required task's error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "flags") {
+		t.Errorf("optional task failure should not be returned: %v", err)
+	}
+	if readiness.Ready() {
+		t.Error("expected not ready with a required task failed")
+	}
+
+	components := readiness.Components()
+	want := map[string]State{"flags": StateFailed, "keys": StateReady, "rules": StateFailed}
+	if len(components) != len(want) {
+		t.Fatalf("got %d components, want %d", len(components), len(want))
+	}
+	for _, c := range components {
+		if c.State != want[c.Name] {
+			t.Errorf("%s is %s, want %s", c.Name, c.State, want[c.Name])
+		}
+	}
+	if components[0].Name != "flags" || components[0].Error == "" {
+		t.Errorf("expected components sorted by name with errors, got %+v", components)
+	}
+}
+
+func TestGroupTimeout(t *testing.T) {
+	readiness := NewReadiness()
+	group := NewGroup(readiness)
+
+	release := make(chan struct{})
+	group.Go(Task{Name: "ports", Timeout: 10 * time.Millisecond, Run: func(context.Context) error {
+		<-release
+		return nil
+	}})
+
+	start := time.Now()
+	if err := group.Wait(); err != nil {
+		t.Fatalf("optional task timing out should not fail Wait: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Wait did not return at the task's timeout")
+	}
+	if c := readiness.Components()[0]; c.State != StateFailed || !strings.Contains(c.Error, "timed out") {
+		t.Errorf("expected a timed out component, got %+v", c)
+	}
+
+	// Finishing late makes the component ready
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for readiness.Components()[0].State != StateReady {
+		if time.Now().After(deadline) {
+			t.Fatal("late task never became ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequiredTimeoutFailsWait(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	group := NewGroup(NewReadiness())
+	group.Go(Task{Name: "auth", Required: true, Timeout: 10 * time.Millisecond, Run: func(context.Context) error {
+		<-release
+		return nil
+	}})
+	if err := group.Wait(); err == nil || !strings.Contains(err.Error(), "auth: timed out") {
+		t.Errorf("expected the required task to time out, got %v", err)
+	}
+}
+
+func TestNilReadiness(t *testing.T) {
+	var readiness *Readiness
+	if !readiness.Ready() || len(readiness.Components()) != 0 {
+		t.Error("nil readiness should be ready with no components")
+	}
+}
@@ -0,0 +1,26 @@
+package syslog
+
+import "time"
+
+// AccessLog represents a user access log entry
+type AccessLog struct {
+	Timestamp   time.Time `json:"timestamp"`
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	PseudonymKey string   `json:"pseudonym_key,omitempty"` // set when UserID and Username are pseudonyms
+	SourceIP    string    `json:"source_ip"`
+	TargetHost  string    `json:"target_host"`
+	Protocol    string    `json:"protocol"`
+	Action      string    `json:"action"` // "allow" or "deny"
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	BytesSent   int64     `json:"bytes_sent,omitempty"`
+	BytesReceived int64   `json:"bytes_received,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	PolicyVersion string  `json:"policy_version,omitempty"`
+	ShadowAction  string  `json:"shadow_action,omitempty"`
+	HTTPVersion   string  `json:"http_version,omitempty"`
+	GRPCStatus    string  `json:"grpc_status,omitempty"`
+}
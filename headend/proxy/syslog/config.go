@@ -0,0 +1,44 @@
+package syslog
+
+import "time"
+
+// Transports
+const (
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
+	ProtocolTLS = "tls" // RFC 5425
+)
+
+// Message formats
+const (
+	FormatRFC3164 = "rfc3164"
+	FormatRFC5424 = "rfc5424"
+)
+
+// DefaultEnterpriseID names the structured data of RFC 5424 messages. It is
+// the enterprise number reserved for documentation (RFC 5612); deployments
+// with their own number should configure it.
+const DefaultEnterpriseID = 32473
+
+// TransportConfig selects how access logs reach the syslog server. The zero
+// value is RFC 3164 messages over UDP.
+type TransportConfig struct {
+	Protocol string // udp, tcp or tls; TCP and TLS frame messages by octet counting
+	Format   string // rfc3164 or rfc5424
+
+	// EnterpriseID names the RFC 5424 structured data element, access@ID
+	EnterpriseID int
+
+	// TLS settings: the CA bundle verifying the server (the system roots if
+	// empty), a client certificate for servers that require one, and the
+	// name to verify (the host if empty)
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+
+	// Reconnect backoff for TCP and TLS, doubling from MinBackoff to
+	// MaxBackoff while the server is unreachable
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
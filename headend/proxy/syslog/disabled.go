@@ -0,0 +1,47 @@
+//go:build minimal
+
+package syslog
+
+import (
+	"context"
+	"errors"
+)
+
+// errNotBuilt is returned by a headend built with the minimal profile,
+// which leaves syslog out
+var errNotBuilt = errors.New("syslog logging is not included in the minimal build")
+
+// SyslogLogger stands in for the syslog logger in the minimal build
+type SyslogLogger struct{}
+
+func NewSyslogLogger(syslogHost, syslogPort string) *SyslogLogger {
+	return &SyslogLogger{}
+}
+
+func (s *SyslogLogger) SetWorkers(workers int) {}
+
+func (s *SyslogLogger) SetQueueSize(size int) {}
+
+func (s *SyslogLogger) SetTransport(config TransportConfig) error {
+	return nil
+}
+
+func (s *SyslogLogger) Start() error {
+	return errNotBuilt
+}
+
+func (s *SyslogLogger) Stop() {}
+
+func (s *SyslogLogger) LogAccess(accessLog AccessLog) {}
+
+func (s *SyslogLogger) LogAccessContext(ctx context.Context, accessLog AccessLog) error {
+	return errNotBuilt
+}
+
+func (s *SyslogLogger) GetQueueDepth() int {
+	return 0
+}
+
+func (s *SyslogLogger) IsEnabled() bool {
+	return false
+}
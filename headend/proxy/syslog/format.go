@@ -0,0 +1,109 @@
+//go:build !minimal
+
+package syslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rfc5424Timestamp is RFC 3339 with the microsecond precision RFC 5424 allows
+const rfc5424Timestamp = "2006-01-02T15:04:05.000000Z07:00"
+
+// format renders an access log entry as a syslog message in the configured
+// format, without transport framing
+func (s *SyslogLogger) format(accessLog AccessLog) ([]byte, error) {
+	// Create structured message with JSON payload
+	jsonData, err := json.Marshal(accessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal access log: %w", err)
+	}
+
+	// Calculate priority (facility * 8 + severity)
+	priority := s.facility*8 + s.severity
+
+	if s.transport.Format == FormatRFC5424 {
+		// <priority>1 timestamp hostname appname procid msgid [sd] message
+		return []byte(fmt.Sprintf("<%d>1 %s %s %s %d access %s %s",
+			priority,
+			accessLog.Timestamp.UTC().Format(rfc5424Timestamp),
+			headerField(s.hostname, 255),
+			headerField(s.appName, 48),
+			s.pid,
+			s.structuredData(accessLog),
+			jsonData,
+		)), nil
+	}
+
+	// RFC3164 format: <priority>timestamp hostname appname: message
+	return []byte(fmt.Sprintf("<%d>%s %s %s: %s",
+		priority,
+		accessLog.Timestamp.Format(time.RFC3339),
+		s.hostname,
+		s.appName,
+		string(jsonData),
+	)), nil
+}
+
+// structuredData renders the access@enterprise element carrying the fields
+// collectors index on; the message repeats the whole entry as JSON
+func (s *SyslogLogger) structuredData(accessLog AccessLog) string {
+	var sd strings.Builder
+	fmt.Fprintf(&sd, "[access@%d", s.transport.EnterpriseID)
+	param := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&sd, " %s=\"%s\"", name, escapeParam(value))
+		}
+	}
+	param("user_id", accessLog.UserID)
+	param("username", accessLog.Username)
+	param("pseudonym_key", accessLog.PseudonymKey)
+	param("source_ip", accessLog.SourceIP)
+	param("target_host", accessLog.TargetHost)
+	param("protocol", accessLog.Protocol)
+	param("action", accessLog.Action)
+	param("method", accessLog.Method)
+	if accessLog.StatusCode != 0 {
+		param("status_code", strconv.Itoa(accessLog.StatusCode))
+	}
+	param("request_id", accessLog.RequestID)
+	param("policy_version", accessLog.PolicyVersion)
+	sd.WriteString("]")
+	return sd.String()
+}
+
+// escapeParam escapes the characters RFC 5424 reserves in parameter values
+func escapeParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// headerField makes value fit an RFC 5424 header field: printable ASCII
+// without spaces, at most max characters, or "-" when empty
+func headerField(value string, max int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if field == "" {
+		return "-"
+	}
+	if len(field) > max {
+		field = field[:max]
+	}
+	return field
+}
+
+// frame prepares message for the transport: stream transports prefix the
+// length (RFC 6587 octet counting, as RFC 5425 requires), datagrams need
+// nothing
+func (s *SyslogLogger) frame(message []byte) []byte {
+	if s.transport.Protocol == ProtocolUDP {
+		return message
+	}
+	return append([]byte(strconv.Itoa(len(message))+" "), message...)
+}
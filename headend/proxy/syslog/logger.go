@@ -1,47 +1,50 @@
-// Package syslog implements RFC3164 compliant UDP syslog logging for the SASEWaddle headend proxy.
+//go:build !minimal
+
+// Package syslog implements syslog access logging for the SASEWaddle headend proxy.
 //
 // The syslog logger provides:
-// - RFC3164 compliant syslog message formatting
-// - UDP-only transport for security compliance
-// - High-performance logging with worker queues
+// - RFC3164 or RFC5424 message formatting, the latter with the access
+//   details as structured data
+// - UDP, TCP or TLS (RFC5425) transport, the stream transports reconnecting
+//   with exponential backoff
+// - High-performance logging with worker queues sized to GOMAXPROCS
 // - Comprehensive access logging for all user activities
 // - JSON payload support for structured logging
 // - Automatic connection management and retry logic
 // - Configurable facility and severity levels
 // - Non-blocking operation to prevent proxy slowdown
+// - Context-aware submission and queue saturation metrics
 //
 // All user access attempts (both allowed and denied) are logged with
 // detailed metadata for security auditing and compliance reporting.
 package syslog
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// AccessLog represents a user access log entry
-type AccessLog struct {
-	Timestamp   time.Time `json:"timestamp"`
-	UserID      string    `json:"user_id"`
-	Username    string    `json:"username"`
-	SourceIP    string    `json:"source_ip"`
-	TargetHost  string    `json:"target_host"`
-	Protocol    string    `json:"protocol"`
-	Action      string    `json:"action"` // "allow" or "deny"
-	Method      string    `json:"method,omitempty"`
-	Path        string    `json:"path,omitempty"`
-	StatusCode  int       `json:"status_code,omitempty"`
-	BytesSent   int64     `json:"bytes_sent,omitempty"`
-	UserAgent   string    `json:"user_agent,omitempty"`
-	RequestID   string    `json:"request_id,omitempty"`
-}
+// ErrQueueFull is returned when an access log entry is dropped because the
+// syslog queue is saturated. Entries are never retried once dropped; the
+// headend_syslog_dropped_total metric records how many were lost.
+var ErrQueueFull = errors.New("syslog queue full")
 
-// SyslogLogger handles UDP syslog logging for user access
+// errUnavailable means a stream transport is waiting out its backoff, so
+// the entry was not sent
+var errUnavailable = errors.New("syslog server unreachable")
+
+// SyslogLogger handles syslog logging for user access
 type SyslogLogger struct {
 	enabled      bool
 	syslogHost   string
@@ -50,13 +53,38 @@ type SyslogLogger struct {
 	severity     int
 	hostname     string
 	appName      string
-	conn         *net.UDPConn
+	pid          int
+	transport    TransportConfig
+	tlsConfig    *tls.Config
+	conn         net.Conn
 	mu           sync.RWMutex
+	// backoff is the wait before the next stream reconnect, not before
+	// nextDial
+	backoff      time.Duration
+	nextDial     time.Time
 	logQueue     chan AccessLog
 	workers      int
 	stopChan     chan bool
+	lastDropLog  atomic.Int64
 }
 
+const (
+	// DefaultQueueSize is how many entries may wait for a worker
+	DefaultQueueSize = 1000
+
+	// maxWorkers bounds the default worker pool
+	maxWorkers = 3
+
+	// Default reconnect backoff for the stream transports
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+
+	// dialTimeout and writeTimeout keep an unresponsive server from
+	// holding a worker
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+)
+
 // RFC3164 priority calculation: facility * 8 + severity
 const (
 	// Facilities
@@ -92,12 +120,110 @@ func NewSyslogLogger(syslogHost, syslogPort string) *SyslogLogger {
 		severity:    SeverityInformational,
 		hostname:    hostname,
 		appName:     "sasewaddle-headend",
-		logQueue:    make(chan AccessLog, 1000), // Buffer up to 1000 logs
-		workers:     3,                          // 3 worker goroutines
+		pid:         os.Getpid(),
+		transport: TransportConfig{
+			Protocol:     ProtocolUDP,
+			Format:       FormatRFC3164,
+			EnterpriseID: DefaultEnterpriseID,
+			MinBackoff:   DefaultMinBackoff,
+			MaxBackoff:   DefaultMaxBackoff,
+		},
+		logQueue:    make(chan AccessLog, DefaultQueueSize),
+		workers:     min(runtime.GOMAXPROCS(0), maxWorkers),
 		stopChan:    make(chan bool),
 	}
 }
 
+// SetWorkers sets the number of workers sending to the syslog server; 0
+// uses one per GOMAXPROCS, up to maxWorkers. It must be called before Start.
+func (s *SyslogLogger) SetWorkers(workers int) {
+	if workers <= 0 {
+		workers = min(runtime.GOMAXPROCS(0), maxWorkers)
+	}
+	s.workers = workers
+}
+
+// SetQueueSize sets how many entries may wait for a worker before new ones
+// are dropped; 0 keeps DefaultQueueSize. It must be called before Start.
+func (s *SyslogLogger) SetQueueSize(size int) {
+	if size > 0 {
+		s.logQueue = make(chan AccessLog, size)
+	}
+}
+
+// SetTransport selects the protocol and message format; empty fields keep
+// their defaults. It must be called before Start.
+func (s *SyslogLogger) SetTransport(config TransportConfig) error {
+	if config.Protocol == "" {
+		config.Protocol = ProtocolUDP
+	}
+	if config.Format == "" {
+		config.Format = FormatRFC3164
+	}
+	if config.EnterpriseID == 0 {
+		config.EnterpriseID = DefaultEnterpriseID
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = max(DefaultMaxBackoff, config.MinBackoff)
+	}
+
+	switch config.Protocol {
+	case ProtocolUDP, ProtocolTCP:
+	case ProtocolTLS:
+		tlsConfig, err := newTLSConfig(config, s.syslogHost)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = tlsConfig
+	default:
+		return fmt.Errorf("unknown syslog protocol %q, want udp, tcp or tls", config.Protocol)
+	}
+	switch config.Format {
+	case FormatRFC3164, FormatRFC5424:
+	default:
+		return fmt.Errorf("unknown syslog format %q, want rfc3164 or rfc5424", config.Format)
+	}
+	if config.EnterpriseID < 0 {
+		return fmt.Errorf("invalid syslog enterprise ID %d", config.EnterpriseID)
+	}
+
+	s.transport = config
+	return nil
+}
+
+// newTLSConfig builds the client TLS configuration for RFC5425 transport
+func newTLSConfig(config TransportConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if config.CAFile != "" {
+		pemData, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read syslog CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in syslog CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load syslog client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
 // Start initializes the syslog logger and starts worker goroutines
 func (s *SyslogLogger) Start() error {
 	if !s.enabled {
@@ -105,9 +231,14 @@ func (s *SyslogLogger) Start() error {
 		return nil
 	}
 
-	// Establish UDP connection
+	// A stream server that is down now is retried by the workers, with
+	// backoff, rather than holding up the headend
 	if err := s.connect(); err != nil {
-		return fmt.Errorf("failed to connect to syslog server: %w", err)
+		if s.transport.Protocol == ProtocolUDP {
+			return fmt.Errorf("failed to connect to syslog server: %w", err)
+		}
+		log.Warnf("Syslog server unreachable, will retry: %v", err)
+		s.scheduleReconnect()
 	}
 
 	// Start worker goroutines
@@ -115,7 +246,8 @@ func (s *SyslogLogger) Start() error {
 		go s.worker(fmt.Sprintf("worker-%d", i))
 	}
 
-	log.Infof("Syslog logger started - sending to %s:%s", s.syslogHost, s.syslogPort)
+	log.Infof("Syslog logger started - sending %s over %s to %s:%s",
+		s.transport.Format, s.transport.Protocol, s.syslogHost, s.syslogPort)
 	return nil
 }
 
@@ -159,10 +291,43 @@ func (s *SyslogLogger) LogAccess(accessLog AccessLog) {
 	// Non-blocking send to queue
 	select {
 	case s.logQueue <- accessLog:
-		// Successfully queued
+		syslogQueueDepth.Set(float64(len(s.logQueue)))
 	default:
 		// Queue is full, drop the log entry
-		log.Warn("Syslog queue full, dropping access log entry")
+		s.recordDrop()
+	}
+}
+
+// LogAccessContext queues an access log entry, waiting for queue space until
+// ctx is done. Use it where losing the entry matters more than latency; the
+// entry is dropped and ErrQueueFull returned if ctx expires first.
+func (s *SyslogLogger) LogAccessContext(ctx context.Context, accessLog AccessLog) error {
+	if !s.enabled {
+		return nil
+	}
+
+	if accessLog.Timestamp.IsZero() {
+		accessLog.Timestamp = time.Now().UTC()
+	}
+
+	select {
+	case s.logQueue <- accessLog:
+		syslogQueueDepth.Set(float64(len(s.logQueue)))
+		return nil
+	case <-ctx.Done():
+		s.recordDrop()
+		return fmt.Errorf("%w: %v", ErrQueueFull, ctx.Err())
+	}
+}
+
+// recordDrop counts a dropped entry and rate-limits the warning log
+func (s *SyslogLogger) recordDrop() {
+	syslogDropped.Inc()
+
+	now := time.Now().Unix()
+	last := s.lastDropLog.Load()
+	if now-last >= 10 && s.lastDropLog.CompareAndSwap(last, now) {
+		log.Warnf("Syslog queue saturated (%d/%d), dropping access log entries", len(s.logQueue), cap(s.logQueue))
 	}
 }
 
@@ -223,25 +388,79 @@ func (s *SyslogLogger) LogUDPAccess(userID, username, sourceIP, targetHost strin
 	})
 }
 
-// connect establishes UDP connection to syslog server
+// connect establishes the connection to the syslog server, replacing any
+// previous one
 func (s *SyslogLogger) connect() error {
-	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%s", s.syslogHost, s.syslogPort))
-	if err != nil {
-		return fmt.Errorf("failed to resolve syslog server address: %w", err)
+	address := net.JoinHostPort(s.syslogHost, s.syslogPort)
+
+	var conn net.Conn
+	var err error
+	switch s.transport.Protocol {
+	case ProtocolTCP:
+		conn, err = net.DialTimeout("tcp", address, dialTimeout)
+	case ProtocolTLS:
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, s.tlsConfig)
+	default:
+		conn, err = net.Dial("udp", address)
 	}
-
-	conn, err := net.DialUDP("udp", nil, serverAddr)
 	if err != nil {
 		return fmt.Errorf("failed to connect to syslog server: %w", err)
 	}
 
 	s.mu.Lock()
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
 	s.conn = conn
+	s.backoff = 0
+	s.nextDial = time.Time{}
 	s.mu.Unlock()
 
 	return nil
 }
 
+// reconnect replaces failed, the connection a send failed on. Stream
+// transports wait out the backoff between attempts; several workers failing
+// on the same connection reconnect once.
+func (s *SyslogLogger) reconnect(failed net.Conn) error {
+	s.mu.RLock()
+	current, nextDial := s.conn, s.nextDial
+	s.mu.RUnlock()
+
+	if current != failed && current != nil {
+		return nil
+	}
+	if s.transport.Protocol != ProtocolUDP && time.Now().Before(nextDial) {
+		return fmt.Errorf("%w, next attempt in %s", errUnavailable, time.Until(nextDial).Round(time.Millisecond))
+	}
+
+	if err := s.connect(); err != nil {
+		s.scheduleReconnect()
+		return err
+	}
+	log.Infof("Reconnected to syslog server %s:%s", s.syslogHost, s.syslogPort)
+	return nil
+}
+
+// scheduleReconnect drops the connection and doubles the backoff before
+// the next attempt
+func (s *SyslogLogger) scheduleReconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	if s.backoff == 0 {
+		s.backoff = s.transport.MinBackoff
+	} else {
+		s.backoff = min(2*s.backoff, s.transport.MaxBackoff)
+	}
+	s.nextDial = time.Now().Add(s.backoff)
+}
+
 // worker processes log entries from the queue
 func (s *SyslogLogger) worker(name string) {
 	log.Debugf("Syslog worker %s started", name)
@@ -249,11 +468,14 @@ func (s *SyslogLogger) worker(name string) {
 	for {
 		select {
 		case accessLog := <-s.logQueue:
-			if err := s.sendLog(accessLog); err != nil {
-				log.Errorf("Syslog worker %s failed to send log: %v", name, err)
-				// Try to reconnect
-				if err := s.connect(); err != nil {
-					log.Errorf("Syslog worker %s failed to reconnect: %v", name, err)
+			syslogQueueDepth.Set(float64(len(s.logQueue)))
+			if err := s.sendWithRetry(accessLog); err != nil {
+				syslogSendErrors.Inc()
+				if errors.Is(err, errUnavailable) {
+					// Logged once when the connection failed
+					log.Debugf("Syslog worker %s dropped log: %v", name, err)
+				} else {
+					log.Errorf("Syslog worker %s failed to send log: %v", name, err)
 				}
 			}
 		case <-s.stopChan:
@@ -263,40 +485,45 @@ func (s *SyslogLogger) worker(name string) {
 	}
 }
 
-// sendLog formats and sends a log entry to syslog server
-func (s *SyslogLogger) sendLog(accessLog AccessLog) error {
+// sendWithRetry sends an entry, reconnecting and trying once more if the
+// connection failed
+func (s *SyslogLogger) sendWithRetry(accessLog AccessLog) error {
 	s.mu.RLock()
 	conn := s.conn
 	s.mu.RUnlock()
 
 	if conn == nil {
-		return fmt.Errorf("no syslog connection available")
+		// Waiting to reconnect
+		if err := s.reconnect(nil); err != nil {
+			return err
+		}
+	} else if err := s.sendLog(conn, accessLog); err == nil {
+		return nil
+	} else if reconnectErr := s.reconnect(conn); reconnectErr != nil {
+		return fmt.Errorf("%v (reconnect: %v)", err, reconnectErr)
 	}
 
-	// Calculate priority (facility * 8 + severity)
-	priority := s.facility*8 + s.severity
+	s.mu.RLock()
+	conn = s.conn
+	s.mu.RUnlock()
+	return s.sendLog(conn, accessLog)
+}
 
-	// Format timestamp (RFC3339)
-	timestamp := accessLog.Timestamp.Format(time.RFC3339)
+// sendLog formats and sends a log entry on conn
+func (s *SyslogLogger) sendLog(conn net.Conn, accessLog AccessLog) error {
+	if conn == nil {
+		return fmt.Errorf("no syslog connection available")
+	}
 
-	// Create structured message with JSON payload
-	jsonData, err := json.Marshal(accessLog)
+	message, err := s.format(accessLog)
 	if err != nil {
-		return fmt.Errorf("failed to marshal access log: %w", err)
+		return err
 	}
 
-	// RFC3164 format: <priority>timestamp hostname appname: message
-	message := fmt.Sprintf("<%d>%s %s %s: %s",
-		priority,
-		timestamp,
-		s.hostname,
-		s.appName,
-		string(jsonData),
-	)
-
-	// Send UDP packet
-	_, err = conn.Write([]byte(message))
-	if err != nil {
+	if s.transport.Protocol != ProtocolUDP {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if _, err := conn.Write(s.frame(message)); err != nil {
 		return fmt.Errorf("failed to write to syslog connection: %w", err)
 	}
 
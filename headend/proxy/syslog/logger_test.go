@@ -0,0 +1,174 @@
+//go:build !minimal
+
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFormatRFC5424(t *testing.T) {
+	s := NewSyslogLogger("localhost", "514")
+	s.hostname = "headend-1"
+	s.pid = 42
+	if err := s.SetTransport(TransportConfig{Format: FormatRFC5424}); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := s.format(AccessLog{
+		Timestamp:  time.Date(2024, 3, 1, 12, 30, 0, 123456000, time.UTC),
+		UserID:     "u1",
+		Username:   `eve "the ]admin\"`,
+		SourceIP:   "10.0.0.5",
+		TargetHost: "db.internal:5432",
+		Protocol:   "TCP",
+		Action:     "deny",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<134>1 2024-03-01T12:30:00.123456Z headend-1 sasewaddle-headend 42 access ` +
+		`[access@32473 user_id="u1" username="eve \"the \]admin\\\"" source_ip="10.0.0.5" target_host="db.internal:5432" protocol="TCP" action="deny"] {`
+	if !strings.HasPrefix(string(message), want) {
+		t.Errorf("got  %s\nwant %s...", message, want)
+	}
+}
+
+func TestSetTransportRejectsUnknown(t *testing.T) {
+	s := NewSyslogLogger("localhost", "514")
+	for _, config := range []TransportConfig{
+		{Protocol: "sctp"},
+		{Format: "cef"},
+		{Protocol: ProtocolTLS, CAFile: "/nonexistent/ca.pem"},
+	} {
+		if err := s.SetTransport(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
+
+// readFrame reads one octet-counted message
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+func TestTCPReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	s := NewSyslogLogger(host, port)
+	s.SetWorkers(1)
+	if err := s.SetTransport(TransportConfig{
+		Protocol:   ProtocolTCP,
+		Format:     FormatRFC5424,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LogAccess(AccessLog{UserID: "first"})
+	message, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(message, `user_id="first"`) {
+		t.Errorf("unexpected message %q", message)
+	}
+
+	// The server drops the connection; entries keep coming until one
+	// arrives on the new connection
+	_ = conn.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		s.LogAccess(AccessLog{UserID: fmt.Sprintf("retry-%d", i)})
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := readFrame(bufio.NewReader(conn)); err != nil {
+				t.Fatalf("no message after reconnecting: %v", err)
+			}
+			return
+		case <-deadline:
+			t.Fatal("logger did not reconnect")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestSaturatedQueueDrops(t *testing.T) {
+	// Without workers nothing drains the queue
+	s := NewSyslogLogger("127.0.0.1", "514")
+	s.SetQueueSize(1)
+	dropped := testutil.ToFloat64(syslogDropped)
+
+	s.LogAccess(AccessLog{UserID: "alice"})
+	s.LogAccess(AccessLog{UserID: "bob"})
+	if got := testutil.ToFloat64(syslogDropped) - dropped; got != 1 {
+		t.Errorf("counted %v drops, want 1", got)
+	}
+
+	// LogAccessContext waits for space...
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-s.logQueue
+	}()
+	if err := s.LogAccessContext(context.Background(), AccessLog{UserID: "carol"}); err != nil {
+		t.Fatalf("log after space freed: %v", err)
+	}
+
+	// ...until its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.LogAccessContext(ctx, AccessLog{UserID: "dave"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got %v after the deadline, want ErrQueueFull", err)
+	}
+	if got := testutil.ToFloat64(syslogDropped) - dropped; got != 2 {
+		t.Errorf("counted %v drops, want 2", got)
+	}
+	if entry := <-s.logQueue; entry.UserID != "carol" || s.GetQueueDepth() != 0 {
+		t.Errorf("queued %s, want only carol", entry.UserID)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !minimal
+
+package syslog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	syslogQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_syslog_queue_depth",
+		Help: "Number of access log entries waiting in the syslog queue.",
+	})
+
+	syslogDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_syslog_dropped_total",
+		Help: "Total number of access log entries dropped because the syslog queue was saturated.",
+	})
+
+	syslogSendErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_syslog_send_errors_total",
+		Help: "Total number of access log entries that failed to send to the syslog server.",
+	})
+)
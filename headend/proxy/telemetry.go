@@ -0,0 +1,68 @@
+// Anonymous usage telemetry for the headend.
+//
+// When telemetry.enabled is set, the telemetry package rolls allowed
+// connections up into a daily report; this file supplies the parts only the
+// server knows: which subsystems are enabled and how large the deployment
+// is. Both are reported coarsely, see the telemetry package.
+package main
+
+import (
+	"github.com/spf13/viper"
+)
+
+// enabledFeatures names the subsystems that are enabled, for telemetry
+func (s *ProxyServer) enabledFeatures() []string {
+	enabled := map[string]bool{
+		"firewall":           s.firewallManager != nil,
+		"mirror":             s.mirrorManager != nil,
+		"suricata":           s.mirrorManager != nil && viper.GetBool("mirror.suricata_enabled"),
+		"syslog":             s.syslogLogger != nil,
+		"access_log":         s.accessLog != nil,
+		"tracing":            s.tracer != nil,
+		"event_webhook":      viper.GetString("events.webhook_url") != "",
+		"policy_decisions":   viper.GetBool("decisions.enabled"),
+		"dynamic_ports":      s.portManager != nil,
+		"socks5":             s.socksProxy != nil,
+		"quic":               s.quicServer != nil,
+		"http2":              viper.GetBool("server.http2.enabled"),
+		"mtls":               viper.GetBool("server.mtls.enabled"),
+		"ha":                 s.haPair != nil,
+		"migration":          viper.GetBool("migration.enabled"),
+		"ratelimit":          s.rateLimiter != nil,
+		"egress":             s.egress != nil,
+		"tcp_session_limits": s.connLimits != nil,
+		"probes":             s.prober != nil,
+		"wireguard_router":   s.wgRouter != nil,
+		"admin_api":          viper.GetBool("admin.enabled"),
+		"feature_flags":      s.flagSource != nil,
+		"dns_proxy":          s.dnsProxy != nil,
+		"registration":       s.registration != nil,
+	}
+	enabled["auth_"+viper.GetString("auth.type")] = true
+	enabled["profile_"+buildProfile] = true
+
+	features := make([]string, 0, len(enabled))
+	for feature, on := range enabled {
+		if on {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// telemetryScale reports the size of the deployment, for telemetry
+func (s *ProxyServer) telemetryScale() map[string]int {
+	scale := map[string]int{
+		"active_sessions": s.activeSessions.Len(),
+	}
+	if s.portManager != nil {
+		scale["dynamic_ports"] = s.portManager.GetListenerCount()
+	}
+	if s.firewallManager != nil {
+		scale["firewall_users"] = s.firewallManager.GetRulesCount()
+	}
+	if status := s.wgMonitor.Status(); status != nil {
+		scale["wireguard_peers"] = status.Peers
+	}
+	return scale
+}
@@ -0,0 +1,11 @@
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var reportsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "headend_telemetry_reports_total",
+	Help: "Total anonymous telemetry reports, by result (sent, failed).",
+}, []string{"result"})
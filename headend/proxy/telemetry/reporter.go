@@ -0,0 +1,320 @@
+// Package telemetry implements opt-in anonymous usage reporting for the
+// SASEWaddle headend proxy.
+//
+// The telemetry package provides:
+//   - Daily roll-ups of which features are enabled, the mix of proxied
+//     protocols and the rough scale of the deployment
+//   - k-anonymity: counters are reported only as ranges no narrower than
+//     the minimum count, and protocols seen fewer times are folded together
+//   - A random instance ID that is rotated periodically, so reports can't
+//     be linked over long periods
+//
+// Reports never contain user IDs, addresses, hostnames, targets or policy
+// content. They exist to guide development of the project and are only
+// sent when telemetry is enabled with an endpoint.
+package telemetry
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tobogganing/headend/proxy/events"
+)
+
+const (
+	// SchemaVersion identifies the layout of a Report
+	SchemaVersion = 1
+
+	DefaultInterval   = 24 * time.Hour
+	DefaultMinCount   = 10
+	DefaultIDRotation = 30 * 24 * time.Hour
+
+	// maxUsers bounds the distinct users counted per window; beyond it the
+	// users counter is only a lower bound
+	maxUsers = 100000
+
+	// Protocol mix ratios are rounded to 1/mixSteps, i.e. 5%
+	mixSteps = 20
+)
+
+// protocols are the protocol labels reported by name; anything else counts
+// as other
+var protocols = map[string]bool{
+	"http":   true,
+	"tcp":    true,
+	"udp":    true,
+	"socks5": true,
+	"raw":    true,
+}
+
+// Report is the payload posted once per interval
+type Report struct {
+	SchemaVersion int    `json:"schema_version"`
+	InstanceID    string `json:"instance_id"`
+	Window        string `json:"window"`
+	GoVersion     string `json:"go_version"`
+	Arch          string `json:"arch"`
+	// Features are the names of the enabled subsystems
+	Features []string `json:"features"`
+	// ProtocolMix is the share of allowed connections per protocol, rounded
+	// to 5%. It is empty when too few connections were seen.
+	ProtocolMix map[string]float64 `json:"protocol_mix"`
+	// Scale holds counters as ranges such as "10-99", or "<k" below the
+	// minimum count
+	Scale map[string]string `json:"scale"`
+}
+
+// Config configures a Reporter
+type Config struct {
+	Endpoint string
+	Interval time.Duration
+	// MinCount is k: no counter is reported more precisely than a range
+	// starting at k
+	MinCount   int
+	IDRotation time.Duration
+	// Features returns the names of the enabled subsystems
+	Features func() []string
+	// Scale returns deployment counters, such as listeners or peers
+	Scale func() map[string]int
+}
+
+// Reporter is an event sink that rolls allowed connections up into
+// anonymous reports and posts them to the telemetry endpoint. A nil
+// Reporter reports nothing.
+type Reporter struct {
+	config      Config
+	httpClient  *http.Client
+	instanceID  string
+	rotatedAt   time.Time
+	protocols   map[string]uint64
+	users       map[string]struct{}
+	connections uint64
+	mu          sync.Mutex
+	stopChan    chan struct{}
+}
+
+// New creates a Reporter and starts its reporting loop
+func New(config Config) *Reporter {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.MinCount <= 0 {
+		config.MinCount = DefaultMinCount
+	}
+	if config.IDRotation <= 0 {
+		config.IDRotation = DefaultIDRotation
+	}
+
+	r := &Reporter{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		protocols: make(map[string]uint64),
+		users:     make(map[string]struct{}),
+		stopChan:  make(chan struct{}),
+	}
+	r.rotateID(time.Now())
+	go r.reportLoop()
+	return r
+}
+
+// Name returns the sink name used in metrics
+func (r *Reporter) Name() string {
+	return "telemetry"
+}
+
+// Handle counts an allowed connection in the current window
+func (r *Reporter) Handle(event events.Event) {
+	if event.Type != events.TypeVerdict || !event.Allowed {
+		return
+	}
+
+	protocol := strings.ToLower(event.Protocol)
+	if !protocols[protocol] {
+		protocol = "other"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.connections++
+	r.protocols[protocol]++
+	if len(r.users) < maxUsers && event.UserID != "" {
+		r.users[event.UserID] = struct{}{}
+	}
+}
+
+// Stop ends reporting. The partial window is discarded.
+func (r *Reporter) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.stopChan)
+}
+
+// Preview returns the report the current window would produce, so
+// operators can see exactly what is sent
+func (r *Reporter) Preview() *Report {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.build()
+}
+
+func (r *Reporter) reportLoop() {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// report posts the window's report and starts a new window. A failed post
+// drops the window rather than retrying it.
+func (r *Reporter) report() {
+	r.mu.Lock()
+	report := r.build()
+	r.protocols = make(map[string]uint64)
+	r.users = make(map[string]struct{})
+	r.connections = 0
+	if time.Since(r.rotatedAt) >= r.config.IDRotation {
+		r.rotateID(time.Now())
+	}
+	r.mu.Unlock()
+
+	if err := r.post(report); err != nil {
+		reportsSent.WithLabelValues("failed").Inc()
+		log.Debugf("Failed to send telemetry report: %v", err)
+		return
+	}
+	reportsSent.WithLabelValues("sent").Inc()
+}
+
+// build assembles the report for the current window; r.mu must be held
+func (r *Reporter) build() *Report {
+	k := uint64(r.config.MinCount)
+	report := &Report{
+		SchemaVersion: SchemaVersion,
+		InstanceID:    r.instanceID,
+		Window:        r.config.Interval.String(),
+		GoVersion:     runtime.Version(),
+		Arch:          runtime.GOARCH,
+		Features:      []string{},
+		ProtocolMix:   map[string]float64{},
+		Scale: map[string]string{
+			"connections": Bucket(r.connections, k),
+			"users":       Bucket(uint64(len(r.users)), k),
+		},
+	}
+
+	if r.config.Features != nil {
+		report.Features = append(report.Features, r.config.Features()...)
+		sort.Strings(report.Features)
+	}
+	if r.config.Scale != nil {
+		for name, value := range r.config.Scale() {
+			if value < 0 {
+				value = 0
+			}
+			report.Scale[name] = Bucket(uint64(value), k)
+		}
+	}
+
+	report.ProtocolMix = ProtocolMix(r.protocols, r.connections, k)
+	return report
+}
+
+func (r *Reporter) post(report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	resp, err := r.httpClient.Post(r.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post report: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("telemetry endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// rotateID picks a new random instance ID; r.mu must be held
+func (r *Reporter) rotateID(now time.Time) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Warnf("Failed to generate telemetry instance ID: %v", err)
+	}
+	r.instanceID = hex.EncodeToString(id)
+	r.rotatedAt = now
+}
+
+// Bucket reports n as a power-of-ten range that starts no lower than k,
+// such as "10-99" or "1000-9999", and as "<k" below k
+func Bucket(n, k uint64) string {
+	if n < k {
+		return fmt.Sprintf("<%d", k)
+	}
+	lower := uint64(1)
+	for lower <= n/10 {
+		lower *= 10
+	}
+	upper := lower*10 - 1
+	if lower < k {
+		lower = k
+	}
+	return fmt.Sprintf("%d-%d", lower, upper)
+}
+
+// ProtocolMix returns each protocol's share of total, rounded to 5%.
+// Protocols seen fewer than k times are folded into other, which is itself
+// left out below k, and nothing is reported when total is below k.
+func ProtocolMix(counts map[string]uint64, total, k uint64) map[string]float64 {
+	mix := map[string]float64{}
+	if total == 0 || total < k {
+		return mix
+	}
+
+	var other uint64
+	for protocol, count := range counts {
+		if count < k || protocol == "other" {
+			other += count
+			continue
+		}
+		mix[protocol] = roundRatio(count, total)
+	}
+	if other >= k {
+		mix["other"] = roundRatio(other, total)
+	}
+	return mix
+}
+
+func roundRatio(count, total uint64) float64 {
+	ratio := float64(count) / float64(total)
+	return math.Round(ratio*mixSteps) / mixSteps
+}
@@ -0,0 +1,97 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tobogganing/headend/proxy/events"
+)
+
+func TestBucket(t *testing.T) {
+	cases := []struct {
+		n, k uint64
+		want string
+	}{
+		{0, 10, "<10"},
+		{9, 10, "<10"},
+		{10, 10, "10-99"},
+		{99, 10, "10-99"},
+		{4321, 10, "1000-9999"},
+		{30, 25, "25-99"},
+		{5, 1, "1-9"},
+	}
+	for _, c := range cases {
+		if got := Bucket(c.n, c.k); got != c.want {
+			t.Errorf("Bucket(%d, %d) = %q, want %q", c.n, c.k, got, c.want)
+		}
+	}
+}
+
+func TestProtocolMixFoldsRareProtocols(t *testing.T) {
+	counts := map[string]uint64{"http": 70, "tcp": 24, "udp": 4, "socks5": 2}
+	mix := ProtocolMix(counts, 100, 5)
+
+	if mix["http"] != 0.7 || mix["tcp"] != 0.25 {
+		t.Errorf("unexpected mix %v", mix)
+	}
+	// udp and socks5 are each below k but together reach it
+	if _, ok := mix["udp"]; ok {
+		t.Errorf("expected udp to be folded into other, got %v", mix)
+	}
+	if mix["other"] != 0.05 {
+		t.Errorf("expected other to hold the rare protocols, got %v", mix)
+	}
+
+	if mix := ProtocolMix(counts, 100, 200); len(mix) != 0 {
+		t.Errorf("expected no mix below k connections, got %v", mix)
+	}
+}
+
+func TestReportIsAnonymous(t *testing.T) {
+	received := make(chan Report, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var report Report
+		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+			t.Errorf("invalid report: %v", err)
+		}
+		received <- report
+	}))
+	defer server.Close()
+
+	r := New(Config{
+		Endpoint: server.URL,
+		Interval: time.Hour,
+		MinCount: 3,
+		Features: func() []string { return []string{"mirror", "firewall"} },
+		Scale:    func() map[string]int { return map[string]int{"wireguard_peers": 2} },
+	})
+	defer r.Stop()
+
+	for i := 0; i < 12; i++ {
+		r.Handle(events.Event{Type: events.TypeVerdict, Allowed: true, Protocol: "HTTP", UserID: "alice", TargetHost: "secret.example.com"})
+	}
+	r.Handle(events.Event{Type: events.TypeVerdict, Allowed: false, Protocol: "TCP", UserID: "bob"})
+	r.report()
+
+	report := <-received
+	if report.InstanceID == "" || report.SchemaVersion != SchemaVersion {
+		t.Errorf("unexpected report header %+v", report)
+	}
+	if len(report.Features) != 2 || report.Features[0] != "firewall" {
+		t.Errorf("expected sorted features, got %v", report.Features)
+	}
+	if report.Scale["connections"] != "10-99" || report.Scale["users"] != "<3" || report.Scale["wireguard_peers"] != "<3" {
+		t.Errorf("unexpected scale %v", report.Scale)
+	}
+	if report.ProtocolMix["http"] != 1 {
+		t.Errorf("unexpected protocol mix %v", report.ProtocolMix)
+	}
+
+	// The window starts over after a report
+	if preview := r.Preview(); preview.Scale["connections"] != "<3" {
+		t.Errorf("expected an empty window, got %v", preview.Scale)
+	}
+}
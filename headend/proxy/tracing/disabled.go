@@ -0,0 +1,37 @@
+//go:build minimal
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errNotBuilt is returned by a headend built with the minimal profile,
+// which leaves the OpenTelemetry SDK and exporter out
+var errNotBuilt = errors.New("tracing is not included in the minimal build")
+
+// Tracer stands in for the tracer in the minimal build. It never exports
+// anything.
+type Tracer struct{}
+
+func New(config Config) (*Tracer, error) {
+	return nil, errNotBuilt
+}
+
+func (t *Tracer) Endpoint() string {
+	return ""
+}
+
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// SetDefault leaves the global no-op provider in place
+func SetDefault(t *Tracer) {}
+
+// Transport returns next; there are no spans to propagate
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return next
+}
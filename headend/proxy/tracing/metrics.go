@@ -0,0 +1,38 @@
+//go:build !minimal
+
+package tracing
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	spansExported = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_tracing_spans_exported_total",
+		Help: "Total number of spans exported to the OTLP collector.",
+	})
+
+	exportErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "headend_tracing_export_errors_total",
+		Help: "Total number of span batches that could not be exported.",
+	})
+)
+
+// countingExporter counts the spans its exporter delivers and the batches
+// it fails to
+type countingExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (e countingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if err := e.SpanExporter.ExportSpans(ctx, spans); err != nil {
+		exportErrors.Inc()
+		return err
+	}
+	spansExported.Add(float64(len(spans)))
+	return nil
+}
@@ -0,0 +1,133 @@
+//go:build !minimal
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Tracer owns the TracerProvider that samples and exports the proxy's spans
+type Tracer struct {
+	endpoint string
+	provider *sdktrace.TracerProvider
+}
+
+// New creates a Tracer exporting to the OTLP/HTTP collector at
+// config.Endpoint
+func New(config Config) (*Tracer, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("no OTLP endpoint configured")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint %q is not an http(s) URL", config.Endpoint)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(config.Endpoint, "/")+"/v1/traces"),
+		otlptracehttp.WithHeaders(config.Headers),
+		otlptracehttp.WithTimeout(config.Timeout),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	t, err := newTracer(config, countingExporter{exporter})
+	if err != nil {
+		return nil, err
+	}
+	t.endpoint = config.Endpoint
+	return t, nil
+}
+
+// newTracer creates a Tracer batching spans into exporter
+func newTracer(config Config, exporter sdktrace.SpanExporter) (*Tracer, error) {
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio %v is not between 0 and 1", config.SampleRatio)
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = DefaultServiceName
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithHost(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(config.ServiceName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxExportBatchSize(config.BatchSize),
+			sdktrace.WithMaxQueueSize(config.QueueSize),
+			sdktrace.WithBatchTimeout(config.FlushInterval),
+		),
+	)
+	return &Tracer{provider: provider}, nil
+}
+
+// Endpoint returns the collector URL spans are exported to
+func (t *Tracer) Endpoint() string {
+	return t.endpoint
+}
+
+// Shutdown exports the spans still queued and stops the provider
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// SetDefault installs t as the global TracerProvider, with W3C Trace
+// Context propagation. A nil t disables tracing.
+func SetDefault(t *Tracer) {
+	if t == nil {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("Tracing error: %v", err)
+	}))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(t.provider)
+}
+
+// Transport wraps next so each upstream request is traced as a client span
+// of the span in its context, and carries that span in its traceparent
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next,
+		otelhttp.WithSpanNameFormatter(func(string, *http.Request) string {
+			return "upstream.request"
+		}),
+	)
+}
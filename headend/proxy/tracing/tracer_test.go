@@ -0,0 +1,231 @@
+//go:build !minimal
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func newTestTracer(t *testing.T, ratio float64) (*Tracer, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tracer, err := newTracer(Config{SampleRatio: ratio}, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDefault(tracer)
+	t.Cleanup(func() {
+		SetDefault(nil)
+		_ = tracer.Shutdown(context.Background())
+	})
+	return tracer, exporter
+}
+
+// spansByName returns the spans exported so far. Tests flush the provider
+// rather than shut it down, which would clear the exporter.
+func spansByName(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestTracePropagation(t *testing.T) {
+	tracer, exporter := newTestTracer(t, 0)
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	// The client's sampling decision wins over the ratio of 0
+	incoming := http.Header{}
+	incoming.Set("traceparent", testTraceparent)
+	ctx, server := Start(Extract(context.Background(), incoming), "proxy.http", trace.SpanKindServer, attribute.String("user.id", "alice"))
+	if TraceIDFromContext(ctx) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace not continued: %q", TraceIDFromContext(ctx))
+	}
+
+	_, check := Start(ctx, "firewall.decide", trace.SpanKindInternal)
+	check.SetAttributes(attribute.Bool("firewall.allowed", true))
+	check.End()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+	resp, err := (&http.Client{Transport: Transport(http.DefaultTransport)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	server.End()
+
+	if err := tracer.provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := spansByName(exporter)
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans: %v", len(spans), spans)
+	}
+	root, firewall, client := spans["proxy.http"], spans["firewall.decide"], spans["upstream.request"]
+	if root.Parent.SpanID().String() != "00f067aa0ba902b7" || !root.Parent.IsRemote() || root.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span: parent %v kind %v", root.Parent, root.SpanKind)
+	}
+	if firewall.Parent.SpanID() != root.SpanContext.SpanID() || client.Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Errorf("children not parented to the server span")
+	}
+	if client.SpanKind != trace.SpanKindClient {
+		t.Errorf("upstream request span kind %v", client.SpanKind)
+	}
+	for _, span := range []tracetest.SpanStub{root, firewall, client} {
+		if span.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s in trace %s", span.Name, span.SpanContext.TraceID())
+		}
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanContext.SpanID().String() + "-01"; upstreamTraceparent != want {
+		t.Errorf("upstream got traceparent %q, want %q", upstreamTraceparent, want)
+	}
+}
+
+func TestUnsampledTrace(t *testing.T) {
+	tracer, exporter := newTestTracer(t, 0)
+
+	ctx, span := Start(context.Background(), "proxy.tcp", trace.SpanKindServer)
+	if span.SpanContext().IsSampled() || TraceIDFromContext(ctx) != "" {
+		t.Error("sampled at a ratio of 0")
+	}
+
+	// Unsampled traces still propagate, flagged as not sampled
+	header := http.Header{}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+	sc := trace.SpanContextFromContext(Extract(context.Background(), header))
+	if !sc.IsValid() || sc.IsSampled() || sc.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("injected %q", header.Get("traceparent"))
+	}
+	span.End()
+
+	if err := tracer.provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("exported unsampled spans: %v", spans)
+	}
+
+	// Disabled tracing hands out spans that record nothing
+	SetDefault(nil)
+	_, span = Start(context.Background(), "proxy.tcp", trace.SpanKindServer)
+	span.SetAttributes(attribute.String("k", "v"))
+	RecordError(span, context.Canceled)
+	span.End()
+	if span.IsRecording() || span.SpanContext().IsValid() {
+		t.Error("span recorded while tracing is disabled")
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	tracer, exporter := newTestTracer(t, 1)
+
+	_, span := Start(context.Background(), "upstream.dial", trace.SpanKindClient)
+	RecordError(span, nil)
+	RecordError(span, errors.New("connection refused"))
+	span.End()
+
+	if err := tracer.provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dial := spansByName(exporter)["upstream.dial"]
+	if dial.Status.Code != codes.Error || dial.Status.Description != "connection refused" {
+		t.Errorf("status %+v, want the error", dial.Status)
+	}
+	if len(dial.Events) != 1 || dial.Events[0].Name != "exception" {
+		t.Errorf("events %+v, want one exception", dial.Events)
+	}
+}
+
+func TestExportOverOTLPHTTP(t *testing.T) {
+	requests := make(chan *collectortrace.ExportTraceServiceRequest, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	tracer, err := New(Config{
+		Endpoint:    collector.URL + "/",
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		ServiceName: "headend-test",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracer.Endpoint() != collector.URL+"/" {
+		t.Errorf("endpoint %q", tracer.Endpoint())
+	}
+	SetDefault(tracer)
+	t.Cleanup(func() { SetDefault(nil) })
+
+	_, span := Start(context.Background(), "proxy.udp", trace.SpanKindServer)
+	span.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case req := <-requests:
+		rs := req.GetResourceSpans()
+		if len(rs) != 1 || len(rs[0].GetScopeSpans()) != 1 || rs[0].GetScopeSpans()[0].GetSpans()[0].GetName() != "proxy.udp" {
+			t.Fatalf("unexpected export %v", req)
+		}
+		var service string
+		for _, attr := range rs[0].GetResource().GetAttributes() {
+			if attr.GetKey() == "service.name" {
+				service = attr.GetValue().GetStringValue()
+			}
+		}
+		if service != "headend-test" {
+			t.Errorf("service.name %q, want headend-test", service)
+		}
+	default:
+		t.Fatal("no spans reached the collector")
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	for _, config := range []Config{
+		{},
+		{Endpoint: "collector:4318"},
+		{Endpoint: "grpc://collector:4317"},
+		{Endpoint: "http://collector:4318", SampleRatio: 1.5},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("accepted %+v", config)
+		}
+	}
+}
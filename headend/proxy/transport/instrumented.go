@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// instrumentedTransport records connection reuse, TLS resumption and the
+// time to response headers for every request made through its class's
+// transport
+type instrumentedTransport struct {
+	class  string
+	base   *http.Transport
+	h2     *http2.Transport
+	h2c    bool
+	total  atomic.Int64
+	reused atomic.Int64
+}
+
+func newInstrumentedTransport(class string, s Settings) *instrumentedTransport {
+	tlsConfig := newTLSConfig(s)
+	return &instrumentedTransport{
+		class: class,
+		base:  newHTTPTransport(s, tlsConfig),
+		h2:    newHTTP2Transport(s, tlsConfig),
+		h2c:   s.H2C,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.recordConn(info.Reused)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				upstreamTLSHandshakes.WithLabelValues(t.class, strconv.FormatBool(state.DidResume)).Inc()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	// h2c targets only speak HTTP/2, and gRPC needs it end to end
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	if t.h2c || IsGRPC(req) {
+		upstreamHTTP2Requests.WithLabelValues(t.class).Inc()
+		resp, err = t.h2.RoundTrip(req)
+	} else {
+		resp, err = t.base.RoundTrip(req)
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	upstreamResponseDuration.WithLabelValues(t.class, result).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+func (t *instrumentedTransport) recordConn(reused bool) {
+	upstreamConnections.WithLabelValues(t.class, strconv.FormatBool(reused)).Inc()
+
+	total := t.total.Add(1)
+	reusedCount := t.reused.Load()
+	if reused {
+		reusedCount = t.reused.Add(1)
+	}
+	upstreamReuseRatio.WithLabelValues(t.class).Set(float64(reusedCount) / float64(total))
+}
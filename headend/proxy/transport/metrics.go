@@ -0,0 +1,34 @@
+package transport
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_connections_total",
+		Help: "Total upstream connections obtained by the reverse proxy, by transport class and whether an idle connection was reused.",
+	}, []string{"class", "reused"})
+
+	upstreamResponseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "headend_upstream_response_seconds",
+		Help:    "Time from sending a request upstream to receiving the response headers, by transport class and result (ok, error).",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"class", "result"})
+
+	upstreamReuseRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_upstream_connection_reuse_ratio",
+		Help: "Fraction of upstream connections served from the idle pool since startup, by transport class.",
+	}, []string{"class"})
+
+	upstreamTLSHandshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_tls_handshakes_total",
+		Help: "Total upstream TLS handshakes, by transport class and whether the session was resumed.",
+	}, []string{"class", "resumed"})
+
+	upstreamHTTP2Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_http2_requests_total",
+		Help: "Total upstream requests sent over the HTTP/2-only transport (gRPC and h2c targets), by transport class.",
+	}, []string{"class"})
+)
@@ -0,0 +1,260 @@
+// Package transport implements tunable upstream HTTP transports for the
+// SASEWaddle headend proxy.
+//
+// The transport package provides:
+//   - Configurable connection pooling, HTTP/2 and TLS session resumption
+//     settings for the reverse proxy
+//   - HTTP/2 for gRPC requests, over TLS or cleartext (h2c), so streams and
+//     trailers survive the hop to the target
+//   - Target classes, so high fan-in internal apps can be tuned separately
+//     from general internet traffic
+//   - One shared transport per class, so every target in a class draws from
+//     the same connection pool
+//   - Metrics on connection reuse and TLS session resumption per class
+//   - TLS session warming, so the first request to a popular target
+//     resumes a session instead of paying a full handshake
+//
+// Targets are matched to classes by host: exact names or "*.suffix"
+// patterns. Targets matching no class use the default settings.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// DefaultClass names the transport used for targets matching no class
+const DefaultClass = "default"
+
+// Settings are the tuning knobs of one upstream transport
+type Settings struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	ForceAttemptHTTP2   bool
+	// TLSSessionCacheSize enables TLS session resumption with an LRU cache
+	// of this many sessions; zero disables resumption
+	TLSSessionCacheSize int
+	SkipTLSVerify       bool
+	// H2C speaks HTTP/2 without TLS to the targets, for internal gRPC
+	// services that don't terminate TLS themselves
+	H2C bool
+	// DialContext replaces the default dialer, e.g. to use pre-resolved
+	// addresses
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Class overrides the default settings for a group of targets. Zero values
+// (and a nil ForceAttemptHTTP2 or H2C) inherit the default.
+type Class struct {
+	Name                string        `mapstructure:"name"`
+	Hosts               []string      `mapstructure:"hosts"`
+	MaxIdleConns        int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+	ForceAttemptHTTP2   *bool         `mapstructure:"force_attempt_http2"`
+	TLSSessionCacheSize int           `mapstructure:"tls_session_cache_size"`
+	H2C                 *bool         `mapstructure:"h2c"`
+}
+
+// Pool holds one instrumented transport per class
+type Pool struct {
+	classes    []Class
+	transports map[string]*instrumentedTransport
+}
+
+// NewPool builds the default transport and one transport per class
+func NewPool(defaults Settings, classes []Class) (*Pool, error) {
+	p := &Pool{
+		classes:    classes,
+		transports: make(map[string]*instrumentedTransport, len(classes)+1),
+	}
+	p.transports[DefaultClass] = newInstrumentedTransport(DefaultClass, defaults)
+
+	for _, class := range classes {
+		if class.Name == "" || class.Name == DefaultClass {
+			return nil, fmt.Errorf("transport class name %q is empty or reserved", class.Name)
+		}
+		if _, exists := p.transports[class.Name]; exists {
+			return nil, fmt.Errorf("duplicate transport class %q", class.Name)
+		}
+		if len(class.Hosts) == 0 {
+			return nil, fmt.Errorf("transport class %q matches no hosts", class.Name)
+		}
+		p.transports[class.Name] = newInstrumentedTransport(class.Name, class.apply(defaults))
+	}
+
+	return p, nil
+}
+
+// Classify returns the class a target (host or host:port) belongs to
+func (p *Pool) Classify(target string) string {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, class := range p.classes {
+		for _, pattern := range class.Hosts {
+			if matchHost(strings.ToLower(pattern), host) {
+				return class.Name
+			}
+		}
+	}
+	return DefaultClass
+}
+
+// ForTarget returns the transport for a target's class
+func (p *Pool) ForTarget(target string) http.RoundTripper {
+	return p.transports[p.Classify(target)]
+}
+
+// CloseIdleConnections closes idle connections in every class
+func (p *Pool) CloseIdleConnections() {
+	for _, t := range p.transports {
+		t.base.CloseIdleConnections()
+		t.h2.CloseIdleConnections()
+	}
+}
+
+// WarmTLS completes a TLS handshake with target through its class's session
+// cache, so the class's next connection to it resumes the session. It
+// returns false without dialing if the class keeps no sessions or speaks
+// h2c.
+func (p *Pool) WarmTLS(ctx context.Context, target string) (bool, error) {
+	t := p.transports[p.Classify(target)]
+	tlsConfig := t.base.TLSClientConfig
+	if t.h2c || tlsConfig == nil || tlsConfig.ClientSessionCache == nil {
+		return false, nil
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false, err
+	}
+
+	// Not the class's dialer: a warming dial isn't traffic, and mustn't
+	// count towards the target's popularity
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return false, err
+	}
+
+	// Sessions are cached by server name, which the transport sets to the
+	// target's host
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = host
+	tlsConn := tls.Client(conn, tlsConfig)
+	defer tlsConn.Close()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return false, err
+	}
+
+	// TLS 1.3 servers send session tickets after the handshake, and the
+	// client only caches them once it reads
+	if tlsConn.ConnectionState().Version >= tls.VersionTLS13 {
+		_ = tlsConn.SetReadDeadline(time.Now().Add(ticketWait))
+		_, _ = tlsConn.Read(make([]byte, 1))
+	}
+	return true, nil
+}
+
+// ticketWait is how long WarmTLS waits for TLS 1.3 session tickets
+const ticketWait = 250 * time.Millisecond
+
+// Classes returns the configured class names, default first
+func (p *Pool) Classes() []string {
+	names := []string{DefaultClass}
+	for _, class := range p.classes {
+		names = append(names, class.Name)
+	}
+	return names
+}
+
+func (c Class) apply(defaults Settings) Settings {
+	s := defaults
+	if c.MaxIdleConns > 0 {
+		s.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		s.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		s.IdleConnTimeout = c.IdleConnTimeout
+	}
+	if c.ForceAttemptHTTP2 != nil {
+		s.ForceAttemptHTTP2 = *c.ForceAttemptHTTP2
+	}
+	if c.TLSSessionCacheSize > 0 {
+		s.TLSSessionCacheSize = c.TLSSessionCacheSize
+	}
+	if c.H2C != nil {
+		s.H2C = *c.H2C
+	}
+	return s
+}
+
+func newTLSConfig(s Settings) *tls.Config {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: s.SkipTLSVerify,
+	}
+	if s.TLSSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(s.TLSSessionCacheSize)
+	}
+	return tlsConfig
+}
+
+func newHTTPTransport(s Settings, tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        s.MaxIdleConns,
+		MaxIdleConnsPerHost: s.MaxIdleConnsPerHost,
+		IdleConnTimeout:     s.IdleConnTimeout,
+		ForceAttemptHTTP2:   s.ForceAttemptHTTP2,
+		DialContext:         s.DialContext,
+	}
+}
+
+// newHTTP2Transport builds the HTTP/2-only transport gRPC requests use, as
+// gRPC can't be downgraded to HTTP/1.1. With H2C the connection is plain
+// TCP with prior knowledge; the proxy still addresses targets as https.
+func newHTTP2Transport(s Settings, tlsConfig *tls.Config) *http2.Transport {
+	t := &http2.Transport{
+		TLSClientConfig: tlsConfig.Clone(),
+		IdleConnTimeout: s.IdleConnTimeout,
+	}
+	if s.H2C {
+		dial := s.DialContext
+		if dial == nil {
+			dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+			dial = dialer.DialContext
+		}
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	}
+	return t
+}
+
+// IsGRPC reports whether r is a gRPC call
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// matchHost matches exact hosts and "*.suffix" patterns; the bare suffix
+// itself also matches a wildcard pattern
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
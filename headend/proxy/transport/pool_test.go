@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcHandler answers like a gRPC server: a body followed by the status
+// in a trailer
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Header().Set("X-Proto", r.Proto)
+	_, _ = io.WriteString(w, "reply")
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func grpcRequest(t *testing.T, rawURL string) *http.Request {
+	t.Helper()
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("bad URL: %v", err)
+	}
+	target.Scheme = "https" // the proxy always addresses targets as https
+	req, err := http.NewRequest(http.MethodPost, target.String()+"/pkg.Service/Method", strings.NewReader("call"))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	return req
+}
+
+func assertGRPCResponse(t *testing.T, resp *http.Response) {
+	t.Helper()
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if resp.ProtoMajor != 2 || resp.Header.Get("X-Proto") != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2 end to end, got %s (server saw %s)", resp.Proto, resp.Header.Get("X-Proto"))
+	}
+	if string(body) != "reply" {
+		t.Errorf("expected body %q, got %q", "reply", body)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("expected trailer Grpc-Status 0, got %q", status)
+	}
+}
+
+func TestGRPCOverTLSUsesHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(grpcHandler))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	pool, err := NewPool(Settings{SkipTLSVerify: true}, nil)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.CloseIdleConnections()
+
+	resp, err := pool.ForTarget(server.Listener.Addr().String()).RoundTrip(grpcRequest(t, server.URL))
+	if err != nil {
+		t.Fatalf("gRPC request failed: %v", err)
+	}
+	assertGRPCResponse(t, resp)
+
+	// Other requests keep the configured HTTP/1.1 behavior
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err = pool.ForTarget(server.Listener.Addr().String()).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("plain request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("expected HTTP/1.1 for a plain request, got %s", resp.Proto)
+	}
+}
+
+func TestH2CClass(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(grpcHandler), &http2.Server{}))
+	defer server.Close()
+
+	enabled := true
+	pool, err := NewPool(Settings{}, []Class{{Name: "grpc", Hosts: []string{"127.0.0.1"}, H2C: &enabled}})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.CloseIdleConnections()
+
+	target := server.Listener.Addr().String()
+	if class := pool.Classify(target); class != "grpc" {
+		t.Fatalf("expected class grpc, got %s", class)
+	}
+
+	resp, err := pool.ForTarget(target).RoundTrip(grpcRequest(t, server.URL))
+	if err != nil {
+		t.Fatalf("h2c request failed: %v", err)
+	}
+	assertGRPCResponse(t, resp)
+}
+
+func TestWarmTLSResumesFirstRequest(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	target := server.Listener.Addr().String()
+
+	pool, err := NewPool(Settings{SkipTLSVerify: true, TLSSessionCacheSize: 8}, nil)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.CloseIdleConnections()
+
+	warmed, err := pool.WarmTLS(context.Background(), target)
+	if err != nil || !warmed {
+		t.Fatalf("WarmTLS = %v, %v", warmed, err)
+	}
+
+	var resumed bool
+	trace := &httptrace.ClientTrace{TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+		resumed = err == nil && state.DidResume
+	}}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, server.URL, nil)
+	resp, err := pool.ForTarget(target).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if !resumed {
+		t.Error("expected the first request to resume the warmed session")
+	}
+
+	// Without a session cache there is nothing to warm
+	pool, err = NewPool(Settings{SkipTLSVerify: true}, nil)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	if warmed, err := pool.WarmTLS(context.Background(), target); warmed || err != nil {
+		t.Errorf("WarmTLS without a session cache = %v, %v", warmed, err)
+	}
+}
@@ -0,0 +1,73 @@
+// Runtime tuning profiles for the headend.
+//
+// performance.profile picks defaults for the hardware the headend runs on.
+// The default profile suits servers. The edge profile suits small ARM64 and
+// 32-bit ARM branch-office gateways with a few cores and little memory:
+// smaller relay buffers, queues and connection pools, one worker per pool,
+// and no per-packet JSON envelope for Suricata. Anything configured
+// explicitly still wins over the profile.
+//
+// Worker pools left at 0 are sized to GOMAXPROCS, which performance.gomaxprocs
+// can lower below the core count, e.g. to leave a core to the kernel's
+// WireGuard and routing work.
+//
+// The benchmarks behind the edge defaults run with `make bench-headend`, or
+// on the gateway itself with the test binaries `make bench-headend-arm`
+// cross-compiles. Measured results are in docs/ARCHITECTURE.md.
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/tobogganing/headend/proxy/protocol"
+)
+
+// tuningProfiles are the defaults each performance.profile applies on top
+// of the ones in initConfig
+var tuningProfiles = map[string]map[string]interface{}{
+	"default": {},
+	"edge": {
+		"performance.relay_buffer_size":           8 * 1024,
+		"mirror.buffer_size":                      256,
+		"mirror.workers":                          1,
+		"mirror.suricata_json":                    false,
+		"mirror.kafka.max_pending":                2000,
+		"mirror.spill.max_size":                   32 << 20,
+		"syslog.workers":                          1,
+		"syslog.queue_size":                       256,
+		"server.udp.max_flows":                    4096,
+		"server.http2.max_concurrent_streams":     100,
+		"proxy.transport.max_idle_conns":          20,
+		"proxy.transport.max_idle_conns_per_host": 4,
+	},
+}
+
+// applyTuningProfile sets the defaults of the configured profile. It runs
+// after the config file is read, since the profile may be set there.
+func applyTuningProfile() {
+	for key, value := range tuningProfiles[viper.GetString("performance.profile")] {
+		viper.SetDefault(key, value)
+	}
+}
+
+// applyRuntimeTuning checks the profile and applies the settings that are
+// process-wide rather than owned by one subsystem
+func applyRuntimeTuning() error {
+	profile := viper.GetString("performance.profile")
+	if _, ok := tuningProfiles[profile]; !ok {
+		return fmt.Errorf("unknown performance.profile %q", profile)
+	}
+
+	if procs := viper.GetInt("performance.gomaxprocs"); procs > 0 {
+		runtime.GOMAXPROCS(procs)
+	}
+	protocol.SetRelayBufferSize(viper.GetInt("performance.relay_buffer_size"))
+
+	log.Infof("Performance profile %s on %s/%s with GOMAXPROCS %d",
+		profile, runtime.GOOS, runtime.GOARCH, runtime.GOMAXPROCS(0))
+	return nil
+}
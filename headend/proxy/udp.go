@@ -0,0 +1,189 @@
+// UDP relay for the UDP proxy port and the dynamic UDP ports.
+//
+// Every datagram from a client is framed with its token and target (see
+// libs/framing). Datagrams are grouped into flows by client address and
+// target: the first datagram of a flow is authenticated and checked against
+// the firewall, after which the flow relays datagrams both ways over one
+// upstream socket until it goes idle. Responses leave through the socket
+// the client sent to, so the client sees them come from the address it used.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"github.com/tobogganing/headend/proxy/connctx"
+	"github.com/tobogganing/headend/proxy/tracing"
+	"github.com/tobogganing/headend/proxy/udpflow"
+	"github.com/tobogganing/libs/framing"
+)
+
+// newUDPProxy creates a UDP relay for conn, or for the dynamic ports when
+// conn is nil. name labels its flow metrics.
+func (s *ProxyServer) newUDPProxy(conn *net.UDPConn, name string) *UDPProxy {
+	return &UDPProxy{
+		conn:            conn,
+		authProvider:    s.authProvider,
+		mirrorManager:   s.mirrorManager,
+		firewallManager: s.firewallManager,
+		eventBus:        s.eventBus,
+		wgRouter:        s.wgRouter,
+		rateLimiter:     s.rateLimiter,
+		egress:          s.egress,
+		sessionCaps:     s.sessionCaps,
+		activeSessions:  s.activeSessions,
+		flows: udpflow.NewTable(name, viper.GetDuration("server.udp.idle_timeout"),
+			viper.GetInt("server.udp.max_flows")),
+	}
+}
+
+// Start relays datagrams received on the UDP proxy port until it is closed
+func (u *UDPProxy) Start() {
+	log.Info("Starting UDP proxy server")
+
+	buffer := make([]byte, 65536)
+	for {
+		n, clientAddr, err := u.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("UDP read error: %v", err)
+			continue
+		}
+
+		// The buffer is reused for the next read
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		u.deliver(u.conn, packet, clientAddr, 0)
+	}
+}
+
+// handleDynamicUDPPacket relays a datagram received on a dynamic UDP port
+func (s *ProxyServer) handleDynamicUDPPacket(conn *net.UDPConn, data []byte, addr *net.UDPAddr, port int) {
+	s.dynamicUDP.deliver(conn, data, addr, port)
+}
+
+// deliver hands a datagram received on conn to its flow. port is the
+// dynamic port it arrived on, or 0 for the UDP proxy port.
+func (u *UDPProxy) deliver(conn *net.UDPConn, data []byte, from *net.UDPAddr, port int) {
+	header, payload, err := framing.Decode(data)
+	if err != nil {
+		log.Errorf("Invalid UDP packet header from %s: %v", from, err)
+		return
+	}
+
+	key := udpflow.Key{Client: from.String(), Target: header.Target}
+	datagram := udpflow.Datagram{From: from, Token: header.Token, Payload: payload}
+	u.flows.Deliver(key, datagram, func(ctx context.Context, key udpflow.Key, first udpflow.Datagram) (*udpflow.Session, error) {
+		return u.openFlow(ctx, conn, port, key, first)
+	})
+}
+
+// openFlow authenticates and authorizes the first datagram of a flow and
+// connects to its target
+func (u *UDPProxy) openFlow(flowCtx context.Context, conn *net.UDPConn, port int, key udpflow.Key, first udpflow.Datagram) (*udpflow.Session, error) {
+	// Flows can last indefinitely, so the span covers opening the flow
+	ctx, span := traceConnection(flowCtx, "UDP", key.Client, port)
+	span.SetAttributes(attribute.String("server.address", key.Target))
+	defer span.End()
+
+	user, err := u.authProvider.ValidateToken(first.Token)
+	if err != nil {
+		log.Errorf("UDP authentication failed: %v", err)
+		tracing.RecordError(span, err)
+		u.eventBus.Publish(authEvent(nil, "UDP", key.Client, err))
+		connctx.RecordDenial("UDP", connctx.DenyAuth)
+		return nil, fmt.Errorf("authentication failed: %w", err)
+	}
+	span.SetAttributes(attribute.String("enduser.id", user.ID))
+
+	ctx = connctx.WithMeta(ctx, connctx.Meta{
+		User:       user,
+		Protocol:   "UDP",
+		SourceIP:   key.Client,
+		TargetHost: key.Target,
+	})
+	logger := connctx.Logger(ctx)
+
+	decision := decideAccess(ctx, u.firewallManager)
+	u.eventBus.Publish(verdictEvent(ctx, port, decision))
+	if !decision.Allowed {
+		logger.Warnf("Firewall blocked UDP flow for user %s to %s (%s)", user.ID, key.Target, decision.Reason)
+		// The denial takes the place of the first response
+		if frame := denialFrame(ctx, u.sessionCaps, decision); frame != nil {
+			_, _ = conn.WriteToUDP(frame, first.From)
+		}
+		return nil, fmt.Errorf("blocked by firewall")
+	}
+
+	targetConn, err := connctx.Dial(ctx, "udp", key.Target)
+	if err != nil {
+		logger.Errorf("Failed to connect to target %s: %v", key.Target, err)
+		return nil, err
+	}
+	logger.Infof("UDP flow opened for user %s to %s", user.ID, key.Target)
+	// Closing the target connection ends the flow
+	remove := u.activeSessions.Add(activeSession(ctx, "udp", port), func() { _ = targetConn.Close() })
+
+	token := first.Token
+	// Mirror the resolved target, so mirror filters can match its address
+	target := targetConn.RemoteAddr().String()
+	return &udpflow.Session{
+		Conn: targetConn,
+		Forward: func(datagram udpflow.Datagram) bool {
+			// A renewed token must still belong to the flow's user
+			if datagram.Token != token {
+				renewed, err := u.authProvider.ValidateToken(datagram.Token)
+				if err != nil || renewed.ID != user.ID {
+					logger.Warnf("Dropped UDP datagram with a token not valid for user %s", user.ID)
+					return false
+				}
+				token = datagram.Token
+			}
+
+			// Datagrams over the user's bandwidth limit are dropped
+			if !u.rateLimiter.Allow(user.ID, len(datagram.Payload)) {
+				logger.Debugf("Rate limit dropped UDP packet for user %s to %s", user.ID, key.Target)
+				return false
+			}
+			if !u.egress.Allow("udp", len(datagram.Payload)) {
+				logger.Debugf("Egress cap dropped UDP packet for user %s to %s", user.ID, key.Target)
+				return false
+			}
+
+			if u.mirrorManager != nil {
+				u.mirrorManager.MirrorUDPContext(ctx, key.Client, target, datagram.Payload)
+			}
+			return true
+		},
+		Return: func(payload []byte) {
+			if !u.rateLimiter.Allow(user.ID, len(payload)) {
+				logger.Debugf("Rate limit dropped UDP response for user %s from %s", user.ID, key.Target)
+				return
+			}
+			if !u.egress.Allow("udp", len(payload)) {
+				logger.Debugf("Egress cap dropped UDP response for user %s from %s", user.ID, key.Target)
+				return
+			}
+
+			if _, err := conn.WriteToUDP(payload, first.From); err != nil {
+				logger.Debugf("Failed to write UDP response to client: %v", err)
+				return
+			}
+
+			if u.mirrorManager != nil {
+				u.mirrorManager.MirrorUDPContext(ctx, target, key.Client, payload)
+			}
+		},
+		Closed: func() {
+			remove()
+			logger.Debugf("UDP flow closed for user %s to %s", user.ID, key.Target)
+		},
+	}, nil
+}
@@ -0,0 +1,28 @@
+package udpflow
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	flowsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_udp_flows_active",
+		Help: "Number of open UDP flows, by listener (static, dynamic).",
+	}, []string{"listener"})
+
+	flowsOpened = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_udp_flows_total",
+		Help: "Total UDP flows opened, by listener.",
+	}, []string{"listener"})
+
+	flowsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_udp_flows_expired_total",
+		Help: "Total UDP flows closed after their idle timeout, by listener.",
+	}, []string{"listener"})
+
+	flowDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_udp_flow_dropped_packets_total",
+		Help: "Total UDP datagrams dropped by the flow table, by listener and reason (table_full, queue_full).",
+	}, []string{"listener", "reason"})
+)
@@ -0,0 +1,252 @@
+// Package udpflow tracks UDP flows through the SASEWaddle headend proxy.
+//
+// The udpflow package provides:
+//   - A flow table keyed by client address and target, so the datagrams of
+//     one exchange share a single upstream socket
+//   - A goroutine per flow that forwards client datagrams in order and
+//     another that routes every target datagram back to the client
+//   - Idle timeouts, after which a flow and its upstream socket are closed
+//   - A bound on the number of flows and on datagrams queued per flow
+//
+// Only the first datagram of a flow pays for authentication, policy and
+// the upstream dial; the rest go straight to the open socket. Responses are
+// not limited to one per request, so DNS, RTP, QUIC and game traffic work.
+package udpflow
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultIdleTimeout closes flows without traffic in either direction
+	DefaultIdleTimeout = 60 * time.Second
+
+	// DefaultMaxFlows bounds the flow table
+	DefaultMaxFlows = 65536
+
+	// queueLength is the number of client datagrams buffered per flow while
+	// it is being opened or its target is slow
+	queueLength = 64
+
+	// maxDatagram is the largest UDP payload
+	maxDatagram = 65535
+)
+
+// Key identifies a flow
+type Key struct {
+	Client string // client address as host:port
+	Target string // target as host:port
+}
+
+// Datagram is one datagram from the client
+type Datagram struct {
+	From    *net.UDPAddr
+	Token   string // credential the datagram was framed with
+	Payload []byte
+}
+
+// Session is what the proxy attaches to an open flow
+type Session struct {
+	// Conn is the connected socket to the target
+	Conn net.Conn
+	// Forward is called with each client datagram before it is sent to the
+	// target, including the first; false drops the datagram
+	Forward func(Datagram) bool
+	// Return sends a datagram from the target back to the client
+	Return func(payload []byte)
+	// Closed, if set, is called once the flow is closed
+	Closed func()
+}
+
+// Opener authenticates and authorizes the first datagram of a flow and
+// dials its target. ctx is cancelled when the flow closes.
+type Opener func(ctx context.Context, key Key, first Datagram) (*Session, error)
+
+// Table is a bounded set of UDP flows
+type Table struct {
+	name        string
+	idleTimeout time.Duration
+	maxFlows    int
+	flows       map[Key]*flow
+	closed      bool
+	mu          sync.Mutex
+}
+
+type flow struct {
+	key        Key
+	queue      chan Datagram
+	lastActive atomic.Int64
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewTable creates a flow table. name labels its metrics; zero values
+// select the defaults.
+func NewTable(name string, idleTimeout time.Duration, maxFlows int) *Table {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	if maxFlows <= 0 {
+		maxFlows = DefaultMaxFlows
+	}
+	return &Table{
+		name:        name,
+		idleTimeout: idleTimeout,
+		maxFlows:    maxFlows,
+		flows:       make(map[Key]*flow),
+	}
+}
+
+// Deliver queues a datagram on its flow, opening the flow with open if it
+// is new. The payload must not be reused by the caller. Deliver never
+// blocks: datagrams are dropped when the flow's queue or the table is full.
+func (t *Table) Deliver(key Key, datagram Datagram, open Opener) {
+	t.mu.Lock()
+	f, ok := t.flows[key]
+	if !ok {
+		if t.closed {
+			t.mu.Unlock()
+			return
+		}
+		if len(t.flows) >= t.maxFlows {
+			t.mu.Unlock()
+			flowDrops.WithLabelValues(t.name, "table_full").Inc()
+			return
+		}
+		f = &flow{key: key, queue: make(chan Datagram, queueLength)}
+		f.ctx, f.cancel = context.WithCancel(context.Background())
+		f.touch()
+		t.flows[key] = f
+		flowsActive.WithLabelValues(t.name).Inc()
+		flowsOpened.WithLabelValues(t.name).Inc()
+		go t.run(f, open)
+	}
+	t.mu.Unlock()
+
+	select {
+	case f.queue <- datagram:
+	default:
+		flowDrops.WithLabelValues(t.name, "queue_full").Inc()
+	}
+}
+
+// Len returns the number of open flows
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// Close closes every flow and stops accepting new ones
+func (t *Table) Close() {
+	t.mu.Lock()
+	t.closed = true
+	flows := make([]*flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f)
+	}
+	t.mu.Unlock()
+
+	for _, f := range flows {
+		f.cancel()
+	}
+}
+
+// run opens the flow with its first datagram and then forwards the client's
+// datagrams until the flow goes idle or is closed
+func (t *Table) run(f *flow, open Opener) {
+	defer t.remove(f)
+	defer f.cancel()
+
+	first := <-f.queue
+	session, err := open(f.ctx, f.key, first)
+	if err != nil {
+		log.Debugf("UDP flow %s -> %s not opened: %v", f.key.Client, f.key.Target, err)
+		return
+	}
+	defer func() {
+		if err := session.Conn.Close(); err != nil {
+			log.Debugf("Error closing UDP flow connection: %v", err)
+		}
+		if session.Closed != nil {
+			session.Closed()
+		}
+	}()
+
+	go t.returnPath(f, session)
+
+	idle := time.NewTicker(t.idleTimeout / 4)
+	defer idle.Stop()
+
+	for datagram, ok := first, true; ok; datagram, ok = t.next(f, idle.C) {
+		if !session.Forward(datagram) {
+			continue
+		}
+		if _, err := session.Conn.Write(datagram.Payload); err != nil {
+			log.Debugf("UDP flow %s -> %s write failed: %v", f.key.Client, f.key.Target, err)
+			return
+		}
+		f.touch()
+	}
+}
+
+// next waits for the flow's next datagram. It returns false once the flow
+// is closed or has been idle for the idle timeout.
+func (t *Table) next(f *flow, tick <-chan time.Time) (Datagram, bool) {
+	for {
+		select {
+		case datagram := <-f.queue:
+			return datagram, true
+		case <-f.ctx.Done():
+			return Datagram{}, false
+		case <-tick:
+			if f.idleFor() >= t.idleTimeout {
+				flowsExpired.WithLabelValues(t.name).Inc()
+				return Datagram{}, false
+			}
+		}
+	}
+}
+
+// returnPath sends every datagram the target sends back to the client
+func (t *Table) returnPath(f *flow, session *Session) {
+	// Closing the connection ends the flow, so stop the flow if we stop
+	defer f.cancel()
+
+	buffer := make([]byte, maxDatagram)
+	for {
+		n, err := session.Conn.Read(buffer)
+		if err != nil {
+			// ICMP unreachable, or the flow was closed
+			if f.ctx.Err() == nil {
+				log.Debugf("UDP flow %s -> %s read failed: %v", f.key.Client, f.key.Target, err)
+			}
+			return
+		}
+		f.touch()
+		session.Return(buffer[:n])
+	}
+}
+
+func (t *Table) remove(f *flow) {
+	t.mu.Lock()
+	if t.flows[f.key] == f {
+		delete(t.flows, f.key)
+		flowsActive.WithLabelValues(t.name).Dec()
+	}
+	t.mu.Unlock()
+}
+
+func (f *flow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *flow) idleFor() time.Duration {
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
@@ -0,0 +1,143 @@
+package udpflow
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoServer answers every datagram twice, so tests can tell a flow from a
+// single request/response exchange
+func echoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		buffer := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buffer[:n], addr)
+			_, _ = conn.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestFlowRelaysBothWays(t *testing.T) {
+	target := echoServer(t)
+	table := NewTable("test", time.Minute, 0)
+	defer table.Close()
+
+	var opened atomic.Int32
+	returned := make(chan string, 16)
+	open := func(ctx context.Context, key Key, first Datagram) (*Session, error) {
+		opened.Add(1)
+		conn, err := net.Dial("udp", key.Target)
+		if err != nil {
+			return nil, err
+		}
+		return &Session{
+			Conn:    conn,
+			Forward: func(Datagram) bool { return true },
+			Return:  func(payload []byte) { returned <- string(payload) },
+		}, nil
+	}
+
+	key := Key{Client: "192.0.2.1:5000", Target: target.LocalAddr().String()}
+	for _, payload := range []string{"one", "two", "three"} {
+		table.Deliver(key, Datagram{Payload: []byte(payload)}, open)
+	}
+
+	// Every datagram is forwarded in order, and every response returned
+	want := []string{"one", "one", "two", "two", "three", "three"}
+	for i, expected := range want {
+		select {
+		case got := <-returned:
+			if got != expected {
+				t.Fatalf("response %d: expected %q, got %q", i, expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for response %d", i)
+		}
+	}
+
+	if n := opened.Load(); n != 1 {
+		t.Errorf("expected one flow to be opened, got %d", n)
+	}
+	if n := table.Len(); n != 1 {
+		t.Errorf("expected one flow in the table, got %d", n)
+	}
+}
+
+func TestFlowExpiresWhenIdle(t *testing.T) {
+	target := echoServer(t)
+	table := NewTable("test", 100*time.Millisecond, 0)
+	defer table.Close()
+
+	closed := make(chan struct{})
+	open := func(ctx context.Context, key Key, first Datagram) (*Session, error) {
+		conn, err := net.Dial("udp", key.Target)
+		if err != nil {
+			return nil, err
+		}
+		return &Session{
+			Conn:    conn,
+			Forward: func(Datagram) bool { return true },
+			Return:  func([]byte) {},
+			Closed:  func() { close(closed) },
+		}, nil
+	}
+
+	table.Deliver(Key{Client: "192.0.2.1:5000", Target: target.LocalAddr().String()}, Datagram{Payload: []byte("ping")}, open)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow was not closed")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for table.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := table.Len(); n != 0 {
+		t.Errorf("expected the expired flow to be removed, %d left", n)
+	}
+}
+
+func TestRejectedFlowIsRemoved(t *testing.T) {
+	table := NewTable("test", time.Minute, 1)
+	defer table.Close()
+
+	rejected := make(chan struct{}, 2)
+	reject := func(ctx context.Context, key Key, first Datagram) (*Session, error) {
+		rejected <- struct{}{}
+		return nil, context.Canceled
+	}
+
+	key := Key{Client: "192.0.2.1:5000", Target: "192.0.2.2:53"}
+	table.Deliver(key, Datagram{Payload: []byte("query")}, reject)
+	<-rejected
+
+	// The table has room for one flow, so it must be free again
+	deadline := time.Now().Add(time.Second)
+	for table.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	table.Deliver(key, Datagram{Payload: []byte("retry")}, reject)
+	select {
+	case <-rejected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow was not opened again after being rejected")
+	}
+}
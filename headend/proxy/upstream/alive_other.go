@@ -0,0 +1,11 @@
+//go:build !unix || aix
+
+package upstream
+
+import "net"
+
+// alive can't peek at sockets without MSG_DONTWAIT, so idle connections are
+// only replaced once they reach their maximum lifetime or fail in use
+func alive(conn net.Conn) bool {
+	return true
+}
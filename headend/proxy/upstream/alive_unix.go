@@ -0,0 +1,37 @@
+//go:build unix && !aix
+
+package upstream
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// alive reports whether the target hasn't closed conn, peeking without
+// blocking or consuming anything it sent unprompted, such as a banner
+func alive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	open := true
+	err = raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case n > 0:
+		case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EWOULDBLOCK):
+		default:
+			// Zero bytes without an error is the target's FIN
+			open = false
+		}
+		return true
+	})
+	return err == nil && open
+}
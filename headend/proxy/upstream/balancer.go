@@ -0,0 +1,424 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/flowtrace"
+)
+
+// Defaults for the fields of BalancerConfig left zero
+const (
+	DefaultMaxFailures   = 3
+	DefaultEjectDuration = 30 * time.Second
+)
+
+// BalancerConfig maps logical targets to backends and tunes passive health
+// checking
+type BalancerConfig struct {
+	// MaxFailures is how many failures in a row eject a backend
+	MaxFailures int
+	// EjectDuration is how long an ejected backend gets no new sessions
+	EjectDuration time.Duration
+	// Groups maps a logical target host to its backend addresses. A
+	// backend without a port is dialed on the port of the target.
+	Groups map[string][]string
+}
+
+// BackendStatus describes a backend, as reported by Balancer.Status
+type BackendStatus struct {
+	Address      string     `json:"address"`
+	Active       int        `json:"active"`
+	Sessions     uint64     `json:"sessions"`
+	Failures     int        `json:"failures"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+}
+
+// GroupStatus describes a logical target, as reported by Balancer.Status
+type GroupStatus struct {
+	Name     string          `json:"name"`
+	Managed  bool            `json:"managed,omitempty"`
+	Backends []BackendStatus `json:"backends"`
+}
+
+type backend struct {
+	address      string
+	active       int
+	sessions     uint64
+	failures     int
+	ejectedUntil time.Time
+}
+
+func (be *backend) ejected(now time.Time) bool {
+	return now.Before(be.ejectedUntil)
+}
+
+// dialAddress is where be is dialed for a target on port
+func (be *backend) dialAddress(port string) string {
+	if _, _, err := net.SplitHostPort(be.address); err == nil || port == "" {
+		return be.address
+	}
+	return net.JoinHostPort(be.address, port)
+}
+
+type group struct {
+	name     string
+	managed  bool
+	backends []*backend
+	next     int
+}
+
+// Balancer spreads the sessions to a logical target over its backends,
+// each to the backend with the fewest open connections. Backends that
+// fail to connect, or answer requests with a gateway error, MaxFailures
+// times in a row are ejected for EjectDuration; if every backend of a
+// target is ejected, the one due back first is used rather than none.
+type Balancer struct {
+	maxFailures int
+	ejectFor    time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	static  map[string][]string
+	managed map[string][]string
+	groups  map[string]*group
+	// backends by group and address, including removed ones still serving
+	// sessions, so they are counted if they come back
+	backends map[string]*backend
+}
+
+// NewBalancer creates a balancer for the statically configured groups
+func NewBalancer(cfg BalancerConfig) *Balancer {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = DefaultMaxFailures
+	}
+	if cfg.EjectDuration <= 0 {
+		cfg.EjectDuration = DefaultEjectDuration
+	}
+	b := &Balancer{
+		maxFailures: cfg.MaxFailures,
+		ejectFor:    cfg.EjectDuration,
+		now:         time.Now,
+		static:      cfg.Groups,
+	}
+	b.rebuild()
+	return b
+}
+
+// SetManagedGroups replaces the groups the Manager defines, which take
+// precedence over static groups of the same name. Backends keep their
+// connection counts and health across updates.
+func (b *Balancer) SetManagedGroups(groups map[string][]string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.managed = groups
+	b.rebuild()
+}
+
+// rebuild merges the static and managed groups. The caller holds b.mu, or
+// has b to itself.
+func (b *Balancer) rebuild() {
+	previous := b.backends
+	backends := make(map[string]*backend)
+	groups := make(map[string]*group)
+	add := func(defined map[string][]string, managed bool) {
+		for name, addresses := range defined {
+			name = strings.ToLower(strings.TrimSpace(name))
+			g := &group{name: name, managed: managed}
+			seen := make(map[string]bool)
+			for _, address := range addresses {
+				address = strings.TrimSpace(address)
+				if address == "" || seen[address] {
+					continue
+				}
+				seen[address] = true
+				key := name + "|" + address
+				be := previous[key]
+				if be == nil {
+					be = &backend{address: address}
+				}
+				backends[key] = be
+				g.backends = append(g.backends, be)
+			}
+			if name != "" && len(g.backends) > 0 {
+				groups[name] = g
+			}
+		}
+	}
+	add(b.static, false)
+	add(b.managed, true)
+	for key, be := range previous {
+		if _, ok := backends[key]; !ok && be.active > 0 {
+			backends[key] = be
+		}
+	}
+
+	b.groups = groups
+	b.backends = backends
+	balancedBackends.Reset()
+	for name, g := range groups {
+		balancedBackends.WithLabelValues(name).Set(float64(len(g.backends)))
+	}
+}
+
+// lookup returns the group target belongs to, if any, and its port
+func (b *Balancer) lookup(target string) (*group, string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.groups[strings.ToLower(host)], port
+}
+
+// Balances reports whether target (host or host:port) is a logical target
+func (b *Balancer) Balances(target string) bool {
+	if b == nil {
+		return false
+	}
+	g, _ := b.lookup(target)
+	return g != nil
+}
+
+// pick takes the healthy backend of g with the fewest open connections,
+// skipping those already tried, and counts a session on it. Ties go round
+// robin.
+func (b *Balancer) pick(g *group, tried map[*backend]bool) *backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	n := len(g.backends)
+	var best *backend
+	for i := 0; i < n; i++ {
+		be := g.backends[(g.next+i)%n]
+		if tried[be] || be.ejected(now) {
+			continue
+		}
+		if best == nil || be.active < best.active {
+			best = be
+		}
+	}
+	if best == nil {
+		// Every backend is ejected: the one due back first beats none
+		for _, be := range g.backends {
+			if !tried[be] && (best == nil || be.ejectedUntil.Before(best.ejectedUntil)) {
+				best = be
+			}
+		}
+	}
+	if best != nil {
+		g.next = (g.next + 1) % n
+		best.active++
+		best.sessions++
+	}
+	return best
+}
+
+func (b *Balancer) release(be *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	be.active--
+}
+
+// failed counts a failure against be, ejecting it after maxFailures in a row
+func (b *Balancer) failed(g *group, be *backend, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	be.failures++
+	now := b.now()
+	if be.failures < b.maxFailures || be.ejected(now) {
+		return
+	}
+	be.ejectedUntil = now.Add(b.ejectFor)
+	balancerEjections.WithLabelValues(g.name).Inc()
+	log.Warnf("Ejecting backend %s of %s for %s after %d failures in a row: %v", be.address, g.name, b.ejectFor, be.failures, err)
+}
+
+func (b *Balancer) succeeded(be *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	be.failures = 0
+}
+
+// Dial connects to target with dial, or, for a logical target, to the
+// backend with the fewest open connections, trying the others if it can't
+// be reached. The connection counts against its backend until it is
+// closed. A nil balancer just dials target.
+func (b *Balancer) Dial(ctx context.Context, target string, dial func(ctx context.Context, address string) (net.Conn, error)) (net.Conn, error) {
+	if b == nil {
+		return dial(ctx, target)
+	}
+	g, port := b.lookup(target)
+	if g == nil {
+		return dial(ctx, target)
+	}
+
+	tried := make(map[*backend]bool, len(g.backends))
+	var lastErr error
+	for {
+		be := b.pick(g, tried)
+		if be == nil {
+			break
+		}
+		tried[be] = true
+
+		conn, err := dial(ctx, be.dialAddress(port))
+		if err != nil {
+			b.release(be)
+			lastErr = err
+			// A session that went away isn't the backend's fault
+			if ctx.Err() != nil {
+				break
+			}
+			b.failed(g, be, err)
+			balancedSessions.WithLabelValues(g.name, "retried").Inc()
+			continue
+		}
+		b.succeeded(be)
+		balancedSessions.WithLabelValues(g.name, "ok").Inc()
+		if trace := flowtrace.FromContext(ctx); trace != nil {
+			trace.Record("upstream.balancer", map[string]any{"target": g.name, "backend": be.address, "attempts": len(tried)})
+		}
+		return &balancedConn{Conn: conn, balancer: b, group: g, backend: be}, nil
+	}
+
+	balancedSessions.WithLabelValues(g.name, "failed").Inc()
+	return nil, fmt.Errorf("no backend of %s reachable: %w", g.name, lastErr)
+}
+
+// DialContext wraps next, the dialer of an HTTP transport, so connections
+// to logical targets go to their backends; nil next uses a plain dialer.
+// Requests keep the logical name for TLS and the Host header.
+func (b *Balancer) DialContext(next func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if next == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		next = dialer.DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return b.Dial(ctx, address, func(ctx context.Context, address string) (net.Conn, error) {
+			return next(ctx, network, address)
+		})
+	}
+}
+
+// Transport wraps next so gateway errors from a backend, and requests that
+// fail on a connection to it, count against its health
+func (b *Balancer) Transport(next http.RoundTripper) http.RoundTripper {
+	if b == nil {
+		return next
+	}
+	return &balancedTransport{balancer: b, next: next}
+}
+
+type balancedTransport struct {
+	balancer *Balancer
+	next     http.RoundTripper
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *balancedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = unwrapBalanced(info.Conn)
+		},
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if conn == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	switch {
+	case err != nil:
+		t.balancer.failed(conn.group, conn.backend, err)
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout:
+		t.balancer.failed(conn.group, conn.backend, fmt.Errorf("status %d", resp.StatusCode))
+	default:
+		t.balancer.succeeded(conn.backend)
+	}
+	return resp, err
+}
+
+// unwrapBalanced finds the balanced connection under conn, e.g. under TLS
+func unwrapBalanced(conn net.Conn) *balancedConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *balancedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// balancedConn is a connection to a backend, counted until it is closed
+type balancedConn struct {
+	net.Conn
+	balancer  *Balancer
+	group     *group
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *balancedConn) Close() error {
+	c.closeOnce.Do(func() { c.balancer.release(c.backend) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection if the underlying one can, so the
+// relay can pass on a client's end of input
+func (c *balancedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Status reports the logical targets and their backends, or nil for a nil
+// balancer
+func (b *Balancer) Status() []GroupStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	groups := make([]GroupStatus, 0, len(b.groups))
+	for _, g := range b.groups {
+		status := GroupStatus{Name: g.name, Managed: g.managed}
+		for _, be := range g.backends {
+			bs := BackendStatus{
+				Address:  be.address,
+				Active:   be.active,
+				Sessions: be.sessions,
+				Failures: be.failures,
+			}
+			if be.ejected(now) {
+				until := be.ejectedUntil
+				bs.EjectedUntil = &until
+			}
+			status.Backends = append(status.Backends, bs)
+		}
+		groups = append(groups, status)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
@@ -0,0 +1,255 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedAddress returns an address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	_ = ln.Close()
+	return address
+}
+
+func plainDial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// backendOf returns the backend status for address
+func backendOf(t *testing.T, b *Balancer, address string) BackendStatus {
+	t.Helper()
+	for _, g := range b.Status() {
+		for _, be := range g.Backends {
+			if be.Address == address {
+				return be
+			}
+		}
+	}
+	t.Fatalf("backend %s not found in %+v", address, b.Status())
+	return BackendStatus{}
+}
+
+func TestLeastConnections(t *testing.T) {
+	first, _ := echoServer(t, "")
+	second, _ := echoServer(t, "")
+	b := NewBalancer(BalancerConfig{Groups: map[string][]string{"App.Internal": {first, second}}})
+
+	a, err := b.Dial(context.Background(), "app.internal:8080", plainDial)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c, err := b.Dial(context.Background(), "app.internal:8080", plainDial)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if a.RemoteAddr().String() == c.RemoteAddr().String() {
+		t.Fatalf("expected the second session on the other backend, both went to %s", a.RemoteAddr())
+	}
+	defer c.Close()
+
+	// Closing a session frees its backend for the next one
+	freed := a.RemoteAddr().String()
+	_ = a.Close()
+	_ = a.Close()
+	d, err := b.Dial(context.Background(), "app.internal:8080", plainDial)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer d.Close()
+	if d.RemoteAddr().String() != freed {
+		t.Errorf("expected the least loaded backend %s, got %s", freed, d.RemoteAddr())
+	}
+	if active := backendOf(t, b, freed).Active; active != 1 {
+		t.Errorf("expected 1 active session on %s, got %d", freed, active)
+	}
+}
+
+func TestBackendPort(t *testing.T) {
+	address, _ := echoServer(t, "")
+	host, port, _ := net.SplitHostPort(address)
+	b := NewBalancer(BalancerConfig{Groups: map[string][]string{"app": {host}}})
+
+	conn, err := b.Dial(context.Background(), net.JoinHostPort("app", port), plainDial)
+	if err != nil {
+		t.Fatalf("expected a backend without a port to take the target's, got %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestFailingBackendIsEjected(t *testing.T) {
+	good, _ := echoServer(t, "")
+	bad := closedAddress(t)
+	b := NewBalancer(BalancerConfig{MaxFailures: 2, EjectDuration: time.Minute, Groups: map[string][]string{"app": {bad, good}}})
+
+	badDials := 0
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		if address == bad {
+			badDials++
+		}
+		return plainDial(ctx, address)
+	}
+
+	// Sessions fail over to the good backend until the bad one is ejected
+	for i := 0; i < 6; i++ {
+		conn, err := b.Dial(context.Background(), "app:80", dial)
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		_ = conn.Close()
+	}
+	if badDials != 2 {
+		t.Errorf("expected the bad backend to be ejected after 2 failures, it was dialed %d times", badDials)
+	}
+	if backendOf(t, b, bad).EjectedUntil == nil {
+		t.Error("expected the bad backend to be reported ejected")
+	}
+
+	// Once the ejection ends it is tried again, and the first failure
+	// ejects it once more
+	b.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	for i := 0; i < 4; i++ {
+		conn, err := b.Dial(context.Background(), "app:80", dial)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		_ = conn.Close()
+	}
+	if badDials != 3 {
+		t.Errorf("expected one retry of the returning backend, got %d dials in all", badDials)
+	}
+}
+
+func TestAllBackendsEjected(t *testing.T) {
+	address, _ := echoServer(t, "")
+	b := NewBalancer(BalancerConfig{MaxFailures: 1, Groups: map[string][]string{"app": {address}}})
+
+	fail := func(ctx context.Context, address string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: context.DeadlineExceeded}
+	}
+	if _, err := b.Dial(context.Background(), "app:80", fail); err == nil || !strings.Contains(err.Error(), "no backend of app") {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+	if backendOf(t, b, address).EjectedUntil == nil {
+		t.Fatal("expected the backend to be ejected")
+	}
+
+	// An ejected backend beats no backend
+	conn, err := b.Dial(context.Background(), "app:80", plainDial)
+	if err != nil {
+		t.Fatalf("expected the ejected backend to be used, got %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestCancelledDialIsNotAFailure(t *testing.T) {
+	address, _ := echoServer(t, "")
+	b := NewBalancer(BalancerConfig{MaxFailures: 1, Groups: map[string][]string{"app": {address}}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.Dial(ctx, "app:80", plainDial); err == nil {
+		t.Fatal("expected a cancelled dial to fail")
+	}
+	if be := backendOf(t, b, address); be.Failures != 0 || be.EjectedUntil != nil {
+		t.Errorf("expected a cancelled session not to count against the backend, got %+v", be)
+	}
+}
+
+func TestManagedGroups(t *testing.T) {
+	static, _ := echoServer(t, "")
+	managed, _ := echoServer(t, "")
+	b := NewBalancer(BalancerConfig{Groups: map[string][]string{"app": {static}}})
+
+	conn, err := b.Dial(context.Background(), "app:80", plainDial)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// The Manager's definition wins while it sends one
+	b.SetManagedGroups(map[string][]string{"app": {managed}, "other": {static}})
+	if !b.Balances("other") {
+		t.Error("expected the managed group to be balanced")
+	}
+	managedConn, err := b.Dial(context.Background(), "app:80", plainDial)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if managedConn.RemoteAddr().String() != managed {
+		t.Errorf("expected the managed backend, got %s", managedConn.RemoteAddr())
+	}
+	_ = managedConn.Close()
+
+	// Backends keep their sessions across updates
+	b.SetManagedGroups(nil)
+	if b.Balances("other") {
+		t.Error("expected the managed group to be removed")
+	}
+	if active := backendOf(t, b, static).Active; active != 1 {
+		t.Errorf("expected the open session to still count, got %d", active)
+	}
+}
+
+func TestTransportGatewayErrors(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "app" {
+			t.Errorf("expected the logical Host header, got %q", r.Host)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	backend := strings.TrimPrefix(server.URL, "http://")
+
+	b := NewBalancer(BalancerConfig{MaxFailures: 2, Groups: map[string][]string{"app": {backend}}})
+	client := &http.Client{Transport: b.Transport(&http.Transport{DialContext: b.DialContext(nil)})}
+
+	get := func() {
+		t.Helper()
+		resp, err := client.Get("http://app/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	get()
+	status = http.StatusOK
+	get()
+	if failures := backendOf(t, b, backend).Failures; failures != 0 {
+		t.Fatalf("expected a good response to reset failures, got %d", failures)
+	}
+
+	status = http.StatusServiceUnavailable
+	get()
+	get()
+	if backendOf(t, b, backend).EjectedUntil == nil {
+		t.Error("expected repeated gateway errors to eject the backend")
+	}
+}
+
+func TestNilBalancer(t *testing.T) {
+	address, _ := echoServer(t, "")
+	var b *Balancer
+	conn, err := b.Dial(context.Background(), address, plainDial)
+	if err != nil {
+		t.Fatalf("expected a nil balancer to dial, got %v", err)
+	}
+	_ = conn.Close()
+	if b.Balances(address) || b.Status() != nil {
+		t.Error("expected a nil balancer to balance nothing")
+	}
+	b.SetManagedGroups(map[string][]string{"app": {address}})
+}
@@ -0,0 +1,43 @@
+package upstream
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pooledDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_pool_dials_total",
+		Help: "Total TCP proxy dials to tracked targets, by result (hit for a pooled connection, miss for a fresh dial).",
+	}, []string{"result"})
+
+	poolFills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_pool_fills_total",
+		Help: "Total connections dialed to fill the upstream pool, by result.",
+	}, []string{"result"})
+
+	pooledDiscards = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_pool_discards_total",
+		Help: "Total idle pooled connections closed before use, by reason (expired, unhealthy).",
+	}, []string{"reason"})
+
+	idleConns = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "headend_upstream_pool_idle_connections",
+		Help: "Idle connections held in the upstream pool.",
+	})
+
+	balancedSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_balancer_dials_total",
+		Help: "Total dials to the backends of logical targets, by target and result (ok, retried on another backend, failed on every backend).",
+	}, []string{"target", "result"})
+
+	balancerEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "headend_upstream_balancer_ejections_total",
+		Help: "Total backends ejected after failing repeatedly, by logical target.",
+	}, []string{"target"})
+
+	balancedBackends = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headend_upstream_balancer_backends",
+		Help: "Backends configured per logical target.",
+	}, []string{"target"})
+)
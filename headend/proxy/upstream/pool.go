@@ -0,0 +1,428 @@
+// Package upstream keeps connections to frequently accessed TCP proxy
+// targets dialed ahead of use, so a new session skips connection setup,
+// and balances sessions to logical targets over their backends.
+//
+// The upstream package provides:
+//   - A pool of idle connections per target, topped up in the background
+//     after each one is taken
+//   - Targets chosen by demand: one dialed MinDials times within a
+//     DemandWindow gets a pool, and loses it once demand falls away
+//   - Statically configured targets kept pooled regardless of demand
+//   - Health checking of idle connections, periodically and before one is
+//     handed out, and a maximum lifetime after which they are redialed
+//   - Logical targets, configured or sent by the Manager, whose sessions go
+//     to the backend with the fewest open connections
+//   - Passive health checking of backends: ones that fail to connect, or
+//     answer with gateway errors, repeatedly are ejected for a while
+//
+// A relayed connection carries whatever the client spoke to the target, so
+// it is closed after use rather than returned to the pool; the reuse is of
+// connections set up before they were needed.
+package upstream
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/connctx"
+	"github.com/tobogganing/headend/proxy/flowtrace"
+)
+
+// Defaults for the fields of Config left zero
+const (
+	DefaultMaxIdle        = 4
+	DefaultMaxLifetime    = 60 * time.Second
+	DefaultHealthInterval = 15 * time.Second
+	DefaultMinDials       = 10
+	DefaultDemandWindow   = time.Minute
+	DefaultMaxTargets     = 64
+)
+
+// Config tunes which targets are pooled and how their connections are kept
+type Config struct {
+	// MaxIdle is how many idle connections are kept per target
+	MaxIdle int
+	// MaxLifetime is how long an idle connection is kept before it is
+	// redialed, as targets close connections that stay quiet
+	MaxLifetime    time.Duration
+	HealthInterval time.Duration
+	// MinDials is how many dials within DemandWindow pool a target
+	MinDials     int
+	DemandWindow time.Duration
+	// MaxTargets bounds the targets tracked for demand, and so pooled
+	MaxTargets int
+	// Targets are host:port targets pooled regardless of demand
+	Targets []string
+}
+
+// TargetStatus describes a pooled target, as reported by Status
+type TargetStatus struct {
+	Target    string `json:"target"`
+	Static    bool   `json:"static,omitempty"`
+	Idle      int    `json:"idle"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Status reports the pooled targets
+type Status struct {
+	Tracked int            `json:"tracked"`
+	Targets []TargetStatus `json:"targets"`
+}
+
+type idleConn struct {
+	conn     net.Conn
+	dialedAt time.Time
+}
+
+type target struct {
+	idle        []idleConn
+	static      bool
+	pooled      bool
+	dials       int
+	windowStart time.Time
+	filling     bool
+	hits        uint64
+	misses      uint64
+	lastErr     error
+}
+
+// Pool hands out pre-dialed connections to pooled targets, dialing the
+// others on demand
+type Pool struct {
+	cfg Config
+	// dial fills the pool; dialSession dials for a session on a miss
+	dial        func(ctx context.Context, network, address string) (net.Conn, error)
+	dialSession func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu      sync.Mutex
+	targets map[string]*target
+	closed  bool
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a pool; Start begins filling it
+func New(cfg Config) *Pool {
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = DefaultMaxIdle
+	}
+	if cfg.MaxLifetime <= 0 {
+		cfg.MaxLifetime = DefaultMaxLifetime
+	}
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = DefaultHealthInterval
+	}
+	if cfg.MinDials <= 0 {
+		cfg.MinDials = DefaultMinDials
+	}
+	if cfg.DemandWindow <= 0 {
+		cfg.DemandWindow = DefaultDemandWindow
+	}
+	if cfg.MaxTargets <= 0 {
+		cfg.MaxTargets = DefaultMaxTargets
+	}
+
+	p := &Pool{
+		cfg:         cfg,
+		dial:        connctx.DialContext,
+		dialSession: connctx.Dial,
+		targets:     make(map[string]*target),
+		stopChan:    make(chan struct{}),
+	}
+	for _, address := range cfg.Targets {
+		p.targets[address] = &target{static: true, pooled: true, windowStart: time.Now()}
+	}
+	return p
+}
+
+// Dial returns a connection to address (host:port) for the session in
+// ctx: an idle pooled one if there is a healthy one, otherwise a fresh
+// dial. A nil Pool always dials.
+func (p *Pool) Dial(ctx context.Context, address string) (net.Conn, error) {
+	if p == nil {
+		return connctx.Dial(ctx, "tcp", address)
+	}
+
+	p.mu.Lock()
+	t := p.track(address)
+	p.mu.Unlock()
+	if t == nil {
+		return p.dialSession(ctx, "tcp", address)
+	}
+
+	for {
+		p.mu.Lock()
+		conn, ok := p.take(t)
+		if !ok {
+			t.misses++
+			p.fillLocked(address, t)
+			p.mu.Unlock()
+			pooledDials.WithLabelValues("miss").Inc()
+			return p.dialSession(ctx, "tcp", address)
+		}
+		p.mu.Unlock()
+
+		if !alive(conn) {
+			_ = conn.Close()
+			pooledDiscards.WithLabelValues("unhealthy").Inc()
+			continue
+		}
+
+		p.mu.Lock()
+		t.hits++
+		p.fillLocked(address, t)
+		p.mu.Unlock()
+		pooledDials.WithLabelValues("hit").Inc()
+		if trace := flowtrace.FromContext(ctx); trace != nil {
+			trace.Record("upstream.pool", map[string]any{"address": address, "remote_address": conn.RemoteAddr().String()})
+		}
+		return conn, nil
+	}
+}
+
+// track counts a dial to address and returns its target, creating it
+// unless MaxTargets targets are already tracked. The caller holds p.mu.
+func (p *Pool) track(address string) *target {
+	t, ok := p.targets[address]
+	if !ok {
+		if len(p.targets) >= p.cfg.MaxTargets {
+			return nil
+		}
+		t = &target{windowStart: time.Now()}
+		p.targets[address] = t
+	}
+
+	p.rollWindow(t)
+	t.dials++
+	if t.dials >= p.cfg.MinDials {
+		t.pooled = true
+	}
+	return t
+}
+
+// rollWindow starts a new demand window for t once the current one is
+// over; a quiet window ends the pooling of a target that isn't static. The
+// caller holds p.mu.
+func (p *Pool) rollWindow(t *target) {
+	if time.Since(t.windowStart) <= p.cfg.DemandWindow {
+		return
+	}
+	if t.dials < p.cfg.MinDials && !t.static {
+		t.pooled = false
+	}
+	t.windowStart = time.Now()
+	t.dials = 0
+}
+
+// take removes the newest idle connection of t that is within its
+// lifetime, closing expired ones. The caller holds p.mu.
+func (p *Pool) take(t *target) (net.Conn, bool) {
+	for len(t.idle) > 0 {
+		ic := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		idleConns.Dec()
+		if time.Since(ic.dialedAt) > p.cfg.MaxLifetime {
+			_ = ic.conn.Close()
+			pooledDiscards.WithLabelValues("expired").Inc()
+			continue
+		}
+		return ic.conn, true
+	}
+	return nil, false
+}
+
+// fillLocked tops up the idle connections of a pooled target in the
+// background. The caller holds p.mu.
+func (p *Pool) fillLocked(address string, t *target) {
+	if !t.pooled || t.filling || p.closed || len(t.idle) >= p.cfg.MaxIdle {
+		return
+	}
+	t.filling = true
+	go p.fill(address, t)
+}
+
+// fill dials until t has MaxIdle idle connections, stopping at the first
+// failure
+func (p *Pool) fill(address string, t *target) {
+	defer func() {
+		p.mu.Lock()
+		t.filling = false
+		p.mu.Unlock()
+	}()
+
+	for {
+		p.mu.Lock()
+		done := p.closed || !t.pooled || len(t.idle) >= p.cfg.MaxIdle
+		p.mu.Unlock()
+		if done {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), connctx.DialTimeout)
+		conn, err := p.dial(ctx, "tcp", address)
+		cancel()
+
+		p.mu.Lock()
+		t.lastErr = err
+		if err != nil {
+			p.mu.Unlock()
+			poolFills.WithLabelValues("error").Inc()
+			log.Debugf("Failed to fill the upstream pool for %s: %v", address, err)
+			return
+		}
+		if p.closed || !t.pooled {
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		t.idle = append(t.idle, idleConn{conn: conn, dialedAt: time.Now()})
+		p.mu.Unlock()
+		idleConns.Inc()
+		poolFills.WithLabelValues("ok").Inc()
+	}
+}
+
+// Start checks idle connections and demand every HealthInterval, and
+// fills the static targets
+func (p *Pool) Start() {
+	p.mu.Lock()
+	for address, t := range p.targets {
+		p.fillLocked(address, t)
+	}
+	p.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(p.cfg.HealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Check()
+			case <-p.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Check closes idle connections that have expired or that the target
+// closed, unpools targets whose demand has fallen away, and tops up the
+// others
+func (p *Pool) Check() {
+	p.mu.Lock()
+	var checking []idleConn
+	for address, t := range p.targets {
+		p.rollWindow(t)
+		if !t.pooled {
+			for _, ic := range t.idle {
+				_ = ic.conn.Close()
+				idleConns.Dec()
+			}
+			t.idle = nil
+			if !t.filling {
+				delete(p.targets, address)
+			}
+			continue
+		}
+
+		kept := t.idle[:0]
+		for _, ic := range t.idle {
+			if time.Since(ic.dialedAt) > p.cfg.MaxLifetime {
+				_ = ic.conn.Close()
+				idleConns.Dec()
+				pooledDiscards.WithLabelValues("expired").Inc()
+				continue
+			}
+			kept = append(kept, ic)
+		}
+		t.idle = kept
+		checking = append(checking, kept...)
+	}
+	p.mu.Unlock()
+
+	// Probing doesn't block, so the connections stay in the pool meanwhile
+	dead := make(map[net.Conn]bool)
+	for _, ic := range checking {
+		if !alive(ic.conn) {
+			dead[ic.conn] = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for address, t := range p.targets {
+		if len(dead) > 0 {
+			kept := t.idle[:0]
+			for _, ic := range t.idle {
+				if dead[ic.conn] {
+					_ = ic.conn.Close()
+					idleConns.Dec()
+					pooledDiscards.WithLabelValues("unhealthy").Inc()
+					continue
+				}
+				kept = append(kept, ic)
+			}
+			t.idle = kept
+		}
+		p.fillLocked(address, t)
+	}
+}
+
+// Stop stops filling the pool and closes its idle connections. It is safe
+// to call on a nil Pool.
+func (p *Pool) Stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stopChan) })
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, t := range p.targets {
+		for _, ic := range t.idle {
+			_ = ic.conn.Close()
+			idleConns.Dec()
+		}
+		t.idle = nil
+	}
+}
+
+// Status reports the pooled targets, or nil if pooling is disabled
+func (p *Pool) Status() *Status {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := &Status{Tracked: len(p.targets), Targets: []TargetStatus{}}
+	for address, t := range p.targets {
+		if !t.pooled {
+			continue
+		}
+		ts := TargetStatus{
+			Target: address,
+			Static: t.static,
+			Idle:   len(t.idle),
+			Hits:   t.hits,
+			Misses: t.misses,
+		}
+		if t.lastErr != nil {
+			ts.LastError = t.lastErr.Error()
+		}
+		status.Targets = append(status.Targets, ts)
+	}
+	sort.Slice(status.Targets, func(i, j int) bool {
+		return status.Targets[i].Target < status.Targets[j].Target
+	})
+	return status
+}
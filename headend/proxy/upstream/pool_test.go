@@ -0,0 +1,210 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoServer accepts connections, greeting each with banner if it is set,
+// and echoes what it reads; it returns its address and accept count
+func echoServer(t *testing.T, banner string) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				if banner != "" {
+					_, _ = conn.Write([]byte(banner))
+				}
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+// waitIdle waits until address has idle pooled connections
+func waitIdle(t *testing.T, p *Pool, address string, idle int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, ts := range p.Status().Targets {
+			if ts.Target == address && ts.Idle == idle {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d idle connections to %s, got %+v", idle, address, p.Status())
+}
+
+func TestDemandPoolsTarget(t *testing.T) {
+	address, accepted := echoServer(t, "")
+	p := New(Config{MaxIdle: 2, MinDials: 2})
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ {
+		conn, err := p.Dial(context.Background(), address)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		_ = conn.Close()
+	}
+	waitIdle(t, p, address, 2)
+	before := accepted.Load()
+
+	conn, err := p.Dial(context.Background(), address)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected a working pooled connection, got %q %v", buf, err)
+	}
+
+	status := p.Status().Targets[0]
+	if status.Hits != 1 || status.Misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %+v", status)
+	}
+	// The hit used a connection dialed before the session, then refilled
+	waitIdle(t, p, address, 2)
+	if got := accepted.Load(); got != before+1 {
+		t.Errorf("expected one refill dial, got %d", got-before)
+	}
+}
+
+func TestAliveKeepsBanner(t *testing.T) {
+	address, _ := echoServer(t, "220 ready\r\n")
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	if !alive(conn) {
+		t.Fatal("expected an open connection to be alive")
+	}
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "220 ready\r\n" {
+		t.Errorf("expected the banner to be left for the session, got %q %v", buf, err)
+	}
+}
+
+func TestClosedConnectionsAreDiscarded(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The target closes every connection right away
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	address := ln.Addr().String()
+
+	p := New(Config{MaxIdle: 2, Targets: []string{address}})
+	defer p.Stop()
+	p.Start()
+	waitIdle(t, p, address, 2)
+	time.Sleep(20 * time.Millisecond)
+
+	var dialed atomic.Bool
+	p.dialSession = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed.Store(true)
+		return net.Dial(network, address)
+	}
+	conn, err := p.Dial(context.Background(), address)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	_ = conn.Close()
+	if !dialed.Load() {
+		t.Error("expected closed pooled connections to be skipped for a fresh dial")
+	}
+}
+
+func TestExpiredConnectionsAreNotUsed(t *testing.T) {
+	address, _ := echoServer(t, "")
+	p := New(Config{MaxIdle: 1, MaxLifetime: 20 * time.Millisecond, Targets: []string{address}})
+	defer p.Stop()
+	p.Start()
+	waitIdle(t, p, address, 1)
+	time.Sleep(30 * time.Millisecond)
+
+	conn, err := p.Dial(context.Background(), address)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	_ = conn.Close()
+	if status := p.Status().Targets[0]; status.Hits != 0 || status.Misses != 1 {
+		t.Errorf("expected the expired connection to be skipped, got %+v", status)
+	}
+}
+
+func TestQuietTargetIsUnpooled(t *testing.T) {
+	address, _ := echoServer(t, "")
+	p := New(Config{MaxIdle: 1, MinDials: 2, DemandWindow: 30 * time.Millisecond})
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ {
+		conn, err := p.Dial(context.Background(), address)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		_ = conn.Close()
+	}
+	waitIdle(t, p, address, 1)
+
+	// The busy window keeps the pool for the next one, which is quiet
+	time.Sleep(40 * time.Millisecond)
+	p.Check()
+	if len(p.Status().Targets) != 1 {
+		t.Fatalf("expected the target to stay pooled after a busy window, got %+v", p.Status())
+	}
+	time.Sleep(40 * time.Millisecond)
+	p.Check()
+	if status := p.Status(); status.Tracked != 0 || len(status.Targets) != 0 {
+		t.Errorf("expected a quiet target to be dropped, got %+v", status)
+	}
+}
+
+func TestNilPool(t *testing.T) {
+	address, _ := echoServer(t, "")
+	var p *Pool
+	conn, err := p.Dial(context.Background(), address)
+	if err != nil {
+		t.Fatalf("expected a nil pool to dial, got %v", err)
+	}
+	_ = conn.Close()
+	if p.Status() != nil {
+		t.Error("expected no status for a nil pool")
+	}
+	p.Stop()
+}
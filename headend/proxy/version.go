@@ -0,0 +1,38 @@
+// Build metadata for the headend.
+//
+// /version reports the release, commit and build time set at link time in
+// libs/version, together with the subsystems that are enabled and the
+// protocol versions this headend speaks, so fleet audits can check what
+// is deployed without parsing /health.
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tobogganing/headend/proxy/telemetry"
+	"github.com/tobogganing/libs/framing"
+	"github.com/tobogganing/libs/version"
+)
+
+// versionComponent names the headend in build metadata
+const versionComponent = "headend"
+
+// buildInfo returns the headend's build metadata
+func (s *ProxyServer) buildInfo() version.Info {
+	info := version.Get(versionComponent)
+	info.Features = s.enabledFeatures()
+	sort.Strings(info.Features)
+	info.Protocols = map[string][]int{
+		"session":    s.buildLocalCapabilities().ProtocolVersions,
+		"framing":    {framing.Version},
+		"enrollment": {enrollmentSchemaVersion},
+		"telemetry":  {telemetry.SchemaVersion},
+	}
+	return info
+}
+
+func (s *ProxyServer) versionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, s.buildInfo())
+}
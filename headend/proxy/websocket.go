@@ -0,0 +1,187 @@
+// WebSocket support for the HTTP proxy path.
+//
+// httputil.ReverseProxy can switch protocols, but the upgraded connection
+// would bypass the response wrapper: its bytes wouldn't be counted or rate
+// limited and the server's write timeout would cut it after 30 seconds. The
+// upgrade is instead sent upstream through the target's transport, and on
+// 101 Switching Protocols the client connection is hijacked and relayed to
+// the upstream connection like a CONNECT tunnel.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/tobogganing/headend/proxy/connctx"
+	"github.com/tobogganing/headend/proxy/drain"
+	"github.com/tobogganing/headend/proxy/firewall"
+)
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyWebSocket relays a WebSocket upgrade the firewall already allowed to
+// its target. The verdict is published when the connection closes so the
+// access log carries the bytes transferred.
+func (s *ProxyServer) proxyWebSocket(c *gin.Context, decision firewall.Decision) {
+	ctx := c.Request.Context()
+	meta := connctx.FromContext(ctx)
+	logger := connctx.Logger(ctx)
+
+	port := 443
+	if _, portStr, err := net.SplitHostPort(meta.TargetHost); err == nil {
+		port, _ = strconv.Atoi(portStr)
+	}
+	event := verdictEvent(ctx, port, decision)
+	event.Method = c.Request.Method
+	event.Path = c.Request.URL.Path
+	event.UserAgent = c.GetHeader("User-Agent")
+
+	done, ok := s.sessions.Begin(drain.KindWebSocket)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Headend is draining"})
+		return
+	}
+	defer done()
+
+	// Upgrades are never sent over HTTP/2, so the target's transport
+	// returns the switched connection as the response body
+	outreq := c.Request.Clone(ctx)
+	outreq.URL.Scheme = "https"
+	outreq.URL.Host = meta.TargetHost
+	outreq.Host = meta.TargetHost
+	outreq.RequestURI = ""
+	outreq.Body = nil
+	outreq.ContentLength = 0
+	outreq.Header.Del("X-Target-Host")
+	outreq.Header.Set("X-Forwarded-For", meta.SourceIP)
+
+	resp, err := s.transports.ForTarget(meta.TargetHost).RoundTrip(outreq)
+	if err != nil {
+		logger.Errorf("WebSocket upgrade to %s failed: %v", meta.TargetHost, err)
+		event.StatusCode = http.StatusBadGateway
+		s.eventBus.Publish(event)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to connect to target"})
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The target declined the upgrade; pass its answer on
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		for name, values := range resp.Header {
+			for _, value := range values {
+				c.Writer.Header().Add(name, value)
+			}
+		}
+		c.Writer.WriteHeader(resp.StatusCode)
+		written, _ := io.Copy(c.Writer, resp.Body)
+		event.StatusCode = resp.StatusCode
+		event.BytesSent = written
+		s.eventBus.Publish(event)
+		return
+	}
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		logger.Errorf("WebSocket upgrade to %s returned a read-only body", meta.TargetHost)
+		event.StatusCode = http.StatusBadGateway
+		s.eventBus.Publish(event)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to connect to target"})
+		return
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	clientConn, buffered, err := c.Writer.Hijack()
+	if err != nil {
+		log.Errorf("Failed to hijack WebSocket connection: %v", err)
+		event.StatusCode = http.StatusInternalServerError
+		s.eventBus.Publish(event)
+		return
+	}
+	defer func() {
+		_ = clientConn.Close()
+	}()
+
+	// The server's read and write timeouts must not cut long-lived sockets
+	if err := clientConn.SetDeadline(time.Time{}); err != nil {
+		log.Debugf("Error clearing WebSocket deadlines: %v", err)
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	_ = resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := clientConn.Write(head.Bytes()); err != nil {
+		log.Errorf("Failed to write WebSocket upgrade response: %v", err)
+		return
+	}
+
+	logger.Debugf("WebSocket open for user %s to %s", meta.User.ID, meta.TargetHost)
+	event.StatusCode = http.StatusSwitchingProtocols
+	defer publishConnectionLifecycle(ctx, s.eventBus, port)()
+
+	// The socket counts against the user's bandwidth limit in both directions
+	clientConn = s.rateLimiter.Conn(meta.User.ID, clientConn)
+	clientConn = s.egress.Conn("http", clientConn)
+
+	// Frames the client sent right after the upgrade request are already buffered
+	initial, _ := buffered.Reader.Peek(buffered.Reader.Buffered())
+
+	start := time.Now()
+	received, sent := relayUpgraded(clientConn, upstream, initial)
+	event.BytesSent = sent
+	event.BytesReceived = received
+	event.Duration = time.Since(start)
+	s.eventBus.Publish(event)
+}
+
+// relayUpgraded copies between the client and the upgraded upstream
+// connection until either side closes. WebSockets have no half-close, so
+// the end of one direction ends both. It returns the bytes delivered in
+// each direction, including initial.
+func relayUpgraded(client net.Conn, upstream io.ReadWriteCloser, initial []byte) (toUpstream, toClient int64) {
+	if len(initial) > 0 {
+		n, err := upstream.Write(initial)
+		toUpstream += int64(n)
+		if err != nil {
+			return toUpstream, 0
+		}
+	}
+
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, client)
+		_ = upstream.Close()
+		done <- n
+	}()
+
+	toClient, _ = io.Copy(client, upstream)
+	_ = client.Close()
+	toUpstream += <-done
+	return toUpstream, toClient
+}
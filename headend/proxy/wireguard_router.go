@@ -8,93 +8,221 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"os/exec"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/tobogganing/headend/proxy/connctx"
+	"github.com/tobogganing/headend/proxy/conntrack"
+	"github.com/tobogganing/headend/proxy/firewall"
+	"github.com/tobogganing/headend/proxy/flowtrace"
+	"github.com/tobogganing/headend/proxy/mesh"
+	"github.com/tobogganing/headend/proxy/protocol"
+	"github.com/tobogganing/headend/proxy/proxyproto"
+	"github.com/tobogganing/headend/proxy/routing"
+	"github.com/tobogganing/headend/proxy/upstream"
+	"github.com/tobogganing/headend/wireguard"
+	"github.com/tobogganing/libs/wgconfig"
 )
 
 // WireGuardRouter handles routing decisions for authenticated traffic
 type WireGuardRouter struct {
-	wgNetwork     *net.IPNet  // WireGuard network CIDR (e.g., 10.200.0.0/16)
+	wgNetworks    []*net.IPNet // WireGuard network CIDRs (e.g., 10.200.0.0/16 and fd00:200::/64)
 	wgInterface   string      // WireGuard interface name (e.g., wg0)
-	headendIP     net.IP      // Headend's IP in WireGuard network
+	headendIPs    []net.IP    // Headend's IP in each WireGuard network
+	upstreamPool  *upstream.Pool // pre-dialed connections to busy targets, if enabled
+	balancer      *upstream.Balancer // backends of logical targets
+	mesh          *mesh.Mesh // peer headends that sessions fail over to, if enabled
+	peers         *wireguard.PeerTable // allowed IPs of the interface's peers, nil without WireGuard control access
+	egressRoutes  *routing.Table // egress interfaces other than the default route, if configured
+	firewall      *firewall.Manager // protocol rules applied to client-to-client traffic, if enabled
+	peerSessions  *conntrack.Table // client-to-client sessions
 }
 
-// NewWireGuardRouter creates a new WireGuard-aware router
-func NewWireGuardRouter(wgInterface string, wgNetwork string, headendIP string) (*WireGuardRouter, error) {
-	// Parse WireGuard network CIDR
-	_, ipNet, err := net.ParseCIDR(wgNetwork)
-	if err != nil {
-		return nil, fmt.Errorf("invalid WireGuard network CIDR: %w", err)
-	}
+// NewWireGuardRouter creates a new WireGuard-aware router for one WireGuard
+// network per IP family. The headend takes the first host of each.
+func NewWireGuardRouter(wgInterface string, wgNetworks []string) (*WireGuardRouter, error) {
+	wr := &WireGuardRouter{wgInterface: wgInterface, peerSessions: conntrack.New(0, 0)}
+	for _, wgNetwork := range wgNetworks {
+		// Parse WireGuard network CIDR
+		_, ipNet, err := net.ParseCIDR(wgNetwork)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WireGuard network CIDR: %w", err)
+		}
 
-	// Parse headend IP
-	ip := net.ParseIP(headendIP)
-	if ip == nil {
-		return nil, fmt.Errorf("invalid headend IP: %s", headendIP)
+		headendAddress, err := wgconfig.HeadendAddress(wgNetwork)
+		if err != nil {
+			return nil, err
+		}
+
+		wr.wgNetworks = append(wr.wgNetworks, ipNet)
+		wr.headendIPs = append(wr.headendIPs, net.IP(headendAddress.Addr().AsSlice()))
+	}
+	if len(wr.wgNetworks) == 0 {
+		return nil, fmt.Errorf("no WireGuard network configured")
 	}
+	return wr, nil
+}
 
-	return &WireGuardRouter{
-		wgNetwork:   ipNet,
-		wgInterface: wgInterface,
-		headendIP:   ip,
-	}, nil
+// inWireGuardNetwork reports whether ip is in any of the WireGuard networks
+func (wr *WireGuardRouter) inWireGuardNetwork(ip net.IP) bool {
+	for _, network := range wr.wgNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-// RouteTraffic determines how to route authenticated traffic
-func (wr *WireGuardRouter) RouteTraffic(targetHost string, sourceConn net.Conn) error {
-	targetIP := net.ParseIP(targetHost)
-	
+// RouteTraffic determines how to route authenticated traffic the firewall
+// allowed with decision. ctx carries the connection's metadata and bounds
+// the upstream dial.
+func (wr *WireGuardRouter) RouteTraffic(ctx context.Context, targetHost string, decision firewall.Decision, sourceConn net.Conn) error {
 	// Check if target is a WireGuard peer
-	if targetIP != nil && wr.wgNetwork.Contains(targetIP) {
-		return wr.routeToPeer(targetHost, sourceConn)
+	if host, _, err := net.SplitHostPort(targetHost); err == nil {
+		if targetIP := net.ParseIP(host); targetIP != nil && wr.inWireGuardNetwork(targetIP) {
+			recordRoute(ctx, "wireguard_peer", targetHost)
+			return wr.routeToPeer(ctx, targetHost, decision, sourceConn)
+		}
 	}
 	
 	// Route to internet via normal proxy
-	return wr.routeToInternet(targetHost, sourceConn)
+	recordRoute(ctx, "internet", targetHost)
+	return wr.routeToInternet(ctx, targetHost, decision, sourceConn)
+}
+
+// recordRoute records the routing decision on the flow's trace, if traced
+func recordRoute(ctx context.Context, route, targetHost string) {
+	if trace := flowtrace.FromContext(ctx); trace != nil {
+		trace.Record("route", map[string]any{"route": route, "target": targetHost})
+	}
 }
 
-// routeToPeer handles traffic destined for other WireGuard clients
-func (wr *WireGuardRouter) routeToPeer(targetIP string, sourceConn net.Conn) error {
-	log.Infof("Routing traffic to WireGuard peer: %s", targetIP)
+// routeToPeer handles traffic destined for other WireGuard clients,
+// tracking it in the peer session table. The headend dials the peer from
+// its own address, so the peer sees the session source-translated.
+func (wr *WireGuardRouter) routeToPeer(ctx context.Context, targetHost string, decision firewall.Decision, sourceConn net.Conn) error {
+	logger := connctx.Logger(ctx)
+	logger.Infof("Routing traffic to WireGuard peer: %s", targetHost)
+
+	target, err := netip.ParseAddrPort(targetHost)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %s: %w", targetHost, err)
+	}
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
 
 	// Check if peer exists in WireGuard configuration
-	if !wr.isPeerConfigured(targetIP) {
-		return fmt.Errorf("peer %s not found in WireGuard configuration", targetIP)
+	if !wr.peers.Contains(target.Addr()) {
+		return fmt.Errorf("peer %s not found in WireGuard configuration", target.Addr())
+	}
+
+	original := conntrack.Tuple{Protocol: "tcp", Source: addrPort(sourceConn.RemoteAddr()), Destination: target}
+	decision, err = wr.decidePeerFlow(ctx, original, decision)
+	if err != nil {
+		return err
+	}
+	session, err := wr.peerSessions.Open(connctx.FromContext(ctx).UserID(), original, decision.RuleLabel())
+	if err != nil {
+		return fmt.Errorf("failed to track session to peer %s: %w", targetHost, err)
 	}
+	var toPeer, toClient int64
+	defer func() { session.Close(toPeer, toClient) }()
 
 	// Create connection to WireGuard peer through the WireGuard interface
-	targetConn, err := wr.dialPeer(targetIP)
+	targetConn, err := wr.dialPeer(ctx, targetHost)
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer %s: %w", targetIP, err)
+		return fmt.Errorf("failed to connect to peer %s: %w", targetHost, err)
 	}
 	defer func() {
 		if err := targetConn.Close(); err != nil {
 			log.Debugf("Error closing target connection: %v", err)
 		}
 	}()
-
-	// Mark this traffic as authenticated for iptables
-	if err := wr.markTrafficAuthenticated(sourceConn); err != nil {
-		log.Warnf("Failed to mark traffic as authenticated: %v", err)
-	}
+	session.Established(conntrack.Tuple{Protocol: "tcp", Source: addrPort(targetConn.LocalAddr()), Destination: target})
+	// A session closed by its limits must not wait on a silent target
+	stop := context.AfterFunc(ctx, func() { _ = targetConn.Close() })
+	defer stop()
 
 	// Bidirectional proxy between client and peer
-	go wr.proxyData(sourceConn, targetConn, fmt.Sprintf("client->%s", targetIP))
-	wr.proxyData(targetConn, sourceConn, fmt.Sprintf("%s->client", targetIP))
+	toPeer, toClient, _ = protocol.Relay(sourceConn, targetConn, nil, nil)
+	logger.Debugf("Relayed %d bytes to peer %s and %d bytes back", toPeer, targetHost, toClient)
 
 	return nil
 }
 
+// decidePeerFlow applies the user's protocol rules to a client-to-client
+// flow, as tcp:src_ip:src_port->dst_ip:dst_port. A matching rule decides
+// the flow; otherwise the decision on the destination stands.
+func (wr *WireGuardRouter) decidePeerFlow(ctx context.Context, flow conntrack.Tuple, decision firewall.Decision) (firewall.Decision, error) {
+	if wr.firewall == nil {
+		return decision, nil
+	}
+	meta := connctx.FromContext(ctx)
+	target := fmt.Sprintf("%s:%s->%s", flow.Protocol, flow.Source, flow.Destination)
+	var groups []string
+	if meta != nil && meta.User != nil {
+		groups = meta.User.Groups
+	}
+	flowDecision := wr.firewall.DecideWithGroups(meta.UserID(), groups, target)
+	if flowDecision.MatchedRule == nil {
+		return decision, nil
+	}
+	if trace := flowtrace.FromContext(ctx); trace != nil {
+		trace.Record("peer_policy", map[string]any{"target": target, "allowed": flowDecision.Allowed, "rule": flowDecision.RuleLabel()})
+	}
+	if !flowDecision.Allowed {
+		if meta != nil {
+			connctx.RecordDenial(meta.Protocol, flowDecision.DenialLabel())
+		}
+		return flowDecision, fmt.Errorf("firewall rule %s denies %s", flowDecision.RuleLabel(), target)
+	}
+	return flowDecision, nil
+}
+
+// addrPort returns the address and port of a TCP or UDP address, IPv4
+// addresses unmapped
+func addrPort(addr net.Addr) netip.AddrPort {
+	if addr == nil {
+		return netip.AddrPort{}
+	}
+	addressPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(addressPort.Addr().Unmap(), addressPort.Port())
+}
+
 // routeToInternet handles traffic destined for external hosts
-func (wr *WireGuardRouter) routeToInternet(targetHost string, sourceConn net.Conn) error {
-	log.Infof("Routing traffic to internet: %s", targetHost)
+func (wr *WireGuardRouter) routeToInternet(ctx context.Context, targetHost string, decision firewall.Decision, sourceConn net.Conn) error {
+	logger := connctx.Logger(ctx)
+	logger.Infof("Routing traffic to internet: %s", targetHost)
+
+	// Traffic of rules tagged for an egress route leaves through its
+	// interface, on a connection of its own since pooled ones weren't
+	// marked for it
+	dial := wr.upstreamPool.Dial
+	if decision.MatchedRule != nil {
+		if route := wr.egressRoutes.ForTags(decision.MatchedRule.Tags); route != nil {
+			logger.Debugf("Routing %s out egress route %s", targetHost, route.Name)
+			recordRoute(ctx, "egress:"+route.Name, targetHost)
+			ctx = connctx.WithSocketMark(ctx, route.Mark)
+			dial = func(ctx context.Context, address string) (net.Conn, error) {
+				return connctx.Dial(ctx, "tcp", address)
+			}
+		}
+	}
 
-	// Connect to external host
-	targetConn, err := net.Dial("tcp", targetHost)
+	// Connect to external host, taking a pre-dialed connection if it's busy,
+	// or to the least loaded backend of a logical target, through a peer
+	// headend if upstream connectivity fails here
+	targetConn, err := wr.mesh.Dial(ctx, targetHost, func(ctx context.Context, address string) (net.Conn, error) {
+		return wr.balancer.Dial(ctx, address, dial)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to connect to %s: %w", targetHost, err)
 	}
@@ -103,97 +231,59 @@ func (wr *WireGuardRouter) routeToInternet(targetHost string, sourceConn net.Con
 			log.Debugf("Error closing target connection: %v", err)
 		}
 	}()
+	// A session closed by its limits must not wait on a silent target
+	stop := context.AfterFunc(ctx, func() { _ = targetConn.Close() })
+	defer stop()
 
-	// Mark this traffic as authenticated for iptables
-	if err := wr.markTrafficAuthenticated(sourceConn); err != nil {
-		log.Warnf("Failed to mark traffic as authenticated: %v", err)
+	// Upstream services can learn the client's address from a PROXY header
+	if err := proxyproto.WriteUpstream(targetConn, sourceConn.RemoteAddr()); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", targetHost, err)
 	}
 
 	// Bidirectional proxy between client and internet
-	go wr.proxyData(sourceConn, targetConn, fmt.Sprintf("client->%s", targetHost))
-	wr.proxyData(targetConn, sourceConn, fmt.Sprintf("%s->client", targetHost))
+	toTarget, toClient, _ := protocol.Relay(sourceConn, targetConn, nil, nil)
+	logger.Debugf("Relayed %d bytes to %s and %d bytes back", toTarget, targetHost, toClient)
 
 	return nil
 }
 
-// isPeerConfigured checks if the target IP is a configured WireGuard peer
-func (wr *WireGuardRouter) isPeerConfigured(targetIP string) bool {
-	// Check WireGuard peer list to see if this IP is configured
-	cmd := exec.Command("wg", "show", wr.wgInterface, "allowed-ips")
-	output, err := cmd.Output()
-	if err != nil {
-		log.Errorf("Failed to check WireGuard peers: %v", err)
-		return false
-	}
-
-	// Parse output to find if targetIP is in allowed IPs
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, targetIP) {
-			return true
-		}
-	}
-
-	return false
-}
-
-// dialPeer creates a connection to a WireGuard peer
-func (wr *WireGuardRouter) dialPeer(targetIP string) (net.Conn, error) {
+// dialPeer creates a connection to a WireGuard peer at targetHost, its
+// address and the port the client asked for
+func (wr *WireGuardRouter) dialPeer(ctx context.Context, targetHost string) (net.Conn, error) {
 	// For peer-to-peer connections, we dial directly to the peer's IP
 	// The traffic will be routed through the WireGuard interface
-	return net.Dial("tcp", targetIP+":0") // Port will be determined by the actual service
+	return connctx.Dial(ctx, "tcp", targetHost)
 }
 
-// markTrafficAuthenticated marks packets as authenticated for iptables processing
-func (wr *WireGuardRouter) markTrafficAuthenticated(conn net.Conn) error {
-	// This would use SO_MARK socket option to mark packets with mark 100
-	// which corresponds to our iptables rule for authenticated traffic
-	
-	// For TCP connections, we can use the file descriptor
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		// Get the file descriptor
-		file, err := tcpConn.File()
-		if err != nil {
-			return fmt.Errorf("failed to get connection file descriptor: %w", err)
-		}
-		defer func() {
-			if err := file.Close(); err != nil {
-				log.Debugf("Error closing file descriptor: %v", err)
-			}
-		}()
-
-		// Use iptables to mark packets from this connection
-		// This is a simplified approach - in production, would use netlink sockets
-		sourceAddr := conn.RemoteAddr().String()
-		cmd := exec.Command("iptables", "-t", "mangle", "-A", "OUTPUT", 
-			"-s", sourceAddr, "-j", "MARK", "--set-mark", "100")
-		
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to mark traffic: %w", err)
-		}
+// removeLegacyMarkRules deletes the mangle rules that marked authenticated
+// traffic before upstream sockets carried the mark themselves; earlier
+// versions appended one per connection. It returns how many it removed.
+func removeLegacyMarkRules() (int, error) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return 0, nil
+	}
+	output, err := exec.Command("iptables", "-t", "mangle", "-S", "OUTPUT").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list mangle rules: %w", err)
 	}
 
-	return nil
-}
-
-// proxyData copies data bidirectionally between connections
-func (wr *WireGuardRouter) proxyData(src, dst net.Conn, direction string) {
-	buffer := make([]byte, 32768)
-	
-	for {
-		n, err := src.Read(buffer)
-		if err != nil {
-			log.Debugf("Connection closed in direction %s: %v", direction, err)
-			break
+	// The rules read back as
+	// -A OUTPUT -s 10.200.1.2/32 -j MARK --set-xmark 0x64/0xffffffff
+	legacyMark := fmt.Sprintf("0x%x/0xffffffff", connctx.AuthenticatedMark)
+	removed := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 8 || fields[0] != "-A" || fields[2] != "-s" ||
+			fields[4] != "-j" || fields[5] != "MARK" || fields[6] != "--set-xmark" || fields[7] != legacyMark {
+			continue
 		}
-
-		if _, err := dst.Write(buffer[:n]); err != nil {
-			log.Errorf("Failed to write in direction %s: %v", direction, err)
-			break
+		fields[0] = "-D"
+		if err := exec.Command("iptables", append([]string{"-t", "mangle"}, fields...)...).Run(); err != nil {
+			return removed, fmt.Errorf("failed to delete mangle rule %q: %w", line, err)
 		}
-
-		log.Debugf("Proxied %d bytes in direction %s", n, direction)
+		removed++
 	}
+	return removed, nil
 }
 
 // IsWireGuardDestination checks if a destination is within the WireGuard network
@@ -208,36 +298,15 @@ func (wr *WireGuardRouter) IsWireGuardDestination(host string) bool {
 		ip = ips[0]
 	}
 
-	return wr.wgNetwork.Contains(ip)
+	return wr.inWireGuardNetwork(ip)
 }
 
-// GetWireGuardPeers returns list of configured WireGuard peers
+// GetWireGuardPeers returns list of configured WireGuard peers, the
+// address of each allowed IP, IPv4 and IPv6 alike
 func (wr *WireGuardRouter) GetWireGuardPeers() ([]string, error) {
-	cmd := exec.Command("wg", "show", wr.wgInterface, "allowed-ips")
-	output, err := cmd.Output()
+	peers, err := wr.peers.Addresses()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get WireGuard peers: %w", err)
 	}
-
-	var peers []string
-	lines := strings.Split(string(output), "\n")
-	
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		
-		// Parse peer line format: "publickey	allowed-ips"
-		parts := strings.Fields(line)
-		if len(parts) >= 2 {
-			// Extract IP from allowed-ips (format: "10.200.1.2/32")
-			allowedIP := parts[1]
-			if ip := strings.Split(allowedIP, "/")[0]; ip != "" {
-				peers = append(peers, ip)
-			}
-		}
-	}
-
 	return peers, nil
-}
\ No newline at end of file
+}
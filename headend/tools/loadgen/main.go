@@ -0,0 +1,256 @@
+// Command loadgen replays archived headend access and flow logs against a
+// staging headend for load testing and capacity planning.
+//
+// Records are read from syslog access logs or event webhook payloads,
+// sorted by timestamp and sent over the same data path they originally
+// used: HTTP reverse proxy, CONNECT tunnels, framed TCP or framed UDP.
+// The original inter-arrival times are kept, optionally compressed by
+// -rate, so the replayed traffic mix matches production. Each recorded
+// user gets a synthetic token signed with the staging Manager's key, and
+// payloads are fixed filler, so repeated runs send identical traffic.
+//
+// Usage:
+//
+//	loadgen -headend staging-headend.internal -signing-key staging-jwt.pem \
+//	    -rate 10 -target-override sink.internal:9000 access-*.log
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	headend := flag.String("headend", "", "staging headend host name or IP (required)")
+	httpPort := flag.String("http-port", "8443", "headend HTTP proxy port")
+	tcpPort := flag.String("tcp-port", "8444", "headend TCP proxy port")
+	udpPort := flag.String("udp-port", "8445", "headend UDP proxy port")
+	plainHTTP := flag.Bool("plain-http", false, "talk to the HTTP proxy without TLS")
+	insecure := flag.Bool("insecure", false, "skip TLS verification of the headend certificate")
+	signingKey := flag.String("signing-key", "", "RSA private key (PEM) used to sign a synthetic token per recorded user")
+	staticToken := flag.String("token", "", "bearer token used for every flow when no signing key is given")
+	rate := flag.Float64("rate", 1, "replay speed multiplier; 0 replays as fast as concurrency allows")
+	concurrency := flag.Int("concurrency", 256, "maximum flows in flight")
+	limit := flag.Int("limit", 0, "replay at most this many records (0 for all)")
+	timeout := flag.Duration("timeout", 30*time.Second, "per-flow timeout")
+	targetOverride := flag.String("target-override", "", "send every flow to this host:port instead of its recorded target")
+	flag.Parse()
+
+	if *headend == "" || flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: loadgen -headend HOST [flags] LOGFILE...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	if *rate < 0 || *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-rate must be >= 0 and -concurrency >= 1")
+		os.Exit(2)
+	}
+
+	tokens, err := newTokenSource(*signingKey, *staticToken)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	records, err := loadRecords(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *limit > 0 && len(records) > *limit {
+		records = records[:*limit]
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(os.Stderr, "No replayable records found")
+		os.Exit(1)
+	}
+
+	r := &replayer{
+		httpHost:       net.JoinHostPort(*headend, *httpPort),
+		tcpAddr:        net.JoinHostPort(*headend, *tcpPort),
+		udpAddr:        net.JoinHostPort(*headend, *udpPort),
+		targetOverride: *targetOverride,
+		timeout:        *timeout,
+		tokens:         tokens,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	if *plainHTTP {
+		r.httpBase = "http://" + r.httpHost
+	} else {
+		r.httpBase = "https://" + r.httpHost
+		r.tlsConfig = &tls.Config{
+			ServerName:         *headend,
+			InsecureSkipVerify: *insecure, // #nosec G402 -- opt-in for self-signed staging headends
+		}
+		transport.TLSClientConfig = r.tlsConfig
+	}
+	r.client = &http.Client{Transport: transport}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	span := records[len(records)-1].Timestamp.Sub(records[0].Timestamp)
+	fmt.Printf("Replaying %d records spanning %s at %gx against %s\n", len(records), span, *rate, *headend)
+
+	stats := run(ctx, r, records, *rate, *concurrency)
+	stats.print(os.Stdout)
+	if stats.failed() {
+		os.Exit(1)
+	}
+}
+
+// run replays records on their recorded schedule, scaled by rate, with at
+// most concurrency flows in flight. Flows that can't start on time because
+// every slot is busy start late and are counted as such.
+func run(ctx context.Context, r *replayer, records []record, rate float64, concurrency int) *stats {
+	results := newStats()
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	base := records[0].Timestamp
+	start := time.Now()
+
+	for _, rec := range records {
+		due := start
+		if rate > 0 {
+			due = start.Add(time.Duration(float64(rec.Timestamp.Sub(base)) / rate))
+		}
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if rate > 0 && time.Since(due) > 100*time.Millisecond {
+			results.late()
+		}
+
+		wg.Add(1)
+		go func(rec record) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			flowStart := time.Now()
+			n, err := r.replay(ctx, rec)
+			results.record(protocolLabel(rec), time.Since(flowStart), n, err)
+		}(rec)
+	}
+
+	wg.Wait()
+	results.elapsed = time.Since(start)
+	return results
+}
+
+func protocolLabel(rec record) string {
+	protocol := strings.ToUpper(rec.Protocol)
+	if strings.EqualFold(rec.Method, http.MethodConnect) {
+		return "CONNECT"
+	}
+	return protocol
+}
+
+// stats aggregates outcomes per protocol
+type stats struct {
+	byProtocol map[string]*protocolStats
+	lateStarts int
+	elapsed    time.Duration
+	mu         sync.Mutex
+}
+
+type protocolStats struct {
+	flows     int
+	errors    int
+	bytes     int64
+	latencies []time.Duration
+	lastError string
+}
+
+func newStats() *stats {
+	return &stats{byProtocol: make(map[string]*protocolStats)}
+}
+
+func (s *stats) record(protocol string, latency time.Duration, bytes int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps, ok := s.byProtocol[protocol]
+	if !ok {
+		ps = &protocolStats{}
+		s.byProtocol[protocol] = ps
+	}
+	ps.flows++
+	ps.bytes += bytes
+	ps.latencies = append(ps.latencies, latency)
+	if err != nil {
+		ps.errors++
+		ps.lastError = err.Error()
+	}
+}
+
+func (s *stats) late() {
+	s.mu.Lock()
+	s.lateStarts++
+	s.mu.Unlock()
+}
+
+func (s *stats) failed() bool {
+	for _, ps := range s.byProtocol {
+		if ps.errors > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stats) print(w *os.File) {
+	protocols := make([]string, 0, len(s.byProtocol))
+	for p := range s.byProtocol {
+		protocols = append(protocols, p)
+	}
+	sort.Strings(protocols)
+
+	fmt.Fprintf(w, "\n%-8s %8s %8s %12s %10s %10s %10s\n", "PROTO", "FLOWS", "ERRORS", "BYTES", "P50", "P95", "P99")
+	total := 0
+	for _, p := range protocols {
+		ps := s.byProtocol[p]
+		total += ps.flows
+		sort.Slice(ps.latencies, func(i, j int) bool { return ps.latencies[i] < ps.latencies[j] })
+		fmt.Fprintf(w, "%-8s %8d %8d %12d %10s %10s %10s\n", p, ps.flows, ps.errors, ps.bytes,
+			percentile(ps.latencies, 0.50), percentile(ps.latencies, 0.95), percentile(ps.latencies, 0.99))
+	}
+
+	fmt.Fprintf(w, "\n%d flows in %s (%.1f flows/s), %d started late\n",
+		total, s.elapsed.Round(time.Millisecond), float64(total)/s.elapsed.Seconds(), s.lateStarts)
+	for _, p := range protocols {
+		if ps := s.byProtocol[p]; ps.lastError != "" {
+			fmt.Fprintf(w, "last %s error: %s\n", p, ps.lastError)
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(q*float64(len(sorted)-1))].Round(time.Millisecond)
+}
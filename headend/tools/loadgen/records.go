@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// record is one flow from an archived log. Syslog access logs and event
+// webhook payloads share these JSON field names.
+type record struct {
+	Type          string    `json:"type"`
+	Timestamp     time.Time `json:"timestamp"`
+	UserID        string    `json:"user_id"`
+	TargetHost    string    `json:"target_host"`
+	Protocol      string    `json:"protocol"`
+	Port          int       `json:"port"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// loadRecords reads every log file, keeping the records that describe a
+// flow, and returns them in timestamp order. Ties keep file order so the
+// schedule is the same on every run.
+func loadRecords(paths []string) ([]record, error) {
+	records := []record{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log: %w", err)
+		}
+		parsed, err := parseRecords(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		records = append(records, parsed...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records, nil
+}
+
+// parseRecords reads one record per line. Lines may be bare JSON (event
+// webhooks, exported logs) or syslog lines with a JSON payload; anything
+// before the first '{' is ignored. A line holding a JSON array, as posted
+// by the webhook sink, yields one record per element.
+func parseRecords(r io.Reader) ([]record, error) {
+	records := []record{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		var batch []record
+		if strings.HasPrefix(line, "[") {
+			if err := json.Unmarshal([]byte(line), &batch); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		} else {
+			start := strings.IndexByte(line, '{')
+			if start < 0 {
+				continue
+			}
+			var rec record
+			if err := json.Unmarshal([]byte(line[start:]), &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			batch = []record{rec}
+		}
+
+		for _, rec := range batch {
+			if replayable(rec) {
+				records = append(records, rec)
+			}
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// replayable reports whether a record describes a flow worth replaying.
+// Event streams describe each flow several times (opened, verdict,
+// closed), so only verdicts are kept; auth events carry no flow at all.
+func replayable(rec record) bool {
+	if rec.Type != "" && rec.Type != "verdict" {
+		return false
+	}
+	if rec.TargetHost == "" || rec.Timestamp.IsZero() {
+		return false
+	}
+	switch strings.ToUpper(rec.Protocol) {
+	case "HTTP", "HTTPS", "TCP", "SOCKS5", "UDP":
+		return true
+	}
+	return false
+}
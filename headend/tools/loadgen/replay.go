@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tobogganing/libs/framing"
+)
+
+// defaultPayloadSize is sent for stream flows whose logs carry no byte counts
+const defaultPayloadSize = 512
+
+// tokenSource hands out a bearer token per replayed user. With a signing
+// key each user gets their own synthetic token, so per-user policy and
+// rate limits behave as they did in production; otherwise every flow uses
+// one static token.
+type tokenSource struct {
+	key    *rsa.PrivateKey
+	static string
+	tokens map[string]string
+	mu     sync.Mutex
+}
+
+func newTokenSource(keyFile, static string) (*tokenSource, error) {
+	ts := &tokenSource{static: static, tokens: make(map[string]string)}
+	if keyFile == "" {
+		if static == "" {
+			return nil, fmt.Errorf("either -signing-key or -token is required")
+		}
+		return ts, nil
+	}
+
+	pemData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	ts.key, err = jwt.ParseRSAPrivateKeyFromPEM(pemData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	return ts, nil
+}
+
+func (ts *tokenSource) token(userID string) (string, error) {
+	if ts.key == nil {
+		return ts.static, nil
+	}
+	if userID == "" {
+		userID = "loadgen"
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if token, ok := ts.tokens[userID]; ok {
+		return token, nil
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":       userID,
+		"type":      "access",
+		"node_type": "client_native",
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(24 * time.Hour).Unix(),
+		"metadata":  map[string]interface{}{"loadgen": true},
+	}).SignedString(ts.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token for %s: %w", userID, err)
+	}
+	ts.tokens[userID] = token
+	return token, nil
+}
+
+// replayer sends recorded flows to a headend over the matching data path
+type replayer struct {
+	httpBase       string
+	httpHost       string
+	tcpAddr        string
+	udpAddr        string
+	tlsConfig      *tls.Config
+	targetOverride string
+	timeout        time.Duration
+	tokens         *tokenSource
+	client         *http.Client
+}
+
+// replay sends one flow and returns the number of bytes moved
+func (r *replayer) replay(ctx context.Context, rec record) (int64, error) {
+	token, err := r.tokens.token(rec.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	target := rec.TargetHost
+	if r.targetOverride != "" {
+		target = r.targetOverride
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	switch strings.ToUpper(rec.Protocol) {
+	case "HTTP", "HTTPS":
+		if strings.EqualFold(rec.Method, http.MethodConnect) {
+			return r.replayConnect(ctx, rec, token, target)
+		}
+		return r.replayHTTP(ctx, rec, token, target)
+	case "TCP", "SOCKS5":
+		return r.replayTCP(ctx, rec, token, target)
+	case "UDP":
+		return r.replayUDP(ctx, rec, token, target)
+	}
+	return 0, fmt.Errorf("unsupported protocol %q", rec.Protocol)
+}
+
+func (r *replayer) replayHTTP(ctx context.Context, rec record, token, target string) (int64, error) {
+	method := rec.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := rec.Path
+	if !strings.HasPrefix(path, "/proxy") {
+		path = "/proxy" + path
+	}
+
+	var body io.Reader
+	if rec.BytesReceived > 0 {
+		body = payload(rec.BytesReceived)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.httpBase+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Target-Host", target)
+	req.Header.Set("User-Agent", "SASEWaddle-Loadgen/1.0")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if resp.StatusCode >= 500 {
+		return n, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return n + rec.BytesReceived, nil
+}
+
+func (r *replayer) replayConnect(ctx context.Context, rec record, token, target string) (int64, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.httpHost)
+	if err != nil {
+		return 0, err
+	}
+	if r.tlsConfig != nil {
+		conn = tls.Client(conn, r.tlsConfig)
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Bearer %s\r\n\r\n",
+		target, target, token)
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("CONNECT status %d", resp.StatusCode)
+	}
+
+	return exchange(conn, reader, rec.BytesReceived, rec.BytesSent)
+}
+
+func (r *replayer) replayTCP(ctx context.Context, rec record, token, target string) (int64, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.tcpAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if err := framing.WriteHeader(conn, token, target); err != nil {
+		return 0, err
+	}
+	return exchange(conn, conn, rec.BytesReceived, rec.BytesSent)
+}
+
+func (r *replayer) replayUDP(ctx context.Context, rec record, token, target string) (int64, error) {
+	size := rec.BytesReceived
+	if size <= 0 || size > 1200 {
+		size = defaultPayloadSize
+	}
+
+	datagram, err := framing.Encode(token, target)
+	if err != nil {
+		return 0, err
+	}
+	data, _ := io.ReadAll(payload(size))
+	datagram = append(datagram, data...)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.udpAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// exchange sends up bytes to the far end, half-closes when possible, then
+// reads until down bytes have arrived or the peer closes. Stream flows in
+// the logs often record no byte counts, so a small default is sent.
+func exchange(conn net.Conn, reader io.Reader, up, down int64) (int64, error) {
+	if up <= 0 {
+		up = defaultPayloadSize
+	}
+	sent, err := io.Copy(conn, payload(up))
+	if err != nil {
+		return sent, err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	limit := down
+	if limit <= 0 {
+		limit = up
+	}
+	received, err := io.Copy(io.Discard, io.LimitReader(reader, limit))
+	if err != nil && !isTimeout(err) {
+		return sent + received, err
+	}
+	return sent + received, nil
+}
+
+// payload returns n bytes of fixed filler so every run sends identical data
+func payload(n int64) io.Reader {
+	return io.LimitReader(filler{}, n)
+}
+
+type filler struct{}
+
+func (filler) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte('a' + i%26)
+	}
+	return len(p), nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -28,6 +28,7 @@ import (
     "time"
     
     log "github.com/sirupsen/logrus"
+    "github.com/tobogganing/libs/wgconfig"
     "golang.zx2c4.com/wireguard/wgctrl"
     "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -38,6 +39,7 @@ type Config struct {
     ListenPort    int
     PrivateKey    string
     Network       string
+    Network6      string // optional IPv6 network for dual-stack tunnels
     ManagerURL    string
 }
 
@@ -57,6 +59,7 @@ type Manager struct {
     publicKey     wgtypes.Key
     listenPort    int
     network       string
+    network6      string
 }
 
 // Peer represents a WireGuard peer configuration
@@ -70,7 +73,12 @@ type Peer struct {
 
 // NewManager creates a new WireGuard manager from a Config
 func NewManager(config *Config) (*Manager, error) {
-    return NewManagerWithParams(config.InterfaceName, config.ManagerURL, config.ListenPort, config.Network)
+    manager, err := NewManagerWithParams(config.InterfaceName, config.ManagerURL, config.ListenPort, config.Network)
+    if err != nil {
+        return nil, err
+    }
+    manager.network6 = config.Network6
+    return manager, nil
 }
 
 // NewManagerWithParams creates a new WireGuard manager with explicit parameters
@@ -174,21 +182,35 @@ func (m *Manager) createInterface() error {
 }
 
 func (m *Manager) configureInterface() error {
-    // Set IP address - headend gets the first IP
-    // Parse network to get first IP
-    // For simplicity, assuming 10.200.0.1 for headend
-    headendIP := "10.200.0.1/16"
-    
-    cmd := exec.Command("ip", "addr", "add", headendIP, "dev", m.interfaceName)
-    if output, err := cmd.CombinedOutput(); err != nil {
-        // Ignore if address already exists
-        if !strings.Contains(string(output), "File exists") {
-            return fmt.Errorf("failed to set IP address: %v, output: %s", err, output)
+    // Set IP addresses - headend gets the first IP of each network
+    network := m.network
+    if network == "" {
+        network = "10.200.0.0/16"
+    }
+    networks := []string{network}
+    if m.network6 != "" {
+        networks = append(networks, m.network6)
+    }
+    var headendIPs []string
+    for _, network := range networks {
+        address, err := wgconfig.HeadendAddress(network)
+        if err != nil {
+            return err
         }
+        headendIP := address.String()
+        
+        cmd := exec.Command("ip", "addr", "add", headendIP, "dev", m.interfaceName)
+        if output, err := cmd.CombinedOutput(); err != nil {
+            // Ignore if address already exists
+            if !strings.Contains(string(output), "File exists") {
+                return fmt.Errorf("failed to set IP address: %v, output: %s", err, output)
+            }
+        }
+        headendIPs = append(headendIPs, headendIP)
     }
     
     // Bring interface up
-    cmd = exec.Command("ip", "link", "set", "up", "dev", m.interfaceName)
+    cmd := exec.Command("ip", "link", "set", "up", "dev", m.interfaceName)
     if output, err := cmd.CombinedOutput(); err != nil {
         return fmt.Errorf("failed to bring interface up: %v, output: %s", err, output)
     }
@@ -203,7 +225,7 @@ func (m *Manager) configureInterface() error {
         return fmt.Errorf("failed to configure WireGuard device: %w", err)
     }
     
-    log.Infof("Configured WireGuard interface %s with IP %s", m.interfaceName, headendIP)
+    log.Infof("Configured WireGuard interface %s with IP %s", m.interfaceName, strings.Join(headendIPs, ", "))
     return nil
 }
 
@@ -239,11 +261,11 @@ func (m *Manager) syncPeers() error {
         
         // Set endpoint if provided
         if peer.Endpoint != "" {
-            // Parse endpoint manually since wgtypes.ParseEndpoint was removed
-            parts := strings.Split(peer.Endpoint, ":")
-            if len(parts) == 2 {
-                host := parts[0]
-                port, err := strconv.Atoi(parts[1])
+            // Parse endpoint manually since wgtypes.ParseEndpoint was removed;
+            // IPv6 endpoints are bracketed, e.g. [2001:db8::1]:51820
+            host, portStr, err := net.SplitHostPort(peer.Endpoint)
+            if err == nil {
+                port, err := strconv.Atoi(portStr)
                 if err != nil {
                     log.Errorf("Invalid endpoint port for peer %s: %v", peer.NodeID, err)
                 } else {
@@ -322,22 +344,20 @@ func (m *Manager) fetchPeersFromManager() ([]Peer, error) {
     return response.Peers, nil
 }
 
+// parseAllowedIPs parses a peer's AllowedIPs with the same rules the clients
+// apply to their wg-quick configs, so both ends agree on the routes
 func (m *Manager) parseAllowedIPs(allowedIPsStr string) ([]net.IPNet, error) {
-    var allowedIPs []net.IPNet
+    prefixes, err := wgconfig.ParseAllowedIPs(allowedIPsStr)
+    if err != nil {
+        return nil, fmt.Errorf("invalid allowed IPs %q: %w", allowedIPsStr, err)
+    }
     
-    for _, ipStr := range strings.Split(allowedIPsStr, ",") {
-        ipStr = strings.TrimSpace(ipStr)
-        if ipStr == "" {
-            continue
-        }
-        
-        // Parse using standard net package since wgtypes.ParseIPNet was removed
-        _, ipNet, err := net.ParseCIDR(ipStr)
-        if err != nil {
-            return nil, fmt.Errorf("invalid IP network %s: %w", ipStr, err)
-        }
-        
-        allowedIPs = append(allowedIPs, *ipNet)
+    allowedIPs := make([]net.IPNet, 0, len(prefixes))
+    for _, prefix := range prefixes {
+        allowedIPs = append(allowedIPs, net.IPNet{
+            IP:   prefix.Addr().AsSlice(),
+            Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+        })
     }
     
     return allowedIPs, nil
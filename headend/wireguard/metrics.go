@@ -0,0 +1,63 @@
+package wireguard
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    wgListenerPackets = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "headend_wireguard_listener_packets_total",
+        Help: "Total datagrams received on the WireGuard listen port, before decryption.",
+    })
+
+    wgListenerSources = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_wireguard_listener_sources",
+        Help: "Distinct source addresses recently seen on the WireGuard listen port.",
+    })
+
+    wgHandshakeInitiations = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "headend_wireguard_handshake_initiations_total",
+        Help: "Total handshake initiation messages received on the WireGuard listen port.",
+    })
+
+    wgHandshakesDropped = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "headend_wireguard_handshake_initiations_dropped_total",
+        Help: "Total handshake initiations dropped by the per-source rate limit.",
+    })
+
+    wgHandshakes = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "headend_wireguard_handshakes_total",
+        Help: "Total handshakes completed with configured peers.",
+    })
+
+    wgPeers = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_wireguard_peers",
+        Help: "Number of peers configured on the WireGuard interface.",
+    })
+
+    wgActivePeers = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_wireguard_active_peers",
+        Help: "Number of peers with a handshake in the last three minutes.",
+    })
+
+    wgPeerEndpoints = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "headend_wireguard_peer_endpoints",
+        Help: "Distinct endpoint addresses of configured peers.",
+    })
+
+    wgTunnelPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "headend_wireguard_tunnel_packets_total",
+        Help: "Total decrypted packets carried by the WireGuard interface, by direction.",
+    }, []string{"direction"})
+
+    peerTableRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "headend_wireguard_peer_table_refreshes_total",
+        Help: "Total reads of the WireGuard peers into the routing peer table, by result.",
+    }, []string{"result"})
+
+    peerTableInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "headend_wireguard_peer_table_invalidations_total",
+        Help: "Total invalidations of the routing peer table after peer changes.",
+    })
+)
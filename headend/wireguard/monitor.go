@@ -0,0 +1,358 @@
+package wireguard
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+    "golang.zx2c4.com/wireguard/wgctrl"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+    // ListenerChain is the iptables chain setup-routing.sh installs in front
+    // of the WireGuard listen port. The Monitor reads its rule counters.
+    ListenerChain = "TOBOGGANING-WG"
+
+    // DefaultMonitorInterval is how often the Monitor polls the interface
+    DefaultMonitorInterval = 15 * time.Second
+
+    // activePeerWindow is how recent a handshake must be for a peer to count
+    // as active. WireGuard rekeys every two minutes while traffic flows.
+    activePeerWindow = 3 * time.Minute
+
+    // Comments tagging the rules of ListenerChain
+    ruleListener           = "wg-listener"
+    ruleHandshake          = "wg-handshake-initiation"
+    ruleHandshakeRateLimit = "wg-handshake-ratelimit"
+
+    // sourcesTable is the hashlimit table tracking listener source addresses
+    sourcesTable = "/proc/net/ipt_hashlimit/wg-sources"
+)
+
+// MonitorStatus summarizes the WireGuard listener (control) and tunnel
+// (data) traffic for health checks
+type MonitorStatus struct {
+    Peers                int       `json:"peers"`
+    ActivePeers          int       `json:"active_peers"`
+    PeerEndpoints        int       `json:"peer_endpoints"`
+    ListenerSources      int       `json:"listener_sources"`
+    ListenerPackets      uint64    `json:"listener_packets"`
+    HandshakeInitiations uint64    `json:"handshake_initiations"`
+    HandshakesDropped    uint64    `json:"handshakes_dropped"`
+    HandshakeRateLimited bool      `json:"handshake_rate_limited"`
+    UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// Monitor polls the WireGuard interface and the iptables counters of its
+// listen port, keeping handshake and packet metrics apart from the proxy's
+// data ports
+type Monitor struct {
+    interfaceName string
+    interval      time.Duration
+    client        *wgctrl.Client
+    handshakes    map[wgtypes.Key]time.Time
+    counters      map[string]uint64
+    status        MonitorStatus
+    mu            sync.RWMutex
+    stopChan      chan bool
+}
+
+// NewMonitor creates a Monitor for interfaceName. Without access to the
+// WireGuard control interface only the iptables counters are collected.
+func NewMonitor(interfaceName string, interval time.Duration) *Monitor {
+    if interval <= 0 {
+        interval = DefaultMonitorInterval
+    }
+
+    client, err := wgctrl.New()
+    if err != nil {
+        log.Warnf("WireGuard monitor cannot read peers: %v", err)
+        client = nil
+    }
+
+    return &Monitor{
+        interfaceName: interfaceName,
+        interval:      interval,
+        client:        client,
+        handshakes:    make(map[wgtypes.Key]time.Time),
+        counters:      make(map[string]uint64),
+        stopChan:      make(chan bool),
+    }
+}
+
+// Start begins polling in the background
+func (m *Monitor) Start() {
+    go func() {
+        ticker := time.NewTicker(m.interval)
+        defer ticker.Stop()
+
+        m.poll()
+        for {
+            select {
+            case <-ticker.C:
+                m.poll()
+            case <-m.stopChan:
+                return
+            }
+        }
+    }()
+}
+
+// Stop ends polling and releases the WireGuard client
+func (m *Monitor) Stop() {
+    close(m.stopChan)
+    if m.client != nil {
+        if err := m.client.Close(); err != nil {
+            log.Debugf("Error closing WireGuard client: %v", err)
+        }
+    }
+}
+
+// Status returns the most recent poll. It is nil-safe.
+func (m *Monitor) Status() *MonitorStatus {
+    if m == nil {
+        return nil
+    }
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    status := m.status
+    return &status
+}
+
+// PeerInfo describes one WireGuard peer for the admin API
+type PeerInfo struct {
+    PublicKey     string    `json:"public_key"`
+    Endpoint      string    `json:"endpoint,omitempty"`
+    AllowedIPs    []string  `json:"allowed_ips"`
+    LastHandshake time.Time `json:"last_handshake,omitempty"`
+    Active        bool      `json:"active"`
+    ReceiveBytes  int64     `json:"receive_bytes"`
+    TransmitBytes int64     `json:"transmit_bytes"`
+}
+
+// Peers reads the interface's peers. It is nil-safe.
+func (m *Monitor) Peers() ([]PeerInfo, error) {
+    if m == nil || m.client == nil {
+        return nil, fmt.Errorf("WireGuard peers are not available")
+    }
+
+    device, err := m.client.Device(m.interfaceName)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read WireGuard device %s: %w", m.interfaceName, err)
+    }
+
+    now := time.Now()
+    peers := make([]PeerInfo, 0, len(device.Peers))
+    for _, peer := range device.Peers {
+        info := PeerInfo{
+            PublicKey:     peer.PublicKey.String(),
+            AllowedIPs:    make([]string, 0, len(peer.AllowedIPs)),
+            LastHandshake: peer.LastHandshakeTime,
+            Active:        !peer.LastHandshakeTime.IsZero() && now.Sub(peer.LastHandshakeTime) < activePeerWindow,
+            ReceiveBytes:  peer.ReceiveBytes,
+            TransmitBytes: peer.TransmitBytes,
+        }
+        if peer.Endpoint != nil {
+            info.Endpoint = peer.Endpoint.String()
+        }
+        for _, allowed := range peer.AllowedIPs {
+            info.AllowedIPs = append(info.AllowedIPs, allowed.String())
+        }
+        peers = append(peers, info)
+    }
+    return peers, nil
+}
+
+func (m *Monitor) poll() {
+    now := time.Now()
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.client != nil {
+        if device, err := m.client.Device(m.interfaceName); err != nil {
+            log.Debugf("Failed to read WireGuard device %s: %v", m.interfaceName, err)
+        } else {
+            m.observePeers(device.Peers, now)
+        }
+    }
+
+    if counters, err := readChainCounters(); err != nil {
+        log.Debugf("Failed to read WireGuard listener counters: %v", err)
+    } else {
+        m.observeCounters(counters)
+    }
+
+    if sources, err := countTableEntries(sourcesTable); err == nil {
+        m.status.ListenerSources = sources
+        wgListenerSources.Set(float64(sources))
+    }
+
+    m.observeTunnel()
+    m.status.UpdatedAt = now
+}
+
+// observePeers counts completed handshakes and distinct peer endpoints;
+// m.mu must be held
+func (m *Monitor) observePeers(peers []wgtypes.Peer, now time.Time) {
+    endpoints := make(map[string]bool)
+    seen := make(map[wgtypes.Key]bool, len(peers))
+    active := 0
+
+    for _, peer := range peers {
+        seen[peer.PublicKey] = true
+        if peer.Endpoint != nil {
+            endpoints[peer.Endpoint.IP.String()] = true
+        }
+        if peer.LastHandshakeTime.IsZero() {
+            continue
+        }
+        if now.Sub(peer.LastHandshakeTime) < activePeerWindow {
+            active++
+        }
+
+        // The first sighting of a peer only sets the baseline
+        last, known := m.handshakes[peer.PublicKey]
+        if known && peer.LastHandshakeTime.After(last) {
+            wgHandshakes.Inc()
+        }
+        m.handshakes[peer.PublicKey] = peer.LastHandshakeTime
+    }
+
+    for key := range m.handshakes {
+        if !seen[key] {
+            delete(m.handshakes, key)
+        }
+    }
+
+    m.status.Peers = len(peers)
+    m.status.ActivePeers = active
+    m.status.PeerEndpoints = len(endpoints)
+    wgPeers.Set(float64(len(peers)))
+    wgActivePeers.Set(float64(active))
+    wgPeerEndpoints.Set(float64(len(endpoints)))
+}
+
+// observeCounters turns the chain's absolute rule counters into metric
+// increments; m.mu must be held
+func (m *Monitor) observeCounters(counters map[string]uint64) {
+    m.addCounter(ruleListener, counters[ruleListener], wgListenerPackets.Add)
+    m.addCounter(ruleHandshake, counters[ruleHandshake], wgHandshakeInitiations.Add)
+    m.addCounter(ruleHandshakeRateLimit, counters[ruleHandshakeRateLimit], wgHandshakesDropped.Add)
+
+    _, limited := counters[ruleHandshakeRateLimit]
+    m.status.ListenerPackets = counters[ruleListener]
+    m.status.HandshakeInitiations = counters[ruleHandshake]
+    m.status.HandshakesDropped = counters[ruleHandshakeRateLimit]
+    m.status.HandshakeRateLimited = limited
+}
+
+// observeTunnel records the decrypted packets carried by the interface;
+// m.mu must be held
+func (m *Monitor) observeTunnel() {
+    stats := filepath.Join("/sys/class/net", m.interfaceName, "statistics")
+    for direction, file := range map[string]string{"rx": "rx_packets", "tx": "tx_packets"} {
+        data, err := os.ReadFile(filepath.Join(stats, file))
+        if err != nil {
+            continue
+        }
+        value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+        if err != nil {
+            continue
+        }
+        m.addCounter("tunnel_"+direction, value, wgTunnelPackets.WithLabelValues(direction).Add)
+    }
+}
+
+// addCounter adds the growth of an absolute counter since the last poll.
+// A smaller value means the counter was reset, e.g. by the chain being
+// reinstalled, and counts from zero. m.mu must be held.
+func (m *Monitor) addCounter(name string, value uint64, add func(float64)) {
+    last, known := m.counters[name]
+    m.counters[name] = value
+    if !known {
+        return
+    }
+    if value < last {
+        last = 0
+    }
+    if value > last {
+        add(float64(value - last))
+    }
+}
+
+// readChainCounters returns the packet counter of each commented rule in
+// ListenerChain
+func readChainCounters() (map[string]uint64, error) {
+    output, err := exec.Command("iptables", "-w", "-n", "-v", "-x", "-L", ListenerChain).Output()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list %s: %w", ListenerChain, err)
+    }
+    return parseChainCounters(bytes.NewReader(output))
+}
+
+// parseChainCounters parses `iptables -nvxL` output, keying the packet
+// counter of each rule by its /* comment */
+func parseChainCounters(r io.Reader) (map[string]uint64, error) {
+    counters := make(map[string]uint64)
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        line := scanner.Text()
+        start := strings.Index(line, "/* ")
+        end := strings.Index(line, " */")
+        if start < 0 || end < start {
+            continue
+        }
+        fields := strings.Fields(line)
+        packets, err := strconv.ParseUint(fields[0], 10, 64)
+        if err != nil {
+            continue
+        }
+        counters[line[start+3:end]] += packets
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read iptables output: %w", err)
+    }
+    return counters, nil
+}
+
+// countTableEntries counts the source addresses in a hashlimit table. The
+// kernel expires entries, so this is the number of recent sources.
+func countTableEntries(path string) (int, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer file.Close()
+    return countSources(file)
+}
+
+// countSources counts the distinct source IPs of hashlimit table entries,
+// which look like "<expires> <src>:<port>-><dst>:<port> ..."
+func countSources(r io.Reader) (int, error) {
+    sources := make(map[string]bool)
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 2 {
+            continue
+        }
+        src := strings.SplitN(fields[1], "->", 2)[0]
+        if host, _, err := net.SplitHostPort(src); err == nil {
+            src = host
+        }
+        sources[src] = true
+    }
+    return len(sources), scanner.Err()
+}
@@ -0,0 +1,90 @@
+package wireguard
+
+import (
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const chainOutput = `Chain TOBOGGANING-WG (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+    1200   180000            all  --  *      *       0.0.0.0/0            0.0.0.0/0            limit: up to 100000/sec burst 5 mode srcip htable-expire 60000 /* wg-listener */
+      40     7040            all  --  *      *       0.0.0.0/0            0.0.0.0/0            length 176 u32 "0x0>>0x16&0x3c@0x8>>0x18=0x1" /* wg-handshake-initiation */
+      12     2112 DROP       all  --  *      *       0.0.0.0/0            0.0.0.0/0            length 176 u32 "0x0>>0x16&0x3c@0x8>>0x18=0x1" limit: above 5/sec burst 10 mode srcip /* wg-handshake-ratelimit */
+    1188   177888 RETURN     all  --  *      *       0.0.0.0/0            0.0.0.0/0
+`
+
+func TestParseChainCounters(t *testing.T) {
+    counters, err := parseChainCounters(strings.NewReader(chainOutput))
+    if err != nil {
+        t.Fatalf("parse: %v", err)
+    }
+
+    want := map[string]uint64{ruleListener: 1200, ruleHandshake: 40, ruleHandshakeRateLimit: 12}
+    if len(counters) != len(want) {
+        t.Fatalf("got %v, want %v", counters, want)
+    }
+    for rule, packets := range want {
+        if counters[rule] != packets {
+            t.Errorf("%s = %d, want %d", rule, counters[rule], packets)
+        }
+    }
+}
+
+func TestCountSources(t *testing.T) {
+    table := `58 192.0.2.1:0->0.0.0.0:0 1000000 1000000 32
+59 192.0.2.1:0->0.0.0.0:0 1000000 1000000 32
+60 198.51.100.7:0->0.0.0.0:0 1000000 1000000 32
+`
+    sources, err := countSources(strings.NewReader(table))
+    if err != nil || sources != 2 {
+        t.Fatalf("countSources = %d, %v; want 2", sources, err)
+    }
+}
+
+func TestMonitorCounters(t *testing.T) {
+    m := &Monitor{handshakes: make(map[wgtypes.Key]time.Time), counters: make(map[string]uint64)}
+
+    var added float64
+    add := func(n float64) { added += n }
+
+    // The first reading is only a baseline
+    m.addCounter("packets", 100, add)
+    m.addCounter("packets", 150, add)
+    if added != 50 {
+        t.Fatalf("added %v, want 50", added)
+    }
+
+    // A reset counts from zero
+    m.addCounter("packets", 20, add)
+    if added != 70 {
+        t.Fatalf("added %v after reset, want 70", added)
+    }
+}
+
+func TestMonitorPeers(t *testing.T) {
+    m := &Monitor{handshakes: make(map[wgtypes.Key]time.Time), counters: make(map[string]uint64)}
+    now := time.Now()
+
+    var a, b wgtypes.Key
+    a[0], b[0] = 1, 2
+    endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+    peers := []wgtypes.Peer{
+        {PublicKey: a, Endpoint: endpoint, LastHandshakeTime: now.Add(-time.Minute)},
+        {PublicKey: b, Endpoint: endpoint, LastHandshakeTime: now.Add(-time.Hour)},
+    }
+
+    m.observePeers(peers, now)
+    if m.status.Peers != 2 || m.status.ActivePeers != 1 || m.status.PeerEndpoints != 1 {
+        t.Fatalf("unexpected status %+v", m.status)
+    }
+
+    // Removed peers are forgotten
+    m.observePeers(peers[:1], now)
+    if _, ok := m.handshakes[b]; ok {
+        t.Error("removed peer is still tracked")
+    }
+}
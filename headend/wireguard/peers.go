@@ -0,0 +1,192 @@
+package wireguard
+
+import (
+    "fmt"
+    "io"
+    "net/netip"
+    "sync"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultPeerRefreshInterval is how often a PeerTable rereads the interface
+const DefaultPeerRefreshInterval = 30 * time.Second
+
+// DeviceReader reads a WireGuard device; *wgctrl.Client implements it
+type DeviceReader interface {
+    Device(name string) (*wgtypes.Device, error)
+}
+
+// PeerTable keeps the allowed IPs of the interface's peers in memory, so
+// routing a connection to a peer doesn't read the interface each time. The
+// table is reread every interval, and on the next lookup after Invalidate,
+// which whatever changes the peers calls.
+type PeerTable struct {
+    interfaceName string
+    interval      time.Duration
+    device        DeviceReader
+    prefixes      []netip.Prefix
+    // loaded is false until the first read and after Invalidate
+    loaded bool
+    // generation counts invalidations, so a read that raced one doesn't
+    // mark the table loaded
+    generation uint64
+    mu         sync.RWMutex
+    stopChan   chan bool
+    stopOnce   sync.Once
+}
+
+// NewPeerTable creates a table of interfaceName's peers read from device,
+// which Stop closes if it is an io.Closer
+func NewPeerTable(interfaceName string, interval time.Duration, device DeviceReader) *PeerTable {
+    if interval <= 0 {
+        interval = DefaultPeerRefreshInterval
+    }
+    return &PeerTable{
+        interfaceName: interfaceName,
+        interval:      interval,
+        device:        device,
+        stopChan:      make(chan bool),
+    }
+}
+
+// Start rereads the interface every interval in the background
+func (t *PeerTable) Start() {
+    go func() {
+        ticker := time.NewTicker(t.interval)
+        defer ticker.Stop()
+
+        for {
+            if err := t.Refresh(); err != nil {
+                log.Debugf("Failed to refresh WireGuard peers: %v", err)
+            }
+            select {
+            case <-ticker.C:
+            case <-t.stopChan:
+                return
+            }
+        }
+    }()
+}
+
+// Stop ends the background refresh and releases the device. It is
+// nil-safe.
+func (t *PeerTable) Stop() {
+    if t == nil {
+        return
+    }
+    t.stopOnce.Do(func() {
+        close(t.stopChan)
+        if closer, ok := t.device.(io.Closer); ok {
+            if err := closer.Close(); err != nil {
+                log.Debugf("Error closing WireGuard client: %v", err)
+            }
+        }
+    })
+}
+
+// Invalidate makes the next lookup reread the interface, e.g. after its
+// peers were replaced. It is nil-safe.
+func (t *PeerTable) Invalidate() {
+    if t == nil {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.loaded = false
+    t.generation++
+    peerTableInvalidations.Inc()
+}
+
+// Refresh rereads the interface's peers
+func (t *PeerTable) Refresh() error {
+    t.mu.RLock()
+    generation := t.generation
+    t.mu.RUnlock()
+
+    device, err := t.device.Device(t.interfaceName)
+    if err != nil {
+        peerTableRefreshes.WithLabelValues("error").Inc()
+        return fmt.Errorf("failed to read WireGuard device %s: %w", t.interfaceName, err)
+    }
+    var prefixes []netip.Prefix
+    for _, peer := range device.Peers {
+        for _, allowed := range peer.AllowedIPs {
+            addr, ok := netip.AddrFromSlice(allowed.IP)
+            if !ok {
+                continue
+            }
+            ones, bits := allowed.Mask.Size()
+            if addr.Is4In6() && bits == 128 {
+                ones -= 96
+            }
+            prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), ones).Masked())
+        }
+    }
+
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.prefixes = prefixes
+    if t.generation == generation {
+        t.loaded = true
+    }
+    peerTableRefreshes.WithLabelValues("ok").Inc()
+    return nil
+}
+
+// snapshot returns the table's prefixes, rereading the interface first if
+// the table isn't loaded
+func (t *PeerTable) snapshot() ([]netip.Prefix, error) {
+    t.mu.RLock()
+    prefixes, loaded := t.prefixes, t.loaded
+    t.mu.RUnlock()
+    if loaded {
+        return prefixes, nil
+    }
+
+    if err := t.Refresh(); err != nil {
+        return nil, err
+    }
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    return t.prefixes, nil
+}
+
+// Contains reports whether ip is in the allowed IPs of a peer. It is
+// nil-safe and false when the interface can't be read.
+func (t *PeerTable) Contains(ip netip.Addr) bool {
+    if t == nil || !ip.IsValid() {
+        return false
+    }
+    prefixes, err := t.snapshot()
+    if err != nil {
+        log.Errorf("Failed to check WireGuard peers: %v", err)
+        return false
+    }
+    ip = ip.Unmap()
+    for _, prefix := range prefixes {
+        if prefix.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Addresses returns the address of each allowed IP of the peers, e.g.
+// 10.200.1.2 and fd00:200::1:2 for a dual-stack peer. It is nil-safe.
+func (t *PeerTable) Addresses() ([]string, error) {
+    if t == nil {
+        return nil, fmt.Errorf("WireGuard peers are not available")
+    }
+    prefixes, err := t.snapshot()
+    if err != nil {
+        return nil, err
+    }
+    addresses := make([]string, 0, len(prefixes))
+    for _, prefix := range prefixes {
+        addresses = append(addresses, prefix.Addr().String())
+    }
+    return addresses, nil
+}
@@ -0,0 +1,98 @@
+package wireguard
+
+import (
+    "errors"
+    "net"
+    "net/netip"
+    "testing"
+
+    "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeDevice counts reads of a device with the given peers' allowed IPs
+type fakeDevice struct {
+    allowedIPs [][]string
+    err        error
+    reads      int
+}
+
+func (d *fakeDevice) Device(name string) (*wgtypes.Device, error) {
+    d.reads++
+    if d.err != nil {
+        return nil, d.err
+    }
+    device := &wgtypes.Device{Name: name}
+    for _, ips := range d.allowedIPs {
+        var peer wgtypes.Peer
+        for _, cidr := range ips {
+            _, network, _ := net.ParseCIDR(cidr)
+            peer.AllowedIPs = append(peer.AllowedIPs, *network)
+        }
+        device.Peers = append(device.Peers, peer)
+    }
+    return device, nil
+}
+
+func TestPeerTableLookups(t *testing.T) {
+    device := &fakeDevice{allowedIPs: [][]string{
+        {"10.200.1.2/32", "fd00:200::1:2/128"},
+        {"10.200.2.0/24"},
+    }}
+    table := NewPeerTable("wg0", 0, device)
+
+    for ip, want := range map[string]bool{
+        "10.200.1.2":    true,
+        "fd00:200::1:2": true,
+        "10.200.2.77":   true,
+        "10.200.1.3":    false,
+        "fd00:200::1:3": false,
+    } {
+        if got := table.Contains(netip.MustParseAddr(ip)); got != want {
+            t.Errorf("Contains(%s) = %v, want %v", ip, got, want)
+        }
+    }
+    if device.reads != 1 {
+        t.Errorf("expected lookups served from one read, got %d", device.reads)
+    }
+
+    addresses, err := table.Addresses()
+    if err != nil || len(addresses) != 3 || addresses[1] != "fd00:200::1:2" {
+        t.Errorf("unexpected addresses %v, %v", addresses, err)
+    }
+}
+
+func TestPeerTableInvalidate(t *testing.T) {
+    device := &fakeDevice{allowedIPs: [][]string{{"10.200.1.2/32"}}}
+    table := NewPeerTable("wg0", 0, device)
+    peer := netip.MustParseAddr("10.200.1.3")
+    if table.Contains(peer) {
+        t.Fatal("expected an unknown peer")
+    }
+
+    // A synced peer is found once the table is invalidated
+    device.allowedIPs = append(device.allowedIPs, []string{"10.200.1.3/32"})
+    if table.Contains(peer) {
+        t.Fatal("expected the table to be served until invalidated")
+    }
+    table.Invalidate()
+    if !table.Contains(peer) || device.reads != 2 {
+        t.Errorf("expected the new peer after one more read, got %d reads", device.reads)
+    }
+
+    // An unreadable device denies peer routing
+    device.err = errors.New("no such device")
+    table.Invalidate()
+    if table.Contains(peer) {
+        t.Error("expected no peers without the device")
+    }
+    if _, err := table.Addresses(); err == nil {
+        t.Error("expected the read error")
+    }
+
+    var none *PeerTable
+    if none.Contains(peer) {
+        t.Error("expected a nil table to contain nothing")
+    }
+    none.Invalidate()
+    none.Stop()
+}
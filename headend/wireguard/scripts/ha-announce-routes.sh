@@ -0,0 +1,29 @@
+#!/bin/bash
+# Re-announce routes after this headend becomes HA master
+#
+# Run by the headend proxy (ha.on_master) once it has taken over the pair's
+# virtual IP. Upstream switches learn the new location of the VIP from
+# gratuitous ARP, and the WireGuard network route is restored locally.
+# HA_ANNOUNCE_COMMAND can hook in a routing daemon, e.g. "birdc reload all".
+
+set -e
+
+WG_INTERFACE="wg0"
+WG_NETWORK="${WG_IP_ADDRESS%/*}/16"
+HA_VIP="${HA_VIP:-}"
+HA_VIP_INTERFACE="${HA_VIP_INTERFACE:-eth0}"
+
+echo "Re-announcing routes as HA ${HA_STATE:-MASTER}"
+
+ip route replace "$WG_NETWORK" dev "$WG_INTERFACE" 2>/dev/null || true
+
+if [ -n "$HA_VIP" ]; then
+    arping -c 3 -U -I "$HA_VIP_INTERFACE" "${HA_VIP%/*}" > /dev/null 2>&1 || \
+        echo "Gratuitous ARP for $HA_VIP failed" >&2
+fi
+
+if [ -n "$HA_ANNOUNCE_COMMAND" ]; then
+    sh -c "$HA_ANNOUNCE_COMMAND"
+fi
+
+echo "Routes re-announced"
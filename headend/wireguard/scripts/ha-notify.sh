@@ -0,0 +1,50 @@
+#!/bin/bash
+# Keepalived notify hook for a warm standby headend pair
+#
+# Keepalived owns the virtual IP; this hook tells the local headend proxy
+# about every VRRP state change so the standby stops replicating and takes
+# over when it becomes MASTER. Both headends must share the WireGuard
+# private key and HA_TOKEN, and set ha.peer_url to each other.
+#
+# Example keepalived.conf on each headend:
+#
+#   vrrp_instance headend {
+#       state BACKUP
+#       interface eth0
+#       virtual_router_id 51
+#       priority 100            # 90 on the standby
+#       advert_int 1
+#       virtual_ipaddress {
+#           203.0.113.10/24
+#       }
+#       notify /app/scripts/ha-notify.sh
+#   }
+#
+# Keepalived calls notify scripts as: <type> <name> <state> <priority>
+
+set -e
+
+STATE="$3"
+HA_TOKEN="${HA_TOKEN:?HA_TOKEN must be set}"
+PROXY_URL="${PROXY_URL:-http://127.0.0.1:8443}"
+
+if [ -z "$STATE" ]; then
+    echo "Usage: $0 <type> <name> <state> [priority]" >&2
+    exit 1
+fi
+
+echo "Reporting VRRP state $STATE for $1 $2 to the headend proxy"
+
+# Retry briefly in case the proxy is still starting
+for attempt in 1 2 3 4 5; do
+    if curl -fsS -X POST "$PROXY_URL/ha/transition" \
+        -H "Authorization: Bearer $HA_TOKEN" \
+        -H "Content-Type: application/json" \
+        -d "{\"state\": \"$STATE\"}" > /dev/null; then
+        exit 0
+    fi
+    sleep 1
+done
+
+echo "Failed to report VRRP state $STATE to the headend proxy" >&2
+exit 1
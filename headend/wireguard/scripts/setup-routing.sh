@@ -1,6 +1,9 @@
 #!/bin/bash
 # Setup intelligent routing for WireGuard traffic
 # Supports both peer-to-peer and internet-bound traffic patterns
+#
+# WG_HANDSHAKE_RATE (e.g. "5/second") limits handshake initiations per
+# source address on the WireGuard listen port; unset disables the limit.
 
 set -e
 
@@ -8,6 +11,8 @@ WG_INTERFACE="wg0"
 WG_NETWORK="${WG_IP_ADDRESS%/*}/16"  # Extract network from IP (e.g., 10.200.0.0/16)
 PROXY_TCP_PORT="8444"
 PROXY_UDP_PORT="8445"
+WG_LISTEN_PORT="${WG_LISTEN_PORT:-51820}"
+WG_LISTENER_CHAIN="TOBOGGANING-WG"
 
 echo "Setting up routing for WireGuard network: $WG_NETWORK"
 
@@ -74,6 +79,37 @@ iptables -A FORWARD -i $WG_INTERFACE -j DROP
 
 echo "✓ Security rules applied"
 
+# 5. WIREGUARD LISTENER
+echo "Configuring WireGuard listener accounting on port $WG_LISTEN_PORT..."
+
+# The headend proxy reads the counters of these rules by their comments
+iptables -N $WG_LISTENER_CHAIN 2>/dev/null || iptables -F $WG_LISTENER_CHAIN
+iptables -D INPUT -p udp --dport $WG_LISTEN_PORT -j $WG_LISTENER_CHAIN 2>/dev/null || true
+iptables -I INPUT -p udp --dport $WG_LISTEN_PORT -j $WG_LISTENER_CHAIN
+
+# Count every datagram and remember its source for a minute (the rate is
+# never reached; the table only measures source diversity)
+iptables -A $WG_LISTENER_CHAIN \
+    -m hashlimit --hashlimit-name wg-sources --hashlimit-mode srcip \
+    --hashlimit-upto 100000/second --hashlimit-htable-expire 60000 \
+    -m comment --comment wg-listener
+
+# Handshake initiations are 148-byte messages of type 1 (IPv4 total length 176)
+WG_HANDSHAKE_MATCH="-m length --length 176 -m u32 --u32 0>>22&0x3C@8>>24=0x1"
+iptables -A $WG_LISTENER_CHAIN $WG_HANDSHAKE_MATCH -m comment --comment wg-handshake-initiation
+
+if [ -n "$WG_HANDSHAKE_RATE" ]; then
+    iptables -A $WG_LISTENER_CHAIN $WG_HANDSHAKE_MATCH \
+        -m hashlimit --hashlimit-name wg-handshake --hashlimit-mode srcip \
+        --hashlimit-above "$WG_HANDSHAKE_RATE" --hashlimit-burst "${WG_HANDSHAKE_BURST:-10}" \
+        -m comment --comment wg-handshake-ratelimit -j DROP
+    echo "✓ Handshake initiations limited to $WG_HANDSHAKE_RATE per source"
+fi
+
+iptables -A $WG_LISTENER_CHAIN -j RETURN
+
+echo "✓ WireGuard listener accounting configured"
+
 echo "WireGuard routing setup complete!"
 echo ""
 echo "Traffic Patterns:"
@@ -0,0 +1,299 @@
+// Package featureflag implements the feature flags the Manager uses to roll
+// out SASEWaddle features gradually to headends and clients.
+//
+// The featureflag package provides:
+//   - The flags this release knows about, each with a compiled-in default
+//   - The payload the Manager delivers in headend and client configuration,
+//     with a rule per flag
+//   - Targeting by tenant, by cohort (user group or label) and by a stable
+//     percentage of subjects, plus subjects that are always included
+//   - Local overrides so operators can force a flag either way
+//
+// Flags are safe by default: a flag the payload does not mention, a rule
+// that fails validation, a payload that cannot be fetched and a nil Set all
+// evaluate to the compiled-in default, which is the behaviour the release
+// had before the flag existed. A bad rule never turns a feature on.
+package featureflag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sync"
+)
+
+// Flags consulted by headend and client subsystems
+const (
+	// FramingV2 offers the binary connection header from libs/framing
+	// (protocol v2) during capability negotiation
+	FramingV2 = "framing_v2"
+	// FallbackTransport offers the TCP, UDP and HTTPS transports for clients
+	// whose WireGuard traffic is blocked
+	FallbackTransport = "fallback_transport"
+	// DNSProxy resolves client DNS queries through the headend
+	DNSProxy = "dns_proxy"
+)
+
+// Definition describes a flag this release knows about
+type Definition struct {
+	Name        string
+	Description string
+	// Default is used whenever the Manager has no valid rule for the flag
+	Default bool
+}
+
+// Definitions are the flags of this release. Features that shipped before
+// they had a flag default to on, so the flag can only switch them off.
+var Definitions = []Definition{
+	{Name: FramingV2, Description: "Binary connection header (protocol v2)", Default: true},
+	{Name: FallbackTransport, Description: "TCP, UDP and HTTPS fallback transports", Default: true},
+	{Name: DNSProxy, Description: "DNS resolution through the headend", Default: false},
+}
+
+// Rule decides a flag for the subjects it targets. A disabled rule turns the
+// flag off for everyone; an enabled one turns it on for subjects matching
+// every targeting condition that is set, and off for the rest.
+type Rule struct {
+	Enabled bool `json:"enabled"`
+	// Percent is the share of subjects, 0 to 100, chosen by a stable hash of
+	// the subject ID so raising it only ever adds subjects. Unset means all.
+	Percent *int `json:"percent,omitempty"`
+	// Tenants limits the flag to subjects of these tenants
+	Tenants []string `json:"tenants,omitempty"`
+	// Cohorts limits the flag to subjects in at least one of these cohorts
+	Cohorts []string `json:"cohorts,omitempty"`
+	// Subjects always get the flag while it is enabled, e.g. for canaries
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// Validate reports whether the rule can be evaluated
+func (r Rule) Validate() error {
+	if r.Percent != nil && (*r.Percent < 0 || *r.Percent > 100) {
+		return fmt.Errorf("percent %d is not between 0 and 100", *r.Percent)
+	}
+	return nil
+}
+
+// Payload is the flag configuration the Manager delivers
+type Payload struct {
+	Version string          `json:"version"`
+	Flags   map[string]Rule `json:"flags"`
+	// Subject describes the recipient as the Manager knows it, for flags
+	// evaluated for the headend or client as a whole
+	Subject *Subject `json:"subject,omitempty"`
+}
+
+// Subject is who a flag is evaluated for: a user, a client or a headend
+type Subject struct {
+	ID      string   `json:"id"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Cohorts []string `json:"cohorts,omitempty"`
+}
+
+// Parse decodes a payload
+func Parse(data []byte) (Payload, error) {
+	var payload Payload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Payload{}, fmt.Errorf("invalid feature flag payload: %w", err)
+	}
+	return payload, nil
+}
+
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Set evaluates flags against the rules last applied. A nil Set evaluates
+// every flag to its default.
+type Set struct {
+	mu        sync.RWMutex
+	defaults  map[string]bool
+	rules     map[string]Rule
+	overrides map[string]bool
+	version   string
+	subject   Subject
+}
+
+// New creates a Set of the given flags, or of Definitions if none are given
+func New(definitions ...Definition) *Set {
+	if len(definitions) == 0 {
+		definitions = Definitions
+	}
+	s := &Set{
+		defaults:  make(map[string]bool, len(definitions)),
+		rules:     make(map[string]Rule),
+		overrides: make(map[string]bool),
+	}
+	for _, def := range definitions {
+		s.defaults[def.Name] = def.Default
+	}
+	return s
+}
+
+// Apply replaces the rules with the payload's. Rules for flags this release
+// doesn't know are ignored; rules that fail validation are left out, so
+// their flags fall back to the default, and reported in the error.
+func (s *Set) Apply(payload Payload) error {
+	rules := make(map[string]Rule, len(payload.Flags))
+	var errs []error
+	for name, rule := range payload.Flags {
+		if !namePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("flag %q: invalid name", name))
+			continue
+		}
+		if _, known := s.defaults[name]; !known {
+			continue
+		}
+		if err := rule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("flag %s: %w", name, err))
+			continue
+		}
+		rules[name] = rule
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = rules
+	s.version = payload.Version
+	if payload.Subject != nil {
+		s.subject = *payload.Subject
+	}
+	return errors.Join(errs...)
+}
+
+// SetOverrides forces flags on or off regardless of the Manager's rules.
+// Overrides for unknown flags are reported and ignored.
+func (s *Set) SetOverrides(overrides map[string]bool) error {
+	kept := make(map[string]bool, len(overrides))
+	var errs []error
+	for name, on := range overrides {
+		if _, known := s.defaults[name]; !known {
+			errs = append(errs, fmt.Errorf("override for unknown flag %q", name))
+			continue
+		}
+		kept[name] = on
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = kept
+	return errors.Join(errs...)
+}
+
+// Version returns the version of the payload last applied
+func (s *Set) Version() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// Subject returns the recipient the Manager described in the payload last
+// applied, with id filled in if the Manager left it out
+func (s *Set) Subject(id string) Subject {
+	if s == nil {
+		return Subject{ID: id}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subject := s.subject
+	if subject.ID == "" {
+		subject.ID = id
+	}
+	return subject
+}
+
+// Enabled reports whether the flag is on for subject. Unknown flags are off.
+func (s *Set) Enabled(name string, subject Subject) bool {
+	if s == nil {
+		return Default(name)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled(name, subject)
+}
+
+// Evaluate reports every flag for subject
+func (s *Set) Evaluate(subject Subject) map[string]bool {
+	if s == nil {
+		flags := make(map[string]bool, len(Definitions))
+		for _, def := range Definitions {
+			flags[def.Name] = def.Default
+		}
+		return flags
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := make(map[string]bool, len(s.defaults))
+	for name := range s.defaults {
+		flags[name] = s.enabled(name, subject)
+	}
+	return flags
+}
+
+// enabled evaluates a flag; s.mu must be held
+func (s *Set) enabled(name string, subject Subject) bool {
+	if on, ok := s.overrides[name]; ok {
+		return on
+	}
+	rule, ok := s.rules[name]
+	if !ok {
+		return s.defaults[name]
+	}
+	if !rule.Enabled {
+		return false
+	}
+	if subject.ID != "" && contains(rule.Subjects, subject.ID) {
+		return true
+	}
+	if len(rule.Tenants) > 0 && !contains(rule.Tenants, subject.Tenant) {
+		return false
+	}
+	if len(rule.Cohorts) > 0 && !overlaps(rule.Cohorts, subject.Cohorts) {
+		return false
+	}
+	if rule.Percent != nil && Bucket(name, subject.ID) >= *rule.Percent {
+		return false
+	}
+	return true
+}
+
+// Default returns the compiled-in default of a flag in Definitions
+func Default(name string) bool {
+	for _, def := range Definitions {
+		if def.Name == name {
+			return def.Default
+		}
+	}
+	return false
+}
+
+// Bucket maps a subject to a stable bucket in [0, 100) for a flag. The flag
+// name is mixed in so each rollout picks a different share of subjects.
+func Bucket(flag, subjectID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(flag))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(subjectID))
+	return int(h.Sum32() % 100)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func overlaps(a, b []string) bool {
+	for _, v := range b {
+		if contains(a, v) {
+			return true
+		}
+	}
+	return false
+}
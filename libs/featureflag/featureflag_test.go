@@ -0,0 +1,135 @@
+package featureflag
+
+import (
+	"fmt"
+	"testing"
+)
+
+func percent(p int) *int { return &p }
+
+func TestDefaults(t *testing.T) {
+	var nilSet *Set
+	s := New()
+	for _, def := range Definitions {
+		if got := nilSet.Enabled(def.Name, Subject{ID: "alice"}); got != def.Default {
+			t.Errorf("nil set: %s = %v, want %v", def.Name, got, def.Default)
+		}
+		if got := s.Enabled(def.Name, Subject{ID: "alice"}); got != def.Default {
+			t.Errorf("empty set: %s = %v, want %v", def.Name, got, def.Default)
+		}
+	}
+	if s.Enabled("no_such_flag", Subject{ID: "alice"}) {
+		t.Error("unknown flag is on")
+	}
+}
+
+func TestTargeting(t *testing.T) {
+	s := New()
+	err := s.Apply(Payload{
+		Version: "v3",
+		Flags: map[string]Rule{
+			DNSProxy: {
+				Enabled:  true,
+				Tenants:  []string{"acme"},
+				Cohorts:  []string{"beta", "staff"},
+				Subjects: []string{"canary"},
+			},
+			FramingV2: {Enabled: false},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version() != "v3" {
+		t.Errorf("version %q", s.Version())
+	}
+
+	for _, tc := range []struct {
+		subject Subject
+		want    bool
+	}{
+		{Subject{ID: "alice", Tenant: "acme", Cohorts: []string{"staff"}}, true},
+		{Subject{ID: "bob", Tenant: "acme"}, false},
+		{Subject{ID: "carol", Tenant: "other", Cohorts: []string{"beta"}}, false},
+		{Subject{ID: "canary"}, true},
+	} {
+		if got := s.Enabled(DNSProxy, tc.subject); got != tc.want {
+			t.Errorf("%+v: got %v, want %v", tc.subject, got, tc.want)
+		}
+	}
+
+	// A disabled rule is a kill switch for a flag that defaults on
+	if s.Enabled(FramingV2, Subject{ID: "alice"}) {
+		t.Error("disabled rule left the flag on")
+	}
+	// Flags the payload leaves out keep their default
+	if !s.Enabled(FallbackTransport, Subject{ID: "alice"}) {
+		t.Error("unmentioned flag lost its default")
+	}
+}
+
+func TestPercentIsStable(t *testing.T) {
+	s := New()
+	on := func() map[string]bool {
+		subjects := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			id := fmt.Sprintf("user-%d", i)
+			if s.Enabled(DNSProxy, Subject{ID: id}) {
+				subjects[id] = true
+			}
+		}
+		return subjects
+	}
+
+	_ = s.Apply(Payload{Flags: map[string]Rule{DNSProxy: {Enabled: true, Percent: percent(10)}}})
+	ten := on()
+	_ = s.Apply(Payload{Flags: map[string]Rule{DNSProxy: {Enabled: true, Percent: percent(50)}}})
+	fifty := on()
+
+	if len(ten) < 50 || len(ten) > 150 || len(fifty) < 400 || len(fifty) > 600 {
+		t.Errorf("10%% enabled %d, 50%% enabled %d of 1000", len(ten), len(fifty))
+	}
+	for id := range ten {
+		if !fifty[id] {
+			t.Fatalf("%s dropped out when the rollout grew", id)
+		}
+	}
+}
+
+func TestInvalidRulesFallBack(t *testing.T) {
+	s := New()
+	err := s.Apply(Payload{Flags: map[string]Rule{
+		DNSProxy:      {Enabled: true, Percent: percent(150)},
+		FramingV2:     {Enabled: false},
+		"Bad-Name":    {Enabled: true},
+		"future_flag": {Enabled: true},
+	}})
+	if err == nil {
+		t.Fatal("invalid rules not reported")
+	}
+	// The invalid rule is dropped, the valid one still applies
+	if s.Enabled(DNSProxy, Subject{ID: "alice"}) {
+		t.Error("invalid rule turned the flag on")
+	}
+	if s.Enabled(FramingV2, Subject{ID: "alice"}) {
+		t.Error("valid rule not applied alongside an invalid one")
+	}
+
+	if _, err := Parse([]byte(`{"flags": []}`)); err == nil {
+		t.Error("parsed a malformed payload")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	s := New()
+	_ = s.Apply(Payload{Flags: map[string]Rule{FramingV2: {Enabled: false}}})
+	if err := s.SetOverrides(map[string]bool{FramingV2: true, "nope": true}); err == nil {
+		t.Error("unknown override not reported")
+	}
+	if !s.Enabled(FramingV2, Subject{ID: "alice"}) {
+		t.Error("override did not win over the Manager's rule")
+	}
+	if flags := s.Evaluate(Subject{ID: "alice"}); len(flags) != len(Definitions) || !flags[FramingV2] {
+		t.Errorf("Evaluate: %v", flags)
+	}
+}
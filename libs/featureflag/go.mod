@@ -0,0 +1,3 @@
+module github.com/tobogganing/libs/featureflag
+
+go 1.23.1
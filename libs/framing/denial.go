@@ -0,0 +1,144 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Denial frames tell a client why the headend refused a connection. Clients
+// that negotiated them receive one in place of the stream, or of the first
+// response datagram, before the headend closes the connection.
+//
+// Denial layout, all integers big-endian:
+//
+//	magic   [3]byte  0x9E 'S' 'D'
+//	version uint8    currently 1
+//	bodyLen uint16
+//	body    [bodyLen]byte  JSON encoded Denial
+
+// MaxDenialLength bounds the JSON body of a denial frame
+const MaxDenialLength = 4096
+
+// DenialMagic opens every denial frame. It differs from Magic so the two
+// frames can't be confused.
+var DenialMagic = [3]byte{0x9E, 'S', 'D'}
+
+var ErrDenialTooLong = errors.New("denial exceeds maximum length")
+
+// Denial explains why a connection was refused
+type Denial struct {
+	// Reason is a machine-readable reason code, such as rule_deny,
+	// default_deny or quarantined
+	Reason string `json:"reason"`
+	// PolicyID is the policy version that made the decision
+	PolicyID string `json:"policy_id,omitempty"`
+	// Rule is the pattern of the rule that matched, if any
+	Rule     string `json:"rule,omitempty"`
+	Category string `json:"category,omitempty"`
+	Target   string `json:"target,omitempty"`
+	// Contact tells the user who can help, e.g. a helpdesk address
+	Contact string `json:"contact,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Error makes a Denial usable as the error of the refused connection
+func (d *Denial) Error() string {
+	msg := "connection denied by policy (" + d.Reason + ")"
+	if d.Target != "" {
+		msg = "connection to " + d.Target + " denied by policy (" + d.Reason + ")"
+	}
+	if d.Category != "" {
+		msg += ": " + d.Category
+	}
+	if d.Contact != "" {
+		msg += "; contact " + d.Contact
+	}
+	return msg
+}
+
+// EncodeDenial returns the denial frame for d
+func EncodeDenial(d Denial) ([]byte, error) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxDenialLength {
+		return nil, ErrDenialTooLong
+	}
+
+	frame := make([]byte, 0, fixedLength+2+len(body))
+	frame = append(frame, DenialMagic[:]...)
+	frame = append(frame, Version)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(body)))
+	return append(frame, body...), nil
+}
+
+// IsDenial reports whether data starts with a denial frame
+func IsDenial(data []byte) bool {
+	return len(data) >= len(DenialMagic) && bytes.Equal(data[:len(DenialMagic)], DenialMagic[:])
+}
+
+// DecodeDenial decodes the denial frame at the start of a datagram
+func DecodeDenial(data []byte) (*Denial, error) {
+	if !IsDenial(data) {
+		return nil, ErrBadMagic
+	}
+	if len(data) < fixedLength {
+		return nil, ErrTruncated
+	}
+	if data[3] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[3])
+	}
+	body, _, err := sliceField(data[fixedLength:], MaxDenialLength, ErrDenialTooLong)
+	if err != nil {
+		return nil, err
+	}
+	return parseDenial(body)
+}
+
+// ReadDenial consumes a denial frame from the start of a stream. If the
+// stream doesn't start with one it returns nil without consuming anything.
+// Only the first byte is waited for unless it could open a denial, so
+// protocols where the target sends a short greeting aren't held up.
+func ReadDenial(r *bufio.Reader) (*Denial, error) {
+	first, err := r.Peek(1)
+	if err != nil || first[0] != DenialMagic[0] {
+		return nil, err
+	}
+	start, err := r.Peek(len(DenialMagic))
+	if !IsDenial(start) {
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	if _, err := r.Discard(len(DenialMagic)); err != nil {
+		return nil, err
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	body, err := readField(r, MaxDenialLength, ErrDenialTooLong)
+	if err != nil {
+		return nil, err
+	}
+	return parseDenial([]byte(body))
+}
+
+func parseDenial(body []byte) (*Denial, error) {
+	var denial Denial
+	if err := json.Unmarshal(body, &denial); err != nil {
+		return nil, fmt.Errorf("invalid denial: %w", err)
+	}
+	return &denial, nil
+}
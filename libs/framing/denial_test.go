@@ -0,0 +1,76 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDenialRoundTripStream(t *testing.T) {
+	denial := Denial{
+		Reason:   "rule_deny",
+		PolicyID: "v42",
+		Rule:     "*.social.example",
+		Category: "Social media",
+		Target:   "www.social.example:443",
+		Contact:  "helpdesk@example.com",
+	}
+	frame, err := EncodeDenial(denial)
+	if err != nil {
+		t.Fatalf("EncodeDenial: %v", err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(frame, "trailing"...)))
+	got, err := ReadDenial(r)
+	if err != nil {
+		t.Fatalf("ReadDenial: %v", err)
+	}
+	if got == nil || *got != denial {
+		t.Fatalf("got %+v, want %+v", got, denial)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "trailing" {
+		t.Fatalf("expected the frame to be consumed, %q left", rest)
+	}
+	if !strings.Contains(got.Error(), "helpdesk@example.com") {
+		t.Errorf("expected the contact in the error, got %q", got.Error())
+	}
+}
+
+func TestDenialRoundTripDatagram(t *testing.T) {
+	frame, _ := EncodeDenial(Denial{Reason: "quarantined"})
+	if !IsDenial(frame) {
+		t.Fatal("expected a denial frame")
+	}
+	got, err := DecodeDenial(frame)
+	if err != nil || got.Reason != "quarantined" {
+		t.Fatalf("unexpected decode %+v, %v", got, err)
+	}
+}
+
+func TestReadDenialLeavesOtherStreams(t *testing.T) {
+	header, _ := Encode("tok", "example.com:443")
+	for name, stream := range map[string][]byte{
+		"text":   []byte("HTTP/1.1 200 OK\r\n"),
+		"header": header,
+		"short":  {DenialMagic[0]},
+	} {
+		r := bufio.NewReader(bytes.NewReader(stream))
+		got, err := ReadDenial(r)
+		if got != nil || err != nil {
+			t.Errorf("%s: expected no denial, got %+v, %v", name, got, err)
+		}
+		if rest, _ := io.ReadAll(r); !bytes.Equal(rest, stream) {
+			t.Errorf("%s: stream was consumed, %q left", name, rest)
+		}
+	}
+}
+
+func TestDenialTooLong(t *testing.T) {
+	_, err := EncodeDenial(Denial{Reason: "rule_deny", Message: strings.Repeat("x", MaxDenialLength)})
+	if !errors.Is(err, ErrDenialTooLong) {
+		t.Fatalf("expected ErrDenialTooLong, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Package framing implements the connection header that precedes proxied
+// TCP streams and UDP datagrams between SASEWaddle clients and headends.
+//
+// The framing package provides:
+//   - A versioned binary header (magic, version, token length, token,
+//     target length, target) with an encoder and decoder
+//   - Detection and parsing of the legacy JWT:/HOST: text format so old
+//     clients keep working against new headends
+//   - Stream decoding from a bufio.Reader for TCP and single-datagram
+//     decoding for UDP
+//   - Denial frames the headend sends back in place of a refused stream,
+//     carrying the reason code, policy and who to contact
+//
+// The binary header is length-prefixed, so tokens, targets and the payload
+// that follows may contain any bytes, unlike the legacy string scan which
+// could be confused by binary payloads.
+//
+// Binary layout, all integers big-endian:
+//
+//	magic   [3]byte  0x9E 'S' 'W'
+//	version uint8    currently 1
+//	tokLen  uint16
+//	token   [tokLen]byte
+//	tgtLen  uint16
+//	target  [tgtLen]byte   host:port
+//	payload ...
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Version is the binary header version written by this package
+	Version = 1
+
+	// MaxTokenLength bounds the token field to keep headers from being used
+	// to make the headend buffer arbitrary amounts of data
+	MaxTokenLength = 16 * 1024
+	// MaxTargetLength bounds the host:port target field
+	MaxTargetLength = 1024
+
+	// fixedLength is magic + version
+	fixedLength = 4
+)
+
+// Magic opens every binary header. The first byte is never valid at the
+// start of the legacy text format, which always begins with printable ASCII.
+var Magic = [3]byte{0x9E, 'S', 'W'}
+
+// Format identifies which header encoding a peer used
+type Format int
+
+const (
+	FormatLegacy Format = iota
+	FormatBinary
+)
+
+func (f Format) String() string {
+	if f == FormatBinary {
+		return "binary"
+	}
+	return "legacy"
+}
+
+var (
+	ErrBadMagic           = errors.New("bad framing magic")
+	ErrUnsupportedVersion = errors.New("unsupported framing version")
+	ErrTokenTooLong       = errors.New("token exceeds maximum length")
+	ErrTargetTooLong      = errors.New("target exceeds maximum length")
+	ErrTruncated          = errors.New("truncated framing header")
+	ErrMissingToken       = errors.New("missing token")
+	ErrMissingTarget      = errors.New("missing target")
+)
+
+// Header is the decoded connection header
+type Header struct {
+	Format  Format
+	Version int
+	Token   string
+	Target  string
+}
+
+// Encode returns the binary header for a token and target
+func Encode(token, target string) ([]byte, error) {
+	return AppendHeader(nil, token, target)
+}
+
+// AppendHeader appends the binary header for a token and target to dst
+func AppendHeader(dst []byte, token, target string) ([]byte, error) {
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	if target == "" {
+		return nil, ErrMissingTarget
+	}
+	if len(token) > MaxTokenLength {
+		return nil, ErrTokenTooLong
+	}
+	if len(target) > MaxTargetLength {
+		return nil, ErrTargetTooLong
+	}
+
+	dst = append(dst, Magic[:]...)
+	dst = append(dst, Version)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(token)))
+	dst = append(dst, token...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(target)))
+	dst = append(dst, target...)
+	return dst, nil
+}
+
+// WriteHeader writes the binary header for a token and target to w
+func WriteHeader(w io.Writer, token, target string) error {
+	header, err := Encode(token, target)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// EncodeLegacy returns the legacy text header, for talking to headends that
+// only negotiated protocol version 1
+func EncodeLegacy(token, target string) []byte {
+	return []byte("JWT:" + token + "\nHOST:" + target + "\n")
+}
+
+// IsBinary reports whether data starts with a binary header
+func IsBinary(data []byte) bool {
+	return len(data) > 0 && data[0] == Magic[0]
+}
+
+// ReadHeader decodes the header at the start of a TCP stream.
+//
+// A binary header is consumed from r, leaving only the payload. A legacy
+// header is parsed from the first chunk available in r, which is left
+// unread: legacy clients expect that chunk to be forwarded as it was.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsBinary(first) {
+		chunk, err := r.Peek(r.Buffered())
+		if err != nil {
+			return nil, err
+		}
+		return parseLegacy(chunk)
+	}
+
+	var fixed [fixedLength]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, truncated(err)
+	}
+	if !bytes.Equal(fixed[:3], Magic[:]) {
+		return nil, fmt.Errorf("%w %x", ErrBadMagic, fixed[:3])
+	}
+	if fixed[3] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, fixed[3])
+	}
+
+	token, err := readField(r, MaxTokenLength, ErrTokenTooLong)
+	if err != nil {
+		return nil, err
+	}
+	target, err := readField(r, MaxTargetLength, ErrTargetTooLong)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBinaryHeader(token, target)
+}
+
+// Decode decodes the header at the start of a UDP datagram and returns the
+// payload that follows it. Legacy datagrams are returned whole as payload,
+// matching how they were forwarded before binary framing existed.
+func Decode(data []byte) (*Header, []byte, error) {
+	if !IsBinary(data) {
+		header, err := parseLegacy(data)
+		return header, data, err
+	}
+
+	if len(data) < fixedLength {
+		return nil, nil, ErrTruncated
+	}
+	if !bytes.Equal(data[:3], Magic[:]) {
+		return nil, nil, fmt.Errorf("%w %x", ErrBadMagic, data[:3])
+	}
+	if data[3] != Version {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[3])
+	}
+
+	rest := data[fixedLength:]
+	token, rest, err := sliceField(rest, MaxTokenLength, ErrTokenTooLong)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, rest, err := sliceField(rest, MaxTargetLength, ErrTargetTooLong)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := newBinaryHeader(string(token), string(target))
+	return header, rest, err
+}
+
+func newBinaryHeader(token, target string) (*Header, error) {
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	if target == "" {
+		return nil, ErrMissingTarget
+	}
+	return &Header{
+		Format:  FormatBinary,
+		Version: Version,
+		Token:   token,
+		Target:  target,
+	}, nil
+}
+
+func readField(r io.Reader, max int, tooLong error) (string, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", truncated(err)
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n > max {
+		return "", tooLong
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return "", truncated(err)
+	}
+	return string(field), nil
+}
+
+func sliceField(data []byte, max int, tooLong error) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, ErrTruncated
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if n > max {
+		return nil, nil, tooLong
+	}
+	data = data[2:]
+	if len(data) < n {
+		return nil, nil, ErrTruncated
+	}
+	return data[:n], data[n:], nil
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	return err
+}
+
+// parseLegacy scans for the JWT: and HOST: lines of the legacy text format
+func parseLegacy(data []byte) (*Header, error) {
+	header := &Header{
+		Format:  FormatLegacy,
+		Version: 0,
+		Token:   legacyField(string(data), "JWT:"),
+		Target:  legacyField(string(data), "HOST:"),
+	}
+	if header.Token == "" {
+		return header, ErrMissingToken
+	}
+	if header.Target == "" {
+		return header, ErrMissingTarget
+	}
+	return header, nil
+}
+
+func legacyField(data, prefix string) string {
+	idx := strings.Index(data, prefix)
+	if idx == -1 {
+		return ""
+	}
+	value := data[idx+len(prefix):]
+	if end := strings.Index(value, "\n"); end != -1 {
+		value = value[:end]
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,89 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBinaryRoundTripStream(t *testing.T) {
+	payload := []byte{0x00, 'J', 'W', 'T', ':', 0xff, '\n', 'H', 'O', 'S', 'T', ':'}
+	header, err := Encode("token.value", "example.com:443")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(header, payload...)))
+	got, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if got.Format != FormatBinary || got.Token != "token.value" || got.Target != "example.com:443" {
+		t.Fatalf("unexpected header %+v", got)
+	}
+
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, payload) {
+		t.Fatalf("payload %q, want %q", rest, payload)
+	}
+}
+
+func TestBinaryRoundTripDatagram(t *testing.T) {
+	header, _ := Encode("tok", "10.0.0.1:53")
+	got, payload, err := Decode(append(header, "query"...))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got.Token != "tok" || got.Target != "10.0.0.1:53" || string(payload) != "query" {
+		t.Fatalf("unexpected decode %+v %q", got, payload)
+	}
+}
+
+func TestLegacyDetection(t *testing.T) {
+	packet := EncodeLegacy("tok", "example.com:80")
+	packet = append(packet, "GET / HTTP/1.1\r\n"...)
+
+	r := bufio.NewReader(bytes.NewReader(packet))
+	got, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if got.Format != FormatLegacy || got.Token != "tok" || got.Target != "example.com:80" {
+		t.Fatalf("unexpected header %+v", got)
+	}
+	if r.Buffered() != len(packet) {
+		t.Fatalf("legacy chunk consumed: %d buffered, want %d", r.Buffered(), len(packet))
+	}
+
+	_, payload, err := Decode(packet)
+	if err != nil || !bytes.Equal(payload, packet) {
+		t.Fatalf("legacy datagram not returned whole: %v", err)
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	valid, _ := Encode("tok", "host:1")
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"truncated", valid[:len(valid)-1], ErrTruncated},
+		{"version", append([]byte{0x9E, 'S', 'W', 9}, valid[4:]...), ErrUnsupportedVersion},
+		{"token too long", []byte{0x9E, 'S', 'W', Version, 0xff, 0xff}, ErrTokenTooLong},
+		{"empty token", []byte{0x9E, 'S', 'W', Version, 0, 0, 0, 1, 'h'}, ErrMissingToken},
+		{"legacy without host", []byte("JWT:tok\n"), ErrMissingTarget},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := Decode(tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Decode error %v, want %v", tt.name, err, tt.want)
+		}
+		if _, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.data))); !errors.Is(err, tt.want) {
+			t.Errorf("%s: ReadHeader error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
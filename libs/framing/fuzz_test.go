@@ -0,0 +1,66 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// The headend decodes these headers from unauthenticated TCP streams and
+// UDP datagrams, before the token has been checked, so every input must
+// either decode to a sane header or fail cleanly.
+
+func fuzzSeeds(f *testing.F) {
+	binary, _ := Encode("token.value", "example.com:443")
+	f.Add(binary)
+	f.Add(append(binary, "payload"...))
+	f.Add(EncodeLegacy("tok", "10.0.0.1:53"))
+	f.Add([]byte("JWT:tok\nHOST:example.com:80\nGET / HTTP/1.1\r\n"))
+	f.Add(Magic[:])
+	f.Add(append(Magic[:], Version, 0xff, 0xff))
+	f.Add([]byte{})
+}
+
+func FuzzDecode(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := Decode(data)
+		if err != nil {
+			return
+		}
+		checkHeader(t, header)
+		if len(payload) > len(data) {
+			t.Fatalf("payload of %d bytes from %d byte input", len(payload), len(data))
+		}
+		if header.Format == FormatBinary {
+			encoded, err := Encode(header.Token, header.Target)
+			if err != nil {
+				t.Fatalf("re-encode %+v: %v", header, err)
+			}
+			if !bytes.Equal(append(encoded, payload...), data) {
+				t.Fatalf("binary header does not round trip: %q", data)
+			}
+		}
+	})
+}
+
+func FuzzReadHeader(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, err := ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		checkHeader(t, header)
+	})
+}
+
+func checkHeader(t *testing.T, header *Header) {
+	t.Helper()
+	if header.Token == "" || header.Target == "" {
+		t.Fatalf("decoded header without token or target: %+v", header)
+	}
+	if header.Format == FormatBinary && (len(header.Token) > MaxTokenLength || len(header.Target) > MaxTargetLength) {
+		t.Fatalf("decoded oversized header: token %d target %d bytes", len(header.Token), len(header.Target))
+	}
+}
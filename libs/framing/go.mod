@@ -0,0 +1,3 @@
+module github.com/tobogganing/libs/framing
+
+go 1.23.1
@@ -0,0 +1,3 @@
+module github.com/tobogganing/libs/version
+
+go 1.23.1
@@ -0,0 +1,127 @@
+// Package version holds the build metadata shared by every SASEWaddle
+// component.
+//
+// The version package provides:
+//   - The release version, git commit and build time, set at link time
+//   - A fallback to the VCS stamp Go embeds when they were not set, so
+//     development builds still identify their commit
+//   - The Info report components publish, with their enabled features and
+//     the protocol versions they speak, for fleet audits
+//
+// Release builds set the variables with the linker, taking the version
+// from the repository's .version file:
+//
+//	go build -ldflags "-X github.com/tobogganing/libs/version.Version=v1.1.4 \
+//	    -X github.com/tobogganing/libs/version.GitCommit=$(git rev-parse HEAD) \
+//	    -X github.com/tobogganing/libs/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Versions are reported without the "v" of the release tag, so every
+// component reports the same string for the same release.
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set with -ldflags "-X github.com/tobogganing/libs/version.<Name>=..."
+var (
+	Version   = ""
+	GitCommit = ""
+	BuildTime = ""
+)
+
+// DevVersion is reported by builds that were not given a version
+const DevVersion = "0.0.0-dev"
+
+// semver matches a semantic version, see semver.org
+var semver = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// Info describes a component's build
+type Info struct {
+	Component string `json:"component"`
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	// Features are the names of the enabled features
+	Features []string `json:"features"`
+	// Protocols maps each wire protocol or file format to the versions
+	// the component speaks, preferred first
+	Protocols map[string][]int `json:"protocols"`
+}
+
+// Get returns the build metadata of component. Callers fill in Features
+// and Protocols.
+func Get(component string) Info {
+	info := Info{
+		Component: component,
+		Version:   Normalize(Version),
+		GitCommit: GitCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  []string{},
+		Protocols: map[string][]int{},
+	}
+
+	// go build stamps the commit when building inside a checkout
+	if build, ok := debug.ReadBuildInfo(); ok {
+		settings := make(map[string]string)
+		for _, setting := range build.Settings {
+			settings[setting.Key] = setting.Value
+		}
+		if info.GitCommit == "" && settings["vcs.revision"] != "" {
+			info.GitCommit = settings["vcs.revision"]
+			if settings["vcs.modified"] == "true" {
+				info.GitCommit += "-dirty"
+			}
+		}
+		// Without a build time, the commit time dates the source
+		if info.BuildTime == "" {
+			info.BuildTime = settings["vcs.time"]
+		}
+	}
+	if info.GitCommit == "" {
+		info.GitCommit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+// String formats the info for --version output
+func (i Info) String() string {
+	commit, dirty := strings.CutSuffix(i.GitCommit, "-dirty")
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if dirty {
+		commit += "-dirty"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s)", i.Version, commit, i.BuildTime, i.GoVersion, i.Platform)
+}
+
+// Normalize returns v as a semantic version without the tag's "v". Empty
+// versions become DevVersion; versions that aren't semantic are returned
+// as they are.
+func Normalize(v string) string {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return DevVersion
+	}
+	if trimmed := strings.TrimPrefix(v, "v"); semver.MatchString(trimmed) {
+		return trimmed
+	}
+	return v
+}
+
+// IsSemver reports whether v, after Normalize, is a semantic version
+func IsSemver(v string) bool {
+	return semver.MatchString(Normalize(v))
+}
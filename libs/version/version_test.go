@@ -0,0 +1,55 @@
+package version
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	for in, want := range map[string]string{
+		"":              DevVersion,
+		"v1.1.4":        "1.1.4",
+		"1.1.4":         "1.1.4",
+		" v1.2.0-rc.1 ": "1.2.0-rc.1",
+		"v2.0.0+build5": "2.0.0+build5",
+		"main":          "main",
+		"v1.2":          "v1.2",
+	} {
+		if got := Normalize(in); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if !IsSemver("v1.1.4") || IsSemver("main") {
+		t.Error("IsSemver disagrees with Normalize")
+	}
+}
+
+func TestGet(t *testing.T) {
+	saved := [3]string{Version, GitCommit, BuildTime}
+	defer func() { Version, GitCommit, BuildTime = saved[0], saved[1], saved[2] }()
+
+	Version, GitCommit, BuildTime = "v1.1.4", "0123456789abcdef0123", "2026-01-02T03:04:05Z"
+	info := Get("headend")
+	if info.Component != "headend" || info.Version != "1.1.4" || info.GitCommit != "0123456789abcdef0123" || info.BuildTime != "2026-01-02T03:04:05Z" {
+		t.Errorf("Get: %+v", info)
+	}
+	if got := info.String(); !strings.HasPrefix(got, "1.1.4 (commit 0123456789ab, built 2026-01-02T03:04:05Z") {
+		t.Errorf("String: %q", got)
+	}
+
+	// Features and protocols are always present so audits can rely on them
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"features":[]`) || !strings.Contains(string(data), `"protocols":{}`) {
+		t.Errorf("marshalled %s", data)
+	}
+
+	Version, GitCommit, BuildTime = "", "", ""
+	info = Get("client")
+	if info.Version != DevVersion || info.GitCommit == "" || info.BuildTime == "" {
+		t.Errorf("unset build: %+v", info)
+	}
+}
@@ -0,0 +1,40 @@
+package wgconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Client configs are downloaded from the Manager and may be edited by hand.
+// Whatever they contain, an accepted config must render to UAPI text that
+// is one key=value per line, so a crafted value can't inject extra device
+// settings, and must survive a round trip through String.
+func FuzzParse(f *testing.F) {
+	f.Add(fullConfig)
+	f.Add("[Interface]\nPrivateKey=" + privateKey + "\r\n[Peer]\nPublicKey=" + publicKey + "\nEndpoint=[::1]:51820\n")
+	f.Add("[Interface]\nPrivateKey = " + privateKey + "\nPostUp = a = b # c\n")
+	f.Add("[Interface]\n[Peer]\n=\n==\n")
+
+	f.Fuzz(func(t *testing.T, config string) {
+		cfg, err := ParseString(config)
+		if err != nil {
+			return
+		}
+
+		for _, line := range strings.Split(strings.TrimSuffix(cfg.IPC(), "\n"), "\n") {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || key == "" || strings.ContainsAny(value, "\r\n") {
+				t.Fatalf("config %q produced bad IPC line %q", config, line)
+			}
+		}
+
+		again, err := ParseString(cfg.String())
+		if err != nil {
+			t.Fatalf("rendered config does not parse: %v\n%s", err, cfg)
+		}
+		if !reflect.DeepEqual(cfg, again) {
+			t.Fatalf("round trip changed config %q:\n%+v\n%+v", config, cfg, again)
+		}
+	})
+}
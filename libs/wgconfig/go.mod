@@ -0,0 +1,3 @@
+module github.com/tobogganing/libs/wgconfig
+
+go 1.23.1
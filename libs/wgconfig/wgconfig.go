@@ -0,0 +1,657 @@
+// Package wgconfig parses and renders wg-quick style WireGuard configuration
+// files for SASEWaddle clients and headends.
+//
+// The wgconfig package provides:
+//   - A strict parser producing a typed Config, with line-numbered errors
+//     for unknown, misplaced and duplicated keys
+//   - The wg-quick options wg(8) itself ignores: Address, DNS, MTU, Table,
+//     SaveConfig and the PreUp/PostUp/PreDown/PostDown hooks
+//   - Rendering back to wg-quick format and to the wireguard-go UAPI
+//     (IPC) format used by the embedded tunnel
+//   - The address a headend takes in an IPv4 or IPv6 WireGuard network
+//
+// Configs are downloaded from the Manager and may be edited by hand, so the
+// parser treats its input as untrusted: input size and line length are
+// bounded and every value is validated before it reaches a tunnel.
+package wgconfig
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxConfigSize bounds the input accepted by Parse
+	MaxConfigSize = 1 << 20
+
+	// MaxLineLength bounds a single line, which is plenty for the longest
+	// AllowedIPs lists seen in practice
+	MaxLineLength = 64 * 1024
+
+	// MinMTU and MaxMTU bound the MTU option
+	MinMTU = 576
+	MaxMTU = 65535
+)
+
+// Table values with special meaning to wg-quick
+const (
+	TableAuto = "auto"
+	TableOff  = "off"
+)
+
+var (
+	ErrTooLarge = errors.New("configuration exceeds maximum size")
+
+	tableName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// Key is a Curve25519 key or preshared key
+type Key [32]byte
+
+// ParseKey decodes a base64 key as written in configuration files
+func ParseKey(s string) (Key, error) {
+	var k Key
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != len(k) {
+		return k, fmt.Errorf("invalid key: must be 32 bytes of base64")
+	}
+	copy(k[:], raw)
+	return k, nil
+}
+
+// String returns the key in base64, as written in configuration files
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// Hex returns the key in hex, as used by the UAPI
+func (k Key) Hex() string {
+	return hex.EncodeToString(k[:])
+}
+
+// IsZero reports whether the key is unset
+func (k Key) IsZero() bool {
+	return k == Key{}
+}
+
+// Config is a parsed wg-quick configuration file
+type Config struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// Interface holds the [Interface] section
+type Interface struct {
+	PrivateKey Key
+	ListenPort int    // 0 picks a random port
+	FwMark     uint32 // 0 is off
+	Addresses  []netip.Prefix
+	DNS        []netip.Addr
+	// DNSSearch holds DNS entries that aren't addresses, which wg-quick
+	// treats as search domains
+	DNSSearch  []string
+	MTU        int    // 0 lets wg-quick choose
+	Table      string // "" or TableAuto, TableOff, a number or a table name
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+}
+
+// Peer holds one [Peer] section
+type Peer struct {
+	PublicKey    Key
+	PresharedKey Key // zero when unset
+	AllowedIPs   []netip.Prefix
+	// Endpoint is host:port; the host may be a name, which the UAPI does
+	// not accept, so callers resolve it before calling IPC
+	Endpoint            string
+	PersistentKeepalive int // seconds, 0 is off
+}
+
+// ParseError describes a problem on a specific line
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ParseString parses a configuration held in a string
+func ParseString(s string) (*Config, error) {
+	return Parse(strings.NewReader(s))
+}
+
+// Parse reads a wg-quick configuration. Section and key names are case
+// insensitive, '#' starts a comment, and list keys (Address, DNS,
+// AllowedIPs and the hooks) may be repeated. Anything wg-quick would reject
+// or silently ignore is an error.
+func Parse(r io.Reader) (*Config, error) {
+	limited := &io.LimitedReader{R: r, N: MaxConfigSize + 1}
+	scanner := bufio.NewScanner(limited)
+	scanner.Buffer(make([]byte, 0, 4096), MaxLineLength)
+
+	p := &parser{cfg: &Config{}, seen: make(map[string]bool)}
+	for scanner.Scan() {
+		p.line++
+		if err := p.parseLine(scanner.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, &ParseError{Line: p.line + 1, Msg: "line too long"}
+		}
+		return nil, err
+	}
+	if limited.N <= 0 {
+		return nil, ErrTooLarge
+	}
+
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return p.cfg, nil
+}
+
+type section int
+
+const (
+	sectionNone section = iota
+	sectionInterface
+	sectionPeer
+)
+
+func (s section) String() string {
+	switch s {
+	case sectionInterface:
+		return "[Interface]"
+	case sectionPeer:
+		return "[Peer]"
+	}
+	return "no section"
+}
+
+type parser struct {
+	cfg            *Config
+	line           int
+	section        section
+	sectionLine    int
+	sawInterface   bool
+	seen           map[string]bool
+	peerStartLines []int
+}
+
+var interfaceKeys = map[string]bool{
+	"privatekey": true, "listenport": true, "fwmark": true, "address": true,
+	"dns": true, "mtu": true, "table": true, "preup": true, "postup": true,
+	"predown": true, "postdown": true, "saveconfig": true,
+}
+
+var peerKeys = map[string]bool{
+	"publickey": true, "presharedkey": true, "allowedips": true,
+	"endpoint": true, "persistentkeepalive": true,
+}
+
+// listKeys may appear more than once in a section
+var listKeys = map[string]bool{
+	"address": true, "dns": true, "allowedips": true,
+	"preup": true, "postup": true, "predown": true, "postdown": true,
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &ParseError{Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseLine(raw string) error {
+	line := raw
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	if strings.ContainsFunc(line, func(r rune) bool { return r < 0x20 && r != '\t' }) {
+		return p.errorf("control character in line")
+	}
+
+	if strings.HasPrefix(line, "[") {
+		return p.startSection(line)
+	}
+
+	name, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return p.errorf("expected key = value, got %q", line)
+	}
+	name = strings.TrimSpace(name)
+	key := strings.ToLower(name)
+	value = strings.TrimSpace(value)
+
+	switch p.section {
+	case sectionNone:
+		return p.errorf("key %q outside of a section", name)
+	case sectionInterface:
+		if peerKeys[key] {
+			return p.errorf("key %q belongs in [Peer], not [Interface]", name)
+		}
+		if !interfaceKeys[key] {
+			return p.errorf("unknown key %q in [Interface]", name)
+		}
+	case sectionPeer:
+		if interfaceKeys[key] {
+			return p.errorf("key %q belongs in [Interface], not [Peer]", name)
+		}
+		if !peerKeys[key] {
+			return p.errorf("unknown key %q in [Peer]", name)
+		}
+	}
+
+	if !listKeys[key] {
+		if p.seen[key] {
+			return p.errorf("duplicate key %q in %s", name, p.section)
+		}
+		p.seen[key] = true
+	}
+	// An empty AllowedIPs is how wg-quick configs say "no routes"
+	if value == "" && key != "allowedips" {
+		return p.errorf("empty value for %q", name)
+	}
+
+	var err error
+	if p.section == sectionInterface {
+		err = setInterface(&p.cfg.Interface, key, value)
+	} else {
+		err = setPeer(&p.cfg.Peers[len(p.cfg.Peers)-1], key, value)
+	}
+	if err != nil {
+		return p.errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *parser) startSection(line string) error {
+	if !strings.HasSuffix(line, "]") {
+		return p.errorf("malformed section header %q", line)
+	}
+	switch strings.ToLower(strings.TrimSpace(line[1 : len(line)-1])) {
+	case "interface":
+		if p.sawInterface {
+			return p.errorf("duplicate [Interface] section")
+		}
+		if err := p.endSection(); err != nil {
+			return err
+		}
+		p.sawInterface = true
+		p.section = sectionInterface
+	case "peer":
+		if err := p.endSection(); err != nil {
+			return err
+		}
+		p.cfg.Peers = append(p.cfg.Peers, Peer{})
+		p.peerStartLines = append(p.peerStartLines, p.line)
+		p.section = sectionPeer
+	default:
+		return p.errorf("unknown section %s", line)
+	}
+
+	p.sectionLine = p.line
+	p.seen = make(map[string]bool)
+	return nil
+}
+
+// endSection checks the required keys of the section being left
+func (p *parser) endSection() error {
+	switch p.section {
+	case sectionInterface:
+		if !p.seen["privatekey"] {
+			return &ParseError{Line: p.sectionLine, Msg: "[Interface] has no PrivateKey"}
+		}
+	case sectionPeer:
+		if !p.seen["publickey"] {
+			return &ParseError{Line: p.sectionLine, Msg: "[Peer] has no PublicKey"}
+		}
+	}
+	return nil
+}
+
+func (p *parser) finish() error {
+	if err := p.endSection(); err != nil {
+		return err
+	}
+	if !p.sawInterface {
+		return &ParseError{Line: p.line, Msg: "missing [Interface] section"}
+	}
+
+	keys := make(map[Key]int, len(p.cfg.Peers))
+	for i, peer := range p.cfg.Peers {
+		if first, dup := keys[peer.PublicKey]; dup {
+			return &ParseError{Line: p.peerStartLines[i], Msg: fmt.Sprintf("peer public key already used by [Peer] on line %d", p.peerStartLines[first])}
+		}
+		keys[peer.PublicKey] = i
+	}
+	return nil
+}
+
+func setInterface(iface *Interface, key, value string) error {
+	var err error
+
+	switch key {
+	case "privatekey":
+		iface.PrivateKey, err = ParseKey(value)
+	case "listenport":
+		iface.ListenPort, err = parsePort(value, true)
+	case "fwmark":
+		iface.FwMark, err = parseFwMark(value)
+	case "address":
+		var prefixes []netip.Prefix
+		prefixes, err = parsePrefixes(value, false)
+		iface.Addresses = append(iface.Addresses, prefixes...)
+	case "dns":
+		for _, entry := range splitList(value) {
+			if addr, addrErr := netip.ParseAddr(entry); addrErr == nil {
+				iface.DNS = append(iface.DNS, addr.Unmap())
+			} else if isHostname(entry) {
+				iface.DNSSearch = append(iface.DNSSearch, entry)
+			} else {
+				err = fmt.Errorf("invalid DNS entry %q", entry)
+				break
+			}
+		}
+	case "mtu":
+		iface.MTU, err = strconv.Atoi(value)
+		if err != nil || iface.MTU < MinMTU || iface.MTU > MaxMTU {
+			err = fmt.Errorf("must be between %d and %d", MinMTU, MaxMTU)
+		}
+	case "table":
+		iface.Table, err = parseTable(value)
+	case "preup":
+		iface.PreUp = append(iface.PreUp, value)
+	case "postup":
+		iface.PostUp = append(iface.PostUp, value)
+	case "predown":
+		iface.PreDown = append(iface.PreDown, value)
+	case "postdown":
+		iface.PostDown = append(iface.PostDown, value)
+	case "saveconfig":
+		iface.SaveConfig, err = parseBool(value)
+	}
+	return err
+}
+
+func setPeer(peer *Peer, key, value string) error {
+	var err error
+
+	switch key {
+	case "publickey":
+		peer.PublicKey, err = ParseKey(value)
+	case "presharedkey":
+		peer.PresharedKey, err = ParseKey(value)
+	case "allowedips":
+		var prefixes []netip.Prefix
+		prefixes, err = parsePrefixes(value, true)
+		peer.AllowedIPs = append(peer.AllowedIPs, prefixes...)
+	case "endpoint":
+		err = validateEndpoint(value)
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		if strings.EqualFold(value, "off") {
+			peer.PersistentKeepalive = 0
+			break
+		}
+		peer.PersistentKeepalive, err = strconv.Atoi(value)
+		if err != nil || peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+			err = fmt.Errorf("must be off or between 0 and 65535")
+		}
+	}
+	return err
+}
+
+// ParseAllowedIPs parses a comma-separated AllowedIPs value. Bare addresses
+// become host routes and host bits are cleared, matching wg(8).
+func ParseAllowedIPs(value string) ([]netip.Prefix, error) {
+	return parsePrefixes(value, true)
+}
+
+// HeadendAddress returns the address a headend takes in a WireGuard network:
+// its first host, with the network's prefix length, e.g. 10.200.0.1/16 in
+// 10.200.0.0/16 or fd00:200::1/64 in fd00:200::/64
+func HeadendAddress(network string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid WireGuard network %q", network)
+	}
+	prefix = prefix.Masked()
+	host := prefix.Addr().Next()
+	if !host.IsValid() || !prefix.Contains(host) {
+		return netip.Prefix{}, fmt.Errorf("WireGuard network %s has no room for a headend", prefix)
+	}
+	return netip.PrefixFrom(host, prefix.Bits()), nil
+}
+
+func parsePrefixes(value string, mask bool) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, entry := range splitList(value) {
+		var prefix netip.Prefix
+		if strings.Contains(entry, "/") {
+			var err error
+			prefix, err = netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix %q", entry)
+			}
+		} else {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if prefix.Addr().Zone() != "" {
+			return nil, fmt.Errorf("zoned address %q not allowed", entry)
+		}
+		if mask {
+			prefix = prefix.Masked()
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func splitList(value string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func parsePort(value string, allowZero bool) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 || (port == 0 && !allowZero) {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
+
+func parseFwMark(value string) (uint32, error) {
+	if strings.EqualFold(value, "off") {
+		return 0, nil
+	}
+	mark, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fwmark %q", value)
+	}
+	return uint32(mark), nil
+}
+
+func parseTable(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case TableAuto, TableOff:
+		return strings.ToLower(value), nil
+	}
+	if _, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return value, nil
+	}
+	if tableName.MatchString(value) {
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid table %q", value)
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected true or false, got %q", value)
+}
+
+func validateEndpoint(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("expected host:port, got %q", value)
+	}
+	if _, err := parsePort(port, false); err != nil {
+		return err
+	}
+	if _, err := netip.ParseAddr(host); err != nil && !isHostname(host) {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	return nil
+}
+
+// isHostname reports whether s is a plausible DNS name
+func isHostname(s string) bool {
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c == '-' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String renders the configuration in wg-quick format
+func (c *Config) String() string {
+	var b strings.Builder
+	iface := c.Interface
+
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", iface.PrivateKey)
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", iface.ListenPort)
+	}
+	if iface.FwMark != 0 {
+		fmt.Fprintf(&b, "FwMark = %#x\n", iface.FwMark)
+	}
+	if len(iface.Addresses) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", joinPrefixes(iface.Addresses))
+	}
+	if len(iface.DNS)+len(iface.DNSSearch) > 0 {
+		entries := make([]string, 0, len(iface.DNS)+len(iface.DNSSearch))
+		for _, addr := range iface.DNS {
+			entries = append(entries, addr.String())
+		}
+		entries = append(entries, iface.DNSSearch...)
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(entries, ", "))
+	}
+	if iface.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", iface.MTU)
+	}
+	if iface.Table != "" {
+		fmt.Fprintf(&b, "Table = %s\n", iface.Table)
+	}
+	for _, hook := range []struct {
+		name     string
+		commands []string
+	}{{"PreUp", iface.PreUp}, {"PostUp", iface.PostUp}, {"PreDown", iface.PreDown}, {"PostDown", iface.PostDown}} {
+		for _, command := range hook.commands {
+			fmt.Fprintf(&b, "%s = %s\n", hook.name, command)
+		}
+	}
+	if iface.SaveConfig {
+		b.WriteString("SaveConfig = true\n")
+	}
+
+	for _, peer := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		if !peer.PresharedKey.IsZero() {
+			fmt.Fprintf(&b, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", joinPrefixes(peer.AllowedIPs))
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}
+
+// IPC renders the device and peer settings in the wireguard-go UAPI set
+// format. The wg-quick-only options are handled by the caller. Endpoints
+// must already be resolved to ip:port.
+func (c *Config) IPC() string {
+	var b strings.Builder
+	iface := c.Interface
+
+	fmt.Fprintf(&b, "private_key=%s\n", iface.PrivateKey.Hex())
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", iface.ListenPort)
+	}
+	if iface.FwMark != 0 {
+		fmt.Fprintf(&b, "fwmark=%d\n", iface.FwMark)
+	}
+	b.WriteString("replace_peers=true\n")
+
+	for _, peer := range c.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", peer.PublicKey.Hex())
+		if !peer.PresharedKey.IsZero() {
+			fmt.Fprintf(&b, "preshared_key=%s\n", peer.PresharedKey.Hex())
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.Endpoint)
+		}
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, prefix := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", prefix)
+		}
+	}
+	return b.String()
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	entries := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		entries[i] = prefix.String()
+	}
+	return strings.Join(entries, ", ")
+}
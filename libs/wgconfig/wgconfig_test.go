@@ -0,0 +1,213 @@
+package wgconfig
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	privateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	publicKey  = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	otherKey   = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+const fullConfig = `# Client config from the Manager
+[Interface]
+PrivateKey = ` + privateKey + `
+ListenPort = 51820
+FwMark = 0xca6c
+Address = 10.200.0.2/32, fd00::2/128
+Address = 10.201.0.2
+DNS = 10.200.0.1, corp.example.com
+MTU = 1380
+Table = off
+PreUp = echo pre-up %i
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostUp = ip rule add fwmark 0xca6c table 51820
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+SaveConfig = false
+
+[peer]
+publickey = ` + publicKey + `
+PresharedKey = ` + otherKey + `
+AllowedIPs = 10.200.0.0/16, 192.168.1.7/24 # host bits are dropped
+AllowedIPs = fd00::/64
+Endpoint = headend.example.com:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = ` + otherKey + `
+AllowedIPs =
+Endpoint = [2001:db8::1]:51820
+PersistentKeepalive = off
+`
+
+func TestParseFullConfig(t *testing.T) {
+	cfg, err := ParseString(fullConfig)
+	if err != nil {
+		t.Fatalf("ParseString: %v", err)
+	}
+
+	iface := cfg.Interface
+	if iface.PrivateKey.String() != privateKey || iface.ListenPort != 51820 || iface.FwMark != 0xca6c {
+		t.Errorf("unexpected interface basics %+v", iface)
+	}
+	wantAddrs := []netip.Prefix{
+		netip.MustParsePrefix("10.200.0.2/32"),
+		netip.MustParsePrefix("fd00::2/128"),
+		netip.MustParsePrefix("10.201.0.2/32"),
+	}
+	if !reflect.DeepEqual(iface.Addresses, wantAddrs) {
+		t.Errorf("Addresses = %v, want %v", iface.Addresses, wantAddrs)
+	}
+	if len(iface.DNS) != 1 || iface.DNS[0] != netip.MustParseAddr("10.200.0.1") ||
+		!reflect.DeepEqual(iface.DNSSearch, []string{"corp.example.com"}) {
+		t.Errorf("DNS = %v search %v", iface.DNS, iface.DNSSearch)
+	}
+	if iface.MTU != 1380 || iface.Table != TableOff || iface.SaveConfig {
+		t.Errorf("MTU %d Table %q SaveConfig %v", iface.MTU, iface.Table, iface.SaveConfig)
+	}
+	if len(iface.PreUp) != 1 || len(iface.PostUp) != 2 || len(iface.PreDown) != 0 || len(iface.PostDown) != 1 {
+		t.Errorf("hooks PreUp %q PostUp %q PreDown %q PostDown %q", iface.PreUp, iface.PostUp, iface.PreDown, iface.PostDown)
+	}
+
+	if len(cfg.Peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(cfg.Peers))
+	}
+	peer := cfg.Peers[0]
+	if peer.PublicKey.String() != publicKey || peer.PresharedKey.String() != otherKey ||
+		peer.Endpoint != "headend.example.com:51820" || peer.PersistentKeepalive != 25 {
+		t.Errorf("unexpected peer %+v", peer)
+	}
+	wantAllowed := []netip.Prefix{
+		netip.MustParsePrefix("10.200.0.0/16"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("fd00::/64"),
+	}
+	if !reflect.DeepEqual(peer.AllowedIPs, wantAllowed) {
+		t.Errorf("AllowedIPs = %v, want %v", peer.AllowedIPs, wantAllowed)
+	}
+	if second := cfg.Peers[1]; len(second.AllowedIPs) != 0 || !second.PresharedKey.IsZero() || second.PersistentKeepalive != 0 {
+		t.Errorf("unexpected second peer %+v", second)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	iface := "[Interface]\nPrivateKey = " + privateKey + "\n"
+	peer := "[Peer]\nPublicKey = " + publicKey + "\n"
+
+	tests := []struct {
+		name   string
+		config string
+		line   int
+		want   string
+	}{
+		{"key outside section", "PrivateKey = " + privateKey + "\n" + iface, 1, "outside of a section"},
+		{"unknown section", iface + "[Route]\n", 3, "unknown section"},
+		{"unknown key", iface + "Foo = bar\n", 3, "unknown key"},
+		{"peer key in interface", iface + "Endpoint = 1.2.3.4:51820\n", 3, "belongs in [Peer]"},
+		{"interface key in peer", iface + peer + "MTU = 1420\n", 5, "belongs in [Interface]"},
+		{"duplicate scalar", iface + "MTU = 1420\nMTU = 1380\n", 4, "duplicate key"},
+		{"duplicate interface", iface + iface, 3, "duplicate [Interface]"},
+		{"missing private key", "[Interface]\nMTU = 1420\n" + peer, 1, "no PrivateKey"},
+		{"missing public key", iface + "[Peer]\nEndpoint = 1.2.3.4:51820\n", 3, "no PublicKey"},
+		{"missing interface", peer, 2, "missing [Interface]"},
+		{"duplicate peer", iface + peer + peer, 5, "already used"},
+		{"no equals", iface + "MTU 1420\n", 3, "expected key = value"},
+		{"bad key", "[Interface]\nPrivateKey = abc\n", 2, "invalid PrivateKey"},
+		{"bad address", iface + "Address = 10.0.0.300/24\n", 3, "invalid Address"},
+		{"bad dns", iface + "DNS = not a name\n", 3, "invalid DNS"},
+		{"bad mtu", iface + "MTU = 100\n", 3, "invalid MTU"},
+		{"bad table", iface + "Table = main;reboot\n", 3, "invalid Table"},
+		{"bad endpoint", iface + peer + "Endpoint = headend.example.com\n", 5, "invalid Endpoint"},
+		{"bad endpoint port", iface + peer + "Endpoint = 1.2.3.4:0\n", 5, "invalid Endpoint"},
+		{"bad keepalive", iface + peer + "PersistentKeepalive = 70000\n", 5, "invalid PersistentKeepalive"},
+		{"empty value", iface + "PostUp =\n", 3, "empty value"},
+		{"control character", iface + "PostUp = echo\x00 hi\n", 3, "control character"},
+		{"long line", iface + "PostUp = " + strings.Repeat("a", MaxLineLength) + "\n", 3, "line too long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseString(tt.config)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("got %v, want ParseError", err)
+			}
+			if perr.Line != tt.line || !strings.Contains(perr.Msg, tt.want) {
+				t.Fatalf("got %q, want line %d containing %q", err, tt.line, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadendAddress(t *testing.T) {
+	tests := []struct {
+		network string
+		want    string
+	}{
+		{"10.200.0.0/16", "10.200.0.1/16"},
+		{"10.200.7.9/16", "10.200.0.1/16"},
+		{"fd00:200::/64", "fd00:200::1/64"},
+		{" fd00:200::/48 ", "fd00:200::1/48"},
+	}
+	for _, tt := range tests {
+		got, err := HeadendAddress(tt.network)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("HeadendAddress(%q) = %v, %v, want %s", tt.network, got, err, tt.want)
+		}
+	}
+
+	for _, network := range []string{"", "10.200.0.0", "10.200.0.1/32", "fd00::1/128"} {
+		if _, err := HeadendAddress(network); err == nil {
+			t.Errorf("HeadendAddress(%q) should fail", network)
+		}
+	}
+}
+
+func TestParseTooLarge(t *testing.T) {
+	config := "[Interface]\nPrivateKey = " + privateKey + "\n" +
+		strings.Repeat("PostUp = "+strings.Repeat("a", 1000)+"\n", MaxConfigSize/1000)
+	if _, err := ParseString(config); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	cfg, err := ParseString(fullConfig)
+	if err != nil {
+		t.Fatalf("ParseString: %v", err)
+	}
+	again, err := ParseString(cfg.String())
+	if err != nil {
+		t.Fatalf("reparse of rendered config: %v\n%s", err, cfg)
+	}
+	if !reflect.DeepEqual(cfg, again) {
+		t.Fatalf("round trip changed config:\n%+v\n%+v", cfg, again)
+	}
+}
+
+func TestIPC(t *testing.T) {
+	cfg, err := ParseString("[Interface]\nPrivateKey = " + privateKey + "\nAddress = 10.0.0.2/32\nMTU = 1380\n" +
+		"[Peer]\nPublicKey = " + publicKey + "\nAllowedIPs = 0.0.0.0/0, ::/0\nEndpoint = 192.0.2.1:51820\n")
+	if err != nil {
+		t.Fatalf("ParseString: %v", err)
+	}
+
+	priv, _ := ParseKey(privateKey)
+	pub, _ := ParseKey(publicKey)
+	want := "private_key=" + priv.Hex() + "\n" +
+		"replace_peers=true\n" +
+		"public_key=" + pub.Hex() + "\n" +
+		"endpoint=192.0.2.1:51820\n" +
+		"persistent_keepalive_interval=0\n" +
+		"replace_allowed_ips=true\n" +
+		"allowed_ip=0.0.0.0/0\n" +
+		"allowed_ip=::/0\n"
+	if got := cfg.IPC(); got != want {
+		t.Fatalf("IPC:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -2,8 +2,17 @@ from py4web import action, request, response, abort
 import json
 import structlog
 from typing import Optional
+from urllib.parse import urlparse
 import uuid
 
+from firewall.quarantine import quarantine_manager, QuarantineSource
+from featureflags.flags import feature_flag_manager, KNOWN_FLAGS
+from privacy.pseudonym import pseudonym_key_manager
+from ratelimits.limits import rate_limit_manager
+from orchestrator.headend_registry import headend_registry
+from cache.redis_cache import get_firewall_cache
+from network.dualstack import dual_stack_allowed_ips, ipv6_address, wireguard_network, wireguard_network6
+
 logger = structlog.get_logger()
 
 def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manager):
@@ -111,9 +120,29 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
             # Generate client ID
             data['id'] = str(uuid.uuid4())
             
-            # Get optimal cluster
-            location = data.get('location', {})
-            cluster = await cluster_manager.get_optimal_cluster(location)
+            # A client re-registering keeps the clusters it is limited to
+            previous = await _authenticated_client()
+            allowed = _allowed_clusters(previous)
+            if allowed is not None:
+                data['metadata'] = {**data.get('metadata', {}), 'allowed_clusters': sorted(allowed)}
+            
+            # Honour the cluster the client picked if it may use it,
+            # otherwise get the optimal cluster
+            cluster = None
+            requested = data.pop('cluster_id', None)
+            if requested:
+                cluster = await cluster_manager.get_cluster(requested)
+                if not cluster or cluster.status != 'active' or (allowed is not None and cluster.id not in allowed):
+                    logger.info(f"Requested cluster {requested} not available, choosing one")
+                    cluster = None
+            
+            if not cluster:
+                location = data.get('location', {})
+                cluster = await cluster_manager.get_optimal_cluster(location, client_id=data['id'])
+                if cluster and allowed is not None and cluster.id not in allowed:
+                    permitted = [c for c in await cluster_manager.get_all_clusters()
+                                 if c.status == 'active' and c.id in allowed]
+                    cluster = min(permitted, key=lambda c: c.client_count) if permitted else None
             
             if not cluster:
                 response.status = 503
@@ -136,7 +165,9 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                 "api_key": api_key,
                 "cluster": {
                     "id": cluster.id,
-                    "headend_url": cluster.headend_url
+                    "name": cluster.name,
+                    "headend_url": cluster.headend_url,
+                    "region": cluster.region
                 },
                 "certificates": {
                     "key": key,
@@ -149,6 +180,84 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
             response.status = 500
             return {"error": "Internal server error"}
     
+    async def _authenticated_client():
+        auth_header = request.headers.get('Authorization', '')
+        if not auth_header.startswith('Bearer '):
+            return None
+        return await client_registry.authenticate_client(auth_header[7:])
+    
+    def _allowed_clusters(client) -> Optional[set]:
+        """Clusters the client is limited to, or None for all of them"""
+        if not client:
+            return None
+        allowed = client.metadata.get('allowed_clusters')
+        return set(allowed) if allowed else None
+    
+    @action("api/v1/clients/clusters", method=["GET"])
+    @action.uses("json")
+    async def list_client_clusters():
+        """List the clusters a client can connect to, for it to choose from"""
+        try:
+            client = await _authenticated_client()
+            if not client:
+                response.status = 401
+                return {"error": "Unauthorized"}
+            
+            allowed = _allowed_clusters(client)
+            clusters = await cluster_manager.get_all_clusters()
+            return {
+                "current": client.cluster_id,
+                "clusters": [
+                    {
+                        **_assignment_entry(c),
+                        "status": c.status,
+                        "allowed": c.status == 'active' and (allowed is None or c.id in allowed)
+                    }
+                    for c in sorted(clusters, key=lambda c: c.id)
+                ]
+            }
+        except Exception as e:
+            logger.error(f"List client clusters error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/clients/bootstrap", method=["GET"])
+    @action.uses("json")
+    async def get_client_bootstrap_list():
+        """Signed list of the headends a client may fall back to while the Manager is down"""
+        try:
+            client = await _authenticated_client()
+            if not client:
+                response.status = 401
+                return {"error": "Unauthorized"}
+            
+            allowed = _allowed_clusters(client)
+            headends = []
+            for cluster in sorted(await cluster_manager.get_all_clusters(), key=lambda c: c.id):
+                if cluster.status != 'active' or (allowed is not None and cluster.id not in allowed):
+                    continue
+                wg_config = await cert_manager.get_wireguard_config(cluster.id)
+                if not wg_config or not wg_config.get('public_key'):
+                    continue
+                host = urlparse(cluster.headend_url).hostname
+                if not host:
+                    continue
+                headends.append({
+                    **_assignment_entry(cluster),
+                    "endpoint": f"{host}:51820",
+                    "public_key": wg_config['public_key']
+                })
+            
+            signed = await jwt_manager.sign_bootstrap_list(client.id, headends)
+            return {
+                **signed,
+                "public_key": await jwt_manager.get_public_key()
+            }
+        except Exception as e:
+            logger.error(f"Bootstrap list error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
     @action("api/v1/clients/<client_id>/config", method=["GET"])
     @action.uses("json")
     async def get_client_config(client_id):
@@ -183,7 +292,13 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                 },
                 "status": client.status,
                 "tunnel_mode": getattr(client, 'tunnel_mode', 'full'),
-                "split_tunnel_routes": getattr(client, 'split_tunnel_routes', [])
+                "split_tunnel_routes": getattr(client, 'split_tunnel_routes', []),
+                "quarantine": await quarantine_manager.get(client.id),
+                "feature_flags": await feature_flag_manager.export(subject={
+                    "id": client.id,
+                    "tenant": getattr(client, 'tenant', None) or '',
+                    "cohorts": [client.type]
+                })
             }
         except Exception as e:
             logger.error(f"Get config error: {e}")
@@ -355,6 +470,13 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                 metrics=data.get('metrics', {})
             )
             
+            # A failed posture check quarantines the client until it passes again
+            if 'posture' in data:
+                was_quarantined = await quarantine_manager.get(client.id) is not None
+                quarantined = await quarantine_manager.evaluate_posture(client.id, data['posture']) is not None
+                if quarantined or was_quarantined:
+                    await _quarantine_changed()
+            
             # Update last seen in database
             from ..database import get_db
             db = get_db()
@@ -444,6 +566,491 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
             response.status = 500
             return {"error": "Internal server error"}
     
+    async def _require_admin() -> Optional[dict]:
+        """Get the token claims of an admin caller, or None"""
+        auth_header = request.headers.get('Authorization', '')
+        if not auth_header.startswith('Bearer '):
+            return None
+        
+        user_info = await jwt_manager.validate_token(auth_header[7:])
+        if not user_info:
+            return None
+        if user_info.get('role') == 'admin' or 'admin' in user_info.get('permissions', []):
+            return user_info
+        return None
+    
+    async def _wireguard_peers():
+        # Quarantined clients' traffic comes from their quarantine address
+        peers = await cert_manager.get_all_wireguard_peers()
+        addresses = {q['user_id']: q['address'] for q in await quarantine_manager.list() if q['address']}
+        for peer in peers:
+            if peer.get('node_id') in addresses:
+                peer['allowed_ips'] = [f"{addresses[peer['node_id']]}/32"]
+            # Dual-stack clients also route their paired IPv6 address
+            peer['allowed_ips'] = dual_stack_allowed_ips(peer['allowed_ips'])
+        return peers
+    
+    async def _quarantine_changed():
+        # Cached full rule sets embed the quarantine profile
+        firewall_cache = await get_firewall_cache()
+        await firewall_cache.invalidate_all_rules()
+    
+    def _assignment_entry(cluster):
+        return {
+            "id": cluster.id,
+            "name": cluster.name,
+            "headend_url": cluster.headend_url,
+            "region": cluster.region,
+            "datacenter": cluster.datacenter
+        }
+    
+    @action("api/v1/clients/<client_id>/assignment", method=["GET"])
+    @action.uses("json")
+    async def get_client_assignment(client_id):
+        """Get the client's preferred headends in consistent-hash order (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            count = max(1, min(int(request.query.get('count', 3)), 16))
+            clusters = await cluster_manager.get_preferred_clusters(client_id, count)
+            
+            return {
+                "client_id": client_id,
+                "assignment_mode": cluster_manager.assignment_mode,
+                "headends": [_assignment_entry(c) for c in clusters]
+            }
+        except ValueError:
+            response.status = 400
+            return {"error": "Invalid count"}
+        except Exception as e:
+            logger.error(f"Client assignment error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/assignments/preview", method=["POST"])
+    @action.uses("json")
+    async def preview_assignments():
+        """Preview how clients spread over headends, optionally with some failed (admin API)
+        
+        Without client_ids every registered client is used. Headends listed in
+        exclude are treated as failed, showing where their clients would go
+        and that nobody else moves.
+        """
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            data = await request.json() or {}
+            client_ids = data.get('client_ids')
+            if client_ids is None:
+                client_ids = [c.id for c in await client_registry.get_all_clients()]
+            exclude = set(data.get('exclude', []))
+            
+            distribution = {}
+            moved = 0
+            assignments = {}
+            for client_id in client_ids:
+                before = await cluster_manager.get_preferred_clusters(client_id, 1)
+                after = await cluster_manager.get_preferred_clusters(client_id, 1, exclude=exclude)
+                if not after:
+                    continue
+                
+                target = after[0].id
+                assignments[client_id] = target
+                distribution[target] = distribution.get(target, 0) + 1
+                if before and before[0].id != target:
+                    moved += 1
+            
+            return {
+                "clients": len(client_ids),
+                "excluded": sorted(exclude),
+                "moved": moved,
+                "distribution": distribution,
+                "assignments": assignments if data.get('include_assignments') else None
+            }
+        except Exception as e:
+            logger.error(f"Assignment preview error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/quarantine", method=["GET"])
+    @action.uses("json")
+    async def list_quarantines():
+        """List quarantined users (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            quarantines = await quarantine_manager.list()
+            return {
+                "quarantines": quarantines,
+                "network": quarantine_manager.network_cidr(),
+                "total": len(quarantines)
+            }
+        except Exception as e:
+            logger.error(f"List quarantines error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/quarantine/<user_id>", method=["POST"])
+    @action.uses("json")
+    async def quarantine_user(user_id):
+        """Quarantine a user (admin API)"""
+        try:
+            admin = await _require_admin()
+            if not admin:
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            data = await request.json() or {}
+            record = await quarantine_manager.quarantine(
+                user_id,
+                data.get('reason', 'quarantined by an administrator'),
+                QuarantineSource.ADMIN,
+                actor=admin.get('sub')
+            )
+            if not record:
+                response.status = 500
+                return {"error": "Failed to quarantine user"}
+            
+            await _quarantine_changed()
+            return {"quarantine": record}
+        except Exception as e:
+            logger.error(f"Quarantine user error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/quarantine/<user_id>", method=["DELETE"])
+    @action.uses("json")
+    async def release_quarantine(user_id):
+        """Release a user from quarantine (admin API)"""
+        try:
+            admin = await _require_admin()
+            if not admin:
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            if not await quarantine_manager.release(user_id, actor=admin.get('sub')):
+                response.status = 404
+                return {"error": "User is not quarantined"}
+            
+            await _quarantine_changed()
+            return {"released": user_id}
+        except Exception as e:
+            logger.error(f"Release quarantine error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/quarantine/<user_id>/anomaly", method=["POST"])
+    @action.uses("json")
+    async def report_anomaly(user_id):
+        """Quarantine a user an anomaly detector flagged (headend API)"""
+        try:
+            auth_header = request.headers.get('Authorization', '')
+            if not auth_header.startswith('Bearer '):
+                response.status = 401
+                return {"error": "Invalid authorization header"}
+            
+            token = auth_header[7:]
+            jwt_payload = await jwt_manager.validate_token(token)
+            if not (jwt_payload and 'headend' in jwt_payload.get('permissions', [])):
+                cluster = await cluster_manager.authenticate_cluster(token)
+                if not cluster:
+                    response.status = 401
+                    return {"error": "Authentication failed"}
+            
+            data = await request.json() or {}
+            detector = data.get('detector', 'unknown')
+            reason = f"anomaly detected by {detector}"
+            if data.get('detail'):
+                reason += f": {data['detail']}"
+            
+            record = await quarantine_manager.quarantine(user_id, reason, QuarantineSource.ANOMALY, actor=detector)
+            if not record:
+                response.status = 500
+                return {"error": "Failed to quarantine user"}
+            
+            await _quarantine_changed()
+            return {"quarantine": record}
+        except Exception as e:
+            logger.error(f"Report anomaly error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/logs/unmask", method=["POST"])
+    @action.uses("json")
+    async def unmask_pseudonym():
+        """Find who a pseudonym in an exported log stands for (admin API)
+        
+        The pseudonym is matched against every registered client's ID and
+        name, and against any further candidates given, e.g. usernames from
+        an identity provider. A reason is required and every unmasking is
+        recorded.
+        """
+        try:
+            admin = await _require_admin()
+            if not admin:
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            data = await request.json() or {}
+            for field in ('pseudonym', 'key_id', 'reason'):
+                if not data.get(field):
+                    response.status = 400
+                    return {"error": f"Missing required field: {field}"}
+            
+            candidates = set(data.get('candidates') or [])
+            for client in await client_registry.get_all_clients():
+                candidates.update((client.id, client.name))
+            
+            matched = await pseudonym_key_manager.unmask(
+                data['key_id'], data['pseudonym'], candidates,
+                actor=admin.get('sub'), reason=data['reason']
+            )
+            if matched is None:
+                response.status = 404
+                return {"error": "Unknown or expired pseudonymization key"}
+            
+            return {"key_id": data['key_id'], "pseudonym": data['pseudonym'], "matched": matched}
+        except Exception as e:
+            logger.error(f"Unmask pseudonym error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/logs/unmaskings", method=["GET"])
+    @action.uses("json")
+    async def list_unmaskings():
+        """List recent pseudonym unmaskings (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            limit = max(1, min(int(request.query.get('limit', 100)), 1000))
+            return {"unmaskings": await pseudonym_key_manager.list_unmaskings(limit)}
+        except ValueError:
+            response.status = 400
+            return {"error": "Invalid limit"}
+        except Exception as e:
+            logger.error(f"List unmaskings error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+
+    @action("api/v1/headends", method=["GET"])
+    @action.uses("json")
+    async def list_headends():
+        """List registered headends with their advertisements (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+
+            cluster_id = request.query.get('cluster_id')
+            return {"headends": await headend_registry.list_headends(cluster_id)}
+        except Exception as e:
+            logger.error(f"List headends error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+
+    @action("api/v1/headends/<headend_id>", method=["DELETE"])
+    @action.uses("json")
+    async def remove_headend(headend_id):
+        """Forget a decommissioned headend (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+
+            if not await headend_registry.remove(headend_id):
+                response.status = 404
+                return {"error": "Headend not found"}
+            return {"status": "removed"}
+        except Exception as e:
+            logger.error(f"Remove headend error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+
+    @action("api/v1/feature-flags", method=["GET"])
+    @action.uses("json")
+    async def list_feature_flags():
+        """List feature flag rules (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            payload = await feature_flag_manager.export()
+            return {
+                "flags": await feature_flag_manager.list(),
+                "known_flags": KNOWN_FLAGS,
+                "version": payload["version"]
+            }
+        except Exception as e:
+            logger.error(f"List feature flags error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/feature-flags/<name>", method=["PUT"])
+    @action.uses("json")
+    async def set_feature_flag(name):
+        """Set a feature flag's rule (admin API). Headends and clients pick
+        it up with their next configuration refresh."""
+        try:
+            admin = await _require_admin()
+            if not admin:
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            data = await request.json() or {}
+            if not isinstance(data.get('enabled'), bool):
+                response.status = 400
+                return {"error": "Missing required field: enabled"}
+            
+            try:
+                record = await feature_flag_manager.set_flag(
+                    name,
+                    data['enabled'],
+                    percent=data.get('percent'),
+                    tenants=data.get('tenants'),
+                    cohorts=data.get('cohorts'),
+                    subjects=data.get('subjects'),
+                    actor=admin.get('sub')
+                )
+            except ValueError as e:
+                response.status = 400
+                return {"error": str(e)}
+            
+            return {"flag": record}
+        except Exception as e:
+            logger.error(f"Set feature flag error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/feature-flags/<name>", method=["DELETE"])
+    @action.uses("json")
+    async def delete_feature_flag(name):
+        """Delete a feature flag's rule, returning it to its default (admin API)"""
+        try:
+            admin = await _require_admin()
+            if not admin:
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            if not await feature_flag_manager.delete_flag(name, actor=admin.get('sub')):
+                response.status = 404
+                return {"error": "Flag has no rule"}
+            
+            return {"deleted": name}
+        except Exception as e:
+            logger.error(f"Delete feature flag error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/rate-limits", method=["GET"])
+    @action.uses("json")
+    async def list_rate_limits():
+        """List the default and per-user bandwidth limits (admin API)"""
+        try:
+            if not await _require_admin():
+                response.status = 401
+                return {"error": "Admin authorization required"}
+            
+            payload = await rate_limit_manager.export()
+            return {
+                "limits": await rate_limit_manager.list(),
+                "version": payload["version"]
+            }
+        except Exception as e:
+            logger.error(f"List rate limits error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    async def _set_rate_limit(user_id):
+        admin = await _require_admin()
+        if not admin:
+            response.status = 401
+            return {"error": "Admin authorization required"}
+        
+        data = await request.json() or {}
+        if 'bytes_per_second' not in data:
+            response.status = 400
+            return {"error": "Missing required field: bytes_per_second"}
+        
+        try:
+            record = await rate_limit_manager.set_limit(
+                user_id,
+                data['bytes_per_second'],
+                burst_bytes=data.get('burst_bytes', 0),
+                actor=admin.get('sub')
+            )
+        except ValueError as e:
+            response.status = 400
+            return {"error": str(e)}
+        
+        return {"limit": record}
+    
+    async def _delete_rate_limit(user_id):
+        admin = await _require_admin()
+        if not admin:
+            response.status = 401
+            return {"error": "Admin authorization required"}
+        
+        if not await rate_limit_manager.delete_limit(user_id, actor=admin.get('sub')):
+            response.status = 404
+            return {"error": "No rate limit set"}
+        
+        return {"deleted": user_id or "default"}
+    
+    @action("api/v1/rate-limits/default", method=["PUT"])
+    @action.uses("json")
+    async def set_default_rate_limit():
+        """Set the limit for users without one of their own (admin API).
+        Headends pick it up with their next rate limit refresh."""
+        try:
+            return await _set_rate_limit(None)
+        except Exception as e:
+            logger.error(f"Set rate limit error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/rate-limits/default", method=["DELETE"])
+    @action.uses("json")
+    async def delete_default_rate_limit():
+        """Delete the default limit, leaving users without one unlimited (admin API)"""
+        try:
+            return await _delete_rate_limit(None)
+        except Exception as e:
+            logger.error(f"Delete rate limit error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/rate-limits/users/<user_id>", method=["PUT"])
+    @action.uses("json")
+    async def set_user_rate_limit(user_id):
+        """Set a user's limit, overriding the default (admin API). A rate of
+        zero exempts the user."""
+        try:
+            return await _set_rate_limit(user_id)
+        except Exception as e:
+            logger.error(f"Set rate limit error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
+    @action("api/v1/rate-limits/users/<user_id>", method=["DELETE"])
+    @action.uses("json")
+    async def delete_user_rate_limit(user_id):
+        """Delete a user's limit, returning them to the default (admin API)"""
+        try:
+            return await _delete_rate_limit(user_id)
+        except Exception as e:
+            logger.error(f"Delete rate limit error: {e}")
+            response.status = 500
+            return {"error": "Internal server error"}
+    
     @action("api/v1/certs/generate", method=["POST"])
     @action.uses("json")
     async def generate_certificate():
@@ -649,6 +1256,17 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
             response.status = 500
             return {"error": "Internal server error"}
     
+    @action(".well-known/jwks.json", method=["GET"])
+    @action.uses("json")
+    async def get_jwks():
+        """Get JWT signing keys as a JWKS (for headend servers)"""
+        try:
+            return await jwt_manager.get_jwks()
+        except Exception as e:
+            logger.error("Failed to get JWKS", error=str(e))
+            response.status = 500
+            return {"error": "Internal server error"}
+    
     # WireGuard Certificate Management Endpoints
     @action("api/v1/wireguard/keys", method=["POST"])
     @action.uses("json")
@@ -684,6 +1302,15 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
             # Generate WireGuard keys and assign IP
             wg_config = await cert_manager.generate_wireguard_keys(node_id, node_type)
             
+            # Quarantined clients are addressed from the quarantine segment
+            quarantine = await quarantine_manager.get(node_id)
+            if quarantine and quarantine['address']:
+                wg_config['ip_address'] = quarantine['address']
+                wg_config['network_cidr'] = quarantine_manager.network_cidr()
+            
+            # On a dual-stack network the IPv6 address pairs with the IPv4 one
+            network6 = wireguard_network6()
+            
             # Generate X.509 certificate for WireGuard authentication
             if node_type in ['headend', 'kubernetes_node', 'raw_compute']:
                 cert_key, cert_pem, ca_cert = await cert_manager.generate_headend_certificate(
@@ -708,7 +1335,9 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                     "private_key": wg_config['private_key'],
                     "public_key": wg_config['public_key'],
                     "ip_address": wg_config['ip_address'],
-                    "network_cidr": wg_config['network_cidr']
+                    "network_cidr": wg_config['network_cidr'],
+                    "ip_address6": ipv6_address(wg_config['ip_address']) or "",
+                    "network_cidr6": str(network6) if network6 else ""
                 },
                 "certificates": {
                     "private_key": cert_key,
@@ -750,7 +1379,7 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                     return {"error": "Authentication failed"}
             
             # Get all WireGuard peers
-            peers = await cert_manager.get_all_wireguard_peers()
+            peers = await _wireguard_peers()
             
             return {
                 "peers": peers,
@@ -812,7 +1441,7 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                 wg_config = await cert_manager.generate_wireguard_keys(cluster_id, "headend")
             
             # Get all peers for this cluster's WireGuard network
-            peers = await cert_manager.get_all_wireguard_peers()
+            peers = await _wireguard_peers()
             
             # Build headend configuration
             config = {
@@ -853,8 +1482,10 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                     "private_key": wg_config.get('private_key', ''),
                     "public_key": wg_config.get('public_key', ''),
                     "listen_port": 51820,
-                    "network": "10.200.0.0/16",
+                    "network": str(wireguard_network()),
+                    "network6": str(wireguard_network6() or ""),
                     "ip_address": wg_config.get('ip_address', '10.200.0.1'),
+                    "ip_address6": ipv6_address(wg_config.get('ip_address', '10.200.0.1')) or "",
                     "peers": [
                         {
                             "node_id": peer['node_id'],
@@ -872,7 +1503,7 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                     "destinations": [],
                     "protocol": "VXLAN",
                     "buffer_size": 1000,
-                    "sample_rate": 100,
+                    "sample_rate": 1,  # Mirror one in N sessions; 1 mirrors all
                     "filter": ""
                 },
                 
@@ -881,7 +1512,13 @@ def setup_routes(app, cluster_manager, client_registry, cert_manager, jwt_manage
                     "skip_tls_verify": False,
                     "timeout_seconds": 30,
                     "max_idle_conns": 100
-                }
+                },
+                
+                # Feature flag rules; headends evaluate them per user
+                "feature_flags": await feature_flag_manager.export(subject={
+                    "id": cluster_id,
+                    "cohorts": [cluster.region]
+                })
             }
             
             logger.info("Provided headend configuration", cluster_id=cluster_id)
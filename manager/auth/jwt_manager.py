@@ -5,6 +5,9 @@ Handles JWT token generation, validation, and refresh for nodes and clients
 
 import jwt
 import asyncio
+import base64
+import hashlib
+import json
 import time
 from datetime import datetime, timedelta, timezone
 from typing import Dict, Optional, Any, List
@@ -64,6 +67,29 @@ class JWTManager:
             encoding=serialization.Encoding.PEM,
             format=serialization.PublicFormat.SubjectPublicKeyInfo
         )
+        
+        # Headends select verification keys by kid, so tokens signed before
+        # and after a key rotation can both be validated
+        self.public_jwk = self._public_jwk()
+        self.key_id = self.public_jwk["kid"]
+    
+    def _public_jwk(self) -> Dict[str, str]:
+        """Build the RFC 7517 JWK for the public key, with its RFC 7638 thumbprint as kid"""
+        numbers = self.public_key.public_numbers()
+        
+        def b64url_uint(value: int) -> str:
+            raw = value.to_bytes((value.bit_length() + 7) // 8, "big")
+            return base64.urlsafe_b64encode(raw).rstrip(b"=").decode("ascii")
+        
+        jwk = {"e": b64url_uint(numbers.e), "kty": "RSA", "n": b64url_uint(numbers.n)}
+        canonical = json.dumps(jwk, separators=(",", ":"), sort_keys=True)
+        thumbprint = hashlib.sha256(canonical.encode("ascii")).digest()
+        jwk.update({
+            "kid": base64.urlsafe_b64encode(thumbprint).rstrip(b"=").decode("ascii"),
+            "use": "sig",
+            "alg": "RS256",
+        })
+        return jwk
     
     async def initialize(self):
         """Initialize Redis connection pool"""
@@ -129,13 +155,15 @@ class JWTManager:
         access_token = jwt.encode(
             access_payload, 
             self.private_pem, 
-            algorithm="RS256"
+            algorithm="RS256",
+            headers={"kid": self.key_id}
         )
         
         refresh_token = jwt.encode(
             refresh_payload,
             self.private_pem,
-            algorithm="RS256"
+            algorithm="RS256",
+            headers={"kid": self.key_id}
         )
         
         # Cache token metadata in Redis for fast validation
@@ -147,8 +175,12 @@ class JWTManager:
             "active": True
         })
         
+        # The refresh token remembers what the access token granted, so a
+        # refresh hands back the same node type and permissions
         await self._cache_token_metadata(refresh_jti, {
             "node_id": node_id,
+            "node_type": node_type,
+            "permissions": json.dumps(permissions),
             "type": "refresh", 
             "expires_at": refresh_expires.isoformat(),
             "active": True
@@ -178,7 +210,7 @@ class JWTManager:
                 
             # Check Redis cache first
             cached_metadata = await self._get_cached_token_metadata(jti)
-            if not cached_metadata or not cached_metadata.get("active"):
+            if not cached_metadata or cached_metadata.get("active") in (None, "false", "False"):
                 return None
             
             # Verify signature and expiration
@@ -199,21 +231,37 @@ class JWTManager:
             return None
     
     async def refresh_token(self, refresh_token: str) -> Optional[Dict[str, str]]:
-        """Refresh access token using valid refresh token"""
+        """
+        Refresh access token using valid refresh token
+        
+        Refresh tokens are single use: the one presented is invalidated and
+        a new one is returned with the access token, so clients must keep
+        the refresh_token from every response. Presenting a used refresh
+        token fails like an expired one.
+        """
         payload = await self.validate_token(refresh_token)
         
         if not payload or payload.get("type") != "refresh":
             return None
         
         node_id = payload["sub"]
+        jti = payload["jti"]
+        
+        metadata = await self._get_cached_token_metadata(jti)
+        node_type = metadata.get("node_type", "unknown")
+        try:
+            permissions = json.loads(metadata.get("permissions", '["basic"]'))
+        except (TypeError, ValueError):
+            permissions = ["basic"]
+        
+        # Rotate: the old refresh token can't be used again
+        await self._invalidate_token(jti)
+        logger.info("Rotated refresh token", node_id=node_id, jti=jti)
         
-        # Get original token metadata to recreate access token
-        # In production, you'd store this info associated with the node
-        # For now, using basic permissions
         return await self.generate_token(
             node_id=node_id,
-            node_type="unknown",  # Would be stored in user/node registry
-            permissions=["basic"]  # Would be retrieved from node registry
+            node_type=node_type,
+            permissions=permissions
         )
     
     async def revoke_token(self, jti: str) -> bool:
@@ -235,10 +283,49 @@ class JWTManager:
         
         return 0
     
+    async def sign_bootstrap_list(
+        self,
+        client_id: str,
+        headends: List[Dict[str, Any]],
+        validity: timedelta = timedelta(days=30)
+    ) -> Dict[str, str]:
+        """
+        Sign the last-known-good headends a client may connect to while the
+        Manager is unreachable
+        
+        The list is a JWT of type "bootstrap", which headends never accept
+        as an access token.
+        
+        Returns:
+            Dict containing the signed list and its expires_at
+        """
+        now = datetime.now(timezone.utc)
+        expires = now + validity
+        payload = {
+            "sub": client_id,
+            "headends": headends,
+            "iat": int(now.timestamp()),
+            "exp": int(expires.timestamp()),
+            "jti": str(uuid.uuid4()),
+            "type": "bootstrap"
+        }
+        
+        token = jwt.encode(
+            payload,
+            self.private_pem,
+            algorithm="RS256",
+            headers={"kid": self.key_id}
+        )
+        return {"bootstrap_list": token, "expires_at": expires.isoformat()}
+    
     async def get_public_key(self) -> str:
         """Get public key for headend servers to validate tokens"""
         return self.public_pem.decode('utf-8')
     
+    async def get_jwks(self) -> Dict[str, List[Dict[str, str]]]:
+        """Get the JSON Web Key Set headend servers use to select verification keys"""
+        return {"keys": [self.public_jwk]}
+    
     async def _cache_token_metadata(self, jti: str, metadata: Dict[str, Any]):
         """Cache token metadata in Redis"""
         key = f"token_metadata:{jti}"
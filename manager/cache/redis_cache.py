@@ -188,6 +188,43 @@ class RedisCache:
             logger.error(f"Failed to invalidate pattern '{pattern}': {e}")
             return 0
     
+    async def incr(self, key: str) -> Optional[int]:
+        """Increment an integer key, creating it at 1.
+        
+        Args:
+            key: Cache key
+            
+        Returns:
+            The new value, or None if Redis is unavailable
+        """
+        if not self.connected or not self.pool:
+            return None
+            
+        try:
+            return await self.pool.incr(key)
+        except Exception as e:
+            logger.error(f"Failed to increment cache key '{key}': {e}")
+            return None
+    
+    async def publish(self, channel: str, message: str) -> int:
+        """Publish a message on a pub/sub channel.
+        
+        Args:
+            channel: Channel name
+            message: Message to publish
+            
+        Returns:
+            Number of subscribers that received the message
+        """
+        if not self.connected or not self.pool:
+            return 0
+            
+        try:
+            return await self.pool.publish(channel, message)
+        except Exception as e:
+            logger.error(f"Failed to publish on channel '{channel}': {e}")
+            return 0
+    
     async def get_ttl(self, key: str) -> int:
         """Get remaining TTL for a key.
         
@@ -230,6 +267,12 @@ class RedisCache:
 class FirewallRulesCache:
     """Specialized cache for firewall rules with versioning."""
     
+    # Headends may share the rule responses they fetch through Redis, keyed
+    # by this generation; bumping it retires every shared response, and the
+    # channel tells subscribed headends to refetch
+    HEADEND_GENERATION_KEY = "headend:firewall:generation"
+    HEADEND_INVALIDATION_CHANNEL = "headend:firewall:invalidate"
+    
     def __init__(self, redis_cache: RedisCache):
         self.redis = redis_cache
         self.key_prefix = "firewall:"
@@ -264,12 +307,35 @@ class FirewallRulesCache:
         
         # Also invalidate the all_rules cache since it contains this user's rules
         await self.redis.delete(f"{self.key_prefix}all_rules")
+        await self.notify_headends()
         
         return success
     
+    async def invalidate_all_rules(self) -> bool:
+        """Invalidate only the cached full rule set served to headends."""
+        success = await self.redis.delete(f"{self.key_prefix}all_rules")
+        await self.notify_headends()
+        return success
+    
     async def invalidate_all(self) -> int:
         """Invalidate all firewall rule caches."""
-        return await self.redis.invalidate_pattern(f"{self.key_prefix}*")
+        deleted = await self.redis.invalidate_pattern(f"{self.key_prefix}*")
+        await self.notify_headends()
+        return deleted
+    
+    async def notify_headends(self) -> Optional[int]:
+        """Retire the rule responses headends share and tell them to refetch.
+        
+        Returns:
+            The new generation, or None if Redis is unavailable
+        """
+        generation = await self.redis.incr(self.HEADEND_GENERATION_KEY)
+        if generation is None:
+            return None
+        
+        receivers = await self.redis.publish(self.HEADEND_INVALIDATION_CHANNEL, str(generation))
+        logger.debug(f"Firewall rules generation {generation} announced to {receivers} headends")
+        return generation
 
 
 # Global cache instance
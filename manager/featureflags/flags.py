@@ -0,0 +1,168 @@
+"""
+Feature flags for SASEWaddle headends and clients
+
+Flags let larger features such as the binary connection framing, the
+fallback transports and the DNS proxy be rolled out gradually. Each flag
+has a rule: a switch, optionally narrowed to tenants, to cohorts (user
+groups) and to a stable percentage of subjects, with canary subjects that
+always get it. The rules are delivered in the headend configuration and in
+each client's configuration payload; headends and clients evaluate them
+with libs/featureflag and fall back to built-in defaults for any flag
+without a valid rule.
+"""
+
+import hashlib
+import json
+import os
+import re
+import sqlite3
+from datetime import datetime
+from typing import Dict, List, Optional
+
+import structlog
+
+logger = structlog.get_logger()
+
+FLAG_NAME_PATTERN = re.compile(r'^[a-z][a-z0-9_]*$')
+
+# Stored alongside the firewall rules by default
+DEFAULT_DB_PATH = "firewall.db"
+
+# Flags known to current headends and clients; rules for other names are
+# delivered but ignored by releases that don't know them
+KNOWN_FLAGS = {
+    "framing_v2": "Binary connection header (protocol v2)",
+    "fallback_transport": "TCP, UDP and HTTPS fallback transports",
+    "dns_proxy": "DNS resolution through the headend",
+}
+
+
+class FeatureFlagManager:
+    def __init__(self, db_path: Optional[str] = None):
+        self.db_path = db_path or os.getenv('FEATURE_FLAGS_DB', DEFAULT_DB_PATH)
+        self._init_database()
+
+    def _init_database(self):
+        """Initialize the feature flag table"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS feature_flags (
+                name TEXT PRIMARY KEY,
+                enabled INTEGER NOT NULL,
+                percent INTEGER,
+                tenants TEXT NOT NULL DEFAULT '[]',
+                cohorts TEXT NOT NULL DEFAULT '[]',
+                subjects TEXT NOT NULL DEFAULT '[]',
+                actor TEXT,
+                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )
+        """)
+
+        conn.commit()
+        conn.close()
+
+    async def set_flag(self, name: str, enabled: bool, percent: Optional[int] = None,
+                       tenants: Optional[List[str]] = None, cohorts: Optional[List[str]] = None,
+                       subjects: Optional[List[str]] = None, actor: Optional[str] = None) -> Dict:
+        """Create or replace a flag's rule. Raises ValueError for invalid rules."""
+        if not FLAG_NAME_PATTERN.match(name):
+            raise ValueError(f"invalid flag name: {name}")
+        if percent is not None and not (isinstance(percent, int) and 0 <= percent <= 100):
+            raise ValueError("percent must be an integer between 0 and 100")
+        for field, values in (("tenants", tenants), ("cohorts", cohorts), ("subjects", subjects)):
+            if values is not None and not all(isinstance(v, str) for v in values):
+                raise ValueError(f"{field} must be a list of strings")
+
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("""
+            INSERT OR REPLACE INTO feature_flags
+                (name, enabled, percent, tenants, cohorts, subjects, actor, updated_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        """, (name, int(bool(enabled)), percent, json.dumps(tenants or []), json.dumps(cohorts or []),
+              json.dumps(subjects or []), actor, datetime.utcnow().isoformat()))
+        conn.commit()
+        conn.close()
+
+        if name not in KNOWN_FLAGS:
+            logger.warning("Rule set for a flag current releases don't know", flag=name)
+        logger.info("Feature flag updated", flag=name, enabled=enabled, percent=percent,
+                    tenants=tenants, cohorts=cohorts, actor=actor)
+        return await self.get(name)
+
+    async def delete_flag(self, name: str, actor: Optional[str] = None) -> bool:
+        """Delete a flag's rule, returning headends and clients to its default"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("DELETE FROM feature_flags WHERE name = ?", (name,))
+        deleted = cursor.rowcount > 0
+        conn.commit()
+        conn.close()
+
+        if deleted:
+            logger.info("Feature flag rule deleted", flag=name, actor=actor)
+        return deleted
+
+    async def get(self, name: str) -> Optional[Dict]:
+        """Get a flag's rule, or None if it has none"""
+        records = await self._select("WHERE name = ?", (name,))
+        return records[0] if records else None
+
+    async def list(self) -> List[Dict]:
+        """List all flag rules"""
+        return await self._select("ORDER BY name", ())
+
+    async def export(self, subject: Optional[Dict] = None) -> Dict:
+        """
+        Export the rules for delivery in a configuration payload. The version
+        is a digest of the rules, so it changes exactly when they do. Subject
+        describes the recipient (tenant and cohorts) for flags evaluated for
+        it as a whole.
+        """
+        flags = {}
+        for record in await self.list():
+            rule = {"enabled": record['enabled']}
+            if record['percent'] is not None:
+                rule['percent'] = record['percent']
+            for field in ('tenants', 'cohorts', 'subjects'):
+                if record[field]:
+                    rule[field] = record[field]
+            flags[record['name']] = rule
+
+        digest = hashlib.sha256(json.dumps(flags, sort_keys=True).encode()).hexdigest()
+        payload = {"version": digest[:12], "flags": flags}
+        if subject:
+            payload['subject'] = subject
+        return payload
+
+    async def _select(self, clause: str, params: tuple) -> List[Dict]:
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            cursor.execute(f"""
+                SELECT name, enabled, percent, tenants, cohorts, subjects, actor, updated_at
+                FROM feature_flags {clause}
+            """, params)
+            records = [{
+                "name": row[0],
+                "enabled": bool(row[1]),
+                "percent": row[2],
+                "tenants": json.loads(row[3]),
+                "cohorts": json.loads(row[4]),
+                "subjects": json.loads(row[5]),
+                "actor": row[6],
+                "updated_at": row[7],
+                "description": KNOWN_FLAGS.get(row[0], "")
+            } for row in cursor.fetchall()]
+            conn.close()
+            return records
+
+        except Exception as e:
+            logger.error("Failed to read feature flags", error=str(e))
+            return []
+
+
+# Global feature flag manager instance
+feature_flag_manager = FeatureFlagManager()
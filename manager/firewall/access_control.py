@@ -7,7 +7,7 @@ import ipaddress
 import re
 import sqlite3
 from dataclasses import dataclass, field
-from datetime import datetime
+from datetime import datetime, timedelta
 from enum import Enum
 from typing import Dict, List, Optional, Set, Union
 from urllib.parse import urlparse
@@ -16,6 +16,19 @@ import structlog
 
 logger = structlog.get_logger()
 
+# How long rule changes are remembered for headend delta syncs. A headend
+# whose cursor is older than this gets the full rule set instead.
+CHANGE_LOG_RETENTION = timedelta(days=7)
+
+# Group rule sets are stored like user rules, under a "group:<name>" subject
+# in place of the user ID, and headends merge them with each member's rules
+GROUP_SUBJECT_PREFIX = "group:"
+
+
+def group_subject(group: str) -> str:
+    """Get the rule subject that holds a group's rules"""
+    return GROUP_SUBJECT_PREFIX + group
+
 class AccessType(Enum):
     ALLOW = "allow"
     DENY = "deny"
@@ -92,6 +105,15 @@ class AccessControlManager:
             ON access_rules(is_active, priority)
         """)
         
+        # Change log backing the headend delta sync cursor
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS rule_changes (
+                seq INTEGER PRIMARY KEY AUTOINCREMENT,
+                user_id TEXT NOT NULL,
+                changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )
+        """)
+        
         conn.commit()
         conn.close()
         
@@ -115,6 +137,7 @@ class AccessControlManager:
                 rule.updated_at.isoformat(), rule.is_active, rule.description,
                 rule.src_ip, rule.dst_ip, rule.protocol, rule.src_port, rule.dst_port, rule.direction
             ))
+            self._record_change(cursor, rule.user_id)
             
             conn.commit()
             conn.close()
@@ -135,7 +158,12 @@ class AccessControlManager:
             conn = sqlite3.connect(self.db_path)
             cursor = conn.cursor()
             
+            cursor.execute("SELECT user_id FROM access_rules WHERE id = ?", (rule_id,))
+            row = cursor.fetchone()
+            
             cursor.execute("DELETE FROM access_rules WHERE id = ?", (rule_id,))
+            if row:
+                self._record_change(cursor, row[0])
             
             conn.commit()
             conn.close()
@@ -496,6 +524,7 @@ class AccessControlManager:
                 rule.priority, rule.updated_at.isoformat(), rule.is_active,
                 rule.description, rule.id
             ))
+            self._record_change(cursor, rule.user_id)
             
             conn.commit()
             conn.close()
@@ -507,6 +536,64 @@ class AccessControlManager:
             logger.error("Failed to update access rule", error=str(e))
             return False
     
+    def _record_change(self, cursor, user_id: str):
+        """Log that a user's rules changed and prune expired log entries"""
+        cursor.execute("INSERT INTO rule_changes (user_id, changed_at) VALUES (?, ?)",
+                       (user_id, datetime.utcnow().isoformat()))
+        cursor.execute("DELETE FROM rule_changes WHERE changed_at < ?",
+                       ((datetime.utcnow() - CHANGE_LOG_RETENTION).isoformat(),))
+    
+    async def get_change_cursor(self) -> int:
+        """Get the sequence number of the latest rule change"""
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            cursor.execute("SELECT seq FROM sqlite_sequence WHERE name = 'rule_changes'")
+            row = cursor.fetchone()
+            conn.close()
+            return row[0] if row else 0
+            
+        except Exception as e:
+            logger.error("Failed to get rule change cursor", error=str(e))
+            return 0
+    
+    async def get_changed_users(self, since: int) -> Optional[List[str]]:
+        """
+        Get the users whose rules changed after cursor `since`.
+        
+        Returns None when the changes can't be listed, because the cursor is
+        ahead of this database or older than the retained change log; the
+        caller must then send the full rule set.
+        """
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            
+            cursor.execute("SELECT seq FROM sqlite_sequence WHERE name = 'rule_changes'")
+            row = cursor.fetchone()
+            current = row[0] if row else 0
+            if since > current:
+                conn.close()
+                return None
+            if since == current:
+                conn.close()
+                return []
+            
+            cursor.execute("SELECT MIN(seq) FROM rule_changes")
+            oldest = cursor.fetchone()[0]
+            if oldest is None or since < oldest - 1:
+                conn.close()
+                return None
+            
+            cursor.execute("SELECT DISTINCT user_id FROM rule_changes WHERE seq > ?", (since,))
+            users = [row[0] for row in cursor.fetchall()]
+            conn.close()
+            return users
+            
+        except Exception as e:
+            logger.error("Failed to get changed users", since=since, error=str(e))
+            return None
+    
     async def export_user_rules(self, user_id: str) -> Dict:
         """Export user rules for headend consumption"""
         rules = await self.get_user_rules(user_id)
@@ -570,5 +657,29 @@ class AccessControlManager:
         
         return export_data
 
+    async def get_rule_groups(self) -> List[str]:
+        """Get the groups that have active rules"""
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            cursor.execute("""
+                SELECT DISTINCT user_id FROM access_rules
+                WHERE user_id LIKE ? AND is_active = 1
+            """, (GROUP_SUBJECT_PREFIX + '%',))
+            groups = [row[0][len(GROUP_SUBJECT_PREFIX):] for row in cursor.fetchall()]
+            conn.close()
+            return groups
+            
+        except Exception as e:
+            logger.error("Failed to get rule groups", error=str(e))
+            return []
+    
+    async def export_group_rules(self, group: str) -> Dict:
+        """Export a group's rules for headend consumption"""
+        export_data = await self.export_user_rules(group_subject(group))
+        del export_data["user_id"]
+        export_data["group"] = group
+        return export_data
+
 # Global access control manager instance
 access_control_manager = AccessControlManager()
\ No newline at end of file
@@ -0,0 +1,216 @@
+"""
+Quarantine network profile for SASEWaddle clients
+
+A quarantined user is held to a restricted firewall rule set, gets its
+tunnel address from a dedicated segment of the WireGuard network and is
+shown a banner by its client. Users are quarantined when their device fails
+a posture check, when an anomaly detector reports them or by an admin, and
+stay quarantined until released.
+"""
+
+import ipaddress
+import os
+import sqlite3
+from datetime import datetime
+from enum import Enum
+from typing import Dict, List, Optional
+
+import structlog
+
+from .access_control import AccessControlManager, access_control_manager
+
+logger = structlog.get_logger()
+
+# The quarantine rule set is stored like user rules under this subject, so
+# it is managed with the regular firewall rule API
+QUARANTINE_SUBJECT = "profile:quarantine"
+
+# Segment of the WireGuard network quarantined clients are addressed from
+DEFAULT_QUARANTINE_NETWORK = "10.200.255.0/24"
+
+DEFAULT_QUARANTINE_MESSAGE = (
+    "This device has been quarantined and can only reach remediation services. "
+    "Contact your administrator if this persists."
+)
+
+
+class QuarantineSource(Enum):
+    POSTURE = "posture"
+    ANOMALY = "anomaly"
+    ADMIN = "admin"
+
+
+class QuarantineManager:
+    def __init__(self, access_control: AccessControlManager,
+                 network: Optional[str] = None, message: Optional[str] = None):
+        self.access_control = access_control
+        self.db_path = access_control.db_path
+        self.network = ipaddress.ip_network(
+            network or os.getenv('QUARANTINE_NETWORK', DEFAULT_QUARANTINE_NETWORK))
+        self.message = message or os.getenv('QUARANTINE_MESSAGE', DEFAULT_QUARANTINE_MESSAGE)
+        self._init_database()
+
+    def _init_database(self):
+        """Initialize the quarantine table"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS quarantines (
+                user_id TEXT PRIMARY KEY,
+                reason TEXT NOT NULL,
+                source TEXT NOT NULL,
+                address TEXT UNIQUE,
+                actor TEXT,
+                created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )
+        """)
+
+        conn.commit()
+        conn.close()
+
+    async def quarantine(self, user_id: str, reason: str, source: QuarantineSource,
+                         actor: Optional[str] = None) -> Optional[Dict]:
+        """
+        Quarantine a user, allocating its tunnel address from the quarantine
+        segment. Quarantining a user again only updates the reason.
+        """
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+
+            cursor.execute("SELECT address FROM quarantines WHERE user_id = ?", (user_id,))
+            row = cursor.fetchone()
+            if row:
+                address = row[0]
+                cursor.execute("""
+                    UPDATE quarantines SET reason = ?, source = ?, actor = ?
+                    WHERE user_id = ?
+                """, (reason, source.value, actor, user_id))
+            else:
+                address = self._allocate_address(cursor)
+                if address is None:
+                    logger.warning("Quarantine address pool exhausted", network=str(self.network))
+                cursor.execute("""
+                    INSERT INTO quarantines (user_id, reason, source, address, actor, created_at)
+                    VALUES (?, ?, ?, ?, ?, ?)
+                """, (user_id, reason, source.value, address, actor, datetime.utcnow().isoformat()))
+
+            # Headends pick the change up with their next delta sync
+            self.access_control._record_change(cursor, QUARANTINE_SUBJECT)
+            conn.commit()
+            conn.close()
+
+            logger.warning("User quarantined", user_id=user_id, reason=reason,
+                           source=source.value, actor=actor, address=address)
+            return await self.get(user_id)
+
+        except Exception as e:
+            logger.error("Failed to quarantine user", user_id=user_id, error=str(e))
+            return None
+
+    async def release(self, user_id: str, actor: Optional[str] = None) -> bool:
+        """Release a user from quarantine, freeing its quarantine address"""
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+
+            cursor.execute("DELETE FROM quarantines WHERE user_id = ?", (user_id,))
+            released = cursor.rowcount > 0
+            if released:
+                self.access_control._record_change(cursor, QUARANTINE_SUBJECT)
+
+            conn.commit()
+            conn.close()
+
+            if released:
+                logger.info("User released from quarantine", user_id=user_id, actor=actor)
+            return released
+
+        except Exception as e:
+            logger.error("Failed to release user from quarantine", user_id=user_id, error=str(e))
+            return False
+
+    async def get(self, user_id: str) -> Optional[Dict]:
+        """Get a user's quarantine, or None if it isn't quarantined"""
+        records = await self._select("WHERE user_id = ?", (user_id,))
+        return records[0] if records else None
+
+    async def list(self) -> List[Dict]:
+        """List all quarantined users"""
+        return await self._select("ORDER BY created_at", ())
+
+    async def evaluate_posture(self, user_id: str, posture: Dict) -> Optional[Dict]:
+        """
+        Apply a posture report from a client. A failed check quarantines the
+        user; a passing check releases it again, but only from a quarantine
+        the posture check caused itself.
+        """
+        if posture.get('compliant', True):
+            current = await self.get(user_id)
+            if current and current['source'] == QuarantineSource.POSTURE.value:
+                await self.release(user_id, actor="posture")
+            return None
+
+        failures = posture.get('failures') or []
+        reason = "posture check failed"
+        if failures:
+            reason += ": " + ", ".join(str(f) for f in failures)
+        return await self.quarantine(user_id, reason, QuarantineSource.POSTURE)
+
+    async def export(self) -> Dict:
+        """Export the quarantine profile and its users for headend consumption"""
+        rules = await self.access_control.export_user_rules(QUARANTINE_SUBJECT)
+        del rules["user_id"]
+
+        users = {}
+        for record in await self.list():
+            users[record['user_id']] = {
+                "reason": record['reason'],
+                "source": record['source'],
+                "address": record['address'],
+                "message": self.message,
+                "since": record['created_at']
+            }
+
+        return {"rules": rules, "users": users}
+
+    def network_cidr(self) -> str:
+        """Get the quarantine segment in CIDR notation"""
+        return str(self.network)
+
+    async def _select(self, clause: str, params: tuple) -> List[Dict]:
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            cursor.execute(f"""
+                SELECT user_id, reason, source, address, actor, created_at
+                FROM quarantines {clause}
+            """, params)
+            records = [{
+                "user_id": row[0],
+                "reason": row[1],
+                "source": row[2],
+                "address": row[3],
+                "actor": row[4],
+                "created_at": row[5]
+            } for row in cursor.fetchall()]
+            conn.close()
+            return records
+
+        except Exception as e:
+            logger.error("Failed to read quarantines", error=str(e))
+            return []
+
+    def _allocate_address(self, cursor) -> Optional[str]:
+        """Pick the first free host address of the quarantine segment"""
+        cursor.execute("SELECT address FROM quarantines WHERE address IS NOT NULL")
+        used = {row[0] for row in cursor.fetchall()}
+        for host in self.network.hosts():
+            if str(host) not in used:
+                return str(host)
+        return None
+
+
+# Global quarantine manager instance
+quarantine_manager = QuarantineManager(access_control_manager)
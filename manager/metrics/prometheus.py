@@ -261,6 +261,13 @@ class ManagerMetrics:
             registry=self.registry
         )
         
+        self.client_metrics_route_tampers = Gauge(
+            'sasewaddle_client_route_tamper_total',
+            'Times other software changed the client tunnel routes or firewall mark',
+            ['client_id', 'client_name', 'client_type', 'headless'],
+            registry=self.registry
+        )
+        
         self.client_metrics_last_check_in = Gauge(
             'sasewaddle_client_last_check_in_timestamp',
             'Timestamp of last check-in from client',
@@ -506,6 +513,14 @@ class ManagerMetrics:
                 headless=headless_str
             ).set(metrics['connection_uptime'])
         
+        if 'route_tamper_total' in metrics:
+            self.client_metrics_route_tampers.labels(
+                client_id=client_id,
+                client_name=client_name,
+                client_type=client_type,
+                headless=headless_str
+            ).set(metrics['route_tamper_total'])
+        
         # Always update last check-in time
         self.client_metrics_last_check_in.labels(
             client_id=client_id,
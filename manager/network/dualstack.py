@@ -0,0 +1,87 @@
+"""
+Dual-stack addressing of the WireGuard network
+
+Clients get their tunnel address from the IPv4 WireGuard network. When an
+IPv6 network is configured with WIREGUARD_NETWORK6, each client also gets
+the IPv6 address at the same offset into it, so a client's two addresses
+are derived from each other and need no separate allocation. The IPv6
+network must hold at least as many addresses as the IPv4 one.
+"""
+
+import ipaddress
+import os
+from typing import List, Optional, Union
+
+import structlog
+
+logger = structlog.get_logger()
+
+DEFAULT_WIREGUARD_NETWORK = "10.200.0.0/16"
+
+
+def wireguard_network() -> ipaddress.IPv4Network:
+    """The IPv4 WireGuard network clients are addressed from"""
+    return ipaddress.IPv4Network(
+        os.getenv('WIREGUARD_NETWORK', DEFAULT_WIREGUARD_NETWORK), strict=False)
+
+
+def wireguard_network6() -> Optional[ipaddress.IPv6Network]:
+    """The IPv6 WireGuard network, or None when tunnels are IPv4 only"""
+    value = os.getenv('WIREGUARD_NETWORK6', '')
+    if not value:
+        return None
+    try:
+        return ipaddress.IPv6Network(value, strict=False)
+    except ValueError as e:
+        logger.warning("Ignoring invalid WIREGUARD_NETWORK6", network=value, error=str(e))
+        return None
+
+
+def ipv6_address(ipv4_address: str,
+                 network: Optional[ipaddress.IPv4Network] = None,
+                 network6: Optional[ipaddress.IPv6Network] = None) -> Optional[str]:
+    """The IPv6 address paired with an IPv4 tunnel address, or None
+
+    An address given with a prefix length (10.200.1.2/16) is returned with
+    the IPv6 network's (fd00:200::1:2/64), a bare one bare.
+    """
+    network = network or wireguard_network()
+    network6 = network6 if network6 is not None else wireguard_network6()
+    if network6 is None or not ipv4_address:
+        return None
+
+    address, _, prefix = ipv4_address.partition('/')
+    try:
+        ipv4 = ipaddress.IPv4Address(address.strip())
+    except ValueError:
+        return None
+    if ipv4 not in network:
+        return None
+
+    offset = int(ipv4) - int(network.network_address)
+    if offset >= network6.num_addresses:
+        return None
+    ipv6 = str(network6.network_address + offset)
+    return f"{ipv6}/{network6.prefixlen}" if prefix else ipv6
+
+
+def dual_stack_allowed_ips(allowed_ips: Union[List[str], str],
+                           network: Optional[ipaddress.IPv4Network] = None,
+                           network6: Optional[ipaddress.IPv6Network] = None) -> List[str]:
+    """A peer's allowed IPs with the IPv6 host route of each IPv4 tunnel address added"""
+    if isinstance(allowed_ips, str):
+        allowed_ips = [ip.strip() for ip in allowed_ips.split(',') if ip.strip()]
+    network = network or wireguard_network()
+    network6 = network6 if network6 is not None else wireguard_network6()
+
+    result = list(allowed_ips)
+    if network6 is None:
+        return result
+    for allowed_ip in allowed_ips:
+        address, _, prefix = allowed_ip.partition('/')
+        if prefix not in ('', '32'):
+            continue
+        ipv6 = ipv6_address(address, network, network6)
+        if ipv6 and f"{ipv6}/128" not in result:
+            result.append(f"{ipv6}/128")
+    return result
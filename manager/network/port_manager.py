@@ -18,6 +18,10 @@ class PortProtocol(Enum):
     UDP = "udp"
 
 
+# States a headend reports for each configured port
+LISTENER_STATES = ("listening", "conflict", "failed")
+
+
 @dataclass
 class PortRange:
     """Represents a range of ports for listening."""
@@ -146,6 +150,20 @@ class PortConfigManager:
                 CREATE INDEX IF NOT EXISTS idx_port_ranges_cluster 
                 ON port_ranges(cluster_id)
             """)
+            
+            # Outcome of each headend's last attempt to bind its ports
+            conn.execute("""
+                CREATE TABLE IF NOT EXISTS port_listener_status (
+                    headend_id TEXT NOT NULL,
+                    protocol TEXT NOT NULL,
+                    port INTEGER NOT NULL,
+                    state TEXT NOT NULL,
+                    error TEXT,
+                    last_attempt TIMESTAMP,
+                    reported_at TIMESTAMP NOT NULL,
+                    PRIMARY KEY (headend_id, protocol, port)
+                )
+            """)
 
     async def get_headend_config(self, headend_id: str) -> Optional[HeadendPortConfig]:
         """Get port configuration for a specific headend."""
@@ -359,6 +377,59 @@ class PortConfigManager:
         
         return configs
 
+    async def save_listener_status(self, headend_id: str, listeners: List[Dict]) -> int:
+        """Replace a headend's reported listener states. Raises ValueError on an invalid entry."""
+        rows = []
+        for listener in listeners:
+            port = listener.get('port')
+            protocol = listener.get('protocol')
+            state = listener.get('state')
+            if not isinstance(port, int) or not 1 <= port <= 65535:
+                raise ValueError(f"Invalid port: {port}")
+            if protocol not in (PortProtocol.TCP.value, PortProtocol.UDP.value):
+                raise ValueError(f"Invalid protocol: {protocol}")
+            if state not in LISTENER_STATES:
+                raise ValueError(f"Invalid listener state: {state}")
+            rows.append((port, protocol, state, listener.get('error') or None, listener.get('last_attempt')))
+        
+        reported_at = datetime.utcnow().isoformat()
+        loop = asyncio.get_event_loop()
+        
+        def _save_status():
+            with sqlite3.connect(self.db_path) as conn:
+                conn.execute("DELETE FROM port_listener_status WHERE headend_id = ?", (headend_id,))
+                conn.executemany("""
+                    INSERT INTO port_listener_status
+                    (headend_id, port, protocol, state, error, last_attempt, reported_at)
+                    VALUES (?, ?, ?, ?, ?, ?, ?)
+                """, [(headend_id, *row, reported_at) for row in rows])
+        
+        await loop.run_in_executor(None, _save_status)
+        
+        unbound = [f"{row[1]}/{row[0]}" for row in rows if row[2] != "listening"]
+        if unbound:
+            logger.warning(f"Headend {headend_id} could not bind ports: {', '.join(unbound)}")
+        
+        return len(rows)
+
+    async def get_listener_status(self, headend_id: str) -> List[Dict]:
+        """Get a headend's last reported listener states, ordered by port and protocol."""
+        loop = asyncio.get_event_loop()
+        
+        def _get_status():
+            with sqlite3.connect(self.db_path) as conn:
+                conn.row_factory = sqlite3.Row
+                cursor = conn.cursor()
+                cursor.execute("""
+                    SELECT port, protocol, state, error, last_attempt, reported_at
+                    FROM port_listener_status
+                    WHERE headend_id = ?
+                    ORDER BY port, protocol
+                """, (headend_id,))
+                return [dict(row) for row in cursor.fetchall()]
+        
+        return await loop.run_in_executor(None, _get_status)
+
     async def set_default_config(self, headend_id: str, cluster_id: str) -> None:
         """Set default port configuration for a headend."""
         # Default proxy ports
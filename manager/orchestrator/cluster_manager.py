@@ -1,11 +1,14 @@
 import asyncio
 import json
+import os
 from typing import Dict, List, Optional, Set
 from datetime import datetime, timedelta
 import structlog
 from dataclasses import dataclass, asdict
 import aioredis
 
+from orchestrator.hash_ring import HashRing
+
 logger = structlog.get_logger()
 
 @dataclass
@@ -26,6 +29,10 @@ class ClusterManager:
         self.redis: Optional[aioredis.Redis] = None
         self.health_check_interval = 30
         self._lock = asyncio.Lock()
+        # least_loaded, or consistent_hash for anycast deployments where
+        # clients should stick to a headend across reconnects
+        self.assignment_mode = os.getenv('CLIENT_ASSIGNMENT_MODE', 'least_loaded')
+        self._rings: Dict[tuple, HashRing] = {}
         
     async def initialize(self):
         try:
@@ -165,7 +172,7 @@ class ClusterManager:
         except:
             return False
     
-    async def get_optimal_cluster(self, client_location: Dict) -> Optional[Cluster]:
+    async def get_optimal_cluster(self, client_location: Dict, client_id: str = None) -> Optional[Cluster]:
         region = client_location.get('region')
         datacenter = client_location.get('datacenter')
         
@@ -185,4 +192,37 @@ class ClusterManager:
         if not active_candidates:
             return None
         
-        return min(active_candidates, key=lambda c: c.client_count)
\ No newline at end of file
+        if self.assignment_mode == 'consistent_hash' and client_id:
+            return self.clusters[self._ring_for(active_candidates).get_node(client_id)]
+        
+        return min(active_candidates, key=lambda c: c.client_count)
+    
+    async def get_preferred_clusters(self, client_id: str, count: int = 3,
+                                     exclude: Set[str] = None) -> List[Cluster]:
+        """Return the client's headends in consistent-hash preference order
+        
+        The first cluster is where the client connects; the others are where
+        it lands, in order, if the ones before it fail. Clusters in exclude
+        are treated as failed, to preview a failover.
+        """
+        exclude = exclude or set()
+        active = [c for c in self.clusters.values() if c.status == 'active' and c.id not in exclude]
+        if not active:
+            return []
+        
+        return [self.clusters[cid] for cid in self._ring_for(active).get_nodes(client_id, count)]
+    
+    def _ring_for(self, clusters: List[Cluster]) -> HashRing:
+        """Return the hash ring over clusters, weighted by metadata weight"""
+        nodes = {c.id: float(c.metadata.get('weight', 1.0)) for c in clusters}
+        key = tuple(sorted(nodes.items()))
+        
+        ring = self._rings.get(key)
+        if ring is None:
+            # Cluster membership changes rarely, so a couple of rings covers
+            # the current and just-failed-over sets
+            if len(self._rings) >= 8:
+                self._rings.clear()
+            ring = HashRing(nodes)
+            self._rings[key] = ring
+        return ring
\ No newline at end of file
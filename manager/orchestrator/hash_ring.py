@@ -0,0 +1,96 @@
+"""
+Consistent hashing of clients onto headends
+
+Anycast and multi-headend clusters assign each client a preferred headend by
+hashing its client ID onto a ring of virtual nodes. Adding or losing a
+headend only moves the clients that hashed to it, so after a failover the
+orphaned clients spread evenly over the survivors while everyone else keeps
+the headend that already caches their rules and sessions.
+"""
+
+import bisect
+import hashlib
+from collections import Counter
+from typing import Dict, Iterable, List, Optional
+
+# Virtual nodes per unit of weight; enough for an even spread over a few
+# dozen headends without making ring rebuilds noticeable
+DEFAULT_VNODES = 160
+
+
+def _hash(key: str) -> int:
+    return int.from_bytes(hashlib.sha256(key.encode('utf-8')).digest()[:8], 'big')
+
+
+class HashRing:
+    """A consistent hash ring of weighted nodes"""
+
+    def __init__(self, nodes: Optional[Dict[str, float]] = None, vnodes: int = DEFAULT_VNODES):
+        self.vnodes = vnodes
+        self._weights: Dict[str, float] = {}
+        self._ring: List[int] = []
+        self._owners: Dict[int, str] = {}
+        for node, weight in (nodes or {}).items():
+            self.add_node(node, weight)
+
+    def add_node(self, node: str, weight: float = 1.0):
+        """Add a node, or change its weight if it is already on the ring"""
+        if weight <= 0:
+            raise ValueError(f"Node weight must be positive: {node}={weight}")
+        if node in self._weights:
+            self.remove_node(node)
+
+        self._weights[node] = weight
+        for i in range(max(1, int(self.vnodes * weight))):
+            point = _hash(f"{node}#{i}")
+            # On the rare collision the first owner keeps the point
+            if point in self._owners:
+                continue
+            self._owners[point] = node
+            bisect.insort(self._ring, point)
+
+    def remove_node(self, node: str) -> bool:
+        if node not in self._weights:
+            return False
+        del self._weights[node]
+        self._ring = [p for p in self._ring if self._owners[p] != node]
+        self._owners = {p: n for p, n in self._owners.items() if n != node}
+        return True
+
+    @property
+    def nodes(self) -> List[str]:
+        return sorted(self._weights)
+
+    def get_node(self, key: str) -> Optional[str]:
+        """Return the node that owns key, or None for an empty ring"""
+        nodes = self.get_nodes(key, 1)
+        return nodes[0] if nodes else None
+
+    def get_nodes(self, key: str, count: int) -> List[str]:
+        """Return up to count distinct nodes in preference order for key
+
+        The first node is the key's owner; the rest are where it lands if
+        the nodes before them fail, in order.
+        """
+        if not self._ring or count <= 0:
+            return []
+
+        count = min(count, len(self._weights))
+        preferred: List[str] = []
+        start = bisect.bisect(self._ring, _hash(key))
+        for offset in range(len(self._ring)):
+            node = self._owners[self._ring[(start + offset) % len(self._ring)]]
+            if node not in preferred:
+                preferred.append(node)
+                if len(preferred) == count:
+                    break
+        return preferred
+
+    def distribution(self, keys: Iterable[str]) -> Dict[str, int]:
+        """Count how many of keys each node owns"""
+        counts = Counter({node: 0 for node in self._weights})
+        for key in keys:
+            node = self.get_node(key)
+            if node is not None:
+                counts[node] += 1
+        return dict(counts)
@@ -0,0 +1,162 @@
+"""
+Headend registry for SASEWaddle
+
+Headends register with the Manager when they start and send heartbeats
+afterwards, each carrying the headend's advertisement: its version, the
+features it has enabled, the listeners it serves and its WireGuard public
+key. The registry keeps the latest advertisement of every headend, so the
+Manager knows what each one actually runs instead of assuming it, and
+reports headends that stopped sending heartbeats as stale.
+"""
+
+import json
+import os
+import sqlite3
+from datetime import datetime, timedelta
+from typing import Dict, List, Optional
+
+import structlog
+
+logger = structlog.get_logger()
+
+# Stored alongside the firewall rules by default
+DEFAULT_DB_PATH = "firewall.db"
+
+# Assumed for headends that don't say how often they send heartbeats
+DEFAULT_HEARTBEAT_INTERVAL = 30
+
+# Heartbeat intervals a headend may miss before it counts as stale
+STALE_HEARTBEATS = 3
+
+STATUS_ONLINE = "online"
+STATUS_STALE = "stale"
+
+
+class HeadendRegistry:
+    def __init__(self, db_path: Optional[str] = None):
+        self.db_path = db_path or os.getenv('HEADEND_REGISTRY_DB', DEFAULT_DB_PATH)
+        self._init_database()
+
+    def _init_database(self):
+        """Initialize the headend table"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS headends (
+                headend_id TEXT PRIMARY KEY,
+                cluster_id TEXT,
+                advertisement TEXT NOT NULL,
+                registered_at TIMESTAMP NOT NULL,
+                last_heartbeat TIMESTAMP NOT NULL
+            )
+        """)
+
+        conn.commit()
+        conn.close()
+
+    async def register(self, advertisement: Dict, now: Optional[datetime] = None) -> Dict:
+        """Record a headend that just started, replacing what was known of it"""
+        now = now or datetime.utcnow()
+        headend_id = advertisement['headend_id']
+
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("""
+            INSERT OR REPLACE INTO headends (headend_id, cluster_id, advertisement, registered_at, last_heartbeat)
+            VALUES (?, ?, ?, ?, ?)
+        """, (headend_id, advertisement.get('cluster_id', ''), json.dumps(advertisement),
+              now.isoformat(), now.isoformat()))
+        conn.commit()
+        conn.close()
+
+        logger.info("Headend registered", headend_id=headend_id,
+                    cluster_id=advertisement.get('cluster_id', ''),
+                    version=(advertisement.get('version') or {}).get('version', ''))
+        return self._describe(headend_id, advertisement, now, now, now)
+
+    async def heartbeat(self, headend_id: str, advertisement: Dict,
+                        now: Optional[datetime] = None) -> bool:
+        """
+        Record a heartbeat with the headend's current advertisement. Returns
+        False for headends that never registered, which register again.
+        """
+        now = now or datetime.utcnow()
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("""
+            UPDATE headends SET cluster_id = ?, advertisement = ?, last_heartbeat = ?
+            WHERE headend_id = ?
+        """, (advertisement.get('cluster_id', ''), json.dumps(advertisement), now.isoformat(), headend_id))
+        known = cursor.rowcount > 0
+        conn.commit()
+        conn.close()
+        return known
+
+    async def get_headend(self, headend_id: str, now: Optional[datetime] = None) -> Optional[Dict]:
+        """Get a headend's latest advertisement and status"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("""
+            SELECT headend_id, advertisement, registered_at, last_heartbeat
+            FROM headends WHERE headend_id = ?
+        """, (headend_id,))
+        row = cursor.fetchone()
+        conn.close()
+        return self._from_row(row, now or datetime.utcnow()) if row else None
+
+    async def list_headends(self, cluster_id: Optional[str] = None,
+                            now: Optional[datetime] = None) -> List[Dict]:
+        """List registered headends, optionally of one cluster"""
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            if cluster_id:
+                cursor.execute("""
+                    SELECT headend_id, advertisement, registered_at, last_heartbeat
+                    FROM headends WHERE cluster_id = ? ORDER BY headend_id
+                """, (cluster_id,))
+            else:
+                cursor.execute("""
+                    SELECT headend_id, advertisement, registered_at, last_heartbeat
+                    FROM headends ORDER BY headend_id
+                """)
+            rows = cursor.fetchall()
+            conn.close()
+
+            now = now or datetime.utcnow()
+            return [self._from_row(row, now) for row in rows]
+
+        except Exception as e:
+            logger.error("Failed to read headend registry", error=str(e))
+            return []
+
+    async def remove(self, headend_id: str) -> bool:
+        """Forget a decommissioned headend"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("DELETE FROM headends WHERE headend_id = ?", (headend_id,))
+        removed = cursor.rowcount > 0
+        conn.commit()
+        conn.close()
+        return removed
+
+    def _from_row(self, row, now: datetime) -> Dict:
+        return self._describe(row[0], json.loads(row[1]), datetime.fromisoformat(row[2]),
+                              datetime.fromisoformat(row[3]), now)
+
+    def _describe(self, headend_id: str, advertisement: Dict, registered_at: datetime,
+                  last_heartbeat: datetime, now: datetime) -> Dict:
+        interval = advertisement.get('heartbeat_interval_seconds') or DEFAULT_HEARTBEAT_INTERVAL
+        stale = now - last_heartbeat > timedelta(seconds=interval * STALE_HEARTBEATS)
+        return {
+            **advertisement,
+            "headend_id": headend_id,
+            "status": STATUS_STALE if stale else STATUS_ONLINE,
+            "registered_at": registered_at.isoformat(),
+            "last_heartbeat": last_heartbeat.isoformat()
+        }
+
+
+# Global headend registry instance
+headend_registry = HeadendRegistry()
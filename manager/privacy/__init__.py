@@ -0,0 +1 @@
+# Privacy controls for SASEWaddle Manager
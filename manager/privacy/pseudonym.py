@@ -0,0 +1,182 @@
+"""
+Access log pseudonymization keys for SASEWaddle headends
+
+Headends replace the user identifiers in the access logs they export with a
+keyed hash, so bulk analytics never see who did what. The Manager issues
+the key, rotates it and keeps it for a retention period; log entries carry
+only the key's ID. During an incident an admin can unmask a pseudonym by
+hashing known identifiers with the referenced key until one matches. Every
+unmasking is recorded with the admin and the reason, and once a key is
+pruned its pseudonyms can no longer be unmasked at all.
+"""
+
+import base64
+import hashlib
+import hmac
+import os
+import secrets
+import sqlite3
+from datetime import datetime, timedelta
+from typing import Dict, Iterable, List, Optional
+
+import structlog
+
+logger = structlog.get_logger()
+
+# Stored alongside the firewall rules by default
+DEFAULT_DB_PATH = "firewall.db"
+
+DEFAULT_ROTATION_HOURS = 24
+DEFAULT_RETENTION_DAYS = 90
+
+# Pseudonyms are the first 16 bytes of the HMAC-SHA256, hex encoded; the
+# headends compute them the same way
+PSEUDONYM_BYTES = 16
+
+
+def pseudonymize(secret: bytes, identifier: str) -> str:
+    """Compute the pseudonym of identifier under secret"""
+    digest = hmac.new(secret, identifier.encode(), hashlib.sha256).digest()
+    return digest[:PSEUDONYM_BYTES].hex()
+
+
+class PseudonymKeyManager:
+    def __init__(self, db_path: Optional[str] = None, rotation: Optional[timedelta] = None,
+                 retention: Optional[timedelta] = None):
+        self.db_path = db_path or os.getenv('PSEUDONYM_KEYS_DB', DEFAULT_DB_PATH)
+        self.rotation = rotation or timedelta(
+            hours=int(os.getenv('PSEUDONYM_KEY_ROTATION_HOURS', DEFAULT_ROTATION_HOURS)))
+        self.retention = retention or timedelta(
+            days=int(os.getenv('PSEUDONYM_KEY_RETENTION_DAYS', DEFAULT_RETENTION_DAYS)))
+        self._init_database()
+
+    def _init_database(self):
+        """Initialize the key and unmasking tables"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS pseudonym_keys (
+                key_id TEXT PRIMARY KEY,
+                secret TEXT NOT NULL,
+                created_at TIMESTAMP NOT NULL,
+                expires_at TIMESTAMP NOT NULL
+            )
+        """)
+
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS pseudonym_unmaskings (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                key_id TEXT NOT NULL,
+                pseudonym TEXT NOT NULL,
+                matched TEXT,
+                actor TEXT NOT NULL,
+                reason TEXT NOT NULL,
+                created_at TIMESTAMP NOT NULL
+            )
+        """)
+
+        conn.commit()
+        conn.close()
+
+    async def current_key(self, now: Optional[datetime] = None) -> Dict:
+        """
+        Get the key headends should hash with, creating a new one once the
+        current one expires. Keys past their retention are pruned.
+        """
+        now = now or datetime.utcnow()
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+
+        cursor.execute("DELETE FROM pseudonym_keys WHERE expires_at < ?",
+                       ((now - self.retention).isoformat(),))
+        if cursor.rowcount:
+            logger.info("Pruned pseudonymization keys past retention", count=cursor.rowcount)
+
+        cursor.execute("""
+            SELECT key_id, secret, created_at, expires_at FROM pseudonym_keys
+            WHERE created_at <= ? AND expires_at > ?
+            ORDER BY created_at DESC LIMIT 1
+        """, (now.isoformat(), now.isoformat()))
+        row = cursor.fetchone()
+        if row is None:
+            row = (secrets.token_hex(8), base64.b64encode(secrets.token_bytes(32)).decode(),
+                   now.isoformat(), (now + self.rotation).isoformat())
+            cursor.execute("""
+                INSERT INTO pseudonym_keys (key_id, secret, created_at, expires_at)
+                VALUES (?, ?, ?, ?)
+            """, row)
+            logger.info("Rotated pseudonymization key", key_id=row[0], expires_at=row[3])
+
+        conn.commit()
+        conn.close()
+        return {"key_id": row[0], "key": row[1], "created_at": row[2], "expires_at": row[3]}
+
+    async def export(self) -> Dict:
+        """Export the current key for headend consumption"""
+        key = await self.current_key()
+        return {"key_id": key["key_id"], "key": key["key"], "expires_at": key["expires_at"]}
+
+    async def unmask(self, key_id: str, pseudonym: str, candidates: Iterable[str],
+                     actor: str, reason: str) -> Optional[List[str]]:
+        """
+        Find the candidate identifiers that hash to pseudonym under the key
+        key_id, recording the attempt. Returns None if the key is unknown or
+        was pruned.
+        """
+        secret = await self._secret(key_id)
+        if secret is None:
+            return None
+
+        pseudonym = pseudonym.strip().lower()
+        matched = sorted({c for c in candidates
+                          if c and hmac.compare_digest(pseudonymize(secret, c), pseudonym)})
+
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("""
+            INSERT INTO pseudonym_unmaskings (key_id, pseudonym, matched, actor, reason, created_at)
+            VALUES (?, ?, ?, ?, ?, ?)
+        """, (key_id, pseudonym, ",".join(matched) or None, actor, reason, datetime.utcnow().isoformat()))
+        conn.commit()
+        conn.close()
+
+        logger.warning("Pseudonym unmasked", key_id=key_id, pseudonym=pseudonym,
+                       matched=len(matched), actor=actor, reason=reason)
+        return matched
+
+    async def list_unmaskings(self, limit: int = 100) -> List[Dict]:
+        """List the most recent unmaskings, newest first"""
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            cursor.execute("""
+                SELECT key_id, pseudonym, matched, actor, reason, created_at
+                FROM pseudonym_unmaskings ORDER BY id DESC LIMIT ?
+            """, (limit,))
+            records = [{
+                "key_id": row[0],
+                "pseudonym": row[1],
+                "matched": row[2].split(",") if row[2] else [],
+                "actor": row[3],
+                "reason": row[4],
+                "created_at": row[5]
+            } for row in cursor.fetchall()]
+            conn.close()
+            return records
+
+        except Exception as e:
+            logger.error("Failed to read pseudonym unmaskings", error=str(e))
+            return []
+
+    async def _secret(self, key_id: str) -> Optional[bytes]:
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("SELECT secret FROM pseudonym_keys WHERE key_id = ?", (key_id,))
+        row = cursor.fetchone()
+        conn.close()
+        return base64.b64decode(row[0]) if row else None
+
+
+# Global pseudonymization key manager instance
+pseudonym_key_manager = PseudonymKeyManager()
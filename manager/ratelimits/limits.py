@@ -0,0 +1,144 @@
+"""
+Per-user bandwidth limits for SASEWaddle headends
+
+Admins set a default limit and per-user overrides, in bytes per second with
+an optional burst. Headends fetch them from /api/v1/headend/rate-limits
+every 30-90 seconds and apply them to each user's token bucket in place, so
+a change reaches live connections without reconnecting. A rate of zero means
+unlimited.
+"""
+
+import hashlib
+import json
+import os
+import sqlite3
+from datetime import datetime
+from typing import Dict, List, Optional
+
+import structlog
+
+logger = structlog.get_logger()
+
+# Stored alongside the firewall rules by default
+DEFAULT_DB_PATH = "firewall.db"
+
+# The subject row holding the limit for users without one of their own
+DEFAULT_SUBJECT = "*"
+
+
+class RateLimitManager:
+    def __init__(self, db_path: Optional[str] = None):
+        self.db_path = db_path or os.getenv('RATE_LIMITS_DB', DEFAULT_DB_PATH)
+        self._init_database()
+
+    def _init_database(self):
+        """Initialize the rate limit table"""
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+
+        cursor.execute("""
+            CREATE TABLE IF NOT EXISTS rate_limits (
+                subject TEXT PRIMARY KEY,
+                bytes_per_second INTEGER NOT NULL,
+                burst_bytes INTEGER NOT NULL DEFAULT 0,
+                actor TEXT,
+                updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )
+        """)
+
+        conn.commit()
+        conn.close()
+
+    async def set_limit(self, user_id: Optional[str], bytes_per_second: int, burst_bytes: int = 0,
+                        actor: Optional[str] = None) -> Dict:
+        """
+        Set a user's limit, or the default limit when user_id is None.
+        Raises ValueError for invalid limits.
+        """
+        for field, value in (("bytes_per_second", bytes_per_second), ("burst_bytes", burst_bytes)):
+            if not isinstance(value, int) or isinstance(value, bool) or value < 0:
+                raise ValueError(f"{field} must be a non-negative integer")
+        if user_id is not None and (not user_id or user_id == DEFAULT_SUBJECT):
+            raise ValueError(f"invalid user ID: {user_id!r}")
+
+        subject = DEFAULT_SUBJECT if user_id is None else user_id
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("""
+            INSERT OR REPLACE INTO rate_limits (subject, bytes_per_second, burst_bytes, actor, updated_at)
+            VALUES (?, ?, ?, ?, ?)
+        """, (subject, bytes_per_second, burst_bytes, actor, datetime.utcnow().isoformat()))
+        conn.commit()
+        conn.close()
+
+        logger.info("Rate limit updated", user_id=user_id or "default", bytes_per_second=bytes_per_second,
+                    burst_bytes=burst_bytes, actor=actor)
+        return await self.get(user_id)
+
+    async def delete_limit(self, user_id: Optional[str], actor: Optional[str] = None) -> bool:
+        """Delete a user's limit, or the default limit when user_id is None"""
+        subject = DEFAULT_SUBJECT if user_id is None else user_id
+        conn = sqlite3.connect(self.db_path)
+        cursor = conn.cursor()
+        cursor.execute("DELETE FROM rate_limits WHERE subject = ?", (subject,))
+        deleted = cursor.rowcount > 0
+        conn.commit()
+        conn.close()
+
+        if deleted:
+            logger.info("Rate limit deleted", user_id=user_id or "default", actor=actor)
+        return deleted
+
+    async def get(self, user_id: Optional[str]) -> Optional[Dict]:
+        """Get a user's limit, or the default limit when user_id is None"""
+        subject = DEFAULT_SUBJECT if user_id is None else user_id
+        records = await self._select("WHERE subject = ?", (subject,))
+        return records[0] if records else None
+
+    async def list(self) -> List[Dict]:
+        """List the default limit, if set, and every user's limit"""
+        return await self._select("ORDER BY subject", ())
+
+    async def export(self) -> Dict:
+        """
+        Export the limits in the form headends fetch them. The version is a
+        digest of the limits, so it changes exactly when they do.
+        """
+        default = {"bytes_per_second": 0, "burst_bytes": 0}
+        users = {}
+        for record in await self.list():
+            limit = {"bytes_per_second": record['bytes_per_second'], "burst_bytes": record['burst_bytes']}
+            if record['user_id'] is None:
+                default = limit
+            else:
+                users[record['user_id']] = limit
+
+        limits = {"default": default, "users": users}
+        digest = hashlib.sha256(json.dumps(limits, sort_keys=True).encode()).hexdigest()
+        return {"version": digest[:12], **limits}
+
+    async def _select(self, clause: str, params: tuple) -> List[Dict]:
+        try:
+            conn = sqlite3.connect(self.db_path)
+            cursor = conn.cursor()
+            cursor.execute(f"""
+                SELECT subject, bytes_per_second, burst_bytes, actor, updated_at
+                FROM rate_limits {clause}
+            """, params)
+            records = [{
+                "user_id": None if row[0] == DEFAULT_SUBJECT else row[0],
+                "bytes_per_second": row[1],
+                "burst_bytes": row[2],
+                "actor": row[3],
+                "updated_at": row[4]
+            } for row in cursor.fetchall()]
+            conn.close()
+            return records
+
+        except Exception as e:
+            logger.error("Failed to read rate limits", error=str(e))
+            return []
+
+
+# Global rate limit manager instance
+rate_limit_manager = RateLimitManager()
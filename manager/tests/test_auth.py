@@ -1,6 +1,7 @@
 """
 Basic unit tests for Manager Service authentication components
 """
+import jwt
 import pytest
 import asyncio
 from unittest.mock import Mock, patch
@@ -91,6 +92,18 @@ class TestJWTManager:
         assert "refresh_token" in new_result
         assert new_result["access_token"] != result["access_token"]  # Should be different
     
+    @pytest.mark.asyncio
+    async def test_sign_bootstrap_list(self, jwt_manager):
+        """Test the signed backup headend list verifies with the public key"""
+        headends = [{"id": "cluster-1", "endpoint": "headend.example.com:51820", "public_key": "key"}]
+        
+        result = await jwt_manager.sign_bootstrap_list("test-client-4", headends)
+        
+        claims = jwt.decode(result["bootstrap_list"], jwt_manager.public_pem, algorithms=["RS256"])
+        assert claims["type"] == "bootstrap"
+        assert claims["sub"] == "test-client-4"
+        assert claims["headends"] == headends
+    
     def test_token_expiry_calculation(self, jwt_manager):
         """Test token expiry time calculation"""
         now = datetime.utcnow()
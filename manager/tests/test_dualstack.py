@@ -0,0 +1,63 @@
+"""
+Unit tests for dual-stack WireGuard addressing
+"""
+import ipaddress
+
+from manager.network.dualstack import dual_stack_allowed_ips, ipv6_address, wireguard_network6
+
+NETWORK = ipaddress.IPv4Network("10.200.0.0/16")
+NETWORK6 = ipaddress.IPv6Network("fd00:200::/64")
+
+
+class TestIPv6Address:
+    """Test pairing IPv6 addresses with IPv4 tunnel addresses"""
+
+    def test_same_offset(self):
+        assert ipv6_address("10.200.0.1", NETWORK, NETWORK6) == "fd00:200::1"
+        assert ipv6_address("10.200.1.2", NETWORK, NETWORK6) == "fd00:200::102"
+
+    def test_keeps_prefix_form(self):
+        assert ipv6_address("10.200.1.2/16", NETWORK, NETWORK6) == "fd00:200::102/64"
+
+    def test_outside_network(self):
+        assert ipv6_address("192.168.1.2", NETWORK, NETWORK6) is None
+        assert ipv6_address("not-an-ip", NETWORK, NETWORK6) is None
+
+    def test_network6_too_small(self):
+        small = ipaddress.IPv6Network("fd00:200::/120")
+        assert ipv6_address("10.200.0.255", NETWORK, small) == "fd00:200::ff"
+        assert ipv6_address("10.200.1.0", NETWORK, small) is None
+
+    def test_ipv4_only(self, monkeypatch):
+        monkeypatch.delenv("WIREGUARD_NETWORK6", raising=False)
+        assert wireguard_network6() is None
+        assert ipv6_address("10.200.1.2") is None
+
+    def test_from_environment(self, monkeypatch):
+        monkeypatch.setenv("WIREGUARD_NETWORK", "10.8.0.0/24")
+        monkeypatch.setenv("WIREGUARD_NETWORK6", "fd00:8::/112")
+        assert ipv6_address("10.8.0.9") == "fd00:8::9"
+
+    def test_invalid_network6_is_ignored(self, monkeypatch):
+        monkeypatch.setenv("WIREGUARD_NETWORK6", "10.0.0.0/8")
+        assert wireguard_network6() is None
+
+
+class TestDualStackAllowedIPs:
+    """Test adding IPv6 host routes to peers"""
+
+    def test_adds_host_routes(self):
+        assert dual_stack_allowed_ips(["10.200.1.2/32"], NETWORK, NETWORK6) == [
+            "10.200.1.2/32", "fd00:200::102/128"]
+
+    def test_accepts_comma_separated(self):
+        assert dual_stack_allowed_ips("10.200.1.2/32, 10.200.1.3/32", NETWORK, NETWORK6) == [
+            "10.200.1.2/32", "10.200.1.3/32", "fd00:200::102/128", "fd00:200::103/128"]
+
+    def test_leaves_other_routes(self):
+        routes = ["192.168.0.0/24", "10.200.0.0/16"]
+        assert dual_stack_allowed_ips(routes, NETWORK, NETWORK6) == routes
+
+    def test_ipv4_only(self, monkeypatch):
+        monkeypatch.delenv("WIREGUARD_NETWORK6", raising=False)
+        assert dual_stack_allowed_ips(["10.200.1.2/32"], NETWORK) == ["10.200.1.2/32"]
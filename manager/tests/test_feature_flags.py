@@ -0,0 +1,56 @@
+"""
+Unit tests for feature flag rules
+"""
+import pytest
+
+from manager.featureflags.flags import FeatureFlagManager
+
+
+class TestFeatureFlagManager:
+    """Test storing flag rules and exporting them for delivery"""
+
+    @pytest.fixture
+    def flags(self, tmp_path):
+        return FeatureFlagManager(db_path=str(tmp_path / "firewall.db"))
+
+    @pytest.mark.asyncio
+    async def test_export_omits_unset_targeting(self, flags):
+        await flags.set_flag("framing_v2", False, actor="admin")
+        await flags.set_flag("dns_proxy", True, percent=10, cohorts=["beta"])
+
+        payload = await flags.export()
+        assert payload["flags"] == {
+            "dns_proxy": {"enabled": True, "percent": 10, "cohorts": ["beta"]},
+            "framing_v2": {"enabled": False},
+        }
+        assert "subject" not in payload
+
+    @pytest.mark.asyncio
+    async def test_version_follows_the_rules(self, flags):
+        empty = (await flags.export())["version"]
+        await flags.set_flag("dns_proxy", True, percent=10)
+        ten = (await flags.export())["version"]
+        assert ten != empty
+
+        # Writing the same rule again keeps the version
+        await flags.set_flag("dns_proxy", True, percent=10)
+        assert (await flags.export())["version"] == ten
+
+        assert await flags.delete_flag("dns_proxy")
+        assert (await flags.export())["version"] == empty
+        assert not await flags.delete_flag("dns_proxy")
+
+    @pytest.mark.asyncio
+    async def test_invalid_rules_are_rejected(self, flags):
+        with pytest.raises(ValueError):
+            await flags.set_flag("Bad-Name", True)
+        with pytest.raises(ValueError):
+            await flags.set_flag("dns_proxy", True, percent=150)
+        with pytest.raises(ValueError):
+            await flags.set_flag("dns_proxy", True, tenants=[1, 2])
+        assert await flags.list() == []
+
+    @pytest.mark.asyncio
+    async def test_export_describes_the_recipient(self, flags):
+        payload = await flags.export(subject={"id": "client-1", "tenant": "acme", "cohorts": ["native"]})
+        assert payload["subject"]["tenant"] == "acme"
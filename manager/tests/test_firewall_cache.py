@@ -0,0 +1,62 @@
+"""
+Unit tests for announcing firewall rule changes to headends
+"""
+import pytest
+
+from manager.cache.redis_cache import RedisCache, FirewallRulesCache
+
+
+class FakePool:
+    """Records the Redis commands the cache sends"""
+
+    def __init__(self):
+        self.data = {}
+        self.published = []
+
+    async def delete(self, *keys):
+        return sum(self.data.pop(key, None) is not None for key in keys)
+
+    async def keys(self, pattern):
+        return [key for key in self.data if key.startswith(pattern.rstrip("*"))]
+
+    async def incr(self, key):
+        self.data[key] = int(self.data.get(key, 0)) + 1
+        return self.data[key]
+
+    async def publish(self, channel, message):
+        self.published.append((channel, message))
+        return 2
+
+
+class TestHeadendInvalidation:
+    """Test that rule cache invalidations retire the headends' shared responses"""
+
+    @pytest.fixture
+    def cache(self):
+        redis = RedisCache(redis_url="redis://localhost:6379/0")
+        redis.pool = FakePool()
+        redis.connected = True
+        return FirewallRulesCache(redis)
+
+    @pytest.mark.asyncio
+    async def test_invalidations_bump_generation(self, cache):
+        pool = cache.redis.pool
+        pool.data["firewall:all_rules"] = "{}"
+
+        await cache.invalidate_user("alice")
+        await cache.invalidate_all_rules()
+        await cache.invalidate_all()
+
+        assert "firewall:all_rules" not in pool.data
+        assert pool.data[FirewallRulesCache.HEADEND_GENERATION_KEY] == 3
+        assert pool.published == [
+            (FirewallRulesCache.HEADEND_INVALIDATION_CHANNEL, "1"),
+            (FirewallRulesCache.HEADEND_INVALIDATION_CHANNEL, "2"),
+            (FirewallRulesCache.HEADEND_INVALIDATION_CHANNEL, "3"),
+        ]
+
+    @pytest.mark.asyncio
+    async def test_redis_unavailable(self, cache):
+        cache.redis.connected = False
+        assert await cache.notify_headends() is None
+        assert cache.redis.pool.published == []
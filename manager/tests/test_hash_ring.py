@@ -0,0 +1,64 @@
+"""
+Unit tests for consistent hashing of clients onto headends
+"""
+import pytest
+
+from manager.orchestrator.hash_ring import HashRing
+
+
+class TestHashRing:
+    """Test client to headend assignment"""
+
+    @pytest.fixture
+    def clients(self):
+        return [f"client-{i}" for i in range(5000)]
+
+    def test_empty_ring(self):
+        ring = HashRing()
+        assert ring.get_node("client-1") is None
+        assert ring.get_nodes("client-1", 3) == []
+
+    def test_assignment_is_stable(self):
+        ring = HashRing({"headend-a": 1, "headend-b": 1, "headend-c": 1})
+        other = HashRing({"headend-c": 1, "headend-a": 1, "headend-b": 1})
+        for i in range(100):
+            assert ring.get_node(f"client-{i}") == other.get_node(f"client-{i}")
+
+    def test_even_distribution(self, clients):
+        ring = HashRing({f"headend-{i}": 1 for i in range(4)})
+        counts = ring.distribution(clients)
+        expected = len(clients) / 4
+        for node, count in counts.items():
+            assert abs(count - expected) < expected * 0.2, counts
+
+    def test_failover_moves_only_orphaned_clients(self, clients):
+        ring = HashRing({f"headend-{i}": 1 for i in range(4)})
+        before = {c: ring.get_node(c) for c in clients}
+
+        ring.remove_node("headend-0")
+        after = {c: ring.get_node(c) for c in clients}
+
+        for client in clients:
+            if before[client] != "headend-0":
+                assert after[client] == before[client]
+
+        # The orphaned clients spread over every survivor
+        orphans = [c for c in clients if before[c] == "headend-0"]
+        survivors = {after[c] for c in orphans}
+        assert survivors == {"headend-1", "headend-2", "headend-3"}
+
+    def test_preference_order_matches_failover(self):
+        ring = HashRing({"headend-a": 1, "headend-b": 1, "headend-c": 1})
+        preferred = ring.get_nodes("client-42", 3)
+        assert sorted(preferred) == ["headend-a", "headend-b", "headend-c"]
+
+        ring.remove_node(preferred[0])
+        assert ring.get_node("client-42") == preferred[1]
+
+    def test_weights(self, clients):
+        ring = HashRing({"small": 1, "large": 3})
+        counts = ring.distribution(clients)
+        assert counts["large"] > counts["small"] * 2
+
+        with pytest.raises(ValueError):
+            ring.add_node("broken", 0)
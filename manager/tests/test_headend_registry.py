@@ -0,0 +1,69 @@
+"""
+Unit tests for the headend registry
+"""
+from datetime import datetime, timedelta
+
+import pytest
+
+from manager.orchestrator.headend_registry import HeadendRegistry, STATUS_ONLINE, STATUS_STALE
+
+
+def advertisement(**overrides):
+    return {
+        "headend_id": "headend-1",
+        "cluster_id": "cluster-a",
+        "version": {"version": "1.4.0"},
+        "features": ["dns", "firewall"],
+        "listeners": [{"name": "tcp", "protocol": "tcp", "address": "vpn.example.com:8443"}],
+        "wireguard": {"public_key": "key-1", "endpoint": "vpn.example.com:51820"},
+        "heartbeat_interval_seconds": 30,
+        **overrides
+    }
+
+
+class TestHeadendRegistry:
+    """Test registration, heartbeats and staleness"""
+
+    @pytest.fixture
+    def registry(self, tmp_path):
+        return HeadendRegistry(db_path=str(tmp_path / "firewall.db"))
+
+    @pytest.mark.asyncio
+    async def test_register_and_heartbeat(self, registry):
+        now = datetime(2024, 3, 1, 12, 0)
+        await registry.register(advertisement(), now)
+
+        # Heartbeats replace the advertisement
+        assert await registry.heartbeat("headend-1", advertisement(features=["dns"]), now + timedelta(seconds=30))
+        headend = await registry.get_headend("headend-1", now + timedelta(seconds=40))
+        assert headend["features"] == ["dns"]
+        assert headend["wireguard"]["public_key"] == "key-1"
+        assert headend["status"] == STATUS_ONLINE
+        assert headend["registered_at"] == now.isoformat()
+
+    @pytest.mark.asyncio
+    async def test_unregistered_heartbeat(self, registry):
+        assert not await registry.heartbeat("headend-2", advertisement(headend_id="headend-2"))
+        assert await registry.get_headend("headend-2") is None
+
+    @pytest.mark.asyncio
+    async def test_stale_after_missed_heartbeats(self, registry):
+        now = datetime(2024, 3, 1, 12, 0)
+        await registry.register(advertisement(), now)
+        await registry.register(advertisement(headend_id="headend-2", cluster_id="cluster-b"), now)
+
+        headends = await registry.list_headends(now=now + timedelta(seconds=91))
+        assert [h["status"] for h in headends] == [STATUS_STALE, STATUS_STALE]
+
+        await registry.heartbeat("headend-1", advertisement(), now + timedelta(seconds=90))
+        headends = await registry.list_headends(now=now + timedelta(seconds=91))
+        assert [h["status"] for h in headends] == [STATUS_ONLINE, STATUS_STALE]
+
+        assert [h["headend_id"] for h in await registry.list_headends("cluster-b")] == ["headend-2"]
+
+    @pytest.mark.asyncio
+    async def test_remove(self, registry):
+        await registry.register(advertisement())
+        assert await registry.remove("headend-1")
+        assert not await registry.remove("headend-1")
+        assert await registry.list_headends() == []
@@ -0,0 +1,59 @@
+"""
+Unit tests for headend port listener status reports
+"""
+import pytest
+
+from manager.network.port_manager import PortConfigManager
+
+
+class TestListenerStatus:
+    """Test storing the ports each headend could bind"""
+
+    @pytest.fixture
+    def manager(self, tmp_path):
+        return PortConfigManager(db_path=str(tmp_path / "ports.db"))
+
+    @pytest.mark.asyncio
+    async def test_report_replaces_previous(self, manager):
+        await manager.save_listener_status("headend-1", [
+            {"port": 8001, "protocol": "tcp", "state": "conflict",
+             "error": "address already in use", "last_attempt": "2026-10-16T12:00:00Z"},
+            {"port": 8000, "protocol": "tcp", "state": "listening", "last_attempt": "2026-10-16T12:00:00Z"},
+            {"port": 8000, "protocol": "udp", "state": "listening", "last_attempt": "2026-10-16T12:00:00Z"},
+        ])
+        await manager.save_listener_status("headend-2", [
+            {"port": 9000, "protocol": "tcp", "state": "failed", "error": "permission denied"},
+        ])
+
+        status = await manager.get_listener_status("headend-1")
+        assert [(s["port"], s["protocol"], s["state"]) for s in status] == [
+            (8000, "tcp", "listening"), (8000, "udp", "listening"), (8001, "tcp", "conflict"),
+        ]
+        assert status[2]["error"] == "address already in use"
+        assert status[0]["error"] is None
+        assert status[0]["reported_at"]
+
+        # The next report replaces the headend's listeners
+        count = await manager.save_listener_status("headend-1", [
+            {"port": 8001, "protocol": "tcp", "state": "listening"},
+        ])
+        assert count == 1
+        assert [s["port"] for s in await manager.get_listener_status("headend-1")] == [8001]
+        assert len(await manager.get_listener_status("headend-2")) == 1
+
+    @pytest.mark.asyncio
+    async def test_invalid_report(self, manager):
+        await manager.save_listener_status("headend-1", [
+            {"port": 8000, "protocol": "tcp", "state": "listening"},
+        ])
+        for listener in (
+            {"port": 0, "protocol": "tcp", "state": "listening"},
+            {"port": "8000", "protocol": "tcp", "state": "listening"},
+            {"port": 8000, "protocol": "sctp", "state": "listening"},
+            {"port": 8000, "protocol": "tcp", "state": "bound"},
+        ):
+            with pytest.raises(ValueError):
+                await manager.save_listener_status("headend-1", [listener])
+
+        # A rejected report leaves the previous one in place
+        assert len(await manager.get_listener_status("headend-1")) == 1
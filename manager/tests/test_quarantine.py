@@ -0,0 +1,73 @@
+"""
+Unit tests for the quarantine network profile
+"""
+import pytest
+
+from manager.firewall.access_control import AccessControlManager
+from manager.firewall.quarantine import QuarantineManager, QuarantineSource, QUARANTINE_SUBJECT
+
+
+class TestQuarantineManager:
+    """Test quarantining and releasing users"""
+
+    @pytest.fixture
+    def access_control(self, tmp_path):
+        return AccessControlManager(db_path=str(tmp_path / "firewall.db"))
+
+    @pytest.fixture
+    def quarantine(self, access_control):
+        return QuarantineManager(access_control, network="10.200.255.0/29")
+
+    @pytest.mark.asyncio
+    async def test_quarantine_allocates_address(self, quarantine):
+        alice = await quarantine.quarantine("alice", "manual", QuarantineSource.ADMIN, actor="admin")
+        bob = await quarantine.quarantine("bob", "manual", QuarantineSource.ADMIN)
+
+        assert alice["address"] == "10.200.255.1"
+        assert bob["address"] == "10.200.255.2"
+
+        # Quarantining again keeps the address
+        again = await quarantine.quarantine("alice", "still bad", QuarantineSource.ANOMALY)
+        assert again["address"] == alice["address"]
+        assert again["reason"] == "still bad"
+
+        # Released addresses are reused
+        assert await quarantine.release("alice", actor="admin")
+        carol = await quarantine.quarantine("carol", "manual", QuarantineSource.ADMIN)
+        assert carol["address"] == "10.200.255.1"
+
+    @pytest.mark.asyncio
+    async def test_release_unknown_user(self, quarantine):
+        assert not await quarantine.release("nobody")
+
+    @pytest.mark.asyncio
+    async def test_posture_quarantine_heals_itself(self, quarantine):
+        record = await quarantine.evaluate_posture("alice", {"compliant": False, "failures": ["disk_encryption"]})
+        assert record["source"] == QuarantineSource.POSTURE.value
+        assert "disk_encryption" in record["reason"]
+
+        await quarantine.evaluate_posture("alice", {"compliant": True})
+        assert await quarantine.get("alice") is None
+
+    @pytest.mark.asyncio
+    async def test_passing_posture_keeps_admin_quarantine(self, quarantine):
+        await quarantine.quarantine("alice", "manual", QuarantineSource.ADMIN)
+        await quarantine.evaluate_posture("alice", {"compliant": True})
+        assert await quarantine.get("alice") is not None
+
+    @pytest.mark.asyncio
+    async def test_changes_advance_the_sync_cursor(self, access_control, quarantine):
+        before = await access_control.get_change_cursor()
+        await quarantine.quarantine("alice", "manual", QuarantineSource.ADMIN)
+        changed = await access_control.get_changed_users(before)
+        assert changed == [QUARANTINE_SUBJECT]
+
+    @pytest.mark.asyncio
+    async def test_export(self, quarantine):
+        await quarantine.quarantine("alice", "manual", QuarantineSource.ADMIN)
+        export = await quarantine.export()
+
+        assert "user_id" not in export["rules"]
+        assert "allow_domains" in export["rules"]["rules"]
+        assert export["users"]["alice"]["address"] == "10.200.255.1"
+        assert export["users"]["alice"]["message"]
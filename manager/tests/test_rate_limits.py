@@ -0,0 +1,67 @@
+"""
+Unit tests for per-user bandwidth limits
+"""
+import pytest
+
+from manager.ratelimits.limits import RateLimitManager
+
+
+class TestRateLimitManager:
+    """Test storing limits and exporting them for headends"""
+
+    @pytest.fixture
+    def limits(self, tmp_path):
+        return RateLimitManager(db_path=str(tmp_path / "firewall.db"))
+
+    @pytest.mark.asyncio
+    async def test_export_matches_the_headend_format(self, limits):
+        payload = await limits.export()
+        assert payload["default"] == {"bytes_per_second": 0, "burst_bytes": 0}
+        assert payload["users"] == {}
+
+        await limits.set_limit(None, 1_000_000, actor="admin")
+        await limits.set_limit("alice", 250_000, burst_bytes=500_000)
+        await limits.set_limit("bob", 0)
+
+        payload = await limits.export()
+        assert payload["default"] == {"bytes_per_second": 1_000_000, "burst_bytes": 0}
+        assert payload["users"] == {
+            "alice": {"bytes_per_second": 250_000, "burst_bytes": 500_000},
+            "bob": {"bytes_per_second": 0, "burst_bytes": 0},
+        }
+
+    @pytest.mark.asyncio
+    async def test_version_follows_the_limits(self, limits):
+        empty = (await limits.export())["version"]
+        await limits.set_limit("alice", 1000)
+        limited = (await limits.export())["version"]
+        assert limited != empty
+
+        # Writing the same limit again keeps the version
+        await limits.set_limit("alice", 1000)
+        assert (await limits.export())["version"] == limited
+
+        assert await limits.delete_limit("alice")
+        assert (await limits.export())["version"] == empty
+        assert not await limits.delete_limit("alice")
+
+    @pytest.mark.asyncio
+    async def test_default_is_kept_apart_from_users(self, limits):
+        await limits.set_limit(None, 1000)
+        assert (await limits.get(None))["bytes_per_second"] == 1000
+        assert await limits.get("alice") is None
+
+        assert await limits.delete_limit(None)
+        assert (await limits.export())["default"]["bytes_per_second"] == 0
+
+    @pytest.mark.asyncio
+    async def test_invalid_limits_are_rejected(self, limits):
+        with pytest.raises(ValueError):
+            await limits.set_limit("alice", -1)
+        with pytest.raises(ValueError):
+            await limits.set_limit("alice", 1000, burst_bytes="lots")
+        with pytest.raises(ValueError):
+            await limits.set_limit("alice", True)
+        with pytest.raises(ValueError):
+            await limits.set_limit("*", 1000)
+        assert await limits.list() == []
@@ -14,7 +14,11 @@ from web.auth import (
     user_manager
 )
 from auth.user_manager import UserRole
-from firewall.access_control import access_control_manager, AccessRule, AccessType, RuleType
+from firewall.access_control import access_control_manager, AccessRule, AccessType, RuleType, GROUP_SUBJECT_PREFIX
+from firewall.quarantine import quarantine_manager, QUARANTINE_SUBJECT
+from privacy.pseudonym import pseudonym_key_manager
+from ratelimits.limits import rate_limit_manager
+from orchestrator.headend_registry import headend_registry
 from network.vrf_manager import vrf_manager, VRFConfiguration, VRFStatus, OSPFArea, OSPFAreaType
 from network.port_manager import port_config_manager, PortRange, PortProtocol
 from cache.redis_cache import get_cache, get_firewall_cache
@@ -941,6 +945,68 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
                 response.status = 401
                 return {"error": "Invalid headend token"}
             
+            # Overrides each headend's configured policy mode when set:
+            # enforce, permissive or disabled
+            policy_mode = os.getenv('FIREWALL_POLICY_MODE', '')
+            
+            # Logical upstream targets the headends balance over their
+            # backends, as JSON: {"app.internal": ["10.0.0.1", "10.0.0.2:8080"]}
+            upstreams = {}
+            try:
+                upstreams = json.loads(os.getenv('FIREWALL_UPSTREAMS', '') or '{}')
+            except ValueError:
+                logger.warning("Ignoring invalid FIREWALL_UPSTREAMS")
+            
+            # Headends that already hold a rule set only need the users
+            # whose rules changed since their cursor
+            since = request.query.get('cursor')
+            if since:
+                try:
+                    changed = await access_control_manager.get_changed_users(int(since))
+                except ValueError:
+                    changed = None
+                
+                if changed is not None:
+                    change_cursor = await access_control_manager.get_change_cursor()
+                    rule_groups = set(await access_control_manager.get_rule_groups())
+                    delta_rules = {}
+                    removed_users = []
+                    delta_groups = {}
+                    removed_groups = []
+                    for user_id in changed:
+                        # The quarantine profile is sent whole with every response
+                        if user_id == QUARANTINE_SUBJECT:
+                            continue
+                        if user_id.startswith(GROUP_SUBJECT_PREFIX):
+                            group = user_id[len(GROUP_SUBJECT_PREFIX):]
+                            if group in rule_groups:
+                                delta_groups[group] = await access_control_manager.export_group_rules(group)
+                            else:
+                                removed_groups.append(group)
+                            continue
+                        
+                        user = await user_manager.get_user(user_id)
+                        if user and user.is_active:
+                            delta_rules[user_id] = await access_control_manager.export_user_rules(user_id)
+                        else:
+                            removed_users.append(user_id)
+                    
+                    return {
+                        "timestamp": datetime.utcnow().isoformat(),
+                        "cursor": str(change_cursor),
+                        "delta": True,
+                        "rules_count": len(delta_rules),
+                        "user_rules": delta_rules,
+                        "removed_users": removed_users,
+                        "group_rules": delta_groups,
+                        "removed_groups": removed_groups,
+                        "quarantine": await quarantine_manager.export(),
+                        "policy_mode": policy_mode,
+                        "upstreams": upstreams
+                    }
+                
+                logger.info("Firewall rules cursor can't be served as a delta, sending full rule set", cursor=since)
+            
             # Try to get cached rules first
             firewall_cache = await get_firewall_cache()
             cached_rules = await firewall_cache.get_all_rules()
@@ -949,6 +1015,10 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
                 logger.debug("Serving firewall rules from cache")
                 return cached_rules
             
+            # Read the cursor first so changes made during the export are
+            # sent again in the next delta
+            change_cursor = await access_control_manager.get_change_cursor()
+            
             # Get all active users and their firewall rules
             users = await user_manager.list_users()
             all_rules = {}
@@ -958,10 +1028,20 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
                     user_rules = await access_control_manager.export_user_rules(user.id)
                     all_rules[user.id] = user_rules
             
+            # Group rule sets, merged with each member's rules by the headend
+            group_rules = {}
+            for group in await access_control_manager.get_rule_groups():
+                group_rules[group] = await access_control_manager.export_group_rules(group)
+            
             rules_response = {
                 "timestamp": datetime.utcnow().isoformat(),
+                "cursor": str(change_cursor),
                 "rules_count": len(all_rules),
-                "user_rules": all_rules
+                "user_rules": all_rules,
+                "group_rules": group_rules,
+                "quarantine": await quarantine_manager.export(),
+                "policy_mode": policy_mode,
+                "upstreams": upstreams
             }
             
             # Cache the response for fast headend retrieval (3 minute TTL)
@@ -1021,6 +1101,56 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
             response.status = 500
             return {"error": "Failed to get user firewall rules"}
     
+    @action("api/v1/headend/log-pseudonym-key", method=["GET"])
+    @action.uses("json")
+    async def get_log_pseudonym_key():
+        """Get the key headends hash user identifiers in exported logs with (headend-to-manager API)"""
+        try:
+            # Authenticate headend server
+            auth_header = request.headers.get('Authorization', '')
+            if not auth_header.startswith('Bearer '):
+                response.status = 401
+                return {"error": "Bearer token required"}
+            
+            token = auth_header[7:]
+            headend_token = os.getenv('HEADEND_API_TOKEN', 'headend-server-token')
+            
+            if token != headend_token:
+                response.status = 401
+                return {"error": "Invalid headend token"}
+            
+            return await pseudonym_key_manager.export()
+            
+        except Exception as e:
+            logger.error("Get log pseudonym key error", error=str(e))
+            response.status = 500
+            return {"error": "Failed to get log pseudonym key"}
+    
+    @action("api/v1/headend/rate-limits", method=["GET"])
+    @action.uses("json")
+    async def get_headend_rate_limits():
+        """Get the per-user bandwidth limits headends enforce (headend-to-manager API)"""
+        try:
+            # Authenticate headend server
+            auth_header = request.headers.get('Authorization', '')
+            if not auth_header.startswith('Bearer '):
+                response.status = 401
+                return {"error": "Bearer token required"}
+            
+            token = auth_header[7:]
+            headend_token = os.getenv('HEADEND_API_TOKEN', 'headend-server-token')
+            
+            if token != headend_token:
+                response.status = 401
+                return {"error": "Invalid headend token"}
+            
+            return await rate_limit_manager.export()
+            
+        except Exception as e:
+            logger.error("Get rate limits error", error=str(e))
+            response.status = 500
+            return {"error": "Failed to get rate limits"}
+    
     # Headend port configuration endpoints
     @action("api/v1/headend/<headend_id>/ports", method=["GET"])
     @action.uses("json")
@@ -1067,6 +1197,168 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
             logger.error("Get headend port config error", headend_id=headend_id, error=str(e))
             response.status = 500
             return {"error": "Failed to get port configuration"}
+
+    # Session migration tickets, shared by the headends of a cluster
+    MIGRATION_KEY_PREFIX = "sasewaddle:migration:"
+    MIGRATION_MAX_TTL = 3600
+
+    def _headend_authorized():
+        auth_header = request.headers.get('Authorization', '')
+        headend_token = os.getenv('HEADEND_API_TOKEN', 'headend-server-token')
+        return auth_header.startswith('Bearer ') and auth_header[7:] == headend_token
+
+    @action("api/v1/headend/migrations/<ticket>", method=["PUT"])
+    @action.uses("json")
+    async def put_migration_ticket(ticket):
+        """Store a migration ticket issued by a draining headend (headend-to-manager API)"""
+        try:
+            if not _headend_authorized():
+                response.status = 401
+                return {"error": "Invalid headend token"}
+
+            data = request.json or {}
+            state = data.get('state')
+            if not isinstance(state, dict) or not state.get('user_id'):
+                response.status = 400
+                return {"error": "Ticket state with user_id required"}
+
+            ttl = min(max(int(data.get('ttl_seconds', 300)), 1), MIGRATION_MAX_TTL)
+            cache = await get_cache()
+            if not await cache.set(MIGRATION_KEY_PREFIX + ticket, state, ttl):
+                response.status = 503
+                return {"error": "Migration store unavailable"}
+
+            return {"success": True, "ttl_seconds": ttl}
+
+        except Exception as e:
+            logger.error("Store migration ticket error", error=str(e))
+            response.status = 500
+            return {"error": "Failed to store migration ticket"}
+
+    @action("api/v1/headend/migrations/<ticket>/redeem", method=["POST"])
+    @action.uses("json")
+    async def redeem_migration_ticket(ticket):
+        """Return and delete a migration ticket for the headend a client moved to (headend-to-manager API)"""
+        try:
+            if not _headend_authorized():
+                response.status = 401
+                return {"error": "Invalid headend token"}
+
+            cache = await get_cache()
+            key = MIGRATION_KEY_PREFIX + ticket
+            state = await cache.get(key)
+
+            # Only the headend whose delete succeeds gets the ticket
+            if state is None or not await cache.delete(key):
+                response.status = 404
+                return {"error": "Migration ticket not found"}
+
+            return {"state": state}
+
+        except Exception as e:
+            logger.error("Redeem migration ticket error", error=str(e))
+            response.status = 500
+            return {"error": "Failed to redeem migration ticket"}
+
+    @action("api/v1/headend/mesh/peers", method=["GET"])
+    @action.uses("json")
+    async def get_mesh_peers():
+        """List the headends of other clusters that sessions can fail over to (headend-to-manager API)"""
+        try:
+            if not _headend_authorized():
+                response.status = 401
+                return {"error": "Invalid headend token"}
+
+            cluster_id = request.query.get('cluster_id', '')
+            clusters = await cluster_manager.get_all_clusters() if cluster_manager else []
+            peers = [
+                {
+                    "id": cluster.id,
+                    "url": cluster.headend_url,
+                    "region": cluster.region,
+                }
+                for cluster in sorted(clusters, key=lambda c: c.id)
+                if cluster.status == 'active' and cluster.id != cluster_id and cluster.headend_url
+            ]
+            return {"peers": peers}
+
+        except Exception as e:
+            logger.error("Get mesh peers error", error=str(e))
+            response.status = 500
+            return {"error": "Failed to get mesh peers"}
+
+    @action("api/v1/headend/register", method=["POST"])
+    @action.uses("json")
+    async def register_headend():
+        """Record a starting headend's advertisement (headend-to-manager API)"""
+        try:
+            if not _headend_authorized():
+                response.status = 401
+                return {"error": "Invalid headend token"}
+
+            data = request.json or {}
+            if not data.get('headend_id'):
+                response.status = 400
+                return {"error": "Advertisement with headend_id required"}
+
+            headend = await headend_registry.register(data)
+            return {"status": "registered", "registered_at": headend["registered_at"]}
+
+        except Exception as e:
+            logger.error("Register headend error", error=str(e))
+            response.status = 500
+            return {"error": "Failed to register headend"}
+
+    @action("api/v1/headend/<headend_id>/heartbeat", method=["POST"])
+    @action.uses("json")
+    async def headend_heartbeat(headend_id):
+        """Record a headend's heartbeat and current advertisement (headend-to-manager API)"""
+        try:
+            if not _headend_authorized():
+                response.status = 401
+                return {"error": "Invalid headend token"}
+
+            data = request.json or {}
+            data['headend_id'] = headend_id
+
+            # Headends the Manager doesn't know, e.g. after its database was
+            # reset, register again on a 404
+            if not await headend_registry.heartbeat(headend_id, data):
+                response.status = 404
+                return {"error": "Headend not registered"}
+
+            return {"status": "ok"}
+
+        except Exception as e:
+            logger.error("Headend heartbeat error", headend_id=headend_id, error=str(e))
+            response.status = 500
+            return {"error": "Failed to record heartbeat"}
+    
+    @action("api/v1/headend/<headend_id>/ports/status", method=["POST"])
+    @action.uses("json")
+    async def report_headend_port_status(headend_id):
+        """Record which of its configured ports a headend could bind (headend-to-manager API)"""
+        try:
+            if not _headend_authorized():
+                response.status = 401
+                return {"error": "Invalid headend token"}
+            
+            data = request.json or {}
+            listeners = data.get('listeners')
+            if not isinstance(listeners, list):
+                response.status = 400
+                return {"error": "Listener list required"}
+            
+            count = await port_config_manager.save_listener_status(headend_id, listeners)
+            return {"success": True, "listeners": count}
+            
+        except ValueError as e:
+            response.status = 400
+            return {"error": f"Invalid listener status: {str(e)}"}
+        except Exception as e:
+            logger.error("Report headend port status error", headend_id=headend_id, error=str(e))
+            response.status = 500
+            return {"error": "Failed to record port status"}
     
     @action("api/v1/ports/all", method=["GET"])
     @action.uses("json")
@@ -1123,6 +1415,7 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
                 return {"error": "Admin access required"}
             
             config = await port_config_manager.get_headend_config(headend_id)
+            listener_status = await port_config_manager.get_listener_status(headend_id)
             
             if not config:
                 return {
@@ -1131,6 +1424,7 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
                     "udp_ranges": "5000-5100",
                     "tcp_ranges_detail": [],
                     "udp_ranges_detail": [],
+                    "listener_status": listener_status,
                 }
             
             return {
@@ -1141,6 +1435,7 @@ def setup_web_routes(app, cluster_manager, client_registry, cert_manager, jwt_ma
                 "tcp_ranges_detail": [pr.to_dict() for pr in config.tcp_ranges],
                 "udp_ranges_detail": [pr.to_dict() for pr in config.udp_ranges],
                 "updated_at": config.updated_at.isoformat() if config.updated_at else None,
+                "listener_status": listener_status,
             }
         except Exception as e:
             logger.error("Web get headend ports error", error=str(e))